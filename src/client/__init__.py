@@ -11,6 +11,7 @@ Schemas are organized in the `schemas` subpackage by category:
     - message: Chat message operations
 """
 
+from .errors import NodeError
 from .service import ClientService
 from .message_buffer import MessageBuffer
 from .chat_client import ChatClient
@@ -34,6 +35,7 @@ from .schemas import (
     SendMessageRequest,
     MessageSentConfirmation,
     NewMessageNotification,
+    MessageStatusNotification,
     MessageErrorResponse,
 )
 
@@ -42,6 +44,7 @@ __all__ = [
     "ClientService",
     "MessageBuffer",
     "ChatClient",
+    "NodeError",
     # Base schema classes
     "BaseRequest",
     "BaseResponse",
@@ -61,5 +64,6 @@ __all__ = [
     "SendMessageRequest",
     "MessageSentConfirmation",
     "NewMessageNotification",
+    "MessageStatusNotification",
     "MessageErrorResponse",
 ]
@@ -48,6 +48,10 @@ class ChatClient(ClientService):
         on_ordering_gap_detected: Callback when gap is detected
         on_duplicate_message: Callback when duplicate is detected
         on_member_joined: Callback when a member joins
+        on_message_status: Callback when a sent message is acknowledged
+            or delivered
+        send_receipts: Whether to confirm receipt of other users'
+            messages to their senders
     """
 
     def __init__(
@@ -68,6 +72,7 @@ class ChatClient(ClientService):
         self.message_buffers: Dict[str, MessageBuffer] = {}
         self.username: Optional[str] = None
         self.current_room: Optional[str] = None
+        self.send_receipts = False
 
         # Callbacks for UI integration
         self._on_message_ready: Optional[Callable[[Dict[str, Any]], None]] = (
@@ -90,6 +95,39 @@ class ChatClient(ClientService):
             None
         )
         self._on_room_deleted: Optional[Callable[[Dict[str, Any]], None]] = None
+        self._on_room_archived: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_removed_from_room: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_member_role_changed: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_message_status: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_message_edited: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_message_reaction: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_thread_updated: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_mention: Optional[Callable[[Dict[str, Any]], None]] = None
+        self._on_typing: Optional[Callable[[Dict[str, Any]], None]] = None
+        self._on_read_position_updated: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_profile_updated: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
+        self._on_room_status: Optional[Callable[[Dict[str, Any]], None]] = None
+        self._on_key_published: Optional[
+            Callable[[Dict[str, Any]], None]
+        ] = None
 
         logger.info("ChatClient initialized for node: %s", node_url)
 
@@ -128,6 +166,22 @@ class ChatClient(ClientService):
             logger.info("Left room: %s", self.current_room)
             self.current_room = None
 
+    def last_seen_sequences(self) -> Dict[str, int]:
+        """
+        Get the highest sequence number displayed in each room.
+
+        Pass the result to resume_session() after reconnecting; it is
+        also reported in the answer to each ping, so the node sends
+        missed messages again.
+
+        Returns:
+            dict: Maps room_id -> last displayed sequence number
+        """
+        return {
+            room_id: buffer.last_displayed_seq
+            for room_id, buffer in self.message_buffers.items()
+        }
+
     def set_on_message_ready(
         self, callback: Callable[[Dict[str, Any]], None]
     ) -> None:
@@ -225,6 +279,160 @@ class ChatClient(ClientService):
         """
         self._on_room_deleted = callback
 
+    def set_on_room_archived(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for when a room is archived (notification to members).
+
+        Args:
+            callback: Function that receives the room_archived data dict
+        """
+        self._on_room_archived = callback
+
+    def set_on_removed_from_room(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for when this user is kicked or banned from a room.
+
+        Args:
+            callback: Function that receives the removed_from_room data dict
+        """
+        self._on_removed_from_room = callback
+
+    def set_on_member_role_changed(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for a member being promoted or demoted.
+
+        Args:
+            callback: Function that receives the member_role_changed data
+        """
+        self._on_member_role_changed = callback
+
+    def set_on_message_status(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for status updates of sent messages.
+
+        Args:
+            callback: Function that receives the message_status data dict
+        """
+        self._on_message_status = callback
+
+    def set_on_message_edited(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for a message being edited or deleted.
+
+        Args:
+            callback: Function that receives the message_edited or
+                message_deleted data dict (its action says which)
+        """
+        self._on_message_edited = callback
+
+    def set_on_message_reaction(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for reactions to messages being added or removed.
+
+        Args:
+            callback: Function that receives the message_reaction data dict
+        """
+        self._on_message_reaction = callback
+
+    def set_on_thread_updated(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for a thread getting a new reply.
+
+        Args:
+            callback: Function that receives the thread_updated data dict
+                (thread_id, reply_count, last_reply_at)
+        """
+        self._on_thread_updated = callback
+
+    def set_on_mention(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for a message mentioning the user.
+
+        Mentions arrive also from muted rooms, next to the new_message.
+
+        Args:
+            callback: Function that receives the mention data dict
+                (room_id, message_id, sender, content, mentions)
+        """
+        self._on_mention = callback
+
+    def set_on_typing(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for room members starting or stopping typing.
+
+        Args:
+            callback: Function that receives the typing data dict; the
+                indicator should be hidden after its expires_in seconds
+        """
+        self._on_typing = callback
+
+    def set_on_read_position_updated(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for room members reading messages.
+
+        Args:
+            callback: Function that receives the read_position_updated
+                data dict (username and sequence_number)
+        """
+        self._on_read_position_updated = callback
+
+    def set_on_profile_updated(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for members of the user's rooms changing profile.
+
+        Args:
+            callback: Function that receives the profile_updated data dict
+                (username, display_name, avatar_url, avatar_hash and bio)
+        """
+        self._on_profile_updated = callback
+
+    def set_on_key_published(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for members of a private room publishing keys.
+
+        Args:
+            callback: Function that receives the key_published data dict
+                (room_id, username, key_id, algorithm and public_key)
+        """
+        self._on_key_published = callback
+
+    def set_on_room_status(
+        self, callback: Callable[[Dict[str, Any]], None]
+    ) -> None:
+        """
+        Register callback for rooms becoming degraded or healthy again.
+
+        Args:
+            callback: Function that receives the room_status data dict
+                (room_id, status, and for degraded rooms mode, admin_node,
+                reason and buffered)
+        """
+        self._on_room_status = callback
+
     async def receive_messages(self) -> None:
         """
         Continuously receive and process messages from the server.
@@ -273,6 +481,13 @@ class ChatClient(ClientService):
         elif message_type == "message_sent":
             # Message confirmation - just log it
             logger.debug("Message sent confirmation received")
+        elif message_type == "ping":
+            await self.send_pong(self.last_seen_sequences())
+        elif message_type == "session_started":
+            self._handle_session_started(data.get("data", {}))
+        elif message_type == "message_status":
+            if self._on_message_status:
+                self._on_message_status(data.get("data", {}))
         elif message_type == "message_error":
             # Message error - log it and notify
             error_data = data.get("data", {})
@@ -286,6 +501,65 @@ class ChatClient(ClientService):
             await self._handle_delete_failed(data.get("data", {}))
         elif message_type == "room_deleted":
             await self._handle_room_deleted(data.get("data", {}))
+        elif message_type == "room_archived":
+            await self._handle_room_archived(data.get("data", {}))
+        elif message_type == "removed_from_room":
+            await self._handle_removed_from_room(data.get("data", {}))
+        elif message_type == "slow_consumer":
+            # The node's send queue for this client is filling up
+            logger.warning(
+                "Falling behind: %s messages queued by the server",
+                data.get("data", {}).get("queue_depth"),
+            )
+        elif message_type in ("message_edited", "message_deleted"):
+            if self._on_message_edited:
+                self._on_message_edited(data.get("data", {}))
+        elif message_type == "message_reaction":
+            if self._on_message_reaction:
+                self._on_message_reaction(data.get("data", {}))
+        elif message_type == "thread_updated":
+            if self._on_thread_updated:
+                self._on_thread_updated(data.get("data", {}))
+        elif message_type == "mention":
+            if self._on_mention:
+                self._on_mention(data.get("data", {}))
+        elif message_type == "typing":
+            if self._on_typing:
+                self._on_typing(data.get("data", {}))
+        elif message_type == "read_position_updated":
+            if self._on_read_position_updated:
+                self._on_read_position_updated(data.get("data", {}))
+        elif message_type == "profile_updated":
+            if self._on_profile_updated:
+                self._on_profile_updated(data.get("data", {}))
+        elif message_type == "room_status":
+            status = data.get("data", {})
+            if status.get("status") == "degraded":
+                logger.warning(
+                    "Room %s is degraded (%s): %s",
+                    status.get("room_id"),
+                    status.get("mode"),
+                    status.get("reason"),
+                )
+            if self._on_room_status:
+                self._on_room_status(status)
+        elif message_type == "key_published":
+            if self._on_key_published:
+                self._on_key_published(data.get("data", {}))
+        elif message_type == "waitlist_joined":
+            logger.info(
+                "On the waiting list of room %s at position %s",
+                data.get("data", {}).get("room_id"),
+                data.get("data", {}).get("position"),
+            )
+        elif message_type == "waitlist_admitted":
+            logger.info(
+                "Admitted from the waiting list to room %s",
+                data.get("data", {}).get("room_id"),
+            )
+        elif message_type == "member_role_changed":
+            if self._on_member_role_changed:
+                self._on_member_role_changed(data.get("data", {}))
         else:
             # Pass through to the original message handler if registered
             if self._message_handler:
@@ -340,6 +614,13 @@ class ChatClient(ClientService):
                 self._on_duplicate_message(message_id)
             return
 
+        # Confirm receipt to the sender
+        sender = message_data.get("username")
+        if self.send_receipts and self.username and sender != self.username:
+            await self.send_receipt(
+                room_id, message_data.get("message_id"), self.username
+            )
+
         # Get messages ready to display
         displayable = buffer.get_new_messages()
 
@@ -498,6 +779,61 @@ class ChatClient(ClientService):
         if self._on_room_deleted:
             self._on_room_deleted(delete_data)
 
+    async def _handle_room_archived(
+        self, archive_data: Dict[str, Any]
+    ) -> None:
+        """
+        Handle room_archived notification (for members of an archived room).
+
+        The room is read-only now, so it stops being the current room, but
+        its buffered messages are kept.
+
+        Args:
+            archive_data: Dict with room_id, room_name, archived_by and
+                message
+        """
+        room_id = archive_data.get("room_id")
+        logger.info(
+            "Room '%s' (ID: %s) has been archived",
+            archive_data.get("room_name", "Unknown"),
+            room_id,
+        )
+        if self.current_room == room_id:
+            self.current_room = None
+
+        if self._on_room_archived:
+            self._on_room_archived(archive_data)
+
+    async def _handle_removed_from_room(
+        self, removal_data: Dict[str, Any]
+    ) -> None:
+        """
+        Handle removed_from_room notification (this user was kicked or banned).
+
+        Args:
+            removal_data: Removal info dictionary containing:
+                - room_id
+                - action ("kick" or "ban")
+                - moderator
+        """
+        room_id = removal_data.get("room_id")
+        logger.info(
+            "Removed from room %s (%s by %s)",
+            room_id,
+            removal_data.get("action"),
+            removal_data.get("moderator"),
+        )
+
+        if room_id in self.message_buffers:
+            self.message_buffers[room_id].clear()
+            del self.message_buffers[room_id]
+
+        if self.current_room == room_id:
+            self.current_room = None
+
+        if self._on_removed_from_room:
+            self._on_removed_from_room(removal_data)
+
     def get_buffer_for_room(self, room_id: str) -> Optional[MessageBuffer]:
         """
         Get the message buffer for a specific room.
@@ -0,0 +1,366 @@
+#!/usr/bin/env python3
+"""
+Command-Line Chat Client
+
+A line-oriented client for demos and integration testing without the
+Textual UI. It connects to a node over WebSocket and reads commands from
+standard input, so it can be driven interactively or by a script:
+
+    /register <username> <password>   Create an account
+    /login <username> <password>      Log in
+    /rooms                            List the rooms on the node
+    /create <room name>               Create a room and join it
+    /join <room_id>                   Join a room
+    /leave                            Leave the current room
+    /help                             Show the commands
+    /quit                             Disconnect and exit
+
+Any other line is sent as a message to the current room. While in a room,
+messages and membership changes are printed as they arrive.
+
+Usage:
+    python -m src.client.cli --url ws://localhost:8080 --username alice
+"""
+
+import argparse
+import asyncio
+import logging
+import sys
+from contextlib import asynccontextmanager
+from datetime import datetime
+from typing import Any, Callable, Dict, List, Optional
+
+from .chat_client import ChatClient
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_URL = "ws://localhost:8080"
+
+# Usage and description of each command, in /help order
+COMMANDS = {
+    "register": ("<username> <password>", "Create an account"),
+    "login": ("<username> <password>", "Log in"),
+    "rooms": ("", "List the rooms on the node"),
+    "create": ("<room name>", "Create a room and join it"),
+    "join": ("<room_id>", "Join a room"),
+    "leave": ("", "Leave the current room"),
+    "help": ("", "Show the commands"),
+    "quit": ("", "Disconnect and exit"),
+}
+
+
+def format_time(timestamp: Optional[str]) -> str:
+    """Format an ISO 8601 timestamp as HH:MM:SS."""
+    try:
+        return datetime.fromisoformat(
+            (timestamp or "").replace("Z", "+00:00")
+        ).strftime("%H:%M:%S")
+    except ValueError:
+        return "--:--:--"
+
+
+def format_message(message: Dict[str, Any]) -> str:
+    """Format a chat message as a line of the live view."""
+    return (
+        f"[{format_time(message.get('timestamp'))}] "
+        f"{message.get('username')}: {message.get('content')}"
+    )
+
+
+class ChatCLI:
+    """
+    Runs commands typed on the command line against a ChatClient.
+
+    While the client is in a room, a background task receives messages
+    and prints them. It is paused while a command waits for its response,
+    since the client reads responses from the same connection.
+    """
+
+    def __init__(
+        self,
+        client: ChatClient,
+        output: Callable[[str], None] = print,
+    ):
+        """
+        Initialize the command-line client.
+
+        Args:
+            client: Connected ChatClient to run commands with
+            output: Function printing a line for the user
+        """
+        self.client = client
+        self.output = output
+        self._receive_task: Optional[asyncio.Task] = None
+
+        client.set_on_message_ready(
+            lambda message: self.output(format_message(message))
+        )
+        client.set_on_member_joined(
+            lambda data: self.output(f"* {data.get('username')} joined")
+        )
+        client.set_on_member_left(
+            lambda data: self.output(f"* {data.get('username')} left")
+        )
+        client.set_on_room_deleted(
+            lambda data: self.output(
+                f"* Room {data.get('room_name') or data.get('room_id')} was "
+                f"deleted"
+            )
+        )
+        client.set_on_room_archived(
+            lambda data: self.output(
+                f"* Room {data.get('room_name') or data.get('room_id')} was "
+                f"archived and is read-only"
+            )
+        )
+        client.set_on_removed_from_room(
+            lambda data: self.output(
+                f"* You were removed from the room ({data.get('action')} by "
+                f"{data.get('moderator')})"
+            )
+        )
+
+    def _start_receiver(self) -> None:
+        """Start printing incoming messages, if in a room."""
+        if self.client.current_room and self._receive_task is None:
+            self._receive_task = asyncio.create_task(
+                self._receive_loop()
+            )
+
+    async def _receive_loop(self) -> None:
+        """Receive messages until the connection closes."""
+        try:
+            await self.client.receive_messages()
+        except asyncio.CancelledError:
+            raise
+        except Exception as e:
+            logger.error(f"Message receiver error: {e}")
+        if not self.client.is_connected:
+            self.output("* Connection closed by the node")
+
+    async def _stop_receiver(self) -> None:
+        """Stop the receive task, if running."""
+        if self._receive_task:
+            self._receive_task.cancel()
+            try:
+                await self._receive_task
+            except asyncio.CancelledError:
+                pass
+            self._receive_task = None
+
+    @asynccontextmanager
+    async def _awaiting_response(self):
+        """Pause the receive task while a command reads its response."""
+        await self._stop_receiver()
+        try:
+            yield
+        finally:
+            self._start_receiver()
+
+    async def execute(self, line: str) -> bool:
+        """
+        Run one line of input.
+
+        Args:
+            line: A /command or a message for the current room
+
+        Returns:
+            bool: False if the client should exit
+        """
+        line = line.strip()
+        if not line:
+            return True
+        if not line.startswith("/"):
+            await self.send(line)
+            return True
+
+        name, _, rest = line[1:].partition(" ")
+        args = rest.split()
+        if name == "quit":
+            return False
+        if name not in COMMANDS:
+            self.output(f"Unknown command /{name}; type /help")
+            return True
+        try:
+            await getattr(self, f"cmd_{name}")(rest.strip(), args)
+        except (ConnectionError, ValueError) as e:
+            self.output(f"Error: {e}")
+        return True
+
+    async def send(self, content: str) -> None:
+        """Send a message to the current room."""
+        if not self.client.current_room:
+            self.output("Join a room first (/rooms, /join <room_id>)")
+            return
+        if not self.client.username:
+            self.output("Log in first (/login <username> <password>)")
+            return
+        await self.client.send_message(
+            self.client.current_room, self.client.username, content
+        )
+
+    def _usage(self, name: str) -> None:
+        """Print the usage of a command."""
+        self.output(f"Usage: /{name} {COMMANDS[name][0]}".rstrip())
+
+    async def cmd_register(self, rest: str, args: List[str]) -> None:
+        """Create an account."""
+        if len(args) != 2:
+            self._usage("register")
+            return
+        async with self._awaiting_response():
+            await self.client.register(args[0], args[1])
+        self.output(f"Registered {args[0]}; /login to sign in")
+
+    async def cmd_login(self, rest: str, args: List[str]) -> None:
+        """Log in and use the account's username."""
+        if len(args) != 2:
+            self._usage("login")
+            return
+        async with self._awaiting_response():
+            await self.client.login(args[0], args[1])
+        self.client.set_username(args[0])
+        self.output(f"Logged in as {args[0]}")
+
+    async def cmd_rooms(self, rest: str, args: List[str]) -> None:
+        """List the rooms on the node."""
+        async with self._awaiting_response():
+            response = await self.client.list_rooms()
+        if not response.rooms:
+            self.output("No rooms; /create <room name> to start one")
+        for room in response.rooms:
+            self.output(
+                f"{room.room_id}  {room.room_name} "
+                f"({room.member_count} members)"
+            )
+
+    async def cmd_create(self, rest: str, args: List[str]) -> None:
+        """Create a room and join it."""
+        if not rest:
+            self._usage("create")
+            return
+        if not self.client.username:
+            self.output("Log in first (/login <username> <password>)")
+            return
+        async with self._awaiting_response():
+            room = await self.client.create_room(rest, self.client.username)
+        self.output(f"Created {room.room_name} ({room.room_id})")
+        await self.cmd_join(room.room_id, [room.room_id])
+
+    async def cmd_join(self, rest: str, args: List[str]) -> None:
+        """Join a room and show its messages live."""
+        if len(args) != 1:
+            self._usage("join")
+            return
+        if not self.client.username:
+            self.output("Log in first (/login <username> <password>)")
+            return
+        if self.client.current_room:
+            await self.cmd_leave("", [])
+        async with self._awaiting_response():
+            room = await self.client.join_room(args[0], self.client.username)
+            self.client.set_current_room(room.room_id)
+        self.output(
+            f"Joined {room.room_name} with {room.member_count} members: "
+            f"{', '.join(room.members)}"
+        )
+
+    async def cmd_leave(self, rest: str, args: List[str]) -> None:
+        """Leave the current room."""
+        room_id = self.client.current_room
+        if not room_id:
+            self.output("Not in a room")
+            return
+        await self._stop_receiver()
+        await self.client.leave_room(room_id, self.client.username)
+        self.client.leave_current_room()
+        self.output(f"Left {room_id}")
+
+    async def cmd_help(self, rest: str, args: List[str]) -> None:
+        """Show the commands."""
+        for name, (usage, description) in COMMANDS.items():
+            self.output(f"  /{f'{name} {usage}'.strip():32} {description}")
+        self.output("  Any other line is sent to the current room")
+
+    async def close(self) -> None:
+        """Stop receiving and disconnect."""
+        await self._stop_receiver()
+        if self.client.is_connected:
+            await self.client.disconnect()
+
+
+async def read_lines(stream=sys.stdin):
+    """Yield lines from a stream without blocking the event loop."""
+    loop = asyncio.get_running_loop()
+    while True:
+        line = await loop.run_in_executor(None, stream.readline)
+        if not line:
+            return
+        yield line
+
+
+async def run_cli(args: argparse.Namespace) -> int:
+    """
+    Connect to the node and run commands from standard input.
+
+    Args:
+        args: Parsed command-line arguments
+
+    Returns:
+        int: Exit status
+    """
+    client = ChatClient(args.url)
+    try:
+        await client.connect()
+    except ConnectionError as e:
+        print(f"Error: {e}", file=sys.stderr)
+        return 1
+
+    cli = ChatCLI(client)
+    print(f"Connected to {args.url}; type /help for commands")
+    try:
+        if args.username:
+            client.set_username(args.username)
+        if args.username and args.password:
+            await cli.execute(f"/login {args.username} {args.password}")
+        if args.room:
+            await cli.execute(f"/join {args.room}")
+        async for line in read_lines():
+            if not await cli.execute(line):
+                break
+    finally:
+        await cli.close()
+    return 0
+
+
+def main(argv=None):
+    """Main entry point for the command-line chat client."""
+    parser = argparse.ArgumentParser(
+        description="Command-line client for the distributed chat system"
+    )
+    parser.add_argument(
+        "--url",
+        default=DEFAULT_URL,
+        help=f"WebSocket URL of the node (default: {DEFAULT_URL})",
+    )
+    parser.add_argument("--username", help="Username to chat as")
+    parser.add_argument("--password", help="Password to log in with")
+    parser.add_argument("--room", help="Room ID to join after connecting")
+    args = parser.parse_args(argv)
+
+    # Log to a file so log lines don't interleave with the chat
+    logging.basicConfig(
+        level=logging.WARNING,
+        format="%(asctime)s - %(name)s - %(levelname)s - %(message)s",
+        handlers=[logging.FileHandler("chat_client.log", mode="a")],
+    )
+
+    try:
+        sys.exit(asyncio.run(run_cli(args)))
+    except KeyboardInterrupt:
+        print("\nExiting...")
+        sys.exit(0)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,54 @@
+"""
+Client Errors
+
+Errors nodes report to the client, raised as NodeError. Error responses
+carry an error code, its category and whether repeating the request can
+succeed (see the node's error catalog, src/node/schemas/errors.py), so
+callers can decide to retry by the error's code rather than its message.
+"""
+
+from typing import Any, Dict, Optional
+
+
+class NodeError(ValueError):
+    """
+    An error reported by the node.
+
+    Subclasses ValueError, which ClientService raised for node errors
+    before error codes were reported.
+
+    Attributes:
+        error_code: The node's error code, if it sent one
+        category: The error code's category (e.g., "not_found")
+        retryable: Whether repeating the request can succeed
+    """
+
+    def __init__(
+        self,
+        message: Optional[str],
+        error_code: Optional[str] = None,
+        category: Optional[str] = None,
+        retryable: bool = False,
+    ):
+        super().__init__(message)
+        self.error_code = error_code
+        self.category = category
+        self.retryable = retryable
+
+    @classmethod
+    def from_data(cls, data: Dict[str, Any]) -> "NodeError":
+        """
+        Create the error of an error response.
+
+        Args:
+            data: The error response's data
+
+        Returns:
+            NodeError: The error, with the response's error message
+        """
+        return cls(
+            data.get("error") or data.get("message"),
+            data.get("error_code"),
+            data.get("category"),
+            bool(data.get("retryable", False)),
+        )
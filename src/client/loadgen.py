@@ -0,0 +1,680 @@
+#!/usr/bin/env python3
+"""
+Load Generator
+
+Measures how fast one or more nodes fan messages out: it opens many
+simulated clients over WebSocket, spreads them over rooms, has each send
+messages at a fixed rate and reports latency percentiles and error rates,
+so a regression in the fan-out path shows up as numbers.
+
+Each run creates its own rooms, named loadgen-<run>-<n>: client i joins
+room i mod --rooms, and the first client of each room creates it. The
+clients are spread over the --url nodes in turn, so with several nodes
+the rooms have members on each. With --password every simulated user
+(loadgen-<run>-<i>) registers and logs in first, for nodes that require
+authentication.
+
+Two latencies are measured from the moment a message is sent:
+
+- ack: until the sender gets its message_sent confirmation
+- delivery: until another member of the room gets it as new_message
+
+A message failed if the node refused it (message_error, rate_limited or
+auth_error; counted by error code) or it is still unconfirmed once the
+run has drained (UNACKNOWLEDGED). Clients that can't connect, log in or
+join are counted by error code too, and send nothing.
+
+All clients share one process, so an overloaded load generator adds its
+own scheduling delay to the latencies: watch its CPU, or lower --clients.
+
+Usage:
+    python -m src.client.loadgen --url ws://localhost:8080 \\
+        --clients 1000 --rooms 20 --rate 2 --duration 60
+"""
+
+import argparse
+import asyncio
+import json
+import logging
+import math
+import random
+import sys
+import time
+import uuid
+from collections import Counter, deque
+from dataclasses import dataclass, field
+from typing import Any, Callable, Deque, Dict, List, Optional
+
+import websockets
+
+from .schemas import CreateRoomRequest, JoinRoomRequest, SendMessageRequest
+
+logger = logging.getLogger(__name__)
+
+# Load test defaults
+DEFAULT_URL = "ws://localhost:8080"
+DEFAULT_CLIENTS = 100
+DEFAULT_ROOMS = 10
+DEFAULT_RATE = 1.0  # messages per second per client
+DEFAULT_DURATION = 30.0  # seconds of sending
+DEFAULT_RAMP = 50  # connections opened at once
+DEFAULT_DRAIN = 5.0  # seconds to wait for confirmations after sending
+DEFAULT_TIMEOUT = 10.0  # seconds to wait for each setup response
+PERCENTILES = (50, 90, 99)
+
+# Error responses that can refuse a send_message
+_REFUSALS = ("rate_limited", "auth_error")
+
+
+class LatencyStats:
+    """Latency samples of one kind, summarized as percentiles."""
+
+    def __init__(self):
+        """Initialize with no samples."""
+        self.samples: List[float] = []
+
+    def add(self, seconds: float) -> None:
+        """Record one latency, in seconds."""
+        self.samples.append(seconds)
+
+    def percentile(self, percent: float) -> Optional[float]:
+        """
+        Get a latency percentile (nearest rank).
+
+        Args:
+            percent: Percentile, 0 to 100
+
+        Returns:
+            The latency in seconds, or None without samples
+        """
+        if not self.samples:
+            return None
+        ordered = sorted(self.samples)
+        rank = max(math.ceil(percent / 100 * len(ordered)), 1)
+        return ordered[rank - 1]
+
+    def summary(self) -> Dict[str, Any]:
+        """Get the sample count and percentiles in milliseconds."""
+        result: Dict[str, Any] = {"count": len(self.samples)}
+        for percent in PERCENTILES + (100,):
+            value = self.percentile(percent)
+            key = "max_ms" if percent == 100 else f"p{percent}_ms"
+            result[key] = None if value is None else round(value * 1000, 2)
+        return result
+
+
+@dataclass
+class LoadConfig:
+    """
+    Settings of a load test run.
+
+    Attributes:
+        urls: WebSocket URLs of the nodes, used in turn
+        clients: Number of simulated clients
+        rooms: Number of rooms the clients are spread over
+        rate: Messages per second each client sends
+        duration: Seconds the clients send for
+        ramp: Most connections opened at once
+        drain: Seconds to wait for outstanding confirmations
+        timeout: Seconds to wait for each setup response
+        password: Register and log in every user with this password
+        message_size: Pad messages to this many characters
+    """
+
+    urls: List[str] = field(default_factory=lambda: [DEFAULT_URL])
+    clients: int = DEFAULT_CLIENTS
+    rooms: int = DEFAULT_ROOMS
+    rate: float = DEFAULT_RATE
+    duration: float = DEFAULT_DURATION
+    ramp: int = DEFAULT_RAMP
+    drain: float = DEFAULT_DRAIN
+    timeout: float = DEFAULT_TIMEOUT
+    password: Optional[str] = None
+    message_size: int = 0
+
+
+@dataclass
+class LoadReport:
+    """
+    Results of a load test run.
+
+    Attributes:
+        clients: Clients requested
+        connected: Clients that connected (and logged in)
+        joined: Clients that joined their room
+        rooms: Rooms created
+        sent: Messages sent
+        acknowledged: Messages confirmed with message_sent
+        failed: Messages refused or never confirmed
+        deliveries: new_message events received for other members'
+            messages
+        elapsed: Seconds the clients sent for
+        errors: Count of each error code, for messages and setup
+        ack_latency: Send to message_sent
+        delivery_latency: Send to another member's new_message
+    """
+
+    clients: int = 0
+    connected: int = 0
+    joined: int = 0
+    rooms: int = 0
+    sent: int = 0
+    acknowledged: int = 0
+    failed: int = 0
+    deliveries: int = 0
+    elapsed: float = 0.0
+    errors: Counter = field(default_factory=Counter)
+    ack_latency: LatencyStats = field(default_factory=LatencyStats)
+    delivery_latency: LatencyStats = field(default_factory=LatencyStats)
+
+    @property
+    def error_rate(self) -> float:
+        """Fraction of sent messages that failed."""
+        return self.failed / self.sent if self.sent else 0.0
+
+    def _per_second(self, count: int) -> float:
+        return round(count / self.elapsed, 1) if self.elapsed else 0.0
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to a dictionary for JSON output."""
+        return {
+            "clients": self.clients,
+            "connected": self.connected,
+            "joined": self.joined,
+            "rooms": self.rooms,
+            "sent": self.sent,
+            "acknowledged": self.acknowledged,
+            "failed": self.failed,
+            "deliveries": self.deliveries,
+            "elapsed": round(self.elapsed, 3),
+            "messages_per_second": self._per_second(self.sent),
+            "deliveries_per_second": self._per_second(self.deliveries),
+            "error_rate": round(self.error_rate, 6),
+            "errors": dict(self.errors),
+            "ack_latency": self.ack_latency.summary(),
+            "delivery_latency": self.delivery_latency.summary(),
+        }
+
+    def format(self) -> str:
+        """Format the report for the terminal."""
+
+        def latency(stats: LatencyStats) -> str:
+            summary = stats.summary()
+            if not summary["count"]:
+                return "no samples"
+            return "  ".join(
+                f"{key[:-3]} {value:.1f} ms"
+                for key, value in summary.items()
+                if key != "count"
+            )
+
+        errors = ", ".join(
+            f"{code} {count}" for code, count in self.errors.most_common()
+        )
+        return "\n".join(
+            [
+                f"Clients:          {self.clients} requested, "
+                f"{self.connected} connected, {self.joined} joined "
+                f"{self.rooms} rooms",
+                f"Messages:         {self.sent} sent "
+                f"({self._per_second(self.sent)}/s), "
+                f"{self.acknowledged} acknowledged, {self.failed} failed "
+                f"({self.error_rate:.2%})",
+                f"Deliveries:       {self.deliveries} "
+                f"({self._per_second(self.deliveries)}/s)",
+                f"Ack latency:      {latency(self.ack_latency)}",
+                f"Delivery latency: {latency(self.delivery_latency)}",
+                f"Errors:           {errors or 'none'}",
+            ]
+        )
+
+
+class SimulatedClient:
+    """
+    One simulated user with its own WebSocket connection.
+
+    A reader task handles everything the node sends: confirmations,
+    refusals and deliveries are passed to the LoadGenerator, pings are
+    answered, and setup responses complete the pending request.
+    """
+
+    def __init__(self, generator: "LoadGenerator", index: int, url: str):
+        """
+        Initialize the client.
+
+        Args:
+            generator: The LoadGenerator running the client
+            index: Position of the client in the run
+            url: WebSocket URL of its node
+        """
+        self.generator = generator
+        self.index = index
+        self.url = url
+        self.username = f"loadgen-{generator.run_id}-{index}"
+        self.websocket = None
+        self.token: Optional[str] = None
+        self.room_id: Optional[str] = None
+        self.closed = False
+        # IDs of sent messages not confirmed or refused yet, oldest first;
+        # a node answers each connection's commands in order
+        self.pending: Deque[str] = deque()
+        self._request_type: Optional[str] = None
+        self._response: Optional[asyncio.Future] = None
+        self._response_types: tuple = ()
+        self._reader: Optional[asyncio.Task] = None
+
+    async def connect(self, connect: Callable) -> None:
+        """Open the connection and start reading from it."""
+        self.websocket = await connect(self.url)
+        self._reader = asyncio.create_task(self._read())
+
+    async def send(self, request: Dict[str, Any]) -> None:
+        """Send a request, with the session token once logged in."""
+        if self.token:
+            request = dict(request, token=self.token)
+        await self.websocket.send(json.dumps(request))
+
+    async def request(
+        self, request: Dict[str, Any], *response_types: str
+    ) -> Dict[str, Any]:
+        """
+        Send a setup request and wait for its response.
+
+        Args:
+            request: The request
+            *response_types: Types the response may have
+
+        Returns:
+            dict: The response
+
+        Raises:
+            asyncio.TimeoutError: If no response came in time
+        """
+        self._request_type = request["type"]
+        self._response_types = response_types + _REFUSALS
+        self._response = asyncio.get_running_loop().create_future()
+        try:
+            await self.send(request)
+            return await asyncio.wait_for(
+                self._response, self.generator.config.timeout
+            )
+        finally:
+            self._request_type = self._response = None
+
+    async def close(self) -> None:
+        """Close the connection and stop reading."""
+        self.closed = True
+        if self.websocket is not None:
+            try:
+                await self.websocket.close()
+            except Exception:
+                pass
+        if self._reader is not None:
+            self._reader.cancel()
+
+    async def _read(self) -> None:
+        try:
+            async for raw in self.websocket:
+                await self._handle(json.loads(raw))
+        except websockets.exceptions.ConnectionClosed:
+            pass
+        except asyncio.CancelledError:
+            return
+        if not self.closed:
+            self.closed = True
+            self.generator.report.errors["DISCONNECTED"] += 1
+
+    async def _handle(self, message: Dict[str, Any]) -> None:
+        message_type = message.get("type")
+        data = message.get("data") or {}
+        if message_type == "ping":
+            await self.send({"type": "pong"})
+        elif message_type == "message_sent":
+            self.generator.acknowledged(self, data.get("message_id"))
+        elif message_type == "new_message":
+            self.generator.delivered(self, data)
+        elif message_type == "message_error" or (
+            message_type in _REFUSALS
+            and data.get("request_type") == "send_message"
+        ):
+            self.generator.refused(self, data.get("error_code") or "ERROR")
+        elif (
+            self._response is not None
+            and not self._response.done()
+            and message_type in self._response_types
+            and (
+                message_type not in _REFUSALS
+                or data.get("request_type") == self._request_type
+            )
+        ):
+            self._response.set_result(message)
+
+
+class LoadGenerator:
+    """
+    Runs a load test: connects, creates and joins the rooms, sends for
+    the configured duration and collects a LoadReport.
+    """
+
+    def __init__(self, config: LoadConfig, connect: Callable = None):
+        """
+        Initialize the generator.
+
+        Args:
+            config: Settings of the run
+            connect: Opens a WebSocket connection to a URL (default:
+                websockets.connect)
+        """
+        self.config = config
+        self.connect = connect or websockets.connect
+        self.run_id = uuid.uuid4().hex[:8]
+        self.report = LoadReport(clients=config.clients)
+        self._sent_at: Dict[str, float] = {}
+
+    async def run(self) -> LoadReport:
+        """
+        Run the load test.
+
+        Returns:
+            LoadReport: The results
+        """
+        config = self.config
+        clients = [
+            SimulatedClient(self, i, config.urls[i % len(config.urls)])
+            for i in range(config.clients)
+        ]
+        ramp = asyncio.Semaphore(config.ramp)
+        try:
+            await asyncio.gather(*(self._connect(c, ramp) for c in clients))
+            connected = [c for c in clients if c.websocket and not c.closed]
+            self.report.connected = len(connected)
+
+            room_ids = await self._create_rooms(connected)
+            self.report.rooms = sum(1 for r in room_ids if r)
+            await asyncio.gather(
+                *(
+                    self._join(c, room_ids[c.index % config.rooms], ramp)
+                    for c in connected
+                )
+            )
+            joined = [c for c in connected if c.room_id]
+            self.report.joined = len(joined)
+
+            started = time.monotonic()
+            end = started + config.duration
+            await asyncio.gather(*(self._send_loop(c, end) for c in joined))
+            self.report.elapsed = time.monotonic() - started
+            await self._drain(joined)
+        finally:
+            await asyncio.gather(*(c.close() for c in clients))
+        return self.report
+
+    def acknowledged(self, client: SimulatedClient, message_id) -> None:
+        """Record a message_sent confirmation."""
+        if message_id not in client.pending:
+            return
+        if client.pending[0] == message_id:
+            client.pending.popleft()
+        else:
+            client.pending.remove(message_id)
+        self.report.acknowledged += 1
+        self.report.ack_latency.add(
+            time.monotonic() - self._sent_at[message_id]
+        )
+
+    def refused(self, client: SimulatedClient, error_code: str) -> None:
+        """Record a refused message, the client's oldest unconfirmed one."""
+        if client.pending:
+            client.pending.popleft()
+        self.report.failed += 1
+        self.report.errors[error_code] += 1
+
+    def delivered(self, client: SimulatedClient, message: Dict) -> None:
+        """Record a new_message received for another member's message."""
+        sent_at = self._sent_at.get(message.get("message_id"))
+        if sent_at is None or message.get("username") == client.username:
+            return
+        self.report.deliveries += 1
+        self.report.delivery_latency.add(time.monotonic() - sent_at)
+
+    async def _connect(
+        self, client: SimulatedClient, ramp: asyncio.Semaphore
+    ) -> None:
+        async with ramp:
+            try:
+                await client.connect(self.connect)
+            except Exception as e:
+                logger.debug(f"{client.username} couldn't connect: {e}")
+                client.closed = True
+                self.report.errors["CONNECT_FAILED"] += 1
+                return
+            if self.config.password and not await self._log_in(client):
+                await client.close()
+
+    async def _log_in(self, client: SimulatedClient) -> bool:
+        credentials = {
+            "username": client.username,
+            "password": self.config.password,
+        }
+        try:
+            await client.request(
+                {"type": "register", "data": credentials},
+                "register_success",
+                "register_error",
+            )
+            response = await client.request(
+                {"type": "login", "data": credentials},
+                "login_success",
+                "login_error",
+            )
+        except (asyncio.TimeoutError, OSError) as e:
+            logger.debug(f"{client.username} couldn't log in: {e}")
+            self.report.errors["LOGIN_FAILED"] += 1
+            return False
+        if response["type"] != "login_success":
+            self.report.errors["LOGIN_FAILED"] += 1
+            return False
+        client.token = response["data"]["token"]
+        return True
+
+    async def _create_rooms(
+        self, connected: List[SimulatedClient]
+    ) -> List[Optional[str]]:
+        """Have the first client of each room create it."""
+        creators: Dict[int, SimulatedClient] = {}
+        for client in connected:
+            creators.setdefault(client.index % self.config.rooms, client)
+
+        async def create(number: int) -> Optional[str]:
+            creator = creators.get(number)
+            if creator is None:
+                return None
+            request = CreateRoomRequest(
+                room_name=f"loadgen-{self.run_id}-{number}",
+                creator_id=creator.username,
+                description="Load test room",
+            )
+            try:
+                response = await creator.request(
+                    request.to_dict(), "room_created"
+                )
+            except (asyncio.TimeoutError, OSError):
+                response = {}
+            room_id = (response.get("data") or {}).get("room_id")
+            if not room_id:
+                self.report.errors["CREATE_FAILED"] += 1
+            return room_id
+
+        return list(
+            await asyncio.gather(
+                *(create(number) for number in range(self.config.rooms))
+            )
+        )
+
+    async def _join(
+        self,
+        client: SimulatedClient,
+        room_id: Optional[str],
+        ramp: asyncio.Semaphore,
+    ) -> None:
+        if room_id is None:
+            self.report.errors["JOIN_FAILED"] += 1
+            return
+        async with ramp:
+            request = JoinRoomRequest(room_id=room_id, username=client.username)
+            try:
+                response = await client.request(
+                    request.to_dict(), "join_room_success", "join_room_error"
+                )
+            except (asyncio.TimeoutError, OSError):
+                response = {}
+        if response.get("type") == "join_room_success":
+            client.room_id = room_id
+        else:
+            self.report.errors["JOIN_FAILED"] += 1
+
+    async def _send_loop(self, client: SimulatedClient, end: float) -> None:
+        """Send messages at the configured rate until the run ends."""
+        interval = 1 / self.config.rate
+        # Start at a random point of the first interval, so thousands of
+        # clients don't send in lockstep
+        next_send = time.monotonic() + random.uniform(0, interval)
+        sequence = 0
+        while not client.closed:
+            await asyncio.sleep(max(next_send - time.monotonic(), 0))
+            if time.monotonic() >= end or client.closed:
+                return
+            sequence += 1
+            message_id = f"lg-{self.run_id}-{client.index}-{sequence}"
+            content = message_id.ljust(self.config.message_size, ".")
+            request = SendMessageRequest(
+                room_id=client.room_id,
+                username=client.username,
+                content=content,
+                message_id=message_id,
+            )
+            self._sent_at[message_id] = time.monotonic()
+            client.pending.append(message_id)
+            self.report.sent += 1
+            try:
+                await client.send(request.to_dict())
+            except (websockets.exceptions.ConnectionClosed, OSError):
+                return
+            next_send += interval
+
+    async def _drain(self, clients: List[SimulatedClient]) -> None:
+        """Wait for outstanding confirmations, then count the rest."""
+        deadline = time.monotonic() + self.config.drain
+        while time.monotonic() < deadline and any(
+            c.pending and not c.closed for c in clients
+        ):
+            await asyncio.sleep(0.05)
+        unacknowledged = sum(len(c.pending) for c in clients)
+        if unacknowledged:
+            self.report.failed += unacknowledged
+            self.report.errors["UNACKNOWLEDGED"] += unacknowledged
+
+
+def main(argv=None):
+    """Main entry point for running a load test."""
+    parser = argparse.ArgumentParser(
+        description="Load test nodes with simulated WebSocket clients"
+    )
+    parser.add_argument(
+        "--url",
+        action="append",
+        dest="urls",
+        help=f"WebSocket URL of a node; repeat for several (default: "
+        f"{DEFAULT_URL})",
+    )
+    parser.add_argument(
+        "--clients",
+        type=int,
+        default=DEFAULT_CLIENTS,
+        help=f"Simulated clients (default: {DEFAULT_CLIENTS})",
+    )
+    parser.add_argument(
+        "--rooms",
+        type=int,
+        default=DEFAULT_ROOMS,
+        help=f"Rooms to spread the clients over (default: {DEFAULT_ROOMS})",
+    )
+    parser.add_argument(
+        "--rate",
+        type=float,
+        default=DEFAULT_RATE,
+        help=f"Messages per second per client (default: {DEFAULT_RATE})",
+    )
+    parser.add_argument(
+        "--duration",
+        type=float,
+        default=DEFAULT_DURATION,
+        help=f"Seconds to send for (default: {DEFAULT_DURATION})",
+    )
+    parser.add_argument(
+        "--ramp",
+        type=int,
+        default=DEFAULT_RAMP,
+        help=f"Connections opened at once (default: {DEFAULT_RAMP})",
+    )
+    parser.add_argument(
+        "--drain",
+        type=float,
+        default=DEFAULT_DRAIN,
+        help=f"Seconds to wait for confirmations after sending "
+        f"(default: {DEFAULT_DRAIN})",
+    )
+    parser.add_argument(
+        "--password", help="Register and log in each user with this password"
+    )
+    parser.add_argument(
+        "--message-size",
+        type=int,
+        default=0,
+        help="Pad messages to this many characters",
+    )
+    parser.add_argument(
+        "--max-error-rate",
+        type=float,
+        help="Exit with status 1 if more than this fraction of messages "
+        "failed",
+    )
+    parser.add_argument(
+        "--json", action="store_true", help="Print the report as JSON"
+    )
+    args = parser.parse_args(argv)
+    if args.clients < 1 or args.ramp < 1:
+        parser.error("--clients and --ramp must be at least 1")
+    if not 1 <= args.rooms <= args.clients:
+        parser.error("--rooms must be between 1 and --clients")
+    if args.rate <= 0 or args.duration <= 0:
+        parser.error("--rate and --duration must be positive")
+
+    logging.basicConfig(level=logging.WARNING)
+    config = LoadConfig(
+        urls=args.urls or [DEFAULT_URL],
+        clients=args.clients,
+        rooms=args.rooms,
+        rate=args.rate,
+        duration=args.duration,
+        ramp=args.ramp,
+        drain=args.drain,
+        password=args.password,
+        message_size=args.message_size,
+    )
+    report = asyncio.run(LoadGenerator(config).run())
+
+    if args.json:
+        print(json.dumps(report.to_dict(), indent=2))
+    else:
+        print(report.format())
+    if not report.joined or (
+        args.max_error_rate is not None
+        and report.error_rate > args.max_error_rate
+    ):
+        sys.exit(1)
+    sys.exit(0)
+
+
+if __name__ == "__main__":
+    main()
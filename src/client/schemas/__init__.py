@@ -26,6 +26,7 @@ from .message import (
     SendMessageRequest,
     MessageSentConfirmation,
     NewMessageNotification,
+    MessageStatusNotification,
     MessageErrorResponse,
 )
 
@@ -49,5 +50,6 @@ __all__ = [
     "SendMessageRequest",
     "MessageSentConfirmation",
     "NewMessageNotification",
+    "MessageStatusNotification",
     "MessageErrorResponse",
 ]
@@ -7,7 +7,7 @@ common serialization and deserialization methods to avoid code duplication.
 
 import json
 from dataclasses import asdict, dataclass, fields
-from typing import Any, Dict, Type, TypeVar
+from typing import Any, Dict, Optional, Type, TypeVar
 
 T = TypeVar("T", bound="BaseResponse")
 
@@ -116,8 +116,12 @@ class BaseErrorResponse(BaseResponse):
         room_id: ID of the room related to the error
         error: Error message
         error_code: Error code (e.g., ROOM_NOT_FOUND, NOT_MEMBER)
+        category: The error code's category (e.g., not_found)
+        retryable: Whether repeating the request can succeed
     """
 
     room_id: str
     error: str
     error_code: str
+    category: Optional[str] = None
+    retryable: bool = False
@@ -5,8 +5,8 @@ This module defines the message structures for chat message operations
 including sending messages and receiving message notifications.
 """
 
-from dataclasses import dataclass
-from typing import Any, Dict
+from dataclasses import dataclass, field
+from typing import Any, Dict, List, Optional
 
 from .base import BaseErrorResponse, BaseRequest, BaseResponse
 
@@ -20,11 +20,22 @@ class SendMessageRequest(BaseRequest):
         room_id: ID of the room to send the message to
         username: Username of the sender
         content: The message content
+        message_id: Optional ID chosen by the sender, so a retry is not
+            added twice
+        reply_to: Optional ID of the message this one replies to
+        encryption: Optional envelope of an end-to-end encrypted message,
+            whose content is then its base64 ciphertext
+        attachments: Optional references to uploaded files (see
+            ChatService.upload_attachment)
     """
 
     room_id: str
     username: str
     content: str
+    message_id: Optional[str] = None
+    reply_to: Optional[str] = None
+    encryption: Optional[Dict[str, Any]] = None
+    attachments: Optional[List[Dict[str, Any]]] = None
 
     @property
     def _message_type(self) -> str:
@@ -42,12 +53,19 @@ class MessageSentConfirmation(BaseResponse):
         message_id: Unique identifier for the message
         sequence_number: Assigned sequence number for ordering
         timestamp: ISO 8601 timestamp of when message was processed
+        vector_clock: Vector clock assigned by the room administrator
+        durable: True if a write quorum of a durable room's copies holds
+            the message
+        replicas: Copies holding the message, for durable rooms
     """
 
     room_id: str
     message_id: str
     sequence_number: int
     timestamp: str
+    vector_clock: Dict[str, int] = field(default_factory=dict)
+    durable: bool = False
+    replicas: Optional[int] = None
 
     @classmethod
     def _from_data(cls, data: Dict[str, Any]) -> "MessageSentConfirmation":
@@ -57,6 +75,9 @@ class MessageSentConfirmation(BaseResponse):
             message_id=data["message_id"],
             sequence_number=data["sequence_number"],
             timestamp=data["timestamp"],
+            vector_clock=data.get("vector_clock") or {},
+            durable=bool(data.get("durable", False)),
+            replicas=data.get("replicas"),
         )
 
 
@@ -72,6 +93,8 @@ class NewMessageNotification(BaseResponse):
         content: The message content
         sequence_number: Sequence number for ordering
         timestamp: ISO 8601 timestamp of when message was processed
+        vector_clock: Vector clock assigned by the room administrator
+        origin_node: Node the sender was connected to
     """
 
     room_id: str
@@ -80,6 +103,8 @@ class NewMessageNotification(BaseResponse):
     content: str
     sequence_number: int
     timestamp: str
+    vector_clock: Dict[str, int] = field(default_factory=dict)
+    origin_node: Optional[str] = None
 
     @classmethod
     def _from_data(cls, data: Dict[str, Any]) -> "NewMessageNotification":
@@ -91,6 +116,43 @@ class NewMessageNotification(BaseResponse):
             content=data["content"],
             sequence_number=data["sequence_number"],
             timestamp=data["timestamp"],
+            vector_clock=data.get("vector_clock") or {},
+            origin_node=data.get("origin_node"),
+        )
+
+
+@dataclass
+class MessageStatusNotification(BaseResponse):
+    """
+    Status update for a message this client sent.
+
+    Attributes:
+        room_id: ID of the room
+        message_id: Unique identifier for the message
+        status: "sent" once the room administrator accepted the message,
+            or "delivered" once a recipient's client confirmed receipt
+        sequence_number: Assigned sequence number, for "sent"
+        recipient: Username of the recipient, for "delivered"
+        timestamp: ISO 8601 timestamp of when the status was reached
+    """
+
+    room_id: str
+    message_id: str
+    status: str
+    sequence_number: Optional[int] = None
+    recipient: Optional[str] = None
+    timestamp: Optional[str] = None
+
+    @classmethod
+    def _from_data(cls, data: Dict[str, Any]) -> "MessageStatusNotification":
+        """Create from response data dictionary."""
+        return cls(
+            room_id=data["room_id"],
+            message_id=data["message_id"],
+            status=data["status"],
+            sequence_number=data.get("sequence_number"),
+            recipient=data.get("recipient"),
+            timestamp=data.get("timestamp"),
         )
 
 
@@ -101,4 +163,10 @@ class MessageErrorResponse(BaseErrorResponse):
 
     Inherits room_id, error, and error_code from BaseErrorResponse.
     Common error codes: NOT_MEMBER, INVALID_CONTENT
+
+    Attributes:
+        message_id: ID of a message that was added but not acknowledged
+            (QUORUM_NOT_REACHED), to resend it with
     """
+
+    message_id: Optional[str] = None
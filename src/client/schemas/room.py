@@ -20,11 +20,33 @@ class CreateRoomRequest(BaseRequest):
         room_name: Name of the room to create
         creator_id: ID of the user creating the room
         description: Optional description for the room
+        private: True to hide the room and require invites to join
+        total_order: True to have every member see messages in the same
+            order
+        max_members: Most members the room may have (0 for no limit)
+        waitlist: True to queue joins while the room is full
+        announcement: True to let only the owner and moderators post
+        delivery: Delivery guarantee of the room's messages
+            (at_most_once, at_least_once, or exactly_once by default)
+        ephemeral: True to have the room deleted once empty or idle
+        placement: Tags the room's admin node must have (e.g.,
+            {"region": "eu"})
+        durable: True to acknowledge messages only once a write quorum
+            of the room's copies holds them
     """
 
     room_name: str
     creator_id: str
     description: Optional[str] = None
+    private: bool = False
+    total_order: bool = False
+    max_members: int = 0
+    waitlist: bool = False
+    announcement: bool = False
+    delivery: Optional[str] = None
+    ephemeral: bool = False
+    placement: Optional[Dict[str, str]] = None
+    durable: bool = False
 
     @property
     def _message_type(self) -> str:
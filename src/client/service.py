@@ -17,12 +17,16 @@ Future Enhancements:
     - Room state caching
 """
 
+import base64
+import hashlib
 import json
 import logging
-from typing import Optional, Callable
+import uuid
+from typing import Dict, List, Optional, Callable
 import websockets
 from websockets.client import WebSocketClientProtocol
 
+from .errors import NodeError
 from .protocol import (
     RoomCreatedResponse,
     JoinRoomSuccessResponse,
@@ -44,6 +48,8 @@ class ClientService:
         node_url: WebSocket URL of the node server (e.g., ws://localhost:8000)
         websocket: Active WebSocket connection (None if not connected)
         _message_handler: Optional callback for handling incoming messages
+        session_token: Token from the last successful login (None if not
+            logged in), attached to every request
     """
 
     def __init__(
@@ -64,6 +70,12 @@ class ClientService:
         self._websocket_factory = websocket_factory or websockets.connect
         self._message_handler: Optional[Callable[[str], None]] = None
         self._connected = False
+        self.session_token: Optional[str] = None
+        # Resumable session of the current and the previous connection
+        self.session_id: Optional[str] = None
+        self._previous_session_id: Optional[str] = None
+        # Last request sent, resent after following a redirect
+        self._last_request: Optional[str] = None
 
         logger.info(f"ClientService initialized for node: {node_url}")
 
@@ -83,6 +95,9 @@ class ClientService:
             logger.info(f"Connecting to {self.node_url}...")
             self.websocket = await self._websocket_factory(self.node_url)
             self._connected = True
+            if self.session_id:
+                self._previous_session_id = self.session_id
+                self.session_id = None
             logger.info("Successfully connected to node server")
         except Exception as e:
             logger.error(f"Failed to connect to node: {e}")
@@ -109,8 +124,286 @@ class ClientService:
         """Check if currently connected to a node."""
         return self._connected and self.websocket is not None
 
+    async def _send(self, request_json: str) -> None:
+        """
+        Send a request, attaching the session token if logged in.
+
+        Args:
+            request_json: The request as a JSON string
+        """
+        self._last_request = request_json
+        if self.session_token:
+            request = json.loads(request_json)
+            request["token"] = self.session_token
+            request_json = json.dumps(request)
+        await self.websocket.send(request_json)
+
+    async def _await_response(self, *response_types: str) -> dict:
+        """
+        Wait for one of the given response types, skipping other messages.
+
+        Returns:
+            dict: The parsed response
+
+        Raises:
+            ValueError: If no matching response arrives
+        """
+        max_attempts = 10
+        for _ in range(max_attempts):
+            response_data = json.loads(await self.websocket.recv())
+            if response_data.get("type") in response_types:
+                return response_data
+            if response_data.get("type") == "session_started":
+                self._handle_session_started(response_data.get("data", {}))
+            if response_data.get("type") == "redirect":
+                await self._follow_redirect(response_data.get("data", {}))
+                continue
+            logger.debug(
+                f"Skipping {response_data.get('type')} while waiting for "
+                f"{response_types}"
+            )
+        raise ValueError(f"Timed out waiting for {response_types[0]}")
+
+    async def _follow_redirect(self, data: dict) -> None:
+        """
+        Reconnect to the node an overloaded node redirected this client to.
+
+        The request the redirected connection dropped is sent again on the
+        new connection.
+
+        Args:
+            data: The redirect frame data
+
+        Raises:
+            ConnectionError: If the frame has no URL or connecting fails
+        """
+        url = data.get("url")
+        if not url:
+            raise ConnectionError("Redirected without a node URL")
+        logger.info(
+            f"Node {data.get('node_id')} is {data.get('reason')}, "
+            f"reconnecting to {url}"
+        )
+        await self.disconnect()
+        self.node_url = url
+        await self.connect()
+        if self._last_request:
+            await self._send(self._last_request)
+
+    def _handle_session_started(self, data: dict) -> None:
+        """
+        Remember the session ID the node gave this connection.
+
+        Args:
+            data: The session_started event data
+        """
+        self.session_id = data.get("session_id")
+        logger.debug(
+            f"Session can be resumed for {data.get('grace_period')}s after "
+            f"a disconnect"
+        )
+
+    async def register(self, username: str, password: str) -> dict:
+        """
+        Register a new user account on the node.
+
+        Args:
+            username: The username to register
+            password: The password for the account
+
+        Returns:
+            dict: The register_success data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If registration is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "register",
+                    "data": {"username": username, "password": password},
+                }
+            )
+        )
+        response = await self._await_response(
+            "register_success", "register_error"
+        )
+        data = response.get("data", {})
+        if response["type"] == "register_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def login(self, username: str, password: str) -> str:
+        """
+        Log in and store the session token for later requests.
+
+        Args:
+            username: The username
+            password: The password
+
+        Returns:
+            str: The session token
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the credentials are rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "login",
+                    "data": {"username": username, "password": password},
+                }
+            )
+        )
+        response = await self._await_response("login_success", "login_error")
+        data = response.get("data", {})
+        if response["type"] == "login_error":
+            raise NodeError.from_data(data)
+
+        self.session_token = data["token"]
+        logger.info(f"Logged in as {username}")
+        return self.session_token
+
+    async def bot_login(self, bot_name: str, api_key: str) -> dict:
+        """
+        Log in as a bot with its API key.
+
+        The session token, if the node issues one, is stored for later
+        requests, which then act as the bot.
+
+        Args:
+            bot_name: The bot's name
+            api_key: The API key returned when the bot was registered
+
+        Returns:
+            dict: The bot's name ("bot_name") and commands ("commands")
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the API key is rejected
+        """
+        data = await self._bot_request(
+            "bot_login",
+            "bot_login_success",
+            {"bot_name": bot_name, "api_key": api_key},
+        )
+        if data.get("token"):
+            self.session_token = data["token"]
+        logger.info(f"Logged in as bot {bot_name}")
+        return data
+
+    async def service_login(self, account: str, api_key: str) -> dict:
+        """
+        Log in as a service account with its API key.
+
+        The session token, if the node issues one, is stored for later
+        requests, which then act as the account and are limited to its
+        scopes.
+
+        Args:
+            account: The service account's name
+            api_key: The API key returned when the account was provisioned
+
+        Returns:
+            dict: The account's name ("name"), scopes ("scopes") and the
+            rooms it is limited to ("rooms", empty for any room)
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the API key is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "service_login",
+                    "data": {"account": account, "api_key": api_key},
+                }
+            )
+        )
+        response = await self._await_response(
+            "service_login_success", "service_login_error"
+        )
+        data = response.get("data", {})
+        if response["type"] == "service_login_error":
+            raise NodeError.from_data(data)
+        if data.get("token"):
+            self.session_token = data["token"]
+        logger.info(f"Logged in as service account {account}")
+        return data
+
+    async def delete_account(self, username: str, password: str) -> dict:
+        """
+        Delete the user's account, releasing the username.
+
+        Args:
+            username: The username
+            password: The password
+
+        Returns:
+            dict: The account_deleted data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the credentials are rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "delete_account",
+                    "data": {"username": username, "password": password},
+                }
+            )
+        )
+        response = await self._await_response(
+            "account_deleted", "delete_account_error"
+        )
+        data = response.get("data", {})
+        if response["type"] == "delete_account_error":
+            raise NodeError.from_data(data)
+        self.session_token = None
+        return data
+
+    async def logout(self) -> None:
+        """
+        Revoke the current session (fire-and-forget).
+
+        Raises:
+            ConnectionError: If not connected to a node server
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(json.dumps({"type": "logout", "data": {}}))
+        self.session_token = None
+
     async def create_room(
-        self, room_name: str, creator_id: str, description: Optional[str] = None
+        self,
+        room_name: str,
+        creator_id: str,
+        description: Optional[str] = None,
+        private: bool = False,
+        total_order: bool = False,
+        max_members: int = 0,
+        waitlist: bool = False,
+        announcement: bool = False,
+        delivery: Optional[str] = None,
+        ephemeral: bool = False,
+        placement: Optional[Dict[str, str]] = None,
+        durable: bool = False,
     ) -> RoomCreatedResponse:
         """
         Send a request to create a new room on the node.
@@ -119,6 +412,24 @@ class ClientService:
             room_name: Name of the room to create
             creator_id: ID of the user creating the room
             description: Optional description for the room
+            private: True to create a private, invite-only room
+            total_order: True to have every member see messages in the
+                same order
+            max_members: Most members the room may have (0 for no limit)
+            waitlist: True to queue joins while the room is full
+            announcement: True to let only the owner and moderators post;
+                other members' messages fail with READ_ONLY_ROOM
+            delivery: Delivery guarantee of the room's messages:
+                at_most_once, at_least_once, or exactly_once (the
+                default)
+            ephemeral: True to have the room deleted once its last member
+                leaves or it was idle too long
+            placement: Tags the room's admin node must have (e.g.,
+                {"region": "eu"}); the room is placed on a node with them
+            durable: True to have messages acknowledged only once a write
+                quorum of the room's copies holds them; unacknowledged
+                ones fail with QUORUM_NOT_REACHED and can be resent with
+                the same message_id
 
         Returns:
             RoomCreatedResponse with room details
@@ -143,8 +454,21 @@ class ClientService:
         from .protocol import CreateRoomRequest
 
         # Create and send request
-        request = CreateRoomRequest(room_name, creator_id, description)
-        await self.websocket.send(request.to_json())
+        request = CreateRoomRequest(
+            room_name,
+            creator_id,
+            description,
+            private,
+            total_order,
+            max_members,
+            waitlist,
+            announcement,
+            delivery,
+            ephemeral,
+            placement,
+            durable,
+        )
+        await self._send(request.to_json())
 
         # Receive response - loop until we get a room_created response
         # Other messages (like global_rooms_list) may be pending
@@ -256,7 +580,7 @@ class ClientService:
 
         # Create and send request
         request = ListRoomsRequest()
-        await self.websocket.send(request.to_json())
+        await self._send(request.to_json())
 
         # Receive response
         response_json = await self.websocket.recv()
@@ -296,7 +620,7 @@ class ClientService:
 
         # Create and send request
         request = JoinRoomRequest(room_id, username)
-        await self.websocket.send(request.to_json())
+        await self._send(request.to_json())
 
         # Receive response - loop until we get a join-related response
         # Other messages (like member_left broadcasts) may be pending
@@ -315,7 +639,21 @@ class ClientService:
                 error_data = response_data.get("data", {})
                 error_msg = error_data.get("error", "Unknown error")
                 logger.error(f"Failed to join room: {error_msg}")
-                raise ValueError(error_msg)
+                raise NodeError(
+                    error_msg,
+                    error_data.get("error_code"),
+                    error_data.get("category"),
+                    bool(error_data.get("retryable", False)),
+                )
+            elif response_type == "waitlist_joined":
+                # The room is full; waitlist_admitted follows when a slot
+                # frees up
+                position = response_data.get("data", {}).get("position")
+                logger.info(f"Room is full, waiting list position {position}")
+                raise ValueError(
+                    f"Room is full, you are number {position} on the "
+                    f"waiting list"
+                )
             else:
                 # Skip non-join responses (e.g., pending broadcasts)
                 logger.debug(
@@ -325,31 +663,1835 @@ class ClientService:
         logger.error("Timed out waiting for join response")
         raise ValueError("Timed out waiting for join response")
 
-    async def send_message(
-        self, room_id: str, username: str, content: str
-    ) -> None:
+    async def create_invite(
+        self, room_id: str, username: str, invitee: Optional[str] = None
+    ) -> dict:
         """
-        Send a message to a room.
+        Create an invite to a private room.
 
-        This is a fire-and-forget operation. The message confirmation will
-        come through the message receive loop asynchronously.
+        Args:
+            room_id: ID of the private room
+            username: Username of the inviting member
+            invitee: Optional username the invite is restricted to
+
+        Returns:
+            dict: The invite_created data, including the invite_token
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the invite is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        request_data = {"room_id": room_id, "username": username}
+        if invitee:
+            request_data["invitee"] = invitee
+        await self._send(
+            json.dumps({"type": "create_invite", "data": request_data})
+        )
+        response = await self._await_response("invite_created", "invite_error")
+        data = response.get("data", {})
+        if response["type"] == "invite_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def revoke_invite(self, invite_token: str, username: str) -> dict:
+        """
+        Revoke an invite to a private room.
 
         Args:
-            room_id: ID of the room to send the message to
-            username: Username of the sender
-            content: The message content
+            invite_token: The invite token
+            username: Username of the inviter, room owner or a moderator
+
+        Returns:
+            dict: The invite_revoked data
 
         Raises:
             ConnectionError: If not connected to a node server
+            ValueError: If the revocation is rejected
         """
         if not self.is_connected:
             raise ConnectionError("Not connected to a node server")
 
-        logger.info(f"Sending message to room '{room_id}'")
+        await self._send(
+            json.dumps(
+                {
+                    "type": "revoke_invite",
+                    "data": {
+                        "invite_token": invite_token,
+                        "username": username,
+                    },
+                }
+            )
+        )
+        response = await self._await_response("invite_revoked", "invite_error")
+        data = response.get("data", {})
+        if response["type"] == "invite_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def kick_user(
+        self, room_id: str, username: str, target: str
+    ) -> dict:
+        """
+        Remove a member from a room this user owns or moderates.
 
-        # Create and send request (fire-and-forget)
-        request = SendMessageRequest(room_id, username, content)
-        await self.websocket.send(request.to_json())
+        The member may join the room again.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner or a moderator
+            target: The member to remove
+
+        Returns:
+            dict: The user_kicked data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the kick is rejected
+        """
+        return await self._moderate(
+            "kick_user", "user_kicked", room_id, username, target
+        )
+
+    async def ban_user(self, room_id: str, username: str, target: str) -> dict:
+        """
+        Remove a user from a room this user owns or moderates for good.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner or a moderator
+            target: The user to ban (need not be a member)
+
+        Returns:
+            dict: The user_banned data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the ban is rejected
+        """
+        return await self._moderate(
+            "ban_user", "user_banned", room_id, username, target
+        )
+
+    async def promote_member(
+        self, room_id: str, username: str, target: str
+    ) -> dict:
+        """
+        Make a member of a room this user owns a moderator.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+            target: The member to promote
+
+        Returns:
+            dict: The role_changed data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the promotion is rejected
+        """
+        return await self._moderate(
+            "promote_member", "role_changed", room_id, username, target
+        )
+
+    async def demote_member(
+        self, room_id: str, username: str, target: str
+    ) -> dict:
+        """
+        Make a moderator of a room this user owns a plain member again.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+            target: The moderator to demote
+
+        Returns:
+            dict: The role_changed data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the demotion is rejected
+        """
+        return await self._moderate(
+            "demote_member", "role_changed", room_id, username, target
+        )
+
+    async def set_retention(
+        self, room_id: str, username: str, retention: List[str]
+    ) -> List[str]:
+        """
+        Limit how long a room this user owns keeps its messages.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+            retention: Limits like ["age=7d", "count=10000"]; an empty
+                list keeps every message
+
+        Returns:
+            list: The room's new limits
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the policy is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = {
+            "room_id": room_id,
+            "username": username,
+            "retention": list(retention),
+        }
+        await self._send(json.dumps({"type": "set_retention", "data": data}))
+        response = await self._await_response(
+            "retention_set", "retention_error"
+        )
+        if response["type"] == "retention_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("retention", [])
+
+    async def set_spam_thresholds(
+        self, room_id: str, username: str, **thresholds: int
+    ) -> Dict[str, int]:
+        """
+        Change the spam detection thresholds of a room this user owns or
+        moderates.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner or a moderator
+            **thresholds: Any of duplicate_limit, mention_limit, window
+                and mute_duration; a limit of 0 turns its check off
+
+        Returns:
+            dict: All of the room's thresholds
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the thresholds are rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = dict(thresholds, room_id=room_id, username=username)
+        await self._send(
+            json.dumps({"type": "set_spam_thresholds", "data": data})
+        )
+        response = await self._await_response(
+            "spam_thresholds_set", "spam_error"
+        )
+        if response["type"] == "spam_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("spam_thresholds", {})
+
+    async def set_content_filters(
+        self, room_id: str, username: str, filters: List[Dict]
+    ) -> List[Dict]:
+        """
+        Replace the content filters of a room this user owns or moderates.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner or a moderator
+            filters: The filters in the order they run, each {"type",
+                **options}, e.g. {"type": "banned_words", "words": [...],
+                "action": "redact"} (empty removes them all)
+
+        Returns:
+            list: The room's filters, with their options filled in
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the filters are rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = {"room_id": room_id, "username": username, "filters": filters}
+        await self._send(
+            json.dumps({"type": "set_content_filters", "data": data})
+        )
+        response = await self._await_response(
+            "content_filters_set", "filter_error"
+        )
+        if response["type"] == "filter_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("content_filters", [])
+
+    async def update_room(
+        self, room_id: str, username: str, **changes: Optional[str]
+    ) -> dict:
+        """
+        Change the name, topic or description of a room this user owns
+        or moderates.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner or a moderator
+            **changes: New room_name, topic or description; an empty
+                topic or description clears it
+
+        Returns:
+            dict: The applied changes
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the update is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = dict(changes, room_id=room_id, username=username)
+        await self._send(json.dumps({"type": "update_room", "data": data}))
+        response = await self._await_response(
+            "update_room_success", "room_update_error"
+        )
+        if response["type"] == "room_update_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("changes", {})
+
+    async def edit_message(
+        self, room_id: str, username: str, message_id: str, content: str
+    ) -> dict:
+        """
+        Change the content of a message in a room.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the message's author or a moderator
+            message_id: ID of the message
+            content: The new content
+
+        Returns:
+            dict: The edit_message_success data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the edit is rejected
+        """
+        return await self._edit(
+            "edit_message", room_id, username, message_id, content
+        )
+
+    async def delete_message(
+        self, room_id: str, username: str, message_id: str
+    ) -> dict:
+        """
+        Delete a message in a room, leaving a tombstone in its place.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the message's author or a moderator
+            message_id: ID of the message
+
+        Returns:
+            dict: The delete_message_success data
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the deletion is rejected
+        """
+        return await self._edit("delete_message", room_id, username, message_id)
+
+    async def pin_message(
+        self, room_id: str, username: str, message_id: str
+    ) -> List[str]:
+        """
+        Pin a message to a room this user owns or moderates.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner or a moderator
+            message_id: ID of the message
+
+        Returns:
+            list: IDs of the room's pinned messages, in the order pinned
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the pin is rejected
+        """
+        return await self._pin("pin_message", room_id, username, message_id)
+
+    async def unpin_message(
+        self, room_id: str, username: str, message_id: str
+    ) -> List[str]:
+        """
+        Unpin a pinned message of a room this user owns or moderates.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner or a moderator
+            message_id: ID of the message
+
+        Returns:
+            list: IDs of the room's pinned messages, in the order pinned
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the unpin is rejected
+        """
+        return await self._pin("unpin_message", room_id, username, message_id)
+
+    async def _pin(
+        self, request_type: str, room_id: str, username: str, message_id: str
+    ) -> List[str]:
+        """Send a pin or unpin request and await the room's pins."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = {
+            "room_id": room_id,
+            "username": username,
+            "message_id": message_id,
+        }
+        await self._send(json.dumps({"type": request_type, "data": data}))
+        response = await self._await_response(
+            f"{request_type}_success", "pin_error"
+        )
+        if response["type"] == "pin_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("pinned", [])
+
+    async def _edit(
+        self,
+        request_type: str,
+        room_id: str,
+        username: str,
+        message_id: str,
+        content: Optional[str] = None,
+    ) -> dict:
+        """Send an edit or deletion request and await the result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        request_data = {
+            "room_id": room_id,
+            "username": username,
+            "message_id": message_id,
+        }
+        if content is not None:
+            request_data["content"] = content
+        await self._send(
+            json.dumps({"type": request_type, "data": request_data})
+        )
+        response = await self._await_response(
+            f"{request_type}_success", "message_edit_error"
+        )
+        data = response.get("data", {})
+        if response["type"] == "message_edit_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def react(
+        self,
+        room_id: str,
+        username: str,
+        message_id: str,
+        emoji: str,
+        remove: bool = False,
+    ) -> dict:
+        """
+        Add or remove an emoji reaction to a message in a room.
+
+        Reacting twice with the same emoji, or removing a reaction that
+        isn't there, succeeds without changing anything.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the reacting member
+            message_id: ID of the message
+            emoji: The emoji
+            remove: True to take the reaction back
+
+        Returns:
+            dict: The react_success data, with the message's reactions
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the reaction is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "react",
+                    "data": {
+                        "room_id": room_id,
+                        "username": username,
+                        "message_id": message_id,
+                        "emoji": emoji,
+                        "remove": remove,
+                    },
+                }
+            )
+        )
+        response = await self._await_response("react_success", "reaction_error")
+        data = response.get("data", {})
+        if response["type"] == "reaction_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def mark_read(
+        self, room_id: str, username: str, sequence_number: int
+    ) -> dict:
+        """
+        Mark a room's messages as read up to a sequence number.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the reader
+            sequence_number: Sequence number of the last message read
+
+        Returns:
+            dict: The mark_read_success data (last_read, unread_count,
+            message_counter and every member's read_positions)
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        return await self._read_state(
+            "mark_read",
+            "mark_read_success",
+            {
+                "room_id": room_id,
+                "username": username,
+                "sequence_number": sequence_number,
+            },
+        )
+
+    async def get_read_state(self, room_id: str, username: str) -> dict:
+        """
+        Get the user's unread count and the read positions of a room.
+
+        Use it after reconnecting to render unread counts and "seen by"
+        indicators; it works from any node.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the member asking
+
+        Returns:
+            dict: The read_state data (last_read, unread_count,
+            message_counter and every member's read_positions)
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        return await self._read_state(
+            "get_read_state",
+            "read_state",
+            {"room_id": room_id, "username": username},
+        )
+
+    async def _read_state(
+        self, request_type: str, success_type: str, request_data: dict
+    ) -> dict:
+        """Send a read state request and await the result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps({"type": request_type, "data": request_data})
+        )
+        response = await self._await_response(success_type, "read_state_error")
+        data = response.get("data", {})
+        if response["type"] == "read_state_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def publish_key(
+        self,
+        room_id: str,
+        username: str,
+        key_id: str,
+        algorithm: str,
+        public_key: str,
+    ) -> dict:
+        """
+        Publish the user's public key to a private room.
+
+        Only the public half of the key pair is sent; the node never sees
+        private keys. Publishing again replaces the user's key.
+
+        Args:
+            room_id: ID of the private room
+            username: Username of the member
+            key_id: ID of the key (e.g., its fingerprint)
+            algorithm: Key algorithm (e.g., "x25519")
+            public_key: The public key, base64-encoded
+
+        Returns:
+            dict: The published key (username, key_id, algorithm,
+            public_key and published_at)
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        return await self._room_keys(
+            "publish_key",
+            "publish_key_success",
+            {
+                "room_id": room_id,
+                "username": username,
+                "key_id": key_id,
+                "algorithm": algorithm,
+                "public_key": public_key,
+            },
+        )
+
+    async def get_room_keys(self, room_id: str, username: str) -> dict:
+        """
+        Get the public keys of a private room's members.
+
+        Args:
+            room_id: ID of the private room
+            username: Username of the member asking
+
+        Returns:
+            dict: Maps username -> published key, for members who
+            published one
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        data = await self._room_keys(
+            "get_room_keys",
+            "room_keys",
+            {"room_id": room_id, "username": username},
+        )
+        return data.get("keys", {})
+
+    async def _room_keys(
+        self, request_type: str, success_type: str, request_data: dict
+    ) -> dict:
+        """Send an encryption key request and await the result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps({"type": request_type, "data": request_data})
+        )
+        response = await self._await_response(success_type, "key_error")
+        data = response.get("data", {})
+        if response["type"] == "key_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def _moderate(
+        self,
+        request_type: str,
+        success_type: str,
+        room_id: str,
+        username: str,
+        target: str,
+    ) -> dict:
+        """Send a moderation request and await the result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": request_type,
+                    "data": {
+                        "room_id": room_id,
+                        "username": username,
+                        "target": target,
+                    },
+                }
+            )
+        )
+        response = await self._await_response(success_type, "moderation_error")
+        data = response.get("data", {})
+        if response["type"] == "moderation_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def join_by_invite(
+        self, invite_token: str, username: str
+    ) -> JoinRoomSuccessResponse:
+        """
+        Join a private room with an invite token.
+
+        Args:
+            invite_token: The invite token
+            username: Username of the user joining the room
+
+        Returns:
+            JoinRoomSuccessResponse with room details
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the invite is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "join_by_invite",
+                    "data": {
+                        "invite_token": invite_token,
+                        "username": username,
+                    },
+                }
+            )
+        )
+        response = await self._await_response(
+            "join_room_success", "join_room_error"
+        )
+        if response["type"] == "join_room_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return JoinRoomSuccessResponse.from_dict(response)
+
+    async def send_message(
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+        encryption: Optional[dict] = None,
+        attachments: Optional[List[dict]] = None,
+    ) -> str:
+        """
+        Send a message to a room.
+
+        This is a fire-and-forget operation. The message_sent confirmation
+        and message_status events for the returned ID will come through
+        the message receive loop asynchronously.
+
+        Args:
+            room_id: ID of the room to send the message to
+            username: Username of the sender
+            content: The message content
+            message_id: ID for the message; pass the same ID to retry a
+                message without it being added twice (defaults to a new
+                UUID)
+            reply_to: ID of the message to reply to, making this message
+                part of its thread
+            encryption: Envelope of an end-to-end encrypted message (see
+                publish_key); content is then the base64 ciphertext, which
+                only recipients listed in the envelope can decrypt
+            attachments: References to files uploaded with
+                upload_attachment; content may then be empty
+
+        Returns:
+            str: The message ID
+
+        Raises:
+            ConnectionError: If not connected to a node server
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        logger.info(f"Sending message to room '{room_id}'")
+
+        # Create and send request (fire-and-forget)
+        message_id = message_id or str(uuid.uuid4())
+        request = SendMessageRequest(
+            room_id,
+            username,
+            content,
+            message_id,
+            reply_to,
+            encryption,
+            attachments,
+        )
+        await self._send(request.to_json())
+        return message_id
+
+    async def schedule_message(
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        send_at: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+    ) -> dict:
+        """
+        Schedule a message to be sent to a room later.
+
+        The room's administrator node keeps the message and sends it at
+        send_at, as a new_message like any other, also if this client is
+        offline by then.
+
+        Args:
+            room_id: ID of the room to send the message to
+            username: Username of the sender
+            content: The message content
+            send_at: ISO 8601 time to send it at (UTC if it has no offset)
+            message_id: ID the message is sent with (defaults to a new
+                UUID); also used to cancel it
+            reply_to: ID of the message to reply to
+
+        Returns:
+            dict: The scheduled message, with message_id, send_at and
+            scheduled_at
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the message can't be scheduled
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = {
+            "room_id": room_id,
+            "username": username,
+            "content": content,
+            "send_at": send_at,
+            "message_id": message_id or str(uuid.uuid4()),
+        }
+        if reply_to:
+            data["reply_to"] = reply_to
+        await self._send(json.dumps({"type": "send_message", "data": data}))
+        response = await self._await_response(
+            "message_scheduled", "message_error"
+        )
+        if response["type"] == "message_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("scheduled", {})
+
+    async def list_scheduled(self, room_id: str, username: str) -> List[dict]:
+        """
+        List this user's messages scheduled in a room (everyone's for the
+        room's owner and moderators).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the member
+
+        Returns:
+            list: The scheduled messages, in the order they are due
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        result = await self._schedule_request(
+            "list_scheduled",
+            "scheduled_messages",
+            {"room_id": room_id, "username": username},
+        )
+        return result["scheduled"]
+
+    async def cancel_scheduled(
+        self, room_id: str, username: str, message_id: str
+    ) -> None:
+        """
+        Cancel a message scheduled in a room before it is sent.
+
+        Args:
+            room_id: ID of the room
+            username: Username of its sender, or of the room's owner or a
+                moderator
+            message_id: ID of the scheduled message
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        await self._schedule_request(
+            "cancel_scheduled",
+            "scheduled_cancelled",
+            {
+                "room_id": room_id,
+                "username": username,
+                "message_id": message_id,
+            },
+        )
+
+    async def _schedule_request(
+        self, request_type: str, response_type: str, data: dict
+    ) -> dict:
+        """Send a scheduled message request and wait for its result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(json.dumps({"type": request_type, "data": data}))
+        response = await self._await_response(response_type, "schedule_error")
+        if response["type"] == "schedule_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def upload_attachment(
+        self,
+        room_id: str,
+        username: str,
+        data: bytes,
+        filename: str,
+        content_type: str = "application/octet-stream",
+    ) -> dict:
+        """
+        Upload a file to attach to messages in a room.
+
+        The file is sent in chunks of the size the node asks for; a file
+        the node already has is not sent again.
+
+        Args:
+            room_id: ID of the room the file will be attached in
+            username: Username of the uploader
+            data: The file's content
+            filename: Name of the file
+            content_type: MIME type of the file
+
+        Returns:
+            dict: The attachment reference (hash, size, content_type and
+            filename) to pass to send_message
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the upload is rejected
+        """
+        started = await self._attachment_request(
+            "start_upload",
+            ("upload_started", "upload_complete"),
+            {
+                "room_id": room_id,
+                "username": username,
+                "hash": hashlib.sha256(data).hexdigest(),
+                "size": len(data),
+                "content_type": content_type,
+                "filename": filename,
+            },
+        )
+        if "attachment" in started:
+            return started["attachment"]
+
+        upload_id = started["upload_id"]
+        chunk_size = started["chunk_size"]
+        for offset in range(0, len(data), chunk_size):
+            chunk = data[offset : offset + chunk_size]
+            await self._attachment_request(
+                "upload_chunk",
+                ("upload_progress",),
+                {
+                    "upload_id": upload_id,
+                    "username": username,
+                    "offset": offset,
+                    "data": base64.b64encode(chunk).decode("ascii"),
+                },
+            )
+        finished = await self._attachment_request(
+            "finish_upload",
+            ("upload_complete",),
+            {"upload_id": upload_id, "username": username},
+        )
+        return finished["attachment"]
+
+    async def download_attachment(
+        self, room_id: str, username: str, sha256: str
+    ) -> bytes:
+        """
+        Download an attached file.
+
+        Args:
+            room_id: ID of a room the file is attached in
+            username: Username of the member downloading it
+            sha256: The attachment's hash
+
+        Returns:
+            bytes: The file's content
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the file can't be downloaded or doesn't match
+                its hash
+        """
+        content = bytearray()
+        while True:
+            chunk = await self._attachment_request(
+                "get_attachment",
+                ("attachment_chunk",),
+                {
+                    "room_id": room_id,
+                    "username": username,
+                    "hash": sha256,
+                    "offset": len(content),
+                },
+            )
+            content.extend(base64.b64decode(chunk["data"]))
+            if chunk["done"]:
+                break
+        if hashlib.sha256(content).hexdigest() != sha256:
+            raise ValueError("Downloaded file doesn't match its hash")
+        return bytes(content)
+
+    async def _attachment_request(
+        self, request_type: str, success_types: tuple, request_data: dict
+    ) -> dict:
+        """Send an attachment request and await the result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps({"type": request_type, "data": request_data})
+        )
+        response = await self._await_response(*success_types, "upload_error")
+        data = response.get("data", {})
+        if response["type"] == "upload_error":
+            raise NodeError.from_data(data)
+        return data
+
+    async def send_receipt(
+        self, room_id: str, message_id: str, username: str
+    ) -> None:
+        """
+        Confirm receipt of a room message to its sender.
+
+        The sender gets a message_status event with status "delivered".
+
+        Args:
+            room_id: ID of the room the message was sent to
+            message_id: ID of the received message
+            username: Username of the recipient
+
+        Raises:
+            ConnectionError: If not connected to a node server
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        request = json.dumps(
+            {
+                "type": "message_received",
+                "data": {
+                    "room_id": room_id,
+                    "message_id": message_id,
+                    "username": username,
+                },
+            }
+        )
+        await self._send(request)
+
+    async def send_pong(
+        self, sequences: Optional[Dict[str, int]] = None
+    ) -> None:
+        """
+        Answer a ping from the node.
+
+        With sequences, the node sends again the messages of each room
+        after the reported sequence number that the client is missing,
+        as new_message events with retransmitted set.
+
+        Args:
+            sequences: Maps room_id -> highest sequence number received
+                without a gap
+
+        Raises:
+            ConnectionError: If not connected to a node server
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        request = {"type": "pong"}
+        if sequences:
+            request["data"] = {"sequences": sequences}
+        await self._send(json.dumps(request))
+
+    async def send_typing(
+        self, room_id: str, username: str, typing: bool = True
+    ) -> None:
+        """
+        Tell the other members of a room that the user is typing.
+
+        Call it as the user types; the node passes on at most one update
+        every few seconds, and the indicator expires on its own.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the user typing
+            typing: False once the user stopped typing
+
+        Raises:
+            ConnectionError: If not connected to a node server
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        request = json.dumps(
+            {
+                "type": "typing",
+                "data": {
+                    "room_id": room_id,
+                    "username": username,
+                    "typing": typing,
+                },
+            }
+        )
+        await self._send(request)
+
+    async def send_direct_message(
+        self, recipient: str, username: str, content: str
+    ) -> None:
+        """
+        Send a direct message to another user.
+
+        This is a fire-and-forget operation. The direct_message_sent
+        confirmation, with status "delivered" or "buffered", will come
+        through the message receive loop asynchronously.
+
+        Args:
+            recipient: Username of the recipient
+            username: Username of the sender
+            content: The message content
+
+        Raises:
+            ConnectionError: If not connected to a node server
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        logger.info(f"Sending direct message to '{recipient}'")
+
+        request = json.dumps(
+            {
+                "type": "send_direct_message",
+                "data": {
+                    "recipient": recipient,
+                    "username": username,
+                    "content": content,
+                },
+            }
+        )
+        await self._send(request)
+
+    async def announce_presence(self, username: str) -> dict:
+        """
+        Go online as a user to receive direct messages.
+
+        Direct messages buffered for the user on this node arrive through
+        the message receive loop right after the response.
+
+        Args:
+            username: The username to go online as
+
+        Returns:
+            dict: The presence_announced data, including the number of
+            pending direct messages
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {"type": "announce_presence", "data": {"username": username}}
+            )
+        )
+        response = await self._await_response(
+            "presence_announced", "presence_error"
+        )
+        if response["type"] == "presence_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def resume_session(
+        self,
+        username: Optional[str] = None,
+        last_seen: Optional[Dict[str, int]] = None,
+    ) -> dict:
+        """
+        Resume the user's session after reconnecting to the same node.
+
+        The session ID the node gave the previous connection is sent when
+        known. The node puts this connection back into the user's rooms,
+        restores their presence status and replays the messages missed
+        while disconnected; they arrive as new_message events after this
+        returns.
+
+        Args:
+            username: The username; optional when the previous connection
+                was given a session ID
+            last_seen: Maps room_id -> highest sequence number received
+
+        Returns:
+            dict: Rooms resumed ("rooms"), number of messages replayed
+            ("replayed"), whether some were dropped ("truncated") and the
+            restored presence status ("status")
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If there is no session to resume; join the rooms
+                again instead
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = {"last_seen": last_seen or {}}
+        if username:
+            data["username"] = username
+        if self._previous_session_id:
+            data["session_id"] = self._previous_session_id
+        await self._send(json.dumps({"type": "resume_session", "data": data}))
+        response = await self._await_response("session_resumed", "resume_error")
+        # The previous session is resumed or gone either way
+        self._previous_session_id = None
+        if response["type"] == "resume_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def set_status(self, username: str, status: str) -> None:
+        """
+        Set the user's presence status.
+
+        Members of the user's rooms receive a presence_update event.
+
+        Args:
+            username: The username
+            status: "online" or "away"
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the status is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "set_status",
+                    "data": {"username": username, "status": status},
+                }
+            )
+        )
+        response = await self._await_response("status_updated", "status_error")
+        if response["type"] == "status_error":
+            raise NodeError.from_data(response.get("data", {}))
+
+    async def get_presence(self, room_id: str) -> Dict[str, str]:
+        """
+        Get the presence status of a room's members.
+
+        Args:
+            room_id: ID of the room
+
+        Returns:
+            dict: Maps each member's username to "online", "away" or
+            "offline"
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps({"type": "get_presence", "data": {"room_id": room_id}})
+        )
+        response = await self._await_response("presence", "presence_error")
+        if response["type"] == "presence_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("users", {})
+
+    async def update_profile(self, username: str, **fields: str) -> dict:
+        """
+        Change the user's profile.
+
+        Args:
+            username: Username of the user
+            fields: Any of display_name, avatar_url, avatar_hash and bio;
+                an empty string clears a field
+
+        Returns:
+            dict: The whole updated profile
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the profile is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "update_profile",
+                    "data": dict(fields, username=username),
+                }
+            )
+        )
+        response = await self._await_response(
+            "update_profile_success", "profile_error"
+        )
+        if response["type"] == "profile_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def register_push_token(
+        self, username: str, token: str, platform: str
+    ) -> dict:
+        """
+        Register this device's push token for notifications while offline.
+
+        Args:
+            username: Username of the user
+            token: The device's FCM or APNs push token
+            platform: "fcm" or "apns"
+
+        Returns:
+            dict: The registration, with the number of tokens the user has
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the token is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "register_push_token",
+                    "data": {
+                        "username": username,
+                        "token": token,
+                        "platform": platform,
+                    },
+                }
+            )
+        )
+        response = await self._await_response(
+            "push_token_registered", "push_error"
+        )
+        if response["type"] == "push_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def unregister_push_token(self, username: str, token: str) -> dict:
+        """
+        Stop push notifications to a device.
+
+        Args:
+            username: Username of the user
+            token: The push token registered for the device
+
+        Returns:
+            dict: The removal, with the number of tokens the user has left
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the token is not registered
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "unregister_push_token",
+                    "data": {"username": username, "token": token},
+                }
+            )
+        )
+        response = await self._await_response(
+            "push_token_unregistered", "push_error"
+        )
+        if response["type"] == "push_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def get_profiles(self, room_id: str) -> Dict[str, Optional[dict]]:
+        """
+        Get the profiles of a room's members.
+
+        Args:
+            room_id: ID of the room
+
+        Returns:
+            dict: Maps each member's username to their profile, or None if
+            they have not set one
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps({"type": "get_profile", "data": {"room_id": room_id}})
+        )
+        response = await self._await_response("profiles", "profile_error")
+        if response["type"] == "profile_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("profiles", {})
+
+    async def update_mutes(self, username: str, **changes) -> dict:
+        """
+        Change the rooms and users this user muted.
+
+        Args:
+            username: Username of the user
+            changes: Any of mute_rooms, unmute_rooms, mute_users and
+                unmute_users (lists), and filter_muted_users (bool) to
+                have the node leave muted users' messages out; without
+                changes, the current mutes are reported
+
+        Returns:
+            dict: muted_rooms, muted_users and filter_muted_users
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the change is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "update_mutes",
+                    "data": dict(changes, username=username),
+                }
+            )
+        )
+        response = await self._await_response("mutes_updated", "mutes_error")
+        if response["type"] == "mutes_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def block_user(
+        self, username: str, user: str, unblock: bool = False
+    ) -> List[str]:
+        """
+        Block or unblock a user on every node and device of this user.
+
+        Args:
+            username: Username of the blocking user
+            user: Username of the user to block or unblock
+            unblock: True to lift the block
+
+        Returns:
+            list: Usernames of every user this user blocked
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the change is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {
+                    "type": "block_user",
+                    "data": {
+                        "username": username,
+                        "user": user,
+                        "unblock": unblock,
+                    },
+                }
+            )
+        )
+        response = await self._await_response("blocks_updated", "block_error")
+        if response["type"] == "block_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {}).get("blocked", [])
+
+    async def get_protocol_info(self, schemas: bool = False) -> dict:
+        """
+        Ask the node which commands, events and versions it supports.
+
+        Args:
+            schemas: Whether to include each command's JSON Schema
+
+        Returns:
+            dict: protocol_version, commands, events and
+            node_protocol_version
+
+        Raises:
+            ConnectionError: If not connected to a node server
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(
+            json.dumps(
+                {"type": "protocol_info", "data": {"schemas": schemas}}
+            )
+        )
+        response = await self._await_response("protocol_info")
+        return response.get("data", {})
+
+    async def get_history(
+        self,
+        room_id: str,
+        username: str,
+        before: Optional[str] = None,
+        after: Optional[str] = None,
+        limit: Optional[int] = None,
+        thread_id: Optional[str] = None,
+    ) -> dict:
+        """
+        Get a page of a room's message history.
+
+        To page backwards, pass the message_id of the oldest message
+        received as ``before`` until "has_more" is False. Messages with
+        replies carry a "thread" summary (reply_count, last_reply_at).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the user asking
+            before: Get the messages just before this message ID
+            after: Get the messages just after this message ID
+            limit: Maximum number of messages (the node's default if None)
+            thread_id: Get only this message and the replies below it
+
+        Returns:
+            dict: The page's messages, oldest first ("messages"), whether
+            there are more in that direction ("has_more"), and whether
+            older messages were removed by the room's retention policy
+            ("truncated"), and the IDs of the room's pinned messages
+            ("pinned")
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = {"room_id": room_id, "username": username}
+        if before:
+            data["before"] = before
+        if after:
+            data["after"] = after
+        if limit is not None:
+            data["limit"] = limit
+        if thread_id:
+            data["thread_id"] = thread_id
+        await self._send(json.dumps({"type": "get_history", "data": data}))
+        response = await self._await_response("history", "history_error")
+        if response["type"] == "history_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def search_messages(
+        self,
+        room_id: str,
+        username: str,
+        query: str = "",
+        author: Optional[str] = None,
+        since: Optional[str] = None,
+        until: Optional[str] = None,
+        limit: Optional[int] = None,
+    ) -> dict:
+        """
+        Search a room's message history.
+
+        Args:
+            room_id: ID of the room
+            username: Username of the user searching
+            query: Words that must all appear in a message
+            author: Only messages by this user
+            since: Only messages sent at or after this ISO 8601 time
+            until: Only messages sent at or before this ISO 8601 time
+            limit: Most messages returned (the node's default if None)
+
+        Returns:
+            dict: The matching messages, newest first ("messages"), and
+            the number of matches ("total")
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the search is rejected
+        """
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        data = {"room_id": room_id, "username": username, "query": query}
+        if author:
+            data["author"] = author
+        if since:
+            data["since"] = since
+        if until:
+            data["until"] = until
+        if limit is not None:
+            data["limit"] = limit
+        await self._send(json.dumps({"type": "search", "data": data}))
+        response = await self._await_response("search_results", "search_error")
+        if response["type"] == "search_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def register_webhook(
+        self,
+        room_id: str,
+        username: str,
+        url: str,
+        events: Optional[List[str]] = None,
+    ) -> dict:
+        """
+        Register a webhook for a room's events (room owners only).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+            url: http:// or https:// URL the events are POSTed to
+            events: Events to deliver (all events if None)
+
+        Returns:
+            dict: The webhook, including the secret its requests are
+            signed with
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the webhook is rejected
+        """
+        data = {"room_id": room_id, "username": username, "url": url}
+        if events is not None:
+            data["events"] = list(events)
+        result = await self._webhook_request(
+            "register_webhook", "webhook_registered", data
+        )
+        return result["webhook"]
+
+    async def remove_webhook(
+        self, room_id: str, username: str, webhook_id: str
+    ) -> None:
+        """
+        Remove a room's webhook (room owners only).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+            webhook_id: ID of the webhook
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the webhook could not be removed
+        """
+        await self._webhook_request(
+            "remove_webhook",
+            "webhook_removed",
+            {
+                "room_id": room_id,
+                "username": username,
+                "webhook_id": webhook_id,
+            },
+        )
+
+    async def list_webhooks(self, room_id: str, username: str) -> List[dict]:
+        """
+        List a room's webhooks, without their secrets (room owners only).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+
+        Returns:
+            list: The webhooks, oldest first
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        result = await self._webhook_request(
+            "list_webhooks",
+            "webhooks",
+            {"room_id": room_id, "username": username},
+        )
+        return result["webhooks"]
+
+    async def _webhook_request(
+        self, request_type: str, response_type: str, data: dict
+    ) -> dict:
+        """Send a webhook request and wait for its result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(json.dumps({"type": request_type, "data": data}))
+        response = await self._await_response(response_type, "webhook_error")
+        if response["type"] == "webhook_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def register_bot(
+        self, username: str, bot_name: str, commands: List[str]
+    ) -> dict:
+        """
+        Register a bot on the connected node.
+
+        Args:
+            username: Username of the bot's owner
+            bot_name: Name the bot acts as in rooms
+            commands: Commands routed to the bot, like "/roll"
+
+        Returns:
+            dict: The bot ("bot") and its API key ("api_key"), which the
+            node doesn't show again
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the bot is rejected
+        """
+        return await self._bot_request(
+            "register_bot",
+            "bot_registered",
+            {
+                "username": username,
+                "bot_name": bot_name,
+                "commands": list(commands),
+            },
+        )
+
+    async def remove_bot(self, username: str, bot_name: str) -> None:
+        """
+        Remove one of the user's bots.
+
+        Args:
+            username: Username of the bot's owner
+            bot_name: The bot's name
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the bot could not be removed
+        """
+        await self._bot_request(
+            "remove_bot",
+            "bot_removed",
+            {"username": username, "bot_name": bot_name},
+        )
+
+    async def list_bots(self, username: str) -> List[dict]:
+        """
+        List the bots a user registered on the connected node.
+
+        Args:
+            username: Username of the bots' owner
+
+        Returns:
+            list: The bots, by name
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        data = await self._bot_request(
+            "list_bots", "bots", {"username": username}
+        )
+        return data["bots"]
+
+    async def _bot_request(
+        self, request_type: str, response_type: str, data: dict
+    ) -> dict:
+        """Send a bot request and wait for its result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(json.dumps({"type": request_type, "data": data}))
+        response = await self._await_response(response_type, "bot_error")
+        if response["type"] == "bot_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
+
+    async def add_bridge(
+        self, room_id: str, username: str, protocol: str, settings: dict
+    ) -> dict:
+        """
+        Bridge a room to an IRC channel or a Matrix room (room owners only).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+            protocol: "irc" or "matrix"
+            settings: The network's settings, e.g. server, channel and
+                nick for IRC
+
+        Returns:
+            dict: The bridge, without passwords and tokens
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the bridge is rejected
+        """
+        result = await self._bridge_request(
+            "add_bridge",
+            "bridge_added",
+            {
+                "room_id": room_id,
+                "username": username,
+                "protocol": protocol,
+                "settings": dict(settings),
+            },
+        )
+        return result["bridge"]
+
+    async def remove_bridge(
+        self, room_id: str, username: str, bridge_id: str
+    ) -> None:
+        """
+        Remove a room's bridge (room owners only).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+            bridge_id: ID of the bridge
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the bridge could not be removed
+        """
+        await self._bridge_request(
+            "remove_bridge",
+            "bridge_removed",
+            {"room_id": room_id, "username": username, "bridge_id": bridge_id},
+        )
+
+    async def list_bridges(self, room_id: str, username: str) -> List[dict]:
+        """
+        List a room's bridges (room owners only).
+
+        Args:
+            room_id: ID of the room
+            username: Username of the room owner
+
+        Returns:
+            list: The bridges, oldest first
+
+        Raises:
+            ConnectionError: If not connected to a node server
+            ValueError: If the request is rejected
+        """
+        result = await self._bridge_request(
+            "list_bridges",
+            "bridges",
+            {"room_id": room_id, "username": username},
+        )
+        return result["bridges"]
+
+    async def _bridge_request(
+        self, request_type: str, response_type: str, data: dict
+    ) -> dict:
+        """Send a bridge request and wait for its result."""
+        if not self.is_connected:
+            raise ConnectionError("Not connected to a node server")
+
+        await self._send(json.dumps({"type": request_type, "data": data}))
+        response = await self._await_response(response_type, "bridge_error")
+        if response["type"] == "bridge_error":
+            raise NodeError.from_data(response.get("data", {}))
+        return response.get("data", {})
 
     async def leave_room(self, room_id: str, username: str) -> None:
         """
@@ -380,7 +2522,7 @@ class ClientService:
                 },
             }
         )
-        await self.websocket.send(request)
+        await self._send(request)
 
     async def delete_room(self, room_id: str, username: str) -> None:
         """
@@ -413,4 +2555,4 @@ class ClientService:
                 },
             }
         )
-        await self.websocket.send(request)
+        await self._send(request)
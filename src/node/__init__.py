@@ -24,6 +24,125 @@ from .room_state import (
 from .websocket_server import WebSocketServer
 from .xmlrpc_server import XMLRPCServer
 from .peer_registry import PeerRegistry
+from .connection_registry import ConnectionRegistry, ClientConnection
+from .room_directory import RoomDirectory, DirectoryEntry
+from .anti_entropy import AntiEntropy
+from .tpc import (
+    TPCCoordinator,
+    TPCParticipant,
+    TransactionHandler,
+    TransactionLog,
+    TransactionStore,
+)
+from .vector_clock import VectorClock, CausalBuffer
+from .clock import HLCTimestamp, HybridLogicalClock, LamportClock
+from .dedup import DedupWindow, DuplicateMessageError
+from .send_queue import SendQueue
+from .dispatch import KeyedDispatcher, KeyedWorkerPool
+from .message_streams import MessageStreams, PeerStream, StreamReceiver
+from .compression import CompressionError
+from .peer_connections import (
+    PeerConnection,
+    PeerConnections,
+    PeerUnavailableError,
+)
+from .clock_skew import ClockSkewMonitor
+from .delivery import DELIVERY_GUARANTEES, DeliveryPolicy, delivery_policy
+from .ephemeral import EphemeralReaper
+from .scheduled import ScheduleError
+from .placement import RoomPlacement
+from .durability import write_quorum
+from .member_set import MemberSet
+from .migration import RoomMigrator
+from .stream_repair import StreamRepair
+from .service_accounts import ServiceAccountRegistry
+from .routing import LatencyRouter
+from .capacity import CapacityError
+from .edits import EditError
+from .profiles import ProfileError, ProfileRegistry
+from .spam import SpamDetector, SpamError
+from .content_filters import (
+    ContentFilter,
+    ContentFilterError,
+    FilterChain,
+    FilterRegistry,
+)
+from .push import (
+    Notifier,
+    PushDispatcher,
+    PushError,
+    PushGatewayNotifier,
+    PushTokenRegistry,
+)
+from .reactions import ReactionError
+from .read_receipts import ReadReceiptError
+from .threads import ThreadError
+from .typing_indicators import TypingThrottle
+from .total_order import SequenceBuffer, SequenceGap
+from .failure_detector import (
+    FailureDetector,
+    MembershipEvent,
+    PeerState,
+    PeerStatus,
+)
+from .failover import ReplicaStore, RoomFailover, RoomReplica
+from .snapshot import RoomSnapshot, SnapshotReceiver, SnapshotSender
+from .archive import ArchiveError, ArchiveStore
+from .export import ExportError
+from .seed import SeedError
+from .replication import ReplicationManager
+from .discovery import PeerDiscovery
+from .invites import InviteError, RoomInvite
+from .moderation import ModerationError
+from .roles import RoleError, has_permission
+from .presence import PresenceDirectory, PresenceEntry
+from .direct_messages import DirectMessage, DirectMessageBuffer
+from .receipts import DeliveryReceipt, ReceiptTracker
+from .offline_queue import OfflineQueue, OfflineSession
+from .orphans import OrphanReaper
+from .history import paginate_history
+from .wal import MessageLog, SegmentedLog
+from .storage import MemoryStorage, Storage
+from .sqlite_storage import SQLiteStorage
+from .compaction import Compactor, RetentionPolicy
+from .membership import ClusterMembership, MembershipView
+from .raft import RaftNode, RaftRoomRegistry, RaftStore
+from .partition import PartitionError, PartitionManager
+from .e2ee import E2EEError, validate_encrypted_message
+from .attachments import (
+    AttachmentError,
+    AttachmentManager,
+    BlobStore,
+    validate_attachments,
+)
+from .search import SearchError, SearchIndex
+from .egress import EgressError, EgressPolicy
+from .webhooks import WebhookDispatcher, WebhookError
+from .bots import BotError, BotRegistry
+from .bridges import BridgeError, BridgeManager
+from .sharding import HashRing, RoomSharding
+from .load_balancing import LoadBalancer, NodeLoad
+from .config_reload import ConfigReloader
+from .retention import RetentionError, RetentionReaper
+from .announcements import AnnouncementError
+from .pins import PinError
+from .room_metadata import RoomUpdateError
+from .mutes import MuteError, MuteRegistry
+from .audit import AuditEntry, AuditLog
+from .versioning import IncompatiblePeerError, negotiate_version
+from .simulation import SimulatedNetwork, SimulatedNode, Simulation
+from .cluster_harness import ClusterHarness, ComposeCluster, FakeClient
+from .faults import FaultInjector
+from .health import HealthChecker
+from .keepalive import KeepaliveMonitor
+from .stats import ClusterStats, NodeStats
+from .metrics import MetricsRegistry, MetricsServer, NodeMetrics
+from .log_context import configure_logging, log_context
+from .tracing import OTLPExporter, configure_tracing, start_span
+from .tls import TLSManager
+from .rate_limit import RateLimit, RateLimiter
+from .admin_api import AdminAPI, AdminServer
+from .auth import AuthManager, AuthError, TokenSigner
 
 __all__ = [
     "RoomStateManager",
@@ -43,4 +162,169 @@ __all__ = [
     "WebSocketServer",
     "XMLRPCServer",
     "PeerRegistry",
+    "ConnectionRegistry",
+    "ClientConnection",
+    "RoomDirectory",
+    "AntiEntropy",
+    "DirectoryEntry",
+    "TPCCoordinator",
+    "TPCParticipant",
+    "TransactionHandler",
+    "TransactionLog",
+    "TransactionStore",
+    "VectorClock",
+    "CausalBuffer",
+    "HLCTimestamp",
+    "HybridLogicalClock",
+    "LamportClock",
+    "DedupWindow",
+    "DuplicateMessageError",
+    "SendQueue",
+    "KeyedDispatcher",
+    "KeyedWorkerPool",
+    "MessageStreams",
+    "PeerStream",
+    "StreamReceiver",
+    "CompressionError",
+    "PeerConnection",
+    "PeerConnections",
+    "PeerUnavailableError",
+    "ClockSkewMonitor",
+    "DELIVERY_GUARANTEES",
+    "DeliveryPolicy",
+    "delivery_policy",
+    "EphemeralReaper",
+    "ScheduleError",
+    "RoomPlacement",
+    "write_quorum",
+    "MemberSet",
+    "RoomMigrator",
+    "StreamRepair",
+    "ServiceAccountRegistry",
+    "LatencyRouter",
+    "CapacityError",
+    "EditError",
+    "ProfileError",
+    "ProfileRegistry",
+    "SpamDetector",
+    "SpamError",
+    "ContentFilter",
+    "ContentFilterError",
+    "FilterChain",
+    "FilterRegistry",
+    "Notifier",
+    "PushDispatcher",
+    "PushError",
+    "PushGatewayNotifier",
+    "PushTokenRegistry",
+    "ReactionError",
+    "ReadReceiptError",
+    "ThreadError",
+    "TypingThrottle",
+    "SequenceBuffer",
+    "SequenceGap",
+    "FailureDetector",
+    "MembershipEvent",
+    "PeerState",
+    "PeerStatus",
+    "ReplicaStore",
+    "RoomFailover",
+    "RoomReplica",
+    "RoomSnapshot",
+    "SnapshotReceiver",
+    "SnapshotSender",
+    "ArchiveError",
+    "ArchiveStore",
+    "ExportError",
+    "SeedError",
+    "ReplicationManager",
+    "PeerDiscovery",
+    "InviteError",
+    "RoomInvite",
+    "ModerationError",
+    "RoleError",
+    "has_permission",
+    "PresenceDirectory",
+    "PresenceEntry",
+    "DirectMessage",
+    "DirectMessageBuffer",
+    "DeliveryReceipt",
+    "ReceiptTracker",
+    "OfflineQueue",
+    "OfflineSession",
+    "OrphanReaper",
+    "paginate_history",
+    "MessageLog",
+    "SegmentedLog",
+    "Storage",
+    "MemoryStorage",
+    "SQLiteStorage",
+    "Compactor",
+    "RetentionPolicy",
+    "ClusterMembership",
+    "MembershipView",
+    "RaftNode",
+    "RaftRoomRegistry",
+    "RaftStore",
+    "PartitionError",
+    "PartitionManager",
+    "E2EEError",
+    "validate_encrypted_message",
+    "AttachmentError",
+    "AttachmentManager",
+    "BlobStore",
+    "validate_attachments",
+    "SearchError",
+    "SearchIndex",
+    "EgressError",
+    "EgressPolicy",
+    "WebhookDispatcher",
+    "WebhookError",
+    "BotError",
+    "BotRegistry",
+    "BridgeError",
+    "BridgeManager",
+    "HashRing",
+    "RoomSharding",
+    "LoadBalancer",
+    "NodeLoad",
+    "ConfigReloader",
+    "RetentionError",
+    "RetentionReaper",
+    "AnnouncementError",
+    "PinError",
+    "RoomUpdateError",
+    "MuteError",
+    "MuteRegistry",
+    "AuditEntry",
+    "AuditLog",
+    "IncompatiblePeerError",
+    "negotiate_version",
+    "SimulatedNetwork",
+    "SimulatedNode",
+    "Simulation",
+    "ClusterHarness",
+    "ComposeCluster",
+    "FakeClient",
+    "FaultInjector",
+    "HealthChecker",
+    "KeepaliveMonitor",
+    "ClusterStats",
+    "NodeStats",
+    "MetricsRegistry",
+    "MetricsServer",
+    "NodeMetrics",
+    "configure_logging",
+    "log_context",
+    "OTLPExporter",
+    "configure_tracing",
+    "start_span",
+    "TLSManager",
+    "RateLimit",
+    "RateLimiter",
+    "AdminAPI",
+    "AdminServer",
+    "AuthManager",
+    "AuthError",
+    "TokenSigner",
 ]
@@ -0,0 +1,1007 @@
+"""
+Admin HTTP API
+
+A REST API for operators, served by AdminServer next to the WebSocket and
+XML-RPC servers. It lists what the node is doing and lets operators close
+rooms and disconnect clients without a chat client:
+
+    GET  /admin/rooms                         Rooms hosted on this node
+    GET  /admin/clients                       Connected WebSocket clients
+    GET  /admin/peers                         Peers, health, membership view
+    GET  /admin/transactions                  In-flight 2PC transactions
+    GET  /admin/transactions/in-doubt         2PC transactions recovery
+                                              couldn't decide, with votes
+    GET  /admin/audit                         Audit log entries (filtered by
+                                              since, until, actor, action
+                                              and limit query parameters)
+    GET  /admin/stats                         Cluster and room statistics
+                                              (optional room_id)
+    GET  /admin/archives                      Rooms archived on this node
+    GET  /admin/rooms/<room_id>/export        Stream a hosted or archived
+                                              room's full history (format,
+                                              since and until)
+    POST /admin/rooms/<room_id>/close         Delete a hosted room
+    POST /admin/rooms/<room_id>/archive       Archive a hosted room
+    POST /admin/rooms/<room_id>/migrate       Move a hosted room to another
+                                              node (node)
+    POST /admin/archives/<room_id>/restore    Host an archived room again,
+                                              here or on another node (node)
+    POST /admin/clients/<client_id>/disconnect  Close a client connection
+    GET  /admin/service-accounts              Provisioned service accounts
+    POST /admin/service-accounts              Provision a service account
+                                              from a JSON body (name,
+                                              scopes and optional rooms)
+    POST /admin/service-accounts/<name>/remove  Remove a service account,
+                                              closing its connections
+    POST /admin/transactions/<id>/commit      Force an in-doubt transaction
+    POST /admin/transactions/<id>/abort       to an outcome (confirm=yes)
+    POST /admin/config/reload                 Reload the configuration
+    POST /admin/seed                          Create rooms with members and
+                                              history from a JSON fixture
+                                              in the request body
+    GET  /admin/faults                        Faults armed on this node
+    POST /admin/faults/crash                  Crash at a 2PC phase (phase)
+    POST /admin/faults/delay                  Delay calls of an RPC (method,
+                                              seconds and optional count)
+    POST /admin/faults/heartbeats             Drop heartbeats (count or
+                                              seconds)
+    POST /admin/faults/clear                  Remove every armed fault
+
+Archived rooms are read-only and kept in the node's archive (see
+archive.py). Restoring one on another node hands it off the way a
+graceful shutdown does, so it needs failover enabled; if the node doesn't
+take the room, it stays archived. Migrating a room moves it the same way
+while requests on it wait (see migration.py, whose command calls the
+endpoint).
+
+Exports stream one message per line as NDJSON (format=ndjson, the
+default) or a JSON array (format=json), limited to messages sent between
+the ISO 8601 times since and until (see export.py). They are written as
+they are read from storage, on the request's thread rather than the event
+loop, so the body isn't held in memory and has no Content-Length.
+
+POST /admin/seed takes a fixture as its JSON body (see seed.py, whose
+command posts fixture files); bodies are limited to MAX_BODY_SIZE.
+
+Provisioning a service account returns its API key, which is shown only
+once (see service_accounts.py); provisioning and removals are recorded in
+the audit log.
+
+The /admin/faults endpoints are only served with fault_injection enabled
+(see faults.py); they take their settings as query parameters.
+
+Forcing a transaction overrides 2PC: if other participants decided
+differently, the nodes disagree about the operation's effects. Requests
+without confirm=yes are refused with CONFIRMATION_REQUIRED and the
+warning, and forced outcomes are recorded in the audit log.
+
+Every request must carry the admin token as "Authorization: Bearer
+<token>". Other responses are JSON; errors have the same error, error_code,
+category and retryable fields as the node's other responses (see
+schemas/errors.py).
+
+Requests are served on their own threads but handled on the node's event
+loop, so handlers see the servers' state as the event loop does.
+"""
+
+import asyncio
+import hmac
+import json
+import logging
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from threading import Thread
+from typing import Any, Dict, Iterable, Optional, Tuple, Union
+from urllib.parse import parse_qs
+
+from .archive import ArchiveError
+from .audit import (
+    AUDIT_QUERY_LIMIT,
+    HISTORY_EXPORTED,
+    SERVICE_ACCOUNT_CREATED,
+    SERVICE_ACCOUNT_REMOVED,
+    TRANSACTION_FORCED,
+    audit,
+)
+from .export import (
+    DEFAULT_EXPORT_FORMAT,
+    EXPORT_FORMATS,
+    ExportError,
+    encode_export,
+    export_filename,
+    parse_range,
+)
+from .faults import FaultError
+from .room_state import TransactionState
+from .schemas.errors import annotate_error, error_fields
+from .seed import SeedError, parse_fixture
+from .service_accounts import ServiceAccountError
+
+logger = logging.getLogger(__name__)
+
+# Admin API configuration
+DEFAULT_ADMIN_PORT = 0  # 0 disables the API
+ADMIN_PREFIX = "/admin"
+# Seconds a request may take on the event loop (closing a room runs 2PC)
+REQUEST_TIMEOUT = 30
+MAX_BODY_SIZE = 16 * 1024 * 1024  # bytes of a request body (seed fixtures)
+
+# Who closed rooms are reported to their members as closed by
+ADMIN_INITIATOR = "admin"
+
+# Shown before, and with the result of, forcing a transaction
+FORCE_WARNING = (
+    "Forcing a 2PC outcome bypasses the protocol: participants that "
+    "decided differently will disagree with this node"
+)
+
+# Forcing endpoint -> decision
+_FORCED_DECISIONS = {
+    "commit": TransactionState.COMMIT,
+    "abort": TransactionState.ROLLBACK,
+}
+
+# HTTP status of each error code
+_ERROR_STATUS = {
+    "UNAUTHORIZED": 401,
+    "NOT_FOUND": 404,
+    "ROOM_NOT_FOUND": 404,
+    "CLIENT_NOT_FOUND": 404,
+    "METHOD_NOT_ALLOWED": 405,
+    "INVALID_STATE": 409,
+    "DELETION_FAILED": 409,
+    "INVALID_CONFIG": 422,
+    "RELOAD_UNSUPPORTED": 404,
+    "INVALID_QUERY": 400,
+    "AUDIT_UNSUPPORTED": 404,
+    "FAULTS_DISABLED": 404,
+    "INVALID_FAULT": 400,
+    "TRANSACTION_NOT_FOUND": 404,
+    "CONFIRMATION_REQUIRED": 428,
+    "ARCHIVE_NOT_FOUND": 404,
+    "ROOM_EXISTS": 409,
+    "ROOM_NAME_TAKEN": 409,
+    "HANDOFF_UNSUPPORTED": 404,
+    "HANDOFF_FAILED": 502,
+    "INVALID_REQUEST": 400,
+    "INVALID_FIXTURE": 400,
+    "BODY_TOO_LARGE": 413,
+    "PEER_UNAVAILABLE": 503,
+    "PLACEMENT_MISMATCH": 409,
+    "ROOM_MIGRATING": 409,
+    "MIGRATION_TIMEOUT": 504,
+    "SERVICE_ACCOUNTS_DISABLED": 404,
+    "ACCOUNT_NOT_FOUND": 404,
+    "ACCOUNT_NAME_TAKEN": 409,
+    "INVALID_ACCOUNT_NAME": 400,
+    "INVALID_SCOPES": 400,
+}
+
+
+def _error(error: str, error_code: str) -> Dict:
+    """Build an error result."""
+    return {"success": False, "error": error, **error_fields(error_code)}
+
+
+def _service_accounts_disabled() -> Dict:
+    """Build the error for nodes without a service account registry."""
+    return _error(
+        "Service accounts are disabled on this node",
+        "SERVICE_ACCOUNTS_DISABLED",
+    )
+
+
+class StreamedBody:
+    """
+    A response body written to the operator as it is produced.
+
+    Attributes:
+        chunks: The body, read on the request's thread
+        content_type: Content type of the body
+        filename: Name to offer the body as a download under, if any
+    """
+
+    def __init__(
+        self,
+        chunks: Iterable[bytes],
+        content_type: str,
+        filename: Optional[str] = None,
+    ):
+        """
+        Initialize the body.
+
+        Args:
+            chunks: The body's chunks, produced as they are written
+            content_type: Content type of the body
+            filename: Name to offer the body as a download under
+        """
+        self.chunks = chunks
+        self.content_type = content_type
+        self.filename = filename
+
+
+class AdminAPI:
+    """
+    Handlers of the admin endpoints.
+    """
+
+    def __init__(
+        self,
+        ws_server,
+        peer_registry=None,
+        failure_detector=None,
+        tpc_participant=None,
+        membership=None,
+        reloader=None,
+        faults=None,
+        failover=None,
+    ):
+        """
+        Initialize the handlers.
+
+        Args:
+            ws_server: WebSocketServer of this node (with its room manager,
+                clients and 2PC coordinator)
+            peer_registry: Optional PeerRegistry listing the peers
+            failure_detector: Optional FailureDetector with peer health
+            tpc_participant: Optional TPCParticipant whose prepared
+                transactions are listed and can be forced
+            membership: Optional ClusterMembership whose view is listed
+                with the peers
+            reloader: Optional ConfigReloader run by POST
+                /admin/config/reload
+            faults: Optional FaultInjector armed by the /admin/faults
+                endpoints
+            failover: Optional RoomFailover handing restored rooms off to
+                other nodes
+        """
+        self.ws_server = ws_server
+        self.peer_registry = peer_registry
+        self.failure_detector = failure_detector
+        self.tpc_participant = tpc_participant
+        self.membership = membership
+        self.reloader = reloader
+        self.faults = faults
+        self.failover = failover
+
+    async def handle(
+        self,
+        method: str,
+        path: str,
+        query: Optional[Dict[str, str]] = None,
+        body: Any = None,
+    ) -> Union[Dict, StreamedBody]:
+        """
+        Handle an authenticated request.
+
+        Args:
+            method: HTTP method
+            path: Request path without the query string
+            query: Query parameters of the request
+            body: The decoded JSON body of the request, if it had one
+
+        Returns:
+            The response body: a dict, or a StreamedBody for exports
+        """
+        parts = [part for part in path.split("/") if part][1:]
+        if method == "GET" and parts[:1] == ["rooms"] and parts[2:] == [
+            "export"
+        ]:
+            return self.export_room(parts[1], query or {})
+        if method == "GET" and parts == ["audit"]:
+            return self.query_audit(query or {})
+        if method == "GET" and parts == ["stats"]:
+            return self.get_stats(query or {})
+        if method == "GET" and parts == ["transactions", "in-doubt"]:
+            return self.list_in_doubt()
+        if method == "GET" and len(parts) == 1:
+            handler = {
+                "rooms": self.list_rooms,
+                "clients": self.list_clients,
+                "peers": self.list_peers,
+                "transactions": self.list_transactions,
+                "archives": self.list_archives,
+            }.get(parts[0])
+            if handler:
+                return handler()
+        if method == "POST" and parts == ["config", "reload"]:
+            return await self.reload_config()
+        if method == "POST" and parts == ["seed"]:
+            return await self.seed(body)
+        if parts == ["service-accounts"] and method in ("GET", "POST"):
+            if method == "GET":
+                return self.list_service_accounts()
+            return self.create_service_account(body)
+        if parts[:1] == ["faults"] and (
+            (method == "GET" and len(parts) == 1)
+            or (method == "POST" and len(parts) == 2)
+        ):
+            return self.inject_fault(parts[1:], query or {})
+        if method == "POST" and len(parts) == 3:
+            if parts[0] == "rooms" and parts[2] == "close":
+                return await self.close_room(parts[1])
+            if parts[0] == "rooms" and parts[2] == "archive":
+                return await self.archive_room(parts[1])
+            if parts[0] == "rooms" and parts[2] == "migrate":
+                return await self.migrate_room(parts[1], query or {})
+            if parts[0] == "archives" and parts[2] == "restore":
+                return await self.restore_archive(parts[1], query or {})
+            if parts[0] == "clients" and parts[2] == "disconnect":
+                return await self.disconnect_client(parts[1])
+            if parts[0] == "service-accounts" and parts[2] == "remove":
+                return await self.remove_service_account(parts[1])
+            if parts[0] == "transactions" and parts[2] in _FORCED_DECISIONS:
+                return await self.force_transaction(
+                    parts[1], _FORCED_DECISIONS[parts[2]], query or {}
+                )
+        if parts and parts[0] in (
+            "rooms",
+            "clients",
+            "peers",
+            "transactions",
+            "config",
+            "audit",
+            "stats",
+            "faults",
+            "archives",
+            "seed",
+            "service-accounts",
+        ):
+            return _error(
+                f"{method} not allowed on {path}", "METHOD_NOT_ALLOWED"
+            )
+        return _error(f"No such endpoint: {path}", "NOT_FOUND")
+
+    def list_rooms(self) -> Dict:
+        """List the rooms hosted on this node."""
+        rooms = self.ws_server.room_manager.list_rooms()
+        return {"success": True, "rooms": rooms, "count": len(rooms)}
+
+    def list_clients(self) -> Dict:
+        """List the clients connected to this node."""
+        clients = []
+        for connection in self.ws_server.connections.list_connections():
+            client = connection.to_dict()
+            client["rooms"] = self.ws_server.client_rooms(connection.websocket)
+            clients.append(client)
+        return {"success": True, "clients": clients, "count": len(clients)}
+
+    def list_peers(self) -> Dict:
+        """List the peer nodes with their liveness and connection state."""
+        peers = []
+        addresses = {}
+        if self.peer_registry:
+            addresses = self.peer_registry.list_peers()
+        for node_id, address in sorted(addresses.items()):
+            peer = {"node_id": node_id, "address": address}
+            status = skew = None
+            if self.failure_detector:
+                status = self.failure_detector.get_status(node_id)
+                skew = self.failure_detector.skew_monitor.status(node_id)
+            if status:
+                peer.update(status.to_dict())
+            else:
+                peer["state"] = None
+            peer["clock_skew"] = skew
+            peer["capabilities"] = self.peer_registry.get_capabilities(
+                node_id
+            )
+            peer["protocol_version"] = (
+                self.peer_registry.get_protocol_version(node_id)
+            )
+            peer["connection"] = self.peer_registry.connection_status(node_id)
+            peers.append(peer)
+        result = {"success": True, "peers": peers, "count": len(peers)}
+        if self.membership:
+            result["membership"] = self.membership.view.to_dict()
+        return result
+
+    def list_transactions(self) -> Dict:
+        """List the 2PC transactions this node is coordinating or in."""
+        coordinating = [
+            txn.to_dict() for txn in self.ws_server.tpc.active_transactions()
+        ]
+        participating = []
+        if self.tpc_participant:
+            participating = [
+                txn.to_dict()
+                for txn in self.tpc_participant.prepared_transactions()
+            ]
+        return {
+            "success": True,
+            "coordinating": coordinating,
+            "participating": participating,
+        }
+
+    def list_in_doubt(self) -> Dict:
+        """
+        List the 2PC transactions that recovery couldn't decide.
+
+        Returns:
+            dict: coordinating (with each participant's vote) and
+            participating (with the other participants' last states)
+        """
+        coordinating = [
+            txn.to_dict() for txn in self.ws_server.tpc.in_doubt_transactions()
+        ]
+        participating = []
+        if self.tpc_participant:
+            participating = [
+                txn.to_dict()
+                for txn in self.tpc_participant.in_doubt_transactions()
+            ]
+        return {
+            "success": True,
+            "coordinating": coordinating,
+            "participating": participating,
+            "count": len(coordinating) + len(participating),
+        }
+
+    async def force_transaction(
+        self,
+        transaction_id: str,
+        decision: TransactionState,
+        query: Dict[str, str],
+    ) -> Dict:
+        """
+        Force an undecided transaction to commit or abort.
+
+        The coordinator's in-doubt transactions are tried first, then the
+        participant's undecided ones; either way the other participants
+        are sent the decision.
+
+        Args:
+            transaction_id: The transaction ID
+            decision: COMMIT or ROLLBACK
+            query: Must have confirm=yes
+
+        Returns:
+            dict: transaction_id, decision, role, the participants that
+            acknowledged, and the warning
+        """
+        if query.get("confirm") != "yes":
+            return dict(
+                _error(
+                    f"{FORCE_WARNING}; repeat with confirm=yes",
+                    "CONFIRMATION_REQUIRED",
+                ),
+                warning=FORCE_WARNING,
+            )
+        role = "coordinator"
+        acknowledged = await self.ws_server.tpc.force(transaction_id, decision)
+        if acknowledged is None and self.tpc_participant:
+            role = "participant"
+            acknowledged = await asyncio.get_running_loop().run_in_executor(
+                None, self.tpc_participant.force, transaction_id, decision
+            )
+        if acknowledged is None:
+            return _error(
+                f"Transaction {transaction_id} is not undecided on this node",
+                "TRANSACTION_NOT_FOUND",
+            )
+        audit(
+            self.ws_server.room_manager.audit_log,
+            ADMIN_INITIATOR,
+            TRANSACTION_FORCED,
+            transaction_id,
+            decision=decision.value,
+            role=role,
+            acknowledged=acknowledged,
+        )
+        return {
+            "success": True,
+            "transaction_id": transaction_id,
+            "decision": decision.value,
+            "role": role,
+            "acknowledged": acknowledged,
+            "warning": FORCE_WARNING,
+        }
+
+    def get_stats(self, query: Dict[str, str]) -> Dict:
+        """
+        Get the statistics of the cluster's nodes and rooms.
+
+        Unlike the stats command, private rooms are included.
+
+        Args:
+            query: Optional room_id to report one room
+
+        Returns:
+            dict: success, node_id, nodes and rooms (see
+            ClusterStats.summary)
+        """
+        room_id = query.get("room_id")
+        summary = self.ws_server.cluster_stats(room_id)
+        if room_id and room_id not in summary["rooms"]:
+            return _error(
+                f"No statistics for room {room_id}", "ROOM_NOT_FOUND"
+            )
+        return {"success": True, **summary}
+
+    def query_audit(self, query: Dict[str, str]) -> Dict:
+        """
+        Find audit log entries.
+
+        Args:
+            query: Optional since and until (UNIX times), actor, action and
+                limit (most entries, newest kept)
+
+        Returns:
+            dict: The entries, oldest first, and whether the log's hash
+            chain is intact ("verified"; "broken_at" names the first
+            entry that was tampered with)
+        """
+        audit_log = self.ws_server.room_manager.audit_log
+        if audit_log is None:
+            return _error("The audit log is not enabled", "AUDIT_UNSUPPORTED")
+        try:
+            since = float(query["since"]) if "since" in query else None
+            until = float(query["until"]) if "until" in query else None
+            limit = int(query.get("limit", AUDIT_QUERY_LIMIT))
+        except ValueError:
+            return _error(
+                "since and until must be UNIX times and limit a number",
+                "INVALID_QUERY",
+            )
+        entries = audit_log.query(
+            since, until, query.get("actor"), query.get("action"), limit
+        )
+        broken_at = audit_log.verify()
+        return {
+            "success": True,
+            "entries": [entry.to_dict() for entry in entries],
+            "count": len(entries),
+            "verified": broken_at is None,
+            "broken_at": broken_at,
+        }
+
+    def inject_fault(self, action: list, query: Dict[str, str]) -> Dict:
+        """
+        List, arm or clear injected faults.
+
+        Args:
+            action: [] to list the faults, or ["crash"], ["delay"],
+                ["heartbeats"] or ["clear"]
+            query: The fault's settings
+
+        Returns:
+            dict: The armed faults (see FaultInjector.status)
+        """
+        if self.faults is None:
+            return _error("Fault injection is not enabled", "FAULTS_DISABLED")
+        try:
+            if not action:
+                faults = self.faults.status()
+            elif action == ["crash"]:
+                faults = self.faults.arm_crash(query.get("phase", ""))
+            elif action == ["delay"]:
+                faults = self.faults.delay_rpc(
+                    query.get("method", ""),
+                    float(query.get("seconds", 0)),
+                    int(query.get("count", 0)),
+                )
+            elif action == ["heartbeats"]:
+                faults = self.faults.drop_heartbeats(
+                    int(query.get("count", 0)),
+                    float(query.get("seconds", 0)),
+                )
+            elif action == ["clear"]:
+                faults = self.faults.clear()
+            else:
+                return _error(f"No such fault: {action[0]}", "NOT_FOUND")
+        except ValueError:
+            return _error("seconds and count must be numbers", "INVALID_FAULT")
+        except FaultError as e:
+            return _error(str(e), e.error_code)
+        return {"success": True, "faults": faults}
+
+    async def close_room(self, room_id: str) -> Dict:
+        """Delete a hosted room through 2PC."""
+        return await self.ws_server.close_room(room_id, ADMIN_INITIATOR)
+
+    async def archive_room(self, room_id: str) -> Dict:
+        """Archive a hosted room instead of deleting it."""
+        return await self.ws_server.archive_room(room_id, ADMIN_INITIATOR)
+
+    async def migrate_room(
+        self, room_id: str, query: Dict[str, str]
+    ) -> Dict:
+        """
+        Move a hosted room to another node (see migration.py).
+
+        Args:
+            room_id: The room's ID
+            query: node, the node to move the room to
+
+        Returns:
+            dict: room_id, room_name, admin_node, previous_admin and
+            paused, the seconds requests on the room waited
+        """
+        node = query.get("node")
+        if not node:
+            return _error("node is required", "INVALID_REQUEST")
+        return await self.ws_server.migrate_room(
+            room_id, node, ADMIN_INITIATOR
+        )
+
+    def list_archives(self) -> Dict:
+        """List the rooms archived on this node."""
+        archives = self.ws_server.room_manager.archive.list_archived()
+        return {"success": True, "archives": archives, "count": len(archives)}
+
+    async def seed(self, fixture: Any) -> Dict:
+        """
+        Create the rooms of a fixture on this node (see seed.py).
+
+        Args:
+            fixture: The decoded fixture
+
+        Returns:
+            dict: rooms and skipped (see WebSocketServer.seed_rooms), or
+            INVALID_FIXTURE if the fixture is malformed
+        """
+        try:
+            rooms = parse_fixture(fixture)
+        except SeedError as e:
+            return _error(str(e), e.error_code)
+        return await self.ws_server.seed_rooms(rooms, ADMIN_INITIATOR)
+
+    def export_room(
+        self, room_id: str, query: Dict[str, str]
+    ) -> Union[Dict, StreamedBody]:
+        """
+        Export a hosted or archived room's full history.
+
+        Args:
+            room_id: The room's ID
+            query: Optional format (one of EXPORT_FORMATS), and since and
+                until as ISO 8601 times
+
+        Returns:
+            A StreamedBody of the exported messages, or an error dict
+        """
+        export_format = query.get("format") or DEFAULT_EXPORT_FORMAT
+        if export_format not in EXPORT_FORMATS:
+            return _error(
+                f"format must be one of {', '.join(EXPORT_FORMATS)}",
+                "INVALID_REQUEST",
+            )
+        room_manager = self.ws_server.room_manager
+        try:
+            since, until = parse_range(query.get("since"), query.get("until"))
+            messages = room_manager.export_history(room_id, since, until)
+        except ExportError as e:
+            return _error(str(e), e.error_code)
+        audit(
+            room_manager.audit_log,
+            ADMIN_INITIATOR,
+            HISTORY_EXPORTED,
+            room_id,
+            format=export_format,
+            since=query.get("since"),
+            until=query.get("until"),
+        )
+        return StreamedBody(
+            encode_export(messages, export_format),
+            EXPORT_FORMATS[export_format],
+            export_filename(room_id, export_format),
+        )
+
+    async def restore_archive(
+        self, room_id: str, query: Dict[str, str]
+    ) -> Dict:
+        """
+        Host an archived room again.
+
+        Args:
+            room_id: The archived room's ID
+            query: Optional node, the node to hand the room to (defaults
+                to this node)
+
+        Returns:
+            dict: room_id, room_name and admin_node, the node hosting the
+            room now
+        """
+        room_manager = self.ws_server.room_manager
+        node = query.get("node") or room_manager.node_id
+        if node != room_manager.node_id and self.failover is None:
+            return _error(
+                "Restoring on another node needs failover enabled",
+                "HANDOFF_UNSUPPORTED",
+            )
+        try:
+            room = room_manager.restore_archived(room_id, ADMIN_INITIATOR)
+        except ArchiveError as e:
+            return _error(str(e), e.error_code)
+
+        if node != room_manager.node_id:
+            new_admin = await asyncio.get_running_loop().run_in_executor(
+                None, self.failover.hand_off_room, room_id, [node]
+            )
+            if new_admin is None:
+                room_manager.archive_room(room_id, ADMIN_INITIATOR)
+                return _error(
+                    f"Node {node} did not take the room; it stays archived",
+                    "HANDOFF_FAILED",
+                )
+        return {
+            "success": True,
+            "room_id": room_id,
+            "room_name": room.room_name,
+            "admin_node": node,
+        }
+
+    async def disconnect_client(self, client_id: str) -> Dict:
+        """Close a client's connection."""
+        if not await self.ws_server.disconnect_client(client_id):
+            return _error(f"Client {client_id} not found", "CLIENT_NOT_FOUND")
+        return {"success": True, "client_id": client_id}
+
+    def list_service_accounts(self) -> Dict:
+        """List the service accounts provisioned on this node."""
+        registry = self.ws_server.service_accounts
+        if registry is None:
+            return _service_accounts_disabled()
+        accounts = registry.list_accounts()
+        return {"success": True, "accounts": accounts, "count": len(accounts)}
+
+    def create_service_account(self, body: Any) -> Dict:
+        """
+        Provision a service account.
+
+        Args:
+            body: The decoded JSON body: name, scopes and optional rooms
+
+        Returns:
+            dict: account and api_key (shown only this once), or an error
+            if the body is malformed or the name is in use by a user, bot
+            or other service account
+        """
+        registry = self.ws_server.service_accounts
+        if registry is None:
+            return _service_accounts_disabled()
+        if not isinstance(body, dict):
+            return _error(
+                "Body must be a JSON object with name and scopes",
+                "INVALID_REQUEST",
+            )
+        name = body.get("name")
+        auth, bots = self.ws_server.auth, self.ws_server.bots
+        if (auth and auth.has_account(name)) or (bots and bots.get(name)):
+            return _error(
+                "Service account name already taken", "ACCOUNT_NAME_TAKEN"
+            )
+        try:
+            account, api_key = registry.create(
+                name, body.get("scopes"), body.get("rooms")
+            )
+        except ServiceAccountError as e:
+            return _error(str(e), e.error_code)
+        audit(
+            self.ws_server.room_manager.audit_log,
+            ADMIN_INITIATOR,
+            SERVICE_ACCOUNT_CREATED,
+            name,
+            scopes=account["scopes"],
+            rooms=account["rooms"],
+        )
+        return {"success": True, "account": account, "api_key": api_key}
+
+    async def remove_service_account(self, name: str) -> Dict:
+        """Remove a service account and close its connections."""
+        registry = self.ws_server.service_accounts
+        if registry is None:
+            return _service_accounts_disabled()
+        try:
+            registry.remove(name)
+        except ServiceAccountError as e:
+            return _error(str(e), e.error_code)
+        disconnected = [
+            connection.client_id
+            for connection in self.ws_server.connections.list_connections()
+            if connection.service_account == name
+        ]
+        for client_id in disconnected:
+            await self.ws_server.disconnect_client(
+                client_id, "Service account removed"
+            )
+        audit(
+            self.ws_server.room_manager.audit_log,
+            ADMIN_INITIATOR,
+            SERVICE_ACCOUNT_REMOVED,
+            name,
+            disconnected=len(disconnected),
+        )
+        return {"success": True, "name": name, "disconnected": disconnected}
+
+    async def reload_config(self) -> Dict:
+        """Reload the configuration, off the event loop."""
+        if self.reloader is None:
+            return _error(
+                "Configuration reload is not enabled", "RELOAD_UNSUPPORTED"
+            )
+        return await asyncio.get_running_loop().run_in_executor(
+            None, self.reloader.reload, "admin_api", ADMIN_INITIATOR
+        )
+
+
+class AdminServer:
+    """
+    HTTP server exposing the admin API under /admin.
+    """
+
+    def __init__(
+        self,
+        api: AdminAPI,
+        token: str,
+        host: str = "127.0.0.1",
+        port: int = DEFAULT_ADMIN_PORT,
+    ):
+        """
+        Initialize the admin server.
+
+        Args:
+            api: Handlers of the admin endpoints
+            token: Bearer token every request must present
+            host: Host address to bind to
+            port: Port to listen on
+        """
+        self.api = api
+        self.token = token
+        self.host = host
+        self.port = port
+        self.loop: Optional[asyncio.AbstractEventLoop] = None
+        self.server: Optional[ThreadingHTTPServer] = None
+        self.server_thread: Optional[Thread] = None
+
+    def authorized(self, header: Optional[str]) -> bool:
+        """Check an Authorization header against the admin token."""
+        scheme, _, token = (header or "").partition(" ")
+        if scheme.lower() != "bearer" or not self.token:
+            return False
+        return hmac.compare_digest(token.strip().encode(), self.token.encode())
+
+    def dispatch(
+        self,
+        method: str,
+        path: str,
+        authorization: Optional[str],
+        body: Optional[bytes] = None,
+    ) -> Tuple[int, Union[Dict, StreamedBody]]:
+        """
+        Handle a request from a server thread on the event loop.
+
+        Args:
+            method: HTTP method
+            path: Request path, possibly with a query string
+            authorization: Authorization header of the request
+            body: The request body, if it had one
+
+        Returns:
+            tuple: (HTTP status, response body)
+        """
+        path, _, query_string = path.partition("?")
+        query = {
+            name: values[-1] for name, values in parse_qs(query_string).items()
+        }
+        if path != ADMIN_PREFIX and not path.startswith(ADMIN_PREFIX + "/"):
+            result = _error(f"No such endpoint: {path}", "NOT_FOUND")
+        elif not self.authorized(authorization):
+            result = _error("Missing or invalid admin token", "UNAUTHORIZED")
+        elif body and len(body) > MAX_BODY_SIZE:
+            result = _error(
+                f"Request bodies are limited to {MAX_BODY_SIZE} bytes",
+                "BODY_TOO_LARGE",
+            )
+        else:
+            try:
+                decoded = json.loads(body) if body else None
+            except ValueError as e:
+                return 400, _error(
+                    f"Request body is not JSON: {e}", "INVALID_REQUEST"
+                )
+            future = asyncio.run_coroutine_threadsafe(
+                self.api.handle(method, path, query, decoded), self.loop
+            )
+            try:
+                result = future.result(REQUEST_TIMEOUT)
+            except Exception as e:
+                future.cancel()
+                logger.error(f"Admin request {method} {path} failed: {e}")
+                result = _error(str(e) or type(e).__name__, "INTERNAL_ERROR")
+        if isinstance(result, StreamedBody):
+            return 200, result
+        if result.get("success", True):
+            return 200, result
+        status = _ERROR_STATUS.get(result.get("error_code"), 500)
+        return status, annotate_error(result)
+
+    def _handler(self):
+        """Build the request handler class bound to this server."""
+        admin = self
+
+        class AdminHandler(BaseHTTPRequestHandler):
+            def _respond(self):
+                length = self.headers.get("Content-Length", "0")
+                length = int(length) if length.isdigit() else 0
+                status, result = admin.dispatch(
+                    self.command,
+                    self.path,
+                    self.headers.get("Authorization"),
+                    # One byte past the limit is enough to refuse the body
+                    self.rfile.read(min(length, MAX_BODY_SIZE + 1)),
+                )
+                if isinstance(result, StreamedBody):
+                    self._stream(result)
+                    return
+                if status != 200:
+                    logger.warning(
+                        f"Admin request {self.command} {self.path} "
+                        f"refused: {result.get('error_code')}"
+                    )
+                body = json.dumps(result).encode()
+                self.send_response(status)
+                if status == 401:
+                    self.send_header("WWW-Authenticate", "Bearer")
+                self.send_header("Content-Type", "application/json")
+                self.send_header("Content-Length", str(len(body)))
+                self.end_headers()
+                self.wfile.write(body)
+
+            def _stream(self, body):
+                # HTTP/1.0: closing the connection ends the body
+                self.send_response(200)
+                self.send_header("Content-Type", body.content_type)
+                if body.filename:
+                    self.send_header(
+                        "Content-Disposition",
+                        f'attachment; filename="{body.filename}"',
+                    )
+                self.end_headers()
+                try:
+                    for chunk in body.chunks:
+                        self.wfile.write(chunk)
+                except Exception as e:
+                    logger.error(
+                        f"Admin request {self.command} {self.path} "
+                        f"stopped streaming: {e}"
+                    )
+
+            do_GET = do_POST = do_PUT = do_DELETE = _respond
+
+            def log_message(self, format, *args):
+                logger.debug(f"Admin request: {format % args}")
+
+        return AdminHandler
+
+    def start(self):
+        """
+        Start the admin server in a background thread.
+
+        Must be called from the event loop the requests are handled on.
+        """
+        self.loop = asyncio.get_running_loop()
+        self.server = ThreadingHTTPServer(
+            (self.host, self.port), self._handler()
+        )
+        self.server.daemon_threads = True
+        self.port = self.server.server_address[1]
+
+        self.server_thread = Thread(
+            target=self.server.serve_forever, daemon=True
+        )
+        self.server_thread.start()
+
+        logger.info(
+            f"Admin API listening on "
+            f"http://{self.host}:{self.port}{ADMIN_PREFIX}"
+        )
+
+    def stop(self):
+        """Stop the admin server."""
+        if self.server:
+            logger.info("Stopping admin server")
+            self.server.shutdown()
+            self.server.server_close()
+            if self.server_thread:
+                self.server_thread.join(timeout=2)
+            logger.info("Admin server stopped")
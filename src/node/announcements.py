@@ -0,0 +1,36 @@
+"""
+Announcement Rooms
+
+The creator of a room may make it an announcement room (announcement,
+set at creation): only its owner and moderators may post, and everyone
+else reads. This suits rooms for system-wide or team-wide announcements.
+
+The check is made by the room's administrator node when it sequences a
+message, so it holds however the message arrives: sent by a local
+client, forwarded by a peer node, or buffered during a partition. A
+refused message fails with READ_ONLY_ROOM. Members can still react to
+announcements and move their read positions, and bridges never post
+external users' messages into announcement rooms.
+
+Whether a room is an announcement room is room metadata like
+total_order: it is written to the message log with the room, and sent
+with join responses, replication, snapshots and the room directory.
+"""
+
+# Error code of messages refused in an announcement room
+READ_ONLY_ROOM = "READ_ONLY_ROOM"
+
+
+class AnnouncementError(Exception):
+    """A member may not post in an announcement room."""
+
+    def __init__(self, message: str, error_code: str = READ_ONLY_ROOM):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "READ_ONLY_ROOM")
+        """
+        super().__init__(message)
+        self.error_code = error_code
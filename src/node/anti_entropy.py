@@ -0,0 +1,187 @@
+"""
+Room Directory Anti-Entropy
+
+Gossip rounds push whole directories to a few random peers, which keeps
+healthy clusters converged but can leave nodes divergent for a long time
+after a network partition heals. Anti-entropy periodically reconciles
+the directory with one peer at a time, cheaply when nothing differs:
+
+1. room_directory_digest fetches the peer's digest tree (see
+   RoomDirectory.digest). Equal roots mean the directories agree.
+2. room_directory_versions fetches the versions of the entries in the
+   leaf buckets whose hashes differ.
+3. sync_room_directory pushes the entries the peer is missing or holds
+   stale versions of, and pulls back the entries this node lacks.
+
+Entries naming this node as admin are never pulled: a live one for a room
+this node doesn't host is disowned with a tombstone, which is pushed.
+
+Every reconciliation is counted in the node's metrics, with the number of
+missing and stale entries it found.
+"""
+
+import logging
+import random
+from typing import Dict, List, Optional
+
+from .room_directory import DIGEST_BUCKETS, RoomDirectory
+
+logger = logging.getLogger(__name__)
+
+# Anti-entropy configuration
+ANTI_ENTROPY_INTERVAL = 30  # seconds between reconciliation rounds
+ANTI_ENTROPY_FANOUT = 1  # peers reconciled with per round
+
+
+class AntiEntropy:
+    """
+    Reconciles the room directory with peers using digest trees.
+    """
+
+    def __init__(
+        self,
+        room_directory: RoomDirectory,
+        room_manager,
+        peer_registry,
+        metrics=None,
+        buckets: int = DIGEST_BUCKETS,
+    ):
+        """
+        Initialize anti-entropy.
+
+        Args:
+            room_directory: The local room directory
+            room_manager: RoomStateManager for this node's rooms
+            peer_registry: PeerRegistry used to reach peers
+            metrics: Optional NodeMetrics counting reconciliations
+            buckets: Number of leaf buckets of the digest tree
+        """
+        self.room_directory = room_directory
+        self.room_manager = room_manager
+        self.peer_registry = peer_registry
+        self.metrics = metrics
+        self.buckets = buckets
+
+    def _record(self, outcome: str, missing: int = 0, stale: int = 0):
+        """Count a reconciliation in the metrics, if enabled."""
+        if self.metrics:
+            self.metrics.record_directory_sync(outcome, missing, stale)
+
+    def reconcile(self, peer_id: str) -> Dict:
+        """
+        Reconcile the room directory with one peer.
+
+        Tombstones are only exchanged for entries the other side still
+        has live; a side that never saw the room, or already dropped its
+        tombstone, has nothing to repair.
+
+        Args:
+            peer_id: Node ID of the peer
+
+        Returns:
+            dict: Counts of 'missing' and 'stale' entries found, entries
+            'pushed' to the peer and 'pulled' into the local directory
+
+        Raises:
+            Exception: If a call to the peer fails
+        """
+        directory = self.room_directory
+        directory.update_local(self.room_manager.list_rooms())
+        result = {"missing": 0, "stale": 0, "pushed": 0, "pulled": 0}
+
+        remote = self.peer_registry.call_peer(
+            peer_id, "room_directory_digest", self.buckets
+        )
+        local = directory.digest(self.buckets)
+        if remote["root"] == local["root"]:
+            self._record("in_sync")
+            return result
+
+        differing = [
+            index
+            for index, (mine, theirs) in enumerate(
+                zip(local["buckets"], remote["buckets"])
+            )
+            if mine != theirs
+        ]
+        remote_versions = self.peer_registry.call_peer(
+            peer_id, "room_directory_versions", differing, self.buckets
+        )
+        local_versions = directory.bucket_versions(differing, self.buckets)
+
+        push: List[str] = []
+        pull: List[str] = []
+        for room_id in set(local_versions) | set(remote_versions):
+            mine = local_versions.get(room_id)
+            theirs = remote_versions.get(room_id)
+            names_me = (
+                theirs is not None
+                and not theirs["deleted"]
+                and theirs.get("admin_node") == directory.node_id
+            )
+            if names_me:
+                if directory.disown(room_id, theirs["version"]):
+                    push.append(room_id)
+                    result["stale"] += 1
+                elif mine is not None and mine["version"] > theirs["version"]:
+                    push.append(room_id)
+                    result["stale"] += 1
+            elif theirs is None:
+                if not mine["deleted"]:
+                    push.append(room_id)
+                    result["missing"] += 1
+            elif mine is None:
+                if not theirs["deleted"]:
+                    pull.append(room_id)
+                    result["missing"] += 1
+            elif theirs["version"] > mine["version"]:
+                pull.append(room_id)
+                result["stale"] += 1
+            elif mine["version"] > theirs["version"]:
+                push.append(room_id)
+                result["stale"] += 1
+
+        if push or pull:
+            entries = self.peer_registry.call_peer(
+                peer_id,
+                "sync_room_directory",
+                directory.get_entries_for(push),
+                pull,
+            )
+            result["pushed"] = len(push)
+            result["pulled"] = directory.merge(entries)
+            logger.info(
+                f"Anti-entropy with {peer_id} found {result['missing']} "
+                f"missing and {result['stale']} stale room directory "
+                f"entries (pushed {len(push)}, pulled {len(pull)})"
+            )
+        self._record(
+            "repaired" if push or pull else "in_sync",
+            result["missing"],
+            result["stale"],
+        )
+        return result
+
+    def run_round(
+        self, fanout: int = ANTI_ENTROPY_FANOUT
+    ) -> Dict[str, Optional[Dict]]:
+        """
+        Reconcile with randomly chosen peers.
+
+        Args:
+            fanout: Number of peers to reconcile with
+
+        Returns:
+            Maps each chosen peer to its reconcile() result, or None if
+            the peer couldn't be reached
+        """
+        peers = list(self.peer_registry.list_peers().keys())
+        results: Dict[str, Optional[Dict]] = {}
+        for peer_id in random.sample(peers, min(fanout, len(peers))):
+            try:
+                results[peer_id] = self.reconcile(peer_id)
+            except Exception as e:
+                logger.debug(f"Anti-entropy with {peer_id} failed: {e}")
+                self._record("error")
+                results[peer_id] = None
+        return results
@@ -0,0 +1,200 @@
+"""
+Room Archival
+
+Instead of deleting a room, an operator can archive it through the admin
+API. The room's full state is taken as a RoomSnapshot (see snapshot.py),
+with its whole stored history instead of the message buffer, and written
+to the node's archive. The room then stops being hosted: its records are
+dropped from storage, it drops out of the room directory like a deleted
+room, and its members get a room_archived event.
+
+An archived room is read-only. Its history can still be paged with
+get_history on the node that archived it, but nobody can post to or join
+it. Restoring it brings it back with its history, members, roles and bans
+intact, either on the archiving node or handed off to another node the
+way rooms are handed off at shutdown (see failover.py). The archive entry
+is removed once the room is hosted again.
+
+Archived rooms are kept as one JSON file each in ARCHIVE_DIRNAME in the
+data directory, written to a temporary file and renamed into place, or in
+memory without a data directory.
+"""
+
+import logging
+import os
+import re
+import threading
+from typing import Dict, List, Optional
+
+from .snapshot import RoomSnapshot, SnapshotError
+
+logger = logging.getLogger(__name__)
+
+ARCHIVE_DIRNAME = "archive"  # in the data directory
+
+# Room IDs that can name an archive file
+_ROOM_ID = re.compile(r"[\w-]+")
+
+
+class ArchiveError(Exception):
+    """
+    A room could not be archived or restored.
+
+    Attributes:
+        error_code: Machine-readable code (e.g., "ARCHIVE_NOT_FOUND")
+    """
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def archive_summary(snapshot: RoomSnapshot) -> Dict:
+    """Describe an archived room without its messages."""
+    return {
+        "room_id": snapshot.room_id,
+        "room_name": snapshot.room_name,
+        "creator_id": snapshot.creator_id,
+        "private": snapshot.private,
+        "member_count": len(snapshot.members),
+        "message_count": len(snapshot.messages),
+        "archived_at": snapshot.taken_at,
+        "archived_on": snapshot.source_node,
+    }
+
+
+class ArchiveStore:
+    """
+    Snapshots of archived rooms, by room ID.
+    """
+
+    def __init__(self, path: Optional[str] = None):
+        """
+        Initialize the store.
+
+        Args:
+            path: Directory to keep archived rooms in (None keeps them in
+                memory)
+        """
+        self.path = path
+        self._lock = threading.Lock()
+        self._rooms: Dict[str, bytes] = {}
+
+    def _file(self, room_id: str) -> str:
+        """Get the path of an archived room's file."""
+        return os.path.join(self.path, f"{room_id}.json")
+
+    def save(self, snapshot: RoomSnapshot) -> None:
+        """
+        Store an archived room, replacing an earlier archive of it.
+
+        Args:
+            snapshot: The room's snapshot
+
+        Raises:
+            OSError: If the snapshot cannot be written
+            ValueError: If the room ID can't name an archive file
+        """
+        if not _ROOM_ID.fullmatch(snapshot.room_id):
+            raise ValueError(f"Cannot archive room ID {snapshot.room_id!r}")
+        data = snapshot.encode()
+        if not self.path:
+            with self._lock:
+                self._rooms[snapshot.room_id] = data
+            return
+        os.makedirs(self.path, exist_ok=True)
+        final = self._file(snapshot.room_id)
+        temporary = f"{final}.tmp"
+        with open(temporary, "wb") as handle:
+            handle.write(data)
+            handle.flush()
+            os.fsync(handle.fileno())
+        os.replace(temporary, final)
+
+    def load(self, room_id: str) -> Optional[RoomSnapshot]:
+        """
+        Read an archived room.
+
+        Returns:
+            The room's snapshot, or None if it isn't archived or its file
+            is unreadable
+        """
+        if not _ROOM_ID.fullmatch(room_id or ""):
+            return None
+        if not self.path:
+            with self._lock:
+                data = self._rooms.get(room_id)
+        else:
+            try:
+                with open(self._file(room_id), "rb") as handle:
+                    data = handle.read()
+            except FileNotFoundError:
+                data = None
+        if data is None:
+            return None
+        try:
+            return RoomSnapshot.decode(data)
+        except SnapshotError as e:
+            logger.error(f"Archive of room {room_id} is unreadable: {e}")
+            return None
+
+    def has(self, room_id: str) -> bool:
+        """Check whether a room is archived."""
+        if not _ROOM_ID.fullmatch(room_id or ""):
+            return False
+        if not self.path:
+            with self._lock:
+                return room_id in self._rooms
+        return os.path.exists(self._file(room_id))
+
+    def remove(self, room_id: str) -> bool:
+        """
+        Delete a room from the archive (after it is restored).
+
+        Returns:
+            True if the room was archived
+        """
+        if not self.has(room_id):
+            return False
+        if not self.path:
+            with self._lock:
+                return self._rooms.pop(room_id, None) is not None
+        try:
+            os.remove(self._file(room_id))
+        except FileNotFoundError:
+            return False
+        return True
+
+    def room_ids(self) -> List[str]:
+        """Get the IDs of the archived rooms, sorted."""
+        if not self.path:
+            with self._lock:
+                return sorted(self._rooms)
+        if not os.path.isdir(self.path):
+            return []
+        return sorted(
+            name[: -len(".json")]
+            for name in os.listdir(self.path)
+            if name.endswith(".json")
+        )
+
+    def list_archived(self) -> List[Dict]:
+        """
+        Describe every archived room.
+
+        Returns:
+            List of archive_summary dicts, sorted by room ID
+        """
+        summaries = []
+        for room_id in self.room_ids():
+            snapshot = self.load(room_id)
+            if snapshot is not None:
+                summaries.append(archive_summary(snapshot))
+        return summaries
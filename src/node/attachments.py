@@ -0,0 +1,687 @@
+"""
+File and Image Attachments
+
+Clients attach files to messages in two steps. First they upload the file
+to the node they are connected to, in chunks small enough for one
+WebSocket message:
+
+- start_upload with the file's name, content type, size and SHA-256
+  hash; the node answers upload_started with an upload ID and the chunk
+  size (or upload_complete right away if it already has the file)
+- upload_chunk with the upload ID, the chunk's offset and its base64 data,
+  answered with upload_progress; chunks must arrive in order, and
+  resending the chunk at the current offset resumes an upload
+- finish_upload, answered with upload_complete once the received bytes
+  match the announced size and hash
+
+The file is kept in a content-addressed blob store under its hash, so a
+file uploaded twice (or to several rooms) is stored once. Then they send
+a message whose "attachments" list references the file by hash, with its
+size, content type and file name.
+
+The room's administrator node accepts such a message only once it holds
+every attached blob: it pulls missing ones from the sender's node with
+the get_blob RPC, in BLOB_CHUNK_SIZE pieces, and then asks the room's
+replication followers to pull them too (replicate_blob), so attachments
+survive a failover like the messages referencing them. Clients download
+an attachment with get_attachment, chunk by chunk; a node that doesn't
+have the blob yet fetches it from the room's admin, or failing that from
+any peer, first.
+"""
+
+import base64
+import binascii
+import hashlib
+import logging
+import os
+import re
+import threading
+import time
+import uuid
+from dataclasses import dataclass, field
+from typing import Dict, Iterable, List, Optional, Tuple
+from xmlrpc.client import Binary
+
+logger = logging.getLogger(__name__)
+
+# Attachment configuration
+CHUNK_SIZE = 32 * 1024  # bytes per upload/download chunk (fits a payload)
+BLOB_CHUNK_SIZE = 1024 * 1024  # bytes per get_blob call between nodes
+MAX_ATTACHMENT_SIZE = 25 * 1024 * 1024  # bytes
+MAX_ATTACHMENTS = 10  # per message
+MAX_UPLOADS_PER_USER = 5  # unfinished uploads at a time
+UPLOAD_TTL = 600  # seconds an upload may stay idle before it is dropped
+UPLOAD_EXPIRY_INTERVAL = 60  # seconds between dropping idle uploads
+BLOB_RPC_TIMEOUT = 5  # seconds to wait for each blob call to a peer
+BLOB_DIRNAME = "blobs"
+
+MAX_FILENAME_LENGTH = 255
+_SHA256 = re.compile(r"^[0-9a-f]{64}$")
+_CONTENT_TYPE = re.compile(r"^[\w.+-]+/[\w.+-]+$")
+
+
+class AttachmentError(Exception):
+    """An upload, download or attachment was refused."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "HASH_MISMATCH")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def blob_hash(data: bytes) -> str:
+    """Get the content address (hex SHA-256) of a blob."""
+    return hashlib.sha256(data).hexdigest()
+
+
+def _metadata_error(
+    sha256, size, content_type, filename, max_size: int
+) -> Optional[str]:
+    """Check attachment metadata, returning the problem if there is one."""
+    if not isinstance(sha256, str) or not _SHA256.match(sha256):
+        return "hash must be a lowercase hex SHA-256 digest"
+    if not isinstance(size, int) or isinstance(size, bool) or size < 1:
+        return "size must be a positive integer"
+    if size > max_size:
+        return f"Attachment too large (max {max_size} bytes)"
+    if not isinstance(content_type, str) or not _CONTENT_TYPE.match(
+        content_type
+    ):
+        return "content_type must be a MIME type (e.g., image/png)"
+    if (
+        not isinstance(filename, str)
+        or not 0 < len(filename) <= MAX_FILENAME_LENGTH
+        or not filename.isprintable()
+        or "/" in filename
+        or "\\" in filename
+        or filename in (".", "..")
+    ):
+        return (
+            f"filename must be 1 to {MAX_FILENAME_LENGTH} printable "
+            f"characters without path separators"
+        )
+    return None
+
+
+def create_attachment(
+    sha256: str, size: int, content_type: str, filename: str
+) -> Dict:
+    """
+    Create the attachment reference stored with a message.
+
+    Args:
+        sha256: Content address of the file
+        size: File size in bytes
+        content_type: MIME type of the file
+        filename: Name of the file
+
+    Returns:
+        dict: {'hash', 'size', 'content_type', 'filename'}
+    """
+    return {
+        "hash": sha256,
+        "size": size,
+        "content_type": content_type,
+        "filename": filename,
+    }
+
+
+def validate_attachments(
+    attachments, max_size: int = MAX_ATTACHMENT_SIZE
+) -> Tuple[bool, Optional[str]]:
+    """
+    Check the attachment references of a message.
+
+    Args:
+        attachments: The message's attachments list
+        max_size: Largest attachment accepted, in bytes
+
+    Returns:
+        tuple: (is_valid, error_message)
+            - is_valid: True if the attachments are valid, False otherwise
+            - error_message: Error message if invalid, None if valid
+    """
+    if not isinstance(attachments, list):
+        return False, "attachments must be a list"
+    if len(attachments) > MAX_ATTACHMENTS:
+        return False, f"Too many attachments (max {MAX_ATTACHMENTS})"
+    for attachment in attachments:
+        if not isinstance(attachment, dict):
+            return False, "Each attachment must be an object"
+        error = _metadata_error(
+            attachment.get("hash"),
+            attachment.get("size"),
+            attachment.get("content_type"),
+            attachment.get("filename"),
+            max_size,
+        )
+        if error:
+            return False, error
+    return True, None
+
+
+class BlobStore:
+    """
+    Content-addressed store of attachment blobs.
+
+    Blobs are files named by their hash under a directory (in
+    subdirectories by the hash's first two characters), written to a
+    temporary file and renamed into place, or kept in memory without a
+    path.
+    """
+
+    def __init__(self, path: Optional[str] = None):
+        """
+        Initialize the store.
+
+        Args:
+            path: Directory to keep blobs in (None keeps them in memory)
+        """
+        self.path = path
+        self._lock = threading.Lock()
+        self._blobs: Dict[str, bytes] = {}
+
+    def _file(self, sha256: str) -> str:
+        """Get the path of a blob's file."""
+        return os.path.join(self.path, sha256[:2], sha256)
+
+    def put(self, data: bytes) -> str:
+        """
+        Store a blob (nothing is written if it is already stored).
+
+        Args:
+            data: The blob's content
+
+        Returns:
+            str: The blob's hash
+
+        Raises:
+            OSError: If the blob cannot be written
+        """
+        sha256 = blob_hash(data)
+        if self.has(sha256):
+            return sha256
+        if not self.path:
+            with self._lock:
+                self._blobs[sha256] = bytes(data)
+            return sha256
+        final = self._file(sha256)
+        os.makedirs(os.path.dirname(final), exist_ok=True)
+        temporary = f"{final}.{uuid.uuid4().hex}.tmp"
+        with open(temporary, "wb") as handle:
+            handle.write(data)
+            handle.flush()
+            os.fsync(handle.fileno())
+        os.replace(temporary, final)
+        return sha256
+
+    def has(self, sha256: str) -> bool:
+        """Check whether a blob is stored."""
+        if not _SHA256.match(sha256 or ""):
+            return False
+        if not self.path:
+            with self._lock:
+                return sha256 in self._blobs
+        return os.path.exists(self._file(sha256))
+
+    def size(self, sha256: str) -> Optional[int]:
+        """Get a stored blob's size in bytes, or None if it isn't stored."""
+        if not self.has(sha256):
+            return None
+        if not self.path:
+            with self._lock:
+                return len(self._blobs[sha256])
+        return os.path.getsize(self._file(sha256))
+
+    def read(self, sha256: str, offset: int = 0, length: int = -1) -> bytes:
+        """
+        Read part of a stored blob.
+
+        Args:
+            sha256: The blob's hash
+            offset: First byte to read
+            length: Number of bytes to read (-1 for the rest)
+
+        Returns:
+            bytes: The data (empty past the end)
+
+        Raises:
+            KeyError: If the blob isn't stored
+        """
+        if not self.has(sha256):
+            raise KeyError(sha256)
+        if not self.path:
+            with self._lock:
+                data = self._blobs[sha256]
+            end = len(data) if length < 0 else offset + length
+            return data[offset:end]
+        with open(self._file(sha256), "rb") as handle:
+            handle.seek(offset)
+            return handle.read(length)
+
+
+@dataclass
+class Upload:
+    """
+    A file being uploaded in chunks.
+
+    Attributes:
+        upload_id: ID the client sends chunks under
+        username: The uploading user
+        room_id: Room the file will be attached in
+        sha256: Announced hash of the file
+        size: Announced size of the file
+        content_type: MIME type of the file
+        filename: Name of the file
+        data: Bytes received so far
+        updated_at: UNIX time of the last chunk
+    """
+
+    upload_id: str
+    username: str
+    room_id: str
+    sha256: str
+    size: int
+    content_type: str
+    filename: str
+    data: bytearray = field(default_factory=bytearray)
+    updated_at: float = field(default_factory=time.time)
+
+    def attachment(self) -> Dict:
+        """Get the attachment reference for the uploaded file."""
+        return create_attachment(
+            self.sha256, self.size, self.content_type, self.filename
+        )
+
+
+class AttachmentManager:
+    """
+    Receives chunked uploads into a blob store and moves blobs between
+    nodes.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        blob_store: Optional[BlobStore] = None,
+        peer_registry=None,
+        max_size: int = MAX_ATTACHMENT_SIZE,
+        upload_ttl: float = UPLOAD_TTL,
+        clock=time.time,
+    ):
+        """
+        Initialize the attachment manager.
+
+        Args:
+            node_id: ID of this node
+            blob_store: BlobStore holding the blobs (defaults to memory)
+            peer_registry: PeerRegistry used to fetch and replicate blobs
+            max_size: Largest attachment accepted, in bytes
+            upload_ttl: Seconds an upload may stay idle
+            clock: Function returning the current UNIX time
+        """
+        self.node_id = node_id
+        self.blob_store = blob_store or BlobStore()
+        self.peer_registry = peer_registry
+        self.max_size = max_size
+        self.upload_ttl = upload_ttl
+        self.clock = clock
+        self._lock = threading.Lock()
+        self._uploads: Dict[str, Upload] = {}
+
+    def start_upload(
+        self,
+        username: str,
+        room_id: str,
+        sha256: str,
+        size: int,
+        content_type: str,
+        filename: str,
+    ) -> Dict:
+        """
+        Start receiving a file.
+
+        Args:
+            username: The uploading user
+            room_id: Room the file will be attached in
+            sha256: Hash of the whole file
+            size: Size of the whole file in bytes
+            content_type: MIME type of the file
+            filename: Name of the file
+
+        Returns:
+            dict: {'upload_id', 'chunk_size', 'received'} for a new upload,
+            or {'complete': True, 'attachment'} if the blob is stored
+            already
+
+        Raises:
+            AttachmentError: If the metadata is invalid (INVALID_ATTACHMENT
+                or ATTACHMENT_TOO_LARGE) or the user has too many uploads
+                open (TOO_MANY_UPLOADS)
+        """
+        error = _metadata_error(
+            sha256, size, content_type, filename, self.max_size
+        )
+        if error:
+            code = (
+                "ATTACHMENT_TOO_LARGE"
+                if isinstance(size, int) and size > self.max_size
+                else "INVALID_ATTACHMENT"
+            )
+            raise AttachmentError(error, code)
+        attachment = create_attachment(sha256, size, content_type, filename)
+        if self.blob_store.size(sha256) == size:
+            return {"complete": True, "attachment": attachment}
+
+        self.expire()
+        with self._lock:
+            open_uploads = sum(
+                1 for u in self._uploads.values() if u.username == username
+            )
+            if open_uploads >= MAX_UPLOADS_PER_USER:
+                raise AttachmentError(
+                    f"Too many uploads in progress "
+                    f"(max {MAX_UPLOADS_PER_USER})",
+                    "TOO_MANY_UPLOADS",
+                )
+            upload = Upload(
+                upload_id=str(uuid.uuid4()),
+                username=username,
+                room_id=room_id,
+                sha256=sha256,
+                size=size,
+                content_type=content_type,
+                filename=filename,
+                updated_at=self.clock(),
+            )
+            self._uploads[upload.upload_id] = upload
+        logger.info(
+            f"User {username} started uploading {filename} ({size} bytes) "
+            f"as {upload.upload_id}"
+        )
+        return {
+            "upload_id": upload.upload_id,
+            "chunk_size": CHUNK_SIZE,
+            "received": 0,
+        }
+
+    def _upload(self, upload_id: str, username: str) -> Upload:
+        """Get a user's open upload (lock held)."""
+        upload = self._uploads.get(upload_id)
+        if upload is None or upload.username != username:
+            raise AttachmentError("Upload not found", "UPLOAD_NOT_FOUND")
+        return upload
+
+    def upload_chunk(
+        self, upload_id: str, username: str, offset: int, data: str
+    ) -> int:
+        """
+        Receive the next chunk of an upload.
+
+        A chunk before the current offset (a resent chunk) is ignored.
+
+        Args:
+            upload_id: The upload's ID
+            username: The uploading user
+            offset: Position of the chunk in the file
+            data: The chunk, base64-encoded
+
+        Returns:
+            int: Number of bytes received so far
+
+        Raises:
+            AttachmentError: If the upload is unknown (UPLOAD_NOT_FOUND),
+                the chunk is malformed or runs past the announced size
+                (INVALID_CHUNK), or it skips data (OUT_OF_ORDER)
+        """
+        try:
+            chunk = base64.b64decode(data or "", validate=True)
+        except (binascii.Error, ValueError, TypeError):
+            raise AttachmentError("Chunk must be base64", "INVALID_CHUNK")
+        if not chunk or len(chunk) > CHUNK_SIZE:
+            raise AttachmentError(
+                f"Chunks must hold 1 to {CHUNK_SIZE} bytes", "INVALID_CHUNK"
+            )
+        if not isinstance(offset, int) or offset < 0:
+            raise AttachmentError(
+                "offset must be a non-negative integer", "INVALID_CHUNK"
+            )
+        with self._lock:
+            upload = self._upload(upload_id, username)
+            received = len(upload.data)
+            if offset + len(chunk) <= received:
+                return received
+            if offset != received:
+                raise AttachmentError(
+                    f"Expected the chunk at offset {received}",
+                    "OUT_OF_ORDER",
+                )
+            if received + len(chunk) > upload.size:
+                raise AttachmentError(
+                    "Chunk runs past the announced size", "INVALID_CHUNK"
+                )
+            upload.data.extend(chunk)
+            upload.updated_at = self.clock()
+            return len(upload.data)
+
+    def finish_upload(self, upload_id: str, username: str) -> Upload:
+        """
+        Verify a fully received upload and store its blob.
+
+        Args:
+            upload_id: The upload's ID
+            username: The uploading user
+
+        Returns:
+            Upload: The finished upload (see Upload.attachment)
+
+        Raises:
+            AttachmentError: If the upload is unknown (UPLOAD_NOT_FOUND),
+                bytes are missing (INCOMPLETE_UPLOAD) or the hash doesn't
+                match (HASH_MISMATCH, and the upload is dropped)
+            OSError: If the blob cannot be written
+        """
+        with self._lock:
+            upload = self._upload(upload_id, username)
+            if len(upload.data) < upload.size:
+                raise AttachmentError(
+                    f"Received {len(upload.data)} of {upload.size} bytes",
+                    "INCOMPLETE_UPLOAD",
+                )
+            del self._uploads[upload_id]
+        if blob_hash(bytes(upload.data)) != upload.sha256:
+            raise AttachmentError(
+                "Uploaded data doesn't match its hash", "HASH_MISMATCH"
+            )
+        self.blob_store.put(bytes(upload.data))
+        logger.info(
+            f"Stored attachment {upload.sha256} ({upload.size} bytes) from "
+            f"{username}"
+        )
+        return upload
+
+    def expire(self) -> int:
+        """
+        Drop uploads that have been idle longer than upload_ttl.
+
+        Returns:
+            int: Number of uploads dropped
+        """
+        cutoff = self.clock() - self.upload_ttl
+        with self._lock:
+            stale = [
+                upload_id
+                for upload_id, upload in self._uploads.items()
+                if upload.updated_at < cutoff
+            ]
+            for upload_id in stale:
+                del self._uploads[upload_id]
+        return len(stale)
+
+    def read_chunk(
+        self, sha256: str, offset: int, length: int = CHUNK_SIZE
+    ) -> Optional[bytes]:
+        """
+        Read part of a stored blob.
+
+        Args:
+            sha256: The blob's hash
+            offset: First byte to read
+            length: Most bytes to read
+
+        Returns:
+            bytes: The data, or None if the blob isn't stored
+        """
+        try:
+            return self.blob_store.read(sha256, max(0, offset), length)
+        except KeyError:
+            return None
+
+    def missing(self, attachments: Iterable[Dict]) -> List[Dict]:
+        """Get the attachments whose blobs are not stored (or differ)."""
+        return [
+            attachment
+            for attachment in attachments
+            if self.blob_store.size(attachment["hash"]) != attachment["size"]
+        ]
+
+    def require(
+        self, attachments: List[Dict], sources: Iterable[str] = ()
+    ) -> None:
+        """
+        Check a message's attachments, pulling missing blobs from sources.
+
+        Args:
+            attachments: The message's attachment references
+            sources: Node IDs that may hold blobs missing here
+
+        Raises:
+            AttachmentError: If a reference is invalid (INVALID_ATTACHMENT)
+                or a blob can't be found (ATTACHMENT_NOT_FOUND)
+        """
+        is_valid, error_msg = validate_attachments(attachments, self.max_size)
+        if not is_valid:
+            raise AttachmentError(error_msg, "INVALID_ATTACHMENT")
+        sources = list(sources)
+        for attachment in self.missing(attachments):
+            if not self.fetch(attachment["hash"], sources, attachment["size"]):
+                raise AttachmentError(
+                    f"Attachment {attachment['hash']} not found",
+                    "ATTACHMENT_NOT_FOUND",
+                )
+
+    def fetch(
+        self, sha256: str, sources: Iterable[str], size: Optional[int] = None
+    ) -> bool:
+        """
+        Pull a blob from the first peer that has it, unless stored here.
+
+        Args:
+            sha256: The blob's hash
+            sources: Node IDs to try, in order
+            size: The blob's size in bytes, if known (otherwise the size
+                the peer reports is used)
+
+        Returns:
+            True if the blob is stored here afterwards
+        """
+        stored = self.blob_store.size(sha256)
+        if stored is not None and stored == (size or stored):
+            return True
+        if self.peer_registry is None:
+            return False
+        for node_id in sources:
+            if not node_id or node_id == self.node_id:
+                continue
+            data = self._pull(node_id, sha256, size)
+            if data is not None and blob_hash(data) == sha256:
+                self.blob_store.put(data)
+                logger.info(f"Fetched blob {sha256} from {node_id}")
+                return True
+        return False
+
+    def _pull(
+        self, node_id: str, sha256: str, size: Optional[int]
+    ) -> Optional[bytes]:
+        """Download a blob from a peer with get_blob, chunk by chunk."""
+        data = bytearray()
+        try:
+            while size is None or len(data) < size:
+                result = self.peer_registry.call_peer(
+                    node_id,
+                    "get_blob",
+                    sha256,
+                    len(data),
+                    BLOB_CHUNK_SIZE,
+                    timeout=BLOB_RPC_TIMEOUT,
+                )
+                if not result or not result.get("success"):
+                    return None
+                size = result["size"]
+                if size > self.max_size:
+                    return None
+                chunk = result.get("data")
+                if isinstance(chunk, Binary):
+                    chunk = chunk.data
+                if not chunk and len(data) < size:
+                    return None
+                data.extend(chunk or b"")
+        except Exception as e:
+            logger.warning(f"Failed to fetch blob {sha256} from {node_id}: {e}")
+            return None
+        return bytes(data) if len(data) == size else None
+
+    def replicate(
+        self, room_id: str, attachments: List[Dict], followers: List[str]
+    ) -> Optional[threading.Thread]:
+        """
+        Ask a room's followers to pull attachment blobs from this node.
+
+        Returns immediately; the followers are asked in the background.
+
+        Args:
+            room_id: The room ID
+            attachments: Attachment references whose blobs to replicate
+            followers: Node IDs of the room's replication followers
+
+        Returns:
+            The thread asking the followers, or None if there is nothing
+            to do
+        """
+        if self.peer_registry is None or not attachments or not followers:
+            return None
+        thread = threading.Thread(
+            target=self._replicate,
+            args=(room_id, list(attachments), list(followers)),
+            daemon=True,
+        )
+        thread.start()
+        return thread
+
+    def _replicate(
+        self, room_id: str, attachments: List[Dict], followers: List[str]
+    ) -> None:
+        """Call replicate_blob on each follower for each attachment."""
+        for follower in followers:
+            for attachment in attachments:
+                try:
+                    self.peer_registry.call_peer(
+                        follower,
+                        "replicate_blob",
+                        room_id,
+                        attachment["hash"],
+                        attachment["size"],
+                        self.node_id,
+                        timeout=BLOB_RPC_TIMEOUT,
+                    )
+                except Exception as e:
+                    logger.warning(
+                        f"Failed to replicate blob {attachment['hash']} "
+                        f"to {follower}: {e}"
+                    )
@@ -0,0 +1,267 @@
+"""
+Audit Log
+
+Records every privileged action taken on this node: rooms created,
+deleted, archived, restored and exported, members kicked and banned,
+role changes, service accounts provisioned and removed, configuration
+reloads, the outcome of each 2PC transaction it coordinated, and rooms
+it took over after their admin failed. Entries are only ever appended, to
+AUDIT_FILENAME in the data directory (or in memory without one).
+
+The log is tamper-evident: each entry carries the SHA-256 hash of its own
+fields and of the previous entry's hash, so changing, removing or
+reordering an entry breaks the chain from that entry on. verify() walks
+the chain; the admin API reports the result with every query of
+GET /admin/audit, which filters entries by time, actor and action.
+"""
+
+import hashlib
+import json
+import logging
+import os
+import threading
+import time
+from dataclasses import asdict, dataclass, field
+from typing import Any, Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Audit log configuration
+AUDIT_FILENAME = "audit.log"  # in the data directory
+AUDIT_QUERY_LIMIT = 100  # entries returned by a query by default
+GENESIS_HASH = "0" * 64  # previous hash of the first entry
+
+# Audited actions
+ROOM_CREATED = "room_created"
+ROOM_DELETED = "room_deleted"
+ROOM_ARCHIVED = "room_archived"  # see archive.py
+ROOM_RESTORED = "room_restored"
+HISTORY_EXPORTED = "history_exported"  # see export.py
+MEMBER_KICKED = "member_kicked"
+MEMBER_BANNED = "member_banned"
+MEMBER_MUTED = "member_muted"  # muted for spam (see spam.py)
+ROLE_CHANGED = "role_changed"
+TRANSACTION_DECIDED = "transaction_decided"
+TRANSACTION_FORCED = "transaction_forced"  # by an operator (admin_api.py)
+ADMIN_FAILOVER = "admin_failover"
+ROOM_MIGRATED = "room_migrated"  # by an operator (see migration.py)
+SERVICE_ACCOUNT_CREATED = "service_account_created"  # service_accounts.py
+SERVICE_ACCOUNT_REMOVED = "service_account_removed"
+CONFIG_RELOADED = "config_reloaded"  # see config_reload.py
+
+
+@dataclass
+class AuditEntry:
+    """
+    One recorded action.
+
+    Attributes:
+        sequence: Position in the log, from 1
+        timestamp: UNIX time the action was recorded
+        node_id: Node that recorded it
+        actor: Who took the action (a username, or a node ID for actions
+            the node takes itself)
+        action: What was done (e.g., "member_banned")
+        target: What it was done to (e.g., a room or transaction ID)
+        details: Further facts about the action
+        previous_hash: Hash of the entry before (GENESIS_HASH for the first)
+        hash: SHA-256 of this entry's other fields
+    """
+
+    sequence: int
+    timestamp: float
+    node_id: str
+    actor: str
+    action: str
+    target: str = ""
+    details: Dict[str, Any] = field(default_factory=dict)
+    previous_hash: str = GENESIS_HASH
+    hash: str = ""
+
+    def compute_hash(self) -> str:
+        """Hash the entry's fields other than its own hash."""
+        fields = asdict(self)
+        del fields["hash"]
+        encoded = json.dumps(fields, sort_keys=True, separators=(",", ":"))
+        return hashlib.sha256(encoded.encode("utf-8")).hexdigest()
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+
+class AuditLog:
+    """
+    Thread-safe, hash-chained, append-only log of privileged actions.
+    """
+
+    def __init__(self, path: Optional[str] = None, node_id: str = ""):
+        """
+        Initialize the log, reading the entries already in the file.
+
+        Args:
+            path: File the entries are appended to, one JSON object per
+                line (None keeps them in memory)
+            node_id: ID of this node, recorded with each entry
+        """
+        self.path = path
+        self.node_id = node_id
+        self._lock = threading.Lock()
+        self._entries: List[AuditEntry] = []
+        if path and os.path.exists(path):
+            self._entries = self._read(path)
+            broken = self.verify()
+            if broken is not None:
+                logger.error(
+                    f"Audit log {path} was tampered with at entry {broken}"
+                )
+
+    @staticmethod
+    def _read(path: str) -> List[AuditEntry]:
+        """Read the entries of an audit log file."""
+        entries = []
+        with open(path, encoding="utf-8") as handle:
+            for line in handle:
+                if not line.strip():
+                    continue
+                try:
+                    entries.append(AuditEntry(**json.loads(line)))
+                except (TypeError, ValueError) as e:
+                    # Keep going; verify() reports where the chain breaks
+                    logger.error(f"Unreadable audit log entry: {e}")
+        return entries
+
+    def record(
+        self,
+        actor: str,
+        action: str,
+        target: str = "",
+        details: Optional[Dict[str, Any]] = None,
+    ) -> AuditEntry:
+        """
+        Append an action to the log.
+
+        Args:
+            actor: Who took the action
+            action: What was done (e.g., ROOM_DELETED)
+            target: What it was done to
+            details: Further facts (must be JSON serializable)
+
+        Returns:
+            The recorded entry
+
+        Raises:
+            OSError: If the entry cannot be written to the file
+        """
+        with self._lock:
+            previous = self._entries[-1] if self._entries else None
+            entry = AuditEntry(
+                sequence=previous.sequence + 1 if previous else 1,
+                timestamp=time.time(),
+                node_id=self.node_id,
+                actor=actor or "",
+                action=action,
+                target=target or "",
+                details=dict(details or {}),
+                previous_hash=previous.hash if previous else GENESIS_HASH,
+            )
+            entry.hash = entry.compute_hash()
+            if self.path:
+                self._append(entry)
+            self._entries.append(entry)
+        logger.info(f"Audit: {entry.actor} {entry.action} {entry.target}")
+        return entry
+
+    def _append(self, entry: AuditEntry) -> None:
+        """Write an entry to the end of the file, fsynced (lock held)."""
+        os.makedirs(os.path.dirname(os.path.abspath(self.path)), exist_ok=True)
+        with open(self.path, "a", encoding="utf-8") as handle:
+            handle.write(json.dumps(entry.to_dict(), sort_keys=True) + "\n")
+            handle.flush()
+            os.fsync(handle.fileno())
+
+    def query(
+        self,
+        since: Optional[float] = None,
+        until: Optional[float] = None,
+        actor: Optional[str] = None,
+        action: Optional[str] = None,
+        limit: int = AUDIT_QUERY_LIMIT,
+    ) -> List[AuditEntry]:
+        """
+        Find recorded actions.
+
+        Args:
+            since: Only entries recorded at or after this UNIX time
+            until: Only entries recorded before this UNIX time
+            actor: Only entries of this actor
+            action: Only entries of this action
+            limit: Most entries to return; the newest are kept
+
+        Returns:
+            Matching entries, oldest first
+        """
+        with self._lock:
+            matches = [
+                entry
+                for entry in self._entries
+                if (since is None or entry.timestamp >= since)
+                and (until is None or entry.timestamp < until)
+                and (actor is None or entry.actor == actor)
+                and (action is None or entry.action == action)
+            ]
+        return matches[-limit:] if limit > 0 else []
+
+    def verify(self) -> Optional[int]:
+        """
+        Check the hash chain.
+
+        Returns:
+            Sequence number (position, from 1) of the first entry that was
+            changed, removed or moved, or None if the chain is intact
+        """
+        with self._lock:
+            entries = list(self._entries)
+        previous_hash = GENESIS_HASH
+        for position, entry in enumerate(entries, start=1):
+            if (
+                entry.sequence != position
+                or entry.previous_hash != previous_hash
+                or entry.hash != entry.compute_hash()
+            ):
+                return position
+            previous_hash = entry.hash
+        return None
+
+    def __len__(self) -> int:
+        """Get the number of entries."""
+        with self._lock:
+            return len(self._entries)
+
+
+def audit(
+    audit_log: Optional[AuditLog],
+    actor: str,
+    action: str,
+    target: str = "",
+    **details: Any,
+) -> None:
+    """
+    Record an action in a node's audit log, if it has one.
+
+    A failed write is logged rather than raised, so the action itself
+    isn't undone.
+
+    Args:
+        audit_log: The node's AuditLog, or None
+        actor: Who took the action
+        action: What was done
+        target: What it was done to
+        details: Further facts about the action
+    """
+    if audit_log is None:
+        return
+    try:
+        audit_log.record(actor, action, target, details)
+    except OSError as e:
+        logger.error(f"Failed to write audit log entry for {action}: {e}")
@@ -0,0 +1,517 @@
+"""
+Client Authentication
+
+Clients register and log in over WebSocket; the node then issues a signed
+session token. A token is
+
+    base64url(JSON claims) "." base64url(HMAC-SHA256(secret, claims))
+
+with claims {"sub": username, "iss": node_id, "iat": ..., "exp": ...,
+"sid": session ID}. Every node in the cluster is configured with the same
+secret (AUTH_SECRET), so a token issued by one node can be verified by any
+peer. Nodes pass the client's token along with forwarded operations, letting
+the room administrator check the identity it acts on.
+
+User accounts are stored on the node where they were registered, in its
+storage backend if it has one. Logging out revokes the session on that
+node only; peers accept the token until it expires.
+
+With the Raft room registry (raft.py), registering also reserves the
+username cluster-wide before the account is created, so two nodes can't
+both register the same name, and deleting the account releases it. With
+the gossiped room directory there is no such coordination and usernames
+are only unique on each node. Accounts registered before the registry was
+enabled are not reserved. Deleting an account revokes the sessions this
+node issued for it, but peers accept them until they expire. The deletion
+is stored with the logouts, so the node keeps rejecting those sessions
+after a restart.
+"""
+
+import base64
+import hashlib
+import hmac
+import json
+import logging
+import os
+import secrets
+import threading
+import time
+from dataclasses import dataclass
+from typing import Dict, Optional
+
+logger = logging.getLogger(__name__)
+
+# Authentication configuration
+SESSION_TTL = 3600  # seconds a session token stays valid
+PASSWORD_ITERATIONS = 100_000  # PBKDF2-SHA256 iterations for password hashes
+MIN_PASSWORD_LENGTH = 8
+# Revocation IDs recording deleted accounts, next to revoked session IDs
+DELETED_ACCOUNT_PREFIX = "deleted:"
+
+# Message types a client may send without a session
+PUBLIC_MESSAGE_TYPES = (
+    "register",
+    "login",
+    "bot_login",
+    "service_login",
+    "protocol_info",
+    "pong",
+)
+
+
+class AuthError(Exception):
+    """A token or credential was rejected."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "TOKEN_EXPIRED")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def _b64encode(data: bytes) -> str:
+    """Encode bytes as unpadded base64url."""
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode("ascii")
+
+
+def _b64decode(data: str) -> bytes:
+    """Decode unpadded base64url."""
+    return base64.urlsafe_b64decode(data + "=" * (-len(data) % 4))
+
+
+class TokenSigner:
+    """
+    Signs and verifies session tokens with a shared HMAC secret.
+    """
+
+    def __init__(self, secret: bytes):
+        """
+        Initialize the signer.
+
+        Args:
+            secret: Cluster-wide signing secret
+        """
+        self._secret = secret
+
+    def sign(self, claims: Dict) -> str:
+        """Create a token carrying the given claims."""
+        payload = _b64encode(
+            json.dumps(claims, separators=(",", ":"), sort_keys=True).encode()
+        )
+        signature = hmac.new(
+            self._secret, payload.encode("ascii"), hashlib.sha256
+        ).digest()
+        return f"{payload}.{_b64encode(signature)}"
+
+    def verify(self, token: str, now: Optional[float] = None) -> Dict:
+        """
+        Verify a token's signature and expiry.
+
+        Args:
+            token: The session token
+            now: Current UNIX time (defaults to time.time())
+
+        Returns:
+            The token's claims
+
+        Raises:
+            AuthError: If the token is malformed, forged or expired
+        """
+        try:
+            payload, signature = token.split(".")
+            expected = hmac.new(
+                self._secret, payload.encode("ascii"), hashlib.sha256
+            ).digest()
+            if not hmac.compare_digest(_b64decode(signature), expected):
+                raise AuthError("Invalid session token", "INVALID_TOKEN")
+            claims = json.loads(_b64decode(payload))
+        except AuthError:
+            raise
+        except (ValueError, TypeError, AttributeError):
+            raise AuthError("Malformed session token", "INVALID_TOKEN")
+
+        if not isinstance(claims, dict) or "sub" not in claims:
+            raise AuthError("Malformed session token", "INVALID_TOKEN")
+        if claims.get("exp", 0) <= (now if now is not None else time.time()):
+            raise AuthError("Session token expired", "TOKEN_EXPIRED")
+        return claims
+
+
+@dataclass
+class UserAccount:
+    """
+    A registered user.
+
+    Attributes:
+        username: The user's name
+        password_hash: PBKDF2-SHA256 hash of the password
+        salt: Random salt for the hash
+        created_at: UNIX time of registration
+    """
+
+    username: str
+    password_hash: bytes
+    salt: bytes
+    created_at: float = 0.0
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for storage, with hex-encoded bytes."""
+        return {
+            "username": self.username,
+            "password_hash": self.password_hash.hex(),
+            "salt": self.salt.hex(),
+            "created_at": self.created_at,
+        }
+
+    @classmethod
+    def from_dict(cls, data: Dict) -> "UserAccount":
+        """Create an account from its stored dictionary form."""
+        return cls(
+            username=data["username"],
+            password_hash=bytes.fromhex(data["password_hash"]),
+            salt=bytes.fromhex(data["salt"]),
+            created_at=float(data.get("created_at", 0.0)),
+        )
+
+
+class AuthManager:
+    """
+    User registration, login and session validation for a node.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        secret: Optional[bytes] = None,
+        required: bool = False,
+        session_ttl: float = SESSION_TTL,
+        password_iterations: int = PASSWORD_ITERATIONS,
+        storage=None,
+        usernames=None,
+    ):
+        """
+        Initialize the auth manager.
+
+        Args:
+            node_id: ID of this node (the token issuer)
+            secret: Cluster-wide signing secret; a random one is generated
+                if omitted, in which case peers cannot verify our tokens
+            required: If True, every client command must carry a valid
+                session; otherwise sessions are checked only when present
+            session_ttl: Seconds a session token stays valid
+            password_iterations: PBKDF2 iterations for password hashes
+            storage: Optional Storage; when set, accounts and logouts are
+                stored there and loaded back on startup
+            usernames: Optional RaftRoomRegistry reserving usernames
+                cluster-wide; register() and delete_account() then make
+                blocking calls into it
+        """
+        if not secret:
+            logger.warning(
+                "No auth secret configured, tokens will only be valid on "
+                "this node"
+            )
+            secret = secrets.token_bytes(32)
+        self.node_id = node_id
+        self.required = required
+        self.session_ttl = session_ttl
+        self.password_iterations = password_iterations
+        self._signer = TokenSigner(secret)
+        self._lock = threading.Lock()
+        self._users: Dict[str, UserAccount] = {}
+        self._revoked: Dict[str, float] = {}  # session ID -> expiry
+        # Deleted account -> UNIX time; sessions issued before are revoked
+        self._deleted: Dict[str, float] = {}
+        self.storage = storage
+        self.usernames = usernames
+        if storage is not None:
+            self._load(storage)
+
+    def register(self, username: str, password: str) -> Dict:
+        """
+        Register a new user, reserving the name cluster-wide if enabled.
+
+        Args:
+            username: Requested username
+            password: The user's password
+
+        Returns:
+            dict: {'success': bool, 'username': str} or an error with
+            'error' and 'error_code' (RESERVATION_FAILED if the registry
+            couldn't commit the reservation)
+        """
+        if not username or not username.strip():
+            return _error("Username is required", "INVALID_USERNAME")
+        username = username.strip()
+        if not password or len(password) < MIN_PASSWORD_LENGTH:
+            return _error(
+                f"Password must be at least {MIN_PASSWORD_LENGTH} "
+                f"characters",
+                "WEAK_PASSWORD",
+            )
+
+        salt = os.urandom(16)
+        account = UserAccount(
+            username=username,
+            password_hash=self._hash_password(password, salt),
+            salt=salt,
+            created_at=time.time(),
+        )
+        if self.has_account(username):
+            return _error("Username already taken", "USERNAME_TAKEN")
+        if self.usernames is not None:
+            reserved = self.usernames.reserve_username(username)
+            if reserved.get("error_code") == "USERNAME_TAKEN":
+                return _error("Username already taken", "USERNAME_TAKEN")
+            if not reserved["success"]:
+                return _error(
+                    f"Could not reserve the username: {reserved.get('error')}",
+                    "RESERVATION_FAILED",
+                )
+        with self._lock:
+            if username in self._users:
+                return _error("Username already taken", "USERNAME_TAKEN")
+            self._users[username] = account
+            self._deleted.pop(username, None)
+        if self.storage is not None:
+            self.storage.save_account(account.to_dict())
+
+        logger.info(f"Registered user {username}")
+        return {"success": True, "username": username}
+
+    def delete_account(self, username: str, password: str) -> Dict:
+        """
+        Delete a user's account and release its name.
+
+        The account is deleted even if the registry can't release the
+        name; it then stays reserved by this node, which can register it
+        again.
+
+        Args:
+            username: The username
+            password: The password
+
+        Returns:
+            dict: {'success': True, 'username'} or an error with 'error'
+            and 'error_code'
+        """
+        with self._lock:
+            account = self._users.get(username or "")
+        if account is None or not hmac.compare_digest(
+            account.password_hash,
+            self._hash_password(password or "", account.salt),
+        ):
+            return _error("Invalid username or password", "INVALID_CREDENTIALS")
+
+        with self._lock:
+            if self._users.pop(username, None) is None:
+                return _error(
+                    "Invalid username or password", "INVALID_CREDENTIALS"
+                )
+            now = time.time()
+            self._deleted[username] = now
+            # Sessions issued before the oldest deletions have expired
+            for name, deleted_at in list(self._deleted.items()):
+                if deleted_at <= now - self.session_ttl:
+                    del self._deleted[name]
+        if self.storage is not None:
+            self.storage.drop_account(username)
+            # Revokes the sessions issued before now until they expire
+            self.storage.save_revocation(
+                f"{DELETED_ACCOUNT_PREFIX}{username}", now + self.session_ttl
+            )
+        if self.usernames is not None:
+            released = self.usernames.release_username(username)
+            if not released["success"]:
+                logger.warning(
+                    f"Username {username} stays reserved: "
+                    f"{released.get('error')}"
+                )
+
+        logger.info(f"Deleted the account of {username}")
+        return {"success": True, "username": username}
+
+    def login(self, username: str, password: str) -> Dict:
+        """
+        Check a user's credentials and issue a session token.
+
+        Args:
+            username: The username
+            password: The password
+
+        Returns:
+            dict: {'success': True, 'username', 'token', 'expires_at'} or
+            an error with 'error' and 'error_code'
+        """
+        with self._lock:
+            account = self._users.get(username or "")
+
+        if account is None or not hmac.compare_digest(
+            account.password_hash,
+            self._hash_password(password or "", account.salt),
+        ):
+            logger.warning(f"Failed login for {username}")
+            return _error("Invalid username or password", "INVALID_CREDENTIALS")
+
+        logger.info(f"User {username} logged in")
+        return self.issue_token(username)
+
+    def issue_token(self, username: str) -> Dict:
+        """
+        Issue a session token for an identity checked by the caller.
+
+        Used by login, and for bots that authenticated with their API key.
+
+        Args:
+            username: The identity the session acts as
+
+        Returns:
+            dict: {'success': True, 'username', 'token', 'expires_at'}
+        """
+        now = time.time()
+        claims = {
+            "sub": username,
+            "iss": self.node_id,
+            "iat": int(now),
+            "exp": int(now + self.session_ttl),
+            "sid": secrets.token_hex(8),
+        }
+        return {
+            "success": True,
+            "username": username,
+            "token": self._signer.sign(claims),
+            "expires_at": claims["exp"],
+        }
+
+    def has_account(self, username: str) -> bool:
+        """Check whether a user is registered on this node."""
+        with self._lock:
+            return username in self._users
+
+    def logout(self, token: str) -> Dict:
+        """
+        Revoke a session on this node.
+
+        Args:
+            token: The session token
+
+        Returns:
+            dict: {'success': bool} or an error
+        """
+        try:
+            claims = self._signer.verify(token)
+        except AuthError as e:
+            return _error(str(e), e.error_code)
+
+        now = time.time()
+        with self._lock:
+            self._revoked[claims["sid"]] = claims["exp"]
+            # Forget revocations for tokens that have expired anyway
+            for sid, expiry in list(self._revoked.items()):
+                if expiry <= now:
+                    del self._revoked[sid]
+        if self.storage is not None:
+            self.storage.save_revocation(claims["sid"], claims["exp"])
+
+        logger.info(f"User {claims['sub']} logged out")
+        return {"success": True, "username": claims["sub"]}
+
+    def verify_token(self, token: str) -> Dict:
+        """
+        Validate a session token issued by any node in the cluster.
+
+        Args:
+            token: The session token
+
+        Returns:
+            dict: {'success': True, 'username', 'issuer', 'expires_at'} or
+            an error with 'error' and 'error_code'
+        """
+        try:
+            claims = self._signer.verify(token)
+        except AuthError as e:
+            return _error(str(e), e.error_code)
+
+        with self._lock:
+            deleted_at = self._deleted.get(claims["sub"])
+            if claims.get("sid") in self._revoked or (
+                deleted_at is not None
+                and claims.get("iss") == self.node_id
+                and claims.get("iat", 0) <= deleted_at
+            ):
+                return _error("Session has been revoked", "TOKEN_REVOKED")
+
+        return {
+            "success": True,
+            "username": claims["sub"],
+            "issuer": claims.get("iss"),
+            "expires_at": claims.get("exp"),
+        }
+
+    def authorize(
+        self, token: Optional[str], username: Optional[str] = None
+    ) -> Dict:
+        """
+        Check that a request may act as a user.
+
+        Without a token the request is allowed only if authentication is
+        not required. With a token, it must be valid and, if a username is
+        claimed by the request, belong to that user.
+
+        Args:
+            token: The session token sent with the request, if any
+            username: The identity the request claims to act as
+
+        Returns:
+            dict: {'success': True, 'username': str or None} or an error
+            with 'error' and 'error_code'
+        """
+        if not token:
+            if self.required:
+                return _error("Authentication required", "AUTH_REQUIRED")
+            return {"success": True, "username": username}
+
+        result = self.verify_token(token)
+        if not result["success"]:
+            return result
+        if username and username != result["username"]:
+            return _error(
+                f"Session belongs to {result['username']}, not {username}",
+                "IDENTITY_MISMATCH",
+            )
+        return result
+
+    def _load(self, storage) -> None:
+        """Load stored accounts and unexpired revocations."""
+        for data in storage.accounts():
+            account = UserAccount.from_dict(data)
+            self._users[account.username] = account
+        now = time.time()
+        for sid, expiry in storage.revocations().items():
+            if expiry <= now:
+                continue
+            if not sid.startswith(DELETED_ACCOUNT_PREFIX):
+                self._revoked[sid] = expiry
+                continue
+            username = sid[len(DELETED_ACCOUNT_PREFIX) :]
+            # Registering the name again lifts the deletion, as it does
+            # before a restart
+            if username not in self._users:
+                self._deleted[username] = expiry - self.session_ttl
+        logger.info(f"Loaded {len(self._users)} user accounts from storage")
+
+    def _hash_password(self, password: str, salt: bytes) -> bytes:
+        """Hash a password with PBKDF2-SHA256."""
+        return hashlib.pbkdf2_hmac(
+            "sha256", password.encode("utf-8"), salt, self.password_iterations
+        )
+
+
+def _error(message: str, error_code: str) -> Dict:
+    """Build a failed auth result."""
+    return {"success": False, "error": message, "error_code": error_code}
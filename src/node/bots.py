@@ -0,0 +1,317 @@
+"""
+Bots
+
+Users register bots on a node with register_bot; the node returns an API
+key, shown only once. A bot program connects to the same node's
+WebSocket endpoint and authenticates with bot_login and its API key,
+after which it acts as a user named after the bot: it joins rooms like a
+member (subject to the same bans, invites and capacity), receives their
+messages and answers with send_message.
+
+Each bot declares the commands it handles, like "/roll". When a bot joins
+a room, its node registers the bot's commands with the room's
+administrator, which refuses commands another bot in the room already
+handles. A message starting with a registered command is routed to its
+bot: the administrator marks it with
+
+    "bot_command": {"bot": "dice", "command": "/roll", "args": "2d6"}
+
+so the owning bot can act on it. A bot's commands are dropped when it
+leaves the room.
+
+Bots and their API key hashes are kept by the node they were registered
+on, in its storage backend if it has one; bots log in there.
+"""
+
+import hashlib
+import hmac
+import logging
+import re
+import secrets
+import threading
+import time
+from dataclasses import dataclass, field
+from typing import Dict, List, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+# Bot configuration
+MAX_BOTS_PER_OWNER = 10
+MAX_COMMANDS = 10  # commands per bot
+
+_BOT_NAME = re.compile(r"^[A-Za-z0-9_-]{1,32}$")
+_COMMAND = re.compile(r"^/[a-z0-9_-]{1,32}$")
+
+
+class BotError(Exception):
+    """A bot request was refused."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_API_KEY")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def hash_api_key(api_key: str) -> str:
+    """Hash an API key for storage, as hex SHA-256."""
+    return hashlib.sha256(api_key.encode()).hexdigest()
+
+
+def validate_commands(commands) -> List[str]:
+    """
+    Check a bot's commands.
+
+    Args:
+        commands: List of commands, each "/" and a lowercase name
+
+    Returns:
+        The commands, without repeats
+
+    Raises:
+        BotError: If the commands aren't a list of up to MAX_COMMANDS
+            valid commands (INVALID_COMMANDS)
+    """
+    if (
+        not isinstance(commands, (list, tuple))
+        or len(commands) > MAX_COMMANDS
+        or not all(
+            isinstance(command, str) and _COMMAND.match(command)
+            for command in commands
+        )
+    ):
+        raise BotError(
+            f"commands must be a list of up to {MAX_COMMANDS} commands "
+            f"like /roll",
+            "INVALID_COMMANDS",
+        )
+    return list(dict.fromkeys(commands))
+
+
+def parse_command(content: str) -> Optional[Tuple[str, str]]:
+    """
+    Split a message into a command and its arguments.
+
+    Args:
+        content: The message text
+
+    Returns:
+        (command, args), or None if the message isn't a command
+    """
+    if not isinstance(content, str) or not content.startswith("/"):
+        return None
+    command, _, args = content.partition(" ")
+    return command.lower(), args.strip()
+
+
+def route_command(
+    room_bots: Dict[str, List[str]], content: str
+) -> Optional[Dict]:
+    """
+    Find the bot a message is a command for.
+
+    Args:
+        room_bots: Maps bot name -> commands registered in the room
+        content: The message text
+
+    Returns:
+        dict: {'bot', 'command', 'args'}, or None if no bot in the room
+        handles the message
+    """
+    parsed = parse_command(content)
+    if parsed is None:
+        return None
+    command, args = parsed
+    for bot_name, commands in room_bots.items():
+        if command in commands:
+            return {"bot": bot_name, "command": command, "args": args}
+    return None
+
+
+@dataclass
+class Bot:
+    """
+    A registered bot.
+
+    Attributes:
+        name: The bot's name, which it acts as in rooms
+        owner: Username of the user who registered it
+        api_key_hash: Hex SHA-256 of its API key
+        commands: Commands it handles, like "/roll"
+        created_at: UNIX time of registration
+    """
+
+    name: str
+    owner: str
+    api_key_hash: str
+    commands: List[str] = field(default_factory=list)
+    created_at: float = 0.0
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for storage."""
+        return {
+            "name": self.name,
+            "owner": self.owner,
+            "api_key_hash": self.api_key_hash,
+            "commands": list(self.commands),
+            "created_at": self.created_at,
+        }
+
+    def public(self) -> Dict:
+        """Describe the bot for its owner, without the key hash."""
+        return {
+            "name": self.name,
+            "owner": self.owner,
+            "commands": list(self.commands),
+            "created_at": self.created_at,
+        }
+
+    @classmethod
+    def from_dict(cls, data: Dict) -> "Bot":
+        """Create a bot from its stored dictionary form."""
+        return cls(
+            name=data["name"],
+            owner=data["owner"],
+            api_key_hash=data["api_key_hash"],
+            commands=list(data.get("commands", [])),
+            created_at=float(data.get("created_at", 0.0)),
+        )
+
+
+class BotRegistry:
+    """
+    Bots registered on this node.
+    """
+
+    def __init__(self, node_id: str, storage=None):
+        """
+        Initialize the registry.
+
+        Args:
+            node_id: ID of this node
+            storage: Optional Storage; when set, bots are stored there and
+                loaded back on startup
+        """
+        self.node_id = node_id
+        self.storage = storage
+        self._lock = threading.Lock()
+        self._bots: Dict[str, Bot] = {}
+        if storage is not None:
+            for data in storage.bots():
+                bot = Bot.from_dict(data)
+                self._bots[bot.name] = bot
+            logger.info(f"Loaded {len(self._bots)} bots from storage")
+
+    def register(
+        self, owner: str, name: str, commands: List[str]
+    ) -> Tuple[Dict, str]:
+        """
+        Register a bot.
+
+        Args:
+            owner: Username of the user registering it
+            name: The bot's name
+            commands: Commands it handles
+
+        Returns:
+            (bot, api_key): The bot's public description and its new API
+            key, which is not kept
+
+        Raises:
+            BotError: If the name is invalid (INVALID_BOT_NAME) or taken
+                (BOT_NAME_TAKEN), the commands are invalid, or the owner
+                has MAX_BOTS_PER_OWNER bots (TOO_MANY_BOTS)
+        """
+        if not isinstance(name, str) or not _BOT_NAME.match(name):
+            raise BotError(
+                "Bot names are 1-32 letters, digits, '_' or '-'",
+                "INVALID_BOT_NAME",
+            )
+        commands = validate_commands(commands)
+        api_key = secrets.token_urlsafe(32)
+        bot = Bot(name, owner, hash_api_key(api_key), commands, time.time())
+        with self._lock:
+            if name in self._bots:
+                raise BotError("Bot name already taken", "BOT_NAME_TAKEN")
+            owned = sum(1 for b in self._bots.values() if b.owner == owner)
+            if owned >= MAX_BOTS_PER_OWNER:
+                raise BotError(
+                    f"A user can have at most {MAX_BOTS_PER_OWNER} bots",
+                    "TOO_MANY_BOTS",
+                )
+            if self.storage is not None:
+                self.storage.save_bot(bot.to_dict())
+            self._bots[name] = bot
+        logger.info(f"User {owner} registered bot {name}")
+        return bot.public(), api_key
+
+    def remove(self, owner: str, name: str) -> None:
+        """
+        Remove a bot; its API key stops working.
+
+        Args:
+            owner: Username of the user removing it
+            name: The bot's name
+
+        Raises:
+            BotError: If there is no such bot (BOT_NOT_FOUND) or it belongs
+                to someone else (NOT_ALLOWED)
+        """
+        with self._lock:
+            bot = self._get(name)
+            if bot.owner != owner:
+                raise BotError("Bot belongs to another user", "NOT_ALLOWED")
+            if self.storage is not None:
+                self.storage.drop_bot(name)
+            del self._bots[name]
+        logger.info(f"User {owner} removed bot {name}")
+
+    def authenticate(self, name: str, api_key: str) -> Bot:
+        """
+        Check a bot's API key.
+
+        Args:
+            name: The bot's name
+            api_key: The API key it presents
+
+        Returns:
+            The bot
+
+        Raises:
+            BotError: If the bot doesn't exist or the key is wrong
+                (INVALID_API_KEY)
+        """
+        with self._lock:
+            bot = self._bots.get(name or "")
+        if bot is None or not hmac.compare_digest(
+            bot.api_key_hash, hash_api_key(api_key or "")
+        ):
+            logger.warning(f"Failed bot login for {name}")
+            raise BotError("Invalid bot name or API key", "INVALID_API_KEY")
+        return bot
+
+    def get(self, name: str) -> Optional[Bot]:
+        """Get a bot by name."""
+        with self._lock:
+            return self._bots.get(name)
+
+    def list_bots(self, owner: str) -> List[Dict]:
+        """Get the public descriptions of a user's bots, by name."""
+        with self._lock:
+            return [
+                bot.public()
+                for name, bot in sorted(self._bots.items())
+                if bot.owner == owner
+            ]
+
+    def _get(self, name: str) -> Bot:
+        """Get a bot or raise BOT_NOT_FOUND (lock held)."""
+        bot = self._bots.get(name)
+        if bot is None:
+            raise BotError("Bot not found", "BOT_NOT_FOUND")
+        return bot
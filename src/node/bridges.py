@@ -0,0 +1,632 @@
+"""
+IRC and Matrix Bridges
+
+A room's owner can bridge the room to an IRC channel or a Matrix room
+with add_bridge. Messages are then relayed both ways by the room's
+administrator node:
+
+- Messages posted in the room are sent to the external channel as
+  "<username> text", by the bridge's own IRC nick or Matrix account.
+- Messages from external users are posted in the room by puppets:
+  synthetic members named after the external user and the network, like
+  "bob[irc]" or "carol[matrix]". A puppet joins the room when its user
+  first speaks and leaves like any member after a period of inactivity.
+
+Messages sent by puppets are never relayed back out, so two bridges
+don't echo each other's messages. Encrypted messages are not relayed, and
+private rooms can't be bridged.
+
+Bridges are room metadata like webhooks: the administrator writes them
+to its message log and hands them over with a room snapshot. Their
+network connections are made by a background task, which reconnects a
+bridge whose connection fails on its next round. Connections to internal
+addresses are refused like webhook deliveries (see egress.py), and an IRC
+server sending more than the bridge can buffer is disconnected.
+"""
+
+import json
+import logging
+import re
+import socket
+import ssl
+import urllib.request
+import uuid
+from abc import ABC, abstractmethod
+from datetime import datetime, timezone
+from functools import partial
+from typing import Callable, Dict, List, Optional, Tuple
+from urllib.parse import quote, urlencode, urlparse
+
+from .egress import EgressPolicy, urlopen
+
+logger = logging.getLogger(__name__)
+
+# Networks a room can be bridged to
+IRC = "irc"
+MATRIX = "matrix"
+BRIDGE_PROTOCOLS = (IRC, MATRIX)
+
+# Bridge configuration
+MAX_BRIDGES = 3  # per room
+BRIDGE_POLL_INTERVAL = 2  # seconds between relay rounds
+BRIDGE_TIMEOUT = 10  # seconds per network operation
+IRC_PORT = 6697
+MAX_LINE_LENGTH = 400  # characters of text per IRC line
+MAX_BUFFER = 8192  # bytes of an incoming IRC line not yet complete
+MAX_READS_PER_POLL = 16  # reads of up to 4096 bytes per relay round
+
+# Settings never shown back to users
+SECRET_SETTINGS = ("password", "access_token")
+
+_IRC_NICK = re.compile(r"^[A-Za-z\[\]\\`_^{|}][A-Za-z0-9\[\]\\`_^{|}-]{0,15}$")
+_PUPPET = re.compile(r"\[(?:%s)\]$" % "|".join(BRIDGE_PROTOCOLS))
+
+
+class BridgeError(Exception):
+    """A bridge could not be added or removed."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_SETTINGS")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def puppet_name(protocol: str, user: str) -> str:
+    """Get the username of an external user's puppet, like "bob[irc]"."""
+    return f"{user}[{protocol}]"
+
+
+def is_puppet(username: str) -> bool:
+    """Check whether a username belongs to a bridge puppet."""
+    return bool(_PUPPET.search(username or ""))
+
+
+def _invalid(message: str) -> BridgeError:
+    """Build an INVALID_SETTINGS error."""
+    return BridgeError(message, "INVALID_SETTINGS")
+
+
+def _validate_irc(settings: Dict) -> Dict:
+    """Check the settings of an IRC bridge, filling in defaults."""
+    server = settings.get("server")
+    if not isinstance(server, str) or not server or " " in server:
+        raise _invalid("server must be the IRC server's host name")
+    port = settings.get("port", IRC_PORT)
+    if isinstance(port, bool) or not isinstance(port, int):
+        raise _invalid("port must be a number")
+    if not 1 <= port <= 65535:
+        raise _invalid("port must be between 1 and 65535")
+    channel = settings.get("channel")
+    if (
+        not isinstance(channel, str)
+        or not channel.startswith(("#", "&"))
+        or " " in channel
+        or "," in channel
+    ):
+        raise _invalid("channel must be an IRC channel like #chat")
+    nick = settings.get("nick")
+    if not isinstance(nick, str) or not _IRC_NICK.match(nick):
+        raise _invalid("nick must be a valid IRC nickname")
+    validated = {
+        "server": server,
+        "port": port,
+        "tls": bool(settings.get("tls", True)),
+        "channel": channel,
+        "nick": nick,
+    }
+    if settings.get("password"):
+        validated["password"] = str(settings["password"])
+    return validated
+
+
+def _validate_matrix(settings: Dict) -> Dict:
+    """Check the settings of a Matrix bridge."""
+    homeserver = settings.get("homeserver")
+    parsed = urlparse(homeserver if isinstance(homeserver, str) else "")
+    if parsed.scheme not in ("http", "https") or not parsed.netloc:
+        raise _invalid("homeserver must be an http:// or https:// URL")
+    room = settings.get("room_id")
+    if not isinstance(room, str) or not room.startswith("!") or ":" not in room:
+        raise _invalid("room_id must be a Matrix room ID like !abc:example.org")
+    user_id = settings.get("user_id")
+    if (
+        not isinstance(user_id, str)
+        or not user_id.startswith("@")
+        or ":" not in user_id
+    ):
+        raise _invalid(
+            "user_id must be a Matrix user ID like @bridge:example.org"
+        )
+    token = settings.get("access_token")
+    if not isinstance(token, str) or not token:
+        raise _invalid("access_token is required")
+    return {
+        "homeserver": homeserver.rstrip("/"),
+        "room_id": room,
+        "user_id": user_id,
+        "access_token": token,
+    }
+
+
+def create_bridge(
+    room_id: str, protocol: str, settings: Dict, created_by: str
+) -> Dict:
+    """
+    Create a bridge record with a new ID.
+
+    IRC settings: server, channel and nick, plus optional port (6697),
+    tls (true) and password. Matrix settings: homeserver, room_id, user_id
+    and access_token of the account the bridge posts as.
+
+    Args:
+        room_id: The room ID
+        protocol: One of BRIDGE_PROTOCOLS
+        settings: The network's settings
+        created_by: Username of the member adding it
+
+    Returns:
+        dict: The bridge, with 'bridge_id', 'room_id', 'protocol',
+        'settings', 'created_by' and 'created_at'
+
+    Raises:
+        BridgeError: If the protocol is unknown (INVALID_PROTOCOL) or the
+            settings are invalid (INVALID_SETTINGS)
+    """
+    if protocol not in BRIDGE_PROTOCOLS:
+        raise BridgeError(
+            f"protocol must be one of {', '.join(BRIDGE_PROTOCOLS)}",
+            "INVALID_PROTOCOL",
+        )
+    if not isinstance(settings, dict):
+        raise _invalid("settings must be an object")
+    if protocol == IRC:
+        validated = _validate_irc(settings)
+    else:
+        validated = _validate_matrix(settings)
+    return {
+        "bridge_id": str(uuid.uuid4()),
+        "room_id": room_id,
+        "protocol": protocol,
+        "settings": validated,
+        "created_by": created_by,
+        "created_at": datetime.now(timezone.utc).isoformat(),
+    }
+
+
+def public_bridge(bridge: Dict) -> Dict:
+    """Get a bridge record without its passwords and tokens."""
+    settings = {
+        key: value
+        for key, value in bridge["settings"].items()
+        if key not in SECRET_SETTINGS
+    }
+    return dict(bridge, settings=settings)
+
+
+class Transport(ABC):
+    """
+    Connection of a bridge to its external network.
+
+    Methods block on the network; BridgeManager calls them from a worker
+    thread.
+    """
+
+    @abstractmethod
+    def send(self, sender: str, text: str) -> None:
+        """
+        Send a room message to the external channel.
+
+        Raises:
+            OSError: If the connection failed
+        """
+
+    @abstractmethod
+    def poll(self) -> List[Tuple[str, str]]:
+        """
+        Get the messages external users sent since the last poll.
+
+        Returns:
+            List of (external username, text)
+
+        Raises:
+            OSError: If the connection failed
+        """
+
+    def close(self) -> None:
+        """Close the connection."""
+
+
+def parse_irc_line(line: str) -> Tuple[str, str, List[str]]:
+    """
+    Split an IRC protocol line.
+
+    Args:
+        line: The line, without its CRLF
+
+    Returns:
+        (prefix, command, params), with the trailing parameter last
+    """
+    prefix = ""
+    if line.startswith(":"):
+        prefix, _, line = line[1:].partition(" ")
+    line, separator, trailing = line.partition(" :")
+    params = line.split()
+    command = params.pop(0).upper() if params else ""
+    if separator:
+        params.append(trailing)
+    return prefix, command, params
+
+
+class IRCTransport(Transport):
+    """
+    Bridge connection to an IRC channel, as one IRC client.
+    """
+
+    def __init__(self, settings: Dict, connect=None):
+        """
+        Initialize the transport; it connects on first use.
+
+        Args:
+            settings: The bridge's IRC settings
+            connect: Function opening a TCP connection to (host, port);
+                refuses internal addresses by default
+        """
+        self.settings = settings
+        self._connect = connect or EgressPolicy().connect
+        self._sock = None
+        self._buffer = b""
+
+    def _connection(self):
+        """Get the connection, connecting and registering if needed."""
+        if self._sock is not None:
+            return self._sock
+        settings = self.settings
+        sock = self._connect(
+            (settings["server"], settings["port"]), BRIDGE_TIMEOUT
+        )
+        if settings["tls"]:
+            sock = ssl.create_default_context().wrap_socket(
+                sock, server_hostname=settings["server"]
+            )
+        self._sock = sock
+        if settings.get("password"):
+            self._write(f"PASS {settings['password']}")
+        self._write(f"NICK {settings['nick']}")
+        self._write(f"USER {settings['nick']} 0 * :Chat room bridge")
+        sock.settimeout(0.0)
+        logger.info(
+            f"Bridge connected to IRC {settings['server']} as "
+            f"{settings['nick']}"
+        )
+        return sock
+
+    def _write(self, line: str) -> None:
+        """Send one protocol line."""
+        data = (line.replace("\r", " ").replace("\n", " ") + "\r\n").encode()
+        sock = self._sock
+        sock.settimeout(BRIDGE_TIMEOUT)
+        try:
+            sock.sendall(data)
+        finally:
+            sock.settimeout(0.0)
+
+    def send(self, sender: str, text: str) -> None:
+        """Relay a room message as PRIVMSG lines."""
+        self._connection()
+        channel = self.settings["channel"]
+        for line in text.splitlines() or [""]:
+            line = line[:MAX_LINE_LENGTH]
+            self._write(f"PRIVMSG {channel} :<{sender}> {line}")
+
+    def poll(self) -> List[Tuple[str, str]]:
+        """
+        Read the lines received so far and answer pings.
+
+        Reads at most MAX_READS_PER_POLL times; the rest is read on the
+        next round.
+
+        Raises:
+            ConnectionError: If the server closed the connection or sent
+                a line longer than MAX_BUFFER
+        """
+        sock = self._connection()
+        for _ in range(MAX_READS_PER_POLL):
+            try:
+                data = sock.recv(4096)
+            except (BlockingIOError, ssl.SSLWantReadError, socket.timeout):
+                break
+            if not data:
+                self.close()
+                raise ConnectionError("IRC server closed the connection")
+            self._buffer += data
+
+        *lines, self._buffer = self._buffer.split(b"\r\n")
+        if len(self._buffer) > MAX_BUFFER:
+            self.close()
+            raise ConnectionError(
+                f"IRC server sent a line over {MAX_BUFFER} bytes"
+            )
+        messages = []
+        channel = self.settings["channel"].lower()
+        for raw in lines:
+            prefix, command, params = parse_irc_line(
+                raw.decode("utf-8", errors="replace")
+            )
+            if command == "PING":
+                self._write(f"PONG :{params[-1] if params else ''}")
+            elif command == "001":
+                self._write(f"JOIN {self.settings['channel']}")
+            elif (
+                command == "PRIVMSG"
+                and len(params) == 2
+                and params[0].lower() == channel
+            ):
+                nick = prefix.split("!", 1)[0]
+                if nick and nick != self.settings["nick"]:
+                    messages.append((nick, params[1]))
+        return messages
+
+    def close(self) -> None:
+        """Quit and close the connection."""
+        if self._sock is None:
+            return
+        try:
+            self._write("QUIT :Bridge closed")
+        except OSError:
+            pass
+        self._sock.close()
+        self._sock = None
+        self._buffer = b""
+
+
+def matrix_messages(sync: Dict, room_id: str, user_id: str):
+    """
+    Get the text messages of a room from a Matrix /sync response.
+
+    Args:
+        sync: The /sync response
+        room_id: The bridged Matrix room
+        user_id: The bridge's own account, whose messages are skipped
+
+    Returns:
+        List of (sender localpart, text)
+    """
+    room = sync.get("rooms", {}).get("join", {}).get(room_id, {})
+    messages = []
+    for event in room.get("timeline", {}).get("events", []):
+        content = event.get("content", {})
+        if (
+            event.get("type") == "m.room.message"
+            and event.get("sender") != user_id
+            and content.get("msgtype") in ("m.text", "m.notice", "m.emote")
+            and isinstance(content.get("body"), str)
+        ):
+            localpart = event["sender"][1:].split(":", 1)[0]
+            messages.append((localpart, content["body"]))
+    return messages
+
+
+def _http_json(
+    method: str,
+    url: str,
+    token: str,
+    body: Optional[Dict] = None,
+    egress: Optional[EgressPolicy] = None,
+) -> Dict:
+    """
+    Make a Matrix client-server API request, without following redirects.
+
+    The connection must pass egress, which refuses internal addresses by
+    default.
+
+    Raises:
+        EgressError: If the homeserver has an address egress refuses
+        OSError: If the request failed
+    """
+    data = json.dumps(body).encode() if body is not None else None
+    request = urllib.request.Request(
+        url,
+        data=data,
+        method=method,
+        headers={
+            "Authorization": f"Bearer {token}",
+            "Content-Type": "application/json",
+        },
+    )
+    policy = egress or EgressPolicy()
+    with urlopen(request, BRIDGE_TIMEOUT, policy) as response:
+        return json.loads(response.read().decode() or "{}")
+
+
+class MatrixTransport(Transport):
+    """
+    Bridge connection to a Matrix room, through the client-server API.
+    """
+
+    def __init__(
+        self,
+        settings: Dict,
+        request: Callable[..., Dict] = _http_json,
+    ):
+        """
+        Initialize the transport.
+
+        Args:
+            settings: The bridge's Matrix settings
+            request: Function making an API request (method, url, token,
+                body) and returning the JSON response
+        """
+        self.settings = settings
+        self._request = request
+        self._since: Optional[str] = None
+
+    def _url(self, path: str) -> str:
+        """Get the URL of a client-server API endpoint."""
+        return f"{self.settings['homeserver']}/_matrix/client/v3{path}"
+
+    def send(self, sender: str, text: str) -> None:
+        """Post a room message as an m.text event."""
+        path = (
+            f"/rooms/{quote(self.settings['room_id'], safe='')}"
+            f"/send/m.room.message/{uuid.uuid4().hex}"
+        )
+        self._request(
+            "PUT",
+            self._url(path),
+            self.settings["access_token"],
+            {"msgtype": "m.text", "body": f"<{sender}> {text}"},
+        )
+
+    def poll(self) -> List[Tuple[str, str]]:
+        """Sync and return the new messages (none on the first sync)."""
+        query = {
+            "timeout": 0,
+            "filter": json.dumps(
+                {"room": {"rooms": [self.settings["room_id"]]}}
+            ),
+        }
+        if self._since:
+            query["since"] = self._since
+        sync = self._request(
+            "GET",
+            self._url(f"/sync?{urlencode(query)}"),
+            self.settings["access_token"],
+        )
+        first = self._since is None
+        self._since = sync.get("next_batch", self._since)
+        if first:
+            return []
+        return matrix_messages(
+            sync, self.settings["room_id"], self.settings["user_id"]
+        )
+
+
+def open_transport(
+    bridge: Dict, egress: Optional[EgressPolicy] = None
+) -> Transport:
+    """
+    Create the transport of a bridge record.
+
+    Args:
+        bridge: The bridge record
+        egress: Policy its connections must pass; internal addresses are
+            refused by default
+
+    Returns:
+        The bridge's Transport
+    """
+    policy = egress or EgressPolicy()
+    if bridge["protocol"] == IRC:
+        return IRCTransport(bridge["settings"], policy.connect)
+    return MatrixTransport(
+        bridge["settings"], partial(_http_json, egress=policy)
+    )
+
+
+class BridgeManager:
+    """
+    Relays messages between hosted rooms and their bridges.
+    """
+
+    def __init__(
+        self,
+        room_manager,
+        transport_factory: Optional[Callable[[Dict], Transport]] = None,
+        egress: Optional[EgressPolicy] = None,
+    ):
+        """
+        Initialize the manager.
+
+        Args:
+            room_manager: RoomStateManager hosting the bridged rooms
+            transport_factory: Function creating a bridge's Transport;
+                open_transport through egress by default
+            egress: Policy bridge connections must pass; internal
+                addresses are refused by default
+        """
+        if transport_factory is None:
+            transport_factory = partial(open_transport, egress=egress)
+        self.room_manager = room_manager
+        self._transport_factory = transport_factory
+        self._transports: Dict[str, Transport] = {}
+        # Bridge ID -> sequence number of the last message relayed out
+        self._relayed: Dict[str, int] = {}
+
+    def relay_round(self) -> List[Tuple[str, str, str]]:
+        """
+        Relay new room messages out and collect external messages.
+
+        Blocks on the network, so it runs in a worker thread. Bridges are
+        connected on their first round, without relaying the room's
+        earlier messages. A bridge whose connection fails is closed and
+        connected again on the next round.
+
+        Returns:
+            List of (room_id, puppet username, text) to post in rooms
+        """
+        bridges = self.room_manager.get_all_bridges()
+        for bridge_id in set(self._relayed) - set(bridges):
+            self._close(bridge_id)
+            del self._relayed[bridge_id]
+
+        inbound = []
+        for bridge_id, bridge in bridges.items():
+            room_id = bridge["room_id"]
+            messages = self.room_manager.get_messages(room_id)
+            try:
+                transport = self._transports.get(bridge_id)
+                if transport is None:
+                    transport = self._transport_factory(bridge)
+                    self._transports[bridge_id] = transport
+                    self._relayed.setdefault(
+                        bridge_id,
+                        messages[-1]["sequence_number"] if messages else 0,
+                    )
+                self._relay_out(bridge_id, transport, messages)
+                for user, text in transport.poll():
+                    puppet = puppet_name(bridge["protocol"], user)
+                    inbound.append((room_id, puppet, text))
+            except Exception as e:
+                logger.warning(
+                    f"Bridge {bridge_id} of room {room_id} failed: {e}"
+                )
+                self._close(bridge_id)
+        return inbound
+
+    def _relay_out(
+        self, bridge_id: str, transport: Transport, messages: List[Dict]
+    ) -> None:
+        """Send a room's messages the bridge hasn't relayed yet."""
+        for message in messages:
+            sequence = message["sequence_number"]
+            if sequence <= self._relayed[bridge_id]:
+                continue
+            if (
+                not is_puppet(message["username"])
+                and not message.get("encrypted")
+                and not message.get("deleted")
+                and message.get("content")
+            ):
+                transport.send(message["username"], message["content"])
+            self._relayed[bridge_id] = sequence
+
+    def _close(self, bridge_id: str) -> None:
+        """Close a bridge's transport."""
+        transport = self._transports.pop(bridge_id, None)
+        if transport is None:
+            return
+        try:
+            transport.close()
+        except OSError:
+            pass
+
+    def close(self) -> None:
+        """Close every bridge's transport."""
+        for bridge_id in list(self._transports):
+            self._close(bridge_id)
@@ -0,0 +1,39 @@
+"""
+Room Capacity and Waiting Lists
+
+The creator of a room may limit how many members it has (max_members, 0
+for no limit). A join while the room is full is refused with ROOM_FULL,
+unless the room has a waiting list: then the user is queued and told
+their position with a waitlist_joined event.
+
+As members leave, the administrator node admits waiting users in the
+order they joined the list. It tells the node each admitted user is
+connected to (notify_waitlist_admitted, or directly for its own clients),
+which puts the user's clients in the room with a waitlist_admitted event,
+and announces a member_joined event. Users no longer connected when
+their turn comes are skipped.
+
+Waiting lists live on the administrator and move with room snapshots
+when a room is handed off; after a failover, waiting users have to join
+again.
+"""
+
+# Error code of joins refused because the room is full
+ROOM_FULL = "ROOM_FULL"
+# Error code of joins that put the user on the waiting list
+WAITLISTED = "WAITLISTED"
+
+
+class CapacityError(Exception):
+    """A user could not join a room because it is full."""
+
+    def __init__(self, message: str, error_code: str = ROOM_FULL):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "ROOM_FULL")
+        """
+        super().__init__(message)
+        self.error_code = error_code
@@ -0,0 +1,253 @@
+"""
+Lamport and Hybrid Logical Clocks
+
+Logical timestamps for ordering events across nodes without synchronized
+wall clocks:
+
+- LamportClock is a single counter, incremented for every local event and
+  advanced past every timestamp received from another node.
+- HybridLogicalClock (HLC) pairs the wall clock in milliseconds with a
+  logical counter. Its timestamps stay close to real time, never go
+  backwards even if the wall clock does, and order every event after the
+  events it has seen, like a Lamport clock.
+
+The room administrator stamps every message with an HLC timestamp under
+"hlc", and nodes stamp the membership events they publish. Nodes update
+their clock with the timestamps they receive, so timestamps assigned
+after seeing an event are ordered after it. A received timestamp further
+ahead of the wall clock than MAX_CLOCK_DRIFT, beyond the sender's clock
+skew measured by heartbeats (see clock_skew.py), is logged.
+
+On the wire an HLC timestamp is a string (XML-RPC integers are 32-bit, too
+small for milliseconds since the epoch):
+
+    <wall ms, 15 digits>.<logical, 6 digits>.<node ID>
+
+Encoded timestamps sort like the timestamps themselves, so they can be
+compared as strings, e.g. when merging message histories.
+"""
+
+import logging
+import threading
+import time
+from dataclasses import asdict, dataclass
+from typing import Callable, Dict, Union
+
+logger = logging.getLogger(__name__)
+
+# Milliseconds a received timestamp may be ahead of the local wall clock
+# before it is logged as clock drift
+MAX_CLOCK_DRIFT = 60_000
+
+# Digits of the encoded wall time and logical counter
+_WALL_DIGITS = 15
+_LOGICAL_DIGITS = 6
+
+
+class LamportClock:
+    """
+    A thread-safe Lamport clock.
+    """
+
+    def __init__(self, value: int = 0):
+        """
+        Initialize the clock.
+
+        Args:
+            value: Initial counter value
+        """
+        self._value = value
+        self._lock = threading.Lock()
+
+    @property
+    def value(self) -> int:
+        """The timestamp of the latest event."""
+        with self._lock:
+            return self._value
+
+    def tick(self) -> int:
+        """
+        Timestamp a local event.
+
+        Returns:
+            int: The event's timestamp
+        """
+        with self._lock:
+            self._value += 1
+            return self._value
+
+    def update(self, remote: int) -> int:
+        """
+        Timestamp the receipt of an event from another node.
+
+        Args:
+            remote: The received event's timestamp
+
+        Returns:
+            int: A timestamp greater than both the local and remote ones
+        """
+        with self._lock:
+            self._value = max(self._value, int(remote)) + 1
+            return self._value
+
+
+@dataclass(frozen=True, order=True)
+class HLCTimestamp:
+    """
+    A hybrid logical clock timestamp.
+
+    Timestamps compare by wall time, then logical counter, then node ID,
+    so timestamps from different nodes are totally ordered.
+
+    Attributes:
+        wall: Wall clock time in milliseconds since the epoch
+        logical: Counter ordering events within the same millisecond
+        node_id: Node that assigned the timestamp
+    """
+
+    wall: int
+    logical: int = 0
+    node_id: str = ""
+
+    def encode(self) -> str:
+        """Encode the timestamp in its wire format."""
+        return (
+            f"{self.wall:0{_WALL_DIGITS}d}."
+            f"{self.logical:0{_LOGICAL_DIGITS}d}.{self.node_id}"
+        )
+
+    @classmethod
+    def decode(cls, data: str) -> "HLCTimestamp":
+        """
+        Decode a timestamp from its wire format.
+
+        Raises:
+            ValueError: If the data isn't an encoded timestamp
+        """
+        parts = str(data).split(".", 2)
+        if len(parts) != 3 or not (parts[0].isdigit() and parts[1].isdigit()):
+            raise ValueError(f"Invalid HLC timestamp: {data!r}")
+        return cls(int(parts[0]), int(parts[1]), parts[2])
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+    @classmethod
+    def from_dict(cls, data: Dict) -> "HLCTimestamp":
+        """Create a timestamp from its dictionary form."""
+        return cls(
+            int(data["wall"]),
+            int(data.get("logical", 0)),
+            data.get("node_id", ""),
+        )
+
+
+class HybridLogicalClock:
+    """
+    A thread-safe hybrid logical clock.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        clock: Callable[[], float] = time.time,
+        max_drift: int = MAX_CLOCK_DRIFT,
+    ):
+        """
+        Initialize the clock.
+
+        Args:
+            node_id: ID of this node, recorded in its timestamps
+            clock: Function returning the wall clock time in seconds
+            max_drift: Milliseconds a received timestamp may be ahead of
+                the wall clock before a warning is logged
+        """
+        self.node_id = node_id
+        self.clock = clock
+        self.max_drift = max_drift
+        self._wall = 0
+        self._logical = 0
+        # Maps node_id -> milliseconds its clock is estimated to be ahead
+        self._skews: Dict[str, int] = {}
+        self._lock = threading.Lock()
+
+    def _physical(self) -> int:
+        """Get the wall clock time in milliseconds."""
+        return int(self.clock() * 1000)
+
+    def _stamp(self) -> HLCTimestamp:
+        """Build a timestamp from the current state."""
+        return HLCTimestamp(self._wall, self._logical, self.node_id)
+
+    def set_skew(self, node_id: str, skew: int) -> None:
+        """
+        Record a peer's estimated clock skew.
+
+        Args:
+            node_id: The peer's node ID
+            skew: Milliseconds its clock is ahead (negative if behind)
+        """
+        with self._lock:
+            self._skews[node_id] = skew
+
+    def now(self) -> HLCTimestamp:
+        """
+        Timestamp a local event.
+
+        Returns:
+            HLCTimestamp: A timestamp greater than every earlier one
+        """
+        physical = self._physical()
+        with self._lock:
+            if physical > self._wall:
+                self._wall = physical
+                self._logical = 0
+            else:
+                self._logical += 1
+            return self._stamp()
+
+    def update(
+        self, remote: Union[HLCTimestamp, str, None]
+    ) -> HLCTimestamp:
+        """
+        Timestamp the receipt of an event from another node.
+
+        Malformed or missing remote timestamps (from nodes that don't
+        stamp events) are ignored, and the result is the same as now().
+
+        Args:
+            remote: The received event's timestamp, decoded or encoded
+
+        Returns:
+            HLCTimestamp: A timestamp greater than both the local and
+            remote ones
+        """
+        if remote is None:
+            return self.now()
+        if not isinstance(remote, HLCTimestamp):
+            try:
+                remote = HLCTimestamp.decode(remote)
+            except ValueError as e:
+                logger.debug(f"Ignoring timestamp: {e}")
+                return self.now()
+
+        physical = self._physical()
+        with self._lock:
+            skew = max(0, self._skews.get(remote.node_id, 0))
+            if remote.wall - physical - skew > self.max_drift:
+                logger.warning(
+                    f"Clock of {remote.node_id or 'a peer'} is "
+                    f"{remote.wall - physical} ms ahead of this node"
+                )
+            wall = max(self._wall, remote.wall, physical)
+            if wall == self._wall and wall == remote.wall:
+                logical = max(self._logical, remote.logical) + 1
+            elif wall == self._wall:
+                logical = self._logical + 1
+            elif wall == remote.wall:
+                logical = remote.logical + 1
+            else:
+                logical = 0
+            self._wall, self._logical = wall, logical
+            return self._stamp()
@@ -0,0 +1,137 @@
+"""
+Clock Skew Detection
+
+HLC timestamps, message ordering and retention all lean on wall clocks,
+so a node whose clock is far off quietly corrupts them. Every heartbeat
+(see failure_detector.py) now carries the wall clock of the node
+answering it, and the node that sent it estimates the peer's skew the
+way NTP does:
+
+    skew = remote clock - (time sent + time answered) / 2
+
+The estimate is off by at most half the round trip, so of the last
+SKEW_SAMPLES heartbeats the one with the shortest round trip wins. A
+peer whose skew grows beyond the threshold is logged as a warning (and
+again when it comes back within it) and exported as
+chat_peer_clock_skew_seconds.
+
+Estimates are passed on to the node's hybrid logical clock, which then
+only warns about timestamps further ahead than the sender's skew
+explains.
+"""
+
+import logging
+import threading
+from collections import deque
+from typing import Deque, Dict, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+# Clock skew configuration
+CLOCK_SKEW_THRESHOLD = 1.0  # seconds of skew before a peer is warned about
+SKEW_SAMPLES = 8  # heartbeats considered per estimate
+
+
+class ClockSkewMonitor:
+    """
+    Estimates of each peer's clock skew from heartbeat samples.
+    """
+
+    def __init__(
+        self,
+        threshold: float = CLOCK_SKEW_THRESHOLD,
+        clock=None,
+        samples: int = SKEW_SAMPLES,
+    ):
+        """
+        Initialize the monitor.
+
+        Args:
+            threshold: Seconds of skew, either way, before a warning
+            clock: Optional HybridLogicalClock given the estimates
+            samples: Heartbeats considered per estimate
+        """
+        self.threshold = threshold
+        self.clock = clock
+        self.samples = samples
+        # Maps node_id -> (round trip, offset) of its latest heartbeats
+        self._samples: Dict[str, Deque[Tuple[float, float]]] = {}
+        self._skewed: Dict[str, bool] = {}
+        self._lock = threading.Lock()
+
+    def record(
+        self, node_id: str, sent: float, remote: float, received: float
+    ) -> float:
+        """
+        Add a heartbeat sample and update the peer's estimate.
+
+        Args:
+            node_id: The peer's node ID
+            sent: Local UNIX time the heartbeat was sent
+            remote: The peer's UNIX time in its response
+            received: Local UNIX time the response arrived
+
+        Returns:
+            float: The peer's estimated skew in seconds (positive if its
+            clock is ahead of this node's)
+        """
+        sample = (received - sent, remote - (sent + received) / 2)
+        with self._lock:
+            samples = self._samples.setdefault(
+                node_id, deque(maxlen=self.samples)
+            )
+            samples.append(sample)
+            rtt, skew = min(samples)
+            skewed = abs(skew) > self.threshold
+            was_skewed = self._skewed.get(node_id, False)
+            self._skewed[node_id] = skewed
+        if skewed and not was_skewed:
+            direction = "ahead of" if skew > 0 else "behind"
+            logger.warning(
+                f"Clock of {node_id} is {abs(skew):.3f} s {direction} this "
+                f"node (within {rtt / 2:.3f} s), over the "
+                f"{self.threshold} s threshold"
+            )
+        elif was_skewed and not skewed:
+            logger.info(
+                f"Clock of {node_id} is back within {self.threshold} s"
+            )
+        if self.clock is not None:
+            self.clock.set_skew(node_id, int(skew * 1000))
+        return skew
+
+    def status(self, node_id: str) -> Optional[Dict]:
+        """
+        Describe a peer's estimate.
+
+        Args:
+            node_id: The peer's node ID
+
+        Returns:
+            dict: skew and error (seconds), samples and skewed (over the
+            threshold), or None without samples
+        """
+        with self._lock:
+            samples = self._samples.get(node_id)
+            if not samples:
+                return None
+            rtt, skew = min(samples)
+            return {
+                "skew": round(skew, 6),
+                "error": round(rtt / 2, 6),
+                "samples": len(samples),
+                "skewed": self._skewed.get(node_id, False),
+            }
+
+    def estimates(self) -> Dict[str, float]:
+        """
+        Get every peer's estimated skew.
+
+        Returns:
+            dict: Node ID -> seconds its clock is ahead
+        """
+        with self._lock:
+            return {
+                node_id: min(samples)[1]
+                for node_id, samples in self._samples.items()
+            }
@@ -0,0 +1,592 @@
+"""
+Cluster Test Harness
+
+End-to-end tests of joins, deletions and failover need a whole cluster,
+users on several nodes and faults between them, and then a check that
+the cluster kept its promises. This module gives tests those pieces, on
+two kinds of cluster:
+
+- ClusterHarness starts nodes in-process on a Simulation (see
+  simulation.py), so runs are deterministic and need no sockets.
+  FakeClients act as users connected to one node: they create and join
+  rooms, send messages with client-chosen IDs (retried on timeouts, as
+  the chat client does) and keep the events their node delivered to
+  them. Partitions, crashes and failure detection go through the
+  simulated network and heartbeat rounds.
+- ComposeCluster starts the nodes of docker-compose.yml in containers,
+  crashes and restarts them, and cuts them off the compose network. The
+  chat client (src/client) connects to them at ws_url(); runs are real
+  and not deterministic.
+
+Invariants are checked by plain functions, so results from either kind
+of cluster can be checked the same way:
+
+- delivery_violations: every client received each message accepted
+  after it joined, exactly once
+- membership_violations: every node holding a room's state (its admin
+  and the replicas) agrees on the room's members
+
+ClusterHarness.check() runs both on a room and raises InvariantViolation
+listing what went wrong.
+"""
+
+import logging
+import subprocess
+import time
+import uuid
+from collections import Counter, defaultdict
+from typing import Any, Callable, Dict, Iterable, List, Optional, Sequence
+
+from .failure_detector import DEAD_THRESHOLD
+from .simulation import DEFAULT_LATENCY, SimulatedNode, Simulation
+
+logger = logging.getLogger(__name__)
+
+# Harness configuration
+SEND_RETRIES = 2  # times a timed-out send is tried again with its ID
+ELECTION_WAIT = 2.0  # seconds to wait for a crashed admin's successor
+
+# The nodes of docker-compose.yml -> the host port of their WebSocket
+COMPOSE_WS_PORTS = {"node1": 8081, "node2": 8082, "node3": 8083}
+
+
+class InvariantViolation(AssertionError):
+    """A cluster broke an invariant."""
+
+    def __init__(self, violations: List[str]):
+        """
+        Initialize the error.
+
+        Args:
+            violations: Description of each violation
+        """
+        super().__init__("; ".join(violations))
+        self.violations = violations
+
+
+def delivery_violations(
+    expected: Dict[str, Sequence[str]], delivered: Dict[str, List[Dict]]
+) -> List[str]:
+    """
+    Find messages a client didn't receive, or received more than once.
+
+    Args:
+        expected: Maps each client -> IDs of the messages it should get
+        delivered: Maps each client -> the messages it received
+
+    Returns:
+        A description of each violation, empty if there is none
+    """
+    violations = []
+    for client in sorted(expected):
+        counts = Counter(
+            message.get("message_id") for message in delivered.get(client, [])
+        )
+        for message_id in expected[client]:
+            if not counts[message_id]:
+                violations.append(f"{client} never got message {message_id}")
+        for message_id, count in sorted(counts.items()):
+            if count > 1:
+                violations.append(
+                    f"{client} got message {message_id} {count} times"
+                )
+    return violations
+
+
+def membership_violations(
+    views: Dict[str, Iterable[str]], reference: str
+) -> List[str]:
+    """
+    Find nodes whose view of a room's members differs from a reference.
+
+    Args:
+        views: Maps node ID -> the room's members as that node has them
+        reference: Node whose view is authoritative, usually the admin
+
+    Returns:
+        A description of each violation, empty if there is none
+    """
+    expected = sorted(views[reference])
+    violations = []
+    for node_id in sorted(views):
+        members = sorted(views[node_id])
+        if members != expected:
+            violations.append(
+                f"{node_id} has members {members} but {reference} has "
+                f"{expected}"
+            )
+    return violations
+
+
+class FakeClient:
+    """A user connected to one node of a ClusterHarness."""
+
+    def __init__(self, harness: "ClusterHarness", node_id: str, username: str):
+        """
+        Initialize the client.
+
+        Args:
+            harness: The cluster the client connects to
+            node_id: ID of the node it is connected to
+            username: The user's name
+        """
+        self.harness = harness
+        self.node_id = node_id
+        self.username = username
+        # Maps room_id -> index of the first event of the room delivered
+        # to this client (the node's events before it joined aren't)
+        self._joined: Dict[str, int] = {}
+
+    @property
+    def node(self) -> SimulatedNode:
+        """The node the client is connected to."""
+        return self.harness.simulation.node(self.node_id)
+
+    def create_room(self, room_name: str, **options) -> str:
+        """
+        Create a room administered by the client's node, and join it.
+
+        Args:
+            room_name: Name of the room
+            **options: Other RoomStateManager.create_room arguments
+
+        Returns:
+            The room ID
+        """
+        room_id = self.node.create_room(room_name, self.username, **options)
+        self._watch(room_id)
+        return room_id
+
+    def join(self, room_id: str) -> Dict:
+        """
+        Join a room through its admin.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The admin's join result, or an error if it can't be reached
+        """
+        admin = self.harness.admin_of(room_id)
+        if admin is None:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        try:
+            result = self.node.join(room_id, self.username, admin)
+        except Exception as e:
+            return _unreachable(e)
+        if result.get("success"):
+            self._watch(room_id)
+        return result
+
+    def send(
+        self, room_id: str, content: str, retries: int = SEND_RETRIES
+    ) -> Dict:
+        """
+        Send a message, trying again with its ID when the call fails.
+
+        Args:
+            room_id: The room ID
+            content: Message text
+            retries: Times to try again after a failed call
+
+        Returns:
+            The admin's result for the last attempt
+        """
+        message_id = str(uuid.uuid4())
+        result = {}
+        for _ in range(retries + 1):
+            if self.node.admin_of(room_id) is None:
+                return {
+                    "success": False,
+                    "error": "Not in the room",
+                    "error_code": "NOT_A_MEMBER",
+                }
+            try:
+                result = self.node.send(
+                    room_id, self.username, content, message_id
+                )
+            except Exception as e:
+                result = _unreachable(e)
+                continue
+            if result.get("success"):
+                self.harness.accepted[room_id].append(message_id)
+            return result
+        return result
+
+    async def delete_room(self, room_id: str) -> bool:
+        """
+        Delete a room administered by the client's node through 2PC.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            bool: True if the deletion committed
+        """
+        return await self.node.delete_room(room_id)
+
+    def events(self, room_id: str, event_type: Optional[str] = None):
+        """
+        Get the events of a room delivered to the client, in order.
+
+        Args:
+            room_id: The room ID
+            event_type: Only events of this type, if given
+
+        Returns:
+            The events
+        """
+        if room_id not in self._joined:
+            return []
+        events = self.node.events[room_id][self._joined[room_id]:]
+        return [
+            event
+            for event in events
+            if event_type is None or event.get("type") == event_type
+        ]
+
+    def messages(self, room_id: str) -> List[Dict]:
+        """Get the messages of a room delivered to the client, in order."""
+        return [event["data"] for event in self.events(room_id, "new_message")]
+
+    def _watch(self, room_id: str) -> None:
+        """Start keeping a room's events, and expect its new messages."""
+        self._joined[room_id] = len(self.node.events[room_id])
+        self.harness.joined[room_id][self] = len(
+            self.harness.accepted[room_id]
+        )
+
+
+class ClusterHarness:
+    """
+    An in-process cluster of simulated nodes with fake clients.
+
+    Use as a context manager, like the Simulation it runs on.
+    """
+
+    def __init__(
+        self,
+        size: int = 3,
+        seed: int = 0,
+        latency=DEFAULT_LATENCY,
+        drop_rate: float = 0.0,
+    ):
+        """
+        Initialize the harness.
+
+        Args:
+            size: Number of nodes, named node1 to node<size>
+            seed: Seed of the simulation
+            latency: Default (min, max) one-way latency in seconds
+            drop_rate: Default probability of dropping a call
+        """
+        self.simulation = Simulation(seed, latency, drop_rate)
+        self.node_ids = [f"node{i}" for i in range(1, size + 1)]
+        self.clients: List[FakeClient] = []
+        # Maps room_id -> IDs of the messages its admin accepted, in order
+        self.accepted: Dict[str, List[str]] = defaultdict(list)
+        # Maps room_id -> client -> messages accepted before it joined
+        self.joined: Dict[str, Dict[FakeClient, int]] = defaultdict(dict)
+
+    def __enter__(self) -> "ClusterHarness":
+        self.simulation.__enter__()
+        for node_id in self.node_ids:
+            self.simulation.add_node(node_id)
+        return self
+
+    def __exit__(self, *exc_info) -> None:
+        self.simulation.__exit__(*exc_info)
+
+    @property
+    def network(self):
+        """The simulated network, for link faults."""
+        return self.simulation.network
+
+    def node(self, node_id: str) -> SimulatedNode:
+        """Get a node by ID."""
+        return self.simulation.node(node_id)
+
+    def running(self) -> List[str]:
+        """Get the IDs of the nodes that aren't crashed."""
+        return [
+            node_id
+            for node_id in self.node_ids
+            if not self.network.is_crashed(node_id)
+        ]
+
+    def connect(self, node_id: str, username: str) -> FakeClient:
+        """
+        Connect a fake client to a node.
+
+        Args:
+            node_id: ID of the node
+            username: The user's name
+
+        Returns:
+            The FakeClient
+        """
+        client = FakeClient(self, node_id, username)
+        self.clients.append(client)
+        return client
+
+    def admin_of(self, room_id: str) -> Optional[str]:
+        """Get the running node administering a room, if any."""
+        for node_id in self.running():
+            if self.node(node_id).room_manager.get_room(room_id):
+                return node_id
+        return None
+
+    def partition(self, *groups: Iterable[str]) -> None:
+        """Split the network; see SimulatedNetwork.partition."""
+        self.network.partition(*groups)
+
+    def heal(self) -> None:
+        """Remove the partition."""
+        self.network.heal()
+
+    def crash(self, node_id: str) -> None:
+        """Crash a node; its peers find out through heartbeats."""
+        self.network.crash(node_id)
+
+    def recover(self, node_id: str) -> None:
+        """Bring a crashed node back."""
+        self.network.recover(node_id)
+
+    def settle(self) -> int:
+        """
+        Deliver everything in flight.
+
+        Returns:
+            The number of queued callbacks run
+        """
+        return self.simulation.run()
+
+    def detect_failures(self, rounds: int = DEAD_THRESHOLD) -> List:
+        """
+        Run heartbeat rounds until unreachable peers are declared dead.
+
+        Rooms administered by dead nodes go to election.
+
+        Args:
+            rounds: Heartbeat rounds to run
+
+        Returns:
+            The membership events of the rounds
+        """
+        events = []
+        for _ in range(rounds):
+            events.extend(self.simulation.heartbeat_round())
+        self.settle()
+        return events
+
+    def wait_for_admin(
+        self, room_id: str, timeout: float = ELECTION_WAIT
+    ) -> Optional[str]:
+        """
+        Wait for a running node to administer a room.
+
+        Elections are answered on the nodes' own threads, so a new admin
+        may take over a moment after the heartbeat round that started it.
+
+        Args:
+            room_id: The room ID
+            timeout: Seconds to wait at most
+
+        Returns:
+            The admin's node ID, or None if there is none in time
+        """
+        deadline = time.monotonic() + timeout
+        while True:
+            admin = self.admin_of(room_id)
+            if admin is not None or time.monotonic() >= deadline:
+                return admin
+            time.sleep(0.01)
+
+    def membership_views(self, room_id: str) -> Dict[str, List[str]]:
+        """
+        Get the room's members as each running node holding it has them.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Maps node ID -> the members, from its room or its replica
+        """
+        views = {}
+        for node_id in self.running():
+            node = self.node(node_id)
+            room = node.room_manager.get_room(room_id)
+            replica = node.replica_store.get(room_id)
+            if room is not None:
+                views[node_id] = sorted(room.members)
+            elif replica is not None:
+                views[node_id] = sorted(replica.members)
+        return views
+
+    def violations(self, room_id: str) -> List[str]:
+        """
+        Check a room's invariants on the running nodes.
+
+        Clients on crashed nodes aren't expected to receive anything.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            A description of each violation, empty if there is none
+        """
+        running = set(self.running())
+        clients = {
+            client: start
+            for client, start in self.joined[room_id].items()
+            if client.node_id in running
+        }
+        expected = {
+            client.username: self.accepted[room_id][start:]
+            for client, start in clients.items()
+        }
+        delivered = {
+            client.username: client.messages(room_id) for client in clients
+        }
+        violations = delivery_violations(expected, delivered)
+        admin = self.admin_of(room_id)
+        if admin is not None:
+            views = self.membership_views(room_id)
+            violations += membership_violations(views, admin)
+        return violations
+
+    def check(self, room_id: str) -> None:
+        """
+        Check a room's invariants once everything in flight is delivered.
+
+        Args:
+            room_id: The room ID
+
+        Raises:
+            InvariantViolation: If an invariant is broken
+        """
+        self.settle()
+        violations = self.violations(room_id)
+        if violations:
+            raise InvariantViolation(violations)
+
+
+class ComposeCluster:
+    """
+    The nodes of a docker-compose file, run in containers.
+
+    Use as a context manager: the containers are started on entry and
+    removed on exit.
+    """
+
+    def __init__(
+        self,
+        compose_file: str = "docker-compose.yml",
+        project: str = "chat-cluster",
+        network: str = "chat-network",
+        ws_ports: Optional[Dict[str, int]] = None,
+        runner: Optional[Callable[[List[str]], Any]] = None,
+    ):
+        """
+        Initialize the cluster.
+
+        Args:
+            compose_file: Path of the compose file
+            project: Compose project name, prefixing its networks
+            network: Name of the compose network the nodes talk over
+            ws_ports: Maps service -> host port of its WebSocket
+                (defaults to those of the repository's compose file)
+            runner: Function running a command given as a list of
+                arguments (defaults to subprocess.run, checked)
+        """
+        self.compose_file = compose_file
+        self.project = project
+        self.network = f"{project}_{network}"
+        self.ws_ports = dict(ws_ports or COMPOSE_WS_PORTS)
+        self.runner = runner or (lambda args: subprocess.run(args, check=True))
+
+    def __enter__(self) -> "ComposeCluster":
+        self.up()
+        return self
+
+    def __exit__(self, *exc_info) -> None:
+        self.down()
+
+    def up(self) -> None:
+        """Build and start every node, waiting until they run."""
+        self._compose("up", "-d", "--build", "--wait")
+
+    def down(self) -> None:
+        """Stop and remove the nodes and their network."""
+        self._compose("down", "--remove-orphans")
+
+    def crash(self, node_id: str) -> None:
+        """Kill a node's container at once, as a crash would."""
+        self._compose("kill", node_id)
+
+    def recover(self, node_id: str) -> None:
+        """Start a killed node's container again."""
+        self._compose("start", node_id)
+
+    def isolate(self, node_id: str) -> None:
+        """
+        Cut a node off the compose network.
+
+        Docker networks can only cut a container off entirely, so this
+        partitions the node from all its peers.
+
+        Args:
+            node_id: The node's compose service
+        """
+        self.runner(
+            [
+                "docker",
+                "network",
+                "disconnect",
+                self.network,
+                self._container(node_id),
+            ]
+        )
+
+    def rejoin(self, node_id: str) -> None:
+        """Connect an isolated node to the compose network again."""
+        self.runner(
+            [
+                "docker",
+                "network",
+                "connect",
+                "--alias",
+                node_id,
+                self.network,
+                self._container(node_id),
+            ]
+        )
+
+    def ws_url(self, node_id: str) -> str:
+        """Get the URL clients on the host connect to a node at."""
+        return f"ws://localhost:{self.ws_ports[node_id]}"
+
+    def _compose(self, *args: str) -> None:
+        """Run a docker compose command on the project."""
+        self.runner(
+            ["docker", "compose", "-f", self.compose_file, "-p", self.project]
+            + list(args)
+        )
+
+    def _container(self, node_id: str) -> str:
+        """Get a node's container name, as set in the compose file."""
+        return f"chat-{node_id}"
+
+
+def _unreachable(error: Exception) -> Dict:
+    """Result for a call that failed on the network."""
+    logger.debug(f"Call failed: {error}")
+    return {
+        "success": False,
+        "error": f"Failed to contact the node: {error}",
+        "error_code": "PEER_UNAVAILABLE",
+    }
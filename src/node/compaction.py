@@ -0,0 +1,248 @@
+"""
+Log Compaction
+
+A room's records in storage only grow: every message, edit, reaction and
+read position is appended. Compaction periodically replaces them with one
+snapshot record holding the room's metadata, current membership, bans,
+roles and read positions, plus the messages its retention policy keeps.
+On the write-ahead log the snapshot goes to a new segment and the older
+segments are deleted.
+
+A retention policy limits the messages kept by count, by age and by total
+size; a message is kept only while it is within every limit that is set,
+counting from the newest message. Limits are written as NAME=VALUE, e.g.
+"count=1000", "age=30d" or "size=10M":
+
+- count: number of messages
+- age: seconds, or with an s, m, h or d suffix
+- size: bytes of the messages' JSON, or with a K, M or G suffix
+
+Each room uses the limits configured for its ID or name (as ROOM:LIMIT,
+e.g. "general:age=7d"), or the default ones. Compaction only runs for
+rooms that have messages outside their policy, and also drops those
+messages from the in-memory history.
+"""
+
+import json
+import logging
+import time
+from dataclasses import dataclass
+from datetime import datetime
+from typing import Dict, Iterable, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Compaction configuration
+COMPACTION_INTERVAL = 300  # seconds between compaction rounds
+
+_AGE_UNITS = {"s": 1, "m": 60, "h": 3600, "d": 86400}
+_SIZE_UNITS = {"k": 1024, "m": 1024 ** 2, "g": 1024 ** 3}
+
+
+@dataclass(frozen=True)
+class RetentionPolicy:
+    """
+    Limits on the messages a room keeps in storage.
+
+    Attributes:
+        max_messages: Most messages kept (0 for no limit)
+        max_age: Oldest message kept, in seconds (0 for no limit)
+        max_bytes: Most bytes of message JSON kept (0 for no limit)
+    """
+
+    max_messages: int = 0
+    max_age: float = 0.0
+    max_bytes: int = 0
+
+    @property
+    def unlimited(self) -> bool:
+        """True if the policy keeps every message."""
+        return not (self.max_messages or self.max_age or self.max_bytes)
+
+    def retain(
+        self, messages: List[Dict], now: Optional[float] = None
+    ) -> List[Dict]:
+        """
+        Select the messages the policy keeps.
+
+        Args:
+            messages: A room's messages in sequence order
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            The newest messages within every limit, in sequence order
+        """
+        if self.unlimited:
+            return list(messages)
+        now = time.time() if now is None else now
+
+        kept: List[Dict] = []
+        size = 0
+        for message in reversed(messages):
+            if self.max_messages and len(kept) >= self.max_messages:
+                break
+            if self.max_age and now - _timestamp(message) > self.max_age:
+                break
+            size += len(json.dumps(message).encode("utf-8"))
+            if self.max_bytes and size > self.max_bytes:
+                break
+            kept.append(message)
+        kept.reverse()
+        return kept
+
+
+def _timestamp(message: Dict) -> float:
+    """Get a message's timestamp as UNIX time (0 if it has none)."""
+    try:
+        return datetime.fromisoformat(message["timestamp"]).timestamp()
+    except (KeyError, TypeError, ValueError):
+        return 0.0
+
+
+def _amount(value: str, units: Dict[str, int]) -> float:
+    """Parse a number with an optional unit suffix."""
+    value = value.strip().lower()
+    if value and value[-1] in units:
+        return float(value[:-1]) * units[value[-1]]
+    return float(value)
+
+
+def parse_retention(limits: Iterable[str]) -> RetentionPolicy:
+    """
+    Parse a retention policy (e.g., ["count=1000", "age=30d"]).
+
+    Args:
+        limits: Limits as NAME=VALUE; no limits keep everything
+
+    Returns:
+        RetentionPolicy: The policy
+
+    Raises:
+        ValueError: If a limit is unknown, malformed or not positive
+    """
+    amounts = {}
+    for limit in limits:
+        name, sep, value = limit.partition("=")
+        name = name.strip()
+        try:
+            if not sep or name not in ("count", "age", "size"):
+                raise ValueError
+            if name == "count":
+                amount = float(int(value))
+            elif name == "age":
+                amount = _amount(value, _AGE_UNITS)
+            else:
+                amount = _amount(value, _SIZE_UNITS)
+        except ValueError:
+            raise ValueError(
+                f"retention limit {limit!r} must be count=N, age=N[smhd] "
+                f"or size=N[KMG]"
+            )
+        if amount <= 0:
+            raise ValueError(f"retention limit {limit!r} must be positive")
+        amounts[name] = amount
+    return RetentionPolicy(
+        max_messages=int(amounts.get("count", 0)),
+        max_age=amounts.get("age", 0.0),
+        max_bytes=int(amounts.get("size", 0)),
+    )
+
+
+def parse_room_retention(specs: Iterable[str]) -> Dict[str, RetentionPolicy]:
+    """
+    Parse per-room limits given as ROOM:LIMIT ("general:count=500").
+
+    Limits given for the same room make up one policy.
+
+    Args:
+        specs: Limit specifications; ROOM is a room ID or name
+
+    Returns:
+        dict: {room ID or name: RetentionPolicy}
+
+    Raises:
+        ValueError: If a specification is malformed
+    """
+    limits: Dict[str, List[str]] = {}
+    for spec in specs:
+        room, sep, limit = spec.rpartition(":")
+        if not sep or not room.strip():
+            raise ValueError(f"room retention {spec!r} must be ROOM:LIMIT")
+        limits.setdefault(room.strip(), []).append(limit)
+    return {room: parse_retention(spec) for room, spec in limits.items()}
+
+
+class Compactor:
+    """
+    Compacts the stored records of the rooms administered by this node.
+    """
+
+    def __init__(
+        self,
+        room_manager,
+        default_policy: RetentionPolicy = RetentionPolicy(),
+        room_policies: Optional[Dict[str, RetentionPolicy]] = None,
+    ):
+        """
+        Initialize the compactor.
+
+        Args:
+            room_manager: The RoomStateManager whose storage is compacted
+            default_policy: Policy of rooms without one of their own
+            room_policies: Maps room ID or name -> RetentionPolicy
+        """
+        self.room_manager = room_manager
+        self.default_policy = default_policy
+        self.room_policies = dict(room_policies or {})
+
+    def policy_for(self, room_id: str, room_name: str) -> RetentionPolicy:
+        """
+        Get the retention policy of a room.
+
+        Args:
+            room_id: The room ID
+            room_name: The room's name
+
+        Returns:
+            RetentionPolicy: The room's own policy (by ID, then name), or
+            the default one
+        """
+        if room_id in self.room_policies:
+            return self.room_policies[room_id]
+        return self.room_policies.get(room_name, self.default_policy)
+
+    def run_round(self, now: Optional[float] = None) -> Dict[str, int]:
+        """
+        Compact every room with messages outside its policy.
+
+        Args:
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            dict: {room_id: number of messages dropped} for compacted rooms
+        """
+        if not self.room_manager.message_log:
+            return {}
+
+        compacted = {}
+        for room in self.room_manager.list_rooms():
+            policy = self.policy_for(room["room_id"], room["room_name"])
+            if policy.unlimited:
+                continue
+            try:
+                dropped = self.room_manager.compact_room(
+                    room["room_id"], policy, now
+                )
+            except OSError as e:
+                logger.error(
+                    f"Compaction of room {room['room_id']} failed: {e}"
+                )
+                continue
+            if dropped:
+                compacted[room["room_id"]] = dropped
+        if compacted:
+            logger.info(
+                f"Compacted {len(compacted)} rooms, dropping "
+                f"{sum(compacted.values())} messages"
+            )
+        return compacted
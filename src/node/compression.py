@@ -0,0 +1,271 @@
+"""
+Message Compression
+
+Compresses the XML-RPC bodies nodes send each other and the WebSocket
+messages they send clients. Bodies and messages under the compression
+threshold are sent as they are, since compressing them costs more CPU
+than the few bytes it saves.
+
+- Between nodes, encodings are negotiated per connection with HTTP
+  headers. A caller lists the encodings it reads in Accept-Encoding, and
+  a node compresses its response with the first of these it knows. The
+  response lists the encodings the node reads in turn (Accept-Encoding
+  on the response, as in RFC 7694), and the caller compresses its later
+  requests on the connection with the best of them. Until then requests
+  use gzip, which every node reads. zstd is offered only when the
+  zstandard package is installed.
+- WebSocket clients negotiate permessage-deflate in the handshake;
+  messages under the threshold are sent uncompressed, which the
+  extension allows message by message.
+"""
+
+import gzip
+import logging
+import zlib
+from typing import List, Optional, Tuple
+
+try:
+    import zstandard
+except ImportError:  # optional; gzip is always available
+    zstandard = None
+
+logger = logging.getLogger(__name__)
+
+# Compression configuration
+COMPRESSION_THRESHOLD = 1024  # bytes; smaller bodies are sent as they are
+MAX_DECOMPRESSED_SIZE = 64 * 1024 * 1024  # bytes a compressed body may hold
+
+# Content encodings
+GZIP = "gzip"
+ZSTD = "zstd"
+IDENTITY = "identity"
+
+# WebSocket opcodes of text and binary frames
+DATA_OPCODES = (0x1, 0x2)
+
+
+class CompressionError(Exception):
+    """A body could not be compressed or decompressed."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "PAYLOAD_TOO_LARGE")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def _unsupported(encoding: str) -> CompressionError:
+    """Build the error for an encoding this node doesn't know."""
+    return CompressionError(
+        f"Unsupported content encoding: {encoding}", "UNSUPPORTED_ENCODING"
+    )
+
+
+def supported_encodings() -> List[str]:
+    """
+    List the content encodings this node reads and writes.
+
+    Returns:
+        Encodings, the preferred first
+    """
+    return [ZSTD, GZIP] if zstandard is not None else [GZIP]
+
+
+def choose_encoding(header: Optional[str]) -> Optional[str]:
+    """
+    Pick the preferred encoding a peer accepts.
+
+    Args:
+        header: The peer's Accept-Encoding header (e.g., "zstd, gzip")
+
+    Returns:
+        The encoding to use, or None if the peer accepts none we know
+    """
+    accepted = set()
+    for part in (header or "").split(","):
+        name, _, params = part.strip().partition(";")
+        if params.strip().replace(" ", "") in ("q=0", "q=0.0"):
+            continue
+        accepted.add(name.strip().lower())
+    for encoding in supported_encodings():
+        if encoding in accepted:
+            return encoding
+    return None
+
+
+def compress(data: bytes, encoding: str) -> bytes:
+    """
+    Compress a body.
+
+    Args:
+        data: The body
+        encoding: GZIP or ZSTD
+
+    Returns:
+        The compressed body
+
+    Raises:
+        CompressionError: If the encoding isn't supported
+    """
+    if encoding == GZIP:
+        return gzip.compress(data, compresslevel=6)
+    if encoding == ZSTD and zstandard is not None:
+        return zstandard.ZstdCompressor().compress(data)
+    raise _unsupported(encoding)
+
+
+def decompress(
+    data: bytes, encoding: str, max_size: int = MAX_DECOMPRESSED_SIZE
+) -> bytes:
+    """
+    Decompress a body, refusing one that expands beyond max_size.
+
+    Args:
+        data: The compressed body
+        encoding: GZIP, ZSTD or IDENTITY
+        max_size: Most bytes the body may decompress to
+
+    Returns:
+        The decompressed body
+
+    Raises:
+        CompressionError: If the encoding isn't supported
+            (UNSUPPORTED_ENCODING), the body is corrupt (CORRUPT_BODY) or
+            it decompresses to more than max_size bytes
+            (PAYLOAD_TOO_LARGE)
+    """
+    encoding = (encoding or IDENTITY).lower()
+    if encoding == IDENTITY:
+        return data
+    if encoding == GZIP:
+        decompressor = zlib.decompressobj(16 + zlib.MAX_WBITS)
+        try:
+            body = decompressor.decompress(data, max_size + 1)
+        except zlib.error as e:
+            raise CompressionError(f"Corrupt gzip body: {e}", "CORRUPT_BODY")
+    elif encoding == ZSTD and zstandard is not None:
+        try:
+            reader = zstandard.ZstdDecompressor().stream_reader(data)
+            body = reader.read(max_size + 1)
+        except zstandard.ZstdError as e:
+            raise CompressionError(f"Corrupt zstd body: {e}", "CORRUPT_BODY")
+    else:
+        raise _unsupported(encoding)
+    if len(body) > max_size:
+        raise CompressionError(
+            f"Body decompresses to over {max_size} bytes", "PAYLOAD_TOO_LARGE"
+        )
+    return body
+
+
+def maybe_compress(
+    data: bytes,
+    encoding: Optional[str],
+    threshold: Optional[int],
+    metrics=None,
+    channel: str = "rpc",
+) -> Tuple[bytes, Optional[str]]:
+    """
+    Compress a body if it reaches the threshold and an encoding is set.
+
+    A body that doesn't get smaller is sent as it was.
+
+    Args:
+        data: The body
+        encoding: The negotiated encoding (None sends it as it is)
+        threshold: Smallest body compressed (None turns compression off)
+        metrics: Optional NodeMetrics counting the bytes saved
+        channel: Metrics label of the traffic ("rpc" or "websocket")
+
+    Returns:
+        tuple: (body to send, its encoding or None if uncompressed)
+    """
+    if threshold is None or encoding is None:
+        return data, None
+    if len(data) < threshold:
+        if metrics is not None:
+            metrics.record_compression(channel, len(data))
+        return data, None
+    compressed = compress(data, encoding)
+    if metrics is not None:
+        metrics.record_compression(channel, len(data), len(compressed))
+    if len(compressed) >= len(data):
+        return data, None
+    return compressed, encoding
+
+
+class ThresholdDeflate:
+    """
+    permessage-deflate extension of a WebSocket connection that sends
+    messages under the threshold uncompressed.
+    """
+
+    name = "permessage-deflate"
+
+    def __init__(self, extension, threshold: int, metrics=None):
+        """
+        Initialize the extension.
+
+        Args:
+            extension: The negotiated websockets PerMessageDeflate
+            threshold: Smallest message compressed, in bytes
+            metrics: Optional NodeMetrics counting the bytes saved
+        """
+        self.extension = extension
+        self.threshold = threshold
+        self.metrics = metrics
+
+    def decode(self, frame, *, max_size: Optional[int] = None):
+        """Decompress a frame from the client."""
+        return self.extension.decode(frame, max_size=max_size)
+
+    def encode(self, frame):
+        """Compress a frame to the client unless it's a small message."""
+        if frame.opcode not in DATA_OPCODES or not frame.fin:
+            return self.extension.encode(frame)
+        size = len(frame.data)
+        if size < self.threshold:
+            if self.metrics is not None:
+                self.metrics.record_compression("websocket", size)
+            return frame
+        encoded = self.extension.encode(frame)
+        if self.metrics is not None:
+            self.metrics.record_compression(
+                "websocket", size, len(encoded.data)
+            )
+        return encoded
+
+    def __repr__(self):
+        return f"ThresholdDeflate({self.extension!r}, {self.threshold})"
+
+
+def deflate_extensions(threshold: int, metrics=None) -> list:
+    """
+    Build the WebSocket server's extension factories.
+
+    Args:
+        threshold: Smallest message compressed, in bytes
+        metrics: Optional NodeMetrics counting the bytes saved
+
+    Returns:
+        list: Extension factories for websockets.serve(extensions=...)
+    """
+    from websockets.extensions.permessage_deflate import (
+        ServerPerMessageDeflateFactory,
+    )
+
+    class ThresholdDeflateFactory(ServerPerMessageDeflateFactory):
+        """permessage-deflate factory wrapping each negotiated extension."""
+
+        def process_request_params(self, params, accepted_extensions):
+            response, extension = super().process_request_params(
+                params, accepted_extensions
+            )
+            return response, ThresholdDeflate(extension, threshold, metrics)
+
+    return [ThresholdDeflateFactory()]
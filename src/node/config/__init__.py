@@ -0,0 +1,27 @@
+"""
+Configuration for Node Server
+
+This package loads node settings from a config file, environment
+variables and command-line flags, and validates them.
+"""
+
+from .settings import NodeConfig, ConfigError
+from .loader import (
+    OPTIONS,
+    load_config,
+    parse_args,
+    format_config,
+    parse_peer_nodes,
+    read_config_file,
+)
+
+__all__ = [
+    "NodeConfig",
+    "ConfigError",
+    "OPTIONS",
+    "load_config",
+    "parse_args",
+    "format_config",
+    "parse_peer_nodes",
+    "read_config_file",
+]
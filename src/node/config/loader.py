@@ -0,0 +1,1076 @@
+"""
+Node Configuration Loader
+
+Builds a NodeConfig from, in increasing order of precedence:
+
+1. Built-in defaults
+2. A TOML, YAML or JSON config file (--config or NODE_CONFIG)
+3. Environment variables (e.g., WEBSOCKET_PORT)
+4. Command-line flags (e.g., --ws-port)
+
+Every setting is described once in OPTIONS with its file key, environment
+variable and flag, so the three sources always stay in sync. Values are
+type-checked as they are read and the merged configuration is validated
+before it is returned.
+"""
+
+import argparse
+import json
+import logging
+import os
+from dataclasses import dataclass
+from typing import Any, Dict, List, Mapping, Optional, Sequence
+
+from .settings import ConfigError, NodeConfig
+
+logger = logging.getLogger(__name__)
+
+# Environment variable naming the config file
+CONFIG_ENV = "NODE_CONFIG"
+
+# Placeholder printed instead of secrets by format_config
+REDACTED = "<redacted>"
+
+_TRUE = ("1", "true", "yes", "on")
+_FALSE = ("0", "false", "no", "off")
+
+
+@dataclass(frozen=True)
+class Option:
+    """
+    A configurable setting.
+
+    Attributes:
+        name: NodeConfig field name, also used for the flag (--ws-port)
+        section: Config file section (table) the key lives in
+        key: Key within the section
+        env: Environment variable name
+        kind: Value type: "str", "int", "float", "bool", "peers" or "list"
+        help: Help text for the flag
+        flag: Flag for repeatable "list" options (e.g., --seed)
+        metavar: Placeholder for the values of "list" options in help
+    """
+
+    name: str
+    section: str
+    key: str
+    env: str
+    kind: str
+    help: str
+    flag: str = ""
+    metavar: str = "URL"
+
+
+OPTIONS = (
+    Option("node_id", "node", "id", "NODE_ID", "str", "Node identifier"),
+    Option("log_level", "node", "log_level", "LOG_LEVEL", "str", "Log level"),
+    Option(
+        "log_format",
+        "node",
+        "log_format",
+        "LOG_FORMAT",
+        "str",
+        "Log line format (text or json)",
+    ),
+    Option(
+        "compression_threshold",
+        "node",
+        "compression_threshold",
+        "COMPRESSION_THRESHOLD",
+        "int",
+        "Smallest client message or peer body compressed, in bytes",
+    ),
+    Option(
+        "ws_host",
+        "websocket",
+        "host",
+        "WEBSOCKET_HOST",
+        "str",
+        "WebSocket bind address",
+    ),
+    Option(
+        "ws_port",
+        "websocket",
+        "port",
+        "WEBSOCKET_PORT",
+        "int",
+        "WebSocket port",
+    ),
+    Option(
+        "ws_url",
+        "websocket",
+        "url",
+        "WEBSOCKET_URL",
+        "str",
+        "WebSocket URL advertised to redirected clients",
+    ),
+    Option(
+        "redirect_threshold",
+        "websocket",
+        "redirect_threshold",
+        "REDIRECT_THRESHOLD",
+        "int",
+        "Clients at which new ones are redirected to a less-loaded node",
+    ),
+    Option(
+        "max_payload_size",
+        "websocket",
+        "max_payload_size",
+        "MAX_PAYLOAD_SIZE",
+        "int",
+        "Largest client message in bytes",
+    ),
+    Option(
+        "require_message_id",
+        "websocket",
+        "require_message_id",
+        "REQUIRE_MESSAGE_ID",
+        "bool",
+        "Reject messages without a client-generated message ID",
+    ),
+    Option(
+        "send_queue_size",
+        "websocket",
+        "send_queue_size",
+        "SEND_QUEUE_SIZE",
+        "int",
+        "Messages queued per client before the send queue policy applies",
+    ),
+    Option(
+        "send_queue_policy",
+        "websocket",
+        "send_queue_policy",
+        "SEND_QUEUE_POLICY",
+        "str",
+        "Full send queue policy (drop_oldest, drop_newest or disconnect)",
+    ),
+    Option(
+        "keepalive_interval",
+        "websocket",
+        "keepalive_interval",
+        "KEEPALIVE_INTERVAL",
+        "float",
+        "Seconds between pings to clients (0: off)",
+    ),
+    Option(
+        "keepalive_timeout",
+        "websocket",
+        "keepalive_timeout",
+        "KEEPALIVE_TIMEOUT",
+        "float",
+        "Seconds a silent client has before it is marked offline",
+    ),
+    Option(
+        "keepalive_grace",
+        "websocket",
+        "keepalive_grace",
+        "KEEPALIVE_GRACE",
+        "float",
+        "Seconds a stale client is kept before it is disconnected",
+    ),
+    Option(
+        "dispatch_workers",
+        "websocket",
+        "dispatch_workers",
+        "DISPATCH_WORKERS",
+        "int",
+        "Event loop workers delivering peer events to clients",
+    ),
+    Option(
+        "ws_compression",
+        "websocket",
+        "compression",
+        "WEBSOCKET_COMPRESSION",
+        "bool",
+        "Offer clients permessage-deflate compression",
+    ),
+    Option(
+        "xmlrpc_host",
+        "xmlrpc",
+        "host",
+        "XMLRPC_HOST",
+        "str",
+        "XML-RPC bind address",
+    ),
+    Option(
+        "xmlrpc_port", "xmlrpc", "port", "XMLRPC_PORT", "int", "XML-RPC port"
+    ),
+    Option(
+        "xmlrpc_address",
+        "xmlrpc",
+        "address",
+        "XMLRPC_ADDRESS",
+        "str",
+        "XML-RPC address advertised to peers",
+    ),
+    Option(
+        "max_rpc_payload_size",
+        "xmlrpc",
+        "max_payload_size",
+        "XMLRPC_MAX_PAYLOAD_SIZE",
+        "int",
+        "Largest XML-RPC request body in bytes",
+    ),
+    Option(
+        "rpc_workers",
+        "xmlrpc",
+        "workers",
+        "XMLRPC_WORKERS",
+        "int",
+        "Threads answering XML-RPC requests",
+    ),
+    Option(
+        "fanout_workers",
+        "xmlrpc",
+        "fanout_workers",
+        "FANOUT_WORKERS",
+        "int",
+        "Threads sending messages and events to peers",
+    ),
+    Option(
+        "message_streams",
+        "xmlrpc",
+        "streams",
+        "MESSAGE_STREAMS",
+        "bool",
+        "Stream room messages to peers in batches",
+    ),
+    Option(
+        "stream_batch_size",
+        "xmlrpc",
+        "stream_batch_size",
+        "STREAM_BATCH_SIZE",
+        "int",
+        "Most messages per stream call to a peer",
+    ),
+    Option(
+        "rpc_compression",
+        "xmlrpc",
+        "compression",
+        "XMLRPC_COMPRESSION",
+        "bool",
+        "Compress request and response bodies sent to peers",
+    ),
+    Option(
+        "circuit_failures",
+        "xmlrpc",
+        "circuit_failures",
+        "CIRCUIT_FAILURES",
+        "int",
+        "Failed calls in a row before a peer's circuit opens",
+    ),
+    Option(
+        "reconnect_max_delay",
+        "xmlrpc",
+        "reconnect_max_delay",
+        "RECONNECT_MAX_DELAY",
+        "float",
+        "Longest wait between reconnection attempts to a peer, in seconds",
+    ),
+    Option(
+        "metrics_host",
+        "metrics",
+        "host",
+        "METRICS_HOST",
+        "str",
+        "Metrics endpoint bind address",
+    ),
+    Option(
+        "metrics_port",
+        "metrics",
+        "port",
+        "METRICS_PORT",
+        "int",
+        "Port of the Prometheus /metrics endpoint (0: off)",
+    ),
+    Option(
+        "min_ready_peers",
+        "metrics",
+        "min_ready_peers",
+        "MIN_READY_PEERS",
+        "int",
+        "Alive peers required before /readyz reports ready",
+    ),
+    Option(
+        "admin_host",
+        "admin",
+        "host",
+        "ADMIN_HOST",
+        "str",
+        "Admin API bind address",
+    ),
+    Option(
+        "admin_port",
+        "admin",
+        "port",
+        "ADMIN_PORT",
+        "int",
+        "Port of the admin HTTP API (0: off)",
+    ),
+    Option(
+        "admin_token",
+        "admin",
+        "token",
+        "ADMIN_TOKEN",
+        "str",
+        "Bearer token required by the admin API",
+    ),
+    Option(
+        "fault_injection",
+        "admin",
+        "fault_injection",
+        "FAULT_INJECTION",
+        "bool",
+        "Let the admin API inject crashes, delays and dropped heartbeats",
+    ),
+    Option(
+        "tracing_endpoint",
+        "tracing",
+        "endpoint",
+        "OTEL_EXPORTER_OTLP_ENDPOINT",
+        "str",
+        "OTLP/HTTP collector URL for traces (empty: off)",
+    ),
+    Option(
+        "tracing_service_name",
+        "tracing",
+        "service_name",
+        "OTEL_SERVICE_NAME",
+        "str",
+        "Service name of exported traces",
+    ),
+    Option(
+        "tracing_sample_ratio",
+        "tracing",
+        "sample_ratio",
+        "TRACING_SAMPLE_RATIO",
+        "float",
+        "Share of traces exported (0 to 1)",
+    ),
+    Option(
+        "tls_cert_file",
+        "tls",
+        "cert_file",
+        "TLS_CERT_FILE",
+        "str",
+        "PEM certificate for wss:// and https:// (empty: plaintext)",
+    ),
+    Option(
+        "tls_key_file",
+        "tls",
+        "key_file",
+        "TLS_KEY_FILE",
+        "str",
+        "PEM private key of the TLS certificate",
+    ),
+    Option(
+        "tls_ca_file",
+        "tls",
+        "ca_file",
+        "TLS_CA_FILE",
+        "str",
+        "PEM CA bundle for mutual TLS between nodes",
+    ),
+    Option(
+        "peers",
+        "peers",
+        "",
+        "PEER_NODES",
+        "peers",
+        "Peer node as ID=ADDRESS (repeatable)",
+    ),
+    Option(
+        "seeds",
+        "discovery",
+        "seeds",
+        "SEED_NODES",
+        "list",
+        "XML-RPC address of a seed node (repeatable)",
+        "--seed",
+    ),
+    Option(
+        "discovery_broadcast",
+        "discovery",
+        "broadcast",
+        "DISCOVERY_BROADCAST",
+        "bool",
+        "Announce and find nodes by LAN broadcast",
+    ),
+    Option(
+        "discovery_port",
+        "discovery",
+        "port",
+        "DISCOVERY_PORT",
+        "int",
+        "UDP port for LAN broadcast discovery",
+    ),
+    Option(
+        "node_tags",
+        "discovery",
+        "tags",
+        "NODE_TAGS",
+        "list",
+        "Capability tag advertised to peers as KEY=VALUE (repeatable)",
+        "--tag",
+        "KEY=VALUE",
+    ),
+    Option(
+        "storage_backend",
+        "storage",
+        "backend",
+        "STORAGE_BACKEND",
+        "str",
+        "Storage backend: wal, sqlite or memory",
+    ),
+    Option(
+        "data_dir",
+        "storage",
+        "data_dir",
+        "DATA_DIR",
+        "str",
+        "WAL or SQLite directory (empty with wal: in-memory only)",
+    ),
+    Option(
+        "wal_fsync",
+        "storage",
+        "wal_fsync",
+        "WAL_FSYNC",
+        "str",
+        "WAL fsync policy: always, interval or never",
+    ),
+    Option(
+        "wal_segment_size",
+        "storage",
+        "wal_segment_size",
+        "WAL_SEGMENT_SIZE",
+        "int",
+        "WAL segment size in bytes",
+    ),
+    Option(
+        "compaction_interval",
+        "storage",
+        "compaction_interval",
+        "COMPACTION_INTERVAL",
+        "float",
+        "Seconds between room log compaction rounds",
+    ),
+    Option(
+        "retention",
+        "storage",
+        "retention",
+        "RETENTION",
+        "list",
+        "Limit on stored messages per room as count=N, age=N[smhd] or "
+        "size=N[KMG] (repeatable)",
+        "--retention",
+        "LIMIT",
+    ),
+    Option(
+        "room_retention",
+        "storage",
+        "room_retention",
+        "ROOM_RETENTION",
+        "list",
+        "Limit on a room's stored messages as ROOM:LIMIT (repeatable)",
+        "--room-retention",
+        "ROOM:LIMIT",
+    ),
+    Option(
+        "retention_interval",
+        "storage",
+        "retention_interval",
+        "RETENTION_INTERVAL",
+        "float",
+        "Seconds between rounds deleting messages outside room owners' "
+        "retention policies",
+    ),
+    Option(
+        "probe_interval",
+        "timeouts",
+        "probe_interval",
+        "PROBE_INTERVAL",
+        "float",
+        "Seconds between heartbeat rounds",
+    ),
+    Option(
+        "probe_timeout",
+        "timeouts",
+        "probe_timeout",
+        "PROBE_TIMEOUT",
+        "float",
+        "Seconds to wait for a heartbeat",
+    ),
+    Option(
+        "suspect_threshold",
+        "timeouts",
+        "suspect_threshold",
+        "SUSPECT_THRESHOLD",
+        "int",
+        "Missed heartbeats before suspect",
+    ),
+    Option(
+        "dead_threshold",
+        "timeouts",
+        "dead_threshold",
+        "DEAD_THRESHOLD",
+        "int",
+        "Missed heartbeats before dead",
+    ),
+    Option(
+        "clock_skew_threshold",
+        "timeouts",
+        "clock_skew_threshold",
+        "CLOCK_SKEW_THRESHOLD",
+        "float",
+        "Seconds a peer's clock may be off before a warning",
+    ),
+    Option(
+        "gossip_interval",
+        "timeouts",
+        "gossip_interval",
+        "GOSSIP_INTERVAL",
+        "float",
+        "Seconds between gossip rounds",
+    ),
+    Option(
+        "presence_debounce",
+        "timeouts",
+        "presence_debounce",
+        "PRESENCE_DEBOUNCE",
+        "float",
+        "Seconds presence changes are collected before publishing",
+    ),
+    Option(
+        "offline_retention",
+        "timeouts",
+        "offline_retention",
+        "OFFLINE_RETENTION",
+        "float",
+        "Seconds a disconnected user's session is held (0 disables)",
+    ),
+    Option(
+        "election_timeout",
+        "timeouts",
+        "election_timeout",
+        "ELECTION_TIMEOUT",
+        "float",
+        "Seconds to wait for an election winner",
+    ),
+    Option(
+        "inactivity_timeout",
+        "timeouts",
+        "inactivity_timeout",
+        "INACTIVITY_TIMEOUT",
+        "float",
+        "Seconds before idle members are removed",
+    ),
+    Option(
+        "ephemeral_idle_timeout",
+        "timeouts",
+        "ephemeral_idle_timeout",
+        "EPHEMERAL_IDLE_TIMEOUT",
+        "float",
+        "Seconds without joins or messages before an ephemeral room is "
+        "torn down (0 only tears down empty ones)",
+    ),
+    Option(
+        "drain_timeout",
+        "timeouts",
+        "drain_timeout",
+        "DRAIN_TIMEOUT",
+        "float",
+        "Seconds allowed for draining on shutdown",
+    ),
+    Option(
+        "session_ttl",
+        "timeouts",
+        "session_ttl",
+        "SESSION_TTL",
+        "float",
+        "Seconds a session token stays valid",
+    ),
+    Option(
+        "auth_secret",
+        "auth",
+        "secret",
+        "AUTH_SECRET",
+        "str",
+        "Cluster-wide session signing secret",
+    ),
+    Option(
+        "auth_required",
+        "auth",
+        "required",
+        "AUTH_REQUIRED",
+        "bool",
+        "Require clients to log in",
+    ),
+    Option(
+        "rate_limiting",
+        "rate_limit",
+        "enabled",
+        "RATE_LIMITING",
+        "bool",
+        "Rate limit client commands",
+    ),
+    Option(
+        "rate_limits",
+        "rate_limit",
+        "limits",
+        "RATE_LIMITS",
+        "list",
+        "Limit of a command type as COMMAND=RATE/BURST (repeatable)",
+        "--rate-limit",
+        "LIMIT",
+    ),
+    Option(
+        "failover",
+        "features",
+        "failover",
+        "FAILOVER_ENABLED",
+        "bool",
+        "Elect new admins for rooms on dead nodes",
+    ),
+    Option(
+        "replication_factor",
+        "features",
+        "replication_factor",
+        "REPLICATION_FACTOR",
+        "int",
+        "Follower nodes per room (0: off)",
+    ),
+    Option(
+        "room_registry",
+        "features",
+        "room_registry",
+        "ROOM_REGISTRY",
+        "str",
+        "Room registry: gossip or raft (strongly consistent)",
+    ),
+    Option(
+        "sharding",
+        "features",
+        "sharding",
+        "SHARDING",
+        "bool",
+        "Place rooms on nodes by consistent hashing of their IDs",
+    ),
+    Option(
+        "degraded_mode",
+        "features",
+        "degraded_mode",
+        "DEGRADED_MODE",
+        "str",
+        "Rooms with an unreachable admin: buffer or read_only",
+    ),
+    Option(
+        "max_attachment_size",
+        "features",
+        "max_attachment_size",
+        "MAX_ATTACHMENT_SIZE",
+        "int",
+        "Largest attached file in bytes (0 disables attachments)",
+    ),
+    Option(
+        "webhooks",
+        "features",
+        "webhooks",
+        "WEBHOOKS",
+        "bool",
+        "Deliver room events to webhooks registered by room owners",
+    ),
+    Option(
+        "bots",
+        "features",
+        "bots",
+        "BOTS",
+        "bool",
+        "Let users register bots that log in with an API key",
+    ),
+    Option(
+        "bridges",
+        "features",
+        "bridges",
+        "BRIDGES",
+        "bool",
+        "Relay hosted rooms to IRC channels and Matrix rooms",
+    ),
+    Option(
+        "egress_allow",
+        "features",
+        "egress_allow",
+        "EGRESS_ALLOW",
+        "list",
+        "Internal network webhooks and bridges may connect to, as CIDR "
+        "(repeatable)",
+        "--egress-allow",
+        "CIDR",
+    ),
+    Option(
+        "filter_rules",
+        "filters",
+        "rules",
+        "FILTER_RULES",
+        "list",
+        "Content filter rule for every hosted room as ACTION:PATTERN, "
+        "ACTION reject or redact (repeatable)",
+        "--filter-rule",
+        "ACTION:PATTERN",
+    ),
+    Option(
+        "filter_plugins",
+        "filters",
+        "plugins",
+        "FILTER_PLUGINS",
+        "list",
+        "Content filter class rooms can enable as MODULE:CLASS (repeatable)",
+        "--filter-plugin",
+        "MODULE:CLASS",
+    ),
+    Option(
+        "push_gateway_url",
+        "push",
+        "gateway_url",
+        "PUSH_GATEWAY_URL",
+        "str",
+        "Push gateway for notifications to offline users (empty disables)",
+    ),
+    Option(
+        "push_gateway_key",
+        "push",
+        "gateway_key",
+        "PUSH_GATEWAY_KEY",
+        "str",
+        "Bearer token sent to the push gateway",
+    ),
+    Option(
+        "reconnect_urls",
+        "shutdown",
+        "reconnect_urls",
+        "RECONNECT_URLS",
+        "list",
+        "WebSocket URL of another node (repeatable)",
+        "--reconnect-url",
+    ),
+)
+
+# Settings whose values format_config never prints
+SECRET_OPTIONS = ("auth_secret", "admin_token", "push_gateway_key")
+
+
+def parse_peer_nodes(spec: str) -> Dict[str, str]:
+    """
+    Parse a PEER_NODES value.
+
+    Format: node2:http://node2:9090,node3:http://node3:9090. The legacy
+    form node_id:host:port is also accepted.
+
+    Args:
+        spec: Comma-separated peer list
+
+    Returns:
+        dict: {node_id: xmlrpc_address}
+    """
+    peers = {}
+    for peer_spec in spec.split(","):
+        if ":" not in peer_spec:
+            continue
+        peer_id, peer_addr = (part.strip() for part in peer_spec.split(":", 1))
+        if not peer_addr.startswith(("http://", "https://")):
+            # Assume format is node_id:node_host:port
+            addr_parts = peer_spec.strip().split(":")
+            if len(addr_parts) >= 3:
+                peer_id = addr_parts[0]
+                peer_addr = f"http://{addr_parts[1]}:{addr_parts[2]}"
+        peers[peer_id] = peer_addr
+    return peers
+
+
+def read_config_file(path: str) -> Dict[str, Any]:
+    """
+    Read a TOML, YAML or JSON config file, chosen by file extension.
+
+    Args:
+        path: Path to the file
+
+    Returns:
+        The parsed file as nested sections
+
+    Raises:
+        ConfigError: If the file cannot be read or parsed
+    """
+    extension = os.path.splitext(path)[1].lower()
+    try:
+        with open(path, "rb") as handle:
+            raw = handle.read()
+    except OSError as e:
+        raise ConfigError([f"Cannot read config file {path}: {e}"])
+
+    try:
+        if extension == ".toml":
+            try:
+                import tomllib
+            except ImportError:  # Python < 3.11
+                import tomli as tomllib
+            data = tomllib.loads(raw.decode("utf-8"))
+        elif extension in (".yaml", ".yml"):
+            try:
+                import yaml
+            except ImportError:
+                raise ConfigError(
+                    [f"PyYAML is required to read {path}: pip install pyyaml"]
+                )
+            data = yaml.safe_load(raw) or {}
+        elif extension == ".json":
+            data = json.loads(raw)
+        else:
+            raise ConfigError(
+                [f"Unsupported config file type {extension!r} ({path})"]
+            )
+    except ConfigError:
+        raise
+    except Exception as e:
+        raise ConfigError([f"Cannot parse config file {path}: {e}"])
+
+    if not isinstance(data, dict):
+        raise ConfigError([f"Config file {path} must contain a mapping"])
+    return data
+
+
+def parse_args(argv: Optional[Sequence[str]] = None) -> argparse.Namespace:
+    """
+    Parse the node's command-line flags.
+
+    Only flags that were given appear on the returned namespace, so unset
+    flags never override the file or environment.
+
+    Args:
+        argv: Arguments to parse (defaults to sys.argv[1:])
+
+    Returns:
+        argparse.Namespace of the given flags, plus config and print_config
+    """
+    parser = argparse.ArgumentParser(
+        prog="chat-node",
+        description="Distributed chat node server",
+        argument_default=argparse.SUPPRESS,
+    )
+    parser.add_argument(
+        "--config",
+        metavar="FILE",
+        help=f"TOML, YAML or JSON config file (env {CONFIG_ENV})",
+    )
+    parser.add_argument(
+        "--print-config",
+        action="store_true",
+        default=False,
+        help="Print the effective configuration and exit",
+    )
+    for option in OPTIONS:
+        flag = "--" + option.name.replace("_", "-")
+        help_text = f"{option.help} (env {option.env})"
+        if option.kind == "bool":
+            parser.add_argument(
+                flag, dest=option.name, action="store_true", help=help_text
+            )
+            parser.add_argument(
+                "--no-" + flag[2:], dest=option.name, action="store_false"
+            )
+        elif option.kind == "peers":
+            parser.add_argument(
+                "--peer",
+                dest=option.name,
+                action="append",
+                metavar="ID=ADDRESS",
+                help=help_text,
+            )
+        elif option.kind == "list":
+            parser.add_argument(
+                option.flag,
+                dest=option.name,
+                action="append",
+                metavar=option.metavar,
+                help=help_text,
+            )
+        else:
+            parser.add_argument(flag, dest=option.name, help=help_text)
+    return parser.parse_args(argv)
+
+
+def load_config(
+    args: Optional[argparse.Namespace] = None,
+    environ: Optional[Mapping[str, str]] = None,
+) -> NodeConfig:
+    """
+    Build and validate the node configuration.
+
+    Args:
+        args: Parsed flags from parse_args (None for no flags)
+        environ: Environment variables (defaults to os.environ)
+
+    Returns:
+        The validated NodeConfig
+
+    Raises:
+        ConfigError: With every problem found in any source
+    """
+    environ = os.environ if environ is None else environ
+    flags = vars(args) if args is not None else {}
+    values: Dict[str, Any] = {}
+    errors: List[str] = []
+
+    path = flags.get("config") or environ.get(CONFIG_ENV)
+    if path:
+        data = read_config_file(path)
+        values.update(_from_file(data, path, errors))
+        logger.info(f"Loaded configuration from {path}")
+
+    for option in OPTIONS:
+        if option.env in environ:
+            raw = environ[option.env]
+            if option.kind == "peers":
+                raw = parse_peer_nodes(raw)
+            elif option.kind == "list":
+                raw = [url for url in raw.split(",") if url.strip()]
+            _set(values, option, raw, option.env, errors)
+
+    for option in OPTIONS:
+        if option.name in flags:
+            raw = flags[option.name]
+            if option.kind == "peers":
+                raw = _parse_peer_flags(raw, errors)
+            _set(values, option, raw, "--" + option.name, errors)
+
+    config = NodeConfig(**values)
+    errors.extend(config.validate())
+    if errors:
+        raise ConfigError(errors)
+    return config
+
+
+def format_config(config: NodeConfig) -> str:
+    """
+    Render a configuration as a TOML config file.
+
+    Secrets are replaced with a placeholder.
+
+    Args:
+        config: The configuration
+
+    Returns:
+        TOML text that load_config can read back
+    """
+    sections: Dict[str, List[str]] = {}
+    for option in OPTIONS:
+        value = getattr(config, option.name)
+        if option.kind == "peers":
+            sections["peers"] = [
+                f"{json.dumps(peer_id)} = {json.dumps(address)}"
+                for peer_id, address in sorted(value.items())
+            ]
+            continue
+        if option.name in SECRET_OPTIONS and value:
+            value = REDACTED
+        sections.setdefault(option.section, []).append(
+            f"{option.key} = {_toml_value(value)}"
+        )
+
+    blocks = []
+    for section in dict.fromkeys(option.section for option in OPTIONS):
+        lines = sections.get(section, [])
+        blocks.append("\n".join([f"[{section}]"] + lines))
+    return "\n\n".join(blocks) + "\n"
+
+
+def _from_file(data: Dict, path: str, errors: List[str]) -> Dict[str, Any]:
+    """Map a parsed config file onto NodeConfig field values."""
+    by_key = {(o.section, o.key): o for o in OPTIONS}
+    values: Dict[str, Any] = {}
+    for section, table in data.items():
+        if not isinstance(table, dict):
+            errors.append(f"{path}: [{section}] must be a table")
+            continue
+        if section == "peers":
+            option = by_key[("peers", "")]
+            _set(values, option, table, f"{path}: [peers]", errors)
+            continue
+        for key, raw in table.items():
+            option = by_key.get((section, key))
+            if option is None:
+                errors.append(f"{path}: unknown setting {section}.{key}")
+                continue
+            _set(values, option, raw, f"{path}: {section}.{key}", errors)
+    return values
+
+
+def _parse_peer_flags(specs: List[str], errors: List[str]) -> Dict[str, str]:
+    """Parse repeated --peer ID=ADDRESS flags."""
+    peers = {}
+    for spec in specs:
+        peer_id, sep, address = spec.partition("=")
+        if not sep or not peer_id.strip():
+            errors.append(f"--peer {spec!r} must be ID=ADDRESS")
+            continue
+        peers[peer_id.strip()] = address.strip()
+    return peers
+
+
+def _set(
+    values: Dict[str, Any],
+    option: Option,
+    raw: Any,
+    source: str,
+    errors: List[str],
+) -> None:
+    """Convert a raw value and store it, recording conversion errors."""
+    try:
+        values[option.name] = _convert(option.kind, raw)
+    except (TypeError, ValueError) as e:
+        errors.append(f"{source}: {e}")
+
+
+def _convert(kind: str, raw: Any) -> Any:
+    """Convert a value from any source to the option's type."""
+    if kind == "str":
+        if not isinstance(raw, (str, int, float)) or isinstance(raw, bool):
+            raise TypeError(f"expected a string, got {raw!r}")
+        return str(raw)
+    if kind in ("int", "float"):
+        if isinstance(raw, bool):
+            raise TypeError(f"expected a number, got {raw!r}")
+        try:
+            return float(raw) if kind == "float" else int(raw)
+        except (TypeError, ValueError):
+            raise ValueError(f"expected {kind}, got {raw!r}")
+    if kind == "bool":
+        if isinstance(raw, bool):
+            return raw
+        text = str(raw).strip().lower()
+        if text in _TRUE:
+            return True
+        if text in _FALSE:
+            return False
+        raise ValueError(f"expected true or false, got {raw!r}")
+    if kind == "peers":
+        if not isinstance(raw, dict):
+            raise TypeError(f"expected a table of peers, got {raw!r}")
+        return {str(k).strip(): str(v).strip() for k, v in raw.items()}
+    if kind == "list":
+        if isinstance(raw, str):
+            raw = raw.split(",")
+        if not isinstance(raw, list):
+            raise TypeError(f"expected a list, got {raw!r}")
+        return [str(item).strip() for item in raw if str(item).strip()]
+    raise ValueError(f"unknown option type {kind}")
+
+
+def _toml_value(value: Any) -> str:
+    """Render a scalar or list of strings as a TOML value."""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (int, float)):
+        return repr(value)
+    if isinstance(value, list):
+        return "[" + ", ".join(json.dumps(item) for item in value) + "]"
+    return json.dumps(value)
+
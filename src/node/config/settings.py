@@ -0,0 +1,561 @@
+"""
+Node Configuration Settings
+
+The NodeConfig dataclass holds every setting a node is started with, with
+defaults taken from the subsystems' module constants.
+"""
+
+import os
+import re
+from dataclasses import dataclass, field
+from typing import Dict, List
+
+from ..admin_api import DEFAULT_ADMIN_PORT
+from ..attachments import MAX_ATTACHMENT_SIZE
+from ..auth import SESSION_TTL
+from ..compaction import (
+    COMPACTION_INTERVAL,
+    parse_retention,
+    parse_room_retention,
+)
+from ..clock_skew import CLOCK_SKEW_THRESHOLD
+from ..compression import COMPRESSION_THRESHOLD
+from ..content_filters import (
+    FilterRegistry,
+    load_filter_plugins,
+    parse_filter_rules,
+)
+from ..discovery import DISCOVERY_PORT
+from ..dispatch import DISPATCH_WORKERS, FANOUT_WORKERS, RPC_WORKERS
+from ..egress import EgressPolicy
+from ..ephemeral import EPHEMERAL_IDLE_TIMEOUT
+from ..failover import ELECTION_TIMEOUT
+from ..failure_detector import (
+    DEAD_THRESHOLD,
+    PROBE_INTERVAL,
+    PROBE_TIMEOUT,
+    SUSPECT_THRESHOLD,
+)
+from ..keepalive import KEEPALIVE_GRACE, KEEPALIVE_INTERVAL, KEEPALIVE_TIMEOUT
+from ..log_context import LOG_FORMATS, TEXT
+from ..message_streams import STREAM_BATCH_SIZE
+from ..metrics import DEFAULT_METRICS_PORT
+from ..offline_queue import OFFLINE_RETENTION
+from ..partition import BUFFER, DEGRADED_MODES
+from ..placement import parse_tags
+from ..peer_connections import CIRCUIT_FAILURE_THRESHOLD, RECONNECT_MAX_DELAY
+from ..presence import PRESENCE_DEBOUNCE
+from ..raft import GOSSIP, ROOM_REGISTRY_MODES
+from ..rate_limit import parse_rate_limits
+from ..replication import REPLICATION_FACTOR
+from ..retention import RETENTION_INTERVAL
+from ..room_directory import GOSSIP_INTERVAL
+from ..room_state import INACTIVITY_TIMEOUT
+from ..send_queue import DROP_OLDEST, SEND_QUEUE_POLICIES, SEND_QUEUE_SIZE
+from ..shutdown import DRAIN_TIMEOUT
+from ..storage import STORAGE_BACKENDS, WAL
+from ..tracing import DEFAULT_SERVICE_NAME
+from ..utils.validation import MAX_PAYLOAD_SIZE, MAX_RPC_PAYLOAD_SIZE
+from ..wal import FSYNC_POLICIES, SEGMENT_SIZE
+
+LOG_LEVELS = ("DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL")
+
+_NODE_ID_PATTERN = re.compile(r"^[A-Za-z0-9_.-]+$")
+
+
+class ConfigError(Exception):
+    """The node configuration is invalid or could not be loaded."""
+
+    def __init__(self, errors: List[str]):
+        """
+        Initialize the error.
+
+        Args:
+            errors: One message per problem found
+        """
+        super().__init__("; ".join(errors))
+        self.errors = errors
+
+
+@dataclass
+class NodeConfig:
+    """
+    Settings for a node server.
+
+    Attributes:
+        node_id: Unique identifier for this node
+        ws_host: WebSocket host address to bind to
+        ws_port: WebSocket port to listen on
+        ws_url: WebSocket URL clients are redirected to this node at
+            (derived from node_id and ws_port if empty)
+        redirect_threshold: Connected clients at which new clients are
+            redirected to a less-loaded node (0 disables redirects)
+        max_payload_size: Largest client WebSocket message, in bytes
+        require_message_id: Reject client messages without a message ID
+        send_queue_size: Messages queued for a slow client before the send
+            queue policy applies
+        send_queue_policy: What to do when a client's send queue is full
+            ("drop_oldest", "drop_newest" or "disconnect")
+        keepalive_interval: Seconds between pings to clients (0 disables
+            keepalive)
+        keepalive_timeout: Seconds a client may stay silent before it is
+            marked offline
+        keepalive_grace: Seconds a silent client is kept connected after
+            that before it is disconnected
+        dispatch_workers: Event loop workers delivering peer events to
+            clients, one room at a time each
+        ws_compression: Offer clients permessage-deflate compression
+        xmlrpc_host: XML-RPC host address to bind to
+        xmlrpc_port: XML-RPC port to listen on
+        xmlrpc_address: Address peers use to reach this node (derived from
+            node_id and xmlrpc_port if empty)
+        max_rpc_payload_size: Largest XML-RPC request body, in bytes
+        rpc_workers: Threads answering XML-RPC requests
+        fanout_workers: Threads sending messages and events to peers,
+            one room at a time each
+        message_streams: Send room messages to each peer on a long-lived
+            batched stream instead of a call per message
+        stream_batch_size: Most messages per stream call
+        rpc_compression: Compress request and response bodies sent to
+            peers
+        circuit_failures: Failed calls in a row to a peer before its
+            circuit breaker opens and calls fail without dialling it
+        reconnect_max_delay: Longest wait, in seconds, between
+            reconnection attempts to a peer whose circuit is open
+        compression_threshold: Smallest client message or peer body
+            compressed, in bytes
+        metrics_host: Metrics endpoint host address to bind to
+        metrics_port: Port of the Prometheus /metrics endpoint (0
+            disables it), which also serves /healthz and /readyz
+        min_ready_peers: Alive peers required before /readyz reports the
+            node ready
+        admin_host: Admin API host address to bind to
+        admin_port: Port of the admin HTTP API (0 disables it)
+        admin_token: Bearer token required by every admin API request
+        fault_injection: Whether the admin API can make this node crash
+            at 2PC phases, delay RPCs and drop heartbeats (for testing
+            failure recovery only)
+        tracing_endpoint: OTLP/HTTP collector URL traces are exported to
+            (empty disables tracing)
+        tracing_service_name: service.name of exported traces
+        tracing_sample_ratio: Share of new traces that are exported
+        tls_cert_file: PEM certificate of the WebSocket listener and the
+            XML-RPC server (empty serves plaintext)
+        tls_key_file: PEM private key of the certificate
+        tls_ca_file: PEM CA bundle peer certificates must be signed by
+            (enables mutual TLS between nodes)
+        peers: Static list of peer nodes {node_id: xmlrpc_address}
+        seeds: XML-RPC addresses of nodes contacted to find the cluster
+        discovery_broadcast: Whether to announce and find nodes by LAN
+            broadcast
+        discovery_port: UDP port for LAN broadcast discovery
+        node_tags: Capability tags advertised to peers, as KEY=VALUE
+            (e.g., "region=eu"), which room placement constraints are
+            matched against
+        storage_backend: Where state is persisted: "wal" (the write-ahead
+            log in data_dir), "sqlite" (a database in data_dir) or
+            "memory" (nothing survives a restart)
+        data_dir: Directory for the write-ahead log or SQLite database
+            (with the wal backend, empty keeps all state in memory)
+        wal_fsync: WAL fsync policy ("always", "interval", "never")
+        wal_segment_size: WAL segment file size in bytes
+        compaction_interval: Seconds between room log compaction rounds
+        retention: Limits on the messages each room keeps in storage, as
+            NAME=VALUE (e.g., "count=1000", "age=30d", "size=10M"; none
+            keeps every message)
+        room_retention: Limits replacing the default ones for some rooms,
+            as ROOM:NAME=VALUE (e.g., "general:age=7d")
+        retention_interval: Seconds between rounds deleting messages
+            outside the retention policies room owners set
+        probe_interval: Seconds between failure detector heartbeat rounds
+        probe_timeout: Seconds to wait for each heartbeat
+        suspect_threshold: Missed heartbeats before a peer is suspected
+        dead_threshold: Missed heartbeats before a peer is declared dead
+        clock_skew_threshold: Seconds a peer's clock, as estimated from
+            heartbeats, may be ahead or behind before a warning is logged
+        gossip_interval: Seconds between room directory gossip rounds
+        presence_debounce: Seconds a user's presence changes are collected
+            before they are published (0 publishes every change)
+        offline_retention: Seconds a disconnected user's rooms and missed
+            messages are held for them to resume (0 disables)
+        election_timeout: Seconds to wait for an election winner
+        inactivity_timeout: Seconds before an idle member is removed
+        ephemeral_idle_timeout: Seconds without joins or messages before
+            an ephemeral room is torn down (0 only tears down empty ones)
+        drain_timeout: Seconds allowed for draining on shutdown
+        session_ttl: Seconds a session token stays valid
+        auth_secret: Cluster-wide secret for signing session tokens
+        auth_required: Whether clients must log in before other commands
+        rate_limiting: Whether client commands are rate limited
+        rate_limits: Limits replacing the defaults for some command types,
+            as COMMAND=RATE/BURST (e.g., "send_message=5/10")
+        failover: Whether to elect new admins for rooms on dead nodes
+        replication_factor: Follower nodes each hosted room is replicated
+            to (0 disables replication)
+        room_registry: How nodes agree on which rooms exist: "gossip"
+            (the eventually consistent room directory) or "raft" (a
+            replicated registry committed by a majority)
+        sharding: Whether rooms are administered by their owner on a
+            consistent hash ring of the cluster's nodes, and moved when
+            nodes join or leave, instead of by the node they were
+            created on
+        degraded_mode: What remote rooms whose admin node is unreachable
+            do with new messages: "buffer" them until it is reachable, or
+            reject them ("read_only")
+        max_attachment_size: Largest file clients can attach to messages,
+            in bytes (0 disables attachments)
+        webhooks: Whether room owners can register webhooks that this
+            node POSTs their rooms' events to
+        bots: Whether users can register bots that log in to this node
+            with an API key
+        bridges: Whether room owners can bridge hosted rooms to IRC
+            channels and Matrix rooms
+        egress_allow: Internal networks (CIDR) webhooks and bridges may
+            connect to anyway; others are refused
+        filter_rules: Content filter rules run on every hosted room's
+            messages, as ACTION:PATTERN (e.g., "reject:free crypto")
+        filter_plugins: ContentFilter classes rooms can enable besides
+            the built-in filters, as MODULE:CLASS
+        push_gateway_url: HTTP(S) endpoint of the push gateway that
+            relays notifications to offline users' devices (empty
+            disables push notifications)
+        push_gateway_key: Bearer token the push gateway expects
+        reconnect_urls: WebSocket URLs of other nodes for the shutdown
+            reconnect hint
+        log_level: Logging level name
+        log_format: Log line format ("text" key=value pairs or "json")
+    """
+
+    node_id: str = "node1"
+    ws_host: str = "0.0.0.0"
+    ws_port: int = 8080
+    ws_url: str = ""
+    redirect_threshold: int = 0
+    max_payload_size: int = MAX_PAYLOAD_SIZE
+    require_message_id: bool = True
+    send_queue_size: int = SEND_QUEUE_SIZE
+    send_queue_policy: str = DROP_OLDEST
+    keepalive_interval: float = KEEPALIVE_INTERVAL
+    keepalive_timeout: float = KEEPALIVE_TIMEOUT
+    keepalive_grace: float = KEEPALIVE_GRACE
+    dispatch_workers: int = DISPATCH_WORKERS
+    ws_compression: bool = True
+    xmlrpc_host: str = "0.0.0.0"
+    xmlrpc_port: int = 9090
+    xmlrpc_address: str = ""
+    max_rpc_payload_size: int = MAX_RPC_PAYLOAD_SIZE
+    rpc_workers: int = RPC_WORKERS
+    fanout_workers: int = FANOUT_WORKERS
+    message_streams: bool = True
+    stream_batch_size: int = STREAM_BATCH_SIZE
+    rpc_compression: bool = True
+    circuit_failures: int = CIRCUIT_FAILURE_THRESHOLD
+    reconnect_max_delay: float = RECONNECT_MAX_DELAY
+    compression_threshold: int = COMPRESSION_THRESHOLD
+    metrics_host: str = "0.0.0.0"
+    metrics_port: int = DEFAULT_METRICS_PORT
+    min_ready_peers: int = 0
+    admin_host: str = "127.0.0.1"
+    admin_port: int = DEFAULT_ADMIN_PORT
+    admin_token: str = ""
+    fault_injection: bool = False
+    tracing_endpoint: str = ""
+    tracing_service_name: str = DEFAULT_SERVICE_NAME
+    tracing_sample_ratio: float = 1.0
+    tls_cert_file: str = ""
+    tls_key_file: str = ""
+    tls_ca_file: str = ""
+    peers: Dict[str, str] = field(default_factory=dict)
+    seeds: List[str] = field(default_factory=list)
+    discovery_broadcast: bool = False
+    discovery_port: int = DISCOVERY_PORT
+    node_tags: List[str] = field(default_factory=list)
+    storage_backend: str = WAL
+    data_dir: str = ""
+    wal_fsync: str = "always"
+    wal_segment_size: int = SEGMENT_SIZE
+    compaction_interval: float = COMPACTION_INTERVAL
+    retention: List[str] = field(default_factory=list)
+    room_retention: List[str] = field(default_factory=list)
+    retention_interval: float = RETENTION_INTERVAL
+    probe_interval: float = PROBE_INTERVAL
+    probe_timeout: float = PROBE_TIMEOUT
+    suspect_threshold: int = SUSPECT_THRESHOLD
+    dead_threshold: int = DEAD_THRESHOLD
+    clock_skew_threshold: float = CLOCK_SKEW_THRESHOLD
+    gossip_interval: float = GOSSIP_INTERVAL
+    presence_debounce: float = PRESENCE_DEBOUNCE
+    offline_retention: float = OFFLINE_RETENTION
+    election_timeout: float = ELECTION_TIMEOUT
+    inactivity_timeout: float = INACTIVITY_TIMEOUT
+    ephemeral_idle_timeout: float = EPHEMERAL_IDLE_TIMEOUT
+    drain_timeout: float = DRAIN_TIMEOUT
+    session_ttl: float = SESSION_TTL
+    auth_secret: str = ""
+    auth_required: bool = False
+    rate_limiting: bool = True
+    rate_limits: List[str] = field(default_factory=list)
+    failover: bool = True
+    replication_factor: int = REPLICATION_FACTOR
+    room_registry: str = GOSSIP
+    sharding: bool = False
+    degraded_mode: str = BUFFER
+    max_attachment_size: int = MAX_ATTACHMENT_SIZE
+    webhooks: bool = True
+    bots: bool = True
+    bridges: bool = True
+    egress_allow: List[str] = field(default_factory=list)
+    filter_rules: List[str] = field(default_factory=list)
+    filter_plugins: List[str] = field(default_factory=list)
+    push_gateway_url: str = ""
+    push_gateway_key: str = ""
+    reconnect_urls: List[str] = field(default_factory=list)
+    log_level: str = "INFO"
+    log_format: str = TEXT
+
+    def __post_init__(self):
+        if not self.ws_url:
+            scheme = "wss" if self.tls_cert_file else "ws"
+            self.ws_url = f"{scheme}://{self.node_id}:{self.ws_port}"
+        if not self.xmlrpc_address:
+            scheme = "https" if self.tls_cert_file else "http"
+            self.xmlrpc_address = (
+                f"{scheme}://{self.node_id}:{self.xmlrpc_port}"
+            )
+
+    def validate(self) -> List[str]:
+        """
+        Check the settings for consistency.
+
+        Returns:
+            List of problems found (empty if the configuration is valid)
+        """
+        errors = []
+        if not _NODE_ID_PATTERN.match(self.node_id or ""):
+            errors.append(
+                f"node_id {self.node_id!r} must be non-empty and contain "
+                f"only letters, digits, '.', '_' or '-'"
+            )
+        for name in ("ws_port", "xmlrpc_port", "discovery_port"):
+            port = getattr(self, name)
+            if not 1 <= port <= 65535:
+                errors.append(f"{name} {port} must be between 1 and 65535")
+        if self.ws_port == self.xmlrpc_port and (
+            self.ws_host == self.xmlrpc_host
+        ):
+            errors.append(
+                f"ws_port and xmlrpc_port are both {self.ws_port} on "
+                f"{self.ws_host}"
+            )
+        if not 0 <= self.metrics_port <= 65535:
+            errors.append(
+                f"metrics_port {self.metrics_port} must be between 0 and "
+                f"65535"
+            )
+        for name, port, host in (
+            ("ws_port", self.ws_port, self.ws_host),
+            ("xmlrpc_port", self.xmlrpc_port, self.xmlrpc_host),
+        ):
+            if port == self.metrics_port and host == self.metrics_host:
+                errors.append(
+                    f"{name} and metrics_port are both {port} on {host}"
+                )
+        if not 0 <= self.admin_port <= 65535:
+            errors.append(
+                f"admin_port {self.admin_port} must be between 0 and 65535"
+            )
+        if self.admin_port:
+            if not self.admin_token:
+                errors.append("admin_port requires an admin_token")
+            for name, port, host in (
+                ("ws_port", self.ws_port, self.ws_host),
+                ("xmlrpc_port", self.xmlrpc_port, self.xmlrpc_host),
+                ("metrics_port", self.metrics_port, self.metrics_host),
+            ):
+                if port == self.admin_port and host == self.admin_host:
+                    errors.append(
+                        f"{name} and admin_port are both {port} on {host}"
+                    )
+        if not self.ws_url.startswith(("ws://", "wss://")):
+            errors.append(
+                f"ws_url {self.ws_url!r} must be a ws:// or wss:// URL"
+            )
+        if self.redirect_threshold < 0:
+            errors.append("redirect_threshold must not be negative")
+        if not _is_http_url(self.xmlrpc_address):
+            errors.append(
+                f"xmlrpc_address {self.xmlrpc_address!r} must be an "
+                f"http:// or https:// URL"
+            )
+        if self.tracing_endpoint and not _is_http_url(self.tracing_endpoint):
+            errors.append(
+                f"tracing_endpoint {self.tracing_endpoint!r} must be an "
+                f"http:// or https:// URL"
+            )
+        if self.push_gateway_url and not _is_http_url(self.push_gateway_url):
+            errors.append(
+                f"push_gateway_url {self.push_gateway_url!r} must be an "
+                f"http:// or https:// URL"
+            )
+        if not 0 <= self.tracing_sample_ratio <= 1:
+            errors.append("tracing_sample_ratio must be between 0 and 1")
+        errors.extend(self._validate_tls())
+        try:
+            parse_rate_limits(self.rate_limits)
+        except ValueError as e:
+            errors.append(str(e))
+        try:
+            EgressPolicy(self.egress_allow)
+        except ValueError as e:
+            errors.append(str(e))
+        try:
+            parse_filter_rules(self.filter_rules)
+            FilterRegistry(load_filter_plugins(self.filter_plugins))
+        except ValueError as e:
+            errors.append(str(e))
+        for peer_id, address in self.peers.items():
+            if peer_id == self.node_id:
+                errors.append(f"Peer list contains this node ({peer_id})")
+            if not _is_http_url(address):
+                errors.append(
+                    f"Peer {peer_id} address {address!r} must be an "
+                    f"http:// or https:// URL"
+                )
+        try:
+            parse_tags(self.node_tags)
+        except ValueError as e:
+            errors.append(str(e))
+        for seed in self.seeds:
+            if not _is_http_url(seed):
+                errors.append(
+                    f"Seed address {seed!r} must be an http:// or https:// URL"
+                )
+        if self.storage_backend not in STORAGE_BACKENDS:
+            errors.append(
+                f"storage_backend {self.storage_backend!r} must be one of "
+                f"{', '.join(STORAGE_BACKENDS)}"
+            )
+        elif self.storage_backend == "sqlite" and not self.data_dir:
+            errors.append("storage_backend sqlite needs a data_dir")
+        if self.wal_fsync not in FSYNC_POLICIES:
+            errors.append(
+                f"wal_fsync {self.wal_fsync!r} must be one of "
+                f"{', '.join(FSYNC_POLICIES)}"
+            )
+        if self.wal_segment_size <= 0:
+            errors.append("wal_segment_size must be positive")
+        for parse, limits in (
+            (parse_retention, self.retention),
+            (parse_room_retention, self.room_retention),
+        ):
+            try:
+                parse(limits)
+            except ValueError as e:
+                errors.append(str(e))
+        if self.send_queue_policy not in SEND_QUEUE_POLICIES:
+            errors.append(
+                f"send_queue_policy {self.send_queue_policy!r} must be one "
+                f"of {', '.join(SEND_QUEUE_POLICIES)}"
+            )
+        for name in (
+            "max_payload_size",
+            "max_rpc_payload_size",
+            "send_queue_size",
+            "dispatch_workers",
+            "rpc_workers",
+            "fanout_workers",
+            "stream_batch_size",
+            "compression_threshold",
+            "circuit_failures",
+        ):
+            if getattr(self, name) <= 0:
+                errors.append(f"{name} must be positive")
+        for name in (
+            "reconnect_max_delay",
+            "probe_interval",
+            "probe_timeout",
+            "clock_skew_threshold",
+            "gossip_interval",
+            "compaction_interval",
+            "retention_interval",
+            "election_timeout",
+            "inactivity_timeout",
+            "keepalive_timeout",
+            "drain_timeout",
+            "session_ttl",
+        ):
+            if getattr(self, name) <= 0:
+                errors.append(f"{name} must be positive")
+        for name in (
+            "presence_debounce",
+            "offline_retention",
+            "ephemeral_idle_timeout",
+            "min_ready_peers",
+            "keepalive_interval",
+            "keepalive_grace",
+            "max_attachment_size",
+        ):
+            if getattr(self, name) < 0:
+                errors.append(f"{name} must not be negative")
+        if not 1 <= self.suspect_threshold <= self.dead_threshold:
+            errors.append(
+                "Thresholds must satisfy 1 <= suspect_threshold "
+                "<= dead_threshold"
+            )
+        if self.replication_factor < 0:
+            errors.append("replication_factor must not be negative")
+        if self.room_registry not in ROOM_REGISTRY_MODES:
+            errors.append(
+                f"room_registry {self.room_registry!r} must be one of "
+                f"{', '.join(ROOM_REGISTRY_MODES)}"
+            )
+        if self.degraded_mode not in DEGRADED_MODES:
+            errors.append(
+                f"degraded_mode {self.degraded_mode!r} must be one of "
+                f"{', '.join(DEGRADED_MODES)}"
+            )
+        for url in self.reconnect_urls:
+            if not url.startswith(("ws://", "wss://")):
+                errors.append(
+                    f"reconnect URL {url!r} must be a ws:// or wss:// URL"
+                )
+        if self.log_level.upper() not in LOG_LEVELS:
+            errors.append(
+                f"log_level {self.log_level!r} must be one of "
+                f"{', '.join(LOG_LEVELS)}"
+            )
+        if self.log_format not in LOG_FORMATS:
+            errors.append(
+                f"log_format {self.log_format!r} must be one of "
+                f"{', '.join(LOG_FORMATS)}"
+            )
+        return errors
+
+    def _validate_tls(self) -> List[str]:
+        """Check the TLS files and that peers are reached over https://."""
+        errors = []
+        if bool(self.tls_cert_file) != bool(self.tls_key_file):
+            errors.append("tls_cert_file and tls_key_file must be set together")
+        if self.tls_ca_file and not self.tls_cert_file:
+            errors.append("tls_ca_file requires tls_cert_file and tls_key_file")
+        for name in ("tls_cert_file", "tls_key_file", "tls_ca_file"):
+            path = getattr(self, name)
+            if path and not os.path.isfile(path):
+                errors.append(f"{name} {path!r} does not exist")
+        if not self.tls_cert_file:
+            return errors
+        addresses = [("xmlrpc_address", self.xmlrpc_address)]
+        addresses.extend((f"peer {p}", a) for p, a in self.peers.items())
+        addresses.extend(("seed", seed) for seed in self.seeds)
+        for name, address in addresses:
+            if address.startswith("http://"):
+                errors.append(
+                    f"{name} {address!r} must be an https:// URL when TLS "
+                    f"is enabled"
+                )
+        return errors
+
+
+def _is_http_url(address: str) -> bool:
+    """Check that an address looks like an HTTP(S) URL."""
+    return address.startswith(("http://", "https://")) and len(address) > 8
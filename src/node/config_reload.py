@@ -0,0 +1,283 @@
+"""
+Hot Configuration Reload
+
+On SIGHUP, or a POST to /admin/config/reload, the node reads its
+configuration again from the same config file, environment and flags it
+was started with, and applies the settings that can change while it
+runs:
+
+- log_level: the root logger's level
+- rate_limits: the rate limiter's limits; every bucket starts full again
+- retention, room_retention: the compactor's policies, used from its next
+  round
+- seeds: the discovery seeds; new seeds are handshaken right away
+- tls_cert_file, tls_key_file, tls_ca_file: the certificates, read again
+  even if the paths didn't change, so certificates rotated in place are
+  picked up (see tls.py)
+
+Other settings (ports, the storage backend, the node ID, turning features
+or TLS on or off, ...) are structural: a changed value is reported as
+needing a restart and the running value is kept. A configuration that
+fails validation is rejected as a whole.
+
+Every reload is recorded as CONFIG_RELOADED in the node's audit log,
+naming each changed setting with its old and new value (secrets
+redacted) and the settings that need a restart; the "audit" logger gets
+the same as a log line.
+"""
+
+import logging
+import signal
+import threading
+from dataclasses import fields, replace
+from typing import Any, Callable, Dict, List
+
+from .audit import CONFIG_RELOADED, audit
+from .compaction import parse_retention, parse_room_retention
+from .config import ConfigError, NodeConfig
+from .config.loader import REDACTED, SECRET_OPTIONS
+from .rate_limit import parse_rate_limits
+
+logger = logging.getLogger(__name__)
+
+# Reload decisions are also logged here, apart from the node's other logs
+audit_logger = logging.getLogger("audit")
+
+# Settings applied without a restart
+RELOADABLE_SETTINGS = (
+    "log_level",
+    "rate_limits",
+    "retention",
+    "room_retention",
+    "seeds",
+    "tls_cert_file",
+    "tls_key_file",
+    "tls_ca_file",
+)
+TLS_SETTINGS = ("tls_cert_file", "tls_key_file", "tls_ca_file")
+
+
+def diff_config(old: NodeConfig, new: NodeConfig) -> Dict[str, Dict]:
+    """
+    Find the settings whose values differ between two configurations.
+
+    Args:
+        old: The running configuration
+        new: The configuration read again
+
+    Returns:
+        dict: Maps each changed setting -> {"old": value, "new": value},
+        with secrets redacted
+    """
+    changes = {}
+    for field in fields(NodeConfig):
+        before = getattr(old, field.name)
+        after = getattr(new, field.name)
+        if before == after:
+            continue
+        if field.name in SECRET_OPTIONS:
+            before, after = REDACTED, REDACTED
+        changes[field.name] = {"old": before, "new": after}
+    return changes
+
+
+class ConfigReloader:
+    """
+    Reads the configuration again and applies the reloadable settings.
+    """
+
+    def __init__(
+        self,
+        config: NodeConfig,
+        load: Callable[[], NodeConfig],
+        rate_limiter=None,
+        compactor=None,
+        discovery=None,
+        tls=None,
+        audit_log=None,
+    ):
+        """
+        Initialize the reloader.
+
+        Args:
+            config: The configuration the node is running with
+            load: Function reading and validating the configuration, e.g.
+                load_config with the node's flags
+            rate_limiter: Optional RateLimiter given the new rate limits
+            compactor: Optional Compactor given the new retention policies
+            discovery: Optional PeerDiscovery given the new seeds
+            tls: Optional TLSManager whose certificates are reloaded
+            audit_log: Optional AuditLog reloads are recorded in
+        """
+        self.config = config
+        self.load = load
+        self.rate_limiter = rate_limiter
+        self.compactor = compactor
+        self.discovery = discovery
+        self.tls = tls
+        self.audit_log = audit_log
+        self.reloads = 0
+        self._lock = threading.Lock()
+
+    def reload(
+        self, trigger: str = "SIGHUP", actor: str = ""
+    ) -> Dict[str, Any]:
+        """
+        Read the configuration again and apply what can change at runtime.
+
+        Args:
+            trigger: What asked for the reload, for the audit log
+            actor: Who asked for it, for the audit log (the trigger if
+                empty)
+
+        Returns:
+            dict: On success, "changed" (the applied settings with their
+            old and new values), "restart_required" (changed settings
+            that were kept) and "tls_reloaded"; on failure, error and
+            error_code INVALID_CONFIG
+        """
+        with self._lock:
+            try:
+                new = self.load()
+            except ConfigError as e:
+                audit_logger.warning(
+                    f"Configuration reload ({trigger}) rejected: {e}",
+                    extra={"event": "config_reload", "errors": e.errors},
+                )
+                return {
+                    "success": False,
+                    "error": f"Invalid configuration: {e}",
+                    "error_code": "INVALID_CONFIG",
+                }
+
+            changes = diff_config(self.config, new)
+            restart_required = sorted(
+                name
+                for name in changes
+                if name not in RELOADABLE_SETTINGS
+                or (name in TLS_SETTINGS and not self._tls_reloadable(new))
+            )
+            applied = {
+                name: change
+                for name, change in changes.items()
+                if name not in restart_required
+            }
+            tls_reloaded = self._apply(new, applied)
+            self.config = replace(
+                self.config, **{name: getattr(new, name) for name in applied}
+            )
+            self.reloads += 1
+
+        self._audit(trigger, actor or trigger, applied, restart_required)
+        return {
+            "success": True,
+            "changed": applied,
+            "restart_required": restart_required,
+            "tls_reloaded": tls_reloaded,
+        }
+
+    def _tls_reloadable(self, new: NodeConfig) -> bool:
+        """Check whether new TLS settings can replace the running ones."""
+        return (
+            self.tls is not None
+            and bool(new.tls_cert_file)
+            and bool(new.tls_ca_file) == self.tls.mutual
+        )
+
+    def _apply(self, new: NodeConfig, applied: Dict[str, Dict]) -> bool:
+        """
+        Hand the applied settings to the node's components.
+
+        Returns:
+            bool: Whether the TLS certificates were reloaded
+        """
+        if "log_level" in applied:
+            logging.getLogger().setLevel(new.log_level.upper())
+        if "rate_limits" in applied and self.rate_limiter is not None:
+            self.rate_limiter.set_limits(parse_rate_limits(new.rate_limits))
+        if self.compactor is not None:
+            if "retention" in applied:
+                self.compactor.default_policy = parse_retention(new.retention)
+            if "room_retention" in applied:
+                self.compactor.room_policies = parse_room_retention(
+                    new.room_retention
+                )
+        if "seeds" in applied and self.discovery is not None:
+            self._apply_seeds(new.seeds)
+        if self.tls is None or not self._tls_reloadable(new):
+            return False
+        return self.tls.reload(
+            new.tls_cert_file, new.tls_key_file, new.tls_ca_file
+        )
+
+    def _apply_seeds(self, seeds: List[str]) -> None:
+        """Replace the discovery seeds and handshake with the new ones."""
+        added = [seed for seed in seeds if seed not in self.discovery.seeds]
+        self.discovery.seeds = list(seeds)
+        for address in added:
+            self.discovery.handshake(address)
+
+    def _audit(
+        self,
+        trigger: str,
+        actor: str,
+        applied: Dict[str, Dict],
+        restart_required: List[str],
+    ) -> None:
+        """Record a reload in the audit log and the audit logger."""
+        audit(
+            self.audit_log,
+            actor,
+            CONFIG_RELOADED,
+            trigger=trigger,
+            changed=applied,
+            restart_required=restart_required,
+        )
+        described = ", ".join(
+            f"{name}: {change['old']!r} -> {change['new']!r}"
+            for name, change in sorted(applied.items())
+        )
+        message = (
+            f"Configuration reloaded ({trigger}): "
+            f"{described or 'no settings changed'}"
+        )
+        if restart_required:
+            message += (
+                f"; kept until restart: {', '.join(restart_required)}"
+            )
+        audit_logger.info(
+            message,
+            extra={
+                "event": "config_reload",
+                "trigger": trigger,
+                "changed": applied,
+                "restart_required": restart_required,
+            },
+        )
+
+
+def install_reload_handler(loop, reloader: ConfigReloader) -> bool:
+    """
+    Reload the configuration when the process receives SIGHUP.
+
+    The reload runs in the loop's executor, since handshakes with new
+    seeds block.
+
+    Args:
+        loop: The running event loop
+        reloader: The node's ConfigReloader
+
+    Returns:
+        bool: True if the handler was installed (False where the platform
+        has no SIGHUP, e.g. on Windows)
+    """
+    sighup = getattr(signal, "SIGHUP", None)
+    if sighup is None:
+        return False
+    try:
+        loop.add_signal_handler(
+            sighup, lambda: loop.run_in_executor(None, reloader.reload)
+        )
+    except (NotImplementedError, RuntimeError):
+        return False
+    return True
@@ -0,0 +1,191 @@
+"""
+Client Connection Registry
+
+Keeps track of every WebSocket client connected to this node, along with
+metadata such as when it connected and which user it is acting as.
+"""
+
+import logging
+import secrets
+import uuid
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+
+@dataclass
+class ClientConnection:
+    """
+    Information about a connected WebSocket client.
+
+    Attributes:
+        client_id: Unique identifier assigned to the connection
+        websocket: The underlying WebSocket connection
+        remote_address: Remote address of the client, if known
+        connected_at: ISO 8601 timestamp when the client connected
+        username: Username the client last acted as (None until known)
+        session_token: Session token the client authenticated with, if any
+        session_id: Secret the client can present after reconnecting to
+            resume this connection's session (never listed in to_dict)
+        send_queue: SendQueue of messages waiting to be sent to the
+            client, once its connection is being served
+        bot: True if the client is a bot logged in with its API key
+        service_account: Name of the service account the client logged
+            in as with its API key, if any (see service_accounts.py)
+        last_seen: When the client last sent anything (keepalive clock)
+        stale_since: When the client was found not answering pings, or
+            None while it answers
+        repaired: Maps room_id -> sequence number up to which the client
+            is not sent messages again (see stream_repair.py)
+    """
+
+    client_id: str
+    websocket: Any
+    remote_address: Optional[str] = None
+    connected_at: str = ""
+    username: Optional[str] = None
+    session_token: Optional[str] = None
+    session_id: str = ""
+    send_queue: Any = None
+    bot: bool = False
+    service_account: Optional[str] = None
+    last_seen: float = 0.0
+    stale_since: Optional[float] = None
+    repaired: Dict[str, int] = field(default_factory=dict)
+
+    def __post_init__(self):
+        """Initialize the connection timestamp and session ID if not set."""
+        if not self.connected_at:
+            self.connected_at = datetime.now(timezone.utc).isoformat()
+        if not self.session_id:
+            self.session_id = secrets.token_urlsafe(16)
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return {
+            "client_id": self.client_id,
+            "remote_address": self.remote_address,
+            "connected_at": self.connected_at,
+            "username": self.username,
+            "authenticated": self.session_token is not None,
+            "bot": self.bot,
+            "service_account": self.service_account,
+        }
+
+
+class ConnectionRegistry:
+    """
+    Registry of WebSocket clients connected to this node.
+
+    Connections are keyed by their WebSocket object so handlers can look
+    up metadata for the connection a request arrived on.
+    """
+
+    def __init__(self):
+        """Initialize an empty connection registry."""
+        self._connections: Dict[Any, ClientConnection] = {}
+
+    def register(self, websocket) -> ClientConnection:
+        """
+        Register a newly connected client.
+
+        Args:
+            websocket: The WebSocket connection
+
+        Returns:
+            The ClientConnection created for the client
+        """
+        remote = getattr(websocket, "remote_address", None)
+        if isinstance(remote, tuple):
+            remote = ":".join(str(part) for part in remote[:2])
+
+        connection = ClientConnection(
+            client_id=str(uuid.uuid4()),
+            websocket=websocket,
+            remote_address=remote,
+        )
+        self._connections[websocket] = connection
+        logger.debug(f"Registered client connection {connection.client_id}")
+        return connection
+
+    def unregister(self, websocket) -> Optional[ClientConnection]:
+        """
+        Remove a client from the registry.
+
+        Args:
+            websocket: The WebSocket connection
+
+        Returns:
+            The removed ClientConnection, or None if it was not registered
+        """
+        connection = self._connections.pop(websocket, None)
+        if connection:
+            logger.debug(
+                f"Unregistered client connection {connection.client_id}"
+            )
+        return connection
+
+    def get(self, websocket) -> Optional[ClientConnection]:
+        """Get the connection info for a WebSocket."""
+        return self._connections.get(websocket)
+
+    def get_by_id(self, client_id: str) -> Optional[ClientConnection]:
+        """Get the connection info for a client ID."""
+        for connection in self._connections.values():
+            if connection.client_id == client_id:
+                return connection
+        return None
+
+    def set_username(self, websocket, username: str) -> None:
+        """
+        Record the username a client is acting as.
+
+        Args:
+            websocket: The WebSocket connection
+            username: The username to associate with the connection
+        """
+        connection = self._connections.get(websocket)
+        if connection:
+            connection.username = username
+
+    def set_session(self, websocket, username: str, token: str) -> None:
+        """
+        Bind an authenticated session to a client.
+
+        Args:
+            websocket: The WebSocket connection
+            username: The authenticated username
+            token: The session token
+        """
+        connection = self._connections.get(websocket)
+        if connection:
+            connection.username = username
+            connection.session_token = token
+
+    def clear_session(self, websocket) -> None:
+        """Remove the authenticated session from a client."""
+        connection = self._connections.get(websocket)
+        if connection:
+            connection.session_token = None
+
+    def find_by_username(self, username: str) -> List[ClientConnection]:
+        """Get all connections associated with a username."""
+        return [
+            connection
+            for connection in self._connections.values()
+            if connection.username == username
+        ]
+
+    def list_connections(self) -> List[ClientConnection]:
+        """Get all registered connections."""
+        return list(self._connections.values())
+
+    def __len__(self) -> int:
+        """Return the number of registered connections."""
+        return len(self._connections)
+
+    def __contains__(self, websocket) -> bool:
+        """Check if a WebSocket is registered."""
+        return websocket in self._connections
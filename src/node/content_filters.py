@@ -0,0 +1,582 @@
+"""
+Content Filters
+
+Before a room's administrator node sequences a message, or applies an
+edit, it runs the content through the room's filter chain. Each filter
+either lets the content through, changes it (redacts the offending
+words or links), or rejects the message with MESSAGE_REJECTED. Redacted
+messages are stored and delivered with "filtered" listing the filters
+that changed them.
+
+Built-in filters, which the room owner and moderators enable and
+configure with set_content_filters:
+
+- max_mentions: rejects messages with more than "limit" @mentions
+- banned_words: rejects, or redacts with asterisks, any of "words"
+  (whole words, ignoring case)
+- url_allowlist: rejects, or replaces with "[link removed]", links to
+  hosts other than "domains" and their subdomains
+
+Operators extend the pipeline in two ways:
+
+- Rules in the node configuration (filter_rules, as ACTION:PATTERN) run
+  before every hosted room's own filters
+- Plugins (filter_plugins, as MODULE:CLASS) are ContentFilter subclasses
+  imported at startup; rooms enable them by their type like the built-in
+  filters
+
+A room's filters are room metadata like its spam thresholds: written to
+the message log and sent with joins, replication and snapshots. A node
+taking over a room skips filters whose plugin it hasn't loaded. Encrypted
+messages are never filtered, since nodes can't read them.
+"""
+
+import importlib
+import logging
+import re
+from abc import ABC, abstractmethod
+from typing import Any, Dict, Iterable, List, Optional, Tuple, Type
+from urllib.parse import urlsplit
+
+from .spam import count_mentions
+
+logger = logging.getLogger(__name__)
+
+# What a filter does with content it catches
+REJECT = "reject"
+REDACT = "redact"
+FILTER_ACTIONS = (REJECT, REDACT)
+
+# Error code of rejected messages
+MESSAGE_REJECTED = "MESSAGE_REJECTED"
+
+MAX_FILTERS = 10  # filters per room
+MAX_MENTION_LIMIT = 1000
+MAX_WORDS = 200  # banned words per filter
+MAX_DOMAINS = 100  # allowed domains per filter
+
+REDACTED_LINK = "[link removed]"
+
+URL_PATTERN = re.compile(r"\b(?:https?://|www\.)[^\s<>\"']+", re.IGNORECASE)
+_DOMAIN = re.compile(r"^(?=.{1,253}$)([a-z0-9-]{1,63}\.)*[a-z0-9-]{1,63}$")
+
+
+class ContentFilterError(Exception):
+    """
+    A message was rejected by a filter, or filters could not be set.
+
+    Attributes:
+        error_code: Machine-readable code (e.g., "MESSAGE_REJECTED")
+        filter_type: Type of the filter that rejected the message
+    """
+
+    def __init__(self, message: str, error_code: str, filter_type: str = ""):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code
+            filter_type: Type of the rejecting filter, for MESSAGE_REJECTED
+        """
+        super().__init__(message)
+        self.error_code = error_code
+        self.filter_type = filter_type
+
+
+class ContentFilter(ABC):
+    """
+    A check on message content.
+
+    Subclasses set type, the name rooms enable them by, and implement
+    apply(). Those taking options check them in __init__, raising
+    ContentFilterError with INVALID_REQUEST, and return them from
+    options(). Plugins are loaded with load_filter_plugins.
+    """
+
+    type: str = ""
+
+    def __init__(self, **options: Any):
+        """
+        Initialize the filter.
+
+        Args:
+            **options: The filter's settings
+
+        Raises:
+            ContentFilterError: INVALID_REQUEST if an option is invalid
+        """
+        if options:
+            raise ContentFilterError(
+                f"{self.type} takes no options", "INVALID_REQUEST"
+            )
+
+    @abstractmethod
+    def apply(self, content: str) -> str:
+        """
+        Check a message's content.
+
+        Args:
+            content: The message content
+
+        Returns:
+            The content, redacted where the filter changes it
+
+        Raises:
+            ContentFilterError: MESSAGE_REJECTED if the message is refused
+        """
+
+    def options(self) -> Dict[str, Any]:
+        """Get the filter's settings, as given to its constructor."""
+        return {}
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to the dictionary stored with the room."""
+        return dict(self.options(), type=self.type)
+
+    def reject(self, reason: str) -> ContentFilterError:
+        """Create the error rejecting a message."""
+        return ContentFilterError(reason, MESSAGE_REJECTED, self.type)
+
+
+def _action(filter_type: str, action: Any) -> str:
+    """Check the action option of a filter."""
+    if action not in FILTER_ACTIONS:
+        raise ContentFilterError(
+            f"{filter_type} action must be one of {', '.join(FILTER_ACTIONS)}",
+            "INVALID_REQUEST",
+        )
+    return action
+
+
+def _strings(filter_type: str, name: str, values: Any, limit: int) -> List[str]:
+    """Check a list option of a filter, dropping repeats and case."""
+    if (
+        not isinstance(values, list)
+        or len(values) > limit
+        or not all(isinstance(v, str) and v.strip() for v in values)
+    ):
+        raise ContentFilterError(
+            f"{filter_type} {name} must be a list of up to {limit} "
+            f"non-empty strings",
+            "INVALID_REQUEST",
+        )
+    return list(dict.fromkeys(v.strip().lower() for v in values))
+
+
+class MaxMentionsFilter(ContentFilter):
+    """Rejects messages mentioning too many users."""
+
+    type = "max_mentions"
+
+    def __init__(self, limit: Any = None):
+        """
+        Initialize the filter.
+
+        Args:
+            limit: Most @mentions allowed in a message
+
+        Raises:
+            ContentFilterError: INVALID_REQUEST if limit isn't a whole
+                number from 1 to MAX_MENTION_LIMIT
+        """
+        if (
+            isinstance(limit, bool)
+            or not isinstance(limit, int)
+            or not 1 <= limit <= MAX_MENTION_LIMIT
+        ):
+            raise ContentFilterError(
+                f"max_mentions limit must be a whole number, 1 to "
+                f"{MAX_MENTION_LIMIT}",
+                "INVALID_REQUEST",
+            )
+        self.limit = limit
+
+    def apply(self, content: str) -> str:
+        """Reject the message if it has more than limit mentions."""
+        if count_mentions(content) > self.limit:
+            raise self.reject(
+                f"Messages may mention at most {self.limit} users"
+            )
+        return content
+
+    def options(self) -> Dict[str, Any]:
+        """Get the filter's settings."""
+        return {"limit": self.limit}
+
+
+class BannedWordsFilter(ContentFilter):
+    """Rejects or redacts messages containing banned words."""
+
+    type = "banned_words"
+
+    def __init__(self, words: Any = None, action: Any = REDACT):
+        """
+        Initialize the filter.
+
+        Args:
+            words: The banned words or phrases, matched as whole words
+                ignoring case
+            action: REDACT to replace them with asterisks, REJECT to
+                refuse the message
+
+        Raises:
+            ContentFilterError: INVALID_REQUEST if words isn't a list of
+                up to MAX_WORDS strings or action is unknown
+        """
+        self.words = _strings(self.type, "words", words, MAX_WORDS)
+        self.action = _action(self.type, action)
+        alternatives = "|".join(
+            re.escape(word) for word in sorted(self.words, key=len)[::-1]
+        )
+        self._pattern = re.compile(
+            rf"(?<!\w)(?:{alternatives})(?!\w)", re.IGNORECASE
+        )
+
+    def apply(self, content: str) -> str:
+        """Reject the message or redact the banned words in it."""
+        if not self.words or not self._pattern.search(content):
+            return content
+        if self.action == REJECT:
+            raise self.reject("Message contains a banned word")
+        return self._pattern.sub(lambda m: "*" * len(m.group()), content)
+
+    def options(self) -> Dict[str, Any]:
+        """Get the filter's settings."""
+        return {"words": list(self.words), "action": self.action}
+
+
+class URLAllowlistFilter(ContentFilter):
+    """Rejects or removes links to hosts outside an allowlist."""
+
+    type = "url_allowlist"
+
+    def __init__(self, domains: Any = None, action: Any = REJECT):
+        """
+        Initialize the filter.
+
+        Args:
+            domains: Hosts links may point to; their subdomains are
+                allowed too (empty allows no links)
+            action: REJECT to refuse the message, REDACT to replace the
+                links with REDACTED_LINK
+
+        Raises:
+            ContentFilterError: INVALID_REQUEST if domains isn't a list
+                of up to MAX_DOMAINS host names or action is unknown
+        """
+        self.domains = _strings(self.type, "domains", domains, MAX_DOMAINS)
+        invalid = [d for d in self.domains if not _DOMAIN.match(d)]
+        if invalid:
+            raise ContentFilterError(
+                f"url_allowlist domains are not host names: "
+                f"{', '.join(invalid)}",
+                "INVALID_REQUEST",
+            )
+        self.action = _action(self.type, action)
+
+    def allowed(self, url: str) -> bool:
+        """Check whether a link points to an allowed host."""
+        if not url.lower().startswith(("http://", "https://")):
+            url = f"http://{url}"
+        try:
+            host = (urlsplit(url).hostname or "").rstrip(".")
+        except ValueError:
+            return False
+        return any(
+            host == domain or host.endswith(f".{domain}")
+            for domain in self.domains
+        )
+
+    def apply(self, content: str) -> str:
+        """Reject the message or remove the links it may not contain."""
+        if all(self.allowed(url) for url in URL_PATTERN.findall(content)):
+            return content
+        if self.action == REJECT:
+            raise self.reject("Message links to a site that isn't allowed")
+        return URL_PATTERN.sub(
+            lambda m: m.group() if self.allowed(m.group()) else REDACTED_LINK,
+            content,
+        )
+
+    def options(self) -> Dict[str, Any]:
+        """Get the filter's settings."""
+        return {"domains": list(self.domains), "action": self.action}
+
+
+class RuleFilter(ContentFilter):
+    """
+    A rule from the node configuration: a regular expression rejecting
+    or redacting what it matches in every hosted room.
+    """
+
+    type = "rule"
+
+    def __init__(self, pattern: str, action: str = REJECT):
+        """
+        Initialize the filter.
+
+        Args:
+            pattern: The regular expression
+            action: REJECT or REDACT (matches become asterisks)
+
+        Raises:
+            ContentFilterError: INVALID_REQUEST if the action is unknown
+                or the pattern is not a valid regular expression
+        """
+        self.action = _action(self.type, action)
+        try:
+            self._pattern = re.compile(pattern, re.IGNORECASE)
+        except re.error as e:
+            raise ContentFilterError(
+                f"Invalid filter rule {pattern!r}: {e}", "INVALID_REQUEST"
+            ) from e
+
+    def apply(self, content: str) -> str:
+        """Reject the message or redact what the pattern matches."""
+        if not self._pattern.search(content):
+            return content
+        if self.action == REJECT:
+            raise self.reject("Message is not allowed on this server")
+        return self._pattern.sub(lambda m: "*" * len(m.group()), content)
+
+    def options(self) -> Dict[str, Any]:
+        """Get the rule's settings."""
+        return {"pattern": self._pattern.pattern, "action": self.action}
+
+
+BUILTIN_FILTERS: Tuple[Type[ContentFilter], ...] = (
+    MaxMentionsFilter,
+    BannedWordsFilter,
+    URLAllowlistFilter,
+)
+
+
+class FilterChain:
+    """
+    Filters run in order, each on the content the previous one passed.
+    """
+
+    def __init__(self, filters: Iterable[ContentFilter] = ()):
+        """
+        Initialize the chain.
+
+        Args:
+            filters: The filters, in the order they run
+        """
+        self.filters = list(filters)
+
+    def run(self, content: str) -> Tuple[str, List[str]]:
+        """
+        Run a message's content through the filters.
+
+        Args:
+            content: The message content
+
+        Returns:
+            (content, filtered): the content after every filter, and the
+            types of the filters that changed it
+
+        Raises:
+            ContentFilterError: MESSAGE_REJECTED from the first filter
+                refusing the message
+        """
+        filtered = []
+        for content_filter in self.filters:
+            changed = content_filter.apply(content)
+            if changed != content:
+                filtered.append(content_filter.type)
+            content = changed
+        return content, filtered
+
+    def __len__(self) -> int:
+        """Count the filters in the chain."""
+        return len(self.filters)
+
+
+class FilterRegistry:
+    """
+    The filter types rooms can enable, and the node's own rules.
+    """
+
+    def __init__(
+        self,
+        plugins: Iterable[Type[ContentFilter]] = (),
+        rules: Iterable[RuleFilter] = (),
+    ):
+        """
+        Initialize the registry with the built-in filters.
+
+        Args:
+            plugins: Extra filter classes (see load_filter_plugins)
+            rules: Rules run before every room's filters (see
+                parse_filter_rules)
+
+        Raises:
+            ValueError: If a plugin's type is missing or already taken
+        """
+        self._types: Dict[str, Type[ContentFilter]] = {}
+        self.rules = list(rules)
+        for filter_class in BUILTIN_FILTERS + tuple(plugins):
+            self.register(filter_class)
+
+    def register(self, filter_class: Type[ContentFilter]) -> None:
+        """
+        Add a filter type rooms can enable.
+
+        Raises:
+            ValueError: If the class has no type or its type is taken
+        """
+        if not filter_class.type or filter_class.type == RuleFilter.type:
+            raise ValueError(
+                f"content filter {filter_class.__name__} needs a type"
+            )
+        if filter_class.type in self._types:
+            raise ValueError(
+                f"content filter type {filter_class.type!r} is already "
+                f"registered"
+            )
+        self._types[filter_class.type] = filter_class
+
+    def types(self) -> List[str]:
+        """Get the filter types rooms can enable."""
+        return list(self._types)
+
+    def build(self, spec: Any) -> ContentFilter:
+        """
+        Create a filter from its stored dictionary.
+
+        Args:
+            spec: {"type": filter type, **options}
+
+        Returns:
+            The filter
+
+        Raises:
+            ContentFilterError: INVALID_REQUEST if the type is unknown or
+                an option is invalid
+        """
+        if not isinstance(spec, dict) or not isinstance(spec.get("type"), str):
+            raise ContentFilterError(
+                "Each filter needs a type", "INVALID_REQUEST"
+            )
+        options = dict(spec)
+        filter_type = options.pop("type")
+        filter_class = self._types.get(filter_type)
+        if filter_class is None:
+            raise ContentFilterError(
+                f"Unknown filter type {filter_type!r}; use one of "
+                f"{', '.join(self._types)}",
+                "INVALID_REQUEST",
+            )
+        try:
+            return filter_class(**options)
+        except TypeError as e:
+            raise ContentFilterError(
+                f"Invalid options for {filter_type}: {e}", "INVALID_REQUEST"
+            ) from e
+
+    def validate(self, specs: Any) -> List[Dict[str, Any]]:
+        """
+        Check the filters of a set_content_filters request.
+
+        Args:
+            specs: List of {"type": filter type, **options}, in the order
+                they run (empty removes the room's filters)
+
+        Returns:
+            The filters as stored with the room
+
+        Raises:
+            ContentFilterError: INVALID_REQUEST if specs isn't a list of
+                up to MAX_FILTERS valid filters
+        """
+        if not isinstance(specs, list) or len(specs) > MAX_FILTERS:
+            raise ContentFilterError(
+                f"filters must be a list of up to {MAX_FILTERS} filters",
+                "INVALID_REQUEST",
+            )
+        return [self.build(spec).to_dict() for spec in specs]
+
+    def chain(self, specs: List[Dict[str, Any]]) -> FilterChain:
+        """
+        Build a room's chain: the node's rules, then the room's filters.
+
+        Filters this node can't build, such as those of plugins it hasn't
+        loaded, are skipped with a warning.
+
+        Args:
+            specs: The room's filters, as stored with it
+
+        Returns:
+            The chain
+        """
+        filters: List[ContentFilter] = list(self.rules)
+        for spec in specs:
+            try:
+                filters.append(self.build(spec))
+            except ContentFilterError as e:
+                logger.warning(f"Skipping content filter {spec}: {e}")
+        return FilterChain(filters)
+
+
+def parse_filter_rules(specs: Iterable[str]) -> List[RuleFilter]:
+    """
+    Parse filter rules given as ACTION:PATTERN ("redact:\\b\\d{16}\\b").
+
+    Args:
+        specs: Rule specifications; ACTION is "reject" or "redact"
+
+    Returns:
+        The rules, in the order given
+
+    Raises:
+        ValueError: If a specification is malformed
+    """
+    rules = []
+    for spec in specs:
+        action, sep, pattern = spec.partition(":")
+        if not sep or not pattern:
+            raise ValueError(f"filter rule {spec!r} must be ACTION:PATTERN")
+        try:
+            rules.append(RuleFilter(pattern, action.strip().lower()))
+        except ContentFilterError as e:
+            raise ValueError(f"filter rule {spec!r}: {e}") from e
+    return rules
+
+
+def load_filter_plugins(
+    specs: Iterable[str],
+) -> List[Type[ContentFilter]]:
+    """
+    Import the filter classes of plugins given as MODULE:CLASS.
+
+    Args:
+        specs: Plugin specifications (e.g., "mycompany.filters:PIIFilter")
+
+    Returns:
+        The classes, in the order given
+
+    Raises:
+        ValueError: If a specification is malformed, its module can't be
+            imported, or it doesn't name a ContentFilter subclass
+    """
+    plugins = []
+    for spec in specs:
+        module_name, sep, class_name = spec.partition(":")
+        if not sep or not module_name or not class_name:
+            raise ValueError(f"filter plugin {spec!r} must be MODULE:CLASS")
+        try:
+            module = importlib.import_module(module_name)
+        except ImportError as e:
+            raise ValueError(f"filter plugin {spec!r}: {e}") from e
+        filter_class: Optional[Any] = getattr(module, class_name, None)
+        if not (
+            isinstance(filter_class, type)
+            and issubclass(filter_class, ContentFilter)
+        ):
+            raise ValueError(
+                f"filter plugin {spec!r} is not a ContentFilter subclass"
+            )
+        plugins.append(filter_class)
+    return plugins
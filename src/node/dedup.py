@@ -0,0 +1,137 @@
+"""
+Message Deduplication
+
+Clients choose the ID of every message they send, and forwarding calls
+are retried with the same ID after a timeout. The ID makes those calls
+idempotent: a DedupWindow remembers the messages of each room for a while
+by ID, so a retry gets the original message back instead of adding it a
+second time.
+
+The room administrator checks its window before sequencing a message,
+and member nodes check theirs before delivering a broadcast, so a
+retransmission at either hop never shows up twice in a member's feed.
+"""
+
+import logging
+import threading
+import time
+from collections import OrderedDict
+from typing import Callable, Dict, Optional
+
+logger = logging.getLogger(__name__)
+
+# Deduplication configuration
+DEDUP_WINDOW = 600  # seconds message IDs are remembered
+DEDUP_MAX_IDS = 10000  # message IDs remembered per room
+FORWARD_RETRIES = 2  # retries of a forwarded message after a failed call
+FORWARD_RETRY_DELAY = 0.5  # seconds before retrying a forwarded message
+
+
+class DuplicateMessageError(Exception):
+    """A message with the same ID was already added to the room."""
+
+    def __init__(self, message: Dict):
+        """
+        Initialize the error.
+
+        Args:
+            message: The message added earlier with the same ID
+        """
+        super().__init__(
+            f"Message {message.get('message_id')} was already added"
+        )
+        self.message = message
+
+
+class DedupWindow:
+    """
+    Thread-safe record of the recent message IDs of each room.
+
+    IDs are forgotten once they are older than the window or the room has
+    more than max_ids newer ones.
+    """
+
+    def __init__(
+        self,
+        window: float = DEDUP_WINDOW,
+        max_ids: int = DEDUP_MAX_IDS,
+        clock: Callable[[], float] = time.time,
+    ):
+        """
+        Initialize the window.
+
+        Args:
+            window: Seconds a message ID is remembered
+            max_ids: Message IDs remembered per room
+            clock: Function returning the current time in seconds
+        """
+        self.window = window
+        self.max_ids = max_ids
+        self.clock = clock
+        self._lock = threading.Lock()
+        # Maps room_id -> message_id -> (added at, message)
+        self._rooms: Dict[str, "OrderedDict[str, tuple]"] = {}
+
+    def _trim(self, room_id: str, now: float) -> None:
+        """Drop a room's expired and excess IDs; caller holds the lock."""
+        ids = self._rooms.get(room_id)
+        if ids is None:
+            return
+        cutoff = now - self.window
+        while ids and (
+            len(ids) > self.max_ids or next(iter(ids.values()))[0] < cutoff
+        ):
+            ids.popitem(last=False)
+        if not ids:
+            del self._rooms[room_id]
+
+    def get(self, room_id: str, message_id: str) -> Optional[Dict]:
+        """
+        Get a remembered message.
+
+        Args:
+            room_id: The room ID
+            message_id: The message ID
+
+        Returns:
+            dict: The message, or None if the ID isn't remembered
+        """
+        with self._lock:
+            self._trim(room_id, self.clock())
+            entry = self._rooms.get(room_id, {}).get(message_id)
+            return entry[1] if entry else None
+
+    def add(self, room_id: str, message: Dict) -> Optional[Dict]:
+        """
+        Remember a message unless its ID is already remembered.
+
+        Args:
+            room_id: The room ID
+            message: The message, with its message_id
+
+        Returns:
+            dict: The message remembered earlier with the same ID, or None
+            if this one was added
+        """
+        message_id = message["message_id"]
+        now = self.clock()
+        with self._lock:
+            self._trim(room_id, now)
+            ids = self._rooms.setdefault(room_id, OrderedDict())
+            entry = ids.get(message_id)
+            if entry:
+                return entry[1]
+            ids[message_id] = (now, message)
+            self._trim(room_id, now)
+            return None
+
+    def drop_room(self, room_id: str) -> None:
+        """Forget the message IDs of a deleted room."""
+        with self._lock:
+            self._rooms.pop(room_id, None)
+
+    def count(self, room_id: str) -> int:
+        """Get the number of message IDs remembered for a room."""
+        with self._lock:
+            self._trim(room_id, self.clock())
+            return len(self._rooms.get(room_id, {}))
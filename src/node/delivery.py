@@ -0,0 +1,99 @@
+"""
+Per-Room Delivery Guarantees
+
+The creator of a room chooses how hard the nodes try to deliver its
+messages (delivery, set at creation). Cheap, lossy chatter doesn't need
+the retries and bookkeeping that coordination rooms do:
+
+- at_most_once: each hop is tried once. A failed forward to the
+  administrator fails the send, peers get a single call per message
+  rather than a stream that resends until acknowledged, and messages
+  aren't buffered for users whose sessions are held. A message may be
+  lost, never repeated.
+- at_least_once: failed forwards are retried and messages reach peers on
+  their streams (or with broadcast retries) and are buffered for held
+  sessions, but member nodes keep no window of delivered message IDs, so
+  a retransmitted broadcast may reach clients twice.
+- exactly_once (the default, and how every room worked before): as
+  at_least_once, and member nodes drop retransmissions by message ID.
+
+The administrator refuses a second message with the ID of one it already
+has at every level, since the ID names the message for edits, reactions
+and replies.
+
+The guarantee is room metadata like total_order: it is written to the
+message log with the room, and sent with join responses, replication,
+snapshots and the room directory. The administrator stamps messages of
+rooms other than exactly_once with their guarantee under "delivery", so
+the nodes relaying and delivering them can act on it.
+"""
+
+from dataclasses import dataclass
+from typing import Optional
+
+# Delivery guarantees
+AT_MOST_ONCE = "at_most_once"
+AT_LEAST_ONCE = "at_least_once"
+EXACTLY_ONCE = "exactly_once"
+DELIVERY_GUARANTEES = (AT_MOST_ONCE, AT_LEAST_ONCE, EXACTLY_ONCE)
+
+
+@dataclass(frozen=True)
+class DeliveryPolicy:
+    """
+    What the nodes do for the messages of a room.
+
+    Attributes:
+        retry: Retry failed forwards and resend broadcasts until peers
+            acknowledge them
+        queue: Buffer messages for users whose sessions are held
+        deduplicate: Drop retransmitted broadcasts by message ID
+    """
+
+    retry: bool
+    queue: bool
+    deduplicate: bool
+
+
+_POLICIES = {
+    AT_MOST_ONCE: DeliveryPolicy(retry=False, queue=False, deduplicate=False),
+    AT_LEAST_ONCE: DeliveryPolicy(retry=True, queue=True, deduplicate=False),
+    EXACTLY_ONCE: DeliveryPolicy(retry=True, queue=True, deduplicate=True),
+}
+
+
+def validate_delivery(delivery: Optional[str]) -> str:
+    """
+    Check a delivery guarantee chosen for a room.
+
+    Args:
+        delivery: The guarantee, or None for the default
+
+    Returns:
+        str: The guarantee (EXACTLY_ONCE if none was given)
+
+    Raises:
+        ValueError: If it isn't one of DELIVERY_GUARANTEES
+    """
+    if delivery is None:
+        return EXACTLY_ONCE
+    if delivery not in DELIVERY_GUARANTEES:
+        raise ValueError(
+            f"delivery must be one of {', '.join(DELIVERY_GUARANTEES)}"
+        )
+    return delivery
+
+
+def delivery_policy(delivery: Optional[str]) -> DeliveryPolicy:
+    """
+    Get what the nodes do for a delivery guarantee.
+
+    Unknown guarantees (e.g., from a newer node) get EXACTLY_ONCE.
+
+    Args:
+        delivery: The guarantee of a room or message, or None
+
+    Returns:
+        DeliveryPolicy: The guarantee's policy
+    """
+    return _POLICIES.get(delivery, _POLICIES[EXACTLY_ONCE])
@@ -0,0 +1,238 @@
+"""
+Direct Messages
+
+One-to-one messages between users, which may be connected to different
+nodes. The sender's node looks the recipient up in the presence directory
+and delivers the message to the recipient's node with the
+deliver_direct_message RPC. If the recipient is offline, or their node
+can't be reached, the sender's node keeps the message in a buffer and
+delivers it when the recipient comes back online.
+
+Buffered messages are kept in memory only, for at most DM_BUFFER_TTL
+seconds and DM_BUFFER_LIMIT messages per recipient.
+"""
+
+import logging
+import threading
+import time
+import uuid
+from collections import deque
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from typing import Any, Deque, Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Direct message configuration
+DM_BUFFER_TTL = 3600  # seconds a buffered message waits for its recipient
+DM_BUFFER_LIMIT = 100  # buffered messages kept per recipient
+DM_RETRY_INTERVAL = 5  # seconds between delivery retries of buffered messages
+
+
+@dataclass
+class DirectMessage:
+    """
+    A message from one user to another.
+
+    Attributes:
+        message_id: Unique identifier for the message
+        sender: Username of the sender
+        recipient: Username of the recipient
+        content: Message content
+        timestamp: ISO 8601 timestamp when the message was sent
+        sender_node: Node the sender is connected to
+        auth_token: Session token of the sender, forwarded to the
+            recipient's node but never sent to clients
+    """
+
+    message_id: str
+    sender: str
+    recipient: str
+    content: str
+    timestamp: str = ""
+    sender_node: str = ""
+    auth_token: str = field(default="", repr=False)
+
+    def __post_init__(self):
+        """Initialize the timestamp if not set."""
+        if not self.timestamp:
+            self.timestamp = datetime.now(timezone.utc).isoformat()
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return {
+            "message_id": self.message_id,
+            "sender": self.sender,
+            "recipient": self.recipient,
+            "content": self.content,
+            "timestamp": self.timestamp,
+            "sender_node": self.sender_node,
+        }
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "DirectMessage":
+        """Create a message from a dictionary received from a peer."""
+        return cls(
+            message_id=data["message_id"],
+            sender=data["sender"],
+            recipient=data["recipient"],
+            content=data.get("content", ""),
+            timestamp=data.get("timestamp", ""),
+            sender_node=data.get("sender_node", ""),
+        )
+
+
+def create_direct_message(
+    sender: str,
+    recipient: str,
+    content: str,
+    sender_node: str = "",
+    auth_token: str = "",
+) -> DirectMessage:
+    """
+    Create a new direct message with a random ID.
+
+    Args:
+        sender: Username of the sender
+        recipient: Username of the recipient
+        content: Message content
+        sender_node: Node the sender is connected to
+        auth_token: Session token of the sender, if any
+
+    Returns:
+        The new DirectMessage
+    """
+    return DirectMessage(
+        message_id=str(uuid.uuid4()),
+        sender=sender,
+        recipient=recipient,
+        content=content,
+        sender_node=sender_node,
+        auth_token=auth_token,
+    )
+
+
+class DirectMessageBuffer:
+    """
+    Thread-safe buffer of direct messages waiting for their recipients.
+    """
+
+    def __init__(
+        self, ttl: float = DM_BUFFER_TTL, limit: int = DM_BUFFER_LIMIT
+    ):
+        """
+        Initialize the buffer.
+
+        Args:
+            ttl: Seconds after sending that a message is dropped
+            limit: Maximum messages kept per recipient; the oldest are
+                dropped first
+        """
+        self.ttl = ttl
+        self.limit = limit
+        self._lock = threading.Lock()
+        # Maps recipient -> buffered messages, oldest first
+        self._pending: Dict[str, Deque[DirectMessage]] = {}
+
+    def add(self, message: DirectMessage) -> None:
+        """
+        Buffer a message until its recipient is reachable.
+
+        Args:
+            message: The undelivered message
+        """
+        with self._lock:
+            queue = self._pending.setdefault(
+                message.recipient, deque(maxlen=self.limit)
+            )
+            if len(queue) == queue.maxlen:
+                logger.warning(
+                    f"Direct message buffer for {message.recipient} is "
+                    f"full, dropping the oldest message"
+                )
+            queue.append(message)
+
+    def take(self, recipient: str) -> List[DirectMessage]:
+        """
+        Remove and return the unexpired messages for a recipient.
+
+        Args:
+            recipient: The recipient's username
+
+        Returns:
+            Buffered messages, oldest first
+        """
+        with self._lock:
+            queue = self._pending.pop(recipient, None)
+        if not queue:
+            return []
+        return [message for message in queue if not self._expired(message)]
+
+    def requeue(self, messages: List[DirectMessage]) -> None:
+        """
+        Put back messages that still could not be delivered.
+
+        They go ahead of any messages buffered since take(), so the
+        recipient still gets them in the order they were sent.
+
+        Args:
+            messages: Messages returned by take(), oldest first
+        """
+        if not messages:
+            return
+        with self._lock:
+            queue = self._pending.setdefault(
+                messages[0].recipient, deque(maxlen=self.limit)
+            )
+            for message in reversed(messages):
+                if len(queue) == queue.maxlen:
+                    break
+                queue.appendleft(message)
+
+    def recipients(self) -> List[str]:
+        """Get the recipients with buffered messages."""
+        with self._lock:
+            return list(self._pending)
+
+    def pending_count(self, recipient: Optional[str] = None) -> int:
+        """
+        Count buffered messages.
+
+        Args:
+            recipient: Optional recipient to count for; all if None
+
+        Returns:
+            Number of buffered messages
+        """
+        with self._lock:
+            if recipient is not None:
+                return len(self._pending.get(recipient, ()))
+            return sum(len(queue) for queue in self._pending.values())
+
+    def purge_expired(self) -> int:
+        """
+        Drop messages older than the TTL.
+
+        Returns:
+            Number of messages dropped
+        """
+        dropped = 0
+        with self._lock:
+            for recipient in list(self._pending):
+                queue = self._pending[recipient]
+                while queue and self._expired(queue[0]):
+                    queue.popleft()
+                    dropped += 1
+                if not queue:
+                    del self._pending[recipient]
+        if dropped:
+            logger.info(f"Dropped {dropped} expired direct messages")
+        return dropped
+
+    def _expired(self, message: DirectMessage) -> bool:
+        """Check whether a message was sent more than ttl seconds ago."""
+        try:
+            sent = datetime.fromisoformat(message.timestamp).timestamp()
+        except ValueError:
+            return False
+        return time.time() - sent > self.ttl
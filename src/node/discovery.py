@@ -0,0 +1,394 @@
+"""
+Node Bootstrap and Peer Discovery
+
+A starting node finds the rest of the cluster in two ways:
+
+- Static seeds: XML-RPC addresses of a few existing nodes. The node
+  handshakes with each seed and with each configured peer, then with every
+  node those peers know about, until no new nodes turn up.
+- LAN broadcast (optional): the node periodically announces its ID and
+  address in a UDP datagram on the discovery port, and handshakes with any
+  node it hears that it doesn't know yet. This plays the role of mDNS on a
+  single network segment without needing a multicast DNS library.
+
+The handshake is the hello RPC. Both sides exchange their node ID,
+address, the range of protocol versions they speak, their capabilities
+and their capability tags (e.g., region=eu, see placement.py), and
+register each other in their PeerRegistry with the
+version they settled on, so the failure detector, gossip and replication
+pick up the new peer on their next round. Nodes without a version in
+common refuse the handshake (see versioning.py). Nodes that predate
+version ranges only accept their own version, so a refused handshake is
+retried with each older version this node still speaks.
+"""
+
+import asyncio
+import json
+import logging
+import threading
+from typing import Dict, List, Optional, Sequence
+
+from .snapshot import SNAPSHOT_CAPABILITY
+from .versioning import (
+    MIN_PROTOCOL_VERSION,
+    PROTOCOL_VERSION,
+    negotiate_version,
+)
+
+logger = logging.getLogger(__name__)
+
+# Discovery configuration
+HANDSHAKE_TIMEOUT = 2  # seconds to wait for a hello response
+ANNOUNCE_INTERVAL = 5  # seconds between LAN broadcast announcements
+DISCOVERY_PORT = 9999  # UDP port for LAN broadcast announcements
+
+# Identifies this system's announcements among other UDP broadcasts
+SERVICE_NAME = "ds-chat-node"
+
+# Features every node supports; optional ones are added by node_capabilities
+BASE_CAPABILITIES = ("rooms", "gossip", "tpc", "causal_delivery")
+
+
+def node_capabilities(config) -> List[str]:
+    """
+    List the capabilities a node advertises in its handshake.
+
+    Args:
+        config: The node's NodeConfig
+
+    Returns:
+        Sorted capability names
+    """
+    capabilities = set(BASE_CAPABILITIES)
+    if config.failover:
+        capabilities.update(("failover", "handoff", SNAPSHOT_CAPABILITY))
+    if config.replication_factor > 0:
+        capabilities.add("replication")
+    if config.auth_required:
+        capabilities.add("auth")
+    return sorted(capabilities)
+
+
+class PeerDiscovery:
+    """
+    Finds peer nodes and registers them in the peer registry.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        node_address: str,
+        peer_registry,
+        seeds: Optional[Sequence[str]] = None,
+        capabilities: Sequence[str] = BASE_CAPABILITIES,
+        timeout: float = HANDSHAKE_TIMEOUT,
+        tags: Optional[Dict[str, str]] = None,
+    ):
+        """
+        Initialize peer discovery.
+
+        Args:
+            node_id: ID of this node
+            node_address: XML-RPC address peers use to reach this node
+            peer_registry: PeerRegistry that discovered peers are added to
+            seeds: XML-RPC addresses of nodes to contact on bootstrap
+            capabilities: Capabilities advertised in the handshake
+            timeout: Seconds to wait for each handshake
+            tags: Capability tags advertised in the handshake, which
+                room placement constraints are matched against
+        """
+        self.node_id = node_id
+        self.node_address = node_address
+        self.peer_registry = peer_registry
+        self.seeds = list(seeds or [])
+        self.capabilities = list(capabilities)
+        self.timeout = timeout
+        self.tags = dict(tags or {})
+        self._lock = threading.Lock()
+        # Addresses with a handshake in progress, to avoid duplicates
+        self._pending: set = set()
+
+    def hello_payload(self, version: int = PROTOCOL_VERSION) -> Dict:
+        """
+        Build this node's side of the handshake.
+
+        Args:
+            version: Highest protocol version to offer
+
+        Returns:
+            dict: {'node_id', 'address', 'protocol_version',
+            'min_protocol_version', 'capabilities', 'tags'}
+        """
+        return {
+            "node_id": self.node_id,
+            "address": self.node_address,
+            "protocol_version": version,
+            "min_protocol_version": MIN_PROTOCOL_VERSION,
+            "capabilities": list(self.capabilities),
+            "tags": dict(self.tags),
+        }
+
+    def handle_hello(self, hello: Dict) -> Dict:
+        """
+        Answer a handshake from another node and register it.
+
+        Args:
+            hello: The caller's hello payload
+
+        Returns:
+            dict: This node's hello payload plus 'success', 'peers'
+            ({node_id: address} known here) and 'negotiated_version', or
+            an error
+        """
+        node_id = hello.get("node_id")
+        address = hello.get("address")
+        if not node_id or not address:
+            return {
+                "success": False,
+                "error": "Handshake requires node_id and address",
+                "error_code": "INVALID_HELLO",
+            }
+        if node_id == self.node_id:
+            return {
+                "success": False,
+                "error": f"Node ID {node_id} is already in use",
+                "error_code": "DUPLICATE_NODE_ID",
+            }
+        version = negotiate_version(
+            hello.get("protocol_version"), hello.get("min_protocol_version")
+        )
+        if version is None:
+            return {
+                "success": False,
+                "error": (
+                    f"Protocol versions "
+                    f"{_version_range(hello)} are not supported "
+                    f"(this node speaks {MIN_PROTOCOL_VERSION} to "
+                    f"{PROTOCOL_VERSION})"
+                ),
+                "error_code": "PROTOCOL_MISMATCH",
+                "protocol_version": PROTOCOL_VERSION,
+                "min_protocol_version": MIN_PROTOCOL_VERSION,
+            }
+
+        self._register(
+            node_id,
+            address,
+            hello.get("capabilities") or [],
+            version,
+            hello.get("tags") or {},
+        )
+        peers = self.peer_registry.list_peers()
+        peers.pop(node_id, None)
+        return dict(
+            self.hello_payload(),
+            success=True,
+            peers=peers,
+            negotiated_version=version,
+        )
+
+    def handshake(self, address: str) -> Optional[Dict]:
+        """
+        Handshake with the node at an address and register it.
+
+        Args:
+            address: XML-RPC address of the node
+
+        Returns:
+            The node's hello response, or None if the handshake failed
+        """
+        for offered in range(PROTOCOL_VERSION, MIN_PROTOCOL_VERSION - 1, -1):
+            try:
+                response = self.peer_registry.rpc.call(
+                    address,
+                    "hello",
+                    self.hello_payload(offered),
+                    timeout=self.timeout,
+                )
+            except Exception as e:
+                logger.warning(f"Handshake with {address} failed: {e}")
+                return None
+            # Only nodes that predate version ranges refuse without theirs
+            if (
+                response.get("error_code") != "PROTOCOL_MISMATCH"
+                or "min_protocol_version" in response
+            ):
+                break
+            logger.info(
+                f"Node at {address} refused protocol version {offered}"
+            )
+
+        if not response.get("success"):
+            logger.warning(
+                f"Node at {address} refused handshake: "
+                f"{response.get('error')}"
+            )
+            return None
+        node_id = response.get("node_id")
+        if not node_id or node_id == self.node_id:
+            logger.debug(f"Skipping handshake response from {address}")
+            return None
+        version = negotiate_version(
+            response.get("protocol_version"),
+            response.get("min_protocol_version"),
+        )
+        if version is None:
+            logger.warning(
+                f"Node {node_id} speaks protocol versions "
+                f"{_version_range(response)}, ignoring it"
+            )
+            return None
+
+        self._register(
+            node_id,
+            response.get("address") or address,
+            response.get("capabilities") or [],
+            version,
+            response.get("tags") or {},
+        )
+        return response
+
+    def bootstrap(self) -> List[str]:
+        """
+        Handshake with the seeds, configured peers and their peers.
+
+        Returns:
+            IDs of the nodes that completed the handshake
+        """
+        queue = self.seeds + list(self.peer_registry.list_peers().values())
+        visited = {self.node_address}
+        joined: List[str] = []
+
+        while queue:
+            address = queue.pop(0)
+            if address in visited:
+                continue
+            visited.add(address)
+            response = self.handshake(address)
+            if response is None:
+                continue
+            joined.append(response["node_id"])
+            for peer_id, peer_address in response.get("peers", {}).items():
+                if peer_id != self.node_id and peer_address not in visited:
+                    queue.append(peer_address)
+
+        logger.info(
+            f"Bootstrap complete: handshook with {len(joined)} nodes, "
+            f"{len(self.peer_registry.list_peers())} peers known"
+        )
+        return joined
+
+    def announcement(self) -> bytes:
+        """
+        Build the LAN broadcast datagram announcing this node.
+
+        Returns:
+            JSON-encoded announcement
+        """
+        return json.dumps(
+            {
+                "service": SERVICE_NAME,
+                "node_id": self.node_id,
+                "address": self.node_address,
+                "protocol_version": PROTOCOL_VERSION,
+            }
+        ).encode()
+
+    def handle_announcement(self, data: bytes) -> Optional[str]:
+        """
+        Decide whether an announcement came from a node to handshake with.
+
+        Args:
+            data: The received datagram
+
+        Returns:
+            The announcing node's address if it is new, None otherwise
+        """
+        try:
+            announcement = json.loads(data)
+        except ValueError:
+            return None
+        if not isinstance(announcement, dict):
+            return None
+        if announcement.get("service") != SERVICE_NAME:
+            return None
+
+        node_id = announcement.get("node_id")
+        address = announcement.get("address")
+        if not node_id or not address or node_id == self.node_id:
+            return None
+        if self.peer_registry.get_peer_address(node_id) == address:
+            return None
+        with self._lock:
+            if address in self._pending:
+                return None
+            self._pending.add(address)
+        return address
+
+    def handshake_announced(self, address: str) -> Optional[Dict]:
+        """
+        Handshake with a node heard on the LAN.
+
+        Args:
+            address: Address returned by handle_announcement
+
+        Returns:
+            The node's hello response, or None if the handshake failed
+        """
+        try:
+            return self.handshake(address)
+        finally:
+            with self._lock:
+                self._pending.discard(address)
+
+    def _register(
+        self,
+        node_id: str,
+        address: str,
+        capabilities: List[str],
+        version: int,
+        tags: Dict[str, str],
+    ) -> None:
+        """Add or update a peer in the registry."""
+        known = self.peer_registry.get_peer_address(node_id)
+        if known != address:
+            if known:
+                logger.info(f"Peer {node_id} moved from {known} to {address}")
+            self.peer_registry.register_peer(node_id, address)
+        self.peer_registry.set_capabilities(node_id, capabilities)
+        if isinstance(tags, dict):
+            self.peer_registry.set_tags(node_id, tags)
+        if self.peer_registry.get_protocol_version(node_id) != version:
+            logger.info(f"Speaking protocol version {version} with {node_id}")
+        self.peer_registry.set_protocol_version(node_id, version)
+
+
+def _version_range(hello: Dict) -> str:
+    """Describe the protocol versions a handshake offered."""
+    highest = hello.get("protocol_version")
+    lowest = hello.get("min_protocol_version", highest)
+    return f"{lowest} to {highest}" if lowest != highest else f"{highest}"
+
+
+class AnnouncementProtocol(asyncio.DatagramProtocol):
+    """
+    Receives LAN broadcast announcements and handshakes with new nodes.
+    """
+
+    def __init__(self, discovery: PeerDiscovery):
+        """
+        Initialize the protocol.
+
+        Args:
+            discovery: The node's PeerDiscovery
+        """
+        self.discovery = discovery
+
+    def datagram_received(self, data: bytes, addr) -> None:
+        """Handshake in the background with newly announced nodes."""
+        address = self.discovery.handle_announcement(data)
+        if address:
+            logger.info(f"Heard new node at {address} from {addr[0]}")
+            asyncio.get_running_loop().run_in_executor(
+                None, self.discovery.handshake_announced, address
+            )
@@ -0,0 +1,268 @@
+"""
+Bounded Dispatch with Per-Room Ordering
+
+Each message used to start work of its own: a task on the event loop for
+every event a peer delivered, and a thread for every XML-RPC request,
+while peer fan-out blocked the event loop. Under load that means
+thousands of tasks and threads competing for the scheduler. Work is now
+run by fixed pools instead, keyed so ordering is kept where it matters:
+jobs with the same key (a room ID) run one at a time in the order they
+were submitted, while jobs with different keys run in parallel, up to
+the pool's worker count.
+
+- KeyedDispatcher: worker tasks on the event loop, delivering events
+  from peers (XML-RPC threads) to local clients. Jobs submitted from
+  other threads are handed to the loop thread-safely.
+- KeyedWorkerPool: worker threads for blocking work, such as XML-RPC
+  fan-out to peers. submit() waits while max_pending jobs are queued, so
+  a node that can't keep up slows its senders down instead of queueing
+  without limit.
+
+A key whose worker finishes a job goes to the back of the ready queue if
+it has more, so one busy room can't starve the others.
+"""
+
+import asyncio
+import logging
+import threading
+from collections import deque
+from typing import Any, Awaitable, Callable, Deque, Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Pool sizes
+DISPATCH_WORKERS = 16  # event loop tasks delivering peer events
+FANOUT_WORKERS = 8  # threads sending to peers
+RPC_WORKERS = 32  # threads answering XML-RPC requests
+MAX_FANOUT_PENDING = 10000  # fan-out jobs queued before submit() waits
+
+
+class KeyedDispatcher:
+    """
+    Worker tasks running coroutine jobs on the event loop, serially per
+    key.
+    """
+
+    def __init__(self, workers: int = DISPATCH_WORKERS):
+        """
+        Initialize the dispatcher.
+
+        Args:
+            workers: Most jobs running at once
+        """
+        if workers < 1:
+            raise ValueError("workers must be at least 1")
+        self.workers = workers
+        self._loop: Optional[asyncio.AbstractEventLoop] = None
+        self._jobs: Dict[Any, Deque] = {}
+        self._ready: Optional[asyncio.Queue] = None
+        self._tasks: List[asyncio.Task] = []
+
+    @property
+    def pending(self) -> int:
+        """Number of jobs waiting or running."""
+        return sum(len(jobs) for jobs in list(self._jobs.values()))
+
+    def bind(self, loop: asyncio.AbstractEventLoop) -> None:
+        """
+        Run the workers on an event loop.
+
+        Jobs submitted from other threads are handed to this loop; a
+        dispatcher that was bound to a loop that has closed starts over.
+
+        Args:
+            loop: The event loop
+        """
+        if loop is self._loop:
+            return
+        self._loop = loop
+        self._jobs = {}
+        self._ready = None
+        self._tasks = []
+
+    def submit(
+        self, key: Any, job: Callable[..., Awaitable], *args: Any
+    ) -> None:
+        """
+        Run a coroutine function after the earlier jobs with its key.
+
+        May be called from any thread. Without an event loop to run on
+        (neither running in this thread nor bound), the job is run here
+        to completion.
+
+        Args:
+            key: Jobs with equal keys run in submission order
+            job: The coroutine function
+            *args: Its arguments
+        """
+        try:
+            running = asyncio.get_running_loop()
+        except RuntimeError:
+            running = None
+        if running is not None:
+            if self._loop is None or self._loop.is_closed():
+                self.bind(running)
+            if running is self._loop:
+                self._enqueue(key, job, args)
+                return
+        if self._loop is not None and self._loop.is_running():
+            self._loop.call_soon_threadsafe(self._enqueue, key, job, args)
+            return
+        asyncio.run(job(*args))
+
+    def _enqueue(self, key: Any, job: Callable, args: tuple) -> None:
+        """Queue a job on the loop, waking a worker if its key is idle."""
+        if self._ready is None:
+            self._ready = asyncio.Queue()
+        jobs = self._jobs.get(key)
+        if jobs is None:
+            jobs = self._jobs[key] = deque()
+            self._ready.put_nowait(key)
+        jobs.append((job, args))
+        self._tasks = [task for task in self._tasks if not task.done()]
+        if len(self._tasks) < min(self.workers, len(self._jobs)):
+            self._tasks.append(asyncio.ensure_future(self._work()))
+
+    async def _work(self) -> None:
+        """Run ready keys' jobs, one job of a key at a time."""
+        ready = self._ready
+        while True:
+            key = await ready.get()
+            jobs = self._jobs[key]
+            job, args = jobs[0]
+            try:
+                await job(*args)
+            except Exception as e:
+                logger.error(f"Dispatched job for {key} failed: {e}")
+            jobs.popleft()
+            if jobs:
+                ready.put_nowait(key)
+            else:
+                del self._jobs[key]
+
+
+class KeyedWorkerPool:
+    """
+    Worker threads running blocking jobs, serially per key.
+    """
+
+    def __init__(
+        self,
+        workers: int = FANOUT_WORKERS,
+        max_pending: int = MAX_FANOUT_PENDING,
+        name: str = "fanout",
+    ):
+        """
+        Initialize the pool; its threads start with the first job.
+
+        Args:
+            workers: Most jobs running at once
+            max_pending: Jobs queued before submit() waits for room
+            name: Prefix of the worker threads' names
+        """
+        if workers < 1 or max_pending < 1:
+            raise ValueError("workers and max_pending must be at least 1")
+        self.workers = workers
+        self.max_pending = max_pending
+        self.name = name
+        self._jobs: Dict[Any, Deque] = {}
+        self._ready: Deque = deque()
+        self._pending = 0
+        self._closed = False
+        self._threads: List[threading.Thread] = []
+        self._lock = threading.Condition()
+
+    @property
+    def pending(self) -> int:
+        """Number of jobs waiting or running."""
+        return self._pending
+
+    def submit(self, key: Any, job: Callable, *args: Any, **kwargs) -> None:
+        """
+        Run a function after the earlier jobs with its key.
+
+        Waits while max_pending jobs are queued. After shutdown() the job
+        is run in the calling thread.
+
+        Args:
+            key: Jobs with equal keys run in submission order
+            job: The function
+            *args: Its positional arguments
+            **kwargs: Its keyword arguments
+        """
+        with self._lock:
+            while self._pending >= self.max_pending and not self._closed:
+                self._lock.wait()
+            if not self._closed:
+                self._pending += 1
+                jobs = self._jobs.get(key)
+                if jobs is None:
+                    jobs = self._jobs[key] = deque()
+                    self._ready.append(key)
+                jobs.append((job, args, kwargs))
+                if len(self._threads) < min(self.workers, len(self._jobs)):
+                    self._start_thread()
+                self._lock.notify_all()
+                return
+        job(*args, **kwargs)
+
+    def _start_thread(self) -> None:
+        """Start another worker thread (called with the lock held)."""
+        thread = threading.Thread(
+            target=self._work,
+            name=f"{self.name}-{len(self._threads)}",
+            daemon=True,
+        )
+        self._threads.append(thread)
+        thread.start()
+
+    def _work(self) -> None:
+        """Run ready keys' jobs until the pool shuts down and is empty."""
+        while True:
+            with self._lock:
+                while not self._ready and not self._closed:
+                    self._lock.wait()
+                if not self._ready:
+                    return
+                key = self._ready.popleft()
+                job, args, kwargs = self._jobs[key][0]
+            try:
+                job(*args, **kwargs)
+            except Exception as e:
+                logger.error(f"{self.name} job for {key} failed: {e}")
+            with self._lock:
+                jobs = self._jobs[key]
+                jobs.popleft()
+                if jobs:
+                    self._ready.append(key)
+                else:
+                    del self._jobs[key]
+                self._pending -= 1
+                self._lock.notify_all()
+
+    def join(self, timeout: Optional[float] = None) -> bool:
+        """
+        Wait until every submitted job has run.
+
+        Args:
+            timeout: Seconds to wait at most (None waits for good)
+
+        Returns:
+            bool: True if no job is left
+        """
+        with self._lock:
+            return self._lock.wait_for(lambda: not self._pending, timeout)
+
+    def shutdown(self, timeout: Optional[float] = None) -> None:
+        """
+        Stop taking jobs and let the workers finish the queued ones.
+
+        Args:
+            timeout: Seconds to wait for each worker thread
+        """
+        with self._lock:
+            self._closed = True
+            self._lock.notify_all()
+            threads = list(self._threads)
+        for thread in threads:
+            thread.join(timeout)
@@ -0,0 +1,94 @@
+"""
+Durable Rooms
+
+The creator of a room can mark it durable (durable, set at creation) for
+messages that must not be lost with a node. The administrator of a
+durable room acknowledges a message to its sender only once a write
+quorum of the room's copies holds it: a majority of the administrator
+and its replication_factor followers (see replication.py), counting the
+administrator's own copy. With the default two followers a message is
+acknowledged once one of them has stored it.
+
+- The administrator adds and broadcasts the message as usual, then waits
+  up to QUORUM_TIMEOUT seconds for its followers' acknowledgments before
+  answering. The sender's message_sent then carries durable (true) and
+  replicas, the number of copies holding the message.
+- If the quorum isn't reached in time (e.g., too few followers are
+  alive), the sender gets a message_error QUORUM_NOT_REACHED with the
+  message's ID instead. The message isn't withdrawn: replication keeps
+  catching the followers up, and a resend with the same message_id is
+  acknowledged once enough of them have it.
+
+Durable rooms need replication, so a node with replication disabled
+refuses to create them. The flag is room metadata like ephemeral: it is
+logged, replicated and snapshotted with the room.
+
+Reads repair the followers of durable rooms: a get_history served by
+the administrator also checks what the room's followers actually hold,
+at most every READ_REPAIR_INTERVAL seconds per room, and resends what a
+follower is missing (e.g., after it restarted without its replica)
+rather than waiting for the next catch-up pass.
+"""
+
+from typing import Dict
+
+# Durability configuration
+QUORUM_TIMEOUT = 5  # seconds to wait for a write quorum
+READ_REPAIR_INTERVAL = 10  # seconds between read repairs of a room
+
+
+def write_quorum(replication_factor: int) -> int:
+    """
+    Get the number of copies a durable room's message must reach.
+
+    Args:
+        replication_factor: Followers per room
+
+    Returns:
+        int: A majority of the administrator and its followers
+    """
+    return (max(replication_factor, 0) + 1) // 2 + 1
+
+
+def await_quorum(
+    replication, room_id: str, result: Dict, timeout: float = QUORUM_TIMEOUT
+) -> Dict:
+    """
+    Wait for a message of a durable room to reach a write quorum.
+
+    Blocks; call it from a worker thread.
+
+    Args:
+        replication: The node's ReplicationManager, or None if
+            replication is disabled
+        room_id: The room ID
+        result: The successful result of adding the message, with its
+            'message_id' and 'sequence_number'
+        timeout: Seconds to wait for the followers
+
+    Returns:
+        dict: The result with 'durable' and 'replicas' set, or a
+        QUORUM_NOT_REACHED error with the message's 'message_id'
+    """
+    if replication is None or replication.replication_factor <= 0:
+        return {
+            "success": False,
+            "error": "Replication is disabled on the room's administrator",
+            "error_code": "QUORUM_NOT_REACHED",
+            "message_id": result["message_id"],
+        }
+    quorum = write_quorum(replication.replication_factor)
+    replicas = replication.wait_for_quorum(
+        room_id, result["sequence_number"], timeout
+    )
+    if replicas < quorum:
+        return {
+            "success": False,
+            "error": (
+                f"Only {replicas} of the {quorum} copies needed hold the "
+                f"message yet; resend it with the same message_id"
+            ),
+            "error_code": "QUORUM_NOT_REACHED",
+            "message_id": result["message_id"],
+        }
+    return dict(result, durable=True, replicas=replicas)
@@ -0,0 +1,203 @@
+"""
+End-to-End Encryption Support
+
+Members of a private room can encrypt their messages so that no node can
+read them. Nodes never see private keys: each client generates its own
+key pair and publishes the public half to the room with the publish_key
+command. The room's administrator node keeps one public key per member
+(publishing again rotates it), writes it to its message log, passes it
+along with snapshots and replicas to a new administrator, and announces
+it with a key_published event to the room's clients on all nodes.
+Clients fetch the current members' keys with get_room_keys.
+
+To send an encrypted message a client picks a fresh message key,
+encrypts the text with it, and wraps the message key for each recipient
+with their public key. It sends the ciphertext, base64-encoded, as the
+message content, along with an encryption envelope:
+
+    {
+        "algorithm": "x25519-xsalsa20-poly1305",
+        "sender_key_id": "...",
+        "nonce": "<base64>",
+        "recipients": {"bob": {"key_id": "...", "wrapped_key": "<base64>"}}
+    }
+
+Nodes only check that the envelope is well formed and within size limits;
+they treat the ciphertext as opaque, and order, deliver, replicate and
+store encrypted messages like any other (marked "encrypted", with the
+envelope). Since the node can't check new content, encrypted messages
+can be deleted but not edited.
+"""
+
+import base64
+import binascii
+from datetime import datetime, timezone
+from typing import Dict, Optional, Tuple
+
+# Size limits
+MAX_KEY_ID_LENGTH = 64
+MAX_ALGORITHM_LENGTH = 64
+MAX_PUBLIC_KEY_BYTES = 1024  # decoded public key
+MAX_WRAPPED_KEY_BYTES = 512  # decoded message key wrapped for a recipient
+MAX_NONCE_BYTES = 64
+MAX_CIPHERTEXT_LENGTH = 16384  # base64 characters of message content
+MAX_RECIPIENTS = 256
+
+# Fields of an encryption envelope
+ENVELOPE_FIELDS = ("algorithm", "sender_key_id", "nonce", "recipients")
+
+
+class E2EEError(Exception):
+    """A public key or encrypted message was refused."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_KEY")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def _decoded_size(value) -> Optional[int]:
+    """Get the size of a base64 string once decoded, or None if invalid."""
+    if not isinstance(value, str) or not value:
+        return None
+    try:
+        return len(base64.b64decode(value, validate=True))
+    except (binascii.Error, ValueError):
+        return None
+
+
+def _valid_name(value, max_length: int) -> bool:
+    """Check a key ID or algorithm name."""
+    return (
+        isinstance(value, str)
+        and 0 < len(value) <= max_length
+        and value.isprintable()
+        and not any(ch.isspace() for ch in value)
+    )
+
+
+def create_public_key(
+    username: str, key_id: str, algorithm: str, public_key: str
+) -> Dict:
+    """
+    Create a published public key record.
+
+    Args:
+        username: The member publishing the key
+        key_id: ID the client chose for the key (e.g., its fingerprint)
+        algorithm: Key algorithm (e.g., "x25519")
+        public_key: The public key, base64-encoded
+
+    Returns:
+        dict: {'username', 'key_id', 'algorithm', 'public_key',
+        'published_at'}
+
+    Raises:
+        E2EEError: If a field is missing, too long or not valid base64
+            (INVALID_KEY)
+    """
+    if not _valid_name(key_id, MAX_KEY_ID_LENGTH):
+        raise E2EEError(
+            f"key_id must be 1 to {MAX_KEY_ID_LENGTH} printable characters",
+            "INVALID_KEY",
+        )
+    if not _valid_name(algorithm, MAX_ALGORITHM_LENGTH):
+        raise E2EEError(
+            f"algorithm must be 1 to {MAX_ALGORITHM_LENGTH} printable "
+            f"characters",
+            "INVALID_KEY",
+        )
+    size = _decoded_size(public_key)
+    if size is None or size > MAX_PUBLIC_KEY_BYTES:
+        raise E2EEError(
+            f"public_key must be base64 of at most {MAX_PUBLIC_KEY_BYTES} "
+            f"bytes",
+            "INVALID_KEY",
+        )
+    return {
+        "username": username,
+        "key_id": key_id,
+        "algorithm": algorithm,
+        "public_key": public_key,
+        "published_at": datetime.now(timezone.utc).isoformat(),
+    }
+
+
+def validate_encrypted_message(
+    content, encryption
+) -> Tuple[bool, Optional[str]]:
+    """
+    Check the shape of an encrypted message without decrypting it.
+
+    Args:
+        content: The ciphertext, base64-encoded
+        encryption: The encryption envelope (see the module docstring)
+
+    Returns:
+        tuple: (is_valid, error_message)
+            - is_valid: True if the message is well formed, False otherwise
+            - error_message: Error message if invalid, None if valid
+    """
+    if not isinstance(content, str) or not content:
+        return False, "Encrypted message content cannot be empty"
+    if len(content) > MAX_CIPHERTEXT_LENGTH:
+        return (
+            False,
+            f"Ciphertext too long (max {MAX_CIPHERTEXT_LENGTH} characters)",
+        )
+    if _decoded_size(content) is None:
+        return False, "Ciphertext must be base64"
+    if not isinstance(encryption, dict):
+        return False, "Encryption envelope must be an object"
+    if not _valid_name(encryption.get("algorithm"), MAX_ALGORITHM_LENGTH):
+        return False, "Encryption envelope needs an algorithm"
+    if not _valid_name(encryption.get("sender_key_id"), MAX_KEY_ID_LENGTH):
+        return False, "Encryption envelope needs a sender_key_id"
+    size = _decoded_size(encryption.get("nonce"))
+    if size is None or size > MAX_NONCE_BYTES:
+        return False, "Encryption envelope nonce must be short base64"
+
+    recipients = encryption.get("recipients")
+    if not isinstance(recipients, dict) or not recipients:
+        return False, "Encryption envelope needs recipients"
+    if len(recipients) > MAX_RECIPIENTS:
+        return False, f"Too many recipients (max {MAX_RECIPIENTS})"
+    for username, wrapped in recipients.items():
+        if not isinstance(wrapped, dict) or not _valid_name(
+            wrapped.get("key_id"), MAX_KEY_ID_LENGTH
+        ):
+            return False, f"Recipient {username} needs a key_id"
+        size = _decoded_size(wrapped.get("wrapped_key"))
+        if size is None or size > MAX_WRAPPED_KEY_BYTES:
+            return False, f"Recipient {username} needs a wrapped_key"
+    unknown = sorted(set(encryption) - set(ENVELOPE_FIELDS))
+    if unknown:
+        return False, f"Unknown envelope fields: {', '.join(unknown)}"
+    return True, None
+
+
+def merge_public_keys(*keys: Dict[str, Dict]) -> Dict[str, Dict]:
+    """
+    Combine public keys from several copies of a room.
+
+    Args:
+        keys: Public key dicts (username -> key record)
+
+    Returns:
+        dict: The most recently published key of each user
+    """
+    merged: Dict[str, Dict] = {}
+    for copy in keys:
+        for username, key in copy.items():
+            current = merged.get(username)
+            if current is None or key.get("published_at", "") > current.get(
+                "published_at", ""
+            ):
+                merged[username] = dict(key)
+    return merged
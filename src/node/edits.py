@@ -0,0 +1,121 @@
+"""
+Message Editing and Deletion
+
+The author of a message, and the room's owner and moderators (see
+roles.py), may edit its content or delete it. Both are carried out by the
+room's administrator node, which writes an edit record to its message log
+and applies it to the stored message:
+
+- an edit replaces the content and sets edited_at and edited_by
+- a deletion leaves a tombstone: the content is cleared and deleted,
+  deleted_at and deleted_by are set, so the message keeps its place in the
+  sequence and history
+
+The administrator announces each change with a message_edited or
+message_deleted event to its local clients and every peer node; nodes
+holding a replica of the room apply it there too. Late joiners and history
+pages get the messages as they are after their edits, and the log replays
+edit records on recovery.
+"""
+
+from datetime import datetime, timezone
+from typing import Dict, Optional
+
+# Edit actions
+EDIT = "edit"
+DELETE = "delete"
+EDIT_ACTIONS = (EDIT, DELETE)
+
+# Events announcing an applied edit record, by action
+EDIT_EVENT_TYPES = {EDIT: "message_edited", DELETE: "message_deleted"}
+
+
+class EditError(Exception):
+    """A message could not be edited or deleted."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "NOT_ALLOWED")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def create_edit(
+    message_id: str,
+    action: str,
+    username: str,
+    content: Optional[str] = None,
+) -> Dict:
+    """
+    Create an edit record.
+
+    Args:
+        message_id: ID of the edited message
+        action: EDIT or DELETE
+        username: The user making the change
+        content: The new content, for EDIT
+
+    Returns:
+        dict: The record, with the current time as its timestamp
+    """
+    return {
+        "message_id": message_id,
+        "action": action,
+        "content": content if action == EDIT else None,
+        "username": username,
+        "timestamp": datetime.now(timezone.utc).isoformat(),
+    }
+
+
+def apply_edit(message: Dict, edit: Dict) -> Dict:
+    """
+    Apply an edit record to a message in place.
+
+    Edits of a deleted message are ignored.
+
+    Args:
+        message: The message data
+        edit: Record from create_edit
+
+    Returns:
+        dict: The message
+    """
+    if message.get("deleted"):
+        return message
+    if edit["action"] == DELETE:
+        message["content"] = ""
+        # Wrapped keys of an encrypted message go with its ciphertext
+        message.pop("encryption", None)
+        message.pop("attachments", None)
+        message.pop("mentions", None)
+        message["deleted"] = True
+        message["deleted_at"] = edit["timestamp"]
+        message["deleted_by"] = edit["username"]
+    else:
+        message["content"] = edit["content"]
+        message["edited_at"] = edit["timestamp"]
+        message["edited_by"] = edit["username"]
+    return message
+
+
+def is_newer_revision(message: Dict, other: Dict) -> bool:
+    """
+    Check whether a copy of a message has later edits than another copy.
+
+    Args:
+        message: One copy of the message
+        other: Another copy of the same message
+
+    Returns:
+        True if message should replace other
+    """
+    if other.get("deleted"):
+        return False
+    if message.get("deleted"):
+        return True
+    return message.get("edited_at", "") > other.get("edited_at", "")
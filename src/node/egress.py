@@ -0,0 +1,226 @@
+"""
+Outbound Connection Policy
+
+Webhooks and bridges connect to hosts that room owners choose, so an
+owner could point one at a service only the node itself can reach: a
+cloud metadata endpoint, an admin port on localhost, a database on the
+private network. Their connections go through an EgressPolicy, which
+resolves the host itself, refuses the connection if any of its addresses
+is internal, and connects to the address it checked, so a name that
+resolves to another address later (DNS rebinding) can't get around it.
+
+Loopback, private, link-local, shared (carrier-grade NAT), multicast,
+reserved and unspecified addresses are internal. The operator can allow
+some of them anyway with the egress_allow setting (e.g., a Matrix
+homeserver on the same private network). HTTP requests made through the
+policy don't use proxies and never follow redirects, which could lead
+anywhere; a redirect response is raised as an HTTPError.
+"""
+
+import http.client
+import ipaddress
+import logging
+import socket
+import ssl
+import urllib.error
+import urllib.request
+from typing import Iterable, List, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+
+class EgressError(OSError):
+    """A connection to an internal address was refused."""
+
+
+class EgressPolicy:
+    """
+    Decides which addresses outbound connections may be made to.
+    """
+
+    def __init__(self, allow: Iterable[str] = ()):
+        """
+        Initialize the policy.
+
+        Args:
+            allow: Networks connections may be made to even though they
+                are internal, as CIDR (e.g., "10.0.0.0/8")
+
+        Raises:
+            ValueError: If a network is not valid CIDR
+        """
+        networks = []
+        for network in allow:
+            try:
+                networks.append(ipaddress.ip_network(network, strict=False))
+            except ValueError:
+                raise ValueError(
+                    f"egress_allow {network!r} must be a network like "
+                    f"10.0.0.0/8"
+                ) from None
+        self.allow: List = networks
+
+    def permits(self, address: str) -> bool:
+        """
+        Check whether connections to an IP address are allowed.
+
+        Args:
+            address: The IP address
+
+        Returns:
+            True if the address is public or in an allowed network
+        """
+        ip = ipaddress.ip_address(address.split("%", 1)[0])
+        if isinstance(ip, ipaddress.IPv6Address) and ip.ipv4_mapped:
+            ip = ip.ipv4_mapped
+        if any(ip in network for network in self.allow):
+            return True
+        return ip.is_global and not ip.is_multicast
+
+    def connect(
+        self,
+        address: Tuple[str, int],
+        timeout: Optional[float] = None,
+        source_address: Optional[Tuple[str, int]] = None,
+    ) -> socket.socket:
+        """
+        Open a TCP connection, like socket.create_connection.
+
+        Args:
+            address: (host, port) to connect to
+            timeout: Seconds to wait for the connection
+            source_address: (host, port) to connect from
+
+        Returns:
+            The connected socket
+
+        Raises:
+            EgressError: If the host has an address the policy refuses
+            OSError: If the connection could not be made
+        """
+        host, port = address
+        candidates = socket.getaddrinfo(host, port, 0, socket.SOCK_STREAM)
+        for *_, sockaddr in candidates:
+            if not self.permits(sockaddr[0]):
+                logger.warning(
+                    f"Refused outbound connection to {host} "
+                    f"({sockaddr[0]}): internal address"
+                )
+                raise EgressError(
+                    f"{host} resolves to internal address {sockaddr[0]}"
+                )
+        error: OSError = OSError(f"{host} has no address")
+        for family, kind, proto, _, sockaddr in candidates:
+            sock = socket.socket(family, kind, proto)
+            try:
+                if isinstance(timeout, (int, float)):
+                    sock.settimeout(timeout)
+                if source_address:
+                    sock.bind(source_address)
+                sock.connect(sockaddr)
+                return sock
+            except OSError as e:
+                sock.close()
+                error = e
+        raise error
+
+
+class _NoRedirects(urllib.request.HTTPRedirectHandler):
+    """Returns redirect responses as errors instead of following them."""
+
+    def redirect_request(self, req, fp, code, msg, headers, newurl):
+        return None
+
+
+class _HTTPConnection(http.client.HTTPConnection):
+    """HTTP connection opened through an EgressPolicy."""
+
+    egress: EgressPolicy
+
+    def connect(self):
+        self.sock = self.egress.connect(
+            (self.host, self.port), self.timeout, self.source_address
+        )
+
+
+class _HTTPSConnection(http.client.HTTPSConnection, _HTTPConnection):
+    """HTTPS connection opened through an EgressPolicy."""
+
+
+def _connection_factory(connection_class, policy: EgressPolicy):
+    """Get a function creating connections that use a policy."""
+
+    def create(*args, **kwargs):
+        connection = connection_class(*args, **kwargs)
+        connection.egress = policy
+        return connection
+
+    return create
+
+
+class _HTTPHandler(urllib.request.HTTPHandler):
+    """Opens http:// URLs through an EgressPolicy."""
+
+    def __init__(self, policy: EgressPolicy):
+        super().__init__()
+        self._policy = policy
+
+    def http_open(self, req):
+        return self.do_open(
+            _connection_factory(_HTTPConnection, self._policy), req
+        )
+
+
+class _HTTPSHandler(urllib.request.HTTPSHandler):
+    """Opens https:// URLs through an EgressPolicy."""
+
+    def __init__(self, policy: EgressPolicy):
+        self._tls = ssl.create_default_context()
+        super().__init__(context=self._tls)
+        self._policy = policy
+
+    def https_open(self, req):
+        return self.do_open(
+            _connection_factory(_HTTPSConnection, self._policy),
+            req,
+            context=self._tls,
+        )
+
+
+def urlopen(
+    request: urllib.request.Request,
+    timeout: float,
+    policy: Optional[EgressPolicy] = None,
+):
+    """
+    Make an HTTP request like urllib.request.urlopen, without redirects.
+
+    Args:
+        request: The request
+        timeout: Seconds to wait for the response
+        policy: Policy the connection must pass, without proxies; the
+            connection isn't checked if None
+
+    Returns:
+        The response
+
+    Raises:
+        EgressError: If the host has an address the policy refuses
+        urllib.error.HTTPError: If the response is an error or redirect
+        OSError: If the request could not be made
+    """
+    if policy is None:
+        opener = urllib.request.build_opener(_NoRedirects)
+    else:
+        opener = urllib.request.build_opener(
+            urllib.request.ProxyHandler({}),
+            _HTTPHandler(policy),
+            _HTTPSHandler(policy),
+            _NoRedirects,
+        )
+    try:
+        return opener.open(request, timeout=timeout)
+    except urllib.error.URLError as e:
+        if isinstance(e.reason, EgressError):
+            raise e.reason from None
+        raise
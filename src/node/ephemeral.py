@@ -0,0 +1,149 @@
+"""
+Ephemeral Rooms
+
+A room created with ephemeral set is for an ad-hoc huddle: its
+administrator deletes it once nobody needs it any more, so such rooms
+don't pile up waiting for someone to clean them up. A round every
+EPHEMERAL_SWEEP_INTERVAL seconds tears down each hosted ephemeral room
+
+- whose last member left, or
+- that nobody joined or posted in for ephemeral_idle_timeout seconds
+  (EPHEMERAL_IDLE_TIMEOUT by default, 0 to only tear down empty rooms).
+
+A room that had no members since the node took it over (e.g., one just
+created, before its creator joined) is only torn down once it has been
+idle for EPHEMERAL_EMPTY_GRACE seconds.
+
+The teardown is the coordinated deletion a delete_room request starts:
+the two-phase commit across the nodes, with delete_room_initiated
+(initiator "ephemeral") and room_deleted sent to the members. The flag
+is room metadata like total_order, so a node taking over the room tears
+it down in turn.
+"""
+
+import logging
+import time
+from datetime import datetime
+from typing import Awaitable, Callable, Dict, Optional, Set
+
+from .room_state import Room, RoomState
+
+logger = logging.getLogger(__name__)
+
+# Ephemeral room configuration
+EPHEMERAL_IDLE_TIMEOUT = 3600  # seconds without joins or messages
+EPHEMERAL_EMPTY_GRACE = 60  # seconds a never-joined room is kept
+EPHEMERAL_SWEEP_INTERVAL = 5  # seconds between teardown rounds
+
+# Who torn-down rooms are reported to their members as deleted by
+EPHEMERAL_INITIATOR = "ephemeral"
+
+# Why a room is torn down
+EMPTY = "empty"
+IDLE = "idle"
+
+
+def last_activity(room: Room) -> float:
+    """
+    Get when a room was last joined, posted in or created.
+
+    Args:
+        room: The room
+
+    Returns:
+        float: UNIX time of the room's latest activity
+    """
+    stamps = [room.created_at]
+    for info in room.member_info.values():
+        stamps.extend((info.joined_at, info.last_activity))
+    if room.messages:
+        stamps.append(room.messages[-1].get("timestamp", ""))
+    return max(
+        datetime.fromisoformat(stamp).timestamp() for stamp in stamps if stamp
+    )
+
+
+class EphemeralReaper:
+    """
+    Tears down the ephemeral rooms this node administers.
+    """
+
+    def __init__(
+        self,
+        room_manager,
+        close_room: Callable[[str, str], Awaitable[Dict]],
+        idle_timeout: float = EPHEMERAL_IDLE_TIMEOUT,
+        empty_grace: float = EPHEMERAL_EMPTY_GRACE,
+    ):
+        """
+        Initialize the reaper.
+
+        Args:
+            room_manager: RoomStateManager whose hosted rooms are checked
+            close_room: Coroutine function deleting a room with the
+                coordinated deletion flow, given its ID and the initiator
+                (WebSocketServer.close_room)
+            idle_timeout: Seconds without joins or messages before a room
+                is torn down (0 for no limit)
+            empty_grace: Seconds a room that never had members is kept
+        """
+        self.room_manager = room_manager
+        self.close_room = close_room
+        self.idle_timeout = idle_timeout
+        self.empty_grace = empty_grace
+        # IDs of rooms seen with members, torn down as soon as they empty
+        self._occupied: Set[str] = set()
+
+    def due(self, now: Optional[float] = None) -> Dict[str, str]:
+        """
+        Find the ephemeral rooms to tear down.
+
+        Args:
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            dict: {room_id: EMPTY or IDLE} for every room due
+        """
+        now = time.time() if now is None else now
+        due = {}
+        hosted = set()
+        for info in self.room_manager.list_rooms():
+            room = self.room_manager.get_room(info["room_id"])
+            if room is None or not room.ephemeral:
+                continue
+            hosted.add(room.room_id)
+            if room.state != RoomState.ACTIVE:
+                continue
+            idle = now - last_activity(room)
+            if room.members:
+                self._occupied.add(room.room_id)
+                if self.idle_timeout and idle >= self.idle_timeout:
+                    due[room.room_id] = IDLE
+            elif room.room_id in self._occupied or idle >= self.empty_grace:
+                due[room.room_id] = EMPTY
+        self._occupied &= hosted
+        return due
+
+    async def run_round(self, now: Optional[float] = None) -> Dict[str, str]:
+        """
+        Tear down every ephemeral room that is due.
+
+        Args:
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            dict: {room_id: EMPTY or IDLE} for the rooms deleted
+        """
+        deleted = {}
+        for room_id, reason in self.due(now).items():
+            logger.info(f"Tearing down ephemeral room {room_id} ({reason})")
+            result = await self.close_room(room_id, EPHEMERAL_INITIATOR)
+            if not result.get("success"):
+                logger.warning(
+                    f"Could not tear down ephemeral room {room_id}: "
+                    f"{result.get('error')}"
+                )
+                continue
+            self._occupied.discard(room_id)
+            deleted[room_id] = reason
+        return deleted
@@ -0,0 +1,1442 @@
+"""
+Room Administrator Failover
+
+Every node with members in a remote room keeps a replica of that room: its
+metadata, member list, recent messages, sequence counter and vector clock,
+kept up to date from join responses and the admin's broadcasts. Follower
+nodes chosen by the admin's ReplicationManager also hold replicas, fed by
+the replication stream, even without local members.
+
+When the failure detector declares a room's admin node dead, the nodes
+holding replicas elect a new administrator with the bully algorithm: the
+highest node ID among the live replica holders wins. With a cluster
+membership view (see membership.py), only the view's members take part,
+and a node only runs an election while it reaches a quorum of them, so
+the minority side of a partition never elects a second admin. The winner
+rebuilds the room from every surviving replica, starts administering it
+under the same room ID, and announces the change so the other nodes
+re-point their clients' requests to it. With the Raft room registry (see
+raft.py), a node only takes a room over after committing itself as the
+room's new admin there, so two nodes can't both take the same room over.
+
+A node that shuts down gracefully hands its rooms off instead: it sends
+a snapshot of each room's full state to a live peer (see snapshot.py),
+which takes it over the same way.
+"""
+
+import asyncio
+import contextvars
+import logging
+import threading
+from dataclasses import dataclass, field
+from typing import Any, Callable, Dict, List, Optional
+
+from .audit import ADMIN_FAILOVER, audit
+from .delivery import EXACTLY_ONCE
+from .e2ee import merge_public_keys
+from .edits import DELETE, apply_edit, is_newer_revision
+from .failure_detector import MembershipEvent, PeerState
+from .history import HISTORY_PAGE_SIZE, paginate_history
+from .member_set import TOMBSTONE_TTL, MemberSet, merge_member_sets
+from .pins import update_pins
+from .placement import matches
+from .read_receipts import merge_read_positions
+from .retention import expire
+from .roles import MEMBER
+from .room_metadata import apply_versioned, merge_versioned, newer_fields
+from .schemas.events import create_room_admin_changed_event
+from .snapshot import SNAPSHOT_CAPABILITY, RoomSnapshot, SnapshotSender
+from .vector_clock import VectorClock
+
+logger = logging.getLogger(__name__)
+
+# Seconds a node that lost an election waits for the winner's announcement
+# before it starts a new election
+ELECTION_TIMEOUT = 10
+
+# Maximum number of recent messages kept per replica
+MAX_REPLICA_MESSAGES = 100
+
+
+@dataclass
+class RoomReplica:
+    """
+    A node's copy of a room administered elsewhere.
+
+    Attributes:
+        room_id: Unique identifier for the room
+        room_name: Name of the room
+        description: Optional room description
+        creator_id: ID of the user who created the room
+        admin_node: Node currently administering the room
+        members: Usernames of all room members
+        local_members: Members connected to this node
+        messages: Recent messages in sequence order
+        message_counter: Highest sequence number seen
+        vector_clock: Vector clock of the latest message seen
+        follower: True if the admin replicates the room to this node
+        replicated_sequence: Sequence number up to which the replication
+            stream has been applied without gaps
+        private: True if the room is private
+        total_order: True if the room delivers messages in total order
+        banned: Usernames banned from the room
+        roles: Maps username -> role of promoted members
+        max_members: Most members the room may have (0 for no limit)
+        waitlist_enabled: True if the room has a waiting list
+        read_positions: Maps username -> last read sequence number
+        public_keys: Maps username -> published public key record
+        retention: The room owner's retention limits (see retention.py)
+        expired_through: Highest sequence number removed by retention
+        announcement: True if only the owner and moderators may post
+        pinned: IDs of the room's pinned messages, in the order pinned
+        topic: Optional room topic
+        metadata_versions: Maps metadata field -> HLC timestamp of its
+            last update (see room_metadata.py)
+        spam_thresholds: Spam thresholds changed from their defaults
+            (see spam.py)
+        content_filters: The room's content filters (see
+            content_filters.py)
+        delivery: The room's delivery guarantee (see delivery.py)
+        ephemeral: True if the room is torn down once empty or idle (see
+            ephemeral.py)
+        scheduled: Maps message ID -> message the admin is to send later
+            (see scheduled.py)
+        placement: Tags the room's admin node must have (see
+            placement.py)
+        durable: True if messages wait for a write quorum (see
+            durability.py)
+        member_set: The room's membership set as a dict, with the joins
+            and leaves of local members made while the admin was
+            unreachable (see member_set.py)
+    """
+
+    room_id: str
+    room_name: str
+    admin_node: str
+    description: Optional[str] = None
+    creator_id: str = ""
+    members: List[str] = field(default_factory=list)
+    local_members: List[str] = field(default_factory=list)
+    messages: List[Dict] = field(default_factory=list)
+    message_counter: int = 0
+    vector_clock: Dict[str, int] = field(default_factory=dict)
+    follower: bool = False
+    replicated_sequence: int = 0
+    private: bool = False
+    total_order: bool = False
+    banned: List[str] = field(default_factory=list)
+    roles: Dict[str, str] = field(default_factory=dict)
+    max_members: int = 0
+    waitlist_enabled: bool = False
+    read_positions: Dict[str, int] = field(default_factory=dict)
+    public_keys: Dict[str, Dict] = field(default_factory=dict)
+    retention: List[str] = field(default_factory=list)
+    expired_through: int = 0
+    announcement: bool = False
+    pinned: List[str] = field(default_factory=list)
+    topic: Optional[str] = None
+    metadata_versions: Dict[str, str] = field(default_factory=dict)
+    spam_thresholds: Dict[str, int] = field(default_factory=dict)
+    content_filters: List[Dict[str, Any]] = field(default_factory=list)
+    delivery: str = EXACTLY_ONCE
+    ephemeral: bool = False
+    scheduled: Dict[str, Dict] = field(default_factory=dict)
+    placement: Dict[str, str] = field(default_factory=dict)
+    durable: bool = False
+    member_set: Dict = field(default_factory=dict)
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return {
+            "room_id": self.room_id,
+            "room_name": self.room_name,
+            "description": self.description,
+            "creator_id": self.creator_id,
+            "admin_node": self.admin_node,
+            "members": list(self.members),
+            "local_members": list(self.local_members),
+            "messages": list(self.messages),
+            "message_counter": self.message_counter,
+            "vector_clock": dict(self.vector_clock),
+            "follower": self.follower,
+            "replicated_sequence": self.replicated_sequence,
+            "private": self.private,
+            "total_order": self.total_order,
+            "banned": list(self.banned),
+            "roles": dict(self.roles),
+            "max_members": self.max_members,
+            "waitlist_enabled": self.waitlist_enabled,
+            "read_positions": dict(self.read_positions),
+            "public_keys": dict(self.public_keys),
+            "retention": list(self.retention),
+            "expired_through": self.expired_through,
+            "announcement": self.announcement,
+            "pinned": list(self.pinned),
+            "topic": self.topic,
+            "metadata_versions": dict(self.metadata_versions),
+            "spam_thresholds": dict(self.spam_thresholds),
+            "content_filters": [dict(f) for f in self.content_filters],
+            "delivery": self.delivery,
+            "ephemeral": self.ephemeral,
+            "scheduled": dict(self.scheduled),
+            "placement": dict(self.placement),
+            "durable": self.durable,
+            "member_set": dict(self.member_set),
+        }
+
+
+class ReplicaStore:
+    """
+    Thread-safe store of replicas for remote rooms with local members.
+    """
+
+    def __init__(self, max_messages: int = MAX_REPLICA_MESSAGES):
+        """
+        Initialize the store.
+
+        Args:
+            max_messages: Maximum number of recent messages per replica
+        """
+        self.max_messages = max_messages
+        self._lock = threading.Lock()
+        self._replicas: Dict[str, RoomReplica] = {}
+
+    def update_from_join(
+        self, room_info: Dict, messages: List[Dict], username: str
+    ) -> None:
+        """
+        Create or refresh a replica from a successful join response.
+
+        Args:
+            room_info: The room_info returned by the admin's join_room
+            messages: Existing messages returned with the join
+            username: The local user who joined
+        """
+        room_id = room_info["room_id"]
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica is None:
+                replica = self._replicas[room_id] = RoomReplica(
+                    room_id=room_id,
+                    room_name=room_info.get("room_name", ""),
+                    admin_node=room_info.get("admin_node", ""),
+                )
+            apply_versioned(
+                replica, room_info, room_info.get("metadata_versions") or {}
+            )
+            replica.creator_id = room_info.get("creator_id", "")
+            replica.admin_node = room_info.get("admin_node", "")
+            replica.private = bool(room_info.get("private", False))
+            replica.total_order = bool(room_info.get("total_order", False))
+            replica.max_members = int(room_info.get("max_members", 0))
+            replica.waitlist_enabled = bool(
+                room_info.get("waitlist_enabled", False)
+            )
+            replica.announcement = bool(room_info.get("announcement", False))
+            replica.delivery = room_info.get("delivery", EXACTLY_ONCE)
+            replica.ephemeral = bool(room_info.get("ephemeral", False))
+            replica.placement = dict(room_info.get("placement") or {})
+            replica.durable = bool(room_info.get("durable", False))
+            replica.members = list(room_info.get("members", []))
+            replica.member_set = merge_member_sets(
+                replica.member_set, room_info.get("member_set")
+            )
+            if "roles" in room_info:
+                replica.roles = dict(room_info["roles"])
+            if "retention" in room_info:
+                replica.retention = list(room_info["retention"])
+            if "pinned" in room_info:
+                replica.pinned = list(room_info["pinned"])
+            if "spam_thresholds" in room_info:
+                replica.spam_thresholds = dict(room_info["spam_thresholds"])
+            if "content_filters" in room_info:
+                replica.content_filters = [
+                    dict(f) for f in room_info["content_filters"]
+                ]
+            if "read_positions" in room_info:
+                replica.read_positions = merge_read_positions(
+                    replica.read_positions, room_info["read_positions"]
+                )
+            if "public_keys" in room_info:
+                replica.public_keys = merge_public_keys(
+                    replica.public_keys, room_info["public_keys"]
+                )
+            if username not in replica.local_members:
+                replica.local_members.append(username)
+            for message in messages or []:
+                self._add_message(replica, message)
+            replica.vector_clock = (
+                VectorClock.from_dict(replica.vector_clock)
+                .merge(VectorClock.from_dict(room_info.get("vector_clock")))
+                .to_dict()
+            )
+
+    def record_message(self, room_id: str, message: Dict) -> None:
+        """
+        Record a message broadcast by the room's admin.
+
+        Args:
+            room_id: The room ID
+            message: The message data
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica:
+                self._add_message(replica, message)
+
+    def record_member_event(
+        self, room_id: str, event_type: str, username: str
+    ) -> None:
+        """
+        Apply a member_joined or member_left event to a replica.
+
+        Args:
+            room_id: The room ID
+            event_type: "member_joined" or "member_left"
+            username: The member who joined or left
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            if event_type == "member_joined":
+                if username not in replica.members:
+                    replica.members.append(username)
+            elif event_type == "member_left":
+                if username in replica.members:
+                    replica.members.remove(username)
+
+    def record_role_change(
+        self, room_id: str, username: str, role: str
+    ) -> None:
+        """
+        Apply a member_role_changed event to a replica.
+
+        Args:
+            room_id: The room ID
+            username: The member whose role changed
+            role: The member's new role
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            if role == MEMBER:
+                replica.roles.pop(username, None)
+            else:
+                replica.roles[username] = role
+
+    def record_retention(self, room_id: str, limits: List[str]) -> None:
+        """
+        Apply a retention_changed event to a replica.
+
+        Args:
+            room_id: The room ID
+            limits: The room's new retention limits
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica:
+                replica.retention = list(limits)
+
+    def record_spam_thresholds(
+        self, room_id: str, thresholds: Dict[str, int]
+    ) -> None:
+        """
+        Apply a spam_thresholds_changed event to a replica.
+
+        Args:
+            room_id: The room ID
+            thresholds: The room's spam thresholds changed from their
+                defaults
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica:
+                replica.spam_thresholds = dict(thresholds)
+
+    def record_content_filters(
+        self, room_id: str, filters: List[Dict[str, Any]]
+    ) -> None:
+        """
+        Apply a content_filters_changed event to a replica.
+
+        Args:
+            room_id: The room ID
+            filters: The room's content filters
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica:
+                replica.content_filters = [dict(f) for f in filters]
+
+    def record_pins(self, room_id: str, pinned: List[str]) -> None:
+        """
+        Apply a message_pinned or message_unpinned event to a replica.
+
+        Args:
+            room_id: The room ID
+            pinned: IDs of the room's pinned messages, in the order pinned
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica:
+                replica.pinned = list(pinned)
+
+    def record_metadata(
+        self,
+        room_id: str,
+        changes: Dict[str, Optional[str]],
+        versions: Dict[str, str],
+    ) -> Dict[str, Optional[str]]:
+        """
+        Apply a room_updated event to a replica, newest field wins.
+
+        Args:
+            room_id: The room ID
+            changes: Maps field -> new value, as announced
+            versions: Maps field -> encoded HLC timestamp, as announced
+
+        Returns:
+            The changes that were newer than the replica's (empty if
+            there is no replica)
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return {}
+            applied = {}
+            for name in newer_fields(replica.metadata_versions, versions):
+                if name in changes:
+                    setattr(replica, name, changes[name])
+                    replica.metadata_versions[name] = versions[name]
+                    applied[name] = changes[name]
+            return applied
+
+    def expire_messages(self, now: Optional[float] = None) -> Dict[str, int]:
+        """
+        Delete replicated messages outside their room's retention policy.
+
+        Args:
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            dict: {room_id: number of messages deleted} for replicas that
+            had expired messages
+        """
+        expired = {}
+        with self._lock:
+            for room_id, replica in self._replicas.items():
+                if not replica.retention:
+                    continue
+                kept, expired_through = expire(
+                    replica.messages, replica.retention, now
+                )
+                if not expired_through:
+                    continue
+                expired[room_id] = len(replica.messages) - len(kept)
+                replica.messages = kept
+                replica.expired_through = max(
+                    replica.expired_through, expired_through
+                )
+        return expired
+
+    def record_edit(self, room_id: str, edit: Dict) -> None:
+        """
+        Apply a message_edited or message_deleted event to a replica.
+
+        A deleted message is unpinned, as on the admin node.
+
+        Args:
+            room_id: The room ID
+            edit: The edit record carried by the event
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            for message in replica.messages:
+                if message.get("message_id") == edit.get("message_id"):
+                    apply_edit(message, edit)
+            if edit.get("action") == DELETE:
+                replica.pinned = update_pins(
+                    replica.pinned, edit.get("message_id"), False
+                )
+
+    def record_reactions(
+        self, room_id: str, message_id: str, reactions: Dict
+    ) -> None:
+        """
+        Apply a message_reaction event to a replica.
+
+        Args:
+            room_id: The room ID
+            message_id: ID of the message reacted to
+            reactions: The message's reactions (emoji -> usernames)
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            for message in replica.messages:
+                if message.get("message_id") == message_id:
+                    message["reactions"] = dict(reactions)
+
+    def record_read(
+        self, room_id: str, username: str, position: int
+    ) -> None:
+        """
+        Apply a read_position_updated event to a replica.
+
+        Args:
+            room_id: The room ID
+            username: The member whose read position moved
+            position: Sequence number of the last message they read
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            replica.read_positions = merge_read_positions(
+                replica.read_positions, {username: position}
+            )
+
+    def record_public_key(self, room_id: str, key: Dict) -> None:
+        """
+        Apply a key_published event to a replica.
+
+        Args:
+            room_id: The room ID
+            key: The event data (the key record plus room_id and hlc)
+        """
+        key = {k: v for k, v in key.items() if k not in ("room_id", "hlc")}
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            replica.public_keys = merge_public_keys(
+                replica.public_keys, {key["username"]: key}
+            )
+
+    def record_thread(
+        self, room_id: str, thread_id: str, thread: Dict
+    ) -> None:
+        """
+        Apply a thread_updated event to a replica.
+
+        Args:
+            room_id: The room ID
+            thread_id: ID of the thread's first message
+            thread: The thread summary (reply_count, last_reply_at)
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            for message in replica.messages:
+                if message.get("message_id") == thread_id:
+                    message["thread"] = {
+                        "reply_count": thread["reply_count"],
+                        "last_reply_at": thread["last_reply_at"],
+                    }
+
+    def remove_local_member(self, room_id: str, username: str) -> None:
+        """
+        Record that a local member left a remote room.
+
+        The replica is dropped once no local members remain, since this
+        node no longer takes part in the room, unless this node is one of
+        the room's replication followers.
+
+        Args:
+            room_id: The room ID
+            username: The member who left
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            if username in replica.local_members:
+                replica.local_members.remove(username)
+            if not replica.local_members and not replica.follower:
+                del self._replicas[room_id]
+
+    def record_local_join(self, room_id: str, username: str) -> bool:
+        """
+        Record a local user joining a remote room whose admin is
+        unreachable, in the replica's membership set.
+
+        Args:
+            room_id: The room ID
+            username: The joining user
+
+        Returns:
+            True if this node holds a replica of the room
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return False
+            member_set = MemberSet.from_dict(replica.member_set)
+            if username not in member_set:
+                member_set.add(username)
+                replica.member_set = member_set.to_dict()
+            if username not in replica.members:
+                replica.members.append(username)
+            if username not in replica.local_members:
+                replica.local_members.append(username)
+            return True
+
+    def record_local_leave(self, room_id: str, username: str) -> None:
+        """
+        Record a local member leaving a remote room whose admin is
+        unreachable, in the replica's membership set.
+
+        The replica is kept until its set reaches the admin, even without
+        local members left.
+
+        Args:
+            room_id: The room ID
+            username: The member who left
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            member_set = MemberSet.from_dict(replica.member_set)
+            member_set.remove(username)
+            replica.member_set = member_set.to_dict()
+            if username in replica.members:
+                replica.members.remove(username)
+            if username in replica.local_members:
+                replica.local_members.remove(username)
+
+    def merge_member_set(self, room_id: str, member_set: Dict) -> None:
+        """
+        Merge a set returned by the room's admin into a replica's.
+
+        Args:
+            room_id: The room ID
+            member_set: The admin's membership set, as a dict
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if not replica:
+                return
+            replica.member_set = merge_member_sets(
+                replica.member_set, member_set
+            )
+            replica.members = MemberSet.from_dict(
+                replica.member_set
+            ).members()
+            if not replica.local_members and not replica.follower:
+                del self._replicas[room_id]
+
+    def purge_member_tombstones(
+        self, ttl: float = TOMBSTONE_TTL, now: Optional[float] = None
+    ) -> int:
+        """
+        Drop old tombstones from the replicas' membership sets.
+
+        Args:
+            ttl: Seconds to keep a tombstone
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            int: Number of tombstones dropped
+        """
+        purged = 0
+        with self._lock:
+            for replica in self._replicas.values():
+                member_set = MemberSet.from_dict(replica.member_set)
+                count = member_set.purge_tombstones(ttl, now)
+                if count:
+                    replica.member_set = member_set.to_dict()
+                    purged += count
+        return purged
+
+    def apply_replication(
+        self,
+        room_info: Dict,
+        messages: List[Dict],
+        reset: bool = False,
+    ) -> int:
+        """
+        Apply a batch from the admin's replication stream.
+
+        Messages must continue the stream without gaps: duplicates are
+        skipped and the batch stops at the first missing sequence number,
+        so the admin resends from the returned position. A reset batch
+        (sent when this node is too far behind) restarts the stream at its
+        first message.
+
+        Args:
+            room_info: Room metadata (room_id, room_name, description,
+                creator_id, admin_node)
+            messages: Messages in sequence order
+            reset: True if the batch restarts the stream
+
+        Returns:
+            int: Sequence number applied through, for acknowledgment
+        """
+        room_id = room_info["room_id"]
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica is None:
+                replica = self._replicas[room_id] = RoomReplica(
+                    room_id=room_id,
+                    room_name=room_info.get("room_name", ""),
+                    admin_node=room_info.get("admin_node", ""),
+                )
+            replica.follower = True
+            apply_versioned(
+                replica, room_info, room_info.get("metadata_versions") or {}
+            )
+            replica.creator_id = room_info.get("creator_id", "")
+            replica.admin_node = room_info.get("admin_node", "")
+            replica.private = bool(room_info.get("private", False))
+            replica.total_order = bool(room_info.get("total_order", False))
+            replica.max_members = int(room_info.get("max_members", 0))
+            replica.waitlist_enabled = bool(
+                room_info.get("waitlist_enabled", False)
+            )
+            replica.announcement = bool(room_info.get("announcement", False))
+            replica.delivery = room_info.get("delivery", EXACTLY_ONCE)
+            replica.ephemeral = bool(room_info.get("ephemeral", False))
+            replica.placement = dict(room_info.get("placement") or {})
+            replica.durable = bool(room_info.get("durable", False))
+            if "members" in room_info:
+                replica.members = list(room_info["members"])
+            if "member_set" in room_info:
+                replica.member_set = merge_member_sets(
+                    replica.member_set, room_info["member_set"]
+                )
+            if "banned" in room_info:
+                replica.banned = list(room_info["banned"])
+            if "roles" in room_info:
+                replica.roles = dict(room_info["roles"])
+            if "retention" in room_info:
+                replica.retention = list(room_info["retention"])
+            if "pinned" in room_info:
+                replica.pinned = list(room_info["pinned"])
+            if "scheduled" in room_info:
+                replica.scheduled = dict(room_info["scheduled"])
+            if "spam_thresholds" in room_info:
+                replica.spam_thresholds = dict(room_info["spam_thresholds"])
+            if "content_filters" in room_info:
+                replica.content_filters = [
+                    dict(f) for f in room_info["content_filters"]
+                ]
+            if "read_positions" in room_info:
+                replica.read_positions = merge_read_positions(
+                    replica.read_positions, room_info["read_positions"]
+                )
+            if "public_keys" in room_info:
+                replica.public_keys = merge_public_keys(
+                    replica.public_keys, room_info["public_keys"]
+                )
+
+            ordered = sorted(messages, key=lambda m: m["sequence_number"])
+            if reset and ordered:
+                replica.replicated_sequence = (
+                    ordered[0]["sequence_number"] - 1
+                )
+            for message in ordered:
+                sequence = message["sequence_number"]
+                if sequence <= replica.replicated_sequence:
+                    continue
+                if sequence != replica.replicated_sequence + 1:
+                    break
+                self._add_message(replica, message)
+                replica.replicated_sequence = sequence
+            return replica.replicated_sequence
+
+    def install_snapshot(self, snapshot: RoomSnapshot) -> int:
+        """
+        Replace this node's replica of a room with a snapshot of it.
+
+        Used to bootstrap a follower of a room it holds nothing of, or
+        that is too far behind the admin's stream; the admin then streams
+        the messages after the snapshot.
+
+        Args:
+            snapshot: The admin's snapshot of the room
+
+        Returns:
+            int: Sequence number the replica is applied through
+        """
+        room_info = dict(
+            snapshot.to_dict(),
+            members=sorted(snapshot.members),
+            admin_node=snapshot.source_node,
+        )
+        with self._lock:
+            replica = self._replicas.get(snapshot.room_id)
+            if replica is not None:
+                replica.messages = []
+                replica.replicated_sequence = 0
+        self.apply_replication(room_info, snapshot.messages, True)
+        with self._lock:
+            replica = self._replicas[snapshot.room_id]
+            replica.replicated_sequence = snapshot.message_counter
+            replica.message_counter = snapshot.message_counter
+            replica.vector_clock = dict(snapshot.vector_clock)
+            replica.expired_through = snapshot.expired_through
+        logger.info(
+            f"Installed snapshot of room {snapshot.room_id} from "
+            f"{snapshot.source_node} through #{snapshot.message_counter}"
+        )
+        return snapshot.message_counter
+
+    def set_admin(self, room_id: str, admin_node: str) -> None:
+        """Record a new admin node for a replicated room."""
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if replica:
+                replica.admin_node = admin_node
+
+    def get(self, room_id: str) -> Optional[RoomReplica]:
+        """Get the replica of a room, if this node holds one."""
+        with self._lock:
+            return self._replicas.get(room_id)
+
+    def history_page(
+        self,
+        room_id: str,
+        username: str,
+        before: Optional[str] = None,
+        after: Optional[str] = None,
+        limit: int = HISTORY_PAGE_SIZE,
+    ) -> Dict:
+        """
+        Get a page of a followed room's history from its replica.
+
+        Only replicas the admin streams to this node as a follower, with
+        every message up to the latest applied, serve history. A replica
+        keeps at most max_messages messages, so a page reaching back past
+        the oldest one it has is refused when older messages remain on
+        the admin (REPLICA_INCOMPLETE), and the caller reads it there.
+
+        Args:
+            room_id: The room ID
+            username: The user asking
+            before: Page ends just before the message with this ID
+            after: Page starts just after the message with this ID
+            limit: Maximum number of messages in the page
+
+        Returns:
+            dict: A page like RoomStateManager.get_history's, or an error
+            with 'error' and 'error_code' (REPLICA_UNAVAILABLE if this
+            node can't serve the room's history)
+        """
+        with self._lock:
+            replica = self._replicas.get(room_id)
+            if (
+                replica is None
+                or not replica.follower
+                or replica.replicated_sequence < replica.message_counter
+            ):
+                return {
+                    "success": False,
+                    "error": "No up-to-date replica of this room",
+                    "error_code": "REPLICA_UNAVAILABLE",
+                }
+            if replica.private and username not in replica.members:
+                return {
+                    "success": False,
+                    "error": "Only room members can read its history",
+                    "error_code": "NOT_A_MEMBER",
+                }
+            messages, expired_through = expire(
+                replica.messages, replica.retention
+            )
+            expired_through = max(expired_through, replica.expired_through)
+            pinned = list(replica.pinned)
+
+        page = paginate_history(messages, before, after, limit)
+        if not page["success"]:
+            return page
+        oldest = messages[0].get("sequence_number", 0) if messages else 0
+        reaches_oldest = not after and not page["has_more"]
+        if reaches_oldest and oldest > expired_through + 1:
+            return {
+                "success": False,
+                "error": "The replica doesn't have the room's older messages",
+                "error_code": "REPLICA_INCOMPLETE",
+            }
+        page["truncated"] = reaches_oldest and expired_through > 0
+        page["pinned"] = pinned
+        page["archived"] = False
+        return page
+
+    def remove(self, room_id: str) -> Optional[RoomReplica]:
+        """Drop the replica of a room."""
+        with self._lock:
+            return self._replicas.pop(room_id, None)
+
+    def rooms_administered_by(self, node_id: str) -> List[str]:
+        """Get the IDs of replicated rooms administered by a node."""
+        with self._lock:
+            return [
+                room_id
+                for room_id, replica in self._replicas.items()
+                if replica.admin_node == node_id
+            ]
+
+    def _add_message(self, replica: RoomReplica, message: Dict) -> None:
+        """Add a message to a replica, keeping the latest copy of each."""
+        message_id = message.get("message_id")
+        for index, existing in enumerate(replica.messages):
+            if existing.get("message_id") == message_id:
+                if is_newer_revision(message, existing):
+                    replica.messages[index] = message
+                return
+        replica.messages.append(message)
+        replica.messages.sort(key=lambda m: m.get("sequence_number", 0))
+        if len(replica.messages) > self.max_messages:
+            del replica.messages[: len(replica.messages) - self.max_messages]
+        replica.message_counter = max(
+            replica.message_counter, message.get("sequence_number", 0)
+        )
+        replica.vector_clock = (
+            VectorClock.from_dict(replica.vector_clock)
+            .merge(VectorClock.from_dict(message.get("vector_clock")))
+            .to_dict()
+        )
+
+
+def merge_replicas(replicas: List[Dict], max_messages: int) -> Dict:
+    """
+    Combine replicas reported by several nodes into one room state.
+
+    Args:
+        replicas: Replica dicts, each with a 'node_id' key naming the
+            node that reported it
+        max_messages: Maximum number of messages to keep
+
+    Returns:
+        dict: Room state with 'members' as {username: node_id} and
+        'member_nodes' for members reported by several nodes, plus the
+        room metadata, messages, message_counter and vector_clock
+    """
+    base = replicas[0]
+    members: Dict[str, str] = {}
+    member_nodes: Dict[str, List[str]] = {}
+    messages: Dict[str, Dict] = {}
+    counter = 0
+    clock = VectorClock()
+    banned = set()
+    roles: Dict[str, str] = {}
+    read_positions: Dict[str, int] = {}
+    public_keys: Dict[str, Dict] = {}
+    scheduled: Dict[str, Dict] = {}
+    retention = next(
+        (r["retention"] for r in replicas if r.get("retention")), []
+    )
+    pinned = next((r["pinned"] for r in replicas if r.get("pinned")), [])
+    spam_thresholds = next(
+        (r["spam_thresholds"] for r in replicas if r.get("spam_thresholds")),
+        {},
+    )
+    content_filters = next(
+        (r["content_filters"] for r in replicas if r.get("content_filters")),
+        [],
+    )
+    delivery = next(
+        (r["delivery"] for r in replicas if r.get("delivery")), EXACTLY_ONCE
+    )
+    placement = next(
+        (r["placement"] for r in replicas if r.get("placement")), {}
+    )
+    metadata = merge_versioned(replicas)
+    member_set = merge_member_sets(*(r.get("member_set") for r in replicas))
+
+    for replica in replicas:
+        for username in replica.get("local_members", []):
+            members[username] = replica["node_id"]
+            member_nodes.setdefault(username, []).append(replica["node_id"])
+        for message in replica.get("messages", []):
+            kept = messages.setdefault(message.get("message_id"), message)
+            if is_newer_revision(message, kept):
+                messages[message.get("message_id")] = message
+        counter = max(counter, replica.get("message_counter", 0))
+        clock.merge(VectorClock.from_dict(replica.get("vector_clock")))
+        banned.update(replica.get("banned", []))
+        for username, role in replica.get("roles", {}).items():
+            roles.setdefault(username, role)
+        read_positions = merge_read_positions(
+            read_positions, replica.get("read_positions", {})
+        )
+        public_keys = merge_public_keys(
+            public_keys, replica.get("public_keys", {})
+        )
+        scheduled.update(replica.get("scheduled", {}))
+
+    ordered = sorted(
+        messages.values(), key=lambda m: m.get("sequence_number", 0)
+    )
+    return {
+        "room_id": base["room_id"],
+        "room_name": metadata["room_name"],
+        "description": metadata["description"],
+        "topic": metadata["topic"],
+        "metadata_versions": metadata["metadata_versions"],
+        "creator_id": base.get("creator_id", ""),
+        "members": members,
+        "member_nodes": {
+            username: nodes
+            for username, nodes in member_nodes.items()
+            if len(nodes) > 1
+        },
+        "messages": ordered[-max_messages:],
+        "message_counter": counter,
+        "vector_clock": clock.to_dict(),
+        "private": any(replica.get("private") for replica in replicas),
+        "total_order": any(
+            replica.get("total_order") for replica in replicas
+        ),
+        "max_members": max(
+            replica.get("max_members", 0) for replica in replicas
+        ),
+        "waitlist_enabled": any(
+            replica.get("waitlist_enabled") for replica in replicas
+        ),
+        "announcement": any(
+            replica.get("announcement") for replica in replicas
+        ),
+        "banned": sorted(banned),
+        "roles": roles,
+        "read_positions": read_positions,
+        "public_keys": public_keys,
+        "retention": list(retention),
+        "pinned": list(pinned),
+        "spam_thresholds": dict(spam_thresholds),
+        "content_filters": [dict(f) for f in content_filters],
+        "delivery": delivery,
+        "ephemeral": any(replica.get("ephemeral") for replica in replicas),
+        "placement": dict(placement),
+        "durable": any(replica.get("durable") for replica in replicas),
+        "member_set": member_set,
+        # Scheduled messages a replica already has were sent
+        "scheduled": {
+            message_id: message
+            for message_id, message in scheduled.items()
+            if message_id not in messages
+        },
+        "expired_through": max(
+            replica.get("expired_through", 0) for replica in replicas
+        ),
+    }
+
+
+class RoomFailover:
+    """
+    Elects new administrators for rooms whose admin node has died.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        node_address: str,
+        room_manager,
+        replica_store: ReplicaStore,
+        peer_registry,
+        failure_detector=None,
+        room_directory=None,
+        election_timeout: float = ELECTION_TIMEOUT,
+        membership=None,
+        room_registry=None,
+    ):
+        """
+        Initialize room failover.
+
+        Args:
+            node_id: ID of this node
+            node_address: XML-RPC address of this node
+            room_manager: RoomStateManager that takes over elected rooms
+            replica_store: Replicas of remote rooms held by this node
+            peer_registry: PeerRegistry used to reach peers
+            failure_detector: Optional FailureDetector for peer liveness
+            room_directory: Optional RoomDirectory to update on changes
+            election_timeout: Seconds to wait for a winner's announcement
+            membership: Optional ClusterMembership whose view decides the
+                election candidates and quorum
+            room_registry: Optional RaftRoomRegistry that must accept this
+                node as a room's new admin before it takes the room over
+        """
+        self.node_id = node_id
+        self.node_address = node_address
+        self.room_manager = room_manager
+        self.replica_store = replica_store
+        self.peer_registry = peer_registry
+        self.failure_detector = failure_detector
+        self.room_directory = room_directory
+        self.election_timeout = election_timeout
+        self.membership = membership
+        self.room_registry = room_registry
+        self._notify_callback: Optional[Callable] = None
+        self._lock = threading.Lock()
+        self._elections: set = set()
+        self.snapshots = SnapshotSender(node_id, peer_registry)
+
+    def set_notify_callback(self, callback: Callable):
+        """
+        Set a callback for notifying local clients in a room.
+
+        Args:
+            callback: Function(room_id, message) that delivers a message to
+                the room's local clients
+        """
+        self._notify_callback = callback
+
+    async def on_membership_change(self, event: MembershipEvent):
+        """
+        Failure detector subscriber: start elections when a node dies.
+
+        Args:
+            event: The membership change
+        """
+        if event.current != PeerState.DEAD:
+            return
+        loop = asyncio.get_running_loop()
+        await loop.run_in_executor(None, self.handle_node_dead, event.node_id)
+
+    def handle_node_dead(self, node_id: str) -> List[str]:
+        """
+        Run elections for every replicated room administered by a node.
+
+        Args:
+            node_id: The dead node
+
+        Returns:
+            IDs of the rooms this node took over
+        """
+        won = []
+        for room_id in self.replica_store.rooms_administered_by(node_id):
+            if self.run_election(room_id):
+                won.append(room_id)
+        return won
+
+    def run_election(self, room_id: str) -> bool:
+        """
+        Run a bully election for a room.
+
+        Higher-ID live peers are asked whether they hold a replica. If any
+        does, it takes over the election and this node waits for the
+        announcement; otherwise this node becomes the administrator.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            True if this node became the room's administrator
+        """
+        replica = self.replica_store.get(room_id)
+        if replica is None or self._is_alive(replica.admin_node):
+            return False
+        if self.membership is not None and not self.membership.has_quorum():
+            logger.warning(
+                f"Not electing an admin for room {room_id}: no quorum of "
+                f"membership epoch {self.membership.epoch}"
+            )
+            self._schedule_recheck(room_id)
+            return False
+
+        with self._lock:
+            if room_id in self._elections:
+                return False
+            self._elections.add(room_id)
+
+        try:
+            logger.info(f"Starting election for room {room_id}")
+            for peer_id in self.live_peers():
+                if peer_id <= self.node_id:
+                    continue
+                try:
+                    response = self.peer_registry.call_peer(
+                        peer_id, "failover_election", room_id, self.node_id
+                    )
+                except Exception as e:
+                    logger.debug(f"Election message to {peer_id} failed: {e}")
+                    continue
+                if response.get("ok"):
+                    logger.info(
+                        f"Node {peer_id} outranks this node for room "
+                        f"{room_id}, waiting for its announcement"
+                    )
+                    self._schedule_recheck(room_id)
+                    return False
+
+            return self._become_admin(room_id, replica.admin_node)
+        finally:
+            with self._lock:
+                self._elections.discard(room_id)
+
+    def handle_election_message(self, room_id: str, candidate: str) -> Dict:
+        """
+        Answer an election message from a lower-ID candidate.
+
+        If this node holds a replica it answers OK and runs its own
+        election in the background.
+
+        Args:
+            room_id: The room ID
+            candidate: Node ID of the candidate
+
+        Returns:
+            dict: {'ok': bool, 'node_id': str}
+        """
+        if self.replica_store.get(room_id) is None:
+            return {"ok": False, "node_id": self.node_id}
+
+        threading.Thread(
+            target=contextvars.copy_context().run,
+            args=(self.run_election, room_id),
+            daemon=True,
+        ).start()
+        return {"ok": True, "node_id": self.node_id}
+
+    def get_replica(self, room_id: str) -> Optional[Dict]:
+        """Get this node's replica of a room as a dict, if it holds one."""
+        replica = self.replica_store.get(room_id)
+        return replica.to_dict() if replica else None
+
+    def apply_admin_change(
+        self, room_id: str, admin_node: str, node_address: str
+    ) -> bool:
+        """
+        Re-point a replicated room to its newly elected administrator.
+
+        Args:
+            room_id: The room ID
+            admin_node: Node ID of the new administrator
+            node_address: XML-RPC address of the new administrator
+
+        Returns:
+            bool: True if this node held a replica of the room
+        """
+        replica = self.replica_store.get(room_id)
+        previous = replica.admin_node if replica else None
+        self.replica_store.set_admin(room_id, admin_node)
+        if self.room_directory:
+            self.room_directory.reassign(
+                room_id,
+                admin_node,
+                node_address,
+                replica.room_name if replica else None,
+            )
+
+        if replica is None:
+            return False
+
+        logger.info(f"Room {room_id} is now administered by {admin_node}")
+        self._notify(
+            room_id,
+            create_room_admin_changed_event(
+                room_id, replica.room_name, admin_node, previous
+            ),
+        )
+        return True
+
+    def hand_off_rooms(self) -> Dict[str, str]:
+        """
+        Hand every room administered here off to a live peer.
+
+        Used during graceful shutdown. Rooms that were handed off are
+        removed from this node. Rooms with placement constraints go to
+        the peers matching them first (see placement.py).
+
+        Returns:
+            dict: Maps each handed-off room ID to its new admin node ID
+        """
+        handed_off = {}
+        for room in self.room_manager.list_rooms():
+            peers = self.live_peers()
+            placement = room.get("placement")
+            if placement:
+                peers.sort(
+                    key=lambda peer_id: not matches(
+                        self.peer_registry.get_tags(peer_id), placement
+                    )
+                )
+            new_admin = self.hand_off_room(room["room_id"], peers)
+            if new_admin:
+                handed_off[room["room_id"]] = new_admin
+        return handed_off
+
+    def hand_off_room(
+        self, room_id: str, peer_ids: Optional[List[str]] = None
+    ) -> Optional[str]:
+        """
+        Transfer a room administered here to a live peer.
+
+        Peers are tried highest node ID first, matching the election
+        order, until one accepts the room.
+
+        Args:
+            room_id: The room ID
+            peer_ids: Peers to try instead, in order (e.g. the room's
+                owner under sharding, see sharding.py)
+
+        Returns:
+            Node ID of the new administrator, or None if no peer took it
+        """
+        snapshot = RoomSnapshot.from_room(self.room_manager, room_id)
+        if snapshot is None:
+            return None
+
+        for peer_id in peer_ids or self.live_peers():
+            capabilities = self.peer_registry.get_capabilities(peer_id)
+            try:
+                if SNAPSHOT_CAPABILITY in capabilities:
+                    result = self.snapshots.send(peer_id, snapshot)
+                else:
+                    # Peers that predate snapshot transfers take the whole
+                    # state in one call
+                    result = self.peer_registry.call_peer(
+                        peer_id,
+                        "accept_room_handoff",
+                        snapshot.restore_args(),
+                        self.node_id,
+                    )
+            except Exception as e:
+                logger.warning(
+                    f"Could not hand room {room_id} off to {peer_id}: {e}"
+                )
+                continue
+            if result.get("success"):
+                self.room_manager.delete_room(room_id, handed_off=True)
+                logger.info(f"Handed room {room_id} off to {peer_id}")
+                return peer_id
+
+        logger.warning(f"No peer accepted room {room_id}")
+        return None
+
+    def accept_handoff(self, state: Dict, previous_admin: str) -> bool:
+        """
+        Take over a room handed off by a node that is shutting down.
+
+        Args:
+            state: Full room state, as accepted by restore_room
+            previous_admin: Node ID of the departing administrator
+
+        Returns:
+            True if this node became the room's administrator
+        """
+        logger.info(
+            f"Accepting handoff of room {state['room_id']} "
+            f"from {previous_admin}"
+        )
+        return self._take_over(state, previous_admin)
+
+    def _become_admin(self, room_id: str, previous_admin: str) -> bool:
+        """Rebuild a room from all replicas and take it over."""
+        own = self.replica_store.get(room_id)
+        if own is None:
+            return False
+
+        replicas = [dict(own.to_dict(), node_id=self.node_id)]
+        for peer_id in self.live_peers():
+            try:
+                result = self.peer_registry.call_peer(
+                    peer_id, "get_room_replica", room_id
+                )
+            except Exception as e:
+                logger.warning(f"Could not fetch replica from {peer_id}: {e}")
+                continue
+            if result.get("success"):
+                replicas.append(dict(result["replica"], node_id=peer_id))
+
+        state = merge_replicas(replicas, self.replica_store.max_messages)
+        logger.info(
+            f"Rebuilt room {room_id} from {len(replicas)} replicas"
+        )
+        if not self._take_over(state, previous_admin):
+            return False
+        audit(
+            self.room_manager.audit_log,
+            self.node_id,
+            ADMIN_FAILOVER,
+            room_id,
+            previous_admin=previous_admin,
+            replicas=len(replicas),
+        )
+        return True
+
+    def _take_over(self, state: Dict, previous_admin: str) -> bool:
+        """Start administering a room and announce the change."""
+        room_id = state["room_id"]
+        if self.room_registry is not None:
+            result = self.room_registry.assign_admin(room_id, previous_admin)
+            if not result.get("success"):
+                logger.warning(
+                    f"Not taking over room {room_id}: {result.get('error')}"
+                )
+                return False
+        room = self.room_manager.restore_room(**state)
+        if room is None:
+            return False
+        self.replica_store.remove(room_id)
+
+        logger.info(
+            f"This node is now administrator of room {room_id} "
+            f"({len(state['members'])} members)"
+        )
+
+        if self.room_directory:
+            self.room_directory.reassign(
+                room_id, self.node_id, self.node_address, room.room_name
+            )
+        for peer_id in self.peer_registry.list_peers():
+            try:
+                self.peer_registry.call_peer(
+                    peer_id,
+                    "room_admin_changed",
+                    room_id,
+                    self.node_id,
+                    self.node_address,
+                )
+            except Exception as e:
+                logger.debug(f"Could not announce to {peer_id}: {e}")
+
+        self._notify(
+            room_id,
+            create_room_admin_changed_event(
+                room_id, room.room_name, self.node_id, previous_admin
+            ),
+        )
+        return True
+
+    def _schedule_recheck(self, room_id: str) -> None:
+        """Re-run the election if no winner is announced in time."""
+        timer = threading.Timer(
+            self.election_timeout,
+            contextvars.copy_context().run,
+            args=(self.run_election, room_id),
+        )
+        timer.daemon = True
+        timer.start()
+
+    def _is_alive(self, node_id: str) -> bool:
+        """Check if a node is alive according to the failure detector."""
+        if node_id == self.node_id:
+            return True
+        if self.failure_detector is None:
+            return False
+        return self.failure_detector.is_alive(node_id)
+
+    def live_peers(self) -> List[str]:
+        """Get the peers currently considered alive, highest ID first."""
+        if self.failure_detector is not None:
+            peers = self.failure_detector.alive_peers()
+        else:
+            peers = list(self.peer_registry.list_peers())
+        if self.membership is not None:
+            members = set(self.membership.peers())
+            peers = [peer for peer in peers if peer in members]
+        return sorted(peers, reverse=True)
+
+    def _notify(self, room_id: str, message: Dict) -> None:
+        """Deliver a message to the room's local clients."""
+        if self._notify_callback:
+            self._notify_callback(room_id, message)
@@ -0,0 +1,354 @@
+"""
+Peer Failure Detection
+
+Sends periodic heartbeats to every peer node, tracks round-trip times, and
+moves each peer through ALIVE -> SUSPECT -> DEAD as heartbeats are missed.
+A successful heartbeat brings a peer straight back to ALIVE.
+
+Heartbeat responses carry the peer's wall clock, from which the skew
+between the two clocks is estimated (see clock_skew.py).
+
+Other subsystems subscribe to membership changes instead of running their
+own health checks. Subscribers are called with a MembershipEvent whenever a
+peer changes state; a subscriber may be a plain function or a coroutine
+function.
+"""
+
+import asyncio
+import logging
+import threading
+import time
+from dataclasses import dataclass
+from enum import Enum
+from typing import Callable, Dict, List, Optional
+
+from .clock_skew import ClockSkewMonitor
+
+logger = logging.getLogger(__name__)
+
+# Failure detector configuration
+PROBE_INTERVAL = 5  # seconds between heartbeat rounds
+PROBE_TIMEOUT = 2  # seconds to wait for a heartbeat response
+SUSPECT_THRESHOLD = 1  # missed heartbeats before a peer is suspected
+DEAD_THRESHOLD = 3  # missed heartbeats before a peer is declared dead
+RTT_SMOOTHING = 0.2  # weight of the newest sample in the RTT average
+
+
+class PeerState(Enum):
+    """Liveness state of a peer node."""
+
+    ALIVE = "alive"
+    SUSPECT = "suspect"
+    DEAD = "dead"
+
+
+@dataclass
+class PeerStatus:
+    """
+    Liveness information for a peer node.
+
+    Attributes:
+        node_id: The peer's node ID
+        state: Current liveness state
+        missed_heartbeats: Consecutive heartbeats without a response
+        last_heard: UNIX time of the last successful heartbeat (0 if never)
+        last_rtt: Round-trip time of the last heartbeat, in seconds
+        avg_rtt: Smoothed round-trip time, in seconds
+        state_changed_at: UNIX time of the last state change
+    """
+
+    node_id: str
+    state: PeerState = PeerState.ALIVE
+    missed_heartbeats: int = 0
+    last_heard: float = 0.0
+    last_rtt: Optional[float] = None
+    avg_rtt: Optional[float] = None
+    state_changed_at: float = 0.0
+
+    def __post_init__(self):
+        """Initialize the state change time if not set."""
+        if not self.state_changed_at:
+            self.state_changed_at = time.time()
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return {
+            "node_id": self.node_id,
+            "state": self.state.value,
+            "missed_heartbeats": self.missed_heartbeats,
+            "last_heard": self.last_heard,
+            "last_rtt": self.last_rtt,
+            "avg_rtt": self.avg_rtt,
+            "state_changed_at": self.state_changed_at,
+        }
+
+
+@dataclass
+class MembershipEvent:
+    """
+    A change in a peer's liveness state.
+
+    Attributes:
+        node_id: The peer whose state changed
+        previous: State before the change
+        current: State after the change
+        timestamp: UNIX time of the change
+    """
+
+    node_id: str
+    previous: PeerState
+    current: PeerState
+    timestamp: float
+
+
+MembershipListener = Callable[[MembershipEvent], None]
+
+
+class FailureDetector:
+    """
+    Heartbeat-based failure detector for peer nodes.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        peer_registry,
+        probe_timeout: float = PROBE_TIMEOUT,
+        suspect_threshold: int = SUSPECT_THRESHOLD,
+        dead_threshold: int = DEAD_THRESHOLD,
+        metrics=None,
+        skew_monitor: Optional[ClockSkewMonitor] = None,
+    ):
+        """
+        Initialize the failure detector.
+
+        Args:
+            node_id: ID of this node
+            peer_registry: PeerRegistry listing the peers to monitor
+            probe_timeout: Seconds to wait for each heartbeat
+            suspect_threshold: Missed heartbeats before SUSPECT
+            dead_threshold: Missed heartbeats before DEAD
+            metrics: Optional NodeMetrics counting missed heartbeats
+            skew_monitor: ClockSkewMonitor given the peers' clocks from
+                heartbeats (defaults to a new one)
+
+        Raises:
+            ValueError: If the thresholds are not 1 <= suspect <= dead
+        """
+        if not 1 <= suspect_threshold <= dead_threshold:
+            raise ValueError(
+                "Thresholds must satisfy 1 <= suspect_threshold "
+                "<= dead_threshold"
+            )
+        self.node_id = node_id
+        self.peer_registry = peer_registry
+        self.probe_timeout = probe_timeout
+        self.suspect_threshold = suspect_threshold
+        self.dead_threshold = dead_threshold
+        self.metrics = metrics
+        self.skew_monitor = skew_monitor or ClockSkewMonitor()
+        self._lock = threading.Lock()
+        self._peers: Dict[str, PeerStatus] = {}
+        self._listeners: List[MembershipListener] = []
+
+    def subscribe(self, listener: MembershipListener) -> None:
+        """
+        Subscribe to membership-change events.
+
+        Args:
+            listener: Function or coroutine function taking a
+                MembershipEvent
+        """
+        self._listeners.append(listener)
+
+    def unsubscribe(self, listener: MembershipListener) -> None:
+        """
+        Remove a membership-change subscriber.
+
+        Args:
+            listener: A previously subscribed listener
+        """
+        if listener in self._listeners:
+            self._listeners.remove(listener)
+
+    def get_status(self, node_id: str) -> Optional[PeerStatus]:
+        """Get the liveness information for a peer."""
+        with self._lock:
+            return self._peers.get(node_id)
+
+    def get_state(self, node_id: str) -> PeerState:
+        """
+        Get the liveness state of a peer.
+
+        Peers that have not been probed yet are assumed ALIVE.
+        """
+        status = self.get_status(node_id)
+        return status.state if status else PeerState.ALIVE
+
+    def is_alive(self, node_id: str) -> bool:
+        """Check if a peer is currently considered ALIVE."""
+        return self.get_state(node_id) == PeerState.ALIVE
+
+    def alive_peers(self) -> List[str]:
+        """Get the IDs of registered peers not suspected or dead."""
+        return [
+            node_id
+            for node_id in self.peer_registry.list_peers()
+            if self.is_alive(node_id)
+        ]
+
+    def list_statuses(self) -> List[Dict]:
+        """Get the liveness information of all probed peers."""
+        with self._lock:
+            return [status.to_dict() for status in self._peers.values()]
+
+    def record_success(
+        self, node_id: str, rtt: float
+    ) -> Optional[MembershipEvent]:
+        """
+        Record a heartbeat response from a peer.
+
+        Args:
+            node_id: The peer's node ID
+            rtt: Round-trip time of the heartbeat in seconds
+
+        Returns:
+            The resulting MembershipEvent, or None if the state didn't change
+        """
+        with self._lock:
+            status = self._get_or_create(node_id)
+            status.missed_heartbeats = 0
+            status.last_heard = time.time()
+            status.last_rtt = rtt
+            if status.avg_rtt is None:
+                status.avg_rtt = rtt
+            else:
+                status.avg_rtt = (
+                    RTT_SMOOTHING * rtt + (1 - RTT_SMOOTHING) * status.avg_rtt
+                )
+            return self._transition(status, PeerState.ALIVE)
+
+    def record_failure(self, node_id: str) -> Optional[MembershipEvent]:
+        """
+        Record a missed heartbeat from a peer.
+
+        Args:
+            node_id: The peer's node ID
+
+        Returns:
+            The resulting MembershipEvent, or None if the state didn't change
+        """
+        if self.metrics is not None:
+            self.metrics.record_heartbeat_failure(node_id)
+        with self._lock:
+            status = self._get_or_create(node_id)
+            status.missed_heartbeats += 1
+            if status.missed_heartbeats >= self.dead_threshold:
+                new_state = PeerState.DEAD
+            elif status.missed_heartbeats >= self.suspect_threshold:
+                new_state = PeerState.SUSPECT
+            else:
+                new_state = status.state
+            return self._transition(status, new_state)
+
+    async def probe_all(self) -> List[MembershipEvent]:
+        """
+        Run one heartbeat round against every registered peer.
+
+        Heartbeats are sent in parallel. Subscribers are notified of any
+        resulting state changes before this returns.
+
+        Returns:
+            The membership events produced by this round
+        """
+        peers = self.peer_registry.list_peers()
+        if not peers:
+            return []
+
+        results = await asyncio.gather(
+            *(self._probe(node_id) for node_id in peers)
+        )
+
+        events = []
+        for node_id, rtt in zip(peers, results):
+            if rtt is None:
+                event = self.record_failure(node_id)
+            else:
+                event = self.record_success(node_id, rtt)
+            if event:
+                events.append(event)
+
+        for event in events:
+            await self._notify(event)
+        return events
+
+    async def _probe(self, node_id: str) -> Optional[float]:
+        """
+        Send a heartbeat to a peer.
+
+        Returns:
+            Round-trip time in seconds, or None if the peer didn't respond
+        """
+        loop = asyncio.get_running_loop()
+
+        def _do_heartbeat():
+            sent = time.time()
+            response = self.peer_registry.call_peer(
+                node_id, "heartbeat", timeout=self.probe_timeout
+            )
+            if isinstance(response.get("clock"), (int, float)):
+                self.skew_monitor.record(
+                    node_id, sent, response["clock"], time.time()
+                )
+            return response.get("status") == "ok"
+
+        started = time.monotonic()
+        try:
+            ok = await asyncio.wait_for(
+                loop.run_in_executor(None, _do_heartbeat),
+                timeout=self.probe_timeout,
+            )
+        except Exception as e:
+            logger.debug(f"Heartbeat to {node_id} failed: {e}")
+            return None
+        return time.monotonic() - started if ok else None
+
+    async def _notify(self, event: MembershipEvent) -> None:
+        """Deliver a membership event to every subscriber."""
+        for listener in list(self._listeners):
+            try:
+                result = listener(event)
+                if asyncio.iscoroutine(result):
+                    await result
+            except Exception as e:
+                logger.error(f"Membership listener failed: {e}")
+
+    def _get_or_create(self, node_id: str) -> PeerStatus:
+        """Get the status record for a peer, creating it if needed."""
+        status = self._peers.get(node_id)
+        if status is None:
+            status = self._peers[node_id] = PeerStatus(node_id=node_id)
+        return status
+
+    def _transition(
+        self, status: PeerStatus, new_state: PeerState
+    ) -> Optional[MembershipEvent]:
+        """Move a peer to a new state and build the resulting event."""
+        if status.state == new_state:
+            return None
+
+        event = MembershipEvent(
+            node_id=status.node_id,
+            previous=status.state,
+            current=new_state,
+            timestamp=time.time(),
+        )
+        status.state = new_state
+        status.state_changed_at = event.timestamp
+
+        log = logger.info if new_state == PeerState.ALIVE else logger.warning
+        log(
+            f"Peer {status.node_id} is now {new_state.value.upper()} "
+            f"(was {event.previous.value})"
+        )
+        return event
@@ -0,0 +1,268 @@
+"""
+Fault Injection
+
+With fault_injection enabled, operators (or test scripts) can make a node
+fail on command through the admin API, to show and test how the cluster
+recovers:
+
+- crash: the node exits the next time it reaches a 2PC phase
+  (FAULT_PHASES), e.g. after voting READY but before the vote is sent,
+  leaving the coordinator without the vote and the participant's prepared
+  state to be recovered from its log
+- delay: calls of one NodeService method into this node are held for a
+  number of seconds before they are answered
+- drop heartbeats: heartbeats sent to this node fail, for a number of
+  heartbeats or seconds, so its peers suspect it and then declare it dead
+
+Faults are armed with POST /admin/faults/... and removed with POST
+/admin/faults/clear; a crash exits the process at once with
+CRASH_EXIT_CODE, so the node comes back only if something restarts it.
+Nodes without fault_injection have no FaultInjector and refuse these
+requests with FAULTS_DISABLED.
+"""
+
+import logging
+import os
+import threading
+import time
+from typing import Callable, Dict, Optional
+
+from .rpc import NODE_SERVICE_METHODS
+
+logger = logging.getLogger(__name__)
+
+# 2PC phases a crash can be armed at
+COORDINATOR_BEFORE_PREPARE = "coordinator_before_prepare"
+COORDINATOR_AFTER_DECISION = "coordinator_after_decision"
+PARTICIPANT_AFTER_VOTE = "participant_after_vote"
+PARTICIPANT_BEFORE_DECISION = "participant_before_decision"
+FAULT_PHASES = (
+    COORDINATOR_BEFORE_PREPARE,
+    COORDINATOR_AFTER_DECISION,
+    PARTICIPANT_AFTER_VOTE,
+    PARTICIPANT_BEFORE_DECISION,
+)
+
+# Exit status of an injected crash
+CRASH_EXIT_CODE = 70
+
+# Longest delay that can be injected into an RPC, in seconds
+MAX_RPC_DELAY = 60
+
+
+class FaultError(Exception):
+    """An injected fault's settings are invalid."""
+
+    def __init__(self, message: str, error_code: str = "INVALID_FAULT"):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_FAULT")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+class HeartbeatDropped(ConnectionError):
+    """Raised in place of answering a heartbeat that is being dropped."""
+
+
+def _crash_process() -> None:
+    """Exit the process at once, as a crash would."""
+    logging.shutdown()
+    os._exit(CRASH_EXIT_CODE)
+
+
+class FaultInjector:
+    """
+    The faults armed on this node and the hooks that trigger them.
+    """
+
+    def __init__(self, node_id: str, crash: Optional[Callable] = None):
+        """
+        Initialize the injector.
+
+        Args:
+            node_id: ID of this node
+            crash: Function called for an injected crash (defaults to
+                exiting the process with CRASH_EXIT_CODE)
+        """
+        self.node_id = node_id
+        self.crash = crash or _crash_process
+        self._lock = threading.Lock()
+        self._crash_phase: Optional[str] = None
+        # Maps method -> [delay in seconds, calls left (0: every call)]
+        self._delays: Dict[str, list] = {}
+        self._dropped_heartbeats = 0
+        self._drop_heartbeats_until = 0.0
+
+    def arm_crash(self, phase: str) -> Dict:
+        """
+        Crash the next time this node reaches a 2PC phase.
+
+        Args:
+            phase: One of FAULT_PHASES
+
+        Returns:
+            dict: The armed faults (see status)
+
+        Raises:
+            FaultError: If the phase is unknown
+        """
+        if phase not in FAULT_PHASES:
+            raise FaultError(
+                f"phase must be one of {', '.join(FAULT_PHASES)}"
+            )
+        with self._lock:
+            self._crash_phase = phase
+        logger.warning(f"Fault injection: crash armed at {phase}")
+        return self.status()
+
+    def delay_rpc(self, method: str, seconds: float, count: int = 0) -> Dict:
+        """
+        Hold calls of a method into this node before answering them.
+
+        Args:
+            method: NodeService method name
+            seconds: Delay of each call
+            count: Calls to delay (0 delays every call until cleared)
+
+        Returns:
+            dict: The armed faults (see status)
+
+        Raises:
+            FaultError: If the method is unknown or the delay or count
+                out of range
+        """
+        if method not in NODE_SERVICE_METHODS:
+            raise FaultError(f"Unknown NodeService method: {method}")
+        if not 0 < seconds <= MAX_RPC_DELAY:
+            raise FaultError(
+                f"seconds must be more than 0 and at most {MAX_RPC_DELAY}"
+            )
+        if count < 0:
+            raise FaultError("count must not be negative")
+        with self._lock:
+            self._delays[method] = [seconds, count]
+        logger.warning(
+            f"Fault injection: delaying {method} calls by {seconds}s"
+        )
+        return self.status()
+
+    def drop_heartbeats(self, count: int = 0, seconds: float = 0) -> Dict:
+        """
+        Fail heartbeats sent to this node.
+
+        Args:
+            count: Heartbeats to drop
+            seconds: Drop every heartbeat for this long
+
+        Returns:
+            dict: The armed faults (see status)
+
+        Raises:
+            FaultError: If neither count nor seconds is positive
+        """
+        if count < 0 or seconds < 0 or not (count or seconds):
+            raise FaultError("count or seconds must be positive")
+        with self._lock:
+            self._dropped_heartbeats = count
+            self._drop_heartbeats_until = (
+                time.time() + seconds if seconds else 0.0
+            )
+        logger.warning(
+            f"Fault injection: dropping heartbeats "
+            f"({count} heartbeats, {seconds}s)"
+        )
+        return self.status()
+
+    def clear(self) -> Dict:
+        """
+        Remove every armed fault.
+
+        Returns:
+            dict: The armed faults, now none (see status)
+        """
+        with self._lock:
+            self._crash_phase = None
+            self._delays.clear()
+            self._dropped_heartbeats = 0
+            self._drop_heartbeats_until = 0.0
+        logger.warning("Fault injection: faults cleared")
+        return self.status()
+
+    def status(self) -> Dict:
+        """
+        Get the armed faults.
+
+        Returns:
+            dict: {'crash_phase': str or None, 'delays': {method:
+            {'seconds', 'count'}}, 'dropped_heartbeats': int,
+            'drop_heartbeats_until': float or None}
+        """
+        with self._lock:
+            return {
+                "crash_phase": self._crash_phase,
+                "delays": {
+                    method: {"seconds": seconds, "count": count}
+                    for method, (seconds, count) in self._delays.items()
+                },
+                "dropped_heartbeats": self._dropped_heartbeats,
+                "drop_heartbeats_until": self._drop_heartbeats_until or None,
+            }
+
+    def crash_point(self, phase: str, transaction_id: str = "") -> None:
+        """
+        Hook: crash here if a crash is armed at this phase.
+
+        Args:
+            phase: The 2PC phase reached
+            transaction_id: The transaction, for the log
+        """
+        with self._lock:
+            if self._crash_phase != phase:
+                return
+            self._crash_phase = None
+        logger.critical(
+            f"Fault injection: crashing at {phase} of transaction "
+            f"{transaction_id}"
+        )
+        self.crash()
+
+    def rpc_delay(self, method: str) -> float:
+        """
+        Hook: get the delay to apply to a call into this node.
+
+        Args:
+            method: The called method
+
+        Returns:
+            Seconds to hold the call (0 for none)
+        """
+        with self._lock:
+            delay = self._delays.get(method)
+            if delay is None:
+                return 0.0
+            seconds, count = delay
+            if count == 1:
+                del self._delays[method]
+            elif count:
+                delay[1] = count - 1
+        return seconds
+
+    def drop_heartbeat(self) -> bool:
+        """
+        Hook: check whether to drop a heartbeat sent to this node.
+
+        Returns:
+            bool: True if the heartbeat must fail
+        """
+        with self._lock:
+            if time.time() < self._drop_heartbeats_until:
+                return True
+            if self._dropped_heartbeats > 0:
+                self._dropped_heartbeats -= 1
+                return True
+            return False
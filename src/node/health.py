@@ -0,0 +1,178 @@
+"""
+Health and Readiness Checks
+
+Answers the probes orchestrators and load balancers send to a node,
+served next to /metrics by MetricsServer:
+
+- GET /healthz (liveness): 200 while the process can answer requests at
+  all; a failing liveness probe means the node should be restarted
+- GET /readyz (readiness): 200 only once the node is fully initialized
+  and able to serve clients, 503 otherwise, so clients are routed only to
+  ready nodes while the node itself keeps running
+
+Readiness is the conjunction of its dependency checks:
+
+- startup: the node finished starting (bootstrap with the cluster done)
+- xmlrpc: the XML-RPC server peers call is running
+- websocket: the WebSocket listener is accepting clients (not while
+  draining before shutdown)
+- storage: the storage backend answers reads (skipped without storage)
+- peers: at least min_ready_peers peers are alive according to the
+  failure detector
+
+Each check reports whether it passed and a short reason, so a failing
+probe shows which dependency is not up.
+"""
+
+import logging
+import time
+from typing import Callable, Dict, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+HEALTHZ_PATH = "/healthz"
+READYZ_PATH = "/readyz"
+
+
+class HealthChecker:
+    """
+    Liveness and readiness of this node, from its components.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        xmlrpc_server=None,
+        ws_server=None,
+        storage=None,
+        failure_detector=None,
+        min_ready_peers: int = 0,
+    ):
+        """
+        Initialize the checker.
+
+        Args:
+            node_id: ID of this node
+            xmlrpc_server: The node's XMLRPCServer
+            ws_server: The node's WebSocketServer
+            storage: Optional Storage backend (None for in-memory nodes)
+            failure_detector: Optional FailureDetector deciding which
+                peers are alive
+            min_ready_peers: Alive peers required to be ready
+        """
+        self.node_id = node_id
+        self.xmlrpc_server = xmlrpc_server
+        self.ws_server = ws_server
+        self.storage = storage
+        self.failure_detector = failure_detector
+        self.min_ready_peers = min_ready_peers
+        self.started_at = time.time()
+        self._started = False
+        self._checks: Dict[str, Callable[[], Tuple[bool, str]]] = {
+            "startup": self._check_startup,
+            "xmlrpc": self._check_xmlrpc,
+            "websocket": self._check_websocket,
+            "storage": self._check_storage,
+            "peers": self._check_peers,
+        }
+
+    def mark_started(self) -> None:
+        """Record that the node finished starting."""
+        self._started = True
+        logger.info(f"Node {self.node_id} is ready to serve clients")
+
+    def liveness(self) -> Dict:
+        """
+        Check that the node is alive.
+
+        Returns:
+            dict: {'status': 'ok', 'node_id': str, 'uptime': seconds}
+        """
+        return {
+            "status": "ok",
+            "node_id": self.node_id,
+            "uptime": round(time.time() - self.started_at, 3),
+        }
+
+    def readiness(self) -> Dict:
+        """
+        Run every dependency check.
+
+        Returns:
+            dict: {'ready': bool, 'node_id': str, 'checks': {name: {'ok':
+            bool, 'detail': str}}}
+        """
+        checks = {}
+        for name, check in self._checks.items():
+            try:
+                ok, detail = check()
+            except Exception as e:
+                ok, detail = False, f"check failed: {e}"
+            checks[name] = {"ok": ok, "detail": detail}
+        ready = all(check["ok"] for check in checks.values())
+        if not ready:
+            failing = [name for name in checks if not checks[name]["ok"]]
+            logger.debug(f"Not ready, failing checks: {', '.join(failing)}")
+        return {"ready": ready, "node_id": self.node_id, "checks": checks}
+
+    def _check_startup(self) -> Tuple[bool, str]:
+        if not self._started:
+            return False, "starting"
+        return True, "started"
+
+    def _check_xmlrpc(self) -> Tuple[bool, str]:
+        server = self.xmlrpc_server
+        if server is None or server.server is None:
+            return False, "not started"
+        thread = server.server_thread
+        if thread is not None and not thread.is_alive():
+            return False, "stopped"
+        return True, f"serving at {server.node_address}"
+
+    def _check_websocket(self) -> Tuple[bool, str]:
+        server = self.ws_server
+        if server is None or server.server is None:
+            return False, "not started"
+        if server.draining:
+            return False, "draining"
+        is_serving = getattr(server.server, "is_serving", None)
+        if is_serving is not None and not is_serving():
+            return False, "closed"
+        return True, f"listening on port {server.port}"
+
+    def _check_storage(self) -> Tuple[bool, str]:
+        if self.storage is None:
+            return True, "in memory"
+        rooms = len(self.storage.room_ids())
+        return True, f"{type(self.storage).__name__}, {rooms} rooms"
+
+    def _check_peers(self) -> Tuple[bool, str]:
+        alive = 0
+        if self.failure_detector is not None:
+            alive = len(self.failure_detector.alive_peers())
+        detail = f"{alive} alive, {self.min_ready_peers} required"
+        return alive >= self.min_ready_peers, detail
+
+
+def probe_response(
+    health: Optional[HealthChecker], path: str
+) -> Optional[Tuple[int, Dict]]:
+    """
+    Answer a probe request.
+
+    Args:
+        health: The node's HealthChecker
+        path: Request path, without the query string
+
+    Returns:
+        (HTTP status, JSON body) for /healthz and /readyz, or None for
+        other paths
+    """
+    if health is None:
+        return None
+    if path == HEALTHZ_PATH:
+        return 200, health.liveness()
+    if path == READYZ_PATH:
+        result = health.readiness()
+        return (200 if result["ready"] else 503), result
+    return None
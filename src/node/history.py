@@ -0,0 +1,88 @@
+"""
+Room Message History
+
+Lets clients page through what was said in a room before they joined.
+Pages are addressed with cursors: the ID of the message to read before or
+after. Without a cursor the newest page is returned. Every page is in
+sequence order, oldest first, and says whether there are more messages in
+the direction it was read.
+
+The room's administrator node serves history from its write-ahead log when
+it has one, and from its in-memory message buffer otherwise. Other nodes
+forward get_history to the administrator with the get_room_history RPC.
+"""
+
+from typing import Any, Dict, List, Optional
+
+# History configuration
+HISTORY_PAGE_SIZE = 50  # messages per page when the client gives no limit
+MAX_HISTORY_PAGE_SIZE = 200  # largest page a client may ask for
+
+
+def paginate_history(
+    messages: List[Dict[str, Any]],
+    before: Optional[str] = None,
+    after: Optional[str] = None,
+    limit: int = HISTORY_PAGE_SIZE,
+) -> Dict[str, Any]:
+    """
+    Get one page of a room's messages.
+
+    Args:
+        messages: The room's messages in sequence order
+        before: Return the messages just before the message with this ID
+        after: Return the messages just after the message with this ID
+        limit: Maximum number of messages in the page
+
+    Returns:
+        dict: {'success': True, 'messages': list, 'has_more': bool} or an
+        error with 'error' and 'error_code'
+    """
+    if before and after:
+        return {
+            "success": False,
+            "error": "Give either before or after, not both",
+            "error_code": "INVALID_REQUEST",
+        }
+    if (
+        isinstance(limit, bool)
+        or not isinstance(limit, int)
+        or not 1 <= limit <= MAX_HISTORY_PAGE_SIZE
+    ):
+        return {
+            "success": False,
+            "error": f"limit must be between 1 and {MAX_HISTORY_PAGE_SIZE}",
+            "error_code": "INVALID_REQUEST",
+        }
+
+    cursor = before or after
+    start, end = max(len(messages) - limit, 0), len(messages)
+    if cursor:
+        index = _find_index(messages, cursor)
+        if index is None:
+            return {
+                "success": False,
+                "error": "Cursor message not found in room history",
+                "error_code": "MESSAGE_NOT_FOUND",
+            }
+        if before:
+            start, end = max(index - limit, 0), index
+        else:
+            start, end = index + 1, min(index + 1 + limit, len(messages))
+
+    has_more = end < len(messages) if after else start > 0
+    return {
+        "success": True,
+        "messages": messages[start:end],
+        "has_more": has_more,
+    }
+
+
+def _find_index(
+    messages: List[Dict[str, Any]], message_id: str
+) -> Optional[int]:
+    """Find the position of a message in the history, or None."""
+    for index in range(len(messages) - 1, -1, -1):
+        if messages[index].get("message_id") == message_id:
+            return index
+    return None
@@ -0,0 +1,144 @@
+"""
+Private Room Invitations
+
+Private rooms are hidden from room listings and global discovery, and can
+only be joined with an invite token. The room's creator or any current
+member can create an invite; the admin node of the room stores it until it
+is redeemed, revoked or expires.
+
+An invite token is "<room_id>.<secret>", so the invitee's node can find
+the room's admin node from the token alone. Invites are single use and may
+be restricted to one username.
+"""
+
+import secrets
+from dataclasses import dataclass
+from datetime import datetime, timedelta, timezone
+from typing import Any, Dict, Optional
+
+# Invitation configuration
+INVITE_TTL = 86400  # seconds (24 hours) an invite stays valid
+
+
+class InviteError(Exception):
+    """An invite could not be created, revoked or redeemed."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVITE_EXPIRED")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+@dataclass
+class RoomInvite:
+    """
+    An invitation to a private room.
+
+    Attributes:
+        token: The invite token handed to the invitee
+        room_id: The room the invite is for
+        inviter: Username of the member who created the invite
+        invitee: Username allowed to redeem it (None for anyone)
+        created_at: ISO 8601 timestamp when the invite was created
+        expires_at: ISO 8601 timestamp after which it is no longer valid
+    """
+
+    token: str
+    room_id: str
+    inviter: str
+    invitee: Optional[str] = None
+    created_at: str = ""
+    expires_at: str = ""
+
+    def __post_init__(self):
+        """Initialize the timestamps if not set."""
+        now = datetime.now(timezone.utc)
+        if not self.created_at:
+            self.created_at = now.isoformat()
+        if not self.expires_at:
+            self.expires_at = (now + timedelta(seconds=INVITE_TTL)).isoformat()
+
+    def is_expired(self) -> bool:
+        """Check whether the invite has expired."""
+        try:
+            expires_at = datetime.fromisoformat(self.expires_at)
+        except ValueError:
+            return True
+        return datetime.now(timezone.utc) >= expires_at
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return {
+            "token": self.token,
+            "room_id": self.room_id,
+            "inviter": self.inviter,
+            "invitee": self.invitee,
+            "created_at": self.created_at,
+            "expires_at": self.expires_at,
+        }
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "RoomInvite":
+        """Create an invite from a dictionary (e.g., a room handoff)."""
+        return cls(
+            token=data["token"],
+            room_id=data["room_id"],
+            inviter=data.get("inviter", ""),
+            invitee=data.get("invitee"),
+            created_at=data.get("created_at", ""),
+            expires_at=data.get("expires_at", ""),
+        )
+
+
+def create_invite(
+    room_id: str,
+    inviter: str,
+    invitee: Optional[str] = None,
+    ttl: float = INVITE_TTL,
+) -> RoomInvite:
+    """
+    Create a new invite with a random token.
+
+    Args:
+        room_id: The room the invite is for
+        inviter: Username of the member creating it
+        invitee: Optional username allowed to redeem it
+        ttl: Seconds the invite stays valid
+
+    Returns:
+        The new RoomInvite
+    """
+    now = datetime.now(timezone.utc)
+    return RoomInvite(
+        token=f"{room_id}.{secrets.token_urlsafe(16)}",
+        room_id=room_id,
+        inviter=inviter,
+        invitee=invitee or None,
+        created_at=now.isoformat(),
+        expires_at=(now + timedelta(seconds=ttl)).isoformat(),
+    )
+
+
+def parse_invite_token(token: str) -> str:
+    """
+    Get the room ID an invite token is for.
+
+    Args:
+        token: The invite token
+
+    Returns:
+        The room ID
+
+    Raises:
+        InviteError: If the token is malformed
+    """
+    room_id, sep, secret = (token or "").rpartition(".")
+    if not sep or not room_id or not secret:
+        raise InviteError("Malformed invite token", "INVALID_INVITE")
+    return room_id
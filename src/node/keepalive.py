@@ -0,0 +1,103 @@
+"""
+Client Keepalive
+
+A client whose network went away without closing its TCP connection (a
+half-open connection) looks connected until the operating system gives
+up on it, which can take hours; meanwhile its user stays online and in
+its rooms. To notice such ghosts, the node sends every client a ping
+event each keepalive interval, which clients answer with a pong command.
+Any message from the client counts as a sign of life, not only pongs.
+
+A client silent for the keepalive timeout is stale: its user is marked
+offline (unless connected elsewhere) and its typing indicators stopped,
+but the connection is kept in case the client was only suspended. If it
+speaks again within the grace period it is live again and marked online;
+otherwise the connection is closed with KEEPALIVE_CLOSE_CODE and cleaned
+up like any disconnect (the user's session is held if an offline queue
+is configured, else the user leaves their rooms).
+"""
+
+import logging
+import time
+from typing import Callable, List, Tuple
+
+from .connection_registry import ClientConnection
+
+logger = logging.getLogger(__name__)
+
+# Keepalive configuration
+KEEPALIVE_INTERVAL = 25.0  # seconds between pings (0 disables keepalive)
+KEEPALIVE_TIMEOUT = 60.0  # seconds of silence before a client is stale
+KEEPALIVE_GRACE = 30.0  # seconds a stale client has before it is closed
+
+# Close code of connections closed for not answering pings
+KEEPALIVE_CLOSE_CODE = 4000
+
+
+class KeepaliveMonitor:
+    """
+    Decides which client connections are stale or must be closed.
+    """
+
+    def __init__(
+        self,
+        interval: float = KEEPALIVE_INTERVAL,
+        timeout: float = KEEPALIVE_TIMEOUT,
+        grace: float = KEEPALIVE_GRACE,
+        clock: Callable[[], float] = time.monotonic,
+    ):
+        """
+        Initialize the monitor.
+
+        Args:
+            interval: Seconds between pings
+            timeout: Seconds without a message before a client is stale
+            grace: Seconds a stale client is kept before it is closed
+            clock: Function returning the current time in seconds
+        """
+        self.interval = interval
+        self.timeout = timeout
+        self.grace = grace
+        self.clock = clock
+
+    def touch(self, connection: ClientConnection) -> bool:
+        """
+        Record a sign of life from a client.
+
+        Args:
+            connection: The client's connection
+
+        Returns:
+            bool: True if the client was stale and is live again
+        """
+        connection.last_seen = self.clock()
+        if connection.stale_since is None:
+            return False
+        connection.stale_since = None
+        return True
+
+    def check(
+        self, connections: List[ClientConnection]
+    ) -> Tuple[List[ClientConnection], List[ClientConnection]]:
+        """
+        Find the clients that became stale and those to close.
+
+        Connections that became stale are marked with the time.
+
+        Args:
+            connections: Every connected client
+
+        Returns:
+            (clients that just became stale, clients stale for longer
+            than the grace period)
+        """
+        now = self.clock()
+        stale, expired = [], []
+        for connection in connections:
+            if connection.stale_since is not None:
+                if now - connection.stale_since >= self.grace:
+                    expired.append(connection)
+            elif now - connection.last_seen >= self.timeout:
+                connection.stale_since = now
+                stale.append(connection)
+        return stale, expired
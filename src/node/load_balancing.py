@@ -0,0 +1,224 @@
+"""
+Client Load Balancing
+
+Every node gossips its load to its peers: how many WebSocket clients are
+connected to it, how many it takes before it redirects new ones (its
+redirect threshold) and the WebSocket URL clients reach it at. When a
+node's clients reach its threshold, it answers a new connection with a
+redirect frame naming the least-loaded peer and closes it, and the
+client reconnects there.
+
+Clients are only sent to peers with fewer clients than this node and
+room below their own threshold, so overloaded nodes never bounce a
+client back and forth. If no peer qualifies, the client is accepted.
+
+A node stamps its load with the time it measured it and the newest entry
+wins. A peer whose load wasn't refreshed within LOAD_TTL seconds (e.g.
+because it died) is never picked.
+"""
+
+import logging
+import random
+import threading
+import time
+from dataclasses import asdict, dataclass, replace
+from typing import Any, Dict, List, Optional
+
+from .room_directory import GOSSIP_FANOUT
+
+logger = logging.getLogger(__name__)
+
+# Load balancing configuration
+LOAD_TTL = 30  # seconds a peer's load is used without a refresh
+
+
+@dataclass
+class NodeLoad:
+    """
+    Load of one node.
+
+    Attributes:
+        node_id: The node
+        ws_url: WebSocket URL clients connect to the node at
+        connections: Connected WebSocket clients
+        capacity: Clients at which the node redirects new ones (0 if it
+            never does)
+        updated_at: Unix time the node measured its load
+    """
+
+    node_id: str
+    ws_url: str
+    connections: int = 0
+    capacity: int = 0
+    updated_at: float = 0.0
+
+    def has_room(self) -> bool:
+        """Check whether the node accepts new clients without redirecting."""
+        return not self.capacity or self.connections < self.capacity
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for gossiping."""
+        return asdict(self)
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "NodeLoad":
+        """Create a NodeLoad from a gossiped dictionary."""
+        return cls(
+            node_id=data["node_id"],
+            ws_url=data["ws_url"],
+            connections=int(data["connections"]),
+            capacity=int(data["capacity"]),
+            updated_at=float(data["updated_at"]),
+        )
+
+
+class LoadBalancer:
+    """
+    Loads of the cluster's nodes, and where to redirect new clients.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        ws_url: str,
+        threshold: int = 0,
+        ttl: float = LOAD_TTL,
+    ):
+        """
+        Initialize the load table with this node's entry.
+
+        Args:
+            node_id: ID of this node
+            ws_url: WebSocket URL clients connect to this node at
+            threshold: Connected clients at which new clients are
+                redirected (0 never redirects)
+            ttl: Seconds a peer's load is used without a refresh
+        """
+        self.node_id = node_id
+        self.threshold = threshold
+        self.ttl = ttl
+        self._lock = threading.Lock()
+        self._loads: Dict[str, NodeLoad] = {
+            node_id: NodeLoad(node_id, ws_url, 0, threshold, time.time())
+        }
+        # Maps node_id -> time.monotonic() its load was last refreshed
+        self._refreshed: Dict[str, float] = {}
+
+    def update_local(self, connections: int) -> None:
+        """
+        Record this node's current load.
+
+        Args:
+            connections: Connected WebSocket clients
+        """
+        with self._lock:
+            self._loads[self.node_id] = replace(
+                self._loads[self.node_id],
+                connections=connections,
+                updated_at=time.time(),
+            )
+
+    def merge(self, entries: List[Dict[str, Any]]) -> int:
+        """
+        Merge loads received from a peer.
+
+        Args:
+            entries: NodeLoad dicts from a peer's table
+
+        Returns:
+            Number of entries that were added or replaced
+        """
+        updated = 0
+        now = time.monotonic()
+        with self._lock:
+            for data in entries:
+                try:
+                    incoming = NodeLoad.from_dict(data)
+                except (KeyError, TypeError, ValueError) as e:
+                    logger.warning(f"Ignoring malformed node load: {e}")
+                    continue
+
+                if incoming.node_id == self.node_id:
+                    continue
+                current = self._loads.get(incoming.node_id)
+                if current and incoming.updated_at <= current.updated_at:
+                    continue
+                self._loads[incoming.node_id] = incoming
+                self._refreshed[incoming.node_id] = now
+                updated += 1
+        return updated
+
+    def get(self, node_id: str) -> Optional[NodeLoad]:
+        """Get a copy of a node's load, or None if it is unknown."""
+        with self._lock:
+            load = self._loads.get(node_id)
+            return replace(load) if load else None
+
+    def get_entries(self) -> List[Dict[str, Any]]:
+        """Get all loads for gossiping."""
+        with self._lock:
+            return [load.to_dict() for load in self._loads.values()]
+
+    def redirect_target(self, connections: int) -> Optional[NodeLoad]:
+        """
+        Pick the peer to redirect a new client to, if this node is full.
+
+        Args:
+            connections: Clients connected to this node
+
+        Returns:
+            The fresh peer with the fewest clients, if this node reached
+            its threshold and that peer has fewer clients and room below
+            its own threshold; otherwise None
+        """
+        if not self.threshold or connections < self.threshold:
+            return None
+        now = time.monotonic()
+        with self._lock:
+            candidates = [
+                load
+                for node_id, load in self._loads.items()
+                if node_id in self._refreshed
+                and now - self._refreshed[node_id] <= self.ttl
+                and load.has_room()
+                and load.connections < connections
+            ]
+            if not candidates:
+                return None
+            target = min(
+                candidates, key=lambda load: (load.connections, load.node_id)
+            )
+            return replace(target)
+
+
+def load_gossip_round(
+    balancer: LoadBalancer,
+    peer_registry,
+    fanout: int = GOSSIP_FANOUT,
+) -> List[str]:
+    """
+    Run one push-pull gossip round of the load table.
+
+    Args:
+        balancer: The local load balancer
+        peer_registry: PeerRegistry used to reach peers
+        fanout: Number of peers to contact
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    peers = list(peer_registry.list_peers().keys())
+    if not peers:
+        return []
+
+    reached = []
+    for peer_id in random.sample(peers, min(fanout, len(peers))):
+        try:
+            remote_entries = peer_registry.call_peer(
+                peer_id, "exchange_load", balancer.get_entries()
+            )
+            balancer.merge(remote_entries)
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Load gossip with {peer_id} failed: {e}")
+    return reached
@@ -0,0 +1,322 @@
+"""
+Structured Logging and Correlation IDs
+
+Every log line carries the node ID and, while a request is being handled,
+the request's correlation ID, room ID and user. The WebSocket server opens
+a log context for each client message, taking the client's correlation_id
+or generating one. XML-RPC calls made while the context is open send it
+along as HTTP headers, and the receiving node's XML-RPC server opens the
+same context for the call, so one message flow can be followed across
+nodes by searching the logs of all nodes for its correlation ID.
+
+The context is held in context variables: it follows asyncio tasks and
+the threads of the XML-RPC server, and is copied into executor threads
+with contextvars.copy_context().
+
+The same HTTP headers carry the trace context of the current span (see
+tracing.py), and every call made through this module's ServerProxy is
+recorded as a client span. A transport factory installed with
+set_transport_factory replaces the transport of every such proxy (see
+simulation.py).
+
+Lines are written as key=value pairs ("text") or as one JSON object per
+line ("json").
+"""
+
+import contextvars
+import json
+import logging
+import sys
+import uuid
+import xmlrpc.client
+from contextlib import contextmanager
+from datetime import datetime, timezone
+from typing import Callable, Dict, Iterator, Optional
+
+from .tls import client_context
+from .tracing import CLIENT, start_span, traceparent_headers
+
+# Log formats
+TEXT = "text"
+JSON = "json"
+LOG_FORMATS = (TEXT, JSON)
+
+# HTTP headers carrying the log context on XML-RPC calls
+CORRELATION_HEADER = "X-Correlation-ID"
+ROOM_HEADER = "X-Room-ID"
+USER_HEADER = "X-User-ID"
+
+# Log record attribute -> context variable
+_correlation_id = contextvars.ContextVar("correlation_id", default=None)
+_room_id = contextvars.ContextVar("room_id", default=None)
+_user_id = contextvars.ContextVar("user_id", default=None)
+_CONTEXT_VARS = {
+    "correlation_id": _correlation_id,
+    "room_id": _room_id,
+    "user_id": _user_id,
+}
+_HEADERS = {
+    "correlation_id": CORRELATION_HEADER,
+    "room_id": ROOM_HEADER,
+    "user_id": USER_HEADER,
+}
+
+# Record attributes every formatter knows about
+# Replaces the transport of every ServerProxy while set
+_transport_factory: Optional[Callable] = None
+
+_STANDARD_ATTRS = set(logging.LogRecord("", 0, "", 0, "", None, None).__dict__)
+_STANDARD_ATTRS.update({"message", "asctime", "node_id"}, _CONTEXT_VARS)
+
+
+def new_correlation_id() -> str:
+    """Generate a correlation ID for a request."""
+    return uuid.uuid4().hex[:16]
+
+
+def current_context() -> Dict[str, str]:
+    """
+    Get the log context of the current task or thread.
+
+    Returns:
+        Dict with the correlation_id, room_id and user_id that are set
+    """
+    return {
+        name: var.get()
+        for name, var in _CONTEXT_VARS.items()
+        if var.get() is not None
+    }
+
+
+@contextmanager
+def log_context(
+    correlation_id: Optional[str] = None,
+    room_id: Optional[str] = None,
+    user_id: Optional[str] = None,
+) -> Iterator[None]:
+    """
+    Tag the log lines written inside the block.
+
+    Values that are None keep the surrounding context's value, so a
+    handler can add the room ID to a request's context without losing its
+    correlation ID.
+
+    Args:
+        correlation_id: ID shared by every log line of one request
+        room_id: Room the request is about
+        user_id: User the request was made by
+    """
+    values = {
+        "correlation_id": correlation_id,
+        "room_id": room_id,
+        "user_id": user_id,
+    }
+    tokens = [
+        (_CONTEXT_VARS[name], _CONTEXT_VARS[name].set(str(value)))
+        for name, value in values.items()
+        if value
+    ]
+    try:
+        yield
+    finally:
+        for var, token in reversed(tokens):
+            var.reset(token)
+
+
+def context_headers() -> Dict[str, str]:
+    """Get the HTTP headers that carry the current log and trace context."""
+    headers = {
+        _HEADERS[name]: value for name, value in current_context().items()
+    }
+    headers.update(traceparent_headers())
+    return headers
+
+
+def context_from_headers(headers) -> Dict[str, Optional[str]]:
+    """
+    Read a log context sent by context_headers.
+
+    A request without a correlation ID gets a new one.
+
+    Args:
+        headers: The request's HTTP headers (e.g., an http.client message)
+
+    Returns:
+        Keyword arguments for log_context
+    """
+    context = {name: headers.get(header) for name, header in _HEADERS.items()}
+    context["correlation_id"] = (
+        context["correlation_id"] or new_correlation_id()
+    )
+    return context
+
+
+class CorrelationTransport(xmlrpc.client.Transport):
+    """XML-RPC transport that sends the log context with each call."""
+
+    def send_headers(self, connection, headers):
+        """Send the request headers, adding the log context headers."""
+        headers = list(headers) + list(context_headers().items())
+        super().send_headers(connection, headers)
+
+
+class CorrelationSafeTransport(xmlrpc.client.SafeTransport):
+    """HTTPS XML-RPC transport that sends the log context with each call."""
+
+    def send_headers(self, connection, headers):
+        """Send the request headers, adding the log context headers."""
+        headers = list(headers) + list(context_headers().items())
+        super().send_headers(connection, headers)
+
+
+def set_transport_factory(factory: Optional[Callable]) -> None:
+    """
+    Replace the transport of every ServerProxy created from now on.
+
+    Args:
+        factory: Function(uri, transport) returning the transport to use,
+            given the address and the transport the proxy would have used
+            (None if the default); None restores the normal transports
+    """
+    global _transport_factory
+    _transport_factory = factory
+
+
+class ServerProxy(xmlrpc.client.ServerProxy):
+    """ServerProxy whose calls carry the log context and are traced."""
+
+    def __init__(self, uri: str, transport=None, **kwargs):
+        """
+        Initialize the proxy.
+
+        Args:
+            uri: XML-RPC address (e.g., "http://node2:9090")
+            transport: Optional transport; defaults to one that sends the
+                log context headers, using the node's TLS client context
+                for https:// addresses
+            **kwargs: Other ServerProxy arguments (e.g., allow_none)
+        """
+        if transport is None:
+            if uri.startswith("https://"):
+                transport = CorrelationSafeTransport(
+                    context=client_context()
+                )
+            else:
+                transport = CorrelationTransport()
+        if _transport_factory is not None:
+            transport = _transport_factory(uri, transport)
+        super().__init__(uri, transport=transport, **kwargs)
+
+    def __getattr__(self, name: str):
+        """Get a remote method that records a client span per call."""
+        method = super().__getattr__(name)
+
+        def call(*args):
+            with start_span(
+                f"NodeService/{name}",
+                CLIENT,
+                {"rpc.system": "xmlrpc", "rpc.method": name},
+            ):
+                return method(*args)
+
+        return call
+
+
+class ContextFilter(logging.Filter):
+    """Add the node ID and the current log context to every record."""
+
+    def __init__(self, node_id: str = ""):
+        """
+        Initialize the filter.
+
+        Args:
+            node_id: ID of this node, added to every record
+        """
+        super().__init__()
+        self.node_id = node_id
+
+    def filter(self, record: logging.LogRecord) -> bool:
+        """Set node_id, correlation_id, room_id and user_id on a record."""
+        record.node_id = self.node_id
+        for name, var in _CONTEXT_VARS.items():
+            if not hasattr(record, name):
+                setattr(record, name, var.get())
+        return True
+
+
+def _record_fields(record: logging.LogRecord) -> Dict[str, object]:
+    """Collect the fields of a record in output order."""
+    created = datetime.fromtimestamp(record.created, timezone.utc)
+    fields = {
+        "time": created.isoformat(timespec="milliseconds"),
+        "level": record.levelname,
+        "logger": record.name,
+        "node": getattr(record, "node_id", None),
+        "correlation_id": getattr(record, "correlation_id", None),
+        "room_id": getattr(record, "room_id", None),
+        "user_id": getattr(record, "user_id", None),
+        "msg": record.getMessage(),
+    }
+    # Fields passed with logger.info(..., extra={...})
+    for name, value in record.__dict__.items():
+        if name not in _STANDARD_ATTRS:
+            fields[name] = value
+    return {
+        name: value for name, value in fields.items() if value not in (None, "")
+    }
+
+
+class TextFormatter(logging.Formatter):
+    """Format records as key=value pairs."""
+
+    def format(self, record: logging.LogRecord) -> str:
+        """Format a record as a single line of key=value pairs."""
+        fields = _record_fields(record)
+        if record.exc_info:
+            fields["error"] = self.formatException(record.exc_info)
+        pairs = []
+        for name, value in fields.items():
+            text = str(value)
+            if not text or any(c in text for c in ' "=\n'):
+                text = json.dumps(text)
+            pairs.append(f"{name}={text}")
+        return " ".join(pairs)
+
+
+class JsonFormatter(logging.Formatter):
+    """Format records as one JSON object per line."""
+
+    def format(self, record: logging.LogRecord) -> str:
+        """Format a record as a JSON object."""
+        fields = _record_fields(record)
+        if record.exc_info:
+            fields["error"] = self.formatException(record.exc_info)
+        return json.dumps(fields, default=str)
+
+
+def configure_logging(
+    node_id: str, level: str = "INFO", log_format: str = TEXT
+) -> logging.Handler:
+    """
+    Replace the root logger's handlers with a structured log handler.
+
+    Args:
+        node_id: ID of this node, added to every line
+        level: Logging level name
+        log_format: One of LOG_FORMATS
+
+    Returns:
+        The installed handler
+    """
+    handler = logging.StreamHandler(sys.stderr)
+    handler.addFilter(ContextFilter(node_id))
+    if log_format == JSON:
+        handler.setFormatter(JsonFormatter())
+    else:
+        handler.setFormatter(TextFormatter())
+    root = logging.getLogger()
+    for existing in list(root.handlers):
+        root.removeHandler(existing)
+    root.addHandler(handler)
+    root.setLevel(level.upper())
+    return handler
@@ -5,24 +5,130 @@ Distributed Chat Node Server
 A distributed peer-to-peer chat system node server.
 """
 
+import argparse
 import logging
+import os
 import sys
 import asyncio
-import os
-from concurrent.futures import ThreadPoolExecutor
 from datetime import datetime, timezone
-from xmlrpc.client import ServerProxy
+from typing import Optional
 
 from .room_state import (
     RoomStateManager,
-    HEARTBEAT_INTERVAL,
-    HEARTBEAT_TIMEOUT,
+    NodeStatus,
     INACTIVITY_TIMEOUT,
     CLEANUP_INTERVAL,
 )
 from .websocket_server import WebSocketServer
 from .xmlrpc_server import XMLRPCServer
 from .peer_registry import PeerRegistry
+from .room_directory import RoomDirectory, GOSSIP_INTERVAL, gossip_round
+from .anti_entropy import ANTI_ENTROPY_INTERVAL, AntiEntropy
+from .presence import (
+    PRESENCE_PUBLISH_INTERVAL,
+    PresenceDirectory,
+    presence_gossip_round,
+    push_presence_changes,
+)
+from .profiles import ProfileRegistry, profile_gossip_round
+from .push import (
+    PUSH_DELIVERY_INTERVAL,
+    PushDispatcher,
+    PushGatewayNotifier,
+    PushTokenRegistry,
+    push_token_gossip_round,
+)
+from .direct_messages import DM_RETRY_INTERVAL
+from .dispatch import KeyedWorkerPool
+from .message_streams import MessageStreams
+from .peer_connections import PeerConnections
+from .clock_skew import ClockSkewMonitor
+from .offline_queue import OFFLINE_EXPIRY_INTERVAL, OfflineQueue
+from .orphans import OrphanReaper
+from .auth import AuthManager
+from .membership import MEMBERSHIP_INTERVAL, ClusterMembership
+from .compaction import Compactor, parse_retention, parse_room_retention
+from .content_filters import (
+    FilterRegistry,
+    load_filter_plugins,
+    parse_filter_rules,
+)
+from .retention import RetentionReaper
+from .ephemeral import EPHEMERAL_SWEEP_INTERVAL, EphemeralReaper
+from .member_set import TOMBSTONE_PURGE_INTERVAL
+from .scheduled import SCHEDULE_INTERVAL
+from .partition import RECONCILE_INTERVAL, PartitionManager
+from .archive import ARCHIVE_DIRNAME, ArchiveStore
+from .attachments import (
+    BLOB_DIRNAME,
+    UPLOAD_EXPIRY_INTERVAL,
+    AttachmentManager,
+    BlobStore,
+)
+from .egress import EgressPolicy
+from .webhooks import WEBHOOK_DELIVERY_INTERVAL, WebhookDispatcher
+from .bots import BotRegistry
+from .service_accounts import ServiceAccountRegistry
+from .routing import REGION_TAG, LatencyRouter
+from .bridges import BRIDGE_POLL_INTERVAL, BridgeManager
+from .raft import (
+    RAFT,
+    RAFT_FILENAME,
+    RAFT_TICK_INTERVAL,
+    RaftRoomRegistry,
+    RaftStore,
+)
+from .discovery import (
+    ANNOUNCE_INTERVAL,
+    AnnouncementProtocol,
+    PeerDiscovery,
+    node_capabilities,
+)
+from .config import (
+    ConfigError,
+    NodeConfig,
+    format_config,
+    load_config,
+    parse_args,
+)
+from .failover import ReplicaStore, RoomFailover
+from .sharding import REBALANCE_INTERVAL, RoomSharding
+from .placement import PLACEMENT_INTERVAL, RoomPlacement, parse_tags
+from .migration import RoomMigrator
+from .load_balancing import LoadBalancer, load_gossip_round
+from .replication import ReplicationManager, CATCH_UP_INTERVAL
+from .snapshot import SnapshotSender
+from .failure_detector import (
+    FailureDetector,
+    MembershipEvent,
+    PeerState,
+    PROBE_INTERVAL,
+)
+from .faults import FaultInjector
+from .health import HealthChecker
+from .keepalive import KeepaliveMonitor
+from .stats import ClusterStats, stats_gossip_round
+from .log_context import configure_logging
+from .metrics import MetricsServer, NodeMetrics
+from .admin_api import AdminAPI, AdminServer
+from .audit import AUDIT_FILENAME, AuditLog
+from .shutdown import RECONNECT_DELAY, drain_node, install_signal_handlers
+from .rate_limit import RateLimiter, parse_rate_limits
+from .tls import TLSManager, configure_tls
+from .config_reload import ConfigReloader, install_reload_handler
+from .tracing import OTLPExporter, configure_tracing
+from .total_order import SequenceBuffer, RETRANSMIT_TIMEOUT
+from .tpc import (
+    TIMEOUT_CHECK_INTERVAL,
+    TPC_FILENAME,
+    TPCCoordinator,
+    TPCParticipant,
+    TransactionStore,
+)
+from .vector_clock import CausalBuffer, CAUSAL_DELIVERY_TIMEOUT
+from .wal import MessageLog, FSYNC_INTERVAL
+from .storage import SQLITE, WAL, Storage
+from .sqlite_storage import SQLITE_FILENAME, SQLiteStorage
 from .schemas.events import create_member_left_event
 from .utils.broadcast import broadcast_to_peers
 
@@ -34,46 +140,445 @@ logging.basicConfig(
 
 logger = logging.getLogger(__name__)
 
+# Node health status recorded for each failure detector state
+NODE_STATUS_BY_PEER_STATE = {
+    PeerState.ALIVE: NodeStatus.HEALTHY,
+    PeerState.SUSPECT: NodeStatus.DEGRADED,
+    PeerState.DEAD: NodeStatus.FAILED,
+}
+
+
+def open_storage(config: NodeConfig) -> Optional[Storage]:
+    """
+    Open the storage backend selected in the configuration.
+
+    Args:
+        config: Validated node configuration
+
+    Returns:
+        The Storage, or None if state is kept in memory only
+    """
+    if config.storage_backend == SQLITE:
+        return SQLiteStorage(
+            os.path.join(config.data_dir, SQLITE_FILENAME), config.wal_fsync
+        )
+    if config.storage_backend == WAL and config.data_dir:
+        return MessageLog(
+            config.data_dir, config.wal_fsync, config.wal_segment_size
+        )
+    return None
+
 
 async def run_server(
-    node_id: str,
-    ws_host: str,
-    ws_port: int,
-    xmlrpc_host: str,
-    xmlrpc_port: int,
-    xmlrpc_address: str,
-    peer_nodes: dict,
+    config: NodeConfig, args: Optional[argparse.Namespace] = None
 ):
     """
     Run the node server with WebSocket and XML-RPC support.
 
     Args:
-        node_id: Unique identifier for this node
-        ws_host: WebSocket host address to bind to
-        ws_port: WebSocket port to listen on
-        xmlrpc_host: XML-RPC host address to bind to
-        xmlrpc_port: XML-RPC port to listen on
-        xmlrpc_address: Full XML-RPC address of this node
-        peer_nodes: Dictionary of peer nodes {node_id: xmlrpc_address}
+        config: Validated node configuration
+        args: Flags the configuration was loaded with, used again when it
+            is reloaded
     """
-    # Initialize room state manager
-    room_manager = RoomStateManager(node_id)
+    # Open the storage backend and recover rooms from a previous run
+    message_log = open_storage(config)
+
+    # Record privileged actions in the append-only audit log
+    audit_path = None
+    if config.data_dir:
+        audit_path = os.path.join(config.data_dir, AUDIT_FILENAME)
+    audit_log = AuditLog(audit_path, config.node_id)
+
+    # Initialize room state manager, delivering room events to webhooks,
+    # filtering messages with the configured rules and plugins, and
+    # keeping archived rooms in the data directory. Webhooks (and bridges,
+    # below) can't reach internal addresses the operator hasn't allowed
+    egress = EgressPolicy(config.egress_allow)
+    webhooks = WebhookDispatcher(egress=egress) if config.webhooks else None
+    archive = ArchiveStore(
+        os.path.join(config.data_dir, ARCHIVE_DIRNAME)
+        if config.data_dir
+        else None
+    )
+    content_filters = FilterRegistry(
+        load_filter_plugins(config.filter_plugins),
+        parse_filter_rules(config.filter_rules),
+    )
+    room_manager = RoomStateManager(
+        config.node_id,
+        message_log,
+        webhooks,
+        config.bridges,
+        audit_log,
+        content_filters,
+        archive,
+    )
+    if message_log:
+        recovered = room_manager.recover_rooms()
+        logger.info(f"Recovered {recovered} rooms from {config.data_dir}")
+    compactor = Compactor(
+        room_manager,
+        parse_retention(config.retention),
+        parse_room_retention(config.room_retention),
+    )
+
+    # Export traces of client requests to the OTLP collector
+    span_exporter = None
+    if config.tracing_endpoint:
+        span_exporter = OTLPExporter(
+            config.tracing_endpoint,
+            config.tracing_service_name,
+            config.node_id,
+        )
+        span_exporter.start()
+        configure_tracing(span_exporter, config.tracing_sample_ratio)
+
+    # Serve wss:// and https://, with mutual TLS between nodes if a CA is set
+    tls = None
+    if config.tls_cert_file:
+        tls = TLSManager(
+            config.tls_cert_file, config.tls_key_file, config.tls_ca_file
+        )
+        configure_tls(tls)
+
+    # Collect the metrics served at /metrics
+    metrics = NodeMetrics()
+
+    # Bodies sent to peers and messages sent to clients are compressed
+    # from this size on, if enabled
+    rpc_compression = ws_compression = None
+    if config.rpc_compression:
+        rpc_compression = config.compression_threshold
+    if config.ws_compression:
+        ws_compression = config.compression_threshold
 
     # Initialize peer registry
-    peer_registry = PeerRegistry(node_id)
-    for peer_id, peer_addr in peer_nodes.items():
+    peer_registry = PeerRegistry(
+        config.node_id,
+        metrics=metrics,
+        compression_threshold=rpc_compression,
+        connections=PeerConnections(
+            config.circuit_failures, max_delay=config.reconnect_max_delay
+        ),
+    )
+    metrics.track_peer_connections(peer_registry)
+    for peer_id, peer_addr in config.peers.items():
         peer_registry.register_peer(peer_id, peer_addr)
 
+    # Find the rest of the cluster through seeds and LAN broadcast
+    discovery = PeerDiscovery(
+        config.node_id,
+        config.xmlrpc_address,
+        peer_registry,
+        config.seeds,
+        node_capabilities(config),
+        tags=parse_tags(config.node_tags),
+    )
+
+    # Initialize the gossiped global room directory
+    room_directory = RoomDirectory(config.node_id, config.xmlrpc_address)
+    # Repair directories left divergent by partitions
+    anti_entropy = AntiEntropy(
+        room_directory, room_manager, peer_registry, metrics
+    )
+
+    # Track which node each user is on, for routing direct messages
+    presence = PresenceDirectory(
+        config.node_id, config.xmlrpc_address, config.presence_debounce
+    )
+
+    # User profiles, replicated last-writer-wins on HLC timestamps
+    profiles = ProfileRegistry(room_manager.clock)
+
+    # Users' push tokens, and notifications to them if a gateway is set
+    push_tokens = PushTokenRegistry(room_manager.clock)
+    push = None
+    if config.push_gateway_url:
+        push = PushDispatcher(
+            PushGatewayNotifier(
+                config.push_gateway_url, config.push_gateway_key
+            )
+        )
+
+    # Hold the sessions of disconnected users so they can resume them
+    offline_queue = None
+    if config.offline_retention > 0:
+        offline_queue = OfflineQueue(config.offline_retention)
+
+    # Initialize the causal delivery buffer for relayed messages
+    causal_buffer = CausalBuffer()
+
+    # Deliver messages of total-order rooms strictly by sequence number
+    sequence_buffer = SequenceBuffer()
+
+    # Detect peer failures and elect new admins for rooms on dead nodes
+    failure_detector = FailureDetector(
+        config.node_id,
+        peer_registry,
+        config.probe_timeout,
+        config.suspect_threshold,
+        config.dead_threshold,
+        metrics,
+        ClockSkewMonitor(config.clock_skew_threshold, room_manager.clock),
+    )
+    metrics.track_clock_skew(failure_detector.skew_monitor)
+    metrics.track_peer_rtt(failure_detector)
+    # Versioned cluster membership, changed through 2PC
+    membership = ClusterMembership(
+        config.node_id,
+        config.xmlrpc_address,
+        peer_registry,
+        failure_detector,
+        config.peers,
+        TPCCoordinator(config.node_id, peer_registry, audit_log=audit_log),
+    )
+    # Rooms committed through Raft instead of only gossiped, if configured
+    room_registry = None
+    if config.room_registry == RAFT:
+        raft_path = None
+        if config.data_dir:
+            raft_path = os.path.join(config.data_dir, RAFT_FILENAME)
+        room_registry = RaftRoomRegistry(
+            config.node_id,
+            config.xmlrpc_address,
+            peer_registry,
+            lambda: membership.view.node_ids,
+            RaftStore(raft_path),
+        )
+    replica_store = ReplicaStore()
+    failover = RoomFailover(
+        config.node_id,
+        config.xmlrpc_address,
+        room_manager,
+        replica_store,
+        peer_registry,
+        failure_detector,
+        room_directory,
+        config.election_timeout,
+        membership,
+        room_registry,
+    )
+    # Delete messages outside room owners' retention policies
+    reaper = RetentionReaper(room_manager, replica_store)
+    # Place rooms on their owners in a consistent hash ring, if configured
+    sharding = None
+    if config.sharding:
+        sharding = RoomSharding(
+            config.node_id, room_manager, failover, membership
+        )
+    # Keep rooms on nodes matching their placement constraints
+    placement = RoomPlacement(
+        config.node_id, discovery.tags, room_manager, failover
+    )
+    # Move rooms to other nodes on operators' commands
+    migrator = None
+    if config.failover:
+        migrator = RoomMigrator(room_manager, failover, sharding)
+
+    # Stream messages of hosted rooms to follower replicas
+    replication = ReplicationManager(
+        config.node_id,
+        room_manager,
+        peer_registry,
+        config.replication_factor,
+        failure_detector,
+        membership=membership,
+        snapshots=SnapshotSender(config.node_id, peer_registry),
+    )
+
+    # Degrade remote rooms whose admin node is unreachable
+    partition = PartitionManager(
+        config.node_id, config.degraded_mode, failure_detector=failure_detector
+    )
+
+    # Attachment blobs, stored by hash and pulled between nodes
+    attachments = None
+    if config.max_attachment_size:
+        blob_path = None
+        if config.data_dir:
+            blob_path = os.path.join(config.data_dir, BLOB_DIRNAME)
+        attachments = AttachmentManager(
+            config.node_id,
+            BlobStore(blob_path),
+            peer_registry,
+            config.max_attachment_size,
+        )
+
+    # Client authentication with cluster-verifiable session tokens, and
+    # usernames reserved cluster-wide through the Raft registry if enabled
+    auth = AuthManager(
+        config.node_id,
+        config.auth_secret.encode(),
+        config.auth_required,
+        config.session_ttl,
+        storage=message_log,
+        usernames=room_registry,
+    )
+
+    # Bots registered on this node, logging in with their API keys
+    bots = None
+    if config.bots:
+        bots = BotRegistry(config.node_id, message_log)
+
+    # Service accounts provisioned through the admin API
+    service_accounts = ServiceAccountRegistry(config.node_id, message_log)
+    # Read remote rooms' history from the nearest of admin and followers
+    router = LatencyRouter(
+        config.node_id,
+        failure_detector,
+        peer_registry,
+        discovery.tags.get(REGION_TAG),
+        metrics,
+    )
+
+    # Gossiped node loads, for redirecting new clients when overloaded
+    load_balancer = LoadBalancer(
+        config.node_id, config.ws_url, config.redirect_threshold
+    )
+
+    # Ping clients and disconnect those that stop answering
+    keepalive = None
+    if config.keepalive_interval > 0:
+        keepalive = KeepaliveMonitor(
+            config.keepalive_interval,
+            config.keepalive_timeout,
+            config.keepalive_grace,
+        )
+
+    # Throughput, members and delivery latency, gossiped across the cluster
+    stats = ClusterStats(config.node_id)
+
+    # Limit how fast each connection and user can send commands
+    rate_limiter = None
+    if config.rate_limiting:
+        rate_limiter = RateLimiter(parse_rate_limits(config.rate_limits))
+
+    # Apply changed runtime settings on SIGHUP or from the admin API
+    reloader = ConfigReloader(
+        config,
+        lambda: load_config(args),
+        rate_limiter,
+        compactor,
+        discovery,
+        tls,
+        audit_log,
+    )
+
+    # Crashes, RPC delays and dropped heartbeats on command, if enabled
+    faults = None
+    if config.fault_injection:
+        faults = FaultInjector(config.node_id)
+        logger.warning("Fault injection is enabled on this node")
+
+    # Undecided 2PC transactions survive restarts when there's a data dir
+    tpc_store = TransactionStore(
+        os.path.join(config.data_dir, TPC_FILENAME)
+        if config.data_dir
+        else None
+    )
+
+    # Room messages go to each peer on a batched stream
+    streams = None
+    if config.message_streams:
+        streams = MessageStreams(
+            config.node_id, peer_registry, config.stream_batch_size
+        )
+
     # Initialize XML-RPC server
     xmlrpc_server = XMLRPCServer(
-        room_manager, xmlrpc_host, xmlrpc_port, xmlrpc_address, peer_registry
+        room_manager,
+        config.xmlrpc_host,
+        config.xmlrpc_port,
+        config.xmlrpc_address,
+        peer_registry,
+        room_directory,
+        causal_buffer,
+        failover,
+        auth,
+        replication,
+        discovery,
+        presence,
+        sequence_buffer,
+        tls,
+        config.max_rpc_payload_size,
+        profiles,
+        membership,
+        room_registry,
+        attachments,
+        load_balancer,
+        faults,
+        stats,
+        push_tokens,
+        tpc_store,
+        config.rpc_workers,
+        streams,
+        rpc_compression,
+        metrics,
+        migrator,
     )
 
+    # Fan-out to peers runs on a bounded pool, one job per room at a time
+    fanout = KeyedWorkerPool(config.fanout_workers)
+
     # Initialize WebSocket server
-    ws_server = WebSocketServer(room_manager, ws_host, ws_port, peer_registry)
+    ws_server = WebSocketServer(
+        room_manager,
+        config.ws_host,
+        config.ws_port,
+        peer_registry,
+        room_directory,
+        causal_buffer,
+        replica_store,
+        auth,
+        replication,
+        presence,
+        offline_queue,
+        sequence_buffer,
+        metrics,
+        tls,
+        rate_limiter,
+        config.max_payload_size,
+        config.require_message_id,
+        config.send_queue_size,
+        config.send_queue_policy,
+        profiles,
+        membership,
+        room_registry,
+        partition,
+        attachments,
+        bots,
+        sharding,
+        load_balancer,
+        faults,
+        keepalive,
+        stats,
+        push_tokens,
+        push,
+        config.dispatch_workers,
+        fanout,
+        streams,
+        ws_compression,
+        placement,
+        migrator,
+        service_accounts,
+        router,
+    )
 
     # Connect XML-RPC broadcast callback to WebSocket server
     xmlrpc_server.set_broadcast_callback(ws_server.broadcast_to_room_sync)
+    xmlrpc_server.set_direct_message_callback(
+        ws_server.deliver_direct_message_sync
+    )
+    xmlrpc_server.set_receipt_callback(ws_server.deliver_receipt_sync)
+    xmlrpc_server.set_removal_callback(ws_server.remove_member_sync)
+    xmlrpc_server.set_admission_callback(ws_server.deliver_admission_sync)
+    xmlrpc_server.set_backlog_callback(lambda: ws_server.dispatcher.pending)
+    failover.set_notify_callback(ws_server.broadcast_to_room_sync)
+
+    # Tear down ephemeral rooms once empty or idle
+    ephemeral = EphemeralReaper(
+        room_manager, ws_server.close_room, config.ephemeral_idle_timeout
+    )
 
     # Start the XML-RPC server
     xmlrpc_server.start()
@@ -81,197 +586,301 @@ async def run_server(
     # Start the WebSocket server
     await ws_server.start()
 
-    logger.info(f"Node server '{node_id}' is ready")
-    logger.info(f"WebSocket server listening on ws://{ws_host}:{ws_port}")
-    logger.info(f"XML-RPC server listening at {xmlrpc_address}")
-    logger.info(f"Registered {len(peer_nodes)} peer nodes")
+    # Answer /healthz and /readyz probes from the node's dependencies
+    health = HealthChecker(
+        config.node_id,
+        xmlrpc_server,
+        ws_server,
+        message_log,
+        failure_detector,
+        config.min_ready_peers,
+    )
+
+    # Start the Prometheus metrics endpoint
+    metrics_server = None
+    if config.metrics_port:
+        metrics_server = MetricsServer(
+            metrics.registry,
+            config.metrics_host,
+            config.metrics_port,
+            health,
+        )
+        metrics_server.start()
+
+    # Start the operator REST API
+    admin_server = None
+    if config.admin_port:
+        admin_server = AdminServer(
+            AdminAPI(
+                ws_server,
+                peer_registry,
+                failure_detector,
+                xmlrpc_server.tpc_participant,
+                membership,
+                reloader,
+                faults,
+                failover if config.failover else None,
+            ),
+            config.admin_token,
+            config.admin_host,
+            config.admin_port,
+        )
+        admin_server.start()
+
+    logger.info(f"Node server '{config.node_id}' is ready")
+    ws_scheme = "wss" if tls else "ws"
+    logger.info(
+        f"WebSocket server listening on "
+        f"{ws_scheme}://{config.ws_host}:{config.ws_port}"
+    )
+    logger.info(f"XML-RPC server listening at {config.xmlrpc_address}")
+    logger.info(f"Registered {len(config.peers)} peer nodes")
+
+    # Handshake with the seeds and known peers before serving rooms
+    await asyncio.get_running_loop().run_in_executor(None, discovery.bootstrap)
+
+    # React to membership changes
+    orphan_reaper = OrphanReaper(
+        room_manager,
+        ws_server,
+        peer_registry,
+        presence,
+        xmlrpc_server.tpc_participant,
+        ws_server.receipts,
+    )
+    failure_detector.subscribe(
+        lambda event: _handle_membership_change(
+            room_manager, ws_server, peer_registry, event, orphan_reaper
+        )
+    )
+    if config.failover:
+        failure_detector.subscribe(failover.on_membership_change)
+    failure_detector.subscribe(presence.on_membership_change)
+    failure_detector.subscribe(ws_server.on_membership_change)
 
     # Create background tasks for health monitoring
     heartbeat_task = asyncio.create_task(
-        heartbeat_monitor(room_manager, peer_registry, ws_server)
+        failure_detection_monitor(failure_detector, config.probe_interval)
     )
     cleanup_task = asyncio.create_task(
-        stale_member_cleanup(room_manager, ws_server, peer_registry)
+        stale_member_cleanup(
+            room_manager, ws_server, peer_registry, config.inactivity_timeout
+        )
+    )
+    gossip_task = asyncio.create_task(
+        room_directory_gossip(
+            room_directory,
+            room_manager,
+            peer_registry,
+            config.gossip_interval,
+        )
+    )
+    anti_entropy_task = asyncio.create_task(
+        room_directory_anti_entropy(anti_entropy)
+    )
+    presence_task = asyncio.create_task(
+        presence_gossip(presence, peer_registry, config.gossip_interval)
+    )
+    presence_update_task = asyncio.create_task(
+        presence_updates(presence, ws_server, peer_registry)
+    )
+    profile_task = asyncio.create_task(
+        profile_gossip(profiles, peer_registry, config.gossip_interval)
+    )
+    push_token_task = asyncio.create_task(
+        push_token_gossip(push_tokens, peer_registry, config.gossip_interval)
+    )
+    load_task = asyncio.create_task(
+        load_gossip(
+            load_balancer, ws_server, peer_registry, config.gossip_interval
+        )
+    )
+    stats_task = asyncio.create_task(
+        stats_gossip(ws_server, peer_registry, config.gossip_interval)
+    )
+    membership_task = asyncio.create_task(membership_monitor(membership))
+    raft_task = asyncio.create_task(raft_ticker(room_registry))
+    partition_task = asyncio.create_task(partition_reconciliation(ws_server))
+    direct_message_task = asyncio.create_task(direct_message_retry(ws_server))
+    offline_task = asyncio.create_task(offline_session_expiry(ws_server))
+    upload_task = asyncio.create_task(upload_expiry(attachments))
+    keepalive_task = asyncio.create_task(client_keepalive(ws_server))
+    webhook_task = asyncio.create_task(webhook_delivery(webhooks))
+    push_task = asyncio.create_task(push_delivery(push))
+    bridges = (
+        BridgeManager(room_manager, egress=egress) if config.bridges else None
     )
+    bridge_task = asyncio.create_task(bridge_relay(bridges, ws_server))
+    rebalance_task = asyncio.create_task(shard_rebalancing(sharding))
+    placement_task = asyncio.create_task(room_placement(placement))
+    tpc_task = asyncio.create_task(
+        tpc_timeout_monitor(xmlrpc_server.tpc_participant)
+    )
+    causal_task = asyncio.create_task(causal_delivery_monitor(xmlrpc_server))
+    sequence_task = asyncio.create_task(sequence_gap_repair(xmlrpc_server))
+    wal_task = asyncio.create_task(wal_sync_monitor(message_log))
+    compaction_task = asyncio.create_task(
+        log_compaction(compactor, config.compaction_interval)
+    )
+    retention_task = asyncio.create_task(
+        retention_reaping(reaper, config.retention_interval)
+    )
+    ephemeral_task = asyncio.create_task(ephemeral_teardown(ephemeral))
+    scheduled_task = asyncio.create_task(scheduled_delivery(ws_server))
+    replication_task = asyncio.create_task(replication_catch_up(replication))
+    tombstone_task = asyncio.create_task(
+        member_tombstone_purge(room_manager, replica_store)
+    )
+    discovery_task = asyncio.create_task(
+        lan_discovery(
+            discovery, config.discovery_port, config.discovery_broadcast
+        )
+    )
+    health.mark_started()
 
-    # Keep server running
+    # Run until SIGTERM/SIGINT, then drain before stopping
+    shutdown_event = asyncio.Event()
+    install_signal_handlers(asyncio.get_running_loop(), shutdown_event)
+    install_reload_handler(asyncio.get_running_loop(), reloader)
     try:
-        # Wait indefinitely
-        await asyncio.Event().wait()
+        await shutdown_event.wait()
+        await drain_node(
+            ws_server,
+            failover,
+            message_log,
+            config.drain_timeout,
+            RECONNECT_DELAY,
+            config.reconnect_urls,
+        )
     except asyncio.CancelledError:
         logger.info("Server shutdown requested")
     finally:
         # Cancel background tasks
-        heartbeat_task.cancel()
-        cleanup_task.cancel()
-        try:
-            await heartbeat_task
-        except asyncio.CancelledError:
-            pass
-        try:
-            await cleanup_task
-        except asyncio.CancelledError:
-            pass
+        tasks = (
+            heartbeat_task,
+            cleanup_task,
+            gossip_task,
+            anti_entropy_task,
+            presence_task,
+            presence_update_task,
+            profile_task,
+            push_token_task,
+            load_task,
+            stats_task,
+            membership_task,
+            raft_task,
+            partition_task,
+            direct_message_task,
+            offline_task,
+            upload_task,
+            keepalive_task,
+            webhook_task,
+            push_task,
+            bridge_task,
+            rebalance_task,
+            placement_task,
+            tpc_task,
+            causal_task,
+            sequence_task,
+            wal_task,
+            compaction_task,
+            retention_task,
+            ephemeral_task,
+            scheduled_task,
+            replication_task,
+            tombstone_task,
+            discovery_task,
+        )
+        for task in tasks:
+            task.cancel()
+        for task in tasks:
+            try:
+                await task
+            except asyncio.CancelledError:
+                pass
         # Stop servers
         await ws_server.stop()
         xmlrpc_server.stop()
+        fanout.shutdown(timeout=2)
+        if streams:
+            streams.shutdown(timeout=2)
+        if admin_server:
+            admin_server.stop()
+        if metrics_server:
+            metrics_server.stop()
+        if span_exporter:
+            span_exporter.shutdown()
+        replication.shutdown()
+        if message_log:
+            message_log.close()
         logger.info("Node server stopped")
 
 
-async def heartbeat_monitor(
-    room_manager: RoomStateManager,
-    peer_registry: PeerRegistry,
-    ws_server: WebSocketServer,
+async def failure_detection_monitor(
+    failure_detector: FailureDetector, interval: float = PROBE_INTERVAL
 ):
     """
-    Periodic task to send heartbeats to member nodes.
+    Periodic task to heartbeat all peer nodes.
 
-    Runs every HEARTBEAT_INTERVAL seconds to check node health.
-    When a node fails to respond, removes all its members from rooms.
+    Runs a failure detector round every interval seconds. State changes
+    are delivered to the detector's subscribers.
 
     Args:
-        room_manager: The room state manager
-        peer_registry: The peer registry for node addresses
-        ws_server: The WebSocket server for broadcasting
+        failure_detector: The node's failure detector
+        interval: Seconds between heartbeat rounds
     """
-    logger.info("Starting heartbeat monitor task")
+    logger.info("Starting failure detection task")
 
     while True:
         try:
-            await asyncio.sleep(HEARTBEAT_INTERVAL)
-
-            # Get all nodes with members in rooms we administer
-            member_nodes = room_manager.get_all_member_nodes()
-
-            if not member_nodes:
-                continue
-
-            # Check health of each node
-            for node_id in member_nodes:
-                if node_id == room_manager.node_id:
-                    continue  # Skip self
-
-                # Get node address from peer registry
-                node_addr = peer_registry.get_peer_address(node_id)
-                if not node_addr:
-                    logger.warning(
-                        f"No address found for node {node_id}, "
-                        f"skipping heartbeat"
-                    )
-                    continue
-
-                # Send heartbeat
-                is_healthy = await _send_heartbeat(node_addr)
-
-                if is_healthy:
-                    room_manager.record_node_heartbeat_success(node_id)
-                else:
-                    is_failed = room_manager.record_node_heartbeat_failure(
-                        node_id
-                    )
-                    if is_failed:
-                        # Node is down - remove all its members
-                        logger.warning(
-                            f"Node {node_id} marked as failed, "
-                            f"removing its members"
-                        )
-                        await _handle_node_failure(
-                            room_manager, ws_server, peer_registry, node_id
-                        )
-
+            await asyncio.sleep(interval)
+            await failure_detector.probe_all()
         except asyncio.CancelledError:
-            logger.info("Heartbeat monitor task cancelled")
+            logger.info("Failure detection task cancelled")
             raise
         except Exception as e:
-            logger.error(f"Error in heartbeat monitor: {e}")
-
-
-async def _send_heartbeat(node_addr: str) -> bool:
-    """
-    Send heartbeat to a node to verify it's alive.
-
-    Args:
-        node_addr: Address of node to ping
-
-    Returns:
-        bool: True if node responded, False otherwise
-    """
-    loop = asyncio.get_running_loop()
-
-    def _do_heartbeat():
-        try:
-            proxy = ServerProxy(node_addr, allow_none=True)
-            # Note: We can't set timeout directly on ServerProxy,
-            # but the call should timeout relatively quickly on network failure
-            response = proxy.heartbeat()
-            return response.get("status") == "ok"
-        except Exception as e:
-            logger.debug(f"Heartbeat to {node_addr} failed: {e}")
-            return False
-
-    try:
-        with ThreadPoolExecutor(max_workers=1) as executor:
-            result = await asyncio.wait_for(
-                loop.run_in_executor(executor, _do_heartbeat),
-                timeout=HEARTBEAT_TIMEOUT,
-            )
-            return result
-    except asyncio.TimeoutError:
-        logger.debug(f"Heartbeat to {node_addr} timed out")
-        return False
+            logger.error(f"Error in failure detection: {e}")
 
 
-async def _handle_node_failure(
+async def _handle_membership_change(
     room_manager: RoomStateManager,
     ws_server: WebSocketServer,
     peer_registry: PeerRegistry,
-    node_id: str,
+    event: MembershipEvent,
+    reaper: Optional[OrphanReaper] = None,
 ):
     """
-    Handle a node failure by removing all its members from all rooms.
+    React to a peer changing liveness state.
+
+    Mirrors the new state onto the room manager's node health, and reaps
+    the state of a peer once it is declared dead.
 
     Args:
         room_manager: The room state manager
         ws_server: The WebSocket server for broadcasting
         peer_registry: The peer registry for broadcasting to other peers
-        node_id: The failed node's ID
+        event: The membership change
+        reaper: Optional OrphanReaper (one removing the peer's members
+            only by default)
     """
-    # Remove all members from the failed node
-    removed = room_manager.remove_all_members_from_node(node_id)
-
-    logger.info(f"Removed {len(removed)} members from failed node {node_id}")
-
-    # Broadcast member_left for each removed member
-    for room_id, username in removed:
-        room = room_manager.get_room(room_id)
-        member_count = len(room.members) if room else 0
-
-        event_data = create_member_left_event(
-            room_id=room_id,
-            username=username,
-            member_count=member_count,
-            timestamp=datetime.now(timezone.utc).isoformat(),
-            reason="Node unreachable",
-        )
-
-        # Broadcast to local WebSocket clients
-        broadcast_msg = {"type": "member_left", "data": event_data}
-        ws_server.broadcast_to_room_sync(room_id, broadcast_msg)
+    room_manager.set_node_status(
+        event.node_id, NODE_STATUS_BY_PEER_STATE[event.current]
+    )
 
-        # Broadcast to other peer nodes (excluding the failed node)
-        broadcast_to_peers(
-            peer_registry,
-            room_id,
-            "member_left",
-            event_data,
-            exclude_node=node_id,
+    if event.current == PeerState.DEAD:
+        logger.warning(
+            f"Node {event.node_id} declared dead, reaping its state"
         )
+        if reaper is None:
+            reaper = OrphanReaper(room_manager, ws_server, peer_registry)
+        await reaper.reap(event.node_id)
 
 
 async def stale_member_cleanup(
     room_manager: RoomStateManager,
     ws_server: WebSocketServer,
     peer_registry: PeerRegistry,
+    inactivity_timeout: float = INACTIVITY_TIMEOUT,
 ):
     """
     Periodic task to remove inactive members.
@@ -282,6 +891,7 @@ async def stale_member_cleanup(
         room_manager: The room state manager
         ws_server: The WebSocket server for broadcasting
         peer_registry: The peer registry for broadcasting to other peers
+        inactivity_timeout: Seconds before an idle member is removed
     """
     logger.info("Starting stale member cleanup task")
 
@@ -299,7 +909,7 @@ async def stale_member_cleanup(
 
                 # Get stale members for this room
                 stale_members = room_manager.get_stale_members(
-                    room_id, INACTIVITY_TIMEOUT
+                    room_id, inactivity_timeout
                 )
 
                 if not stale_members:
@@ -323,6 +933,7 @@ async def stale_member_cleanup(
                         member_count=member_count,
                         timestamp=datetime.now(timezone.utc).isoformat(),
                         reason="Inactivity",
+                        hlc=room_manager.clock.now().encode(),
                     )
 
                     # Broadcast to local WebSocket clients
@@ -338,6 +949,9 @@ async def stale_member_cleanup(
                         f"Removed stale member {username} from room {room_id}"
                     )
 
+                if room_manager.get_waitlist(room_id):
+                    ws_server.admit_waitlisted_sync(room_id)
+
         except asyncio.CancelledError:
             logger.info("Stale member cleanup task cancelled")
             raise
@@ -345,59 +959,892 @@ async def stale_member_cleanup(
             logger.error(f"Error in stale member cleanup: {e}")
 
 
-def main():
-    """Main entry point for the node server."""
-    logger.info("Starting distributed chat node server...")
+async def room_directory_gossip(
+    room_directory: RoomDirectory,
+    room_manager: RoomStateManager,
+    peer_registry: PeerRegistry,
+    interval: float = GOSSIP_INTERVAL,
+):
+    """
+    Periodic task to gossip the global room directory with peers.
 
-    # Get configuration from environment or use defaults
-    node_id = os.environ.get("NODE_ID", "node1")
-
-    # WebSocket configuration
-    ws_host = os.environ.get("WEBSOCKET_HOST", "0.0.0.0")
-    ws_port = int(os.environ.get("WEBSOCKET_PORT", "8080"))
-
-    # XML-RPC configuration
-    xmlrpc_host = os.environ.get("XMLRPC_HOST", "0.0.0.0")
-    xmlrpc_port = int(os.environ.get("XMLRPC_PORT", "9090"))
-    xmlrpc_address = os.environ.get(
-        "XMLRPC_ADDRESS", f"http://{node_id}:{xmlrpc_port}"
-    )
-
-    # Parse peer nodes from environment
-    # Format: PEER_NODES=node2:http://node2:9090,node3:http://node3:9090
-    peer_nodes = {}
-    peer_nodes_env = os.environ.get("PEER_NODES", "")
-    if peer_nodes_env:
-        for peer_spec in peer_nodes_env.split(","):
-            if ":" in peer_spec:
-                parts = peer_spec.split(":", 1)
-                if len(parts) == 2:
-                    peer_id, peer_addr = parts[0].strip(), parts[1].strip()
-                    # Handle the case where address has http://
-                    if not peer_addr.startswith("http://"):
-                        # Assume format is node_id:node_host:port
-                        addr_parts = peer_spec.split(":")
-                        if len(addr_parts) >= 3:
-                            peer_id = addr_parts[0]
-                            peer_host = addr_parts[1]
-                            peer_port = addr_parts[2]
-                            peer_addr = f"http://{peer_host}:{peer_port}"
-                    peer_nodes[peer_id] = peer_addr
-                    logger.info(f"Configured peer: {peer_id} at {peer_addr}")
+    Runs every interval seconds. Each round exchanges directories with a
+    few random peers so all nodes converge on the same room list.
 
-    # Run the async server
-    try:
-        asyncio.run(
-            run_server(
-                node_id,
-                ws_host,
-                ws_port,
-                xmlrpc_host,
-                xmlrpc_port,
-                xmlrpc_address,
-                peer_nodes,
+    Args:
+        room_directory: The local room directory
+        room_manager: The room state manager
+        peer_registry: The peer registry for reaching peers
+        interval: Seconds between gossip rounds
+    """
+    logger.info("Starting room directory gossip task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            await loop.run_in_executor(
+                None, gossip_round, room_directory, room_manager, peer_registry
             )
-        )
+        except asyncio.CancelledError:
+            logger.info("Room directory gossip task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in room directory gossip: {e}")
+
+
+async def room_directory_anti_entropy(anti_entropy: AntiEntropy):
+    """
+    Periodic task to reconcile the room directory with peers.
+
+    Runs every ANTI_ENTROPY_INTERVAL seconds, comparing directory digests
+    with a random peer and repairing missing or stale entries.
+
+    Args:
+        anti_entropy: The node's anti-entropy reconciler
+    """
+    logger.info("Starting room directory anti-entropy task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(ANTI_ENTROPY_INTERVAL)
+            await loop.run_in_executor(None, anti_entropy.run_round)
+        except asyncio.CancelledError:
+            logger.info("Room directory anti-entropy task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in room directory anti-entropy: {e}")
+
+
+async def presence_gossip(
+    presence: PresenceDirectory,
+    peer_registry: PeerRegistry,
+    interval: float = GOSSIP_INTERVAL,
+):
+    """
+    Periodic task to gossip the user presence directory with peers.
+
+    Args:
+        presence: The local presence directory
+        peer_registry: The peer registry for reaching peers
+        interval: Seconds between gossip rounds
+    """
+    logger.info("Starting presence gossip task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            await loop.run_in_executor(
+                None, presence_gossip_round, presence, peer_registry
+            )
+        except asyncio.CancelledError:
+            logger.info("Presence gossip task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in presence gossip: {e}")
+
+
+async def presence_updates(
+    presence: PresenceDirectory,
+    ws_server: WebSocketServer,
+    peer_registry: PeerRegistry,
+):
+    """
+    Periodic task to publish debounced presence changes.
+
+    Runs every PRESENCE_PUBLISH_INTERVAL seconds. Changes are sent to
+    clients in the rooms of the affected users, and changes to users on
+    this node are pushed to every peer.
+
+    Args:
+        presence: The local presence directory
+        ws_server: The WebSocket server for notifying clients
+        peer_registry: The peer registry for reaching peers
+    """
+    logger.info("Starting presence update task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(PRESENCE_PUBLISH_INTERVAL)
+            changes = presence.take_changes()
+            if not changes:
+                continue
+            await ws_server.publish_presence_changes(changes)
+            await loop.run_in_executor(
+                None, push_presence_changes, presence, changes, peer_registry
+            )
+        except asyncio.CancelledError:
+            logger.info("Presence update task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error publishing presence changes: {e}")
+
+
+async def profile_gossip(
+    profiles: ProfileRegistry,
+    peer_registry: PeerRegistry,
+    interval: float = GOSSIP_INTERVAL,
+):
+    """
+    Periodic task to gossip the user profile registry with peers.
+
+    Args:
+        profiles: The local profile registry
+        peer_registry: The peer registry for reaching peers
+        interval: Seconds between gossip rounds
+    """
+    logger.info("Starting profile gossip task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            await loop.run_in_executor(
+                None, profile_gossip_round, profiles, peer_registry
+            )
+        except asyncio.CancelledError:
+            logger.info("Profile gossip task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in profile gossip: {e}")
+
+
+async def push_token_gossip(
+    push_tokens: PushTokenRegistry,
+    peer_registry: PeerRegistry,
+    interval: float = GOSSIP_INTERVAL,
+):
+    """
+    Periodic task to gossip users' push tokens with peers.
+
+    Args:
+        push_tokens: The local push token registry
+        peer_registry: The peer registry for reaching peers
+        interval: Seconds between gossip rounds
+    """
+    logger.info("Starting push token gossip task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            await loop.run_in_executor(
+                None, push_token_gossip_round, push_tokens, peer_registry
+            )
+        except asyncio.CancelledError:
+            logger.info("Push token gossip task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in push token gossip: {e}")
+
+
+async def stats_gossip(
+    ws_server: WebSocketServer,
+    peer_registry: PeerRegistry,
+    interval: float = GOSSIP_INTERVAL,
+):
+    """
+    Periodic task to gossip node and room statistics with peers.
+
+    Args:
+        ws_server: WebSocket server measuring this node's statistics
+        peer_registry: The peer registry for reaching peers
+        interval: Seconds between gossip rounds
+    """
+    logger.info("Starting stats gossip task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            ws_server.refresh_stats()
+            await loop.run_in_executor(
+                None, stats_gossip_round, ws_server.stats, peer_registry
+            )
+        except asyncio.CancelledError:
+            logger.info("Stats gossip task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in stats gossip: {e}")
+
+
+async def load_gossip(
+    load_balancer: LoadBalancer,
+    ws_server: WebSocketServer,
+    peer_registry: PeerRegistry,
+    interval: float = GOSSIP_INTERVAL,
+):
+    """
+    Periodic task to gossip this node's client load with peers.
+
+    Args:
+        load_balancer: The local load balancer
+        ws_server: WebSocket server whose clients are counted
+        peer_registry: The peer registry for reaching peers
+        interval: Seconds between gossip rounds
+    """
+    logger.info("Starting load gossip task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            load_balancer.update_local(len(ws_server.clients))
+            await loop.run_in_executor(
+                None, load_gossip_round, load_balancer, peer_registry
+            )
+        except asyncio.CancelledError:
+            logger.info("Load gossip task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in load gossip: {e}")
+
+
+async def membership_monitor(membership: ClusterMembership):
+    """
+    Periodic task to keep the cluster membership view current.
+
+    Runs every MEMBERSHIP_INTERVAL seconds, adopting newer views held by
+    peers and, on the proposing node, proposing a view with the nodes
+    currently alive.
+
+    Args:
+        membership: The node's cluster membership
+    """
+    logger.info("Starting membership task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(MEMBERSHIP_INTERVAL)
+            await loop.run_in_executor(None, membership.sync)
+            await membership.reconcile()
+        except asyncio.CancelledError:
+            logger.info("Membership task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in membership round: {e}")
+
+
+async def raft_ticker(room_registry: RaftRoomRegistry):
+    """
+    Periodic task driving the Raft room registry's timers.
+
+    Runs every RAFT_TICK_INTERVAL seconds, sending the leader's heartbeats
+    or starting an election when no leader has been heard from. Does
+    nothing with the gossip room registry.
+
+    Args:
+        room_registry: The node's Raft room registry, or None
+    """
+    if room_registry is None:
+        return
+
+    logger.info("Starting Raft task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(RAFT_TICK_INTERVAL)
+            await loop.run_in_executor(None, room_registry.raft.tick)
+        except asyncio.CancelledError:
+            logger.info("Raft task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in Raft tick: {e}")
+
+
+async def partition_reconciliation(ws_server: WebSocketServer):
+    """
+    Periodic task to reconcile degraded rooms.
+
+    Runs every RECONCILE_INTERVAL seconds, forwarding the messages
+    buffered for rooms whose admin node is reachable again.
+
+    Args:
+        ws_server: The WebSocket server
+    """
+    logger.info("Starting partition reconciliation task")
+
+    while True:
+        try:
+            await asyncio.sleep(RECONCILE_INTERVAL)
+            await ws_server.reconcile_partitions()
+        except asyncio.CancelledError:
+            logger.info("Partition reconciliation task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in partition reconciliation: {e}")
+
+
+async def direct_message_retry(ws_server: WebSocketServer):
+    """
+    Periodic task to retry delivery of buffered direct messages.
+
+    Runs every DM_RETRY_INTERVAL seconds, so a message for a user who was
+    offline reaches them soon after gossip shows them online on any node.
+
+    Args:
+        ws_server: The WebSocket server holding the buffered messages
+    """
+    logger.info("Starting direct message retry task")
+
+    while True:
+        try:
+            await asyncio.sleep(DM_RETRY_INTERVAL)
+            await ws_server.retry_direct_messages()
+        except asyncio.CancelledError:
+            logger.info("Direct message retry task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error retrying direct messages: {e}")
+
+
+async def offline_session_expiry(ws_server: WebSocketServer):
+    """
+    Periodic task to expire held sessions of disconnected users.
+
+    Runs every OFFLINE_EXPIRY_INTERVAL seconds; users whose sessions were
+    not resumed within the retention window leave their rooms.
+
+    Args:
+        ws_server: The WebSocket server holding the sessions
+    """
+    logger.info("Starting offline session expiry task")
+
+    while True:
+        try:
+            await asyncio.sleep(OFFLINE_EXPIRY_INTERVAL)
+            await ws_server.expire_offline_sessions()
+        except asyncio.CancelledError:
+            logger.info("Offline session expiry task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error expiring offline sessions: {e}")
+
+
+async def client_keepalive(ws_server: WebSocketServer):
+    """
+    Periodic task to ping clients and reap those that stopped answering.
+
+    Runs every keepalive interval; returns at once if keepalive is
+    disabled.
+
+    Args:
+        ws_server: The WebSocket server of the clients
+    """
+    if ws_server.keepalive is None:
+        return
+    logger.info("Starting client keepalive task")
+
+    while True:
+        try:
+            await asyncio.sleep(ws_server.keepalive.interval)
+            stale, closed = await ws_server.keepalive_round()
+            if stale or closed:
+                logger.info(
+                    f"Keepalive: {stale} clients stale, {closed} "
+                    f"disconnected"
+                )
+        except asyncio.CancelledError:
+            logger.info("Client keepalive task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error checking client keepalive: {e}")
+
+
+async def upload_expiry(attachments: Optional[AttachmentManager]):
+    """
+    Periodic task to drop attachment uploads that were abandoned.
+
+    Runs every UPLOAD_EXPIRY_INTERVAL seconds; uploads without a chunk
+    for UPLOAD_TTL seconds are dropped. Returns at once if attachments
+    are disabled.
+
+    Args:
+        attachments: The node's attachment manager, if any
+    """
+    if attachments is None:
+        return
+    logger.info("Starting upload expiry task")
+
+    while True:
+        try:
+            await asyncio.sleep(UPLOAD_EXPIRY_INTERVAL)
+            expired = attachments.expire()
+            if expired:
+                logger.info(f"Dropped {expired} idle attachment uploads")
+        except asyncio.CancelledError:
+            logger.info("Upload expiry task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error expiring attachment uploads: {e}")
+
+
+async def webhook_delivery(webhooks: Optional[WebhookDispatcher]):
+    """
+    Periodic task to POST queued room events to their webhooks.
+
+    Runs every WEBHOOK_DELIVERY_INTERVAL seconds; deliveries are sent in
+    a worker thread so slow webhook endpoints don't block the event loop,
+    and failed ones are retried with backoff. Returns at once if webhooks
+    are disabled.
+
+    Args:
+        webhooks: The node's webhook dispatcher, if any
+    """
+    if webhooks is None:
+        return
+    logger.info("Starting webhook delivery task")
+
+    loop = asyncio.get_running_loop()
+    while True:
+        try:
+            await asyncio.sleep(WEBHOOK_DELIVERY_INTERVAL)
+            if webhooks.pending():
+                await loop.run_in_executor(None, webhooks.deliver_due)
+        except asyncio.CancelledError:
+            logger.info("Webhook delivery task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error delivering webhooks: {e}")
+
+
+async def push_delivery(push: Optional[PushDispatcher]):
+    """
+    Periodic task to send queued push notifications to the gateway.
+
+    Runs every PUSH_DELIVERY_INTERVAL seconds in a worker thread, so a
+    slow gateway doesn't block the event loop. Returns at once if no push
+    gateway is configured.
+
+    Args:
+        push: The node's push dispatcher, if any
+    """
+    if push is None:
+        return
+    logger.info("Starting push notification delivery task")
+
+    loop = asyncio.get_running_loop()
+    while True:
+        try:
+            await asyncio.sleep(PUSH_DELIVERY_INTERVAL)
+            if push.pending():
+                await loop.run_in_executor(None, push.deliver)
+        except asyncio.CancelledError:
+            logger.info("Push notification delivery task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error sending push notifications: {e}")
+
+
+async def bridge_relay(
+    bridges: Optional[BridgeManager], ws_server: WebSocketServer
+):
+    """
+    Periodic task to relay messages between hosted rooms and their bridges.
+
+    Runs every BRIDGE_POLL_INTERVAL seconds; the IRC and Matrix traffic
+    runs in a worker thread, and the external messages it collects are
+    posted in their rooms by the users' puppets. Closes the bridges'
+    connections when cancelled. Returns at once if bridges are disabled.
+
+    Args:
+        bridges: The node's bridge manager, if any
+        ws_server: WebSocket server posting the relayed messages
+    """
+    if bridges is None:
+        return
+    logger.info("Starting bridge relay task")
+
+    loop = asyncio.get_running_loop()
+    while True:
+        try:
+            await asyncio.sleep(BRIDGE_POLL_INTERVAL)
+            inbound = await loop.run_in_executor(None, bridges.relay_round)
+            for room_id, username, content in inbound:
+                await ws_server.post_bridged_message(room_id, username, content)
+        except asyncio.CancelledError:
+            logger.info("Bridge relay task cancelled")
+            await loop.run_in_executor(None, bridges.close)
+            raise
+        except Exception as e:
+            logger.error(f"Error relaying bridged messages: {e}")
+
+
+async def shard_rebalancing(sharding: Optional[RoomSharding]):
+    """
+    Periodic task to move hosted rooms to their owners on the hash ring.
+
+    Runs every REBALANCE_INTERVAL seconds in a worker thread, since rooms
+    are handed off over XML-RPC. Rooms move after the ring changes, when
+    nodes join or leave, and after this node took a room over through
+    failover. Returns at once if sharding is disabled.
+
+    Args:
+        sharding: The node's room sharding, if enabled
+    """
+    if sharding is None:
+        return
+    logger.info("Starting shard rebalancing task")
+
+    loop = asyncio.get_running_loop()
+    while True:
+        try:
+            await asyncio.sleep(REBALANCE_INTERVAL)
+            await loop.run_in_executor(None, sharding.rebalance)
+        except asyncio.CancelledError:
+            logger.info("Shard rebalancing task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error rebalancing rooms: {e}")
+
+
+async def room_placement(placement: RoomPlacement):
+    """
+    Periodic task to move hosted rooms to nodes matching their placement.
+
+    Runs every PLACEMENT_INTERVAL seconds in a worker thread, since rooms
+    are handed off over XML-RPC. Rooms move after this node took over a
+    room it doesn't match, e.g. through failover, or when a matching
+    peer turned up for a room no live node matched.
+
+    Args:
+        placement: The node's room placement
+    """
+    logger.info("Starting room placement task")
+
+    loop = asyncio.get_running_loop()
+    while True:
+        try:
+            await asyncio.sleep(PLACEMENT_INTERVAL)
+            await loop.run_in_executor(None, placement.rebalance)
+        except asyncio.CancelledError:
+            logger.info("Room placement task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error placing rooms: {e}")
+
+
+async def tpc_timeout_monitor(tpc_participant: TPCParticipant):
+    """
+    Periodic task to finish 2PC transactions that never got a decision.
+
+    Runs every TIMEOUT_CHECK_INTERVAL seconds so a participant doesn't keep
+    resources locked forever when its coordinator fails mid-transaction:
+    transactions without the recovery extension are aborted, the others
+    recovered with the other participants.
+
+    Args:
+        tpc_participant: The node's 2PC participant
+    """
+    logger.info("Starting 2PC timeout monitor task")
+
+    while True:
+        try:
+            await asyncio.sleep(TIMEOUT_CHECK_INTERVAL)
+            tpc_participant.expire_prepared()
+            await asyncio.get_running_loop().run_in_executor(
+                None, tpc_participant.recover_blocked
+            )
+        except asyncio.CancelledError:
+            logger.info("2PC timeout monitor task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in 2PC timeout monitor: {e}")
+
+
+async def causal_delivery_monitor(xmlrpc_server: XMLRPCServer):
+    """
+    Periodic task to release messages stuck waiting for dependencies.
+
+    Runs every CAUSAL_DELIVERY_TIMEOUT seconds. A relayed message whose
+    causal predecessor was lost would otherwise never reach clients.
+
+    Args:
+        xmlrpc_server: The XML-RPC server holding the causal buffer
+    """
+    logger.info("Starting causal delivery monitor task")
+
+    while True:
+        try:
+            await asyncio.sleep(CAUSAL_DELIVERY_TIMEOUT)
+            xmlrpc_server.deliver_overdue_messages()
+        except asyncio.CancelledError:
+            logger.info("Causal delivery monitor task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in causal delivery monitor: {e}")
+
+
+async def sequence_gap_repair(xmlrpc_server: XMLRPCServer):
+    """
+    Periodic task to request missing messages of total-order rooms.
+
+    Runs every RETRANSMIT_TIMEOUT seconds. Messages held back behind a gap
+    are delivered once the sequencer sends the missing ones again, or
+    after the gap is given up on.
+
+    Args:
+        xmlrpc_server: The XML-RPC server holding the sequence buffer
+    """
+    logger.info("Starting sequence gap repair task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(RETRANSMIT_TIMEOUT)
+            await loop.run_in_executor(None, xmlrpc_server.repair_sequence_gaps)
+        except asyncio.CancelledError:
+            logger.info("Sequence gap repair task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in sequence gap repair: {e}")
+
+
+async def wal_sync_monitor(message_log: Optional[Storage]):
+    """
+    Periodic task to fsync the write-ahead log or SQLite database.
+
+    Runs every FSYNC_INTERVAL seconds so records written under the
+    "interval" policy reach disk even when a room goes quiet. Does nothing
+    without storage or with another policy.
+
+    Args:
+        message_log: The node's storage backend, or None
+    """
+    if not message_log or message_log.fsync_policy != "interval":
+        return
+
+    logger.info("Starting WAL sync task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(FSYNC_INTERVAL)
+            await loop.run_in_executor(None, message_log.sync)
+        except asyncio.CancelledError:
+            logger.info("WAL sync task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in WAL sync: {e}")
+
+
+async def log_compaction(compactor: Compactor, interval: float):
+    """
+    Periodic task to compact the stored records of hosted rooms.
+
+    Does nothing without storage or when no room has a retention policy.
+
+    Args:
+        compactor: The node's log compactor
+        interval: Seconds between compaction rounds
+    """
+    policies = [compactor.default_policy, *compactor.room_policies.values()]
+    if not compactor.room_manager.message_log or all(
+        policy.unlimited for policy in policies
+    ):
+        return
+
+    logger.info("Starting log compaction task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            await loop.run_in_executor(None, compactor.run_round)
+        except asyncio.CancelledError:
+            logger.info("Log compaction task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in log compaction: {e}")
+
+
+async def retention_reaping(reaper: RetentionReaper, interval: float):
+    """
+    Periodic task to delete messages outside their room's retention policy.
+
+    Args:
+        reaper: The node's retention reaper
+        interval: Seconds between reaper rounds
+    """
+    logger.info("Starting retention reaper task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(interval)
+            await loop.run_in_executor(None, reaper.run_round)
+        except asyncio.CancelledError:
+            logger.info("Retention reaper task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in retention reaper: {e}")
+
+
+async def ephemeral_teardown(reaper: EphemeralReaper):
+    """
+    Periodic task to tear down empty or idle ephemeral rooms.
+
+    Args:
+        reaper: The node's ephemeral room reaper
+    """
+    logger.info("Starting ephemeral room teardown task")
+
+    while True:
+        try:
+            await asyncio.sleep(EPHEMERAL_SWEEP_INTERVAL)
+            await reaper.run_round()
+        except asyncio.CancelledError:
+            logger.info("Ephemeral room teardown task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in ephemeral room teardown: {e}")
+
+
+async def scheduled_delivery(ws_server: WebSocketServer):
+    """
+    Periodic task to send scheduled messages that are due.
+
+    Args:
+        ws_server: WebSocket server posting the messages of hosted rooms
+    """
+    logger.info("Starting scheduled message delivery task")
+
+    while True:
+        try:
+            await asyncio.sleep(SCHEDULE_INTERVAL)
+            await ws_server.post_scheduled_messages()
+        except asyncio.CancelledError:
+            logger.info("Scheduled message delivery task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error sending scheduled messages: {e}")
+
+
+async def replication_catch_up(replication: ReplicationManager):
+    """
+    Periodic task to catch up follower replicas.
+
+    Runs every CATCH_UP_INTERVAL seconds, resending messages to followers
+    that missed them, replacing dead followers, and dropping replicas of
+    deleted rooms.
+
+    Args:
+        replication: The node's replication manager
+    """
+    logger.info("Starting replication catch-up task")
+    loop = asyncio.get_running_loop()
+
+    while True:
+        try:
+            await asyncio.sleep(CATCH_UP_INTERVAL)
+            await loop.run_in_executor(None, replication.catch_up)
+        except asyncio.CancelledError:
+            logger.info("Replication catch-up task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error in replication catch-up: {e}")
+
+
+async def member_tombstone_purge(
+    room_manager: RoomStateManager, replica_store: ReplicaStore
+):
+    """
+    Periodic task to drop old tombstones from room membership sets.
+
+    Args:
+        room_manager: The room state manager
+        replica_store: The node's replicas of remote rooms
+    """
+    logger.info("Starting membership tombstone purge task")
+
+    while True:
+        try:
+            await asyncio.sleep(TOMBSTONE_PURGE_INTERVAL)
+            purged = room_manager.purge_member_tombstones()
+            purged += replica_store.purge_member_tombstones()
+            if purged:
+                logger.info(f"Purged {purged} membership tombstones")
+        except asyncio.CancelledError:
+            logger.info("Membership tombstone purge task cancelled")
+            raise
+        except Exception as e:
+            logger.error(f"Error purging membership tombstones: {e}")
+
+
+async def lan_discovery(discovery: PeerDiscovery, port: int, enabled: bool):
+    """
+    Periodic task to announce this node by LAN broadcast.
+
+    Listens for other nodes' announcements on the discovery port and
+    handshakes with new ones, and broadcasts this node's announcement
+    every ANNOUNCE_INTERVAL seconds. Does nothing unless enabled.
+
+    Args:
+        discovery: The node's peer discovery
+        port: UDP port for announcements
+        enabled: Whether LAN broadcast discovery is enabled
+    """
+    if not enabled:
+        return
+
+    logger.info(f"Starting LAN discovery task on UDP port {port}")
+    loop = asyncio.get_running_loop()
+    transport, _ = await loop.create_datagram_endpoint(
+        lambda: AnnouncementProtocol(discovery),
+        local_addr=("0.0.0.0", port),
+        allow_broadcast=True,
+    )
+
+    try:
+        while True:
+            try:
+                transport.sendto(
+                    discovery.announcement(), ("<broadcast>", port)
+                )
+                await asyncio.sleep(ANNOUNCE_INTERVAL)
+            except asyncio.CancelledError:
+                logger.info("LAN discovery task cancelled")
+                raise
+            except Exception as e:
+                logger.error(f"Error in LAN discovery: {e}")
+                await asyncio.sleep(ANNOUNCE_INTERVAL)
+    finally:
+        transport.close()
+
+
+def main(argv=None):
+    """
+    Main entry point for the node server.
+
+    Args:
+        argv: Command-line arguments (defaults to sys.argv[1:])
+    """
+    # Settings come from the config file, environment and flags
+    args = parse_args(argv)
+    try:
+        config = load_config(args)
+    except ConfigError as e:
+        for error in e.errors:
+            logger.error(f"Configuration error: {error}")
+        sys.exit(2)
+
+    if args.print_config:
+        print(format_config(config), end="")
+        return
+
+    configure_logging(config.node_id, config.log_level, config.log_format)
+    logger.info("Starting distributed chat node server...")
+    for peer_id, peer_addr in config.peers.items():
+        logger.info(f"Configured peer: {peer_id} at {peer_addr}")
+
+    # Run the async server
+    try:
+        asyncio.run(run_server(config, args))
     except KeyboardInterrupt:
         logger.info("Shutting down node server...")
         sys.exit(0)
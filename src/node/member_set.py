@@ -0,0 +1,176 @@
+"""
+Room Membership Sets
+
+A room's membership is kept as an observed-remove set (OR-Set), a CRDT
+that nodes can change independently and merge in any order to the same
+result. Without it, joins and leaves on both sides of a partition
+conflict when it heals: a list of members can't tell a member who left
+on one side from one who joined on the other.
+
+- Every join adds the username with a new unique tag.
+- A leave tombstones the tags of the username seen so far, so it only
+  undoes the joins it observed: a concurrent join on the other side of a
+  partition, with a tag the leave never saw, survives the merge (add
+  wins).
+- Merging two sets takes the union of their tags and of their
+  tombstones; a username is a member while one of its tags isn't
+  tombstoned.
+
+The room's admin keeps the set with the room, replicates it with the
+room's metadata and sends it with join responses, so replicas and
+follower replicas merge it. A node whose admin is unreachable (see
+partition.py) records the joins and leaves of its local clients in its
+replica's set, and pushes it to the admin with merge_room_members when
+the room is reconciled; the admin merges it into the room, announces the
+members who joined or left, and returns the merged set. Failover merges
+the surviving replicas' sets.
+
+Tombstones are dropped TOMBSTONE_TTL seconds after the leave. A replica
+that missed a leave for longer than that could bring the member back on
+merge, so the TTL is much longer than partitions are expected to last.
+"""
+
+import time
+import uuid
+from typing import Dict, List, Optional, Set
+
+# Membership set configuration
+TOMBSTONE_TTL = 86400  # seconds to remember a leave
+TOMBSTONE_PURGE_INTERVAL = 600  # seconds between tombstone purges
+
+
+class MemberSet:
+    """
+    An observed-remove set of a room's member usernames.
+
+    Not thread-safe; callers hold the lock of the room or replica that
+    owns the set.
+    """
+
+    def __init__(
+        self,
+        tags: Optional[Dict[str, List[str]]] = None,
+        tombstones: Optional[Dict[str, float]] = None,
+    ):
+        """
+        Initialize the set.
+
+        Args:
+            tags: Maps username -> tags of its joins
+            tombstones: Maps each removed tag -> UNIX time of the leave
+        """
+        self._tombstones: Dict[str, float] = dict(tombstones or {})
+        self._tags: Dict[str, Set[str]] = {}
+        for username, user_tags in (tags or {}).items():
+            live = set(user_tags) - set(self._tombstones)
+            if live:
+                self._tags[username] = live
+
+    def __contains__(self, username: str) -> bool:
+        return username in self._tags
+
+    def members(self) -> List[str]:
+        """Get the member usernames, sorted."""
+        return sorted(self._tags)
+
+    def add(self, username: str) -> str:
+        """
+        Record a join.
+
+        Args:
+            username: The joining user
+
+        Returns:
+            str: The join's new tag
+        """
+        tag = uuid.uuid4().hex
+        self._tags.setdefault(username, set()).add(tag)
+        return tag
+
+    def remove(self, username: str, now: Optional[float] = None) -> bool:
+        """
+        Record a leave, tombstoning the user's joins seen so far.
+
+        Args:
+            username: The leaving user
+            now: UNIX time of the leave (defaults to the current time)
+
+        Returns:
+            True if the user was a member
+        """
+        tags = self._tags.pop(username, None)
+        if not tags:
+            return False
+        removed_at = time.time() if now is None else now
+        for tag in tags:
+            self._tombstones[tag] = removed_at
+        return True
+
+    def merge(self, other: "MemberSet") -> None:
+        """
+        Merge another replica's set into this one.
+
+        Args:
+            other: The other set
+        """
+        for tag, removed_at in other._tombstones.items():
+            self._tombstones[tag] = min(
+                removed_at, self._tombstones.get(tag, removed_at)
+            )
+        for username, tags in other._tags.items():
+            self._tags.setdefault(username, set()).update(tags)
+        for username in list(self._tags):
+            self._tags[username] -= set(self._tombstones)
+            if not self._tags[username]:
+                del self._tags[username]
+
+    def purge_tombstones(
+        self, ttl: float = TOMBSTONE_TTL, now: Optional[float] = None
+    ) -> int:
+        """
+        Drop the tombstones of leaves older than ttl seconds.
+
+        Args:
+            ttl: Seconds to keep a tombstone
+            now: Current UNIX time (defaults to the current time)
+
+        Returns:
+            int: Number of tombstones dropped
+        """
+        cutoff = (time.time() if now is None else now) - ttl
+        expired = [t for t, at in self._tombstones.items() if at <= cutoff]
+        for tag in expired:
+            del self._tombstones[tag]
+        return len(expired)
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return {
+            "tags": {
+                username: sorted(tags)
+                for username, tags in sorted(self._tags.items())
+            },
+            "tombstones": dict(self._tombstones),
+        }
+
+    @classmethod
+    def from_dict(cls, data: Optional[Dict]) -> "MemberSet":
+        """Create a set from its dictionary form (empty for None)."""
+        data = data or {}
+        return cls(data.get("tags"), data.get("tombstones"))
+
+
+def merge_member_sets(*member_sets: Optional[Dict]) -> Dict:
+    """
+    Merge membership sets given as dicts.
+
+    Args:
+        *member_sets: The sets' dictionary forms (None for no set)
+
+    Returns:
+        dict: The merged set's dictionary form
+    """
+    merged = MemberSet()
+    for data in member_sets:
+        merged.merge(MemberSet.from_dict(data))
+    return merged.to_dict()
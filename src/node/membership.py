@@ -0,0 +1,405 @@
+"""
+Cluster Membership View
+
+Every node holds a versioned view of the cluster: an epoch number and the
+members (node ID -> XML-RPC address) in that epoch. Subsystems that need
+to know "who is in the cluster" read it from the view instead of from the
+peer registry or the failure detector, so they all agree:
+
+- 2PC room deletions use the view's members as participants
+- Replication picks follower nodes among the view's live members
+- Room admin elections only proceed with a quorum (a majority) of the
+  view's members reachable
+
+Views change through the two-phase commit engine (tpc.py): the lowest-ID
+live node proposes the next epoch with the nodes it currently sees alive,
+every member of the new view must vote READY, and the view is installed
+everywhere on COMMIT. A participant votes ABORT on a proposal that doesn't
+advance its epoch or while another change is prepared, so concurrent
+proposals can't both win. A proposal is only made if the new members
+include a majority of the current view, so the nodes cut off on the
+minority side of a partition keep their view (and can't elect admins)
+until they rejoin.
+
+Nodes that missed a change, for example while down, adopt the newest view
+held by their peers, which are asked for it every MEMBERSHIP_INTERVAL
+seconds.
+"""
+
+import logging
+import threading
+import uuid
+from dataclasses import dataclass, field
+from typing import Callable, Dict, Iterable, List, Optional
+
+from .tpc import (
+    VOTE_ABORT,
+    VOTE_READY,
+    CoordinatorTransaction,
+    TPCCoordinator,
+    TransactionHandler,
+)
+
+logger = logging.getLogger(__name__)
+
+# Membership configuration
+MEMBERSHIP_INTERVAL = 5  # seconds between view sync and change rounds
+
+# 2PC operation name of membership changes
+MEMBERSHIP_CHANGE = "membership_change"
+
+ViewListener = Callable[["MembershipView"], None]
+
+
+@dataclass
+class MembershipView:
+    """
+    The cluster's members in one epoch.
+
+    Attributes:
+        epoch: Version of the view; each installed change increments it
+        members: Maps node_id -> XML-RPC address of every member
+    """
+
+    epoch: int = 0
+    members: Dict[str, str] = field(default_factory=dict)
+
+    @property
+    def node_ids(self) -> List[str]:
+        """The members' node IDs, sorted."""
+        return sorted(self.members)
+
+    @property
+    def quorum(self) -> int:
+        """Number of members forming a majority of the view."""
+        return len(self.members) // 2 + 1
+
+    def has_quorum(self, node_ids: Iterable[str]) -> bool:
+        """
+        Check whether some nodes include a majority of the view.
+
+        Args:
+            node_ids: Node IDs, e.g. the reachable ones
+
+        Returns:
+            True if at least quorum of them are members
+        """
+        return len(set(node_ids) & set(self.members)) >= self.quorum
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return {"epoch": self.epoch, "members": dict(self.members)}
+
+    @classmethod
+    def from_dict(cls, data: Dict) -> "MembershipView":
+        """Create a view from a dictionary made by to_dict()."""
+        return cls(
+            epoch=int(data["epoch"]),
+            members={str(k): str(v) for k, v in data["members"].items()},
+        )
+
+
+class MembershipChangeHandler(TransactionHandler):
+    """
+    2PC participant handler for the "membership_change" operation.
+    """
+
+    def __init__(self, membership: "ClusterMembership"):
+        """
+        Initialize the handler.
+
+        Args:
+            membership: The node's ClusterMembership
+        """
+        self.membership = membership
+
+    def prepare(self, transaction_id: str, payload: Dict) -> Dict:
+        """Vote on installing payload['view']."""
+        return self.membership.prepare_change(
+            transaction_id, MembershipView.from_dict(payload["view"])
+        )
+
+    def commit(self, transaction_id: str, payload: Dict) -> Dict:
+        """Install the prepared view."""
+        self.membership.commit_change(
+            transaction_id, MembershipView.from_dict(payload["view"])
+        )
+        return {"success": True}
+
+    def abort(self, transaction_id: str, payload: Dict) -> Dict:
+        """Release the prepared change."""
+        self.membership.abort_change(transaction_id)
+        return {"success": True}
+
+
+class ClusterMembership:
+    """
+    This node's membership view and the protocol that changes it.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        node_address: str,
+        peer_registry=None,
+        failure_detector=None,
+        initial_members: Optional[Dict[str, str]] = None,
+        coordinator: Optional[TPCCoordinator] = None,
+    ):
+        """
+        Initialize the membership view.
+
+        Args:
+            node_id: ID of this node
+            node_address: XML-RPC address of this node
+            peer_registry: PeerRegistry used to reach members
+            failure_detector: Optional FailureDetector for peer liveness
+            initial_members: Members of epoch 0 besides this node (e.g., the
+                statically configured peers)
+            coordinator: TPCCoordinator proposing changes (defaults to one
+                using the peer registry)
+        """
+        self.node_id = node_id
+        self.node_address = node_address
+        self.peer_registry = peer_registry
+        self.failure_detector = failure_detector
+        self.coordinator = coordinator or TPCCoordinator(
+            node_id, peer_registry
+        )
+        self.handler = MembershipChangeHandler(self)
+        members = dict(initial_members or {})
+        members[node_id] = node_address
+        self._view = MembershipView(0, members)
+        self._lock = threading.Lock()
+        # ID of the change this node voted READY on, until it is decided
+        self._pending: Optional[str] = None
+        self._listeners: List[ViewListener] = []
+
+    @property
+    def view(self) -> MembershipView:
+        """A copy of the current view."""
+        with self._lock:
+            return MembershipView.from_dict(self._view.to_dict())
+
+    @property
+    def epoch(self) -> int:
+        """The current view's epoch."""
+        with self._lock:
+            return self._view.epoch
+
+    def subscribe(self, listener: ViewListener) -> None:
+        """
+        Subscribe to installed views.
+
+        Args:
+            listener: Function taking the new MembershipView
+        """
+        self._listeners.append(listener)
+
+    def peers(self) -> List[str]:
+        """Get the IDs of the view's members other than this node, sorted."""
+        return [n for n in self.view.node_ids if n != self.node_id]
+
+    def live_members(self) -> List[str]:
+        """Get the view's members currently considered alive, sorted."""
+        return [n for n in self.view.node_ids if self._is_alive(n)]
+
+    def has_quorum(self) -> bool:
+        """Check whether a majority of the view's members is reachable."""
+        return self.view.has_quorum(self.live_members())
+
+    def install(self, view: MembershipView) -> bool:
+        """
+        Adopt a view if it is newer than the current one.
+
+        Members' addresses are registered in the peer registry, so every
+        member can be reached.
+
+        Args:
+            view: The view
+
+        Returns:
+            True if the view was installed
+        """
+        with self._lock:
+            if view.epoch <= self._view.epoch:
+                return False
+            self._view = view
+        if self.peer_registry is not None:
+            known = self.peer_registry.list_peers()
+            for node_id, address in view.members.items():
+                if node_id != self.node_id and known.get(node_id) != address:
+                    self.peer_registry.register_peer(node_id, address)
+        logger.info(
+            f"Installed membership epoch {view.epoch}: "
+            f"{', '.join(view.node_ids)}"
+        )
+        for listener in list(self._listeners):
+            try:
+                listener(view)
+            except Exception as e:
+                logger.error(f"Membership listener failed: {e}")
+        return True
+
+    def prepare_change(
+        self, transaction_id: str, view: MembershipView
+    ) -> Dict:
+        """
+        Vote on a proposed view.
+
+        Args:
+            transaction_id: The 2PC transaction ID
+            view: The proposed view
+
+        Returns:
+            dict: {'vote': 'READY'} or {'vote': 'ABORT', 'reason': str}
+        """
+        with self._lock:
+            if view.epoch <= self._view.epoch:
+                return {
+                    "vote": VOTE_ABORT,
+                    "reason": (
+                        f"Epoch {view.epoch} does not advance epoch "
+                        f"{self._view.epoch}"
+                    ),
+                }
+            if self._pending not in (None, transaction_id):
+                return {
+                    "vote": VOTE_ABORT,
+                    "reason": "Another membership change is in progress",
+                }
+            self._pending = transaction_id
+        return {"vote": VOTE_READY}
+
+    def commit_change(self, transaction_id: str, view: MembershipView) -> None:
+        """
+        Install a view whose change was committed.
+
+        Args:
+            transaction_id: The 2PC transaction ID
+            view: The committed view
+        """
+        self.abort_change(transaction_id)
+        self.install(view)
+
+    def abort_change(self, transaction_id: str) -> None:
+        """
+        Release a prepared change.
+
+        Args:
+            transaction_id: The 2PC transaction ID
+        """
+        with self._lock:
+            if self._pending == transaction_id:
+                self._pending = None
+
+    async def propose(
+        self, members: Dict[str, str]
+    ) -> Optional[CoordinatorTransaction]:
+        """
+        Propose the next view through 2PC, with every new member voting.
+
+        Args:
+            members: Maps node_id -> XML-RPC address of the new members
+
+        Returns:
+            The finished transaction, or None if the new members don't
+            include a quorum of the current view or a change is already
+            prepared here
+        """
+        current = self.view
+        if not current.has_quorum(members):
+            logger.warning(
+                f"Not proposing membership {', '.join(sorted(members))}: "
+                f"no quorum of epoch {current.epoch}"
+            )
+            return None
+
+        view = MembershipView(current.epoch + 1, dict(members))
+        transaction_id = str(uuid.uuid4())
+        if self.prepare_change(transaction_id, view)["vote"] != VOTE_READY:
+            return None
+
+        def on_decision(txn: CoordinatorTransaction) -> None:
+            """Install or release the view on this node."""
+            if txn.committed:
+                self.commit_change(transaction_id, view)
+            else:
+                self.abort_change(transaction_id)
+
+        logger.info(
+            f"Proposing membership epoch {view.epoch}: "
+            f"{', '.join(view.node_ids)}"
+        )
+        return await self.coordinator.execute(
+            MEMBERSHIP_CHANGE,
+            {"view": view.to_dict()},
+            [n for n in view.node_ids if n != self.node_id],
+            transaction_id=transaction_id,
+            on_decision=on_decision,
+        )
+
+    def observed_members(self) -> Dict[str, str]:
+        """
+        Get the members a new view should have: this node and its live
+        peers.
+
+        Returns:
+            dict: Maps node_id -> XML-RPC address
+        """
+        members = {self.node_id: self.node_address}
+        if self.peer_registry is not None:
+            for node_id, address in self.peer_registry.list_peers().items():
+                if self._is_alive(node_id):
+                    members[node_id] = address
+        return members
+
+    def is_proposer(self) -> bool:
+        """Check whether this node is the lowest-ID live node it knows."""
+        return min(self.observed_members()) == self.node_id
+
+    async def reconcile(self) -> Optional[CoordinatorTransaction]:
+        """
+        Propose a new view if this node is the proposer and the live nodes
+        differ from the current members.
+
+        Returns:
+            The finished transaction, or None if nothing was proposed
+        """
+        if not self.is_proposer():
+            return None
+        members = self.observed_members()
+        if members == self.view.members:
+            return None
+        return await self.propose(members)
+
+    def sync(self) -> bool:
+        """
+        Adopt the newest view held by any live peer.
+
+        Returns:
+            True if a newer view was installed
+        """
+        if self.peer_registry is None:
+            return False
+
+        installed = False
+        for node_id in self.peer_registry.list_peers():
+            if not self._is_alive(node_id):
+                continue
+            try:
+                data = self.peer_registry.call_peer(
+                    node_id, "get_membership_view"
+                )
+            except Exception as e:
+                logger.debug(f"Membership sync with {node_id} failed: {e}")
+                continue
+            if data and self.install(MembershipView.from_dict(data)):
+                installed = True
+        return installed
+
+    def _is_alive(self, node_id: str) -> bool:
+        """Check if a node is alive according to the failure detector."""
+        if node_id == self.node_id or self.failure_detector is None:
+            return True
+        return self.failure_detector.is_alive(node_id)
@@ -0,0 +1,73 @@
+"""
+Mentions
+
+A message naming a room member as @username mentions them. The admin
+node parses each unencrypted message when it is added (see
+RoomStateManager.add_message), and a message mentioning members carries
+"mentions": one {"username", "offset", "length"} per mention, in the
+order they appear, with the offset and length of "@username" in the
+content. Names that aren't members of the room are plain text, and a
+name followed by "." or "-" (e.g., at the end of a sentence) still
+mentions the member. Encrypted messages aren't parsed, since the admin
+can't read them; the mentions go and are replicated with the message,
+and are removed when it is deleted.
+
+Each node delivering a message sends a mention event to the local
+connections of every user it mentions, besides the new_message, also if
+they muted the room: a mention is meant to get through. Users who filter
+out or blocked the sender don't get it, and the sender mentioning
+themselves isn't notified.
+"""
+
+from typing import Dict, Iterable, List
+
+from .spam import MENTION_PATTERN
+
+
+def parse_mentions(content: str, members: Iterable[str]) -> List[Dict]:
+    """
+    Find the room members a message mentions.
+
+    Args:
+        content: The message text
+        members: Usernames of the room's members
+
+    Returns:
+        list: One {"username", "offset", "length"} per mention of a
+        member, in the order they appear
+    """
+    members = set(members)
+    mentions = []
+    for match in MENTION_PATTERN.finditer(content or ""):
+        name = match.group()[1:]
+        if name not in members:
+            name = name.rstrip(".-")
+        if name in members:
+            mentions.append(
+                {
+                    "username": name,
+                    "offset": match.start(),
+                    "length": len(name) + 1,
+                }
+            )
+    return mentions
+
+
+def mentioned_users(message: Dict) -> List[str]:
+    """
+    Get the users a message mentions.
+
+    Args:
+        message: The message data
+
+    Returns:
+        list: Usernames mentioned, each once, in the order first
+        mentioned, without the sender
+    """
+    users = []
+    for mention in message.get("mentions", ()):
+        username = mention.get("username")
+        if username and username != message.get("username"):
+            if username not in users:
+                users.append(username)
+    return users
@@ -0,0 +1,371 @@
+"""
+Message Streams Between Nodes
+
+The administrator of a room used to send each message to every peer in a
+call of its own (receive_message_broadcast), paying a round trip per
+message and peer. Each peer now gets a long-lived stream instead: a
+sender thread per peer that keeps its connection to the peer open and
+sends the messages queued for it in batches through
+receive_message_stream.
+
+- Batching: a call carries up to `batch_size` messages, everything that
+  queued up while the previous call was in flight.
+- Flow control: the receiver answers each call with the last stream
+  sequence number it has and its credit, the number of messages it takes
+  next (STREAM_WINDOW less its delivery backlog). The sender never sends
+  more than the credit, and asks again after STREAM_PAUSE while it is
+  zero. A stream holding `queue_size` messages makes send() wait, so a
+  slow peer slows down the fan-out pool instead of filling memory.
+- Re-establishment: messages stay queued until the receiver acknowledges
+  them. After a failed call the connection is dropped and the sender
+  retries on a new one, waiting STREAM_RETRY_DELAY doubled per failure up
+  to STREAM_MAX_RETRY_DELAY, from the first unacknowledged message; the
+  receiver skips messages it already has by their sequence number.
+
+Each stream has a random ID, so a sender that restarts opens a new
+stream rather than being mistaken for an old one. Peers speaking a
+protocol version before 10 get a receive_message_broadcast call per
+message, as before.
+"""
+
+import logging
+import threading
+import time
+import uuid
+from collections import deque
+from typing import Deque, Dict, List, Optional
+
+from .versioning import IncompatiblePeerError
+
+logger = logging.getLogger(__name__)
+
+# Stream configuration
+STREAM_BATCH_SIZE = 100  # messages per receive_message_stream call
+STREAM_QUEUE_SIZE = 10000  # unacknowledged messages before send() waits
+STREAM_WINDOW = 1000  # messages a receiver takes while not backlogged
+STREAM_PAUSE = 0.05  # seconds before asking a receiver with no credit again
+STREAM_RETRY_DELAY = 0.1  # seconds before the first reconnection attempt
+STREAM_MAX_RETRY_DELAY = 5.0  # longest wait between reconnection attempts
+
+
+class PeerStream:
+    """
+    One peer's stream: its queued messages and the thread sending them.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        peer_id: str,
+        peer_registry,
+        batch_size: int = STREAM_BATCH_SIZE,
+        queue_size: int = STREAM_QUEUE_SIZE,
+    ):
+        """
+        Initialize the stream; its thread starts with the first message.
+
+        Args:
+            node_id: ID of this node
+            peer_id: ID of the peer receiving the stream
+            peer_registry: PeerRegistry used to call the peer
+            batch_size: Most messages sent per call
+            queue_size: Unacknowledged messages before send() waits
+        """
+        self.node_id = node_id
+        self.peer_id = peer_id
+        self.peer_registry = peer_registry
+        self.batch_size = batch_size
+        self.queue_size = queue_size
+        self.stream_id = uuid.uuid4().hex
+        # (sequence number, room_id, message) not yet acknowledged
+        self._queue: Deque[tuple] = deque()
+        self._next_sequence = 1
+        self.acked = 0
+        self.credit = batch_size
+        self.connected = False
+        self.failures = 0
+        self._closed = False
+        self._thread: Optional[threading.Thread] = None
+        self._lock = threading.Condition()
+
+    @property
+    def queued(self) -> int:
+        """Number of messages sent or waiting but not yet acknowledged."""
+        return len(self._queue)
+
+    @property
+    def closed(self) -> bool:
+        """Whether the stream stopped taking messages."""
+        return self._closed
+
+    def send(self, room_id: str, message: Dict) -> bool:
+        """
+        Queue a message for the peer, waiting while the queue is full.
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+
+        Returns:
+            bool: True if queued, False if the stream was closed
+        """
+        with self._lock:
+            while len(self._queue) >= self.queue_size and not self._closed:
+                self._lock.wait()
+            if self._closed:
+                return False
+            self._queue.append((self._next_sequence, room_id, message))
+            self._next_sequence += 1
+            if self._thread is None:
+                self._thread = threading.Thread(
+                    target=self._run,
+                    name=f"stream-{self.peer_id}",
+                    daemon=True,
+                )
+                self._thread.start()
+            self._lock.notify_all()
+            return True
+
+    def close(self, timeout: Optional[float] = None) -> None:
+        """
+        Stop taking messages and let the thread send the queued ones.
+
+        Args:
+            timeout: Seconds to wait for the thread
+        """
+        with self._lock:
+            self._closed = True
+            self._lock.notify_all()
+            thread = self._thread
+        if thread is not None:
+            thread.join(timeout)
+
+    def status(self) -> Dict:
+        """
+        Describe the stream.
+
+        Returns:
+            dict: stream_id, queued, acked, credit, connected and failures
+        """
+        return {
+            "stream_id": self.stream_id,
+            "queued": self.queued,
+            "acked": self.acked,
+            "credit": self.credit,
+            "connected": self.connected,
+            "failures": self.failures,
+        }
+
+    def _run(self) -> None:
+        """Send batches until the stream is closed and acknowledged."""
+        delay = STREAM_RETRY_DELAY
+        while True:
+            with self._lock:
+                while not self._queue and not self._closed:
+                    self._lock.wait()
+                if not self._queue:
+                    return
+                if self._closed and self.failures and not self.connected:
+                    logger.warning(
+                        f"Dropping {len(self._queue)} messages streamed to "
+                        f"unreachable peer {self.peer_id}"
+                    )
+                    return
+                count = min(self.batch_size, self.credit)
+                batch = [list(item) for item in list(self._queue)[:count]]
+            try:
+                self._send_batch(batch)
+            except ValueError:
+                # The peer left the registry
+                with self._lock:
+                    self._closed = True
+                    self._queue.clear()
+                    self._lock.notify_all()
+                return
+            except Exception as e:
+                if self.connected or not self.failures:
+                    logger.warning(
+                        f"Message stream to {self.peer_id} failed: {e}"
+                    )
+                self.connected = False
+                self.failures += 1
+                with self._lock:
+                    self._lock.wait_for(lambda: self._closed, delay)
+                delay = min(delay * 2, STREAM_MAX_RETRY_DELAY)
+                continue
+            if not self.connected and self.failures:
+                logger.info(f"Message stream to {self.peer_id} re-established")
+            self.connected = True
+            delay = STREAM_RETRY_DELAY
+            if not self.credit:
+                time.sleep(STREAM_PAUSE)
+
+    def _send_batch(self, batch: List[list]) -> None:
+        """Send one batch and drop the messages the peer acknowledged."""
+        try:
+            result = self.peer_registry.call_peer(
+                self.peer_id,
+                "receive_message_stream",
+                self.node_id,
+                self.stream_id,
+                batch,
+            )
+            acked = result.get("acked", 0)
+            credit = result.get("credit", self.batch_size)
+        except IncompatiblePeerError:
+            for _, room_id, message in batch:
+                self.peer_registry.call_peer(
+                    self.peer_id, "receive_message_broadcast", room_id, message
+                )
+            acked = batch[-1][0] if batch else self.acked
+            credit = self.batch_size
+        with self._lock:
+            while self._queue and self._queue[0][0] <= acked:
+                self._queue.popleft()
+            self.acked = max(self.acked, acked)
+            self.credit = max(0, min(credit, self.batch_size))
+            self._lock.notify_all()
+
+
+class MessageStreams:
+    """
+    The message streams from this node to each of its peers.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        peer_registry,
+        batch_size: int = STREAM_BATCH_SIZE,
+        queue_size: int = STREAM_QUEUE_SIZE,
+    ):
+        """
+        Initialize the streams.
+
+        Args:
+            node_id: ID of this node
+            peer_registry: PeerRegistry listing the peers
+            batch_size: Most messages sent per call
+            queue_size: Unacknowledged messages per peer before send()
+                waits
+        """
+        if batch_size < 1 or queue_size < 1:
+            raise ValueError("batch_size and queue_size must be at least 1")
+        self.node_id = node_id
+        self.peer_registry = peer_registry
+        self.batch_size = batch_size
+        self.queue_size = queue_size
+        self._streams: Dict[str, PeerStream] = {}
+        self._lock = threading.Lock()
+
+    def send(self, room_id: str, message: Dict) -> None:
+        """
+        Stream a room message to every peer.
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+        """
+        peers = self.peer_registry.list_peers()
+        with self._lock:
+            for peer_id in [p for p in self._streams if p not in peers]:
+                self._streams.pop(peer_id).close(timeout=0)
+            streams = []
+            for peer_id in peers:
+                stream = self._streams.get(peer_id)
+                if stream is None or stream.closed:
+                    stream = self._streams[peer_id] = PeerStream(
+                        self.node_id,
+                        peer_id,
+                        self.peer_registry,
+                        self.batch_size,
+                        self.queue_size,
+                    )
+                streams.append(stream)
+        for stream in streams:
+            stream.send(room_id, message)
+
+    def status(self) -> Dict[str, Dict]:
+        """
+        Describe each peer's stream.
+
+        Returns:
+            dict: Peer ID -> the stream's status
+        """
+        with self._lock:
+            streams = dict(self._streams)
+        return {peer: stream.status() for peer, stream in streams.items()}
+
+    def shutdown(self, timeout: Optional[float] = None) -> None:
+        """
+        Close every stream after sending what it has queued.
+
+        Args:
+            timeout: Seconds to wait for each stream's thread
+        """
+        with self._lock:
+            streams = list(self._streams.values())
+            self._streams.clear()
+        for stream in streams:
+            stream.close(timeout)
+
+
+class StreamReceiver:
+    """
+    The receiving end of the streams from peers: the last sequence number
+    taken from each sender's current stream.
+    """
+
+    def __init__(self, window: int = STREAM_WINDOW):
+        """
+        Initialize the receiver.
+
+        Args:
+            window: Messages taken at a time while nothing is backlogged
+        """
+        self.window = window
+        # Maps sender node_id -> (stream_id, last sequence number taken)
+        self._streams: Dict[str, tuple] = {}
+        # Maps sender node_id -> lock serializing its batches, so a batch
+        # retried while the first attempt is still delivering waits
+        self._locks: Dict[str, threading.Lock] = {}
+        self._lock = threading.Lock()
+
+    def receive(self, sender: str, stream_id: str, batch, deliver) -> int:
+        """
+        Deliver the messages of a batch the sender's stream hasn't had.
+
+        Args:
+            sender: ID of the sending node
+            stream_id: ID of the sender's stream
+            batch: [sequence number, room_id, message] items
+            deliver: Function taking (room_id, message)
+
+        Returns:
+            int: The last sequence number taken from the stream
+        """
+        with self._lock:
+            lock = self._locks.setdefault(sender, threading.Lock())
+        with lock:
+            current, last = self._streams.get(sender, (stream_id, 0))
+            if current != stream_id:
+                last = 0
+            for sequence, room_id, message in batch:
+                if sequence <= last:
+                    continue
+                deliver(room_id, message)
+                last = sequence
+            self._streams[sender] = (stream_id, last)
+            return last
+
+    def credit(self, backlog: int = 0) -> int:
+        """
+        Get the number of messages a sender may send next.
+
+        Args:
+            backlog: Deliveries waiting on this node
+
+        Returns:
+            int: The window less the backlog, at least 0
+        """
+        return max(0, self.window - backlog)
@@ -0,0 +1,793 @@
+"""
+Prometheus Metrics
+
+Counters, gauges and histograms describing a node, rendered in the
+Prometheus text exposition format and served at GET /metrics by
+MetricsServer. They are implemented with the standard library, so nodes
+need no Prometheus client package.
+
+Event metrics are recorded by the components that see the events: the RPC
+client pool times every call to a peer (inter-node calls use XML-RPC, so
+these are the node's RPC latencies), the 2PC coordinator counts transaction
+outcomes, the failure detector counts missed heartbeats, anti-entropy
+counts room directory divergence after partitions and the latency router
+counts which node served requests several could (see routing.py). State
+metrics (connected clients, messages per room, WebSocket send queue depth
+and heartbeat round-trip times) are read from the live objects through
+callbacks on every scrape.
+
+Given a HealthChecker, the server also answers the /healthz and /readyz
+probes (see health.py).
+"""
+
+import bisect
+import json
+import logging
+import math
+import threading
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from threading import Thread
+from typing import Any, Callable, Dict, List, Optional, Sequence, Tuple
+
+from .health import HealthChecker, probe_response
+from .peer_connections import CIRCUIT_STATES
+
+logger = logging.getLogger(__name__)
+
+# Metrics configuration
+DEFAULT_METRICS_PORT = 9100  # 0 disables the endpoint
+METRICS_PATH = "/metrics"
+CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+# Latency buckets in seconds, as used by the Prometheus client libraries
+DEFAULT_BUCKETS = (
+    0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0
+)
+
+LabelValues = Tuple[str, ...]
+
+
+def _format_value(value: float) -> str:
+    """Format a sample value for the text exposition format."""
+    if math.isinf(value):
+        return "+Inf" if value > 0 else "-Inf"
+    if float(value).is_integer():
+        return str(int(value))
+    return repr(float(value))
+
+
+def _format_labels(names: Sequence[str], values: Sequence[str]) -> str:
+    """Format label pairs as {name="value",...}, escaping the values."""
+    if not names:
+        return ""
+    pairs = []
+    for name, value in zip(names, values):
+        escaped = (
+            str(value)
+            .replace("\\", "\\\\")
+            .replace("\n", "\\n")
+            .replace('"', '\\"')
+        )
+        pairs.append(f'{name}="{escaped}"')
+    return "{" + ",".join(pairs) + "}"
+
+
+class Metric:
+    """
+    A named metric family with optional labels.
+
+    Values are either recorded on the metric or, when a function is
+    given, read from it on every scrape. The function returns a single
+    value for metrics without labels, or a dict mapping tuples of label
+    values to values.
+    """
+
+    kind = "untyped"
+
+    def __init__(
+        self,
+        name: str,
+        help_text: str,
+        labels: Sequence[str] = (),
+        function: Optional[Callable] = None,
+    ):
+        """
+        Initialize the metric.
+
+        Args:
+            name: Metric name (e.g., "chat_connected_clients")
+            help_text: One-line description shown in the HELP line
+            labels: Names of the metric's labels
+            function: Optional callback providing the values on scrape
+        """
+        self.name = name
+        self.help_text = help_text
+        self.labels = tuple(labels)
+        self.function = function
+        self._lock = threading.Lock()
+        self._values: Dict[LabelValues, float] = {}
+
+    def _key(self, labels: Dict[str, str]) -> LabelValues:
+        """Get the label values of a sample in label order."""
+        if set(labels) != set(self.labels):
+            raise ValueError(
+                f"Metric {self.name} expects labels {list(self.labels)}"
+            )
+        return tuple(str(labels[name]) for name in self.labels)
+
+    def samples(self) -> Dict[LabelValues, float]:
+        """
+        Get the current samples of the metric.
+
+        Returns:
+            Dict mapping tuples of label values to values
+        """
+        if self.function is not None:
+            values = self.function()
+            if not isinstance(values, dict):
+                return {(): float(values)}
+            return {
+                tuple(str(v) for v in key): float(value)
+                for key, value in values.items()
+            }
+        with self._lock:
+            return dict(self._values)
+
+    def value(self, **labels) -> float:
+        """Get the value of one sample (0 if it was never recorded)."""
+        return self.samples().get(self._key(labels), 0.0)
+
+    def render(self) -> List[str]:
+        """Render the metric family in the text exposition format."""
+        lines = [
+            f"# HELP {self.name} {self.help_text}",
+            f"# TYPE {self.name} {self.kind}",
+        ]
+        for key, value in sorted(self.samples().items()):
+            lines.append(
+                f"{self.name}{_format_labels(self.labels, key)} "
+                f"{_format_value(value)}"
+            )
+        return lines
+
+
+class Counter(Metric):
+    """A value that only goes up, such as a count of events."""
+
+    kind = "counter"
+
+    def inc(self, amount: float = 1.0, **labels) -> None:
+        """
+        Increase the counter.
+
+        Args:
+            amount: Non-negative amount to add
+            **labels: Value of each of the metric's labels
+
+        Raises:
+            ValueError: If the amount is negative or labels don't match
+        """
+        if amount < 0:
+            raise ValueError("Counters can only be increased")
+        key = self._key(labels)
+        with self._lock:
+            self._values[key] = self._values.get(key, 0.0) + amount
+
+
+class Gauge(Metric):
+    """A value that can go up and down, such as a queue depth."""
+
+    kind = "gauge"
+
+    def set(self, value: float, **labels) -> None:
+        """
+        Set the gauge.
+
+        Args:
+            value: The new value
+            **labels: Value of each of the metric's labels
+        """
+        key = self._key(labels)
+        with self._lock:
+            self._values[key] = float(value)
+
+
+class Histogram(Metric):
+    """Observations counted in buckets, such as call latencies."""
+
+    kind = "histogram"
+
+    def __init__(
+        self,
+        name: str,
+        help_text: str,
+        labels: Sequence[str] = (),
+        buckets: Sequence[float] = DEFAULT_BUCKETS,
+    ):
+        """
+        Initialize the histogram.
+
+        Args:
+            name: Metric name (e.g., "chat_rpc_duration_seconds")
+            help_text: One-line description shown in the HELP line
+            labels: Names of the metric's labels
+            buckets: Upper bounds of the buckets; +Inf is always added
+        """
+        super().__init__(name, help_text, labels)
+        self.buckets = tuple(sorted(buckets))
+        # label values -> observations per bucket (not cumulative), with
+        # the last entry counting observations above every bound
+        self._counts: Dict[LabelValues, List[int]] = {}
+        self._sums: Dict[LabelValues, float] = {}
+
+    def observe(self, value: float, **labels) -> None:
+        """
+        Record an observation.
+
+        Args:
+            value: The observed value (e.g., seconds)
+            **labels: Value of each of the metric's labels
+        """
+        key = self._key(labels)
+        with self._lock:
+            counts = self._counts.setdefault(
+                key, [0] * (len(self.buckets) + 1)
+            )
+            counts[bisect.bisect_left(self.buckets, value)] += 1
+            self._sums[key] = self._sums.get(key, 0.0) + value
+
+    def count(self, **labels) -> int:
+        """Get the number of observations of one sample."""
+        with self._lock:
+            return sum(self._counts.get(self._key(labels), []))
+
+    def render(self) -> List[str]:
+        """Render buckets, sum and count in the text exposition format."""
+        lines = [
+            f"# HELP {self.name} {self.help_text}",
+            f"# TYPE {self.name} {self.kind}",
+        ]
+        with self._lock:
+            counts = {key: list(value) for key, value in self._counts.items()}
+            sums = dict(self._sums)
+        bounds = self.buckets + (math.inf,)
+        for key in sorted(counts):
+            cumulative = 0
+            for bound, count in zip(bounds, counts[key]):
+                cumulative += count
+                labels = _format_labels(
+                    self.labels + ("le",), key + (_format_value(bound),)
+                )
+                lines.append(f"{self.name}_bucket{labels} {cumulative}")
+            labels = _format_labels(self.labels, key)
+            lines.append(
+                f"{self.name}_sum{labels} {_format_value(sums[key])}"
+            )
+            lines.append(f"{self.name}_count{labels} {cumulative}")
+        return lines
+
+
+class MetricsRegistry:
+    """
+    Collection of metric families rendered together on a scrape.
+    """
+
+    def __init__(self):
+        """Initialize an empty registry."""
+        self._lock = threading.Lock()
+        self._metrics: Dict[str, Metric] = {}
+
+    def register(self, metric: Metric) -> Metric:
+        """
+        Add a metric to the registry.
+
+        Args:
+            metric: The metric to add
+
+        Returns:
+            The metric
+
+        Raises:
+            ValueError: If a metric with the same name is registered
+        """
+        with self._lock:
+            if metric.name in self._metrics:
+                raise ValueError(f"Metric {metric.name} already registered")
+            self._metrics[metric.name] = metric
+        return metric
+
+    def counter(
+        self,
+        name: str,
+        help_text: str,
+        labels: Sequence[str] = (),
+        function: Optional[Callable] = None,
+    ) -> Counter:
+        """Create and register a counter."""
+        return self.register(Counter(name, help_text, labels, function))
+
+    def gauge(
+        self,
+        name: str,
+        help_text: str,
+        labels: Sequence[str] = (),
+        function: Optional[Callable] = None,
+    ) -> Gauge:
+        """Create and register a gauge."""
+        return self.register(Gauge(name, help_text, labels, function))
+
+    def histogram(
+        self,
+        name: str,
+        help_text: str,
+        labels: Sequence[str] = (),
+        buckets: Sequence[float] = DEFAULT_BUCKETS,
+    ) -> Histogram:
+        """Create and register a histogram."""
+        return self.register(Histogram(name, help_text, labels, buckets))
+
+    def get(self, name: str) -> Optional[Metric]:
+        """Get a registered metric by name."""
+        with self._lock:
+            return self._metrics.get(name)
+
+    def render(self) -> str:
+        """
+        Render every metric in the text exposition format.
+
+        A metric whose callback fails is left out of the scrape.
+
+        Returns:
+            The body of a /metrics response
+        """
+        with self._lock:
+            metrics = list(self._metrics.values())
+        lines = []
+        for metric in metrics:
+            try:
+                lines.extend(metric.render())
+            except Exception as e:
+                logger.warning(f"Error collecting metric {metric.name}: {e}")
+        return "\n".join(lines) + "\n"
+
+
+class NodeMetrics:
+    """
+    The metrics exported by a chat node.
+
+    Shared by the components that record events; the WebSocket server
+    attaches the state metrics of its clients and rooms.
+    """
+
+    def __init__(self, registry: Optional[MetricsRegistry] = None):
+        """
+        Initialize the node's metrics.
+
+        Args:
+            registry: Optional registry to add the metrics to
+        """
+        self.registry = registry or MetricsRegistry()
+        self.rpc_duration = self.registry.histogram(
+            "chat_rpc_duration_seconds",
+            "Latency of RPC calls to peer nodes",
+            ("method", "outcome"),
+        )
+        self.tpc_transactions = self.registry.counter(
+            "chat_tpc_transactions_total",
+            "Two-phase commit transactions coordinated by this node",
+            ("operation", "outcome"),
+        )
+        self.heartbeat_failures = self.registry.counter(
+            "chat_heartbeat_failures_total",
+            "Heartbeats to peer nodes that got no response",
+            ("peer",),
+        )
+        self.directory_syncs = self.registry.counter(
+            "chat_directory_sync_rounds_total",
+            "Room directory anti-entropy reconciliations with peers",
+            ("outcome",),
+        )
+        self.directory_divergence = self.registry.counter(
+            "chat_directory_divergent_entries_total",
+            "Room directory entries found missing or stale by anti-entropy",
+            ("kind",),
+        )
+        self.send_queue_overflows = self.registry.counter(
+            "chat_websocket_send_queue_overflows_total",
+            "Messages that found a client's send queue full",
+            ("policy",),
+        )
+        self.redirects = self.registry.counter(
+            "chat_client_redirects_total",
+            "New WebSocket clients redirected to a less-loaded node",
+            ("target",),
+        )
+        self.compression_input = self.registry.counter(
+            "chat_compression_input_bytes_total",
+            "Bytes of compressed bodies and messages before compression",
+            ("channel",),
+        )
+        self.compression_saved = self.registry.counter(
+            "chat_compression_saved_bytes_total",
+            "Bytes saved by compressing bodies and messages",
+            ("channel",),
+        )
+        self.compression_skipped = self.registry.counter(
+            "chat_compression_skipped_total",
+            "Bodies and messages sent uncompressed for being too small",
+            ("channel",),
+        )
+        self.routing_decisions = self.registry.counter(
+            "chat_routing_decisions_total",
+            "Requests several nodes could serve, by the node that served",
+            ("purpose", "peer"),
+        )
+        self.routing_fallbacks = self.registry.counter(
+            "chat_routing_fallbacks_total",
+            "Nodes a routed request was tried on that couldn't serve it",
+            ("purpose",),
+        )
+
+    def observe_rpc(self, method: str, seconds: float, ok: bool) -> None:
+        """
+        Record the latency of an RPC call to a peer.
+
+        Args:
+            method: Name of the remote method
+            seconds: Duration of the call
+            ok: Whether the call returned (False if it raised)
+        """
+        outcome = "ok" if ok else "error"
+        self.rpc_duration.observe(seconds, method=method, outcome=outcome)
+
+    def record_transaction(self, operation: str, outcome: str) -> None:
+        """
+        Count a decided 2PC transaction.
+
+        Args:
+            operation: The transaction's operation (e.g., "delete_room")
+            outcome: "commit" or "rollback"
+        """
+        self.tpc_transactions.inc(operation=operation, outcome=outcome)
+
+    def record_heartbeat_failure(self, peer: str) -> None:
+        """
+        Count a missed heartbeat.
+
+        Args:
+            peer: Node ID of the peer that didn't respond
+        """
+        self.heartbeat_failures.inc(peer=peer)
+
+    def record_directory_sync(
+        self, outcome: str, missing: int = 0, stale: int = 0
+    ) -> None:
+        """
+        Count an anti-entropy reconciliation and the divergence it found.
+
+        Args:
+            outcome: "in_sync", "repaired" or "error"
+            missing: Entries only one of the two nodes had
+            stale: Entries the two nodes had different versions of
+        """
+        self.directory_syncs.inc(outcome=outcome)
+        if missing:
+            self.directory_divergence.inc(missing, kind="missing")
+        if stale:
+            self.directory_divergence.inc(stale, kind="stale")
+
+    def record_send_queue_overflow(self, policy: str) -> None:
+        """
+        Count a message that found a client's send queue full.
+
+        Args:
+            policy: The policy applied: "drop_oldest", "drop_newest" or
+                "disconnect"
+        """
+        self.send_queue_overflows.inc(policy=policy)
+
+    def record_redirect(self, target: str) -> None:
+        """
+        Count a new client redirected because this node is overloaded.
+
+        Args:
+            target: Node ID of the peer the client was sent to
+        """
+        self.redirects.inc(target=target)
+
+    def record_compression(
+        self, channel: str, size: int, compressed: Optional[int] = None
+    ) -> None:
+        """
+        Count a body or message that was compressed or was too small.
+
+        Args:
+            channel: "rpc" (bodies sent to peers) or "websocket"
+                (messages sent to clients)
+            size: Bytes before compression
+            compressed: Bytes after compression (None if it was sent
+                uncompressed for being under the threshold)
+        """
+        if compressed is None:
+            self.compression_skipped.inc(channel=channel)
+            return
+        self.compression_input.inc(size, channel=channel)
+        self.compression_saved.inc(max(0, size - compressed), channel=channel)
+
+    def record_route(self, purpose: str, peer: str, fallbacks: int) -> None:
+        """
+        Count a request routed to the nearest node able to serve it.
+
+        Args:
+            purpose: What the request was for (e.g., "history")
+            peer: Node ID of the node that served it
+            fallbacks: Nodes tried before it that couldn't serve it
+        """
+        self.routing_decisions.inc(purpose=purpose, peer=peer)
+        if fallbacks:
+            self.routing_fallbacks.inc(fallbacks, purpose=purpose)
+
+    def track_clients(self, connections) -> None:
+        """
+        Export the connected clients and their send queues.
+
+        A client's messages wait in two places: its bounded send queue
+        of messages, and the data written to its WebSocket that the
+        transport hasn't sent yet.
+
+        Args:
+            connections: ConnectionRegistry of the WebSocket server
+        """
+
+        def queue_sizes() -> List[int]:
+            sizes = []
+            for connection in connections.list_connections():
+                transport = getattr(connection.websocket, "transport", None)
+                if transport is not None:
+                    sizes.append(transport.get_write_buffer_size())
+            return sizes
+
+        def queue_depths() -> List[int]:
+            return [
+                connection.send_queue.depth
+                for connection in connections.list_connections()
+                if connection.send_queue is not None
+            ]
+
+        self.registry.gauge(
+            "chat_connected_clients",
+            "WebSocket clients connected to this node",
+            function=lambda: len(connections),
+        )
+        self.registry.gauge(
+            "chat_websocket_send_queue_bytes",
+            "Bytes queued for sending across all WebSocket clients",
+            function=lambda: sum(queue_sizes()),
+        )
+        self.registry.gauge(
+            "chat_websocket_send_queue_max_bytes",
+            "Bytes queued for sending to the most backed-up client",
+            function=lambda: max(queue_sizes(), default=0),
+        )
+        self.registry.gauge(
+            "chat_websocket_send_queue_messages",
+            "Messages queued for sending across all WebSocket clients",
+            function=lambda: sum(queue_depths()),
+        )
+        self.registry.gauge(
+            "chat_websocket_send_queue_max_messages",
+            "Messages queued for sending to the most backed-up client",
+            function=lambda: max(queue_depths(), default=0),
+        )
+
+    def track_dispatch(self, pools: Dict[str, Any]) -> None:
+        """
+        Export the jobs waiting in the dispatch pools (see dispatch.py).
+
+        Args:
+            pools: KeyedDispatcher or KeyedWorkerPool by pool name; pools
+                that are None are left out
+        """
+        self.registry.gauge(
+            "chat_dispatch_pending_jobs",
+            "Jobs waiting or running in a dispatch pool",
+            ("pool",),
+            function=lambda: {
+                (name,): pool.pending
+                for name, pool in pools.items()
+                if pool is not None
+            },
+        )
+
+    def track_streams(self, streams) -> None:
+        """
+        Export the messages each peer's stream hasn't had acknowledged.
+
+        Args:
+            streams: MessageStreams of this node
+        """
+        self.registry.gauge(
+            "chat_peer_stream_queued_messages",
+            "Messages queued for a peer's stream and not yet acknowledged",
+            ("peer",),
+            function=lambda: {
+                (peer,): status["queued"]
+                for peer, status in streams.status().items()
+            },
+        )
+
+    def track_peer_connections(self, peer_registry) -> None:
+        """
+        Export the circuit state and failed calls of each peer connection.
+
+        Args:
+            peer_registry: PeerRegistry of this node
+        """
+
+        def connections():
+            statuses = {}
+            for peer in peer_registry.list_peers():
+                status = peer_registry.connection_status(peer)
+                if status is not None:
+                    statuses[(peer,)] = status
+            return statuses
+
+        self.registry.gauge(
+            "chat_peer_circuit_state",
+            "Circuit breaker of a peer connection (0 closed, 1 half open, "
+            "2 open)",
+            ("peer",),
+            function=lambda: {
+                key: CIRCUIT_STATES.index(status["state"])
+                for key, status in connections().items()
+            },
+        )
+        self.registry.gauge(
+            "chat_peer_consecutive_failures",
+            "Failed calls in a row to a peer",
+            ("peer",),
+            function=lambda: {
+                key: status["failures"]
+                for key, status in connections().items()
+            },
+        )
+
+    def track_clock_skew(self, skew_monitor) -> None:
+        """
+        Export the estimated clock skew of each peer.
+
+        Args:
+            skew_monitor: ClockSkewMonitor of this node
+        """
+        self.registry.gauge(
+            "chat_peer_clock_skew_seconds",
+            "Seconds a peer's clock is estimated to be ahead of this node's",
+            ("peer",),
+            function=lambda: {
+                (peer,): skew
+                for peer, skew in skew_monitor.estimates().items()
+            },
+        )
+
+    def track_peer_rtt(self, failure_detector) -> None:
+        """
+        Export the smoothed heartbeat round-trip time to each peer.
+
+        Args:
+            failure_detector: FailureDetector of this node
+        """
+        self.registry.gauge(
+            "chat_peer_rtt_seconds",
+            "Smoothed round-trip time of heartbeats to a peer",
+            ("peer",),
+            function=lambda: {
+                (status["node_id"],): status["avg_rtt"]
+                for status in failure_detector.list_statuses()
+                if status["avg_rtt"] is not None
+            },
+        )
+
+    def track_rooms(self, room_manager) -> None:
+        """
+        Export the number of messages of each room hosted here.
+
+        Args:
+            room_manager: RoomStateManager of this node
+        """
+        self.registry.counter(
+            "chat_room_messages_total",
+            "Messages sequenced in rooms administered by this node",
+            ("room_id",),
+            function=lambda: {
+                (room_id,): count
+                for room_id, count in room_manager.message_counts().items()
+            },
+        )
+
+
+class MetricsServer:
+    """
+    HTTP server exposing a metrics registry at GET /metrics, and the
+    health probes at GET /healthz and /readyz.
+    """
+
+    def __init__(
+        self,
+        registry: MetricsRegistry,
+        host: str = "0.0.0.0",
+        port: int = DEFAULT_METRICS_PORT,
+        health: Optional[HealthChecker] = None,
+    ):
+        """
+        Initialize the metrics server.
+
+        Args:
+            registry: The registry to render on each scrape
+            host: Host address to bind to
+            port: Port to listen on
+            health: Optional HealthChecker answering /healthz and /readyz
+        """
+        self.registry = registry
+        self.health = health
+        self.host = host
+        self.port = port
+        self.server: Optional[ThreadingHTTPServer] = None
+        self.server_thread: Optional[Thread] = None
+
+    def _handler(self):
+        """Build the request handler class bound to the registry."""
+        registry = self.registry
+        health = self.health
+
+        class MetricsHandler(BaseHTTPRequestHandler):
+            def do_GET(self):
+                path = self.path.split("?", 1)[0]
+                probe = probe_response(health, path)
+                if probe is not None:
+                    status, result = probe
+                    self._send(status, "application/json", json.dumps(result))
+                    return
+                if path != METRICS_PATH:
+                    self.send_error(404)
+                    return
+                self._send(200, CONTENT_TYPE, registry.render())
+
+            def _send(self, status, content_type, text):
+                body = text.encode()
+                self.send_response(status)
+                self.send_header("Content-Type", content_type)
+                self.send_header("Content-Length", str(len(body)))
+                self.end_headers()
+                self.wfile.write(body)
+
+            def log_message(self, format, *args):
+                logger.debug(f"Metrics request: {format % args}")
+
+        return MetricsHandler
+
+    def start(self):
+        """Start the metrics server in a background thread."""
+        self.server = ThreadingHTTPServer(
+            (self.host, self.port), self._handler()
+        )
+        self.server.daemon_threads = True
+        self.port = self.server.server_address[1]
+
+        self.server_thread = Thread(
+            target=self.server.serve_forever, daemon=True
+        )
+        self.server_thread.start()
+
+        logger.info(
+            f"Metrics server listening on "
+            f"http://{self.host}:{self.port}{METRICS_PATH}"
+        )
+
+    def stop(self):
+        """Stop the metrics server."""
+        if self.server:
+            logger.info("Stopping metrics server")
+            self.server.shutdown()
+            self.server.server_close()
+            if self.server_thread:
+                self.server_thread.join(timeout=2)
+            logger.info("Metrics server stopped")
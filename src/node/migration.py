@@ -0,0 +1,413 @@
+#!/usr/bin/env python3
+"""
+Room Migration
+
+Moves a hosted room to another node on an operator's command, for manual
+rebalancing. The migration is started with POST
+/admin/rooms/<room_id>/migrate?node=<target> on the room's admin node, by
+hand or with this module's command:
+
+    python -m src.node.migration <room_id> <target_node> \\
+        --url http://127.0.0.1:9200
+
+The room moves the way sharding moves rooms (see sharding.py): the target
+receives a snapshot of the room's full state and takes the room over,
+switching the room's admin in the Raft room registry, when there is one,
+before it announces itself as the new admin to every node; this node
+then keeps a replica for the room's members connected here. The
+registry entry changes in one committed Raft command, so every node
+resolves the room to the old or the new admin, never to both.
+
+Requests on the room are paused while it moves:
+
+- New requests from clients connected here, and the calls of peers
+  changing the room (PAUSED_METHODS), wait for the migration to finish,
+  for at most MIGRATION_PAUSE seconds. Requests already being handled
+  are finished first; the room isn't snapshotted until they are.
+- Once the room has moved, clients' requests are forwarded to the new
+  admin, and peers' calls are answered with ROOM_MOVED, naming it, so
+  they call it instead.
+- A request that waited MIGRATION_PAUSE seconds is refused with
+  ROOM_MIGRATING, and can be retried.
+
+A migration to a node the room's placement constraints exclude (see
+placement.py), or with sharding to a node other than the room's owner on
+the hash ring, is refused: placement or sharding would move it back.
+"""
+
+import argparse
+import json
+import logging
+import os
+import sys
+import threading
+import time
+from typing import Any, Callable, Dict, Optional, Sequence, Set, Tuple
+from urllib.error import HTTPError, URLError
+from urllib.parse import quote
+from urllib.request import Request, urlopen
+
+from .audit import ROOM_MIGRATED, audit
+from .placement import matches
+from .room_state import RoomState
+from .sharding import move_room
+
+logger = logging.getLogger(__name__)
+
+# Migration configuration
+MIGRATION_PAUSE = 5  # seconds a request waits for a migration
+DEFAULT_ADMIN_URL = "http://127.0.0.1:9200"
+
+# NodeService methods changing a hosted room, paused while it moves
+PAUSED_METHODS = frozenset(
+    {
+        "join_room",
+        "join_room_by_invite",
+        "create_room_invite",
+        "revoke_room_invite",
+        "leave_room",
+        "merge_room_members",
+        "moderate_member",
+        "set_member_role",
+        "set_room_retention",
+        "set_spam_thresholds",
+        "set_content_filters",
+        "edit_message",
+        "pin_message",
+        "schedule_message",
+        "cancel_scheduled",
+        "update_room_metadata",
+        "react",
+        "mark_read",
+        "publish_key",
+        "forward_message",
+        "register_webhook",
+        "remove_webhook",
+        "set_room_bot",
+        "add_bridge",
+        "remove_bridge",
+    }
+)
+
+# Error codes of requests paused by a migration
+ROOM_MIGRATING = "ROOM_MIGRATING"
+ROOM_MOVED = "ROOM_MOVED"
+
+
+def _error(error: str, error_code: str, **fields) -> Dict:
+    """Build an error result."""
+    return {
+        "success": False,
+        "error": error,
+        "error_code": error_code,
+        **fields,
+    }
+
+
+class RoomMigrator:
+    """
+    Migrates hosted rooms to other nodes, pausing requests on them.
+
+    Thread-safe: requests are admitted from the event loop and XML-RPC
+    worker threads while a migration runs on another thread.
+    """
+
+    def __init__(
+        self,
+        room_manager,
+        failover,
+        sharding=None,
+        pause: float = MIGRATION_PAUSE,
+    ):
+        """
+        Initialize the migrator.
+
+        Args:
+            room_manager: RoomStateManager hosting the rooms
+            failover: RoomFailover handing rooms off
+            sharding: Optional RoomSharding whose ring owners rooms must
+                be migrated to
+            pause: Seconds a request waits for a migration
+        """
+        self.room_manager = room_manager
+        self.failover = failover
+        self.sharding = sharding
+        self.pause = pause
+        self._condition = threading.Condition()
+        self._migrating: Set[str] = set()
+        # Maps room_id -> requests being handled
+        self._in_flight: Dict[str, int] = {}
+        # Maps room_id -> (node ID, address) of the node it moved to
+        self._moved: Dict[str, Tuple[str, str]] = {}
+
+    def is_migrating(self, room_id: str) -> bool:
+        """Check whether a room is being migrated."""
+        with self._condition:
+            return room_id in self._migrating
+
+    def wait(self, room_id: str) -> bool:
+        """
+        Wait for a room's migration, if any, to finish.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            True unless the room was still migrating after the pause
+        """
+        with self._condition:
+            return self._condition.wait_for(
+                lambda: room_id not in self._migrating, self.pause
+            )
+
+    def enter(self, room_id: str, timeout: Optional[float] = None):
+        """
+        Admit a request on a room, waiting for its migration if any.
+
+        A request admitted (None returned) counts as being handled until
+        leave() is called.
+
+        Args:
+            room_id: The room ID
+            timeout: Seconds to wait (defaults to the pause)
+
+        Returns:
+            None if admitted, or a ROOM_MIGRATING error, or a ROOM_MOVED
+            error with the admin_node and node_address it moved to
+        """
+        with self._condition:
+            if not self._condition.wait_for(
+                lambda: room_id not in self._migrating,
+                self.pause if timeout is None else timeout,
+            ):
+                return _error(
+                    f"Room {room_id} is being migrated, try again",
+                    ROOM_MIGRATING,
+                )
+            moved = self._moved.get(room_id)
+            if moved and self.room_manager.get_room(room_id) is None:
+                return _error(
+                    f"Room {room_id} moved to {moved[0]}",
+                    ROOM_MOVED,
+                    admin_node=moved[0],
+                    node_address=moved[1],
+                )
+            self._in_flight[room_id] = self._in_flight.get(room_id, 0) + 1
+            return None
+
+    def leave(self, room_id: str) -> None:
+        """Mark a request admitted by enter() as handled."""
+        with self._condition:
+            count = self._in_flight.get(room_id, 0) - 1
+            if count > 0:
+                self._in_flight[room_id] = count
+            else:
+                self._in_flight.pop(room_id, None)
+            self._condition.notify_all()
+
+    def gate(self, method: str, params: Sequence, call: Callable) -> Any:
+        """
+        Answer a peer's call unless its room is being or was migrated.
+
+        Calls that don't change a room (see PAUSED_METHODS) always go
+        ahead.
+
+        Args:
+            method: The called NodeService method
+            params: The call's parameters, the room ID first
+            call: Answers the call
+
+        Returns:
+            The call's result, or the ROOM_MIGRATING or ROOM_MOVED error
+            (see enter)
+        """
+        if method not in PAUSED_METHODS or not params:
+            return call()
+        room_id = params[0]
+        if not isinstance(room_id, str):
+            return call()
+        refused = self.enter(room_id)
+        if refused:
+            return refused
+        try:
+            return call()
+        finally:
+            self.leave(room_id)
+
+    def migrate(self, room_id: str, target: str, actor: str) -> Dict:
+        """
+        Move a hosted room to another node.
+
+        Args:
+            room_id: The room ID
+            target: ID of the node to move the room to
+            actor: Who requested the migration, for the audit log
+
+        Returns:
+            dict: room_id, room_name, admin_node, previous_admin and
+            paused, the seconds requests were paused for; or an error
+        """
+        node_id = self.room_manager.node_id
+        room = self.room_manager.get_room(room_id)
+        if room is None:
+            return _error("Room not found", "ROOM_NOT_FOUND")
+        if room.state != RoomState.ACTIVE:
+            return _error(
+                f"Room is in {room.state.value} state", "INVALID_STATE"
+            )
+        if target == node_id:
+            return _error(
+                f"Room {room_id} is already on {target}", "INVALID_REQUEST"
+            )
+        if target not in self.failover.live_peers():
+            return _error(
+                f"Node {target} is not a live peer", "PEER_UNAVAILABLE"
+            )
+        refused = self._check_target(room, target)
+        if refused:
+            return _error(refused, "PLACEMENT_MISMATCH")
+
+        with self._condition:
+            if room_id in self._migrating:
+                return _error(
+                    f"Room {room_id} is already being migrated",
+                    ROOM_MIGRATING,
+                )
+            self._migrating.add(room_id)
+        started = time.monotonic()
+        try:
+            with self._condition:
+                drained = self._condition.wait_for(
+                    lambda: not self._in_flight.get(room_id), self.pause
+                )
+            if not drained:
+                return _error(
+                    f"Requests on room {room_id} did not finish in time",
+                    "MIGRATION_TIMEOUT",
+                )
+            moved = move_room(
+                self.room_manager, self.failover, room_id, target
+            )
+            if not moved:
+                return _error(
+                    f"Node {target} did not take the room; it stays here",
+                    "HANDOFF_FAILED",
+                )
+            with self._condition:
+                self._moved[room_id] = (
+                    target,
+                    self.failover.peer_registry.get_peer_address(target),
+                )
+        finally:
+            with self._condition:
+                self._migrating.discard(room_id)
+                self._condition.notify_all()
+
+        paused = time.monotonic() - started
+        audit(
+            self.room_manager.audit_log,
+            actor,
+            ROOM_MIGRATED,
+            room_id,
+            admin_node=target,
+            previous_admin=node_id,
+        )
+        logger.info(
+            f"Migrated room {room_id} to {target} "
+            f"(requests paused for {paused:.3f}s)"
+        )
+        return {
+            "success": True,
+            "room_id": room_id,
+            "room_name": room.room_name,
+            "admin_node": target,
+            "previous_admin": node_id,
+            "paused": round(paused, 3),
+        }
+
+    def _check_target(self, room, target: str) -> Optional[str]:
+        """Get why placement or sharding would move the room back, if so."""
+        if room.placement:
+            tags = self.failover.peer_registry.get_tags(target)
+            if not matches(tags, room.placement):
+                return f"Node {target} does not match the room's placement"
+        elif self.sharding is not None:
+            owner = self.sharding.owner_of(room.room_id)
+            if owner != target:
+                return f"The room's owner with sharding is {owner}"
+        return None
+
+
+def post_migration(
+    url: str, token: str, room_id: str, target: str
+) -> Tuple[int, Dict]:
+    """
+    Ask a room's admin node to migrate it, through its admin API.
+
+    Args:
+        url: Base URL of the admin API (without /admin)
+        token: The node's admin token
+        room_id: The room ID
+        target: ID of the node to move the room to
+
+    Returns:
+        tuple: (HTTP status, response body)
+
+    Raises:
+        URLError: If the node can't be reached
+    """
+    request = Request(
+        f"{url.rstrip('/')}/admin/rooms/{quote(room_id)}/migrate"
+        f"?node={quote(target)}",
+        headers={"Authorization": f"Bearer {token}"},
+        method="POST",
+    )
+    try:
+        with urlopen(request) as response:
+            return response.status, json.loads(response.read())
+    except HTTPError as e:
+        return e.code, json.loads(e.read() or b"{}")
+
+
+def main(argv=None):
+    """Main entry point for migrating a room to another node."""
+    parser = argparse.ArgumentParser(
+        description="Move a room to another node"
+    )
+    parser.add_argument("room_id", help="ID of the room")
+    parser.add_argument("target_node", help="ID of the node to move it to")
+    parser.add_argument(
+        "--url",
+        default=DEFAULT_ADMIN_URL,
+        help="Admin API URL of the room's admin node "
+        f"(default: {DEFAULT_ADMIN_URL})",
+    )
+    parser.add_argument(
+        "--token",
+        default=os.environ.get("ADMIN_TOKEN"),
+        help="Admin token (default: $ADMIN_TOKEN)",
+    )
+    args = parser.parse_args(argv)
+    if not args.token:
+        parser.error("an admin token is required (--token or ADMIN_TOKEN)")
+
+    try:
+        status, result = post_migration(
+            args.url, args.token, args.room_id, args.target_node
+        )
+    except (OSError, ValueError, URLError) as e:
+        print(f"Error: {e}", file=sys.stderr)
+        sys.exit(1)
+
+    if status != 200:
+        print(f"Error: {result.get('error', status)}", file=sys.stderr)
+        sys.exit(1)
+    print(
+        f"Migrated '{result['room_name']}' ({result['room_id']}) from "
+        f"{result['previous_admin']} to {result['admin_node']}; requests "
+        f"paused for {result['paused']}s"
+    )
+
+
+if __name__ == "__main__":
+    main()
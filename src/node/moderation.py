@@ -0,0 +1,33 @@
+"""
+Room Moderation
+
+The owner and moderators of a room may kick or ban users below their role
+(see roles.py). Both are carried out by the room's administrator node: it
+removes the member, tells the node the member is connected to so their
+client is taken out of the room, and announces a member_left event. A
+kicked user may join again; a banned user is refused by every later join,
+with or without an invite.
+
+Bans are room metadata: the administrator writes them to its message log
+and sends them with replication, so they survive restarts and failover.
+"""
+
+# Moderation actions
+KICK = "kick"
+BAN = "ban"
+MODERATION_ACTIONS = (KICK, BAN)
+
+
+class ModerationError(Exception):
+    """A member could not be kicked or banned."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "NOT_ALLOWED")
+        """
+        super().__init__(message)
+        self.error_code = error_code
@@ -0,0 +1,221 @@
+"""
+Muted Rooms and Users
+
+Each user can mute rooms and other users with the update_mutes command.
+A muted room stays joined and its messages are still kept in its history
+and delivered to the user's open connections, but they no longer notify
+the user: nothing from the room is buffered for the user's held session
+while they are offline (see offline_queue.py), so a quiet room doesn't
+fill the queue. A client resuming its session with a last_seen map still
+catches up on the room from its history.
+
+Muting a user is a client-side hint by default. A user who also turns on
+filter_muted_users has the node drop room messages from the users they
+muted from their own delivery stream, both live and when a session is
+replayed; the messages stay in the rooms' history.
+
+Preferences are kept in memory by the node the user is connected to,
+like held sessions; a client that connects to another node sets them
+again.
+"""
+
+import logging
+import threading
+from dataclasses import dataclass, field
+from typing import Any, Dict, Iterable, Optional, Set
+
+logger = logging.getLogger(__name__)
+
+# Mute configuration
+MAX_MUTES = 1000  # rooms plus users a user can mute
+
+
+class MuteError(Exception):
+    """A change to a user's mutes was refused."""
+
+    def __init__(self, message: str, error_code: str = "INVALID_MUTE"):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_MUTE")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+@dataclass
+class MutePreferences:
+    """
+    The rooms and users a user muted.
+
+    Attributes:
+        username: The user
+        rooms: IDs of the muted rooms
+        users: Usernames of the muted users
+        filter_muted_users: Whether room messages from muted users are
+            left out of the user's delivery stream
+    """
+
+    username: str
+    rooms: Set[str] = field(default_factory=set)
+    users: Set[str] = field(default_factory=set)
+    filter_muted_users: bool = False
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return {
+            "username": self.username,
+            "muted_rooms": sorted(self.rooms),
+            "muted_users": sorted(self.users),
+            "filter_muted_users": self.filter_muted_users,
+        }
+
+
+def _names(value: Any, name: str) -> Set[str]:
+    """
+    Check a list of room IDs or usernames of an update.
+
+    Raises:
+        MuteError: If the value isn't a list of non-empty strings
+    """
+    if not isinstance(value, (list, tuple)) or not all(
+        isinstance(item, str) and item for item in value
+    ):
+        raise MuteError(f"{name} must be a list of names")
+    return set(value)
+
+
+class MuteRegistry:
+    """
+    Thread-safe store of each user's muted rooms and users.
+    """
+
+    def __init__(self, limit: int = MAX_MUTES):
+        """
+        Initialize the registry.
+
+        Args:
+            limit: Rooms plus users each user can mute
+        """
+        self.limit = limit
+        self._lock = threading.Lock()
+        # Maps username -> preferences
+        self._preferences: Dict[str, MutePreferences] = {}
+
+    def update(
+        self,
+        username: str,
+        mute_rooms: Iterable[str] = (),
+        unmute_rooms: Iterable[str] = (),
+        mute_users: Iterable[str] = (),
+        unmute_users: Iterable[str] = (),
+        filter_muted_users: Optional[bool] = None,
+    ) -> MutePreferences:
+        """
+        Change a user's mutes.
+
+        Unmuting is applied after muting, so a name in both lists ends up
+        unmuted.
+
+        Args:
+            username: The user
+            mute_rooms: IDs of rooms to mute
+            unmute_rooms: IDs of rooms to unmute
+            mute_users: Usernames of users to mute
+            unmute_users: Usernames of users to unmute
+            filter_muted_users: Whether to leave messages from muted users
+                out of the user's delivery stream; None keeps the setting
+
+        Returns:
+            The user's preferences after the change
+
+        Raises:
+            MuteError: If a list is invalid, the user mutes themselves, the
+                filter isn't a boolean or the limit is exceeded
+        """
+        mute_rooms = _names(mute_rooms, "mute_rooms")
+        unmute_rooms = _names(unmute_rooms, "unmute_rooms")
+        mute_users = _names(mute_users, "mute_users")
+        unmute_users = _names(unmute_users, "unmute_users")
+        if username in mute_users:
+            raise MuteError("Users cannot mute themselves")
+        if filter_muted_users is not None and not isinstance(
+            filter_muted_users, bool
+        ):
+            raise MuteError("filter_muted_users must be true or false")
+
+        with self._lock:
+            current = self._preferences.get(username)
+            rooms = (set(current.rooms) if current else set()) | mute_rooms
+            users = (set(current.users) if current else set()) | mute_users
+            rooms -= unmute_rooms
+            users -= unmute_users
+            if len(rooms) + len(users) > self.limit:
+                raise MuteError(
+                    f"A user can mute at most {self.limit} rooms and users",
+                    "TOO_MANY_MUTES",
+                )
+            if filter_muted_users is None:
+                filter_muted_users = bool(
+                    current and current.filter_muted_users
+                )
+            preferences = MutePreferences(
+                username, rooms, users, filter_muted_users
+            )
+            self._preferences[username] = preferences
+        logger.info(
+            f"{username} mutes {len(rooms)} rooms and {len(users)} users"
+        )
+        return preferences
+
+    def get(self, username: str) -> MutePreferences:
+        """Get a user's preferences (empty if they muted nothing)."""
+        with self._lock:
+            return self._preferences.get(username) or MutePreferences(
+                username
+            )
+
+    def room_muted(self, username: str, room_id: str) -> bool:
+        """Check whether a user muted a room."""
+        with self._lock:
+            preferences = self._preferences.get(username)
+            return preferences is not None and room_id in preferences.rooms
+
+    def silenced(self, room_id: str) -> Set[str]:
+        """
+        Get the users that muted a room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Usernames not notified of the room's messages
+        """
+        with self._lock:
+            return {
+                username
+                for username, preferences in self._preferences.items()
+                if room_id in preferences.rooms
+            }
+
+    def filtering(self, sender: Optional[str]) -> Set[str]:
+        """
+        Get the users whose delivery streams leave out a sender's messages.
+
+        Args:
+            sender: Username of the message's sender
+
+        Returns:
+            Usernames that muted the sender with filter_muted_users on
+        """
+        if not sender:
+            return set()
+        with self._lock:
+            return {
+                username
+                for username, preferences in self._preferences.items()
+                if preferences.filter_muted_users
+                and sender in preferences.users
+            }
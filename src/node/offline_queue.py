@@ -0,0 +1,255 @@
+"""
+Offline Message Queue
+
+Keeps a user's room sessions alive for a while after their client
+disconnects. Instead of leaving their rooms at once, the user's node holds
+the session for OFFLINE_RETENTION seconds and buffers every message sent
+to those rooms in the meantime.
+
+Every connection is given a secret session ID in a session_started
+message when it connects. A client that reconnects to the same node within
+the window sends resume_session with that ID and the last sequence number
+it saw in each room. The node puts the connection back into the rooms
+without member events, restores the user's presence status, delivers
+pending direct messages and replays the room messages after those sequence
+numbers, in order. Sessions that are not
+resumed in time expire, and the user leaves their rooms as if they had
+disconnected just then.
+
+Sessions and buffered messages are kept in memory only; a client that
+reconnects to another node has to join its rooms again.
+"""
+
+import logging
+import threading
+import time
+from dataclasses import dataclass, field
+from typing import Any, Dict, Iterable, List, Optional, Set
+
+logger = logging.getLogger(__name__)
+
+# Offline queue configuration
+OFFLINE_RETENTION = 120  # seconds a disconnected user's session is held
+OFFLINE_QUEUE_LIMIT = 500  # messages buffered per held session
+OFFLINE_EXPIRY_INTERVAL = 5  # seconds between checks for expired sessions
+
+
+@dataclass
+class OfflineSession:
+    """
+    The rooms and missed messages of a disconnected user.
+
+    Attributes:
+        username: The user
+        rooms: Rooms the user was in when they disconnected
+        disconnected_at: UNIX time the last connection closed
+        messages: Maps room_id -> messages buffered since, oldest first
+        truncated: True if messages were dropped because the queue was
+            full
+        session_ids: Session IDs of the connections that were held
+        status: Presence status the user had when they disconnected
+    """
+
+    username: str
+    rooms: Set[str]
+    disconnected_at: float = 0.0
+    messages: Dict[str, List[Dict[str, Any]]] = field(default_factory=dict)
+    truncated: bool = False
+    session_ids: Set[str] = field(default_factory=set)
+    status: Optional[str] = None
+
+    def __post_init__(self):
+        """Initialize the disconnect time if not set."""
+        if not self.disconnected_at:
+            self.disconnected_at = time.time()
+
+    def message_count(self) -> int:
+        """Get the number of buffered messages."""
+        return sum(len(messages) for messages in self.messages.values())
+
+
+class OfflineQueue:
+    """
+    Thread-safe store of held sessions and their missed messages.
+    """
+
+    def __init__(
+        self,
+        retention: float = OFFLINE_RETENTION,
+        limit: int = OFFLINE_QUEUE_LIMIT,
+    ):
+        """
+        Initialize the queue.
+
+        Args:
+            retention: Seconds a session is held after the disconnect
+            limit: Maximum messages buffered per session; the oldest are
+                dropped first
+        """
+        self.retention = retention
+        self.limit = limit
+        self._lock = threading.Lock()
+        # Maps username -> held session
+        self._sessions: Dict[str, OfflineSession] = {}
+
+    def hold(
+        self,
+        username: str,
+        room_ids: Set[str],
+        session_id: Optional[str] = None,
+        status: Optional[str] = None,
+    ) -> OfflineSession:
+        """
+        Hold a disconnected user's session.
+
+        If the user already has a held session, the rooms are added to it
+        and the retention window starts again.
+
+        Args:
+            username: The user
+            room_ids: Rooms the connection was in
+            session_id: Session ID of the connection, if it was given one
+            status: The user's presence status at the disconnect
+
+        Returns:
+            The held session
+        """
+        with self._lock:
+            session = self._sessions.get(username)
+            if session is None:
+                session = OfflineSession(username, set(room_ids))
+                self._sessions[username] = session
+            else:
+                session.rooms.update(room_ids)
+                session.disconnected_at = time.time()
+            if session_id:
+                session.session_ids.add(session_id)
+            if status:
+                session.status = status
+        logger.info(
+            f"Holding session of {username} in {len(room_ids)} rooms for "
+            f"{self.retention}s"
+        )
+        return session
+
+    def add(
+        self,
+        room_id: str,
+        message: Dict[str, Any],
+        exclude: Iterable[str] = (),
+    ) -> int:
+        """
+        Buffer a room message for every held session in the room.
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+            exclude: Users the message isn't buffered for (e.g., because
+                they muted the room)
+
+        Returns:
+            Number of sessions the message was buffered for
+        """
+        exclude = set(exclude)
+        buffered = 0
+        with self._lock:
+            for session in self._sessions.values():
+                if room_id not in session.rooms:
+                    continue
+                if session.username in exclude:
+                    continue
+                session.messages.setdefault(room_id, []).append(message)
+                buffered += 1
+                if session.message_count() > self.limit:
+                    self._drop_oldest(session)
+        return buffered
+
+    def resume(self, username: str) -> Optional[OfflineSession]:
+        """
+        Remove and return a user's held session, if it has not expired.
+
+        Args:
+            username: The user
+
+        Returns:
+            The session, or None if there is none to resume
+        """
+        with self._lock:
+            session = self._sessions.get(username)
+            if session is None or self._expired(session, time.time()):
+                return None
+            del self._sessions[username]
+            return session
+
+    def find_user(self, session_id: str) -> Optional[str]:
+        """
+        Find the user whose held session has a session ID.
+
+        Args:
+            session_id: Session ID the client was given when it connected
+
+        Returns:
+            The username, or None if no held session has the ID
+        """
+        with self._lock:
+            for session in self._sessions.values():
+                if session_id in session.session_ids:
+                    return session.username
+        return None
+
+    def drop_room(self, username: str, room_id: str) -> bool:
+        """
+        Take a room out of a user's held session (e.g., after a kick).
+
+        Args:
+            username: The user
+            room_id: The room ID
+
+        Returns:
+            True if the held session had the room
+        """
+        with self._lock:
+            session = self._sessions.get(username)
+            if session is None or room_id not in session.rooms:
+                return False
+            session.rooms.discard(room_id)
+            session.messages.pop(room_id, None)
+            return True
+
+    def is_held(self, username: str) -> bool:
+        """Check whether a user has a held session."""
+        with self._lock:
+            return username in self._sessions
+
+    def take_expired(self, now: Optional[float] = None) -> List[OfflineSession]:
+        """
+        Remove and return sessions held longer than the retention window.
+
+        Args:
+            now: Current UNIX time (defaults to time.time())
+
+        Returns:
+            The expired sessions
+        """
+        now = time.time() if now is None else now
+        with self._lock:
+            expired = [
+                session
+                for session in self._sessions.values()
+                if self._expired(session, now)
+            ]
+            for session in expired:
+                del self._sessions[session.username]
+        return expired
+
+    def _expired(self, session: OfflineSession, now: float) -> bool:
+        """Check whether a session outlived the retention window."""
+        return now - session.disconnected_at > self.retention
+
+    @staticmethod
+    def _drop_oldest(session: OfflineSession) -> None:
+        """Drop the session's oldest buffered message (lock held)."""
+        queues = [queue for queue in session.messages.values() if queue]
+        oldest = min(queues, key=lambda queue: queue[0].get("timestamp", ""))
+        oldest.pop(0)
+        session.truncated = True
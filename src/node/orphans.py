@@ -0,0 +1,215 @@
+"""
+Orphaned State Reaping
+
+A node that dies for good leaves state behind on the others: members it
+hosted stay in rooms, its users keep presence entries, transactions it
+coordinated sit prepared waiting for a decision that never comes, and
+messages its users sent wait for delivery receipts that can't be routed
+back. When the failure detector declares a node dead, the OrphanReaper
+cleans all of that up at once:
+
+- members connected to the node are removed from the local rooms, and
+  the remaining members here and on the other live nodes get member_left
+  (reason "Node unreachable"); freed slots go to waiting users;
+- the node's presence entries are dropped (see PresenceDirectory's
+  forget_node), its users published as offline;
+- 2PC transactions it coordinated that carry a participant list are
+  recovered with the other participants without waiting for the
+  participant timeout (see tpc.py);
+- room deletions it asked this node to prepare outside of the 2PC engine
+  that have waited the participant timeout are rolled back, and local
+  members get delete_room_cancelled;
+- messages its users sent are no longer tracked for receipts.
+
+Transactions this node voted READY on are never aborted just because
+their coordinator is declared dead: the verdict can be wrong, and the
+coordinator may still commit them. Those without a participant list to
+recover with are aborted on the participant timeout (presumed abort) as
+before.
+
+A node declared dead that comes back rejoins like a new one: its users
+reconnect and join their rooms again.
+"""
+
+import asyncio
+import logging
+from datetime import datetime, timedelta, timezone
+from typing import Dict, List, Tuple
+
+from .schemas.events import create_member_left_event
+from .tpc import PARTICIPANT_TIMEOUT
+from .utils.broadcast import broadcast_to_peers
+
+logger = logging.getLogger(__name__)
+
+# Reason given in member_left events for members of a dead node
+NODE_UNREACHABLE = "Node unreachable"
+
+
+class OrphanReaper:
+    """
+    Removes the state tied to nodes declared dead.
+    """
+
+    def __init__(
+        self,
+        room_manager,
+        ws_server,
+        peer_registry,
+        presence=None,
+        tpc_participant=None,
+        receipts=None,
+        deletion_timeout: float = PARTICIPANT_TIMEOUT,
+    ):
+        """
+        Initialize the reaper.
+
+        Args:
+            room_manager: The room state manager
+            ws_server: The WebSocket server for notifying local members
+            peer_registry: The peer registry for notifying other peers
+            presence: Optional PresenceDirectory to drop entries from
+            tpc_participant: Optional TPCParticipant whose transactions
+                coordinated by dead nodes are decided
+            receipts: Optional ReceiptTracker to forget messages from
+            deletion_timeout: Seconds a deletion prepared outside the 2PC
+                engine waits for its decision before it is rolled back
+        """
+        self.room_manager = room_manager
+        self.ws_server = ws_server
+        self.peer_registry = peer_registry
+        self.presence = presence
+        self.tpc_participant = tpc_participant
+        self.receipts = receipts
+        self.deletion_timeout = deletion_timeout
+
+    async def reap(self, node_id: str) -> Dict[str, int]:
+        """
+        Remove everything tied to a dead node.
+
+        Args:
+            node_id: The dead node's ID
+
+        Returns:
+            dict: Number of members, presence entries, transactions,
+            deletions and receipts reaped
+        """
+        reaped = {
+            "members": len(self.remove_members(node_id)),
+            "presence": 0,
+            "transactions": 0,
+            "deletions": 0,
+            "receipts": 0,
+        }
+        if self.presence is not None:
+            reaped["presence"] = self.presence.forget_node(node_id)
+        if self.tpc_participant is not None:
+            decided = await asyncio.get_running_loop().run_in_executor(
+                None, self.tpc_participant.resolve_orphaned, node_id
+            )
+            reaped["transactions"] = len(decided)
+        reaped["deletions"] = len(self.cancel_deletions(node_id))
+        if self.receipts is not None:
+            reaped["receipts"] = self.receipts.forget_node(node_id)
+        logger.info(f"Reaped the state of dead node {node_id}: {reaped}")
+        return reaped
+
+    def remove_members(self, node_id: str) -> List[Tuple[str, str]]:
+        """
+        Remove a dead node's members from all rooms, notifying the others.
+
+        Args:
+            node_id: The dead node's ID
+
+        Returns:
+            list: (room_id, username) of the members removed
+        """
+        removed = self.room_manager.remove_all_members_from_node(node_id)
+        logger.info(
+            f"Removed {len(removed)} members from failed node {node_id}"
+        )
+
+        for room_id, username in removed:
+            room = self.room_manager.get_room(room_id)
+            member_count = len(room.members) if room else 0
+
+            event_data = create_member_left_event(
+                room_id=room_id,
+                username=username,
+                member_count=member_count,
+                timestamp=datetime.now(timezone.utc).isoformat(),
+                reason=NODE_UNREACHABLE,
+                hlc=self.room_manager.clock.now().encode(),
+            )
+
+            # Broadcast to local WebSocket clients
+            broadcast_msg = {"type": "member_left", "data": event_data}
+            self.ws_server.broadcast_to_room_sync(room_id, broadcast_msg)
+
+            # Broadcast to other peer nodes (excluding the failed node)
+            broadcast_to_peers(
+                self.peer_registry,
+                room_id,
+                "member_left",
+                event_data,
+                exclude_node=node_id,
+            )
+
+        # Members who left free slots for waiting users
+        for room_id in {room_id for room_id, _ in removed}:
+            if self.room_manager.get_waitlist(room_id):
+                self.ws_server.admit_waitlisted_sync(room_id)
+        return removed
+
+    def cancel_deletions(self, node_id: str) -> List[str]:
+        """
+        Roll back the deletions a dead node had prepared here long ago.
+
+        Only deletions prepared at least deletion_timeout seconds ago are
+        rolled back (presumed abort); newer ones are left for the
+        coordinator to decide, in case it isn't dead after all. Deletions
+        the 2PC participant still holds are left to it.
+
+        Args:
+            node_id: The dead node's ID
+
+        Returns:
+            list: IDs of the transactions rolled back
+        """
+        undecided = set()
+        if self.tpc_participant is not None:
+            undecided = {
+                txn.transaction_id
+                for txn in self.tpc_participant.prepared_transactions()
+            }
+        cutoff = datetime.now(timezone.utc) - timedelta(
+            seconds=self.deletion_timeout
+        )
+        cancelled = []
+        for prepared in self.room_manager.get_prepared_deletions(node_id):
+            transaction_id = prepared.transaction_id
+            if (
+                transaction_id in undecided
+                or datetime.fromisoformat(prepared.prepared_at) > cutoff
+            ):
+                continue
+            self.room_manager.rollback_deletion_participant(
+                prepared.room_id, transaction_id
+            )
+            self.ws_server.broadcast_to_room_sync(
+                prepared.room_id,
+                {
+                    "type": "delete_room_cancelled",
+                    "data": {
+                        "room_id": prepared.room_id,
+                        "transaction_id": transaction_id,
+                    },
+                },
+            )
+            cancelled.append(transaction_id)
+        if cancelled:
+            logger.warning(
+                f"Rolled back {len(cancelled)} deletions prepared for dead "
+                f"node {node_id}"
+            )
+        return cancelled
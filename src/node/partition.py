@@ -0,0 +1,351 @@
+"""
+Network Partition Handling
+
+A client's messages to a room administered by another node are forwarded
+to that admin node, which orders them. When the admin node can't be
+reached (the failure detector suspects it, or forwarding fails) the room
+is degraded on this node and its local clients get a room_status event
+with status "degraded". What happens to their messages depends on the
+degraded mode:
+
+- read_only: messages are rejected with error code ROOM_READ_ONLY; the
+  history already received can still be read
+- buffer: messages are kept in a local per-room buffer (up to
+  MAX_BUFFERED_MESSAGES) and the sender gets a message_status event with
+  status "buffered"
+
+Every RECONCILE_INTERVAL seconds, and when a peer comes back, degraded
+rooms whose admin is reachable again (or that have a new admin after a
+failover) are reconciled: buffered messages are forwarded to the admin in
+causal order, each under its message ID so a retry is never added twice,
+and their senders get status "sent". Once the buffer is empty the room is
+healthy again and local clients get a room_status event with status
+"healthy".
+
+Each buffered message carries a vector clock: the room's clock as
+delivered on this node, with this node's entry counting the messages
+buffered since. A message therefore comes after everything its sender
+could have seen, and after the messages buffered before it; messages
+buffered on other nodes during the partition are concurrent and the
+admin orders them by arrival.
+"""
+
+import logging
+import threading
+import time
+import uuid
+from dataclasses import dataclass, field
+from typing import Dict, List, Optional
+
+from .vector_clock import VectorClock
+
+logger = logging.getLogger(__name__)
+
+# Degraded modes
+READ_ONLY = "read_only"
+BUFFER = "buffer"
+DEGRADED_MODES = (READ_ONLY, BUFFER)
+
+# Room statuses sent to clients
+HEALTHY = "healthy"
+DEGRADED = "degraded"
+
+# Partition handling configuration
+MAX_BUFFERED_MESSAGES = 1000  # per degraded room
+RECONCILE_INTERVAL = 2  # seconds between reconciliation rounds
+
+
+class PartitionError(Exception):
+    """A message can't be accepted in a degraded room."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "ROOM_READ_ONLY")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+@dataclass
+class BufferedMessage:
+    """
+    A message held while its room's admin node is unreachable.
+
+    Attributes:
+        room_id: Room the message was sent to
+        username: Sender of the message
+        content: Message content
+        message_id: ID the message is forwarded under (generated if the
+            client didn't choose one)
+        reply_to: ID of the message replied to, if any
+        session_token: Sender's session token, forwarded with the message
+        vector_clock: Causal dependencies of the message
+        buffered_at: UNIX time the message was buffered
+        encryption: Envelope of an encrypted message, if any
+        attachments: References to the message's attached files, if any
+    """
+
+    room_id: str
+    username: str
+    content: str
+    message_id: str
+    reply_to: Optional[str] = None
+    session_token: Optional[str] = None
+    vector_clock: Dict[str, int] = field(default_factory=dict)
+    buffered_at: float = field(default_factory=time.time)
+    encryption: Optional[Dict] = None
+    attachments: Optional[List[Dict]] = None
+
+
+@dataclass
+class DegradedRoom:
+    """
+    A remote room whose admin node is unreachable from this node.
+
+    Attributes:
+        room_id: The room ID
+        admin_node: Node ID of the unreachable admin
+        reason: Why the room was degraded
+        since: UNIX time the room was degraded
+        buffer: Buffered messages, oldest first
+        clock: Vector clock of the newest buffered message
+    """
+
+    room_id: str
+    admin_node: Optional[str]
+    reason: str
+    since: float = field(default_factory=time.time)
+    buffer: List[BufferedMessage] = field(default_factory=list)
+    clock: VectorClock = field(default_factory=VectorClock)
+
+
+class PartitionManager:
+    """
+    Tracks this node's degraded rooms and their buffered messages.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        mode: str = BUFFER,
+        max_buffered: int = MAX_BUFFERED_MESSAGES,
+        failure_detector=None,
+    ):
+        """
+        Initialize the partition manager.
+
+        Args:
+            node_id: ID of this node
+            mode: Degraded mode: "buffer" or "read_only"
+            max_buffered: Most messages buffered per degraded room
+            failure_detector: Optional FailureDetector deciding whether a
+                degraded room's admin is reachable again
+
+        Raises:
+            ValueError: If mode is unknown
+        """
+        if mode not in DEGRADED_MODES:
+            raise ValueError(
+                f"Degraded mode must be one of {', '.join(DEGRADED_MODES)}"
+            )
+        self.node_id = node_id
+        self.mode = mode
+        self.max_buffered = max_buffered
+        self.failure_detector = failure_detector
+        self._lock = threading.Lock()
+        self._rooms: Dict[str, DegradedRoom] = {}
+
+    def degrade(
+        self, room_id: str, admin_node: Optional[str], reason: str
+    ) -> bool:
+        """
+        Mark a room as degraded.
+
+        Args:
+            room_id: The room ID
+            admin_node: Node ID of the unreachable admin, if known
+            reason: Why the admin is unreachable
+
+        Returns:
+            True if the room wasn't degraded already
+        """
+        with self._lock:
+            if room_id in self._rooms:
+                return False
+            self._rooms[room_id] = DegradedRoom(room_id, admin_node, reason)
+        logger.warning(f"Room {room_id} degraded ({self.mode}): {reason}")
+        return True
+
+    def restore(self, room_id: str) -> bool:
+        """
+        Mark a degraded room as healthy, dropping its (empty) buffer.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            True if the room was degraded
+        """
+        with self._lock:
+            room = self._rooms.pop(room_id, None)
+        if room is None:
+            return False
+        logger.info(f"Room {room_id} healthy again")
+        return True
+
+    def is_degraded(self, room_id: str) -> bool:
+        """Check whether a room is degraded."""
+        with self._lock:
+            return room_id in self._rooms
+
+    def degraded_rooms(self) -> List[str]:
+        """Get the IDs of the degraded rooms, sorted."""
+        with self._lock:
+            return sorted(self._rooms)
+
+    def buffer(
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+        session_token: Optional[str] = None,
+        delivered_clock: Optional[Dict[str, int]] = None,
+        encryption: Optional[Dict] = None,
+        attachments: Optional[List[Dict]] = None,
+    ) -> BufferedMessage:
+        """
+        Buffer a message sent to a degraded room.
+
+        Args:
+            room_id: The degraded room's ID
+            username: Sender of the message
+            content: Message content
+            message_id: ID chosen by the client, if any
+            reply_to: ID of the message replied to, if any
+            session_token: Sender's session token, if any
+            delivered_clock: The room's vector clock as delivered to this
+                node's clients
+            encryption: Envelope of an encrypted message, if any
+            attachments: References to the message's attached files, if any
+
+        Returns:
+            BufferedMessage: The buffered message
+
+        Raises:
+            PartitionError: If the room isn't degraded (NOT_DEGRADED), the
+                mode is read_only (ROOM_READ_ONLY) or the room's buffer is
+                full (BUFFER_FULL)
+        """
+        with self._lock:
+            room = self._rooms.get(room_id)
+            if room is None:
+                raise PartitionError("Room is not degraded", "NOT_DEGRADED")
+            if self.mode == READ_ONLY:
+                raise PartitionError(
+                    "Room is read-only until its admin node is reachable",
+                    "ROOM_READ_ONLY",
+                )
+            if len(room.buffer) >= self.max_buffered:
+                raise PartitionError(
+                    "Too many messages buffered for this room",
+                    "BUFFER_FULL",
+                )
+            room.clock = room.clock.merge(
+                VectorClock.from_dict(delivered_clock)
+            ).increment(self.node_id)
+            message = BufferedMessage(
+                room_id=room_id,
+                username=username,
+                content=content,
+                message_id=message_id or str(uuid.uuid4()),
+                reply_to=reply_to,
+                session_token=session_token,
+                vector_clock=room.clock.to_dict(),
+                encryption=encryption,
+                attachments=attachments,
+            )
+            room.buffer.append(message)
+            return message
+
+    def pending(self, room_id: str) -> List[BufferedMessage]:
+        """
+        Get a degraded room's buffered messages in causal order.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The buffered messages, each after the ones it depends on
+        """
+        with self._lock:
+            room = self._rooms.get(room_id)
+            if room is None:
+                return []
+            # A linear extension of happened-before: a message's clock
+            # sum exceeds that of every message it depends on
+            return sorted(
+                room.buffer,
+                key=lambda m: (sum(m.vector_clock.values()), m.buffered_at),
+            )
+
+    def delivered(self, room_id: str, message_id: str) -> None:
+        """
+        Drop a buffered message once the admin has accepted it.
+
+        Args:
+            room_id: The room ID
+            message_id: The delivered message's ID
+        """
+        with self._lock:
+            room = self._rooms.get(room_id)
+            if room is not None:
+                room.buffer = [
+                    m for m in room.buffer if m.message_id != message_id
+                ]
+
+    def reachable(self, admin_node: Optional[str]) -> bool:
+        """
+        Check whether a room's admin node can be tried again.
+
+        Args:
+            admin_node: The admin's node ID (this node after a takeover)
+
+        Returns:
+            True if it is this node, or the failure detector (if any)
+            considers it alive
+        """
+        if admin_node is None:
+            return False
+        if admin_node == self.node_id or self.failure_detector is None:
+            return True
+        return self.failure_detector.is_alive(admin_node)
+
+    def status(self, room_id: str) -> Dict:
+        """
+        Get a room's status as sent in room_status events.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            dict: status ("degraded" or "healthy"), and for degraded rooms
+            the mode, unreachable admin node, reason and buffered count
+        """
+        with self._lock:
+            room = self._rooms.get(room_id)
+            if room is None:
+                return {"room_id": room_id, "status": HEALTHY}
+            return {
+                "room_id": room_id,
+                "status": DEGRADED,
+                "mode": self.mode,
+                "admin_node": room.admin_node,
+                "reason": room.reason,
+                "buffered": len(room.buffer),
+            }
@@ -0,0 +1,235 @@
+"""
+Peer Connection Manager
+
+Every call to a peer used to open a connection, however often the peer
+had just failed, so a node that went down was dialled by each heartbeat,
+gossip round and stream retry at once. Calls through the RPC client pool
+now go through one managed connection per peer address, a circuit
+breaker with three states:
+
+- closed: calls go through; CIRCUIT_FAILURE_THRESHOLD failed calls in a
+  row open the circuit.
+- open: calls fail at once with PeerUnavailableError, without dialling,
+  until the reconnect delay has passed. The delay starts at
+  RECONNECT_BASE_DELAY and doubles each time the circuit opens again, up
+  to RECONNECT_MAX_DELAY, with random jitter so peers that failed
+  together aren't retried together.
+- half_open: a single trial call goes through. Success closes the
+  circuit; failure opens it again for a longer delay.
+
+An XML-RPC fault counts as success: the peer answered. PeerUnavailableError
+is a ConnectionError, so callers treat a peer behind an open circuit as
+they treat one refusing connections.
+"""
+
+import logging
+import random
+import threading
+import time
+from typing import Dict, Optional
+
+logger = logging.getLogger(__name__)
+
+# Circuit breaker configuration
+CIRCUIT_FAILURE_THRESHOLD = 5  # failed calls in a row that open the circuit
+RECONNECT_BASE_DELAY = 0.5  # seconds before the first trial call
+RECONNECT_MAX_DELAY = 15.0  # longest wait between trial calls
+RECONNECT_JITTER = 0.5  # fraction of the delay taken off at random
+
+# Circuit states
+CLOSED = "closed"
+OPEN = "open"
+HALF_OPEN = "half_open"
+CIRCUIT_STATES = (CLOSED, HALF_OPEN, OPEN)
+
+
+class PeerUnavailableError(ConnectionError):
+    """A call was refused because the peer's circuit is open."""
+
+    error_code = "PEER_UNAVAILABLE"
+
+    def __init__(self, address: str, retry_in: float):
+        """
+        Initialize the error.
+
+        Args:
+            address: XML-RPC address of the peer
+            retry_in: Seconds until the next trial call
+        """
+        super().__init__(
+            f"Peer {address} is unavailable, retrying in {retry_in:.1f}s"
+        )
+        self.address = address
+        self.retry_in = retry_in
+
+
+class PeerConnection:
+    """
+    The managed connection to one peer and its circuit breaker.
+    """
+
+    def __init__(
+        self,
+        address: str,
+        failure_threshold: int = CIRCUIT_FAILURE_THRESHOLD,
+        base_delay: float = RECONNECT_BASE_DELAY,
+        max_delay: float = RECONNECT_MAX_DELAY,
+    ):
+        """
+        Initialize the connection with a closed circuit.
+
+        Args:
+            address: XML-RPC address of the peer
+            failure_threshold: Failed calls in a row that open the circuit
+            base_delay: Seconds before the first trial call
+            max_delay: Longest wait between trial calls
+        """
+        self.address = address
+        self.failure_threshold = failure_threshold
+        self.base_delay = base_delay
+        self.max_delay = max_delay
+        self.state = CLOSED
+        self.failures = 0  # failed calls in a row
+        self.opens = 0  # times opened since the last success
+        self.last_error: Optional[str] = None
+        self._retry_at = 0.0
+        self._lock = threading.Lock()
+
+    def before_call(self) -> None:
+        """
+        Let a call through, or refuse it while the circuit is open.
+
+        Raises:
+            PeerUnavailableError: If the circuit is open, or half open with
+                the trial call still running
+        """
+        with self._lock:
+            if self.state == CLOSED:
+                return
+            retry_in = self._retry_at - time.monotonic()
+            if self.state == OPEN and retry_in <= 0:
+                self.state = HALF_OPEN
+                return
+            raise PeerUnavailableError(self.address, max(0.0, retry_in))
+
+    def record_success(self) -> None:
+        """Close the circuit after a call the peer answered."""
+        with self._lock:
+            if self.state != CLOSED:
+                logger.info(f"Connection to {self.address} re-established")
+            self.state = CLOSED
+            self.failures = 0
+            self.opens = 0
+
+    def record_failure(self, error: Exception) -> None:
+        """
+        Count a failed call, opening the circuit if it was the last straw.
+
+        Args:
+            error: Why the call failed
+        """
+        with self._lock:
+            self.failures += 1
+            self.last_error = str(error)
+            if self.state == CLOSED and self.failures < self.failure_threshold:
+                return
+            delay = min(self.max_delay, self.base_delay * 2**self.opens)
+            delay *= 1 - random.uniform(0, RECONNECT_JITTER)
+            if self.state == CLOSED:
+                logger.warning(
+                    f"Opening circuit to {self.address} after "
+                    f"{self.failures} failed calls: {error}"
+                )
+            self.state = OPEN
+            self.opens += 1
+            self._retry_at = time.monotonic() + delay
+
+    def status(self) -> Dict:
+        """
+        Describe the connection.
+
+        Returns:
+            dict: address, state, failures, opens, retry_in (seconds
+            until the next trial call, 0 unless open) and last_error
+        """
+        with self._lock:
+            retry_in = 0.0
+            if self.state == OPEN:
+                retry_in = max(0.0, self._retry_at - time.monotonic())
+            return {
+                "address": self.address,
+                "state": self.state,
+                "failures": self.failures,
+                "opens": self.opens,
+                "retry_in": round(retry_in, 3),
+                "last_error": self.last_error,
+            }
+
+
+class PeerConnections:
+    """
+    The managed connections of this node, one per peer address.
+    """
+
+    def __init__(
+        self,
+        failure_threshold: int = CIRCUIT_FAILURE_THRESHOLD,
+        base_delay: float = RECONNECT_BASE_DELAY,
+        max_delay: float = RECONNECT_MAX_DELAY,
+    ):
+        """
+        Initialize the manager.
+
+        Args:
+            failure_threshold: Failed calls in a row that open a circuit
+            base_delay: Seconds before the first trial call to a peer
+            max_delay: Longest wait between trial calls (also caps
+                base_delay)
+
+        Raises:
+            ValueError: If the threshold is below 1 or a delay negative
+        """
+        if failure_threshold < 1:
+            raise ValueError("failure_threshold must be at least 1")
+        if base_delay < 0 or max_delay < 0:
+            raise ValueError("base_delay and max_delay must not be negative")
+        self.failure_threshold = failure_threshold
+        self.base_delay = min(base_delay, max_delay)
+        self.max_delay = max_delay
+        self._connections: Dict[str, PeerConnection] = {}
+        self._lock = threading.Lock()
+
+    def get(self, address: str) -> PeerConnection:
+        """
+        Get the connection to an address, creating it on first use.
+
+        Args:
+            address: XML-RPC address of the peer
+
+        Returns:
+            PeerConnection: The address's connection
+        """
+        with self._lock:
+            connection = self._connections.get(address)
+            if connection is None:
+                connection = self._connections[address] = PeerConnection(
+                    address,
+                    self.failure_threshold,
+                    self.base_delay,
+                    self.max_delay,
+                )
+            return connection
+
+    def status(self, address: str) -> Optional[Dict]:
+        """
+        Describe the connection to an address.
+
+        Args:
+            address: XML-RPC address of the peer
+
+        Returns:
+            dict: The connection's status, or None if it was never used
+        """
+        with self._lock:
+            connection = self._connections.get(address)
+        return connection.status() if connection else None
@@ -6,10 +6,16 @@ Manages the registry of peer nodes in the distributed system.
 
 import logging
 import socket
-from typing import Dict, List, Any
-from xmlrpc.client import ServerProxy, Fault
+from typing import Dict, List, Any, Optional
+from xmlrpc.client import Fault
 from concurrent.futures import ThreadPoolExecutor, as_completed
 
+from .log_context import ServerProxy
+from .compression import COMPRESSION_THRESHOLD
+from .peer_connections import PeerConnections
+from .rpc import RPCClientPool
+from .versioning import check_compatible
+
 logger = logging.getLogger(__name__)
 
 
@@ -21,17 +27,41 @@ class PeerRegistry:
     methods to query them via XML-RPC.
     """
 
-    def __init__(self, node_id: str, timeout: int = 3):
+    def __init__(
+        self,
+        node_id: str,
+        timeout: int = 3,
+        metrics=None,
+        compression_threshold: Optional[int] = COMPRESSION_THRESHOLD,
+        connections: Optional[PeerConnections] = None,
+    ):
         """
         Initialize the peer registry.
 
         Args:
             node_id: Unique identifier for this node
             timeout: Default timeout for XML-RPC calls in seconds
+            metrics: Optional NodeMetrics recording the latency of calls
+            compression_threshold: Smallest request body compressed, in
+                bytes (None sends requests uncompressed)
+            connections: PeerConnections holding each peer's circuit
+                breaker (defaults to a new one)
         """
         self.node_id = node_id
         self.timeout = timeout
         self._peers: Dict[str, str] = {}  # node_id -> node_address
+        # node_id -> capabilities advertised in the discovery handshake
+        self._capabilities: Dict[str, List[str]] = {}
+        # node_id -> capability tags advertised in the handshake
+        self._tags: Dict[str, Dict[str, str]] = {}
+        # node_id -> protocol version settled on in the handshake
+        self._versions: Dict[str, int] = {}
+        self.rpc = RPCClientPool(
+            timeout=timeout,
+            metrics=metrics,
+            compression_threshold=compression_threshold,
+            connections=connections,
+        )
 
     def register_peer(self, node_id: str, node_address: str):
         """
@@ -56,6 +86,122 @@ class PeerRegistry:
         """
         return self._peers.get(node_id)
 
+    def set_capabilities(self, node_id: str, capabilities: List[str]):
+        """
+        Record the capabilities a peer advertised.
+
+        Args:
+            node_id: Unique identifier for the peer node
+            capabilities: Capability names from the peer's handshake
+        """
+        self._capabilities[node_id] = list(capabilities)
+
+    def get_capabilities(self, node_id: str) -> List[str]:
+        """
+        Get the capabilities a peer advertised.
+
+        Args:
+            node_id: The node ID to look up
+
+        Returns:
+            Capability names (empty if the peer never handshook)
+        """
+        return list(self._capabilities.get(node_id, []))
+
+    def set_tags(self, node_id: str, tags: Dict[str, str]):
+        """
+        Record the capability tags a peer advertised (see placement.py).
+
+        Args:
+            node_id: Unique identifier for the peer node
+            tags: Tags from the peer's handshake (e.g., {"region": "eu"})
+        """
+        self._tags[node_id] = dict(tags)
+
+    def get_tags(self, node_id: str) -> Dict[str, str]:
+        """
+        Get the capability tags a peer advertised.
+
+        Args:
+            node_id: The node ID to look up
+
+        Returns:
+            The tags (empty if the peer never handshook or has none)
+        """
+        return dict(self._tags.get(node_id, {}))
+
+    def set_protocol_version(self, node_id: str, version: int):
+        """
+        Record the protocol version negotiated with a peer.
+
+        Args:
+            node_id: Unique identifier for the peer node
+            version: Version both nodes speak
+        """
+        self._versions[node_id] = version
+
+    def get_protocol_version(self, node_id: str) -> Optional[int]:
+        """
+        Get the protocol version negotiated with a peer.
+
+        Args:
+            node_id: The node ID to look up
+
+        Returns:
+            The version, or None if the peer never handshook
+        """
+        return self._versions.get(node_id)
+
+    def check_compatible(self, node_id: str, method: str) -> None:
+        """
+        Check that a peer's protocol version and capabilities can serve a
+        method (see versioning.py).
+
+        Args:
+            node_id: ID of the peer node
+            method: Name of the remote method
+
+        Raises:
+            IncompatiblePeerError: If the peer can't answer the method
+        """
+        check_compatible(
+            node_id,
+            method,
+            self.get_protocol_version(node_id),
+            self.get_capabilities(node_id),
+        )
+
+    def call_peer(
+        self, node_id: str, method: str, *args, timeout: Optional[float] = None
+    ) -> Any:
+        """
+        Call an XML-RPC method on a registered peer node.
+
+        Uses the pooled RPC client so connections are reused, calls are
+        bounded by a timeout and a peer that keeps failing isn't dialled
+        again until its circuit breaker allows it.
+
+        Args:
+            node_id: ID of the peer node
+            method: Name of the remote method
+            *args: Positional arguments for the remote method
+            timeout: Optional timeout override in seconds
+
+        Returns:
+            The remote method's return value
+
+        Raises:
+            ValueError: If the peer is not registered
+            IncompatiblePeerError: If the peer can't answer the method
+            PeerUnavailableError: If the peer's circuit is open
+            Exception: If the call fails or times out
+        """
+        node_address = self._peers.get(node_id)
+        if not node_address:
+            raise ValueError(f"Unknown peer node: {node_id}")
+        self.check_compatible(node_id, method)
+        return self.rpc.call(node_address, method, *args, timeout=timeout)
+
     def list_peers(self) -> Dict[str, str]:
         """
         Get all registered peer nodes.
@@ -65,6 +211,22 @@ class PeerRegistry:
         """
         return self._peers.copy()
 
+    def connection_status(self, node_id: str) -> Optional[Dict]:
+        """
+        Describe the managed connection to a peer node.
+
+        Args:
+            node_id: The node ID to look up
+
+        Returns:
+            dict: The connection's circuit state (see
+            PeerConnection.status), or None if the peer was never called
+        """
+        node_address = self._peers.get(node_id)
+        if not node_address:
+            return None
+        return self.rpc.connections.status(node_address)
+
     def query_peer_rooms(self, node_id: str, node_address: str) -> List[Dict]:
         """
         Query a single peer node for its hosted rooms.
@@ -0,0 +1,73 @@
+"""
+Pinned Messages
+
+The owner and moderators of a room can pin messages to it with
+pin_message, e.g. rules or an important announcement, and unpin them
+again with unpin_message. A room pins at most MAX_PINNED_MESSAGES
+messages, kept in the order they were pinned; deleting a pinned message
+unpins it.
+
+Pins are room metadata like retention policies: the administrator writes
+the room's pinned message IDs to its message log, sends them with
+replication, snapshots, join responses and history pages, and announces
+each change with a message_pinned or message_unpinned event carrying the
+room's pins, so every node shows the same ones.
+"""
+
+from typing import List
+
+# Pin configuration
+MAX_PINNED_MESSAGES = 50  # most messages a room can pin
+
+# Whether a message was pinned -> type of the event announcing it
+PIN_EVENT_TYPES = {True: "message_pinned", False: "message_unpinned"}
+
+
+class PinError(Exception):
+    """A message could not be pinned or unpinned."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "PIN_LIMIT")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def update_pins(
+    pinned: List[str],
+    message_id: str,
+    pin: bool,
+    limit: int = MAX_PINNED_MESSAGES,
+) -> List[str]:
+    """
+    Pin or unpin a message in a room's list of pinned message IDs.
+
+    Pinning a pinned message or unpinning one that isn't pinned leaves
+    the list as it is.
+
+    Args:
+        pinned: The room's pinned message IDs, in the order pinned
+        message_id: ID of the message
+        pin: True to pin the message, False to unpin it
+        limit: Most messages the room may pin
+
+    Returns:
+        The new list of pinned message IDs
+
+    Raises:
+        PinError: If the room already pins the most messages it may
+    """
+    if not pin:
+        return [pinned_id for pinned_id in pinned if pinned_id != message_id]
+    if message_id in pinned:
+        return list(pinned)
+    if len(pinned) >= limit:
+        raise PinError(
+            f"A room can pin at most {limit} messages", "PIN_LIMIT"
+        )
+    return list(pinned) + [message_id]
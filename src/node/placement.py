@@ -0,0 +1,249 @@
+"""
+Node Capability Tags and Room Placement
+
+Each node can be given capability tags, KEY=VALUE pairs describing where
+it runs and what it offers (e.g., region=eu, storage=persistent), with
+the node_tags setting. Nodes advertise their tags in the discovery
+handshake (see discovery.py), and keep their peers' in the PeerRegistry.
+
+A room can be created with placement constraints: tags its administrator
+must have, e.g. {"region": "eu"} to keep a room's messages on European
+nodes. A node matches when it has every tag of the constraints with the
+same value; a room without constraints can be on any node. When a room is
+created:
+
+- a room nobody matches (by the tags known here) is refused
+- a room this node matches stays here
+- any other room is handed off to a live matching peer right away, the
+  way sharding moves rooms (see sharding.py); the peer is picked from
+  the matching nodes by consistent hashing, so rooms with the same
+  constraints spread evenly over them
+
+The constraints are room metadata like the delivery guarantee, so they
+are logged, replicated and snapshotted with the room. A node
+administering a room it doesn't match, e.g. after a failover elected it
+or a handoff found no matching peer alive, moves the room to a matching
+peer in its next placement round, every PLACEMENT_INTERVAL seconds. A
+node shutting down hands its rooms to matching peers first. Constrained
+rooms are left to placement by sharding's rebalancing.
+"""
+
+import logging
+import re
+from typing import Dict, Iterable, List, Optional
+
+from .sharding import HashRing, move_room
+
+logger = logging.getLogger(__name__)
+
+# Placement configuration
+MAX_TAGS = 16  # tags per node or room
+PLACEMENT_INTERVAL = 10  # seconds between placement rounds
+MAX_PLACEMENT_MOVES = 20  # rooms moved per placement round
+
+_TAG_PATTERN = re.compile(r"^[A-Za-z0-9_.-]{1,64}$")
+
+
+def _check_tags(tags: Dict[str, str], name: str) -> Dict[str, str]:
+    """Check the keys and values of tags, naming them name in errors."""
+    if len(tags) > MAX_TAGS:
+        raise ValueError(f"{name} may have at most {MAX_TAGS} tags")
+    for key, value in tags.items():
+        for part in (key, value):
+            if not isinstance(part, str) or not _TAG_PATTERN.match(part):
+                raise ValueError(
+                    f"Invalid {name} tag {key!r}={value!r}: keys and values "
+                    f"are 1 to 64 letters, digits, '.', '_' or '-'"
+                )
+    return dict(tags)
+
+
+def parse_tags(specs: Iterable[str]) -> Dict[str, str]:
+    """
+    Parse node tags given as KEY=VALUE strings.
+
+    Args:
+        specs: The tags (e.g., ["region=eu", "storage=persistent"])
+
+    Returns:
+        dict: Tag key -> value
+
+    Raises:
+        ValueError: If a tag isn't KEY=VALUE, a key is given twice, or a
+            key or value is invalid
+    """
+    tags = {}
+    for spec in specs:
+        key, sep, value = spec.partition("=")
+        if not sep:
+            raise ValueError(f"Node tag {spec!r} must be KEY=VALUE")
+        if key in tags:
+            raise ValueError(f"Node tag {key!r} is given twice")
+        tags[key] = value
+    return _check_tags(tags, "node")
+
+
+def validate_placement(placement: Optional[Dict]) -> Dict[str, str]:
+    """
+    Check the placement constraints chosen for a room.
+
+    Args:
+        placement: Tags the room's administrator must have, or None for
+            no constraints
+
+    Returns:
+        dict: The constraints (empty if none were given)
+
+    Raises:
+        ValueError: If placement isn't an object of valid tags
+    """
+    if placement is None:
+        return {}
+    if not isinstance(placement, dict):
+        raise ValueError("placement must be an object of tags")
+    return _check_tags(placement, "placement")
+
+
+def matches(tags: Dict[str, str], placement: Dict[str, str]) -> bool:
+    """
+    Check whether a node's tags satisfy a room's placement constraints.
+
+    Args:
+        tags: The node's tags
+        placement: The room's constraints
+
+    Returns:
+        True if the node has every constrained tag with the same value
+    """
+    return all(tags.get(key) == value for key, value in placement.items())
+
+
+class RoomPlacement:
+    """
+    Keeps the rooms this node administers on nodes matching their
+    placement constraints.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        tags: Dict[str, str],
+        room_manager,
+        failover,
+    ):
+        """
+        Initialize placement.
+
+        Args:
+            node_id: ID of this node
+            tags: This node's capability tags
+            room_manager: RoomStateManager hosting this node's rooms
+            failover: RoomFailover handing rooms off; its peer registry
+                has the peers' tags and its live peers are the candidates
+        """
+        self.node_id = node_id
+        self.tags = dict(tags)
+        self.room_manager = room_manager
+        self.failover = failover
+
+    def matching_peers(
+        self, placement: Dict[str, str], peer_ids: Iterable[str]
+    ) -> List[str]:
+        """
+        Get the peers whose tags satisfy placement constraints.
+
+        Args:
+            placement: The room's constraints
+            peer_ids: IDs of the peers to check, in order
+
+        Returns:
+            list: The matching peer IDs, in the same order
+        """
+        registry = self.failover.peer_registry
+        return [
+            peer_id
+            for peer_id in peer_ids
+            if matches(registry.get_tags(peer_id), placement)
+        ]
+
+    def can_place(self, placement: Dict[str, str]) -> bool:
+        """
+        Check whether this node or a live peer matches constraints.
+
+        Args:
+            placement: The room's constraints
+
+        Returns:
+            True if a room with them can be created
+        """
+        return matches(self.tags, placement) or bool(
+            self.matching_peers(placement, self.failover.live_peers())
+        )
+
+    def target_of(self, room_id: str) -> Optional[str]:
+        """
+        Choose the node that should administer a room hosted here.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            This node's ID if it matches the room's constraints (or the
+            room has none), a live matching peer's otherwise, or None if
+            nobody alive matches
+        """
+        room = self.room_manager.get_room(room_id)
+        if room is None or matches(self.tags, room.placement):
+            return self.node_id
+        peers = self.matching_peers(
+            room.placement, self.failover.live_peers()
+        )
+        return HashRing(peers).owner(room_id)
+
+    def place_room(self, room_id: str) -> str:
+        """
+        Move a room hosted here to a matching node, if this isn't one.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            ID of the node administering the room afterwards
+        """
+        target = self.target_of(room_id)
+        if target is None:
+            logger.warning(
+                f"No live node matches the placement of room {room_id}"
+            )
+            return self.node_id
+        if target == self.node_id:
+            return self.node_id
+        if not move_room(self.room_manager, self.failover, room_id, target):
+            return self.node_id
+        logger.info(f"Placed room {room_id} on matching node {target}")
+        return target
+
+    def rebalance(self, max_moves: int = MAX_PLACEMENT_MOVES) -> Dict[str, str]:
+        """
+        Move the rooms hosted here that this node doesn't match.
+
+        Args:
+            max_moves: Most rooms moved in this round; the rest move in
+                the next rounds
+
+        Returns:
+            dict: Maps each moved room ID to its new admin node ID
+        """
+        moved = {}
+        for info in self.room_manager.list_rooms():
+            if len(moved) >= max_moves:
+                break
+            room = self.room_manager.get_room(info["room_id"])
+            if room is None or matches(self.tags, room.placement):
+                continue
+            admin = self.place_room(room.room_id)
+            if admin != self.node_id:
+                moved[room.room_id] = admin
+        if moved:
+            logger.info(f"Moved {len(moved)} rooms to matching nodes")
+        return moved
@@ -0,0 +1,580 @@
+"""
+User Presence Service
+
+Tracks which nodes each user is connected to and whether they are
+online, away or offline. Nodes use it to route direct messages to the
+recipient's nodes and to tell clients when members of their rooms come
+and go.
+
+Each node publishes entries for the users connected to it. Changes to
+those entries are pushed to every peer with the receive_presence_update
+RPC, and the whole directory is also gossiped periodically so nodes that
+missed a push still converge, like the room directory.
+
+Changes are debounced: a user's changes are published at most once per
+PRESENCE_DEBOUNCE seconds, with only the latest status, and a connection
+that drops and comes back within the window publishes nothing at all.
+That keeps flapping connections from flooding peers and clients.
+
+A user can be connected from several devices, through different nodes,
+so a user has one entry per node, published by that node. Each entry
+gets a version from a millisecond timestamp bumped past the previous
+version, and the highest version of an entry wins. Direct messages go to
+every node the user is online on; locate() gives the most recent online
+connection. Clients see one status per user: online if any device is,
+away if all of them are, and offline once the last one is gone.
+"""
+
+import logging
+import random
+import threading
+import time
+from dataclasses import dataclass, asdict, replace
+from typing import Any, Dict, List, Optional, Tuple
+
+from .failure_detector import MembershipEvent, PeerState
+from .room_directory import GOSSIP_FANOUT
+
+logger = logging.getLogger(__name__)
+
+# Presence configuration
+PRESENCE_TTL = 3600  # seconds to remember users after they went offline
+PRESENCE_DEBOUNCE = 2  # seconds a user's changes are collected
+PRESENCE_PUSH_TIMEOUT = 1  # seconds to wait for each peer on a push
+PRESENCE_PUBLISH_INTERVAL = 0.5  # seconds between checks for changes
+
+# Presence statuses; clients may choose between online and away
+STATUS_ONLINE = "online"
+STATUS_AWAY = "away"
+STATUS_OFFLINE = "offline"
+CLIENT_STATUSES = (STATUS_ONLINE, STATUS_AWAY)
+
+
+@dataclass
+class PresenceEntry:
+    """
+    Where a user was last seen, and their status.
+
+    Attributes:
+        username: The user
+        node_id: Node the user is (or was last) connected to
+        node_address: XML-RPC address of that node
+        status: "online", "away" or "offline"
+        version: Version of the connection; the highest version wins
+        updated_at: Local UNIX time when this entry was last changed
+    """
+
+    username: str
+    node_id: str
+    node_address: str = ""
+    status: str = STATUS_ONLINE
+    version: int = 1
+    updated_at: float = 0.0
+
+    def __post_init__(self):
+        """Initialize the update time if not set."""
+        if not self.updated_at:
+            self.updated_at = time.time()
+
+    @property
+    def online(self) -> bool:
+        """True while the user has a connection to the node."""
+        return self.status != STATUS_OFFLINE
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "PresenceEntry":
+        """Create an entry from a dictionary received from a peer."""
+        status = data.get("status", STATUS_OFFLINE)
+        if status not in CLIENT_STATUSES + (STATUS_OFFLINE,):
+            raise ValueError(f"Unknown presence status: {status}")
+        return cls(
+            username=data["username"],
+            node_id=data["node_id"],
+            node_address=data.get("node_address", ""),
+            status=status,
+            version=int(data.get("version", 1)),
+        )
+
+
+def _next_version(current: Optional[PresenceEntry]) -> int:
+    """Get a version newer than the current entry's."""
+    version = int(time.time() * 1000)
+    if current is not None and version <= current.version:
+        version = current.version + 1
+    return version
+
+
+def _newer(incoming: PresenceEntry, current: PresenceEntry) -> bool:
+    """Check whether an incoming entry supersedes the current one."""
+    if incoming.version != current.version:
+        return incoming.version > current.version
+    return current.online and not incoming.online
+
+
+def _primary(entries: List[PresenceEntry]) -> Optional[PresenceEntry]:
+    """Pick a user's most recent online entry, or most recent one."""
+    if not entries:
+        return None
+    return max(entries, key=lambda entry: (entry.online, entry.version))
+
+
+def _combined_status(entries: List[PresenceEntry]) -> str:
+    """Get a user's status across all the nodes they are on."""
+    statuses = {entry.status for entry in entries}
+    for status in (STATUS_ONLINE, STATUS_AWAY):
+        if status in statuses:
+            return status
+    return STATUS_OFFLINE
+
+
+class PresenceDirectory:
+    """
+    Thread-safe directory of where users in the cluster are connected.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        node_address: str = "",
+        debounce: float = PRESENCE_DEBOUNCE,
+    ):
+        """
+        Initialize the presence directory.
+
+        Args:
+            node_id: ID of this node
+            node_address: XML-RPC address of this node
+            debounce: Seconds a user's changes are collected before
+                take_changes() returns them
+        """
+        self.node_id = node_id
+        self.node_address = node_address
+        self.debounce = debounce
+        self._lock = threading.Lock()
+        # Maps username -> node ID -> entry
+        self._entries: Dict[str, Dict[str, PresenceEntry]] = {}
+        # Users with a connection to this node
+        self._local: set = set()
+        # Maps username -> time of its first unpublished change
+        self._changed: Dict[str, float] = {}
+        # Maps username -> (status, node_id) last returned by take_changes
+        self._published: Dict[str, Tuple[str, str]] = {}
+        # Dead nodes whose entries were forgotten, ignored in merges
+        self._forgotten: set = set()
+
+    def set_online(self, username: str) -> None:
+        """
+        Record that a user connected to this node.
+
+        Args:
+            username: The user
+        """
+        with self._lock:
+            self._local.add(username)
+            current = self._own_entry(username)
+            if current is not None and current.online:
+                return
+            self._store(
+                PresenceEntry(
+                    username=username,
+                    node_id=self.node_id,
+                    node_address=self.node_address,
+                    version=_next_version(current),
+                )
+            )
+            self._mark_changed(username)
+        logger.debug(f"User {username} is online on {self.node_id}")
+
+    def set_status(self, username: str, status: str) -> bool:
+        """
+        Set the status chosen by a user connected to this node.
+
+        Args:
+            username: The user
+            status: "online" or "away"
+
+        Returns:
+            bool: True if the user is connected here
+
+        Raises:
+            ValueError: If the status is not one clients may set
+        """
+        if status not in CLIENT_STATUSES:
+            raise ValueError(f"Status must be one of {CLIENT_STATUSES}")
+        with self._lock:
+            current = self._own_entry(username)
+            if username not in self._local or current is None:
+                return False
+            if current.status != status:
+                current.status = status
+                current.version = _next_version(current)
+                current.updated_at = time.time()
+                self._mark_changed(username)
+        return True
+
+    def set_offline(self, username: str) -> None:
+        """
+        Record that a user's last connection to this node closed.
+
+        Entries for other nodes are left alone, since the user may still
+        be connected there.
+
+        Args:
+            username: The user
+        """
+        with self._lock:
+            self._local.discard(username)
+            current = self._own_entry(username)
+            if current is None or not current.online:
+                return
+            current.status = STATUS_OFFLINE
+            current.updated_at = time.time()
+            self._mark_changed(username)
+        logger.debug(f"User {username} is offline on {self.node_id}")
+
+    def mark_node_offline(self, node_id: str) -> int:
+        """
+        Mark every user connected to a failed node as offline.
+
+        Args:
+            node_id: The failed node
+
+        Returns:
+            Number of users marked offline
+        """
+        marked = 0
+        with self._lock:
+            for nodes in self._entries.values():
+                entry = nodes.get(node_id)
+                if entry is not None and entry.online:
+                    entry.status = STATUS_OFFLINE
+                    entry.updated_at = time.time()
+                    self._mark_changed(entry.username)
+                    marked += 1
+        return marked
+
+    def on_membership_change(self, event: MembershipEvent) -> None:
+        """
+        Failure detector subscriber: take users on dead nodes offline.
+
+        Args:
+            event: The membership change
+        """
+        if event.current == PeerState.DEAD:
+            marked = self.mark_node_offline(event.node_id)
+            if marked:
+                logger.info(f"Marked {marked} users on {event.node_id} offline")
+        elif event.current == PeerState.ALIVE:
+            with self._lock:
+                self._forgotten.discard(event.node_id)
+
+    def forget_node(self, node_id: str) -> int:
+        """
+        Drop every entry of a dead node.
+
+        Users who were online there are still published as offline, and
+        entries of the node gossiped by peers are ignored until it is
+        alive again, so they don't come back.
+
+        Args:
+            node_id: The dead node
+
+        Returns:
+            Number of entries removed
+        """
+        removed = 0
+        with self._lock:
+            self._forgotten.add(node_id)
+            for username, nodes in list(self._entries.items()):
+                entry = nodes.pop(node_id, None)
+                if entry is None:
+                    continue
+                if entry.online:
+                    self._mark_changed(username)
+                if not nodes:
+                    del self._entries[username]
+                removed += 1
+        return removed
+
+    def merge(self, entries: List[Dict[str, Any]]) -> int:
+        """
+        Merge entries received from a peer.
+
+        An incoming entry replaces the one for the same user and node if
+        its version is higher, or if it marks the same connection offline.
+        A peer that wrongly marked a user connected here as offline (e.g.
+        after suspecting this node had failed) is overruled with a newer
+        online entry.
+
+        Args:
+            entries: Entry dicts from a peer's directory
+
+        Returns:
+            Number of entries that were added or updated
+        """
+        updated = 0
+        with self._lock:
+            for data in entries:
+                try:
+                    incoming = PresenceEntry.from_dict(data)
+                except (KeyError, TypeError, ValueError) as e:
+                    logger.warning(f"Ignoring malformed presence entry: {e}")
+                    continue
+
+                if incoming.node_id in self._forgotten:
+                    continue
+                current = self._entries.get(incoming.username, {}).get(
+                    incoming.node_id
+                )
+                if current is not None and not _newer(incoming, current):
+                    continue
+                if (
+                    incoming.node_id == self.node_id
+                    and incoming.username in self._local
+                    and not incoming.online
+                ):
+                    incoming = PresenceEntry(
+                        username=incoming.username,
+                        node_id=self.node_id,
+                        node_address=self.node_address,
+                        status=current.status if current else STATUS_ONLINE,
+                        version=_next_version(incoming),
+                    )
+                self._store(incoming)
+                self._mark_changed(incoming.username)
+                updated += 1
+        if updated:
+            logger.debug(f"Merged {updated} presence entries")
+        return updated
+
+    def locate(self, username: str) -> Optional[PresenceEntry]:
+        """
+        Find where a user is.
+
+        Args:
+            username: The user
+
+        Returns:
+            The PresenceEntry of the user's most recent online connection
+            (or of the last one, if offline), or None if the user has not
+            been seen
+        """
+        with self._lock:
+            return _primary(list(self._entries.get(username, {}).values()))
+
+    def locate_all(self, username: str) -> List[PresenceEntry]:
+        """
+        Find every node a user is online on.
+
+        Args:
+            username: The user
+
+        Returns:
+            The user's online entries, most recent first
+        """
+        with self._lock:
+            entries = self._entries.get(username, {}).values()
+            return sorted(
+                (entry for entry in entries if entry.online),
+                key=lambda entry: entry.version,
+                reverse=True,
+            )
+
+    def get_status(self, username: str) -> str:
+        """Get a user's status ("offline" if the user has not been seen)."""
+        with self._lock:
+            return _combined_status(self._entries.get(username, {}).values())
+
+    def get_entries(self) -> List[Dict[str, Any]]:
+        """Get all entries for gossiping."""
+        with self._lock:
+            return [
+                entry.to_dict()
+                for nodes in self._entries.values()
+                for entry in nodes.values()
+            ]
+
+    def get_local_entries(self, usernames: List[str]) -> List[Dict[str, Any]]:
+        """
+        Get this node's own entries for some users.
+
+        Args:
+            usernames: The users
+
+        Returns:
+            Entry dicts of the users that have been on this node
+        """
+        with self._lock:
+            entries = (self._own_entry(username) for username in usernames)
+            return [entry.to_dict() for entry in entries if entry]
+
+    def online_users(self) -> List[str]:
+        """Get the users currently online or away anywhere in the cluster."""
+        with self._lock:
+            return sorted(
+                username
+                for username, nodes in self._entries.items()
+                if any(entry.online for entry in nodes.values())
+            )
+
+    def take_changes(self, now: Optional[float] = None) -> List[PresenceEntry]:
+        """
+        Get the users whose presence changed, once the debounce has passed.
+
+        A user is returned once their first unpublished change is at least
+        debounce seconds old, with the entry locate() would give and their
+        status across all their devices. Users whose status and node are
+        back to what was last returned, or who went offline before they
+        were ever returned, are skipped.
+
+        Args:
+            now: Current UNIX time (defaults to time.time())
+
+        Returns:
+            Copies of the changed entries
+        """
+        now = time.time() if now is None else now
+        changes = []
+        with self._lock:
+            ready = [
+                username
+                for username, changed_at in self._changed.items()
+                if now - changed_at >= self.debounce
+            ]
+            for username in ready:
+                del self._changed[username]
+                entries = list(self._entries.get(username, {}).values())
+                entry = _primary(entries)
+                last = self._published.get(username)
+                if entry is None and last is not None:
+                    # Every entry was forgotten (see forget_node)
+                    del self._published[username]
+                    if last[0] != STATUS_OFFLINE:
+                        changes.append(
+                            PresenceEntry(
+                                username, last[1], status=STATUS_OFFLINE
+                            )
+                        )
+                    continue
+                if entry is None:
+                    continue
+                entry = replace(entry, status=_combined_status(entries))
+                published = (entry.status, entry.node_id)
+                if last == published or (last is None and not entry.online):
+                    continue
+                self._published[username] = published
+                changes.append(entry)
+        return changes
+
+    def purge_offline(self, ttl: float = PRESENCE_TTL) -> int:
+        """
+        Forget connections that have been offline longer than the TTL.
+
+        Args:
+            ttl: Age in seconds after which offline entries are dropped
+
+        Returns:
+            Number of entries removed
+        """
+        cutoff = time.time() - ttl
+        removed = 0
+        with self._lock:
+            for username, nodes in list(self._entries.items()):
+                for node_id, entry in list(nodes.items()):
+                    if not entry.online and entry.updated_at < cutoff:
+                        del nodes[node_id]
+                        removed += 1
+                if not nodes:
+                    del self._entries[username]
+                    self._changed.pop(username, None)
+                    self._published.pop(username, None)
+        return removed
+
+    def _own_entry(self, username: str) -> Optional[PresenceEntry]:
+        """Get this node's entry for a user (call with the lock held)."""
+        return self._entries.get(username, {}).get(self.node_id)
+
+    def _store(self, entry: PresenceEntry) -> None:
+        """Add or replace an entry (call with the lock held)."""
+        self._entries.setdefault(entry.username, {})[entry.node_id] = entry
+
+    def _mark_changed(self, username: str) -> None:
+        """Note a change to publish (call with the lock held)."""
+        self._changed.setdefault(username, time.time())
+
+
+def presence_gossip_round(
+    presence: PresenceDirectory,
+    peer_registry,
+    fanout: int = GOSSIP_FANOUT,
+) -> List[str]:
+    """
+    Run one push-pull gossip round of the presence directory.
+
+    Args:
+        presence: The local presence directory
+        peer_registry: PeerRegistry used to reach peers
+        fanout: Number of peers to contact
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    presence.purge_offline()
+
+    peers = list(peer_registry.list_peers().keys())
+    if not peers:
+        return []
+
+    reached = []
+    for peer_id in random.sample(peers, min(fanout, len(peers))):
+        try:
+            remote_entries = peer_registry.call_peer(
+                peer_id, "exchange_presence", presence.get_entries()
+            )
+            presence.merge(remote_entries)
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Presence gossip with {peer_id} failed: {e}")
+    return reached
+
+
+def push_presence_changes(
+    presence: PresenceDirectory,
+    changes: List[PresenceEntry],
+    peer_registry,
+    timeout: float = PRESENCE_PUSH_TIMEOUT,
+) -> List[str]:
+    """
+    Push changes to users connected to this node to every peer.
+
+    Only this node's own entries for the changed users are pushed; the
+    nodes a user is connected to push theirs, and gossip repairs missed
+    pushes.
+
+    Args:
+        presence: The local presence directory
+        changes: Entries returned by take_changes()
+        peer_registry: PeerRegistry used to reach peers
+        timeout: Seconds to wait for each peer
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    local = presence.get_local_entries([entry.username for entry in changes])
+    if not local:
+        return []
+
+    reached = []
+    for peer_id in peer_registry.list_peers():
+        try:
+            peer_registry.call_peer(
+                peer_id, "receive_presence_update", local, timeout=timeout
+            )
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Presence push to {peer_id} failed: {e}")
+    return reached
@@ -0,0 +1,422 @@
+"""
+User Profile Service
+
+Keeps each user's display name, avatar (a URL and an optional hash of the
+image, so clients can cache it) and bio. Clients change their own profile
+with the update_profile command on whichever node they are connected to,
+and read the profiles of other users with get_profile.
+
+Profiles are not owned by one node, since a user can connect anywhere.
+Every change is stamped with the node's hybrid logical clock and the
+profile with the highest timestamp wins (last-writer-wins), so nodes
+that see changes in different orders still agree. A change is pushed to
+every peer with the receive_profile_update RPC and the whole registry is
+also gossiped periodically, like user presence, so nodes that missed a
+push converge.
+
+Whenever a node adopts a newer profile, clients in rooms the user is a
+member of get a profile_updated event, so names and avatars update right
+away.
+
+The profile also keeps the users the user blocked with block_user, so
+the block list follows the user to every node and device like the rest
+of the profile. Nodes leave messages, direct messages and invites of
+blocked users out of the blocking user's delivery stream. The block
+list is private: profiles given to other users (public_dict) leave it
+out, and only the user's own connections get it in profile_updated.
+"""
+
+import logging
+import random
+import re
+import threading
+from dataclasses import asdict, dataclass, field, replace
+from typing import Any, Callable, Dict, List, Optional, Set
+
+from .clock import HybridLogicalClock
+from .room_directory import GOSSIP_FANOUT
+
+logger = logging.getLogger(__name__)
+
+# Profile configuration
+MAX_DISPLAY_NAME_LENGTH = 64
+MAX_BIO_LENGTH = 500
+MAX_AVATAR_URL_LENGTH = 2048
+PROFILE_PUSH_TIMEOUT = 1  # seconds to wait for each peer on a push
+MAX_BLOCKED_USERS = 1000  # users each user can block
+
+# Profile fields clients may change with update_profile
+PROFILE_FIELDS = ("display_name", "avatar_url", "avatar_hash", "bio")
+
+# Hex digest of the avatar image (e.g., SHA-256)
+_AVATAR_HASH = re.compile(r"^[0-9a-fA-F]{8,128}$")
+
+
+class ProfileError(Exception):
+    """A profile change was refused."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_PROFILE")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+@dataclass
+class UserProfile:
+    """
+    A user's public profile.
+
+    Attributes:
+        username: The user
+        display_name: Name shown instead of the username, if set
+        avatar_url: http(s) URL of the avatar image
+        avatar_hash: Hex digest of the avatar image
+        bio: Short text about the user
+        hlc: Encoded HLC timestamp of the last change; the highest wins
+        blocked: Usernames the user blocked, sorted (never shown to other
+            users)
+    """
+
+    username: str
+    display_name: str = ""
+    avatar_url: str = ""
+    avatar_hash: str = ""
+    bio: str = ""
+    hlc: str = ""
+    blocked: List[str] = field(default_factory=list)
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+    def public_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for other users, without the block list."""
+        data = self.to_dict()
+        del data["blocked"]
+        return data
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "UserProfile":
+        """
+        Create a profile from a dictionary received from a peer.
+
+        Raises:
+            ProfileError: If a field is invalid
+        """
+        fields = {field: data.get(field, "") for field in PROFILE_FIELDS}
+        validate_profile_fields(fields)
+        blocked = data.get("blocked", [])
+        if not isinstance(blocked, list) or not all(
+            isinstance(name, str) and name for name in blocked
+        ):
+            raise ProfileError(
+                "Blocked users must be a list of usernames", "INVALID_PROFILE"
+            )
+        return cls(
+            username=data["username"],
+            hlc=str(data.get("hlc", "")),
+            blocked=sorted(set(blocked)),
+            **fields,
+        )
+
+
+def validate_profile_fields(fields: Dict[str, Any]) -> None:
+    """
+    Check the profile fields of an update.
+
+    Empty strings are allowed and clear a field.
+
+    Args:
+        fields: Maps field name -> new value
+
+    Raises:
+        ProfileError: If a field is unknown, not a string or invalid
+    """
+    for field, value in fields.items():
+        if field not in PROFILE_FIELDS:
+            raise ProfileError(
+                f"Unknown profile field: {field}", "INVALID_PROFILE"
+            )
+        if not isinstance(value, str):
+            raise ProfileError(
+                f"Profile field {field} must be a string", "INVALID_PROFILE"
+            )
+
+    display_name = fields.get("display_name", "")
+    if len(display_name) > MAX_DISPLAY_NAME_LENGTH:
+        raise ProfileError(
+            f"Display name is longer than {MAX_DISPLAY_NAME_LENGTH} "
+            f"characters",
+            "INVALID_PROFILE",
+        )
+    if len(fields.get("bio", "")) > MAX_BIO_LENGTH:
+        raise ProfileError(
+            f"Bio is longer than {MAX_BIO_LENGTH} characters",
+            "INVALID_PROFILE",
+        )
+    avatar_url = fields.get("avatar_url", "")
+    if avatar_url and (
+        len(avatar_url) > MAX_AVATAR_URL_LENGTH
+        or not avatar_url.startswith(("http://", "https://"))
+    ):
+        raise ProfileError(
+            "Avatar URL must be an http(s) URL of at most "
+            f"{MAX_AVATAR_URL_LENGTH} characters",
+            "INVALID_PROFILE",
+        )
+    avatar_hash = fields.get("avatar_hash", "")
+    if avatar_hash and not _AVATAR_HASH.match(avatar_hash):
+        raise ProfileError(
+            "Avatar hash must be a hex digest", "INVALID_PROFILE"
+        )
+
+
+class ProfileRegistry:
+    """
+    Thread-safe registry of user profiles, merged last-writer-wins.
+    """
+
+    def __init__(self, clock: HybridLogicalClock):
+        """
+        Initialize the profile registry.
+
+        Args:
+            clock: The node's hybrid logical clock, used to stamp changes
+        """
+        self.clock = clock
+        self._lock = threading.Lock()
+        self._profiles: Dict[str, UserProfile] = {}
+        self._subscribers: List[Callable[[List[UserProfile]], None]] = []
+
+    def subscribe(
+        self, callback: Callable[[List[UserProfile]], None]
+    ) -> None:
+        """
+        Register a callback for profiles adopted from peers.
+
+        Args:
+            callback: Function called with copies of the profiles merge()
+                added or replaced
+        """
+        self._subscribers.append(callback)
+
+    def update(self, username: str, fields: Dict[str, Any]) -> UserProfile:
+        """
+        Change fields of a user's profile.
+
+        Fields not given keep their values.
+
+        Args:
+            username: The user
+            fields: Maps field name -> new value
+
+        Returns:
+            UserProfile: A copy of the updated profile
+
+        Raises:
+            ProfileError: If a field is invalid
+        """
+        validate_profile_fields(fields)
+        with self._lock:
+            current = self._profiles.get(username) or UserProfile(username)
+            profile = replace(
+                current, hlc=self.clock.now().encode(), **fields
+            )
+            self._profiles[username] = profile
+        logger.debug(f"Profile of {username} updated at {profile.hlc}")
+        return replace(profile)
+
+    def block(
+        self, username: str, user: str, unblock: bool = False
+    ) -> UserProfile:
+        """
+        Block or unblock a user for another user.
+
+        Args:
+            username: The blocking user
+            user: Username of the user to block or unblock
+            unblock: True to lift the block
+
+        Returns:
+            UserProfile: A copy of the blocking user's updated profile
+
+        Raises:
+            ProfileError: If the username is invalid, the user blocks
+                themselves or the limit is exceeded
+        """
+        if not isinstance(user, str) or not user:
+            raise ProfileError(
+                "block_user needs the username of a user", "INVALID_BLOCK"
+            )
+        if user == username:
+            raise ProfileError("Users cannot block themselves", "INVALID_BLOCK")
+        with self._lock:
+            current = self._profiles.get(username) or UserProfile(username)
+            blocked = set(current.blocked)
+            if unblock:
+                blocked.discard(user)
+            else:
+                blocked.add(user)
+            if len(blocked) > MAX_BLOCKED_USERS:
+                raise ProfileError(
+                    f"A user can block at most {MAX_BLOCKED_USERS} users",
+                    "TOO_MANY_BLOCKS",
+                )
+            profile = replace(
+                current, hlc=self.clock.now().encode(), blocked=sorted(blocked)
+            )
+            self._profiles[username] = profile
+        logger.info(f"{username} blocks {len(blocked)} users")
+        return replace(profile)
+
+    def blocks(self, username: str, sender: Optional[str]) -> bool:
+        """Check whether a user blocked a sender."""
+        with self._lock:
+            profile = self._profiles.get(username)
+            return profile is not None and sender in profile.blocked
+
+    def blocked_by(self, sender: Optional[str]) -> Set[str]:
+        """
+        Get the users that blocked a sender.
+
+        Args:
+            sender: Username of the sender
+
+        Returns:
+            Usernames whose delivery streams leave out the sender
+        """
+        if not sender:
+            return set()
+        with self._lock:
+            return {
+                profile.username
+                for profile in self._profiles.values()
+                if sender in profile.blocked
+            }
+
+    def merge(self, entries: List[Dict[str, Any]]) -> List[UserProfile]:
+        """
+        Merge profiles received from a peer.
+
+        An incoming profile replaces the local one if its HLC timestamp is
+        higher. Encoded timestamps compare in the same order as decoded
+        ones, so they are compared as strings.
+
+        Args:
+            entries: Profile dicts from a peer's registry
+
+        Returns:
+            Copies of the profiles that were added or replaced
+        """
+        updated = []
+        with self._lock:
+            for data in entries:
+                try:
+                    incoming = UserProfile.from_dict(data)
+                except (KeyError, TypeError, ProfileError) as e:
+                    logger.warning(f"Ignoring malformed profile: {e}")
+                    continue
+
+                current = self._profiles.get(incoming.username)
+                if current is not None and incoming.hlc <= current.hlc:
+                    continue
+                self.clock.update(incoming.hlc)
+                self._profiles[incoming.username] = incoming
+                updated.append(replace(incoming))
+        if updated:
+            logger.debug(f"Merged {len(updated)} profiles")
+            for callback in self._subscribers:
+                try:
+                    callback(updated)
+                except Exception as e:
+                    logger.error(f"Error in profile subscriber: {e}")
+        return updated
+
+    def get(self, username: str) -> Optional[UserProfile]:
+        """
+        Get a user's profile.
+
+        Args:
+            username: The user
+
+        Returns:
+            A copy of the UserProfile, or None if the user has none
+        """
+        with self._lock:
+            profile = self._profiles.get(username)
+            return replace(profile) if profile else None
+
+    def get_entries(self) -> List[Dict[str, Any]]:
+        """Get all profiles for gossiping."""
+        with self._lock:
+            return [profile.to_dict() for profile in self._profiles.values()]
+
+
+def profile_gossip_round(
+    profiles: ProfileRegistry,
+    peer_registry,
+    fanout: int = GOSSIP_FANOUT,
+) -> List[str]:
+    """
+    Run one push-pull gossip round of the profile registry.
+
+    Args:
+        profiles: The local profile registry
+        peer_registry: PeerRegistry used to reach peers
+        fanout: Number of peers to contact
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    peers = list(peer_registry.list_peers().keys())
+    if not peers:
+        return []
+
+    reached = []
+    for peer_id in random.sample(peers, min(fanout, len(peers))):
+        try:
+            remote_entries = peer_registry.call_peer(
+                peer_id, "exchange_profiles", profiles.get_entries()
+            )
+            profiles.merge(remote_entries)
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Profile gossip with {peer_id} failed: {e}")
+    return reached
+
+
+def push_profile_update(
+    profile: UserProfile,
+    peer_registry,
+    timeout: float = PROFILE_PUSH_TIMEOUT,
+) -> List[str]:
+    """
+    Push a profile changed on this node to every peer.
+
+    Args:
+        profile: The profile returned by ProfileRegistry.update()
+        peer_registry: PeerRegistry used to reach peers
+        timeout: Seconds to wait for each peer
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    reached = []
+    for peer_id in peer_registry.list_peers():
+        try:
+            peer_registry.call_peer(
+                peer_id,
+                "receive_profile_update",
+                [profile.to_dict()],
+                timeout=timeout,
+            )
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Profile push to {peer_id} failed: {e}")
+    return reached
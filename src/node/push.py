@@ -0,0 +1,609 @@
+"""
+Push Notifications
+
+Users register the push tokens of their devices (FCM or APNs) with the
+register_push_token command, and remove them with unregister_push_token,
+e.g. when they log out on a device. When a room message arrives for a
+member who is offline everywhere in the cluster, the room's administrator
+node queues a notification for each of the member's devices; a direct
+message that has to be buffered for its recipient is notified by the
+sender's node.
+
+Notifications are sent by a Notifier. PushGatewayNotifier POSTs them in
+batches to an external push gateway, an FCM/APNs-compatible HTTP endpoint
+that relays them to the devices:
+
+    POST <push_gateway_url>
+    Authorization: Bearer <push_gateway_key>
+    {"notifications": [{"token": "...", "platform": "fcm", "title": "...",
+                        "body": "...", "count": 1, "data": {...}}]}
+
+Notifications wait in a queue and are sent by a background task, never on
+the path of the message that caused them. Notifications for the same
+device and conversation that are still queued are merged into one with a
+count and the latest message, so a busy room sends one notification per
+device per round, not one per message. A batch the gateway refuses is
+retried in the next rounds, up to MAX_PUSH_ATTEMPTS times.
+
+Tokens are not owned by one node, since a user can connect anywhere. Each
+(user, token) record is stamped with the node's hybrid logical clock and
+the record with the highest timestamp wins; removed tokens are kept as
+tombstones so removals win over older registrations. Changes are pushed
+to every peer with the receive_push_tokens RPC and the registry is
+gossiped periodically, like user profiles. A token belongs to one user at
+a time: registering it for another user (someone else logging in on the
+device) removes it from the first.
+"""
+
+import json
+import logging
+import random
+import threading
+from abc import ABC, abstractmethod
+from collections import OrderedDict
+from dataclasses import asdict, dataclass, field, replace
+from typing import Any, Callable, Dict, List, Optional, Tuple
+
+from .clock import HybridLogicalClock
+from .room_directory import GOSSIP_FANOUT
+from .webhooks import http_post
+
+logger = logging.getLogger(__name__)
+
+# Push platforms a token can belong to
+PLATFORMS = ("fcm", "apns")
+
+# Push configuration
+MAX_DEVICE_TOKENS = 10  # per user
+MAX_TOKEN_LENGTH = 4096
+MAX_PREVIEW_LENGTH = 100  # characters of a message shown in a notification
+PUSH_BATCH_SIZE = 100  # notifications per gateway request
+MAX_QUEUED = 1000  # notifications waiting; the oldest are dropped beyond it
+MAX_PUSH_ATTEMPTS = 3  # attempts before a notification is dropped
+PUSH_TIMEOUT = 5  # seconds per gateway request
+PUSH_DELIVERY_INTERVAL = 1  # seconds between delivery rounds
+PUSH_TOKEN_PUSH_TIMEOUT = 1  # seconds to wait for each peer on a push
+
+
+class PushError(Exception):
+    """A push token could not be registered or removed."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_TOKEN")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+@dataclass
+class DeviceToken:
+    """
+    A push token registered by a user, or the tombstone of a removed one.
+
+    Attributes:
+        username: The user
+        token: The device's push token
+        platform: "fcm" or "apns"
+        hlc: Encoded HLC timestamp of the last change
+        removed: True once the token was unregistered
+    """
+
+    username: str
+    token: str
+    platform: str
+    hlc: str = ""
+    removed: bool = False
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "DeviceToken":
+        """
+        Create a record from a dictionary received from a peer.
+
+        Raises:
+            PushError: If the token or platform is invalid
+            KeyError: If a field is missing
+        """
+        record = cls(
+            username=data["username"],
+            token=data["token"],
+            platform=data["platform"],
+            hlc=data["hlc"],
+            removed=bool(data.get("removed", False)),
+        )
+        validate_token(record.token, record.platform)
+        return record
+
+
+def validate_token(token: Any, platform: Any) -> None:
+    """
+    Check a push token and its platform.
+
+    Raises:
+        PushError: INVALID_TOKEN or INVALID_PLATFORM
+    """
+    if not isinstance(token, str) or not token.strip():
+        raise PushError(
+            "Push token must be a non-empty string", "INVALID_TOKEN"
+        )
+    if len(token) > MAX_TOKEN_LENGTH:
+        raise PushError(
+            f"Push token too long (max {MAX_TOKEN_LENGTH} characters)",
+            "INVALID_TOKEN",
+        )
+    if platform not in PLATFORMS:
+        raise PushError(
+            f"Platform must be one of {', '.join(PLATFORMS)}",
+            "INVALID_PLATFORM",
+        )
+
+
+class PushTokenRegistry:
+    """
+    Thread-safe registry of users' push tokens, merged last-writer-wins.
+    """
+
+    def __init__(
+        self,
+        clock: HybridLogicalClock,
+        max_tokens: int = MAX_DEVICE_TOKENS,
+    ):
+        """
+        Initialize the token registry.
+
+        Args:
+            clock: The node's hybrid logical clock, used to stamp changes
+            max_tokens: Most tokens a user may register
+        """
+        self.clock = clock
+        self.max_tokens = max_tokens
+        self._lock = threading.Lock()
+        # Maps (username, token) -> record
+        self._tokens: Dict[Tuple[str, str], DeviceToken] = {}
+
+    def register(
+        self, username: str, token: str, platform: str
+    ) -> List[DeviceToken]:
+        """
+        Register a device's push token for a user.
+
+        Registering a token again refreshes it; a token registered by
+        another user is removed from them.
+
+        Args:
+            username: The user
+            token: The device's push token
+            platform: "fcm" or "apns"
+
+        Returns:
+            Copies of the changed records, the registration first
+
+        Raises:
+            PushError: If the token or platform is invalid
+                (INVALID_TOKEN, INVALID_PLATFORM) or the user has
+                registered the most tokens they may (TOO_MANY_TOKENS)
+        """
+        validate_token(token, platform)
+        with self._lock:
+            live = self._live(username)
+            if token not in live and len(live) >= self.max_tokens:
+                raise PushError(
+                    f"A user can register at most {self.max_tokens} "
+                    f"push tokens",
+                    "TOO_MANY_TOKENS",
+                )
+            record = DeviceToken(
+                username, token, platform, self.clock.now().encode()
+            )
+            self._tokens[(username, token)] = record
+            changed = [replace(record)]
+            for (other, other_token), held in list(self._tokens.items()):
+                if other_token == token and other != username:
+                    if not held.removed:
+                        changed.append(self._remove(held))
+        logger.debug(f"Push token registered for {username} ({platform})")
+        return changed
+
+    def unregister(self, username: str, token: str) -> Optional[DeviceToken]:
+        """
+        Remove a user's push token.
+
+        Args:
+            username: The user
+            token: The push token
+
+        Returns:
+            A copy of the tombstone, or None if the user hasn't registered
+            the token
+        """
+        with self._lock:
+            record = self._tokens.get((username, token))
+            if record is None or record.removed:
+                return None
+            tombstone = self._remove(record)
+        logger.debug(f"Push token of {username} removed")
+        return tombstone
+
+    def tokens_for(self, username: str) -> List[DeviceToken]:
+        """
+        Get a user's registered tokens.
+
+        Args:
+            username: The user
+
+        Returns:
+            Copies of the records of the user's registered tokens
+        """
+        with self._lock:
+            return [replace(r) for r in self._live(username).values()]
+
+    def merge(self, entries: List[Dict[str, Any]]) -> int:
+        """
+        Merge token records received from a peer.
+
+        An incoming record replaces the local one if its HLC timestamp is
+        higher.
+
+        Args:
+            entries: Record dicts from a peer's registry
+
+        Returns:
+            Number of records that were added or replaced
+        """
+        updated = 0
+        with self._lock:
+            for data in entries:
+                try:
+                    incoming = DeviceToken.from_dict(data)
+                except (KeyError, TypeError, PushError) as e:
+                    logger.warning(f"Ignoring malformed push token: {e}")
+                    continue
+
+                key = (incoming.username, incoming.token)
+                current = self._tokens.get(key)
+                if current is not None and incoming.hlc <= current.hlc:
+                    continue
+                self.clock.update(incoming.hlc)
+                self._tokens[key] = incoming
+                updated += 1
+        if updated:
+            logger.debug(f"Merged {updated} push token records")
+        return updated
+
+    def get_entries(self) -> List[Dict[str, Any]]:
+        """Get all records, tombstones included, for gossiping."""
+        with self._lock:
+            return [record.to_dict() for record in self._tokens.values()]
+
+    def _live(self, username: str) -> Dict[str, DeviceToken]:
+        """Get a user's registered tokens (call with the lock held)."""
+        return {
+            token: record
+            for (user, token), record in self._tokens.items()
+            if user == username and not record.removed
+        }
+
+    def _remove(self, record: DeviceToken) -> DeviceToken:
+        """Replace a record with a tombstone (call with the lock held)."""
+        tombstone = replace(
+            record, hlc=self.clock.now().encode(), removed=True
+        )
+        self._tokens[(record.username, record.token)] = tombstone
+        return replace(tombstone)
+
+
+@dataclass
+class Notification:
+    """
+    A notification waiting to be sent to one device.
+
+    Attributes:
+        username: The user notified
+        token: The device's push token
+        platform: "fcm" or "apns"
+        title: Notification title
+        body: Notification text
+        data: Payload for the client app (e.g., room_id and message_id)
+        count: Messages the notification stands for
+        attempts: Attempts that failed so far
+    """
+
+    username: str
+    token: str
+    platform: str
+    title: str
+    body: str
+    data: Dict[str, str] = field(default_factory=dict)
+    count: int = 1
+    attempts: int = 0
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to the dictionary sent to the push gateway."""
+        return {
+            "token": self.token,
+            "platform": self.platform,
+            "title": self.title,
+            "body": self.body,
+            "count": self.count,
+            "data": dict(self.data),
+        }
+
+
+def preview(message: Dict) -> str:
+    """
+    Get the text a notification shows for a message.
+
+    Encrypted messages are not previewed, and long ones are cut short.
+
+    Args:
+        message: The room or direct message dict
+
+    Returns:
+        The preview text
+    """
+    if message.get("encryption"):
+        return "New encrypted message"
+    content = (message.get("content") or "").strip()
+    if not content and message.get("attachments"):
+        return "Sent an attachment"
+    if len(content) > MAX_PREVIEW_LENGTH:
+        return content[: MAX_PREVIEW_LENGTH - 1].rstrip() + "…"
+    return content
+
+
+class Notifier(ABC):
+    """
+    Backend that sends push notifications to devices.
+
+    send() blocks on the network; PushDispatcher calls it from a worker
+    thread.
+    """
+
+    @abstractmethod
+    def send(self, notifications: List[Notification]) -> None:
+        """
+        Send a batch of notifications.
+
+        Raises:
+            OSError: If the batch could not be handed over
+        """
+
+
+class PushGatewayNotifier(Notifier):
+    """
+    Notifier POSTing batches to an FCM/APNs-compatible push gateway.
+    """
+
+    def __init__(
+        self,
+        url: str,
+        api_key: str = "",
+        post: Callable[[str, bytes, Dict[str, str], float], int] = http_post,
+        timeout: float = PUSH_TIMEOUT,
+    ):
+        """
+        Initialize the notifier.
+
+        Args:
+            url: The gateway's HTTP(S) endpoint
+            api_key: Bearer token the gateway expects, if any
+            post: Function POSTing (url, body, headers, timeout) and
+                returning the HTTP status
+            timeout: Seconds to wait for each request
+        """
+        self.url = url
+        self.api_key = api_key
+        self._post = post
+        self.timeout = timeout
+
+    def send(self, notifications: List[Notification]) -> None:
+        """POST the batch as one request."""
+        body = json.dumps(
+            {"notifications": [n.to_dict() for n in notifications]},
+            sort_keys=True,
+        ).encode()
+        headers = {"Content-Type": "application/json"}
+        if self.api_key:
+            headers["Authorization"] = f"Bearer {self.api_key}"
+        status = self._post(self.url, body, headers, self.timeout)
+        if not 200 <= status < 300:
+            raise OSError(f"Push gateway answered HTTP {status}")
+
+
+class PushDispatcher:
+    """
+    Queue of push notifications, sent in batches by a Notifier.
+
+    Notifications are queued from message deliveries and sent by
+    deliver(), which blocks on the network and so runs outside the event
+    loop.
+    """
+
+    def __init__(
+        self,
+        notifier: Notifier,
+        batch_size: int = PUSH_BATCH_SIZE,
+        max_queued: int = MAX_QUEUED,
+        max_attempts: int = MAX_PUSH_ATTEMPTS,
+    ):
+        """
+        Initialize the dispatcher.
+
+        Args:
+            notifier: Backend sending the notifications
+            batch_size: Most notifications sent in one batch
+            max_queued: Most notifications waiting at once
+            max_attempts: Attempts before a notification is dropped
+        """
+        self.notifier = notifier
+        self.batch_size = batch_size
+        self.max_queued = max_queued
+        self.max_attempts = max_attempts
+        self._lock = threading.Lock()
+        # Maps (token, conversation) -> notification, oldest first
+        self._queue: "OrderedDict[Tuple[str, str], Notification]" = (
+            OrderedDict()
+        )
+
+    def enqueue(
+        self,
+        tokens: List[DeviceToken],
+        conversation: str,
+        title: str,
+        body: str,
+        data: Dict[str, str],
+    ) -> int:
+        """
+        Queue a notification for each of a user's devices.
+
+        A notification still queued for the same device and conversation
+        is replaced, counting both.
+
+        Args:
+            tokens: The user's registered tokens
+            conversation: Room ID, or the sender of a direct message
+            title: Notification title
+            body: Notification text
+            data: Payload for the client app
+
+        Returns:
+            Number of devices notified
+        """
+        with self._lock:
+            for record in tokens:
+                key = (record.token, conversation)
+                queued = self._queue.pop(key, None)
+                self._queue[key] = Notification(
+                    record.username,
+                    record.token,
+                    record.platform,
+                    title,
+                    body,
+                    dict(data),
+                    count=queued.count + 1 if queued else 1,
+                )
+            while len(self._queue) > self.max_queued:
+                self._queue.popitem(last=False)
+                logger.warning("Push queue full: dropped a notification")
+        return len(tokens)
+
+    def pending(self) -> int:
+        """Get the number of notifications waiting."""
+        with self._lock:
+            return len(self._queue)
+
+    def deliver(self) -> int:
+        """
+        Send the waiting notifications in batches.
+
+        Batches that fail are queued again, unless a newer notification
+        for the same device and conversation came meanwhile; their
+        notifications are dropped after max_attempts attempts.
+
+        Returns:
+            Number of notifications sent
+        """
+        with self._lock:
+            waiting = list(self._queue.items())
+            self._queue.clear()
+
+        sent = 0
+        for start in range(0, len(waiting), self.batch_size):
+            batch = waiting[start : start + self.batch_size]
+            try:
+                self.notifier.send([n for _, n in batch])
+            except Exception as e:
+                self._retry(batch, str(e) or type(e).__name__)
+                continue
+            sent += len(batch)
+        if sent:
+            logger.info(f"Sent {sent} push notifications")
+        return sent
+
+    def _retry(
+        self, batch: List[Tuple[Tuple[str, str], Notification]], error: str
+    ) -> None:
+        """Queue a failed batch again, or drop it after too many attempts."""
+        dropped = 0
+        with self._lock:
+            for key, notification in batch:
+                notification.attempts += 1
+                if notification.attempts >= self.max_attempts:
+                    dropped += 1
+                elif key not in self._queue:
+                    self._queue[key] = notification
+                    self._queue.move_to_end(key, last=False)
+        logger.warning(
+            f"Push batch of {len(batch)} failed ({error}); dropped "
+            f"{dropped} after {self.max_attempts} attempts"
+        )
+
+
+def push_token_gossip_round(
+    tokens: PushTokenRegistry,
+    peer_registry,
+    fanout: int = GOSSIP_FANOUT,
+) -> List[str]:
+    """
+    Run one push-pull gossip round of the push token registry.
+
+    Args:
+        tokens: The local push token registry
+        peer_registry: PeerRegistry used to reach peers
+        fanout: Number of peers to contact
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    peers = list(peer_registry.list_peers().keys())
+    if not peers:
+        return []
+
+    reached = []
+    for peer_id in random.sample(peers, min(fanout, len(peers))):
+        try:
+            remote_entries = peer_registry.call_peer(
+                peer_id, "exchange_push_tokens", tokens.get_entries()
+            )
+            tokens.merge(remote_entries)
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Push token gossip with {peer_id} failed: {e}")
+    return reached
+
+
+def push_token_update(
+    records: List[DeviceToken],
+    peer_registry,
+    timeout: float = PUSH_TOKEN_PUSH_TIMEOUT,
+) -> List[str]:
+    """
+    Push token records changed on this node to every peer.
+
+    Args:
+        records: Records returned by register() or unregister()
+        peer_registry: PeerRegistry used to reach peers
+        timeout: Seconds to wait for each peer
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    entries = [record.to_dict() for record in records]
+    reached = []
+    for peer_id in peer_registry.list_peers():
+        try:
+            peer_registry.call_peer(
+                peer_id, "receive_push_tokens", entries, timeout=timeout
+            )
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Push token push to {peer_id} failed: {e}")
+    return reached
@@ -0,0 +1,1214 @@
+"""
+Raft Replicated Room Registry
+
+By default the cluster learns about rooms through the gossiped room
+directory (room_directory.py), which converges eventually: just after a
+room is created, deleted or taken over, nodes can disagree about whether
+it exists or who administers it. With room_registry = "raft", those
+changes are instead commands in a log replicated with the Raft consensus
+algorithm, and every node applies them in the same order to its copy of
+the registry:
+
+- create_room: registers a room; names are unique cluster-wide (compared
+  case-insensitively), so of two rooms created with the same name on
+  different nodes only the first committed one is kept
+- update_room: renames a room or changes its description, keeping
+  names unique like create_room
+- delete_room: removes a deleted room
+- assign_admin: moves a room to a new admin node, but only if it is still
+  administered by the expected previous admin, so two nodes taking over
+  the same room can't both win
+- reserve_username: claims a username for an account registered on a
+  node; like room names, usernames are unique cluster-wide compared
+  case-insensitively, so of two nodes registering the same name only the
+  first committed reservation wins (and the other refuses the account)
+- release_username: frees the username of a deleted account, but only
+  for the node holding it
+
+The nodes of the cluster membership view (membership.py) form the Raft
+group. One of them is elected leader for a term by a majority of votes;
+the leader appends commands to its log and replicates them with
+raft_append_entries, which doubles as its heartbeat. A command is
+committed once a majority stores it, and only committed commands are
+applied. Followers that receive a command forward it to the leader. The
+current term, vote and log are saved to disk before they are acted on,
+so a restarted node keeps its promises.
+
+Once SNAPSHOT_THRESHOLD entries have been applied since the last
+snapshot, a node saves a snapshot of the registry and drops the entries
+it covers from its log. A follower missing entries the leader no longer
+has gets the leader's snapshot with raft_install_snapshot instead.
+
+Nodes still gossip the room directory for member counts and descriptions;
+the registry only decides which rooms exist, where they live and which
+node holds each username.
+"""
+
+import json
+import logging
+import os
+import random
+import threading
+import time
+from typing import Callable, Dict, List, Optional, Tuple
+
+from .delivery import EXACTLY_ONCE
+
+logger = logging.getLogger(__name__)
+
+# Room registry modes selectable with the room_registry setting
+GOSSIP = "gossip"
+RAFT = "raft"
+ROOM_REGISTRY_MODES = (GOSSIP, RAFT)
+
+# Raft configuration
+RAFT_TICK_INTERVAL = 0.1  # seconds between timer checks
+ELECTION_TIMEOUT_RANGE = (1.5, 3.0)  # seconds without a leader, randomized
+HEARTBEAT_INTERVAL = 0.5  # seconds between the leader's append rounds
+PROPOSAL_TIMEOUT = 5  # seconds to wait for a command to be committed
+RAFT_RPC_TIMEOUT = 1  # seconds to wait for each Raft RPC
+MAX_APPEND_ENTRIES = 100  # log entries sent per append call
+SNAPSHOT_THRESHOLD = 1000  # applied entries kept before a snapshot
+RAFT_FILENAME = "raft.json"
+
+# Roles
+FOLLOWER = "follower"
+CANDIDATE = "candidate"
+LEADER = "leader"
+
+# Command the leader appends on election to commit earlier terms' entries
+NOOP = "noop"
+
+
+class RaftStore:
+    """
+    Durable Raft state: the current term, the vote cast in it, the log and
+    the latest snapshot of the state machine.
+
+    The term and vote are one small JSON file replaced atomically. Log
+    entries are appended to PATH.log as JSON lines, and entries replaced
+    after a conflict are cut off the end of the file, so each change only
+    writes what it adds. A snapshot of the state machine is saved to
+    PATH.snapshot, after which the log file is rewritten without the
+    entries it covers. Without a path, the state is kept in memory.
+    """
+
+    def __init__(self, path: Optional[str] = None):
+        """
+        Initialize the store.
+
+        Args:
+            path: JSON file to keep the term and vote in, next to the log
+                and snapshot files (None keeps the state in memory)
+        """
+        self.path = path
+        self._state: Dict = {"term": 0, "voted_for": None}
+        self._snapshot: Optional[Dict] = None
+        # The log, kept here only without a path
+        self._log: List[Dict] = []
+        # Index of the entry before the log file's first, and where each
+        # entry's line starts in the file
+        self._start = 0
+        self._offsets: List[int] = []
+        self._size = 0
+
+    @property
+    def _log_path(self) -> str:
+        return f"{self.path}.log"
+
+    @property
+    def _snapshot_path(self) -> str:
+        return f"{self.path}.snapshot"
+
+    def load(self) -> Tuple[int, Optional[str], List[Dict]]:
+        """
+        Read the saved state.
+
+        Returns:
+            tuple: (term, voted_for, log entries after the snapshot)
+        """
+        if not self.path:
+            state = self._state
+            return state["term"], state["voted_for"], list(self._log)
+        if os.path.exists(self._snapshot_path):
+            with open(self._snapshot_path, encoding="utf-8") as handle:
+                self._snapshot = json.load(handle)
+        log = self._read_log()
+        if os.path.exists(self.path):
+            with open(self.path, encoding="utf-8") as handle:
+                state = json.load(handle)
+            self._state = {
+                "term": state["term"],
+                "voted_for": state["voted_for"],
+            }
+            if "log" in state and not os.path.exists(self._log_path):
+                # Saved by a version keeping the log in this file
+                log = state["log"]
+                self._rewrite_log(log)
+                self.save_vote(state["term"], state["voted_for"])
+        state = self._state
+        return state["term"], state["voted_for"], log
+
+    def load_snapshot(self) -> Optional[Dict]:
+        """
+        Get the latest snapshot, after load().
+
+        Returns:
+            dict: 'index' and 'term' of the last entry it covers and the
+            state machine's 'state', or None without a snapshot
+        """
+        return self._snapshot
+
+    def save_vote(self, term: int, voted_for: Optional[str]) -> None:
+        """
+        Save the current term and vote, fsynced before returning.
+
+        Args:
+            term: The current term
+            voted_for: Node voted for in the term, or None
+
+        Raises:
+            OSError: If the state cannot be written
+        """
+        self._state = {"term": term, "voted_for": voted_for}
+        if self.path:
+            _write_json(self.path, self._state)
+
+    def append(self, entries: List[Dict]) -> None:
+        """
+        Append entries to the log, fsynced before returning.
+
+        Args:
+            entries: The new entries, following the saved ones
+
+        Raises:
+            OSError: If the entries cannot be written
+        """
+        if not self.path:
+            self._log.extend(entries)
+            return
+        if not self._size:
+            self._rewrite_log(entries)
+            return
+        with open(self._log_path, "ab") as handle:
+            for entry in entries:
+                line = _log_line(entry)
+                self._offsets.append(self._size)
+                self._size += len(line)
+                handle.write(line)
+            handle.flush()
+            os.fsync(handle.fileno())
+
+    def truncate(self, count: int) -> None:
+        """
+        Drop the log's entries after its first count, fsynced.
+
+        Args:
+            count: Number of entries after the snapshot to keep
+
+        Raises:
+            OSError: If the log cannot be written
+        """
+        if not self.path:
+            del self._log[count:]
+            return
+        if count >= len(self._offsets):
+            return
+        self._size = self._offsets[count]
+        del self._offsets[count:]
+        with open(self._log_path, "r+b") as handle:
+            handle.truncate(self._size)
+            handle.flush()
+            os.fsync(handle.fileno())
+
+    def save_snapshot(
+        self, index: int, term: int, state: Dict, log: List[Dict]
+    ) -> None:
+        """
+        Save a snapshot and drop the log entries it covers.
+
+        Args:
+            index: Index of the last entry the snapshot covers
+            term: Term of that entry
+            state: The state machine's state after applying it
+            log: The entries after it
+
+        Raises:
+            OSError: If the snapshot or log cannot be written
+        """
+        self._snapshot = {"index": index, "term": term, "state": state}
+        if not self.path:
+            self._log = list(log)
+            return
+        _write_json(self._snapshot_path, self._snapshot)
+        self._rewrite_log(log)
+
+    def _read_log(self) -> List[Dict]:
+        """Read the log file's entries after the snapshot."""
+        self._start, self._offsets, self._size = 0, [], 0
+        if not os.path.exists(self._log_path):
+            return []
+        entries = []
+        with open(self._log_path, "rb") as handle:
+            for number, line in enumerate(handle):
+                try:
+                    record = json.loads(line)
+                except ValueError:
+                    record = None
+                if record is None or not line.endswith(b"\n"):
+                    logger.warning(
+                        f"Dropping a torn entry at the end of "
+                        f"{self._log_path}"
+                    )
+                    break
+                if number == 0:
+                    self._start = record["start"]
+                else:
+                    self._offsets.append(self._size)
+                    entries.append(record)
+                self._size += len(line)
+        snapshot_index = self._snapshot["index"] if self._snapshot else 0
+        if self._start != snapshot_index or self._size < os.path.getsize(
+            self._log_path
+        ):
+            # Interrupted while compacting or appending
+            entries = entries[max(0, snapshot_index - self._start) :]
+            self._rewrite_log(entries)
+        return entries
+
+    def _rewrite_log(self, entries: List[Dict]) -> None:
+        """Replace the log file with entries following the snapshot."""
+        os.makedirs(os.path.dirname(os.path.abspath(self.path)), exist_ok=True)
+        self._start = self._snapshot["index"] if self._snapshot else 0
+        header = _log_line({"start": self._start})
+        self._offsets, self._size = [], len(header)
+        temporary = f"{self._log_path}.tmp"
+        with open(temporary, "wb") as handle:
+            handle.write(header)
+            for entry in entries:
+                line = _log_line(entry)
+                self._offsets.append(self._size)
+                self._size += len(line)
+                handle.write(line)
+            handle.flush()
+            os.fsync(handle.fileno())
+        os.replace(temporary, self._log_path)
+
+
+def _log_line(record: Dict) -> bytes:
+    """Encode a log file record as one JSON line."""
+    return (json.dumps(record, separators=(",", ":")) + "\n").encode()
+
+
+def _write_json(path: str, data: Dict) -> None:
+    """Replace a JSON file atomically, fsynced before returning."""
+    os.makedirs(os.path.dirname(os.path.abspath(path)), exist_ok=True)
+    temporary = f"{path}.tmp"
+    with open(temporary, "w", encoding="utf-8") as handle:
+        json.dump(data, handle, separators=(",", ":"))
+        handle.flush()
+        os.fsync(handle.fileno())
+    os.replace(temporary, path)
+
+
+class RaftNode:
+    """
+    One member of a Raft group replicating a log of commands.
+
+    Log entries are dicts {'term': int, 'command': dict} with indexes
+    starting at 1. The log holds the entries after snapshot_index, the
+    last one covered by the snapshot. Timers are driven by tick(); RPCs
+    are made through the peer registry without holding the node's lock.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        peer_registry,
+        apply: Callable[[Dict], Dict],
+        members: Optional[Callable[[], List[str]]] = None,
+        store: Optional[RaftStore] = None,
+        election_timeout: Tuple[float, float] = ELECTION_TIMEOUT_RANGE,
+        heartbeat_interval: float = HEARTBEAT_INTERVAL,
+        clock: Callable[[], float] = time.monotonic,
+        snapshot: Optional[Callable[[], Dict]] = None,
+        restore: Optional[Callable[[Dict], None]] = None,
+        snapshot_threshold: int = SNAPSHOT_THRESHOLD,
+    ):
+        """
+        Initialize the node as a follower.
+
+        Args:
+            node_id: ID of this node
+            peer_registry: PeerRegistry used to reach the other members
+            apply: Function applying a committed command to the state
+                machine and returning its result dict
+            members: Function returning the group's node IDs, this node
+                included (defaults to this node and every known peer)
+            store: RaftStore with the durable state (defaults to memory)
+            election_timeout: (min, max) seconds without hearing from a
+                leader before starting an election
+            heartbeat_interval: Seconds between the leader's heartbeats
+            clock: Monotonic time source
+            snapshot: Function returning the state machine's state as a
+                JSON-serializable dict (the log is never compacted
+                without it)
+            restore: Function replacing the state machine's state with a
+                snapshot's
+            snapshot_threshold: Applied entries kept in the log before a
+                snapshot replaces them
+        """
+        self.node_id = node_id
+        self.peer_registry = peer_registry
+        self._apply = apply
+        self._members = members
+        self.store = store or RaftStore()
+        self.election_timeout = election_timeout
+        self.heartbeat_interval = heartbeat_interval
+        self._clock = clock
+        self._snapshot = snapshot
+        self._restore = restore
+        self.snapshot_threshold = snapshot_threshold
+        self._lock = threading.Lock()
+        self._applied = threading.Condition(self._lock)
+
+        self.current_term, self.voted_for, self.log = self.store.load()
+        saved = self.store.load_snapshot()
+        self.snapshot_index = saved["index"] if saved else 0
+        self.snapshot_term = saved["term"] if saved else 0
+        self._snapshot_state = saved["state"] if saved else None
+        if saved and restore is not None:
+            restore(saved["state"])
+        self.role = FOLLOWER
+        self.leader_id: Optional[str] = None
+        self.commit_index = self.snapshot_index
+        self.last_applied = self.snapshot_index
+        self._next_index: Dict[str, int] = {}
+        self._match_index: Dict[str, int] = {}
+        self._results: Dict[int, Dict] = {}
+        self._election_deadline = 0.0
+        self._next_heartbeat = 0.0
+        self._reset_election_deadline()
+
+    # Timers
+
+    def tick(self) -> None:
+        """Send heartbeats as leader, or start an election on timeout."""
+        with self._lock:
+            now = self._clock()
+            heartbeat = self.role == LEADER and now >= self._next_heartbeat
+            election = self.role != LEADER and now >= self._election_deadline
+        if heartbeat:
+            self._replicate()
+        elif election:
+            self._start_election()
+
+    # Proposals
+
+    def propose(
+        self, command: Dict, timeout: float = PROPOSAL_TIMEOUT
+    ) -> Dict:
+        """
+        Commit a command and get the result of applying it.
+
+        Followers forward the command to the leader.
+
+        Args:
+            command: JSON-serializable command with an 'op' field
+            timeout: Seconds to wait for the command to be committed
+
+        Returns:
+            dict: The state machine's result, or an error with
+            'error_code' NOT_LEADER (no leader is known) or TIMEOUT
+        """
+        with self._lock:
+            is_leader = self.role == LEADER
+            leader_id = self.leader_id
+            if is_leader:
+                entry = {"term": self.current_term, "command": command}
+                self.log.append(entry)
+                self.store.append([entry])
+                index = self._last_index()
+                term = self.current_term
+
+        if not is_leader:
+            if leader_id is None or leader_id == self.node_id:
+                return _error("No Raft leader is known", "NOT_LEADER")
+            try:
+                return self.peer_registry.call_peer(
+                    leader_id, "raft_submit", command, timeout=timeout
+                )
+            except Exception as e:
+                return _error(
+                    f"Raft leader {leader_id} unreachable: {e}", "NOT_LEADER"
+                )
+
+        self._replicate()
+        deadline = self._clock() + timeout
+        with self._lock:
+            while self.last_applied < index:
+                remaining = deadline - self._clock()
+                if remaining <= 0:
+                    return _error(
+                        f"Command {command.get('op')} was not committed "
+                        f"in time",
+                        "TIMEOUT",
+                    )
+                self._applied.wait(min(remaining, self.heartbeat_interval))
+            applied_term, result = self._results.pop(index, (None, None))
+            if applied_term is None and index > self.snapshot_index:
+                applied_term = self._term_at(index)
+            if applied_term != term:
+                return _error("Leadership was lost", "NOT_LEADER")
+            return dict(result or {"success": True})
+
+    def status(self) -> Dict:
+        """Get this node's role, term, leader and log positions."""
+        with self._lock:
+            return {
+                "node_id": self.node_id,
+                "role": self.role,
+                "term": self.current_term,
+                "leader_id": self.leader_id,
+                "commit_index": self.commit_index,
+                "last_index": self._last_index(),
+                "snapshot_index": self.snapshot_index,
+            }
+
+    # RPC handlers
+
+    def handle_request_vote(
+        self,
+        term: int,
+        candidate_id: str,
+        last_log_index: int,
+        last_log_term: int,
+    ) -> Dict:
+        """
+        Vote for a candidate whose log is at least as up to date.
+
+        Returns:
+            dict: {'term': int, 'vote_granted': bool}
+        """
+        with self._lock:
+            if term > self.current_term:
+                self._step_down(term)
+            granted = (
+                term == self.current_term
+                and self.voted_for in (None, candidate_id)
+                and (last_log_term, last_log_index)
+                >= (self._last_term(), self._last_index())
+            )
+            if granted:
+                self.voted_for = candidate_id
+                self._persist()
+                self._reset_election_deadline()
+            return {"term": self.current_term, "vote_granted": granted}
+
+    def handle_append_entries(
+        self,
+        term: int,
+        leader_id: str,
+        prev_log_index: int,
+        prev_log_term: int,
+        entries: List[Dict],
+        leader_commit: int,
+    ) -> Dict:
+        """
+        Append a leader's entries after the matching previous entry.
+
+        Returns:
+            dict: {'term': int, 'success': bool, 'last_index': int}
+        """
+        with self._lock:
+            if term < self.current_term:
+                return self._append_result(False)
+            if term > self.current_term or self.role != FOLLOWER:
+                self._step_down(term)
+            self.leader_id = leader_id
+            self._reset_election_deadline()
+
+            # Entries up to the snapshot are committed, so they match
+            if prev_log_index > self._last_index() or (
+                prev_log_index >= self.snapshot_index
+                and self._term_at(prev_log_index) != prev_log_term
+            ):
+                return self._append_result(False)
+
+            added = []
+            for offset, entry in enumerate(entries):
+                index = prev_log_index + offset + 1
+                if index <= self.snapshot_index:
+                    continue
+                if index <= self._last_index():
+                    if self._term_at(index) == entry["term"]:
+                        continue
+                    # Conflicting uncommitted entries are replaced
+                    kept = index - self.snapshot_index - 1
+                    del self.log[kept:]
+                    self.store.truncate(kept)
+                self.log.append(entry)
+                added.append(entry)
+            if added:
+                self.store.append(added)
+
+            last_new = prev_log_index + len(entries)
+            if min(leader_commit, last_new) > self.commit_index:
+                self.commit_index = min(leader_commit, last_new)
+                self._apply_committed()
+            return self._append_result(True, last_new)
+
+    def handle_install_snapshot(
+        self,
+        term: int,
+        leader_id: str,
+        last_index: int,
+        last_term: int,
+        state: Dict,
+    ) -> Dict:
+        """
+        Replace the log up to a leader's snapshot with the snapshot.
+
+        Entries after the snapshot are kept if the log has its last entry.
+
+        Returns:
+            dict: {'term': int}
+        """
+        with self._lock:
+            if term < self.current_term:
+                return {"term": self.current_term}
+            if term > self.current_term or self.role != FOLLOWER:
+                self._step_down(term)
+            self.leader_id = leader_id
+            self._reset_election_deadline()
+            if last_index <= self.commit_index or self._restore is None:
+                return {"term": self.current_term}
+
+            if (
+                last_index <= self._last_index()
+                and self._term_at(last_index) == last_term
+            ):
+                del self.log[: last_index - self.snapshot_index]
+            else:
+                self.log = []
+            self.store.save_snapshot(last_index, last_term, state, self.log)
+            self.snapshot_index = last_index
+            self.snapshot_term = last_term
+            self._snapshot_state = state
+            self._restore(state)
+            self.commit_index = self.last_applied = last_index
+            logger.info(
+                f"Installed Raft snapshot up to entry {last_index} from "
+                f"{leader_id}"
+            )
+            return {"term": self.current_term}
+
+    # Elections
+
+    def _start_election(self) -> None:
+        """Become a candidate for the next term and ask for votes."""
+        with self._lock:
+            self.role = CANDIDATE
+            self.current_term += 1
+            self.voted_for = self.node_id
+            self.leader_id = None
+            self._persist()
+            self._reset_election_deadline()
+            term = self.current_term
+            args = (
+                term,
+                self.node_id,
+                self._last_index(),
+                self._last_term(),
+            )
+            peers = self._peers()
+        logger.info(f"Starting Raft election for term {term}")
+
+        votes = 1
+        for peer_id in peers:
+            response = self._call(peer_id, "raft_request_vote", *args)
+            if response is None:
+                continue
+            with self._lock:
+                if response["term"] > self.current_term:
+                    self._step_down(response["term"])
+                    return
+                if self.role != CANDIDATE or self.current_term != term:
+                    return
+            if response["vote_granted"]:
+                votes += 1
+
+        with self._lock:
+            if (
+                self.role != CANDIDATE
+                or self.current_term != term
+                or votes < self._quorum()
+            ):
+                return
+            self.role = LEADER
+            self.leader_id = self.node_id
+            self._next_index = {p: self._last_index() + 1 for p in peers}
+            self._match_index = {p: 0 for p in peers}
+            entry = {"term": term, "command": {"op": NOOP}}
+            self.log.append(entry)
+            self.store.append([entry])
+        logger.info(f"Elected Raft leader for term {term} with {votes} votes")
+        self._replicate()
+
+    def _step_down(self, term: int) -> None:
+        """Follow a newer term (called with the lock held)."""
+        if term > self.current_term:
+            self.current_term = term
+            self.voted_for = None
+            self._persist()
+        if self.role != FOLLOWER:
+            logger.info(f"Raft {self.role} stepping down in term {term}")
+        self.role = FOLLOWER
+        self._reset_election_deadline()
+
+    # Replication
+
+    def _replicate(self) -> None:
+        """Send every follower the entries it is missing (or a heartbeat)."""
+        with self._lock:
+            if self.role != LEADER:
+                return
+            self._next_heartbeat = self._clock() + self.heartbeat_interval
+            peers = self._peers()
+        for peer_id in peers:
+            self._replicate_to(peer_id)
+        with self._lock:
+            self._advance_commit()
+
+    def _replicate_to(self, peer_id: str) -> None:
+        """Send one append call to a follower and record the outcome."""
+        with self._lock:
+            if self.role != LEADER:
+                return
+            term = self.current_term
+            next_index = self._next_index.setdefault(
+                peer_id, self._last_index() + 1
+            )
+            if next_index <= self.snapshot_index:
+                snapshot = (
+                    self.snapshot_index,
+                    self.snapshot_term,
+                    self._snapshot_state,
+                )
+            else:
+                snapshot = None
+                prev_index = next_index - 1
+                prev_term = self._term_at(prev_index)
+                start = prev_index - self.snapshot_index
+                entries = self.log[start : start + MAX_APPEND_ENTRIES]
+            commit = self.commit_index
+
+        if snapshot is not None:
+            self._install_snapshot_on(peer_id, term, *snapshot)
+            return
+
+        response = self._call(
+            peer_id,
+            "raft_append_entries",
+            term,
+            self.node_id,
+            prev_index,
+            prev_term,
+            entries,
+            commit,
+        )
+        if response is None:
+            return
+        with self._lock:
+            if response["term"] > self.current_term:
+                self._step_down(response["term"])
+                return
+            if self.role != LEADER or self.current_term != term:
+                return
+            if response["success"]:
+                match = prev_index + len(entries)
+                self._match_index[peer_id] = max(
+                    self._match_index.get(peer_id, 0), match
+                )
+                self._next_index[peer_id] = match + 1
+            else:
+                # Back up to the follower's log end, or one entry
+                self._next_index[peer_id] = max(
+                    1, min(next_index - 1, response["last_index"] + 1)
+                )
+
+    def _install_snapshot_on(
+        self,
+        peer_id: str,
+        term: int,
+        last_index: int,
+        last_term: int,
+        state: Dict,
+    ) -> None:
+        """Send a follower lagging behind the log this node's snapshot."""
+        response = self._call(
+            peer_id,
+            "raft_install_snapshot",
+            term,
+            self.node_id,
+            last_index,
+            last_term,
+            state,
+        )
+        if response is None:
+            return
+        with self._lock:
+            if response["term"] > self.current_term:
+                self._step_down(response["term"])
+                return
+            if self.role != LEADER or self.current_term != term:
+                return
+            self._match_index[peer_id] = max(
+                self._match_index.get(peer_id, 0), last_index
+            )
+            self._next_index[peer_id] = last_index + 1
+
+    def _advance_commit(self) -> None:
+        """Commit the newest entry of this term a majority stores."""
+        if self.role != LEADER:
+            return
+        members = set(self._peers())
+        for index in range(self._last_index(), self.commit_index, -1):
+            if self._term_at(index) != self.current_term:
+                break
+            stored = 1 + sum(
+                1
+                for peer_id, match in self._match_index.items()
+                if peer_id in members and match >= index
+            )
+            if stored >= self._quorum():
+                self.commit_index = index
+                self._apply_committed()
+                return
+
+    def _apply_committed(self) -> None:
+        """Apply committed entries in order (called with the lock held)."""
+        while self.last_applied < self.commit_index:
+            self.last_applied += 1
+            entry = self.log[self.last_applied - self.snapshot_index - 1]
+            command = entry["command"]
+            try:
+                result = self._apply(command)
+            except Exception as e:
+                logger.error(f"Applying Raft command {command} failed: {e}")
+                result = _error(str(e), "APPLY_FAILED")
+            if self.role == LEADER and command.get("op") != NOOP:
+                self._results[self.last_applied] = (entry["term"], result)
+        self._applied.notify_all()
+        if (
+            self._snapshot is not None
+            and self.last_applied - self.snapshot_index
+            >= self.snapshot_threshold
+        ):
+            self._compact()
+
+    def _compact(self) -> None:
+        """Snapshot the applied state and drop the entries it covers."""
+        index = self.last_applied
+        term = self._term_at(index)
+        state = self._snapshot()
+        del self.log[: index - self.snapshot_index]
+        self.store.save_snapshot(index, term, state, self.log)
+        self.snapshot_index = index
+        self.snapshot_term = term
+        self._snapshot_state = state
+        logger.info(f"Compacted the Raft log up to entry {index}")
+
+    # Helpers
+
+    def _peers(self) -> List[str]:
+        """Get the other members of the group, sorted."""
+        if self._members is not None:
+            members = self._members()
+        else:
+            members = list(self.peer_registry.list_peers())
+        return sorted(set(members) - {self.node_id})
+
+    def _quorum(self) -> int:
+        """Number of votes or copies forming a majority of the group."""
+        return (len(self._peers()) + 1) // 2 + 1
+
+    def _last_index(self) -> int:
+        """Index of the last log entry (0 for an empty log)."""
+        return self.snapshot_index + len(self.log)
+
+    def _last_term(self) -> int:
+        """Term of the last log entry (0 for an empty log)."""
+        return self.log[-1]["term"] if self.log else self.snapshot_term
+
+    def _term_at(self, index: int) -> int:
+        """Term of the entry at an index from the snapshot's on."""
+        if index == self.snapshot_index:
+            return self.snapshot_term
+        return self.log[index - self.snapshot_index - 1]["term"]
+
+    def _persist(self) -> None:
+        """Save the term and vote before acting on them."""
+        self.store.save_vote(self.current_term, self.voted_for)
+
+    def _reset_election_deadline(self) -> None:
+        """Pick a new randomized election deadline."""
+        self._election_deadline = self._clock() + random.uniform(
+            *self.election_timeout
+        )
+
+    def _append_result(self, success: bool, last_index: int = -1) -> Dict:
+        """Build an append_entries response."""
+        return {
+            "term": self.current_term,
+            "success": success,
+            "last_index": (
+                self._last_index() if last_index < 0 else last_index
+            ),
+        }
+
+    def _call(self, peer_id: str, method: str, *args) -> Optional[Dict]:
+        """Call a Raft RPC on a peer, or get None if it fails."""
+        try:
+            response = self.peer_registry.call_peer(
+                peer_id, method, *args, timeout=RAFT_RPC_TIMEOUT
+            )
+        except Exception as e:
+            logger.debug(f"{method} to {peer_id} failed: {e}")
+            return None
+        # Nodes without the Raft registry answer with an error instead
+        if not isinstance(response, dict) or "term" not in response:
+            return None
+        return response
+
+
+class RaftRoomRegistry:
+    """
+    The room registry state machine, replicated by a RaftNode.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        node_address: str,
+        peer_registry,
+        members: Optional[Callable[[], List[str]]] = None,
+        store: Optional[RaftStore] = None,
+        **raft_options,
+    ):
+        """
+        Initialize the registry and its Raft node.
+
+        Args:
+            node_id: ID of this node
+            node_address: XML-RPC address of this node
+            peer_registry: PeerRegistry used to reach the other members
+            members: Function returning the Raft group's node IDs
+            store: RaftStore with the durable Raft state
+            **raft_options: Timing options passed to RaftNode
+        """
+        self.node_id = node_id
+        self.node_address = node_address
+        self._lock = threading.Lock()
+        self._rooms: Dict[str, Dict] = {}
+        # Maps lowercased username -> {'username', 'node_id'}
+        self._usernames: Dict[str, Dict] = {}
+        self.raft = RaftNode(
+            node_id,
+            peer_registry,
+            self.apply,
+            members,
+            store,
+            snapshot=self.snapshot,
+            restore=self.restore,
+            **raft_options,
+        )
+
+    def register_room(self, room: Dict) -> Dict:
+        """
+        Register a room created on this node.
+
+        Args:
+            room: Room dict (see Room.to_dict)
+
+        Returns:
+            dict: Result with 'success'; error_code ROOM_NAME_TAKEN if the
+            name is in use, or NOT_LEADER or TIMEOUT if not committed
+        """
+        return self.raft.propose(
+            {
+                "op": "create_room",
+                "room": {
+                    "room_id": room["room_id"],
+                    "room_name": room["room_name"],
+                    "description": room.get("description"),
+                    "creator_id": room.get("creator_id", ""),
+                    "admin_node": self.node_id,
+                    "node_address": self.node_address,
+                    "private": bool(room.get("private", False)),
+                    "total_order": bool(room.get("total_order", False)),
+                    "announcement": bool(room.get("announcement", False)),
+                    "delivery": room.get("delivery", EXACTLY_ONCE),
+                    "ephemeral": bool(room.get("ephemeral", False)),
+                },
+            }
+        )
+
+    def update_room(self, room_id: str, changes: Dict) -> Dict:
+        """
+        Change the name or description of a room administered here.
+
+        Args:
+            room_id: The room ID
+            changes: Validated changes of an update_room request (fields
+                the registry doesn't keep, like the topic, are ignored)
+
+        Returns:
+            dict: Result with 'success'; error_code ROOM_NAME_TAKEN if the
+            new name is in use, or NOT_LEADER or TIMEOUT if not committed
+        """
+        fields = {
+            name: changes[name]
+            for name in ("room_name", "description")
+            if name in changes
+        }
+        if not fields:
+            return {"success": True}
+        return self.raft.propose(
+            {"op": "update_room", "room_id": room_id, "fields": fields}
+        )
+
+    def unregister_room(self, room_id: str) -> Dict:
+        """
+        Remove a deleted room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            dict: Result with 'success'
+        """
+        return self.raft.propose({"op": "delete_room", "room_id": room_id})
+
+    def assign_admin(self, room_id: str, previous_admin: str) -> Dict:
+        """
+        Make this node a room's admin, if previous_admin still is.
+
+        Args:
+            room_id: The room ID
+            previous_admin: Node ID of the admin being replaced
+
+        Returns:
+            dict: Result with 'success'; error_code ADMIN_CONFLICT if the
+            room has another admin by now
+        """
+        return self.raft.propose(
+            {
+                "op": "assign_admin",
+                "room_id": room_id,
+                "admin_node": self.node_id,
+                "node_address": self.node_address,
+                "previous_admin": previous_admin,
+            }
+        )
+
+    def reserve_username(self, username: str) -> Dict:
+        """
+        Claim a username for an account registered on this node.
+
+        Reserving a name this node already holds succeeds again.
+
+        Args:
+            username: The username
+
+        Returns:
+            dict: Result with 'success'; error_code USERNAME_TAKEN if
+            another node holds the name, or NOT_LEADER or TIMEOUT if not
+            committed
+        """
+        return self.raft.propose(
+            {
+                "op": "reserve_username",
+                "username": username,
+                "node_id": self.node_id,
+            }
+        )
+
+    def release_username(self, username: str) -> Dict:
+        """
+        Free the username of an account deleted on this node.
+
+        Args:
+            username: The username
+
+        Returns:
+            dict: Result with 'success'; error_code USERNAME_NOT_RESERVED
+            if this node doesn't hold the name
+        """
+        return self.raft.propose(
+            {
+                "op": "release_username",
+                "username": username,
+                "node_id": self.node_id,
+            }
+        )
+
+    def username_holder(self, username: str) -> Optional[str]:
+        """
+        Get the node holding a username.
+
+        Args:
+            username: The username
+
+        Returns:
+            Node ID of the node the account is registered on, or None
+        """
+        with self._lock:
+            entry = self._usernames.get(username.lower())
+            return entry["node_id"] if entry else None
+
+    def get(self, room_id: str) -> Optional[Dict]:
+        """
+        Get a registered room in the room dictionary format.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The room dict, or None if no such room is registered
+        """
+        with self._lock:
+            room = self._rooms.get(room_id)
+            return dict(room, member_count=0) if room else None
+
+    def list_rooms(self) -> List[Dict]:
+        """Get every registered public room in the room dictionary format."""
+        with self._lock:
+            return [
+                dict(room, member_count=0)
+                for room in self._rooms.values()
+                if not room["private"]
+            ]
+
+    def snapshot(self) -> Dict:
+        """
+        Get the registry's state for a Raft snapshot.
+
+        Returns:
+            dict: 'rooms' and 'usernames', copied
+        """
+        with self._lock:
+            return {
+                "rooms": {
+                    room_id: dict(room) for room_id, room in self._rooms.items()
+                },
+                "usernames": {
+                    key: dict(entry) for key, entry in self._usernames.items()
+                },
+            }
+
+    def restore(self, state: Dict) -> None:
+        """
+        Replace the registry's state with a Raft snapshot's.
+
+        Args:
+            state: State returned by snapshot()
+        """
+        with self._lock:
+            self._rooms = {
+                room_id: dict(room)
+                for room_id, room in state["rooms"].items()
+            }
+            self._usernames = {
+                key: dict(entry) for key, entry in state["usernames"].items()
+            }
+
+    def apply(self, command: Dict) -> Dict:
+        """
+        Apply a committed command (called by the Raft node, in log order).
+
+        Args:
+            command: The command
+
+        Returns:
+            dict: Result with 'success' (and 'error' and 'error_code')
+        """
+        op = command.get("op")
+        with self._lock:
+            if op == NOOP:
+                return {"success": True}
+            if op == "create_room":
+                room = command["room"]
+                name = room["room_name"].lower()
+                if any(
+                    r["room_name"].lower() == name
+                    for r in self._rooms.values()
+                ):
+                    return _error(
+                        f"Room name '{room['room_name']}' is already taken",
+                        "ROOM_NAME_TAKEN",
+                    )
+                self._rooms[room["room_id"]] = dict(room)
+                return {"success": True}
+            if op == "update_room":
+                room = self._rooms.get(command["room_id"])
+                if room is None:
+                    return _error("Room not found", "ROOM_NOT_FOUND")
+                fields = command["fields"]
+                name = (fields.get("room_name") or "").lower()
+                if name and any(
+                    r["room_name"].lower() == name
+                    for r in self._rooms.values()
+                    if r is not room
+                ):
+                    return _error(
+                        f"Room name '{fields['room_name']}' is already taken",
+                        "ROOM_NAME_TAKEN",
+                    )
+                room.update(fields)
+                return {"success": True}
+            if op == "delete_room":
+                if self._rooms.pop(command["room_id"], None) is None:
+                    return _error("Room not found", "ROOM_NOT_FOUND")
+                return {"success": True}
+            if op == "assign_admin":
+                room = self._rooms.get(command["room_id"])
+                if room is None:
+                    return _error("Room not found", "ROOM_NOT_FOUND")
+                if room["admin_node"] != command["previous_admin"]:
+                    return _error(
+                        f"Room is administered by {room['admin_node']}",
+                        "ADMIN_CONFLICT",
+                    )
+                room["admin_node"] = command["admin_node"]
+                room["node_address"] = command["node_address"]
+                return {"success": True}
+            if op == "reserve_username":
+                key = command["username"].lower()
+                entry = self._usernames.get(key)
+                if entry and entry["node_id"] != command["node_id"]:
+                    return _error(
+                        f"Username '{command['username']}' is already taken",
+                        "USERNAME_TAKEN",
+                    )
+                self._usernames[key] = {
+                    "username": command["username"],
+                    "node_id": command["node_id"],
+                }
+                return {"success": True}
+            if op == "release_username":
+                key = command["username"].lower()
+                entry = self._usernames.get(key)
+                if entry is None or entry["node_id"] != command["node_id"]:
+                    return _error(
+                        "Username is not reserved by this node",
+                        "USERNAME_NOT_RESERVED",
+                    )
+                del self._usernames[key]
+                return {"success": True}
+        return _error(f"Unknown command: {op}", "UNKNOWN_COMMAND")
+
+
+def _error(error: str, error_code: str) -> Dict:
+    """Build an error result."""
+    return {"success": False, "error": error, "error_code": error_code}
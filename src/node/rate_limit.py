@@ -0,0 +1,240 @@
+"""
+Client Rate Limiting
+
+Limits how fast clients can send commands, with a token bucket per
+WebSocket connection and one per authenticated user. The user's bucket is
+kept when their connection closes, so reconnecting (or opening several
+connections) doesn't give a user a fresh allowance. Clients that haven't
+logged in are limited per connection only, since the usernames they claim
+aren't verified.
+
+Each command type has its own limit, given as a sustained rate in commands
+per second and a burst size. Commands without a limit of their own share
+the "*" limit. A command over its limit is dropped and the client gets a
+rate_limited event saying when to retry.
+"""
+
+import threading
+import time
+from dataclasses import dataclass
+from typing import Callable, Dict, Iterable, Optional, Tuple
+
+# Command type whose limit applies to types without one of their own
+DEFAULT_COMMAND = "*"
+
+
+@dataclass(frozen=True)
+class RateLimit:
+    """
+    Limit for one command type.
+
+    Attributes:
+        rate: Commands per second allowed in the long run
+        burst: Commands allowed at once after a quiet period
+    """
+
+    rate: float
+    burst: float
+
+
+# Default limits per command type
+DEFAULT_RATE_LIMITS: Dict[str, RateLimit] = {
+    DEFAULT_COMMAND: RateLimit(20, 40),
+    "send_message": RateLimit(5, 10),
+    "send_direct_message": RateLimit(5, 10),
+    "create_room": RateLimit(0.5, 5),
+    "create_invite": RateLimit(0.5, 5),
+    "register": RateLimit(0.2, 3),
+    "login": RateLimit(0.2, 5),
+}
+
+
+def parse_rate_limits(specs: Iterable[str]) -> Dict[str, RateLimit]:
+    """
+    Parse limits given as COMMAND=RATE/BURST (e.g., "send_message=5/10").
+
+    Args:
+        specs: Limit specifications
+
+    Returns:
+        dict: {command_type: RateLimit}
+
+    Raises:
+        ValueError: If a specification is malformed or not positive
+    """
+    limits = {}
+    for spec in specs:
+        command, sep, value = spec.partition("=")
+        rate, slash, burst = value.partition("/")
+        try:
+            if not sep or not slash or not command.strip():
+                raise ValueError
+            limit = RateLimit(float(rate), float(burst))
+        except ValueError:
+            raise ValueError(
+                f"rate limit {spec!r} must be COMMAND=RATE/BURST"
+            )
+        if limit.rate <= 0 or limit.burst < 1:
+            raise ValueError(
+                f"rate limit {spec!r} needs a positive rate and a burst of "
+                f"at least 1"
+            )
+        limits[command.strip()] = limit
+    return limits
+
+
+class TokenBucket:
+    """
+    Tokens refill at a fixed rate up to the burst size; each command uses
+    one.
+    """
+
+    def __init__(self, limit: RateLimit, now: float):
+        """
+        Initialize a full bucket.
+
+        Args:
+            limit: The rate and burst size
+            now: Current time in seconds
+        """
+        self.limit = limit
+        self.tokens = limit.burst
+        self.updated = now
+
+    def refill(self, now: float) -> None:
+        """Add the tokens accumulated since the last update."""
+        elapsed = max(0.0, now - self.updated)
+        self.tokens = min(
+            self.limit.burst, self.tokens + elapsed * self.limit.rate
+        )
+        self.updated = now
+
+    def retry_after(self) -> float:
+        """Get the seconds until a token is available (0 if one is)."""
+        if self.tokens >= 1:
+            return 0.0
+        return (1 - self.tokens) / self.limit.rate
+
+    def is_full(self) -> bool:
+        """Check whether the bucket has refilled completely."""
+        return self.tokens >= self.limit.burst
+
+
+class RateLimiter:
+    """
+    Thread-safe token buckets per connection and per user.
+    """
+
+    def __init__(
+        self,
+        limits: Optional[Dict[str, RateLimit]] = None,
+        clock: Callable[[], float] = time.monotonic,
+    ):
+        """
+        Initialize the rate limiter.
+
+        Args:
+            limits: Limits per command type, added to (or replacing)
+                DEFAULT_RATE_LIMITS
+            clock: Function returning the current time in seconds
+        """
+        self.limits = dict(DEFAULT_RATE_LIMITS)
+        self.limits.update(limits or {})
+        self.clock = clock
+        # Maps (kind, key, command type) -> bucket, where kind is
+        # "connection" or "user"
+        self._buckets: Dict[Tuple[str, str, str], TokenBucket] = {}
+        self._lock = threading.Lock()
+
+    def set_limits(self, limits: Dict[str, RateLimit]) -> None:
+        """
+        Replace the limits, e.g. after a configuration reload.
+
+        Every bucket starts full again under the new limits.
+
+        Args:
+            limits: Limits per command type, added to (or replacing)
+                DEFAULT_RATE_LIMITS
+        """
+        with self._lock:
+            self.limits = dict(DEFAULT_RATE_LIMITS)
+            self.limits.update(limits)
+            self._buckets.clear()
+
+    def limit_for(self, command: str) -> RateLimit:
+        """Get the limit that applies to a command type."""
+        return self.limits.get(command) or self.limits[DEFAULT_COMMAND]
+
+    def _bucket_command(self, command: str) -> str:
+        """Get the command type whose buckets count a command."""
+        return command if command in self.limits else DEFAULT_COMMAND
+
+    def acquire(
+        self,
+        connection_id: str,
+        command: str,
+        username: Optional[str] = None,
+    ) -> Optional[Dict]:
+        """
+        Count a command against the connection's and the user's buckets.
+
+        A token is taken from each bucket only if both have one, so a
+        rejected command doesn't use up the other bucket.
+
+        Args:
+            connection_id: ID of the client connection
+            command: Type of the command
+            username: Authenticated user of the connection, if any
+
+        Returns:
+            None if the command may be processed, otherwise a dict with
+            "limit" ("connection" or "user") and "retry_after" in seconds
+        """
+        now = self.clock()
+        bucket_command = self._bucket_command(command)
+        keys = [("connection", connection_id, bucket_command)]
+        if username:
+            keys.append(("user", username, bucket_command))
+
+        with self._lock:
+            buckets = []
+            for key in keys:
+                bucket = self._buckets.get(key)
+                if bucket is None:
+                    bucket = TokenBucket(self.limit_for(command), now)
+                    self._buckets[key] = bucket
+                bucket.refill(now)
+                retry_after = bucket.retry_after()
+                if retry_after:
+                    return {"limit": key[0], "retry_after": retry_after}
+                buckets.append(bucket)
+            for bucket in buckets:
+                bucket.tokens -= 1
+        return None
+
+    def forget_connection(self, connection_id: str) -> None:
+        """
+        Drop a closed connection's buckets.
+
+        Users' buckets that have refilled completely are dropped too;
+        buckets of users still over their limit are kept.
+
+        Args:
+            connection_id: ID of the closed connection
+        """
+        now = self.clock()
+        with self._lock:
+            for key in list(self._buckets):
+                kind, owner, _ = key
+                if kind == "connection" and owner == connection_id:
+                    del self._buckets[key]
+                elif kind == "user":
+                    bucket = self._buckets[key]
+                    bucket.refill(now)
+                    if bucket.is_full():
+                        del self._buckets[key]
+
+    def bucket_count(self) -> int:
+        """Get the number of buckets being tracked."""
+        with self._lock:
+            return len(self._buckets)
@@ -0,0 +1,121 @@
+"""
+Emoji Reactions
+
+Members of a room may react to its messages with emoji. A reaction is
+identified by (user, message, emoji): adding one twice, or removing one
+that isn't there, changes nothing, so clients can safely retry the react
+command.
+
+Reactions are aggregated on the room's administrator node, in each
+message's "reactions" field (emoji -> sorted usernames), and written to
+its message log as reaction records. Every change is announced with a
+message_reaction event carrying the message's new aggregate, which other
+nodes store in their replicas as is. Late joiners and history pages get
+the reactions with the messages.
+"""
+
+import unicodedata
+from datetime import datetime, timezone
+from typing import Dict, List, Optional, Tuple
+
+# Reaction actions
+ADD = "add"
+REMOVE = "remove"
+
+# Longest emoji accepted, in characters (sequences joined with ZWJ and
+# modifiers take several)
+MAX_EMOJI_LENGTH = 16
+_ZWJ = "\u200d"  # zero width joiner, allowed between emoji
+
+
+class ReactionError(Exception):
+    """A reaction could not be added or removed."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_EMOJI")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def validate_emoji(emoji) -> Tuple[bool, Optional[str]]:
+    """
+    Check that a reaction is a single short emoji.
+
+    Args:
+        emoji: The reaction as sent by the client
+
+    Returns:
+        tuple: (is_valid, error_message)
+            - is_valid: True if the emoji is valid, False otherwise
+            - error_message: Error message if invalid, None if valid
+    """
+    if not isinstance(emoji, str) or not emoji:
+        return False, "Missing emoji"
+    if len(emoji) > MAX_EMOJI_LENGTH:
+        return False, f"Emoji too long (max {MAX_EMOJI_LENGTH} characters)"
+    categories = [unicodedata.category(ch) for ch in emoji]
+    if "So" not in categories or any(
+        ch.isspace() or (category.startswith(("L", "C")) and ch != _ZWJ)
+        for ch, category in zip(emoji, categories)
+    ):
+        return False, "Reaction must be an emoji"
+    return True, None
+
+
+def create_reaction(
+    message_id: str, emoji: str, username: str, action: str = ADD
+) -> Dict:
+    """
+    Create a reaction record.
+
+    Args:
+        message_id: ID of the message reacted to
+        emoji: The emoji
+        username: The reacting user
+        action: ADD or REMOVE
+
+    Returns:
+        dict: The record, with the current time as its timestamp
+    """
+    return {
+        "message_id": message_id,
+        "emoji": emoji,
+        "username": username,
+        "action": action,
+        "timestamp": datetime.now(timezone.utc).isoformat(),
+    }
+
+
+def apply_reaction(message: Dict, reaction: Dict) -> bool:
+    """
+    Apply a reaction record to a message's aggregate in place.
+
+    Args:
+        message: The message data
+        reaction: Record from create_reaction
+
+    Returns:
+        bool: True if the message's reactions changed
+    """
+    reactions: Dict[str, List[str]] = message.setdefault("reactions", {})
+    users = reactions.get(reaction["emoji"], [])
+    username = reaction["username"]
+    if reaction["action"] == REMOVE:
+        if username not in users:
+            return False
+        users = [user for user in users if user != username]
+    else:
+        if username in users:
+            return False
+        users = sorted(users + [username])
+    if users:
+        reactions[reaction["emoji"]] = users
+    else:
+        del reactions[reaction["emoji"]]
+    return True
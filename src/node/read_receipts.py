@@ -0,0 +1,84 @@
+"""
+Read Receipts and Unread Counts
+
+Each member of a room has a read position: the sequence number of the
+last message they have read there. Clients move it forward with the
+mark_read command; a position never moves backwards, so read receipts
+from several devices or a retried command can't undo each other.
+
+Read positions are kept by the room's administrator node, like the rest
+of the room state: they are written to its message log, passed along
+with snapshots and replicas to a new administrator, and returned with
+join results. A client connected to any node can ask for its read state
+(get_read_state) after reconnecting, which gives its unread count and
+everyone's positions for "seen by" indicators. Every change is announced
+with a read_position_updated event to the room's clients on all nodes.
+"""
+
+from typing import Dict, List
+
+
+class ReadReceiptError(Exception):
+    """A read position could not be read or updated."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "NOT_IN_ROOM")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def unread_count(message_counter: int, last_read: int) -> int:
+    """
+    Count the messages of a room after a read position.
+
+    Args:
+        message_counter: Highest sequence number assigned in the room
+        last_read: The member's read position
+
+    Returns:
+        int: Number of messages not read yet
+    """
+    return max(0, message_counter - last_read)
+
+
+def seen_by(
+    read_positions: Dict[str, int], sequence_number: int
+) -> List[str]:
+    """
+    List the members who have read a message.
+
+    Args:
+        read_positions: Maps username -> read position
+        sequence_number: Sequence number of the message
+
+    Returns:
+        Sorted usernames whose read position reaches the message
+    """
+    return sorted(
+        username
+        for username, position in read_positions.items()
+        if position >= sequence_number
+    )
+
+
+def merge_read_positions(*positions: Dict[str, int]) -> Dict[str, int]:
+    """
+    Combine read positions from several copies of a room.
+
+    Args:
+        positions: Read position dicts (username -> sequence number)
+
+    Returns:
+        dict: The furthest position of each user
+    """
+    merged: Dict[str, int] = {}
+    for copy in positions:
+        for username, position in copy.items():
+            merged[username] = max(merged.get(username, 0), position)
+    return merged
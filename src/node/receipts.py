@@ -0,0 +1,183 @@
+"""
+Delivery Receipts
+
+Lets a sender know which recipients' clients received a room message.
+When a node hands a new_message to its clients it remembers the message's
+room, sender and origin node. A client that wants to confirm receipt sends
+message_received; the recipient's node then sends a DeliveryReceipt to the
+node the sender is connected to, with the deliver_receipt RPC, and that
+node tells the sender with a message_status event.
+
+Receipts are best effort: they are not buffered, and a receipt for a
+message this node no longer remembers, or for a sender who has since
+disconnected, is dropped.
+"""
+
+import threading
+from collections import OrderedDict
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from typing import Any, Dict, Optional, Set
+
+# Receipt configuration
+RECEIPT_TRACK_LIMIT = 1000  # delivered messages remembered for receipts
+
+
+@dataclass
+class DeliveryReceipt:
+    """
+    Confirmation that a recipient's client received a message.
+
+    Attributes:
+        room_id: Room the message was sent to
+        message_id: ID of the message
+        sender: Username of the message's sender
+        recipient: Username of the client that received it
+        timestamp: ISO 8601 timestamp when receipt was confirmed
+    """
+
+    room_id: str
+    message_id: str
+    sender: str
+    recipient: str
+    timestamp: str = ""
+
+    def __post_init__(self):
+        """Initialize the timestamp if not set."""
+        if not self.timestamp:
+            self.timestamp = datetime.now(timezone.utc).isoformat()
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return {
+            "room_id": self.room_id,
+            "message_id": self.message_id,
+            "sender": self.sender,
+            "recipient": self.recipient,
+            "timestamp": self.timestamp,
+        }
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "DeliveryReceipt":
+        """Create a receipt from a dictionary received from a peer."""
+        return cls(
+            room_id=data["room_id"],
+            message_id=data["message_id"],
+            sender=data["sender"],
+            recipient=data["recipient"],
+            timestamp=data.get("timestamp", ""),
+        )
+
+
+@dataclass
+class TrackedMessage:
+    """
+    A message delivered to clients on this node.
+
+    Attributes:
+        room_id: Room the message was sent to
+        sender: Username of the sender
+        origin_node: Node the sender is connected to
+        confirmed: Recipients that already confirmed receipt
+    """
+
+    room_id: str
+    sender: str
+    origin_node: str
+    confirmed: Set[str] = field(default_factory=set)
+
+
+class ReceiptTracker:
+    """
+    Thread-safe record of recently delivered messages, for receipts.
+    """
+
+    def __init__(self, limit: int = RECEIPT_TRACK_LIMIT):
+        """
+        Initialize the tracker.
+
+        Args:
+            limit: Maximum messages remembered; the oldest are forgotten
+                first
+        """
+        self.limit = limit
+        self._lock = threading.Lock()
+        # Maps message_id -> TrackedMessage, oldest first
+        self._messages: "OrderedDict[str, TrackedMessage]" = OrderedDict()
+
+    def track(self, room_id: str, message: Dict[str, Any]) -> None:
+        """
+        Remember a message handed to clients on this node.
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+        """
+        message_id = message.get("message_id")
+        if not message_id:
+            return
+        with self._lock:
+            if message_id in self._messages:
+                return
+            self._messages[message_id] = TrackedMessage(
+                room_id=room_id,
+                sender=message.get("username", ""),
+                origin_node=message.get("origin_node", ""),
+            )
+            while len(self._messages) > self.limit:
+                self._messages.popitem(last=False)
+
+    def confirm(
+        self, room_id: str, message_id: str, recipient: str
+    ) -> Optional[TrackedMessage]:
+        """
+        Record that a recipient confirmed receipt of a message.
+
+        Args:
+            room_id: The room ID
+            message_id: The message ID
+            recipient: Username of the recipient
+
+        Returns:
+            The tracked message if this is the recipient's first receipt
+            for it, or None if the message is unknown, is in another room,
+            was sent by the recipient, or was already confirmed
+        """
+        with self._lock:
+            tracked = self._messages.get(message_id)
+            if (
+                tracked is None
+                or tracked.room_id != room_id
+                or tracked.sender == recipient
+                or recipient in tracked.confirmed
+            ):
+                return None
+            tracked.confirmed.add(recipient)
+            return tracked
+
+    def forget_node(self, node_id: str) -> int:
+        """
+        Forget the messages of senders connected to a dead node.
+
+        Their receipts could never be routed back to the sender.
+
+        Args:
+            node_id: The dead node
+
+        Returns:
+            Number of messages forgotten
+        """
+        with self._lock:
+            orphaned = [
+                message_id
+                for message_id, tracked in self._messages.items()
+                if tracked.origin_node == node_id
+            ]
+            for message_id in orphaned:
+                del self._messages[message_id]
+        return len(orphaned)
+
+    def tracked_count(self) -> int:
+        """Get the number of messages remembered."""
+        with self._lock:
+            return len(self._messages)
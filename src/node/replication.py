@@ -0,0 +1,619 @@
+"""
+Primary-Backup Message Replication
+
+The admin node of a room (the primary) streams the room's committed
+messages to a configurable number of follower nodes. Followers store them
+in their ReplicaStore, so a follower can rebuild the room if the admin
+fails even when none of its clients are in the room.
+
+For each (room, follower) pair the primary tracks the highest sequence
+number the follower has acknowledged. Syncing a follower sends every
+buffered message after that position; a follower that has fallen behind
+the primary's message buffer is sent a reset batch with the whole buffer
+instead. Every new message triggers a sync in the background, and a
+periodic catch-up pass retries followers that missed messages, replaces
+followers that died, and tells followers to drop replicas of deleted
+rooms.
+
+A follower that holds nothing of a room with more messages than fit in
+a batch (e.g., one just added for a busy room), or that is behind the
+buffer, is bootstrapped with a snapshot instead (see snapshot.py). The
+primary buffers the room's live messages for the follower, streams it a
+snapshot of the room taken at one point, then sends the buffered tail
+after the snapshot before the follower is back in sync and streamed to
+as usual.
+
+For durable rooms the primary also waits for a write quorum of the
+followers to acknowledge each message before it is acknowledged to its
+sender, and repairs followers' replicas when the room is read (see
+durability.py).
+"""
+
+import contextvars
+import logging
+import threading
+import time
+import zlib
+from concurrent.futures import ThreadPoolExecutor
+from typing import Dict, List, Optional
+
+from .durability import QUORUM_TIMEOUT, READ_REPAIR_INTERVAL, write_quorum
+from .snapshot import REPLICA, SNAPSHOT_CAPABILITY
+
+logger = logging.getLogger(__name__)
+
+# Replication configuration
+REPLICATION_FACTOR = 2  # follower nodes per room
+REPLICATION_TIMEOUT = 2  # seconds to wait for a follower's acknowledgment
+CATCH_UP_INTERVAL = 5  # seconds between catch-up passes
+MAX_BATCH_SIZE = 50  # messages sent to a follower per call
+
+
+class ReplicationManager:
+    """
+    Streams messages of rooms administered here to follower nodes.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        room_manager,
+        peer_registry,
+        replication_factor: int = REPLICATION_FACTOR,
+        failure_detector=None,
+        timeout: float = REPLICATION_TIMEOUT,
+        max_workers: int = 4,
+        membership=None,
+        executor=None,
+        snapshots=None,
+    ):
+        """
+        Initialize the replication manager.
+
+        Args:
+            node_id: ID of this node
+            room_manager: RoomStateManager holding the primary copies
+            peer_registry: PeerRegistry used to reach followers
+            replication_factor: Number of followers per room (0 disables
+                replication)
+            failure_detector: Optional FailureDetector; dead peers are not
+                chosen as followers
+            timeout: Seconds to wait for each replication call
+            max_workers: Threads used for background syncs
+            membership: Optional ClusterMembership; followers are then
+                chosen among the view's live members only
+            executor: Optional executor running the background syncs
+                instead of a thread pool of max_workers threads
+            snapshots: Optional SnapshotSender used to bootstrap followers
+                that are far behind; without it they are sent the whole
+                message buffer instead
+        """
+        self.node_id = node_id
+        self.room_manager = room_manager
+        self.peer_registry = peer_registry
+        self.replication_factor = replication_factor
+        self.failure_detector = failure_detector
+        self.timeout = timeout
+        self.membership = membership
+        self.snapshots = snapshots
+        self._lock = threading.Lock()
+        # Notified whenever a follower acknowledges messages
+        self._acked_changed = threading.Condition(self._lock)
+        # Maps room_id -> {follower node_id: acknowledged sequence number}
+        self._acked: Dict[str, Dict[str, int]] = {}
+        # Maps room_id -> monotonic time of its last read repair
+        self._repaired_at: Dict[str, float] = {}
+        # Maps (room_id, follower) -> live messages buffered while the
+        # follower is bootstrapped
+        self._bootstrapping: Dict[tuple, List[Dict]] = {}
+        # Maps (room_id, follower) -> lock serializing syncs to it
+        self._sync_locks: Dict[tuple, threading.Lock] = {}
+        self._executor = executor or ThreadPoolExecutor(
+            max_workers=max_workers, thread_name_prefix="replication"
+        )
+
+    def choose_followers(self, room_id: str) -> List[str]:
+        """
+        Pick the follower nodes for a room.
+
+        Followers are taken from the live peers (in the membership view,
+        if there is one), sorted by node ID and starting at a position
+        derived from the room ID, so rooms spread across the cluster and
+        every node picks the same followers.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Up to replication_factor follower node IDs
+        """
+        return self.followers_of(room_id, self.node_id)
+
+    def followers_of(self, room_id: str, admin_node: str) -> List[str]:
+        """
+        Pick the follower nodes a room's admin chooses for it.
+
+        Other nodes use this to find replicas of a remote room: as long
+        as their view of the live nodes agrees with the admin's, they
+        pick the same followers (see choose_followers).
+
+        Args:
+            room_id: The room ID
+            admin_node: Node ID of the room's admin
+
+        Returns:
+            Up to replication_factor follower node IDs
+        """
+        if self.membership is not None:
+            peers = list(self.membership.live_members())
+        elif self.failure_detector is not None:
+            peers = self.failure_detector.alive_peers() + [self.node_id]
+        else:
+            peers = list(self.peer_registry.list_peers()) + [self.node_id]
+        peers = sorted({node_id for node_id in peers if node_id != admin_node})
+        if not peers or self.replication_factor <= 0:
+            return []
+
+        start = zlib.crc32(room_id.encode("utf-8")) % len(peers)
+        rotated = peers[start:] + peers[:start]
+        return rotated[: self.replication_factor]
+
+    def replicate(self, room_id: str, message: Dict) -> None:
+        """
+        Stream a newly committed message to the room's followers.
+
+        Returns immediately; the followers are synced in the background,
+        and the message is buffered for followers being bootstrapped.
+
+        Args:
+            room_id: The room ID
+            message: The committed message
+        """
+        for follower in self._update_followers(room_id):
+            with self._lock:
+                tail = self._bootstrapping.get((room_id, follower))
+                if tail is not None:
+                    tail.append(message)
+                    continue
+            self._executor.submit(
+                contextvars.copy_context().run,
+                self.sync_follower,
+                room_id,
+                follower,
+            )
+
+    def replicate_room_info(self, room_id: str) -> None:
+        """
+        Send a room's metadata to its followers without a new message.
+
+        Used when room state that only replication carries changed (e.g.,
+        its scheduled messages). Returns immediately; the followers are
+        synced in the background.
+
+        Args:
+            room_id: The room ID
+        """
+        for follower in self._update_followers(room_id):
+            if self.is_bootstrapping(room_id, follower):
+                continue
+            self._executor.submit(
+                contextvars.copy_context().run,
+                self.sync_follower,
+                room_id,
+                follower,
+                True,
+            )
+
+    def sync_follower(
+        self, room_id: str, follower: str, refresh: bool = False
+    ) -> int:
+        """
+        Send a follower every message it has not acknowledged yet.
+
+        Args:
+            room_id: The room ID
+            follower: The follower node ID
+            refresh: Send the room's metadata even if the follower has
+                every message
+
+        Returns:
+            int: The follower's acknowledged sequence number afterwards
+        """
+        if self.is_bootstrapping(room_id, follower):
+            return self.get_acked(room_id, follower)
+        with self._sync_lock(room_id, follower):
+            room = self.room_manager.get_room(room_id)
+            if room is None:
+                return 0
+            messages = self.room_manager.get_messages(room_id)
+            acked = self.get_acked(room_id, follower)
+
+            reset = False
+            pending = [m for m in messages if m["sequence_number"] > acked]
+            if messages and messages[0]["sequence_number"] > acked + 1:
+                # The follower is behind our buffer: restart its stream
+                reset = True
+                pending = messages
+            if (reset or (acked == 0 and len(pending) > MAX_BATCH_SIZE)) and (
+                self._can_bootstrap(follower)
+            ):
+                bootstrapped = self._bootstrap(room, follower)
+                if bootstrapped is not None:
+                    return bootstrapped
+            if not pending and not refresh:
+                return acked
+            return self._send_batches(
+                room_id, follower, self._room_info(room), pending, reset, acked
+            )
+
+    def is_bootstrapping(self, room_id: str, follower: str) -> bool:
+        """Check whether a follower of a room is being bootstrapped."""
+        with self._lock:
+            return (room_id, follower) in self._bootstrapping
+
+    def _can_bootstrap(self, follower: str) -> bool:
+        """Check whether a follower can be sent a replica snapshot."""
+        return self.snapshots is not None and (
+            SNAPSHOT_CAPABILITY in self.peer_registry.get_capabilities(follower)
+        )
+
+    def _bootstrap(self, room, follower: str) -> Optional[int]:
+        """
+        Bring a follower up to date with a snapshot and the live tail.
+
+        Called with the follower's sync lock held.
+
+        Args:
+            room: The room, administered here
+            follower: The follower node ID
+
+        Returns:
+            int: The follower's acknowledged sequence number afterwards,
+            or None if the snapshot transfer failed
+        """
+        room_id = room.room_id
+        key = (room_id, follower)
+        with self._lock:
+            self._bootstrapping[key] = []
+        try:
+            # Messages added from here on are buffered in the tail
+            snapshot = self.room_manager.take_snapshot(room_id)
+            result = (
+                self.snapshots.send(follower, snapshot, REPLICA)
+                if snapshot
+                else {"success": False, "error": "Room not found"}
+            )
+        except Exception as e:
+            result = {"success": False, "error": str(e)}
+        if not result.get("success"):
+            with self._lock:
+                self._bootstrapping.pop(key, None)
+            logger.warning(
+                f"Bootstrapping {follower} as follower of room {room_id} "
+                f"failed: {result.get('error')}"
+            )
+            return None
+
+        acked = int(result.get("acked_sequence", snapshot.message_counter))
+        self._set_acked(room_id, follower, acked)
+        with self._lock:
+            tail = self._bootstrapping.pop(key, [])
+        tail = [m for m in tail if m["sequence_number"] > acked]
+        if tail:
+            acked = self._send_batches(
+                room_id, follower, self._room_info(room), tail, False, acked
+            )
+        logger.info(
+            f"Bootstrapped {follower} as follower of room {room_id} with a "
+            f"snapshot through #{snapshot.message_counter} and "
+            f"{len(tail)} buffered messages"
+        )
+        return acked
+
+    def _room_info(self, room) -> Dict:
+        """Get the room metadata sent with each replication batch."""
+        room_id = room.room_id
+        return {
+            "room_id": room.room_id,
+            "room_name": room.room_name,
+            "description": room.description,
+            "creator_id": room.creator_id,
+            "admin_node": self.node_id,
+            "members": self.room_manager.get_members(room_id),
+            "private": room.private,
+            "total_order": room.total_order,
+            "max_members": room.max_members,
+            "waitlist_enabled": room.waitlist_enabled,
+            "announcement": room.announcement,
+            "delivery": room.delivery,
+            "ephemeral": room.ephemeral,
+            "placement": dict(room.placement),
+            "durable": room.durable,
+            "member_set": self.room_manager.get_member_set(room_id),
+            "scheduled": self.room_manager.get_scheduled(room_id),
+            "banned": self.room_manager.get_banned(room_id),
+            "roles": self.room_manager.get_roles(room_id),
+            "public_keys": self.room_manager.get_all_public_keys(room_id),
+            "retention": self.room_manager.get_retention(room_id),
+            "pinned": self.room_manager.get_pinned(room_id),
+            "spam_thresholds": dict(room.spam_thresholds),
+            "content_filters": self.room_manager.get_content_filters(room_id),
+            "topic": room.topic,
+            "metadata_versions": dict(room.metadata_versions),
+        }
+
+    def _send_batches(
+        self,
+        room_id: str,
+        follower: str,
+        room_info: Dict,
+        pending: List[Dict],
+        reset: bool,
+        acked: int,
+    ) -> int:
+        """
+        Send messages to a follower in batches until one fails.
+
+        Args:
+            room_id: The room ID
+            follower: The follower node ID
+            room_info: The room metadata sent with each batch
+            pending: The messages to send, in order
+            reset: Whether the follower restarts its stream of the room
+            acked: The follower's acknowledged sequence number
+
+        Returns:
+            int: The follower's acknowledged sequence number afterwards
+        """
+        for start in range(0, max(len(pending), 1), MAX_BATCH_SIZE):
+            batch = pending[start : start + MAX_BATCH_SIZE]
+            try:
+                result = self.peer_registry.call_peer(
+                    follower,
+                    "replicate_messages",
+                    room_id,
+                    room_info,
+                    batch,
+                    reset and start == 0,
+                    timeout=self.timeout,
+                )
+            except Exception as e:
+                logger.warning(
+                    f"Replication of room {room_id} to {follower} "
+                    f"failed: {e}"
+                )
+                break
+            if not result.get("success"):
+                logger.warning(
+                    f"Follower {follower} rejected replication of room "
+                    f"{room_id}: {result.get('error')}"
+                )
+                break
+            acked = int(result.get("acked_sequence", acked))
+            self._set_acked(room_id, follower, acked)
+            if batch and acked < batch[-1]["sequence_number"]:
+                # Follower reported a gap; catch-up resends from acked
+                break
+        return acked
+
+    def wait_for_quorum(
+        self, room_id: str, sequence: int, timeout: float = QUORUM_TIMEOUT
+    ) -> int:
+        """
+        Wait until a write quorum of a room's copies holds a message.
+
+        Syncs the followers that haven't acknowledged the message yet,
+        then blocks until enough of them have or the timeout passes.
+
+        Args:
+            room_id: The room ID
+            sequence: The message's sequence number
+            timeout: Seconds to wait
+
+        Returns:
+            int: Copies holding the message, this node's included
+        """
+        for follower in self._update_followers(room_id):
+            if self.get_acked(room_id, follower) < sequence:
+                self._executor.submit(
+                    contextvars.copy_context().run,
+                    self.sync_follower,
+                    room_id,
+                    follower,
+                )
+        quorum = write_quorum(self.replication_factor)
+        with self._acked_changed:
+            self._acked_changed.wait_for(
+                lambda: self._copies(room_id, sequence) >= quorum, timeout
+            )
+            return self._copies(room_id, sequence)
+
+    def read_repair(self, room_id: str) -> List[str]:
+        """
+        Resend a room's followers the messages their replicas miss.
+
+        Each follower is asked what it holds with an empty batch, which it
+        answers with the sequence number it actually applied through
+        (lower than acknowledged if it lost its replica), and the ones
+        behind are synced.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            list: IDs of the followers that were behind
+        """
+        room = self.room_manager.get_room(room_id)
+        if room is None:
+            return []
+        repaired = []
+        for follower in self._update_followers(room_id):
+            if self.sync_follower(room_id, follower, True) >= (
+                room.message_counter
+            ):
+                continue
+            logger.info(
+                f"Read repair of room {room_id}: {follower} is behind"
+            )
+            self.sync_follower(room_id, follower)
+            repaired.append(follower)
+        return repaired
+
+    def repair_on_read(self, room_id: str) -> bool:
+        """
+        Start a read repair of a room that was just read.
+
+        Returns immediately; the repair runs in the background, at most
+        once every READ_REPAIR_INTERVAL seconds per room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            bool: True if a repair was started
+        """
+        now = time.monotonic()
+        with self._lock:
+            last = self._repaired_at.get(room_id)
+            if last is not None and now - last < READ_REPAIR_INTERVAL:
+                return False
+            self._repaired_at[room_id] = now
+        self._executor.submit(
+            contextvars.copy_context().run, self.read_repair, room_id
+        )
+        return True
+
+    def catch_up(self) -> int:
+        """
+        Run one catch-up pass over every room administered here.
+
+        Re-chooses followers, syncs each one, and tells followers of rooms
+        that no longer exist here to drop their replicas.
+
+        Returns:
+            int: Number of followers that are fully caught up
+        """
+        caught_up = 0
+        local_rooms = {
+            room["room_id"] for room in self.room_manager.list_rooms()
+        }
+        for room_id in local_rooms:
+            room = self.room_manager.get_room(room_id)
+            if room is None:
+                continue
+            for follower in self._update_followers(room_id):
+                if self.sync_follower(room_id, follower) >= (
+                    room.message_counter
+                ):
+                    caught_up += 1
+
+        with self._lock:
+            gone = [r for r in self._acked if r not in local_rooms]
+        for room_id in gone:
+            self.forget_room(room_id)
+        return caught_up
+
+    def forget_room(self, room_id: str) -> None:
+        """
+        Stop replicating a room and drop it from its followers.
+
+        Args:
+            room_id: The room ID (e.g., of a deleted room)
+        """
+        with self._lock:
+            followers = list(self._acked.pop(room_id, {}))
+            self._repaired_at.pop(room_id, None)
+            for key in [k for k in self._sync_locks if k[0] == room_id]:
+                del self._sync_locks[key]
+        for follower in followers:
+            try:
+                self.peer_registry.call_peer(
+                    follower, "drop_room_replica", room_id, timeout=self.timeout
+                )
+            except Exception as e:
+                logger.debug(
+                    f"Could not drop replica of {room_id} on {follower}: {e}"
+                )
+
+    def get_acked(self, room_id: str, follower: str) -> int:
+        """Get the sequence number a follower has acknowledged."""
+        with self._lock:
+            return self._acked.get(room_id, {}).get(follower, 0)
+
+    def get_status(self, room_id: str) -> Optional[Dict]:
+        """
+        Get the replication state of a room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            dict: {'room_id', 'sequence_number', 'followers': {node_id:
+            {'acked_sequence', 'lag'}}, 'bootstrapping': [node_id]}, or
+            None if the room is not administered here
+        """
+        room = self.room_manager.get_room(room_id)
+        if room is None:
+            return None
+        with self._lock:
+            acked = dict(self._acked.get(room_id, {}))
+            bootstrapping = sorted(
+                follower
+                for room, follower in self._bootstrapping
+                if room == room_id
+            )
+        return {
+            "room_id": room_id,
+            "sequence_number": room.message_counter,
+            "followers": {
+                follower: {
+                    "acked_sequence": sequence,
+                    "lag": room.message_counter - sequence,
+                }
+                for follower, sequence in acked.items()
+            },
+            "bootstrapping": bootstrapping,
+        }
+
+    def shutdown(self) -> None:
+        """Stop the background sync threads."""
+        self._executor.shutdown(wait=False)
+
+    def _update_followers(self, room_id: str) -> List[str]:
+        """Refresh a room's followers, dropping ones no longer chosen."""
+        followers = self.choose_followers(room_id)
+        with self._lock:
+            acked = self._acked.setdefault(room_id, {})
+            for follower in list(acked):
+                if follower not in followers:
+                    logger.info(
+                        f"Node {follower} is no longer a follower of room "
+                        f"{room_id}"
+                    )
+                    del acked[follower]
+            for follower in followers:
+                if follower not in acked:
+                    logger.info(
+                        f"Node {follower} is now a follower of room {room_id}"
+                    )
+                    acked[follower] = 0
+        return followers
+
+    def _set_acked(self, room_id: str, follower: str, sequence: int) -> None:
+        """Record a follower's acknowledgment."""
+        with self._acked_changed:
+            if follower in self._acked.get(room_id, {}):
+                self._acked[room_id][follower] = sequence
+                self._acked_changed.notify_all()
+
+    def _copies(self, room_id: str, sequence: int) -> int:
+        """Count the copies holding a message; call with the lock held."""
+        acked = self._acked.get(room_id, {})
+        return 1 + sum(1 for s in acked.values() if s >= sequence)
+
+    def _sync_lock(self, room_id: str, follower: str) -> threading.Lock:
+        """Get the lock serializing syncs of a room to a follower."""
+        with self._lock:
+            return self._sync_locks.setdefault(
+                (room_id, follower), threading.Lock()
+            )
@@ -0,0 +1,160 @@
+"""
+Room Retention Policies
+
+A room's owner can limit how long the room keeps its messages with
+set_retention, e.g. ["age=7d", "count=10000"], written like the
+operator's retention limits (see compaction.py); an empty list keeps
+every message again. The operator's limits still apply on top of the
+room's own.
+
+History queries only ever return the messages the policy keeps. A page
+that reaches the oldest kept message is marked "truncated" if older
+messages were removed, so clients can tell an expired history from the
+start of the room.
+
+A background reaper deletes expired messages every RETENTION_INTERVAL
+seconds: from memory and storage on the room's administrator, and from
+the replicas other nodes keep of the room. Policies are room metadata
+like roles: the administrator writes them to its message log, sends them
+with replication and join responses, and announces each change with a
+retention_changed event.
+"""
+
+import logging
+from typing import Dict, Iterable, List, Optional, Tuple
+
+from .compaction import RetentionPolicy, parse_retention
+
+logger = logging.getLogger(__name__)
+
+# Retention configuration
+RETENTION_INTERVAL = 60  # seconds between reaper rounds
+
+
+class RetentionError(Exception):
+    """A room's retention policy could not be set."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_RETENTION")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def normalize_retention(limits: Iterable[str]) -> List[str]:
+    """
+    Check a room's retention limits.
+
+    Args:
+        limits: Limits as NAME=VALUE (e.g., ["age=7d", "count=10000"])
+
+    Returns:
+        The limits without surrounding whitespace, sorted
+
+    Raises:
+        RetentionError: If a limit is unknown, malformed or not positive,
+            or a limit is given twice
+    """
+    if isinstance(limits, str) or not isinstance(limits, (list, tuple)):
+        raise RetentionError(
+            "retention must be a list of limits", "INVALID_RETENTION"
+        )
+    normalized = sorted(str(limit).strip() for limit in limits)
+    names = [limit.partition("=")[0].strip() for limit in normalized]
+    if len(set(names)) != len(names):
+        raise RetentionError(
+            "Each retention limit can only be given once", "INVALID_RETENTION"
+        )
+    try:
+        parse_retention(normalized)
+    except ValueError as e:
+        raise RetentionError(str(e), "INVALID_RETENTION")
+    return normalized
+
+
+def room_policy(limits: Iterable[str]) -> RetentionPolicy:
+    """Get the policy of a room's retention limits (unlimited if invalid)."""
+    try:
+        return parse_retention(limits or [])
+    except ValueError as e:
+        logger.warning(f"Ignoring invalid room retention {limits}: {e}")
+        return RetentionPolicy()
+
+
+def expire(
+    messages: List[Dict], limits: Iterable[str], now: Optional[float] = None
+) -> Tuple[List[Dict], int]:
+    """
+    Drop the messages a room's retention limits no longer keep.
+
+    Args:
+        messages: The room's messages in sequence order
+        limits: The room's retention limits
+        now: Current UNIX time (defaults to the time now)
+
+    Returns:
+        tuple: (kept messages, highest sequence number dropped, or 0 if
+        no message was dropped)
+    """
+    kept = room_policy(limits).retain(messages, now)
+    if len(kept) == len(messages):
+        return list(messages), 0
+    ids = {message.get("message_id") for message in kept}
+    dropped = [m for m in messages if m.get("message_id") not in ids]
+    return kept, max(m.get("sequence_number", 0) for m in dropped)
+
+
+class RetentionReaper:
+    """
+    Deletes messages outside their room's retention policy.
+    """
+
+    def __init__(self, room_manager, replica_store=None):
+        """
+        Initialize the reaper.
+
+        Args:
+            room_manager: RoomStateManager whose hosted rooms are reaped
+            replica_store: Optional ReplicaStore whose replicas are reaped
+        """
+        self.room_manager = room_manager
+        self.replica_store = replica_store
+
+    def run_round(self, now: Optional[float] = None) -> Dict[str, int]:
+        """
+        Delete expired messages of every room with a retention policy.
+
+        Args:
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            dict: {room_id: number of messages deleted} for rooms that had
+            expired messages
+        """
+        expired = {}
+        for room in self.room_manager.list_rooms():
+            try:
+                deleted = self.room_manager.expire_messages(
+                    room["room_id"], now
+                )
+            except OSError as e:
+                logger.error(
+                    f"Expiring messages of room {room['room_id']} "
+                    f"failed: {e}"
+                )
+                continue
+            if deleted:
+                expired[room["room_id"]] = deleted
+        if self.replica_store is not None:
+            expired.update(self.replica_store.expire_messages(now))
+        if expired:
+            logger.info(
+                f"Expired {sum(expired.values())} messages of "
+                f"{len(expired)} rooms"
+            )
+        return expired
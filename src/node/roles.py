@@ -0,0 +1,112 @@
+"""
+Room Roles and Permissions
+
+Every member of a room has a role. The room's creator is its owner; the
+owner can promote members to moderator and demote them again. Everyone
+else is a plain member. Each mutating room command checks the requester's
+role against ROLE_PERMISSIONS before it is carried out, on the room's
+administrator node.
+
+Moderators may only act on users below them: they can kick or ban plain
+members and non-members, but not the owner or other moderators.
+
+Roles are room metadata like bans: the administrator writes role changes
+to its message log, sends them with replication and join responses, and
+announces each change to the other nodes with a member_role_changed event.
+"""
+
+from typing import Dict
+
+# Roles
+OWNER = "owner"
+MODERATOR = "moderator"
+MEMBER = "member"
+ROLES = (OWNER, MODERATOR, MEMBER)
+ASSIGNABLE_ROLES = (MODERATOR, MEMBER)  # roles the owner can give
+
+# Permissions
+DELETE_ROOM = "delete_room"
+KICK_MEMBERS = "kick_members"
+BAN_MEMBERS = "ban_members"
+REVOKE_INVITES = "revoke_invites"  # revoke invites created by others
+MANAGE_ROLES = "manage_roles"
+MANAGE_MESSAGES = "manage_messages"  # edit or delete others' messages
+MANAGE_WEBHOOKS = "manage_webhooks"
+MANAGE_BRIDGES = "manage_bridges"  # bridge to IRC and Matrix
+MANAGE_RETENTION = "manage_retention"  # limit how long messages are kept
+POST_ANNOUNCEMENTS = "post_announcements"  # post in announcement rooms
+PIN_MESSAGES = "pin_messages"
+MANAGE_ROOM = "manage_room"  # change the name, topic and description
+MANAGE_SPAM = "manage_spam"  # set the spam detection thresholds
+MANAGE_FILTERS = "manage_filters"  # set the content filters
+
+ROLE_PERMISSIONS = {
+    OWNER: frozenset(
+        {
+            DELETE_ROOM,
+            KICK_MEMBERS,
+            BAN_MEMBERS,
+            REVOKE_INVITES,
+            MANAGE_ROLES,
+            MANAGE_MESSAGES,
+            MANAGE_WEBHOOKS,
+            MANAGE_BRIDGES,
+            MANAGE_RETENTION,
+            POST_ANNOUNCEMENTS,
+            PIN_MESSAGES,
+            MANAGE_ROOM,
+            MANAGE_SPAM,
+            MANAGE_FILTERS,
+        }
+    ),
+    MODERATOR: frozenset(
+        {
+            KICK_MEMBERS,
+            BAN_MEMBERS,
+            REVOKE_INVITES,
+            MANAGE_MESSAGES,
+            POST_ANNOUNCEMENTS,
+            PIN_MESSAGES,
+            MANAGE_ROOM,
+            MANAGE_SPAM,
+            MANAGE_FILTERS,
+        }
+    ),
+    MEMBER: frozenset(),
+}
+
+_RANKS: Dict[str, int] = {OWNER: 2, MODERATOR: 1, MEMBER: 0}
+
+
+class RoleError(Exception):
+    """A member's role could not be changed."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "NOT_ALLOWED")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def has_permission(role: str, permission: str) -> bool:
+    """
+    Check whether a role grants a permission.
+
+    Args:
+        role: One of ROLES
+        permission: The permission to check (e.g., DELETE_ROOM)
+
+    Returns:
+        True if the role may perform the action
+    """
+    return permission in ROLE_PERMISSIONS.get(role, frozenset())
+
+
+def outranks(role: str, other: str) -> bool:
+    """Check whether a role is above another (owner > moderator > member)."""
+    return _RANKS.get(role, 0) > _RANKS.get(other, 0)
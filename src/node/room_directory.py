@@ -0,0 +1,532 @@
+"""
+Global Room Directory
+
+Maintains an eventually-consistent directory of every room in the cluster.
+Each node is authoritative for the rooms it administers and publishes
+versioned entries for them. Nodes periodically exchange their directories
+with peers (push-pull gossip) and keep the highest version of each entry,
+so every node converges on the same view without querying all peers for
+each lookup.
+
+Gossip only reaches a few random peers per round, so after a partition
+heals directories can stay divergent for a while. Anti-entropy (see
+anti_entropy.py) repairs them by comparing digest() trees with each peer.
+
+A peer cut off for longer than TOMBSTONE_TTL may still list a room that
+was deleted meanwhile, after every other node forgot its tombstone. Only
+a room's admin can bump its version, so an admin sent a live entry for a
+room it doesn't host answers with a fresh tombstone that outranks it
+(see disown()); otherwise the room would come back for good.
+"""
+
+import hashlib
+import logging
+import random
+import threading
+import time
+import zlib
+from dataclasses import dataclass, asdict
+from typing import Any, Dict, List, Optional
+
+from .delivery import EXACTLY_ONCE
+
+logger = logging.getLogger(__name__)
+
+# Gossip configuration
+GOSSIP_INTERVAL = 5  # seconds between gossip rounds
+GOSSIP_FANOUT = 2  # peers contacted per round
+TOMBSTONE_TTL = 300  # seconds to remember deleted rooms
+DIGEST_BUCKETS = 64  # leaves of the directory digest tree
+
+# Fields that, when changed, require a new entry version
+_TRACKED_FIELDS = (
+    "room_name",
+    "description",
+    "topic",
+    "admin_node",
+    "node_address",
+    "member_count",
+    "creator_id",
+    "private",
+    "total_order",
+    "announcement",
+    "delivery",
+    "ephemeral",
+)
+
+
+@dataclass
+class DirectoryEntry:
+    """
+    A room as known to the global directory.
+
+    Attributes:
+        room_id: Unique identifier for the room
+        room_name: Name of the room
+        description: Optional room description
+        topic: Optional room topic
+        admin_node: Node administering the room
+        node_address: XML-RPC address of the admin node
+        member_count: Number of members at the last update
+        creator_id: ID of the user who created the room
+        private: True if the room is private (kept for routing invite
+            joins, but never listed)
+        total_order: True if the room delivers messages in total order
+        announcement: True if only the owner and moderators may post
+        delivery: The room's delivery guarantee (see delivery.py)
+        ephemeral: True if the room is torn down once empty or idle
+        version: Monotonic version assigned by the admin node
+        deleted: True if this entry is a tombstone for a deleted room
+        updated_at: Local UNIX time when this entry was last changed
+    """
+
+    room_id: str
+    room_name: str
+    admin_node: str
+    node_address: str = ""
+    description: Optional[str] = None
+    topic: Optional[str] = None
+    member_count: int = 0
+    creator_id: str = ""
+    private: bool = False
+    total_order: bool = False
+    announcement: bool = False
+    delivery: str = EXACTLY_ONCE
+    ephemeral: bool = False
+    version: int = 1
+    deleted: bool = False
+    updated_at: float = 0.0
+
+    def __post_init__(self):
+        """Initialize the update time if not set."""
+        if not self.updated_at:
+            self.updated_at = time.time()
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+    def to_room_dict(self) -> Dict[str, Any]:
+        """Convert to the room dictionary format used by list_rooms."""
+        return {
+            "room_id": self.room_id,
+            "room_name": self.room_name,
+            "description": self.description,
+            "topic": self.topic,
+            "member_count": self.member_count,
+            "admin_node": self.admin_node,
+            "creator_id": self.creator_id,
+            "node_address": self.node_address,
+            "private": self.private,
+            "total_order": self.total_order,
+            "announcement": self.announcement,
+            "delivery": self.delivery,
+            "ephemeral": self.ephemeral,
+        }
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "DirectoryEntry":
+        """Create an entry from a dictionary received from a peer."""
+        return cls(
+            room_id=data["room_id"],
+            room_name=data.get("room_name", ""),
+            admin_node=data.get("admin_node", ""),
+            node_address=data.get("node_address", ""),
+            description=data.get("description"),
+            topic=data.get("topic"),
+            member_count=int(data.get("member_count", 0)),
+            creator_id=data.get("creator_id", ""),
+            private=bool(data.get("private", False)),
+            total_order=bool(data.get("total_order", False)),
+            announcement=bool(data.get("announcement", False)),
+            delivery=data.get("delivery", EXACTLY_ONCE),
+            ephemeral=bool(data.get("ephemeral", False)),
+            version=int(data.get("version", 1)),
+            deleted=bool(data.get("deleted", False)),
+        )
+
+
+def digest_bucket(room_id: str, buckets: int = DIGEST_BUCKETS) -> int:
+    """Get the digest tree leaf a room's entry is hashed into."""
+    return zlib.crc32(room_id.encode()) % buckets
+
+
+class RoomDirectory:
+    """
+    Thread-safe directory of all known rooms in the cluster.
+    """
+
+    def __init__(self, node_id: str, node_address: str = ""):
+        """
+        Initialize the room directory.
+
+        Args:
+            node_id: ID of this node
+            node_address: XML-RPC address of this node
+        """
+        self.node_id = node_id
+        self.node_address = node_address
+        self._lock = threading.Lock()
+        self._entries: Dict[str, DirectoryEntry] = {}
+
+    def update_local(self, local_rooms: List[Dict[str, Any]]) -> None:
+        """
+        Refresh entries for rooms administered by this node.
+
+        Changed rooms get a new version; rooms that no longer exist
+        locally are replaced by tombstones so the deletion propagates.
+
+        Args:
+            local_rooms: Room dicts from RoomStateManager.list_rooms()
+        """
+        with self._lock:
+            seen = set()
+            for room in local_rooms:
+                room_id = room["room_id"]
+                seen.add(room_id)
+                current = self._entries.get(room_id)
+                fields = {
+                    "room_name": room.get("room_name", ""),
+                    "description": room.get("description"),
+                    "topic": room.get("topic"),
+                    "admin_node": self.node_id,
+                    "node_address": self.node_address,
+                    "member_count": room.get("member_count", 0),
+                    "creator_id": room.get("creator_id", ""),
+                    "private": bool(room.get("private", False)),
+                    "total_order": bool(room.get("total_order", False)),
+                    "announcement": bool(room.get("announcement", False)),
+                    "delivery": room.get("delivery", EXACTLY_ONCE),
+                    "ephemeral": bool(room.get("ephemeral", False)),
+                }
+                if current is None:
+                    self._entries[room_id] = DirectoryEntry(
+                        room_id=room_id, **fields
+                    )
+                elif current.deleted or any(
+                    getattr(current, name) != fields[name]
+                    for name in _TRACKED_FIELDS
+                ):
+                    for name, value in fields.items():
+                        setattr(current, name, value)
+                    current.deleted = False
+                    current.version += 1
+                    current.updated_at = time.time()
+
+            for entry in self._entries.values():
+                if (
+                    entry.admin_node == self.node_id
+                    and not entry.deleted
+                    and entry.room_id not in seen
+                ):
+                    entry.deleted = True
+                    entry.version += 1
+                    entry.updated_at = time.time()
+
+    def merge(self, entries: List[Dict[str, Any]]) -> int:
+        """
+        Merge entries received from a peer.
+
+        An incoming entry replaces the local one if its version is higher.
+        Entries naming this node as admin are never taken, since the local
+        room state is authoritative for them; a live one for a room this
+        node doesn't host is disowned with a tombstone instead.
+
+        Args:
+            entries: Entry dicts from a peer's directory
+
+        Returns:
+            Number of entries that were added or updated
+        """
+        updated = 0
+        with self._lock:
+            for data in entries:
+                try:
+                    incoming = DirectoryEntry.from_dict(data)
+                except (KeyError, TypeError, ValueError) as e:
+                    logger.warning(f"Ignoring malformed directory entry: {e}")
+                    continue
+
+                current = self._entries.get(incoming.room_id)
+                if incoming.admin_node == self.node_id:
+                    if not incoming.deleted and not self._hosts(current):
+                        self._disown(incoming, current)
+                    continue
+
+                if current is None or incoming.version > current.version:
+                    self._entries[incoming.room_id] = incoming
+                    updated += 1
+        if updated:
+            logger.debug(f"Merged {updated} room directory entries")
+        return updated
+
+    def disown(self, room_id: str, version: int) -> bool:
+        """
+        Tombstone a room peers list with this node as admin, though it
+        doesn't host it.
+
+        Args:
+            room_id: The room ID
+            version: Version of the live entry the peers hold
+
+        Returns:
+            True if this node now holds a tombstone outranking that
+            version (False if it hosts the room, or a newer live entry
+            names another admin)
+        """
+        with self._lock:
+            current = self._entries.get(room_id)
+            if self._hosts(current):
+                return False
+            incoming = DirectoryEntry(
+                room_id=room_id,
+                room_name=current.room_name if current else "",
+                admin_node=self.node_id,
+                version=version,
+            )
+            return self._disown(incoming, current)
+
+    def _hosts(self, entry: Optional[DirectoryEntry]) -> bool:
+        """Check whether an entry is live and names this node as admin."""
+        return (
+            entry is not None
+            and not entry.deleted
+            and entry.admin_node == self.node_id
+        )
+
+    def _disown(
+        self, incoming: DirectoryEntry, current: Optional[DirectoryEntry]
+    ) -> bool:
+        """
+        Store a tombstone outranking an entry wrongly naming this node
+        (call with the lock held).
+        """
+        if current is not None and current.version > incoming.version:
+            # The incoming entry is stale; a tombstone is kept while peers
+            # still send it
+            if current.deleted:
+                current.updated_at = time.time()
+            return current.deleted
+        logger.info(
+            f"Room {incoming.room_id} listed with this node as admin but "
+            f"not hosted here, tombstoning it"
+        )
+        self._entries[incoming.room_id] = DirectoryEntry(
+            room_id=incoming.room_id,
+            room_name=incoming.room_name,
+            admin_node=self.node_id,
+            node_address=self.node_address,
+            version=incoming.version + 1,
+            deleted=True,
+        )
+        return True
+
+    def reassign(
+        self,
+        room_id: str,
+        admin_node: str,
+        node_address: str,
+        room_name: Optional[str] = None,
+    ) -> bool:
+        """
+        Point a room's entry at a new admin node after failover.
+
+        Args:
+            room_id: The room ID
+            admin_node: Node ID of the new administrator
+            node_address: XML-RPC address of the new administrator
+            room_name: Name used to create the entry if the room is not
+                in the directory yet
+
+        Returns:
+            True if the room has an entry after the call
+        """
+        with self._lock:
+            entry = self._entries.get(room_id)
+            if entry is None:
+                if room_name is None:
+                    return False
+                self._entries[room_id] = DirectoryEntry(
+                    room_id=room_id,
+                    room_name=room_name,
+                    admin_node=admin_node,
+                    node_address=node_address,
+                )
+                return True
+            if (entry.admin_node, entry.node_address) != (
+                admin_node,
+                node_address,
+            ):
+                entry.admin_node = admin_node
+                entry.node_address = node_address
+                entry.version += 1
+                entry.updated_at = time.time()
+            return True
+
+    def get_entries(self) -> List[Dict[str, Any]]:
+        """Get all entries, including tombstones, for gossiping."""
+        with self._lock:
+            return [entry.to_dict() for entry in self._entries.values()]
+
+    def get_entries_for(self, room_ids: List[str]) -> List[Dict[str, Any]]:
+        """
+        Get the entries of some rooms, including tombstones.
+
+        Args:
+            room_ids: IDs of the rooms; unknown rooms are skipped
+
+        Returns:
+            List of entry dicts
+        """
+        with self._lock:
+            return [
+                self._entries[room_id].to_dict()
+                for room_id in room_ids
+                if room_id in self._entries
+            ]
+
+    def digest(self, buckets: int = DIGEST_BUCKETS) -> Dict[str, Any]:
+        """
+        Build a two-level hash tree summarizing the directory.
+
+        Each live entry is hashed by room ID and version into one of the
+        leaf buckets; the root hashes all leaves. Two nodes with the same
+        root hold the same live entries, and the leaves that differ show
+        where to look for the entries that don't match. Tombstones are
+        left out so that a node that already dropped one is not reported
+        as divergent.
+
+        Args:
+            buckets: Number of leaf buckets
+
+        Returns:
+            dict: {'root': hex digest, 'buckets': list of hex digests}
+        """
+        leaves: List[List[str]] = [[] for _ in range(buckets)]
+        with self._lock:
+            for entry in self._entries.values():
+                if not entry.deleted:
+                    leaves[digest_bucket(entry.room_id, buckets)].append(
+                        f"{entry.room_id}:{entry.version}"
+                    )
+        hashes = [
+            hashlib.sha256("\n".join(sorted(leaf)).encode()).hexdigest()
+            for leaf in leaves
+        ]
+        root = hashlib.sha256("".join(hashes).encode()).hexdigest()
+        return {"root": root, "buckets": hashes}
+
+    def bucket_versions(
+        self, bucket_indices: List[int], buckets: int = DIGEST_BUCKETS
+    ) -> Dict[str, Dict[str, Any]]:
+        """
+        Get the versions of the entries in some digest buckets.
+
+        Args:
+            bucket_indices: Indices of the leaf buckets
+            buckets: Number of leaf buckets of the digest
+
+        Returns:
+            Maps room_id -> {'version': int, 'deleted': bool,
+            'admin_node': str}, including tombstones
+        """
+        wanted = set(bucket_indices)
+        with self._lock:
+            return {
+                entry.room_id: {
+                    "version": entry.version,
+                    "deleted": entry.deleted,
+                    "admin_node": entry.admin_node,
+                }
+                for entry in self._entries.values()
+                if digest_bucket(entry.room_id, buckets) in wanted
+            }
+
+    def get(self, room_id: str) -> Optional[DirectoryEntry]:
+        """
+        Get the live entry for a room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The DirectoryEntry, or None if unknown or deleted
+        """
+        with self._lock:
+            entry = self._entries.get(room_id)
+            if entry is None or entry.deleted:
+                return None
+            return entry
+
+    def list_rooms(self) -> List[Dict[str, Any]]:
+        """Get all live public rooms in the room dictionary format."""
+        with self._lock:
+            return [
+                entry.to_room_dict()
+                for entry in self._entries.values()
+                if not entry.deleted and not entry.private
+            ]
+
+    def purge_tombstones(self, ttl: float = TOMBSTONE_TTL) -> int:
+        """
+        Forget tombstones older than the TTL.
+
+        Args:
+            ttl: Age in seconds after which tombstones are dropped
+
+        Returns:
+            Number of tombstones removed
+        """
+        cutoff = time.time() - ttl
+        with self._lock:
+            expired = [
+                room_id
+                for room_id, entry in self._entries.items()
+                if entry.deleted and entry.updated_at < cutoff
+            ]
+            for room_id in expired:
+                del self._entries[room_id]
+        return len(expired)
+
+
+def gossip_round(
+    room_directory: RoomDirectory,
+    room_manager,
+    peer_registry,
+    fanout: int = GOSSIP_FANOUT,
+) -> List[str]:
+    """
+    Run one push-pull gossip round with randomly chosen peers.
+
+    Refreshes the local entries, sends the directory to each chosen peer
+    via exchange_room_directory, and merges the peer's reply.
+
+    Args:
+        room_directory: The local room directory
+        room_manager: RoomStateManager for this node's rooms
+        peer_registry: PeerRegistry used to reach peers
+        fanout: Number of peers to contact
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    room_directory.update_local(room_manager.list_rooms())
+    room_directory.purge_tombstones()
+
+    peers = list(peer_registry.list_peers().keys())
+    if not peers:
+        return []
+
+    reached = []
+    for peer_id in random.sample(peers, min(fanout, len(peers))):
+        try:
+            remote_entries = peer_registry.call_peer(
+                peer_id,
+                "exchange_room_directory",
+                room_directory.get_entries(),
+            )
+            room_directory.merge(remote_entries)
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Gossip with {peer_id} failed: {e}")
+    return reached
@@ -0,0 +1,173 @@
+"""
+Room Metadata Updates
+
+After a room is created, its owner and moderators can change its name,
+topic and description with update_room. Requests for remote rooms are
+forwarded to the room's administrator, which applies the change and
+announces it with a room_updated event.
+
+Every field carries the HLC timestamp (see clock.py) of its last change
+in the room's metadata_versions, and a change is only applied to a field
+whose version is older (last writer wins, per field). HLC timestamps are
+unique and totally ordered across nodes, so every node that sees the
+same changes ends up with the same metadata, whatever order they
+arrive in. This matters around failover: a change made by an admin that
+then died may have reached only some replicas, and the new admin may
+accept another one meanwhile. The new admin keeps the newest version of
+each field from the surviving replicas, and a late room_updated from the
+old admin only wins where it is newer.
+
+Metadata is written to the message log with its versions and sent with
+join responses, replication and snapshots; names and descriptions reach
+room listings through the room directory and the Raft registry.
+"""
+
+from typing import Any, Dict, List, Optional
+
+from .utils.validation import validate_room_name
+
+# Fields update_room can change
+METADATA_FIELDS = ("room_name", "topic", "description")
+
+# Metadata limits, in characters
+MAX_TOPIC_LENGTH = 300
+MAX_DESCRIPTION_LENGTH = 1000
+
+_MAX_LENGTHS = {
+    "topic": MAX_TOPIC_LENGTH,
+    "description": MAX_DESCRIPTION_LENGTH,
+}
+
+
+class RoomUpdateError(Exception):
+    """A room's metadata could not be updated."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_REQUEST")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def validate_changes(changes: Any) -> Dict[str, Optional[str]]:
+    """
+    Check the fields of an update_room request.
+
+    Args:
+        changes: Maps field -> new value; an empty topic or description
+            clears it
+
+    Returns:
+        The changes without surrounding whitespace, empty values as None
+
+    Raises:
+        RoomUpdateError: If there are no changes, a field is unknown, or
+            a value is invalid (INVALID_REQUEST or INVALID_ROOM_NAME)
+    """
+    if not isinstance(changes, dict) or not changes:
+        raise RoomUpdateError(
+            f"Give at least one of {', '.join(METADATA_FIELDS)}",
+            "INVALID_REQUEST",
+        )
+    unknown = sorted(set(changes) - set(METADATA_FIELDS))
+    if unknown:
+        raise RoomUpdateError(
+            f"Unknown room fields: {', '.join(unknown)}", "INVALID_REQUEST"
+        )
+
+    cleaned = {}
+    for name, value in changes.items():
+        if value is not None and not isinstance(value, str):
+            raise RoomUpdateError(f"{name} must be a string", "INVALID_REQUEST")
+        if name == "room_name":
+            is_valid, error_msg = validate_room_name(value)
+            if not is_valid:
+                raise RoomUpdateError(error_msg, "INVALID_ROOM_NAME")
+            cleaned[name] = value.strip()
+            continue
+        value = (value or "").strip()
+        if len(value) > _MAX_LENGTHS[name]:
+            raise RoomUpdateError(
+                f"{name} too long (max {_MAX_LENGTHS[name]} characters)",
+                "INVALID_REQUEST",
+            )
+        cleaned[name] = value or None
+    return cleaned
+
+
+def newer_fields(
+    versions: Dict[str, str], incoming: Dict[str, str]
+) -> List[str]:
+    """
+    Find the fields whose incoming version wins over the current one.
+
+    Args:
+        versions: Maps field -> encoded HLC timestamp of its last change
+        incoming: Maps field -> encoded HLC timestamp of a change to it
+
+    Returns:
+        The fields to apply the change to
+    """
+    return [
+        name
+        for name, version in incoming.items()
+        if name in METADATA_FIELDS and version > versions.get(name, "")
+    ]
+
+
+def apply_versioned(
+    target: Any, values: Dict[str, Any], versions: Dict[str, str]
+) -> None:
+    """
+    Update a room or replica from a full copy of a room's metadata.
+
+    Fields in the copy replace the target's unless the target's version
+    is newer, so unversioned copies from older nodes still apply.
+
+    Args:
+        target: Object with the METADATA_FIELDS and metadata_versions
+            attributes (a Room or RoomReplica)
+        values: The copy's fields, e.g. a join response's room_info
+        versions: The copy's metadata_versions
+    """
+    for name in METADATA_FIELDS:
+        if name not in values:
+            continue
+        version = versions.get(name, "")
+        if version < target.metadata_versions.get(name, ""):
+            continue
+        setattr(target, name, values[name])
+        if version:
+            target.metadata_versions[name] = version
+
+
+def merge_versioned(states: List[Dict[str, Any]]) -> Dict[str, Any]:
+    """
+    Merge the metadata of several copies of a room, newest field wins.
+
+    Fields never changed on any copy are taken from the first.
+
+    Args:
+        states: Dicts with the METADATA_FIELDS and 'metadata_versions'
+
+    Returns:
+        dict: The merged METADATA_FIELDS plus their 'metadata_versions'
+    """
+    merged: Dict[str, Any] = {}
+    versions: Dict[str, str] = {}
+    for state in states:
+        state_versions = state.get("metadata_versions") or {}
+        for name in METADATA_FIELDS:
+            version = state_versions.get(name, "")
+            if name in merged and version <= versions.get(name, ""):
+                continue
+            merged[name] = state.get(name)
+            if version:
+                versions[name] = version
+    merged["metadata_versions"] = versions
+    return merged
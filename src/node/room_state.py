@@ -2,15 +2,133 @@
 Room State Management for Node Server
 
 This module manages the in-memory state of rooms hosted on this node.
-Each node maintains its own list of rooms that it administers.
+Each node maintains its own list of rooms that it administers. With a
+storage backend attached (see storage.py), room creation, deletion and
+messages are written ahead so the rooms can be recovered after a restart.
+Rooms can also be archived instead of deleted, and restored later (see
+archive.py).
 """
 
+import functools
 import logging
+import threading
 import uuid
 from dataclasses import dataclass, field
 from datetime import datetime, timezone
 from enum import Enum
-from typing import Any, Dict, List, Optional
+from typing import Any, Dict, Iterator, List, Optional, Set, Tuple
+
+from .announcements import AnnouncementError
+from .archive import ArchiveError, ArchiveStore, archive_summary
+from .audit import (
+    MEMBER_BANNED,
+    MEMBER_KICKED,
+    MEMBER_MUTED,
+    ROLE_CHANGED,
+    ROOM_ARCHIVED,
+    ROOM_CREATED,
+    ROOM_RESTORED,
+    audit,
+)
+from .bots import BotError, route_command, validate_commands
+from .capacity import CapacityError
+from .clock import HybridLogicalClock
+from .compaction import RetentionPolicy
+from .content_filters import ContentFilterError, FilterChain, FilterRegistry
+from .dedup import DedupWindow, DuplicateMessageError
+from .delivery import EXACTLY_ONCE, validate_delivery
+from .e2ee import E2EEError, create_public_key, validate_encrypted_message
+from .export import ExportError, select_messages, stored_messages
+from .edits import (
+    DELETE,
+    EDIT,
+    EDIT_ACTIONS,
+    EditError,
+    apply_edit,
+    create_edit,
+)
+from .history import HISTORY_PAGE_SIZE, paginate_history
+from .invites import INVITE_TTL, InviteError, RoomInvite, create_invite
+from .member_set import TOMBSTONE_TTL, MemberSet
+from .mentions import parse_mentions
+from .moderation import ModerationError
+from .pins import PinError, update_pins
+from .placement import validate_placement
+from .read_receipts import ReadReceiptError, unread_count
+from .room_metadata import RoomUpdateError, newer_fields, validate_changes
+from .scheduled import (
+    MAX_SCHEDULED_MESSAGES,
+    ScheduleError,
+    create_scheduled,
+    is_due,
+    parse_send_at,
+    send_time,
+)
+from .search import SEARCH_LIMIT, SearchError, SearchIndex
+from .seed import SeedError, build_messages
+from .snapshot import RoomSnapshot
+from .spam import (
+    SPAM_DETECTED,
+    SpamDetector,
+    SpamError,
+    effective_thresholds,
+    validate_thresholds,
+)
+from .reactions import (
+    ADD,
+    REMOVE,
+    ReactionError,
+    apply_reaction,
+    create_reaction,
+    validate_emoji,
+)
+from .retention import (
+    RetentionError,
+    expire,
+    normalize_retention,
+    room_policy,
+)
+from .roles import (
+    ASSIGNABLE_ROLES,
+    BAN_MEMBERS,
+    KICK_MEMBERS,
+    MANAGE_BRIDGES,
+    MANAGE_FILTERS,
+    MANAGE_MESSAGES,
+    MANAGE_RETENTION,
+    MANAGE_ROLES,
+    MANAGE_ROOM,
+    MANAGE_SPAM,
+    MANAGE_WEBHOOKS,
+    MEMBER,
+    MODERATOR,
+    OWNER,
+    PIN_MESSAGES,
+    POST_ANNOUNCEMENTS,
+    REVOKE_INVITES,
+    RoleError,
+    has_permission,
+    outranks,
+)
+from .bridges import (
+    MAX_BRIDGES,
+    BridgeError,
+    create_bridge,
+    public_bridge,
+)
+from .threads import ThreadError, thread_messages, thread_root, thread_summary
+from .utils.validation import validate_message_content, validate_room_name
+from .webhooks import (
+    MAX_WEBHOOKS,
+    MEMBER_JOINED,
+    MEMBER_LEFT,
+    MESSAGE_POSTED,
+    ROOM_DELETED,
+    WebhookError,
+    create_webhook,
+    public_webhook,
+    webhooks_for,
+)
 
 logger = logging.getLogger(__name__)
 
@@ -27,20 +145,27 @@ class MemberInfo:
     """
     Information about a room member.
 
+    A user may be connected from several devices, through different
+    nodes; the member stays in the room until all of them are gone.
+
     Attributes:
         username: The member's username
-        node_id: The node the member is connected to
+        node_id: The node the member last joined through
         joined_at: ISO 8601 timestamp when member joined
         last_activity: ISO 8601 timestamp of last activity
+        nodes: Every node the member is connected through
     """
 
     username: str
     node_id: str
     joined_at: str = ""
     last_activity: str = ""
+    nodes: Set[str] = None
 
     def __post_init__(self):
-        """Initialize timestamps if not set."""
+        """Initialize timestamps and nodes if not set."""
+        if self.nodes is None:
+            self.nodes = {self.node_id}
         now = datetime.now(timezone.utc).isoformat()
         if not self.joined_at:
             self.joined_at = now
@@ -54,6 +179,7 @@ class MemberInfo:
             "node_id": self.node_id,
             "joined_at": self.joined_at,
             "last_activity": self.last_activity,
+            "nodes": sorted(self.nodes),
         }
 
     def update_activity(self):
@@ -216,6 +342,54 @@ class Room:
         message_counter: Counter for assigning sequence numbers to messages
         messages: List of messages in the room (in-memory buffer)
         state: Current room state for 2PC protocol
+        vector_clock: Vector clock of the latest message ({node_id: count})
+        private: True if the room is hidden from listings and can only be
+            joined with an invite
+        invites: Dict of invite token -> RoomInvite for private rooms
+        total_order: True if every member must see messages in the order
+            this node sequenced them (see total_order.py)
+        banned: Usernames banned from the room
+        roles: Maps username -> role for members promoted above member
+            (the creator is always the owner, see roles.py)
+        max_members: Most members the room may have (0 for no limit)
+        waitlist_enabled: True if joins beyond max_members wait for a
+            free slot instead of being refused (see capacity.py)
+        waitlist: Maps each waiting username -> node ID, in the order
+            they will be admitted
+        read_positions: Maps username -> sequence number of the last
+            message they have read (see read_receipts.py)
+        public_keys: Maps username -> public key record published for
+            end-to-end encryption (see e2ee.py)
+        webhooks: Maps webhook ID -> webhook record (see webhooks.py)
+        bots: Maps the name of each bot in the room -> the commands
+            routed to it (see bots.py)
+        bridges: Maps bridge ID -> bridge record (see bridges.py)
+        retention: The room owner's retention limits, e.g. ["age=7d"]
+            (see retention.py)
+        expired_through: Highest sequence number of a message removed by
+            retention or compaction (0 if none was)
+        announcement: True if only the owner and moderators may post
+            (see announcements.py)
+        pinned: IDs of the room's pinned messages, in the order they
+            were pinned (see pins.py)
+        topic: Optional room topic
+        metadata_versions: Maps room_name, topic and description -> HLC
+            timestamp of their last update (see room_metadata.py)
+        spam_thresholds: Spam detection thresholds changed by the owner
+            or moderators, the others keep their defaults (see spam.py)
+        content_filters: The room's content filters, in the order they
+            run, each {"type", **options} (see content_filters.py)
+        delivery: The room's delivery guarantee (see delivery.py)
+        ephemeral: True if the room is torn down once empty or idle (see
+            ephemeral.py)
+        scheduled: Maps message ID -> message scheduled to be sent later
+            (see scheduled.py)
+        placement: Tags the room's admin node must have (see
+            placement.py)
+        durable: True if messages are acknowledged only once a write
+            quorum of the room's copies holds them (see durability.py)
+        member_set: OR-Set of the room's members, merged with the sets
+            of other nodes' replicas (see member_set.py)
     """
 
     room_id: str
@@ -229,6 +403,34 @@ class Room:
     messages: list = None
     state: RoomState = RoomState.ACTIVE
     member_info: Dict[str, MemberInfo] = None
+    vector_clock: Dict[str, int] = None
+    private: bool = False
+    invites: Dict[str, RoomInvite] = None
+    total_order: bool = False
+    banned: Set[str] = None
+    roles: Dict[str, str] = None
+    max_members: int = 0
+    waitlist_enabled: bool = False
+    waitlist: Dict[str, str] = None
+    read_positions: Dict[str, int] = None
+    public_keys: Dict[str, Dict] = None
+    webhooks: Dict[str, Dict] = None
+    bots: Dict[str, List[str]] = None
+    bridges: Dict[str, Dict] = None
+    retention: List[str] = None
+    expired_through: int = 0
+    announcement: bool = False
+    pinned: List[str] = None
+    topic: Optional[str] = None
+    metadata_versions: Dict[str, str] = None
+    spam_thresholds: Dict[str, int] = None
+    content_filters: List[Dict[str, Any]] = None
+    delivery: str = EXACTLY_ONCE
+    ephemeral: bool = False
+    scheduled: Dict[str, Dict] = None
+    placement: Dict[str, str] = None
+    durable: bool = False
+    member_set: MemberSet = None
 
     def __post_init__(self):
         """Initialize the messages list and member_info dict if not set."""
@@ -236,6 +438,42 @@ class Room:
             self.messages = []
         if self.member_info is None:
             self.member_info = {}
+        if self.vector_clock is None:
+            self.vector_clock = {}
+        if self.invites is None:
+            self.invites = {}
+        if self.banned is None:
+            self.banned = set()
+        if self.roles is None:
+            self.roles = {}
+        if self.waitlist is None:
+            self.waitlist = {}
+        if self.read_positions is None:
+            self.read_positions = {}
+        if self.public_keys is None:
+            self.public_keys = {}
+        if self.webhooks is None:
+            self.webhooks = {}
+        if self.bots is None:
+            self.bots = {}
+        if self.bridges is None:
+            self.bridges = {}
+        if self.retention is None:
+            self.retention = []
+        if self.pinned is None:
+            self.pinned = []
+        if self.metadata_versions is None:
+            self.metadata_versions = {}
+        if self.spam_thresholds is None:
+            self.spam_thresholds = {}
+        if self.content_filters is None:
+            self.content_filters = []
+        if self.scheduled is None:
+            self.scheduled = {}
+        if self.placement is None:
+            self.placement = {}
+        if self.member_set is None:
+            self.member_set = MemberSet()
 
     def to_dict(self) -> Dict:
         """Convert room to dictionary for serialization."""
@@ -243,22 +481,81 @@ class Room:
             "room_id": self.room_id,
             "room_name": self.room_name,
             "description": self.description,
+            "topic": self.topic,
             "member_count": len(self.members),
             "admin_node": self.admin_node,
             "creator_id": self.creator_id,
+            "private": self.private,
+            "total_order": self.total_order,
+            "max_members": self.max_members,
+            "waitlist_enabled": self.waitlist_enabled,
+            "announcement": self.announcement,
+            "delivery": self.delivery,
+            "ephemeral": self.ephemeral,
+            "placement": dict(self.placement),
+            "durable": self.durable,
         }
 
+    def is_full(self) -> bool:
+        """Check whether the room has no free slot for another member."""
+        return 0 < self.max_members <= len(self.members)
+
+    def can_join(self, username: str) -> bool:
+        """Check whether a user may join without an invite."""
+        return (
+            not self.private
+            or username in self.members
+            or username == self.creator_id
+        )
+
+    def role_of(self, username: str) -> str:
+        """Get a user's role in the room."""
+        if username == self.creator_id:
+            return OWNER
+        return self.roles.get(username, MEMBER)
+
+    def has_permission(self, username: str, permission: str) -> bool:
+        """Check whether a user's role grants a permission in the room."""
+        return has_permission(self.role_of(username), permission)
+
+    def moderators(self) -> List[str]:
+        """Get the room's owner and moderators, the owner first."""
+        return [self.creator_id] + sorted(
+            user for user, role in self.roles.items() if role == MODERATOR
+        )
+
     def get_members_by_node(self, node_id: str) -> List[str]:
         """Get list of usernames for members connected to a specific node."""
         return [
             username
             for username, info in self.member_info.items()
-            if info.node_id == node_id
+            if node_id in info.nodes
         ]
 
     def get_all_nodes(self) -> List[str]:
         """Get list of all unique node IDs with members in this room."""
-        return list(set(info.node_id for info in self.member_info.values()))
+        return list(
+            set().union(*(info.nodes for info in self.member_info.values()))
+        )
+
+
+def _copy_reactions(message: Dict) -> Dict[str, List[str]]:
+    """Copy a message's reactions (emoji -> usernames)."""
+    return {
+        emoji: list(users)
+        for emoji, users in message.get("reactions", {}).items()
+    }
+
+
+def _synchronized(method):
+    """Run a RoomStateManager method while holding the manager's lock."""
+
+    @functools.wraps(method)
+    def wrapper(self, *args, **kwargs):
+        with self._lock:
+            return method(self, *args, **kwargs)
+
+    return wrapper
 
 
 class RoomStateManager:
@@ -268,26 +565,81 @@ class RoomStateManager:
     This class provides thread-safe operations for creating, listing,
     and managing rooms on the node. Also supports Two-Phase Commit (2PC)
     for coordinated room deletion across distributed nodes.
+
+    All public methods hold a re-entrant lock, so the manager can be
+    shared between the WebSocket event loop and XML-RPC worker threads.
     """
 
-    def __init__(self, node_id: str):
+    def __init__(
+        self,
+        node_id: str,
+        message_log=None,
+        webhooks=None,
+        bridges: bool = False,
+        audit_log=None,
+        content_filters: Optional[FilterRegistry] = None,
+        archive: Optional[ArchiveStore] = None,
+    ):
         """
         Initialize the room state manager.
 
         Args:
             node_id: Unique identifier for this node
+            message_log: Optional Storage (e.g. a MessageLog) for
+                persisting rooms and messages
+            webhooks: Optional WebhookDispatcher delivering hosted rooms'
+                events to their webhooks (see webhooks.py)
+            bridges: True if hosted rooms may be bridged to IRC channels
+                and Matrix rooms (see bridges.py)
+            audit_log: Optional AuditLog recording privileged actions on
+                hosted rooms (see audit.py)
+            content_filters: FilterRegistry with the filter types rooms
+                can enable and the node's rules (defaults to the built-in
+                filters only, see content_filters.py)
+            archive: ArchiveStore keeping archived rooms (defaults to one
+                in memory, see archive.py)
         """
         self.node_id = node_id
+        self.message_log = message_log
+        self.webhooks = webhooks
+        self.bridges_enabled = bridges
+        self.audit_log = audit_log
+        self._lock = threading.RLock()
         self._rooms: Dict[str, Room] = {}
         # 2PC transaction tracking
         self._deletion_transactions: Dict[str, DeletionTransaction] = {}
         self._prepared_transactions: Dict[str, PreparedTransaction] = {}
         # Node health tracking
         self._node_health: Dict[str, NodeHealth] = {}
+        # Hybrid logical clock stamping messages and membership events
+        self.clock = HybridLogicalClock(node_id)
+        # Recent message IDs of each room, for recognising retries
+        self.recent_messages = DedupWindow()
+        # Inverted indexes of hosted rooms' messages, built on first search
+        self.search_index = SearchIndex()
+        # Members' recent messages and temporary mutes in hosted rooms
+        self.spam = SpamDetector()
+        self.content_filters = content_filters or FilterRegistry()
+        # Maps room_id -> (the filters it was built from, FilterChain)
+        self._filter_chains: Dict[str, Tuple[List[Dict], FilterChain]] = {}
+        self.archive = archive if archive is not None else ArchiveStore()
         logger.info(f"RoomStateManager initialized for node: {node_id}")
 
+    @_synchronized
     def create_room(
-        self, room_name: str, creator_id: str, description: Optional[str] = None
+        self,
+        room_name: str,
+        creator_id: str,
+        description: Optional[str] = None,
+        private: bool = False,
+        total_order: bool = False,
+        max_members: int = 0,
+        waitlist_enabled: bool = False,
+        announcement: bool = False,
+        delivery: Optional[str] = EXACTLY_ONCE,
+        ephemeral: bool = False,
+        placement: Optional[Dict[str, str]] = None,
+        durable: bool = False,
     ) -> Room:
         """
         Create a new room on this node.
@@ -296,20 +648,47 @@ class RoomStateManager:
             room_name: Name of the room to create
             creator_id: ID of the user creating the room
             description: Optional room description
+            private: True to hide the room and require invites to join
+            total_order: True to have every member see messages in the
+                same order
+            max_members: Most members the room may have (0 for no limit)
+            waitlist_enabled: True to queue joins while the room is full
+                instead of refusing them
+            announcement: True to let only the owner and moderators post
+            delivery: The room's delivery guarantee (see delivery.py)
+            ephemeral: True to tear the room down once empty or idle
+            placement: Tags the room's admin node must have (see
+                placement.py)
+            durable: True to acknowledge messages only once a write
+                quorum of the room's copies holds them
 
         Returns:
             The created Room object
 
         Raises:
-            ValueError: If a room with the same name already exists
+            ValueError: If the name is invalid, a room with the same name
+                already exists (names are compared case-insensitively),
+                max_members is negative, delivery is unknown or placement
+                has invalid tags
         """
+        is_valid, error_msg = validate_room_name(room_name)
+        if not is_valid:
+            raise ValueError(error_msg)
+        room_name = room_name.strip()
+        if max_members < 0:
+            raise ValueError("max_members must not be negative")
+        delivery = validate_delivery(delivery)
+        placement = validate_placement(placement)
+
         # Check if room name already exists
         for room in self._rooms.values():
-            if room.room_name == room_name:
+            if room.room_name.casefold() == room_name.casefold():
                 raise ValueError(f"Room with name '{room_name}' already exists")
 
         # Generate unique room ID
         room_id = str(uuid.uuid4())
+        while room_id in self._rooms:
+            room_id = str(uuid.uuid4())
 
         # Create the room with current timestamp
         created_at = datetime.now(timezone.utc).isoformat()
@@ -321,15 +700,213 @@ class RoomStateManager:
             admin_node=self.node_id,
             members=set(),  # Room starts with no members
             created_at=created_at,
+            private=private,
+            total_order=total_order,
+            max_members=max_members,
+            waitlist_enabled=waitlist_enabled,
+            announcement=announcement,
+            delivery=delivery,
+            ephemeral=ephemeral,
+            placement=placement,
+            durable=durable,
         )
 
+        if self.message_log:
+            self.message_log.log_room(
+                {
+                    "room_id": room_id,
+                    "room_name": room_name,
+                    "description": description,
+                    "creator_id": creator_id,
+                    "created_at": created_at,
+                    "private": private,
+                    "total_order": total_order,
+                    "max_members": max_members,
+                    "waitlist_enabled": waitlist_enabled,
+                    "announcement": announcement,
+                    "delivery": delivery,
+                    "ephemeral": ephemeral,
+                    "placement": placement,
+                    "durable": durable,
+                }
+            )
+
         self._rooms[room_id] = room
         logger.info(
             f"Created room '{room_name}' (ID: {room_id}) by user {creator_id}"
         )
+        audit(
+            self.audit_log,
+            creator_id,
+            ROOM_CREATED,
+            room_id,
+            room_name=room_name,
+            private=private,
+        )
 
         return room
 
+    @_synchronized
+    def recover_rooms(self, max_messages: int = 100) -> int:
+        """
+        Rebuild rooms from the message log after a restart.
+
+        Recovered rooms keep their IDs, metadata, sequence counters, vector
+        clocks and most recent messages. They start with no members, since
+        clients have to reconnect.
+
+        Args:
+            max_messages: Number of most recent messages to keep per room
+
+        Returns:
+            Number of rooms recovered
+        """
+        if not self.message_log:
+            return 0
+
+        recovered = 0
+        for state in self.message_log.recover(max_messages):
+            room_id = state["room_id"]
+            if room_id in self._rooms:
+                continue
+            self._rooms[room_id] = Room(
+                room_id=room_id,
+                room_name=state["room_name"],
+                description=state.get("description"),
+                creator_id=state.get("creator_id", ""),
+                admin_node=self.node_id,
+                members=set(),
+                created_at=state.get("created_at")
+                or datetime.now(timezone.utc).isoformat(),
+                message_counter=state["message_counter"],
+                messages=state["messages"],
+                vector_clock=state["vector_clock"],
+                private=bool(state.get("private", False)),
+                total_order=bool(state.get("total_order", False)),
+                banned=set(state.get("banned", [])),
+                roles=dict(state.get("roles", {})),
+                max_members=int(state.get("max_members", 0)),
+                waitlist_enabled=bool(state.get("waitlist_enabled", False)),
+                read_positions=dict(state.get("read_positions", {})),
+                public_keys=dict(state.get("public_keys", {})),
+                webhooks=dict(state.get("webhooks", {})),
+                bridges=dict(state.get("bridges", {})),
+                retention=list(state.get("retention", [])),
+                expired_through=int(state.get("expired_through", 0)),
+                announcement=bool(state.get("announcement", False)),
+                pinned=list(state.get("pinned", [])),
+                topic=state.get("topic"),
+                metadata_versions=dict(state.get("metadata_versions", {})),
+                spam_thresholds=dict(state.get("spam_thresholds", {})),
+                content_filters=[
+                    dict(f) for f in state.get("content_filters", [])
+                ],
+                delivery=state.get("delivery", EXACTLY_ONCE),
+                ephemeral=bool(state.get("ephemeral", False)),
+                scheduled=dict(state.get("scheduled", {})),
+                placement=dict(state.get("placement", {})),
+                durable=bool(state.get("durable", False)),
+            )
+            recovered += 1
+            logger.info(
+                f"Recovered room '{state['room_name']}' (ID: {room_id}) "
+                f"with {len(state['messages'])} messages"
+            )
+        return recovered
+
+    @_synchronized
+    def compact_room(
+        self,
+        room_id: str,
+        policy: RetentionPolicy,
+        now: Optional[float] = None,
+    ) -> Optional[int]:
+        """
+        Replace a room's stored records with a snapshot (see compaction.py).
+
+        Nothing is written unless the policy drops messages. Messages
+        dropped from storage are dropped from the in-memory history too.
+
+        Args:
+            room_id: The room ID
+            policy: The room's retention policy
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            Number of messages dropped, or None without a message log or
+            if the room is not hosted here
+
+        Raises:
+            OSError: If the snapshot cannot be written; the stored records
+                are then kept
+        """
+        room = self._rooms.get(room_id)
+        if not self.message_log or room is None:
+            return None
+
+        messages = self.message_log.messages(room_id)
+        retained = policy.retain(messages, now)
+        dropped = len(messages) - len(retained)
+        if not dropped:
+            return 0
+
+        kept = {message["message_id"] for message in retained}
+        room.expired_through = max(
+            room.expired_through,
+            *(
+                message["sequence_number"]
+                for message in messages
+                if message["message_id"] not in kept
+            ),
+        )
+        state = dict(self._snapshot_state(room), members=sorted(room.members))
+        self.message_log.compact(
+            room_id, {"type": "snapshot", "room": state, "messages": retained}
+        )
+        room.messages = [m for m in room.messages if m["message_id"] in kept]
+        self.search_index.drop(room_id)
+        logger.info(
+            f"Compacted room {room_id}: kept {len(retained)} messages, "
+            f"dropped {dropped}"
+        )
+        return dropped
+
+    def _snapshot_state(self, room: Room) -> Dict:
+        """Get the metadata a snapshot record stores for a room."""
+        return {
+            "room_id": room.room_id,
+            "room_name": room.room_name,
+            "description": room.description,
+            "creator_id": room.creator_id,
+            "created_at": room.created_at,
+            "message_counter": room.message_counter,
+            "vector_clock": dict(room.vector_clock),
+            "private": room.private,
+            "total_order": room.total_order,
+            "banned": sorted(room.banned),
+            "roles": dict(room.roles),
+            "max_members": room.max_members,
+            "waitlist_enabled": room.waitlist_enabled,
+            "read_positions": dict(room.read_positions),
+            "public_keys": dict(room.public_keys),
+            "webhooks": dict(room.webhooks),
+            "bridges": dict(room.bridges),
+            "retention": list(room.retention),
+            "expired_through": room.expired_through,
+            "announcement": room.announcement,
+            "pinned": list(room.pinned),
+            "topic": room.topic,
+            "metadata_versions": dict(room.metadata_versions),
+            "spam_thresholds": dict(room.spam_thresholds),
+            "content_filters": [dict(f) for f in room.content_filters],
+            "delivery": room.delivery,
+            "ephemeral": room.ephemeral,
+            "scheduled": dict(room.scheduled),
+            "placement": dict(room.placement),
+            "durable": room.durable,
+        }
+
+    @_synchronized
     def get_room(self, room_id: str) -> Optional[Room]:
         """
         Get a room by its ID.
@@ -338,42 +915,2026 @@ class RoomStateManager:
             room_id: The room ID to look up
 
         Returns:
-            The Room object if found, None otherwise
+            The Room object if found, None otherwise
+        """
+        return self._rooms.get(room_id)
+
+    @_synchronized
+    def list_rooms(self) -> List[Dict]:
+        """
+        Get a list of all rooms hosted on this node.
+
+        Returns:
+            List of room dictionaries with metadata
+        """
+        return [room.to_dict() for room in self._rooms.values()]
+
+    @_synchronized
+    def message_counts(self) -> Dict[str, int]:
+        """
+        Get the number of messages sequenced in each hosted room.
+
+        Returns:
+            Dict mapping room ID to the room's message counter
+        """
+        return {
+            room_id: room.message_counter
+            for room_id, room in self._rooms.items()
+        }
+
+    @_synchronized
+    def list_public_rooms(self) -> List[Dict]:
+        """
+        Get the rooms hosted on this node that are not private.
+
+        Returns:
+            List of room dictionaries with metadata
+        """
+        return [
+            room.to_dict() for room in self._rooms.values() if not room.private
+        ]
+
+    @_synchronized
+    def delete_room(self, room_id: str, handed_off: bool = False) -> bool:
+        """
+        Delete a room from this node.
+
+        Args:
+            room_id: The room ID to delete
+            handed_off: True if the room moved to another node or the
+                archive, which keeps it and its webhooks, so room_deleted
+                isn't sent
+
+        Returns:
+            True if room was deleted, False if room didn't exist
+        """
+        if room_id in self._rooms:
+            room = self._rooms[room_id]
+            if not handed_off:
+                self._emit_webhook(
+                    room, ROOM_DELETED, {"room_name": room.room_name}
+                )
+            del self._rooms[room_id]
+            self.recent_messages.drop_room(room_id)
+            self.search_index.drop(room_id)
+            self.spam.forget_room(room_id)
+            self._filter_chains.pop(room_id, None)
+            if self.message_log:
+                self.message_log.drop_room(room_id)
+            logger.info(f"Deleted room '{room.room_name}' (ID: {room_id})")
+            return True
+        return False
+
+    @_synchronized
+    def restore_room(
+        self,
+        room_id: str,
+        room_name: str,
+        creator_id: str,
+        members: Dict[str, str],
+        messages: List[Dict],
+        message_counter: int,
+        vector_clock: Dict[str, int],
+        description: Optional[str] = None,
+        private: bool = False,
+        invites: Optional[List[Dict]] = None,
+        total_order: bool = False,
+        banned: Optional[List[str]] = None,
+        roles: Optional[Dict[str, str]] = None,
+        max_members: int = 0,
+        waitlist_enabled: bool = False,
+        waitlist: Optional[Dict[str, str]] = None,
+        read_positions: Optional[Dict[str, int]] = None,
+        public_keys: Optional[Dict[str, Dict]] = None,
+        webhooks: Optional[Dict[str, Dict]] = None,
+        bots: Optional[Dict[str, List[str]]] = None,
+        bridges: Optional[Dict[str, Dict]] = None,
+        retention: Optional[List[str]] = None,
+        expired_through: int = 0,
+        announcement: bool = False,
+        pinned: Optional[List[str]] = None,
+        topic: Optional[str] = None,
+        metadata_versions: Optional[Dict[str, str]] = None,
+        member_nodes: Optional[Dict[str, List[str]]] = None,
+        spam_thresholds: Optional[Dict[str, int]] = None,
+        content_filters: Optional[List[Dict[str, Any]]] = None,
+        delivery: str = EXACTLY_ONCE,
+        ephemeral: bool = False,
+        scheduled: Optional[Dict[str, Dict]] = None,
+        placement: Optional[Dict[str, str]] = None,
+        durable: bool = False,
+        member_set: Optional[Dict] = None,
+    ) -> Optional[Room]:
+        """
+        Take over a room previously administered by another node.
+
+        Used during failover: the room keeps its ID, members and message
+        history, and this node becomes its administrator.
+
+        Args:
+            room_id: The existing room ID
+            room_name: Name of the room
+            creator_id: ID of the user who created the room
+            members: Maps each member's username to its node ID
+            messages: Recent messages in sequence order
+            message_counter: Highest sequence number assigned so far
+            vector_clock: Vector clock of the latest message
+            description: Optional room description
+            private: True if the room is private
+            invites: Outstanding invites of a private room, as dicts
+            total_order: True if the room delivers messages in total order
+            banned: Usernames banned from the room
+            roles: Maps username -> role of promoted members
+            max_members: Most members the room may have (0 for no limit)
+            waitlist_enabled: True if the room has a waiting list
+            waitlist: Maps waiting usernames -> node IDs, in order
+            read_positions: Maps username -> last read sequence number
+            public_keys: Maps username -> published public key record
+            webhooks: Maps webhook ID -> webhook record
+            bots: Maps bot name -> commands routed to it
+            bridges: Maps bridge ID -> bridge record
+            retention: The room owner's retention limits
+            expired_through: Highest sequence number removed by retention
+            announcement: True if only the owner and moderators may post
+            pinned: IDs of the room's pinned messages, in the order pinned
+            topic: Optional room topic
+            metadata_versions: Maps metadata field -> HLC timestamp of
+                its last update
+            member_nodes: Maps username -> every node the member is
+                connected through, for members on several nodes
+            spam_thresholds: Spam thresholds changed from their defaults
+            content_filters: The room's content filters
+            delivery: The room's delivery guarantee
+            ephemeral: True if the room is torn down once empty or idle
+            scheduled: Maps message ID -> message scheduled to be sent
+            placement: Tags the room's admin node must have
+            durable: True if messages wait for a write quorum
+            member_set: The room's membership set, as a dict; members
+                missing from it are added
+
+        Returns:
+            The restored Room, or None if a room with that ID already exists
+        """
+        if room_id in self._rooms:
+            return None
+
+        room = Room(
+            room_id=room_id,
+            room_name=room_name,
+            description=description,
+            creator_id=creator_id,
+            admin_node=self.node_id,
+            members=set(members),
+            created_at=datetime.now(timezone.utc).isoformat(),
+            message_counter=message_counter,
+            messages=list(messages),
+            vector_clock=dict(vector_clock),
+            private=private,
+            total_order=total_order,
+            banned=set(banned or []),
+            roles=dict(roles or {}),
+            max_members=max_members,
+            waitlist_enabled=waitlist_enabled,
+            waitlist=dict(waitlist or {}),
+            read_positions=dict(read_positions or {}),
+            public_keys=dict(public_keys or {}),
+            webhooks=dict(webhooks or {}),
+            bots={name: list(c) for name, c in (bots or {}).items()},
+            bridges=dict(bridges or {}),
+            retention=list(retention or []),
+            expired_through=expired_through,
+            announcement=announcement,
+            pinned=list(pinned or []),
+            topic=topic,
+            metadata_versions=dict(metadata_versions or {}),
+            spam_thresholds=dict(spam_thresholds or {}),
+            content_filters=[dict(f) for f in content_filters or []],
+            delivery=delivery,
+            ephemeral=ephemeral,
+            scheduled=dict(scheduled or {}),
+            placement=dict(placement or {}),
+            durable=durable,
+            member_set=MemberSet.from_dict(member_set),
+        )
+        for username in members:
+            if username not in room.member_set:
+                room.member_set.add(username)
+        for data in invites or []:
+            invite = RoomInvite.from_dict(data)
+            if not invite.is_expired():
+                room.invites[invite.token] = invite
+        for username, node_id in members.items():
+            nodes = {node_id}.union((member_nodes or {}).get(username, []))
+            room.member_info[username] = MemberInfo(
+                username=username, node_id=node_id, nodes=nodes
+            )
+            for node in nodes - {self.node_id}:
+                if node not in self._node_health:
+                    self._node_health[node] = NodeHealth(node_id=node)
+
+        if self.message_log:
+            self.message_log.log_snapshot(
+                self._snapshot_state(room), list(messages)
+            )
+
+        self._rooms[room_id] = room
+        self.search_index.drop(room_id)
+        logger.info(
+            f"Restored room '{room_name}' (ID: {room_id}) with "
+            f"{len(members)} members"
+        )
+        return room
+
+    @_synchronized
+    def take_snapshot(self, room_id: str) -> Optional[RoomSnapshot]:
+        """
+        Take a snapshot of a room hosted here (see snapshot.py).
+
+        The manager's lock is held throughout, so the snapshot has no
+        message added halfway through taking it.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The snapshot, or None if the room isn't hosted here
+        """
+        return RoomSnapshot.from_room(self, room_id)
+
+    @_synchronized
+    def archive_room(self, room_id: str, actor: str) -> Dict:
+        """
+        Archive a hosted room instead of deleting it (see archive.py).
+
+        The room's state and full history are written to the archive,
+        then the room and its stored records are removed from this node.
+
+        Args:
+            room_id: The room ID
+            actor: Who archived the room, for the audit log
+
+        Returns:
+            dict: The archived room's summary (see archive_summary)
+
+        Raises:
+            ArchiveError: ROOM_NOT_FOUND if the room isn't hosted here, or
+                INVALID_STATE while it is being deleted
+            OSError: If the archive cannot be written; the room is then
+                kept
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ArchiveError("Room not found", "ROOM_NOT_FOUND")
+        if room.state != RoomState.ACTIVE:
+            raise ArchiveError(
+                f"Room is in {room.state.value} state", "INVALID_STATE"
+            )
+
+        snapshot = RoomSnapshot.from_room(self, room_id)
+        snapshot.messages = self._history_messages(room)
+        self.archive.save(snapshot)
+        self.delete_room(room_id, handed_off=True)
+        audit(
+            self.audit_log,
+            actor,
+            ROOM_ARCHIVED,
+            room_id,
+            room_name=room.room_name,
+            messages=len(snapshot.messages),
+        )
+        logger.info(
+            f"Archived room '{room.room_name}' (ID: {room_id}) with "
+            f"{len(snapshot.messages)} messages"
+        )
+        return archive_summary(snapshot)
+
+    @_synchronized
+    def restore_archived(self, room_id: str, actor: str) -> Room:
+        """
+        Host an archived room again, with its history and members.
+
+        Args:
+            room_id: The archived room's ID
+            actor: Who restored the room, for the audit log
+
+        Returns:
+            The restored Room
+
+        Raises:
+            ArchiveError: ARCHIVE_NOT_FOUND if the room isn't archived,
+                ROOM_EXISTS if a room with its ID is hosted here, or
+                ROOM_NAME_TAKEN if a hosted room has its name
+        """
+        snapshot = self.archive.load(room_id)
+        if snapshot is None:
+            raise ArchiveError(
+                f"Room {room_id} is not archived", "ARCHIVE_NOT_FOUND"
+            )
+        if room_id in self._rooms:
+            raise ArchiveError("Room is already hosted", "ROOM_EXISTS")
+        name = snapshot.room_name.casefold()
+        if any(r.room_name.casefold() == name for r in self._rooms.values()):
+            raise ArchiveError(
+                f"Room with name '{snapshot.room_name}' already exists",
+                "ROOM_NAME_TAKEN",
+            )
+
+        room = self.restore_room(**snapshot.restore_args())
+        self.archive.remove(room_id)
+        audit(
+            self.audit_log,
+            actor,
+            ROOM_RESTORED,
+            room_id,
+            room_name=room.room_name,
+            archived_on=snapshot.source_node,
+        )
+        return room
+
+    @_synchronized
+    def seed_room(
+        self, seed: Dict, actor: str, max_messages: int = 100
+    ) -> Room:
+        """
+        Create a room with members and history from a fixture (see seed.py).
+
+        The whole history is written to storage; the message buffer keeps
+        the last max_messages, as after recovery.
+
+        Args:
+            seed: A room checked by parse_fixture
+            actor: Who seeded the room, for the audit log
+            max_messages: Number of messages to keep in the buffer
+
+        Returns:
+            The seeded Room
+
+        Raises:
+            SeedError: INVALID_FIXTURE if the room name is invalid, or
+                ROOM_NAME_TAKEN if a hosted room has its name
+        """
+        is_valid, error_msg = validate_room_name(seed["room_name"])
+        if not is_valid:
+            raise SeedError(error_msg, "INVALID_FIXTURE")
+        name = seed["room_name"].casefold()
+        if any(r.room_name.casefold() == name for r in self._rooms.values()):
+            raise SeedError(
+                f"Room with name '{seed['room_name']}' already exists",
+                "ROOM_NAME_TAKEN",
+            )
+        room_id = str(uuid.uuid4())
+        messages, vector_clock = build_messages(
+            room_id, self.node_id, seed["messages"], self.clock
+        )
+        room = self.restore_room(
+            room_id=room_id,
+            room_name=seed["room_name"],
+            creator_id=seed["creator"],
+            members={username: self.node_id for username in seed["members"]},
+            messages=messages,
+            message_counter=len(messages),
+            vector_clock=vector_clock,
+            description=seed["description"],
+            private=seed["private"],
+            banned=seed["banned"],
+            roles=seed["roles"],
+        )
+        room.messages = room.messages[-max_messages:] if max_messages else []
+        audit(
+            self.audit_log,
+            actor,
+            ROOM_CREATED,
+            room_id,
+            room_name=room.room_name,
+            private=room.private,
+            seeded=len(messages),
+        )
+        logger.info(
+            f"Seeded room '{room.room_name}' (ID: {room_id}) with "
+            f"{len(room.members)} members and {len(messages)} messages"
+        )
+        return room
+
+    def _archived_room(self, room_id: str) -> Optional[Room]:
+        """Build a read-only view of an archived room, if it is one."""
+        snapshot = self.archive.load(room_id)
+        if snapshot is None:
+            return None
+        return Room(
+            room_id=room_id,
+            room_name=snapshot.room_name,
+            description=snapshot.description,
+            creator_id=snapshot.creator_id,
+            admin_node=snapshot.source_node,
+            members=set(snapshot.members),
+            created_at="",
+            messages=snapshot.messages,
+            private=snapshot.private,
+            retention=snapshot.retention,
+            expired_through=snapshot.expired_through,
+            pinned=snapshot.pinned,
+        )
+
+    @_synchronized
+    def export_history(
+        self, room_id: str, since=None, until=None
+    ) -> Iterator[Dict]:
+        """
+        Export a hosted or archived room's full history (see export.py).
+
+        The room is looked up now; its stored records are only read as
+        the returned iterator is consumed, outside the lock.
+
+        Args:
+            room_id: The room ID
+            since: Only messages sent at or after this datetime
+            until: Only messages sent at or before this datetime
+
+        Returns:
+            Iterator over the messages in sequence order, each with the
+            'edits' made to it
+
+        Raises:
+            ExportError: If the room is neither hosted here nor archived
+                (ROOM_NOT_FOUND)
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            room = self._archived_room(room_id)
+            if room is None:
+                raise ExportError("Room not found", "ROOM_NOT_FOUND")
+            messages = iter(room.messages)
+        else:
+            messages = self._stored_history(room_id, list(room.messages))
+        return select_messages(messages, since, until, room.expired_through)
+
+    def _stored_history(
+        self, room_id: str, buffer: List[Dict]
+    ) -> Iterator[Dict]:
+        """Stream a room's history from the log, or its buffer."""
+        exported = False
+        if self.message_log:
+            for message in stored_messages(
+                lambda: self.message_log.records(room_id)
+            ):
+                exported = True
+                yield message
+        if not exported:
+            yield from buffer
+
+    @_synchronized
+    def create_invite(
+        self,
+        room_id: str,
+        inviter: str,
+        invitee: Optional[str] = None,
+        ttl: float = INVITE_TTL,
+    ) -> RoomInvite:
+        """
+        Create an invite to a private room.
+
+        Args:
+            room_id: The room ID
+            inviter: Username of the creator or a member of the room
+            invitee: Optional username allowed to redeem the invite
+            ttl: Seconds the invite stays valid
+
+        Returns:
+            The new RoomInvite
+
+        Raises:
+            InviteError: If the room doesn't exist, is not private, or the
+                inviter is neither its creator nor a member
+        """
+        room = self._get_private_room(room_id)
+        if inviter not in room.members and inviter != room.creator_id:
+            raise InviteError(
+                "Only room members can create invites", "NOT_A_MEMBER"
+            )
+
+        for token in [t for t, i in room.invites.items() if i.is_expired()]:
+            del room.invites[token]
+        invite = create_invite(room_id, inviter, invitee, ttl)
+        room.invites[invite.token] = invite
+        logger.info(
+            f"User {inviter} created an invite to room '{room.room_name}' "
+            f"(ID: {room_id})"
+        )
+        return invite
+
+    @_synchronized
+    def revoke_invite(
+        self, room_id: str, token: str, requester: str
+    ) -> RoomInvite:
+        """
+        Revoke an outstanding invite.
+
+        Args:
+            room_id: The room ID
+            token: The invite token
+            requester: Username of the invite's creator, or of the room
+                owner or a moderator
+
+        Returns:
+            The revoked RoomInvite
+
+        Raises:
+            InviteError: If the invite doesn't exist or the requester may
+                not revoke it
+        """
+        room = self._get_private_room(room_id)
+        invite = room.invites.get(token)
+        if invite is None:
+            raise InviteError("Invite not found", "INVITE_NOT_FOUND")
+        if requester != invite.inviter and not room.has_permission(
+            requester, REVOKE_INVITES
+        ):
+            raise InviteError(
+                "Only the inviter, room owner or a moderator can revoke "
+                "an invite",
+                "NOT_ALLOWED",
+            )
+        del room.invites[token]
+        logger.info(f"User {requester} revoked an invite to room {room_id}")
+        return invite
+
+    @_synchronized
+    def redeem_invite(self, room_id: str, token: str, username: str) -> None:
+        """
+        Use up an invite so a user can join a private room.
+
+        Args:
+            room_id: The room ID
+            token: The invite token
+            username: The user joining
+
+        Raises:
+            InviteError: If the invite doesn't exist, has expired or is for
+                another user
+        """
+        room = self._get_private_room(room_id)
+        invite = room.invites.get(token)
+        if invite is None:
+            raise InviteError("Invite not found", "INVITE_NOT_FOUND")
+        if invite.is_expired():
+            del room.invites[token]
+            raise InviteError("Invite has expired", "INVITE_EXPIRED")
+        if invite.invitee and invite.invitee != username:
+            raise InviteError(
+                "Invite is for another user", "INVITE_NOT_FOR_USER"
+            )
+        del room.invites[token]
+        logger.info(f"User {username} redeemed an invite to room {room_id}")
+
+    @_synchronized
+    def list_invites(self, room_id: str) -> List[Dict]:
+        """
+        Get a snapshot of a room's outstanding invites.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            List of invite dicts (empty if the room doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        if not room:
+            return []
+        return [invite.to_dict() for invite in room.invites.values()]
+
+    def _get_private_room(self, room_id: str) -> Room:
+        """Get a private room, raising InviteError if there is none."""
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise InviteError("Room not found", "ROOM_NOT_FOUND")
+        if not room.private:
+            raise InviteError("Room is not private", "ROOM_NOT_PRIVATE")
+        return room
+
+    @_synchronized
+    def moderate_member(
+        self, room_id: str, moderator: str, target: str, ban: bool = False
+    ) -> Optional[str]:
+        """
+        Kick or ban a member of a room.
+
+        A ban is written to the message log before it is applied. Banning
+        a user who is not a member keeps them from joining. A removed
+        moderator loses their role.
+
+        Args:
+            room_id: The room ID
+            moderator: Username of the room owner or a moderator
+            target: The user to remove
+            ban: True to also refuse the user's future joins
+
+        Returns:
+            Node ID the target was connected to, or None if they were not
+            a member
+
+        Raises:
+            ModerationError: If the room doesn't exist, the moderator's role
+                doesn't allow it, or the target can't be removed
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ModerationError("Room not found", "ROOM_NOT_FOUND")
+        permission = BAN_MEMBERS if ban else KICK_MEMBERS
+        if not room.has_permission(moderator, permission):
+            raise ModerationError(
+                "Only the room owner and moderators can kick or ban members",
+                "NOT_ALLOWED",
+            )
+        if target == room.creator_id:
+            raise ModerationError(
+                "The room owner can't be removed", "INVALID_TARGET"
+            )
+        if not outranks(room.role_of(moderator), room.role_of(target)):
+            raise ModerationError(
+                "Moderators can't remove other moderators", "NOT_ALLOWED"
+            )
+        if not ban and target not in room.members:
+            raise ModerationError("User is not in the room", "NOT_IN_ROOM")
+
+        if ban and target not in room.banned:
+            if self.message_log:
+                self.message_log.log_ban(room_id, target)
+            room.banned.add(target)
+            logger.info(
+                f"User {moderator} banned {target} from room "
+                f"'{room.room_name}' (ID: {room_id})"
+            )
+            audit(
+                self.audit_log, moderator, MEMBER_BANNED, room_id, user=target
+            )
+
+        if target in room.roles:
+            if self.message_log:
+                self.message_log.log_role(room_id, target, MEMBER)
+            del room.roles[target]
+
+        info = room.member_info.pop(target, None)
+        if target not in room.members:
+            return None
+        room.members.remove(target)
+        room.member_set.remove(target)
+        logger.info(
+            f"User {moderator} removed {target} from room "
+            f"'{room.room_name}' (ID: {room_id})"
+        )
+        if not ban:
+            audit(
+                self.audit_log, moderator, MEMBER_KICKED, room_id, user=target
+            )
+        return info.node_id if info else self.node_id
+
+    @_synchronized
+    def set_member_role(
+        self, room_id: str, requester: str, target: str, role: str
+    ) -> bool:
+        """
+        Promote a member to moderator or demote them to member.
+
+        The change is written to the message log before it is applied.
+
+        Args:
+            room_id: The room ID
+            requester: Username of the room owner
+            target: The member whose role changes
+            role: "moderator" or "member"
+
+        Returns:
+            True if the role changed, False if the member already had it
+
+        Raises:
+            RoleError: If the room doesn't exist, the role is unknown, the
+                requester may not manage roles, or the target is the owner
+                or not a member
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise RoleError("Room not found", "ROOM_NOT_FOUND")
+        if role not in ASSIGNABLE_ROLES:
+            raise RoleError(
+                f"Role must be one of {', '.join(ASSIGNABLE_ROLES)}",
+                "INVALID_ROLE",
+            )
+        if not room.has_permission(requester, MANAGE_ROLES):
+            raise RoleError(
+                "Only the room owner can change roles", "NOT_ALLOWED"
+            )
+        if target == room.creator_id:
+            raise RoleError(
+                "The room owner's role can't be changed", "INVALID_TARGET"
+            )
+        if target not in room.members:
+            raise RoleError("User is not in the room", "NOT_IN_ROOM")
+        if room.role_of(target) == role:
+            return False
+
+        if self.message_log:
+            self.message_log.log_role(room_id, target, role)
+        if role == MEMBER:
+            del room.roles[target]
+        else:
+            room.roles[target] = role
+        logger.info(
+            f"User {requester} made {target} {role} of room "
+            f"'{room.room_name}' (ID: {room_id})"
+        )
+        audit(
+            self.audit_log,
+            requester,
+            ROLE_CHANGED,
+            room_id,
+            user=target,
+            role=role,
+        )
+        return True
+
+    @_synchronized
+    def get_roles(self, room_id: str) -> Dict[str, str]:
+        """
+        Get the roles of a room's promoted members.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Maps username -> role (empty if the room doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return dict(room.roles) if room else {}
+
+    @_synchronized
+    def set_retention(
+        self, room_id: str, requester: str, limits: List[str]
+    ) -> List[str]:
+        """
+        Set how long a room keeps its messages (see retention.py).
+
+        The change is written to the message log before it is applied.
+        Expired messages are hidden from history right away and deleted
+        by the next expire_messages.
+
+        Args:
+            room_id: The room ID
+            requester: Username of the room owner
+            limits: Limits as NAME=VALUE (e.g., ["age=7d"]); an empty
+                list keeps every message
+
+        Returns:
+            The room's new limits, sorted
+
+        Raises:
+            RetentionError: If the room doesn't exist, the requester may
+                not manage retention, or a limit is invalid
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise RetentionError("Room not found", "ROOM_NOT_FOUND")
+        if not room.has_permission(requester, MANAGE_RETENTION):
+            raise RetentionError(
+                "Only the room owner can set its retention", "NOT_ALLOWED"
+            )
+        retention = normalize_retention(limits)
+
+        if self.message_log:
+            self.message_log.log_retention(room_id, retention)
+        room.retention = retention
+        logger.info(
+            f"User {requester} set retention of room '{room.room_name}' "
+            f"(ID: {room_id}) to {retention or 'unlimited'}"
+        )
+        return list(retention)
+
+    @_synchronized
+    def get_retention(self, room_id: str) -> List[str]:
+        """
+        Get a room's retention limits.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The limits (empty if the room keeps every message or doesn't
+            exist)
+        """
+        room = self._rooms.get(room_id)
+        return list(room.retention) if room else []
+
+    @_synchronized
+    def set_spam_thresholds(
+        self, room_id: str, requester: str, changes: Dict[str, int]
+    ) -> Dict[str, int]:
+        """
+        Change a room's spam detection thresholds (see spam.py).
+
+        The change is written to the message log before it is applied.
+
+        Args:
+            room_id: The room ID
+            requester: Username of the room owner or a moderator
+            changes: Maps threshold -> new value (0 turns a limit off)
+
+        Returns:
+            The room's thresholds, the unchanged ones at their defaults
+
+        Raises:
+            SpamError: If the room doesn't exist, the requester may not
+                manage spam detection, or a threshold is invalid
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise SpamError("Room not found", "ROOM_NOT_FOUND")
+        if not room.has_permission(requester, MANAGE_SPAM):
+            raise SpamError(
+                "Only the room owner and moderators can set spam thresholds",
+                "NOT_ALLOWED",
+            )
+        thresholds = dict(room.spam_thresholds, **validate_thresholds(changes))
+
+        if self.message_log:
+            self.message_log.log_spam_thresholds(room_id, thresholds)
+        room.spam_thresholds = thresholds
+        logger.info(
+            f"User {requester} set spam thresholds of room "
+            f"'{room.room_name}' (ID: {room_id}): {changes}"
+        )
+        return effective_thresholds(thresholds)
+
+    @_synchronized
+    def get_spam_thresholds(self, room_id: str) -> Dict[str, int]:
+        """
+        Get a room's spam detection thresholds.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The thresholds, the unchanged ones at their defaults (the
+            defaults if the room doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return effective_thresholds(room.spam_thresholds if room else {})
+
+    @_synchronized
+    def set_content_filters(
+        self, room_id: str, requester: str, filters: List[Dict[str, Any]]
+    ) -> List[Dict[str, Any]]:
+        """
+        Replace a room's content filters (see content_filters.py).
+
+        The new filters are written to the message log before they are
+        applied.
+
+        Args:
+            room_id: The room ID
+            requester: Username of the room owner or a moderator
+            filters: The filters in the order they run, each
+                {"type", **options} (empty removes them all)
+
+        Returns:
+            The room's filters, with their options filled in
+
+        Raises:
+            ContentFilterError: If the room doesn't exist, the requester
+                may not manage filters, or a filter is invalid
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ContentFilterError("Room not found", "ROOM_NOT_FOUND")
+        if not room.has_permission(requester, MANAGE_FILTERS):
+            raise ContentFilterError(
+                "Only the room owner and moderators can set content filters",
+                "NOT_ALLOWED",
+            )
+        filters = self.content_filters.validate(filters)
+
+        if self.message_log:
+            self.message_log.log_content_filters(room_id, filters)
+        room.content_filters = filters
+        logger.info(
+            f"User {requester} set content filters of room "
+            f"'{room.room_name}' (ID: {room_id}): "
+            f"{[f['type'] for f in filters]}"
+        )
+        return [dict(f) for f in filters]
+
+    @_synchronized
+    def get_content_filters(self, room_id: str) -> List[Dict[str, Any]]:
+        """
+        Get a room's content filters.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The filters in the order they run (empty if the room doesn't
+            exist)
+        """
+        room = self._rooms.get(room_id)
+        return [dict(f) for f in room.content_filters] if room else []
+
+    @_synchronized
+    def pin_message(
+        self, room_id: str, requester: str, message_id: str, pin: bool = True
+    ) -> List[str]:
+        """
+        Pin a message to a room or unpin it (see pins.py).
+
+        The room's new pins are written to the message log before they
+        are applied. Unpinning needs only the message ID, so messages
+        removed from the history can still be unpinned.
+
+        Args:
+            room_id: The room ID
+            requester: Username of the owner or a moderator
+            message_id: ID of the message
+            pin: True to pin the message, False to unpin it
+
+        Returns:
+            IDs of the room's pinned messages, in the order pinned
+
+        Raises:
+            PinError: If the room or message doesn't exist, the message
+                was deleted, the requester may not pin messages, or the
+                room pins the most messages it may
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise PinError("Room not found", "ROOM_NOT_FOUND")
+        if not room.has_permission(requester, PIN_MESSAGES):
+            raise PinError(
+                "Only the room owner and moderators can pin messages",
+                "NOT_ALLOWED",
+            )
+        if pin:
+            message = self._find_stored_message(room, message_id)
+            if message is None:
+                raise PinError("Message not found", "MESSAGE_NOT_FOUND")
+            if message.get("deleted"):
+                raise PinError("Message was deleted", "MESSAGE_DELETED")
+        pinned = update_pins(room.pinned, message_id, pin)
+
+        if pinned != room.pinned:
+            if self.message_log:
+                self.message_log.log_pins(room_id, pinned)
+            room.pinned = pinned
+            logger.info(
+                f"User {requester} {'pinned' if pin else 'unpinned'} "
+                f"message {message_id} in room {room_id}"
+            )
+        return list(pinned)
+
+    @_synchronized
+    def get_pinned(self, room_id: str) -> List[str]:
+        """
+        Get the IDs of a room's pinned messages.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The message IDs in the order pinned (empty if the room
+            doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return list(room.pinned) if room else []
+
+    @_synchronized
+    def schedule_message(
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        send_at: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+    ) -> Dict:
+        """
+        Schedule a message to be sent to a room later (see scheduled.py).
+
+        The scheduled message is written to the message log before it is
+        kept.
+
+        Args:
+            room_id: The room ID
+            username: The member sending it
+            content: The message text
+            send_at: ISO 8601 time to send it at
+            message_id: ID generated by the sender (defaults to a new
+                UUID)
+            reply_to: ID of the message it replies to, if any
+
+        Returns:
+            dict: The scheduled message's record
+
+        Raises:
+            ScheduleError: If the room doesn't exist, the user isn't a
+                member (NOT_MEMBER) or may not post (READ_ONLY_ROOM), the
+                message ID is in use (DUPLICATE_MESSAGE_ID), the message
+                replied to doesn't exist (PARENT_NOT_FOUND), send_at is
+                invalid (INVALID_SEND_AT), or the user has the most
+                messages pending they may (TOO_MANY_SCHEDULED)
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ScheduleError("Room not found", "ROOM_NOT_FOUND")
+        if username not in room.members:
+            raise ScheduleError(
+                "You are not a member of this room", "NOT_MEMBER"
+            )
+        if room.announcement and not room.has_permission(
+            username, POST_ANNOUNCEMENTS
+        ):
+            error = AnnouncementError(
+                "Only the room owner and moderators can post in an "
+                "announcement room"
+            )
+            raise ScheduleError(str(error), error.error_code)
+        when = parse_send_at(send_at)
+        if message_id and (
+            message_id in room.scheduled
+            or self.find_message(room_id, message_id)
+        ):
+            raise ScheduleError(
+                "Message ID is already in use", "DUPLICATE_MESSAGE_ID"
+            )
+        if reply_to and self._find_stored_message(room, reply_to) is None:
+            raise ScheduleError(
+                "Message replied to not found", "PARENT_NOT_FOUND"
+            )
+        pending = [
+            s for s in room.scheduled.values() if s["username"] == username
+        ]
+        if len(pending) >= MAX_SCHEDULED_MESSAGES:
+            raise ScheduleError(
+                f"A member can have at most {MAX_SCHEDULED_MESSAGES} "
+                f"messages scheduled in a room",
+                "TOO_MANY_SCHEDULED",
+            )
+
+        scheduled = create_scheduled(
+            message_id or str(uuid.uuid4()),
+            username,
+            content,
+            when,
+            reply_to,
+        )
+        if self.message_log:
+            self.message_log.log_scheduled(room_id, scheduled)
+        room.scheduled[scheduled["message_id"]] = scheduled
+        logger.info(
+            f"User {username} scheduled message {scheduled['message_id']} "
+            f"in room {room_id} for {scheduled['send_at']}"
+        )
+        return dict(scheduled)
+
+    @_synchronized
+    def cancel_scheduled(
+        self, room_id: str, username: str, message_id: str
+    ) -> Dict:
+        """
+        Cancel a message scheduled in a room.
+
+        Members cancel their own messages; the owner and moderators can
+        cancel anyone's.
+
+        Args:
+            room_id: The room ID
+            username: The member cancelling it
+            message_id: The scheduled message's ID
+
+        Returns:
+            dict: The cancelled message's record
+
+        Raises:
+            ScheduleError: If the room doesn't exist, there is no such
+                pending message (SCHEDULED_NOT_FOUND), or it is someone
+                else's and the user may not manage messages (NOT_ALLOWED)
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ScheduleError("Room not found", "ROOM_NOT_FOUND")
+        scheduled = room.scheduled.get(message_id)
+        if scheduled is None:
+            raise ScheduleError(
+                "Scheduled message not found", "SCHEDULED_NOT_FOUND"
+            )
+        if scheduled["username"] != username and not room.has_permission(
+            username, MANAGE_MESSAGES
+        ):
+            raise ScheduleError(
+                "Only the owner and moderators can cancel others' messages",
+                "NOT_ALLOWED",
+            )
+        self._remove_scheduled(room, message_id)
+        logger.info(
+            f"User {username} cancelled scheduled message {message_id} in "
+            f"room {room_id}"
+        )
+        return dict(scheduled)
+
+    @_synchronized
+    def list_scheduled(self, room_id: str, username: str) -> List[Dict]:
+        """
+        List the messages pending in a room that a member may see.
+
+        Args:
+            room_id: The room ID
+            username: The member asking
+
+        Returns:
+            The member's scheduled messages (everyone's for the owner and
+            moderators), in the order they are due
+
+        Raises:
+            ScheduleError: If the room doesn't exist (ROOM_NOT_FOUND)
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ScheduleError("Room not found", "ROOM_NOT_FOUND")
+        everyone = room.has_permission(username, MANAGE_MESSAGES)
+        return [
+            dict(s)
+            for s in sorted(room.scheduled.values(), key=send_time)
+            if everyone or s["username"] == username
+        ]
+
+    @_synchronized
+    def get_scheduled(self, room_id: str) -> Dict[str, Dict]:
+        """
+        Get every message pending in a room, e.g. for replication.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Maps message ID -> scheduled message (empty if the room
+            doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return dict(room.scheduled) if room else {}
+
+    @_synchronized
+    def due_scheduled(self, now=None) -> List[Tuple[str, str]]:
+        """
+        Find the scheduled messages of active rooms that are due.
+
+        Args:
+            now: Current time as a datetime (defaults to the time now)
+
+        Returns:
+            (room_id, message_id) of each, in the order they are due
+        """
+        due = [
+            (scheduled, room.room_id)
+            for room in self._rooms.values()
+            if room.state == RoomState.ACTIVE
+            for scheduled in room.scheduled.values()
+            if is_due(scheduled, now)
+        ]
+        due.sort(key=lambda item: send_time(item[0]))
+        return [(room_id, s["message_id"]) for s, room_id in due]
+
+    @_synchronized
+    def send_scheduled(
+        self, room_id: str, message_id: str, max_messages: int = 100
+    ) -> Optional[Dict]:
+        """
+        Post a scheduled message that is due, as its author.
+
+        The message is added like any (see add_message) and removed from
+        the room's scheduled messages. One whose author was banned, or
+        that the room refuses, is dropped; one that was already sent
+        (e.g., before a failover) is only removed. If the message can't be
+        written, it stays scheduled for the next round.
+
+        Args:
+            room_id: The room ID
+            message_id: The scheduled message's ID
+            max_messages: Maximum number of messages to keep in buffer
+
+        Returns:
+            dict: The message posted, or None if none was
+        """
+        room = self._rooms.get(room_id)
+        scheduled = room.scheduled.get(message_id) if room else None
+        if scheduled is None:
+            return None
+
+        message = None
+        username = scheduled["username"]
+        if username in room.banned:
+            logger.warning(
+                f"Dropped scheduled message {message_id} in room {room_id}: "
+                f"{username} was banned"
+            )
+        else:
+            try:
+                message = self.add_message(
+                    room_id,
+                    username,
+                    scheduled["content"],
+                    max_messages,
+                    message_id=message_id,
+                    reply_to=scheduled.get("reply_to"),
+                    scheduled_at=scheduled["scheduled_at"],
+                )
+            except DuplicateMessageError:
+                logger.info(
+                    f"Scheduled message {message_id} in room {room_id} was "
+                    f"already sent"
+                )
+            except (
+                ThreadError,
+                AnnouncementError,
+                SpamError,
+                ContentFilterError,
+            ) as e:
+                logger.warning(
+                    f"Dropped scheduled message {message_id} in room "
+                    f"{room_id}: {e}"
+                )
+            else:
+                if message is None:
+                    # Storage failed; keep it for the next round
+                    return None
+        self._remove_scheduled(room, message_id)
+        return message
+
+    def _remove_scheduled(self, room: Room, message_id: str) -> None:
+        """Remove a sent or cancelled scheduled message (lock held)."""
+        if self.message_log:
+            self.message_log.log_scheduled_removal(room.room_id, message_id)
+        del room.scheduled[message_id]
+
+    @_synchronized
+    def check_room_update(
+        self, room_id: str, requester: str, changes: Dict[str, Any]
+    ) -> Dict[str, Optional[str]]:
+        """
+        Check an update_room request without applying it.
+
+        Used to validate a rename before committing it to the Raft room
+        registry.
+
+        Args:
+            room_id: The room ID
+            requester: Username of the owner or a moderator
+            changes: Maps room_name, topic or description -> new value
+
+        Returns:
+            The validated changes (see room_metadata.validate_changes)
+
+        Raises:
+            RoomUpdateError: If the room doesn't exist, the requester may
+                not change it, a change is invalid or another room has
+                the new name
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise RoomUpdateError("Room not found", "ROOM_NOT_FOUND")
+        if not room.has_permission(requester, MANAGE_ROOM):
+            raise RoomUpdateError(
+                "Only the room owner and moderators can update the room",
+                "NOT_ALLOWED",
+            )
+        changes = validate_changes(changes)
+        name = changes.get("room_name")
+        if name and any(
+            other.room_name.casefold() == name.casefold()
+            for other in self._rooms.values()
+            if other is not room
+        ):
+            raise RoomUpdateError(
+                f"Room with name '{name}' already exists", "ROOM_NAME_TAKEN"
+            )
+        return changes
+
+    @_synchronized
+    def update_room(
+        self, room_id: str, requester: str, changes: Dict[str, Any]
+    ) -> Dict[str, Dict]:
+        """
+        Change a room's name, topic or description (see room_metadata.py).
+
+        Every changed field is versioned with a new HLC timestamp, and
+        the changes are written to the message log before they are
+        applied.
+
+        Args:
+            room_id: The room ID
+            requester: Username of the owner or a moderator
+            changes: Maps room_name, topic or description -> new value
+
+        Returns:
+            dict: {'changes': the applied values, 'versions': maps each
+            changed field -> encoded HLC timestamp}
+
+        Raises:
+            RoomUpdateError: As check_room_update
+        """
+        changes = self.check_room_update(room_id, requester, changes)
+        room = self._rooms[room_id]
+        # Newer than every version the room has, even ones that came
+        # from a previous administrator with a faster clock
+        version = self.clock.update(
+            max(room.metadata_versions.values(), default=None)
+        ).encode()
+        versions = {field_name: version for field_name in changes}
+        self._apply_metadata(room, changes, versions)
+        logger.info(
+            f"User {requester} updated {', '.join(changes)} of room "
+            f"{room_id}"
+        )
+        return {"changes": changes, "versions": versions}
+
+    @_synchronized
+    def apply_room_update(
+        self,
+        room_id: str,
+        changes: Dict[str, Optional[str]],
+        versions: Dict[str, str],
+    ) -> Dict[str, Dict]:
+        """
+        Apply a room_updated event to a room hosted here.
+
+        Only fields whose incoming version is newer than the room's are
+        changed, so a late update from a previous administrator can't
+        overwrite a newer one.
+
+        Args:
+            room_id: The room ID
+            changes: Maps field -> new value, as announced
+            versions: Maps field -> encoded HLC timestamp, as announced
+
+        Returns:
+            dict: {'changes', 'versions'} of the fields that were applied
+            (both empty if none were)
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            return {"changes": {}, "versions": {}}
+        fields = [
+            name
+            for name in newer_fields(room.metadata_versions, versions)
+            if name in changes
+        ]
+        for name in fields:
+            self.clock.update(versions[name])
+        applied = {name: changes[name] for name in fields}
+        applied_versions = {name: versions[name] for name in fields}
+        if applied:
+            self._apply_metadata(room, applied, applied_versions)
+        return {"changes": applied, "versions": applied_versions}
+
+    def _apply_metadata(
+        self,
+        room: Room,
+        changes: Dict[str, Optional[str]],
+        versions: Dict[str, str],
+    ) -> None:
+        """Log and apply versioned metadata changes to a room (lock held)."""
+        if self.message_log:
+            self.message_log.log_metadata(room.room_id, changes, versions)
+        for name, value in changes.items():
+            setattr(room, name, value)
+        room.metadata_versions.update(versions)
+
+    @_synchronized
+    def expire_messages(
+        self, room_id: str, now: Optional[float] = None
+    ) -> int:
+        """
+        Delete a room's messages outside its retention policy.
+
+        With a message log, the room's records are compacted (see
+        compact_room); otherwise only the in-memory history is trimmed.
+
+        Args:
+            room_id: The room ID
+            now: Current UNIX time (defaults to the time now)
+
+        Returns:
+            Number of messages deleted
+
+        Raises:
+            OSError: If the compacted records cannot be written
+        """
+        room = self._rooms.get(room_id)
+        if room is None or not room.retention:
+            return 0
+        if self.message_log:
+            return (
+                self.compact_room(room_id, room_policy(room.retention), now)
+                or 0
+            )
+
+        kept, expired_through = expire(room.messages, room.retention, now)
+        if not expired_through:
+            return 0
+        deleted = len(room.messages) - len(kept)
+        room.messages = kept
+        room.expired_through = max(room.expired_through, expired_through)
+        self.search_index.drop(room_id)
+        logger.info(
+            f"Expired {deleted} messages of room {room_id} "
+            f"(retention {room.retention})"
+        )
+        return deleted
+
+    @_synchronized
+    def mark_read(
+        self, room_id: str, username: str, sequence_number: int
+    ) -> bool:
+        """
+        Move a member's read position forward.
+
+        Positions never move backwards, and are capped at the room's last
+        sequence number. Changes are written to the message log first.
+
+        Args:
+            room_id: The room ID
+            username: The member who read the messages
+            sequence_number: Sequence number of the last message read
+
+        Returns:
+            bool: True if the position moved, False if it was already at
+            or past sequence_number
+
+        Raises:
+            ReadReceiptError: If the room doesn't exist, the user is not a
+                member, or the sequence number is not a positive integer
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ReadReceiptError("Room not found", "ROOM_NOT_FOUND")
+        if username not in room.members:
+            raise ReadReceiptError("User is not in the room", "NOT_IN_ROOM")
+        if (
+            not isinstance(sequence_number, int)
+            or isinstance(sequence_number, bool)
+            or sequence_number < 1
+        ):
+            raise ReadReceiptError(
+                "sequence_number must be a positive integer",
+                "INVALID_REQUEST",
+            )
+
+        position = min(sequence_number, room.message_counter)
+        current = room.read_positions.get(username, 0)
+        if position <= current:
+            return False
+        if self.message_log:
+            self.message_log.log_read(room_id, username, position)
+        room.read_positions[username] = position
+        logger.debug(
+            f"User {username} read room {room_id} up to message #{position}"
+        )
+        return True
+
+    @_synchronized
+    def get_read_state(self, room_id: str, username: str) -> Dict:
+        """
+        Get a member's unread count and the room's read positions.
+
+        Args:
+            room_id: The room ID
+            username: The member asking
+
+        Returns:
+            dict: {'last_read': int, 'unread_count': int,
+            'message_counter': int, 'read_positions': dict}
+
+        Raises:
+            ReadReceiptError: If the room doesn't exist or the user is not
+                a member
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ReadReceiptError("Room not found", "ROOM_NOT_FOUND")
+        if username not in room.members:
+            raise ReadReceiptError("User is not in the room", "NOT_IN_ROOM")
+        last_read = room.read_positions.get(username, 0)
+        return {
+            "last_read": last_read,
+            "unread_count": unread_count(room.message_counter, last_read),
+            "message_counter": room.message_counter,
+            "read_positions": dict(room.read_positions),
+        }
+
+    @_synchronized
+    def get_read_positions(self, room_id: str) -> Dict[str, int]:
+        """
+        Get the read positions of a room's members.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Maps username -> last read sequence number (empty if the room
+            doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return dict(room.read_positions) if room else {}
+
+    @_synchronized
+    def publish_key(
+        self,
+        room_id: str,
+        username: str,
+        key_id: str,
+        algorithm: str,
+        public_key: str,
+    ) -> Dict:
+        """
+        Publish a member's public key to a private room.
+
+        The key replaces any key the member published before. It is
+        written to the message log first.
+
+        Args:
+            room_id: The room ID
+            username: The member publishing the key
+            key_id: ID the client chose for the key
+            algorithm: Key algorithm
+            public_key: The public key, base64-encoded
+
+        Returns:
+            dict: The key record (see e2ee.create_public_key)
+
+        Raises:
+            E2EEError: If the room doesn't exist, is not private, the user
+                is not a member, or the key is invalid
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise E2EEError("Room not found", "ROOM_NOT_FOUND")
+        if not room.private:
+            raise E2EEError(
+                "Encryption keys can only be published to private rooms",
+                "ROOM_NOT_PRIVATE",
+            )
+        if username not in room.members:
+            raise E2EEError("User is not in the room", "NOT_IN_ROOM")
+
+        key = create_public_key(username, key_id, algorithm, public_key)
+        if self.message_log:
+            self.message_log.log_key(room_id, key)
+        room.public_keys[username] = key
+        logger.info(
+            f"User {username} published key {key_id} to room {room_id}"
+        )
+        return dict(key)
+
+    @_synchronized
+    def get_public_keys(self, room_id: str, username: str) -> Dict[str, Dict]:
+        """
+        Get the public keys of a private room's current members.
+
+        Args:
+            room_id: The room ID
+            username: The member asking
+
+        Returns:
+            Maps username -> key record, for members who published one
+
+        Raises:
+            E2EEError: If the room doesn't exist, is not private, or the
+                user is not a member
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise E2EEError("Room not found", "ROOM_NOT_FOUND")
+        if not room.private:
+            raise E2EEError("Room is not private", "ROOM_NOT_PRIVATE")
+        if username not in room.members:
+            raise E2EEError("User is not in the room", "NOT_IN_ROOM")
+        return {
+            member: dict(key)
+            for member, key in room.public_keys.items()
+            if member in room.members
+        }
+
+    @_synchronized
+    def get_all_public_keys(self, room_id: str) -> Dict[str, Dict]:
+        """
+        Get every public key published to a room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Maps username -> key record (empty if the room doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return dict(room.public_keys) if room else {}
+
+    @_synchronized
+    def set_room_bot(
+        self, room_id: str, bot_name: str, commands: List[str]
+    ) -> None:
+        """
+        Register the commands a bot in a room handles.
+
+        Messages starting with one of them are marked as commands for the
+        bot; see bots.py.
+
+        Args:
+            room_id: The room ID
+            bot_name: The bot, which must have joined the room
+            commands: Commands routed to it, replacing earlier ones
+
+        Raises:
+            BotError: If the room doesn't exist, the bot is not in it
+                (NOT_IN_ROOM), the commands are invalid, or another bot in
+                the room handles one of them (COMMAND_TAKEN)
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise BotError("Room not found", "ROOM_NOT_FOUND")
+        if bot_name not in room.members:
+            raise BotError("Bot is not in the room", "NOT_IN_ROOM")
+        commands = validate_commands(commands)
+        for other, taken in room.bots.items():
+            clash = sorted(set(commands) & set(taken))
+            if other != bot_name and clash:
+                raise BotError(
+                    f"Bot {other} already handles {', '.join(clash)}",
+                    "COMMAND_TAKEN",
+                )
+        room.bots[bot_name] = commands
+        logger.info(
+            f"Bot {bot_name} handles {', '.join(commands) or 'no commands'} "
+            f"in room {room_id}"
+        )
+
+    @_synchronized
+    def register_webhook(
+        self, room_id: str, username: str, url: str, events: List[str]
+    ) -> Dict:
+        """
+        Register a webhook receiving a room's events.
+
+        The webhook is written to the message log before it is added.
+
+        Args:
+            room_id: The room ID
+            username: The member registering it
+            url: http:// or https:// URL the events are POSTed to
+            events: Events to deliver (see webhooks.WEBHOOK_EVENTS; empty
+                for all)
+
+        Returns:
+            dict: The webhook record, including the secret its requests
+            are signed with
+
+        Raises:
+            WebhookError: If webhooks are disabled, the room doesn't exist,
+                the user may not manage webhooks, the room has
+                MAX_WEBHOOKS already, or the URL or events are invalid
+        """
+        room = self._get_webhook_room(room_id, username)
+        if len(room.webhooks) >= MAX_WEBHOOKS:
+            raise WebhookError(
+                f"A room can have at most {MAX_WEBHOOKS} webhooks",
+                "TOO_MANY_WEBHOOKS",
+            )
+        webhook = create_webhook(room_id, url, events, username)
+        if self.message_log:
+            self.message_log.log_webhook(room_id, webhook)
+        room.webhooks[webhook["webhook_id"]] = webhook
+        logger.info(
+            f"User {username} registered webhook {webhook['webhook_id']} "
+            f"for room {room_id}"
+        )
+        return dict(webhook)
+
+    @_synchronized
+    def remove_webhook(
+        self, room_id: str, username: str, webhook_id: str
+    ) -> None:
+        """
+        Remove a room's webhook; its waiting deliveries are dropped.
+
+        Args:
+            room_id: The room ID
+            username: The member removing it
+            webhook_id: The webhook's ID
+
+        Raises:
+            WebhookError: If webhooks are disabled, the room doesn't exist,
+                the user may not manage webhooks, or there is no such
+                webhook (WEBHOOK_NOT_FOUND)
+        """
+        room = self._get_webhook_room(room_id, username)
+        if webhook_id not in room.webhooks:
+            raise WebhookError("Webhook not found", "WEBHOOK_NOT_FOUND")
+        if self.message_log:
+            self.message_log.log_webhook_removal(room_id, webhook_id)
+        del room.webhooks[webhook_id]
+        self.webhooks.drop_webhook(webhook_id)
+        logger.info(
+            f"User {username} removed webhook {webhook_id} from room "
+            f"{room_id}"
+        )
+
+    @_synchronized
+    def list_webhooks(self, room_id: str, username: str) -> List[Dict]:
+        """
+        List a room's webhooks, without their secrets.
+
+        Args:
+            room_id: The room ID
+            username: The member asking
+
+        Returns:
+            The webhook records, oldest first
+
+        Raises:
+            WebhookError: If webhooks are disabled, the room doesn't exist
+                or the user may not manage webhooks
+        """
+        room = self._get_webhook_room(room_id, username)
+        return [public_webhook(w) for w in webhooks_for(room.webhooks)]
+
+    def _get_webhook_room(self, room_id: str, username: str) -> Room:
+        """Get a room whose webhooks a user manages (lock held)."""
+        if self.webhooks is None:
+            raise WebhookError(
+                "Webhooks are disabled on this node", "WEBHOOKS_DISABLED"
+            )
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise WebhookError("Room not found", "ROOM_NOT_FOUND")
+        if not room.has_permission(username, MANAGE_WEBHOOKS):
+            raise WebhookError(
+                "Only the room owner can manage webhooks", "NOT_ALLOWED"
+            )
+        return room
+
+    def _emit_webhook(self, room: Room, event: str, data: Dict) -> None:
+        """Queue an event for a room's webhooks (lock held)."""
+        if self.webhooks is not None and room.webhooks:
+            self.webhooks.enqueue(
+                webhooks_for(room.webhooks), event, room.room_id, data
+            )
+
+    @_synchronized
+    def add_bridge(
+        self, room_id: str, username: str, protocol: str, settings: Dict
+    ) -> Dict:
+        """
+        Bridge a room to an IRC channel or a Matrix room.
+
+        The bridge is written to the message log before it is added; the
+        relay task connects it on its next round.
+
+        Args:
+            room_id: The room ID
+            username: The member adding it
+            protocol: "irc" or "matrix"
+            settings: The network's settings (see bridges.create_bridge)
+
+        Returns:
+            dict: The bridge record, without passwords and tokens
+
+        Raises:
+            BridgeError: If bridges are disabled, the room doesn't exist,
+                the user may not manage bridges, the room is private
+                (ROOM_PRIVATE), has MAX_BRIDGES already, or the protocol
+                or settings are invalid
+        """
+        room = self._get_bridge_room(room_id, username)
+        if room.private:
+            raise BridgeError(
+                "Private rooms can't be bridged", "ROOM_PRIVATE"
+            )
+        if len(room.bridges) >= MAX_BRIDGES:
+            raise BridgeError(
+                f"A room can have at most {MAX_BRIDGES} bridges",
+                "TOO_MANY_BRIDGES",
+            )
+        bridge = create_bridge(room_id, protocol, settings, username)
+        if self.message_log:
+            self.message_log.log_bridge(room_id, bridge)
+        room.bridges[bridge["bridge_id"]] = bridge
+        logger.info(
+            f"User {username} bridged room {room_id} to {protocol} "
+            f"(bridge {bridge['bridge_id']})"
+        )
+        return public_bridge(bridge)
+
+    @_synchronized
+    def remove_bridge(
+        self, room_id: str, username: str, bridge_id: str
+    ) -> None:
+        """
+        Remove a room's bridge; the relay task disconnects it.
+
+        Args:
+            room_id: The room ID
+            username: The member removing it
+            bridge_id: The bridge's ID
+
+        Raises:
+            BridgeError: If bridges are disabled, the room doesn't exist,
+                the user may not manage bridges, or there is no such
+                bridge (BRIDGE_NOT_FOUND)
+        """
+        room = self._get_bridge_room(room_id, username)
+        if bridge_id not in room.bridges:
+            raise BridgeError("Bridge not found", "BRIDGE_NOT_FOUND")
+        if self.message_log:
+            self.message_log.log_bridge_removal(room_id, bridge_id)
+        del room.bridges[bridge_id]
+        logger.info(
+            f"User {username} removed bridge {bridge_id} from room {room_id}"
+        )
+
+    @_synchronized
+    def list_bridges(self, room_id: str, username: str) -> List[Dict]:
+        """
+        List a room's bridges, without their passwords and tokens.
+
+        Args:
+            room_id: The room ID
+            username: The member asking
+
+        Returns:
+            The bridge records, oldest first
+
+        Raises:
+            BridgeError: If bridges are disabled, the room doesn't exist
+                or the user may not manage bridges
+        """
+        room = self._get_bridge_room(room_id, username)
+        bridges = sorted(room.bridges.values(), key=lambda b: b["created_at"])
+        return [public_bridge(b) for b in bridges]
+
+    @_synchronized
+    def get_all_bridges(self) -> Dict[str, Dict]:
+        """
+        Get the bridges of every active room hosted on this node.
+
+        Returns:
+            Maps bridge ID -> bridge record, including its secrets
+        """
+        if not self.bridges_enabled:
+            return {}
+        return {
+            bridge_id: dict(bridge)
+            for room in self._rooms.values()
+            if room.state == RoomState.ACTIVE
+            for bridge_id, bridge in room.bridges.items()
+        }
+
+    def _get_bridge_room(self, room_id: str, username: str) -> Room:
+        """Get a room whose bridges a user manages (lock held)."""
+        if not self.bridges_enabled:
+            raise BridgeError(
+                "Bridges are disabled on this node", "BRIDGES_DISABLED"
+            )
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise BridgeError("Room not found", "ROOM_NOT_FOUND")
+        if not room.has_permission(username, MANAGE_BRIDGES):
+            raise BridgeError(
+                "Only the room owner can manage bridges", "NOT_ALLOWED"
+            )
+        return room
+
+    @_synchronized
+    def get_banned(self, room_id: str) -> List[str]:
+        """
+        Get the users banned from a room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            Sorted list of usernames (empty if the room doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return sorted(room.banned) if room else []
+
+    @_synchronized
+    def get_members(self, room_id: str) -> List[str]:
+        """
+        Get a snapshot of a room's members.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            List of usernames (empty if the room doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return list(room.members) if room else []
+
+    @_synchronized
+    def get_member_set(self, room_id: str) -> Optional[Dict]:
+        """
+        Get a room's membership set (see member_set.py).
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            dict: The set's dictionary form, or None if the room doesn't
+            exist
+        """
+        room = self._rooms.get(room_id)
+        return room.member_set.to_dict() if room else None
+
+    @_synchronized
+    def merge_members(
+        self, room_id: str, member_set: Dict, node_id: str
+    ) -> Optional[Dict[str, List[str]]]:
+        """
+        Merge another node's membership set of a room into the room.
+
+        Users the merge adds are made members through node_id, unless
+        they are banned, in which case their joins are undone; members
+        the merge removes are removed from the room.
+
+        Args:
+            room_id: The room ID
+            member_set: The other node's set, as a dict
+            node_id: The node that sent the set
+
+        Returns:
+            dict: 'joined' and 'left', the usernames the merge added and
+            removed, or None if the room doesn't exist
         """
-        return self._rooms.get(room_id)
+        room = self._rooms.get(room_id)
+        if room is None:
+            return None
+        before = set(room.member_set.members())
+        room.member_set.merge(MemberSet.from_dict(member_set))
+        after = set(room.member_set.members())
+        joined = []
+        for username in sorted(after - before):
+            if username in room.banned:
+                room.member_set.remove(username)
+            elif username not in room.members:
+                self.add_member(room_id, username, node_id)
+                joined.append(username)
+        left = [u for u in sorted(before - after) if u in room.members]
+        for username in left:
+            self.remove_member(room_id, username)
+        if joined or left:
+            logger.info(
+                f"Merged membership of room {room_id} from {node_id}: "
+                f"{len(joined)} joined, {len(left)} left"
+            )
+        return {"joined": joined, "left": left}
 
-    def list_rooms(self) -> List[Dict]:
+    @_synchronized
+    def purge_member_tombstones(
+        self, ttl: float = TOMBSTONE_TTL, now: Optional[float] = None
+    ) -> int:
         """
-        Get a list of all rooms hosted on this node.
+        Drop old tombstones from the membership sets of hosted rooms.
+
+        Args:
+            ttl: Seconds to keep a tombstone
+            now: Current UNIX time (defaults to the time now)
 
         Returns:
-            List of room dictionaries with metadata
+            int: Number of tombstones dropped
         """
-        return [room.to_dict() for room in self._rooms.values()]
+        return sum(
+            room.member_set.purge_tombstones(ttl, now)
+            for room in self._rooms.values()
+        )
 
-    def delete_room(self, room_id: str) -> bool:
+    @_synchronized
+    def get_messages(self, room_id: str) -> List[Dict]:
         """
-        Delete a room from this node.
+        Get a snapshot of a room's message buffer.
 
         Args:
-            room_id: The room ID to delete
+            room_id: The room ID
 
         Returns:
-            True if room was deleted, False if room didn't exist
+            List of message dicts (empty if the room doesn't exist)
         """
-        if room_id in self._rooms:
-            room = self._rooms[room_id]
-            del self._rooms[room_id]
-            logger.info(f"Deleted room '{room.room_name}' (ID: {room_id})")
-            return True
-        return False
+        room = self._rooms.get(room_id)
+        return list(room.messages) if room else []
 
+    @_synchronized
     def add_member(
         self, room_id: str, user_id: str, node_id: str = None
     ) -> bool:
         """
         Add a member to a room.
 
+        Adding a member again through another node records that node as
+        well, e.g. when the user connects from a second device.
+
         Args:
             room_id: The room ID
             user_id: The user ID to add
@@ -384,12 +2945,21 @@ class RoomStateManager:
         """
         room = self._rooms.get(room_id)
         if room:
+            joined = user_id not in room.members
             room.members.add(user_id)
+            if user_id not in room.member_set:
+                room.member_set.add(user_id)
             # Track member info with node_id
             member_node = node_id if node_id else self.node_id
-            room.member_info[user_id] = MemberInfo(
-                username=user_id, node_id=member_node
-            )
+            info = room.member_info.get(user_id)
+            if info is None:
+                room.member_info[user_id] = MemberInfo(
+                    username=user_id, node_id=member_node
+                )
+            else:
+                info.node_id = member_node
+                info.nodes.add(member_node)
+                info.update_activity()
             # Initialize node health tracking if needed
             if member_node != self.node_id:
                 if member_node not in self._node_health:
@@ -400,9 +2970,16 @@ class RoomStateManager:
                 f"Added user {user_id} to room '{room.room_name}' "
                 f"(ID: {room_id}) from node {member_node}"
             )
+            if joined:
+                self._emit_webhook(
+                    room,
+                    MEMBER_JOINED,
+                    {"username": user_id, "member_count": len(room.members)},
+                )
             return True
         return False
 
+    @_synchronized
     def remove_member(self, room_id: str, user_id: str) -> bool:
         """
         Remove a member from a room.
@@ -417,15 +2994,158 @@ class RoomStateManager:
         room = self._rooms.get(room_id)
         if room and user_id in room.members:
             room.members.remove(user_id)
+            room.member_set.remove(user_id)
             # Also remove from member_info
             if user_id in room.member_info:
                 del room.member_info[user_id]
+            room.bots.pop(user_id, None)
             logger.info(
                 f"Removed user {user_id} from room '{room.room_name}' (ID: {room_id})"
             )
+            self._emit_webhook(
+                room,
+                MEMBER_LEFT,
+                {"username": user_id, "member_count": len(room.members)},
+            )
             return True
         return False
 
+    @_synchronized
+    def remove_member_node(
+        self, room_id: str, user_id: str, node_id: str
+    ) -> bool:
+        """
+        Note that a member's connections through one node are gone.
+
+        The member is removed once no node is left, and otherwise stays
+        in the room for their other devices.
+
+        Args:
+            room_id: The room ID
+            user_id: The member's username
+            node_id: The node whose connections closed
+
+        Returns:
+            True if the member was removed from the room
+        """
+        room = self._rooms.get(room_id)
+        info = room.member_info.get(user_id) if room else None
+        if info is None:
+            return self.remove_member(room_id, user_id)
+        info.nodes.discard(node_id)
+        if not info.nodes:
+            return self.remove_member(room_id, user_id)
+        if info.node_id == node_id:
+            info.node_id = sorted(info.nodes)[0]
+        logger.info(
+            f"User {user_id} is still connected to room {room_id} through "
+            f"{', '.join(sorted(info.nodes))}"
+        )
+        return False
+
+    @_synchronized
+    def join_or_wait(self, room_id: str, user_id: str, node_id: str) -> int:
+        """
+        Add a member to a room, or put them on its waiting list if full.
+
+        Members re-joining always get in, and users already waiting keep
+        their place.
+
+        Args:
+            room_id: The room ID
+            user_id: The user ID to add
+            node_id: The node the user is connected to
+
+        Returns:
+            int: 0 if the user is a member, otherwise their position on
+            the waiting list (from 1)
+
+        Raises:
+            CapacityError: If the room doesn't exist, or is full and has
+                no waiting list
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise CapacityError("Room not found", "ROOM_NOT_FOUND")
+        if user_id in room.members:
+            self.add_member(room_id, user_id, node_id)
+            return 0
+        if user_id in room.waitlist:
+            return list(room.waitlist).index(user_id) + 1
+        if not room.is_full() and not room.waitlist:
+            self.add_member(room_id, user_id, node_id)
+            return 0
+        if not room.waitlist_enabled:
+            raise CapacityError(
+                f"Room is full ({room.max_members} members)"
+            )
+        room.waitlist[user_id] = node_id
+        logger.info(
+            f"User {user_id} is waiting for room '{room.room_name}' "
+            f"(ID: {room_id}) at position {len(room.waitlist)}"
+        )
+        return len(room.waitlist)
+
+    @_synchronized
+    def leave_waitlist(self, room_id: str, user_id: str) -> bool:
+        """
+        Take a user off a room's waiting list.
+
+        Args:
+            room_id: The room ID
+            user_id: The waiting user
+
+        Returns:
+            True if the user was waiting
+        """
+        room = self._rooms.get(room_id)
+        if room is None or user_id not in room.waitlist:
+            return False
+        del room.waitlist[user_id]
+        logger.info(f"User {user_id} left the waiting list of room {room_id}")
+        return True
+
+    @_synchronized
+    def get_waitlist(self, room_id: str) -> List[str]:
+        """
+        Get the users waiting for a room, in the order they'll be admitted.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            List of usernames (empty if the room doesn't exist)
+        """
+        room = self._rooms.get(room_id)
+        return list(room.waitlist) if room else []
+
+    @_synchronized
+    def admit_next(self, room_id: str) -> Optional[tuple]:
+        """
+        Admit the first waiting user to a room with a free slot.
+
+        Waiting users banned meanwhile are dropped from the list.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            (username, node_id) of the new member, or None if the room is
+            full or nobody is waiting
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            return None
+        while room.waitlist and not room.is_full():
+            user_id = next(iter(room.waitlist))
+            node_id = room.waitlist.pop(user_id)
+            if user_id in room.banned:
+                continue
+            self.add_member(room_id, user_id, node_id)
+            return user_id, node_id
+        return None
+
+    @_synchronized
     def get_member_info(
         self, room_id: str, user_id: str
     ) -> Optional[MemberInfo]:
@@ -444,6 +3164,7 @@ class RoomStateManager:
             return room.member_info.get(user_id)
         return None
 
+    @_synchronized
     def update_member_activity(self, room_id: str, user_id: str) -> bool:
         """
         Update the last activity timestamp for a member.
@@ -461,6 +3182,7 @@ class RoomStateManager:
             return True
         return False
 
+    @_synchronized
     def get_members_by_node(self, room_id: str, node_id: str) -> List[str]:
         """
         Get all members in a room connected to a specific node.
@@ -477,6 +3199,7 @@ class RoomStateManager:
             return room.get_members_by_node(node_id)
         return []
 
+    @_synchronized
     def get_stale_members(
         self, room_id: str, timeout_seconds: int = INACTIVITY_TIMEOUT
     ) -> List[str]:
@@ -512,10 +3235,12 @@ class RoomStateManager:
 
     # Node Health Management
 
+    @_synchronized
     def get_node_health(self, node_id: str) -> Optional[NodeHealth]:
         """Get health info for a node."""
         return self._node_health.get(node_id)
 
+    @_synchronized
     def get_all_member_nodes(self) -> Dict[str, str]:
         """
         Get all nodes that have members in rooms administered by this node.
@@ -526,10 +3251,11 @@ class RoomStateManager:
         nodes = set()
         for room in self._rooms.values():
             for info in room.member_info.values():
-                if info.node_id != self.node_id:
-                    nodes.add(info.node_id)
+                nodes.update(info.nodes)
+        nodes.discard(self.node_id)
         return {node: node for node in nodes}
 
+    @_synchronized
     def record_node_heartbeat_success(self, node_id: str):
         """Record a successful heartbeat from a node."""
         if node_id in self._node_health:
@@ -538,6 +3264,7 @@ class RoomStateManager:
         else:
             self._node_health[node_id] = NodeHealth(node_id=node_id)
 
+    @_synchronized
     def record_node_heartbeat_failure(self, node_id: str) -> bool:
         """
         Record a failed heartbeat for a node.
@@ -559,6 +3286,25 @@ class RoomStateManager:
             logger.debug(f"Heartbeat failure #{failures} for node {node_id}")
         return is_failed
 
+    @_synchronized
+    def set_node_status(self, node_id: str, status: NodeStatus):
+        """
+        Set a node's health status as decided by the failure detector.
+
+        Args:
+            node_id: The node ID
+            status: The new health status
+        """
+        health = self._node_health.get(node_id)
+        if health is None:
+            health = self._node_health[node_id] = NodeHealth(node_id=node_id)
+
+        if status == NodeStatus.HEALTHY:
+            health.record_success()
+        else:
+            health.status = status
+
+    @_synchronized
     def get_failed_nodes(self) -> List[str]:
         """Get list of nodes marked as failed."""
         return [
@@ -567,6 +3313,7 @@ class RoomStateManager:
             if health.status == NodeStatus.FAILED
         ]
 
+    @_synchronized
     def get_rooms_with_node_members(self, node_id: str) -> List[str]:
         """
         Get all rooms that have members from a specific node.
@@ -580,15 +3327,18 @@ class RoomStateManager:
         rooms = []
         for room_id, room in self._rooms.items():
             for info in room.member_info.values():
-                if info.node_id == node_id:
+                if node_id in info.nodes:
                     rooms.append(room_id)
                     break
         return rooms
 
+    @_synchronized
     def remove_all_members_from_node(self, node_id: str) -> List[tuple]:
         """
         Remove all members from a specific node from all rooms.
 
+        Members also connected through other nodes stay in their rooms.
+
         Args:
             node_id: The node ID
 
@@ -599,29 +3349,67 @@ class RoomStateManager:
         for room_id, room in self._rooms.items():
             members_to_remove = room.get_members_by_node(node_id)
             for username in members_to_remove:
-                self.remove_member(room_id, username)
-                removed.append((room_id, username))
+                if self.remove_member_node(room_id, username, node_id):
+                    removed.append((room_id, username))
         return removed
 
+    @_synchronized
     def get_room_count(self) -> int:
         """Get the total number of rooms on this node."""
         return len(self._rooms)
 
+    @_synchronized
     def add_message(
-        self, room_id: str, username: str, content: str, max_messages: int = 100
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        max_messages: int = 100,
+        origin_node: Optional[str] = None,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+        encryption: Optional[Dict] = None,
+        attachments: Optional[List[Dict]] = None,
+        scheduled_at: Optional[str] = None,
     ) -> Optional[Dict]:
         """
         Add a message to a room and assign a sequence number.
 
         This method is used by the administrator node to process messages.
-        It assigns a sequence number, generates a message_id and timestamp,
-        and stores the message in the room's message buffer.
+        It assigns a sequence number, a vector clock and a hybrid logical
+        clock timestamp, generates a message_id (unless the sender chose
+        one) and timestamp, and stores the message in the room's message
+        buffer. In a total-order room the message is also marked with this
+        node as its sequencer, and in a room that isn't exactly_once with
+        its delivery guarantee (see delivery.py). A reply also gets reply_to
+        and thread_id, and its thread root's summary is updated. An
+        encrypted message (private rooms only) keeps its ciphertext content
+        and envelope as is, marked "encrypted". Attachment references (see
+        attachments.py) are stored with the message; their blobs must
+        already be in this node's blob store. A message starting with a
+        command handled by a bot in the room is marked with bot_command (see
+        bots.py). In an announcement room only the owner and moderators may
+        post. Members flooding the room are muted for a while (see spam.py).
+        Unencrypted content is run through the room's filters, which may
+        redact it (see content_filters.py), and carries the members it
+        @mentions (see mentions.py). A scheduled message (see
+        scheduled.py) is marked with when it was scheduled; its sender
+        needn't be in the room any more.
 
         Args:
             room_id: The room ID
             username: The username of the sender
             content: The message content
             max_messages: Maximum number of messages to keep in buffer
+            origin_node: Node the sender is connected to (defaults to
+                this node)
+            message_id: ID generated by the sender (defaults to a new
+                UUID)
+            reply_to: ID of the message this one replies to, if any
+            encryption: Encryption envelope of an encrypted message (see
+                e2ee.py); content is then its ciphertext
+            attachments: References to the files attached to the message
+            scheduled_at: When the message was scheduled, if it was
 
         Returns:
             dict: Message data with assigned sequence number, or None if failed
@@ -631,38 +3419,146 @@ class RoomStateManager:
                     'username': str,
                     'content': str,
                     'sequence_number': int,
-                    'timestamp': str
+                    'timestamp': str,
+                    'vector_clock': Dict[str, int],
+                    'origin_node': str,
+                    'hlc': str
                 }
+
+        Raises:
+            DuplicateMessageError: If a message with the same ID was
+                already added to the room (a retry)
+            ThreadError: If the message replied to is not in the room
+            E2EEError: If the message is encrypted but the room is not
+                private (ROOM_NOT_PRIVATE) or the message is malformed
+                (INVALID_CIPHERTEXT)
+            AnnouncementError: If the room is an announcement room and
+                the sender is neither its owner nor a moderator
+            SpamError: If the sender is muted for spam (USER_MUTED), or
+                this message got them muted (SPAM_DETECTED)
+            ContentFilterError: If a content filter rejected the message
+                (MESSAGE_REJECTED)
         """
         room = self._rooms.get(room_id)
         if not room:
             logger.warning(f"Cannot add message: Room {room_id} not found")
             return None
 
-        if username not in room.members:
+        if username not in room.members and scheduled_at is None:
             logger.warning(
                 f"Cannot add message: User {username} not in room {room_id}"
             )
             return None
 
+        if message_id:
+            existing = self.find_message(room_id, message_id)
+            if existing:
+                raise DuplicateMessageError(existing)
+
+        if room.announcement and not room.has_permission(
+            username, POST_ANNOUNCEMENTS
+        ):
+            raise AnnouncementError(
+                "Only the room owner and moderators can post in an "
+                "announcement room"
+            )
+
+        self._check_spam(room, username, content)
+
+        filtered = []
+        if encryption is None:
+            content, filtered = self._filter_content(room, content)
+
+        if encryption is not None:
+            if not room.private:
+                raise E2EEError(
+                    "Encrypted messages can only be sent to private rooms",
+                    "ROOM_NOT_PRIVATE",
+                )
+            is_valid, error_msg = validate_encrypted_message(
+                content, encryption
+            )
+            if not is_valid:
+                raise E2EEError(error_msg, "INVALID_CIPHERTEXT")
+
+        parent = None
+        if reply_to:
+            parent = self._find_stored_message(room, reply_to)
+            if parent is None:
+                raise ThreadError(
+                    "Message replied to not found", "PARENT_NOT_FOUND"
+                )
+
         # Assign sequence number
-        room.message_counter += 1
-        seq_num = room.message_counter
+        seq_num = room.message_counter + 1
+
+        # Advance the room's vector clock for the origin node
+        origin_node = origin_node or self.node_id
+        vector_clock = dict(room.vector_clock)
+        vector_clock[origin_node] = vector_clock.get(origin_node, 0) + 1
 
         # Create message
         message = {
-            "message_id": str(uuid.uuid4()),
+            "message_id": message_id or str(uuid.uuid4()),
             "room_id": room_id,
             "username": username,
             "content": content,
             "sequence_number": seq_num,
             "timestamp": datetime.now(timezone.utc).isoformat(),
+            "vector_clock": vector_clock,
+            "origin_node": origin_node,
+            "hlc": self.clock.now().encode(),
         }
+        if room.total_order:
+            message["total_order"] = True
+            message["sequencer"] = self.node_id
+        if room.delivery != EXACTLY_ONCE:
+            message["delivery"] = room.delivery
+        if parent:
+            message["reply_to"] = reply_to
+            message["thread_id"] = thread_root(parent)
+        if encryption is not None:
+            message["encrypted"] = True
+            message["encryption"] = dict(encryption)
+        if attachments:
+            message["attachments"] = [dict(a) for a in attachments]
+        if filtered:
+            message["filtered"] = filtered
+        mentions = (
+            parse_mentions(content, room.members) if encryption is None else []
+        )
+        if mentions:
+            message["mentions"] = mentions
+        if scheduled_at:
+            message["scheduled_at"] = scheduled_at
+        if encryption is None and username not in room.bots:
+            command = route_command(room.bots, content)
+            if command:
+                message["bot_command"] = command
+
+        # Write ahead before the message becomes visible
+        if self.message_log:
+            try:
+                self.message_log.log_message(room_id, message)
+            except OSError as e:
+                logger.error(
+                    f"Cannot add message: storage write failed for room "
+                    f"{room_id}: {e}"
+                )
+                return None
+
+        room.message_counter = seq_num
+        room.vector_clock = dict(vector_clock)
 
         # Store in buffer (with size limit)
         room.messages.append(message)
         if len(room.messages) > max_messages:
             room.messages.pop(0)
+        self.recent_messages.add(room_id, message)
+        self.search_index.add(room_id, message)
+        if parent:
+            self._update_thread(room, message)
+        self._emit_webhook(room, MESSAGE_POSTED, dict(message))
 
         logger.info(
             f"Added message #{seq_num} from {username} to room {room_id}"
@@ -670,8 +3566,486 @@ class RoomStateManager:
 
         return message
 
+    def _update_thread(self, room: Room, reply: Dict) -> None:
+        """Update the summary of a new reply's thread root (lock)."""
+        root = self._find_stored_message(room, reply["thread_id"])
+        if root is None:
+            return
+        thread = thread_summary(root, reply)
+        recent = self.recent_messages.get(room.room_id, root["message_id"])
+        for message in [root, recent] + room.messages:
+            if message and message["message_id"] == root["message_id"]:
+                message["thread"] = dict(thread)
+
+    @_synchronized
+    def get_thread(self, room_id: str, thread_id: str) -> Optional[Dict]:
+        """
+        Get the summary of a thread.
+
+        Args:
+            room_id: The room ID
+            thread_id: ID of the thread's first message
+
+        Returns:
+            dict: {'reply_count': int, 'last_reply_at': str}, or None if
+            the message is unknown or has no replies
+        """
+        room = self._rooms.get(room_id)
+        if not room:
+            return None
+        root = self._find_stored_message(room, thread_id)
+        if root is None or "thread" not in root:
+            return None
+        return dict(root["thread"])
+
+    @_synchronized
+    def find_message(self, room_id: str, message_id: str) -> Optional[Dict]:
+        """
+        Find a recent message of a room by ID.
+
+        Used to recognise a sender retrying a message that was already
+        added. Messages are found while they are in the deduplication
+        window or the room's message buffer.
+
+        Args:
+            room_id: The room ID
+            message_id: The message ID
+
+        Returns:
+            dict: The message, or None if not found
+        """
+        room = self._rooms.get(room_id)
+        if not room:
+            return None
+        recent = self.recent_messages.get(room_id, message_id)
+        if recent:
+            return recent
+        for message in reversed(room.messages):
+            if message["message_id"] == message_id:
+                return message
+        return None
+
+    @_synchronized
+    def edit_message(
+        self,
+        room_id: str,
+        username: str,
+        message_id: str,
+        action: str,
+        content: Optional[str] = None,
+    ) -> Dict:
+        """
+        Edit or delete a message of a room.
+
+        The message's author and the room's owner and moderators may
+        change it. The edit record is written to the message log before
+        it is applied. A deleted message that was pinned is unpinned. New
+        content is run through the room's filters (see
+        content_filters.py).
+
+        Args:
+            room_id: The room ID
+            username: The user making the change
+            message_id: ID of the message
+            action: "edit" or "delete"
+            content: The new content, for "edit"
+
+        Returns:
+            dict: The edit record (see edits.create_edit)
+
+        Raises:
+            EditError: If the room or message doesn't exist, the request
+                is invalid, the message was deleted, the user may not
+                change it, or a content filter rejected the new content
+                (MESSAGE_REJECTED)
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise EditError("Room not found", "ROOM_NOT_FOUND")
+        if action not in EDIT_ACTIONS:
+            raise EditError(
+                f"Action must be one of {', '.join(EDIT_ACTIONS)}",
+                "INVALID_REQUEST",
+            )
+        if action == EDIT:
+            is_valid, error_msg = validate_message_content(content)
+            if not is_valid:
+                raise EditError(error_msg, "INVALID_CONTENT")
+        if username not in room.members:
+            raise EditError("User is not in the room", "NOT_IN_ROOM")
+
+        message = self._find_stored_message(room, message_id)
+        if message is None:
+            raise EditError("Message not found", "MESSAGE_NOT_FOUND")
+        if message.get("deleted"):
+            raise EditError("Message was deleted", "MESSAGE_DELETED")
+        if action == EDIT and message.get("encrypted"):
+            raise EditError(
+                "Encrypted messages can't be edited, only deleted",
+                "MESSAGE_ENCRYPTED",
+            )
+        if message["username"] != username and not room.has_permission(
+            username, MANAGE_MESSAGES
+        ):
+            raise EditError(
+                "Only the author or a moderator can change a message",
+                "NOT_ALLOWED",
+            )
+        if action == EDIT:
+            try:
+                content, _ = self._filter_content(room, content)
+            except ContentFilterError as e:
+                raise EditError(str(e), e.error_code) from e
+
+        edit = create_edit(message_id, action, username, content)
+        if self.message_log:
+            self.message_log.log_edit(room_id, edit)
+        for stored in room.messages:
+            if stored["message_id"] == message_id:
+                apply_edit(stored, edit)
+        recent = self.recent_messages.get(room_id, message_id)
+        if recent is not None:
+            apply_edit(recent, edit)
+        self.search_index.apply_edit(room_id, edit)
+        if action == DELETE and message_id in room.pinned:
+            pinned = update_pins(room.pinned, message_id, False)
+            if self.message_log:
+                self.message_log.log_pins(room_id, pinned)
+            room.pinned = pinned
+        logger.info(
+            f"Applied {action} of message {message_id} by {username} in "
+            f"room {room_id}"
+        )
+        return edit
+
+    @_synchronized
+    def react(
+        self,
+        room_id: str,
+        username: str,
+        message_id: str,
+        emoji: str,
+        remove: bool = False,
+    ) -> Tuple[Optional[Dict], Dict[str, List[str]]]:
+        """
+        Add or remove a member's emoji reaction to a message.
+
+        Reactions are idempotent per (user, message, emoji): adding one
+        that exists or removing one that doesn't changes nothing. Changes
+        are written to the message log before they are applied.
+
+        Args:
+            room_id: The room ID
+            username: The reacting member
+            message_id: ID of the message
+            emoji: The emoji
+            remove: True to take the reaction back
+
+        Returns:
+            tuple: (reaction, reactions)
+                - reaction: The reaction record (see
+                  reactions.create_reaction), or None if nothing changed
+                - reactions: The message's reactions afterwards, mapping
+                  emoji -> sorted usernames
+
+        Raises:
+            ReactionError: If the room or message doesn't exist, the
+                emoji is invalid, the message was deleted, or the user is
+                not a member
+        """
+        room = self._rooms.get(room_id)
+        if room is None:
+            raise ReactionError("Room not found", "ROOM_NOT_FOUND")
+        is_valid, error_msg = validate_emoji(emoji)
+        if not is_valid:
+            raise ReactionError(error_msg, "INVALID_EMOJI")
+        if username not in room.members:
+            raise ReactionError("User is not in the room", "NOT_IN_ROOM")
+        message = self._find_stored_message(room, message_id)
+        if message is None:
+            raise ReactionError("Message not found", "MESSAGE_NOT_FOUND")
+        if message.get("deleted"):
+            raise ReactionError("Message was deleted", "MESSAGE_DELETED")
+
+        users = message.get("reactions", {}).get(emoji, [])
+        if (username in users) != remove:
+            return None, _copy_reactions(message)
+
+        reaction = create_reaction(
+            message_id, emoji, username, REMOVE if remove else ADD
+        )
+        if self.message_log:
+            self.message_log.log_reaction(room_id, reaction)
+        apply_reaction(message, reaction)
+        for stored in room.messages:
+            if stored["message_id"] == message_id:
+                apply_reaction(stored, reaction)
+        recent = self.recent_messages.get(room_id, message_id)
+        if recent is not None:
+            apply_reaction(recent, reaction)
+        logger.info(
+            f"User {username} {reaction['action']}s {emoji} on message "
+            f"{message_id} in room {room_id}"
+        )
+        return reaction, _copy_reactions(message)
+
+    def _check_spam(self, room: Room, username: str, content: str) -> None:
+        """
+        Run a member's message past spam detection (lock held).
+
+        The owner, moderators and bots are not checked. A member who gets
+        muted is recorded in the audit log.
+
+        Raises:
+            SpamError: USER_MUTED or SPAM_DETECTED
+        """
+        if username in room.bots or room.has_permission(
+            username, KICK_MEMBERS
+        ):
+            return
+        thresholds = effective_thresholds(room.spam_thresholds)
+        try:
+            self.spam.check(room.room_id, username, content, thresholds)
+        except SpamError as e:
+            if e.error_code == SPAM_DETECTED:
+                logger.warning(
+                    f"Muted {username} in room '{room.room_name}' "
+                    f"(ID: {room.room_id}) for {e.reason}"
+                )
+                audit(
+                    self.audit_log,
+                    self.node_id,
+                    MEMBER_MUTED,
+                    room.room_id,
+                    user=username,
+                    reason=e.reason,
+                    until=e.muted_until,
+                )
+            raise
+
+    def _filter_content(
+        self, room: Room, content: str
+    ) -> Tuple[str, List[str]]:
+        """
+        Run content through a room's filter chain (lock held).
+
+        The chain is rebuilt when the room's filters change.
+
+        Returns:
+            (content, filtered): see FilterChain.run
+
+        Raises:
+            ContentFilterError: MESSAGE_REJECTED
+        """
+        cached = self._filter_chains.get(room.room_id)
+        if cached is None or cached[0] != room.content_filters:
+            chain = self.content_filters.chain(room.content_filters)
+            cached = ([dict(f) for f in room.content_filters], chain)
+            self._filter_chains[room.room_id] = cached
+        try:
+            return cached[1].run(content)
+        except ContentFilterError as e:
+            logger.info(
+                f"Content filter {e.filter_type} rejected a message in "
+                f"room {room.room_id}: {e}"
+            )
+            raise
+
+    def _find_stored_message(
+        self, room: Room, message_id: str
+    ) -> Optional[Dict]:
+        """Find a message in a room's buffer or its full history (lock)."""
+        message = self.find_message(room.room_id, message_id)
+        if message is not None:
+            return message
+        return next(
+            (
+                m
+                for m in self._history_messages(room)
+                if m["message_id"] == message_id
+            ),
+            None,
+        )
+
+    @_synchronized
+    def get_history(
+        self,
+        room_id: str,
+        username: str,
+        before: Optional[str] = None,
+        after: Optional[str] = None,
+        limit: int = HISTORY_PAGE_SIZE,
+        thread_id: Optional[str] = None,
+    ) -> Dict:
+        """
+        Get a page of a room's message history.
+
+        The full history is read from the message log when one is
+        attached; otherwise only the in-memory message buffer is paged.
+        History of a private room is only shown to its members. With a
+        thread_id, only that message and the replies below it are paged.
+        Only messages within the room's retention policy are returned.
+        Archived rooms are paged from the archive (see archive.py).
+
+        Args:
+            room_id: The room ID
+            username: The user asking
+            before: Page ends just before the message with this ID
+            after: Page starts just after the message with this ID
+            limit: Maximum number of messages in the page
+            thread_id: ID of a message whose thread subtree to page
+
+        Returns:
+            dict: {'success': True, 'messages': list, 'has_more': bool,
+            'truncated': bool, 'pinned': list} or an error with 'error'
+            and 'error_code'; 'truncated' is True if the page reaches the
+            oldest kept message and older messages were removed,
+            'pinned' has the IDs of the room's pinned messages and
+            'archived' is True for an archived room
+        """
+        room = self._rooms.get(room_id) or self._archived_room(room_id)
+        if not room:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        if room.private and username not in room.members:
+            return {
+                "success": False,
+                "error": "Only room members can read its history",
+                "error_code": "NOT_A_MEMBER",
+            }
+
+        messages, expired = self._retained_history(room)
+        if thread_id:
+            messages = thread_messages(messages, thread_id)
+            if not messages:
+                return {
+                    "success": False,
+                    "error": "Thread not found",
+                    "error_code": "MESSAGE_NOT_FOUND",
+                }
+        page = paginate_history(messages, before, after, limit)
+        if page["success"]:
+            oldest = messages[0]["message_id"] if messages else None
+            page["truncated"] = expired and (
+                not page["messages"]
+                or page["messages"][0]["message_id"] == oldest
+            )
+            page["pinned"] = list(room.pinned)
+            page["archived"] = room_id not in self._rooms
+        return page
+
+    @_synchronized
+    def search_messages(
+        self,
+        room_id: str,
+        username: str,
+        query: str,
+        author: Optional[str] = None,
+        since: Optional[str] = None,
+        until: Optional[str] = None,
+        limit: int = SEARCH_LIMIT,
+    ) -> Dict:
+        """
+        Search a room's message history (see search.py).
+
+        Like history, a private room can only be searched by its members.
+
+        Args:
+            room_id: The room ID
+            username: The user searching
+            query: Words that must all appear in a message
+            author: Only messages by this user
+            since: Only messages sent at or after this ISO 8601 time
+            until: Only messages sent at or before this ISO 8601 time
+            limit: Most messages returned
+
+        Returns:
+            dict: {'success': True, 'messages': list, 'total': int} with
+            the newest matches first, or an error with 'error' and
+            'error_code'
+        """
+        room = self._rooms.get(room_id)
+        if not room:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        if room.private and username not in room.members:
+            return {
+                "success": False,
+                "error": "Only room members can search its history",
+                "error_code": "NOT_A_MEMBER",
+            }
+        try:
+            result = self.search_index.search(
+                room_id,
+                lambda: self._history_messages(room),
+                query,
+                author,
+                since,
+                until,
+                limit,
+            )
+        except SearchError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, **result}
+
+    @_synchronized
+    def get_sequence_range(
+        self, room_id: str, first_sequence: int, last_sequence: int
+    ) -> List[Dict]:
+        """
+        Get a room's messages with sequence numbers in a range.
+
+        Used to retransmit messages a node missed in a total-order room.
+
+        Args:
+            room_id: The room ID
+            first_sequence: First sequence number, inclusive
+            last_sequence: Last sequence number, inclusive
+
+        Returns:
+            The messages still in the room's history, in sequence order
+        """
+        room = self._rooms.get(room_id)
+        if not room:
+            return []
+        return [
+            message
+            for message in self._history_messages(room)
+            if first_sequence <= message["sequence_number"] <= last_sequence
+        ]
+
+    def _history_messages(self, room: Room) -> List[Dict]:
+        """Get a room's full history from the log, or its buffer (lock)."""
+        return self._retained_history(room)[0]
+
+    def _retained_history(self, room: Room) -> Tuple[List[Dict], bool]:
+        """
+        Get a room's history within its retention policy (lock held).
+
+        Returns:
+            tuple: (messages, True if older messages were removed)
+        """
+        messages = list(room.messages)
+        if self.message_log:
+            messages = self.message_log.messages(room.room_id) or messages
+        if not room.retention:
+            return messages, bool(room.expired_through)
+        kept, expired_through = expire(messages, room.retention)
+        return kept, bool(expired_through or room.expired_through)
+
     # ===== Two-Phase Commit (2PC) Methods for Room Deletion =====
 
+    @_synchronized
     def start_deletion_transaction(
         self, room_id: str, participants: List[str]
     ) -> Optional[DeletionTransaction]:
@@ -715,12 +4089,14 @@ class RoomStateManager:
 
         return transaction
 
+    @_synchronized
     def get_deletion_transaction(
         self, transaction_id: str
     ) -> Optional[DeletionTransaction]:
         """Get a deletion transaction by ID."""
         return self._deletion_transactions.get(transaction_id)
 
+    @_synchronized
     def record_vote(self, transaction_id: str, node_id: str, vote: str) -> bool:
         """
         Record a vote from a participant node.
@@ -752,6 +4128,7 @@ class RoomStateManager:
         )
         return True
 
+    @_synchronized
     def all_votes_ready(self, transaction_id: str) -> bool:
         """Check if all participants voted READY."""
         transaction = self._deletion_transactions.get(transaction_id)
@@ -760,6 +4137,7 @@ class RoomStateManager:
 
         return all(vote == "READY" for vote in transaction.votes.values())
 
+    @_synchronized
     def all_votes_received(self, transaction_id: str) -> bool:
         """Check if all votes have been received."""
         transaction = self._deletion_transactions.get(transaction_id)
@@ -768,6 +4146,7 @@ class RoomStateManager:
 
         return all(vote is not None for vote in transaction.votes.values())
 
+    @_synchronized
     def transition_to_commit(self, transaction_id: str) -> bool:
         """Transition a transaction to COMMIT state."""
         transaction = self._deletion_transactions.get(transaction_id)
@@ -782,6 +4161,7 @@ class RoomStateManager:
         logger.info(f"Transaction {transaction_id} transitioned to COMMIT")
         return True
 
+    @_synchronized
     def transition_to_rollback(self, transaction_id: str) -> bool:
         """Transition a transaction to ROLLBACK state."""
         transaction = self._deletion_transactions.get(transaction_id)
@@ -796,6 +4176,7 @@ class RoomStateManager:
         logger.info(f"Transaction {transaction_id} transitioned to ROLLBACK")
         return True
 
+    @_synchronized
     def complete_deletion(self, transaction_id: str) -> bool:
         """
         Complete a deletion transaction by removing the room.
@@ -821,6 +4202,7 @@ class RoomStateManager:
         )
         return success
 
+    @_synchronized
     def rollback_deletion(self, transaction_id: str) -> bool:
         """
         Rollback a deletion transaction, restoring room to ACTIVE state.
@@ -847,6 +4229,7 @@ class RoomStateManager:
 
     # ===== Participant-side 2PC Methods =====
 
+    @_synchronized
     def prepare_for_deletion(
         self, room_id: str, transaction_id: str, coordinator: str
     ) -> Dict:
@@ -917,6 +4300,18 @@ class RoomStateManager:
             "transaction_id": transaction_id,
         }
 
+    @_synchronized
+    def get_prepared_deletions(
+        self, coordinator: str
+    ) -> List[PreparedTransaction]:
+        """Get the deletions prepared here for a coordinator."""
+        return [
+            prepared
+            for prepared in self._prepared_transactions.values()
+            if prepared.coordinator == coordinator
+        ]
+
+    @_synchronized
     def commit_deletion(self, room_id: str, transaction_id: str) -> Dict:
         """
         Commit the deletion of a room (participant's COMMIT phase).
@@ -958,6 +4353,7 @@ class RoomStateManager:
             "node_id": self.node_id,
         }
 
+    @_synchronized
     def rollback_deletion_participant(
         self, room_id: str, transaction_id: str
     ) -> Dict:
@@ -995,6 +4391,7 @@ class RoomStateManager:
             "node_id": self.node_id,
         }
 
+    @_synchronized
     def can_operate_on_room(self, room_id: str) -> bool:
         """
         Check if normal operations (join, message) can be performed on a room.
@@ -0,0 +1,145 @@
+"""
+Latency-Aware Routing
+
+Some requests can be answered by more than one node: any follower of a
+room holds a replica that can serve a page of its history as well as
+the room's admin can. In a cluster spread over regions the admin may be
+far away while a follower is next door, so such requests go to the
+nearest node that can answer them.
+
+Nearness is the smoothed round-trip time of the failure detector's
+heartbeats to each peer (this node itself is nearest of all). Peers the
+failure detector suspects or declared dead are tried last. Peers without
+a measured round trip yet rank after the measured ones, those in this
+node's region (its "region" tag, see placement.py) first, so a node
+that just started still prefers nearby peers. Ties go to the preferred
+node, usually the room's admin, whose answer is authoritative.
+
+When the chosen node can't answer (e.g., its replica is missing older
+messages), the next one in the ranking is tried; an answer from the admin
+is final unless it is unreachable. Each decision is counted in the node's
+metrics by purpose and by the node that answered, as are fallbacks.
+"""
+
+import logging
+from typing import Iterable, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Routing purposes, as recorded in the metrics
+HISTORY = "history"
+
+# Tag naming a node's region
+REGION_TAG = "region"
+
+
+class LatencyRouter:
+    """
+    Ranks the nodes that can serve a request by their round-trip time.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        failure_detector=None,
+        peer_registry=None,
+        region: Optional[str] = None,
+        metrics=None,
+    ):
+        """
+        Initialize the router.
+
+        Args:
+            node_id: ID of this node
+            failure_detector: Optional FailureDetector measuring the
+                round-trip times of heartbeats to peers
+            peer_registry: Optional PeerRegistry with the peers' tags
+            region: This node's region tag, if any
+            metrics: Optional NodeMetrics counting routing decisions
+        """
+        self.node_id = node_id
+        self.failure_detector = failure_detector
+        self.peer_registry = peer_registry
+        self.region = region
+        self.metrics = metrics
+
+    def rtt(self, node_id: str) -> Optional[float]:
+        """
+        Get the smoothed round-trip time to a node.
+
+        Args:
+            node_id: The node ID
+
+        Returns:
+            float: Seconds (0 for this node), or None if not measured
+        """
+        if node_id == self.node_id:
+            return 0.0
+        if self.failure_detector is None:
+            return None
+        status = self.failure_detector.get_status(node_id)
+        return status.avg_rtt if status else None
+
+    def rank(
+        self, candidates: Iterable[str], preferred: Optional[str] = None
+    ) -> List[str]:
+        """
+        Order the nodes able to serve a request, nearest first.
+
+        Args:
+            candidates: Node IDs; repeats and empty IDs are dropped
+            preferred: Node that wins ties (e.g., the room's admin)
+
+        Returns:
+            The node IDs in the order to try them
+        """
+        return sorted(
+            {node for node in candidates if node},
+            key=lambda node: self._sort_key(node, preferred),
+        )
+
+    def record(
+        self, purpose: str, chosen: str, fallbacks: int = 0
+    ) -> None:
+        """
+        Count a routed request.
+
+        Args:
+            purpose: What the request was for (e.g., HISTORY)
+            chosen: Node that answered it
+            fallbacks: Nodes tried before it that couldn't answer
+        """
+        rtt = self.rtt(chosen)
+        logger.debug(
+            f"Routed {purpose} request to {chosen} "
+            f"(rtt {rtt}, after {fallbacks} fallbacks)"
+        )
+        if self.metrics is not None:
+            self.metrics.record_route(purpose, chosen, fallbacks)
+
+    def _sort_key(self, node: str, preferred: Optional[str]) -> tuple:
+        """Sort live, measured, nearby and preferred nodes first."""
+        rtt = self.rtt(node)
+        return (
+            not self._is_alive(node),
+            rtt is None,
+            rtt or 0.0,
+            rtt is None and not self._in_region(node),
+            node != preferred,
+            node,
+        )
+
+    def _is_alive(self, node: str) -> bool:
+        """Check whether the failure detector has a node as ALIVE."""
+        if node == self.node_id or self.failure_detector is None:
+            return True
+        return self.failure_detector.is_alive(node)
+
+    def _in_region(self, node: str) -> bool:
+        """Check whether a node advertised this node's region."""
+        if self.region is None or self.peer_registry is None:
+            return False
+        if node == self.node_id:
+            return True
+        tags = self.peer_registry.get_tags(node)
+        return tags.get(REGION_TAG) == self.region
@@ -0,0 +1,387 @@
+"""
+Inter-Node RPC Layer
+
+Defines the NodeService contract exposed by every node over XML-RPC, and
+provides a client manager that reuses connections to peer nodes and
+applies a per-call timeout, unlike a bare ServerProxy which blocks for
+as long as the OS allows. Its connections compress large request and
+response bodies (see compression.py), and calls to a peer that keeps
+failing are refused by its circuit breaker (see peer_connections.py).
+"""
+
+import http.client
+import logging
+import threading
+import time
+from typing import Any, Dict, Optional, Tuple
+from xmlrpc.client import Fault
+from .compression import (
+    COMPRESSION_THRESHOLD,
+    GZIP,
+    choose_encoding,
+    decompress,
+    maybe_compress,
+    supported_encodings,
+)
+from .log_context import (
+    CorrelationSafeTransport,
+    CorrelationTransport,
+    ServerProxy,
+)
+from .peer_connections import PeerConnections
+from .tls import client_context
+
+logger = logging.getLogger(__name__)
+
+# Default timeout for inter-node calls, in seconds
+DEFAULT_RPC_TIMEOUT = 3
+
+# The NodeService contract: XML-RPC methods every node exposes to its peers.
+# Maps method name -> short description of its purpose.
+NODE_SERVICE_METHODS: Dict[str, str] = {
+    "get_hosted_rooms": "List rooms administered by the node",
+    "get_room_info": "Get details of a single hosted room",
+    "exchange_room_directory": "Push-pull gossip of the room directory",
+    "room_directory_digest": "Digest tree of the room directory",
+    "room_directory_versions": "Directory entry versions in digest buckets",
+    "sync_room_directory": "Repair divergent room directory entries",
+    "exchange_presence": "Push-pull gossip of the user presence directory",
+    "receive_presence_update": "Deliver debounced user presence changes",
+    "exchange_profiles": "Push-pull gossip of the user profile registry",
+    "receive_profile_update": "Deliver changed user profiles",
+    "exchange_push_tokens": "Push-pull gossip of users' push tokens",
+    "receive_push_tokens": "Deliver registered and removed push tokens",
+    "exchange_load": "Push-pull gossip of node loads for client redirects",
+    "exchange_stats": "Push-pull gossip of node and room statistics",
+    "join_room": "Join a hosted room on behalf of a remote client",
+    "join_room_by_invite": "Join a private hosted room with an invite",
+    "create_room_invite": "Create an invite to a private hosted room",
+    "revoke_room_invite": "Revoke an invite to a private hosted room",
+    "leave_room": "Leave a hosted room on behalf of a remote client",
+    "merge_room_members": "Merge a node's membership set of a hosted room",
+    "moderate_member": "Kick or ban a member of a hosted room",
+    "remove_room_member": "Take a kicked or banned local user out of a room",
+    "set_member_role": "Promote or demote a member of a hosted room",
+    "set_room_retention": "Set how long a hosted room keeps its messages",
+    "set_spam_thresholds": "Change the spam thresholds of a hosted room",
+    "set_content_filters": "Replace the content filters of a hosted room",
+    "edit_message": "Edit or delete a message of a hosted room",
+    "pin_message": "Pin or unpin a message of a hosted room",
+    "schedule_message": "Schedule a message to be sent to a hosted room",
+    "list_scheduled": "List the messages scheduled in a hosted room",
+    "cancel_scheduled": "Cancel a message scheduled in a hosted room",
+    "update_room_metadata": "Update the name, topic or description of a room",
+    "react": "Add or remove an emoji reaction to a hosted room's message",
+    "mark_read": "Move a member's read position in a hosted room",
+    "get_read_state": "Get a member's unread count and the read positions",
+    "publish_key": "Publish a member's public key to a hosted private room",
+    "get_room_keys": "Get the members' public keys of a hosted private room",
+    "forward_message": "Submit a message to the room administrator",
+    "get_blob": "Read part of an attachment blob stored on the node",
+    "replicate_blob": "Pull an attachment blob of a followed room",
+    "get_room_history": "Get a page of a hosted room's message history",
+    "get_replica_history": "Get a page of a followed room's history",
+    "search_room": "Full-text search of a hosted room's message history",
+    "register_webhook": "Register a webhook for a hosted room's events",
+    "remove_webhook": "Remove a webhook of a hosted room",
+    "list_webhooks": "List the webhooks of a hosted room",
+    "set_room_bot": "Register the commands of a bot in a hosted room",
+    "add_bridge": "Bridge a hosted room to IRC or Matrix",
+    "remove_bridge": "Remove a bridge of a hosted room",
+    "list_bridges": "List the bridges of a hosted room",
+    "deliver_direct_message": "Deliver a direct message to a local user",
+    "deliver_receipt": "Tell a local sender a message was received",
+    "receive_message_broadcast": "Deliver an ordered message to members",
+    "receive_message_stream": "Deliver a batch of a peer's message stream",
+    "retransmit_messages": "Resend messages a node or its clients missed",
+    "receive_member_event_broadcast": "Deliver a member join/leave event",
+    "notify_member_disconnect": "Report that a remote member disconnected",
+    "notify_waitlist_admitted": "Admit a local user from a room's waiting list",
+    "heartbeat": "Liveness check",
+    "prepare_delete_room": "2PC prepare phase for room deletion",
+    "commit_delete_room": "2PC commit phase for room deletion",
+    "rollback_delete_room": "2PC rollback phase for room deletion",
+    "tpc_prepare": "Generic 2PC prepare phase",
+    "tpc_commit": "Generic 2PC commit phase",
+    "tpc_abort": "Generic 2PC abort phase",
+    "tpc_precommit": "2PC recovery extension pre-commit phase",
+    "tpc_status": "Report a 2PC transaction's state for recovery",
+    "get_membership_view": "Get the node's cluster membership view",
+    "raft_request_vote": "Raft election vote request",
+    "raft_append_entries": "Raft log replication and leader heartbeat",
+    "raft_install_snapshot": "Raft snapshot for a follower missing entries",
+    "raft_submit": "Forward a room registry command to the Raft leader",
+    "get_room_replica": "Get this node's replica of a remote room",
+    "failover_election": "Bully election message for a room's admin",
+    "room_admin_changed": "Announce a room's newly elected admin",
+    "replicate_messages": "Stream a room's messages to a follower replica",
+    "drop_room_replica": "Drop a follower's replica of a deleted room",
+    "accept_room_handoff": "Take over a room from a node shutting down",
+    "begin_snapshot_transfer": "Start or resume receiving a room snapshot",
+    "receive_snapshot_chunk": "Receive one checksummed room snapshot chunk",
+    "commit_snapshot_transfer": "Verify a room snapshot and take the room over",
+    "hello": "Discovery handshake exchanging node IDs and capabilities",
+}
+
+
+class CompressingTransport:
+    """
+    Transport mixin compressing request bodies of at least
+    compression_threshold bytes and reading compressed responses.
+
+    Requests use gzip until a response lists the encodings the peer
+    reads, and then the best of them. A threshold of None sends requests
+    uncompressed.
+    """
+
+    compression_threshold: Optional[int] = None
+    metrics = None
+    request_encoding: Optional[str] = GZIP
+
+    def send_headers(self, connection, headers):
+        """Send the request headers, listing the encodings read here."""
+        headers = [h for h in headers if h[0].lower() != "accept-encoding"]
+        accept = ("Accept-Encoding", ", ".join(supported_encodings()))
+        super().send_headers(connection, headers + [accept])
+
+    def send_content(self, connection, request_body):
+        """Send the request body, compressed if it's large enough."""
+        body, encoding = maybe_compress(
+            request_body,
+            self.request_encoding,
+            self.compression_threshold,
+            self.metrics,
+        )
+        if encoding:
+            connection.putheader("Content-Encoding", encoding)
+        connection.putheader("Content-Length", str(len(body)))
+        connection.endheaders(body)
+
+    def parse_response(self, response):
+        """Read a response and note the encodings the peer reads."""
+        accepted = response.getheader("Accept-Encoding")
+        if accepted:
+            self.request_encoding = choose_encoding(accepted)
+        body = decompress(
+            response.read(), response.getheader("Content-Encoding", "")
+        )
+        parser, unmarshaller = self.getparser()
+        parser.feed(body)
+        parser.close()
+        return unmarshaller.close()
+
+
+class TimeoutTransport(CompressingTransport, CorrelationTransport):
+    """
+    XML-RPC transport that applies a socket timeout to connections.
+
+    Calls carry the caller's log context (see log_context.py).
+    """
+
+    def __init__(
+        self,
+        timeout: float = DEFAULT_RPC_TIMEOUT,
+        compression_threshold: Optional[int] = None,
+        metrics=None,
+        **kwargs,
+    ):
+        """
+        Initialize the transport.
+
+        Args:
+            timeout: Socket timeout in seconds for each connection
+            compression_threshold: Smallest request body compressed, in
+                bytes (None sends requests uncompressed)
+            metrics: Optional NodeMetrics counting the bytes saved
+        """
+        super().__init__(**kwargs)
+        self.timeout = timeout
+        self.compression_threshold = compression_threshold
+        self.metrics = metrics
+
+    def make_connection(self, host):
+        """Create (or reuse) an HTTP connection with the timeout applied."""
+        return _apply_timeout(super().make_connection(host), self.timeout)
+
+
+class TimeoutSafeTransport(CompressingTransport, CorrelationSafeTransport):
+    """
+    HTTPS XML-RPC transport that applies a socket timeout to connections.
+
+    Connections use the node's TLS client context (see tls.py).
+    """
+
+    def __init__(
+        self,
+        timeout: float = DEFAULT_RPC_TIMEOUT,
+        compression_threshold: Optional[int] = None,
+        metrics=None,
+        **kwargs,
+    ):
+        """
+        Initialize the transport.
+
+        Args:
+            timeout: Socket timeout in seconds for each connection
+            compression_threshold: Smallest request body compressed, in
+                bytes (None sends requests uncompressed)
+            metrics: Optional NodeMetrics counting the bytes saved
+        """
+        kwargs.setdefault("context", client_context())
+        super().__init__(**kwargs)
+        self.timeout = timeout
+        self.compression_threshold = compression_threshold
+        self.metrics = metrics
+
+    def make_connection(self, host):
+        """Create (or reuse) an HTTPS connection with the timeout applied."""
+        return _apply_timeout(super().make_connection(host), self.timeout)
+
+
+def _apply_timeout(connection, timeout: float):
+    """Set the socket timeout of an HTTP(S) connection."""
+    if isinstance(connection, http.client.HTTPConnection):
+        connection.timeout = timeout
+        if connection.sock is not None:
+            connection.sock.settimeout(timeout)
+    return connection
+
+
+class RPCClientPool:
+    """
+    Connection-pooled XML-RPC client manager.
+
+    ServerProxy objects are not thread-safe, so proxies are cached per
+    (thread, address, timeout). Each cached proxy keeps its HTTP
+    connection alive between calls, so repeated calls to the same peer
+    from the same thread reuse one connection.
+    """
+
+    def __init__(
+        self,
+        timeout: float = DEFAULT_RPC_TIMEOUT,
+        metrics=None,
+        compression_threshold: Optional[int] = COMPRESSION_THRESHOLD,
+        connections: Optional[PeerConnections] = None,
+    ):
+        """
+        Initialize the client pool.
+
+        Args:
+            timeout: Default timeout in seconds for calls
+            metrics: Optional NodeMetrics recording the latency of calls
+                and the bytes compression saved
+            compression_threshold: Smallest request body compressed, in
+                bytes (None sends requests uncompressed)
+            connections: PeerConnections holding each peer's circuit
+                breaker (defaults to a new one)
+        """
+        self.timeout = timeout
+        self.metrics = metrics
+        self.compression_threshold = compression_threshold
+        self.connections = connections or PeerConnections()
+        self._local = threading.local()
+
+    def _proxies(self) -> Dict[Tuple[str, float], ServerProxy]:
+        """Get the proxy cache for the current thread."""
+        if not hasattr(self._local, "proxies"):
+            self._local.proxies = {}
+        return self._local.proxies
+
+    def get_proxy(
+        self, address: str, timeout: Optional[float] = None
+    ) -> ServerProxy:
+        """
+        Get a cached proxy for a peer address.
+
+        Args:
+            address: XML-RPC address of the peer (e.g., "http://node2:9090")
+            timeout: Optional timeout override in seconds
+
+        Returns:
+            ServerProxy bound to the address
+        """
+        effective_timeout = self.timeout if timeout is None else timeout
+        key = (address, effective_timeout)
+        proxies = self._proxies()
+        proxy = proxies.get(key)
+        if proxy is None:
+            if address.startswith("https://"):
+                transport_class = TimeoutSafeTransport
+            else:
+                transport_class = TimeoutTransport
+            transport = transport_class(
+                timeout=effective_timeout,
+                compression_threshold=self.compression_threshold,
+                metrics=self.metrics,
+            )
+            proxy = ServerProxy(address, transport=transport, allow_none=True)
+            proxies[key] = proxy
+        return proxy
+
+    def call(
+        self,
+        address: str,
+        method: str,
+        *args,
+        timeout: Optional[float] = None,
+    ) -> Any:
+        """
+        Call an XML-RPC method on a peer.
+
+        A failed call drops the cached proxy so the next call opens a
+        fresh connection, and counts towards opening the peer's circuit.
+
+        Args:
+            address: XML-RPC address of the peer
+            method: Name of the remote method
+            *args: Positional arguments for the remote method
+            timeout: Optional timeout override in seconds
+
+        Returns:
+            The remote method's return value
+
+        Raises:
+            PeerUnavailableError: If the peer's circuit is open
+            Exception: If the call fails or times out
+        """
+        connection = self.connections.get(address)
+        connection.before_call()
+        proxy = self.get_proxy(address, timeout)
+        started = time.monotonic()
+        try:
+            result = getattr(proxy, method)(*args)
+        except Fault:
+            # The peer answered, if with an error
+            self._observe(method, started, ok=False)
+            connection.record_success()
+            self.discard(address)
+            raise
+        except Exception as e:
+            self._observe(method, started, ok=False)
+            connection.record_failure(e)
+            self.discard(address)
+            raise
+        self._observe(method, started, ok=True)
+        connection.record_success()
+        return result
+
+    def _observe(self, method: str, started: float, ok: bool) -> None:
+        """Record the latency of a call if metrics are enabled."""
+        if self.metrics is not None:
+            self.metrics.observe_rpc(method, time.monotonic() - started, ok)
+
+    def discard(self, address: str) -> None:
+        """
+        Drop cached proxies for an address on the current thread.
+
+        Args:
+            address: XML-RPC address of the peer
+        """
+        proxies = self._proxies()
+        for key in [key for key in proxies if key[0] == address]:
+            proxy = proxies.pop(key)
+            try:
+                proxy("close")()
+            except Exception as e:
+                logger.debug(f"Error closing proxy for {address}: {e}")
@@ -0,0 +1,134 @@
+"""
+Scheduled Messages
+
+A member can have a message sent later by giving send_message a send_at
+time (ISO 8601, UTC if it has no offset). The room's administrator keeps
+the message until then and posts it as the member, with its sequence
+number and timestamp assigned when it is sent and scheduled_at saying
+when it was scheduled. The message keeps the ID it was scheduled with
+(the sender's message_id, or a new one), so a message that was already
+sent isn't sent twice after a restart or a failover.
+
+A member can have MAX_SCHEDULED_MESSAGES messages pending in a room, at
+most MAX_SCHEDULE_AHEAD seconds ahead; a send_at that has already passed
+is sent on the next round. Scheduled messages carry text and optionally
+reply_to, not attachments or encryption. list_scheduled lists a member's
+pending messages (the whole room's for its owner and moderators), and
+cancel_scheduled cancels one; the owner and moderators can cancel
+anyone's.
+
+Pending messages are room state like webhooks: the administrator writes
+them to its message log, and sends them with replication and snapshots,
+so a node taking over the room sends them in turn. A round every
+SCHEDULE_INTERVAL seconds sends the messages that are due. A message
+whose author was banned in the meantime, or that the room refuses when
+it is due (e.g., a content filter rejects it), is dropped.
+"""
+
+from datetime import datetime, timedelta, timezone
+from typing import Dict, Optional
+
+# Scheduling configuration
+MAX_SCHEDULED_MESSAGES = 50  # pending messages per member and room
+MAX_SCHEDULE_AHEAD = 30 * 86400  # seconds (30 days) ahead of now
+SCHEDULE_INTERVAL = 1  # seconds between delivery rounds
+
+
+class ScheduleError(Exception):
+    """A message could not be scheduled, listed or cancelled."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_SEND_AT")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def parse_send_at(send_at, now: Optional[datetime] = None) -> datetime:
+    """
+    Parse and check the time a message is to be sent at.
+
+    Args:
+        send_at: ISO 8601 time (UTC if it has no offset)
+        now: Current time (defaults to the time now)
+
+    Returns:
+        The time, in UTC
+
+    Raises:
+        ScheduleError: If it isn't an ISO 8601 time, or is more than
+            MAX_SCHEDULE_AHEAD seconds ahead (INVALID_SEND_AT)
+    """
+    now = now or datetime.now(timezone.utc)
+    try:
+        parsed = datetime.fromisoformat(send_at)
+    except (TypeError, ValueError):
+        raise ScheduleError(
+            f"Invalid send_at {send_at!r}; use ISO 8601", "INVALID_SEND_AT"
+        )
+    if parsed.tzinfo is None:
+        parsed = parsed.replace(tzinfo=timezone.utc)
+    if parsed - now > timedelta(seconds=MAX_SCHEDULE_AHEAD):
+        raise ScheduleError(
+            f"Messages can be scheduled at most "
+            f"{MAX_SCHEDULE_AHEAD // 86400} days ahead",
+            "INVALID_SEND_AT",
+        )
+    return parsed.astimezone(timezone.utc)
+
+
+def create_scheduled(
+    message_id: str,
+    username: str,
+    content: str,
+    send_at: datetime,
+    reply_to: Optional[str] = None,
+) -> Dict:
+    """
+    Create the record of a scheduled message.
+
+    Args:
+        message_id: ID the message is sent with
+        username: The member sending it
+        content: The message text
+        send_at: When to send it (see parse_send_at)
+        reply_to: ID of the message it replies to, if any
+
+    Returns:
+        dict: The record, with 'message_id', 'username', 'content',
+        'send_at', 'scheduled_at' and 'reply_to' if given
+    """
+    scheduled = {
+        "message_id": message_id,
+        "username": username,
+        "content": content,
+        "send_at": send_at.isoformat(),
+        "scheduled_at": datetime.now(timezone.utc).isoformat(),
+    }
+    if reply_to:
+        scheduled["reply_to"] = reply_to
+    return scheduled
+
+
+def send_time(scheduled: Dict) -> datetime:
+    """Get the time a scheduled message is to be sent at."""
+    return datetime.fromisoformat(scheduled["send_at"])
+
+
+def is_due(scheduled: Dict, now: Optional[datetime] = None) -> bool:
+    """
+    Check whether a scheduled message is to be sent.
+
+    Args:
+        scheduled: The scheduled message's record
+        now: Current time (defaults to the time now)
+
+    Returns:
+        True if its send_at has come
+    """
+    return send_time(scheduled) <= (now or datetime.now(timezone.utc))
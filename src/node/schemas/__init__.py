@@ -8,31 +8,163 @@ for messages, events, and responses used in the node server.
 from .messages import (
     create_message_data,
     create_message_sent_confirmation,
+    create_message_status_event,
     create_message_error,
     create_new_message_broadcast,
+    create_message_edit_event,
+    create_message_reaction_event,
+    create_thread_updated_event,
+    create_direct_message_event,
+    create_direct_message_sent_confirmation,
+    create_direct_message_error,
 )
 from .events import (
     create_member_joined_event,
     create_member_left_event,
+    create_member_role_changed_event,
+    create_retention_changed_event,
+    create_spam_thresholds_changed_event,
+    create_spam_detected_event,
+    create_content_filters_changed_event,
+    create_pin_event,
+    create_mention_event,
+    create_room_updated_event,
     create_delete_room_initiated_event,
     create_room_deleted_event,
+    create_room_archived_event,
+    create_room_admin_changed_event,
+    create_node_shutdown_event,
+    create_redirect_event,
+    create_presence_update_event,
+    create_session_started_event,
+    create_ping_event,
+    create_removed_from_room_event,
+    create_slow_consumer_event,
+    create_waitlist_joined_event,
+    create_waitlist_admitted_event,
+    create_typing_event,
+    create_read_position_updated_event,
+    create_room_status_event,
+    create_key_published_event,
 )
 from .responses import (
     create_error_response,
     create_success_response,
     create_join_error_response,
+    create_invite_error_response,
+    create_auth_error_response,
+    create_rate_limited_response,
+    create_validation_error_response,
+    create_resume_error_response,
+    create_history_error_response,
+    create_moderation_error_response,
+    create_message_edit_error_response,
+    create_reaction_error_response,
+    create_read_state_error_response,
+    create_key_error_response,
+    create_upload_error_response,
+    create_search_error_response,
+    create_webhook_error_response,
+    create_bot_error_response,
+    create_retention_error_response,
+    create_pin_error_response,
+    create_room_update_error_response,
+    create_spam_error_response,
+    create_filter_error_response,
+    create_push_error_response,
+    create_mutes_error_response,
+    create_block_error_response,
+    create_schedule_error_response,
+    create_stats_error_response,
+)
+from .catalog import (
+    CLIENT_PROTOCOL_VERSION,
+    COMMAND_CATALOG,
+    EVENT_CATALOG,
+    CommandSpec,
+    protocol_info,
+)
+from .errors import (
+    ERROR_CATALOG,
+    ErrorSpec,
+    describe_error,
+    error_fields,
 )
 
 __all__ = [
     "create_message_data",
     "create_message_sent_confirmation",
+    "create_message_status_event",
     "create_message_error",
     "create_new_message_broadcast",
+    "create_message_edit_event",
+    "create_message_reaction_event",
+    "create_thread_updated_event",
+    "create_direct_message_event",
+    "create_direct_message_sent_confirmation",
+    "create_direct_message_error",
     "create_member_joined_event",
     "create_member_left_event",
+    "create_member_role_changed_event",
+    "create_retention_changed_event",
+    "create_spam_thresholds_changed_event",
+    "create_spam_detected_event",
+    "create_content_filters_changed_event",
+    "create_pin_event",
+    "create_mention_event",
+    "create_room_updated_event",
     "create_delete_room_initiated_event",
     "create_room_deleted_event",
+    "create_room_archived_event",
+    "create_room_admin_changed_event",
+    "create_node_shutdown_event",
+    "create_redirect_event",
+    "create_presence_update_event",
+    "create_session_started_event",
+    "create_ping_event",
+    "create_removed_from_room_event",
+    "create_slow_consumer_event",
+    "create_waitlist_joined_event",
+    "create_waitlist_admitted_event",
+    "create_typing_event",
+    "create_read_position_updated_event",
+    "create_room_status_event",
+    "create_key_published_event",
     "create_error_response",
     "create_success_response",
     "create_join_error_response",
+    "create_invite_error_response",
+    "create_auth_error_response",
+    "create_rate_limited_response",
+    "create_validation_error_response",
+    "create_resume_error_response",
+    "create_history_error_response",
+    "create_moderation_error_response",
+    "create_message_edit_error_response",
+    "create_reaction_error_response",
+    "create_read_state_error_response",
+    "create_key_error_response",
+    "create_upload_error_response",
+    "create_search_error_response",
+    "create_webhook_error_response",
+    "create_bot_error_response",
+    "create_retention_error_response",
+    "create_pin_error_response",
+    "create_room_update_error_response",
+    "create_spam_error_response",
+    "create_filter_error_response",
+    "create_push_error_response",
+    "create_mutes_error_response",
+    "create_block_error_response",
+    "create_schedule_error_response",
+    "create_stats_error_response",
+    "CLIENT_PROTOCOL_VERSION",
+    "COMMAND_CATALOG",
+    "EVENT_CATALOG",
+    "CommandSpec",
+    "protocol_info",
+    "ERROR_CATALOG",
+    "ErrorSpec",
+    "describe_error",
+    "error_fields",
 ]
@@ -0,0 +1,754 @@
+"""
+Message Catalog
+
+The client protocol in one machine-readable place: every command a
+client can send over WebSocket, with the fields of its data and their
+JSON types, the fields it requires, the responses it gets and the type it
+reports errors with, and every event the node pushes on its own.
+
+The catalog is the source the rest of the node works from: request
+validation (utils/validation.py) checks required fields and field types
+against it, ERROR_RESPONSE_TYPES (responses.py) is read from it, and the
+protocol_info command hands it to clients, each command also as a JSON
+Schema, so they can discover at runtime what the node they're connected
+to supports. A command registered on the WebSocket server without an
+entry here is a bug.
+
+Version history of the client protocol:
+
+1. The first catalogued protocol
+2. pong and the ping event, stats, pin_message and unpin_message
+3. update_room and the room_updated event
+4. register_push_token and unregister_push_token
+5. set_spam_thresholds and the spam_detected and spam_thresholds_changed
+   events
+6. set_content_filters and the content_filters_changed event
+7. delete_account
+8. the room_archived event, and archived in history responses
+9. block_user
+10. send_at of send_message and the message_scheduled response,
+    list_scheduled and cancel_scheduled
+11. mentions in messages and the mention event
+12. placement of create_room
+13. durable of create_room, durable and replicas in message_sent, and
+    message_id in message_error
+14. category and retryable in error responses, and the error catalog in
+    protocol_info
+15. sequences of pong, and retransmitted in new_message
+16. service_login
+"""
+
+from dataclasses import dataclass, field
+from typing import Any, Dict, Optional, Tuple
+
+from .errors import error_catalog
+
+# Version of the client protocol described by the catalog
+CLIENT_PROTOCOL_VERSION = 16
+
+JSON_SCHEMA_DIALECT = "https://json-schema.org/draft/2020-12/schema"
+
+# JSON type name -> Python types of its parsed values
+JSON_TYPES: Dict[str, Tuple[type, ...]] = {
+    "string": (str,),
+    "integer": (int,),
+    "number": (int, float),
+    "boolean": (bool,),
+    "array": (list,),
+    "object": (dict,),
+}
+
+
+@dataclass(frozen=True)
+class CommandSpec:
+    """
+    One command clients can send.
+
+    Attributes:
+        description: What the command does
+        fields: Fields of the request data -> JSON type (None for fields
+            whose values the command checks itself)
+        required: Fields the command needs, as non-empty strings
+        responses: Types of the responses sent back on success
+        error: Type of the response reporting a failure
+        since: Client protocol version that added the command
+    """
+
+    description: str
+    fields: Dict[str, Optional[str]] = field(default_factory=dict)
+    required: Tuple[str, ...] = ()
+    responses: Tuple[str, ...] = ()
+    error: str = "error"
+    since: int = 1
+
+    def json_schema(self, message_type: str) -> Dict[str, Any]:
+        """
+        Describe a message of the command as a JSON Schema.
+
+        Args:
+            message_type: The command's name
+
+        Returns:
+            dict: Schema of the whole message ({"type", "data"})
+        """
+        properties = {}
+        for name, json_type in self.fields.items():
+            properties[name] = {"type": json_type} if json_type else {}
+            if name in self.required:
+                properties[name]["minLength"] = 1
+        return {
+            "$schema": JSON_SCHEMA_DIALECT,
+            "title": message_type,
+            "description": self.description,
+            "type": "object",
+            "required": ["type"],
+            "properties": {
+                "type": {"const": message_type},
+                "correlation_id": {"type": "string"},
+                "data": {
+                    "type": "object",
+                    "required": list(self.required),
+                    "properties": properties,
+                },
+            },
+        }
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return {
+            "description": self.description,
+            "fields": dict(self.fields),
+            "required": list(self.required),
+            "responses": list(self.responses),
+            "error": self.error,
+            "since": self.since,
+        }
+
+
+# Fields of commands acting on a room as one of its members
+_ROOM = {"room_id": "string", "username": "string"}
+_ROOM_REQUIRED = ("room_id", "username")
+_MODERATION = dict(_ROOM, target="string")
+_MODERATION_REQUIRED = _ROOM_REQUIRED + ("target",)
+_CREDENTIALS = {"username": "string", "password": "string"}
+
+COMMAND_CATALOG: Dict[str, CommandSpec] = {
+    "protocol_info": CommandSpec(
+        "Describe the client protocol the node speaks",
+        {"schemas": "boolean"},
+        responses=("protocol_info",),
+    ),
+    "pong": CommandSpec(
+        "Answer a ping from the node, reporting the stream positions",
+        {"sequences": "object"},
+        since=2,
+    ),
+    "register": CommandSpec(
+        "Create an account",
+        _CREDENTIALS,
+        ("username", "password"),
+        ("register_success",),
+        "register_error",
+    ),
+    "login": CommandSpec(
+        "Log in and get a session token",
+        _CREDENTIALS,
+        ("username", "password"),
+        ("login_success",),
+        "login_error",
+    ),
+    "logout": CommandSpec(
+        "End the session of the message's or the connection's token",
+        responses=("logout_success",),
+        error="logout_error",
+    ),
+    "delete_account": CommandSpec(
+        "Delete an account and release its username",
+        _CREDENTIALS,
+        ("username", "password"),
+        ("account_deleted",),
+        "delete_account_error",
+        since=7,
+    ),
+    "bot_login": CommandSpec(
+        "Log a bot in with its API key",
+        {"bot_name": "string", "api_key": "string"},
+        ("bot_name", "api_key"),
+        ("bot_login_success",),
+        "bot_error",
+    ),
+    "service_login": CommandSpec(
+        "Log a service account in with its API key",
+        {"account": "string", "api_key": "string"},
+        ("account", "api_key"),
+        ("service_login_success",),
+        "service_login_error",
+        since=16,
+    ),
+    "list_rooms": CommandSpec(
+        "List the rooms of this node, or of the cluster",
+        {"scope": "string"},
+        responses=("rooms_list",),
+    ),
+    "discover_rooms": CommandSpec(
+        "List the rooms of every reachable node",
+        responses=("global_rooms_list",),
+    ),
+    "create_room": CommandSpec(
+        "Create a room administered by this node",
+        {
+            "room_name": "string",
+            "creator_id": "string",
+            "description": "string",
+            "max_members": None,
+            "waitlist": None,
+            "private": None,
+            "total_order": None,
+            "announcement": None,
+            "delivery": "string",
+            "ephemeral": None,
+            "placement": "object",
+            "durable": None,
+        },
+        ("room_name", "creator_id"),
+        ("room_created",),
+        "room_created",
+    ),
+    "join_room": CommandSpec(
+        "Join a room",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("join_room_success", "waitlist_joined"),
+        "join_room_error",
+    ),
+    "join_by_invite": CommandSpec(
+        "Join a private room with an invite token",
+        {"invite_token": "string", "username": "string"},
+        ("invite_token", "username"),
+        ("join_room_success", "waitlist_joined"),
+        "join_room_error",
+    ),
+    "create_invite": CommandSpec(
+        "Create an invite token for a private room",
+        dict(_ROOM, invitee="string"),
+        _ROOM_REQUIRED,
+        ("invite_created",),
+        "invite_error",
+    ),
+    "revoke_invite": CommandSpec(
+        "Revoke an invite token",
+        {"invite_token": "string", "username": "string"},
+        ("invite_token", "username"),
+        ("invite_revoked",),
+        "invite_error",
+    ),
+    "leave_room": CommandSpec(
+        "Leave a room",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("leave_room_success",),
+    ),
+    "delete_room": CommandSpec(
+        "Delete a room everywhere with two-phase commit",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("delete_room_initiated", "delete_room_success"),
+        "delete_room_failed",
+    ),
+    "get_history": CommandSpec(
+        "Page through a room's messages, or a thread's",
+        dict(
+            _ROOM, before=None, after=None, limit=None, thread_id="string"
+        ),
+        _ROOM_REQUIRED,
+        ("history",),
+        "history_error",
+    ),
+    "search": CommandSpec(
+        "Search a room's messages",
+        dict(
+            _ROOM,
+            query="string",
+            author="string",
+            since="string",
+            until="string",
+            limit=None,
+        ),
+        _ROOM_REQUIRED,
+        ("search_results",),
+        "search_error",
+    ),
+    "kick_user": CommandSpec(
+        "Remove a member from a room",
+        _MODERATION,
+        _MODERATION_REQUIRED,
+        ("user_kicked",),
+        "moderation_error",
+    ),
+    "ban_user": CommandSpec(
+        "Remove a member from a room and keep them out",
+        _MODERATION,
+        _MODERATION_REQUIRED,
+        ("user_banned",),
+        "moderation_error",
+    ),
+    "promote_member": CommandSpec(
+        "Make a member a moderator",
+        _MODERATION,
+        _MODERATION_REQUIRED,
+        ("role_changed",),
+        "moderation_error",
+    ),
+    "demote_member": CommandSpec(
+        "Make a moderator a plain member",
+        _MODERATION,
+        _MODERATION_REQUIRED,
+        ("role_changed",),
+        "moderation_error",
+    ),
+    "set_retention": CommandSpec(
+        "Set how long a room keeps its messages",
+        dict(_ROOM, retention=None),
+        _ROOM_REQUIRED,
+        ("retention_set",),
+        "retention_error",
+    ),
+    "set_spam_thresholds": CommandSpec(
+        "Change a room's spam detection thresholds as its owner or a "
+        "moderator",
+        dict(
+            _ROOM,
+            duplicate_limit="integer",
+            mention_limit="integer",
+            window="integer",
+            mute_duration="integer",
+        ),
+        _ROOM_REQUIRED,
+        ("spam_thresholds_set",),
+        "spam_error",
+        since=5,
+    ),
+    "set_content_filters": CommandSpec(
+        "Replace a room's content filters as its owner or a moderator",
+        dict(_ROOM, filters="array"),
+        _ROOM_REQUIRED,
+        ("content_filters_set",),
+        "filter_error",
+        since=6,
+    ),
+    "update_room": CommandSpec(
+        "Change a room's name, topic or description as its owner or a "
+        "moderator",
+        dict(_ROOM, room_name="string", topic=None, description=None),
+        _ROOM_REQUIRED,
+        ("update_room_success",),
+        "room_update_error",
+        since=3,
+    ),
+    "send_message": CommandSpec(
+        "Send a message to a room",
+        dict(
+            _ROOM,
+            content="string",
+            message_id="string",
+            reply_to=None,
+            attachments=None,
+            encryption=None,
+            send_at="string",
+        ),
+        _ROOM_REQUIRED,
+        ("message_sent", "message_scheduled"),
+        "message_error",
+    ),
+    "list_scheduled": CommandSpec(
+        "List one's messages scheduled in a room (everyone's for "
+        "moderators)",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("scheduled_messages",),
+        "schedule_error",
+        since=10,
+    ),
+    "cancel_scheduled": CommandSpec(
+        "Cancel a message scheduled in a room",
+        dict(_ROOM, message_id="string"),
+        _ROOM_REQUIRED + ("message_id",),
+        ("scheduled_cancelled",),
+        "schedule_error",
+        since=10,
+    ),
+    "edit_message": CommandSpec(
+        "Change the content of one's message",
+        dict(_ROOM, message_id="string", content="string"),
+        _ROOM_REQUIRED + ("message_id",),
+        ("edit_message_success",),
+        "message_edit_error",
+    ),
+    "delete_message": CommandSpec(
+        "Delete one's message, or any as a moderator",
+        dict(_ROOM, message_id="string"),
+        _ROOM_REQUIRED + ("message_id",),
+        ("delete_message_success",),
+        "message_edit_error",
+    ),
+    "pin_message": CommandSpec(
+        "Pin a message to a room as its owner or a moderator",
+        dict(_ROOM, message_id="string"),
+        _ROOM_REQUIRED + ("message_id",),
+        ("pin_message_success",),
+        "pin_error",
+        since=2,
+    ),
+    "unpin_message": CommandSpec(
+        "Unpin a pinned message as the room's owner or a moderator",
+        dict(_ROOM, message_id="string"),
+        _ROOM_REQUIRED + ("message_id",),
+        ("unpin_message_success",),
+        "pin_error",
+        since=2,
+    ),
+    "react": CommandSpec(
+        "Add or remove an emoji reaction to a message",
+        dict(_ROOM, message_id="string", emoji="string", remove=None),
+        _ROOM_REQUIRED + ("message_id", "emoji"),
+        ("react_success",),
+        "reaction_error",
+    ),
+    "message_received": CommandSpec(
+        "Acknowledge the delivery of a message",
+        dict(_ROOM, message_id="string"),
+        ("room_id", "message_id", "username"),
+        error="message_error",
+    ),
+    "typing": CommandSpec(
+        "Tell a room's members one is typing",
+        dict(_ROOM, typing=None),
+        _ROOM_REQUIRED,
+        error="message_error",
+    ),
+    "mark_read": CommandSpec(
+        "Move one's read position in a room",
+        dict(_ROOM, sequence_number=None),
+        _ROOM_REQUIRED,
+        ("mark_read_success",),
+        "read_state_error",
+    ),
+    "get_read_state": CommandSpec(
+        "Get the read positions of a room's members",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("read_state",),
+        "read_state_error",
+    ),
+    "publish_key": CommandSpec(
+        "Publish one's public key for an encrypted room",
+        dict(
+            _ROOM, key_id="string", public_key="string", algorithm="string"
+        ),
+        _ROOM_REQUIRED,
+        ("publish_key_success",),
+        "key_error",
+    ),
+    "get_room_keys": CommandSpec(
+        "Get the public keys of an encrypted room's members",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("room_keys",),
+        "key_error",
+    ),
+    "start_upload": CommandSpec(
+        "Start or resume uploading an attachment",
+        dict(
+            _ROOM,
+            hash="string",
+            size=None,
+            content_type="string",
+            filename="string",
+        ),
+        _ROOM_REQUIRED + ("hash",),
+        ("upload_started", "upload_complete"),
+        "upload_error",
+    ),
+    "upload_chunk": CommandSpec(
+        "Send a chunk of an attachment",
+        {
+            "upload_id": "string",
+            "username": "string",
+            "offset": None,
+            "data": None,
+        },
+        ("upload_id", "username"),
+        ("upload_progress",),
+        "upload_error",
+    ),
+    "finish_upload": CommandSpec(
+        "Finish uploading an attachment",
+        {"upload_id": "string", "username": "string"},
+        ("upload_id", "username"),
+        ("upload_complete",),
+        "upload_error",
+    ),
+    "get_attachment": CommandSpec(
+        "Download a chunk of an attachment",
+        dict(_ROOM, hash="string", offset=None),
+        _ROOM_REQUIRED + ("hash",),
+        ("attachment_chunk",),
+        "upload_error",
+    ),
+    "register_webhook": CommandSpec(
+        "Register an outgoing webhook for a room",
+        dict(_ROOM, url="string", events=None),
+        _ROOM_REQUIRED + ("url",),
+        ("webhook_registered",),
+        "webhook_error",
+    ),
+    "remove_webhook": CommandSpec(
+        "Remove a room's webhook",
+        dict(_ROOM, webhook_id="string"),
+        _ROOM_REQUIRED + ("webhook_id",),
+        ("webhook_removed",),
+        "webhook_error",
+    ),
+    "list_webhooks": CommandSpec(
+        "List a room's webhooks",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("webhooks",),
+        "webhook_error",
+    ),
+    "add_bridge": CommandSpec(
+        "Bridge a room to an IRC channel or Matrix room",
+        dict(_ROOM, protocol="string", settings=None),
+        _ROOM_REQUIRED + ("protocol",),
+        ("bridge_added",),
+        "bridge_error",
+    ),
+    "remove_bridge": CommandSpec(
+        "Remove a room's bridge",
+        dict(_ROOM, bridge_id="string"),
+        _ROOM_REQUIRED + ("bridge_id",),
+        ("bridge_removed",),
+        "bridge_error",
+    ),
+    "list_bridges": CommandSpec(
+        "List a room's bridges",
+        _ROOM,
+        _ROOM_REQUIRED,
+        ("bridges",),
+        "bridge_error",
+    ),
+    "register_bot": CommandSpec(
+        "Register a bot and get its API key",
+        {"username": "string", "bot_name": "string", "commands": None},
+        ("username", "bot_name"),
+        ("bot_registered",),
+        "bot_error",
+    ),
+    "remove_bot": CommandSpec(
+        "Remove one's bot",
+        {"username": "string", "bot_name": "string"},
+        ("username", "bot_name"),
+        ("bot_removed",),
+        "bot_error",
+    ),
+    "list_bots": CommandSpec(
+        "List one's bots",
+        {"username": "string"},
+        ("username",),
+        ("bots",),
+        "bot_error",
+    ),
+    "send_direct_message": CommandSpec(
+        "Send a private message to a user",
+        {"username": "string", "recipient": "string", "content": "string"},
+        ("username", "recipient"),
+        ("direct_message_sent",),
+        "direct_message_error",
+    ),
+    "announce_presence": CommandSpec(
+        "Announce one is online",
+        {"username": "string"},
+        ("username",),
+        ("presence_announced",),
+        "presence_error",
+    ),
+    "set_status": CommandSpec(
+        "Set one's presence status",
+        {"username": "string", "status": "string"},
+        ("username", "status"),
+        ("status_updated",),
+        "status_error",
+    ),
+    "get_presence": CommandSpec(
+        "Get the presence of a room's members or of users",
+        {"room_id": "string", "usernames": None},
+        responses=("presence",),
+        error="presence_error",
+    ),
+    "resume_session": CommandSpec(
+        "Resume a held session and receive the missed messages",
+        {"session_id": "string", "username": "string", "last_seen": None},
+        responses=("session_resumed",),
+        error="resume_error",
+    ),
+    "update_profile": CommandSpec(
+        "Change one's profile",
+        {
+            "username": "string",
+            "display_name": None,
+            "avatar_url": None,
+            "avatar_hash": None,
+            "bio": None,
+        },
+        ("username",),
+        ("update_profile_success",),
+        "profile_error",
+    ),
+    "register_push_token": CommandSpec(
+        "Register a device's push token for notifications while offline",
+        {"username": "string", "token": "string", "platform": "string"},
+        ("username", "token", "platform"),
+        ("push_token_registered",),
+        "push_error",
+        since=4,
+    ),
+    "unregister_push_token": CommandSpec(
+        "Stop push notifications to a device",
+        {"username": "string", "token": "string"},
+        ("username", "token"),
+        ("push_token_unregistered",),
+        "push_error",
+        since=4,
+    ),
+    "get_profile": CommandSpec(
+        "Get the profiles of a room's members or of users",
+        {"room_id": "string", "usernames": None},
+        responses=("profiles",),
+        error="profile_error",
+    ),
+    "update_mutes": CommandSpec(
+        "Mute or unmute rooms and users",
+        {
+            "username": "string",
+            "mute_rooms": None,
+            "unmute_rooms": None,
+            "mute_users": None,
+            "unmute_users": None,
+            "filter_muted_users": None,
+        },
+        ("username",),
+        ("mutes_updated",),
+        "mutes_error",
+    ),
+    "block_user": CommandSpec(
+        "Block or unblock a user on every node and device",
+        {"username": "string", "user": "string", "unblock": "boolean"},
+        ("username", "user"),
+        ("blocks_updated",),
+        "block_error",
+        since=9,
+    ),
+    "stats": CommandSpec(
+        "Get message throughput, members and delivery latency of the "
+        "cluster's rooms",
+        {"room_id": "string"},
+        responses=("stats",),
+        error="stats_error",
+        since=2,
+    ),
+}
+
+# Events the node sends without being asked -> what they report
+EVENT_CATALOG: Dict[str, str] = {
+    "new_message": "A message was sent to one of the client's rooms",
+    "message_status": "A sent message was delivered or read",
+    "message_edited": "A message's content was changed",
+    "message_deleted": "A message was deleted",
+    "message_pinned": "A message was pinned to one of the client's rooms",
+    "message_unpinned": "A pinned message was unpinned",
+    "message_reaction": "A reaction was added to or removed from a message",
+    "thread_updated": "A thread got a reply",
+    "mention": "A message mentioned the client's user, also in a muted room",
+    "direct_message": "A private message for the client's user",
+    "typing": "A member started or stopped typing",
+    "read_position_updated": "A member's read position moved",
+    "member_joined": "A user joined one of the client's rooms",
+    "member_left": "A user left one of the client's rooms",
+    "member_role_changed": "A member became a moderator or plain member",
+    "removed_from_room": "The client's user was kicked or banned",
+    "waitlist_admitted": "A waitlisted user got a place in a full room",
+    "retention_changed": "A room's retention policy changed",
+    "spam_thresholds_changed": "A room's spam detection thresholds changed",
+    "spam_detected": "A member was muted for spam (moderators only)",
+    "content_filters_changed": "A room's content filters changed",
+    "room_updated": "A room's name, topic or description changed",
+    "key_published": "A member published a public key",
+    "profile_updated": "A user sharing a room changed their profile (or "
+    "the client's user changed theirs, with their block list)",
+    "presence_update": "A user's presence changed",
+    "room_status": "A room became degraded or healthy again",
+    "room_admin_changed": "Another node took over administering a room",
+    "delete_room_initiated": "A room's deletion started",
+    "delete_room_cancelled": "A room's deletion was aborted",
+    "room_deleted": "A room was deleted",
+    "room_archived": "A room was archived and became read-only",
+    "session_started": "The connection's session and its ID",
+    "ping": "The node checks the client is there; answer with pong",
+    "slow_consumer": "Messages were dropped for a client reading too slowly",
+    "redirect": "A less loaded node to connect to",
+    "node_shutdown": "The node is shutting down",
+    "rate_limited": "A message was refused for exceeding the rate limit",
+    "auth_error": "A message needed a valid session token",
+    "error": "A message couldn't be handled",
+}
+
+
+def required_fields() -> Dict[str, Tuple[str, ...]]:
+    """
+    Get the fields each command requires.
+
+    Returns:
+        dict: Command -> required fields, for commands that have any
+    """
+    return {
+        message_type: spec.required
+        for message_type, spec in COMMAND_CATALOG.items()
+        if spec.required
+    }
+
+
+def error_response_types() -> Dict[str, str]:
+    """
+    Get the response type each command reports its errors with.
+
+    Returns:
+        dict: Command -> error response type
+    """
+    return {
+        message_type: spec.error
+        for message_type, spec in COMMAND_CATALOG.items()
+    }
+
+
+def protocol_info(schemas: bool = False) -> Dict[str, Any]:
+    """
+    Describe the client protocol for the protocol_info command.
+
+    Args:
+        schemas: Whether to include each command's JSON Schema
+
+    Returns:
+        dict: The protocol version, the commands, the events and the
+        error codes
+    """
+    commands = {}
+    for message_type, spec in sorted(COMMAND_CATALOG.items()):
+        commands[message_type] = spec.to_dict()
+        if schemas:
+            commands[message_type]["schema"] = spec.json_schema(message_type)
+    return {
+        "protocol_version": CLIENT_PROTOCOL_VERSION,
+        "commands": commands,
+        "events": dict(sorted(EVENT_CATALOG.items())),
+        "errors": error_catalog(),
+    }
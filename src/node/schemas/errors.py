@@ -0,0 +1,355 @@
+"""
+Error Catalog
+
+Every error code the node reports, to clients over WebSocket, to peers in
+XML-RPC results and to operators through the admin API, with what kind
+of error it is and whether repeating the request can succeed. Error
+responses carry the code's category and retryable flag next to the free-
+form error message, so clients and peers can decide what to do about an
+error by its code rather than by parsing its text:
+
+- Retryable errors (a peer unavailable, a room migrating, a rate limit)
+  may succeed when the same request is sent again, after a backoff or
+  the retry_after the response names.
+- Errors that aren't retryable fail the same way until something else
+  changes: the request itself, the user's permissions or the room.
+
+Codes missing from the catalog are reported in the internal category,
+not retryable. The protocol_info command hands the catalog to clients
+(see catalog.py).
+"""
+
+from dataclasses import asdict, dataclass
+from typing import Any, Dict, Optional
+
+# Error categories
+INVALID_REQUEST = "invalid_request"  # the request is malformed
+UNAUTHENTICATED = "unauthenticated"  # no valid credentials
+FORBIDDEN = "forbidden"  # the user may not do this
+NOT_FOUND = "not_found"  # what the request names doesn't exist
+CONFLICT = "conflict"  # the request clashes with the current state
+LIMIT_EXCEEDED = "limit_exceeded"  # a quota or rate limit was hit
+UNAVAILABLE = "unavailable"  # a node or room can't answer right now
+UNSUPPORTED = "unsupported"  # the node doesn't offer the feature
+INTERNAL = "internal"  # the node failed
+
+CATEGORIES = (
+    INVALID_REQUEST,
+    UNAUTHENTICATED,
+    FORBIDDEN,
+    NOT_FOUND,
+    CONFLICT,
+    LIMIT_EXCEEDED,
+    UNAVAILABLE,
+    UNSUPPORTED,
+    INTERNAL,
+)
+
+
+@dataclass(frozen=True)
+class ErrorSpec:
+    """
+    One error code.
+
+    Attributes:
+        code: The error code (e.g., "ROOM_NOT_FOUND")
+        category: What kind of error it is (see CATEGORIES)
+        retryable: Whether repeating the request can succeed
+        message: What the error means, for people
+    """
+
+    code: str
+    category: str
+    retryable: bool
+    message: str
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+
+def _specs(category: str, retryable: bool, messages: Dict[str, str]):
+    """Build the specs of the codes in one category."""
+    return {
+        code: ErrorSpec(code, category, retryable, message)
+        for code, message in messages.items()
+    }
+
+
+ERROR_CATALOG: Dict[str, ErrorSpec] = {
+    **_specs(
+        INVALID_REQUEST,
+        False,
+        {
+            "INVALID_REQUEST": "The request is malformed",
+            "INVALID_JSON": "The message is not valid JSON",
+            "INVALID_PROTOCOL": "The protocol version is not supported",
+            "INVALID_HELLO": "The hello message is malformed",
+            "PROTOCOL_MISMATCH": "The nodes speak different protocols",
+            "PAYLOAD_TOO_LARGE": "The message is too large",
+            "BODY_TOO_LARGE": "The request body is too large",
+            "UNKNOWN_COMMAND": "The command is unknown",
+            "INVALID_ROOM_ID": "The room ID is invalid",
+            "INVALID_ROOM_NAME": "The room name is invalid",
+            "INVALID_USERNAME": "The username is invalid",
+            "INVALID_MESSAGE": "The message is invalid",
+            "INVALID_CONTENT": "The message content is invalid",
+            "INVALID_SEND_AT": "The scheduled send time is invalid",
+            "INVALID_QUERY": "The search query is invalid",
+            "INVALID_PROFILE": "The profile is invalid",
+            "INVALID_SETTINGS": "The settings are invalid",
+            "INVALID_RETENTION": "The retention policy is invalid",
+            "INVALID_ROLE": "The role is invalid",
+            "INVALID_EMOJI": "The reaction emoji is invalid",
+            "INVALID_RECEIPT": "The read receipt is invalid",
+            "INVALID_BLOCK": "The block is invalid",
+            "INVALID_KEY": "The encryption key is invalid",
+            "INVALID_CIPHERTEXT": "The encrypted message is invalid",
+            "MESSAGE_ENCRYPTED": "The message is encrypted",
+            "INVALID_ATTACHMENT": "The attachment is invalid",
+            "INVALID_CHUNK": "The upload chunk is invalid",
+            "INCOMPLETE_UPLOAD": "The upload is missing chunks",
+            "HASH_MISMATCH": "The upload does not match its hash",
+            "CHECKSUM_MISMATCH": "The data does not match its checksum",
+            "CORRUPT_BODY": "The request body is corrupt",
+            "UNSUPPORTED_ENCODING": "The encoding is not supported",
+            "INVALID_URL": "The URL is invalid",
+            "INVALID_EVENTS": "The webhook events are invalid",
+            "INVALID_PLATFORM": "The push platform is invalid",
+            "INVALID_BOT_NAME": "The bot name is invalid",
+            "INVALID_COMMANDS": "The bot commands are invalid",
+            "INVALID_INVITE": "The invite is invalid",
+            "INVALID_TARGET": "The target is invalid",
+            "INVALID_SNAPSHOT": "The snapshot is invalid",
+            "INVALID_CONFIG": "The configuration is invalid",
+            "INVALID_FIXTURE": "The fixture is invalid",
+            "INVALID_FAULT": "The fault is invalid",
+            "INVALID_ACCOUNT_NAME": "The service account name is invalid",
+            "INVALID_SCOPES": "The service account scopes are invalid",
+            "WEAK_PASSWORD": "The password is too weak",
+            "CONFIRMATION_REQUIRED": "The request must be confirmed",
+        },
+    ),
+    **_specs(
+        UNAUTHENTICATED,
+        False,
+        {
+            "AUTH_REQUIRED": "The request needs a signed-in user",
+            "INVALID_CREDENTIALS": "The username or password is wrong",
+            "INVALID_TOKEN": "The token is invalid",
+            "TOKEN_EXPIRED": "The token has expired",
+            "TOKEN_REVOKED": "The token was revoked",
+            "INVALID_API_KEY": "The API key is invalid",
+            "UNAUTHORIZED": "The request is not authorized",
+            "IDENTITY_MISMATCH": "The request names another user",
+        },
+    ),
+    **_specs(
+        FORBIDDEN,
+        False,
+        {
+            "NOT_ALLOWED": "The user may not do this",
+            "NOT_MEMBER": "The user is not a member of the room",
+            "NOT_A_MEMBER": "The user is not a member of the room",
+            "NOT_IN_ROOM": "The user is not in the room",
+            "BANNED": "The user is banned from the room",
+            "USER_MUTED": "The user is muted in the room",
+            "ROOM_PRIVATE": "The room is private",
+            "INVITE_REQUIRED": "The room needs an invite",
+            "INVITE_NOT_FOR_USER": "The invite is for another user",
+            "INVITE_REFUSED": "The invite was refused",
+            "READ_ONLY_ROOM": "The room is read-only",
+            "ROOM_READ_ONLY": "The room is read-only",
+            "MESSAGE_REJECTED": "The message was rejected",
+            "SPAM_DETECTED": "The message looks like spam",
+            "USERNAME_NOT_RESERVED": "The username is not reserved",
+            "METHOD_NOT_ALLOWED": "The method is not allowed",
+            "OUT_OF_SCOPE": "The service account may not do this",
+        },
+    ),
+    **_specs(
+        NOT_FOUND,
+        False,
+        {
+            "NOT_FOUND": "Not found",
+            "ROOM_NOT_FOUND": "The room does not exist",
+            "MESSAGE_NOT_FOUND": "The message does not exist",
+            "PARENT_NOT_FOUND": "The replied-to message does not exist",
+            "MESSAGE_DELETED": "The message was deleted",
+            "CLIENT_NOT_FOUND": "The client is not connected",
+            "INVITE_NOT_FOUND": "The invite does not exist",
+            "INVITE_EXPIRED": "The invite has expired",
+            "ATTACHMENT_NOT_FOUND": "The attachment does not exist",
+            "UPLOAD_NOT_FOUND": "The upload does not exist",
+            "BLOB_NOT_FOUND": "The blob does not exist",
+            "ARCHIVE_NOT_FOUND": "The archive does not exist",
+            "SCHEDULED_NOT_FOUND": "The scheduled message does not exist",
+            "WEBHOOK_NOT_FOUND": "The webhook does not exist",
+            "BOT_NOT_FOUND": "The bot does not exist",
+            "ACCOUNT_NOT_FOUND": "The service account does not exist",
+            "BRIDGE_NOT_FOUND": "The bridge does not exist",
+            "TRANSACTION_NOT_FOUND": "The transaction does not exist",
+            "UNKNOWN_TRANSFER": "The transfer does not exist",
+        },
+    ),
+    **_specs(
+        CONFLICT,
+        False,
+        {
+            "ROOM_EXISTS": "The room already exists",
+            "ROOM_NAME_TAKEN": "The room name is taken",
+            "USERNAME_TAKEN": "The username is taken",
+            "BOT_NAME_TAKEN": "The bot name is taken",
+            "ACCOUNT_NAME_TAKEN": "The service account name is taken",
+            "COMMAND_TAKEN": "The bot command is taken",
+            "DUPLICATE_MESSAGE_ID": "The message ID was already used",
+            "DUPLICATE_NODE_ID": "The node ID is already in use",
+            "ADMIN_CONFLICT": "Another node administers the room",
+            "INVALID_STATE": "The room is in the wrong state",
+            "ROOM_NOT_PRIVATE": "The room is not private",
+            "NOT_DEGRADED": "The room is not degraded",
+            "OUT_OF_ORDER": "The update arrived out of order",
+            "TRANSFER_MISMATCH": "The transfer does not match",
+            "INCOMPLETE_TRANSFER": "The transfer is incomplete",
+            "PLACEMENT_MISMATCH": "The node does not fit the placement",
+        },
+    ),
+    **_specs(
+        LIMIT_EXCEEDED,
+        False,
+        {
+            "ROOM_FULL": "The room is full",
+            "PIN_LIMIT": "The room has too many pinned messages",
+            "TOO_MANY_BLOCKS": "The user has blocked too many users",
+            "TOO_MANY_MUTES": "The user has muted too many rooms",
+            "TOO_MANY_BOTS": "The room has too many bots",
+            "TOO_MANY_BRIDGES": "The room has too many bridges",
+            "TOO_MANY_WEBHOOKS": "The room has too many webhooks",
+            "TOO_MANY_SCHEDULED": "Too many messages are scheduled",
+            "TOO_MANY_TOKENS": "The user has too many push tokens",
+            "TOO_MANY_UPLOADS": "Too many uploads are in progress",
+        },
+    ),
+    **_specs(
+        LIMIT_EXCEEDED,
+        True,
+        {
+            "RATE_LIMITED": "Too many requests; retry after a while",
+            "WAITLISTED": "The room is full; the user is on its waitlist",
+            "BUFFER_FULL": "The buffer is full; retry shortly",
+        },
+    ),
+    **_specs(
+        UNAVAILABLE,
+        True,
+        {
+            "ADMIN_NODE_UNAVAILABLE": "The room's admin node is unreachable",
+            "PEER_UNAVAILABLE": "The peer node is unreachable",
+            "NOT_LEADER": "The node is not the leader",
+            "QUORUM_NOT_REACHED": "Too few replicas acknowledged",
+            "TIMEOUT": "The request timed out",
+            "ROOM_MIGRATING": "The room is moving to another node",
+            "ROOM_MOVED": "The room moved to another node",
+            "MIGRATION_TIMEOUT": "Requests on the room did not finish",
+            "HANDOFF_FAILED": "The room could not be handed off",
+            "RESERVATION_FAILED": "The username could not be reserved",
+            "SENDER_OFFLINE": "The sender's node is unreachable",
+            "RECIPIENT_OFFLINE": "The recipient is offline",
+            "REPLICA_UNAVAILABLE": "The node has no up-to-date replica",
+            "REPLICA_INCOMPLETE": "The replica lacks older messages",
+        },
+    ),
+    **_specs(
+        UNSUPPORTED,
+        False,
+        {
+            "ATTACHMENTS_DISABLED": "Attachments are disabled",
+            "BOTS_DISABLED": "Bots are disabled",
+            "SERVICE_ACCOUNTS_DISABLED": "Service accounts are disabled",
+            "BRIDGES_DISABLED": "Bridges are disabled",
+            "WEBHOOKS_DISABLED": "Webhooks are disabled",
+            "FAULTS_DISABLED": "Fault injection is disabled",
+            "REPLICATION_DISABLED": "Replication is disabled",
+            "AUDIT_UNSUPPORTED": "The node keeps no audit log",
+            "DISCOVERY_UNSUPPORTED": "The node has no discovery",
+            "HANDOFF_UNSUPPORTED": "The node can't hand rooms off",
+            "PRESENCE_UNSUPPORTED": "The node tracks no presence",
+            "PROFILES_UNSUPPORTED": "The node keeps no profiles",
+            "PUSH_UNSUPPORTED": "The node sends no push notifications",
+            "RAFT_UNSUPPORTED": "The node runs no Raft registry",
+            "RELOAD_UNSUPPORTED": "The node can't reload its config",
+            "UNSUPPORTED_TRANSFER": "The transfer is not supported",
+        },
+    ),
+    **_specs(
+        INTERNAL,
+        False,
+        {
+            "INTERNAL_ERROR": "The node failed to handle the request",
+            "APPLY_FAILED": "The change could not be applied",
+            "ARCHIVE_FAILED": "The room could not be archived",
+            "DELETION_FAILED": "The deletion failed",
+            "UNKNOWN_ERROR": "An unknown error occurred",
+        },
+    ),
+}
+
+
+def describe_error(error_code: str) -> ErrorSpec:
+    """
+    Look up an error code.
+
+    Args:
+        error_code: The error code
+
+    Returns:
+        ErrorSpec: The code's spec; codes missing from the catalog are
+        internal errors, not retryable
+    """
+    spec = ERROR_CATALOG.get(error_code)
+    if spec is None:
+        return ErrorSpec(error_code, INTERNAL, False, "Unknown error code")
+    return spec
+
+
+def error_fields(error_code: str) -> Dict[str, Any]:
+    """
+    Get the fields describing an error code in an error response.
+
+    Args:
+        error_code: The error code
+
+    Returns:
+        dict: error_code, category and retryable
+    """
+    spec = describe_error(error_code)
+    return {
+        "error_code": error_code,
+        "category": spec.category,
+        "retryable": spec.retryable,
+    }
+
+
+def annotate_error(result: Any) -> Any:
+    """
+    Add the category and retryable flag to a result with an error code.
+
+    Args:
+        result: A result dict, or any other value (returned unchanged)
+
+    Returns:
+        The result; dicts with an error_code but no category are given
+        one, and the retryable flag, in place
+    """
+    if isinstance(result, dict):
+        error_code: Optional[str] = result.get("error_code")
+        if isinstance(error_code, str) and "category" not in result:
+            result.update(error_fields(error_code))
+    return result
+
+
+def error_catalog() -> Dict[str, Dict[str, Any]]:
+    """Describe every error code, for the protocol_info command."""
+    return {
+        code: spec.to_dict() for code, spec in sorted(ERROR_CATALOG.items())
+    }
@@ -5,7 +5,8 @@ Contains functions for creating standardized event data structures
 for member join/leave, room deletion, etc.
 """
 
-from typing import Dict, Any, Optional
+from datetime import datetime, timezone
+from typing import Dict, Any, List, Optional
 
 
 def create_member_joined_event(
@@ -13,6 +14,7 @@ def create_member_joined_event(
     username: str,
     member_count: int,
     timestamp: str,
+    hlc: Optional[str] = None,
 ) -> Dict[str, Any]:
     """
     Create a member_joined event data structure.
@@ -22,16 +24,20 @@ def create_member_joined_event(
         username: Username of the joining member
         member_count: Total member count after join
         timestamp: ISO 8601 timestamp
+        hlc: Optional encoded hybrid logical clock timestamp
 
     Returns:
         dict: Event data
     """
-    return {
+    event = {
         "room_id": room_id,
         "username": username,
         "member_count": member_count,
         "timestamp": timestamp,
     }
+    if hlc:
+        event["hlc"] = hlc
+    return event
 
 
 def create_member_left_event(
@@ -40,6 +46,7 @@ def create_member_left_event(
     member_count: int,
     timestamp: str,
     reason: Optional[str] = None,
+    hlc: Optional[str] = None,
 ) -> Dict[str, Any]:
     """
     Create a member_left event data structure.
@@ -50,6 +57,7 @@ def create_member_left_event(
         member_count: Total member count after leave
         timestamp: ISO 8601 timestamp
         reason: Optional reason for leaving
+        hlc: Optional encoded hybrid logical clock timestamp
 
     Returns:
         dict: Event data
@@ -62,9 +70,240 @@ def create_member_left_event(
     }
     if reason:
         event["reason"] = reason
+    if hlc:
+        event["hlc"] = hlc
     return event
 
 
+def create_member_role_changed_event(
+    room_id: str,
+    username: str,
+    role: str,
+    changed_by: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a member_role_changed event data structure.
+
+    Args:
+        room_id: Room ID where the role changed
+        username: Username of the promoted or demoted member
+        role: The member's new role
+        changed_by: Username of the room owner who changed it
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "username": username,
+        "role": role,
+        "changed_by": changed_by,
+        "timestamp": timestamp,
+    }
+
+
+def create_retention_changed_event(
+    room_id: str,
+    retention: List[str],
+    changed_by: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a retention_changed event data structure.
+
+    Args:
+        room_id: Room ID whose retention policy changed
+        retention: The room's new retention limits (empty for none)
+        changed_by: Username of the room owner who changed it
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "retention": list(retention),
+        "changed_by": changed_by,
+        "timestamp": timestamp,
+    }
+
+
+def create_spam_thresholds_changed_event(
+    room_id: str,
+    thresholds: Dict[str, int],
+    changed_by: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a spam_thresholds_changed event data structure.
+
+    Args:
+        room_id: Room ID whose spam thresholds changed
+        thresholds: The thresholds changed from their defaults
+        changed_by: Username of the owner or moderator who changed them
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "spam_thresholds": dict(thresholds),
+        "changed_by": changed_by,
+        "timestamp": timestamp,
+    }
+
+
+def create_content_filters_changed_event(
+    room_id: str,
+    filters: List[Dict[str, Any]],
+    changed_by: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a content_filters_changed event data structure.
+
+    Args:
+        room_id: Room ID whose content filters changed
+        filters: The room's filters, in the order they run
+        changed_by: Username of the owner or moderator who changed them
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "content_filters": [dict(f) for f in filters],
+        "changed_by": changed_by,
+        "timestamp": timestamp,
+    }
+
+
+def create_spam_detected_event(
+    room_id: str,
+    username: str,
+    reason: str,
+    muted_until: str,
+    moderators: List[str],
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a spam_detected event data structure.
+
+    Args:
+        room_id: Room ID the member flooded
+        username: The member muted
+        reason: The heuristic that caught them ("duplicate_burst" or
+            "mention_flood")
+        muted_until: ISO 8601 timestamp the mute ends
+        moderators: The room's owner and moderators, the only users the
+            event is delivered to
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "username": username,
+        "reason": reason,
+        "muted_until": muted_until,
+        "moderators": list(moderators),
+        "timestamp": timestamp,
+    }
+
+
+def create_pin_event(
+    room_id: str,
+    message_id: str,
+    pinned: List[str],
+    changed_by: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a message_pinned or message_unpinned event data structure.
+
+    Args:
+        room_id: Room ID of the message
+        message_id: ID of the message pinned or unpinned
+        pinned: IDs of the room's pinned messages, in the order pinned
+        changed_by: Username of the owner or moderator who changed it
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "message_id": message_id,
+        "pinned": list(pinned),
+        "changed_by": changed_by,
+        "timestamp": timestamp,
+    }
+
+
+def create_mention_event(
+    room_id: str, username: str, message: Dict[str, Any]
+) -> Dict[str, Any]:
+    """
+    Create a mention event data structure for a mentioned user.
+
+    Args:
+        room_id: Room ID of the message
+        username: The user mentioned
+        message: The message mentioning them (see mentions.py)
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "username": username,
+        "message_id": message.get("message_id", ""),
+        "sender": message.get("username", ""),
+        "content": message.get("content", ""),
+        "mentions": [
+            dict(m)
+            for m in message.get("mentions", ())
+            if m.get("username") == username
+        ],
+        "timestamp": message.get("timestamp", ""),
+    }
+
+
+def create_room_updated_event(
+    room_id: str,
+    changes: Dict[str, Optional[str]],
+    versions: Dict[str, str],
+    updated_by: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a room_updated event data structure.
+
+    Args:
+        room_id: Room ID
+        changes: Maps each changed field (room_name, topic, description)
+            -> its new value
+        versions: Maps each changed field -> encoded HLC timestamp
+        updated_by: Username of the owner or moderator who changed it
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "changes": dict(changes),
+        "versions": dict(versions),
+        "updated_by": updated_by,
+        "timestamp": timestamp,
+    }
+
+
 def create_delete_room_initiated_event(
     room_id: str,
     initiator: str,
@@ -121,3 +360,408 @@ def create_room_deleted_event(
         "type": "room_deleted",
         "data": data,
     }
+
+
+def create_room_archived_event(
+    room_id: str,
+    room_name: str,
+    archived_by: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a room_archived event data structure.
+
+    Args:
+        room_id: Room ID that was archived
+        room_name: Name of the archived room
+        archived_by: Who archived the room
+        timestamp: ISO 8601 timestamp
+
+    Returns:
+        dict: Event data
+    """
+    return {
+        "room_id": room_id,
+        "room_name": room_name,
+        "archived_by": archived_by,
+        "message": f"Room '{room_name}' has been archived and is read-only",
+        "timestamp": timestamp,
+    }
+
+
+def create_room_admin_changed_event(
+    room_id: str,
+    room_name: str,
+    admin_node: str,
+    previous_admin: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create a room_admin_changed event.
+
+    Args:
+        room_id: Room ID whose administrator changed
+        room_name: Name of the room
+        admin_node: Node ID of the new administrator
+        previous_admin: Node ID of the failed administrator
+
+    Returns:
+        dict: Event broadcast
+    """
+    data = {
+        "room_id": room_id,
+        "room_name": room_name,
+        "admin_node": admin_node,
+    }
+    if previous_admin:
+        data["previous_admin"] = previous_admin
+    return {
+        "type": "room_admin_changed",
+        "data": data,
+    }
+
+
+def create_node_shutdown_event(
+    node_id: str,
+    retry_after: float,
+    nodes: List[str],
+    rooms: Dict[str, str],
+    reconnect_urls: Optional[List[str]] = None,
+) -> Dict[str, Any]:
+    """
+    Create a node_shutdown event with a reconnect hint.
+
+    Args:
+        node_id: ID of the node shutting down
+        retry_after: Seconds the client should wait before reconnecting
+        nodes: IDs of live nodes the client can reconnect to
+        rooms: Maps the client's rooms to their new admin node IDs
+        reconnect_urls: Optional WebSocket URLs of the other nodes
+
+    Returns:
+        dict: Event broadcast
+    """
+    data = {
+        "node_id": node_id,
+        "message": f"Node {node_id} is shutting down",
+        "retry_after": retry_after,
+        "nodes": nodes,
+        "rooms": rooms,
+    }
+    if reconnect_urls:
+        data["reconnect_urls"] = reconnect_urls
+    return {
+        "type": "node_shutdown",
+        "data": data,
+    }
+
+
+def create_redirect_event(
+    node_id: str, target_node: str, url: str, reason: str = "overloaded"
+) -> Dict[str, Any]:
+    """
+    Create a redirect frame sent to a new client before closing it.
+
+    Args:
+        node_id: ID of the node turning the client away
+        target_node: ID of the node the client should connect to
+        url: WebSocket URL of that node
+        reason: Why the client is redirected
+
+    Returns:
+        dict: Event sent to the client
+    """
+    return {
+        "type": "redirect",
+        "data": {
+            "node_id": node_id,
+            "target_node": target_node,
+            "url": url,
+            "reason": reason,
+        },
+    }
+
+
+def create_presence_update_event(
+    room_id: str,
+    username: str,
+    status: str,
+    node_id: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a presence_update event for the clients in a room.
+
+    Args:
+        room_id: Room the user is a member of
+        username: User whose presence changed
+        status: New status ("online", "away" or "offline")
+        node_id: Node the user is (or was last) connected to
+        timestamp: ISO 8601 timestamp of the update
+
+    Returns:
+        dict: Event broadcast
+    """
+    return {
+        "type": "presence_update",
+        "data": {
+            "room_id": room_id,
+            "username": username,
+            "status": status,
+            "node_id": node_id,
+            "timestamp": timestamp,
+        },
+    }
+
+
+def create_session_started_event(
+    session_id: str,
+    client_id: str,
+    grace_period: float,
+) -> Dict[str, Any]:
+    """
+    Create a session_started event for a newly connected client.
+
+    Args:
+        session_id: Secret the client presents in resume_session after
+            reconnecting
+        client_id: ID the node assigned to the connection
+        grace_period: Seconds the session is held after a disconnect
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "session_started",
+        "data": {
+            "session_id": session_id,
+            "client_id": client_id,
+            "grace_period": grace_period,
+        },
+    }
+
+
+def create_ping_event(timeout: float, timestamp: str) -> Dict[str, Any]:
+    """
+    Create a ping event, which clients answer with a pong command.
+
+    Args:
+        timeout: Seconds of silence after which the client is stale
+        timestamp: ISO 8601 timestamp of the ping
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "ping",
+        "data": {"timeout": timeout, "timestamp": timestamp},
+    }
+
+
+def create_removed_from_room_event(
+    room_id: str,
+    action: str,
+    moderator: str,
+) -> Dict[str, Any]:
+    """
+    Create a removed_from_room event for a kicked or banned user.
+
+    Args:
+        room_id: Room ID the user was removed from
+        action: "kick" or "ban"
+        moderator: Username of the room creator who removed the user
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "removed_from_room",
+        "data": {
+            "room_id": room_id,
+            "action": action,
+            "moderator": moderator,
+        },
+    }
+
+
+def create_slow_consumer_event(
+    queue_depth: int,
+    queue_size: int,
+    policy: str,
+    dropped: int,
+) -> Dict[str, Any]:
+    """
+    Create a slow_consumer event for a client falling behind its rooms.
+
+    Args:
+        queue_depth: Messages queued for the client
+        queue_size: Messages the client's queue holds
+        policy: What the node does when the queue is full
+        dropped: Messages dropped for the client so far
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "slow_consumer",
+        "data": {
+            "queue_depth": queue_depth,
+            "queue_size": queue_size,
+            "policy": policy,
+            "dropped": dropped,
+        },
+    }
+
+
+def create_waitlist_joined_event(
+    room_id: str,
+    position: int,
+    max_members: int,
+) -> Dict[str, Any]:
+    """
+    Create a waitlist_joined event for a user queued for a full room.
+
+    Args:
+        room_id: Room ID the user is waiting for
+        position: The user's place on the waiting list (from 1)
+        max_members: Most members the room may have
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "waitlist_joined",
+        "data": {
+            "room_id": room_id,
+            "position": position,
+            "max_members": max_members,
+        },
+    }
+
+
+def create_waitlist_admitted_event(room_info: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Create a waitlist_admitted event for a waiting user who got a slot.
+
+    Args:
+        room_info: The room, as in a join_room_success response
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "waitlist_admitted",
+        "data": room_info,
+    }
+
+
+def create_typing_event(
+    room_id: str,
+    username: str,
+    typing: bool,
+    expires_in: float,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a typing event for the other clients in a room.
+
+    Args:
+        room_id: Room the user is typing in
+        username: The user typing
+        typing: True if the user started typing, False if they stopped
+        expires_in: Seconds until the indicator should be hidden
+        timestamp: ISO 8601 timestamp of the update
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "typing",
+        "data": {
+            "room_id": room_id,
+            "username": username,
+            "typing": typing,
+            "expires_in": expires_in,
+            "timestamp": timestamp,
+        },
+    }
+
+
+def create_read_position_updated_event(
+    room_id: str,
+    username: str,
+    sequence_number: int,
+    hlc: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create a read_position_updated event for a member who read messages.
+
+    Args:
+        room_id: Room ID of the messages
+        username: The member who read them
+        sequence_number: Sequence number of the last message they read
+        hlc: Hybrid logical clock timestamp of the change
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "read_position_updated",
+        "data": {
+            "room_id": room_id,
+            "username": username,
+            "sequence_number": sequence_number,
+            "hlc": hlc,
+        },
+    }
+
+
+def create_profile_updated_event(profile: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Create a profile_updated event for clients sharing a room with a user.
+
+    Args:
+        profile: The user's UserProfile dict (username, display_name,
+            avatar_url, avatar_hash, bio and hlc)
+
+    Returns:
+        dict: Event message
+    """
+    return {"type": "profile_updated", "data": dict(profile)}
+
+
+def create_room_status_event(status: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Create a room_status event telling clients a room is degraded or
+    healthy again.
+
+    Args:
+        status: The room's status (see PartitionManager.status): room_id,
+            status, and for degraded rooms mode, admin_node, reason and
+            buffered
+
+    Returns:
+        dict: Event message
+    """
+    data = dict(status, timestamp=datetime.now(timezone.utc).isoformat())
+    return {"type": "room_status", "data": data}
+
+
+def create_key_published_event(
+    room_id: str, key: Dict[str, Any], hlc: Optional[str] = None
+) -> Dict[str, Any]:
+    """
+    Create a key_published event for a member's new public key.
+
+    Args:
+        room_id: Room ID the key was published to
+        key: The key record (username, key_id, algorithm, public_key and
+            published_at)
+        hlc: Hybrid logical clock timestamp of the change
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "key_published",
+        "data": dict(key, room_id=room_id, hlc=hlc),
+    }
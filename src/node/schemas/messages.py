@@ -4,7 +4,10 @@ Message Schema Definitions
 Contains functions for creating standardized message data structures.
 """
 
-from typing import Dict, Any
+from typing import Dict, Any, Optional
+
+from ..edits import EDIT_EVENT_TYPES
+from .errors import error_fields
 
 
 def create_message_data(
@@ -14,6 +17,8 @@ def create_message_data(
     content: str,
     sequence_number: int,
     timestamp: str,
+    vector_clock: Optional[Dict[str, int]] = None,
+    origin_node: Optional[str] = None,
 ) -> Dict[str, Any]:
     """
     Create a standardized message data structure.
@@ -25,6 +30,8 @@ def create_message_data(
         content: Message content
         sequence_number: Sequential number assigned by room admin
         timestamp: ISO 8601 timestamp
+        vector_clock: Vector clock assigned by room admin
+        origin_node: Node the sender is connected to
 
     Returns:
         dict: Standardized message data
@@ -36,6 +43,8 @@ def create_message_data(
         "content": content,
         "sequence_number": sequence_number,
         "timestamp": timestamp,
+        "vector_clock": vector_clock or {},
+        "origin_node": origin_node,
     }
 
 
@@ -44,6 +53,8 @@ def create_message_sent_confirmation(
     message_id: str,
     sequence_number: int,
     timestamp: str,
+    vector_clock: Optional[Dict[str, int]] = None,
+    replicas: Optional[int] = None,
 ) -> Dict[str, Any]:
     """
     Create a message_sent confirmation response.
@@ -53,17 +64,62 @@ def create_message_sent_confirmation(
         message_id: ID of the sent message
         sequence_number: Assigned sequence number
         timestamp: Message timestamp
+        vector_clock: Assigned vector clock
+        replicas: Copies holding the message of a durable room, which
+            marks the confirmation durable (see durability.py)
 
     Returns:
         dict: Confirmation response
     """
-    return {
+    response = {
         "type": "message_sent",
         "data": {
             "room_id": room_id,
             "message_id": message_id,
             "sequence_number": sequence_number,
             "timestamp": timestamp,
+            "vector_clock": vector_clock or {},
+        },
+    }
+    if replicas is not None:
+        response["data"]["durable"] = True
+        response["data"]["replicas"] = replicas
+    return response
+
+
+def create_message_status_event(
+    room_id: str,
+    message_id: str,
+    status: str,
+    sequence_number: Optional[int] = None,
+    recipient: Optional[str] = None,
+    timestamp: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create a message_status event for the sender of a message.
+
+    Args:
+        room_id: Room ID where message was sent
+        message_id: ID of the message
+        status: "sent" once the room administrator accepted the message,
+            "buffered" while its room is degraded, or "delivered" once a
+            recipient's client confirmed receipt
+        sequence_number: Assigned sequence number, for "sent"
+        recipient: Username of the recipient, for "delivered"
+        timestamp: When the status was reached
+
+    Returns:
+        dict: Message status event
+    """
+    return {
+        "type": "message_status",
+        "data": {
+            "room_id": room_id,
+            "message_id": message_id,
+            "status": status,
+            "sequence_number": sequence_number,
+            "recipient": recipient,
+            "timestamp": timestamp,
         },
     }
 
@@ -72,6 +128,7 @@ def create_message_error(
     room_id: str,
     error: str,
     error_code: str,
+    message_id: Optional[str] = None,
 ) -> Dict[str, Any]:
     """
     Create a message_error response.
@@ -80,18 +137,23 @@ def create_message_error(
         room_id: Room ID where error occurred
         error: Error message
         error_code: Error code
+        message_id: ID of the message, if it was added but can't be
+            acknowledged yet (e.g., QUORUM_NOT_REACHED)
 
     Returns:
         dict: Error response
     """
-    return {
+    response = {
         "type": "message_error",
         "data": {
             "room_id": room_id,
             "error": error,
-            "error_code": error_code,
+            **error_fields(error_code),
         },
     }
+    if message_id:
+        response["data"]["message_id"] = message_id
+    return response
 
 
 def create_new_message_broadcast(
@@ -110,3 +172,149 @@ def create_new_message_broadcast(
         "type": "new_message",
         "data": message_data,
     }
+
+
+def create_message_edit_event(
+    room_id: str,
+    edit: Dict[str, Any],
+    hlc: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create a message_edited or message_deleted event.
+
+    Args:
+        room_id: Room ID of the message
+        edit: The applied edit record (message_id, action, content,
+            username, timestamp)
+        hlc: Hybrid logical clock timestamp of the change
+
+    Returns:
+        dict: Event message, typed by the edit's action
+    """
+    return {
+        "type": EDIT_EVENT_TYPES[edit["action"]],
+        "data": dict(edit, room_id=room_id, hlc=hlc),
+    }
+
+
+def create_message_reaction_event(
+    room_id: str,
+    reaction: Dict[str, Any],
+    reactions: Dict[str, Any],
+    hlc: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create a message_reaction event.
+
+    Args:
+        room_id: Room ID of the message
+        reaction: The applied reaction record (message_id, emoji,
+            username, action, timestamp)
+        reactions: The message's reactions afterwards (emoji ->
+            usernames)
+        hlc: Hybrid logical clock timestamp of the change
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "message_reaction",
+        "data": dict(reaction, room_id=room_id, reactions=reactions, hlc=hlc),
+    }
+
+
+def create_thread_updated_event(
+    room_id: str,
+    thread_id: str,
+    thread: Dict[str, Any],
+    hlc: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create a thread_updated event for a thread that got a reply.
+
+    Args:
+        room_id: Room ID of the thread
+        thread_id: ID of the thread's first message
+        thread: The thread summary (reply_count, last_reply_at)
+        hlc: Hybrid logical clock timestamp of the reply
+
+    Returns:
+        dict: Event message
+    """
+    return {
+        "type": "thread_updated",
+        "data": dict(thread, room_id=room_id, thread_id=thread_id, hlc=hlc),
+    }
+
+
+def create_direct_message_event(
+    message_data: Dict[str, Any],
+) -> Dict[str, Any]:
+    """
+    Create a direct_message event for the recipient.
+
+    Args:
+        message_data: Message data from DirectMessage.to_dict
+
+    Returns:
+        dict: Direct message event
+    """
+    return {
+        "type": "direct_message",
+        "data": message_data,
+    }
+
+
+def create_direct_message_sent_confirmation(
+    message_id: str,
+    recipient: str,
+    status: str,
+    timestamp: str,
+) -> Dict[str, Any]:
+    """
+    Create a direct_message_sent confirmation response.
+
+    Args:
+        message_id: ID of the sent message
+        recipient: Username of the recipient
+        status: "delivered", or "buffered" if the recipient is offline
+        timestamp: Message timestamp
+
+    Returns:
+        dict: Confirmation response
+    """
+    return {
+        "type": "direct_message_sent",
+        "data": {
+            "message_id": message_id,
+            "recipient": recipient,
+            "status": status,
+            "timestamp": timestamp,
+        },
+    }
+
+
+def create_direct_message_error(
+    recipient: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a direct_message_error response.
+
+    Args:
+        recipient: Username the message was addressed to
+        error: Error message
+        error_code: Error code
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "direct_message_error",
+        "data": {
+            "recipient": recipient,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
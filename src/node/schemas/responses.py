@@ -6,10 +6,17 @@ Contains functions for creating standardized response structures.
 
 from typing import Dict, Any, Optional
 
+from .catalog import error_response_types
+from .errors import error_fields
+
+# Response type each command reports its errors with
+ERROR_RESPONSE_TYPES = error_response_types()
+
 
 def create_error_response(
     error_message: str,
     error_type: str = "error",
+    error_code: Optional[str] = None,
 ) -> Dict[str, Any]:
     """
     Create a generic error response.
@@ -17,16 +24,20 @@ def create_error_response(
     Args:
         error_message: Error message text
         error_type: Type of error response
+        error_code: Optional error code (see errors.py)
 
     Returns:
         dict: Error response
     """
+    data = {
+        "success": False,
+        "message": error_message,
+    }
+    if error_code:
+        data.update(error_fields(error_code))
     return {
         "type": error_type,
-        "data": {
-            "success": False,
-            "message": error_message,
-        },
+        "data": data,
     }
 
 
@@ -79,6 +90,769 @@ def create_join_error_response(
         "data": {
             "room_id": room_id,
             "error": error,
-            "error_code": error_code,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_invite_error_response(
+    request_type: str,
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create an invite_error response for a failed invite command.
+
+    Args:
+        request_type: Type of the failed request (create_invite or
+            revoke_invite)
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "NOT_A_MEMBER", "INVITE_NOT_FOUND")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "invite_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_auth_error_response(
+    request_type: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create an auth_error response for a rejected client command.
+
+    Args:
+        request_type: Type of the rejected request
+        error: Error message
+        error_code: Error code (e.g., "AUTH_REQUIRED", "TOKEN_EXPIRED")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "auth_error",
+        "data": {
+            "request_type": request_type,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_rate_limited_response(
+    request_type: str,
+    limit: str,
+    retry_after: float,
+) -> Dict[str, Any]:
+    """
+    Create a rate_limited response for a command over its rate limit.
+
+    Args:
+        request_type: Type of the dropped request
+        limit: Which limit was hit ("connection" or "user")
+        retry_after: Seconds until the command may be sent again
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "rate_limited",
+        "data": {
+            "request_type": request_type,
+            "limit": limit,
+            "retry_after": round(retry_after, 3),
+            "error": f"Too many {request_type} requests",
+            **error_fields("RATE_LIMITED"),
+        },
+    }
+
+
+def create_validation_error_response(
+    request_type: Optional[str],
+    error: str,
+    error_code: str,
+    field: Optional[str] = None,
+    room_id: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create the response for a client message that failed validation.
+
+    The response has the type the command reports its other errors with
+    (see ERROR_RESPONSE_TYPES), or "error" for messages whose command is
+    unknown.
+
+    Args:
+        request_type: Type of the rejected request, if it could be read
+        error: Error message
+        error_code: Error code (e.g., "PAYLOAD_TOO_LARGE", "INVALID_ROOM_ID")
+        field: Request field at fault, if any
+        room_id: Room ID named by the request, if any
+
+    Returns:
+        dict: Error response
+    """
+    data = {
+        "success": False,
+        "request_type": request_type,
+        "message": error,
+        "error": error,
+        **error_fields(error_code),
+        "field": field,
+    }
+    if room_id is not None:
+        data["room_id"] = room_id
+    return {
+        "type": ERROR_RESPONSE_TYPES.get(request_type, "error"),
+        "data": data,
+    }
+
+
+def create_resume_error_response(
+    username: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a resume_error response for a session that can't be resumed.
+
+    Args:
+        username: The user who tried to resume
+        error: Error message
+        error_code: Error code (e.g., "SESSION_NOT_FOUND")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "resume_error",
+        "data": {
+            "username": username,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_history_error_response(
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a history_error response for a failed get_history request.
+
+    Args:
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "NOT_A_MEMBER", "MESSAGE_NOT_FOUND")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "history_error",
+        "data": {
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_read_state_error_response(
+    request_type: str,
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a read_state_error response for mark_read or get_read_state.
+
+    Args:
+        request_type: "mark_read" or "get_read_state"
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "NOT_IN_ROOM")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "read_state_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_moderation_error_response(
+    request_type: str,
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a moderation_error response for a failed moderation command.
+
+    Args:
+        request_type: Type of the failed request (kick_user, ban_user,
+            promote_member or demote_member)
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "NOT_ALLOWED", "NOT_IN_ROOM")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "moderation_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_message_edit_error_response(
+    request_type: str,
+    room_id: str,
+    message_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a message_edit_error response for a failed edit or deletion.
+
+    Args:
+        request_type: Type of the failed request (edit_message or
+            delete_message)
+        room_id: Room ID
+        message_id: ID of the message
+        error: Error message
+        error_code: Error code (e.g., "NOT_ALLOWED", "MESSAGE_NOT_FOUND")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "message_edit_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "message_id": message_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_reaction_error_response(
+    room_id: str,
+    message_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a reaction_error response for a failed react command.
+
+    Args:
+        room_id: Room ID
+        message_id: ID of the message
+        error: Error message
+        error_code: Error code (e.g., "INVALID_EMOJI", "MESSAGE_NOT_FOUND")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "reaction_error",
+        "data": {
+            "room_id": room_id,
+            "message_id": message_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_profile_error_response(
+    request_type: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a profile_error response for update_profile or get_profile.
+
+    Args:
+        request_type: "update_profile" or "get_profile"
+        error: Error message
+        error_code: Error code (e.g., "INVALID_PROFILE")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "profile_error",
+        "data": {
+            "request_type": request_type,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_stats_error_response(
+    room_id: Optional[str],
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a stats_error response for a failed stats request.
+
+    Args:
+        room_id: The room whose statistics were asked for, if any
+        error: Error message
+        error_code: Error code (e.g., "ROOM_NOT_FOUND")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "stats_error",
+        "data": {
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_mutes_error_response(
+    username: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a mutes_error response for a failed update_mutes request.
+
+    Args:
+        username: The user whose mutes were to change
+        error: Error message
+        error_code: Error code (e.g., "INVALID_MUTE", "TOO_MANY_MUTES")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "mutes_error",
+        "data": {
+            "username": username,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_block_error_response(
+    username: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a block_error response for a failed block_user request.
+
+    Args:
+        username: The user whose block list was to change
+        error: Error message
+        error_code: Error code (e.g., "INVALID_BLOCK", "TOO_MANY_BLOCKS")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "block_error",
+        "data": {
+            "username": username,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_key_error_response(
+    request_type: str,
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a key_error response for publish_key or get_room_keys.
+
+    Args:
+        request_type: "publish_key" or "get_room_keys"
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "ROOM_NOT_PRIVATE")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "key_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_upload_error_response(
+    request_type: str,
+    error: str,
+    error_code: str,
+    upload_id: Optional[str] = None,
+) -> Dict[str, Any]:
+    """
+    Create an upload_error response for an attachment upload or download.
+
+    Args:
+        request_type: "start_upload", "upload_chunk", "finish_upload" or
+            "get_attachment"
+        error: Error message
+        error_code: Error code (e.g., "HASH_MISMATCH")
+        upload_id: ID of the upload, if any
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "upload_error",
+        "data": {
+            "request_type": request_type,
+            "upload_id": upload_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_search_error_response(
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a search_error response for a failed search request.
+
+    Args:
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "INVALID_QUERY", "NOT_A_MEMBER")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "search_error",
+        "data": {
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_webhook_error_response(
+    request_type: str,
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a webhook_error response for a failed webhook request.
+
+    Args:
+        request_type: "register_webhook", "remove_webhook" or
+            "list_webhooks"
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "INVALID_URL", "NOT_ALLOWED")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "webhook_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_bot_error_response(
+    request_type: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a bot_error response for a failed bot request.
+
+    Args:
+        request_type: The request that failed (e.g., "bot_login")
+        error: Error message
+        error_code: Error code (e.g., "INVALID_API_KEY")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "bot_error",
+        "data": {
+            "request_type": request_type,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_bridge_error_response(
+    request_type: str,
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a bridge_error response for a failed bridge request.
+
+    Args:
+        request_type: "add_bridge", "remove_bridge" or "list_bridges"
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "INVALID_SETTINGS", "NOT_ALLOWED")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "bridge_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_schedule_error_response(
+    request_type: str,
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a schedule_error response for a failed scheduled message request.
+
+    Args:
+        request_type: "list_scheduled" or "cancel_scheduled"
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "SCHEDULED_NOT_FOUND", "NOT_ALLOWED")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "schedule_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_pin_error_response(
+    request_type: str,
+    room_id: str,
+    message_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a pin_error response for a failed pin or unpin.
+
+    Args:
+        request_type: Type of the failed request (pin_message or
+            unpin_message)
+        room_id: Room ID
+        message_id: ID of the message
+        error: Error message
+        error_code: Error code (e.g., "NOT_ALLOWED", "PIN_LIMIT")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "pin_error",
+        "data": {
+            "request_type": request_type,
+            "room_id": room_id,
+            "message_id": message_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_room_update_error_response(
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a room_update_error response for a failed update_room request.
+
+    Args:
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "NOT_ALLOWED", "ROOM_NAME_TAKEN")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "room_update_error",
+        "data": {
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_spam_error_response(
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a spam_error response for a failed set_spam_thresholds request.
+
+    Args:
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "INVALID_REQUEST", "NOT_ALLOWED")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "spam_error",
+        "data": {
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_filter_error_response(
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a filter_error response for a failed set_content_filters request.
+
+    Args:
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "INVALID_REQUEST", "NOT_ALLOWED")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "filter_error",
+        "data": {
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_push_error_response(
+    request_type: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a push_error response for a push token command.
+
+    Args:
+        request_type: "register_push_token" or "unregister_push_token"
+        error: Error message
+        error_code: Error code (e.g., "INVALID_TOKEN")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "push_error",
+        "data": {
+            "request_type": request_type,
+            "error": error,
+            **error_fields(error_code),
+        },
+    }
+
+
+def create_retention_error_response(
+    room_id: str,
+    error: str,
+    error_code: str,
+) -> Dict[str, Any]:
+    """
+    Create a retention_error response for a failed set_retention request.
+
+    Args:
+        room_id: Room ID
+        error: Error message
+        error_code: Error code (e.g., "INVALID_RETENTION", "NOT_ALLOWED")
+
+    Returns:
+        dict: Error response
+    """
+    return {
+        "type": "retention_error",
+        "data": {
+            "room_id": room_id,
+            "error": error,
+            **error_fields(error_code),
         },
     }
@@ -0,0 +1,287 @@
+"""
+Message Search
+
+Clients search a room's history with the search command: words that must
+all appear in a message (case-insensitively, as whole words), optionally
+narrowed to one author and to a time range. Results are newest first, up
+to a limit, with the total number of matches.
+
+The room's administrator node answers searches from an inverted index of
+the room's messages (word -> message IDs). A room's index is built from
+its full history (the message log when there is one) on its first
+search, and kept up to date as messages are committed, edited and
+deleted. It is rebuilt on the next search after the room's history is
+replaced (recovery, compaction, a snapshot or failover). Other nodes
+forward search to the administrator with the search_room RPC.
+
+Encrypted messages are never indexed: the node can't read them.
+"""
+
+import re
+from datetime import datetime, timezone
+from typing import Callable, Dict, Iterable, List, Optional, Set
+
+from .edits import DELETE, apply_edit
+
+# Search configuration
+SEARCH_LIMIT = 20  # results when the client gives no limit
+MAX_SEARCH_LIMIT = 100  # most results a client may ask for
+MAX_QUERY_LENGTH = 200  # characters
+MAX_QUERY_TERMS = 10
+
+_WORD = re.compile(r"\w+")
+
+
+class SearchError(Exception):
+    """A search request was refused."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_QUERY")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def tokenize(text: str) -> List[str]:
+    """Split text into lowercase words, in order, without repeats."""
+    return list(dict.fromkeys(_WORD.findall((text or "").casefold())))
+
+
+def parse_time(value) -> Optional[datetime]:
+    """
+    Parse an ISO 8601 time filter (UTC if it has no offset).
+
+    Args:
+        value: The time, or None/"" for no filter
+
+    Returns:
+        The time, or None for no filter
+
+    Raises:
+        SearchError: If the value isn't an ISO 8601 time (INVALID_QUERY)
+    """
+    if not value:
+        return None
+    try:
+        parsed = datetime.fromisoformat(value)
+    except (TypeError, ValueError):
+        raise SearchError(
+            f"Invalid time {value!r}; use ISO 8601", "INVALID_QUERY"
+        )
+    if parsed.tzinfo is None:
+        parsed = parsed.replace(tzinfo=timezone.utc)
+    return parsed
+
+
+def _indexable(message: Dict) -> bool:
+    """Check whether a message's text can be searched."""
+    return not message.get("encrypted") and not message.get("deleted")
+
+
+class RoomIndex:
+    """
+    Inverted index of one room's messages.
+
+    Attributes:
+        postings: Word -> IDs of the messages containing it
+        messages: Message ID -> the indexed message
+    """
+
+    def __init__(self, messages: Iterable[Dict] = ()):
+        """
+        Initialize the index.
+
+        Args:
+            messages: The room's history to index
+        """
+        self.postings: Dict[str, Set[str]] = {}
+        self.messages: Dict[str, Dict] = {}
+        for message in messages:
+            self.add(message)
+
+    def add(self, message: Dict) -> None:
+        """Index a message (replacing an earlier version of it)."""
+        self.remove(message["message_id"])
+        if not _indexable(message):
+            return
+        self.messages[message["message_id"]] = dict(message)
+        for word in tokenize(message.get("content", "")):
+            self.postings.setdefault(word, set()).add(message["message_id"])
+
+    def remove(self, message_id: str) -> None:
+        """Drop a message from the index."""
+        message = self.messages.pop(message_id, None)
+        if message is None:
+            return
+        for word in tokenize(message.get("content", "")):
+            ids = self.postings.get(word)
+            if ids is not None:
+                ids.discard(message_id)
+                if not ids:
+                    del self.postings[word]
+
+    def search(
+        self,
+        words: List[str],
+        author: Optional[str] = None,
+        since: Optional[datetime] = None,
+        until: Optional[datetime] = None,
+    ) -> List[Dict]:
+        """
+        Find the messages matching a query.
+
+        Args:
+            words: Words that must all appear (none to match every message)
+            author: Only messages by this user
+            since: Only messages sent at or after this time
+            until: Only messages sent at or before this time
+
+        Returns:
+            The matching messages, newest first
+        """
+        if words:
+            # Intersect the rarest words first
+            postings = sorted(
+                (self.postings.get(word, set()) for word in words), key=len
+            )
+            ids = set(postings[0]).intersection(*postings[1:])
+        else:
+            ids = set(self.messages)
+
+        matches = []
+        for message_id in ids:
+            message = self.messages[message_id]
+            if author and message["username"] != author:
+                continue
+            if since or until:
+                sent = parse_time(message["timestamp"])
+                if (since and sent < since) or (until and sent > until):
+                    continue
+            matches.append(message)
+        matches.sort(key=lambda m: m["sequence_number"], reverse=True)
+        return [dict(m) for m in matches]
+
+
+class SearchIndex:
+    """
+    Inverted indexes of the rooms administered by a node.
+
+    Not thread-safe on its own; RoomStateManager only uses it under its
+    lock.
+    """
+
+    def __init__(self):
+        """Initialize an empty set of indexes."""
+        self._rooms: Dict[str, RoomIndex] = {}
+
+    def is_indexed(self, room_id: str) -> bool:
+        """Check whether a room's index has been built."""
+        return room_id in self._rooms
+
+    def build(self, room_id: str, messages: Iterable[Dict]) -> RoomIndex:
+        """
+        Build a room's index from its full history.
+
+        Args:
+            room_id: The room ID
+            messages: The room's messages
+
+        Returns:
+            RoomIndex: The new index
+        """
+        index = RoomIndex(messages)
+        self._rooms[room_id] = index
+        return index
+
+    def add(self, room_id: str, message: Dict) -> None:
+        """Index a newly committed message, if the room is indexed."""
+        index = self._rooms.get(room_id)
+        if index is not None:
+            index.add(message)
+
+    def apply_edit(self, room_id: str, edit: Dict) -> None:
+        """Re-index an edited message or drop a deleted one."""
+        index = self._rooms.get(room_id)
+        if index is None:
+            return
+        if edit["action"] == DELETE:
+            index.remove(edit["message_id"])
+            return
+        message = index.messages.get(edit["message_id"])
+        if message is not None:
+            index.add(apply_edit(dict(message), edit))
+
+    def drop(self, room_id: str) -> None:
+        """Forget a room's index (rebuilt on its next search)."""
+        self._rooms.pop(room_id, None)
+
+    def search(
+        self,
+        room_id: str,
+        history: Callable[[], Iterable[Dict]],
+        query: str,
+        author: Optional[str] = None,
+        since=None,
+        until=None,
+        limit: int = SEARCH_LIMIT,
+    ) -> Dict:
+        """
+        Search a room's messages.
+
+        Args:
+            room_id: The room ID
+            history: Function returning the room's full history, called
+                if its index must be built
+            query: Words that must all appear in a message
+            author: Only messages by this user
+            since: Only messages sent at or after this ISO 8601 time
+            until: Only messages sent at or before this ISO 8601 time
+            limit: Most messages returned
+
+        Returns:
+            dict: {'messages': list, 'total': int} with the newest
+            matches first and the number of matches
+
+        Raises:
+            SearchError: If the query is empty, too long or has too many
+                words, a time is invalid, or the limit is out of range
+                (INVALID_QUERY)
+        """
+        if not isinstance(query, str) or len(query) > MAX_QUERY_LENGTH:
+            raise SearchError(
+                f"query must be text of at most {MAX_QUERY_LENGTH} "
+                f"characters",
+                "INVALID_QUERY",
+            )
+        words = tokenize(query)
+        if len(words) > MAX_QUERY_TERMS:
+            raise SearchError(
+                f"Too many search words (max {MAX_QUERY_TERMS})",
+                "INVALID_QUERY",
+            )
+        since, until = parse_time(since), parse_time(until)
+        if not words and not author and not since and not until:
+            raise SearchError(
+                "Give search words, an author or a time range",
+                "INVALID_QUERY",
+            )
+        if (
+            isinstance(limit, bool)
+            or not isinstance(limit, int)
+            or not 1 <= limit <= MAX_SEARCH_LIMIT
+        ):
+            raise SearchError(
+                f"limit must be between 1 and {MAX_SEARCH_LIMIT}",
+                "INVALID_QUERY",
+            )
+
+        index = self._rooms.get(room_id)
+        if index is None:
+            index = self.build(room_id, history())
+        matches = index.search(words, author, since, until)
+        return {"messages": matches[:limit], "total": len(matches)}
@@ -0,0 +1,328 @@
+#!/usr/bin/env python3
+"""
+Room Seeding
+
+Loads rooms, their members and their message histories from a JSON
+fixture into a running node, for demos, load tests and reproducing bug
+reports with realistic data. The fixture is posted to the node's admin
+API (POST /admin/seed), by hand or with this module's command:
+
+    python -m src.node.seed fixture.json --url http://127.0.0.1:9200
+
+A fixture lists rooms:
+
+    {"rooms": [{"room_name": "General", "creator": "alice",
+                "description": "Chat", "private": false,
+                "members": ["alice", "bob"], "roles": {"bob": "moderator"},
+                "banned": ["mallory"],
+                "messages": [{"username": "alice", "content": "hi",
+                              "timestamp": "2026-01-05T09:00:00+00:00"},
+                             ...]}]}
+
+Only room_name and creator are required; the creator is always a member.
+Messages are imported as history, not posted: they skip spam detection,
+content filters and bots, keep their timestamp (default: the time they
+are seeded) and message_id when given, and can carry reactions
+({emoji: [usernames]}) and reply_to, the ID of an earlier message.
+Messages exported with GET /admin/rooms/<id>/export can be seeded as
+they are.
+
+The whole fixture is checked before anything is seeded. Each room then
+gets a new ID on the node receiving the fixture; a room whose name is
+taken is skipped and reported, and the others are still seeded.
+"""
+
+import argparse
+import json
+import os
+import sys
+import uuid
+from datetime import datetime, timezone
+from typing import Any, Dict, List, Tuple
+from urllib.error import HTTPError, URLError
+from urllib.request import Request, urlopen
+
+from .roles import ASSIGNABLE_ROLES, MEMBER
+from .search import SearchError, parse_time
+from .threads import thread_root, thread_summary
+
+# Seeding configuration
+MAX_SEED_ROOMS = 100  # rooms per fixture
+MAX_SEED_MESSAGES = 100000  # messages per room
+DEFAULT_ADMIN_URL = "http://127.0.0.1:9200"
+
+_ROOM_FIELDS = {
+    "room_name",
+    "creator",
+    "description",
+    "private",
+    "members",
+    "roles",
+    "banned",
+    "messages",
+}
+
+
+class SeedError(Exception):
+    """A fixture could not be seeded."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_FIXTURE")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def _invalid(message: str) -> SeedError:
+    """Build the error for a malformed fixture."""
+    return SeedError(message, "INVALID_FIXTURE")
+
+
+def _usernames(value: Any, field: str) -> List[str]:
+    """Check a list of usernames."""
+    if not isinstance(value, list) or not all(
+        isinstance(name, str) and name for name in value
+    ):
+        raise _invalid(f"{field} must be a list of usernames")
+    return list(dict.fromkeys(value))
+
+
+def parse_fixture(data: Any) -> List[Dict]:
+    """
+    Check a fixture and normalize its rooms.
+
+    Args:
+        data: The decoded fixture
+
+    Returns:
+        The rooms, each with every field filled in
+
+    Raises:
+        SeedError: If the fixture is malformed (INVALID_FIXTURE)
+    """
+    if not isinstance(data, dict) or not isinstance(data.get("rooms"), list):
+        raise _invalid("A fixture must be an object with a rooms list")
+    rooms = data["rooms"]
+    if not rooms or len(rooms) > MAX_SEED_ROOMS:
+        raise _invalid(f"A fixture must have 1 to {MAX_SEED_ROOMS} rooms")
+    return [_parse_room(room, index) for index, room in enumerate(rooms)]
+
+
+def _parse_room(room: Any, index: int) -> Dict:
+    """Check one room of a fixture."""
+    if not isinstance(room, dict):
+        raise _invalid(f"Room {index} must be an object")
+    unknown = set(room) - _ROOM_FIELDS
+    if unknown:
+        raise _invalid(f"Room {index} has unknown fields: {sorted(unknown)}")
+    name, creator = room.get("room_name"), room.get("creator")
+    if not isinstance(name, str) or not isinstance(creator, str) or not (
+        name.strip() and creator
+    ):
+        raise _invalid(f"Room {index} needs a room_name and a creator")
+    description = room.get("description")
+    if description is not None and not isinstance(description, str):
+        raise _invalid(f"Room {name!r}: description must be a string")
+    if not isinstance(room.get("private", False), bool):
+        raise _invalid(f"Room {name!r}: private must be true or false")
+
+    members = _usernames(room.get("members", []), "members")
+    if creator not in members:
+        members.insert(0, creator)
+    banned = _usernames(room.get("banned", []), "banned")
+    if set(banned) & set(members):
+        raise _invalid(f"Room {name!r}: banned users can't be members")
+    roles = room.get("roles", {})
+    if not isinstance(roles, dict):
+        raise _invalid(f"Room {name!r}: roles must map usernames to roles")
+    for username, role in roles.items():
+        if username not in members or username == creator:
+            raise _invalid(
+                f"Room {name!r}: only members other than the creator "
+                f"can be given a role ({username})"
+            )
+        if role not in ASSIGNABLE_ROLES:
+            raise _invalid(f"Room {name!r}: unknown role {role!r}")
+
+    messages = room.get("messages", [])
+    if not isinstance(messages, list) or len(messages) > MAX_SEED_MESSAGES:
+        raise _invalid(
+            f"Room {name!r}: messages must be a list of at most "
+            f"{MAX_SEED_MESSAGES}"
+        )
+    seen = set()
+    for message in messages:
+        _check_message(name, message, members, seen)
+    return {
+        "room_name": name.strip(),
+        "creator": creator,
+        "description": description,
+        "private": room.get("private", False),
+        "members": members,
+        "roles": {u: r for u, r in roles.items() if r != MEMBER},
+        "banned": banned,
+        "messages": messages,
+    }
+
+
+def _check_message(name: str, message: Any, members, seen: set) -> None:
+    """Check one message of a fixture room."""
+    if not isinstance(message, dict):
+        raise _invalid(f"Room {name!r}: messages must be objects")
+    username, content = message.get("username"), message.get("content")
+    if username not in members:
+        raise _invalid(f"Room {name!r}: {username!r} isn't a member")
+    if not isinstance(content, str):
+        raise _invalid(f"Room {name!r}: a message has no content")
+    try:
+        parse_time(message.get("timestamp"))
+    except SearchError as e:
+        raise _invalid(f"Room {name!r}: {e}")
+    message_id = message.get("message_id")
+    if message_id is not None:
+        if not isinstance(message_id, str) or message_id in seen:
+            raise _invalid(f"Room {name!r}: duplicate message_id {message_id}")
+    reply_to = message.get("reply_to")
+    if reply_to is not None and reply_to not in seen:
+        raise _invalid(
+            f"Room {name!r}: reply_to {reply_to} isn't an earlier message"
+        )
+    if message_id is not None:
+        seen.add(message_id)
+    reactions = message.get("reactions", {})
+    if not isinstance(reactions, dict) or not all(
+        isinstance(users, list) and all(isinstance(u, str) for u in users)
+        for users in reactions.values()
+    ):
+        raise _invalid(f"Room {name!r}: reactions must map emoji to users")
+
+
+def build_messages(
+    room_id: str, node_id: str, messages: List[Dict], clock
+) -> Tuple[List[Dict], Dict[str, int]]:
+    """
+    Turn a fixture room's messages into stored messages.
+
+    Args:
+        room_id: ID the seeded room got
+        node_id: The node seeding the room
+        messages: The room's checked fixture messages
+        clock: The node's HybridLogicalClock
+
+    Returns:
+        tuple: (messages in sequence order, vector clock of the last one)
+    """
+    built: List[Dict] = []
+    by_id: Dict[str, Dict] = {}
+    for sequence_number, fixture in enumerate(messages, start=1):
+        timestamp = parse_time(fixture.get("timestamp"))
+        message = {
+            "message_id": fixture.get("message_id") or str(uuid.uuid4()),
+            "room_id": room_id,
+            "username": fixture["username"],
+            "content": fixture["content"],
+            "sequence_number": sequence_number,
+            "timestamp": (timestamp or datetime.now(timezone.utc)).isoformat(),
+            "vector_clock": {node_id: sequence_number},
+            "origin_node": node_id,
+            "hlc": clock.now().encode(),
+        }
+        reactions = {
+            emoji: sorted(set(users))
+            for emoji, users in fixture.get("reactions", {}).items()
+            if users
+        }
+        if reactions:
+            message["reactions"] = reactions
+        parent = by_id.get(fixture.get("reply_to"))
+        if parent is not None:
+            message["reply_to"] = parent["message_id"]
+            message["thread_id"] = thread_root(parent)
+            root = by_id[message["thread_id"]]
+            root["thread"] = thread_summary(root, message)
+        by_id[message["message_id"]] = message
+        built.append(message)
+    return built, {node_id: len(built)} if built else {}
+
+
+def post_fixture(url: str, token: str, fixture: Dict) -> Tuple[int, Dict]:
+    """
+    Post a fixture to a node's admin API.
+
+    Args:
+        url: Base URL of the admin API (without /admin)
+        token: The node's admin token
+        fixture: The fixture
+
+    Returns:
+        tuple: (HTTP status, response body)
+
+    Raises:
+        URLError: If the node can't be reached
+    """
+    request = Request(
+        f"{url.rstrip('/')}/admin/seed",
+        data=json.dumps(fixture).encode(),
+        headers={
+            "Authorization": f"Bearer {token}",
+            "Content-Type": "application/json",
+        },
+        method="POST",
+    )
+    try:
+        with urlopen(request) as response:
+            return response.status, json.loads(response.read())
+    except HTTPError as e:
+        return e.code, json.loads(e.read() or b"{}")
+
+
+def main(argv=None):
+    """Main entry point for seeding a node from a fixture."""
+    parser = argparse.ArgumentParser(
+        description="Load rooms and messages from a JSON fixture into a node"
+    )
+    parser.add_argument("fixture", help="Path of the JSON fixture")
+    parser.add_argument(
+        "--url",
+        default=DEFAULT_ADMIN_URL,
+        help=f"Admin API URL of the node (default: {DEFAULT_ADMIN_URL})",
+    )
+    parser.add_argument(
+        "--token",
+        default=os.environ.get("ADMIN_TOKEN"),
+        help="Admin token (default: $ADMIN_TOKEN)",
+    )
+    args = parser.parse_args(argv)
+    if not args.token:
+        parser.error("an admin token is required (--token or ADMIN_TOKEN)")
+
+    try:
+        with open(args.fixture, encoding="utf-8") as handle:
+            fixture = json.load(handle)
+        parse_fixture(fixture)
+        status, result = post_fixture(args.url, args.token, fixture)
+    except (OSError, ValueError, SeedError, URLError) as e:
+        print(f"Error: {e}", file=sys.stderr)
+        sys.exit(1)
+
+    if status != 200:
+        print(f"Error: {result.get('error', status)}", file=sys.stderr)
+        sys.exit(1)
+    for room in result["rooms"]:
+        print(
+            f"Seeded '{room['room_name']}' ({room['room_id']}): "
+            f"{room['member_count']} members, "
+            f"{room['message_count']} messages"
+        )
+    for room in result["skipped"]:
+        print(f"Skipped '{room['room_name']}': {room['error']}")
+    sys.exit(0 if result["rooms"] else 1)
+
+
+if __name__ == "__main__":
+    main()
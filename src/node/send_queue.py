@@ -0,0 +1,303 @@
+"""
+Bounded WebSocket Send Queues
+
+A client that reads its messages slower than its rooms produce them
+would otherwise hold up every broadcast (or, with a fast transport, make
+the node buffer its messages without limit). Each connected client gets
+a SendQueue of at most SEND_QUEUE_SIZE messages, written to its
+WebSocket by a task of its own, so a slow consumer only delays itself.
+
+When a client's queue is full, the node's send queue policy decides:
+
+- drop_oldest: the oldest queued message is dropped for the new one
+- drop_newest: the new message is dropped
+- disconnect: the connection is closed with code 1008
+
+A client whose queue fills past SLOW_CONSUMER_MARK is sent a
+slow_consumer event ahead of its queued messages, once until the queue
+drains below half full again.
+
+Queues hold Frames. A broadcast serializes its message once, with
+encode_frame, and puts the same Frame in every recipient's queue; the
+first queue to write it encodes it to UTF-8 and the others reuse the
+bytes. Each queue's task writes up to SEND_BATCH_SIZE frames at a time
+through a FrameWriter, which waits for the connection to drain once per
+batch instead of once per message.
+"""
+
+import asyncio
+import json
+import logging
+from collections import deque
+from typing import Any, Callable, Deque, Dict, List, Optional, Union
+
+import websockets
+
+from .schemas import create_slow_consumer_event
+
+logger = logging.getLogger(__name__)
+
+# Send queue configuration
+SEND_QUEUE_SIZE = 1000  # messages queued per client
+SLOW_CONSUMER_MARK = 0.8  # fill level at which the client is warned
+CLOSE_TIMEOUT = 1.0  # seconds to flush a queue when its client leaves
+SEND_BATCH_SIZE = 64  # frames written before waiting for the connection
+
+# Opcode of WebSocket text frames (RFC 6455)
+TEXT_OPCODE = 0x1
+
+# Connection methods FrameWriter writes batches with
+TRANSPORT_METHODS = ("ensure_open", "write_frame_sync", "drain")
+
+# Policies for a full queue
+DROP_OLDEST = "drop_oldest"
+DROP_NEWEST = "drop_newest"
+DISCONNECT = "disconnect"
+SEND_QUEUE_POLICIES = (DROP_OLDEST, DROP_NEWEST, DISCONNECT)
+
+# Close code for clients disconnected by the disconnect policy
+SLOW_CONSUMER_CLOSE_CODE = 1008
+
+
+class Frame:
+    """
+    A message serialized once, shared by the queues of its recipients.
+
+    Attributes:
+        text: The JSON-encoded message
+    """
+
+    __slots__ = ("text", "_data")
+
+    def __init__(self, text: str):
+        """
+        Initialize the frame.
+
+        Args:
+            text: The JSON-encoded message
+        """
+        self.text = text
+        self._data: Optional[bytes] = None
+
+    @property
+    def data(self) -> bytes:
+        """The message as UTF-8, encoded the first time it is needed."""
+        if self._data is None:
+            self._data = self.text.encode("utf-8")
+        return self._data
+
+
+def encode_frame(message: Dict[str, Any]) -> Frame:
+    """Serialize a message once for all the clients it is sent to."""
+    return Frame(json.dumps(message))
+
+
+class FrameWriter:
+    """
+    Writes batches of frames to one WebSocket connection.
+
+    The websockets library has no public way to send text that is already
+    encoded, or to wait for the connection once for several messages. So
+    for connections with all of TRANSPORT_METHODS (those of its legacy
+    protocol), the frames' shared bytes are written with write_frame_sync
+    and the connection drained once per batch. These methods aren't part
+    of the library's public API, which is why requirements pin websockets
+    to the 12.x releases. Other connections get each message with send().
+    """
+
+    def __init__(self, websocket):
+        """
+        Initialize the writer.
+
+        Args:
+            websocket: The client's WebSocket connection
+        """
+        self.websocket = websocket
+        self.batched = all(
+            callable(getattr(websocket, name, None))
+            for name in TRANSPORT_METHODS
+        )
+
+    async def write(self, batch: List[Frame]) -> None:
+        """
+        Write a batch of frames.
+
+        Args:
+            batch: The frames, in order
+
+        Raises:
+            ConnectionClosed: If the connection is closed
+        """
+        if not self.batched:
+            for frame in batch:
+                await self.websocket.send(frame.text)
+            return
+        await self.websocket.ensure_open()
+        for frame in batch:
+            self.websocket.write_frame_sync(True, TEXT_OPCODE, frame.data)
+        await self.websocket.drain()
+
+
+class SendQueue:
+    """
+    Bounded queue of messages for one WebSocket client.
+
+    put() never waits: it queues the message or applies the overflow
+    policy. Messages are written in order by the task start() creates.
+    """
+
+    def __init__(
+        self,
+        websocket,
+        max_size: int = SEND_QUEUE_SIZE,
+        policy: str = DROP_OLDEST,
+        on_overflow: Optional[Callable[[str], None]] = None,
+    ):
+        """
+        Initialize the queue.
+
+        Args:
+            websocket: The client's WebSocket connection
+            max_size: Messages the queue holds before overflowing
+            policy: What to do when the queue is full (one of
+                SEND_QUEUE_POLICIES)
+            on_overflow: Optional function called with the policy every
+                time a message is dropped or the client disconnected
+        """
+        if policy not in SEND_QUEUE_POLICIES:
+            raise ValueError(f"Unknown send queue policy: {policy!r}")
+        self.websocket = websocket
+        self.writer = FrameWriter(websocket)
+        self.max_size = max_size
+        self.policy = policy
+        self.on_overflow = on_overflow
+        self.dropped = 0
+        self.closed = False
+        self._messages: Deque[Frame] = deque()
+        self._ready = asyncio.Event()
+        self._warned = False
+        # slow_consumer event waiting to be sent ahead of the messages
+        self._notice: Optional[Frame] = None
+        self._task: Optional[asyncio.Future] = None
+
+    @property
+    def depth(self) -> int:
+        """Number of messages waiting to be sent."""
+        return len(self._messages)
+
+    def start(self) -> None:
+        """Start writing queued messages to the WebSocket."""
+        if self._task is None:
+            self._task = asyncio.ensure_future(self._run())
+
+    def put(self, data: Union[str, Frame]) -> bool:
+        """
+        Queue a message for the client.
+
+        Args:
+            data: The JSON-encoded message, or a Frame shared with other
+                recipients
+
+        Returns:
+            bool: True if the message was queued, False if it was dropped
+            or the client is being disconnected
+        """
+        if self.closed:
+            return False
+        if not isinstance(data, Frame):
+            data = Frame(data)
+        queued = True
+        if len(self._messages) >= self.max_size:
+            queued = self._overflow(data)
+        else:
+            self._messages.append(data)
+        if self.closed:
+            return False
+
+        mark = self.max_size * SLOW_CONSUMER_MARK
+        if not self._warned and self.depth >= mark:
+            self._warned = True
+            logger.warning(
+                f"Slow consumer: {self.depth} messages queued for "
+                f"{self._peer()}"
+            )
+            event = create_slow_consumer_event(
+                self.depth, self.max_size, self.policy, self.dropped
+            )
+            self._notice = encode_frame(event)
+        self._ready.set()
+        return queued
+
+    def _overflow(self, data: Frame) -> bool:
+        """Apply the policy to a message that doesn't fit."""
+        if self.on_overflow:
+            self.on_overflow(self.policy)
+        if self.policy == DROP_OLDEST:
+            self._messages.popleft()
+            self._messages.append(data)
+            self.dropped += 1
+            return True
+        if self.policy == DROP_NEWEST:
+            self.dropped += 1
+            return False
+
+        logger.warning(f"Disconnecting slow consumer {self._peer()}")
+        self.closed = True
+        self._messages.clear()
+        self._notice = None
+        self._ready.set()
+        asyncio.ensure_future(
+            self.websocket.close(SLOW_CONSUMER_CLOSE_CODE, "Slow consumer")
+        )
+        return False
+
+    def _peer(self) -> str:
+        """Describe the client for log lines."""
+        remote = getattr(self.websocket, "remote_address", None)
+        return str(remote) if remote else "client"
+
+    async def _run(self) -> None:
+        """Write queued messages until the queue is closed and empty."""
+        while True:
+            batch = self._next_batch()
+            if not batch:
+                if self.closed:
+                    return
+                self._ready.clear()
+                await self._ready.wait()
+                continue
+            try:
+                await self.writer.write(batch)
+            except websockets.exceptions.ConnectionClosed:
+                self.closed = True
+                self._messages.clear()
+                return
+
+    def _next_batch(self) -> List[Frame]:
+        """Take the pending notice and up to a batch of messages."""
+        batch = []
+        if self._notice:
+            batch.append(self._notice)
+            self._notice = None
+        while self._messages and len(batch) < SEND_BATCH_SIZE:
+            batch.append(self._messages.popleft())
+        if self.depth < self.max_size // 2:
+            self._warned = False
+        return batch
+
+    async def close(self, timeout: float = CLOSE_TIMEOUT) -> None:
+        """
+        Stop the queue after sending what is queued.
+
+        Args:
+            timeout: Seconds to wait for the queued messages to be sent
+        """
+        self.closed = True
+        self._ready.set()
+        if self._task is None:
+            return
+        try:
+            await asyncio.wait_for(self._task, timeout)
+        except asyncio.TimeoutError:
+            logger.debug(f"Dropped {self.depth} unsent messages")
+            self._messages.clear()
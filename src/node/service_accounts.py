@@ -0,0 +1,387 @@
+"""
+Service Accounts
+
+Operators provision service accounts for monitoring bots and integrations
+with the admin API (POST /admin/service-accounts); the node returns an
+API key, shown only once. The program connects to the node's WebSocket
+endpoint and authenticates with service_login and its API key, after
+which it acts as a user named after the account.
+
+Unlike bots and users, a service account may only do what its scopes
+grant:
+
+- read: join and leave rooms, receive their messages, and read their
+  history, members, read state and attachments
+- post: join and leave rooms and send messages to them, without receiving
+  their messages unless read is granted too
+- dm: send and receive direct messages
+
+An account may also be limited to some rooms; it is then refused
+commands on any other room. Commands no scope covers (creating rooms,
+moderation, editing messages, registering bots, ...) are always refused,
+as are commands naming another user. So a post-only account limited to
+an alerts room can announce there and nothing else, and a read-only one
+can watch rooms but never write to them.
+
+Service accounts and their API key hashes are kept by the node they were
+provisioned on, in its storage backend if it has one; they log in there.
+"""
+
+import hmac
+import logging
+import re
+import secrets
+import threading
+import time
+from dataclasses import dataclass, field
+from typing import Dict, List, Optional, Set, Tuple
+
+from .bots import hash_api_key
+
+logger = logging.getLogger(__name__)
+
+# Scopes a service account can be granted
+READ = "read"
+POST = "post"
+DM = "dm"
+SCOPES = (READ, POST, DM)
+
+# Service account configuration
+MAX_SCOPED_ROOMS = 100  # rooms an account can be limited to
+
+# Commands allowed to every account, whatever its scopes
+ALWAYS_ALLOWED = (
+    "protocol_info",
+    "pong",
+    "logout",
+    "service_login",
+)
+
+# Scope -> the commands it grants
+SCOPE_COMMANDS: Dict[str, Tuple[str, ...]] = {
+    READ: (
+        "list_rooms",
+        "discover_rooms",
+        "join_room",
+        "leave_room",
+        "get_history",
+        "search",
+        "message_received",
+        "mark_read",
+        "get_read_state",
+        "get_room_keys",
+        "get_attachment",
+        "get_presence",
+        "get_profile",
+    ),
+    POST: (
+        "list_rooms",
+        "join_room",
+        "leave_room",
+        "send_message",
+        "typing",
+        "start_upload",
+        "upload_chunk",
+        "finish_upload",
+    ),
+    DM: ("send_direct_message",),
+}
+
+_ACCOUNT_NAME = re.compile(r"^[A-Za-z0-9_-]{1,32}$")
+
+
+class ServiceAccountError(Exception):
+    """A service account request was refused."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_API_KEY")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def validate_scopes(scopes) -> List[str]:
+    """
+    Check a service account's scopes.
+
+    Args:
+        scopes: List of scopes, each one of SCOPES
+
+    Returns:
+        The scopes, without repeats
+
+    Raises:
+        ServiceAccountError: If the scopes aren't a non-empty list of
+            SCOPES (INVALID_SCOPES)
+    """
+    if (
+        not isinstance(scopes, (list, tuple))
+        or not scopes
+        or not all(scope in SCOPES for scope in scopes)
+    ):
+        raise ServiceAccountError(
+            f"scopes must be a non-empty list of {', '.join(SCOPES)}",
+            "INVALID_SCOPES",
+        )
+    return list(dict.fromkeys(scopes))
+
+
+def validate_rooms(rooms) -> List[str]:
+    """
+    Check the rooms a service account is limited to.
+
+    Args:
+        rooms: List of room IDs, empty for any room
+
+    Returns:
+        The room IDs, without repeats
+
+    Raises:
+        ServiceAccountError: If the rooms aren't a list of up to
+            MAX_SCOPED_ROOMS room IDs (INVALID_REQUEST)
+    """
+    if (
+        not isinstance(rooms, (list, tuple))
+        or len(rooms) > MAX_SCOPED_ROOMS
+        or not all(isinstance(room, str) and room for room in rooms)
+    ):
+        raise ServiceAccountError(
+            f"rooms must be a list of up to {MAX_SCOPED_ROOMS} room IDs",
+            "INVALID_REQUEST",
+        )
+    return list(dict.fromkeys(rooms))
+
+
+@dataclass
+class ServiceAccount:
+    """
+    A provisioned service account.
+
+    Attributes:
+        name: The account's name, which it acts as in rooms
+        api_key_hash: Hex SHA-256 of its API key
+        scopes: Scopes it was granted (see SCOPES)
+        rooms: Room IDs it is limited to, empty for any room
+        created_at: UNIX time of provisioning
+    """
+
+    name: str
+    api_key_hash: str
+    scopes: List[str] = field(default_factory=list)
+    rooms: List[str] = field(default_factory=list)
+    created_at: float = 0.0
+
+    def refusal(self, message_type: str, request_data: Dict) -> Optional[str]:
+        """
+        Check a command against the account's scopes and rooms.
+
+        Args:
+            message_type: The command
+            request_data: The command's data
+
+        Returns:
+            Why the command is refused, or None if it is allowed
+        """
+        claimed = request_data.get("username") or request_data.get(
+            "creator_id"
+        )
+        if claimed is not None and claimed != self.name:
+            return "Service accounts can only act as themselves"
+        if message_type in ALWAYS_ALLOWED:
+            return None
+        if not any(
+            message_type in SCOPE_COMMANDS[scope] for scope in self.scopes
+        ):
+            return f"{message_type} is outside the account's scopes"
+        room_id = request_data.get("room_id")
+        if self.rooms and room_id is not None and room_id not in self.rooms:
+            return f"Room {room_id} is outside the account's scopes"
+        return None
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for storage."""
+        return {
+            "name": self.name,
+            "api_key_hash": self.api_key_hash,
+            "scopes": list(self.scopes),
+            "rooms": list(self.rooms),
+            "created_at": self.created_at,
+        }
+
+    def public(self) -> Dict:
+        """Describe the account for operators, without the key hash."""
+        return {
+            "name": self.name,
+            "scopes": list(self.scopes),
+            "rooms": list(self.rooms),
+            "created_at": self.created_at,
+        }
+
+    @classmethod
+    def from_dict(cls, data: Dict) -> "ServiceAccount":
+        """Create an account from its stored dictionary form."""
+        return cls(
+            name=data["name"],
+            api_key_hash=data["api_key_hash"],
+            scopes=list(data.get("scopes", [])),
+            rooms=list(data.get("rooms", [])),
+            created_at=float(data.get("created_at", 0.0)),
+        )
+
+
+class ServiceAccountRegistry:
+    """
+    Service accounts provisioned on this node.
+    """
+
+    def __init__(self, node_id: str, storage=None):
+        """
+        Initialize the registry.
+
+        Args:
+            node_id: ID of this node
+            storage: Optional Storage; when set, accounts are stored there
+                and loaded back on startup
+        """
+        self.node_id = node_id
+        self.storage = storage
+        self._lock = threading.Lock()
+        self._accounts: Dict[str, ServiceAccount] = {}
+        if storage is not None:
+            for data in storage.service_accounts():
+                account = ServiceAccount.from_dict(data)
+                self._accounts[account.name] = account
+            logger.info(
+                f"Loaded {len(self._accounts)} service accounts from storage"
+            )
+
+    def create(
+        self, name: str, scopes: List[str], rooms: Optional[List[str]] = None
+    ) -> Tuple[Dict, str]:
+        """
+        Provision a service account.
+
+        Args:
+            name: The account's name
+            scopes: Scopes it is granted
+            rooms: Room IDs it is limited to, None or empty for any room
+
+        Returns:
+            (account, api_key): The account's public description and its
+            new API key, which is not kept
+
+        Raises:
+            ServiceAccountError: If the name is invalid
+                (INVALID_ACCOUNT_NAME) or taken (ACCOUNT_NAME_TAKEN), or
+                the scopes or rooms are invalid
+        """
+        if not isinstance(name, str) or not _ACCOUNT_NAME.match(name):
+            raise ServiceAccountError(
+                "Service account names are 1-32 letters, digits, '_' or '-'",
+                "INVALID_ACCOUNT_NAME",
+            )
+        scopes = validate_scopes(scopes)
+        rooms = validate_rooms(rooms or [])
+        api_key = secrets.token_urlsafe(32)
+        account = ServiceAccount(
+            name, hash_api_key(api_key), scopes, rooms, time.time()
+        )
+        with self._lock:
+            if name in self._accounts:
+                raise ServiceAccountError(
+                    "Service account name already taken",
+                    "ACCOUNT_NAME_TAKEN",
+                )
+            if self.storage is not None:
+                self.storage.save_service_account(account.to_dict())
+            self._accounts[name] = account
+        logger.info(
+            f"Provisioned service account {name} with scopes "
+            f"{', '.join(scopes)}"
+        )
+        return account.public(), api_key
+
+    def remove(self, name: str) -> None:
+        """
+        Remove a service account; its API key stops working.
+
+        Args:
+            name: The account's name
+
+        Raises:
+            ServiceAccountError: If there is no such account
+                (ACCOUNT_NOT_FOUND)
+        """
+        with self._lock:
+            if name not in self._accounts:
+                raise ServiceAccountError(
+                    "Service account not found", "ACCOUNT_NOT_FOUND"
+                )
+            if self.storage is not None:
+                self.storage.drop_service_account(name)
+            del self._accounts[name]
+        logger.info(f"Removed service account {name}")
+
+    def authenticate(self, name: str, api_key: str) -> ServiceAccount:
+        """
+        Check a service account's API key.
+
+        Args:
+            name: The account's name
+            api_key: The API key it presents
+
+        Returns:
+            The account
+
+        Raises:
+            ServiceAccountError: If the account doesn't exist or the key is
+                wrong (INVALID_API_KEY)
+        """
+        with self._lock:
+            account = self._accounts.get(name or "")
+        if account is None or not hmac.compare_digest(
+            account.api_key_hash, hash_api_key(api_key or "")
+        ):
+            logger.warning(f"Failed service account login for {name}")
+            raise ServiceAccountError(
+                "Invalid service account name or API key", "INVALID_API_KEY"
+            )
+        return account
+
+    def get(self, name: str) -> Optional[ServiceAccount]:
+        """Get a service account by name."""
+        with self._lock:
+            return self._accounts.get(name)
+
+    def list_accounts(self) -> List[Dict]:
+        """Get the public descriptions of every account, by name."""
+        with self._lock:
+            return [
+                account.public()
+                for _, account in sorted(self._accounts.items())
+            ]
+
+    def without_scope(self, scope: str) -> Set[str]:
+        """
+        Get the accounts not granted a scope.
+
+        Accounts without READ aren't sent their rooms' messages, and
+        accounts without DM aren't sent direct messages.
+
+        Args:
+            scope: One of SCOPES
+
+        Returns:
+            The accounts' names
+        """
+        with self._lock:
+            return {
+                name
+                for name, account in self._accounts.items()
+                if scope not in account.scopes
+            }
@@ -0,0 +1,221 @@
+"""
+Room Sharding by Consistent Hashing
+
+With sharding enabled, a room is administered by the node its ID hashes
+to on a consistent hash ring of the cluster membership view's members
+(see membership.py), instead of by the node it was created on:
+
+- A room created on another node is handed off to its owner right away.
+- A node looks up a room missing from its directory on the ring, so it
+  can reach the room without the full directory.
+- When a node joins or leaves, a new view is installed and every node
+  rebuilds the ring from it. In its next rebalancing round, each node
+  hands the rooms it no longer owns to their new owners. Every node has
+  VIRTUAL_NODES points on the ring, so only about 1/N of the rooms move
+  and the load stays even.
+
+Rooms move like in a graceful shutdown (see failover.py): the owner
+receives a snapshot of the room's full state and announces itself as the
+room's new admin, and the old admin keeps a replica for its connected
+members. A room whose admin died is first taken over through a failover
+election, then moved to its owner. Every node builds the ring from the
+same view, so they agree on each room's owner. Rooms with placement
+constraints stay on the nodes matching them instead (see placement.py).
+"""
+
+import bisect
+import hashlib
+import logging
+import threading
+from typing import Dict, Iterable, Optional
+
+logger = logging.getLogger(__name__)
+
+# Sharding configuration
+VIRTUAL_NODES = 64  # ring points per node
+REBALANCE_INTERVAL = 10  # seconds between rebalancing rounds
+MAX_MOVES = 20  # rooms handed off per rebalancing round
+
+
+def ring_hash(key: str) -> int:
+    """Hash a key to a point on the ring (the first 8 bytes of SHA-256)."""
+    return int.from_bytes(hashlib.sha256(key.encode()).digest()[:8], "big")
+
+
+class HashRing:
+    """
+    Consistent hash ring over node IDs.
+    """
+
+    def __init__(self, node_ids: Iterable[str], vnodes: int = VIRTUAL_NODES):
+        """
+        Build the ring.
+
+        Args:
+            node_ids: IDs of the nodes on the ring
+            vnodes: Points each node has on the ring
+        """
+        self.node_ids = sorted(set(node_ids))
+        points = sorted(
+            (ring_hash(f"{node_id}#{index}"), node_id)
+            for node_id in self.node_ids
+            for index in range(vnodes)
+        )
+        self._hashes = [point for point, _ in points]
+        self._nodes = [node_id for _, node_id in points]
+
+    def owner(self, key: str) -> Optional[str]:
+        """
+        Find the node owning a key: the first point clockwise of its hash.
+
+        Args:
+            key: The key, e.g. a room ID
+
+        Returns:
+            The owner's node ID, or None if the ring is empty
+        """
+        if not self._nodes:
+            return None
+        index = bisect.bisect(self._hashes, ring_hash(key))
+        return self._nodes[index % len(self._nodes)]
+
+
+def move_room(room_manager, failover, room_id: str, target: str) -> bool:
+    """
+    Hand a room hosted here off to another node.
+
+    The target gets the room's snapshot and becomes its admin, the room
+    directory points at it, and this node keeps a replica for the
+    room's members connected here.
+
+    Args:
+        room_manager: RoomStateManager hosting the room
+        failover: RoomFailover handing the room off
+        room_id: The room ID
+        target: ID of the node to move the room to
+
+    Returns:
+        True if the target took the room
+    """
+    room = room_manager.get_room(room_id)
+    if room is None:
+        return False
+    room_info = dict(
+        room.to_dict(), admin_node=target, members=sorted(room.members)
+    )
+    local_members = [
+        username
+        for username, info in room.member_info.items()
+        if room_manager.node_id in info.nodes
+    ]
+    messages = room_manager.get_messages(room_id)
+
+    if failover.hand_off_room(room_id, [target]) != target:
+        return False
+    if failover.room_directory:
+        failover.room_directory.reassign(
+            room_id,
+            target,
+            failover.peer_registry.get_peer_address(target),
+            room.room_name,
+        )
+    for username in local_members:
+        failover.replica_store.update_from_join(room_info, messages, username)
+    return True
+
+
+class RoomSharding:
+    """
+    Places this node's rooms on their owners in the hash ring.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        room_manager,
+        failover,
+        membership,
+        vnodes: int = VIRTUAL_NODES,
+    ):
+        """
+        Initialize sharding and build the ring from the current view.
+
+        Args:
+            node_id: ID of this node
+            room_manager: RoomStateManager hosting this node's rooms
+            failover: RoomFailover handing rooms off and holding replicas
+            membership: ClusterMembership whose views the ring is built
+                from; new views rebuild it
+            vnodes: Points each node has on the ring
+        """
+        self.node_id = node_id
+        self.room_manager = room_manager
+        self.failover = failover
+        self.vnodes = vnodes
+        self._lock = threading.Lock()
+        self._ring = HashRing(membership.view.node_ids or [node_id], vnodes)
+        membership.subscribe(self._on_view)
+
+    def _on_view(self, view) -> None:
+        """Membership listener: rebuild the ring from a new view."""
+        ring = HashRing(view.node_ids or [self.node_id], self.vnodes)
+        with self._lock:
+            self._ring = ring
+        logger.info(
+            f"Rebuilt hash ring for membership epoch {view.epoch} with "
+            f"{len(ring.node_ids)} nodes"
+        )
+
+    def owner_of(self, room_id: str) -> str:
+        """Get the ID of the node that should administer a room."""
+        with self._lock:
+            return self._ring.owner(room_id)
+
+    def place_room(self, room_id: str) -> str:
+        """
+        Move a room hosted here to its owner, if that is another node.
+
+        Rooms stay here while their owner is unreachable; rebalancing
+        moves them later.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            ID of the node administering the room afterwards
+        """
+        owner = self.owner_of(room_id)
+        if owner == self.node_id or owner not in self.failover.live_peers():
+            return self.node_id
+        if not move_room(self.room_manager, self.failover, room_id, owner):
+            return self.node_id
+        logger.info(f"Moved room {room_id} to its ring owner {owner}")
+        return owner
+
+    def rebalance(self, max_moves: int = MAX_MOVES) -> Dict[str, str]:
+        """
+        Move the rooms hosted here that other nodes own to them.
+
+        Args:
+            max_moves: Most rooms moved in this round; the rest move in
+                the next rounds
+
+        Returns:
+            dict: Maps each moved room ID to its new admin node ID
+        """
+        moved = {}
+        for room in self.room_manager.list_rooms():
+            if len(moved) >= max_moves:
+                break
+            room_id = room["room_id"]
+            if self.owner_of(room_id) == self.node_id:
+                continue
+            hosted = self.room_manager.get_room(room_id)
+            if hosted is not None and hosted.placement:
+                continue
+            admin = self.place_room(room_id)
+            if admin != self.node_id:
+                moved[room_id] = admin
+        if moved:
+            logger.info(f"Rebalanced {len(moved)} rooms to their owners")
+        return moved
@@ -0,0 +1,123 @@
+"""
+Graceful Node Shutdown
+
+On SIGTERM or SIGINT the node drains before exiting:
+
+1. Stop accepting clients; new connections get the shutdown notice and
+   client commands other than leave_room are rejected
+2. Hand every room administered here off to a live peer
+3. Send connected clients a node_shutdown event with a reconnect hint (live
+   nodes and the new admin of each of their rooms) and close them
+4. Flush the write-ahead log
+
+Steps 1-3 share a drain deadline. Whatever is left when it expires is
+skipped, but the log is always flushed before the node exits.
+"""
+
+import asyncio
+import logging
+import signal
+from typing import Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Shutdown configuration
+DRAIN_TIMEOUT = 20  # seconds allowed for draining before the node exits
+RECONNECT_DELAY = 1  # seconds clients are told to wait before reconnecting
+
+# Signals that trigger a graceful shutdown
+SHUTDOWN_SIGNALS = (signal.SIGTERM, signal.SIGINT)
+
+
+def install_signal_handlers(
+    loop: asyncio.AbstractEventLoop, shutdown_event: asyncio.Event
+) -> List[int]:
+    """
+    Set shutdown_event when the process receives SIGTERM or SIGINT.
+
+    Args:
+        loop: The running event loop
+        shutdown_event: Event the server waits on
+
+    Returns:
+        The signals that were hooked (empty where the loop does not
+        support signal handlers, e.g. on Windows)
+    """
+    installed = []
+    for sig in SHUTDOWN_SIGNALS:
+        try:
+            loop.add_signal_handler(sig, _request_shutdown, sig, shutdown_event)
+        except (NotImplementedError, RuntimeError):
+            continue
+        installed.append(sig)
+    return installed
+
+
+def _request_shutdown(sig: int, shutdown_event: asyncio.Event) -> None:
+    """Signal handler: start the graceful shutdown."""
+    if shutdown_event.is_set():
+        logger.warning(f"Received {signal.Signals(sig).name} again, draining")
+        return
+    logger.info(f"Received {signal.Signals(sig).name}, shutting down")
+    shutdown_event.set()
+
+
+async def drain_node(
+    ws_server,
+    failover,
+    message_log=None,
+    drain_timeout: float = DRAIN_TIMEOUT,
+    retry_after: float = RECONNECT_DELAY,
+    reconnect_urls: Optional[List[str]] = None,
+) -> Dict:
+    """
+    Drain the node before it exits.
+
+    Args:
+        ws_server: The node's WebSocketServer
+        failover: The node's RoomFailover, used to hand off rooms
+        message_log: Optional Storage to flush
+        drain_timeout: Seconds allowed for stopping intake, handing off
+            rooms and disconnecting clients
+        retry_after: Seconds clients are told to wait before reconnecting
+        reconnect_urls: Optional WebSocket URLs of the other nodes,
+            included in the reconnect hint
+
+    Returns:
+        dict: {'handed_off': {room_id: node_id}, 'clients_notified': int,
+        'completed': bool}; completed is False if the deadline expired
+    """
+    loop = asyncio.get_running_loop()
+    deadline = loop.time() + drain_timeout
+    summary = {"handed_off": {}, "clients_notified": 0, "completed": False}
+
+    def remaining() -> float:
+        return max(0.0, deadline - loop.time())
+
+    ws_server.begin_drain()
+    try:
+        summary["handed_off"] = await asyncio.wait_for(
+            loop.run_in_executor(None, failover.hand_off_rooms),
+            remaining(),
+        )
+        nodes = sorted(failover.live_peers())
+        summary["clients_notified"] = await asyncio.wait_for(
+            ws_server.notify_shutdown(
+                retry_after, nodes, summary["handed_off"], reconnect_urls
+            ),
+            remaining(),
+        )
+        summary["completed"] = await ws_server.wait_disconnected(remaining())
+    except asyncio.TimeoutError:
+        logger.warning(
+            f"Drain deadline of {drain_timeout}s expired, exiting anyway"
+        )
+    finally:
+        if message_log:
+            message_log.sync()
+
+    logger.info(
+        f"Drained node: handed off {len(summary['handed_off'])} rooms, "
+        f"notified {summary['clients_notified']} clients"
+    )
+    return summary
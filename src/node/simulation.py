@@ -0,0 +1,836 @@
+"""
+Deterministic Multi-Node Simulation
+
+Runs several nodes in one process, connected by a simulated network
+instead of sockets, so ordering, 2PC and failover can be tested in CI
+without real timing. Each SimulatedNode has the same components as a
+node started by main.py (room state, peer registry, failure detector,
+replicas and failover, replication, 2PC and the delivery buffers) and
+answers XML-RPC calls through the real NodeService dispatcher.
+
+While a Simulation is open, every ServerProxy sends its calls through the
+SimulatedNetwork (see log_context.set_transport_factory). Each call is
+attributed to the node making it, taken from a context variable set while
+a simulated node acts or answers a call, and is decided per link:
+
+- a call to a crashed node is refused (ConnectionRefusedError)
+- a call across a partition, a dropped call and a call whose round trip
+  exceeds the caller's timeout time out (socket.timeout)
+- message, member event, presence and profile broadcasts (DEFERRED_METHODS)
+  are acknowledged at once and delivered after the link's latency, so
+  broadcasts sent close together can arrive out of order
+- other calls are answered at once; their latency only counts against
+  the caller's timeout
+
+Each node has a FaultInjector (see faults.py) whose injected crash takes
+the node off the network instead of exiting the process; RPC delays it
+injects are slept for real.
+
+Time is virtual: deferred deliveries and background work (such as the
+replication syncs) are queued on the Simulation's scheduler and run by
+run() or advance(). Drops and latencies are drawn from one random
+generator per link and ties in the queue are broken by the scheduler's
+generator, all seeded from the simulation's seed. While the simulation is
+open, uuid.uuid4 also draws from a seeded generator, so room, message and
+transaction IDs repeat too, and a run with the same seed makes the same
+calls in the same order. Work the components start on their own threads
+(2PC phases sent in parallel, elections answered in the background) is
+not scheduled and may interleave differently, but each link still sees
+the same drops and latencies.
+"""
+
+import contextvars
+import heapq
+import itertools
+import logging
+import random
+import socket
+import threading
+import uuid
+import xmlrpc.client
+from collections import defaultdict
+from concurrent.futures import Future
+from contextlib import contextmanager
+from dataclasses import dataclass
+from typing import Callable, Dict, Iterable, Iterator, List, Optional, Tuple
+from xmlrpc.server import SimpleXMLRPCDispatcher
+
+from .failover import ReplicaStore, RoomFailover
+from .failure_detector import FailureDetector, MembershipEvent, PeerState
+from .faults import FaultInjector
+from .log_context import set_transport_factory
+from .peer_registry import PeerRegistry
+from .replication import ReplicationManager
+from .room_state import RoomStateManager
+from .total_order import SequenceBuffer
+from .tpc import TPCCoordinator
+from .vector_clock import CausalBuffer
+from .xmlrpc_server import ThreadedXMLRPCServer, XMLRPCServer
+
+logger = logging.getLogger(__name__)
+
+# One-way broadcasts, delivered after the link's latency
+DEFERRED_METHODS = frozenset(
+    {
+        "receive_message_broadcast",
+        "receive_member_event_broadcast",
+        "receive_presence_update",
+        "receive_profile_update",
+    }
+)
+
+# Default one-way latency range of a link, in virtual seconds
+DEFAULT_LATENCY = (0.001, 0.01)
+
+# Call outcomes recorded in the trace
+OK = "ok"
+FAULT = "fault"
+REFUSED = "refused"
+PARTITIONED = "partitioned"
+DROPPED = "dropped"
+TIMED_OUT = "timed_out"
+
+# The simulated node making the current call, if any
+_current_node: contextvars.ContextVar[Optional[str]] = contextvars.ContextVar(
+    "simulated_node", default=None
+)
+
+
+def current_node() -> Optional[str]:
+    """Get the ID of the simulated node acting in this context, if any."""
+    return _current_node.get()
+
+
+@contextmanager
+def acting_as(node_id: str) -> Iterator[None]:
+    """
+    Attribute the calls made in this context to a simulated node.
+
+    Args:
+        node_id: ID of the simulated node
+    """
+    token = _current_node.set(node_id)
+    try:
+        yield
+    finally:
+        _current_node.reset(token)
+
+
+class SimulatedCrash(Exception):
+    """Raised where a node crashed by an injected fault stops running."""
+
+
+@dataclass
+class Link:
+    """Fault settings of the link from one node to another."""
+
+    latency: Tuple[float, float] = DEFAULT_LATENCY
+    drop_rate: float = 0.0
+
+
+@dataclass(frozen=True)
+class TraceEntry:
+    """A call made on the simulated network."""
+
+    time: float
+    source: Optional[str]
+    target: str
+    method: str
+    outcome: str
+
+
+class SimulatedExecutor:
+    """Executor whose work is queued on a simulation's scheduler."""
+
+    def __init__(self, simulation: "Simulation"):
+        """
+        Initialize the executor.
+
+        Args:
+            simulation: The Simulation that runs the work
+        """
+        self.simulation = simulation
+
+    def submit(self, fn: Callable, *args, **kwargs) -> Future:
+        """
+        Queue a call to run at the current virtual time.
+
+        Returns:
+            A Future holding the call's result once it has run
+        """
+        future: Future = Future()
+
+        def run():
+            if not future.set_running_or_notify_cancel():
+                return
+            try:
+                future.set_result(fn(*args, **kwargs))
+            except Exception as e:
+                future.set_exception(e)
+
+        self.simulation.schedule(0, run)
+        return future
+
+    def shutdown(self, wait: bool = True) -> None:
+        """Nothing to stop; queued work is dropped with the simulation."""
+
+
+class SimulatedDispatcher(ThreadedXMLRPCServer):
+    """The XML-RPC server's dispatcher and checks, without a socket."""
+
+    def __init__(self):
+        """Initialize the dispatcher."""
+        SimpleXMLRPCDispatcher.__init__(self, allow_none=True)
+
+
+class SimulatedTransport:
+    """XML-RPC transport sending calls over a SimulatedNetwork."""
+
+    def __init__(
+        self,
+        network: "SimulatedNetwork",
+        address: str,
+        timeout: Optional[float] = None,
+    ):
+        """
+        Initialize the transport.
+
+        Args:
+            network: The network carrying the calls
+            address: Address of the called node
+            timeout: Caller's timeout in seconds, if any
+        """
+        self.network = network
+        self.address = address
+        self.timeout = timeout
+
+    def request(self, host, handler, request_body, verbose=False):
+        """Send a marshalled call and unmarshal the response."""
+        response = self.network.call(self.address, request_body, self.timeout)
+        return xmlrpc.client.loads(response)[0]
+
+    def close(self) -> None:
+        """Nothing to close; calls don't hold connections."""
+
+
+class SimulatedNetwork:
+    """Links between simulated nodes, with latency, drops and partitions."""
+
+    def __init__(
+        self,
+        simulation: "Simulation",
+        seed: int = 0,
+        latency: Tuple[float, float] = DEFAULT_LATENCY,
+        drop_rate: float = 0.0,
+    ):
+        """
+        Initialize the network.
+
+        Args:
+            simulation: The Simulation whose scheduler delivers broadcasts
+            seed: Seed of the per-link random generators
+            latency: Default (min, max) one-way latency in seconds
+            drop_rate: Default probability of dropping a call
+        """
+        self.simulation = simulation
+        self.seed = seed
+        self.default_link = Link(latency, drop_rate)
+        self.trace: List[TraceEntry] = []
+        self._lock = threading.Lock()
+        self._addresses: Dict[str, str] = {}
+        self._links: Dict[Tuple[str, str], Link] = {}
+        self._random: Dict[Tuple[str, str], random.Random] = {}
+        self._groups: Dict[str, int] = {}
+        self._crashed: set = set()
+
+    def attach(self, node_id: str, address: str) -> None:
+        """
+        Connect a node to the network.
+
+        Args:
+            node_id: ID of the node
+            address: XML-RPC address peers call it at
+        """
+        with self._lock:
+            self._addresses[address] = node_id
+
+    def set_link(
+        self,
+        source: str,
+        target: str,
+        latency: Optional[Tuple[float, float]] = None,
+        drop_rate: Optional[float] = None,
+    ) -> None:
+        """
+        Change the faults of the link from one node to another.
+
+        Args:
+            source: ID of the calling node
+            target: ID of the called node
+            latency: (min, max) one-way latency in seconds
+            drop_rate: Probability of dropping a call
+        """
+        with self._lock:
+            link = self._links.get((source, target), self.default_link)
+            self._links[(source, target)] = Link(
+                link.latency if latency is None else latency,
+                link.drop_rate if drop_rate is None else drop_rate,
+            )
+
+    def partition(self, *groups: Iterable[str]) -> None:
+        """
+        Split the network so that only nodes of the same group can talk.
+
+        Nodes not named in any group form one more group together.
+
+        Args:
+            *groups: Node IDs of each side of the partition
+        """
+        with self._lock:
+            self._groups = {
+                node_id: index
+                for index, group in enumerate(groups, start=1)
+                for node_id in group
+            }
+
+    def heal(self) -> None:
+        """Remove the partition."""
+        with self._lock:
+            self._groups = {}
+
+    def crash(self, node_id: str) -> None:
+        """Stop a node: calls to it are refused and it makes none."""
+        with self._lock:
+            self._crashed.add(node_id)
+
+    def recover(self, node_id: str) -> None:
+        """Let a crashed node answer and make calls again."""
+        with self._lock:
+            self._crashed.discard(node_id)
+
+    def is_crashed(self, node_id: str) -> bool:
+        """Check if a node is crashed."""
+        with self._lock:
+            return node_id in self._crashed
+
+    def call(
+        self, address: str, request_body: bytes, timeout: Optional[float]
+    ) -> bytes:
+        """
+        Carry a marshalled call from the current node to a node.
+
+        Args:
+            address: Address of the called node
+            request_body: The marshalled call
+            timeout: Caller's timeout in seconds, if any
+
+        Returns:
+            The marshalled response
+
+        Raises:
+            ConnectionRefusedError: If no node answers at the address
+            socket.timeout: If the call is partitioned, dropped or too slow
+        """
+        method = xmlrpc.client.loads(request_body)[1]
+        source = current_node()
+        with self._lock:
+            target = self._addresses.get(address)
+            if target is None:
+                raise ConnectionRefusedError(f"No node at {address}")
+            outcome, delay = self._route(source, target)
+            if outcome is None and timeout is not None and 2 * delay > timeout:
+                outcome = TIMED_OUT
+            if outcome is not None:
+                self._record(source, target, method, outcome)
+        if outcome == REFUSED:
+            raise ConnectionRefusedError(f"Node {target} is down")
+        if outcome is not None:
+            raise socket.timeout("timed out")
+
+        if method in DEFERRED_METHODS and source not in (None, target):
+            self.simulation.schedule(
+                delay,
+                contextvars.copy_context().run,
+                self._deliver,
+                source,
+                target,
+                method,
+                request_body,
+            )
+            return xmlrpc.client.dumps((True,), methodresponse=True)
+        return self._deliver(source, target, method, request_body)
+
+    def _route(
+        self, source: Optional[str], target: str
+    ) -> Tuple[Optional[str], float]:
+        """Decide a call's fate; returns (failure outcome or None, delay)."""
+        if target in self._crashed or source in self._crashed:
+            return REFUSED, 0.0
+        if source is None or source == target:
+            return None, 0.0
+        if self._groups.get(source, 0) != self._groups.get(target, 0):
+            return PARTITIONED, 0.0
+        link = self._links.get((source, target), self.default_link)
+        generator = self._random.get((source, target))
+        if generator is None:
+            generator = random.Random(f"{self.seed}:{source}:{target}")
+            self._random[(source, target)] = generator
+        if generator.random() < link.drop_rate:
+            return DROPPED, 0.0
+        return None, generator.uniform(*link.latency)
+
+    def _deliver(
+        self,
+        source: Optional[str],
+        target: str,
+        method: str,
+        request_body: bytes,
+    ) -> Optional[bytes]:
+        """Have the called node answer a call."""
+        node = self.simulation.nodes[target]
+        if self.is_crashed(target):
+            with self._lock:
+                self._record(source, target, method, REFUSED)
+            return None
+        with acting_as(target):
+            response = node.dispatcher._marshaled_dispatch(request_body)
+        if self.is_crashed(target):
+            # The node crashed answering; the response is lost
+            with self._lock:
+                self._record(source, target, method, REFUSED)
+            raise ConnectionResetError(f"Node {target} crashed")
+        try:
+            xmlrpc.client.loads(response)
+            outcome = OK
+        except xmlrpc.client.Fault:
+            outcome = FAULT
+        with self._lock:
+            self._record(source, target, method, outcome)
+        return response
+
+    def _record(
+        self, source: Optional[str], target: str, method: str, outcome: str
+    ) -> None:
+        """Add a call to the trace (the lock must be held)."""
+        self.trace.append(
+            TraceEntry(self.simulation.now, source, target, method, outcome)
+        )
+
+
+class SimulatedNode:
+    """A node's components, wired as in main.py, on a simulated network."""
+
+    def __init__(self, simulation: "Simulation", node_id: str):
+        """
+        Initialize the node.
+
+        Args:
+            simulation: The Simulation the node runs in
+            node_id: ID of the node
+        """
+        self.simulation = simulation
+        self.node_id = node_id
+        self.address = f"http://{node_id}:9090"
+        self.room_manager = RoomStateManager(node_id)
+        self.peer_registry = PeerRegistry(node_id)
+        self.failure_detector = FailureDetector(node_id, self.peer_registry)
+        self.replica_store = ReplicaStore()
+        self.failover = RoomFailover(
+            node_id,
+            self.address,
+            self.room_manager,
+            self.replica_store,
+            self.peer_registry,
+            self.failure_detector,
+        )
+        self.replication = ReplicationManager(
+            node_id,
+            self.room_manager,
+            self.peer_registry,
+            failure_detector=self.failure_detector,
+            executor=SimulatedExecutor(simulation),
+        )
+        self.faults = FaultInjector(node_id, crash=self._crash)
+        self.tpc = TPCCoordinator(
+            node_id, self.peer_registry, faults=self.faults
+        )
+        self.causal_buffer = CausalBuffer()
+        self.sequence_buffer = SequenceBuffer()
+        self.server = XMLRPCServer(
+            self.room_manager,
+            "localhost",
+            0,
+            self.address,
+            self.peer_registry,
+            causal_buffer=self.causal_buffer,
+            failover=self.failover,
+            replication=self.replication,
+            sequence_buffer=self.sequence_buffer,
+            faults=self.faults,
+        )
+        self.server.set_broadcast_callback(self._record_event)
+        self.failover.set_notify_callback(self._record_event)
+        self.dispatcher = SimulatedDispatcher()
+        self.dispatcher.faults = self.faults
+        self.server.register_methods(self.dispatcher)
+        # Maps room_id -> events delivered to the room's local clients
+        self.events: Dict[str, List[Dict]] = defaultdict(list)
+
+    def call(self, node_id: str, method: str, *args):
+        """
+        Call a NodeService method as this node, locally or over the network.
+
+        Args:
+            node_id: ID of the called node
+            method: Name of the method
+            *args: The method's arguments
+
+        Returns:
+            The method's result
+        """
+        with acting_as(self.node_id):
+            if node_id == self.node_id:
+                return getattr(self.server, method)(*args)
+            return self.peer_registry.call_peer(node_id, method, *args)
+
+    def create_room(self, room_name: str, creator: str, **options) -> str:
+        """
+        Create a room administered by this node, with its creator in it.
+
+        Args:
+            room_name: Name of the room
+            creator: Username of the creator
+            **options: Other RoomStateManager.create_room arguments
+
+        Returns:
+            The room ID
+        """
+        room = self.room_manager.create_room(room_name, creator, **options)
+        self.room_manager.add_member(room.room_id, creator)
+        return room.room_id
+
+    def join(self, room_id: str, username: str, admin_node: str) -> Dict:
+        """
+        Join a user connected to this node to a room.
+
+        A remote room is followed the way the WebSocket server does: its
+        clock and sequence seed the delivery buffers and the join result
+        seeds this node's replica.
+
+        Args:
+            room_id: The room ID
+            username: The joining user
+            admin_node: ID of the room's administrator
+
+        Returns:
+            The administrator's join_room result
+        """
+        result = self.call(
+            admin_node, "join_room", room_id, username, self.node_id
+        )
+        if admin_node != self.node_id and result.get("success"):
+            room_info = result["room_info"]
+            messages = result.get("messages") or []
+            self.causal_buffer.seed(
+                room_id, room_info.get("vector_clock") or {}
+            )
+            if room_info.get("total_order"):
+                last_sequence = (
+                    messages[-1]["sequence_number"] if messages else 0
+                )
+                self.sequence_buffer.seed(room_id, last_sequence)
+            self.replica_store.update_from_join(room_info, messages, username)
+        return result
+
+    def send(
+        self, room_id: str, username: str, content: str, message_id: str = ""
+    ) -> Dict:
+        """
+        Send a message from a user connected to this node.
+
+        Args:
+            room_id: The room ID
+            username: The sender
+            content: Message text
+            message_id: Optional message ID chosen by the sender
+
+        Returns:
+            The administrator's forward_message result
+        """
+        return self.call(
+            self.admin_of(room_id),
+            "forward_message",
+            room_id,
+            username,
+            content,
+            self.node_id,
+            "",
+            message_id,
+        )
+
+    def admin_of(self, room_id: str) -> Optional[str]:
+        """Get the administrator of a room as far as this node knows."""
+        if self.room_manager.get_room(room_id):
+            return self.node_id
+        replica = self.replica_store.get(room_id)
+        return replica.admin_node if replica else None
+
+    def delivered(self, room_id: str) -> List[Dict]:
+        """Get the messages delivered to a room's local clients, in order."""
+        return [
+            event["data"]
+            for event in self.events[room_id]
+            if event.get("type") == "new_message"
+        ]
+
+    def heartbeat(self) -> List[MembershipEvent]:
+        """
+        Run one heartbeat round against every peer, in node ID order.
+
+        Rooms of peers declared dead go to election, as the failover's
+        membership subscriber does.
+
+        Returns:
+            The membership events produced by this round
+        """
+        events = []
+        detector = self.failure_detector
+        with acting_as(self.node_id):
+            for node_id in sorted(self.peer_registry.list_peers()):
+                try:
+                    response = self.peer_registry.call_peer(
+                        node_id, "heartbeat", timeout=detector.probe_timeout
+                    )
+                    ok = response.get("status") == "ok"
+                except Exception as e:
+                    logger.debug(f"Heartbeat to {node_id} failed: {e}")
+                    ok = False
+                if ok:
+                    event = detector.record_success(node_id, 0.0)
+                else:
+                    event = detector.record_failure(node_id)
+                if event:
+                    events.append(event)
+            for event in events:
+                if event.current == PeerState.DEAD:
+                    self.failover.handle_node_dead(event.node_id)
+        return events
+
+    async def delete_room(self, room_id: str) -> bool:
+        """
+        Delete a room administered by this node through 2PC.
+
+        Mirrors the WebSocket server's delete_room, with every peer as a
+        participant.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            bool: True if the deletion committed
+        """
+        room = self.room_manager.get_room(room_id)
+        transaction = self.room_manager.start_deletion_transaction(
+            room_id, sorted(self.peer_registry.list_peers())
+        )
+        if transaction is None:
+            return False
+        transaction_id = transaction.transaction_id
+
+        def on_decision(result):
+            for node_id, vote in result.votes.items():
+                self.room_manager.record_vote(transaction_id, node_id, vote)
+            if result.committed:
+                self.room_manager.transition_to_commit(transaction_id)
+            else:
+                self.room_manager.transition_to_rollback(transaction_id)
+
+        with acting_as(self.node_id):
+            result = await self.tpc.execute(
+                "delete_room",
+                {
+                    "room_id": room_id,
+                    "room_name": room.room_name,
+                    "coordinator": self.node_id,
+                },
+                transaction.participants,
+                transaction_id=transaction_id,
+                on_decision=on_decision,
+            )
+        if result.committed:
+            self.room_manager.complete_deletion(transaction_id)
+            return True
+        self.room_manager.rollback_deletion(transaction_id)
+        return False
+
+    def _crash(self) -> None:
+        """Injected crash: leave the network and stop the current work."""
+        self.simulation.network.crash(self.node_id)
+        raise SimulatedCrash(f"Node {self.node_id} crashed")
+
+    def _record_event(self, room_id: str, message: Dict, exclude_user=None):
+        """Broadcast callback: keep what local clients would receive."""
+        self.events[room_id].append(message)
+
+
+class Simulation:
+    """
+    In-process nodes on a simulated network under a seeded scheduler.
+
+    Use as a context manager; ServerProxy calls go over the simulated
+    network until it exits.
+    """
+
+    def __init__(
+        self,
+        seed: int = 0,
+        latency: Tuple[float, float] = DEFAULT_LATENCY,
+        drop_rate: float = 0.0,
+    ):
+        """
+        Initialize the simulation.
+
+        Args:
+            seed: Seed of the scheduler and the network's links
+            latency: Default (min, max) one-way latency in seconds
+            drop_rate: Default probability of dropping a call
+        """
+        self.seed = seed
+        self.now = 0.0
+        self.network = SimulatedNetwork(self, seed, latency, drop_rate)
+        self.nodes: Dict[str, SimulatedNode] = {}
+        self._random = random.Random(seed)
+        self._ids = random.Random(f"{seed}:ids")
+        self._uuid4: Optional[Callable] = None
+        self._counter = itertools.count()
+        self._queue: List[tuple] = []
+        self._lock = threading.Lock()
+
+    def __enter__(self) -> "Simulation":
+        set_transport_factory(
+            lambda uri, transport: SimulatedTransport(
+                self.network, uri, getattr(transport, "timeout", None)
+            )
+        )
+        self._uuid4 = uuid.uuid4
+        uuid.uuid4 = self._next_uuid
+        return self
+
+    def __exit__(self, *exc_info) -> None:
+        set_transport_factory(None)
+        uuid.uuid4 = self._uuid4
+
+    def _next_uuid(self) -> uuid.UUID:
+        """Seeded stand-in for uuid.uuid4."""
+        with self._lock:
+            bits = self._ids.getrandbits(128)
+        return uuid.UUID(int=bits, version=4)
+
+    def add_node(self, node_id: str) -> SimulatedNode:
+        """
+        Start a node, registered as a peer of every other node.
+
+        Args:
+            node_id: ID of the new node
+
+        Returns:
+            The SimulatedNode
+        """
+        node = SimulatedNode(self, node_id)
+        for other in self.nodes.values():
+            other.peer_registry.register_peer(node_id, node.address)
+            node.peer_registry.register_peer(other.node_id, other.address)
+        self.nodes[node_id] = node
+        self.network.attach(node_id, node.address)
+        return node
+
+    def node(self, node_id: str) -> SimulatedNode:
+        """Get a node by ID."""
+        return self.nodes[node_id]
+
+    def schedule(self, delay: float, callback: Callable, *args) -> None:
+        """
+        Queue a callback to run after a virtual delay.
+
+        Args:
+            delay: Seconds from now
+            callback: Function to call
+            *args: Arguments to call it with
+        """
+        with self._lock:
+            heapq.heappush(
+                self._queue,
+                (
+                    self.now + delay,
+                    self._random.random(),
+                    next(self._counter),
+                    callback,
+                    args,
+                ),
+            )
+
+    def step(self) -> bool:
+        """
+        Run the next queued callback, moving the clock to its time.
+
+        Returns:
+            bool: False if nothing was queued
+        """
+        with self._lock:
+            if not self._queue:
+                return False
+            when, _, _, callback, args = heapq.heappop(self._queue)
+            self.now = max(self.now, when)
+        callback(*args)
+        return True
+
+    def run(self, max_steps: int = 100000) -> int:
+        """
+        Run queued callbacks until none are left.
+
+        Args:
+            max_steps: Callbacks to run at most
+
+        Returns:
+            The number of callbacks run
+        """
+        steps = 0
+        while steps < max_steps and self.step():
+            steps += 1
+        return steps
+
+    def advance(self, seconds: float) -> int:
+        """
+        Run the callbacks due within a virtual time span.
+
+        Args:
+            seconds: Length of the span
+
+        Returns:
+            The number of callbacks run
+        """
+        until = self.now + seconds
+        steps = 0
+        while True:
+            with self._lock:
+                if not self._queue or self._queue[0][0] > until:
+                    break
+            self.step()
+            steps += 1
+        self.now = until
+        return steps
+
+    def heartbeat_round(self) -> List[MembershipEvent]:
+        """
+        Run a heartbeat round on every running node, in a seeded order.
+
+        Returns:
+            The membership events produced by the round
+        """
+        node_ids = sorted(self.nodes)
+        self._random.shuffle(node_ids)
+        events = []
+        for node_id in node_ids:
+            if not self.network.is_crashed(node_id):
+                events.extend(self.nodes[node_id].heartbeat())
+        return events
@@ -0,0 +1,663 @@
+"""
+Room State Snapshots and Transfer
+
+When a room's administration moves to another node, the new admin needs
+the room's full state. A RoomSnapshot captures it: metadata, members and
+the nodes they are on, roles, bans, outstanding invites, the message
+buffer, and the sequence counter and vector clock.
+
+Snapshots are sent in chunks over XML-RPC (inter-node calls use XML-RPC,
+so a chunked transfer stands in for a streaming RPC):
+
+1. begin_snapshot_transfer announces the transfer's ID, size, number of
+   chunks and SHA-256 checksum. The receiver answers with the index of the
+   first chunk it still needs.
+2. receive_snapshot_chunk sends each chunk with its own checksum. A chunk
+   that fails its checksum is refused and sent again.
+3. commit_snapshot_transfer asks the receiver to check the whole
+   snapshot and take over the room.
+
+If the connection fails partway through, the sender calls
+begin_snapshot_transfer again with the same transfer ID and resumes from
+the chunk the receiver asks for, instead of starting over. Receivers
+remember the outcome of committed transfers for a while, so a sender that
+missed the commit reply gets the same result when it retries.
+
+The same transfer bootstraps new follower replicas of a busy room (see
+replication.py). A REPLICA transfer doesn't hand the room over: the
+receiver installs the snapshot as its replica of the room, and answers
+the commit with the sequence number the snapshot goes through, so the
+administrator streams the messages after it.
+"""
+
+import hashlib
+import json
+import logging
+import threading
+import time
+import uuid
+import xmlrpc.client
+from dataclasses import asdict, dataclass, field
+from typing import Any, Callable, Dict, List, Optional
+
+from .delivery import EXACTLY_ONCE
+
+logger = logging.getLogger(__name__)
+
+# Format version of encoded snapshots
+SNAPSHOT_VERSION = 1
+
+# Transfer configuration
+CHUNK_SIZE = 256 * 1024  # bytes of encoded snapshot per chunk
+MAX_TRANSFER_RETRIES = 3  # interrupted calls tolerated per transfer
+TRANSFER_TTL = 120  # seconds unfinished or committed transfers are kept
+CHUNK_TIMEOUT = 10  # seconds allowed for each transfer call
+
+# Capability advertised by nodes that accept snapshot transfers
+SNAPSHOT_CAPABILITY = "snapshot_transfer"
+
+# Purposes of a transfer: taking over the room, or following it
+HANDOFF = "handoff"
+REPLICA = "replica"
+
+# Fields of a snapshot that aren't arguments of restore_room
+_METADATA_FIELDS = ("version", "source_node", "taken_at")
+
+
+class SnapshotError(Exception):
+    """A snapshot is malformed, of an unsupported version, or corrupt."""
+
+
+def checksum(data: bytes) -> str:
+    """Get the SHA-256 checksum of some data, as hex."""
+    return hashlib.sha256(data).hexdigest()
+
+
+@dataclass
+class RoomSnapshot:
+    """
+    The full state of a room at one point in time.
+
+    Attributes:
+        room_id: Unique identifier for the room
+        room_name: Name of the room
+        creator_id: ID of the user who created the room
+        members: Maps each member's username to its node ID
+        messages: Message buffer in sequence order
+        message_counter: Highest sequence number assigned so far
+        vector_clock: Vector clock of the latest message
+        description: Optional room description
+        private: True if the room is private
+        total_order: True if the room delivers messages in total order
+        invites: Outstanding invites of a private room, as dicts
+        banned: Usernames banned from the room
+        roles: Maps username -> role of promoted members
+        max_members: Most members the room may have (0 for no limit)
+        waitlist_enabled: True if the room has a waiting list
+        waitlist: Maps waiting usernames -> node IDs, in order
+        read_positions: Maps username -> last read sequence number
+        public_keys: Maps username -> published public key record
+        webhooks: Maps webhook ID -> webhook record
+        bots: Maps bot name -> commands routed to it
+        bridges: Maps bridge ID -> bridge record
+        retention: The room owner's retention limits
+        expired_through: Highest sequence number removed by retention
+        announcement: True if only the owner and moderators may post
+        pinned: IDs of the room's pinned messages, in the order pinned
+        topic: Optional room topic
+        metadata_versions: Maps metadata field -> HLC timestamp of its
+            last update
+        spam_thresholds: Spam thresholds changed from their defaults
+        content_filters: The room's content filters, in the order they run
+        member_nodes: Maps username -> every node the member is
+            connected through, for members on several nodes
+        delivery: The room's delivery guarantee (see delivery.py)
+        ephemeral: True if the room is torn down once empty or idle
+        scheduled: Maps message ID -> message scheduled to be sent later
+        placement: Tags the room's admin node must have (see placement.py)
+        durable: True if messages wait for a write quorum (see
+            durability.py)
+        member_set: The room's membership set (see member_set.py)
+        source_node: Node the snapshot was taken on
+        taken_at: UNIX time the snapshot was taken
+        version: Format version of the snapshot
+    """
+
+    room_id: str
+    room_name: str
+    creator_id: str
+    members: Dict[str, str]
+    messages: List[Dict]
+    message_counter: int
+    vector_clock: Dict[str, int]
+    description: Optional[str] = None
+    private: bool = False
+    total_order: bool = False
+    invites: List[Dict] = field(default_factory=list)
+    banned: List[str] = field(default_factory=list)
+    roles: Dict[str, str] = field(default_factory=dict)
+    max_members: int = 0
+    waitlist_enabled: bool = False
+    waitlist: Dict[str, str] = field(default_factory=dict)
+    read_positions: Dict[str, int] = field(default_factory=dict)
+    public_keys: Dict[str, Dict] = field(default_factory=dict)
+    webhooks: Dict[str, Dict] = field(default_factory=dict)
+    bots: Dict[str, List[str]] = field(default_factory=dict)
+    bridges: Dict[str, Dict] = field(default_factory=dict)
+    retention: List[str] = field(default_factory=list)
+    expired_through: int = 0
+    announcement: bool = False
+    pinned: List[str] = field(default_factory=list)
+    topic: Optional[str] = None
+    metadata_versions: Dict[str, str] = field(default_factory=dict)
+    spam_thresholds: Dict[str, int] = field(default_factory=dict)
+    content_filters: List[Dict[str, Any]] = field(default_factory=list)
+    member_nodes: Dict[str, List[str]] = field(default_factory=dict)
+    delivery: str = EXACTLY_ONCE
+    ephemeral: bool = False
+    scheduled: Dict[str, Dict] = field(default_factory=dict)
+    placement: Dict[str, str] = field(default_factory=dict)
+    durable: bool = False
+    member_set: Dict = field(default_factory=dict)
+    source_node: str = ""
+    taken_at: float = field(default_factory=time.time)
+    version: int = SNAPSHOT_VERSION
+
+    @classmethod
+    def from_room(
+        cls, room_manager, room_id: str
+    ) -> Optional["RoomSnapshot"]:
+        """
+        Take a snapshot of a room hosted on this node.
+
+        Args:
+            room_manager: RoomStateManager hosting the room
+            room_id: The room ID
+
+        Returns:
+            The snapshot, or None if the room isn't hosted here
+        """
+        room = room_manager.get_room(room_id)
+        if room is None:
+            return None
+        return cls(
+            room_id=room.room_id,
+            room_name=room.room_name,
+            creator_id=room.creator_id,
+            members={
+                username: info.node_id
+                for username, info in room.member_info.items()
+            },
+            messages=room_manager.get_messages(room_id),
+            message_counter=room.message_counter,
+            vector_clock=dict(room.vector_clock),
+            description=room.description,
+            private=room.private,
+            total_order=room.total_order,
+            invites=room_manager.list_invites(room_id),
+            banned=room_manager.get_banned(room_id),
+            roles=room_manager.get_roles(room_id),
+            max_members=room.max_members,
+            waitlist_enabled=room.waitlist_enabled,
+            waitlist=dict(room.waitlist),
+            read_positions=room_manager.get_read_positions(room_id),
+            public_keys=room_manager.get_all_public_keys(room_id),
+            webhooks=dict(room.webhooks),
+            bots={name: list(c) for name, c in room.bots.items()},
+            bridges=dict(room.bridges),
+            retention=list(room.retention),
+            expired_through=room.expired_through,
+            announcement=room.announcement,
+            pinned=list(room.pinned),
+            topic=room.topic,
+            metadata_versions=dict(room.metadata_versions),
+            spam_thresholds=dict(room.spam_thresholds),
+            content_filters=[dict(f) for f in room.content_filters],
+            member_nodes={
+                username: sorted(info.nodes)
+                for username, info in room.member_info.items()
+                if len(info.nodes) > 1
+            },
+            delivery=room.delivery,
+            ephemeral=room.ephemeral,
+            scheduled=room_manager.get_scheduled(room_id),
+            placement=dict(room.placement),
+            durable=room.durable,
+            member_set=room.member_set.to_dict(),
+            source_node=room_manager.node_id,
+        )
+
+    @classmethod
+    def from_dict(cls, data: Dict) -> "RoomSnapshot":
+        """
+        Create a snapshot from its dictionary form.
+
+        Raises:
+            SnapshotError: If the version is unsupported or fields are
+                missing
+        """
+        version = data.get("version", SNAPSHOT_VERSION)
+        if version != SNAPSHOT_VERSION:
+            raise SnapshotError(f"Unsupported snapshot version {version}")
+        try:
+            return cls(**data)
+        except TypeError as e:
+            raise SnapshotError(f"Malformed snapshot: {e}")
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return asdict(self)
+
+    def restore_args(self) -> Dict:
+        """Get the room state as keyword arguments of restore_room."""
+        state = self.to_dict()
+        for name in _METADATA_FIELDS:
+            del state[name]
+        return state
+
+    def encode(self) -> bytes:
+        """Encode the snapshot as canonical JSON."""
+        return json.dumps(
+            self.to_dict(), sort_keys=True, separators=(",", ":")
+        ).encode()
+
+    @classmethod
+    def decode(cls, data: bytes) -> "RoomSnapshot":
+        """
+        Decode a snapshot encoded by encode().
+
+        Raises:
+            SnapshotError: If the data isn't a valid snapshot
+        """
+        try:
+            fields = json.loads(data.decode())
+        except (UnicodeDecodeError, json.JSONDecodeError) as e:
+            raise SnapshotError(f"Snapshot is not valid JSON: {e}")
+        if not isinstance(fields, dict):
+            raise SnapshotError("Snapshot is not an object")
+        return cls.from_dict(fields)
+
+
+class SnapshotSender:
+    """
+    Sends snapshots to peers in checksummed chunks.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        peer_registry,
+        chunk_size: int = CHUNK_SIZE,
+        max_retries: int = MAX_TRANSFER_RETRIES,
+    ):
+        """
+        Initialize the sender.
+
+        Args:
+            node_id: ID of this node
+            peer_registry: PeerRegistry used to reach peers
+            chunk_size: Bytes of encoded snapshot per chunk
+            max_retries: Interrupted calls tolerated before giving up
+        """
+        self.node_id = node_id
+        self.peer_registry = peer_registry
+        self.chunk_size = chunk_size
+        self.max_retries = max_retries
+
+    def _call(self, peer_id: str, method: str, *args) -> Dict:
+        """Make one transfer call to a peer."""
+        return self.peer_registry.call_peer(
+            peer_id, method, *args, timeout=CHUNK_TIMEOUT
+        )
+
+    def send(
+        self, peer_id: str, snapshot: RoomSnapshot, purpose: str = HANDOFF
+    ) -> Dict:
+        """
+        Transfer a snapshot to a peer.
+
+        Args:
+            peer_id: Node ID of the receiving peer
+            snapshot: The room's snapshot
+            purpose: HANDOFF to have the peer take over the room, or
+                REPLICA to have it install the snapshot as its replica
+
+        Returns:
+            dict: The receiver's commit result, with 'success' and, on
+            failure, 'error' and 'error_code'
+
+        Raises:
+            Exception: The last connection error, if the transfer was
+                interrupted more than max_retries times
+        """
+        data = snapshot.encode()
+        chunks = [
+            data[i : i + self.chunk_size]
+            for i in range(0, len(data), self.chunk_size)
+        ] or [b""]
+        transfer_id = str(uuid.uuid4())
+        attempts = 0
+        next_chunk = None
+        # Older receivers only know handoffs, which need no purpose
+        extra_args = () if purpose == HANDOFF else (purpose,)
+
+        while True:
+            try:
+                if next_chunk is None:
+                    result = self._call(
+                        peer_id,
+                        "begin_snapshot_transfer",
+                        transfer_id,
+                        snapshot.room_id,
+                        len(data),
+                        len(chunks),
+                        checksum(data),
+                        self.node_id,
+                        *extra_args,
+                    )
+                    if not result.get("success"):
+                        return result
+                    next_chunk = result["next_chunk"]
+
+                while next_chunk < len(chunks):
+                    chunk = chunks[next_chunk]
+                    result = self._call(
+                        peer_id,
+                        "receive_snapshot_chunk",
+                        transfer_id,
+                        next_chunk,
+                        xmlrpc.client.Binary(chunk),
+                        checksum(chunk),
+                    )
+                    if not result.get("success"):
+                        if result.get("error_code") != "CHECKSUM_MISMATCH":
+                            return result
+                        attempts += 1
+                        if attempts > self.max_retries:
+                            return result
+                        continue
+                    next_chunk = result["next_chunk"]
+
+                result = self._call(
+                    peer_id, "commit_snapshot_transfer", transfer_id
+                )
+                logger.info(
+                    f"Sent snapshot of room {snapshot.room_id} to {peer_id} "
+                    f"({len(data)} bytes in {len(chunks)} chunks)"
+                )
+                return result
+            except Exception as e:
+                attempts += 1
+                if attempts > self.max_retries:
+                    raise
+                logger.warning(
+                    f"Snapshot transfer {transfer_id} to {peer_id} was "
+                    f"interrupted, resuming: {e}"
+                )
+                next_chunk = None
+
+
+@dataclass
+class IncomingTransfer:
+    """
+    A snapshot being received.
+
+    Attributes:
+        transfer_id: ID chosen by the sender
+        room_id: Room the snapshot is of
+        size: Size of the encoded snapshot in bytes
+        chunk_count: Number of chunks
+        checksum: SHA-256 checksum of the encoded snapshot
+        sender: Node ID of the sender
+        purpose: HANDOFF or REPLICA
+        chunks: Received chunks by index
+        updated_at: UNIX time of the last call for the transfer
+        result: Commit result, once committed
+    """
+
+    transfer_id: str
+    room_id: str
+    size: int
+    chunk_count: int
+    checksum: str
+    sender: str
+    purpose: str = HANDOFF
+    chunks: Dict[int, bytes] = field(default_factory=dict)
+    updated_at: float = field(default_factory=time.time)
+    result: Optional[Dict] = None
+
+    def next_chunk(self) -> int:
+        """Get the index of the first chunk not received yet."""
+        if self.result is not None:
+            return self.chunk_count
+        for index in range(self.chunk_count):
+            if index not in self.chunks:
+                return index
+        return self.chunk_count
+
+
+class SnapshotReceiver:
+    """
+    Receives chunked snapshots and hands complete ones to a callback.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        on_snapshot: Callable[[RoomSnapshot, str], Dict],
+        ttl: float = TRANSFER_TTL,
+        clock: Callable[[], float] = time.time,
+        on_replica: Optional[Callable[[RoomSnapshot, str], Dict]] = None,
+    ):
+        """
+        Initialize the receiver.
+
+        Args:
+            node_id: ID of this node
+            on_snapshot: Called with each verified snapshot and the node
+                that sent it; returns the commit result dict
+            ttl: Seconds an idle or committed transfer is kept
+            clock: Function returning the current time in seconds
+            on_replica: Called like on_snapshot with the snapshots of
+                REPLICA transfers; without it they are refused
+        """
+        self.node_id = node_id
+        self.on_snapshot = on_snapshot
+        self.on_replica = on_replica
+        self.ttl = ttl
+        self.clock = clock
+        self._transfers: Dict[str, IncomingTransfer] = {}
+        self._lock = threading.Lock()
+
+    def _error(self, error: str, error_code: str) -> Dict:
+        """Build an error result."""
+        return {
+            "success": False,
+            "node_id": self.node_id,
+            "error": error,
+            "error_code": error_code,
+        }
+
+    def begin(
+        self,
+        transfer_id: str,
+        room_id: str,
+        size: int,
+        chunk_count: int,
+        snapshot_checksum: str,
+        sender: str,
+        purpose: str = HANDOFF,
+    ) -> Dict:
+        """
+        Start or resume receiving a snapshot.
+
+        Args:
+            transfer_id: ID chosen by the sender
+            room_id: Room the snapshot is of
+            size: Size of the encoded snapshot in bytes
+            chunk_count: Number of chunks
+            snapshot_checksum: SHA-256 checksum of the encoded snapshot
+            sender: Node ID of the sender
+            purpose: HANDOFF or REPLICA
+
+        Returns:
+            dict: {'success': True, 'next_chunk': int} or an error
+        """
+        if purpose not in (HANDOFF, REPLICA) or (
+            purpose == REPLICA and self.on_replica is None
+        ):
+            return self._error(
+                f"Snapshot transfers for {purpose!r} aren't accepted",
+                "UNSUPPORTED_TRANSFER",
+            )
+        self.expire()
+        with self._lock:
+            transfer = self._transfers.get(transfer_id)
+            if transfer is None:
+                transfer = IncomingTransfer(
+                    transfer_id=transfer_id,
+                    room_id=room_id,
+                    size=size,
+                    chunk_count=chunk_count,
+                    checksum=snapshot_checksum,
+                    sender=sender,
+                    purpose=purpose,
+                    updated_at=self.clock(),
+                )
+                self._transfers[transfer_id] = transfer
+                logger.info(
+                    f"Receiving snapshot of room {room_id} from {sender} "
+                    f"({size} bytes in {chunk_count} chunks)"
+                )
+            elif transfer.checksum != snapshot_checksum:
+                return self._error(
+                    f"Transfer {transfer_id} was started with another "
+                    f"snapshot",
+                    "TRANSFER_MISMATCH",
+                )
+            else:
+                transfer.updated_at = self.clock()
+                logger.info(
+                    f"Resuming snapshot transfer {transfer_id} at chunk "
+                    f"{transfer.next_chunk()}"
+                )
+            return {"success": True, "next_chunk": transfer.next_chunk()}
+
+    def add_chunk(
+        self,
+        transfer_id: str,
+        index: int,
+        data: bytes,
+        chunk_checksum: str,
+    ) -> Dict:
+        """
+        Store one chunk of a snapshot.
+
+        Args:
+            transfer_id: ID of the transfer
+            index: Index of the chunk
+            data: The chunk's bytes
+            chunk_checksum: SHA-256 checksum of the chunk
+
+        Returns:
+            dict: {'success': True, 'next_chunk': int} or an error
+        """
+        with self._lock:
+            transfer = self._transfers.get(transfer_id)
+            if transfer is None:
+                return self._error(
+                    f"Unknown transfer {transfer_id}", "UNKNOWN_TRANSFER"
+                )
+            if not 0 <= index < transfer.chunk_count:
+                return self._error(
+                    f"Chunk {index} out of range", "INVALID_CHUNK"
+                )
+            if checksum(data) != chunk_checksum:
+                logger.warning(
+                    f"Chunk {index} of snapshot transfer {transfer_id} "
+                    f"failed its checksum"
+                )
+                return self._error(
+                    f"Chunk {index} failed its checksum", "CHECKSUM_MISMATCH"
+                )
+            transfer.chunks[index] = data
+            transfer.updated_at = self.clock()
+            return {"success": True, "next_chunk": transfer.next_chunk()}
+
+    def commit(self, transfer_id: str) -> Dict:
+        """
+        Verify a complete snapshot and hand it to the callback of its
+        transfer's purpose.
+
+        Args:
+            transfer_id: ID of the transfer
+
+        Returns:
+            dict: The callback's result, or an error
+        """
+        with self._lock:
+            transfer = self._transfers.get(transfer_id)
+            if transfer is None:
+                return self._error(
+                    f"Unknown transfer {transfer_id}", "UNKNOWN_TRANSFER"
+                )
+            if transfer.result is not None:
+                return transfer.result
+            if transfer.next_chunk() < transfer.chunk_count:
+                return self._error(
+                    f"Chunk {transfer.next_chunk()} is missing",
+                    "INCOMPLETE_TRANSFER",
+                )
+            data = b"".join(
+                transfer.chunks[index] for index in range(transfer.chunk_count)
+            )
+
+        if len(data) != transfer.size or checksum(data) != transfer.checksum:
+            with self._lock:
+                self._transfers.pop(transfer_id, None)
+            logger.warning(
+                f"Snapshot of room {transfer.room_id} from "
+                f"{transfer.sender} failed its checksum"
+            )
+            return self._error(
+                "Snapshot failed its checksum", "CHECKSUM_MISMATCH"
+            )
+        try:
+            snapshot = RoomSnapshot.decode(data)
+        except SnapshotError as e:
+            with self._lock:
+                self._transfers.pop(transfer_id, None)
+            return self._error(str(e), "INVALID_SNAPSHOT")
+
+        if transfer.purpose == REPLICA:
+            result = self.on_replica(snapshot, transfer.sender)
+        else:
+            result = self.on_snapshot(snapshot, transfer.sender)
+        with self._lock:
+            transfer.result = result
+            transfer.chunks = {}
+            transfer.updated_at = self.clock()
+        return result
+
+    def expire(self) -> int:
+        """
+        Drop transfers idle for longer than the TTL.
+
+        Returns:
+            int: Number of transfers dropped
+        """
+        cutoff = self.clock() - self.ttl
+        with self._lock:
+            expired = [
+                transfer_id
+                for transfer_id, transfer in self._transfers.items()
+                if transfer.updated_at < cutoff
+            ]
+            for transfer_id in expired:
+                del self._transfers[transfer_id]
+        return len(expired)
+
+    def pending_count(self) -> int:
+        """Get the number of transfers being received or remembered."""
+        with self._lock:
+            return len(self._transfers)
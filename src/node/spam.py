@@ -0,0 +1,267 @@
+"""
+Spam and Flood Detection
+
+Rate limits (rate_limit.py) cap how fast a client sends, but a member can
+stay under them and still flood a room. The room's administrator node
+watches what each member posts and catches two patterns:
+
+- Duplicate bursts: more than duplicate_limit messages with the same
+  content (ignoring case and whitespace) within window seconds
+- Mention floods: more than mention_limit @mentions within window
+  seconds, counted over all of the member's messages
+
+A member caught by either is muted in the room for mute_duration
+seconds: the message that crossed the threshold and every later one
+until the mute ends are refused, while they can still read, react and
+move their read position. The room's owner and moderators are told with
+a spam_detected event, delivered only to them, and the mute is recorded
+in the audit log. The owner, moderators and bots are never muted.
+
+The owner and moderators can change a room's thresholds with
+set_spam_thresholds; a threshold of 0 turns its check off. Thresholds are
+room metadata like retention limits: written to the message log, sent
+with joins, replication and snapshots, and announced to the other nodes
+with a spam_thresholds_changed event. Mutes are short-lived and kept
+only in the administrator node's memory, so they end early if the room
+fails over or the node restarts.
+"""
+
+import re
+import threading
+import time
+from collections import deque
+from dataclasses import dataclass
+from typing import Any, Deque, Dict, Optional, Tuple
+
+# Spam heuristics
+DUPLICATE_BURST = "duplicate_burst"
+MENTION_FLOOD = "mention_flood"
+
+# Error codes of refused messages
+SPAM_DETECTED = "SPAM_DETECTED"  # the message got its sender muted
+USER_MUTED = "USER_MUTED"  # the sender is still muted
+
+# Default thresholds of a room, changed with set_spam_thresholds
+DEFAULT_THRESHOLDS: Dict[str, int] = {
+    "duplicate_limit": 3,  # identical messages allowed within the window
+    "mention_limit": 10,  # mentions allowed within the window
+    "window": 30,  # seconds
+    "mute_duration": 300,  # seconds
+}
+THRESHOLD_FIELDS = tuple(DEFAULT_THRESHOLDS)
+
+MAX_WINDOW = 3600  # seconds
+MAX_MUTE_DURATION = 86400  # seconds
+
+# Allowed values of thresholds other than the limits (0 or more)
+_RANGES = {"window": (1, MAX_WINDOW), "mute_duration": (1, MAX_MUTE_DURATION)}
+
+MENTION_PATTERN = re.compile(r"(?<![\w@])@[\w.-]+")
+
+
+class SpamError(Exception):
+    """
+    A message was refused as spam, or thresholds could not be changed.
+
+    Attributes:
+        error_code: Machine-readable code (e.g., "SPAM_DETECTED")
+        reason: The heuristic that caught the sender, for SPAM_DETECTED
+        muted_until: UNIX time the sender's mute ends, for SPAM_DETECTED
+            and USER_MUTED
+    """
+
+    def __init__(
+        self,
+        message: str,
+        error_code: str,
+        reason: str = "",
+        muted_until: Optional[float] = None,
+    ):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code
+            reason: DUPLICATE_BURST or MENTION_FLOOD
+            muted_until: UNIX time the mute ends
+        """
+        super().__init__(message)
+        self.error_code = error_code
+        self.reason = reason
+        self.muted_until = muted_until
+
+
+def validate_thresholds(changes: Any) -> Dict[str, int]:
+    """
+    Check the fields of a set_spam_thresholds request.
+
+    Args:
+        changes: Maps threshold -> new value
+
+    Returns:
+        The checked changes
+
+    Raises:
+        SpamError: INVALID_REQUEST if there are no changes, a threshold is
+            unknown, or a value is not a whole number in range
+    """
+    if not isinstance(changes, dict) or not changes:
+        raise SpamError(
+            f"Give at least one of {', '.join(THRESHOLD_FIELDS)}",
+            "INVALID_REQUEST",
+        )
+    unknown = sorted(set(changes) - set(THRESHOLD_FIELDS))
+    if unknown:
+        raise SpamError(
+            f"Unknown spam thresholds: {', '.join(unknown)}",
+            "INVALID_REQUEST",
+        )
+
+    for name, value in changes.items():
+        low, high = _RANGES.get(name, (0, None))
+        if (
+            isinstance(value, bool)
+            or not isinstance(value, int)
+            or value < low
+            or (high is not None and value > high)
+        ):
+            bounds = f"{low} to {high}" if high else f"at least {low}"
+            raise SpamError(
+                f"{name} must be a whole number, {bounds}", "INVALID_REQUEST"
+            )
+    return dict(changes)
+
+
+def effective_thresholds(overrides: Dict[str, int]) -> Dict[str, int]:
+    """Get a room's thresholds from the values its moderators changed."""
+    return {**DEFAULT_THRESHOLDS, **overrides}
+
+
+def count_mentions(content: str) -> int:
+    """Count the @mentions in a message."""
+    return len(MENTION_PATTERN.findall(content or ""))
+
+
+def _fingerprint(content: str) -> str:
+    """Normalize content so trivially varied repeats compare equal."""
+    return " ".join((content or "").lower().split())
+
+
+@dataclass
+class _Posted:
+    """A recent message of a member, as the detector remembers it."""
+
+    time: float
+    fingerprint: str
+    mentions: int
+
+
+class SpamDetector:
+    """
+    Thread-safe record of members' recent messages and temporary mutes.
+    """
+
+    def __init__(self):
+        """Initialize the detector."""
+        self._lock = threading.Lock()
+        # Maps (room_id, username) -> recent messages, oldest first
+        self._recent: Dict[Tuple[str, str], Deque[_Posted]] = {}
+        # Maps (room_id, username) -> UNIX time the mute ends
+        self._muted: Dict[Tuple[str, str], float] = {}
+
+    def check(
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        thresholds: Dict[str, int],
+        now: Optional[float] = None,
+    ) -> None:
+        """
+        Check a member's message and remember it if it is accepted.
+
+        Args:
+            room_id: The room ID
+            username: The sender
+            content: The message content
+            thresholds: The room's effective thresholds
+            now: Current UNIX time (defaults to time.time())
+
+        Raises:
+            SpamError: USER_MUTED if the sender is muted, or SPAM_DETECTED
+                if this message crossed a threshold and muted them
+        """
+        now = time.time() if now is None else now
+        key = (room_id, username)
+        with self._lock:
+            until = self._muted.get(key)
+            if until is not None and until > now:
+                raise SpamError(
+                    f"You are muted in this room for another "
+                    f"{int(until - now) + 1} seconds",
+                    USER_MUTED,
+                    muted_until=until,
+                )
+            self._muted.pop(key, None)
+
+            recent = self._recent.setdefault(key, deque())
+            while recent and recent[0].time <= now - thresholds["window"]:
+                recent.popleft()
+            posted = _Posted(
+                now, _fingerprint(content), count_mentions(content)
+            )
+            reason = self._crossed(recent, posted, thresholds)
+            if reason is None:
+                recent.append(posted)
+                return
+            del self._recent[key]
+            until = now + thresholds["mute_duration"]
+            self._muted[key] = until
+        raise SpamError(
+            f"Muted for {thresholds['mute_duration']} seconds: "
+            f"{reason.replace('_', ' ')}",
+            SPAM_DETECTED,
+            reason=reason,
+            muted_until=until,
+        )
+
+    def muted_until(
+        self, room_id: str, username: str, now: Optional[float] = None
+    ) -> Optional[float]:
+        """
+        Get when a member's mute ends.
+
+        Returns:
+            UNIX time the mute ends, or None if the member isn't muted
+        """
+        now = time.time() if now is None else now
+        with self._lock:
+            until = self._muted.get((room_id, username))
+        return until if until is not None and until > now else None
+
+    def forget_room(self, room_id: str) -> None:
+        """Drop everything remembered about a deleted room."""
+        with self._lock:
+            for records in (self._recent, self._muted):
+                for key in [k for k in records if k[0] == room_id]:
+                    del records[key]
+
+    @staticmethod
+    def _crossed(
+        recent: Deque[_Posted], posted: _Posted, thresholds: Dict[str, int]
+    ) -> Optional[str]:
+        """Find the threshold a new message crosses, if any."""
+        duplicate_limit = thresholds["duplicate_limit"]
+        if duplicate_limit and posted.fingerprint:
+            repeats = sum(
+                1 for p in recent if p.fingerprint == posted.fingerprint
+            )
+            if repeats + 1 > duplicate_limit:
+                return DUPLICATE_BURST
+        mention_limit = thresholds["mention_limit"]
+        if mention_limit and posted.mentions:
+            mentions = posted.mentions + sum(p.mentions for p in recent)
+            if mentions > mention_limit:
+                return MENTION_FLOOD
+        return None
@@ -0,0 +1,239 @@
+"""
+SQLite Storage
+
+Keeps a node's room records, user accounts, revoked sessions, bots and
+service accounts in a single SQLite database file, for small deployments
+that want durability without an external database. Records are stored as
+JSON in insertion order, so rooms are replayed exactly like the
+write-ahead log's.
+
+The database runs in WAL journal mode. The WAL fsync policies map to
+SQLite's synchronous setting:
+
+- "always": FULL, every committed write is on disk
+- "interval": NORMAL, commits reach disk at checkpoints, made on sync()
+- "never": OFF, flushing is left to the operating system
+"""
+
+import json
+import logging
+import os
+import sqlite3
+import threading
+from typing import Dict, Iterator, List
+
+from .storage import Storage
+from .wal import FSYNC_POLICIES
+
+logger = logging.getLogger(__name__)
+
+# SQLite configuration
+SQLITE_FILENAME = "node.db"
+
+_SYNCHRONOUS = {"always": "FULL", "interval": "NORMAL", "never": "OFF"}
+
+_SCHEMA = (
+    """
+    CREATE TABLE IF NOT EXISTS room_records (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        room_id TEXT NOT NULL,
+        record TEXT NOT NULL
+    )
+    """,
+    "CREATE INDEX IF NOT EXISTS room_records_room "
+    "ON room_records (room_id, id)",
+    """
+    CREATE TABLE IF NOT EXISTS accounts (
+        username TEXT PRIMARY KEY,
+        account TEXT NOT NULL
+    )
+    """,
+    """
+    CREATE TABLE IF NOT EXISTS revoked_sessions (
+        session_id TEXT PRIMARY KEY,
+        expires_at REAL NOT NULL
+    )
+    """,
+    """
+    CREATE TABLE IF NOT EXISTS bots (
+        name TEXT PRIMARY KEY,
+        bot TEXT NOT NULL
+    )
+    """,
+    """
+    CREATE TABLE IF NOT EXISTS service_accounts (
+        name TEXT PRIMARY KEY,
+        account TEXT NOT NULL
+    )
+    """,
+)
+
+
+class SQLiteStorage(Storage):
+    """
+    Storage in a SQLite database, shared by the node's threads.
+    """
+
+    def __init__(self, path: str, fsync_policy: str = "always"):
+        """
+        Open (or create) the database.
+
+        Args:
+            path: Database file, or ":memory:" for a throwaway database
+            fsync_policy: One of FSYNC_POLICIES
+
+        Raises:
+            ValueError: If the fsync policy is unknown
+            sqlite3.Error: If the database cannot be opened
+        """
+        if fsync_policy not in FSYNC_POLICIES:
+            raise ValueError(f"Unknown fsync policy: {fsync_policy}")
+        if path != ":memory:":
+            os.makedirs(os.path.dirname(os.path.abspath(path)), exist_ok=True)
+        self.path = path
+        self.fsync_policy = fsync_policy
+        self._lock = threading.Lock()
+        self._db = sqlite3.connect(path, check_same_thread=False)
+        with self._lock, self._db:
+            self._db.execute("PRAGMA journal_mode=WAL")
+            self._db.execute(
+                f"PRAGMA synchronous={_SYNCHRONOUS[fsync_policy]}"
+            )
+            for statement in _SCHEMA:
+                self._db.execute(statement)
+        logger.info(f"Opened SQLite storage at {path}")
+
+    def append(self, room_id: str, record: Dict) -> None:
+        """Append a record to a room's records."""
+        payload = json.dumps(record, separators=(",", ":"))
+        self._write(
+            "INSERT INTO room_records (room_id, record) VALUES (?, ?)",
+            (room_id, payload),
+        )
+
+    def records(self, room_id: str) -> Iterator[Dict]:
+        """Read a room's records, oldest first."""
+        rows = self._read(
+            "SELECT record FROM room_records WHERE room_id = ? ORDER BY id",
+            (room_id,),
+        )
+        return (json.loads(record) for (record,) in rows)
+
+    def room_ids(self) -> List[str]:
+        """Get the IDs of all rooms with stored records, sorted."""
+        rows = self._read(
+            "SELECT DISTINCT room_id FROM room_records ORDER BY room_id"
+        )
+        return [room_id for (room_id,) in rows]
+
+    def compact(self, room_id: str, record: Dict) -> None:
+        """Replace all of a room's records with one, in one transaction."""
+        payload = json.dumps(record, separators=(",", ":"))
+        try:
+            with self._lock, self._db:
+                self._db.execute(
+                    "DELETE FROM room_records WHERE room_id = ?", (room_id,)
+                )
+                self._db.execute(
+                    "INSERT INTO room_records (room_id, record) "
+                    "VALUES (?, ?)",
+                    (room_id, payload),
+                )
+        except sqlite3.Error as e:
+            raise OSError(f"SQLite compaction failed: {e}") from e
+
+    def drop_room(self, room_id: str) -> None:
+        """Delete a room's records."""
+        self._write("DELETE FROM room_records WHERE room_id = ?", (room_id,))
+        logger.info(f"Dropped stored records of room {room_id}")
+
+    def save_account(self, account: Dict) -> None:
+        """Store a registered user account."""
+        self._write(
+            "INSERT OR REPLACE INTO accounts (username, account) "
+            "VALUES (?, ?)",
+            (account["username"], json.dumps(account)),
+        )
+
+    def drop_account(self, username: str) -> None:
+        """Delete a deleted user account."""
+        self._write("DELETE FROM accounts WHERE username = ?", (username,))
+
+    def accounts(self) -> List[Dict]:
+        """Get every stored user account."""
+        rows = self._read("SELECT account FROM accounts ORDER BY username")
+        return [json.loads(account) for (account,) in rows]
+
+    def save_revocation(self, session_id: str, expires_at: float) -> None:
+        """Store a session revoked by logging out."""
+        self._write(
+            "INSERT OR REPLACE INTO revoked_sessions "
+            "(session_id, expires_at) VALUES (?, ?)",
+            (session_id, expires_at),
+        )
+
+    def revocations(self) -> Dict[str, float]:
+        """Get the stored revoked sessions (session ID -> expiry)."""
+        rows = self._read("SELECT session_id, expires_at FROM revoked_sessions")
+        return dict(rows)
+
+    def save_bot(self, bot: Dict) -> None:
+        """Store a registered bot."""
+        self._write(
+            "INSERT OR REPLACE INTO bots (name, bot) VALUES (?, ?)",
+            (bot["name"], json.dumps(bot)),
+        )
+
+    def drop_bot(self, name: str) -> None:
+        """Delete a removed bot."""
+        self._write("DELETE FROM bots WHERE name = ?", (name,))
+
+    def bots(self) -> List[Dict]:
+        """Get every stored bot."""
+        rows = self._read("SELECT bot FROM bots ORDER BY name")
+        return [json.loads(bot) for (bot,) in rows]
+
+    def save_service_account(self, account: Dict) -> None:
+        """Store a provisioned service account."""
+        self._write(
+            "INSERT OR REPLACE INTO service_accounts (name, account) "
+            "VALUES (?, ?)",
+            (account["name"], json.dumps(account)),
+        )
+
+    def drop_service_account(self, name: str) -> None:
+        """Delete a removed service account."""
+        self._write("DELETE FROM service_accounts WHERE name = ?", (name,))
+
+    def service_accounts(self) -> List[Dict]:
+        """Get every stored service account."""
+        rows = self._read("SELECT account FROM service_accounts ORDER BY name")
+        return [json.loads(account) for (account,) in rows]
+
+    def sync(self) -> None:
+        """Checkpoint the SQLite journal into the database file."""
+        with self._lock:
+            self._db.execute("PRAGMA wal_checkpoint(PASSIVE)")
+
+    def close(self) -> None:
+        """Checkpoint and close the database."""
+        with self._lock:
+            self._db.close()
+
+    def _write(self, statement: str, parameters: tuple = ()) -> None:
+        """
+        Run a statement in its own transaction.
+
+        Raises:
+            OSError: If the write fails, as the other backends raise
+        """
+        try:
+            with self._lock, self._db:
+                self._db.execute(statement, parameters)
+        except sqlite3.Error as e:
+            raise OSError(f"SQLite write failed: {e}") from e
+
+    def _read(self, query: str, parameters: tuple = ()) -> List[tuple]:
+        """Run a query and fetch every row."""
+        with self._lock:
+            return self._db.execute(query, parameters).fetchall()
@@ -0,0 +1,343 @@
+"""
+Cluster Statistics
+
+Per-node and per-room statistics for the stats command and GET
+/admin/stats. Every node measures what it can see and gossips it to its
+peers (exchange_stats), so any node can answer for the whole cluster:
+
+- throughput: messages a room's admin node sequenced per minute,
+  measured over the last STATS_WINDOW seconds from the room's message
+  counter
+- members: the room's members, counted by its admin node
+- active members: distinct users with a client in the room, summed over
+  the nodes they are connected to
+- delivery latency: time from a message being sequenced (its timestamp)
+  to it being handed to the room's clients on a node, averaged over the
+  window and weighted by deliveries across nodes; nodes' clocks are not
+  synchronized, so remote latencies include their clock skew
+
+A node stamps its statistics with the time it measured them and the
+newest entry wins. Entries of nodes not refreshed within STATS_TTL
+seconds (e.g. because the node died) are left out of the aggregate.
+"""
+
+import logging
+import random
+import threading
+import time
+from collections import deque
+from dataclasses import asdict, dataclass, field
+from typing import Any, Callable, Deque, Dict, List, Optional, Tuple
+
+from .room_directory import GOSSIP_FANOUT
+
+logger = logging.getLogger(__name__)
+
+# Statistics configuration
+STATS_WINDOW = 60  # seconds over which throughput and latency are measured
+STATS_TTL = 30  # seconds a peer's statistics are used without a refresh
+
+
+@dataclass
+class NodeStats:
+    """
+    Statistics measured by one node.
+
+    Attributes:
+        node_id: The node
+        connections: Connected WebSocket clients
+        rooms: Maps room_id -> {'admin': whether the node administers the
+            room, 'private': bool, 'messages': messages sequenced (admin
+            only), 'throughput': messages per minute (admin only),
+            'members': member count (admin only), 'active_members':
+            distinct users connected to the node in the room,
+            'latency_total': seconds summed over 'deliveries' recent
+            deliveries}
+        updated_at: Unix time the node measured its statistics
+    """
+
+    node_id: str
+    connections: int = 0
+    rooms: Dict[str, Dict[str, Any]] = field(default_factory=dict)
+    updated_at: float = 0.0
+
+    def to_dict(self) -> Dict[str, Any]:
+        """Convert to dictionary for gossiping."""
+        return asdict(self)
+
+    @classmethod
+    def from_dict(cls, data: Dict[str, Any]) -> "NodeStats":
+        """Create NodeStats from a gossiped dictionary."""
+        rooms = data.get("rooms") or {}
+        if not isinstance(rooms, dict):
+            raise TypeError("rooms must be a dict")
+        return cls(
+            node_id=data["node_id"],
+            connections=int(data["connections"]),
+            rooms={str(k): dict(v) for k, v in rooms.items()},
+            updated_at=float(data["updated_at"]),
+        )
+
+
+def _average_ms(total: float, count: int) -> Optional[float]:
+    """Average of a latency total in milliseconds, or None without data."""
+    if not count:
+        return None
+    return round(total / count * 1000, 1)
+
+
+class ClusterStats:
+    """
+    This node's measurements and the statistics gossiped by its peers.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        window: float = STATS_WINDOW,
+        ttl: float = STATS_TTL,
+        clock: Callable[[], float] = time.time,
+    ):
+        """
+        Initialize the statistics with an empty entry for this node.
+
+        Args:
+            node_id: ID of this node
+            window: Seconds over which throughput and latency are measured
+            ttl: Seconds a peer's statistics are used without a refresh
+            clock: Function returning the current Unix time
+        """
+        self.node_id = node_id
+        self.window = window
+        self.ttl = ttl
+        self.clock = clock
+        self._lock = threading.Lock()
+        self._stats: Dict[str, NodeStats] = {
+            node_id: NodeStats(node_id, updated_at=clock())
+        }
+        # Maps node_id -> time.monotonic() its statistics were refreshed
+        self._refreshed: Dict[str, float] = {}
+        # Maps room_id -> (time, message counter) samples in the window
+        self._counters: Dict[str, Deque[Tuple[float, int]]] = {}
+        # Maps room_id -> (time, latency) of deliveries in the window
+        self._deliveries: Dict[str, Deque[Tuple[float, float]]] = {}
+
+    def record_delivery(self, room_id: str, latency: float) -> None:
+        """
+        Record a message handed to a room's clients on this node.
+
+        Args:
+            room_id: The room
+            latency: Seconds since the message was sequenced
+        """
+        now = self.clock()
+        with self._lock:
+            deliveries = self._deliveries.setdefault(room_id, deque())
+            deliveries.append((now, max(latency, 0.0)))
+            self._trim(deliveries, now)
+
+    def update_local(
+        self,
+        hosted: Dict[str, Dict[str, Any]],
+        active_members: Dict[str, int],
+        connections: int,
+    ) -> NodeStats:
+        """
+        Measure this node's statistics.
+
+        Args:
+            hosted: Maps room_id -> {'messages', 'members', 'private'} of
+                the rooms this node administers
+            active_members: Maps room_id -> distinct users connected to
+                this node in the room
+            connections: Connected WebSocket clients
+
+        Returns:
+            NodeStats: The new entry of this node
+        """
+        now = self.clock()
+        rooms = {}
+        with self._lock:
+            for room_id, room in hosted.items():
+                samples = self._counters.setdefault(room_id, deque())
+                samples.append((now, room["messages"]))
+                self._trim(samples, now)
+                first_time, first_count = samples[0]
+                elapsed = now - first_time
+                throughput = 0.0
+                if elapsed > 0:
+                    throughput = (room["messages"] - first_count) / elapsed
+                rooms[room_id] = {
+                    "admin": True,
+                    "private": bool(room.get("private")),
+                    "messages": room["messages"],
+                    "throughput": round(throughput * 60, 2),
+                    "members": room["members"],
+                }
+            for room_id in list(self._counters):
+                if room_id not in hosted:
+                    del self._counters[room_id]
+
+            for room_id in set(active_members) | set(self._deliveries):
+                deliveries = self._deliveries.get(room_id, deque())
+                self._trim(deliveries, now)
+                if not deliveries and room_id not in active_members:
+                    self._deliveries.pop(room_id, None)
+                    continue
+                entry = rooms.setdefault(room_id, {"admin": False})
+                entry["active_members"] = active_members.get(room_id, 0)
+                entry["deliveries"] = len(deliveries)
+                entry["latency_total"] = sum(
+                    latency for _, latency in deliveries
+                )
+
+            stats = NodeStats(self.node_id, connections, rooms, now)
+            self._stats[self.node_id] = stats
+            return stats
+
+    def merge(self, entries: List[Dict[str, Any]]) -> int:
+        """
+        Merge statistics received from a peer.
+
+        Args:
+            entries: NodeStats dicts from a peer
+
+        Returns:
+            Number of entries that were added or replaced
+        """
+        updated = 0
+        now = time.monotonic()
+        with self._lock:
+            for data in entries:
+                try:
+                    incoming = NodeStats.from_dict(data)
+                except (KeyError, TypeError, ValueError) as e:
+                    logger.warning(f"Ignoring malformed node stats: {e}")
+                    continue
+
+                if incoming.node_id == self.node_id:
+                    continue
+                current = self._stats.get(incoming.node_id)
+                if current and incoming.updated_at <= current.updated_at:
+                    continue
+                self._stats[incoming.node_id] = incoming
+                self._refreshed[incoming.node_id] = now
+                updated += 1
+        return updated
+
+    def get_entries(self) -> List[Dict[str, Any]]:
+        """Get the statistics of every node for gossiping."""
+        with self._lock:
+            return [stats.to_dict() for stats in self._stats.values()]
+
+    def summary(self, room_id: Optional[str] = None) -> Dict[str, Any]:
+        """
+        Aggregate the fresh statistics of the cluster.
+
+        Args:
+            room_id: Only report this room
+
+        Returns:
+            dict: {'nodes': [{'node_id', 'connections', 'rooms' (hosted),
+            'updated_at'}], 'rooms': {room_id: {'admin_node',
+            'private', 'messages', 'throughput', 'members',
+            'active_members', 'avg_latency_ms', 'nodes'}}}
+        """
+        nodes, rooms = [], {}
+        for stats in self._fresh():
+            hosted = 0
+            for rid, entry in stats.rooms.items():
+                if room_id is not None and rid != room_id:
+                    continue
+                room = rooms.setdefault(
+                    rid,
+                    {
+                        "admin_node": None,
+                        "private": False,
+                        "messages": 0,
+                        "throughput": 0.0,
+                        "members": 0,
+                        "active_members": 0,
+                        "deliveries": 0,
+                        "latency_total": 0.0,
+                        "nodes": [],
+                    },
+                )
+                if entry.get("admin"):
+                    hosted += 1
+                    room["admin_node"] = stats.node_id
+                    room["private"] = entry.get("private", False)
+                    room["messages"] = entry.get("messages", 0)
+                    room["throughput"] = entry.get("throughput", 0.0)
+                    room["members"] = entry.get("members", 0)
+                if entry.get("active_members"):
+                    room["active_members"] += entry["active_members"]
+                    room["nodes"].append(stats.node_id)
+                room["deliveries"] += entry.get("deliveries", 0)
+                room["latency_total"] += entry.get("latency_total", 0.0)
+            nodes.append(
+                {
+                    "node_id": stats.node_id,
+                    "connections": stats.connections,
+                    "rooms": hosted,
+                    "updated_at": stats.updated_at,
+                }
+            )
+
+        for room in rooms.values():
+            room["avg_latency_ms"] = _average_ms(
+                room.pop("latency_total"), room.pop("deliveries")
+            )
+            room["nodes"].sort()
+        nodes.sort(key=lambda node: node["node_id"])
+        return {"nodes": nodes, "rooms": rooms}
+
+    def _fresh(self) -> List[NodeStats]:
+        """Get this node's entry and the peers' refreshed within the TTL."""
+        now = time.monotonic()
+        with self._lock:
+            return [
+                stats
+                for node_id, stats in self._stats.items()
+                if node_id == self.node_id
+                or now - self._refreshed.get(node_id, float("-inf"))
+                <= self.ttl
+            ]
+
+    def _trim(self, samples: Deque[Tuple[float, Any]], now: float) -> None:
+        """Drop samples older than the window (lock held)."""
+        while samples and now - samples[0][0] > self.window:
+            samples.popleft()
+
+
+def stats_gossip_round(
+    stats: ClusterStats,
+    peer_registry,
+    fanout: int = GOSSIP_FANOUT,
+) -> List[str]:
+    """
+    Run one push-pull gossip round of the cluster statistics.
+
+    Args:
+        stats: The local statistics
+        peer_registry: PeerRegistry used to reach peers
+        fanout: Number of peers to contact
+
+    Returns:
+        List of peer node IDs that were reached
+    """
+    peers = list(peer_registry.list_peers().keys())
+    if not peers:
+        return []
+
+    reached = []
+    for peer_id in random.sample(peers, min(fanout, len(peers))):
+        try:
+            remote_entries = peer_registry.call_peer(
+                peer_id, "exchange_stats", stats.get_entries()
+            )
+            stats.merge(remote_entries)
+            reached.append(peer_id)
+        except Exception as e:
+            logger.debug(f"Stats gossip with {peer_id} failed: {e}")
+    return reached
@@ -0,0 +1,730 @@
+"""
+Storage Backends
+
+The room manager and auth manager persist their state through the Storage
+interface, so a node can keep it in the write-ahead log (wal.py), in a
+SQLite database (sqlite_storage.py) or in memory (MemoryStorage, for tests
+and embedding), chosen with the storage_backend setting.
+
+Room state is stored as an ordered list of JSON records per room. The
+record types are:
+
+- "room": room metadata, written when a room is created
+- "snapshot": metadata plus its messages, sequence counter and vector
+  clock, written when a room is taken over via failover or its records
+  are compacted (see compaction.py)
+- "message": a single message, written before it is added to the room
+- "ban" and "role": a ban or role change (the room's persistent members;
+  connected members join again after a restart)
+- "edit": an edit or deletion of a message (see edits.py)
+- "reaction": an emoji reaction added or removed (see reactions.py)
+- "read": a member's read position moved forward (see
+  read_receipts.py)
+- "key": a member published a public key (see e2ee.py)
+- "webhook": a webhook registered, or removed if the record has only
+  its ID (see webhooks.py)
+- "bridge": a bridge added, or removed if the record has only its ID
+  (see bridges.py)
+- "retention": the room owner's retention limits (see retention.py)
+- "pins": the IDs of the room's pinned messages (see pins.py)
+- "scheduled": a message scheduled, or sent or cancelled if the record
+  has only its ID (see scheduled.py)
+- "spam_thresholds": the room's changed spam thresholds (see spam.py)
+- "content_filters": the room's content filters (see content_filters.py)
+- "metadata": a change to the room's name, topic or description, with
+  the HLC timestamp of each changed field (see room_metadata.py)
+
+Backends only append and read back records; replaying them into room
+states is shared by all of them. User accounts, revoked sessions,
+registered bots (see bots.py) and service accounts (see
+service_accounts.py) are stored alongside, so logins survive restarts
+too.
+"""
+
+import copy
+import json
+import logging
+import threading
+from abc import ABC, abstractmethod
+from typing import Any, Dict, Iterable, Iterator, List, Optional
+
+from .edits import apply_edit
+from .reactions import apply_reaction
+from .threads import apply_logged_reply
+
+logger = logging.getLogger(__name__)
+
+# Storage backends selectable with the storage_backend setting
+MEMORY = "memory"
+WAL = "wal"
+SQLITE = "sqlite"
+STORAGE_BACKENDS = (MEMORY, WAL, SQLITE)
+
+
+class Storage(ABC):
+    """
+    Persistent store of room records, user accounts and revoked sessions.
+    """
+
+    # How often writes are flushed to disk; backends that honour
+    # FSYNC_POLICIES override it
+    fsync_policy = "always"
+
+    @abstractmethod
+    def append(self, room_id: str, record: Dict) -> None:
+        """
+        Append a record to a room's records.
+
+        Args:
+            room_id: The room ID
+            record: JSON-serializable record
+
+        Raises:
+            OSError: If the record cannot be written
+            ValueError: If the room ID can't be stored
+        """
+
+    @abstractmethod
+    def records(self, room_id: str) -> Iterator[Dict]:
+        """
+        Read a room's records, oldest first.
+
+        Args:
+            room_id: The room ID
+
+        Yields:
+            The stored records
+        """
+
+    @abstractmethod
+    def room_ids(self) -> List[str]:
+        """Get the IDs of all rooms with stored records, sorted."""
+
+    @abstractmethod
+    def compact(self, room_id: str, record: Dict) -> None:
+        """
+        Replace all of a room's records with one (see compaction.py).
+
+        Args:
+            room_id: The room ID
+            record: The snapshot record standing in for the old records
+
+        Raises:
+            OSError: If the record cannot be written; the old records are
+                then kept
+        """
+
+    @abstractmethod
+    def drop_room(self, room_id: str) -> None:
+        """
+        Delete a room's records (after the room is deleted).
+
+        Args:
+            room_id: The room ID
+        """
+
+    @abstractmethod
+    def save_account(self, account: Dict) -> None:
+        """
+        Store a registered user account.
+
+        Args:
+            account: Account dict (username, password_hash and salt as hex
+                strings, created_at)
+        """
+
+    @abstractmethod
+    def drop_account(self, username: str) -> None:
+        """
+        Delete a deleted user account.
+
+        Args:
+            username: The account's username
+        """
+
+    @abstractmethod
+    def accounts(self) -> List[Dict]:
+        """Get every stored user account."""
+
+    @abstractmethod
+    def save_revocation(self, session_id: str, expires_at: float) -> None:
+        """
+        Store a session revoked by logging out.
+
+        Args:
+            session_id: The session's "sid" claim
+            expires_at: UNIX time the session's token expires
+        """
+
+    @abstractmethod
+    def revocations(self) -> Dict[str, float]:
+        """Get the stored revoked sessions (session ID -> expiry)."""
+
+    @abstractmethod
+    def save_bot(self, bot: Dict) -> None:
+        """
+        Store a registered bot.
+
+        Args:
+            bot: Bot dict (name, owner, api_key_hash, commands,
+                created_at)
+        """
+
+    @abstractmethod
+    def drop_bot(self, name: str) -> None:
+        """
+        Delete a removed bot.
+
+        Args:
+            name: The bot's name
+        """
+
+    @abstractmethod
+    def bots(self) -> List[Dict]:
+        """Get every stored bot."""
+
+    @abstractmethod
+    def save_service_account(self, account: Dict) -> None:
+        """
+        Store a provisioned service account.
+
+        Args:
+            account: Service account dict (name, api_key_hash, scopes,
+                rooms, created_at)
+        """
+
+    @abstractmethod
+    def drop_service_account(self, name: str) -> None:
+        """
+        Delete a removed service account.
+
+        Args:
+            name: The account's name
+        """
+
+    @abstractmethod
+    def service_accounts(self) -> List[Dict]:
+        """Get every stored service account."""
+
+    def sync(self) -> None:
+        """Flush unsynced writes to disk, if the backend buffers them."""
+
+    def close(self) -> None:
+        """Sync and release the backend's files or connections."""
+
+    def log_room(self, room: Dict) -> None:
+        """
+        Record a newly created room.
+
+        Args:
+            room: Room metadata (room_id, room_name, description,
+                creator_id, created_at)
+        """
+        self.append(room["room_id"], {"type": "room", "room": room})
+
+    def log_snapshot(self, room: Dict, messages: List[Dict]) -> None:
+        """
+        Record the full state of a room taken over from another node.
+
+        Args:
+            room: Room metadata plus message_counter and vector_clock
+            messages: The room's messages in sequence order
+        """
+        self.append(
+            room["room_id"],
+            {"type": "snapshot", "room": room, "messages": messages},
+        )
+
+    def log_message(self, room_id: str, message: Dict) -> None:
+        """
+        Record a message added to a room.
+
+        Args:
+            room_id: The room ID
+            message: The message data
+        """
+        self.append(room_id, {"type": "message", "message": message})
+
+    def log_ban(self, room_id: str, username: str) -> None:
+        """
+        Record a user banned from a room.
+
+        Args:
+            room_id: The room ID
+            username: The banned user
+        """
+        self.append(room_id, {"type": "ban", "username": username})
+
+    def log_role(self, room_id: str, username: str, role: str) -> None:
+        """
+        Record a change of a member's role in a room.
+
+        Args:
+            room_id: The room ID
+            username: The member
+            role: The member's new role
+        """
+        self.append(
+            room_id, {"type": "role", "username": username, "role": role}
+        )
+
+    def log_edit(self, room_id: str, edit: Dict) -> None:
+        """
+        Record an edit or deletion of a message in a room.
+
+        Args:
+            room_id: The room ID
+            edit: The edit record (see edits.create_edit)
+        """
+        self.append(room_id, {"type": "edit", "edit": edit})
+
+    def log_reaction(self, room_id: str, reaction: Dict) -> None:
+        """
+        Record an emoji reaction added to or removed from a message.
+
+        Args:
+            room_id: The room ID
+            reaction: The reaction record (see reactions.create_reaction)
+        """
+        self.append(room_id, {"type": "reaction", "reaction": reaction})
+
+    def log_read(self, room_id: str, username: str, position: int) -> None:
+        """
+        Append a read position record for a room member.
+
+        Args:
+            room_id: The room ID
+            username: The member
+            position: Sequence number of the last message they read
+        """
+        self.append(
+            room_id,
+            {"type": "read", "username": username, "position": position},
+        )
+
+    def log_key(self, room_id: str, key: Dict) -> None:
+        """
+        Record a public key published by a room member.
+
+        Args:
+            room_id: The room ID
+            key: The key record (see e2ee.create_public_key)
+        """
+        self.append(room_id, {"type": "key", "key": key})
+
+    def log_webhook(self, room_id: str, webhook: Dict) -> None:
+        """
+        Record a webhook registered for a room.
+
+        Args:
+            room_id: The room ID
+            webhook: The webhook record (see webhooks.create_webhook)
+        """
+        self.append(room_id, {"type": "webhook", "webhook": webhook})
+
+    def log_webhook_removal(self, room_id: str, webhook_id: str) -> None:
+        """
+        Record a webhook removed from a room.
+
+        Args:
+            room_id: The room ID
+            webhook_id: The webhook's ID
+        """
+        self.append(room_id, {"type": "webhook", "webhook_id": webhook_id})
+
+    def log_bridge(self, room_id: str, bridge: Dict) -> None:
+        """
+        Record a bridge added to a room.
+
+        Args:
+            room_id: The room ID
+            bridge: The bridge record (see bridges.create_bridge)
+        """
+        self.append(room_id, {"type": "bridge", "bridge": bridge})
+
+    def log_bridge_removal(self, room_id: str, bridge_id: str) -> None:
+        """
+        Record a bridge removed from a room.
+
+        Args:
+            room_id: The room ID
+            bridge_id: The bridge's ID
+        """
+        self.append(room_id, {"type": "bridge", "bridge_id": bridge_id})
+
+    def log_scheduled(self, room_id: str, scheduled: Dict) -> None:
+        """
+        Record a message scheduled to be sent later.
+
+        Args:
+            room_id: The room ID
+            scheduled: The scheduled message (see scheduled.create_scheduled)
+        """
+        self.append(room_id, {"type": "scheduled", "scheduled": scheduled})
+
+    def log_scheduled_removal(self, room_id: str, message_id: str) -> None:
+        """
+        Record a scheduled message sent or cancelled.
+
+        Args:
+            room_id: The room ID
+            message_id: The scheduled message's ID
+        """
+        self.append(room_id, {"type": "scheduled", "message_id": message_id})
+
+    def log_retention(self, room_id: str, limits: List[str]) -> None:
+        """
+        Record a room's new retention limits.
+
+        Args:
+            room_id: The room ID
+            limits: The limits (empty if the room keeps every message)
+        """
+        self.append(room_id, {"type": "retention", "limits": list(limits)})
+
+    def log_pins(self, room_id: str, pinned: List[str]) -> None:
+        """
+        Record a room's pinned messages after one was pinned or unpinned.
+
+        Args:
+            room_id: The room ID
+            pinned: IDs of the pinned messages, in the order pinned
+        """
+        self.append(room_id, {"type": "pins", "pinned": list(pinned)})
+
+    def log_spam_thresholds(
+        self, room_id: str, thresholds: Dict[str, int]
+    ) -> None:
+        """
+        Record a room's spam thresholds after they were changed.
+
+        Args:
+            room_id: The room ID
+            thresholds: Maps each threshold changed from its default ->
+                its value
+        """
+        self.append(
+            room_id,
+            {"type": "spam_thresholds", "thresholds": dict(thresholds)},
+        )
+
+    def log_content_filters(
+        self, room_id: str, filters: List[Dict[str, Any]]
+    ) -> None:
+        """
+        Record a room's content filters after they were replaced.
+
+        Args:
+            room_id: The room ID
+            filters: The filters in the order they run
+        """
+        self.append(
+            room_id,
+            {"type": "content_filters", "filters": [dict(f) for f in filters]},
+        )
+
+    def log_metadata(
+        self,
+        room_id: str,
+        changes: Dict[str, Optional[str]],
+        versions: Dict[str, str],
+    ) -> None:
+        """
+        Record a change to a room's name, topic or description.
+
+        Args:
+            room_id: The room ID
+            changes: Maps each changed field -> its new value
+            versions: Maps each changed field -> encoded HLC timestamp
+        """
+        self.append(
+            room_id,
+            {
+                "type": "metadata",
+                "changes": dict(changes),
+                "versions": dict(versions),
+            },
+        )
+
+    def recover(self, max_messages: int = 100) -> List[Dict]:
+        """
+        Replay every room's records.
+
+        Args:
+            max_messages: Number of most recent messages to return per room
+
+        Returns:
+            List of room states, each a dict with the room metadata plus
+            'messages', 'message_counter', 'vector_clock' and, if they
+            were ever changed, 'banned', 'roles', 'read_positions',
+            'public_keys', 'webhooks', 'bridges', 'scheduled',
+            'retention', 'pinned', 'topic', 'metadata_versions',
+            'spam_thresholds' and 'content_filters'
+        """
+        rooms = []
+        for room_id in self.room_ids():
+            state = replay_room(self.records(room_id), max_messages)
+            if state is None:
+                logger.warning(f"Storage for room {room_id} has no room record")
+                continue
+            rooms.append(state)
+        logger.info(f"Recovered {len(rooms)} rooms from storage")
+        return rooms
+
+    def messages(self, room_id: str) -> List[Dict]:
+        """
+        Read every message of a room still in storage.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The messages in sequence order, starting from the last snapshot
+        """
+        return replay_messages(self.records(room_id))
+
+
+class MemoryStorage(Storage):
+    """
+    Storage kept in process memory; nothing survives a restart.
+
+    Records are copied in and out, so callers can't change stored state by
+    mutating them, as with the on-disk backends.
+    """
+
+    def __init__(self):
+        """Initialize empty storage."""
+        self._lock = threading.Lock()
+        self._records: Dict[str, List[Dict]] = {}
+        self._accounts: Dict[str, Dict] = {}
+        self._revocations: Dict[str, float] = {}
+        self._bots: Dict[str, Dict] = {}
+        self._service_accounts: Dict[str, Dict] = {}
+
+    def append(self, room_id: str, record: Dict) -> None:
+        """Append a record to a room's records."""
+        # Round-trip through JSON to reject what the disk backends would
+        stored = json.loads(json.dumps(record))
+        with self._lock:
+            self._records.setdefault(room_id, []).append(stored)
+
+    def records(self, room_id: str) -> Iterator[Dict]:
+        """Read a room's records, oldest first."""
+        with self._lock:
+            records = copy.deepcopy(self._records.get(room_id, []))
+        return iter(records)
+
+    def room_ids(self) -> List[str]:
+        """Get the IDs of all rooms with stored records, sorted."""
+        with self._lock:
+            return sorted(self._records)
+
+    def compact(self, room_id: str, record: Dict) -> None:
+        """Replace all of a room's records with one."""
+        stored = json.loads(json.dumps(record))
+        with self._lock:
+            self._records[room_id] = [stored]
+
+    def drop_room(self, room_id: str) -> None:
+        """Delete a room's records."""
+        with self._lock:
+            self._records.pop(room_id, None)
+
+    def save_account(self, account: Dict) -> None:
+        """Store a registered user account."""
+        with self._lock:
+            self._accounts[account["username"]] = dict(account)
+
+    def drop_account(self, username: str) -> None:
+        """Delete a deleted user account."""
+        with self._lock:
+            self._accounts.pop(username, None)
+
+    def accounts(self) -> List[Dict]:
+        """Get every stored user account."""
+        with self._lock:
+            return [dict(account) for account in self._accounts.values()]
+
+    def save_revocation(self, session_id: str, expires_at: float) -> None:
+        """Store a session revoked by logging out."""
+        with self._lock:
+            self._revocations[session_id] = expires_at
+
+    def revocations(self) -> Dict[str, float]:
+        """Get the stored revoked sessions (session ID -> expiry)."""
+        with self._lock:
+            return dict(self._revocations)
+
+    def save_bot(self, bot: Dict) -> None:
+        """Store a registered bot."""
+        with self._lock:
+            self._bots[bot["name"]] = copy.deepcopy(bot)
+
+    def drop_bot(self, name: str) -> None:
+        """Delete a removed bot."""
+        with self._lock:
+            self._bots.pop(name, None)
+
+    def bots(self) -> List[Dict]:
+        """Get every stored bot."""
+        with self._lock:
+            return [copy.deepcopy(bot) for bot in self._bots.values()]
+
+    def save_service_account(self, account: Dict) -> None:
+        """Store a provisioned service account."""
+        with self._lock:
+            self._service_accounts[account["name"]] = copy.deepcopy(account)
+
+    def drop_service_account(self, name: str) -> None:
+        """Delete a removed service account."""
+        with self._lock:
+            self._service_accounts.pop(name, None)
+
+    def service_accounts(self) -> List[Dict]:
+        """Get every stored service account."""
+        with self._lock:
+            return [
+                copy.deepcopy(account)
+                for account in self._service_accounts.values()
+            ]
+
+
+def replay_room(
+    records: Iterable[Dict], max_messages: int
+) -> Optional[Dict]:
+    """
+    Rebuild a room's state from its records.
+
+    Args:
+        records: The room's records, oldest first
+        max_messages: Number of most recent messages to keep
+
+    Returns:
+        The room state (see Storage.recover), or None if there is no room
+        or snapshot record
+    """
+    state = None
+    messages: List[Dict] = []
+    for record in records:
+        kind = record.get("type")
+        if kind in ("room", "snapshot"):
+            state = dict(record["room"])
+            state.setdefault("message_counter", 0)
+            state.setdefault("vector_clock", {})
+            messages = list(record.get("messages", []))
+        elif kind == "message" and state is not None:
+            message = record["message"]
+            if message.get("thread_id"):
+                apply_logged_reply(messages, message)
+            messages.append(message)
+            state["message_counter"] = max(
+                state["message_counter"], message["sequence_number"]
+            )
+            clock = state["vector_clock"]
+            for node_id, counter in message["vector_clock"].items():
+                clock[node_id] = max(clock.get(node_id, 0), counter)
+            if len(messages) > max_messages:
+                messages.pop(0)
+        elif kind == "ban" and state is not None:
+            banned = state.setdefault("banned", [])
+            if record["username"] not in banned:
+                banned.append(record["username"])
+        elif kind == "role" and state is not None:
+            roles = state.setdefault("roles", {})
+            if record["role"] == "member":
+                roles.pop(record["username"], None)
+            else:
+                roles[record["username"]] = record["role"]
+        elif kind == "read" and state is not None:
+            positions = state.setdefault("read_positions", {})
+            positions[record["username"]] = max(
+                positions.get(record["username"], 0), record["position"]
+            )
+        elif kind == "key" and state is not None:
+            key = record["key"]
+            state.setdefault("public_keys", {})[key["username"]] = key
+        elif kind == "webhook" and state is not None:
+            webhooks = state.setdefault("webhooks", {})
+            if "webhook" in record:
+                webhook = record["webhook"]
+                webhooks[webhook["webhook_id"]] = webhook
+            else:
+                webhooks.pop(record["webhook_id"], None)
+        elif kind == "bridge" and state is not None:
+            bridges = state.setdefault("bridges", {})
+            if "bridge" in record:
+                bridge = record["bridge"]
+                bridges[bridge["bridge_id"]] = bridge
+            else:
+                bridges.pop(record["bridge_id"], None)
+        elif kind == "scheduled" and state is not None:
+            scheduled = state.setdefault("scheduled", {})
+            if "scheduled" in record:
+                message = record["scheduled"]
+                scheduled[message["message_id"]] = message
+            else:
+                scheduled.pop(record["message_id"], None)
+        elif kind == "retention" and state is not None:
+            state["retention"] = list(record["limits"])
+        elif kind == "pins" and state is not None:
+            state["pinned"] = list(record["pinned"])
+        elif kind == "spam_thresholds" and state is not None:
+            state["spam_thresholds"] = dict(record["thresholds"])
+        elif kind == "content_filters" and state is not None:
+            state["content_filters"] = [dict(f) for f in record["filters"]]
+        elif kind == "metadata" and state is not None:
+            state.update(record["changes"])
+            state.setdefault("metadata_versions", {}).update(
+                record["versions"]
+            )
+        elif kind == "edit" and state is not None:
+            _apply_logged_edit(messages, record["edit"])
+        elif kind == "reaction" and state is not None:
+            _apply_logged_reaction(messages, record["reaction"])
+
+    if state is None:
+        return None
+    state["messages"] = messages[-max_messages:]
+    return state
+
+
+def replay_messages(records: Iterable[Dict]) -> List[Dict]:
+    """
+    Rebuild every message of a room from its records.
+
+    Args:
+        records: The room's records, oldest first
+
+    Returns:
+        The messages in sequence order, starting from the last snapshot
+    """
+    messages: List[Dict] = []
+    for record in records:
+        kind = record.get("type")
+        if kind == "snapshot":
+            messages = list(record.get("messages", []))
+        elif kind == "message":
+            if record["message"].get("thread_id"):
+                apply_logged_reply(messages, record["message"])
+            messages.append(record["message"])
+        elif kind == "edit":
+            _apply_logged_edit(messages, record["edit"])
+        elif kind == "reaction":
+            _apply_logged_reaction(messages, record["reaction"])
+    return messages
+
+
+def _apply_logged_edit(messages: List[Dict], edit: Dict) -> None:
+    """Apply an edit record to the message it names, if still kept."""
+    for message in reversed(messages):
+        if message.get("message_id") == edit["message_id"]:
+            apply_edit(message, edit)
+            return
+
+
+def _apply_logged_reaction(messages: List[Dict], reaction: Dict) -> None:
+    """Apply a reaction record to the message it names, if still kept."""
+    for message in reversed(messages):
+        if message.get("message_id") == reaction["message_id"]:
+            apply_reaction(message, reaction)
+            return
@@ -0,0 +1,138 @@
+"""
+Stream Repair
+
+Heals clients' room streams without them asking for history. A new_message
+lost on the way to a client (a dropped frame, a slow consumer, a message
+delivered while the connection was being replaced) leaves a gap in the
+room's sequence numbers the client can't fill on its own until it pages
+through get_history.
+
+Clients report in each pong, under ``sequences``, the highest sequence
+number they received without a gap in each of their rooms. The node
+compares it with the highest sequence number it handed to the room's
+local clients and sends the client the messages in between again, as
+new_message events with ``retransmitted`` set; clients order them into
+their streams and drop the ones they already have by message ID.
+
+- Messages handed out less than REPAIR_GRACE seconds ago don't count as
+  missing: they may still be on their way.
+- At most REPAIR_BATCH messages of a room are sent per report; the rest
+  follow the next pong.
+- Messages from before the connection joined the room are history, not
+  part of its stream (see get_history and resume_session), and each
+  message is sent again at most once per connection, so a message the
+  user filters out, or a retention policy removed, isn't asked for
+  forever.
+- Messages of at_most_once rooms are never sent twice (see delivery.py).
+
+The messages come from the room's history when this node administers the
+room, else from its admin with the retransmit_messages RPC.
+"""
+
+import threading
+import time
+from collections import deque
+from typing import Callable, Deque, Dict, Optional, Tuple
+
+# Stream repair configuration
+REPAIR_GRACE = 2.0  # seconds a delivered message may still be in flight
+REPAIR_BATCH = 100  # messages of a room sent again per report
+
+
+class StreamRepair:
+    """
+    Tracks the sequence numbers handed to local clients, per room.
+
+    Thread-safe: messages are recorded from the event loop and from
+    XML-RPC worker threads.
+    """
+
+    def __init__(
+        self,
+        grace: float = REPAIR_GRACE,
+        batch: int = REPAIR_BATCH,
+        clock: Callable[[], float] = time.monotonic,
+    ):
+        """
+        Initialize the tracker.
+
+        Args:
+            grace: Seconds a delivered message may still be in flight
+            batch: Messages of a room sent again per report
+            clock: Function returning the current time in seconds
+        """
+        self.grace = grace
+        self.batch = batch
+        self.clock = clock
+        self._lock = threading.Lock()
+        # Maps room_id -> (sequence number, when it was handed out), the
+        # oldest entry being the newest one older than the grace period
+        self._delivered: Dict[str, Deque[Tuple[int, float]]] = {}
+
+    def record(self, room_id: str, sequence: int) -> None:
+        """
+        Note a message handed to the room's local clients.
+
+        Args:
+            room_id: The room ID
+            sequence: The message's sequence number
+        """
+        now = self.clock()
+        with self._lock:
+            delivered = self._delivered.setdefault(room_id, deque())
+            if delivered and sequence <= delivered[-1][0]:
+                return
+            delivered.append((sequence, now))
+            while len(delivered) > 1 and delivered[1][1] <= now - self.grace:
+                delivered.popleft()
+
+    def latest(self, room_id: str) -> int:
+        """Get the highest sequence number handed out in a room (0 if none)."""
+        with self._lock:
+            delivered = self._delivered.get(room_id)
+            return delivered[-1][0] if delivered else 0
+
+    def settled(self, room_id: str) -> int:
+        """
+        Get the highest sequence number handed out before the grace period.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            int: The sequence number, 0 if none
+        """
+        cutoff = self.clock() - self.grace
+        with self._lock:
+            for sequence, at in reversed(self._delivered.get(room_id, ())):
+                if at <= cutoff:
+                    return sequence
+        return 0
+
+    def missing(
+        self, room_id: str, seen: int, floor: int = 0
+    ) -> Optional[Tuple[int, int]]:
+        """
+        Get the sequence numbers a client reporting seen is missing.
+
+        Args:
+            room_id: The room ID
+            seen: Highest sequence number the client has without a gap
+            floor: Sequence number up to which the connection is not to
+                be sent messages again (it joined after them, or already
+                had them sent again)
+
+        Returns:
+            tuple: (first, last) sequence numbers to send again, at most
+            batch of them, or None if the client isn't missing any
+        """
+        first = max(seen, floor) + 1
+        last = min(self.settled(room_id), first + self.batch - 1)
+        if first > last:
+            return None
+        return first, last
+
+    def forget(self, room_id: str) -> None:
+        """Stop tracking a room, e.g. once it was deleted."""
+        with self._lock:
+            self._delivered.pop(room_id, None)
@@ -0,0 +1,104 @@
+"""
+Threaded Replies
+
+A message sent with reply_to names the message it answers, which must be
+in the same room. The administrator node stores the parent's ID in the
+reply's reply_to field and the thread's first message in its thread_id
+field, so replies to replies stay in one thread whose parent -> children
+relationships can be walked.
+
+The thread root keeps a summary of its thread in a "thread" field
+(reply_count and last_reply_at). The administrator updates it with every
+reply and announces it with a thread_updated event, which other nodes
+store in their replicas; the message log rebuilds it from the replies on
+recovery. History queries with a thread_id return just that message and
+its replies.
+"""
+
+from typing import Dict, List
+
+
+class ThreadError(Exception):
+    """A reply could not be added to a thread."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "PARENT_NOT_FOUND")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def thread_root(message: Dict) -> str:
+    """
+    Get the ID of the first message of a message's thread.
+
+    Args:
+        message: The message data
+
+    Returns:
+        str: The thread_id of a reply, or the message's own ID
+    """
+    return message.get("thread_id") or message["message_id"]
+
+
+def thread_summary(root: Dict, reply: Dict) -> Dict:
+    """
+    Compute a thread root's summary after a new reply.
+
+    Args:
+        root: The thread's first message
+        reply: The reply just added
+
+    Returns:
+        dict: {'reply_count': int, 'last_reply_at': str}
+    """
+    thread = root.get("thread", {})
+    return {
+        "reply_count": thread.get("reply_count", 0) + 1,
+        "last_reply_at": reply["timestamp"],
+    }
+
+
+def apply_logged_reply(messages: List[Dict], reply: Dict) -> None:
+    """
+    Update the summary of a reply's thread root while replaying messages.
+
+    Args:
+        messages: Messages read so far, in sequence order
+        reply: A message with a thread_id
+    """
+    for message in reversed(messages):
+        if message.get("message_id") == reply["thread_id"]:
+            message["thread"] = thread_summary(message, reply)
+            return
+
+
+def thread_messages(messages: List[Dict], message_id: str) -> List[Dict]:
+    """
+    Select a message and all replies below it.
+
+    Parents come before their replies in sequence order, so one pass
+    collects the subtree.
+
+    Args:
+        messages: A room's messages in sequence order
+        message_id: ID of the subtree's top message
+
+    Returns:
+        The message and its replies in sequence order, or an empty list if
+        the message is not among messages
+    """
+    selected: List[Dict] = []
+    ids = set()
+    for message in messages:
+        if message["message_id"] == message_id or (
+            message.get("reply_to") in ids
+        ):
+            selected.append(message)
+            ids.add(message["message_id"])
+    return selected
@@ -0,0 +1,171 @@
+"""
+TLS for Client and Inter-Node Connections
+
+With a certificate and key configured, the WebSocket listener serves
+wss:// and the XML-RPC server serves https://. With a CA file as well,
+nodes use mutual TLS: the XML-RPC server only accepts callers presenting a
+certificate signed by the CA, and outgoing XML-RPC calls present the
+node's certificate and verify the peer's against the CA.
+
+The SSL contexts are created once and reloaded in place. On SIGHUP the
+certificate, key and CA are read again (from new paths, if a
+configuration reload changed them): new connections use them, and
+established connections keep the certificates they were opened with.
+Files that fail to load leave the previous certificates in use. Reloaded
+CA certificates are added to those already trusted, so peers still
+presenting certificates from the previous CA keep working until restart.
+"""
+
+import logging
+import signal
+import ssl
+import threading
+from typing import Optional
+
+logger = logging.getLogger(__name__)
+
+# Seconds allowed for the TLS handshake of an incoming XML-RPC connection
+HANDSHAKE_TIMEOUT = 5
+
+
+class TLSManager:
+    """
+    Holds the node's SSL contexts and reloads their certificates.
+
+    Attributes:
+        server_context: Context of the client WebSocket listener
+        node_server_context: Context of the XML-RPC server; requires a
+            client certificate when a CA file is set
+        client_context: Context of outgoing XML-RPC calls
+        reloads: Number of successful reloads
+    """
+
+    def __init__(self, cert_file: str, key_file: str, ca_file: str = ""):
+        """
+        Initialize the contexts and load the certificates.
+
+        Args:
+            cert_file: PEM certificate chain of this node
+            key_file: PEM private key of the certificate
+            ca_file: Optional PEM CA bundle that peer certificates must be
+                signed by; enables mutual TLS between nodes
+
+        Raises:
+            OSError: If a file can't be read
+            ssl.SSLError: If a file isn't a valid certificate or key
+        """
+        self.cert_file = cert_file
+        self.key_file = key_file
+        self.ca_file = ca_file
+        self.server_context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+        self.node_server_context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+        self.client_context = ssl.SSLContext(ssl.PROTOCOL_TLS_CLIENT)
+        if self.mutual:
+            self.node_server_context.verify_mode = ssl.CERT_REQUIRED
+        else:
+            self.client_context.load_default_certs()
+        self.reloads = 0
+        self._lock = threading.Lock()
+        self._load()
+
+    @property
+    def mutual(self) -> bool:
+        """Whether nodes authenticate each other with certificates."""
+        return bool(self.ca_file)
+
+    def _load(self) -> None:
+        """Load the certificate files into every context."""
+        # Check the files on a scratch context first, so a bad file can't
+        # leave the live contexts half updated
+        scratch = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+        scratch.load_cert_chain(self.cert_file, self.key_file)
+        if self.ca_file:
+            scratch.load_verify_locations(self.ca_file)
+
+        for context in (
+            self.server_context,
+            self.node_server_context,
+            self.client_context,
+        ):
+            context.load_cert_chain(self.cert_file, self.key_file)
+        if self.ca_file:
+            self.node_server_context.load_verify_locations(self.ca_file)
+            self.client_context.load_verify_locations(self.ca_file)
+
+    def reload(
+        self,
+        cert_file: Optional[str] = None,
+        key_file: Optional[str] = None,
+        ca_file: Optional[str] = None,
+    ) -> bool:
+        """
+        Read the certificate, key and CA files again.
+
+        Args:
+            cert_file: Optional new path of the certificate chain
+            key_file: Optional new path of the private key
+            ca_file: Optional new path of the CA bundle
+
+        Returns:
+            bool: True if the new files were loaded, False if they failed
+            to load and the previous certificates are still in use
+        """
+        with self._lock:
+            previous = (self.cert_file, self.key_file, self.ca_file)
+            self.cert_file = cert_file or self.cert_file
+            self.key_file = key_file or self.key_file
+            self.ca_file = ca_file or self.ca_file
+            try:
+                self._load()
+            except (OSError, ssl.SSLError) as e:
+                self.cert_file, self.key_file, self.ca_file = previous
+                logger.error(
+                    f"Failed to reload TLS certificates, keeping the "
+                    f"previous ones: {e}"
+                )
+                return False
+            self.reloads += 1
+        logger.info(f"Reloaded TLS certificate {self.cert_file}")
+        return True
+
+
+# The manager whose client context outgoing XML-RPC calls use
+_manager: Optional[TLSManager] = None
+
+
+def configure_tls(manager: Optional[TLSManager]) -> None:
+    """
+    Install the TLS manager used by outgoing XML-RPC calls.
+
+    Args:
+        manager: The node's TLSManager; None uses Python's defaults
+    """
+    global _manager
+    _manager = manager
+
+
+def client_context() -> Optional[ssl.SSLContext]:
+    """Get the SSL context for https:// XML-RPC calls, if configured."""
+    return _manager.client_context if _manager else None
+
+
+def install_reload_handler(loop, manager: TLSManager) -> bool:
+    """
+    Reload the certificates when the process receives SIGHUP.
+
+    Args:
+        loop: The running event loop
+        manager: The TLSManager to reload
+
+    Returns:
+        bool: True if the handler was installed (False where the platform
+        has no SIGHUP, e.g. on Windows)
+    """
+    sighup = getattr(signal, "SIGHUP", None)
+    if sighup is None:
+        return False
+    try:
+        loop.add_signal_handler(sighup, manager.reload)
+    except (NotImplementedError, RuntimeError):
+        return False
+    return True
@@ -0,0 +1,230 @@
+"""
+Total-Order Delivery
+
+Rooms created with the total order option have every member see messages
+in exactly the same order. The room's administrator node acts as the
+sequencer: it assigns each message the next sequence number and marks it
+with "total_order" and its own node ID as "sequencer".
+
+Other nodes release such messages to their clients strictly by sequence
+number. A message that arrives ahead of a missing one is held back; once
+the gap has been open for RETRANSMIT_TIMEOUT seconds the node asks the
+sequencer to send the missing messages again with the retransmit_messages
+RPC. If the sequencer can't fill the gap after MAX_RETRANSMIT_ATTEMPTS
+requests (e.g. the messages fell out of its history), the held messages
+are released and the gap is skipped, so the room does not stall forever.
+"""
+
+import logging
+import threading
+import time
+from dataclasses import dataclass
+from typing import Dict, List, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+# Total-order configuration
+RETRANSMIT_TIMEOUT = 1.0  # seconds a gap stays open before retransmission
+MAX_RETRANSMIT_ATTEMPTS = 5  # requests before a gap is skipped
+MAX_HELD_MESSAGES = 1000  # held messages per room before a gap is skipped
+
+
+@dataclass
+class SequenceGap:
+    """
+    Messages missing before the held messages of a room.
+
+    Attributes:
+        room_id: The room ID
+        sequencer: Node that assigned the held messages' sequence numbers
+        first_sequence: First missing sequence number
+        last_sequence: Last missing sequence number
+    """
+
+    room_id: str
+    sequencer: str
+    first_sequence: int
+    last_sequence: int
+
+
+class SequenceBuffer:
+    """
+    Per-room buffer that releases total-order messages by sequence number.
+    """
+
+    def __init__(
+        self,
+        retransmit_timeout: float = RETRANSMIT_TIMEOUT,
+        max_attempts: int = MAX_RETRANSMIT_ATTEMPTS,
+        max_held: int = MAX_HELD_MESSAGES,
+    ):
+        """
+        Initialize the buffer.
+
+        Args:
+            retransmit_timeout: Seconds a gap stays open before it is
+                reported for retransmission
+            max_attempts: Retransmission requests before a gap is skipped
+            max_held: Maximum number of held messages per room
+        """
+        self.retransmit_timeout = retransmit_timeout
+        self.max_attempts = max_attempts
+        self.max_held = max_held
+        self._lock = threading.Lock()
+        # Maps room_id -> next sequence number to deliver
+        self._next: Dict[str, int] = {}
+        # Maps room_id -> {sequence_number: message} held back
+        self._held: Dict[str, Dict[int, Dict]] = {}
+        # Maps room_id -> (time the gap opened, retransmission requests)
+        self._gaps: Dict[str, Tuple[float, int]] = {}
+
+    def seed(self, room_id: str, last_sequence: int) -> List[Dict]:
+        """
+        Mark messages up to a sequence number as delivered, e.g. on join.
+
+        The delivered position only moves forward.
+
+        Args:
+            room_id: The room ID
+            last_sequence: Sequence number of the last message already shown
+
+        Returns:
+            Held messages that became deliverable, in sequence order
+        """
+        with self._lock:
+            current = self._next.get(room_id, 0)
+            self._next[room_id] = max(current, last_sequence + 1)
+            return self._release(room_id)
+
+    def next_sequence(self, room_id: str) -> Optional[int]:
+        """Get the next sequence number to deliver, or None if unknown."""
+        with self._lock:
+            return self._next.get(room_id)
+
+    def held_count(self, room_id: str) -> int:
+        """Get the number of messages held back for a room."""
+        with self._lock:
+            return len(self._held.get(room_id, {}))
+
+    def forget(self, room_id: str) -> None:
+        """Drop all state for a room (e.g., after it is deleted)."""
+        with self._lock:
+            self._next.pop(room_id, None)
+            self._held.pop(room_id, None)
+            self._gaps.pop(room_id, None)
+
+    def receive(self, room_id: str, message: Dict) -> List[Dict]:
+        """
+        Accept a message and return every message now deliverable.
+
+        Args:
+            room_id: The room ID
+            message: Message data with 'sequence_number'
+
+        Returns:
+            Messages to deliver to clients, in sequence order. Empty if the
+            message is held back or was already delivered.
+        """
+        sequence_number = message["sequence_number"]
+        with self._lock:
+            # First message seen for this room: it defines the baseline
+            expected = self._next.setdefault(room_id, sequence_number)
+            if sequence_number < expected:
+                logger.debug(
+                    f"Dropping already delivered message #{sequence_number} "
+                    f"in room {room_id}"
+                )
+                return []
+
+            held = self._held.setdefault(room_id, {})
+            held[sequence_number] = message
+            released = self._release(room_id)
+            if not released:
+                logger.debug(
+                    f"Holding message #{sequence_number} in room {room_id}, "
+                    f"waiting for #{expected}"
+                )
+            if len(held) > self.max_held:
+                logger.warning(
+                    f"Too many messages held in room {room_id}, skipping gap"
+                )
+                released.extend(self._skip_gap(room_id))
+            return released
+
+    def gaps(self, now: Optional[float] = None) -> List[SequenceGap]:
+        """
+        Get the gaps that have been open longer than the timeout.
+
+        Each call counts as a retransmission request for the gaps it
+        returns. Gaps already requested MAX_RETRANSMIT_ATTEMPTS times are
+        not returned; use skip_stale_gaps() to release what they hold.
+
+        Args:
+            now: Current UNIX time (defaults to time.time())
+
+        Returns:
+            The gaps to request from their sequencers
+        """
+        now = time.time() if now is None else now
+        gaps = []
+        with self._lock:
+            for room_id, (opened_at, attempts) in list(self._gaps.items()):
+                if now - opened_at < self.retransmit_timeout:
+                    continue
+                if attempts >= self.max_attempts:
+                    continue
+                held = self._held[room_id]
+                first_held = min(held)
+                gaps.append(
+                    SequenceGap(
+                        room_id=room_id,
+                        sequencer=held[first_held].get("sequencer", ""),
+                        first_sequence=self._next[room_id],
+                        last_sequence=first_held - 1,
+                    )
+                )
+                self._gaps[room_id] = (opened_at, attempts + 1)
+        return gaps
+
+    def skip_stale_gaps(self) -> Dict[str, List[Dict]]:
+        """
+        Release held messages of gaps that retransmission couldn't fill.
+
+        Returns:
+            Maps room_id to the messages released for it, in order
+        """
+        released = {}
+        with self._lock:
+            for room_id, (_, attempts) in list(self._gaps.items()):
+                if attempts < self.max_attempts:
+                    continue
+                logger.warning(
+                    f"Skipping messages #{self._next[room_id]}-"
+                    f"#{min(self._held[room_id]) - 1} in room {room_id}, "
+                    "retransmission failed"
+                )
+                released[room_id] = self._skip_gap(room_id)
+        return released
+
+    def _release(self, room_id: str) -> List[Dict]:
+        """Release held messages in sequence from the next expected (lock)."""
+        held = self._held.get(room_id, {})
+        released = []
+        while self._next[room_id] in held:
+            released.append(held.pop(self._next[room_id]))
+            self._next[room_id] += 1
+        if not held:
+            self._gaps.pop(room_id, None)
+        elif released or room_id not in self._gaps:
+            # A gap after released messages starts its own timeout
+            self._gaps[room_id] = (time.time(), 0)
+        return released
+
+    def _skip_gap(self, room_id: str) -> List[Dict]:
+        """Move past the missing messages and release what follows (lock)."""
+        held = self._held.get(room_id, {})
+        if not held:
+            return []
+        self._next[room_id] = min(held)
+        self._gaps.pop(room_id, None)
+        return self._release(room_id)
@@ -0,0 +1,1317 @@
+"""
+Two-Phase Commit (2PC) Engine
+
+Generic coordinator and participant roles for operations that must be
+applied atomically on several nodes. The coordinator asks every participant
+to PREPARE an operation, collects their votes, and then tells all of them
+to COMMIT (if every vote was READY) or ABORT.
+
+Participants delegate the actual work to a TransactionHandler registered
+for the operation name, so a new multi-node mutation (room deletion, room
+renames, ...) only has to supply a handler. Both roles keep a log of every
+transaction they take part in, and both abort on timeout: the coordinator
+when votes don't arrive in time, and a participant when it has voted READY
+but never hears the coordinator's decision (presumed abort).
+
+Presumed abort is only safe while nobody has committed, so a coordinator
+that dies after sending COMMIT to some participants leaves the others
+aborting. Participants given a peer registry recover such transactions
+instead, with a three-phase commit extension:
+
+- The coordinator sends the participant list with PREPARE (under
+  PARTICIPANTS_KEY in the payload), and participants that can recover add
+  'recovery': True to their READY vote. Only if every vote has it does the
+  coordinator run the extra round; otherwise it runs plain 2PC, so nodes
+  without the extension keep working.
+- Before COMMIT, the coordinator sends PRECOMMIT to every participant.
+  Each logs PRECOMMITTED durably (TransactionStore) and acknowledges, and
+  the coordinator commits once any participant has.
+- A participant that hears nothing for participant_timeout seconds asks
+  the other participants for their state (tpc_status). The lowest node ID
+  that answered, counting the asking node, is the recovery coordinator:
+  it decides with decide_outcome and sends COMMIT or ABORT to everyone.
+  Any node adopts an outcome that some participant already knows.
+
+Answering tpc_status while PREPARED makes a participant refuse later
+PRECOMMITs, so a recovery coordinator that saw every participant PREPARED
+can abort without a late PRECOMMIT slipping in, and a participant asked
+about a transaction it never prepared remembers it as aborted. A
+transaction stays blocked while a participant that might hold the
+outcome is unreachable; recovery is retried every participant_timeout.
+"""
+
+import asyncio
+import contextvars
+import json
+import logging
+import os
+import threading
+import time
+import uuid
+from collections import OrderedDict
+from concurrent.futures import ThreadPoolExecutor
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
+from typing import Any, Callable, Dict, List, Optional, Tuple
+
+from .audit import TRANSACTION_DECIDED, audit
+from .faults import (
+    COORDINATOR_AFTER_DECISION,
+    COORDINATOR_BEFORE_PREPARE,
+    PARTICIPANT_AFTER_VOTE,
+    PARTICIPANT_BEFORE_DECISION,
+)
+from .room_state import TransactionState
+
+logger = logging.getLogger(__name__)
+
+# 2PC timeout constants
+PREPARE_TIMEOUT = 5  # seconds to wait for all votes
+DECISION_TIMEOUT = 5  # seconds to wait for COMMIT/ABORT acknowledgements
+PARTICIPANT_TIMEOUT = 30  # seconds a prepared participant waits for a decision
+TIMEOUT_CHECK_INTERVAL = 5  # seconds between participant timeout checks
+
+# Maximum number of transactions kept in a TransactionLog
+MAX_LOGGED_TRANSACTIONS = 1000
+
+# Votes
+VOTE_READY = "READY"
+VOTE_ABORT = "ABORT"
+
+# Participant states reported by tpc_status, besides COMMIT and ROLLBACK
+STATE_PREPARED = "PREPARED"
+STATE_PRECOMMITTED = "PRECOMMITTED"
+STATE_UNKNOWN = "UNKNOWN"  # never prepared on the node
+DECIDED_STATES = (
+    TransactionState.COMMIT.value,
+    TransactionState.ROLLBACK.value,
+)
+
+# Payload field carrying the participant list to participants
+PARTICIPANTS_KEY = "tpc_participants"
+
+# Name of the participant's state file in the data directory
+TPC_FILENAME = "tpc.json"
+
+
+def decide_outcome(
+    statuses: Dict[str, Optional[str]]
+) -> Optional[TransactionState]:
+    """
+    Decide a transaction from its participants' states.
+
+    The coordinator only pre-commits after every vote was READY and only
+    commits after a pre-commit, so any COMMIT or PRECOMMITTED state means
+    the transaction commits. Any ROLLBACK or UNKNOWN state means it can't.
+    If every participant answered PREPARED, none can have pre-committed
+    (they won't any more once asked), so aborting is safe.
+
+    Args:
+        statuses: Maps node_id -> state, or None if the node didn't answer
+
+    Returns:
+        COMMIT, ROLLBACK, or None while the outcome depends on a node that
+        didn't answer
+    """
+    states = list(statuses.values())
+    if any(
+        s in (TransactionState.COMMIT.value, STATE_PRECOMMITTED)
+        for s in states
+    ):
+        return TransactionState.COMMIT
+    if any(
+        s in (TransactionState.ROLLBACK.value, STATE_UNKNOWN) for s in states
+    ):
+        return TransactionState.ROLLBACK
+    if all(s == STATE_PREPARED for s in states):
+        return TransactionState.ROLLBACK
+    return None
+
+
+class TransactionStore:
+    """
+    Durable participant state: undecided transactions and recent outcomes.
+
+    Saved as one JSON file replaced atomically, or kept in memory without a
+    path.
+    """
+
+    def __init__(self, path: Optional[str] = None):
+        """
+        Initialize the store.
+
+        Args:
+            path: JSON file to keep the state in (None keeps it in memory)
+        """
+        self.path = path
+        self._state: Dict = {"transactions": [], "outcomes": {}}
+
+    def load(self) -> Tuple[List[Dict], Dict[str, str]]:
+        """
+        Read the saved state.
+
+        Returns:
+            tuple: (transaction records, transaction_id -> outcome)
+        """
+        if self.path and os.path.exists(self.path):
+            with open(self.path, encoding="utf-8") as handle:
+                self._state = json.load(handle)
+        state = self._state
+        return list(state["transactions"]), dict(state["outcomes"])
+
+    def save(self, transactions: List[Dict], outcomes: Dict[str, str]) -> None:
+        """
+        Save the state, fsynced before returning.
+
+        Args:
+            transactions: Records of the undecided transactions
+            outcomes: Maps transaction_id -> COMMIT or ROLLBACK
+
+        Raises:
+            OSError: If the state cannot be written
+        """
+        self._state = {
+            "transactions": list(transactions),
+            "outcomes": dict(outcomes),
+        }
+        if not self.path:
+            return
+        os.makedirs(os.path.dirname(os.path.abspath(self.path)), exist_ok=True)
+        temporary = f"{self.path}.tmp"
+        with open(temporary, "w", encoding="utf-8") as handle:
+            json.dump(self._state, handle, separators=(",", ":"))
+            handle.flush()
+            os.fsync(handle.fileno())
+        os.replace(temporary, self.path)
+
+
+class TransactionLog:
+    """
+    Per-transaction event log.
+
+    Records every state change of each transaction so the outcome of a
+    distributed operation can be inspected after the fact. Only the most
+    recent transactions are kept.
+    """
+
+    def __init__(self, max_transactions: int = MAX_LOGGED_TRANSACTIONS):
+        """
+        Initialize the log.
+
+        Args:
+            max_transactions: Number of transactions to retain
+        """
+        self.max_transactions = max_transactions
+        self._lock = threading.Lock()
+        self._entries: "OrderedDict[str, List[Dict[str, Any]]]" = OrderedDict()
+
+    def append(self, transaction_id: str, event: str, **details) -> None:
+        """
+        Append an event to a transaction's log.
+
+        Args:
+            transaction_id: The transaction ID
+            event: Short event name (e.g., "PREPARE", "VOTE", "COMMIT")
+            **details: Extra fields to record with the event
+        """
+        entry = {
+            "event": event,
+            "timestamp": datetime.now(timezone.utc).isoformat(),
+        }
+        entry.update(details)
+        with self._lock:
+            events = self._entries.get(transaction_id)
+            if events is None:
+                events = self._entries[transaction_id] = []
+                while len(self._entries) > self.max_transactions:
+                    self._entries.popitem(last=False)
+            events.append(entry)
+
+    def get(self, transaction_id: str) -> List[Dict[str, Any]]:
+        """Get a copy of the events logged for a transaction."""
+        with self._lock:
+            return list(self._entries.get(transaction_id, []))
+
+    def transaction_ids(self) -> List[str]:
+        """Get the IDs of all logged transactions, oldest first."""
+        with self._lock:
+            return list(self._entries.keys())
+
+
+class TransactionHandler:
+    """
+    Participant-side implementation of one 2PC operation.
+
+    Subclasses override the three phases. Each receives the transaction ID
+    and the operation payload sent by the coordinator.
+    """
+
+    def prepare(self, transaction_id: str, payload: Dict) -> Dict:
+        """
+        Check and lock resources for the operation.
+
+        Returns:
+            dict: {'vote': 'READY'} or {'vote': 'ABORT', 'reason': str}
+        """
+        raise NotImplementedError
+
+    def commit(self, transaction_id: str, payload: Dict) -> Dict:
+        """
+        Apply the prepared operation.
+
+        Returns:
+            dict: Result with 'success' flag
+        """
+        raise NotImplementedError
+
+    def abort(self, transaction_id: str, payload: Dict) -> Dict:
+        """
+        Release anything locked by prepare.
+
+        Returns:
+            dict: Result with 'success' flag
+        """
+        raise NotImplementedError
+
+
+@dataclass
+class ParticipantTransaction:
+    """
+    A transaction as seen by a participant.
+
+    Attributes:
+        transaction_id: Unique identifier for the transaction
+        operation: Name of the operation being performed
+        payload: Operation arguments sent by the coordinator
+        coordinator: Node ID of the coordinator
+        vote: Vote cast ('READY' or 'ABORT')
+        prepared_at: UNIX time when the vote was cast, or when the
+            transaction was last pre-committed or recovered
+        participants: Node IDs of all participants, if the transaction
+            can be recovered without its coordinator (empty otherwise)
+        state: 'PREPARED' or 'PRECOMMITTED'
+        fenced: True once a status query or a recovery here saw it
+            PREPARED; later PRECOMMITs are refused
+        recovery_attempts: Recovery rounds that couldn't decide it
+        statuses: The other participants' states seen by the last
+            recovery round (None for nodes that didn't answer)
+    """
+
+    transaction_id: str
+    operation: str
+    payload: Dict
+    coordinator: str
+    vote: str = VOTE_READY
+    prepared_at: float = field(default_factory=time.time)
+    participants: List[str] = field(default_factory=list)
+    state: str = STATE_PREPARED
+    fenced: bool = False
+    recovery_attempts: int = 0
+    statuses: Dict[str, Optional[str]] = field(default_factory=dict)
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return {
+            "transaction_id": self.transaction_id,
+            "operation": self.operation,
+            "coordinator": self.coordinator,
+            "vote": self.vote,
+            "prepared_at": self.prepared_at,
+            "participants": list(self.participants),
+            "state": self.state,
+            "recovery_attempts": self.recovery_attempts,
+            "statuses": dict(self.statuses),
+        }
+
+
+class TPCParticipant:
+    """
+    Participant role: votes on and applies operations from coordinators.
+
+    With a peer registry, transactions whose coordinator sent the
+    participant list are recovered by the participants after a timeout
+    instead of being presumed aborted.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        participant_timeout: float = PARTICIPANT_TIMEOUT,
+        faults=None,
+        peer_registry=None,
+        store: Optional[TransactionStore] = None,
+    ):
+        """
+        Initialize the participant.
+
+        Args:
+            node_id: ID of this node
+            participant_timeout: Seconds to wait for a decision after
+                voting READY before aborting or recovering
+            faults: Optional FaultInjector that may crash this node after
+                voting or before applying a decision
+            peer_registry: Optional PeerRegistry used to query the other
+                participants; enables recovery
+            store: Optional TransactionStore keeping undecided transactions
+                and outcomes across restarts (in memory by default)
+        """
+        self.node_id = node_id
+        self.participant_timeout = participant_timeout
+        self.faults = faults
+        self.peer_registry = peer_registry
+        self.store = store or TransactionStore()
+        self.log = TransactionLog()
+        self._lock = threading.RLock()
+        self._handlers: Dict[str, TransactionHandler] = {}
+        self._transactions: Dict[str, ParticipantTransaction] = {}
+        # Maps transaction_id -> COMMIT or ROLLBACK, most recent last
+        self._outcomes: "OrderedDict[str, str]" = OrderedDict()
+
+        transactions, outcomes = self.store.load()
+        for record in transactions:
+            txn = ParticipantTransaction(**record)
+            self._transactions[txn.transaction_id] = txn
+        self._outcomes.update(outcomes)
+        if transactions:
+            logger.info(
+                f"Restored {len(transactions)} undecided 2PC transactions"
+            )
+
+    def register_handler(
+        self, operation: str, handler: TransactionHandler
+    ) -> None:
+        """
+        Register the handler for an operation.
+
+        Args:
+            operation: Operation name sent by coordinators
+            handler: Handler implementing the operation's phases
+        """
+        self._handlers[operation] = handler
+
+    def get_transaction(
+        self, transaction_id: str
+    ) -> Optional[ParticipantTransaction]:
+        """Get a transaction this participant has prepared."""
+        with self._lock:
+            return self._transactions.get(transaction_id)
+
+    def prepared_transactions(self) -> List[ParticipantTransaction]:
+        """Get the transactions voted READY and awaiting a decision."""
+        with self._lock:
+            return list(self._transactions.values())
+
+    def in_doubt_transactions(self) -> List[ParticipantTransaction]:
+        """Get the transactions recovery has tried and failed to decide."""
+        with self._lock:
+            return [
+                txn
+                for txn in self._transactions.values()
+                if txn.recovery_attempts
+            ]
+
+    def force(
+        self, transaction_id: str, decision: TransactionState
+    ) -> Optional[List[str]]:
+        """
+        Apply an operator's decision to an undecided transaction.
+
+        The decision is sent to the other participants too. Unlike
+        recovery, nothing checks that it matches what they decided, so it
+        is meant for transactions recovery can't finish. Makes blocking
+        RPCs, so it is run in an executor.
+
+        Args:
+            transaction_id: The transaction ID
+            decision: COMMIT or ROLLBACK
+
+        Returns:
+            The other participants that acknowledged, or None if the
+            transaction isn't undecided here
+        """
+        txn = self.get_transaction(transaction_id)
+        if txn is None:
+            return None
+        logger.warning(
+            f"Forcing {decision.value} of transaction {transaction_id}"
+        )
+        self.log.append(transaction_id, "FORCED", decision=decision.value)
+        acknowledged = self._send_decision(txn, decision, {})
+        self._decide(transaction_id, decision)
+        return acknowledged
+
+    def prepare(
+        self,
+        transaction_id: str,
+        operation: str,
+        payload: Dict,
+        coordinator: str,
+    ) -> Dict:
+        """
+        Phase 1: vote on an operation.
+
+        Args:
+            transaction_id: The transaction ID
+            operation: Operation name
+            payload: Operation arguments
+            coordinator: Node ID of the coordinator
+
+        Returns:
+            dict: Vote with 'vote', 'node_id', 'transaction_id' and,
+            for ABORT, 'reason'
+        """
+        self.log.append(
+            transaction_id,
+            "PREPARE",
+            operation=operation,
+            coordinator=coordinator,
+        )
+
+        participants = list(payload.get(PARTICIPANTS_KEY) or [])
+        payload = {k: v for k, v in payload.items() if k != PARTICIPANTS_KEY}
+        recoverable = bool(participants) and self.peer_registry is not None
+
+        with self._lock:
+            existing = self._transactions.get(transaction_id)
+            if existing:
+                # Repeated PREPARE (e.g., a retry): repeat the earlier vote
+                return self._vote_result(
+                    transaction_id,
+                    existing.vote,
+                    recovery=bool(existing.participants),
+                )
+            if transaction_id in self._outcomes:
+                # Aborted by recovery before this PREPARE arrived
+                reason = "Transaction was already decided"
+                self.log.append(transaction_id, "VOTE", vote=VOTE_ABORT)
+                return self._vote_result(transaction_id, VOTE_ABORT, reason)
+
+            handler = self._handlers.get(operation)
+            if handler is None:
+                reason = f"Unknown operation: {operation}"
+                self.log.append(transaction_id, "VOTE", vote=VOTE_ABORT)
+                return self._vote_result(transaction_id, VOTE_ABORT, reason)
+
+            try:
+                result = handler.prepare(transaction_id, payload) or {}
+            except Exception as e:
+                logger.error(
+                    f"Prepare failed for transaction {transaction_id}: {e}"
+                )
+                result = {"vote": VOTE_ABORT, "reason": str(e)}
+
+            vote = result.get("vote", VOTE_ABORT)
+            reason = result.get("reason")
+            self.log.append(transaction_id, "VOTE", vote=vote, reason=reason)
+
+            if vote == VOTE_READY:
+                self._transactions[transaction_id] = ParticipantTransaction(
+                    transaction_id=transaction_id,
+                    operation=operation,
+                    payload=payload,
+                    coordinator=coordinator,
+                    participants=participants if recoverable else [],
+                )
+                if recoverable:
+                    self._save()
+
+        logger.info(
+            f"Voted {vote} on {operation} transaction {transaction_id}"
+        )
+        if self.faults is not None:
+            self.faults.crash_point(PARTICIPANT_AFTER_VOTE, transaction_id)
+        return self._vote_result(
+            transaction_id,
+            vote,
+            reason,
+            recovery=recoverable and vote == VOTE_READY,
+        )
+
+    def precommit(self, transaction_id: str) -> Dict:
+        """
+        Extra phase of the recovery extension: promise to commit.
+
+        Args:
+            transaction_id: The transaction ID
+
+        Returns:
+            dict: Result with 'success', 'node_id' and, on failure, 'error'
+        """
+        with self._lock:
+            txn = self._transactions.get(transaction_id)
+            if txn is None or not txn.participants:
+                if (
+                    self._outcomes.get(transaction_id)
+                    == TransactionState.COMMIT.value
+                ):
+                    return {"success": True, "node_id": self.node_id}
+                return {
+                    "success": False,
+                    "node_id": self.node_id,
+                    "error": "Transaction not prepared",
+                }
+            if txn.fenced:
+                return {
+                    "success": False,
+                    "node_id": self.node_id,
+                    "error": "Transaction is being recovered",
+                }
+            txn.state = STATE_PRECOMMITTED
+            txn.prepared_at = time.time()
+            self._save()
+        self.log.append(transaction_id, STATE_PRECOMMITTED)
+        return {"success": True, "node_id": self.node_id}
+
+    def status(self, transaction_id: str, requester: str = "") -> Dict:
+        """
+        Report where a transaction stands on this node, for recovery.
+
+        A PREPARED transaction is fenced so it refuses later PRECOMMITs,
+        and a transaction never prepared here is remembered as aborted so
+        a late PREPARE votes ABORT.
+
+        Args:
+            transaction_id: The transaction ID
+            requester: Node ID of the node asking
+
+        Returns:
+            dict: {'transaction_id', 'node_id', 'state'} where state is
+            PREPARED, PRECOMMITTED, COMMIT, ROLLBACK or UNKNOWN
+        """
+        with self._lock:
+            txn = self._transactions.get(transaction_id)
+            if txn is not None:
+                state = txn.state
+                if state == STATE_PREPARED and not txn.fenced:
+                    txn.fenced = True
+                    self._save()
+            else:
+                state = self._outcomes.get(transaction_id)
+                if state is None:
+                    state = STATE_UNKNOWN
+                    self._remember(
+                        transaction_id, TransactionState.ROLLBACK.value
+                    )
+                    self._save()
+        self.log.append(
+            transaction_id, "STATUS", requester=requester, state=state
+        )
+        return {
+            "transaction_id": transaction_id,
+            "node_id": self.node_id,
+            "state": state,
+        }
+
+    def commit(self, transaction_id: str) -> Dict:
+        """
+        Phase 2: apply a prepared operation.
+
+        Args:
+            transaction_id: The transaction ID
+
+        Returns:
+            dict: Result with 'success' and 'node_id'
+        """
+        return self._decide(transaction_id, TransactionState.COMMIT)
+
+    def abort(self, transaction_id: str) -> Dict:
+        """
+        Phase 2: abandon a prepared operation.
+
+        Aborting an unknown transaction succeeds, since a participant that
+        voted ABORT (or never prepared) has nothing to undo.
+
+        Args:
+            transaction_id: The transaction ID
+
+        Returns:
+            dict: Result with 'success' and 'node_id'
+        """
+        return self._decide(transaction_id, TransactionState.ROLLBACK)
+
+    def expire_prepared(self) -> List[str]:
+        """
+        Abort prepared transactions whose decision never arrived.
+
+        Transactions that can be recovered are left to recover_blocked().
+
+        Returns:
+            IDs of the transactions that were aborted
+        """
+        cutoff = time.time() - self.participant_timeout
+        with self._lock:
+            expired = [
+                txn.transaction_id
+                for txn in self._transactions.values()
+                if txn.prepared_at < cutoff and not txn.participants
+            ]
+        for transaction_id in expired:
+            logger.warning(
+                f"No decision for transaction {transaction_id}, aborting"
+            )
+            self.log.append(transaction_id, "TIMEOUT")
+            self.abort(transaction_id)
+        return expired
+
+    def recover_blocked(self) -> List[str]:
+        """
+        Drive recoverable transactions silent for too long to an outcome.
+
+        Makes blocking RPCs, so it is run in an executor.
+
+        Returns:
+            IDs of the transactions that were decided
+        """
+        if self.peer_registry is None:
+            return []
+        cutoff = time.time() - self.participant_timeout
+        with self._lock:
+            blocked = [
+                txn
+                for txn in self._transactions.values()
+                if txn.prepared_at < cutoff and txn.participants
+            ]
+        return [
+            txn.transaction_id
+            for txn in blocked
+            if self._recover(txn) is not None
+        ]
+
+    def resolve_orphaned(self, coordinator: str) -> List[str]:
+        """
+        Recover the transactions of a coordinator declared dead right away.
+
+        Transactions with a participant list are recovered with the other
+        participants instead of waiting out participant_timeout. The
+        others are left prepared: the coordinator may only look dead and
+        still commit them, so they are only aborted by expire_prepared()
+        (presumed abort) once the timeout passes. Makes blocking RPCs, so
+        it is run in an executor.
+
+        Args:
+            coordinator: Node ID of the dead coordinator
+
+        Returns:
+            IDs of the transactions that were decided
+        """
+        with self._lock:
+            orphaned = [
+                txn
+                for txn in self._transactions.values()
+                if txn.coordinator == coordinator
+            ]
+        decided = []
+        for txn in orphaned:
+            transaction_id = txn.transaction_id
+            if not txn.participants:
+                logger.warning(
+                    f"Coordinator {coordinator} of transaction "
+                    f"{transaction_id} is dead; aborting it if no decision "
+                    f"arrives in {self.participant_timeout}s"
+                )
+                self.log.append(transaction_id, "COORDINATOR_DEAD")
+            elif self.peer_registry is not None:
+                if self._recover(txn) is not None:
+                    decided.append(transaction_id)
+        return decided
+
+    def _recover(
+        self, txn: ParticipantTransaction
+    ) -> Optional[TransactionState]:
+        """
+        Query the other participants and decide if this node may.
+
+        The transaction is fenced here first, as on the nodes queried, so
+        a PRECOMMIT arriving while the queries are out is refused instead
+        of changing the state the decision is taken on. If the state
+        changed anyway, the participants are queried again.
+        """
+        transaction_id = txn.transaction_id
+        others = [n for n in txn.participants if n != self.node_id]
+        with self._lock:
+            if txn.state == STATE_PREPARED and not txn.fenced:
+                txn.fenced = True
+                self._save()
+        self.log.append(transaction_id, "RECOVERY", participants=others)
+        statuses: Dict[str, Optional[str]] = {}
+        for node_id in others:
+            try:
+                result = self.peer_registry.call_peer(
+                    node_id,
+                    "tpc_status",
+                    transaction_id,
+                    self.node_id,
+                    timeout=DECISION_TIMEOUT,
+                )
+                statuses[node_id] = (result or {}).get("state")
+            except Exception as e:
+                logger.warning(
+                    f"No status for transaction {transaction_id} from "
+                    f"{node_id}: {e}"
+                )
+                statuses[node_id] = None
+
+        with self._lock:
+            if transaction_id not in self._transactions:
+                return None  # decided while the queries were out
+            statuses[self.node_id] = txn.state
+            txn.prepared_at = time.time()
+        decision = decide_outcome(statuses)
+        known = any(s in DECIDED_STATES for s in statuses.values())
+        leader = min(n for n, s in statuses.items() if s is not None)
+        if decision is None or not (known or leader == self.node_id):
+            reason = "blocked" if decision is None else f"left to {leader}"
+            with self._lock:
+                txn.recovery_attempts += 1
+                txn.statuses = {n: statuses[n] for n in others}
+                self._save()
+            self.log.append(transaction_id, "WAIT", reason=reason)
+            logger.warning(
+                f"Transaction {transaction_id} not recovered ({reason}); "
+                f"retrying in {self.participant_timeout}s"
+            )
+            return None
+
+        with self._lock:
+            if transaction_id not in self._transactions:
+                return None
+            changed = txn.state != statuses[self.node_id]
+        if changed:
+            return self._recover(txn)
+        self.log.append(
+            transaction_id,
+            "RECOVERED",
+            decision=decision.value,
+            statuses=statuses,
+        )
+        logger.info(
+            f"Recovered transaction {transaction_id} without its "
+            f"coordinator: {decision.value}"
+        )
+        self._send_decision(txn, decision, statuses)
+        self._decide(transaction_id, decision)
+        return decision
+
+    def _send_decision(
+        self,
+        txn: ParticipantTransaction,
+        decision: TransactionState,
+        statuses: Dict[str, Optional[str]],
+    ) -> List[str]:
+        """
+        Send a decision to the other participants not known to have one.
+
+        Returns:
+            The participants that acknowledged
+        """
+        if self.peer_registry is None:
+            return []
+        method = (
+            "tpc_commit" if decision == TransactionState.COMMIT else "tpc_abort"
+        )
+        acknowledged = []
+        for node_id in txn.participants:
+            decided = statuses.get(node_id) in DECIDED_STATES
+            if node_id == self.node_id or decided:
+                continue
+            try:
+                result = self.peer_registry.call_peer(
+                    node_id,
+                    method,
+                    txn.transaction_id,
+                    timeout=DECISION_TIMEOUT,
+                )
+                if (result or {}).get("success"):
+                    acknowledged.append(node_id)
+            except Exception as e:
+                logger.warning(f"Failed to send {method} to {node_id}: {e}")
+        return acknowledged
+
+    def _decide(self, transaction_id: str, decision: TransactionState) -> Dict:
+        """Apply a COMMIT or ROLLBACK decision from the coordinator."""
+        if self.faults is not None:
+            self.faults.crash_point(
+                PARTICIPANT_BEFORE_DECISION, transaction_id
+            )
+        with self._lock:
+            txn = self._transactions.pop(transaction_id, None)
+            if txn is None:
+                outcome = self._outcomes.get(transaction_id)
+                if outcome is not None and outcome != decision.value:
+                    logger.warning(
+                        f"Cannot {decision.value} transaction "
+                        f"{transaction_id}: it was already {outcome}"
+                    )
+                    return {
+                        "success": False,
+                        "node_id": self.node_id,
+                        "error": f"Transaction already {outcome}",
+                    }
+                if outcome is not None:
+                    return {"success": True, "node_id": self.node_id}
+                if decision == TransactionState.COMMIT:
+                    logger.warning(
+                        f"Cannot commit: transaction {transaction_id} was "
+                        f"not prepared on this node"
+                    )
+                    return {
+                        "success": False,
+                        "node_id": self.node_id,
+                        "error": "Transaction not prepared",
+                    }
+                return {"success": True, "node_id": self.node_id}
+            self._remember(transaction_id, decision.value)
+            self._save()
+
+        handler = self._handlers[txn.operation]
+        try:
+            if decision == TransactionState.COMMIT:
+                result = handler.commit(transaction_id, txn.payload)
+            else:
+                result = handler.abort(transaction_id, txn.payload)
+        except Exception as e:
+            logger.error(
+                f"{decision.value} failed for transaction "
+                f"{transaction_id}: {e}"
+            )
+            result = {"success": False, "error": str(e)}
+
+        result = dict(result or {})
+        result.setdefault("success", True)
+        result["node_id"] = self.node_id
+        self.log.append(
+            transaction_id, decision.value, success=result["success"]
+        )
+        return result
+
+    def _remember(self, transaction_id: str, outcome: str) -> None:
+        """Record an outcome, forgetting the oldest beyond the log size."""
+        self._outcomes[transaction_id] = outcome
+        self._outcomes.move_to_end(transaction_id)
+        while len(self._outcomes) > MAX_LOGGED_TRANSACTIONS:
+            self._outcomes.popitem(last=False)
+
+    def _save(self) -> None:
+        """Write undecided transactions and outcomes to the store."""
+        transactions = [
+            dict(txn.to_dict(), payload=txn.payload, fenced=txn.fenced)
+            for txn in self._transactions.values()
+        ]
+        try:
+            self.store.save(transactions, self._outcomes)
+        except OSError as e:
+            logger.error(f"Failed to save 2PC participant state: {e}")
+
+    def _vote_result(
+        self,
+        transaction_id: str,
+        vote: str,
+        reason: Optional[str] = None,
+        recovery: bool = False,
+    ) -> Dict:
+        """Build the vote response sent back to the coordinator."""
+        result = {
+            "vote": vote,
+            "node_id": self.node_id,
+            "transaction_id": transaction_id,
+        }
+        if reason:
+            result["reason"] = reason
+        if recovery:
+            result["recovery"] = True
+        return result
+
+
+@dataclass
+class CoordinatorTransaction:
+    """
+    A transaction driven by this node as coordinator.
+
+    Attributes:
+        transaction_id: Unique identifier for the transaction
+        operation: Name of the operation being performed
+        payload: Operation arguments sent to participants
+        participants: Node IDs of the participants
+        state: Current state of the transaction
+        votes: Maps node_id to vote ('READY', 'ABORT', or None if missing)
+        abort_reason: Why the transaction was aborted, if it was
+        in_doubt: True if no PRECOMMIT was acknowledged and the outcome
+            was left to the participants' recovery
+    """
+
+    transaction_id: str
+    operation: str
+    payload: Dict
+    participants: List[str]
+    state: TransactionState = TransactionState.PREPARE
+    votes: Dict[str, Optional[str]] = field(default_factory=dict)
+    abort_reason: Optional[str] = None
+    started_at: float = field(default_factory=time.time)
+    in_doubt: bool = False
+
+    @property
+    def committed(self) -> bool:
+        """True if the transaction was committed."""
+        return self.state in (
+            TransactionState.COMMIT,
+            TransactionState.COMPLETED,
+        )
+
+    def to_dict(self) -> Dict:
+        """Convert to dictionary for serialization."""
+        return {
+            "transaction_id": self.transaction_id,
+            "operation": self.operation,
+            "participants": list(self.participants),
+            "state": self.state.value,
+            "votes": dict(self.votes),
+            "abort_reason": self.abort_reason,
+            "started_at": self.started_at,
+            "in_doubt": self.in_doubt,
+        }
+
+
+class TPCCoordinator:
+    """
+    Coordinator role: drives operations across participant nodes.
+
+    Remote participants are reached with the tpc_prepare, tpc_commit and
+    tpc_abort RPCs through the peer registry, plus tpc_precommit and
+    tpc_status when every participant supports recovery.
+    """
+
+    def __init__(
+        self,
+        node_id: str,
+        peer_registry=None,
+        prepare_timeout: float = PREPARE_TIMEOUT,
+        decision_timeout: float = DECISION_TIMEOUT,
+        metrics=None,
+        audit_log=None,
+        faults=None,
+    ):
+        """
+        Initialize the coordinator.
+
+        Args:
+            node_id: ID of this node
+            peer_registry: PeerRegistry used to reach participants
+            prepare_timeout: Seconds to wait for all votes
+            decision_timeout: Seconds to wait for phase 2 acknowledgements
+            metrics: Optional NodeMetrics counting transaction outcomes
+            audit_log: Optional AuditLog recording each outcome
+            faults: Optional FaultInjector that may crash this node
+                before PREPARE or after the decision
+        """
+        self.node_id = node_id
+        self.peer_registry = peer_registry
+        self.prepare_timeout = prepare_timeout
+        self.decision_timeout = decision_timeout
+        self.metrics = metrics
+        self.audit_log = audit_log
+        self.faults = faults
+        self.log = TransactionLog()
+        # Transactions started by execute() that haven't finished yet
+        self._active: Dict[str, CoordinatorTransaction] = {}
+        # Transactions left in doubt, until an operator forces them
+        self._in_doubt: Dict[str, CoordinatorTransaction] = {}
+
+    def active_transactions(self) -> List[CoordinatorTransaction]:
+        """Get the transactions this coordinator is still driving."""
+        return list(self._active.values())
+
+    def in_doubt_transactions(self) -> List[CoordinatorTransaction]:
+        """Get the transactions execute() returned in doubt."""
+        return list(self._in_doubt.values())
+
+    async def force(
+        self, transaction_id: str, decision: TransactionState
+    ) -> Optional[List[str]]:
+        """
+        Send an operator's decision for an in-doubt transaction.
+
+        execute() already returned the transaction as not committed, so
+        on_decision isn't run again; only the participants are told.
+
+        Args:
+            transaction_id: The transaction ID
+            decision: COMMIT or ROLLBACK
+
+        Returns:
+            The participants that acknowledged, or None if the transaction
+            isn't in doubt here
+        """
+        txn = self._in_doubt.pop(transaction_id, None)
+        if txn is None:
+            return None
+        txn.in_doubt = False
+        txn.state = decision
+        if decision == TransactionState.ROLLBACK:
+            txn.abort_reason = "Aborted by an operator"
+        method = (
+            "tpc_commit" if decision == TransactionState.COMMIT else "tpc_abort"
+        )
+        logger.warning(
+            f"Forcing {decision.value} of transaction {transaction_id}"
+        )
+        self.log.append(transaction_id, "FORCED", decision=decision.value)
+        acks = await self._call_all(
+            txn.participants,
+            method,
+            (transaction_id,),
+            self.decision_timeout,
+        )
+        if decision == TransactionState.COMMIT:
+            txn.state = TransactionState.COMPLETED
+        self.log.append(transaction_id, "COMPLETED")
+        return [
+            n for n in txn.participants if (acks.get(n) or {}).get("success")
+        ]
+
+    async def execute(
+        self,
+        operation: str,
+        payload: Dict,
+        participants: List[str],
+        transaction_id: Optional[str] = None,
+        on_decision: Optional[Callable[[CoordinatorTransaction], None]] = None,
+    ) -> CoordinatorTransaction:
+        """
+        Run an operation through both phases of 2PC.
+
+        If the PRECOMMIT round of the recovery extension fails on every
+        participant and their states don't settle the outcome, the
+        transaction is returned in doubt, neither committed nor aborted
+        here, and on_decision isn't called.
+
+        Args:
+            operation: Operation name registered on the participants
+            payload: Operation arguments (must be XML-RPC serializable)
+            participants: Node IDs of the participants
+            transaction_id: Optional ID to use instead of a new UUID
+            on_decision: Optional callback invoked once the outcome is
+                known, before phase 2 is sent to participants
+
+        Returns:
+            The finished CoordinatorTransaction
+        """
+        txn = CoordinatorTransaction(
+            transaction_id=transaction_id or str(uuid.uuid4()),
+            operation=operation,
+            payload=payload,
+            participants=list(participants),
+            votes={node_id: None for node_id in participants},
+        )
+        self._active[txn.transaction_id] = txn
+        try:
+            return await self._run(txn, on_decision)
+        finally:
+            self._active.pop(txn.transaction_id, None)
+
+    async def _run(
+        self,
+        txn: CoordinatorTransaction,
+        on_decision: Optional[Callable[[CoordinatorTransaction], None]],
+    ) -> CoordinatorTransaction:
+        """Drive a new transaction through both phases."""
+        operation = txn.operation
+        payload = txn.payload
+        participants = txn.participants
+        self.log.append(
+            txn.transaction_id,
+            "PREPARE",
+            operation=operation,
+            participants=txn.participants,
+        )
+        logger.info(
+            f"2PC PREPARE phase for {operation} transaction "
+            f"{txn.transaction_id} with {len(participants)} participants"
+        )
+        if self.faults is not None:
+            self.faults.crash_point(
+                COORDINATOR_BEFORE_PREPARE, txn.transaction_id
+            )
+
+        recoverable = bool(participants)
+        if participants:
+            sent = dict(payload, **{PARTICIPANTS_KEY: list(participants)})
+            results = await self._call_all(
+                participants,
+                "tpc_prepare",
+                (txn.transaction_id, operation, sent, self.node_id),
+                self.prepare_timeout,
+            )
+            for node_id in participants:
+                result = results.get(node_id)
+                if result is None:
+                    txn.votes[node_id] = VOTE_ABORT
+                    txn.abort_reason = (
+                        txn.abort_reason or f"Node {node_id} timed out"
+                    )
+                elif result.get("vote") != VOTE_READY:
+                    txn.votes[node_id] = VOTE_ABORT
+                    txn.abort_reason = txn.abort_reason or result.get(
+                        "reason", f"Node {node_id} voted ABORT"
+                    )
+                else:
+                    txn.votes[node_id] = VOTE_READY
+                recoverable = recoverable and bool(
+                    (result or {}).get("recovery")
+                )
+                self.log.append(
+                    txn.transaction_id,
+                    "VOTE",
+                    node_id=node_id,
+                    vote=txn.votes[node_id],
+                )
+
+        if recoverable and txn.abort_reason is None:
+            if not await self._precommit(txn):
+                return txn
+
+        if txn.abort_reason is None:
+            txn.state = TransactionState.COMMIT
+            method = "tpc_commit"
+        else:
+            txn.state = TransactionState.ROLLBACK
+            method = "tpc_abort"
+        self.log.append(
+            txn.transaction_id, txn.state.value, reason=txn.abort_reason
+        )
+        logger.info(
+            f"2PC {txn.state.value} phase for transaction "
+            f"{txn.transaction_id}"
+            + (f": {txn.abort_reason}" if txn.abort_reason else "")
+        )
+        if self.metrics is not None:
+            self.metrics.record_transaction(
+                operation, txn.state.value.lower()
+            )
+        audit(
+            self.audit_log,
+            self.node_id,
+            TRANSACTION_DECIDED,
+            txn.transaction_id,
+            operation=operation,
+            decision=txn.state.value,
+            reason=txn.abort_reason,
+            participants=list(participants),
+        )
+
+        if on_decision:
+            on_decision(txn)
+        if self.faults is not None:
+            self.faults.crash_point(
+                COORDINATOR_AFTER_DECISION, txn.transaction_id
+            )
+
+        if participants:
+            acks = await self._call_all(
+                participants,
+                method,
+                (txn.transaction_id,),
+                self.decision_timeout,
+            )
+            for node_id in participants:
+                if not (acks.get(node_id) or {}).get("success"):
+                    logger.warning(
+                        f"Node {node_id} did not acknowledge {method} for "
+                        f"transaction {txn.transaction_id}"
+                    )
+
+        if txn.state == TransactionState.COMMIT:
+            txn.state = TransactionState.COMPLETED
+        self.log.append(txn.transaction_id, "COMPLETED")
+        return txn
+
+    async def _precommit(self, txn: CoordinatorTransaction) -> bool:
+        """
+        Run the PRECOMMIT round of the recovery extension.
+
+        Returns:
+            False if the transaction was left in doubt, True once it may be
+            committed or txn.abort_reason says why it must abort
+        """
+        participants = txn.participants
+        acks = await self._call_all(
+            participants,
+            "tpc_precommit",
+            (txn.transaction_id,),
+            self.decision_timeout,
+        )
+        acked = [n for n in participants if (acks.get(n) or {}).get("success")]
+        self.log.append(txn.transaction_id, STATE_PRECOMMITTED, acked=acked)
+        if acked:
+            return True
+
+        # Nobody acknowledged: decide as a recovery coordinator would
+        results = await self._call_all(
+            participants,
+            "tpc_status",
+            (txn.transaction_id, self.node_id),
+            self.decision_timeout,
+        )
+        statuses = {
+            n: (results.get(n) or {}).get("state") for n in participants
+        }
+        decision = decide_outcome(statuses)
+        if decision == TransactionState.ROLLBACK:
+            txn.abort_reason = "No participant accepted PRECOMMIT"
+        if decision is not None:
+            return True
+        txn.in_doubt = True
+        self._in_doubt[txn.transaction_id] = txn
+        self.log.append(txn.transaction_id, "IN_DOUBT", statuses=statuses)
+        logger.warning(
+            f"Transaction {txn.transaction_id} is in doubt; leaving it to "
+            f"the participants' recovery"
+        )
+        return False
+
+    async def _call_all(
+        self,
+        participants: List[str],
+        method: str,
+        args: tuple,
+        timeout: float,
+    ) -> Dict[str, Optional[Dict]]:
+        """
+        Call an RPC on all participants in parallel.
+
+        Returns:
+            Maps node_id to the call result, or None if the call failed
+            or did not finish within the timeout
+        """
+        results: Dict[str, Optional[Dict]] = {}
+
+        def call(node_id: str) -> tuple:
+            """Call the method on a single participant."""
+            try:
+                return node_id, self.peer_registry.call_peer(
+                    node_id, method, *args, timeout=timeout
+                )
+            except Exception as e:
+                logger.error(f"Failed to send {method} to {node_id}: {e}")
+                return node_id, None
+
+        loop = asyncio.get_running_loop()
+        executor = ThreadPoolExecutor(max_workers=len(participants))
+        futures = [
+            loop.run_in_executor(
+                executor, contextvars.copy_context().run, call, node_id
+            )
+            for node_id in participants
+        ]
+        try:
+            done, _ = await asyncio.wait(futures, timeout=timeout)
+            for future in done:
+                node_id, result = future.result()
+                results[node_id] = result
+        finally:
+            executor.shutdown(wait=False)
+
+        for node_id in participants:
+            if node_id not in results:
+                logger.warning(f"{method} timed out for node {node_id}")
+                results.setdefault(node_id, None)
+        return results
@@ -0,0 +1,451 @@
+"""
+Distributed Tracing
+
+Records spans in the OpenTelemetry data model and exports them to an
+OTLP/HTTP collector (JSON encoding), using the standard library so nodes
+need no OpenTelemetry packages.
+
+A client send_message produces one trace across the nodes it reaches:
+
+- "ws send_message" (server) on the node the client is connected to
+- "NodeService/forward_message" (client, then server on the admin node);
+  every XML-RPC call gets such a pair of spans
+- "fan_out" on the admin node, with a receive_message_broadcast call to
+  each peer
+- "deliver" on each node that sends the message to its local clients
+
+The current span is held in a context variable. XML-RPC calls send it in
+a W3C traceparent header (see log_context.py) and the receiving node's
+spans become its children.
+
+Tracing is off until configure_tracing installs an exporter; until then
+start_span records nothing.
+"""
+
+import json
+import logging
+import random
+import secrets
+import threading
+import time
+import urllib.request
+from collections import deque
+from contextlib import contextmanager
+from contextvars import ContextVar
+from dataclasses import dataclass, field
+from typing import Any, Dict, Iterator, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Tracing configuration
+DEFAULT_SERVICE_NAME = "chat-node"
+EXPORT_INTERVAL = 5  # seconds between exports of finished spans
+EXPORT_BATCH_SIZE = 256  # spans per export request
+EXPORT_TIMEOUT = 5  # seconds to wait for the collector
+MAX_QUEUED_SPANS = 2048  # older spans are dropped when the queue is full
+TRACES_PATH = "/v1/traces"
+
+# HTTP header carrying the trace context on XML-RPC calls
+TRACEPARENT_HEADER = "traceparent"
+
+# Span kinds (values of the OTLP SpanKind enum)
+INTERNAL = 1
+SERVER = 2
+CLIENT = 3
+
+# Span status codes (values of the OTLP StatusCode enum)
+STATUS_UNSET = 0
+STATUS_OK = 1
+STATUS_ERROR = 2
+
+
+@dataclass(frozen=True)
+class SpanContext:
+    """
+    The part of a span that is propagated to other nodes.
+
+    Attributes:
+        trace_id: 32 hex digits shared by every span of a trace
+        span_id: 16 hex digits identifying the span
+        sampled: Whether spans of the trace are exported
+    """
+
+    trace_id: str
+    span_id: str
+    sampled: bool = True
+
+    def to_traceparent(self) -> str:
+        """Format the context as a W3C traceparent header value."""
+        flags = "01" if self.sampled else "00"
+        return f"00-{self.trace_id}-{self.span_id}-{flags}"
+
+    @classmethod
+    def from_traceparent(cls, value: Optional[str]) -> Optional["SpanContext"]:
+        """
+        Parse a W3C traceparent header value.
+
+        Args:
+            value: The header value, or None
+
+        Returns:
+            The remote span context, or None if the value is malformed
+        """
+        parts = (value or "").strip().split("-")
+        if len(parts) != 4 or parts[0] != "00":
+            return None
+        _, trace_id, span_id, flags = parts
+        if len(trace_id) != 32 or len(span_id) != 16 or len(flags) != 2:
+            return None
+        try:
+            valid = int(trace_id, 16) and int(span_id, 16)
+            sampled = bool(int(flags, 16) & 1)
+        except ValueError:
+            return None
+        if not valid:
+            return None
+        return cls(trace_id, span_id, sampled)
+
+
+@dataclass
+class Span:
+    """
+    A timed operation within a trace.
+
+    Attributes:
+        name: Operation name (e.g., "NodeService/forward_message")
+        context: The span's trace and span IDs
+        parent_span_id: Span ID of the parent ("" for a trace's root)
+        kind: INTERNAL, SERVER or CLIENT
+        start_time: UNIX time the span started, in nanoseconds
+        end_time: UNIX time the span ended, in nanoseconds (0 if running)
+        attributes: Key/value details of the operation
+        status: STATUS_UNSET, STATUS_OK or STATUS_ERROR
+        status_message: Description of the error, if any
+    """
+
+    name: str
+    context: SpanContext
+    parent_span_id: str = ""
+    kind: int = INTERNAL
+    start_time: int = 0
+    end_time: int = 0
+    attributes: Dict[str, Any] = field(default_factory=dict)
+    status: int = STATUS_UNSET
+    status_message: str = ""
+
+    def set_attribute(self, key: str, value: Any) -> None:
+        """Set an attribute, ignoring empty values."""
+        if value is not None and value != "":
+            self.attributes[key] = value
+
+    def set_error(self, message: str) -> None:
+        """Mark the span as failed."""
+        self.status = STATUS_ERROR
+        self.status_message = message
+
+    def to_otlp(self) -> Dict[str, Any]:
+        """Convert to a span of an OTLP/JSON export request."""
+        span = {
+            "traceId": self.context.trace_id,
+            "spanId": self.context.span_id,
+            "name": self.name,
+            "kind": self.kind,
+            "startTimeUnixNano": str(self.start_time),
+            "endTimeUnixNano": str(self.end_time),
+            "attributes": _otlp_attributes(self.attributes),
+            "status": {"code": self.status},
+        }
+        if self.parent_span_id:
+            span["parentSpanId"] = self.parent_span_id
+        if self.status_message:
+            span["status"]["message"] = self.status_message
+        return span
+
+
+def _otlp_attributes(attributes: Dict[str, Any]) -> List[Dict[str, Any]]:
+    """Convert attributes to OTLP key/value pairs."""
+    converted = []
+    for key, value in attributes.items():
+        if isinstance(value, bool):
+            typed = {"boolValue": value}
+        elif isinstance(value, int):
+            typed = {"intValue": str(value)}
+        elif isinstance(value, float):
+            typed = {"doubleValue": value}
+        else:
+            typed = {"stringValue": str(value)}
+        converted.append({"key": key, "value": typed})
+    return converted
+
+
+# Context of the span that new spans become children of
+_current_context = ContextVar("current_span_context", default=None)
+
+
+def current_span_context() -> Optional[SpanContext]:
+    """Get the context of the current span, if any."""
+    return _current_context.get()
+
+
+def traceparent_headers() -> Dict[str, str]:
+    """Get the HTTP headers that carry the current trace context."""
+    context = _current_context.get()
+    if context is None:
+        return {}
+    return {TRACEPARENT_HEADER: context.to_traceparent()}
+
+
+@contextmanager
+def remote_parent(traceparent: Optional[str]) -> Iterator[None]:
+    """
+    Make spans started inside the block children of a remote span.
+
+    Args:
+        traceparent: The traceparent header of an incoming call, or None
+    """
+    context = SpanContext.from_traceparent(traceparent)
+    if context is None:
+        yield
+        return
+    token = _current_context.set(context)
+    try:
+        yield
+    finally:
+        _current_context.reset(token)
+
+
+class Tracer:
+    """
+    Creates spans and hands finished, sampled spans to an exporter.
+    """
+
+    def __init__(self, exporter=None, sample_ratio: float = 1.0):
+        """
+        Initialize the tracer.
+
+        Args:
+            exporter: Object with an export(span) method; None turns
+                tracing off
+            sample_ratio: Share of new traces that are exported; traces
+                started on another node keep that node's decision
+        """
+        self.exporter = exporter
+        self.sample_ratio = sample_ratio
+
+    @property
+    def enabled(self) -> bool:
+        """Whether spans are recorded."""
+        return self.exporter is not None
+
+    @contextmanager
+    def start_span(
+        self,
+        name: str,
+        kind: int = INTERNAL,
+        attributes: Optional[Dict[str, Any]] = None,
+    ) -> Iterator[Optional[Span]]:
+        """
+        Record a span around the block, as a child of the current span.
+
+        An exception raised in the block marks the span as failed.
+
+        Args:
+            name: Operation name
+            kind: INTERNAL, SERVER or CLIENT
+            attributes: Initial attributes; empty values are left out
+
+        Yields:
+            The span, or None if tracing is off
+        """
+        if not self.enabled:
+            yield None
+            return
+
+        parent = _current_context.get()
+        if parent is None:
+            trace_id = secrets.token_hex(16)
+            sampled = random.random() < self.sample_ratio
+        else:
+            trace_id = parent.trace_id
+            sampled = parent.sampled
+        span = Span(
+            name=name,
+            context=SpanContext(trace_id, secrets.token_hex(8), sampled),
+            parent_span_id=parent.span_id if parent else "",
+            kind=kind,
+            start_time=time.time_ns(),
+        )
+        for key, value in (attributes or {}).items():
+            span.set_attribute(key, value)
+
+        token = _current_context.set(span.context)
+        try:
+            yield span
+        except Exception as e:
+            span.set_error(f"{type(e).__name__}: {e}")
+            raise
+        finally:
+            _current_context.reset(token)
+            span.end_time = time.time_ns()
+            if sampled:
+                try:
+                    self.exporter.export(span)
+                except Exception as e:
+                    logger.debug(f"Error exporting span {name}: {e}")
+
+
+class OTLPExporter:
+    """
+    Batches finished spans and posts them to an OTLP/HTTP collector.
+    """
+
+    def __init__(
+        self,
+        endpoint: str,
+        service_name: str = DEFAULT_SERVICE_NAME,
+        node_id: str = "",
+        interval: float = EXPORT_INTERVAL,
+        batch_size: int = EXPORT_BATCH_SIZE,
+        timeout: float = EXPORT_TIMEOUT,
+    ):
+        """
+        Initialize the exporter.
+
+        Args:
+            endpoint: Base URL of the collector (e.g.,
+                "http://collector:4318"); /v1/traces is appended
+            service_name: service.name of the exported spans
+            node_id: ID of this node, exported as service.instance.id
+            interval: Seconds between exports
+            batch_size: Queued spans that trigger an early export
+            timeout: Seconds to wait for the collector
+        """
+        self.url = endpoint.rstrip("/")
+        if not self.url.endswith(TRACES_PATH):
+            self.url += TRACES_PATH
+        self.resource = {"service.name": service_name}
+        if node_id:
+            self.resource["service.instance.id"] = node_id
+        self.interval = interval
+        self.batch_size = batch_size
+        self.timeout = timeout
+        self._queue: deque = deque(maxlen=MAX_QUEUED_SPANS)
+        self._wake = threading.Event()
+        self._stopped = threading.Event()
+        self._thread: Optional[threading.Thread] = None
+
+    def export(self, span: Span) -> None:
+        """Queue a finished span for the next export."""
+        self._queue.append(span)
+        if len(self._queue) >= self.batch_size:
+            self._wake.set()
+
+    def start(self) -> None:
+        """Start exporting in a background thread."""
+        self._thread = threading.Thread(
+            target=self._run, name="otlp-exporter", daemon=True
+        )
+        self._thread.start()
+        logger.info(f"Exporting traces to {self.url}")
+
+    def _run(self) -> None:
+        """Export queued spans until stopped."""
+        while not self._stopped.is_set():
+            self._wake.wait(self.interval)
+            self._wake.clear()
+            self.flush()
+
+    def flush(self) -> int:
+        """
+        Post every queued span to the collector.
+
+        Spans of a failed export are dropped.
+
+        Returns:
+            Number of spans exported
+        """
+        exported = 0
+        while self._queue:
+            batch = []
+            while self._queue and len(batch) < self.batch_size:
+                batch.append(self._queue.popleft())
+            try:
+                self._post(batch)
+                exported += len(batch)
+            except Exception as e:
+                logger.warning(
+                    f"Failed to export {len(batch)} spans to {self.url}: {e}"
+                )
+        return exported
+
+    def encode(self, spans: List[Span]) -> Dict[str, Any]:
+        """Build an OTLP/JSON export request for spans."""
+        return {
+            "resourceSpans": [
+                {
+                    "resource": {
+                        "attributes": _otlp_attributes(self.resource)
+                    },
+                    "scopeSpans": [
+                        {
+                            "scope": {"name": __name__},
+                            "spans": [span.to_otlp() for span in spans],
+                        }
+                    ],
+                }
+            ]
+        }
+
+    def _post(self, spans: List[Span]) -> None:
+        """Send one export request."""
+        request = urllib.request.Request(
+            self.url,
+            data=json.dumps(self.encode(spans)).encode(),
+            headers={"Content-Type": "application/json"},
+            method="POST",
+        )
+        with urllib.request.urlopen(request, timeout=self.timeout):
+            pass
+
+    def shutdown(self) -> None:
+        """Stop the background thread and export the remaining spans."""
+        self._stopped.set()
+        self._wake.set()
+        if self._thread:
+            self._thread.join(timeout=self.timeout)
+        self.flush()
+
+
+# The tracer used by start_span
+_tracer = Tracer()
+
+
+def configure_tracing(exporter=None, sample_ratio: float = 1.0) -> Tracer:
+    """
+    Install the tracer used by every node component.
+
+    Args:
+        exporter: Span exporter (e.g., OTLPExporter); None turns tracing
+            off
+        sample_ratio: Share of new traces that are exported
+
+    Returns:
+        The installed tracer
+    """
+    global _tracer
+    _tracer = Tracer(exporter, sample_ratio)
+    return _tracer
+
+
+def get_tracer() -> Tracer:
+    """Get the installed tracer."""
+    return _tracer
+
+
+def start_span(
+    name: str,
+    kind: int = INTERNAL,
+    attributes: Optional[Dict[str, Any]] = None,
+):
+    """Record a span with the installed tracer (see Tracer.start_span)."""
+    return _tracer.start_span(name, kind, attributes)
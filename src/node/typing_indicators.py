@@ -0,0 +1,87 @@
+"""
+Typing Indicators
+
+Clients send typing (with typing true while the user types, false when
+they stop) to their node, which fans a typing event out to the room's
+clients on this node and to every peer node, whose clients in the room get
+it too. Typing events are ephemeral: they are never written to the message
+log, buffered for offline users or replicated.
+
+To keep the fan-out cheap, each node passes on at most one "started"
+event per user and room every TYPING_THROTTLE seconds. Every event says
+how long it lasts (expires_in); clients hide the indicator when it
+expires without a refresh, so a user who disconnects mid-sentence doesn't
+stay "typing" forever. A "stopped" event is only sent for an indicator
+that hasn't expired yet.
+"""
+
+import threading
+import time
+from typing import Callable, Dict, Tuple
+
+# Typing indicator configuration
+TYPING_THROTTLE = 3.0  # seconds between typing events of a user in a room
+TYPING_TIMEOUT = 6.0  # seconds a typing indicator lasts without a refresh
+
+
+class TypingThrottle:
+    """
+    Thread-safe record of when each user's typing was last announced.
+    """
+
+    def __init__(
+        self,
+        interval: float = TYPING_THROTTLE,
+        timeout: float = TYPING_TIMEOUT,
+        clock: Callable[[], float] = time.monotonic,
+    ):
+        """
+        Initialize the throttle.
+
+        Args:
+            interval: Seconds between announcements of a user in a room
+            timeout: Seconds after which an announcement has expired
+            clock: Function returning the current time in seconds
+        """
+        self.interval = interval
+        self.timeout = timeout
+        self.clock = clock
+        # Maps (room_id, username) -> time typing was last announced
+        self._announced: Dict[Tuple[str, str], float] = {}
+        self._lock = threading.Lock()
+
+    def allow(self, room_id: str, username: str, typing: bool) -> bool:
+        """
+        Decide whether a typing update should be announced.
+
+        Args:
+            room_id: The room ID
+            username: The user typing
+            typing: True if the user is typing, False if they stopped
+
+        Returns:
+            bool: True if the update should be fanned out
+        """
+        now = self.clock()
+        key = (room_id, username)
+        with self._lock:
+            self._expire(now)
+            if not typing:
+                return self._announced.pop(key, None) is not None
+            last = self._announced.get(key)
+            if last is not None and now - last < self.interval:
+                return False
+            self._announced[key] = now
+            return True
+
+    def active_count(self) -> int:
+        """Get the number of typing indicators that haven't expired."""
+        with self._lock:
+            self._expire(self.clock())
+            return len(self._announced)
+
+    def _expire(self, now: float) -> None:
+        """Drop announcements that have expired (lock held)."""
+        for key, announced in list(self._announced.items()):
+            if now - announced >= self.timeout:
+                del self._announced[key]
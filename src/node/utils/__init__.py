@@ -6,10 +6,26 @@ like broadcasting, validation, and peer communication.
 """
 
 from .broadcast import broadcast_to_peers, broadcast_message_to_peers
-from .validation import validate_message_content
+from .validation import (
+    parse_client_request,
+    validate_message_content,
+    validate_message_id,
+    validate_request_fields,
+    validate_room_id,
+    validate_room_name,
+    validate_rpc_params,
+    validate_username,
+)
 
 __all__ = [
     "broadcast_to_peers",
     "broadcast_message_to_peers",
+    "parse_client_request",
     "validate_message_content",
+    "validate_message_id",
+    "validate_request_fields",
+    "validate_room_id",
+    "validate_room_name",
+    "validate_rpc_params",
+    "validate_username",
 ]
@@ -6,10 +6,16 @@ Contains utility functions for broadcasting messages and events to peer nodes.
 
 import logging
 from typing import Dict, Any, Optional
-from xmlrpc.client import ServerProxy
+
+from ..log_context import ServerProxy
+from ..tracing import start_span
 
 logger = logging.getLogger(__name__)
 
+# Retries of a message broadcast to a peer after a failed call (receivers
+# ignore message IDs they already delivered, so retries are safe)
+BROADCAST_RETRIES = 1
+
 
 def broadcast_to_peers(
     peer_registry,
@@ -55,6 +61,7 @@ def broadcast_message_to_peers(
     peer_registry,
     room_id: str,
     message_data: Dict[str, Any],
+    retries: int = BROADCAST_RETRIES,
 ):
     """
     Broadcast a message to all peer nodes via XML-RPC.
@@ -63,15 +70,26 @@ def broadcast_message_to_peers(
         peer_registry: PeerRegistry instance for getting peer addresses
         room_id: The room ID for the message
         message_data: Message data to broadcast
+        retries: Times a failed call to a peer is retried
     """
     if not peer_registry:
         return
 
     peers = peer_registry.list_peers()
-    for peer_node_id, peer_addr in peers.items():
-        try:
-            proxy = ServerProxy(peer_addr, allow_none=True)
-            proxy.receive_message_broadcast(room_id, message_data)
-            logger.debug(f"Broadcasted message to peer {peer_node_id}")
-        except Exception as e:
-            logger.error(f"Failed to broadcast message to {peer_node_id}: {e}")
+    attributes = {"chat.room_id": room_id, "chat.peer_count": len(peers)}
+    with start_span("fan_out", attributes=attributes):
+        for peer_node_id, peer_addr in peers.items():
+            for attempt in range(retries + 1):
+                try:
+                    proxy = ServerProxy(peer_addr, allow_none=True)
+                    proxy.receive_message_broadcast(room_id, message_data)
+                    logger.debug(
+                        f"Broadcasted message to peer {peer_node_id}"
+                    )
+                    break
+                except Exception as e:
+                    if attempt < retries:
+                        continue
+                    logger.error(
+                        f"Failed to broadcast message to {peer_node_id}: {e}"
+                    )
@@ -2,12 +2,292 @@
 Validation Utilities
 
 Contains utility functions for validating message content and other inputs.
+
+Every client message is checked before it reaches its handler: its size,
+UTF-8 encoding and JSON structure (parse_client_request), then the fields
+its command requires and the format of the room IDs and usernames it
+names (validate_request_fields). The fields each command requires and
+the JSON types of its fields come from the message catalog
+(schemas/catalog.py). Problems are reported as a dict with an "error",
+an "error_code" and the "field" at fault, which the WebSocket server
+sends back as the command's usual error response.
 """
 
-from typing import Tuple, Optional
+import inspect
+import json
+import re
+from typing import Any, Dict, Optional, Tuple, Union
+
+from ..schemas.catalog import COMMAND_CATALOG, JSON_TYPES, required_fields
 
 # Message validation constants
 MAX_MESSAGE_LENGTH = 5000
+MAX_MESSAGE_ID_LENGTH = 64
+
+# Room validation constants
+MAX_ROOM_NAME_LENGTH = 100
+
+# Payload limits, in bytes
+MAX_PAYLOAD_SIZE = 64 * 1024  # per client WebSocket message
+MAX_RPC_PAYLOAD_SIZE = 16 * 1024 * 1024  # per XML-RPC request body
+
+# ID formats
+MAX_ID_LENGTH = 64
+ROOM_ID_PATTERN = re.compile(r"^[A-Za-z0-9_.:-]+$")
+USERNAME_PATTERN = re.compile(r"^[^\s\x00-\x1f\x7f]+$")
+
+# Validation error codes
+PAYLOAD_TOO_LARGE = "PAYLOAD_TOO_LARGE"
+INVALID_UTF8 = "INVALID_UTF8"
+INVALID_JSON = "INVALID_JSON"
+INVALID_REQUEST = "INVALID_REQUEST"
+INVALID_ROOM_ID = "INVALID_ROOM_ID"
+INVALID_USERNAME = "INVALID_USERNAME"
+
+# Fields every command needs, as non-empty strings (message content is
+# checked by validate_message_content)
+REQUIRED_FIELDS: Dict[str, Tuple[str, ...]] = required_fields()
+
+# Fields that must be strings whenever present
+STRING_FIELDS = ("content", "message_id", "room_name", "status")
+
+# Fields holding a room ID or a username, checked whenever present
+ROOM_ID_FIELDS = ("room_id",)
+USERNAME_FIELDS = ("username", "creator_id", "target", "invitee", "recipient")
+
+
+def validation_error(
+    error: str, error_code: str, field: Optional[str] = None
+) -> Dict[str, Any]:
+    """
+    Describe a validation failure.
+
+    Args:
+        error: Error message
+        error_code: One of the validation error codes
+        field: Request field at fault, if any
+
+    Returns:
+        dict: The error, error_code and field
+    """
+    return {"error": error, "error_code": error_code, "field": field}
+
+
+def parse_client_request(
+    message: Union[str, bytes], max_size: int = MAX_PAYLOAD_SIZE
+) -> Tuple[Optional[Dict[str, Any]], Optional[Dict[str, Any]]]:
+    """
+    Parse a client WebSocket message, checking its size and structure.
+
+    Args:
+        message: The message as received (text or binary frame)
+        max_size: Largest accepted message, in bytes
+
+    Returns:
+        tuple: (request, error)
+            - request: The parsed message if valid, None otherwise
+            - error: validation_error dict if invalid, None if valid
+    """
+    if isinstance(message, str):
+        try:
+            raw = message.encode("utf-8")
+        except UnicodeEncodeError:
+            return None, validation_error(
+                "Message is not valid UTF-8", INVALID_UTF8
+            )
+    else:
+        raw = bytes(message)
+    if len(raw) > max_size:
+        return None, validation_error(
+            f"Message too large ({len(raw)} bytes, max {max_size})",
+            PAYLOAD_TOO_LARGE,
+        )
+
+    try:
+        text = raw.decode("utf-8")
+    except UnicodeDecodeError:
+        return None, validation_error(
+            "Message is not valid UTF-8", INVALID_UTF8
+        )
+    try:
+        request = json.loads(text)
+    except ValueError:
+        return None, validation_error("Invalid JSON format", INVALID_JSON)
+    if not _is_encodable(request):
+        # JSON escapes can spell out lone surrogates
+        return None, validation_error(
+            "Message contains invalid Unicode characters", INVALID_UTF8
+        )
+
+    if not isinstance(request, dict):
+        return None, validation_error(
+            "Message must be a JSON object", INVALID_REQUEST
+        )
+    if not isinstance(request.get("type"), str) or not request["type"]:
+        return None, validation_error(
+            "Message needs a type", INVALID_REQUEST, "type"
+        )
+    if not isinstance(request.get("data", {}), dict):
+        return None, validation_error(
+            "Message data must be an object", INVALID_REQUEST, "data"
+        )
+    return request, None
+
+
+def _is_encodable(value: Any) -> bool:
+    """Check that every string in a parsed JSON value is valid UTF-8."""
+    if isinstance(value, str):
+        try:
+            value.encode("utf-8")
+        except UnicodeEncodeError:
+            return False
+        return True
+    if isinstance(value, dict):
+        return all(
+            _is_encodable(k) and _is_encodable(v) for k, v in value.items()
+        )
+    if isinstance(value, list):
+        return all(_is_encodable(item) for item in value)
+    return True
+
+
+def validate_request_fields(request: Dict[str, Any]) -> Optional[Dict]:
+    """
+    Check a parsed client message's fields for its command.
+
+    Args:
+        request: Message returned by parse_client_request
+
+    Returns:
+        validation_error dict if a field is missing or malformed, None if
+        the message is valid
+    """
+    data = request.get("data") or {}
+    for name in REQUIRED_FIELDS.get(request["type"], ()):
+        value = data.get(name)
+        if not isinstance(value, str) or not value.strip():
+            return validation_error(
+                f"Missing or invalid field: {name}", INVALID_REQUEST, name
+            )
+    for name in STRING_FIELDS:
+        if data.get(name) is not None and not isinstance(data[name], str):
+            return validation_error(
+                f"Field {name} must be a string", INVALID_REQUEST, name
+            )
+    spec = COMMAND_CATALOG.get(request["type"])
+    for name, json_type in (spec.fields if spec else {}).items():
+        value = data.get(name)
+        if json_type and value is not None and not _has_type(value, json_type):
+            return validation_error(
+                f"Field {name} must be of type {json_type}",
+                INVALID_REQUEST,
+                name,
+            )
+
+    for name in ROOM_ID_FIELDS:
+        if data.get(name) is not None:
+            is_valid, error_msg = validate_room_id(data[name])
+            if not is_valid:
+                return validation_error(error_msg, INVALID_ROOM_ID, name)
+    usernames = [(name, data.get(name)) for name in USERNAME_FIELDS]
+    if isinstance(data.get("usernames"), list):
+        usernames.extend(("usernames", name) for name in data["usernames"])
+    for name, value in usernames:
+        if value is not None:
+            is_valid, error_msg = validate_username(value)
+            if not is_valid:
+                return validation_error(error_msg, INVALID_USERNAME, name)
+    return None
+
+
+def _has_type(value: Any, json_type: str) -> bool:
+    """Check that a parsed JSON value has a JSON type."""
+    if isinstance(value, bool) and json_type != "boolean":
+        return False
+    return isinstance(value, JSON_TYPES[json_type])
+
+
+def validate_rpc_params(func, params: tuple) -> Optional[Dict[str, Any]]:
+    """
+    Check the room IDs and usernames passed to an XML-RPC method.
+
+    Parameters are matched to the method's argument names; string
+    arguments named like ROOM_ID_FIELDS or USERNAME_FIELDS are checked.
+
+    Args:
+        func: The registered method
+        params: The call's positional parameters
+
+    Returns:
+        validation_error dict if an argument is malformed, None otherwise
+        (including when the parameters don't fit the method)
+    """
+    try:
+        arguments = inspect.signature(func).bind_partial(*params).arguments
+    except (TypeError, ValueError):
+        return None
+    for name, value in arguments.items():
+        if not isinstance(value, str):
+            continue
+        if name in ROOM_ID_FIELDS:
+            is_valid, error_msg = validate_room_id(value)
+            if not is_valid:
+                return validation_error(error_msg, INVALID_ROOM_ID, name)
+        elif name in USERNAME_FIELDS:
+            is_valid, error_msg = validate_username(value)
+            if not is_valid:
+                return validation_error(error_msg, INVALID_USERNAME, name)
+    return None
+
+
+def validate_room_id(room_id: str) -> Tuple[bool, Optional[str]]:
+    """
+    Validate the format of a room ID.
+
+    Args:
+        room_id: The room ID to validate
+
+    Returns:
+        tuple: (is_valid, error_message)
+            - is_valid: True if the ID is valid, False otherwise
+            - error_message: Error message if invalid, None if valid
+    """
+    if not isinstance(room_id, str) or not room_id:
+        return False, "Room ID cannot be empty"
+
+    if len(room_id) > MAX_ID_LENGTH or not ROOM_ID_PATTERN.match(room_id):
+        return (
+            False,
+            f"Invalid room ID (up to {MAX_ID_LENGTH} letters, digits "
+            f"and _.:-)",
+        )
+
+    return True, None
+
+
+def validate_username(username: str) -> Tuple[bool, Optional[str]]:
+    """
+    Validate the format of a username.
+
+    Args:
+        username: The username to validate
+
+    Returns:
+        tuple: (is_valid, error_message)
+            - is_valid: True if the username is valid, False otherwise
+            - error_message: Error message if invalid, None if valid
+    """
+    if not isinstance(username, str) or not username:
+        return False, "Username cannot be empty"
+
+    if len(username) > MAX_ID_LENGTH or not USERNAME_PATTERN.match(username):
+        return (
+            False,
+            f"Invalid username (up to {MAX_ID_LENGTH} characters, no "
+            f"spaces or control characters)",
+        )
+
+    return True, None
 
 
 def validate_message_content(content: str) -> Tuple[bool, Optional[str]]:
@@ -32,3 +312,51 @@ def validate_message_content(content: str) -> Tuple[bool, Optional[str]]:
         )
 
     return True, None
+
+
+def validate_message_id(message_id: str) -> Tuple[bool, Optional[str]]:
+    """
+    Validate a message ID chosen by the sender.
+
+    Args:
+        message_id: The message ID to validate
+
+    Returns:
+        tuple: (is_valid, error_message)
+            - is_valid: True if the ID is valid, False otherwise
+            - error_message: Error message if invalid, None if valid
+    """
+    if not isinstance(message_id, str) or not message_id.strip():
+        return False, "Message ID cannot be empty"
+
+    if len(message_id) > MAX_MESSAGE_ID_LENGTH:
+        return (
+            False,
+            f"Message ID too long (max {MAX_MESSAGE_ID_LENGTH} characters)",
+        )
+
+    return True, None
+
+
+def validate_room_name(room_name: str) -> Tuple[bool, Optional[str]]:
+    """
+    Validate a room name.
+
+    Args:
+        room_name: The room name to validate
+
+    Returns:
+        tuple: (is_valid, error_message)
+            - is_valid: True if the name is valid, False otherwise
+            - error_message: Error message if invalid, None if valid
+    """
+    if not isinstance(room_name, str) or not room_name.strip():
+        return False, "Room name cannot be empty"
+
+    if len(room_name.strip()) > MAX_ROOM_NAME_LENGTH:
+        return (
+            False,
+            f"Room name too long (max {MAX_ROOM_NAME_LENGTH} characters)",
+        )
+
+    return True, None
@@ -0,0 +1,296 @@
+"""
+Vector Clocks and Causal Delivery
+
+Chat messages carry a vector clock mapping node IDs to counters. The room
+administrator stamps each message, incrementing the entry for the node the
+sender is connected to (the message's origin node).
+
+Nodes receiving relayed messages pass them through a CausalBuffer, which
+holds back any message whose causal dependencies have not been delivered
+yet and releases it, in causal order, once they have.
+"""
+
+import logging
+import threading
+import time
+from typing import Dict, List, Optional
+
+logger = logging.getLogger(__name__)
+
+# Seconds a message may wait for missing dependencies before it is
+# released anyway (the missing message is assumed lost)
+CAUSAL_DELIVERY_TIMEOUT = 5
+
+# Maximum number of messages held back per room
+MAX_BUFFERED_MESSAGES = 100
+
+
+class VectorClock:
+    """
+    A vector clock: a counter per node.
+
+    Missing entries are treated as zero.
+    """
+
+    def __init__(self, clock: Optional[Dict[str, int]] = None):
+        """
+        Initialize the clock.
+
+        Args:
+            clock: Optional initial counters as {node_id: counter}
+        """
+        self._clock: Dict[str, int] = {
+            node_id: int(counter)
+            for node_id, counter in (clock or {}).items()
+            if int(counter) > 0
+        }
+
+    def get(self, node_id: str) -> int:
+        """Get the counter for a node."""
+        return self._clock.get(node_id, 0)
+
+    def increment(self, node_id: str) -> "VectorClock":
+        """
+        Increment the counter for a node.
+
+        Args:
+            node_id: The node whose counter to increment
+
+        Returns:
+            self, for chaining
+        """
+        self._clock[node_id] = self.get(node_id) + 1
+        return self
+
+    def merge(self, other: "VectorClock") -> "VectorClock":
+        """
+        Merge another clock into this one (element-wise maximum).
+
+        Args:
+            other: The clock to merge
+
+        Returns:
+            self, for chaining
+        """
+        for node_id, counter in other._clock.items():
+            if counter > self.get(node_id):
+                self._clock[node_id] = counter
+        return self
+
+    def copy(self) -> "VectorClock":
+        """Return an independent copy of the clock."""
+        return VectorClock(self._clock)
+
+    def happened_before(self, other: "VectorClock") -> bool:
+        """Check if this clock is causally before another clock."""
+        return self <= other and self != other
+
+    def concurrent_with(self, other: "VectorClock") -> bool:
+        """Check if neither clock is causally before the other."""
+        return not (self <= other) and not (other <= self)
+
+    def to_dict(self) -> Dict[str, int]:
+        """Convert to dictionary for serialization."""
+        return dict(self._clock)
+
+    @classmethod
+    def from_dict(cls, data: Optional[Dict[str, int]]) -> "VectorClock":
+        """Create a clock from a serialized dictionary."""
+        return cls(data)
+
+    def __le__(self, other: "VectorClock") -> bool:
+        """Check if every counter is <= the other clock's counter."""
+        return all(
+            counter <= other.get(node_id)
+            for node_id, counter in self._clock.items()
+        )
+
+    def __eq__(self, other) -> bool:
+        """Check if two clocks have the same counters."""
+        if not isinstance(other, VectorClock):
+            return NotImplemented
+        return self._clock == other._clock
+
+    def __repr__(self) -> str:
+        """Return a readable representation of the clock."""
+        return f"VectorClock({self._clock})"
+
+
+class CausalBuffer:
+    """
+    Per-room buffer that releases messages in causal order.
+
+    A message from origin node j with clock V is deliverable once the
+    room's delivered clock D satisfies V[j] == D[j] + 1 and V[k] <= D[k]
+    for every other node k. Messages without a vector clock are released
+    immediately.
+    """
+
+    def __init__(
+        self,
+        delivery_timeout: float = CAUSAL_DELIVERY_TIMEOUT,
+        max_buffered: int = MAX_BUFFERED_MESSAGES,
+    ):
+        """
+        Initialize the buffer.
+
+        Args:
+            delivery_timeout: Seconds to hold a message before releasing
+                it despite missing dependencies
+            max_buffered: Maximum number of held messages per room
+        """
+        self.delivery_timeout = delivery_timeout
+        self.max_buffered = max_buffered
+        self._lock = threading.Lock()
+        self._delivered: Dict[str, VectorClock] = {}
+        # Maps room_id -> list of (received_at, message)
+        self._pending: Dict[str, List[tuple]] = {}
+
+    def seed(self, room_id: str, clock: Dict[str, int]) -> None:
+        """
+        Mark messages up to a clock as delivered, e.g. after joining a room.
+
+        The delivered clock only moves forward, and any held messages that
+        become deliverable stay queued until the next receive().
+
+        Args:
+            room_id: The room ID
+            clock: The room's clock as of the last message already shown
+        """
+        with self._lock:
+            delivered = self._delivered.setdefault(room_id, VectorClock())
+            delivered.merge(VectorClock.from_dict(clock))
+
+    def delivered_clock(self, room_id: str) -> Dict[str, int]:
+        """Get the clock of the messages delivered so far in a room."""
+        with self._lock:
+            return self._delivered.get(room_id, VectorClock()).to_dict()
+
+    def pending_count(self, room_id: str) -> int:
+        """Get the number of messages held back for a room."""
+        with self._lock:
+            return len(self._pending.get(room_id, []))
+
+    def forget(self, room_id: str) -> None:
+        """Drop all state for a room (e.g., after it is deleted)."""
+        with self._lock:
+            self._delivered.pop(room_id, None)
+            self._pending.pop(room_id, None)
+
+    def receive(self, room_id: str, message: Dict) -> List[Dict]:
+        """
+        Accept a message and return every message now deliverable.
+
+        Args:
+            room_id: The room ID
+            message: Message data with 'vector_clock' and 'origin_node'
+
+        Returns:
+            Messages to deliver to clients, in causal order. Empty if the
+            message is held back or is a duplicate.
+        """
+        raw_clock = message.get("vector_clock")
+        origin = message.get("origin_node")
+        if not raw_clock or not origin:
+            return [message]
+
+        with self._lock:
+            clock = VectorClock.from_dict(raw_clock)
+            if room_id not in self._delivered:
+                # First message seen for this room: it defines the baseline
+                baseline = dict(raw_clock, **{origin: clock.get(origin) - 1})
+                self._delivered[room_id] = VectorClock.from_dict(baseline)
+
+            delivered = self._delivered[room_id]
+            if clock <= delivered:
+                logger.debug(
+                    f"Dropping already delivered message in room {room_id}"
+                )
+                return []
+
+            pending = self._pending.setdefault(room_id, [])
+            pending.append((time.time(), message))
+            released = self._release_ready(room_id)
+
+            if not released:
+                logger.debug(
+                    f"Holding message from {origin} in room {room_id} "
+                    f"({len(pending)} pending)"
+                )
+            released.extend(self._release_overdue(room_id))
+            return released
+
+    def flush_overdue(self) -> Dict[str, List[Dict]]:
+        """
+        Release held messages that exceeded the delivery timeout.
+
+        Returns:
+            Maps room_id to the messages released for it, in order
+        """
+        with self._lock:
+            released = {}
+            for room_id in list(self._pending):
+                messages = self._release_overdue(room_id)
+                if messages:
+                    released[room_id] = messages
+            return released
+
+    def _deliverable(self, delivered: VectorClock, message: Dict) -> bool:
+        """Check if a message's dependencies have all been delivered."""
+        clock = VectorClock.from_dict(message["vector_clock"])
+        origin = message["origin_node"]
+        if clock.get(origin) != delivered.get(origin) + 1:
+            return False
+        return all(
+            counter <= delivered.get(node_id)
+            for node_id, counter in clock.to_dict().items()
+            if node_id != origin
+        )
+
+    def _release_ready(self, room_id: str) -> List[Dict]:
+        """Release pending messages whose dependencies are satisfied."""
+        delivered = self._delivered[room_id]
+        pending = self._pending[room_id]
+        released = []
+        progress = True
+        while progress:
+            progress = False
+            for entry in list(pending):
+                message = entry[1]
+                if self._deliverable(delivered, message):
+                    pending.remove(entry)
+                    delivered.merge(
+                        VectorClock.from_dict(message["vector_clock"])
+                    )
+                    released.append(message)
+                    progress = True
+        return released
+
+    def _release_overdue(self, room_id: str) -> List[Dict]:
+        """
+        Release messages that waited too long or overflow the buffer.
+
+        Held messages are force-delivered oldest-clock first; the missing
+        dependencies are assumed lost.
+        """
+        pending = self._pending[room_id]
+        cutoff = time.time() - self.delivery_timeout
+        released = []
+        while pending and (
+            len(pending) > self.max_buffered
+            or any(received_at < cutoff for received_at, _ in pending)
+        ):
+            pending.sort(
+                key=lambda entry: sum(entry[1]["vector_clock"].values())
+            )
+            _, message = pending.pop(0)
+            logger.warning(
+                f"Releasing message in room {room_id} with missing "
+                f"causal dependencies"
+            )
+            self._delivered[room_id].merge(
+                VectorClock.from_dict(message["vector_clock"])
+            )
+            released.append(message)
+            released.extend(self._release_ready(room_id))
+        return released
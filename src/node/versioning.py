@@ -0,0 +1,144 @@
+"""
+Protocol Versions and Compatibility Gates
+
+Every node speaks a range of inter-node protocol versions, from
+MIN_PROTOCOL_VERSION to PROTOCOL_VERSION. The discovery handshake (see
+discovery.py) exchanges both ends of the range and the node's
+capabilities (feature flags such as "failover" or "snapshot_transfer"),
+and the two nodes settle on the highest version both speak. Nodes whose
+ranges don't overlap refuse the handshake with PROTOCOL_MISMATCH, naming
+both ranges.
+
+The negotiated version and the capabilities are kept per peer in the
+PeerRegistry. Before calling a peer, gates check that the peer can answer
+the method: methods added in a later protocol version need that version
+(METHOD_VERSIONS), and optional features need the peer to advertise the
+capability (METHOD_CAPABILITIES). A gated call fails at once with
+IncompatiblePeerError (error code PEER_INCOMPATIBLE) instead of going out
+and failing on the peer, so callers degrade the way they do for an
+unreachable peer. Peers that were never handshaken (e.g. statically
+configured ones without discovery) are not gated.
+
+Version history:
+
+1. The original protocol
+2. Version ranges in the handshake; set_room_retention and exchange_load
+3. exchange_stats
+4. pin_message
+5. update_room_metadata
+6. exchange_push_tokens and receive_push_tokens
+7. set_spam_thresholds
+8. set_content_filters
+9. tpc_precommit and tpc_status (2PC recovery)
+10. receive_message_stream (batched message streams between nodes)
+11. schedule_message, list_scheduled and cancel_scheduled
+12. get_replica_history (history read from room followers)
+"""
+
+from typing import Dict, Iterable, Optional
+
+from .snapshot import SNAPSHOT_CAPABILITY
+
+# Protocol versions spoken by this node
+PROTOCOL_VERSION = 12
+MIN_PROTOCOL_VERSION = 1
+
+# Methods added after version 1 -> the version that added them
+METHOD_VERSIONS: Dict[str, int] = {
+    "set_room_retention": 2,
+    "exchange_load": 2,
+    "exchange_stats": 3,
+    "pin_message": 4,
+    "update_room_metadata": 5,
+    "exchange_push_tokens": 6,
+    "receive_push_tokens": 6,
+    "set_spam_thresholds": 7,
+    "set_content_filters": 8,
+    "tpc_precommit": 9,
+    "tpc_status": 9,
+    "receive_message_stream": 10,
+    "schedule_message": 11,
+    "list_scheduled": 11,
+    "cancel_scheduled": 11,
+    "get_replica_history": 12,
+}
+
+# Methods of optional features -> the capability a peer must advertise
+METHOD_CAPABILITIES: Dict[str, str] = {
+    "begin_snapshot_transfer": SNAPSHOT_CAPABILITY,
+    "receive_snapshot_chunk": SNAPSHOT_CAPABILITY,
+    "commit_snapshot_transfer": SNAPSHOT_CAPABILITY,
+}
+
+
+class IncompatiblePeerError(Exception):
+    """A peer's protocol version or capabilities can't serve a call."""
+
+    def __init__(self, message: str, error_code: str = "PEER_INCOMPATIBLE"):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "PEER_INCOMPATIBLE")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def negotiate_version(max_version, min_version=None) -> Optional[int]:
+    """
+    Find the protocol version to speak with a peer.
+
+    Args:
+        max_version: Highest version the peer speaks
+        min_version: Lowest version the peer speaks (peers that predate
+            version ranges only speak max_version)
+
+    Returns:
+        The highest version both nodes speak, or None if there is none
+    """
+    if min_version is None:
+        min_version = max_version
+    if not isinstance(max_version, int) or not isinstance(min_version, int):
+        return None
+    version = min(PROTOCOL_VERSION, max_version)
+    if version < max(MIN_PROTOCOL_VERSION, min_version):
+        return None
+    return version
+
+
+def check_compatible(
+    node_id: str,
+    method: str,
+    version: Optional[int],
+    capabilities: Iterable[str] = (),
+) -> None:
+    """
+    Check that a peer can answer a method.
+
+    Args:
+        node_id: ID of the peer
+        method: Name of the remote method
+        version: Protocol version negotiated with the peer (None if it was
+            never handshaken, which isn't gated)
+        capabilities: Capabilities the peer advertised
+
+    Raises:
+        IncompatiblePeerError: If the method needs a later protocol
+            version or a capability the peer lacks
+    """
+    if version is None:
+        return
+    needed = METHOD_VERSIONS.get(method, MIN_PROTOCOL_VERSION)
+    if version < needed:
+        raise IncompatiblePeerError(
+            f"Node {node_id} speaks protocol version {version}, but "
+            f"{method} needs version {needed}"
+        )
+    capability = METHOD_CAPABILITIES.get(method)
+    if capability and capability not in capabilities:
+        raise IncompatiblePeerError(
+            f"Node {node_id} doesn't support {capability}, needed by "
+            f"{method}"
+        )
@@ -0,0 +1,425 @@
+"""
+Write-Ahead Message Log
+
+Persists room metadata and message history so rooms administered by a node
+survive restarts. Each room has its own append-only log, split into segment
+files under <data_dir>/rooms/<room_id>/. Every record is framed as
+
+    [length: uint32][crc32: uint32][JSON payload]
+
+The room manager appends a record before applying the change in memory. On
+startup the logs are replayed to rebuild the rooms; a torn or corrupt
+record at the end of the newest segment (e.g. from a crash mid-write) is
+truncated away.
+
+fsync policies:
+
+- "always": fsync after every record (safest, slowest)
+- "interval": fsync at most every FSYNC_INTERVAL seconds, plus on sync()
+- "never": leave flushing to the operating system
+"""
+
+import json
+import logging
+import os
+import re
+import shutil
+import struct
+import threading
+import time
+import zlib
+from typing import Dict, Iterator, List
+
+from .storage import Storage
+
+logger = logging.getLogger(__name__)
+
+# WAL configuration
+SEGMENT_SIZE = 4 * 1024 * 1024  # bytes per segment file before rolling
+FSYNC_INTERVAL = 1  # seconds between fsyncs with the "interval" policy
+FSYNC_POLICIES = ("always", "interval", "never")
+
+SEGMENT_SUFFIX = ".log"
+_HEADER = struct.Struct(">II")
+_ROOM_ID_PATTERN = re.compile(r"^[A-Za-z0-9_-]+$")
+
+
+class SegmentedLog:
+    """
+    Append-only log of JSON records split across segment files.
+    """
+
+    def __init__(
+        self,
+        directory: str,
+        segment_size: int = SEGMENT_SIZE,
+        fsync_policy: str = "always",
+    ):
+        """
+        Initialize the log, creating its directory if needed.
+
+        Args:
+            directory: Directory holding the segment files
+            segment_size: Size in bytes after which a new segment starts
+            fsync_policy: One of FSYNC_POLICIES
+
+        Raises:
+            ValueError: If the fsync policy is unknown
+        """
+        if fsync_policy not in FSYNC_POLICIES:
+            raise ValueError(f"Unknown fsync policy: {fsync_policy}")
+        self.directory = directory
+        self.segment_size = segment_size
+        self.fsync_policy = fsync_policy
+        self._lock = threading.Lock()
+        self._file = None
+        self._last_sync = time.monotonic()
+        self._dirty = False
+        os.makedirs(directory, exist_ok=True)
+
+    def segments(self) -> List[str]:
+        """Get the paths of all segment files, oldest first."""
+        names = sorted(
+            name
+            for name in os.listdir(self.directory)
+            if name.endswith(SEGMENT_SUFFIX)
+        )
+        return [os.path.join(self.directory, name) for name in names]
+
+    def append(self, record: Dict) -> None:
+        """
+        Append a record to the log.
+
+        Args:
+            record: JSON-serializable record
+
+        Raises:
+            OSError: If the record cannot be written
+        """
+        payload = json.dumps(record, separators=(",", ":")).encode("utf-8")
+        frame = _HEADER.pack(len(payload), zlib.crc32(payload)) + payload
+        with self._lock:
+            handle = self._writable_segment()
+            handle.write(frame)
+            handle.flush()
+            self._dirty = True
+            if self.fsync_policy == "always" or (
+                self.fsync_policy == "interval"
+                and time.monotonic() - self._last_sync >= FSYNC_INTERVAL
+            ):
+                self._fsync()
+
+    def records(self) -> Iterator[Dict]:
+        """
+        Read every valid record, oldest first.
+
+        Reading a segment stops at the first torn or corrupt record. If
+        that happens in the newest segment, the damaged tail is truncated
+        so later appends follow the last good record.
+
+        Yields:
+            The decoded records
+        """
+        segments = self.segments()
+        for index, path in enumerate(segments):
+            with open(path, "rb") as handle:
+                data = handle.read()
+
+            offset = 0
+            while offset < len(data):
+                record, next_offset = _decode(data, offset)
+                if record is None:
+                    break
+                yield record
+                offset = next_offset
+
+            if offset < len(data):
+                if index == len(segments) - 1:
+                    logger.warning(
+                        f"Truncating damaged WAL tail in {path} "
+                        f"at byte {offset}"
+                    )
+                    with self._lock:
+                        self._close_file()
+                        with open(path, "r+b") as handle:
+                            handle.truncate(offset)
+                else:
+                    logger.error(
+                        f"Skipping corrupt WAL segment data in {path} "
+                        f"after byte {offset}"
+                    )
+
+    def compact(self, record: Dict) -> None:
+        """
+        Replace every record with one, removing the old segments.
+
+        The record is written and fsynced to a new segment before the old
+        ones are deleted, so a crash in between leaves the old records
+        followed by the new one.
+
+        Args:
+            record: JSON-serializable record (a snapshot of the state the
+                old records built)
+
+        Raises:
+            OSError: If the record cannot be written
+        """
+        payload = json.dumps(record, separators=(",", ":")).encode("utf-8")
+        frame = _HEADER.pack(len(payload), zlib.crc32(payload)) + payload
+        with self._lock:
+            if self._file is not None and self._dirty:
+                self._fsync()
+            self._close_file()
+            old_segments = self.segments()
+            self._file = open(self._next_segment(old_segments), "ab")
+            self._file.write(frame)
+            self._fsync()
+            for path in old_segments:
+                os.remove(path)
+
+    def sync(self) -> None:
+        """Flush and fsync any unsynced records."""
+        with self._lock:
+            if self._file is not None and self._dirty:
+                self._fsync()
+
+    def close(self) -> None:
+        """Sync and close the current segment."""
+        with self._lock:
+            if self._file is not None and self._dirty:
+                self._fsync()
+            self._close_file()
+
+    def _writable_segment(self):
+        """Get the open segment to append to, rolling over if it is full."""
+        if self._file is not None and self._file.tell() < self.segment_size:
+            return self._file
+
+        if self._file is not None:
+            if self._dirty:
+                self._fsync()
+            self._close_file()
+
+        segments = self.segments()
+        if segments and os.path.getsize(segments[-1]) < self.segment_size:
+            path = segments[-1]
+        else:
+            path = self._next_segment(segments)
+        self._file = open(path, "ab")
+        return self._file
+
+    def _next_segment(self, segments: List[str]) -> str:
+        """Get the path of the segment after the newest one."""
+        number = 1
+        if segments:
+            name = os.path.basename(segments[-1])
+            number = int(name[: -len(SEGMENT_SUFFIX)]) + 1
+        return os.path.join(self.directory, f"{number:08d}{SEGMENT_SUFFIX}")
+
+    def _fsync(self) -> None:
+        """Flush the open segment to disk."""
+        self._file.flush()
+        os.fsync(self._file.fileno())
+        self._last_sync = time.monotonic()
+        self._dirty = False
+
+    def _close_file(self) -> None:
+        """Close the open segment, if any."""
+        if self._file is not None:
+            self._file.close()
+            self._file = None
+
+
+def _decode(data: bytes, offset: int):
+    """
+    Decode the record starting at an offset.
+
+    Returns:
+        tuple: (record or None if torn or corrupt, offset after the record)
+    """
+    if offset + _HEADER.size > len(data):
+        return None, offset
+    length, crc = _HEADER.unpack_from(data, offset)
+    start = offset + _HEADER.size
+    payload = data[start : start + length]
+    if len(payload) < length or zlib.crc32(payload) != crc:
+        return None, offset
+    try:
+        return json.loads(payload.decode("utf-8")), start + length
+    except ValueError:
+        return None, offset
+
+
+class MessageLog(Storage):
+    """
+    Storage in per-room write-ahead logs on disk.
+
+    Each room's records go to a SegmentedLog under <data_dir>/rooms/<room_id>/,
+    and user accounts, revoked sessions, bots and service accounts to one
+    under <data_dir>/sessions/. See storage.py for the record types.
+    """
+
+    def __init__(
+        self,
+        data_dir: str,
+        fsync_policy: str = "always",
+        segment_size: int = SEGMENT_SIZE,
+    ):
+        """
+        Initialize the message log.
+
+        Args:
+            data_dir: Directory under which room logs are stored
+            fsync_policy: One of FSYNC_POLICIES
+            segment_size: Size in bytes after which a new segment starts
+
+        Raises:
+            ValueError: If the fsync policy is unknown
+        """
+        if fsync_policy not in FSYNC_POLICIES:
+            raise ValueError(f"Unknown fsync policy: {fsync_policy}")
+        self.data_dir = data_dir
+        self.fsync_policy = fsync_policy
+        self.segment_size = segment_size
+        self._rooms_dir = os.path.join(data_dir, "rooms")
+        self._lock = threading.Lock()
+        self._logs: Dict[str, SegmentedLog] = {}
+        self._sessions = SegmentedLog(
+            os.path.join(data_dir, "sessions"), segment_size, fsync_policy
+        )
+        os.makedirs(self._rooms_dir, exist_ok=True)
+
+    def append(self, room_id: str, record: Dict) -> None:
+        """Append a record to a room's log."""
+        self._log(room_id).append(record)
+
+    def records(self, room_id: str) -> Iterator[Dict]:
+        """Read a room's records, oldest first."""
+        return self._log(room_id).records()
+
+    def room_ids(self) -> List[str]:
+        """Get the IDs of all rooms with a log, sorted."""
+        return sorted(
+            room_id
+            for room_id in os.listdir(self._rooms_dir)
+            if _ROOM_ID_PATTERN.match(room_id)
+        )
+
+    def compact(self, room_id: str, record: Dict) -> None:
+        """Replace a room's log with one record in a new segment."""
+        self._log(room_id).compact(record)
+
+    def drop_room(self, room_id: str) -> None:
+        """
+        Delete the log of a room (after the room is deleted).
+
+        Args:
+            room_id: The room ID
+        """
+        with self._lock:
+            log = self._logs.pop(room_id, None)
+        if log is not None:
+            log.close()
+        path = os.path.join(self._rooms_dir, room_id)
+        if _ROOM_ID_PATTERN.match(room_id) and os.path.isdir(path):
+            shutil.rmtree(path, ignore_errors=True)
+            logger.info(f"Dropped WAL for room {room_id}")
+
+    def save_account(self, account: Dict) -> None:
+        """Append a registered user account to the sessions log."""
+        self._sessions.append({"type": "account", "account": account})
+
+    def drop_account(self, username: str) -> None:
+        """Append an account's deletion to the sessions log."""
+        self._sessions.append({"type": "account_removed", "username": username})
+
+    def accounts(self) -> List[Dict]:
+        """Get the accounts in the sessions log that weren't deleted."""
+        accounts: Dict[str, Dict] = {}
+        for record in self._sessions.records():
+            if record.get("type") == "account":
+                accounts[record["account"]["username"]] = record["account"]
+            elif record.get("type") == "account_removed":
+                accounts.pop(record["username"], None)
+        return list(accounts.values())
+
+    def save_revocation(self, session_id: str, expires_at: float) -> None:
+        """Append a revoked session to the sessions log."""
+        self._sessions.append(
+            {"type": "revoke", "sid": session_id, "expires_at": expires_at}
+        )
+
+    def revocations(self) -> Dict[str, float]:
+        """Get the revoked sessions in the sessions log."""
+        return {
+            record["sid"]: record["expires_at"]
+            for record in self._sessions.records()
+            if record.get("type") == "revoke"
+        }
+
+    def save_bot(self, bot: Dict) -> None:
+        """Append a registered bot to the sessions log."""
+        self._sessions.append({"type": "bot", "bot": bot})
+
+    def drop_bot(self, name: str) -> None:
+        """Append a bot's removal to the sessions log."""
+        self._sessions.append({"type": "bot_removed", "name": name})
+
+    def bots(self) -> List[Dict]:
+        """Get the bots in the sessions log that weren't removed."""
+        bots: Dict[str, Dict] = {}
+        for record in self._sessions.records():
+            if record.get("type") == "bot":
+                bots[record["bot"]["name"]] = record["bot"]
+            elif record.get("type") == "bot_removed":
+                bots.pop(record["name"], None)
+        return list(bots.values())
+
+    def save_service_account(self, account: Dict) -> None:
+        """Append a provisioned service account to the sessions log."""
+        self._sessions.append({"type": "service_account", "account": account})
+
+    def drop_service_account(self, name: str) -> None:
+        """Append a service account's removal to the sessions log."""
+        self._sessions.append(
+            {"type": "service_account_removed", "name": name}
+        )
+
+    def service_accounts(self) -> List[Dict]:
+        """Get the service accounts in the sessions log not removed."""
+        accounts: Dict[str, Dict] = {}
+        for record in self._sessions.records():
+            if record.get("type") == "service_account":
+                accounts[record["account"]["name"]] = record["account"]
+            elif record.get("type") == "service_account_removed":
+                accounts.pop(record["name"], None)
+        return list(accounts.values())
+
+    def sync(self) -> None:
+        """fsync every open log."""
+        with self._lock:
+            logs = list(self._logs.values())
+        for log in logs + [self._sessions]:
+            log.sync()
+
+    def close(self) -> None:
+        """Sync and close every open log."""
+        with self._lock:
+            logs = list(self._logs.values())
+            self._logs.clear()
+        for log in logs + [self._sessions]:
+            log.close()
+
+    def _log(self, room_id: str) -> SegmentedLog:
+        """Get the log for a room, opening it if needed."""
+        if not _ROOM_ID_PATTERN.match(room_id):
+            raise ValueError(f"Invalid room ID for WAL: {room_id!r}")
+        with self._lock:
+            log = self._logs.get(room_id)
+            if log is None:
+                log = self._logs[room_id] = SegmentedLog(
+                    os.path.join(self._rooms_dir, room_id),
+                    self.segment_size,
+                    self.fsync_policy,
+                )
+            return log
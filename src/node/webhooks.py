@@ -0,0 +1,393 @@
+"""
+Outbound Webhooks
+
+A room's owner can register webhook URLs so external systems (CI bots,
+notification relays) hear about what happens in the room. Each webhook
+subscribes to some of WEBHOOK_EVENTS; when one of them happens, the
+room's administrator node POSTs a JSON payload to the URL:
+
+    {"event": "message_posted", "room_id": "...", "delivery_id": "...",
+     "timestamp": "...", "data": {...}}
+
+Every request carries the event name, the delivery ID and an HMAC-SHA256
+signature of the body made with the webhook's secret, which is returned
+once when the webhook is registered:
+
+    X-Chat-Signature: sha256=<hex digest>
+
+Deliveries are queued and sent by a background task, never on the path
+of the chat command that caused them. A delivery that fails (a
+connection error or a non-2xx status) is retried with exponential
+backoff, up to MAX_RETRIES times, then dropped. Deliveries to internal
+addresses are refused and redirects aren't followed (see egress.py).
+
+Webhooks are room metadata: the administrator writes them to its message
+log and hands them over with a room snapshot. Room replicas don't carry
+them, so a room taken over through failover has none until they are
+registered again.
+"""
+
+import hashlib
+import hmac
+import json
+import logging
+import secrets
+import threading
+import time
+import urllib.error
+import urllib.request
+import uuid
+from dataclasses import dataclass
+from datetime import datetime, timezone
+from functools import partial
+from typing import Callable, Dict, Iterable, List, Optional
+from urllib.parse import urlparse
+
+from .egress import EgressPolicy, urlopen
+
+logger = logging.getLogger(__name__)
+
+# POSTs (url, body, headers, timeout), returning the HTTP status
+PostFunction = Callable[[str, bytes, Dict[str, str], float], int]
+
+# Events a webhook can subscribe to
+MESSAGE_POSTED = "message_posted"
+MEMBER_JOINED = "member_joined"
+MEMBER_LEFT = "member_left"
+ROOM_DELETED = "room_deleted"
+WEBHOOK_EVENTS = (MESSAGE_POSTED, MEMBER_JOINED, MEMBER_LEFT, ROOM_DELETED)
+
+# Webhook configuration
+MAX_WEBHOOKS = 5  # per room
+MAX_URL_LENGTH = 2048
+MAX_RETRIES = 5  # retries after the first attempt
+RETRY_BACKOFF = 2.0  # seconds before the first retry, doubled each time
+MAX_BACKOFF = 300.0  # seconds
+MAX_QUEUED = 1000  # deliveries waiting; the oldest are dropped beyond it
+DELIVERY_TIMEOUT = 5  # seconds per request
+WEBHOOK_DELIVERY_INTERVAL = 1  # seconds between delivery rounds
+
+# Request headers
+SIGNATURE_HEADER = "X-Chat-Signature"
+EVENT_HEADER = "X-Chat-Event"
+DELIVERY_HEADER = "X-Chat-Delivery"
+
+
+class WebhookError(Exception):
+    """A webhook could not be registered or removed."""
+
+    def __init__(self, message: str, error_code: str):
+        """
+        Initialize the error.
+
+        Args:
+            message: Human-readable reason
+            error_code: Machine-readable code (e.g., "INVALID_URL")
+        """
+        super().__init__(message)
+        self.error_code = error_code
+
+
+def create_webhook(
+    room_id: str, url: str, events: Iterable[str], created_by: str
+) -> Dict:
+    """
+    Create a webhook record with a new ID and secret.
+
+    Args:
+        room_id: The room ID
+        url: http:// or https:// URL the events are POSTed to
+        events: Events to deliver, from WEBHOOK_EVENTS (empty for all)
+        created_by: Username of the member registering it
+
+    Returns:
+        dict: The webhook, with 'webhook_id', 'room_id', 'url', 'events',
+        'secret', 'created_by' and 'created_at'
+
+    Raises:
+        WebhookError: If the URL isn't an http(s) URL (INVALID_URL) or an
+            event is unknown (INVALID_EVENTS)
+    """
+    if not isinstance(url, str) or len(url) > MAX_URL_LENGTH:
+        raise WebhookError(
+            f"url must be text of at most {MAX_URL_LENGTH} characters",
+            "INVALID_URL",
+        )
+    parsed = urlparse(url)
+    if parsed.scheme not in ("http", "https") or not parsed.netloc:
+        raise WebhookError(
+            "url must be an http:// or https:// URL", "INVALID_URL"
+        )
+    if not isinstance(events, (list, tuple)) or not all(
+        event in WEBHOOK_EVENTS for event in events
+    ):
+        raise WebhookError(
+            f"events must be a list of {', '.join(WEBHOOK_EVENTS)}",
+            "INVALID_EVENTS",
+        )
+    return {
+        "webhook_id": str(uuid.uuid4()),
+        "room_id": room_id,
+        "url": url,
+        "events": list(dict.fromkeys(events or WEBHOOK_EVENTS)),
+        "secret": secrets.token_hex(32),
+        "created_by": created_by,
+        "created_at": datetime.now(timezone.utc).isoformat(),
+    }
+
+
+def public_webhook(webhook: Dict) -> Dict:
+    """Get a webhook record without its secret."""
+    return {key: value for key, value in webhook.items() if key != "secret"}
+
+
+def sign(secret: str, body: bytes) -> str:
+    """
+    Sign a request body.
+
+    Args:
+        secret: The webhook's secret
+        body: The JSON body sent
+
+    Returns:
+        The SIGNATURE_HEADER value, "sha256=" and the hex HMAC-SHA256
+    """
+    digest = hmac.new(secret.encode(), body, hashlib.sha256).hexdigest()
+    return f"sha256={digest}"
+
+
+def http_post(
+    url: str,
+    body: bytes,
+    headers: Dict[str, str],
+    timeout: float,
+    egress: Optional[EgressPolicy] = None,
+) -> int:
+    """
+    POST a body to a URL, without following redirects.
+
+    Args:
+        url: The URL
+        body: The request body
+        headers: The request headers
+        timeout: Seconds to wait for the response
+        egress: Policy the connection must pass, if any
+
+    Returns:
+        The response's HTTP status
+
+    Raises:
+        EgressError: If the URL's host has an address the policy refuses
+        OSError: If the request could not be made
+    """
+    request = urllib.request.Request(
+        url, data=body, headers=headers, method="POST"
+    )
+    try:
+        with urlopen(request, timeout, egress) as response:
+            return response.status
+    except urllib.error.HTTPError as e:
+        return e.code
+
+
+@dataclass
+class Delivery:
+    """
+    One payload waiting to be POSTed to a webhook.
+
+    Attributes:
+        delivery_id: Unique ID, sent with every attempt
+        webhook_id: The webhook's ID
+        url: The webhook's URL
+        secret: The webhook's secret, for signing
+        event: The event delivered
+        body: The JSON payload
+        attempts: Attempts that failed so far
+        next_attempt: UNIX time the next attempt is due
+    """
+
+    delivery_id: str
+    webhook_id: str
+    url: str
+    secret: str
+    event: str
+    body: bytes
+    attempts: int = 0
+    next_attempt: float = 0.0
+
+    def headers(self) -> Dict[str, str]:
+        """Get the request headers of an attempt."""
+        return {
+            "Content-Type": "application/json",
+            EVENT_HEADER: self.event,
+            DELIVERY_HEADER: self.delivery_id,
+            SIGNATURE_HEADER: sign(self.secret, self.body),
+        }
+
+
+class WebhookDispatcher:
+    """
+    Queue of webhook deliveries, sent with retries.
+
+    Deliveries are queued from room state changes and sent by
+    deliver_due(), which blocks on the network and so runs outside the
+    event loop.
+    """
+
+    def __init__(
+        self,
+        post: Optional[PostFunction] = None,
+        max_retries: int = MAX_RETRIES,
+        backoff: float = RETRY_BACKOFF,
+        max_queued: int = MAX_QUEUED,
+        clock: Callable[[], float] = time.time,
+        egress: Optional[EgressPolicy] = None,
+    ):
+        """
+        Initialize the dispatcher.
+
+        Args:
+            post: Function POSTing (url, body, headers, timeout) and
+                returning the HTTP status; http_post through egress by
+                default
+            max_retries: Retries of a failed delivery before it is dropped
+            backoff: Seconds before the first retry, doubled for each next
+            max_queued: Most deliveries waiting at once
+            clock: Function returning the current UNIX time
+            egress: Policy deliveries must pass; internal addresses are
+                refused by default
+        """
+        if post is None:
+            post = partial(http_post, egress=egress or EgressPolicy())
+        self._post = post
+        self.max_retries = max_retries
+        self.backoff = backoff
+        self.max_queued = max_queued
+        self._clock = clock
+        self._lock = threading.Lock()
+        self._queue: List[Delivery] = []
+
+    def enqueue(
+        self, webhooks: Iterable[Dict], event: str, room_id: str, data: Dict
+    ) -> int:
+        """
+        Queue an event for the webhooks subscribed to it.
+
+        Args:
+            webhooks: The room's webhook records
+            event: One of WEBHOOK_EVENTS
+            room_id: The room ID
+            data: The event's data
+
+        Returns:
+            Number of deliveries queued
+        """
+        queued = 0
+        now = self._clock()
+        timestamp = datetime.now(timezone.utc).isoformat()
+        with self._lock:
+            for webhook in webhooks:
+                if event not in webhook["events"]:
+                    continue
+                delivery_id = str(uuid.uuid4())
+                body = json.dumps(
+                    {
+                        "event": event,
+                        "room_id": room_id,
+                        "delivery_id": delivery_id,
+                        "timestamp": timestamp,
+                        "data": data,
+                    },
+                    sort_keys=True,
+                ).encode()
+                self._queue.append(
+                    Delivery(
+                        delivery_id,
+                        webhook["webhook_id"],
+                        webhook["url"],
+                        webhook["secret"],
+                        event,
+                        body,
+                        next_attempt=now,
+                    )
+                )
+                queued += 1
+            if len(self._queue) > self.max_queued:
+                dropped = len(self._queue) - self.max_queued
+                del self._queue[:dropped]
+                logger.warning(
+                    f"Webhook queue full: dropped {dropped} deliveries"
+                )
+        return queued
+
+    def pending(self) -> int:
+        """Get the number of deliveries waiting."""
+        with self._lock:
+            return len(self._queue)
+
+    def deliver_due(self) -> int:
+        """
+        Send every delivery whose attempt is due.
+
+        Deliveries that fail are rescheduled after a backoff, or dropped
+        once they have been retried max_retries times.
+
+        Returns:
+            Number of deliveries that succeeded
+        """
+        now = self._clock()
+        with self._lock:
+            due = [d for d in self._queue if d.next_attempt <= now]
+            self._queue = [d for d in self._queue if d.next_attempt > now]
+
+        delivered = 0
+        retry = []
+        for delivery in due:
+            try:
+                status = self._post(
+                    delivery.url,
+                    delivery.body,
+                    delivery.headers(),
+                    DELIVERY_TIMEOUT,
+                )
+                error = None if 200 <= status < 300 else f"HTTP {status}"
+            except Exception as e:
+                error = str(e) or type(e).__name__
+            if error is None:
+                delivered += 1
+                continue
+
+            delivery.attempts += 1
+            if delivery.attempts > self.max_retries:
+                logger.warning(
+                    f"Dropped {delivery.event} delivery "
+                    f"{delivery.delivery_id} to webhook "
+                    f"{delivery.webhook_id} after {delivery.attempts} "
+                    f"attempts: {error}"
+                )
+                continue
+            delay = min(
+                self.backoff * 2 ** (delivery.attempts - 1), MAX_BACKOFF
+            )
+            delivery.next_attempt = self._clock() + delay
+            retry.append(delivery)
+            logger.info(
+                f"Webhook {delivery.webhook_id} delivery failed ({error}); "
+                f"retrying in {delay:.0f}s"
+            )
+
+        with self._lock:
+            self._queue.extend(retry)
+        return delivered
+
+    def drop_webhook(self, webhook_id: str) -> None:
+        """Forget the waiting deliveries of a removed webhook."""
+        with self._lock:
+            self._queue = [
+                d for d in self._queue if d.webhook_id != webhook_id
+            ]
+
+
+def webhooks_for(records: Optional[Dict[str, Dict]]) -> List[Dict]:
+    """Get a room's webhook records, oldest first."""
+    return sorted((records or {}).values(), key=lambda w: w["created_at"])
@@ -5,35 +5,200 @@ Handles WebSocket connections from clients and processes their requests.
 """
 
 import asyncio
+import base64
 import logging
 import json
-from concurrent.futures import ThreadPoolExecutor
 from datetime import datetime, timezone
-from typing import Set, Dict, Optional, List
-from xmlrpc.client import ServerProxy
+from typing import Awaitable, Callable, Set, Dict, List, Optional, Tuple, Union
 import websockets
 from websockets.server import WebSocketServerProtocol
 
+from .attachments import (
+    AttachmentError,
+    AttachmentManager,
+    validate_attachments,
+)
+from .archive import ArchiveError
+from .auth import AuthManager, PUBLIC_MESSAGE_TYPES
+from .bots import BotError, BotRegistry
+from .service_accounts import (
+    DM,
+    READ,
+    ServiceAccountError,
+    ServiceAccountRegistry,
+)
+from .placement import RoomPlacement, validate_placement
+from .sharding import RoomSharding
+from .migration import ROOM_MIGRATING, ROOM_MOVED, RoomMigrator
+from .load_balancing import LoadBalancer, NodeLoad
 from .room_state import RoomStateManager, RoomState
 from .peer_registry import PeerRegistry
+from .capacity import ROOM_FULL, WAITLISTED, CapacityError
+from .connection_registry import ConnectionRegistry
+from .direct_messages import (
+    DirectMessage,
+    DirectMessageBuffer,
+    create_direct_message,
+)
+from .dedup import FORWARD_RETRIES, FORWARD_RETRY_DELAY, DuplicateMessageError
+from .delivery import delivery_policy
+from .durability import await_quorum
+from .e2ee import E2EEError, validate_encrypted_message
+from .edits import DELETE, EDIT, EditError
+from .reactions import ReactionError
+from .read_receipts import ReadReceiptError
+from .threads import ThreadError
+from .failover import ReplicaStore
+from .history import HISTORY_PAGE_SIZE
+from .invites import InviteError, parse_invite_token
+from .log_context import ServerProxy, log_context, new_correlation_id
+from .audit import ROOM_DELETED, audit
+from .membership import ClusterMembership
+from .mentions import mentioned_users
+from .mutes import MuteError, MuteRegistry
+from .tracing import SERVER, start_span
+from .metrics import NodeMetrics
+from .tls import TLSManager
+from .moderation import BAN, KICK, ModerationError
+from .roles import DELETE_ROOM, MEMBER, MODERATOR, RoleError
+from .offline_queue import OfflineQueue, OfflineSession
+from .failure_detector import MembershipEvent, PeerState
+from .faults import FaultInjector
+from .keepalive import KEEPALIVE_CLOSE_CODE, KeepaliveMonitor
+from .partition import READ_ONLY, PartitionError, PartitionManager
+from .presence import CLIENT_STATUSES, PresenceDirectory, PresenceEntry
+from .profiles import (
+    PROFILE_FIELDS,
+    ProfileError,
+    ProfileRegistry,
+    UserProfile,
+    push_profile_update,
+)
+from .push import (
+    PushDispatcher,
+    PushError,
+    PushTokenRegistry,
+    preview,
+    push_token_update,
+)
+from .raft import RaftRoomRegistry
+from .rate_limit import RateLimiter
+from .receipts import DeliveryReceipt, ReceiptTracker
+from .announcements import AnnouncementError
+from .replication import ReplicationManager
+from .pins import PIN_EVENT_TYPES, PinError
+from .scheduled import ScheduleError
+from .retention import RetentionError
+from .room_metadata import METADATA_FIELDS, RoomUpdateError
+from .room_directory import RoomDirectory
+from .routing import HISTORY, LatencyRouter
+from .search import SEARCH_LIMIT
+from .seed import SeedError
+from .spam import SPAM_DETECTED, THRESHOLD_FIELDS, SpamError
+from .content_filters import ContentFilterError
+from .send_queue import (
+    DROP_OLDEST,
+    SEND_QUEUE_SIZE,
+    Frame,
+    SendQueue,
+    encode_frame,
+)
+from .stats import ClusterStats, NodeStats
+from .stream_repair import StreamRepair
+from .total_order import SequenceBuffer
+from .typing_indicators import TypingThrottle
+from .tpc import TPCCoordinator
+from .vector_clock import CausalBuffer
+from .versioning import PROTOCOL_VERSION, IncompatiblePeerError
+from .webhooks import WebhookError
+from .bridges import BridgeError, is_puppet
 from .schemas.events import (
     create_member_joined_event,
     create_member_left_event,
+    create_member_role_changed_event,
+    create_retention_changed_event,
+    create_spam_detected_event,
+    create_spam_thresholds_changed_event,
+    create_content_filters_changed_event,
+    create_pin_event,
+    create_mention_event,
+    create_room_updated_event,
     create_room_deleted_event,
+    create_room_archived_event,
+    create_room_admin_changed_event,
+    create_node_shutdown_event,
+    create_redirect_event,
+    create_presence_update_event,
+    create_profile_updated_event,
+    create_session_started_event,
+    create_ping_event,
+    create_removed_from_room_event,
+    create_waitlist_admitted_event,
+    create_typing_event,
+    create_read_position_updated_event,
+    create_waitlist_joined_event,
+    create_room_status_event,
+    create_key_published_event,
 )
+from .schemas.errors import annotate_error, describe_error, error_fields
 from .schemas.messages import (
     create_message_sent_confirmation,
+    create_message_status_event,
+    create_message_edit_event,
+    create_message_reaction_event,
+    create_thread_updated_event,
     create_message_error,
+    create_direct_message_event,
+    create_direct_message_sent_confirmation,
+    create_direct_message_error,
 )
-from .schemas.responses import create_join_error_response, create_error_response
+from .schemas.responses import (
+    create_auth_error_response,
+    create_rate_limited_response,
+    create_validation_error_response,
+    create_join_error_response,
+    create_invite_error_response,
+    create_error_response,
+    create_resume_error_response,
+    create_history_error_response,
+    create_moderation_error_response,
+    create_message_edit_error_response,
+    create_reaction_error_response,
+    create_read_state_error_response,
+    create_profile_error_response,
+    create_key_error_response,
+    create_upload_error_response,
+    create_search_error_response,
+    create_webhook_error_response,
+    create_bot_error_response,
+    create_bridge_error_response,
+    create_retention_error_response,
+    create_pin_error_response,
+    create_room_update_error_response,
+    create_spam_error_response,
+    create_filter_error_response,
+    create_push_error_response,
+    create_mutes_error_response,
+    create_block_error_response,
+    create_schedule_error_response,
+    create_stats_error_response,
+)
+from .schemas.catalog import protocol_info
 from .utils.broadcast import broadcast_to_peers, broadcast_message_to_peers
-from .utils.validation import validate_message_content
+from .dispatch import DISPATCH_WORKERS, KeyedDispatcher, KeyedWorkerPool
+from .compression import COMPRESSION_THRESHOLD, deflate_extensions
+from .utils.validation import (
+    MAX_PAYLOAD_SIZE,
+    parse_client_request,
+    validate_message_content,
+    validate_message_id,
+    validate_request_fields,
+)
 
 logger = logging.getLogger(__name__)
 
-# 2PC timeout constants
-PREPARE_TIMEOUT = 5  # seconds
-COMMIT_TIMEOUT = 5  # seconds
+# Signature of a client message handler: (websocket, request_data) -> None
+MessageHandler = Callable[[WebSocketServerProtocol, dict], Awaitable[None]]
 
 
 class WebSocketServer:
@@ -50,6 +215,42 @@ class WebSocketServer:
         host: str,
         port: int,
         peer_registry: PeerRegistry = None,
+        room_directory: RoomDirectory = None,
+        causal_buffer: CausalBuffer = None,
+        replica_store: ReplicaStore = None,
+        auth: AuthManager = None,
+        replication: ReplicationManager = None,
+        presence: PresenceDirectory = None,
+        offline_queue: OfflineQueue = None,
+        sequence_buffer: SequenceBuffer = None,
+        metrics: NodeMetrics = None,
+        tls: TLSManager = None,
+        rate_limiter: RateLimiter = None,
+        max_payload_size: int = MAX_PAYLOAD_SIZE,
+        require_message_id: bool = False,
+        send_queue_size: int = SEND_QUEUE_SIZE,
+        send_queue_policy: str = DROP_OLDEST,
+        profiles: ProfileRegistry = None,
+        membership: ClusterMembership = None,
+        room_registry: RaftRoomRegistry = None,
+        partition: PartitionManager = None,
+        attachments: AttachmentManager = None,
+        bots: BotRegistry = None,
+        sharding: RoomSharding = None,
+        load_balancer: LoadBalancer = None,
+        faults: FaultInjector = None,
+        keepalive: KeepaliveMonitor = None,
+        stats: ClusterStats = None,
+        push_tokens: PushTokenRegistry = None,
+        push: PushDispatcher = None,
+        dispatch_workers: int = DISPATCH_WORKERS,
+        fanout: KeyedWorkerPool = None,
+        streams=None,
+        compression_threshold: Optional[int] = COMPRESSION_THRESHOLD,
+        placement: RoomPlacement = None,
+        migrator: RoomMigrator = None,
+        service_accounts: ServiceAccountRegistry = None,
+        router: LatencyRouter = None,
     ):
         """
         Initialize the WebSocket server.
@@ -59,11 +260,139 @@ class WebSocketServer:
             host: Host address to bind to
             port: Port to listen on
             peer_registry: Optional peer registry for distributed operations
+            room_directory: Optional gossiped directory of all rooms
+            causal_buffer: Optional causal delivery buffer shared with the
+                XML-RPC server, seeded when joining remote rooms
+            replica_store: Optional store of replicas of remote rooms with
+                local members, used for admin failover
+            auth: Optional AuthManager; when set, clients log in and every
+                command is checked against their session token
+            replication: Optional ReplicationManager that streams messages
+                of rooms administered here to follower nodes
+            presence: Optional PresenceDirectory used to find the node a
+                direct message's recipient is connected to
+            offline_queue: Optional OfflineQueue; when set, disconnected
+                users keep their rooms for a while and get the messages
+                they missed when they resume their session
+            sequence_buffer: Optional total-order delivery buffer shared
+                with the XML-RPC server, seeded when joining remote rooms
+            metrics: Optional NodeMetrics; when set, the server exports its
+                clients and rooms and counts its 2PC transactions
+            tls: Optional TLSManager; when set, clients connect over wss://
+            rate_limiter: Optional RateLimiter; when set, commands over the
+                connection's or user's rate limit are dropped
+            max_payload_size: Largest client message accepted, in bytes
+            require_message_id: Reject messages without a message_id
+                chosen by the client, which makes every send retryable
+            send_queue_size: Messages queued for a client that reads
+                slowly before the send queue policy applies
+            send_queue_policy: What to do with a client whose send queue
+                is full: drop_oldest, drop_newest or disconnect
+            profiles: Optional ProfileRegistry shared with the XML-RPC
+                server; without one, profiles are kept on this node only
+            membership: Optional ClusterMembership whose view's members
+                take part in room deletions (instead of every known peer)
+            room_registry: Optional RaftRoomRegistry; when set, room
+                creations and deletions are committed to it, and rooms
+                are looked up and listed cluster-wide from it
+            partition: Optional PartitionManager; when set, remote rooms
+                whose admin node is unreachable are degraded (read-only or
+                buffering messages) instead of rejecting every message
+            attachments: Optional AttachmentManager shared with the XML-RPC
+                server; when set, clients can upload files and attach them
+                to messages
+            bots: Optional BotRegistry; when set, users can register bots
+                that log in with an API key
+            sharding: Optional RoomSharding; when set, new rooms are moved
+                to their owner on the hash ring, where rooms missing from
+                the directory are also looked up
+            load_balancer: Optional LoadBalancer; when set and this node
+                has reached its redirect threshold, new clients are
+                redirected to the least-loaded peer
+            faults: Optional FaultInjector that may crash this node at
+                the 2PC phases of room deletions it coordinates
+            keepalive: Optional KeepaliveMonitor; when set, clients are
+                pinged by keepalive_round(), and clients that stop
+                answering are marked offline and then disconnected
+            stats: Optional ClusterStats shared with the XML-RPC server,
+                whose peers' statistics the stats command aggregates;
+                without one, it reports this node only
+            push_tokens: Optional PushTokenRegistry shared with the XML-RPC
+                server; without one, push tokens are kept on this node only
+            push: Optional PushDispatcher; when set, offline members of
+                rooms hosted here and recipients of buffered direct
+                messages get push notifications on their devices
+            dispatch_workers: Event loop tasks delivering events from peers
+                to local clients, in order per room (see dispatch.py)
+            fanout: Optional KeyedWorkerPool sending events and messages
+                to peers from its threads, in order per room; without
+                one, they are sent before the command is answered
+            streams: Optional MessageStreams sending room messages to
+                peers in batches instead of a call each
+            compression_threshold: Smallest message compressed with
+                permessage-deflate, in bytes (None turns off compression)
+            placement: Optional RoomPlacement; when set, rooms created
+                with placement constraints are refused if no node matches
+                them and moved to a matching node if this isn't one
+            migrator: Optional RoomMigrator; when set, operators can move
+                hosted rooms to other nodes, and requests on a room wait
+                while it moves (see migration.py)
+            service_accounts: Optional ServiceAccountRegistry; when set,
+                service accounts provisioned by operators log in with an
+                API key and are limited to their scopes
+            router: Optional LatencyRouter; when set, the history of rooms
+                administered elsewhere is read from the nearest of their
+                admin and followers (see routing.py)
         """
         self.room_manager = room_manager
         self.host = host
         self.port = port
         self.peer_registry = peer_registry
+        self.room_directory = room_directory
+        self.causal_buffer = causal_buffer
+        self.replica_store = replica_store
+        self.auth = auth
+        self.replication = replication
+        self.presence = presence
+        self.offline_queue = offline_queue
+        self.sequence_buffer = sequence_buffer
+        self.metrics = metrics
+        self.tls = tls
+        self.rate_limiter = rate_limiter
+        self.max_payload_size = max_payload_size
+        self.require_message_id = require_message_id
+        self.send_queue_size = send_queue_size
+        self.send_queue_policy = send_queue_policy
+        self.profiles = profiles or ProfileRegistry(room_manager.clock)
+        self.profiles.subscribe(self.publish_profiles_sync)
+        self.membership = membership
+        self.room_registry = room_registry
+        self.partition = partition
+        self.attachments = attachments
+        self.bots = bots
+        self.sharding = sharding
+        self.load_balancer = load_balancer
+        self.keepalive = keepalive
+        self.stats = stats or ClusterStats(room_manager.node_id)
+        self.push_tokens = push_tokens or PushTokenRegistry(
+            room_manager.clock
+        )
+        self.push = push
+        self.dispatcher = KeyedDispatcher(dispatch_workers)
+        self.fanout = fanout
+        self.streams = streams
+        self.compression_threshold = compression_threshold
+        self.placement = placement
+        self.migrator = migrator
+        self.service_accounts = service_accounts
+        self.router = router
+        self.tpc = TPCCoordinator(
+            room_manager.node_id,
+            peer_registry,
+            metrics=metrics,
+            audit_log=room_manager.audit_log,
+            faults=faults,
+        )
         self.clients: Set[WebSocketServerProtocol] = set()
         self.server = None
         # Track which clients are in which rooms
@@ -71,13 +400,267 @@ class WebSocketServer:
         self._room_clients: Dict[str, Set[tuple]] = {}
         # Maps websocket -> set of room_ids
         self._client_rooms: Dict[WebSocketServerProtocol, Set[str]] = {}
+        # Metadata for every connected client
+        self.connections = ConnectionRegistry()
+        # When each user's typing was last fanned out, per room
+        self.typing = TypingThrottle()
+        # Direct messages waiting for their recipients to come online
+        self.direct_messages = DirectMessageBuffer()
+        # Maps websocket -> username it is marked online as
+        self._online_users: Dict[WebSocketServerProtocol, str] = {}
+        # Room messages handed to local clients, for delivery receipts
+        self.receipts = ReceiptTracker()
+        # Sequence numbers handed to local clients, to repair their streams
+        self.stream_repair = StreamRepair()
+        # Rooms and users each connected user muted
+        self.mutes = MuteRegistry()
+        # Set once the node starts shutting down; new clients are turned
+        # away with the shutdown notice
+        self.draining = False
+        self._shutdown_notice: Optional[dict] = None
+        # Maps message type -> handler coroutine
+        self._handlers: Dict[str, MessageHandler] = {}
+        self._register_default_handlers()
+        if metrics is not None:
+            metrics.track_clients(self.connections)
+            metrics.track_rooms(room_manager)
+            metrics.track_dispatch(
+                {"deliver": self.dispatcher, "fanout": fanout}
+            )
+            if streams is not None:
+                metrics.track_streams(streams)
+
+    def _register_default_handlers(self):
+        """Register the handlers for the built-in client message types."""
+        self.register_handler("protocol_info", self.handle_protocol_info)
+        self.register_handler("pong", self.handle_pong)
+        self.register_handler("list_rooms", self.handle_list_rooms)
+        self.register_handler("create_room", self.handle_create_room)
+        self.register_handler("discover_rooms", self.handle_discover_rooms)
+        self.register_handler("join_room", self.handle_join_room)
+        self.register_handler("create_invite", self.handle_create_invite)
+        self.register_handler("revoke_invite", self.handle_revoke_invite)
+        self.register_handler("join_by_invite", self.handle_join_by_invite)
+        self.register_handler("get_history", self.handle_get_history)
+        self.register_handler("search", self.handle_search)
+        self.register_handler("register_webhook", self.handle_register_webhook)
+        self.register_handler("remove_webhook", self.handle_remove_webhook)
+        self.register_handler("list_webhooks", self.handle_list_webhooks)
+        self.register_handler("add_bridge", self.handle_add_bridge)
+        self.register_handler("remove_bridge", self.handle_remove_bridge)
+        self.register_handler("list_bridges", self.handle_list_bridges)
+        self.register_handler("register_bot", self.handle_register_bot)
+        self.register_handler("remove_bot", self.handle_remove_bot)
+        self.register_handler("list_bots", self.handle_list_bots)
+        self.register_handler("bot_login", self.handle_bot_login)
+        self.register_handler("service_login", self.handle_service_login)
+        self.register_handler("leave_room", self.handle_leave_room)
+        self.register_handler("kick_user", self.handle_kick_user)
+        self.register_handler("ban_user", self.handle_ban_user)
+        self.register_handler("promote_member", self.handle_promote_member)
+        self.register_handler("demote_member", self.handle_demote_member)
+        self.register_handler("set_retention", self.handle_set_retention)
+        self.register_handler(
+            "set_spam_thresholds", self.handle_set_spam_thresholds
+        )
+        self.register_handler(
+            "set_content_filters", self.handle_set_content_filters
+        )
+        self.register_handler("update_room", self.handle_update_room)
+        self.register_handler("send_message", self.handle_send_message)
+        self.register_handler("list_scheduled", self.handle_list_scheduled)
+        self.register_handler(
+            "cancel_scheduled", self.handle_cancel_scheduled
+        )
+        self.register_handler("edit_message", self.handle_edit_message)
+        self.register_handler("delete_message", self.handle_delete_message)
+        self.register_handler("pin_message", self.handle_pin_message)
+        self.register_handler("unpin_message", self.handle_unpin_message)
+        self.register_handler("react", self.handle_react)
+        self.register_handler(
+            "message_received", self.handle_message_received
+        )
+        self.register_handler("typing", self.handle_typing)
+        self.register_handler("mark_read", self.handle_mark_read)
+        self.register_handler("get_read_state", self.handle_get_read_state)
+        self.register_handler("publish_key", self.handle_publish_key)
+        self.register_handler("get_room_keys", self.handle_get_room_keys)
+        self.register_handler("start_upload", self.handle_start_upload)
+        self.register_handler("upload_chunk", self.handle_upload_chunk)
+        self.register_handler("finish_upload", self.handle_finish_upload)
+        self.register_handler("get_attachment", self.handle_get_attachment)
+        self.register_handler(
+            "send_direct_message", self.handle_send_direct_message
+        )
+        self.register_handler(
+            "announce_presence", self.handle_announce_presence
+        )
+        self.register_handler("set_status", self.handle_set_status)
+        self.register_handler("resume_session", self.handle_resume_session)
+        self.register_handler("get_presence", self.handle_get_presence)
+        self.register_handler("update_profile", self.handle_update_profile)
+        self.register_handler("get_profile", self.handle_get_profile)
+        self.register_handler(
+            "register_push_token", self.handle_register_push_token
+        )
+        self.register_handler(
+            "unregister_push_token", self.handle_unregister_push_token
+        )
+        self.register_handler("update_mutes", self.handle_update_mutes)
+        self.register_handler("block_user", self.handle_block_user)
+        self.register_handler("stats", self.handle_stats)
+        self.register_handler("delete_room", self.handle_delete_room)
+        self.register_handler("register", self.handle_register)
+        self.register_handler("login", self.handle_login)
+        self.register_handler("logout", self.handle_logout)
+        self.register_handler("delete_account", self.handle_delete_account)
+
+    def register_handler(self, message_type: str, handler: MessageHandler):
+        """
+        Register a handler for a client message type.
+
+        Registering a handler for an existing type replaces it.
+
+        Args:
+            message_type: The "type" field of the client message
+            handler: Coroutine called with (websocket, message_data)
+        """
+        self._handlers[message_type] = handler
 
     async def start(self):
         """Start the WebSocket server."""
+        self.dispatcher.bind(asyncio.get_running_loop())
+        ssl_context = self.tls.server_context if self.tls else None
+        # Frames up to twice the payload limit are read so oversized
+        # messages get an error response; larger frames close the
+        # connection (code 1009)
+        if self.compression_threshold is None:
+            compression = {"compression": None}
+        else:
+            compression = {
+                "extensions": deflate_extensions(
+                    self.compression_threshold, self.metrics
+                )
+            }
         self.server = await websockets.serve(
-            self.handle_client, self.host, self.port
+            self.handle_client,
+            self.host,
+            self.port,
+            ssl=ssl_context,
+            max_size=2 * self.max_payload_size,
+            **compression,
+        )
+        scheme = "wss" if ssl_context else "ws"
+        logger.info(
+            f"WebSocket server started on {scheme}://{self.host}:{self.port}"
+        )
+
+    def begin_drain(self):
+        """
+        Start draining: turn away new clients and reject new commands.
+
+        Connected clients stay connected until notify_shutdown().
+        """
+        self.draining = True
+        logger.info("WebSocket server draining, no longer accepting clients")
+
+    async def notify_shutdown(
+        self,
+        retry_after: float,
+        nodes: List[str],
+        handed_off: Dict[str, str],
+        reconnect_urls: Optional[List[str]] = None,
+    ) -> int:
+        """
+        Tell every connected client the node is going away and close it.
+
+        Each client gets a node_shutdown event listing the live nodes and
+        the current admin node of each of its rooms, then its connection
+        is closed with code 1001 (going away).
+
+        Args:
+            retry_after: Seconds clients should wait before reconnecting
+            nodes: IDs of live nodes clients can reconnect to
+            handed_off: Maps rooms handed off during shutdown to their new
+                admin node IDs
+            reconnect_urls: Optional WebSocket URLs of the other nodes
+
+        Returns:
+            int: Number of clients notified
+        """
+        self._shutdown_notice = create_node_shutdown_event(
+            self.room_manager.node_id, retry_after, nodes, {}, reconnect_urls
         )
-        logger.info(f"WebSocket server started on ws://{self.host}:{self.port}")
+        notified = 0
+        for websocket in list(self.clients):
+            rooms = {}
+            for room_id in self._client_rooms.get(websocket, set()):
+                admin = handed_off.get(room_id)
+                if admin is None and self.room_directory:
+                    entry = self.room_directory.get(room_id)
+                    admin = entry.admin_node if entry else None
+                rooms[room_id] = admin
+            event = create_node_shutdown_event(
+                self.room_manager.node_id,
+                retry_after,
+                nodes,
+                rooms,
+                reconnect_urls,
+            )
+            try:
+                await websocket.send(json.dumps(event))
+                await websocket.close(1001, "Node shutting down")
+                notified += 1
+            except websockets.exceptions.ConnectionClosed:
+                pass
+        logger.info(f"Notified {notified} clients of shutdown")
+        return notified
+
+    async def wait_disconnected(self, timeout: float) -> bool:
+        """
+        Wait for every client connection to finish its cleanup.
+
+        Args:
+            timeout: Maximum seconds to wait
+
+        Returns:
+            bool: True if all clients disconnected in time
+        """
+        loop = asyncio.get_running_loop()
+        deadline = loop.time() + timeout
+        while self.clients and loop.time() < deadline:
+            await asyncio.sleep(0.05)
+        return not self.clients
+
+    def client_rooms(self, websocket: WebSocketServerProtocol) -> List[str]:
+        """Get the IDs of the rooms a client has joined through this node."""
+        return sorted(self._client_rooms.get(websocket, set()))
+
+    async def disconnect_client(
+        self, client_id: str, reason: str = "Disconnected by administrator"
+    ) -> bool:
+        """
+        Close a client's connection.
+
+        The connection is closed with code 1008 (policy violation). The
+        client is removed from its rooms by the usual disconnect handling.
+
+        Args:
+            client_id: ID of the client connection
+            reason: Close reason sent to the client
+
+        Returns:
+            bool: True if the client was connected
+        """
+        connection = self.connections.get_by_id(client_id)
+        if connection is None:
+            return False
+        logger.info(f"Disconnecting client {client_id}: {reason}")
+        try:
+            await connection.websocket.close(1008, reason)
+        except websockets.exceptions.ConnectionClosed:
+            pass
+        return True
 
     async def stop(self):
         """Stop the WebSocket server."""
@@ -105,6 +688,14 @@ class WebSocketServer:
             self._client_rooms[websocket] = set()
         self._client_rooms[websocket].add(room_id)
 
+        self.connections.set_username(websocket, username)
+        connection = self.connections.get(websocket)
+        if connection is not None:
+            # Messages from before the join are history, not its stream
+            connection.repaired.setdefault(
+                room_id, self.stream_repair.latest(room_id)
+            )
+
     def unregister_client_room_membership(
         self, websocket: WebSocketServerProtocol, room_id: str = None
     ):
@@ -125,6 +716,9 @@ class WebSocketServer:
                 }
             if websocket in self._client_rooms:
                 self._client_rooms[websocket].discard(room_id)
+            connection = self.connections.get(websocket)
+            if connection is not None:
+                connection.repaired.pop(room_id, None)
         else:
             # Remove from all rooms
             if websocket in self._client_rooms:
@@ -154,13 +748,54 @@ class WebSocketServer:
         if room_id not in self._room_clients:
             return
 
-        message_json = json.dumps(message)
-        for websocket, _ in self._room_clients[room_id]:
-            if websocket != exclude_websocket:
-                try:
-                    await websocket.send(message_json)
-                except websockets.exceptions.ConnectionClosed:
-                    pass
+        frame = encode_frame(message)
+        hidden = self._hidden_from(room_id, message)
+        if message.get("type") == "new_message":
+            self._record_latency(room_id, message.get("data", {}))
+        with start_span("deliver", attributes={"chat.room_id": room_id}):
+            for websocket, username in self._room_clients[room_id]:
+                if websocket != exclude_websocket and username not in hidden:
+                    try:
+                        await self._send(websocket, frame)
+                    except websockets.exceptions.ConnectionClosed:
+                        pass
+        self._leave_on_all_devices(room_id, message)
+
+    def _leave_on_all_devices(self, room_id: str, message: dict):
+        """
+        Take a user who left a room out of it on all their connections.
+
+        Membership belongs to the user, so leaving from one device leaves
+        the room on the others too, wherever they are connected; they get
+        the member_left event and then stop receiving the room. After a
+        room_archived event nobody receives the room any more.
+
+        Args:
+            room_id: The room ID
+            message: A message just broadcast to the room
+        """
+        if message.get("type") == "member_left":
+            username = message.get("data", {}).get("username")
+            self._take_out_of_room(room_id, username)
+        elif message.get("type") == "room_archived":
+            self._room_clients.pop(room_id, None)
+
+    def _record_latency(self, room_id: str, message: dict):
+        """
+        Record the delivery latency of a message for the statistics.
+
+        Args:
+            room_id: The room ID
+            message: The delivered message, with its sequencing timestamp
+        """
+        try:
+            sequenced = datetime.fromisoformat(message["timestamp"])
+        except (KeyError, TypeError, ValueError):
+            return
+        if sequenced.tzinfo is None:
+            sequenced = sequenced.replace(tzinfo=timezone.utc)
+        latency = datetime.now(timezone.utc) - sequenced
+        self.stats.record_delivery(room_id, latency.total_seconds())
 
     def broadcast_to_room_sync(
         self,
@@ -177,27 +812,72 @@ class WebSocketServer:
             message: The message to broadcast
             exclude_user: Optional username to exclude from broadcast
         """
+        if message.get("type") == "new_message":
+            self._record_delivery(room_id, message.get("data", {}))
 
         async def _do_broadcast():
             if room_id not in self._room_clients:
                 return
-            message_json = json.dumps(message)
-            for websocket, username in self._room_clients[room_id]:
-                if username != exclude_user:
-                    try:
-                        await websocket.send(message_json)
-                    except websockets.exceptions.ConnectionClosed:
-                        pass
+            frame = encode_frame(message)
+            hidden = self._hidden_from(room_id, message) | {exclude_user}
+            with start_span("deliver", attributes={"chat.room_id": room_id}):
+                for websocket, username in self._room_clients[room_id]:
+                    if username not in hidden:
+                        try:
+                            await self._send(websocket, frame)
+                        except websockets.exceptions.ConnectionClosed:
+                            pass
+            self._leave_on_all_devices(room_id, message)
+
+        self.dispatcher.submit(room_id, _do_broadcast)
+
+    def _broadcast_to_peers(
+        self, room_id: str, event_type: str, event_data: dict
+    ):
+        """
+        Send a room event to the peers, through the fan-out pool if set.
 
-        try:
-            loop = asyncio.get_event_loop()
-            if loop.is_running():
-                asyncio.ensure_future(_do_broadcast())
-            else:
-                loop.run_until_complete(_do_broadcast())
-        except RuntimeError:
-            # No event loop running, create new one
-            asyncio.run(_do_broadcast())
+        Args:
+            room_id: The room ID
+            event_type: Type of event (e.g., "member_joined")
+            event_data: Event data
+        """
+        if self.fanout is None:
+            broadcast_to_peers(
+                self.peer_registry, room_id, event_type, event_data
+            )
+            return
+        self.fanout.submit(
+            room_id,
+            broadcast_to_peers,
+            self.peer_registry,
+            room_id,
+            event_type,
+            event_data,
+        )
+
+    def _broadcast_message_to_peers(self, room_id: str, message: dict):
+        """
+        Send a room message to the peers, through the fan-out pool if set
+        and on the message streams if set. Messages of at-most-once rooms
+        get a single call per peer instead.
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+        """
+        if not delivery_policy(message.get("delivery")).retry:
+            send = broadcast_message_to_peers
+            args = (self.peer_registry, room_id, message, 0)
+        elif self.streams is not None:
+            send, args = self.streams.send, (room_id, message)
+        else:
+            send = broadcast_message_to_peers
+            args = (self.peer_registry, room_id, message)
+        if self.fanout is None:
+            send(*args)
+        else:
+            self.fanout.submit(room_id, send, *args)
 
     async def handle_client(self, websocket: WebSocketServerProtocol):
         """
@@ -206,12 +886,41 @@ class WebSocketServer:
         Args:
             websocket: The WebSocket connection
         """
+        if self.draining:
+            # Shutting down: send the reconnect hint and turn the client away
+            if self._shutdown_notice:
+                await self._send(websocket, json.dumps(self._shutdown_notice))
+            await websocket.close(1001, "Node shutting down")
+            return
+        if self.load_balancer is not None:
+            target = self.load_balancer.redirect_target(len(self.clients))
+            if target is not None:
+                await self._redirect(websocket, target)
+                return
+
         # Register client
         self.clients.add(websocket)
-        client_id = id(websocket)
+        connection = self.connections.register(websocket)
+        client_id = connection.client_id
+        connection.send_queue = SendQueue(
+            websocket,
+            self.send_queue_size,
+            self.send_queue_policy,
+            self._record_overflow,
+        )
+        connection.send_queue.start()
+        if self.keepalive:
+            self.keepalive.touch(connection)
         logger.info(f"Client {client_id} connected")
 
         try:
+            if self.offline_queue:
+                event = create_session_started_event(
+                    connection.session_id,
+                    client_id,
+                    self.offline_queue.retention,
+                )
+                await self._send(websocket, json.dumps(event))
             async for message in websocket:
                 await self.process_message(websocket, message)
         except websockets.exceptions.ConnectionClosed:
@@ -219,10 +928,63 @@ class WebSocketServer:
         except Exception as e:
             logger.error(f"Error handling client {client_id}: {e}")
         finally:
+            await connection.send_queue.close()
             # Handle client disconnection
             await self._handle_client_disconnect(websocket)
             # Unregister client
             self.clients.discard(websocket)
+            self.connections.unregister(websocket)
+            self._mark_offline(websocket)
+            if self.rate_limiter:
+                self.rate_limiter.forget_connection(client_id)
+
+    async def _redirect(
+        self, websocket: WebSocketServerProtocol, target: NodeLoad
+    ):
+        """
+        Turn a new client away with a redirect frame naming a peer.
+
+        Args:
+            websocket: The WebSocket connection, not yet registered
+            target: Load of the peer the client should connect to
+        """
+        event = create_redirect_event(
+            self.room_manager.node_id, target.node_id, target.ws_url
+        )
+        await websocket.send(json.dumps(event))
+        await websocket.close(1013, "Node overloaded")
+        if self.metrics is not None:
+            self.metrics.record_redirect(target.node_id)
+        logger.info(
+            f"Redirected new client to {target.node_id} "
+            f"({target.connections} clients there, {len(self.clients)} here)"
+        )
+
+    async def _send(
+        self, websocket: WebSocketServerProtocol, data: Union[str, Frame]
+    ):
+        """
+        Send a message to a client.
+
+        Messages to connected clients go through their send queue, so a
+        slow client never holds up the sender. Messages sent to several
+        clients are passed as one Frame (see send_queue.py), serialized
+        and encoded once for all of them.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The JSON-encoded message, or a Frame
+        """
+        connection = self.connections.get(websocket)
+        if connection is None or connection.send_queue is None:
+            await websocket.send(data.text if isinstance(data, Frame) else data)
+        else:
+            connection.send_queue.put(data)
+
+    def _record_overflow(self, policy: str):
+        """Count a full send queue in the metrics, if enabled."""
+        if self.metrics is not None:
+            self.metrics.record_send_queue_overflow(policy)
 
     async def _handle_client_disconnect(
         self, websocket: WebSocketServerProtocol
@@ -231,11 +993,14 @@ class WebSocketServer:
         Handle cleanup when a client disconnects.
 
         This method:
-        1. Gets all rooms the client was in
-        2. For each room:
+        1. Gets all rooms the client was in, leaving out rooms the user
+           is still in on another connection to this node
+        2. If an offline queue is configured, holds the user's session
+           so they stay in the rooms until it expires or is resumed
+        3. Otherwise, for each room:
            - If local (we are admin): removes member and broadcasts
            - If remote: notifies the admin node via XML-RPC
-        3. Unregisters the client from room tracking
+        4. Unregisters the client from room tracking
 
         Args:
             websocket: The WebSocket connection that disconnected
@@ -244,7 +1009,22 @@ class WebSocketServer:
         if websocket not in self._client_rooms:
             return
 
-        rooms_copy = list(self._client_rooms.get(websocket, set()))
+        connection = self.connections.get(websocket)
+        username = connection.username if connection else None
+        rooms_copy = [
+            room_id
+            for room_id in self._client_rooms.get(websocket, set())
+            if not self._on_other_device(websocket, room_id)
+        ]
+        if self.offline_queue and username and rooms_copy:
+            status = None
+            if self.presence:
+                status = self.presence.get_status(username)
+            self.offline_queue.hold(
+                username, set(rooms_copy), connection.session_id, status
+            )
+            self.unregister_client_room_membership(websocket)
+            return
 
         for room_id in rooms_copy:
             # Find the username for this client in this room
@@ -258,40 +1038,123 @@ class WebSocketServer:
             if not username:
                 continue
 
-            # Check if this is a local room (we are the administrator)
-            room = self.room_manager.get_room(room_id)
+            await self._remove_disconnected_member(room_id, username, websocket)
 
-            if room:
-                # Local room - we are the administrator
-                # Remove member from room
-                self.room_manager.remove_member(room_id, username)
+        # Finally, unregister from room membership tracking
+        self.unregister_client_room_membership(websocket)
 
-                # Broadcast member_left to remaining members
-                event_data = create_member_left_event(
-                    room_id=room_id,
-                    username=username,
-                    member_count=len(room.members),
-                    timestamp=datetime.now(timezone.utc).isoformat(),
-                    reason="User disconnected",
-                )
-                broadcast_msg = {"type": "member_left", "data": event_data}
-                await self.broadcast_to_room(room_id, broadcast_msg, websocket)
+    def _on_other_device(
+        self, websocket: WebSocketServerProtocol, room_id: str
+    ) -> bool:
+        """Check if a client's user is in a room on another connection."""
+        clients = self._room_clients.get(room_id, set())
+        usernames = {user for ws, user in clients if ws == websocket}
+        return any(
+            ws != websocket and user in usernames for ws, user in clients
+        )
 
-                # Also broadcast to peer nodes
-                broadcast_to_peers(
-                    self.peer_registry, room_id, "member_left", event_data
-                )
+    async def _remove_disconnected_member(
+        self,
+        room_id: str,
+        username: str,
+        websocket: Optional[WebSocketServerProtocol] = None,
+    ):
+        """
+        Take a disconnected user out of a room.
 
-                logger.info(
-                    f"User {username} removed from local room {room_id} "
-                    f"(disconnected)"
-                )
-            else:
-                # Remote room - notify the administrator node
-                await self._notify_admin_of_disconnect(room_id, username)
+        Users still connected to the room through another node stay in
+        it.
 
-        # Finally, unregister from room membership tracking
-        self.unregister_client_room_membership(websocket)
+        Args:
+            room_id: The room ID
+            username: The username of the disconnected member
+            websocket: The closed connection, excluded from the broadcast
+        """
+        # Check if this is a local room (we are the administrator)
+        room = self.room_manager.get_room(room_id)
+
+        if room:
+            # Local room - we are the administrator
+            # Remove member from room
+            if not self.room_manager.remove_member_node(
+                room_id, username, self.room_manager.node_id
+            ):
+                return
+
+            # Broadcast member_left to remaining members
+            event_data = create_member_left_event(
+                room_id=room_id,
+                username=username,
+                member_count=len(room.members),
+                timestamp=datetime.now(timezone.utc).isoformat(),
+                reason="User disconnected",
+                hlc=self.room_manager.clock.now().encode(),
+            )
+            broadcast_msg = {"type": "member_left", "data": event_data}
+            await self.broadcast_to_room(room_id, broadcast_msg, websocket)
+
+            # Also broadcast to peer nodes
+            self._broadcast_to_peers(room_id, "member_left", event_data)
+
+            logger.info(
+                f"User {username} removed from local room {room_id} "
+                f"(disconnected)"
+            )
+            await self._admit_waitlisted(room_id)
+        else:
+            # Remote room - notify the administrator node
+            await self._notify_admin_of_disconnect(room_id, username)
+            if self.replica_store:
+                self.replica_store.remove_local_member(room_id, username)
+
+    def _locate_room_admin(
+        self, room_id: str
+    ) -> Tuple[Optional[dict], Optional[str]]:
+        """
+        Find a remote room and the address of its administrator node.
+
+        The gossiped room directory is consulted first. If the room is not
+        known there, its owner on the hash ring is used with sharding, and
+        otherwise all peers are queried via global discovery.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            tuple: (room dict or None if not found, admin node address or
+            None if it cannot be determined)
+        """
+        target_room = None
+        if self.room_registry:
+            target_room = self.room_registry.get(room_id)
+        if not target_room and self.room_directory:
+            entry = self.room_directory.get(room_id)
+            if entry:
+                target_room = entry.to_room_dict()
+        if not target_room and self.sharding:
+            owner = self.sharding.owner_of(room_id)
+            if owner != self.room_manager.node_id:
+                target_room = {"room_id": room_id, "admin_node": owner}
+
+        if not target_room and self.peer_registry:
+            local_rooms = self.room_manager.list_rooms()
+            discovery_result = self.peer_registry.discover_global_rooms(
+                local_rooms
+            )
+            for room in discovery_result.get("rooms", []):
+                if room.get("room_id") == room_id:
+                    target_room = room
+                    break
+
+        if not target_room:
+            return None, None
+
+        node_address = target_room.get("node_address")
+        if not node_address and self.peer_registry:
+            node_address = self.peer_registry.get_peer_address(
+                target_room.get("admin_node")
+            )
+        return target_room, node_address
 
     async def _notify_admin_of_disconnect(self, room_id: str, username: str):
         """
@@ -307,16 +1170,8 @@ class WebSocketServer:
             )
             return
 
-        # Discover rooms to find the admin node
-        local_rooms = self.room_manager.list_rooms()
-        discovery_result = self.peer_registry.discover_global_rooms(local_rooms)
-
-        # Find the room in the discovered rooms
-        target_room = None
-        for room in discovery_result.get("rooms", []):
-            if room.get("room_id") == room_id:
-                target_room = room
-                break
+        # Find the admin node for the room
+        target_room, node_address = self._locate_room_admin(room_id)
 
         if not target_room:
             logger.warning(
@@ -325,12 +1180,6 @@ class WebSocketServer:
             )
             return
 
-        # Get the admin node address
-        node_address = target_room.get("node_address")
-        if not node_address:
-            admin_node = target_room.get("admin_node")
-            node_address = self.peer_registry.get_peer_address(admin_node)
-
         if not node_address:
             logger.warning(
                 f"Could not get address for admin node of room {room_id}"
@@ -372,558 +1221,864 @@ class WebSocketServer:
             websocket: The WebSocket connection
             message: The message string (JSON)
         """
-        try:
-            data = json.loads(message)
-            message_type = data.get("type")
-
-            if message_type == "list_rooms":
-                await self.handle_list_rooms(websocket)
-            elif message_type == "create_room":
-                await self.handle_create_room(websocket, data)
-            elif message_type == "discover_rooms":
-                await self.handle_discover_rooms(websocket, data)
-            elif message_type == "join_room":
-                await self.handle_join_room(websocket, data)
-            elif message_type == "leave_room":
-                await self.handle_leave_room(websocket, data)
-            elif message_type == "send_message":
-                await self.handle_send_message(websocket, data)
-            elif message_type == "delete_room":
-                await self.handle_delete_room(websocket, data)
-            else:
-                logger.warning(f"Unknown message type: {message_type}")
-                await self.send_error(
-                    websocket, f"Unknown message type: {message_type}"
-                )
+        connection = self.connections.get(websocket)
+        if self.keepalive and connection and self.keepalive.touch(connection):
+            logger.info(f"Client {connection.client_id} is answering again")
+        data, error = parse_client_request(message, self.max_payload_size)
+        if error:
+            logger.warning(f"Rejected client message: {error['error']}")
+            await self._send_validation_error(websocket, None, error)
+            return
 
-        except json.JSONDecodeError as e:
-            logger.error(f"Invalid JSON received: {e}")
-            await self.send_error(websocket, "Invalid JSON format")
-        except Exception as e:
-            logger.error(f"Error processing message: {e}")
-            await self.send_error(websocket, str(e))
+        context = self._request_context(websocket, data)
+        message_type = data["type"]
+        with log_context(**context), start_span(
+            f"ws {message_type}",
+            SERVER,
+            {
+                "chat.message_type": message_type,
+                "chat.room_id": context["room_id"],
+                "chat.user_id": context["user_id"],
+                "chat.correlation_id": context["correlation_id"],
+            },
+        ):
+            try:
+                if not await self._within_rate_limit(websocket, message_type):
+                    return
+                error = validate_request_fields(data)
+                if error:
+                    logger.warning(
+                        f"Rejected {message_type} from client: "
+                        f"{error['error']}"
+                    )
+                    await self._send_validation_error(websocket, data, error)
+                    return
+                handler = self._handlers.get(message_type)
+                if self.draining and message_type not in (
+                    "leave_room",
+                    "pong",
+                ):
+                    await self.send_error(
+                        websocket,
+                        "Node is shutting down, reconnect to another node",
+                        "node_shutting_down",
+                    )
+                elif handler:
+                    if not await self._authorize(websocket, data):
+                        return
+                    error = self._out_of_scope(websocket, data)
+                    if error:
+                        logger.warning(
+                            f"Refused {message_type} from service account: "
+                            f"{error['error']}"
+                        )
+                        await self._send_validation_error(
+                            websocket, data, error
+                        )
+                        return
+                    admitted = await self._admit(websocket, context["room_id"])
+                    if admitted is False:
+                        return
+                    try:
+                        await handler(websocket, data)
+                    finally:
+                        if admitted:
+                            self.migrator.leave(context["room_id"])
+                    await self._update_presence(websocket)
+                else:
+                    logger.warning(f"Unknown message type: {message_type}")
+                    await self.send_error(
+                        websocket, f"Unknown message type: {message_type}"
+                    )
+            except Exception as e:
+                logger.error(f"Error processing message: {e}")
+                await self.send_error(websocket, str(e))
 
-    async def handle_list_rooms(self, websocket: WebSocketServerProtocol):
+    async def _admit(
+        self, websocket: WebSocketServerProtocol, room_id
+    ) -> Optional[bool]:
         """
-        Handle a list_rooms request.
+        Hold a request on a room while the room is being migrated.
 
         Args:
             websocket: The WebSocket connection
+            room_id: The room the request is on, if any
+
+        Returns:
+            True if the request was admitted and must be passed to the
+            migrator's leave() once handled, None if it goes ahead
+            without (no migrator, or the room has moved), or False if it
+            was refused and the client told
         """
-        logger.info("Processing list_rooms request")
+        if self.migrator is None or not isinstance(room_id, str):
+            return None
+        if self.migrator.is_migrating(room_id):
+            await asyncio.get_running_loop().run_in_executor(
+                None, self.migrator.wait, room_id
+            )
+        refused = self.migrator.enter(room_id, timeout=0)
+        if refused is None:
+            return True
+        if refused["error_code"] == ROOM_MOVED:
+            return None
+        await self.send_error(
+            websocket, refused["error"], "room_migrating", ROOM_MIGRATING
+        )
+        return False
 
-        # Get all rooms from the room manager
-        rooms = self.room_manager.list_rooms()
+    def _follow_move(self, room_id: str, result) -> bool:
+        """
+        Re-point a room whose old admin answered that it moved.
 
-        # Create response
-        response = {
-            "type": "rooms_list",
-            "data": {"rooms": rooms, "total_count": len(rooms)},
-        }
+        Args:
+            room_id: The room ID
+            result: The old admin's answer
 
-        # Send response
-        await websocket.send(json.dumps(response))
-        logger.info(f"Sent rooms_list response with {len(rooms)} rooms")
+        Returns:
+            True if the room moved and the request should be retried
+        """
+        if not isinstance(result, dict):
+            return False
+        if result.get("error_code") != ROOM_MOVED:
+            return False
+        logger.info(
+            f"Room {room_id} moved to {result['admin_node']}, retrying there"
+        )
+        if self.room_directory:
+            self.room_directory.reassign(
+                room_id, result["admin_node"], result["node_address"]
+            )
+        return True
 
-    async def handle_create_room(
-        self, websocket: WebSocketServerProtocol, data: dict
-    ):
+    def _request_context(
+        self, websocket: WebSocketServerProtocol, data
+    ) -> Dict[str, Optional[str]]:
         """
-        Handle a create_room request.
+        Get the log context of a client message.
+
+        The correlation ID is the message's top-level "correlation_id", or
+        a new one. The room and user are taken from the message's data,
+        falling back to the user the connection last acted as.
 
         Args:
             websocket: The WebSocket connection
-            data: The request data
+            data: The parsed client message
+
+        Returns:
+            Keyword arguments for log_context
         """
-        try:
-            # Extract parameters
-            request_data = data.get("data", {})
-            room_name = request_data.get("room_name")
-            creator_id = request_data.get("creator_id")
-            description = request_data.get("description")
-
-            if not room_name or not creator_id:
-                raise ValueError("Missing room_name or creator_id")
-
-            logger.info(
-                f"Processing create_room request: "
-                f"'{room_name}' by {creator_id}"
-            )
-
-            # Create the room
-            room = self.room_manager.create_room(
-                room_name, creator_id, description
-            )
-
-            # Create response matching the specification
-            response = {
-                "type": "room_created",
-                "data": {
-                    "room_id": room.room_id,
-                    "room_name": room.room_name,
-                    "admin_node": room.admin_node,
-                    "members": list(room.members),
-                    "created_at": room.created_at,
-                },
-            }
-
-            # Send response
-            await websocket.send(json.dumps(response))
-            logger.info(f"Sent room_created response for room {room.room_id}")
-
-        except ValueError as e:
-            logger.error(f"Error creating room: {e}")
-            await self.send_error(websocket, str(e), error_type="room_created")
-        except Exception as e:
-            logger.error(f"Unexpected error creating room: {e}")
-            await self.send_error(
-                websocket, "Internal server error", error_type="room_created"
-            )
+        request_data = data.get("data")
+        if not isinstance(request_data, dict):
+            request_data = {}
+        connection = self.connections.get(websocket)
+        return {
+            "correlation_id": data.get("correlation_id")
+            or new_correlation_id(),
+            "room_id": request_data.get("room_id"),
+            "user_id": request_data.get("username")
+            or request_data.get("creator_id")
+            or (connection.username if connection else None),
+        }
 
-    async def handle_join_room(
-        self, websocket: WebSocketServerProtocol, data: dict
+    async def _send_validation_error(
+        self,
+        websocket: WebSocketServerProtocol,
+        request: Optional[dict],
+        error: dict,
     ):
         """
-        Handle a join_room request.
+        Tell a client its message failed validation.
 
         Args:
             websocket: The WebSocket connection
-            data: The request data
+            request: The parsed message, or None if it couldn't be parsed
+            error: The validation_error dict
         """
-        try:
-            # Extract parameters
-            request_data = data.get("data", {})
-            room_id = request_data.get("room_id")
-            username = request_data.get("username")
-
-            if not room_id or not username:
-                await self.send_join_error(
-                    websocket,
-                    room_id or "",
-                    "Missing room_id or username",
-                    "INVALID_REQUEST",
-                )
-                return
-
-            logger.info(
-                f"Processing join_room request: "
-                f"room {room_id} by {username}"
-            )
-
-            # Check if this node administers the room
-            room = self.room_manager.get_room(room_id)
+        request = request or {}
+        room_id = (request.get("data") or {}).get("room_id")
+        response = create_validation_error_response(
+            request.get("type"),
+            error["error"],
+            error["error_code"],
+            error["field"],
+            room_id if isinstance(room_id, str) else None,
+        )
+        await self._send(websocket, json.dumps(response))
 
-            if room:
-                # Local join - this node is the administrator
-                result = await self._handle_local_join(
-                    websocket, room_id, username
-                )
-            else:
-                # Try remote join - find the administrator node
-                result = await self._handle_remote_join(
-                    websocket, room_id, username
-                )
+    async def _within_rate_limit(
+        self, websocket: WebSocketServerProtocol, message_type
+    ) -> bool:
+        """
+        Count a client command against its connection's and user's limits.
 
-            if result["success"]:
-                # Track that this client is in the room
-                self.register_client_room_membership(
-                    websocket, room_id, username
-                )
+        The user's limit applies once the connection has logged in.
+        Commands over a limit get a rate_limited response.
 
-                # Send success response
-                response = {
-                    "type": "join_room_success",
-                    "data": result["room_info"],
-                }
-                await websocket.send(json.dumps(response))
-                logger.info(
-                    f"User {username} successfully joined room {room_id}"
-                )
+        Args:
+            websocket: The WebSocket connection
+            message_type: The "type" field of the command
 
-                # Send existing messages to the joining user
-                # First try local room (for local joins)
-                room = self.room_manager.get_room(room_id)
-                messages = room.messages if room else []
-                # For remote joins, messages are included in the result
-                if not messages and "messages" in result:
-                    messages = result["messages"]
+        Returns:
+            bool: True if the command may be processed
+        """
+        connection = self.connections.get(websocket)
+        if not self.rate_limiter or connection is None:
+            return True
 
-                if messages:
-                    for message in messages:
-                        msg_response = {
-                            "type": "new_message",
-                            "data": message,
-                        }
-                        await websocket.send(json.dumps(msg_response))
-                    logger.info(
-                        f"Sent {len(messages)} existing messages "
-                        f"to {username}"
-                    )
-            else:
-                await self.send_join_error(
-                    websocket,
-                    room_id,
-                    result["message"],
-                    result.get("error_code", "UNKNOWN_ERROR"),
-                )
+        username = connection.username if connection.session_token else None
+        rejected = self.rate_limiter.acquire(
+            connection.client_id, str(message_type), username
+        )
+        if rejected is None:
+            return True
 
-        except Exception as e:
-            logger.error(f"Error processing join_room: {e}")
-            room_id = data.get("data", {}).get("room_id", "")
-            await self.send_join_error(
-                websocket, room_id, str(e), "INTERNAL_ERROR"
-            )
+        logger.warning(
+            f"Rate limited {message_type} from client "
+            f"{connection.client_id} ({rejected['limit']} limit)"
+        )
+        response = create_rate_limited_response(
+            str(message_type), rejected["limit"], rejected["retry_after"]
+        )
+        await self._send(websocket, json.dumps(response))
+        return False
 
-    async def _handle_local_join(
-        self, websocket: WebSocketServerProtocol, room_id: str, username: str
-    ) -> dict:
+    async def _authorize(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ) -> bool:
         """
-        Handle a join request for a room administered by this node.
+        Check a client command against the client's session.
+
+        The token is taken from the command's top-level "token" field, or
+        from the session bound to the connection at login. If the command
+        names a user (username or creator_id), the session must belong to
+        that user. Rejected commands get an auth_error response.
 
         Args:
             websocket: The WebSocket connection
-            room_id: The room ID
-            username: The username
+            data: The parsed client message
 
         Returns:
-            dict: Result with success status and room_info or error
+            bool: True if the command may be processed
         """
-        room = self.room_manager.get_room(room_id)
-        if not room:
-            return {
-                "success": False,
-                "message": "Room not found",
-                "error_code": "ROOM_NOT_FOUND",
-            }
+        message_type = data.get("type")
+        if not self.auth or message_type in PUBLIC_MESSAGE_TYPES:
+            return True
 
-        # Check if user is already in the room
-        already_member = username in room.members
+        request_data = data.get("data") or {}
+        claimed = request_data.get("username") or request_data.get(
+            "creator_id"
+        )
+        token = data.get("token") or self._session_token(websocket)
+        result = self.auth.authorize(token, claimed)
 
-        if not already_member:
-            # Add user to the room (local node)
-            self.room_manager.add_member(
-                room_id, username, self.room_manager.node_id
+        if not result["success"]:
+            logger.warning(
+                f"Rejected {message_type} from client: {result['error']}"
             )
-
-            # Broadcast member_joined to existing members
-            event_data = create_member_joined_event(
-                room_id=room_id,
-                username=username,
-                member_count=len(room.members),
-                timestamp=datetime.now(timezone.utc).isoformat(),
+            response = create_auth_error_response(
+                message_type, result["error"], result["error_code"]
             )
-            broadcast_msg = {"type": "member_joined", "data": event_data}
-            await self.broadcast_to_room(room_id, broadcast_msg, websocket)
-            logger.info(f"User {username} joined local room {room.room_name}")
+            await self._send(websocket, json.dumps(response))
+            return False
 
-            # Also broadcast to peer nodes
-            broadcast_to_peers(
-                self.peer_registry, room_id, "member_joined", event_data
-            )
-        else:
-            # User is already a member (e.g., room creator)
-            # Just log it - we'll register their WebSocket connection below
-            logger.info(
-                f"User {username} re-joining room {room.room_name} "
-                f"(already a member)"
-            )
+        if token and result.get("username"):
+            self.connections.set_session(websocket, result["username"], token)
+        return True
 
-        return {
-            "success": True,
-            "message": "Successfully joined room",
-            "room_info": {
-                "room_id": room.room_id,
-                "room_name": room.room_name,
-                "description": room.description,
-                "members": list(room.members),
-                "member_count": len(room.members),
-                "admin_node": room.admin_node,
-            },
-        }
+    def _session_token(
+        self, websocket: WebSocketServerProtocol
+    ) -> Optional[str]:
+        """Get the session token bound to a client connection, if any."""
+        connection = self.connections.get(websocket)
+        return connection.session_token if connection else None
 
-    async def _handle_remote_join(
-        self, websocket: WebSocketServerProtocol, room_id: str, username: str
-    ) -> dict:
+    def _auth_args(self, websocket: WebSocketServerProtocol) -> tuple:
+        """Get the trailing token argument for a forwarded XML-RPC call."""
+        token = self._session_token(websocket)
+        return (token,) if token else ()
+
+    async def handle_register(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
         """
-        Handle a join request for a room administered by another node.
+        Handle a register request.
 
         Args:
             websocket: The WebSocket connection
-            room_id: The room ID
-            username: The username
-
-        Returns:
-            dict: Result with success status and room_info or error
+            data: The request data
         """
-        if not self.peer_registry:
-            return {
-                "success": False,
-                "message": "Room not found",
-                "error_code": "ROOM_NOT_FOUND",
-            }
-
-        # Try to find the room on peer nodes
-        # First, discover all rooms to find which node hosts this room
-        local_rooms = self.room_manager.list_rooms()
-        discovery_result = self.peer_registry.discover_global_rooms(local_rooms)
-
-        # Find the room in the discovered rooms
-        target_room = None
-        for room in discovery_result.get("rooms", []):
-            if room.get("room_id") == room_id:
-                target_room = room
-                break
+        if not self.auth:
+            await self.send_error(
+                websocket,
+                "Authentication is not enabled on this node",
+                error_type="register_error",
+            )
+            return
 
-        if not target_room:
-            return {
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+        if (self.bots and self.bots.get(username)) or (
+            self.service_accounts and self.service_accounts.get(username)
+        ):
+            result = {
                 "success": False,
-                "message": "Room not found",
-                "error_code": "ROOM_NOT_FOUND",
+                "error": "Username already taken",
+                "error_code": "USERNAME_TAKEN",
             }
+        else:
+            # Off the event loop: reserving the name may wait for Raft
+            result = await asyncio.get_running_loop().run_in_executor(
+                None,
+                self.auth.register,
+                username,
+                request_data.get("password"),
+            )
+        response_type = (
+            "register_success" if result["success"] else "register_error"
+        )
+        response = {"type": response_type, "data": annotate_error(result)}
+        await self._send(websocket, json.dumps(response))
 
-        # Get the admin node address
-        admin_node = target_room.get("admin_node")
-        node_address = target_room.get("node_address")
+    async def handle_login(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a login request.
 
-        if not node_address:
-            # Try to get address from peer registry
-            node_address = self.peer_registry.get_peer_address(admin_node)
+        On success the session is bound to the connection, so later
+        commands on it need not repeat the token.
 
-        if not node_address:
-            return {
-                "success": False,
-                "message": "Administrator node unavailable",
-                "error_code": "ADMIN_NODE_UNAVAILABLE",
-            }
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        if not self.auth:
+            await self.send_error(
+                websocket,
+                "Authentication is not enabled on this node",
+                error_type="login_error",
+            )
+            return
 
-        # Call XML-RPC on the administrator node
-        try:
-            proxy = ServerProxy(node_address, allow_none=True)
-            result = proxy.join_room(
-                room_id, username, self.room_manager.node_id
+        request_data = data.get("data", {})
+        result = self.auth.login(
+            request_data.get("username"), request_data.get("password")
+        )
+        if result["success"]:
+            self.connections.set_session(
+                websocket, result["username"], result["token"]
             )
+        response_type = "login_success" if result["success"] else "login_error"
+        response = {"type": response_type, "data": annotate_error(result)}
+        await self._send(websocket, json.dumps(response))
 
-            return result
+    async def handle_logout(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a logout request by revoking the client's session.
 
-        except Exception as e:
-            logger.error(f"Failed to join remote room: {e}")
-            return {
-                "success": False,
-                "message": f"Failed to contact administrator node: {e}",
-                "error_code": "ADMIN_NODE_UNAVAILABLE",
-            }
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        if not self.auth:
+            await self.send_error(
+                websocket,
+                "Authentication is not enabled on this node",
+                error_type="logout_error",
+            )
+            return
 
-    async def send_join_error(
-        self,
-        websocket: WebSocketServerProtocol,
-        room_id: str,
-        error: str,
-        error_code: str,
+        token = data.get("token") or self._session_token(websocket)
+        result = self.auth.logout(token or "")
+        self.connections.clear_session(websocket)
+        response_type = (
+            "logout_success" if result["success"] else "logout_error"
+        )
+        response = {"type": response_type, "data": annotate_error(result)}
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_delete_account(
+        self, websocket: WebSocketServerProtocol, data: dict
     ):
         """
-        Send a join_room error response.
+        Handle a delete_account request.
+
+        Request data: username and password. The client gets
+        account_deleted and its connection's session is cleared; the
+        username is released for registering again.
 
         Args:
             websocket: The WebSocket connection
-            room_id: The room ID
-            error: The error message
-            error_code: The error code
+            data: The request data
         """
-        response = create_join_error_response(room_id, error, error_code)
-        await websocket.send(json.dumps(response))
+        if not self.auth:
+            await self.send_error(
+                websocket,
+                "Authentication is not enabled on this node",
+                error_type="delete_account_error",
+            )
+            return
 
-    async def handle_leave_room(
+        request_data = data.get("data", {})
+        result = await asyncio.get_running_loop().run_in_executor(
+            None,
+            self.auth.delete_account,
+            request_data.get("username"),
+            request_data.get("password"),
+        )
+        if result["success"]:
+            self.connections.clear_session(websocket)
+        response_type = (
+            "account_deleted" if result["success"] else "delete_account_error"
+        )
+        response = {"type": response_type, "data": annotate_error(result)}
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_register_bot(
         self, websocket: WebSocketServerProtocol, data: dict
     ):
         """
-        Handle a leave_room request.
+        Handle a register_bot request.
+
+        Request data: username, bot_name and commands (like "/roll"). The
+        client gets bot_registered with the bot and its API key, which is
+        shown only this once.
 
         Args:
             websocket: The WebSocket connection
             data: The request data
         """
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+        bot_name = request_data.get("bot_name")
         try:
-            # Extract parameters
-            request_data = data.get("data", {})
-            room_id = request_data.get("room_id")
-            username = request_data.get("username")
+            self._check_bots_enabled()
+            if (self.auth and self.auth.has_account(bot_name)) or (
+                self.service_accounts and self.service_accounts.get(bot_name)
+            ):
+                raise BotError("Bot name already taken", "BOT_NAME_TAKEN")
+            bot, api_key = self.bots.register(
+                username, bot_name, request_data.get("commands") or []
+            )
+        except BotError as e:
+            await self._send_bot_error(websocket, "register_bot", e)
+            return
+        response = {
+            "type": "bot_registered",
+            "data": {"bot": bot, "api_key": api_key},
+        }
+        await self._send(websocket, json.dumps(response))
 
-            if not room_id or not username:
-                await self.send_error(websocket, "Missing room_id or username")
-                return
+    async def handle_remove_bot(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a remove_bot request from a bot's owner.
 
-            logger.info(
-                f"Processing leave_room request: "
-                f"room {room_id} by {username}"
-            )
+        Request data: username and bot_name. The client gets bot_removed;
+        the bot's API key stops working.
 
-            # Remove client from room membership tracking
-            self.unregister_client_room_membership(websocket, room_id)
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        bot_name = request_data.get("bot_name")
+        try:
+            self._check_bots_enabled()
+            self.bots.remove(request_data.get("username"), bot_name)
+        except BotError as e:
+            await self._send_bot_error(websocket, "remove_bot", e)
+            return
+        response = {"type": "bot_removed", "data": {"bot_name": bot_name}}
+        await self._send(websocket, json.dumps(response))
 
-            # Check if this is a local or remote room
-            room = self.room_manager.get_room(room_id)
-            if room:
-                # Local room - handle directly
-                self.room_manager.remove_member(room_id, username)
+    async def handle_list_bots(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a list_bots request for the bots a user registered here.
 
-                # Broadcast member_left to remaining local members
-                event_data = create_member_left_event(
-                    room_id=room_id,
-                    username=username,
-                    member_count=len(room.members),
-                    timestamp=datetime.now(timezone.utc).isoformat(),
-                )
-                broadcast_msg = {"type": "member_left", "data": event_data}
-                await self.broadcast_to_room(room_id, broadcast_msg, websocket)
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        try:
+            self._check_bots_enabled()
+        except BotError as e:
+            await self._send_bot_error(websocket, "list_bots", e)
+            return
+        response = {
+            "type": "bots",
+            "data": {"bots": self.bots.list_bots(request_data.get("username"))},
+        }
+        await self._send(websocket, json.dumps(response))
 
-                # Also broadcast to peer nodes
-                broadcast_to_peers(
-                    self.peer_registry, room_id, "member_left", event_data
-                )
-            else:
-                # Remote room - call XML-RPC on the admin node
-                await self._handle_remote_leave(room_id, username)
+    async def handle_bot_login(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a bot_login request from a bot program.
 
-            # Send success response
-            response = {
-                "type": "leave_room_success",
-                "data": {
-                    "room_id": room_id,
-                    "username": username,
-                },
-            }
-            await websocket.send(json.dumps(response))
-            logger.info(f"User {username} left room {room_id}")
+        Request data: bot_name and api_key. On success the connection acts
+        as the bot, with a session token when authentication is enabled,
+        and the bot gets bot_login_success with its commands. Rooms it
+        joins afterwards route those commands to it.
 
-        except Exception as e:
-            logger.error(f"Error processing leave_room: {e}")
-            await self.send_error(websocket, str(e))
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        try:
+            self._check_bots_enabled()
+            bot = self.bots.authenticate(
+                request_data.get("bot_name"), request_data.get("api_key")
+            )
+        except BotError as e:
+            await self._send_bot_error(websocket, "bot_login", e)
+            return
 
-    async def _handle_remote_leave(self, room_id: str, username: str):
+        result = {"bot_name": bot.name, "commands": list(bot.commands)}
+        if self.auth:
+            session = self.auth.issue_token(bot.name)
+            self.connections.set_session(websocket, bot.name, session["token"])
+            result["token"] = session["token"]
+            result["expires_at"] = session["expires_at"]
+        else:
+            self.connections.set_username(websocket, bot.name)
+        connection = self.connections.get(websocket)
+        if connection:
+            connection.bot = True
+        response = {"type": "bot_login_success", "data": result}
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Bot {bot.name} logged in")
+
+    async def handle_service_login(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
         """
-        Handle leaving a remote room by calling XML-RPC on the admin node.
+        Handle a service_login request from an automated client.
+
+        Request data: account and api_key. On success the connection acts
+        as the service account, with a session token when authentication
+        is enabled, and its commands are limited to the account's scopes
+        and rooms (see service_accounts.py). The client gets
+        service_login_success with the scopes and rooms.
 
         Args:
-            room_id: The room ID
-            username: The username
+            websocket: The WebSocket connection
+            data: The request data
         """
-        if not self.peer_registry:
+        request_data = data.get("data", {})
+        try:
+            if self.service_accounts is None:
+                raise ServiceAccountError(
+                    "Service accounts are disabled on this node",
+                    "SERVICE_ACCOUNTS_DISABLED",
+                )
+            account = self.service_accounts.authenticate(
+                request_data.get("account"), request_data.get("api_key")
+            )
+        except ServiceAccountError as e:
+            await self.send_error(
+                websocket, str(e), "service_login_error", e.error_code
+            )
             return
 
-        # Discover rooms to find the admin node
-        local_rooms = self.room_manager.list_rooms()
-        discovery_result = self.peer_registry.discover_global_rooms(local_rooms)
+        result = account.public()
+        if self.auth:
+            session = self.auth.issue_token(account.name)
+            self.connections.set_session(
+                websocket, account.name, session["token"]
+            )
+            result["token"] = session["token"]
+            result["expires_at"] = session["expires_at"]
+        else:
+            self.connections.set_username(websocket, account.name)
+        connection = self.connections.get(websocket)
+        if connection:
+            connection.service_account = account.name
+        response = {"type": "service_login_success", "data": result}
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Service account {account.name} logged in")
+
+    def _out_of_scope(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ) -> Optional[dict]:
+        """
+        Check a command from a service account against its scopes.
 
-        # Find the room in the discovered rooms
-        target_room = None
-        for room in discovery_result.get("rooms", []):
-            if room.get("room_id") == room_id:
-                target_room = room
-                break
+        Args:
+            websocket: The WebSocket connection
+            data: The parsed client message
 
-        if not target_room:
-            logger.warning(f"Could not find admin node for room {room_id}")
-            return
+        Returns:
+            dict: OUT_OF_SCOPE validation error if the connection is a
+            service account's and the command isn't allowed to it (or the
+            account was removed), else None
+        """
+        connection = self.connections.get(websocket)
+        if connection is None or connection.service_account is None:
+            return None
+        account = self.service_accounts.get(connection.service_account)
+        if account is None:
+            reason = "The service account was removed"
+        else:
+            reason = account.refusal(data["type"], data.get("data") or {})
+        if reason is None:
+            return None
+        return {"error": reason, "error_code": "OUT_OF_SCOPE", "field": None}
 
-        # Get the admin node address
-        node_address = target_room.get("node_address")
-        if not node_address:
-            admin_node = target_room.get("admin_node")
-            node_address = self.peer_registry.get_peer_address(admin_node)
+    async def _register_room_bot(
+        self, websocket: WebSocketServerProtocol, room_id: str, bot_name: str
+    ):
+        """
+        Register a bot's commands with a room it joined.
 
-        if not node_address:
-            logger.warning(
-                f"Could not get address for admin node of room {room_id}"
-            )
+        The bot gets bot_commands_registered, or bot_error if another bot
+        in the room already handles one of its commands.
+
+        Args:
+            websocket: The bot's WebSocket connection
+            room_id: The room ID
+            bot_name: The bot
+        """
+        bot = self.bots.get(bot_name) if self.bots else None
+        if bot is None:
             return
+        if self.room_manager.get_room(room_id):
+            try:
+                self.room_manager.set_room_bot(room_id, bot_name, bot.commands)
+                result = {"success": True}
+            except BotError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "set_room_bot",
+                room_id,
+                bot_name,
+                list(bot.commands),
+                *self._auth_args(websocket),
+            )
 
-        # Call XML-RPC to leave the room
-        try:
-            proxy = ServerProxy(node_address, allow_none=True)
-            proxy.leave_room(room_id, username, self.room_manager.node_id)
-        except Exception as e:
-            logger.error(f"Failed to leave remote room: {e}")
+        if not result.get("success"):
+            response = create_bot_error_response(
+                "join_room",
+                result.get("error", "Failed to register bot commands"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+        else:
+            response = {
+                "type": "bot_commands_registered",
+                "data": {
+                    "room_id": room_id,
+                    "bot_name": bot_name,
+                    "commands": list(bot.commands),
+                },
+            }
+        await self._send(websocket, json.dumps(response))
 
-    async def handle_discover_rooms(
+    def _check_bots_enabled(self) -> None:
+        """Raise BotError(BOTS_DISABLED) if this node has no bot registry."""
+        if self.bots is None:
+            raise BotError("Bots are disabled on this node", "BOTS_DISABLED")
+
+    async def _send_bot_error(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        error: BotError,
+    ):
+        """Send a bot_error response for a refused bot request."""
+        response = create_bot_error_response(
+            request_type, str(error), error.error_code
+        )
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_pong(
         self, websocket: WebSocketServerProtocol, data: dict
     ):
         """
-        Handle a discover_rooms request for global room discovery.
+        Handle a pong, a client's answer to a ping event.
+
+        Like any other message it was recorded as a sign of life when it
+        arrived. A pong may report, under ``sequences``, the highest
+        sequence number the client received without a gap in each of its
+        rooms; messages it is missing are sent to it again (see
+        stream_repair.py). Nothing else is sent back.
 
         Args:
             websocket: The WebSocket connection
             data: The request data
         """
-        logger.info("Processing discover_rooms request")
+        sequences = (data.get("data") or {}).get("sequences")
+        if isinstance(sequences, dict):
+            await self._repair_streams(websocket, sequences)
 
-        try:
-            # Check if peer registry is available
-            if not self.peer_registry:
-                # Fall back to local rooms only
-                logger.warning(
-                    "Peer registry not available, returning local rooms only"
-                )
-                rooms = self.room_manager.list_rooms()
-                response = {
-                    "type": "global_rooms_list",
-                    "data": {
-                        "rooms": rooms,
-                        "total_count": len(rooms),
-                        "nodes_queried": [self.room_manager.node_id],
-                        "nodes_available": [self.room_manager.node_id],
-                        "nodes_unavailable": [],
-                    },
-                }
-            else:
-                # Get local rooms
-                local_rooms = self.room_manager.list_rooms()
+    async def _repair_streams(
+        self, websocket: WebSocketServerProtocol, sequences: dict
+    ):
+        """
+        Send a client again the room messages it reported missing.
 
-                # Discover rooms from all nodes (including peers)
-                discovery_result = self.peer_registry.discover_global_rooms(
-                    local_rooms
+        Args:
+            websocket: The WebSocket connection
+            sequences: Maps room_id -> highest sequence number the client
+                received without a gap
+        """
+        connection = self.connections.get(websocket)
+        if connection is None:
+            return
+        rooms = self._client_rooms.get(websocket, set())
+        for room_id, seen in sorted(sequences.items()):
+            if (
+                room_id not in rooms
+                or isinstance(seen, bool)
+                or not isinstance(seen, int)
+            ):
+                continue
+            missing = self.stream_repair.missing(
+                room_id, seen, connection.repaired.get(room_id, 0)
+            )
+            if missing is None:
+                continue
+            messages = await self._sequence_range(room_id, *missing)
+            if messages is None:
+                continue
+            connection.repaired[room_id] = missing[1]
+            sent = 0
+            for message in messages:
+                if not delivery_policy(message.get("delivery")).retry:
+                    continue
+                if connection.username in self._filtering(
+                    message.get("username")
+                ):
+                    continue
+                await self._send(
+                    websocket,
+                    json.dumps(
+                        {
+                            "type": "new_message",
+                            "data": {**message, "retransmitted": True},
+                        }
+                    ),
                 )
-
-                # Create response
-                response = {
-                    "type": "global_rooms_list",
-                    "data": discovery_result,
-                }
-
-            # Send response
-            await websocket.send(json.dumps(response))
+                sent += 1
             logger.info(
-                f"Sent global_rooms_list response with "
-                f"{response['data']['total_count']} rooms"
+                f"Repaired stream of {connection.client_id} in room "
+                f"{room_id}: #{missing[0]}-#{missing[1]}, sent {sent}"
             )
 
-        except Exception as e:
-            logger.error(f"Error discovering rooms: {e}")
-            await self.send_error(
-                websocket, "Failed to discover rooms", error_type="error"
+    async def _sequence_range(
+        self, room_id: str, first: int, last: int
+    ) -> Optional[List[dict]]:
+        """
+        Get a room's messages in a range of sequence numbers.
+
+        Args:
+            room_id: The room ID
+            first: First sequence number, inclusive
+            last: Last sequence number, inclusive
+
+        Returns:
+            The messages still in the room's history, from this node or
+            the room's admin, or None if the admin can't be reached
+        """
+        if self.room_manager.get_room(room_id):
+            return self.room_manager.get_sequence_range(room_id, first, last)
+        result = await self._call_room_admin(
+            room_id, "retransmit_messages", room_id, first, last
+        )
+        if not result.get("success"):
+            logger.warning(
+                f"Could not repair streams in room {room_id}: "
+                f"{result.get('error')}"
             )
+            return None
+        return result.get("messages", [])
 
-    async def send_error(
-        self,
-        websocket: WebSocketServerProtocol,
-        error_message: str,
-        error_type: str = "error",
+    async def handle_protocol_info(
+        self, websocket: WebSocketServerProtocol, data: dict
     ):
         """
-        Send an error response to a client.
+        Handle a protocol_info request.
+
+        The client gets protocol_info with the client protocol version,
+        the commands this node handles from the message catalog (their
+        fields, responses and error type, plus their JSON Schemas with
+        ``{"schemas": true}`` in the request data) and the events it
+        sends, as well as the inter-node protocol version.
 
         Args:
             websocket: The WebSocket connection
-            error_message: The error message
-            error_type: The type of error response
+            data: The request data
         """
-        response = create_error_response(error_message, error_type)
-        await websocket.send(json.dumps(response))
+        request_data = data.get("data") or {}
+        info = protocol_info(bool(request_data.get("schemas")))
+        info["commands"] = {
+            message_type: spec
+            for message_type, spec in info["commands"].items()
+            if message_type in self._handlers
+        }
+        info["node_id"] = self.room_manager.node_id
+        info["node_protocol_version"] = PROTOCOL_VERSION
+        response = {"type": "protocol_info", "data": info}
+        await self._send(websocket, json.dumps(response))
 
-    async def handle_send_message(
+    async def handle_list_rooms(
+        self, websocket: WebSocketServerProtocol, data: dict = None
+    ):
+        """
+        Handle a list_rooms request.
+
+        By default only rooms hosted on this node are listed. With
+        ``{"scope": "global"}`` in the request data, every room in the
+        gossiped cluster directory is listed instead. Private rooms are
+        never listed.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = (data or {}).get("data") or {}
+        scope = request_data.get("scope", "local")
+        logger.info(f"Processing list_rooms request (scope: {scope})")
+
+        if scope == "global" and self.room_registry:
+            rooms = self.room_registry.list_rooms()
+        elif scope == "global" and self.room_directory:
+            self.room_directory.update_local(self.room_manager.list_rooms())
+            rooms = self.room_directory.list_rooms()
+        else:
+            # Get all public rooms from the room manager
+            rooms = self.room_manager.list_public_rooms()
+
+        # Create response
+        response = {
+            "type": "rooms_list",
+            "data": {"rooms": rooms, "total_count": len(rooms)},
+        }
+        if scope == "global":
+            response["data"]["scope"] = "global"
+
+        # Send response
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent rooms_list response with {len(rooms)} rooms")
+
+    async def handle_create_room(
         self, websocket: WebSocketServerProtocol, data: dict
     ):
         """
-        Handle a send_message request from a client.
+        Handle a create_room request.
 
         Args:
             websocket: The WebSocket connection
@@ -932,287 +2087,5758 @@ class WebSocketServer:
         try:
             # Extract parameters
             request_data = data.get("data", {})
-            room_id = request_data.get("room_id")
-            username = request_data.get("username")
-            content = request_data.get("content")
+            room_name = request_data.get("room_name")
+            creator_id = request_data.get("creator_id")
+            description = request_data.get("description")
+            private = bool(request_data.get("private", False))
+            total_order = bool(request_data.get("total_order", False))
+            max_members = int(request_data.get("max_members") or 0)
+            waitlist = bool(request_data.get("waitlist", False))
+            announcement = bool(request_data.get("announcement", False))
+            delivery = request_data.get("delivery")
+            ephemeral = bool(request_data.get("ephemeral", False))
+            placement = validate_placement(request_data.get("placement"))
+            durable = bool(request_data.get("durable", False))
 
-            # Validate required fields
-            if not room_id or not username:
-                await self.send_message_error(
-                    websocket,
-                    room_id or "",
-                    "Missing room_id or username",
-                    "INVALID_REQUEST",
-                )
-                return
-
-            # Validate message content
-            is_valid, error_msg = validate_message_content(content)
-            if not is_valid:
-                await self.send_message_error(
-                    websocket,
-                    room_id,
-                    error_msg,
-                    "INVALID_CONTENT",
-                )
-                return
+            if not room_name or not creator_id:
+                raise ValueError("Missing room_name or creator_id")
+            if durable and not (
+                self.replication and self.replication.replication_factor > 0
+            ):
+                raise ValueError("Durable rooms need replication enabled")
+            if placement and self.placement:
+                if not self.placement.can_place(placement):
+                    raise ValueError(
+                        "No node matches the room's placement constraints"
+                    )
 
             logger.info(
-                f"Processing send_message request: "
-                f"room {room_id} from {username}"
+                f"Processing create_room request: "
+                f"'{room_name}' by {creator_id}"
             )
 
-            # Check if user is member of the room (local check)
-            if not self._is_client_in_room(websocket, room_id):
-                await self.send_message_error(
-                    websocket,
-                    room_id,
-                    "You are not a member of this room",
-                    "NOT_MEMBER",
+            # Create the room
+            room = self.room_manager.create_room(
+                room_name,
+                creator_id,
+                description,
+                private,
+                total_order,
+                max_members,
+                waitlist,
+                announcement,
+                delivery,
+                ephemeral,
+                placement,
+                durable,
+            )
+            if self.room_registry:
+                await self._register_room(room)
+            admin_node = room.admin_node
+            loop = asyncio.get_running_loop()
+            if placement and self.placement:
+                admin_node = await loop.run_in_executor(
+                    None, self.placement.place_room, room.room_id
+                )
+            elif self.sharding:
+                admin_node = await loop.run_in_executor(
+                    None, self.sharding.place_room, room.room_id
                 )
-                return
 
-            # Check if this node administers the room
-            room = self.room_manager.get_room(room_id)
+            # Create response matching the specification
+            response = {
+                "type": "room_created",
+                "data": {
+                    "room_id": room.room_id,
+                    "room_name": room.room_name,
+                    "admin_node": admin_node,
+                    "members": list(room.members),
+                    "created_at": room.created_at,
+                    "private": room.private,
+                    "total_order": room.total_order,
+                    "max_members": room.max_members,
+                    "waitlist_enabled": room.waitlist_enabled,
+                    "announcement": room.announcement,
+                    "delivery": room.delivery,
+                    "ephemeral": room.ephemeral,
+                    "placement": dict(room.placement),
+                    "durable": room.durable,
+                },
+            }
 
-            if room:
-                # Local message - this node is the administrator
-                result = await self._handle_local_message(
-                    websocket, room_id, username, content
-                )
-            else:
-                # Remote message - forward to administrator
-                result = await self._handle_remote_message(
-                    websocket, room_id, username, content
-                )
+            # Send response
+            await self._send(websocket, json.dumps(response))
+            logger.info(f"Sent room_created response for room {room.room_id}")
 
-            if result["success"]:
-                # Send confirmation to sender
-                confirmation = create_message_sent_confirmation(
-                    room_id=room_id,
-                    message_id=result["message_id"],
-                    sequence_number=result["sequence_number"],
-                    timestamp=result["timestamp"],
-                )
-                await websocket.send(json.dumps(confirmation))
-                logger.info(
-                    f"Message from {username} sent successfully "
-                    f"(seq: {result['sequence_number']})"
+        except ValueError as e:
+            logger.error(f"Error creating room: {e}")
+            await self.send_error(websocket, str(e), error_type="room_created")
+        except Exception as e:
+            logger.error(f"Unexpected error creating room: {e}")
+            await self.send_error(
+                websocket, "Internal server error", error_type="room_created"
+            )
+
+    async def _register_room(self, room) -> None:
+        """
+        Commit a newly created room to the Raft room registry.
+
+        Args:
+            room: The Room created on this node
+
+        Raises:
+            ValueError: If the registry rejected the room (its name is
+                taken elsewhere in the cluster) or couldn't commit it; the
+                local room is deleted again
+        """
+        loop = asyncio.get_running_loop()
+        result = await loop.run_in_executor(
+            None, self.room_registry.register_room, room.to_dict()
+        )
+        if not result.get("success"):
+            self.room_manager.delete_room(room.room_id)
+            raise ValueError(result.get("error", "Room registration failed"))
+
+    async def handle_join_room(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a join_room request.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        try:
+            # Extract parameters
+            request_data = data.get("data", {})
+            room_id = request_data.get("room_id")
+            username = request_data.get("username")
+
+            if not room_id or not username:
+                await self.send_join_error(
+                    websocket,
+                    room_id or "",
+                    "Missing room_id or username",
+                    "INVALID_REQUEST",
                 )
-            else:
-                await self.send_message_error(
+                return
+            if is_puppet(username):
+                await self.send_join_error(
                     websocket,
                     room_id,
-                    result.get("error", "Failed to send message"),
-                    result.get("error_code", "UNKNOWN_ERROR"),
+                    "Usernames like name[irc] belong to bridged users",
+                    "INVALID_USERNAME",
                 )
+                return
+
+            logger.info(
+                f"Processing join_room request: "
+                f"room {room_id} by {username}"
+            )
+            await self._join(websocket, room_id, username)
 
         except Exception as e:
-            logger.error(f"Error processing send_message: {e}")
+            logger.error(f"Error processing join_room: {e}")
             room_id = data.get("data", {}).get("room_id", "")
-            await self.send_message_error(
+            await self.send_join_error(
                 websocket, room_id, str(e), "INTERNAL_ERROR"
             )
 
-    def _is_client_in_room(
-        self, websocket: WebSocketServerProtocol, room_id: str
-    ) -> bool:
+    async def handle_join_by_invite(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
         """
-        Check if a client's websocket is registered as being in a room.
+        Handle a join_by_invite request for a private room.
+
+        The room is taken from the invite token, and the join is forwarded
+        to the room's administrator node if it is not hosted here. Replies
+        like join_room.
 
         Args:
             websocket: The WebSocket connection
-            room_id: The room ID
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        invite_token = request_data.get("invite_token")
+        username = request_data.get("username")
+        room_id = ""
+        try:
+            room_id = parse_invite_token(invite_token)
+            if not username:
+                raise InviteError("Missing username", "INVALID_REQUEST")
 
-        Returns:
-            bool: True if client is in the room
+            logger.info(
+                f"Processing join_by_invite request: "
+                f"room {room_id} by {username}"
+            )
+            await self._join(websocket, room_id, username, invite_token)
+
+        except InviteError as e:
+            await self.send_join_error(
+                websocket, room_id, str(e), e.error_code
+            )
+        except Exception as e:
+            logger.error(f"Error processing join_by_invite: {e}")
+            await self.send_join_error(
+                websocket, room_id, str(e), "INTERNAL_ERROR"
+            )
+
+    async def _join(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        username: str,
+        invite_token: Optional[str] = None,
+    ):
         """
-        if websocket not in self._client_rooms:
-            return False
-        return room_id in self._client_rooms[websocket]
+        Join a room and send the result and existing messages.
 
-    async def _handle_local_message(
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room ID
+            username: The username
+            invite_token: Invite token for a private room, if any
+        """
+        # Check if this node administers the room
+        room = self.room_manager.get_room(room_id)
+
+        if room:
+            # Local join - this node is the administrator
+            result = await self._handle_local_join(
+                websocket, room_id, username, invite_token
+            )
+        elif self.partition and self.partition.is_degraded(room_id):
+            result = self._handle_degraded_join(room_id, username)
+        else:
+            # Try remote join - find the administrator node
+            result = await self._handle_remote_join(
+                websocket, room_id, username, invite_token
+            )
+            if self._follow_move(room_id, result):
+                result = await self._handle_remote_join(
+                    websocket, room_id, username, invite_token
+                )
+            if (
+                self.partition
+                and not invite_token
+                and result.get("error_code") == "ADMIN_NODE_UNAVAILABLE"
+                and self.replica_store
+                and self.replica_store.get(room_id)
+            ):
+                await self.degrade_room(
+                    room_id, self._room_admin_node(room_id), result["message"]
+                )
+                result = self._handle_degraded_join(room_id, username)
+
+        if result["success"]:
+            # Track that this client is in the room
+            self.register_client_room_membership(websocket, room_id, username)
+
+            # Send success response; the membership set is for nodes only
+            room_info = dict(result["room_info"])
+            room_info.pop("member_set", None)
+            response = {
+                "type": "join_room_success",
+                "data": room_info,
+            }
+            await self._send(websocket, json.dumps(response))
+            logger.info(f"User {username} successfully joined room {room_id}")
+
+            # Send existing messages to the joining user
+            # First try local room (for local joins)
+            room = self.room_manager.get_room(room_id)
+            messages = room.messages if room else []
+            # For remote joins, messages are included in the result
+            if not messages and "messages" in result:
+                messages = result["messages"]
+
+            if messages:
+                for message in messages:
+                    self.receipts.track(room_id, message)
+                    msg_response = {
+                        "type": "new_message",
+                        "data": message,
+                    }
+                    await self._send(websocket, json.dumps(msg_response))
+                logger.info(
+                    f"Sent {len(messages)} existing messages "
+                    f"to {username}"
+                )
+
+            connection = self.connections.get(websocket)
+            if connection and connection.bot:
+                await self._register_room_bot(websocket, room_id, username)
+        elif result.get("error_code") == WAITLISTED:
+            # Remember who the client is so it can be admitted later
+            self.connections.set_username(websocket, username)
+            event = create_waitlist_joined_event(
+                room_id,
+                result["waitlist_position"],
+                result.get("max_members", 0),
+            )
+            await self._send(websocket, json.dumps(event))
+            logger.info(
+                f"User {username} is number {result['waitlist_position']} "
+                f"on the waiting list of room {room_id}"
+            )
+        else:
+            await self.send_join_error(
+                websocket,
+                room_id,
+                result["message"],
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+
+    async def _handle_local_join(
         self,
         websocket: WebSocketServerProtocol,
         room_id: str,
         username: str,
-        content: str,
+        invite_token: Optional[str] = None,
     ) -> dict:
         """
-        Handle a message for a room administered by this node.
+        Handle a join request for a room administered by this node.
 
         Args:
             websocket: The WebSocket connection
             room_id: The room ID
             username: The username
-            content: The message content
+            invite_token: Invite token for a private room, if any
 
         Returns:
-            dict: Result with success status and message data or error
+            dict: Result with success status and room_info or error
         """
-        # Add message to room (assigns sequence number)
-        message = self.room_manager.add_message(room_id, username, content)
+        room = self.room_manager.get_room(room_id)
+        if not room:
+            return {
+                "success": False,
+                "message": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
 
-        if not message:
+        if username in room.banned:
             return {
                 "success": False,
-                "error": "Failed to add message",
-                "error_code": "INTERNAL_ERROR",
+                "message": "You are banned from this room",
+                "error_code": "BANNED",
             }
 
-        # Broadcast to all room members (including sender)
-        await self._broadcast_message_to_room(room_id, message)
+        # Check if user is already in the room
+        already_member = username in room.members
+
+        # Private rooms need an invite unless the user is a member
+        if invite_token and not already_member:
+            try:
+                self.room_manager.redeem_invite(room_id, invite_token, username)
+            except InviteError as e:
+                return {
+                    "success": False,
+                    "message": str(e),
+                    "error_code": e.error_code,
+                }
+        elif not room.can_join(username):
+            return {
+                "success": False,
+                "message": "Room is private, an invite is required",
+                "error_code": "INVITE_REQUIRED",
+            }
+
+        if not already_member:
+            # Add user to the room (local node), or queue them if it is full
+            try:
+                position = self.room_manager.join_or_wait(
+                    room_id, username, self.room_manager.node_id
+                )
+            except CapacityError as e:
+                return {
+                    "success": False,
+                    "message": str(e),
+                    "error_code": e.error_code,
+                }
+            if position:
+                return {
+                    "success": False,
+                    "message": (
+                        f"Room is full, you are number {position} on the "
+                        f"waiting list"
+                    ),
+                    "error_code": WAITLISTED,
+                    "waitlist_position": position,
+                    "max_members": room.max_members,
+                }
+
+            # Broadcast member_joined to existing members
+            event_data = create_member_joined_event(
+                room_id=room_id,
+                username=username,
+                member_count=len(room.members),
+                timestamp=datetime.now(timezone.utc).isoformat(),
+                hlc=self.room_manager.clock.now().encode(),
+            )
+            broadcast_msg = {"type": "member_joined", "data": event_data}
+            await self.broadcast_to_room(room_id, broadcast_msg, websocket)
+            logger.info(f"User {username} joined local room {room.room_name}")
+
+            # Also broadcast to peer nodes
+            self._broadcast_to_peers(room_id, "member_joined", event_data)
+        else:
+            # User is already a member (e.g., room creator, or another
+            # device) - record this node and register the connection below
+            self.room_manager.add_member(room_id, username)
+            logger.info(
+                f"User {username} re-joining room {room.room_name} "
+                f"(already a member)"
+            )
 
         return {
             "success": True,
-            "message_id": message["message_id"],
-            "sequence_number": message["sequence_number"],
-            "timestamp": message["timestamp"],
+            "message": "Successfully joined room",
+            "room_info": self._room_info(room),
         }
 
-    async def _handle_remote_message(
+    def _room_info(self, room) -> dict:
+        """Describe a local room for a join result."""
+        return {
+            "room_id": room.room_id,
+            "room_name": room.room_name,
+            "description": room.description,
+            "members": list(room.members),
+            "member_count": len(room.members),
+            "admin_node": room.admin_node,
+            "vector_clock": dict(room.vector_clock),
+            "private": room.private,
+            "roles": dict(room.roles),
+            "max_members": room.max_members,
+            "waitlist_enabled": room.waitlist_enabled,
+            "announcement": room.announcement,
+            "delivery": room.delivery,
+            "ephemeral": room.ephemeral,
+            "placement": dict(room.placement),
+            "durable": room.durable,
+            "read_positions": dict(room.read_positions),
+            "public_keys": dict(room.public_keys),
+            "retention": list(room.retention),
+            "pinned": list(room.pinned),
+            "topic": room.topic,
+            "metadata_versions": dict(room.metadata_versions),
+            "spam_thresholds": dict(room.spam_thresholds),
+            "content_filters": [dict(f) for f in room.content_filters],
+        }
+
+    async def _handle_remote_join(
         self,
         websocket: WebSocketServerProtocol,
         room_id: str,
         username: str,
-        content: str,
+        invite_token: Optional[str] = None,
     ) -> dict:
         """
-        Handle a message for a room administered by another node.
+        Handle a join request for a room administered by another node.
 
         Args:
             websocket: The WebSocket connection
             room_id: The room ID
             username: The username
-            content: The message content
+            invite_token: Invite token for a private room, if any
 
         Returns:
-            dict: Result with success status and message data or error
+            dict: Result with success status and room_info or error
+        """
+        if not self.peer_registry:
+            return {
+                "success": False,
+                "message": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+
+        # Find which node administers this room
+        target_room, node_address = self._locate_room_admin(room_id)
+
+        if not target_room:
+            return {
+                "success": False,
+                "message": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+
+        if not node_address:
+            return {
+                "success": False,
+                "message": "Administrator node unavailable",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+
+        # Call XML-RPC on the administrator node
+        try:
+            proxy = ServerProxy(node_address, allow_none=True)
+            if invite_token:
+                result = proxy.join_room_by_invite(
+                    room_id,
+                    username,
+                    self.room_manager.node_id,
+                    invite_token,
+                    *self._auth_args(websocket),
+                )
+            else:
+                result = proxy.join_room(
+                    room_id,
+                    username,
+                    self.room_manager.node_id,
+                    *self._auth_args(websocket),
+                )
+
+            if result.get("success"):
+                self._adopt_remote_room(
+                    room_id,
+                    result.get("room_info") or {},
+                    result.get("messages") or [],
+                    username,
+                )
+
+            return result
+
+        except Exception as e:
+            logger.error(f"Failed to join remote room: {e}")
+            return {
+                "success": False,
+                "message": f"Failed to contact administrator node: {e}",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+
+    def _handle_degraded_join(self, room_id: str, username: str) -> dict:
+        """
+        Handle a join to a room whose admin node is unreachable.
+
+        The join is recorded in this node's replica of the room, and
+        reaches the admin with the replica's membership set when the room
+        is reconciled (see member_set.py). Private and full rooms, banned
+        users and read-only degraded rooms are refused.
+
+        Args:
+            room_id: The room ID
+            username: The username
+
+        Returns:
+            dict: Result with success, degraded set and room_info and
+            messages from the replica, or an error
+        """
+        replica = (
+            self.replica_store.get(room_id) if self.replica_store else None
+        )
+        if replica is None:
+            return {
+                "success": False,
+                "message": "Administrator node unavailable",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+        if username not in replica.members:
+            refused = None
+            if self.partition.mode == READ_ONLY:
+                refused = (
+                    "Room is read-only until its admin node is reachable",
+                    "ROOM_READ_ONLY",
+                )
+            elif replica.private:
+                refused = (
+                    "Private rooms can't be joined until their admin node "
+                    "is reachable",
+                    "ADMIN_NODE_UNAVAILABLE",
+                )
+            elif username in replica.banned:
+                refused = ("You are banned from this room", "BANNED")
+            elif 0 < replica.max_members <= len(replica.members):
+                refused = (
+                    f"Room is full ({replica.max_members} members)",
+                    ROOM_FULL,
+                )
+            if refused:
+                return {
+                    "success": False,
+                    "message": refused[0],
+                    "error_code": refused[1],
+                }
+        self.replica_store.record_local_join(room_id, username)
+        replica = self.replica_store.get(room_id)
+        logger.info(
+            f"User {username} joined degraded room {room_id}; the join "
+            f"reaches its admin when the room is reconciled"
+        )
+        return {
+            "success": True,
+            "degraded": True,
+            "room_info": {
+                "room_id": room_id,
+                "room_name": replica.room_name,
+                "description": replica.description,
+                "members": list(replica.members),
+                "member_count": len(replica.members),
+                "admin_node": replica.admin_node,
+                "creator_id": replica.creator_id,
+                "vector_clock": dict(replica.vector_clock),
+                "topic": replica.topic,
+                "degraded": True,
+            },
+            "messages": list(replica.messages),
+        }
+
+    async def send_join_error(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        error: str,
+        error_code: str,
+    ):
+        """
+        Send a join_room error response.
+
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room ID
+            error: The error message
+            error_code: The error code
+        """
+        response = create_join_error_response(room_id, error, error_code)
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_create_invite(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a create_invite request for a private room.
+
+        Request data: room_id, username (the inviter) and an optional
+        invitee. The request is forwarded to the room's administrator node
+        if the room is not hosted here. Invites for a user who blocked the
+        inviter are refused.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        invitee = request_data.get("invitee")
+
+        if not room_id or not username:
+            await self._send_invite_error(
+                websocket,
+                "create_invite",
+                room_id or "",
+                "Missing room_id or username",
+                "INVALID_REQUEST",
+            )
+            return
+
+        logger.info(
+            f"Processing create_invite request: room {room_id} by {username}"
+        )
+        if invitee and self.profiles.blocks(invitee, username):
+            result = {
+                "success": False,
+                "error": "Cannot invite this user",
+                "error_code": "INVITE_REFUSED",
+            }
+        elif self.room_manager.get_room(room_id):
+            try:
+                invite = self.room_manager.create_invite(
+                    room_id, username, invitee
+                ).to_dict()
+                result = {"success": True, "invite": invite}
+            except InviteError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "create_room_invite",
+                room_id,
+                username,
+                invitee or "",
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            await self._send_invite_error(
+                websocket,
+                "create_invite",
+                room_id,
+                result.get("error", "Failed to create invite"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            return
+
+        invite = result["invite"]
+        response = {
+            "type": "invite_created",
+            "data": {
+                "room_id": room_id,
+                "invite_token": invite["token"],
+                "inviter": invite["inviter"],
+                "invitee": invite.get("invitee"),
+                "expires_at": invite["expires_at"],
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent invite_created response for room {room_id}")
+
+    async def handle_revoke_invite(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a revoke_invite request for a private room.
+
+        Request data: invite_token and username (the inviter or the room
+        creator). The request is forwarded to the room's administrator
+        node if the room is not hosted here.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        invite_token = request_data.get("invite_token")
+        username = request_data.get("username")
+        room_id = ""
+
+        try:
+            room_id = parse_invite_token(invite_token)
+            if not username:
+                raise InviteError("Missing username", "INVALID_REQUEST")
+            logger.info(
+                f"Processing revoke_invite request: "
+                f"room {room_id} by {username}"
+            )
+            if self.room_manager.get_room(room_id):
+                self.room_manager.revoke_invite(room_id, invite_token, username)
+                result = {"success": True}
+            else:
+                result = await self._call_room_admin(
+                    room_id,
+                    "revoke_room_invite",
+                    room_id,
+                    invite_token,
+                    username,
+                    *self._auth_args(websocket),
+                )
+        except InviteError as e:
+            result = {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        if not result.get("success"):
+            await self._send_invite_error(
+                websocket,
+                "revoke_invite",
+                room_id,
+                result.get("error", "Failed to revoke invite"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            return
+
+        response = {
+            "type": "invite_revoked",
+            "data": {"room_id": room_id, "invite_token": invite_token},
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent invite_revoked response for room {room_id}")
+
+    async def _call_room_admin(self, room_id: str, method: str, *args) -> dict:
+        """
+        Call an XML-RPC method on the administrator node of a remote room.
+
+        A call answered with ROOM_MOVED by an admin the room was migrated
+        away from is made again on the new admin.
+
+        Args:
+            room_id: The room ID
+            method: Name of the remote method
+            *args: Positional arguments for the remote method
+
+        Returns:
+            dict: The remote result, or an error if the admin can't be
+            reached
+        """
+        result = await self._call_admin_node(room_id, method, *args)
+        if self._follow_move(room_id, result):
+            result = await self._call_admin_node(room_id, method, *args)
+        return result
+
+    async def _call_admin_node(self, room_id: str, method: str, *args):
+        """Call an XML-RPC method on a remote room's admin, once."""
+        if not self.peer_registry:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+
+        target_room, node_address = self._locate_room_admin(room_id)
+        if not target_room:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        if not node_address:
+            return {
+                "success": False,
+                "error": "Administrator node unavailable",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+        try:
+            # Only a PeerRegistry knows the versions negotiated with peers
+            if isinstance(self.peer_registry, PeerRegistry):
+                self.peer_registry.check_compatible(
+                    target_room.get("admin_node"), method
+                )
+        except IncompatiblePeerError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        try:
+            proxy = ServerProxy(node_address, allow_none=True)
+            return getattr(proxy, method)(*args)
+        except Exception as e:
+            logger.error(f"Failed to call {method} on admin node: {e}")
+            return {
+                "success": False,
+                "error": f"Failed to contact administrator node: {e}",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+
+    async def _send_invite_error(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        room_id: str,
+        error: str,
+        error_code: str,
+    ):
+        """Send an invite_error response."""
+        response = create_invite_error_response(
+            request_type, room_id, error, error_code
+        )
+        await self._send(websocket, json.dumps(response))
+
+    def _adopt_remote_room(
+        self,
+        room_id: str,
+        room_info: dict,
+        messages: List[dict],
+        username: str,
+    ):
+        """
+        Start following a remote room a local user has joined.
+
+        Args:
+            room_id: The room ID
+            room_info: The room, as returned by the administrator
+            messages: Messages returned with the join
+            username: The joining user
+        """
+        # Messages up to the room's current clock come with the join
+        # response, so only later broadcasts need causal buffering
+        if self.causal_buffer:
+            self.causal_buffer.seed(
+                room_id, room_info.get("vector_clock") or {}
+            )
+        if room_info.get("total_order"):
+            self._seed_sequence(room_id, messages)
+        if self.replica_store:
+            self.replica_store.update_from_join(room_info, messages, username)
+
+    def _seed_sequence(self, room_id: str, messages: List[dict]):
+        """
+        Mark the messages that came with a remote join as delivered.
+
+        Held messages of a total-order room that this makes deliverable
+        are sent to the room's local clients.
+
+        Args:
+            room_id: The room ID
+            messages: Messages returned with the join, in sequence order
+        """
+        if not self.sequence_buffer:
+            return
+        last_sequence = messages[-1]["sequence_number"] if messages else 0
+        for message in self.sequence_buffer.seed(room_id, last_sequence):
+            self.broadcast_to_room_sync(
+                room_id, {"type": "new_message", "data": message}
+            )
+
+    async def handle_get_history(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a get_history request.
+
+        Returns a page of the room's messages, oldest first, ending just
+        before the ``before`` message ID or starting just after the
+        ``after`` message ID; without either, the newest page. With a
+        ``thread_id`` only that message and its replies are paged. Rooms
+        administered elsewhere are read from their administrator node (or
+        with a latency router the nearest node holding a replica), and
+        rooms archived here from the archive. Reading a durable room
+        administered here repairs its followers' replicas.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        before = request_data.get("before")
+        after = request_data.get("after")
+        limit = request_data.get("limit", HISTORY_PAGE_SIZE)
+        thread_id = request_data.get("thread_id")
+        if not room_id or not username:
+            response = create_history_error_response(
+                room_id or "",
+                "get_history needs a room_id and a username",
+                "INVALID_REQUEST",
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        room = self.room_manager.get_room(room_id)
+        if room or self.room_manager.archive.has(room_id):
+            result = self.room_manager.get_history(
+                room_id, username, before, after, limit, thread_id
+            )
+            if room and room.durable and self.replication:
+                self.replication.repair_on_read(room_id)
+        elif self.router and not thread_id:
+            result = await self._routed_history(
+                websocket, room_id, username, before, after, limit
+            )
+        else:
+            extra_args = self._auth_args(websocket)
+            if thread_id:
+                extra_args = (self._session_token(websocket) or "", thread_id)
+            result = await self._call_room_admin(
+                room_id,
+                "get_room_history",
+                room_id,
+                username,
+                before or "",
+                after or "",
+                limit,
+                *extra_args,
+            )
+
+        if not result.get("success"):
+            response = create_history_error_response(
+                room_id,
+                result.get("error", "Failed to get history"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "history",
+            "data": {
+                "room_id": room_id,
+                "messages": result["messages"],
+                "has_more": result["has_more"],
+                "truncated": result.get("truncated", False),
+                "pinned": result.get("pinned", []),
+                "archived": result.get("archived", False),
+                "before": before,
+                "after": after,
+                "thread_id": thread_id,
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(
+            f"Sent {len(result['messages'])} history messages of room "
+            f"{room_id} to {username}"
+        )
+
+    async def _routed_history(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        username: str,
+        before: Optional[str],
+        after: Optional[str],
+        limit: int,
+    ) -> dict:
+        """
+        Read a page of a remote room's history from the nearest node.
+
+        The room's admin and its followers, possibly this node, can serve
+        the page; they are tried in the latency router's order until one
+        does. Followers refuse pages their replica can't serve whole, and
+        the admin's answer is final unless the admin is unavailable.
+
+        Args:
+            websocket: The WebSocket connection asking
+            room_id: The room ID
+            username: The user asking
+            before: Page ends just before this message ID
+            after: Page starts just after this message ID
+            limit: Maximum number of messages in the page
+
+        Returns:
+            dict: The page, or the last node's error
+        """
+        node_id = self.room_manager.node_id
+        args = (room_id, username, before or "", after or "", limit)
+        args += self._auth_args(websocket)
+        target_room, _ = self._locate_room_admin(room_id)
+        admin = (target_room or {}).get("admin_node")
+        if not admin:
+            return await self._call_room_admin(
+                room_id, "get_room_history", *args
+            )
+
+        candidates = [admin]
+        if self.replication:
+            candidates += self.replication.followers_of(room_id, admin)
+        replica = None
+        if self.replica_store:
+            replica = self.replica_store.get(room_id)
+        if replica and replica.follower:
+            candidates.append(node_id)
+
+        loop = asyncio.get_running_loop()
+        result = {}
+        for fallbacks, node in enumerate(
+            self.router.rank(candidates, preferred=admin)
+        ):
+            if node == admin:
+                result = await self._call_room_admin(
+                    room_id, "get_room_history", *args
+                )
+                code = result.get("error_code", "UNKNOWN_ERROR")
+                final = not describe_error(code).retryable
+            elif node == node_id:
+                result = self.replica_store.history_page(
+                    room_id, username, before, after, limit
+                )
+                final = False
+            else:
+                try:
+                    result = await loop.run_in_executor(
+                        None,
+                        self.peer_registry.call_peer,
+                        node,
+                        "get_replica_history",
+                        *args,
+                    )
+                except Exception as e:
+                    logger.debug(
+                        f"Could not read history of room {room_id} "
+                        f"from follower {node}: {e}"
+                    )
+                    result = {
+                        "success": False,
+                        "error": f"Failed to contact follower: {e}",
+                        "error_code": "PEER_UNAVAILABLE",
+                    }
+                final = False
+            if result.get("success"):
+                self.router.record(HISTORY, node, fallbacks)
+                return result
+            if final:
+                return result
+        return result
+
+    async def handle_search(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a search request over a room's message history.
+
+        Request data: room_id, username, and at least one of query (words
+        that must all appear), author, since and until (ISO 8601 times),
+        plus an optional limit. The client gets search_results with the
+        newest matches first and the total number of matches. Rooms
+        administered elsewhere are searched on their administrator node.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        query = request_data.get("query") or ""
+        author = request_data.get("author")
+        since = request_data.get("since")
+        until = request_data.get("until")
+        limit = request_data.get("limit", SEARCH_LIMIT)
+
+        if self.room_manager.get_room(room_id):
+            result = self.room_manager.search_messages(
+                room_id, username, query, author, since, until, limit
+            )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "search_room",
+                room_id,
+                username,
+                query,
+                author or "",
+                since or "",
+                until or "",
+                limit,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_search_error_response(
+                room_id,
+                result.get("error", "Search failed"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "search_results",
+            "data": {
+                "room_id": room_id,
+                "query": query,
+                "author": author,
+                "since": since,
+                "until": until,
+                "messages": result["messages"],
+                "total": result["total"],
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(
+            f"Sent {len(result['messages'])} of {result['total']} search "
+            f"results in room {room_id} to {username}"
+        )
+
+    async def handle_register_webhook(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a register_webhook request from a room owner.
+
+        Request data: room_id, username, url and an optional list of events
+        (all events if omitted). The room's administrator keeps the
+        webhook, so requests for remote rooms are forwarded to it. The
+        client gets webhook_registered with the webhook, including the
+        secret its requests are signed with.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        url = request_data.get("url")
+        events = request_data.get("events") or []
+
+        if self.room_manager.get_room(room_id):
+            try:
+                result = {
+                    "success": True,
+                    "webhook": self.room_manager.register_webhook(
+                        room_id, username, url, events
+                    ),
+                }
+            except WebhookError as e:
+                result = self._webhook_failure(e)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "register_webhook",
+                room_id,
+                username,
+                url,
+                events,
+                *self._auth_args(websocket),
+            )
+        await self._send_webhook_result(
+            websocket,
+            "register_webhook",
+            "webhook_registered",
+            room_id,
+            result,
+            "webhook",
+        )
+
+    async def handle_remove_webhook(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a remove_webhook request from a room owner.
+
+        Request data: room_id, username and webhook_id. The client gets
+        webhook_removed once the room's administrator has removed it.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        webhook_id = request_data.get("webhook_id")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                self.room_manager.remove_webhook(room_id, username, webhook_id)
+                result = {"success": True, "webhook_id": webhook_id}
+            except WebhookError as e:
+                result = self._webhook_failure(e)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "remove_webhook",
+                room_id,
+                username,
+                webhook_id,
+                *self._auth_args(websocket),
+            )
+        await self._send_webhook_result(
+            websocket,
+            "remove_webhook",
+            "webhook_removed",
+            room_id,
+            result,
+            "webhook_id",
+        )
+
+    async def handle_list_webhooks(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a list_webhooks request from a room owner.
+
+        Request data: room_id and username. The client gets webhooks with
+        the room's webhooks, without their secrets.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                result = {
+                    "success": True,
+                    "webhooks": self.room_manager.list_webhooks(
+                        room_id, username
+                    ),
+                }
+            except WebhookError as e:
+                result = self._webhook_failure(e)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "list_webhooks",
+                room_id,
+                username,
+                *self._auth_args(websocket),
+            )
+        await self._send_webhook_result(
+            websocket,
+            "list_webhooks",
+            "webhooks",
+            room_id,
+            result,
+            "webhooks",
+        )
+
+    @staticmethod
+    def _webhook_failure(error: WebhookError) -> dict:
+        """Describe a refused webhook request as a failed result."""
+        return {
+            "success": False,
+            "error": str(error),
+            "error_code": error.error_code,
+        }
+
+    async def _send_webhook_result(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        response_type: str,
+        room_id: str,
+        result: dict,
+        key: str,
+    ):
+        """Send a webhook request's result, or webhook_error if it failed."""
+        if not result.get("success"):
+            response = create_webhook_error_response(
+                request_type,
+                room_id,
+                result.get("error", "Failed to manage webhooks"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+        else:
+            response = {
+                "type": response_type,
+                "data": {"room_id": room_id, key: result[key]},
+            }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_add_bridge(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an add_bridge request from a room owner.
+
+        Request data: room_id, username, protocol ("irc" or "matrix") and
+        the network's settings (see bridges.create_bridge). The room's
+        administrator keeps the bridge and relays its messages, so
+        requests for remote rooms are forwarded to it. The client gets
+        bridge_added with the bridge, without passwords and tokens.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        protocol = request_data.get("protocol")
+        settings = request_data.get("settings") or {}
+
+        if self.room_manager.get_room(room_id):
+            try:
+                result = {
+                    "success": True,
+                    "bridge": self.room_manager.add_bridge(
+                        room_id, username, protocol, settings
+                    ),
+                }
+            except BridgeError as e:
+                result = self._bridge_failure(e)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "add_bridge",
+                room_id,
+                username,
+                protocol,
+                settings,
+                *self._auth_args(websocket),
+            )
+        await self._send_bridge_result(
+            websocket, "add_bridge", "bridge_added", room_id, result, "bridge"
+        )
+
+    async def handle_remove_bridge(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a remove_bridge request from a room owner.
+
+        Request data: room_id, username and bridge_id. The client gets
+        bridge_removed once the room's administrator has removed it.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        bridge_id = request_data.get("bridge_id")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                self.room_manager.remove_bridge(room_id, username, bridge_id)
+                result = {"success": True, "bridge_id": bridge_id}
+            except BridgeError as e:
+                result = self._bridge_failure(e)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "remove_bridge",
+                room_id,
+                username,
+                bridge_id,
+                *self._auth_args(websocket),
+            )
+        await self._send_bridge_result(
+            websocket,
+            "remove_bridge",
+            "bridge_removed",
+            room_id,
+            result,
+            "bridge_id",
+        )
+
+    async def handle_list_bridges(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a list_bridges request from a room owner.
+
+        Request data: room_id and username. The client gets bridges with
+        the room's bridges, without passwords and tokens.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                result = {
+                    "success": True,
+                    "bridges": self.room_manager.list_bridges(
+                        room_id, username
+                    ),
+                }
+            except BridgeError as e:
+                result = self._bridge_failure(e)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "list_bridges",
+                room_id,
+                username,
+                *self._auth_args(websocket),
+            )
+        await self._send_bridge_result(
+            websocket, "list_bridges", "bridges", room_id, result, "bridges"
+        )
+
+    @staticmethod
+    def _bridge_failure(error: BridgeError) -> dict:
+        """Describe a refused bridge request as a failed result."""
+        return {
+            "success": False,
+            "error": str(error),
+            "error_code": error.error_code,
+        }
+
+    async def _send_bridge_result(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        response_type: str,
+        room_id: str,
+        result: dict,
+        key: str,
+    ):
+        """Send a bridge request's result, or bridge_error if it failed."""
+        if not result.get("success"):
+            response = create_bridge_error_response(
+                request_type,
+                room_id,
+                result.get("error", "Failed to manage bridges"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+        else:
+            response = {
+                "type": response_type,
+                "data": {"room_id": room_id, key: result[key]},
+            }
+        await self._send(websocket, json.dumps(response))
+
+    async def post_bridged_message(
+        self, room_id: str, username: str, content: str
+    ) -> bool:
+        """
+        Post a message relayed from a bridge, as the sender's puppet.
+
+        A puppet that isn't in the room joins it first, announced with
+        member_joined like any member; one that is has its activity
+        refreshed, so it leaves only after it stops speaking.
+
+        Args:
+            room_id: ID of a room hosted on this node
+            username: The puppet's username (see bridges.puppet_name)
+            content: The message text
+
+        Returns:
+            True if the message was posted
+        """
+        room = self.room_manager.get_room(room_id)
+        if room is None or not validate_message_content(content)[0]:
+            return False
+        if room.announcement:
+            # Puppets are plain members, who can't post here
+            return False
+        if username not in self.room_manager.get_members(room_id):
+            self.room_manager.add_member(room_id, username)
+            event_data = create_member_joined_event(
+                room_id=room_id,
+                username=username,
+                member_count=len(self.room_manager.get_members(room_id)),
+                timestamp=datetime.now(timezone.utc).isoformat(),
+                hlc=self.room_manager.clock.now().encode(),
+            )
+            await self.broadcast_to_room(
+                room_id, {"type": "member_joined", "data": event_data}
+            )
+            self._broadcast_to_peers(room_id, "member_joined", event_data)
+        else:
+            self.room_manager.update_member_activity(room_id, username)
+        try:
+            message = self.room_manager.add_message(room_id, username, content)
+        except SpamError as e:
+            if e.error_code == SPAM_DETECTED:
+                await self._announce_spam(room_id, username, e)
+            return False
+        except ContentFilterError:
+            return False
+        if message is None:
+            return False
+        await self._broadcast_message_to_room(room_id, message)
+        return True
+
+    async def handle_kick_user(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a kick_user request from a room owner or moderator.
+
+        Request data: room_id, username (the owner or a moderator) and
+        target. The target is removed from the room but may join again.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._moderate(websocket, data.get("data", {}), KICK)
+
+    async def handle_ban_user(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a ban_user request from a room owner or moderator.
+
+        Request data: room_id, username (the owner or a moderator) and
+        target. The target is removed from the room and can't join it
+        again.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._moderate(websocket, data.get("data", {}), BAN)
+
+    async def _moderate(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_data: dict,
+        action: str,
+    ):
+        """Kick or ban a member, forwarding to the admin node if remote."""
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        target = request_data.get("target")
+        request_type = f"{action}_user"
+
+        if not room_id or not username or not target:
+            result = {
+                "success": False,
+                "error": f"{request_type} needs a room_id, username and target",
+                "error_code": "INVALID_REQUEST",
+            }
+        elif self.room_manager.get_room(room_id):
+            logger.info(
+                f"Processing {request_type} request: room {room_id}, "
+                f"{target} by {username}"
+            )
+            try:
+                member_node = self.room_manager.moderate_member(
+                    room_id, username, target, ban=action == BAN
+                )
+                result = {"success": True}
+            except ModerationError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                if member_node is not None:
+                    await self._enforce_removal(
+                        room_id, target, member_node, action, username
+                    )
+                    await self._admit_waitlisted(room_id)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "moderate_member",
+                room_id,
+                username,
+                target,
+                action,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_moderation_error_response(
+                request_type,
+                room_id or "",
+                result.get("error", f"Failed to {action} user"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "user_banned" if action == BAN else "user_kicked",
+            "data": {"room_id": room_id, "username": target},
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent {response['type']} response for room {room_id}")
+
+    async def handle_promote_member(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a promote_member request from a room owner.
+
+        Request data: room_id, username (the owner) and target. The target
+        becomes a moderator of the room.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._change_role(
+            websocket, data.get("data", {}), "promote_member", MODERATOR
+        )
+
+    async def handle_demote_member(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a demote_member request from a room owner.
+
+        Request data: room_id, username (the owner) and target. The target
+        goes back to being a plain member.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._change_role(
+            websocket, data.get("data", {}), "demote_member", MEMBER
+        )
+
+    async def _change_role(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_data: dict,
+        request_type: str,
+        role: str,
+    ):
+        """Set a member's role, forwarding to the admin node if remote."""
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        target = request_data.get("target")
+
+        if not room_id or not username or not target:
+            result = {
+                "success": False,
+                "error": f"{request_type} needs a room_id, username and target",
+                "error_code": "INVALID_REQUEST",
+            }
+        elif self.room_manager.get_room(room_id):
+            logger.info(
+                f"Processing {request_type} request: room {room_id}, "
+                f"{target} by {username}"
+            )
+            try:
+                changed = self.room_manager.set_member_role(
+                    room_id, username, target, role
+                )
+                result = {"success": True}
+            except RoleError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                if changed:
+                    event_data = create_member_role_changed_event(
+                        room_id=room_id,
+                        username=target,
+                        role=role,
+                        changed_by=username,
+                        timestamp=datetime.now(timezone.utc).isoformat(),
+                    )
+                    broadcast_msg = {
+                        "type": "member_role_changed",
+                        "data": event_data,
+                    }
+                    await self.broadcast_to_room(room_id, broadcast_msg)
+                    self._broadcast_to_peers(
+                        room_id,
+                        "member_role_changed",
+                        event_data,
+                    )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "set_member_role",
+                room_id,
+                username,
+                target,
+                role,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_moderation_error_response(
+                request_type,
+                room_id or "",
+                result.get("error", "Failed to change role"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "role_changed",
+            "data": {"room_id": room_id, "username": target, "role": role},
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent role_changed response for room {room_id}")
+
+    async def handle_set_retention(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a set_retention request from a room owner.
+
+        Request data: room_id, username (the owner) and retention, a list
+        of limits like ["age=7d", "count=10000"] (empty keeps every
+        message). Requests for remote rooms are forwarded to the room's
+        administrator, which announces the change with retention_changed.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        limits = request_data.get("retention", [])
+
+        if self.room_manager.get_room(room_id):
+            try:
+                retention = self.room_manager.set_retention(
+                    room_id, username, limits
+                )
+                result = {"success": True, "retention": retention}
+            except RetentionError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                event_data = create_retention_changed_event(
+                    room_id=room_id,
+                    retention=retention,
+                    changed_by=username,
+                    timestamp=datetime.now(timezone.utc).isoformat(),
+                )
+                await self.broadcast_to_room(
+                    room_id, {"type": "retention_changed", "data": event_data}
+                )
+                self._broadcast_to_peers(
+                    room_id,
+                    "retention_changed",
+                    event_data,
+                )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "set_room_retention",
+                room_id,
+                username,
+                limits,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_retention_error_response(
+                room_id,
+                result.get("error", "Failed to set retention"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "retention_set",
+            "data": {"room_id": room_id, "retention": result["retention"]},
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent retention_set response for room {room_id}")
+
+    async def handle_set_spam_thresholds(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a set_spam_thresholds request from a room owner or moderator.
+
+        Request data: room_id, username and any of duplicate_limit,
+        mention_limit, window and mute_duration (see spam.py). Requests for
+        remote rooms are forwarded to the room's administrator, which
+        announces the change with spam_thresholds_changed.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        changes = {
+            name: request_data[name]
+            for name in THRESHOLD_FIELDS
+            if name in request_data
+        }
+
+        room = self.room_manager.get_room(room_id)
+        if room:
+            try:
+                thresholds = self.room_manager.set_spam_thresholds(
+                    room_id, username, changes
+                )
+                result = {"success": True, "spam_thresholds": thresholds}
+            except SpamError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                event_data = create_spam_thresholds_changed_event(
+                    room_id=room_id,
+                    thresholds=room.spam_thresholds,
+                    changed_by=username,
+                    timestamp=datetime.now(timezone.utc).isoformat(),
+                )
+                await self.broadcast_to_room(
+                    room_id,
+                    {"type": "spam_thresholds_changed", "data": event_data},
+                )
+                self._broadcast_to_peers(
+                    room_id,
+                    "spam_thresholds_changed",
+                    event_data,
+                )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "set_spam_thresholds",
+                room_id,
+                username,
+                changes,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_spam_error_response(
+                room_id,
+                result.get("error", "Failed to set spam thresholds"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "spam_thresholds_set",
+            "data": {
+                "room_id": room_id,
+                "spam_thresholds": result["spam_thresholds"],
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_set_content_filters(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a set_content_filters request from a room owner or moderator.
+
+        Request data: room_id, username and filters, the room's new
+        filters in the order they run (see content_filters.py). Requests
+        for remote rooms are forwarded to the room's administrator, which
+        announces the change with content_filters_changed.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        filters = request_data.get("filters")
+
+        room = self.room_manager.get_room(room_id)
+        if room:
+            try:
+                filters = self.room_manager.set_content_filters(
+                    room_id, username, filters
+                )
+                result = {
+                    "success": True,
+                    "content_filters": filters,
+                    "filter_types": self.room_manager.content_filters.types(),
+                }
+            except ContentFilterError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                event_data = create_content_filters_changed_event(
+                    room_id=room_id,
+                    filters=filters,
+                    changed_by=username,
+                    timestamp=datetime.now(timezone.utc).isoformat(),
+                )
+                await self.broadcast_to_room(
+                    room_id,
+                    {"type": "content_filters_changed", "data": event_data},
+                )
+                self._broadcast_to_peers(
+                    room_id,
+                    "content_filters_changed",
+                    event_data,
+                )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "set_content_filters",
+                room_id,
+                username,
+                filters,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_filter_error_response(
+                room_id,
+                result.get("error", "Failed to set content filters"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "content_filters_set",
+            "data": {
+                "room_id": room_id,
+                "content_filters": result["content_filters"],
+                "filter_types": result.get("filter_types", []),
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def _announce_spam(
+        self, room_id: str, username: str, error: SpamError
+    ):
+        """
+        Tell a hosted room's owner and moderators a member was muted.
+
+        Args:
+            room_id: The room ID
+            username: The member muted
+            error: The SPAM_DETECTED error that muted them
+        """
+        room = self.room_manager.get_room(room_id)
+        if room is None:
+            return
+        event_data = create_spam_detected_event(
+            room_id=room_id,
+            username=username,
+            reason=error.reason,
+            muted_until=datetime.fromtimestamp(
+                error.muted_until, timezone.utc
+            ).isoformat(),
+            moderators=room.moderators(),
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        await self.broadcast_to_room(
+            room_id, {"type": "spam_detected", "data": event_data}
+        )
+        self._broadcast_to_peers(room_id, "spam_detected", event_data)
+
+    async def handle_update_room(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an update_room request from a room's owner or a moderator.
+
+        Request data: room_id, username and at least one of room_name,
+        topic and description (an empty topic or description clears it).
+        Requests for remote rooms are forwarded to the room's
+        administrator. Members of the room on every node are told with a
+        room_updated event.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        changes = {
+            name: request_data[name]
+            for name in METADATA_FIELDS
+            if name in request_data
+        }
+
+        if self.room_manager.get_room(room_id):
+            result = await self._update_local_room(room_id, username, changes)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "update_room_metadata",
+                room_id,
+                username,
+                changes,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_room_update_error_response(
+                room_id,
+                result.get("error", "Failed to update room"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "update_room_success",
+            "data": {
+                "room_id": room_id,
+                "changes": result["changes"],
+                "versions": result["versions"],
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent update_room_success response for room {room_id}")
+
+    async def _update_local_room(
+        self, room_id: str, username: str, changes: dict
+    ) -> dict:
+        """
+        Update the metadata of a room hosted here and announce it.
+
+        A rename is committed to the Raft room registry first, if there
+        is one.
+
+        Args:
+            room_id: The room ID
+            username: The owner or moderator
+            changes: Maps room_name, topic or description -> new value
+
+        Returns:
+            dict: {'success': True, 'changes', 'versions'} or an error
+            with 'error' and 'error_code'
+        """
+        try:
+            checked = self.room_manager.check_room_update(
+                room_id, username, changes
+            )
+            if self.room_registry:
+                loop = asyncio.get_running_loop()
+                registered = await loop.run_in_executor(
+                    None, self.room_registry.update_room, room_id, checked
+                )
+                if not registered.get("success"):
+                    return registered
+            update = self.room_manager.update_room(room_id, username, checked)
+        except RoomUpdateError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event_data = create_room_updated_event(
+            room_id=room_id,
+            changes=update["changes"],
+            versions=update["versions"],
+            updated_by=username,
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        await self.broadcast_to_room(
+            room_id, {"type": "room_updated", "data": event_data}
+        )
+        self._broadcast_to_peers(room_id, "room_updated", event_data)
+        return dict(update, success=True)
+
+    async def handle_edit_message(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an edit_message request from a message's author or a
+        moderator.
+
+        Request data: room_id, username, message_id and the new content.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._edit(websocket, data.get("data", {}), EDIT)
+
+    async def handle_delete_message(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a delete_message request from a message's author or a
+        moderator.
+
+        Request data: room_id, username and message_id. The message is
+        replaced with a tombstone.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._edit(websocket, data.get("data", {}), DELETE)
+
+    async def _edit(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_data: dict,
+        action: str,
+    ):
+        """Edit or delete a message, forwarding to the admin if remote."""
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        message_id = request_data.get("message_id")
+        content = request_data.get("content") or ""
+        request_type = f"{action}_message"
+
+        if self.room_manager.get_room(room_id):
+            logger.info(
+                f"Processing {request_type} request: room {room_id}, "
+                f"message {message_id} by {username}"
+            )
+            try:
+                edit = self.room_manager.edit_message(
+                    room_id, username, message_id, action, content
+                )
+                result = {"success": True, "edit": edit}
+            except EditError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                event = create_message_edit_event(
+                    room_id, edit, self.room_manager.clock.now().encode()
+                )
+                await self.broadcast_to_room(room_id, event)
+                self._broadcast_to_peers(room_id, event["type"], event["data"])
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "edit_message",
+                room_id,
+                username,
+                message_id,
+                action,
+                content,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_message_edit_error_response(
+                request_type,
+                room_id,
+                message_id,
+                result.get("error", f"Failed to {action} message"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": f"{request_type}_success",
+            "data": {"room_id": room_id, "message_id": message_id},
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent {response['type']} response for room {room_id}")
+
+    async def handle_pin_message(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a pin_message request from a room's owner or a moderator.
+
+        Request data: room_id, username and message_id. Members of the
+        room on every node are told with a message_pinned event.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._pin(websocket, data.get("data", {}), True)
+
+    async def handle_unpin_message(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an unpin_message request from a room's owner or a
+        moderator.
+
+        Request data: room_id, username and message_id. Members of the
+        room on every node are told with a message_unpinned event.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        await self._pin(websocket, data.get("data", {}), False)
+
+    async def _pin(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_data: dict,
+        pin: bool,
+    ):
+        """Pin or unpin a message, forwarding to the admin if remote."""
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        message_id = request_data.get("message_id")
+        action = "pin" if pin else "unpin"
+        request_type = f"{action}_message"
+
+        if self.room_manager.get_room(room_id):
+            try:
+                pinned = self.room_manager.pin_message(
+                    room_id, username, message_id, pin
+                )
+                result = {"success": True, "pinned": pinned}
+            except PinError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                event_data = create_pin_event(
+                    room_id=room_id,
+                    message_id=message_id,
+                    pinned=pinned,
+                    changed_by=username,
+                    timestamp=datetime.now(timezone.utc).isoformat(),
+                )
+                await self.broadcast_to_room(
+                    room_id, {"type": PIN_EVENT_TYPES[pin], "data": event_data}
+                )
+                self._broadcast_to_peers(
+                    room_id,
+                    PIN_EVENT_TYPES[pin],
+                    event_data,
+                )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "pin_message",
+                room_id,
+                username,
+                message_id,
+                pin,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_pin_error_response(
+                request_type,
+                room_id,
+                message_id,
+                result.get("error", f"Failed to {action} message"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": f"{request_type}_success",
+            "data": {
+                "room_id": room_id,
+                "message_id": message_id,
+                "pinned": result["pinned"],
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(f"Sent {response['type']} response for room {room_id}")
+
+    async def handle_react(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a react request adding or removing an emoji reaction.
+
+        Request data: room_id, username, message_id, emoji and optionally
+        remove (true to take the reaction back). The request is forwarded
+        to the room's administrator node if the room is not hosted here.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        message_id = request_data.get("message_id")
+        emoji = request_data.get("emoji")
+        remove = bool(request_data.get("remove", False))
+
+        if self.room_manager.get_room(room_id):
+            try:
+                reaction, reactions = self.room_manager.react(
+                    room_id, username, message_id, emoji, remove
+                )
+                result = {
+                    "success": True,
+                    "changed": reaction is not None,
+                    "reactions": reactions,
+                }
+            except ReactionError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                if reaction:
+                    event = create_message_reaction_event(
+                        room_id,
+                        reaction,
+                        reactions,
+                        self.room_manager.clock.now().encode(),
+                    )
+                    await self.broadcast_to_room(room_id, event)
+                    self._broadcast_to_peers(
+                        room_id,
+                        event["type"],
+                        event["data"],
+                    )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "react",
+                room_id,
+                username,
+                message_id,
+                emoji,
+                remove,
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            response = create_reaction_error_response(
+                room_id,
+                message_id,
+                result.get("error", "Failed to react"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "react_success",
+            "data": {
+                "room_id": room_id,
+                "message_id": message_id,
+                "emoji": emoji,
+                "changed": result.get("changed", False),
+                "reactions": result.get("reactions", {}),
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def _enforce_removal(
+        self,
+        room_id: str,
+        username: str,
+        member_node: str,
+        action: str,
+        moderator: str,
+    ):
+        """Take a removed member out of a local room and announce it."""
+        if member_node == self.room_manager.node_id:
+            removed = self._take_out_of_room(room_id, username)
+            await self._send_removed(
+                removed,
+                create_removed_from_room_event(room_id, action, moderator),
+            )
+        elif self.peer_registry:
+            try:
+                self.peer_registry.call_peer(
+                    member_node,
+                    "remove_room_member",
+                    room_id,
+                    username,
+                    action,
+                    moderator,
+                )
+            except Exception as e:
+                logger.warning(
+                    f"Could not tell {member_node} to remove {username} "
+                    f"from room {room_id}: {e}"
+                )
+
+        event_data = create_member_left_event(
+            room_id=room_id,
+            username=username,
+            member_count=len(self.room_manager.get_members(room_id)),
+            timestamp=datetime.now(timezone.utc).isoformat(),
+            hlc=self.room_manager.clock.now().encode(),
+        )
+        broadcast_msg = {"type": "member_left", "data": event_data}
+        await self.broadcast_to_room(room_id, broadcast_msg)
+        self._broadcast_to_peers(room_id, "member_left", event_data)
+
+    def remove_member_sync(
+        self, room_id: str, username: str, action: str, moderator: str
+    ) -> int:
+        """
+        Take a kicked or banned user out of a room, for XML-RPC callbacks.
+
+        The user's connections stop receiving the room's messages at once;
+        the removed_from_room events are scheduled on the event loop.
+
+        Args:
+            room_id: The room ID
+            username: The removed user
+            action: "kick" or "ban"
+            moderator: Username of the owner or moderator who removed them
+
+        Returns:
+            int: Number of connections taken out of the room
+        """
+        removed = self._take_out_of_room(room_id, username)
+        if not removed:
+            return 0
+        event = create_removed_from_room_event(room_id, action, moderator)
+        self.dispatcher.submit(room_id, self._send_removed, removed, event)
+        return len(removed)
+
+    def _take_out_of_room(
+        self, room_id: str, username: str
+    ) -> List[WebSocketServerProtocol]:
+        """Unregister a user's connections and held session from a room."""
+        removed = [
+            ws
+            for ws, user in self._room_clients.get(room_id, set())
+            if user == username
+        ]
+        for ws in removed:
+            self.unregister_client_room_membership(ws, room_id)
+        if self.offline_queue:
+            self.offline_queue.drop_room(username, room_id)
+        if self.replica_store:
+            self.replica_store.remove_local_member(room_id, username)
+        return removed
+
+    async def _send_removed(
+        self, removed: List[WebSocketServerProtocol], event: dict
+    ):
+        """Send a removed_from_room event to the removed connections."""
+        frame = encode_frame(event)
+        for ws in removed:
+            try:
+                await self._send(ws, frame)
+            except websockets.exceptions.ConnectionClosed:
+                pass
+
+    async def _admit_waitlisted(self, room_id: str):
+        """
+        Fill a local room's free slots from its waiting list.
+
+        Each admitted user is put in the room through the node they are
+        connected to; users no longer connected give up their slot.
+
+        Args:
+            room_id: The room ID
+        """
+        while True:
+            admitted = self.room_manager.admit_next(room_id)
+            room = self.room_manager.get_room(room_id)
+            if admitted is None or room is None:
+                return
+            username, member_node = admitted
+            room_info = self._room_info(room)
+            messages = self.room_manager.get_messages(room_id)
+            delivered = 0
+            if member_node == self.room_manager.node_id:
+                delivered = self.deliver_admission_sync(
+                    room_id, username, room_info, messages
+                )
+            elif self.peer_registry:
+                try:
+                    result = self.peer_registry.call_peer(
+                        member_node,
+                        "notify_waitlist_admitted",
+                        room_id,
+                        username,
+                        room_info,
+                        messages,
+                    )
+                    delivered = result.get("admitted", 0)
+                except Exception as e:
+                    logger.warning(
+                        f"Could not tell {member_node} that {username} "
+                        f"was admitted to room {room_id}: {e}"
+                    )
+            if not delivered:
+                logger.info(
+                    f"Waiting user {username} is gone, giving their slot "
+                    f"in room {room_id} to the next"
+                )
+                self.room_manager.remove_member(room_id, username)
+                continue
+
+            logger.info(
+                f"Admitted {username} to room {room_id} from the waiting list"
+            )
+            event_data = create_member_joined_event(
+                room_id=room_id,
+                username=username,
+                member_count=len(self.room_manager.get_members(room_id)),
+                timestamp=datetime.now(timezone.utc).isoformat(),
+                hlc=self.room_manager.clock.now().encode(),
+            )
+            broadcast_msg = {"type": "member_joined", "data": event_data}
+            await self.broadcast_to_room(room_id, broadcast_msg)
+            self._broadcast_to_peers(room_id, "member_joined", event_data)
+
+    def admit_waitlisted_sync(self, room_id: str):
+        """
+        Fill a local room's free slots from its waiting list, for callers
+        outside the event loop.
+
+        Args:
+            room_id: The room ID
+        """
+        self.dispatcher.submit(room_id, self._admit_waitlisted, room_id)
+
+    def deliver_admission_sync(
+        self,
+        room_id: str,
+        username: str,
+        room_info: dict,
+        messages: List[dict],
+    ) -> int:
+        """
+        Put a user admitted from a waiting list in the room.
+
+        The user's connections are registered in the room at once; the
+        waitlist_admitted event and the room's messages are scheduled on
+        the event loop.
+
+        Args:
+            room_id: The room ID
+            username: The admitted user
+            room_info: The room, as in a join result
+            messages: The room's recent messages
+
+        Returns:
+            int: Number of connections put in the room (0 if the user is
+            no longer connected)
+        """
+        admitted = [
+            connection.websocket
+            for connection in self.connections.find_by_username(username)
+        ]
+        if not admitted:
+            return 0
+        for ws in admitted:
+            self.register_client_room_membership(ws, room_id, username)
+        if not self.room_manager.get_room(room_id):
+            self._adopt_remote_room(room_id, room_info, messages, username)
+
+        self.dispatcher.submit(
+            room_id,
+            self._send_admission,
+            admitted,
+            room_id,
+            room_info,
+            messages,
+        )
+        return len(admitted)
+
+    async def _send_admission(
+        self,
+        admitted: List[WebSocketServerProtocol],
+        room_id: str,
+        room_info: dict,
+        messages: List[dict],
+    ):
+        """Send waitlist_admitted and the room's messages to admitted users."""
+        event = encode_frame(create_waitlist_admitted_event(room_info))
+        frames = []
+        for message in messages:
+            self.receipts.track(room_id, message)
+            frames.append(
+                encode_frame({"type": "new_message", "data": message})
+            )
+        for ws in admitted:
+            try:
+                await self._send(ws, event)
+                for frame in frames:
+                    await self._send(ws, frame)
+            except websockets.exceptions.ConnectionClosed:
+                pass
+
+    async def handle_leave_room(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a leave_room request.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        try:
+            # Extract parameters
+            request_data = data.get("data", {})
+            room_id = request_data.get("room_id")
+            username = request_data.get("username")
+
+            if not room_id or not username:
+                await self.send_error(websocket, "Missing room_id or username")
+                return
+
+            logger.info(
+                f"Processing leave_room request: "
+                f"room {room_id} by {username}"
+            )
+
+            # Remove client from room membership tracking
+            self.unregister_client_room_membership(websocket, room_id)
+
+            # Check if this is a local or remote room
+            room = self.room_manager.get_room(room_id)
+            if room and username not in room.members:
+                # Local room the user was only waiting for
+                self.room_manager.leave_waitlist(room_id, username)
+            elif room:
+                # Local room - handle directly
+                self.room_manager.remove_member(room_id, username)
+
+                # Broadcast member_left to remaining local members
+                event_data = create_member_left_event(
+                    room_id=room_id,
+                    username=username,
+                    member_count=len(room.members),
+                    timestamp=datetime.now(timezone.utc).isoformat(),
+                    hlc=self.room_manager.clock.now().encode(),
+                )
+                broadcast_msg = {"type": "member_left", "data": event_data}
+                await self.broadcast_to_room(room_id, broadcast_msg, websocket)
+
+                # Also broadcast to peer nodes
+                self._broadcast_to_peers(room_id, "member_left", event_data)
+                await self._admit_waitlisted(room_id)
+            elif self.partition and self.partition.is_degraded(room_id):
+                # The admin learns of the leave when the room is reconciled
+                if self.replica_store:
+                    self.replica_store.record_local_leave(room_id, username)
+            else:
+                # Remote room - call XML-RPC on the admin node
+                await self._handle_remote_leave(
+                    room_id, username, self._auth_args(websocket)
+                )
+                if self.replica_store:
+                    self.replica_store.remove_local_member(room_id, username)
+
+            # Send success response
+            response = {
+                "type": "leave_room_success",
+                "data": {
+                    "room_id": room_id,
+                    "username": username,
+                },
+            }
+            await self._send(websocket, json.dumps(response))
+            logger.info(f"User {username} left room {room_id}")
+
+        except Exception as e:
+            logger.error(f"Error processing leave_room: {e}")
+            await self.send_error(websocket, str(e))
+
+    async def _handle_remote_leave(
+        self, room_id: str, username: str, auth_args: tuple = ()
+    ):
+        """
+        Handle leaving a remote room by calling XML-RPC on the admin node.
+
+        Args:
+            room_id: The room ID
+            username: The username
+            auth_args: Session token to forward, as a 0- or 1-tuple
+        """
+        if not self.peer_registry:
+            return
+
+        # Find the admin node for the room
+        target_room, node_address = self._locate_room_admin(room_id)
+
+        if not target_room:
+            logger.warning(f"Could not find admin node for room {room_id}")
+            return
+
+        if not node_address:
+            logger.warning(
+                f"Could not get address for admin node of room {room_id}"
+            )
+            return
+
+        # Call XML-RPC to leave the room
+        try:
+            proxy = ServerProxy(node_address, allow_none=True)
+            proxy.leave_room(
+                room_id, username, self.room_manager.node_id, *auth_args
+            )
+        except Exception as e:
+            logger.error(f"Failed to leave remote room: {e}")
+
+    async def handle_discover_rooms(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a discover_rooms request for global room discovery.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        logger.info("Processing discover_rooms request")
+
+        try:
+            # Check if peer registry is available
+            if not self.peer_registry:
+                # Fall back to local rooms only
+                logger.warning(
+                    "Peer registry not available, returning local rooms only"
+                )
+                rooms = self.room_manager.list_public_rooms()
+                response = {
+                    "type": "global_rooms_list",
+                    "data": {
+                        "rooms": rooms,
+                        "total_count": len(rooms),
+                        "nodes_queried": [self.room_manager.node_id],
+                        "nodes_available": [self.room_manager.node_id],
+                        "nodes_unavailable": [],
+                    },
+                }
+            else:
+                # Get local public rooms
+                local_rooms = self.room_manager.list_public_rooms()
+
+                # Discover rooms from all nodes (including peers)
+                discovery_result = self.peer_registry.discover_global_rooms(
+                    local_rooms
+                )
+
+                # Create response
+                response = {
+                    "type": "global_rooms_list",
+                    "data": discovery_result,
+                }
+
+            # Send response
+            await self._send(websocket, json.dumps(response))
+            logger.info(
+                f"Sent global_rooms_list response with "
+                f"{response['data']['total_count']} rooms"
+            )
+
+        except Exception as e:
+            logger.error(f"Error discovering rooms: {e}")
+            await self.send_error(
+                websocket, "Failed to discover rooms", error_type="error"
+            )
+
+    async def send_error(
+        self,
+        websocket: WebSocketServerProtocol,
+        error_message: str,
+        error_type: str = "error",
+        error_code: Optional[str] = None,
+    ):
+        """
+        Send an error response to a client.
+
+        Args:
+            websocket: The WebSocket connection
+            error_message: The error message
+            error_type: The type of error response
+            error_code: Optional error code of the error
+        """
+        response = create_error_response(
+            error_message, error_type, error_code
+        )
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_send_message(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a send_message request from a client.
+
+        The client may choose the message's ``message_id`` (and must, if
+        require_message_id is set), so a retry of a message that was
+        already accepted is not added twice. Once the room administrator
+        accepts the message the sender gets both message_sent and a
+        message_status event with status "sent". A ``reply_to`` message ID
+        makes the message a reply in that message's thread. In a private
+        room an ``encryption`` envelope makes the message end-to-end
+        encrypted: its content is then opaque ciphertext (see e2ee.py).
+        An ``attachments`` list references files uploaded beforehand (see
+        attachments.py); the content may then be empty. A ``send_at`` time
+        (ISO 8601) schedules the message instead: the sender gets
+        message_scheduled, and the room's administrator sends the message
+        at that time (see scheduled.py). In a durable room the sender is
+        answered only once a write quorum of the room's copies holds the
+        message (see durability.py).
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        try:
+            # Extract parameters
+            request_data = data.get("data", {})
+            room_id = request_data.get("room_id")
+            username = request_data.get("username")
+            content = request_data.get("content")
+            message_id = request_data.get("message_id")
+            reply_to = request_data.get("reply_to")
+            encryption = request_data.get("encryption")
+            attachments = request_data.get("attachments")
+            send_at = request_data.get("send_at")
+
+            # Validate required fields
+            if not room_id or not username:
+                await self.send_message_error(
+                    websocket,
+                    room_id or "",
+                    "Missing room_id or username",
+                    "INVALID_REQUEST",
+                )
+                return
+
+            # Validate message content
+            if encryption is not None:
+                is_valid, error_msg = validate_encrypted_message(
+                    content, encryption
+                )
+                error_code = "INVALID_CIPHERTEXT"
+            elif attachments and content == "":
+                is_valid, error_msg = True, None
+            else:
+                is_valid, error_msg = validate_message_content(content)
+                error_code = "INVALID_CONTENT"
+            if is_valid and attachments is not None:
+                if self.attachments is None:
+                    is_valid, error_msg = (
+                        False,
+                        "Attachments are not supported by this node",
+                    )
+                else:
+                    is_valid, error_msg = validate_attachments(
+                        attachments, self.attachments.max_size
+                    )
+                error_code = "INVALID_ATTACHMENT"
+            if not is_valid:
+                await self.send_message_error(
+                    websocket,
+                    room_id,
+                    error_msg,
+                    error_code,
+                )
+                return
+
+            if message_id is None and self.require_message_id:
+                await self.send_message_error(
+                    websocket,
+                    room_id,
+                    "Missing message_id; generate a UUID for each message",
+                    "INVALID_REQUEST",
+                )
+                return
+            for field_id in (message_id, reply_to):
+                if field_id is None:
+                    continue
+                is_valid, error_msg = validate_message_id(field_id)
+                if not is_valid:
+                    await self.send_message_error(
+                        websocket, room_id, error_msg, "INVALID_REQUEST"
+                    )
+                    return
+
+            logger.info(
+                f"Processing send_message request: "
+                f"room {room_id} from {username}"
+            )
+
+            # Check if user is member of the room (local check)
+            if not self._is_client_in_room(websocket, room_id):
+                await self.send_message_error(
+                    websocket,
+                    room_id,
+                    "You are not a member of this room",
+                    "NOT_MEMBER",
+                )
+                return
+
+            if send_at is not None:
+                if encryption is not None or attachments:
+                    await self.send_message_error(
+                        websocket,
+                        room_id,
+                        "Scheduled messages can't be encrypted or carry "
+                        "attachments",
+                        "INVALID_REQUEST",
+                    )
+                    return
+                await self._schedule_message(
+                    websocket,
+                    room_id,
+                    username,
+                    content,
+                    send_at,
+                    message_id,
+                    reply_to,
+                )
+                return
+
+            # Check if this node administers the room
+            room = self.room_manager.get_room(room_id)
+
+            message_args = (
+                room_id,
+                username,
+                content,
+                message_id,
+                reply_to,
+                encryption,
+                attachments or None,
+            )
+            if room:
+                # Local message - this node is the administrator
+                result = await self._await_durable(
+                    room,
+                    await self._handle_local_message(websocket, *message_args),
+                )
+            elif self.partition and self.partition.is_degraded(room_id):
+                result = self._handle_degraded_message(websocket, *message_args)
+            else:
+                # Remote message - forward to administrator
+                result = await self._handle_remote_message(
+                    websocket, *message_args
+                )
+                if self._follow_move(room_id, result):
+                    result = await self._handle_remote_message(
+                        websocket, *message_args
+                    )
+                if (
+                    self.partition
+                    and result.get("error_code") == "ADMIN_NODE_UNAVAILABLE"
+                ):
+                    await self.degrade_room(
+                        room_id, self._room_admin_node(room_id), result["error"]
+                    )
+                    result = self._handle_degraded_message(
+                        websocket, *message_args
+                    )
+
+            if result.get("buffered"):
+                status = create_message_status_event(
+                    room_id=room_id,
+                    message_id=result["message_id"],
+                    status="buffered",
+                )
+                await self._send(websocket, json.dumps(status))
+                logger.info(
+                    f"Buffered message from {username} for degraded room "
+                    f"{room_id}"
+                )
+            elif result["success"]:
+                # Send confirmation to sender
+                confirmation = create_message_sent_confirmation(
+                    room_id=room_id,
+                    message_id=result["message_id"],
+                    sequence_number=result["sequence_number"],
+                    timestamp=result["timestamp"],
+                    vector_clock=result.get("vector_clock"),
+                    replicas=result.get("replicas"),
+                )
+                await self._send(websocket, json.dumps(confirmation))
+                status = create_message_status_event(
+                    room_id=room_id,
+                    message_id=result["message_id"],
+                    status="sent",
+                    sequence_number=result["sequence_number"],
+                    timestamp=result["timestamp"],
+                )
+                await self._send(websocket, json.dumps(status))
+                logger.info(
+                    f"Message from {username} sent successfully "
+                    f"(seq: {result['sequence_number']})"
+                )
+            else:
+                await self.send_message_error(
+                    websocket,
+                    room_id,
+                    result.get("error", "Failed to send message"),
+                    result.get("error_code", "UNKNOWN_ERROR"),
+                    result.get("message_id"),
+                )
+
+        except Exception as e:
+            logger.error(f"Error processing send_message: {e}")
+            room_id = data.get("data", {}).get("room_id", "")
+            await self.send_message_error(
+                websocket, room_id, str(e), "INTERNAL_ERROR"
+            )
+
+    async def _schedule_message(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        username: str,
+        content: str,
+        send_at: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+    ):
+        """Schedule a message, forwarding to the admin if remote."""
+        if self.room_manager.get_room(room_id):
+            try:
+                result = {
+                    "success": True,
+                    "scheduled": self.room_manager.schedule_message(
+                        room_id,
+                        username,
+                        content,
+                        send_at,
+                        message_id,
+                        reply_to,
+                    ),
+                }
+            except ScheduleError as e:
+                result = self._schedule_failure(e)
+            else:
+                self._replicate_schedule(room_id)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "schedule_message",
+                room_id,
+                username,
+                content,
+                send_at,
+                message_id or "",
+                reply_to or "",
+                *self._auth_args(websocket),
+            )
+
+        if not result.get("success"):
+            await self.send_message_error(
+                websocket,
+                room_id,
+                result.get("error", "Failed to schedule message"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+            return
+        response = {
+            "type": "message_scheduled",
+            "data": {"room_id": room_id, "scheduled": result["scheduled"]},
+        }
+        await self._send(websocket, json.dumps(response))
+        logger.info(
+            f"Scheduled message from {username} in room {room_id} for "
+            f"{result['scheduled']['send_at']}"
+        )
+
+    async def handle_list_scheduled(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a list_scheduled request from a room member.
+
+        Request data: room_id and username. The client gets
+        scheduled_messages with the user's pending messages, or the whole
+        room's for its owner and moderators, in the order they are due.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                result = {
+                    "success": True,
+                    "scheduled": self.room_manager.list_scheduled(
+                        room_id, username
+                    ),
+                }
+            except ScheduleError as e:
+                result = self._schedule_failure(e)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "list_scheduled",
+                room_id,
+                username,
+                *self._auth_args(websocket),
+            )
+        await self._send_schedule_result(
+            websocket,
+            "list_scheduled",
+            "scheduled_messages",
+            room_id,
+            result,
+            "scheduled",
+        )
+
+    async def handle_cancel_scheduled(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a cancel_scheduled request from a room member.
+
+        Request data: room_id, username and message_id. The client gets
+        scheduled_cancelled once the room's administrator has dropped the
+        message.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        message_id = request_data.get("message_id")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                self.room_manager.cancel_scheduled(
+                    room_id, username, message_id
+                )
+                result = {"success": True, "message_id": message_id}
+            except ScheduleError as e:
+                result = self._schedule_failure(e)
+            else:
+                self._replicate_schedule(room_id)
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "cancel_scheduled",
+                room_id,
+                username,
+                message_id,
+                *self._auth_args(websocket),
+            )
+        await self._send_schedule_result(
+            websocket,
+            "cancel_scheduled",
+            "scheduled_cancelled",
+            room_id,
+            result,
+            "message_id",
+        )
+
+    @staticmethod
+    def _schedule_failure(error: ScheduleError) -> dict:
+        """Describe a refused scheduled message request as a result."""
+        return {
+            "success": False,
+            "error": str(error),
+            "error_code": error.error_code,
+        }
+
+    async def _send_schedule_result(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        response_type: str,
+        room_id: str,
+        result: dict,
+        key: str,
+    ):
+        """Send a schedule request's result, or schedule_error."""
+        if not result.get("success"):
+            response = create_schedule_error_response(
+                request_type,
+                room_id,
+                result.get("error", "Failed to manage scheduled messages"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+        else:
+            response = {
+                "type": response_type,
+                "data": {"room_id": room_id, key: result[key]},
+            }
+        await self._send(websocket, json.dumps(response))
+
+    def _replicate_schedule(self, room_id: str):
+        """Send a hosted room's changed schedule to its followers."""
+        if self.replication:
+            self.replication.replicate_room_info(room_id)
+
+    async def post_scheduled_messages(self, now=None) -> int:
+        """
+        Send the due scheduled messages of rooms hosted here.
+
+        Each is posted as its author (see RoomStateManager.send_scheduled)
+        and broadcast like any message, and the rooms' followers get the
+        rest of their schedules.
+
+        Args:
+            now: Current time as a datetime (defaults to the time now)
+
+        Returns:
+            int: Number of messages sent
+        """
+        sent = 0
+        changed = set()
+        for room_id, message_id in self.room_manager.due_scheduled(now):
+            message = self.room_manager.send_scheduled(room_id, message_id)
+            if message_id not in self.room_manager.get_scheduled(room_id):
+                changed.add(room_id)
+            if message is None:
+                continue
+            await self._broadcast_message_to_room(room_id, message)
+            if message.get("thread_id"):
+                await self._announce_thread(room_id, message)
+            sent += 1
+        for room_id in changed:
+            self._replicate_schedule(room_id)
+        return sent
+
+    async def handle_message_received(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a client confirming receipt of a room message.
+
+        The message's sender gets a message_status event with status
+        "delivered". Receipts are optional and best effort, so nothing is
+        sent back to the recipient.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        message_id = request_data.get("message_id")
+        username = request_data.get("username")
+        if not room_id or not message_id or not username:
+            return
+        if not self._is_client_in_room(websocket, room_id):
+            return
+
+        tracked = self.receipts.confirm(room_id, message_id, username)
+        if tracked is None:
+            return
+        receipt = DeliveryReceipt(
+            room_id=room_id,
+            message_id=message_id,
+            sender=tracked.sender,
+            recipient=username,
+        )
+        await self._route_receipt(receipt, tracked.origin_node)
+
+    async def handle_mark_read(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a mark_read request moving the user's read position.
+
+        Request data: room_id, username and sequence_number (of the last
+        message read). The room's administrator keeps the position, so
+        requests for remote rooms are forwarded to it. The client gets
+        mark_read_success with its read state.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        sequence_number = request_data.get("sequence_number")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                changed = self.room_manager.mark_read(
+                    room_id, username, sequence_number
+                )
+                result = dict(
+                    self.room_manager.get_read_state(room_id, username),
+                    success=True,
+                )
+            except ReadReceiptError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                if changed:
+                    event = create_read_position_updated_event(
+                        room_id,
+                        username,
+                        result["last_read"],
+                        self.room_manager.clock.now().encode(),
+                    )
+                    await self.broadcast_to_room(room_id, event)
+                    self._broadcast_to_peers(
+                        room_id,
+                        event["type"],
+                        event["data"],
+                    )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "mark_read",
+                room_id,
+                username,
+                sequence_number,
+                *self._auth_args(websocket),
+            )
+        await self._send_read_state(
+            websocket, "mark_read", "mark_read_success", room_id, result
+        )
+
+    async def handle_get_read_state(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a get_read_state request.
+
+        Request data: room_id and username. The client gets read_state
+        with its read position, unread count and every member's read
+        position, from the room's administrator node.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                result = dict(
+                    self.room_manager.get_read_state(room_id, username),
+                    success=True,
+                )
+            except ReadReceiptError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "get_read_state",
+                room_id,
+                username,
+                *self._auth_args(websocket),
+            )
+        await self._send_read_state(
+            websocket, "get_read_state", "read_state", room_id, result
+        )
+
+    async def _send_read_state(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        response_type: str,
+        room_id: str,
+        result: dict,
+    ):
+        """Send a read state result, or read_state_error if it failed."""
+        if not result.get("success"):
+            response = create_read_state_error_response(
+                request_type,
+                room_id,
+                result.get("error", "Failed to get read state"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+        else:
+            response = {
+                "type": response_type,
+                "data": {
+                    "room_id": room_id,
+                    "last_read": result["last_read"],
+                    "unread_count": result["unread_count"],
+                    "message_counter": result["message_counter"],
+                    "read_positions": result["read_positions"],
+                },
+            }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_publish_key(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a publish_key request sharing the user's public key.
+
+        Request data: room_id, username, key_id, algorithm and public_key
+        (base64). The room's administrator keeps the key, so requests for
+        remote rooms are forwarded to it. The client gets
+        publish_key_success with the key record, and the room's clients on
+        every node get a key_published event.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        key_args = (
+            request_data.get("key_id"),
+            request_data.get("algorithm"),
+            request_data.get("public_key"),
+        )
+
+        if self.room_manager.get_room(room_id):
+            try:
+                key = self.room_manager.publish_key(
+                    room_id, username, *key_args
+                )
+                result = {"success": True, "key": key}
+            except E2EEError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+            else:
+                event = create_key_published_event(
+                    room_id, key, self.room_manager.clock.now().encode()
+                )
+                await self.broadcast_to_room(room_id, event)
+                self._broadcast_to_peers(
+                    room_id,
+                    event["type"],
+                    event["data"],
+                )
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "publish_key",
+                room_id,
+                username,
+                *key_args,
+                *self._auth_args(websocket),
+            )
+        await self._send_key_result(
+            websocket, "publish_key", "publish_key_success", room_id, result
+        )
+
+    async def handle_get_room_keys(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a get_room_keys request.
+
+        Request data: room_id and username. The client gets room_keys with
+        the public keys of the room's current members, from the room's
+        administrator node.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+
+        if self.room_manager.get_room(room_id):
+            try:
+                result = {
+                    "success": True,
+                    "keys": self.room_manager.get_public_keys(
+                        room_id, username
+                    ),
+                }
+            except E2EEError as e:
+                result = {
+                    "success": False,
+                    "error": str(e),
+                    "error_code": e.error_code,
+                }
+        else:
+            result = await self._call_room_admin(
+                room_id,
+                "get_room_keys",
+                room_id,
+                username,
+                *self._auth_args(websocket),
+            )
+        await self._send_key_result(
+            websocket, "get_room_keys", "room_keys", room_id, result
+        )
+
+    async def _send_key_result(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        response_type: str,
+        room_id: str,
+        result: dict,
+    ):
+        """Send a key or room keys result, or key_error if it failed."""
+        if not result.get("success"):
+            response = create_key_error_response(
+                request_type,
+                room_id,
+                result.get("error", "Failed to handle encryption keys"),
+                result.get("error_code", "UNKNOWN_ERROR"),
+            )
+        elif "key" in result:
+            response = {"type": response_type, "data": result["key"]}
+        else:
+            response = {
+                "type": response_type,
+                "data": {"room_id": room_id, "keys": result["keys"]},
+            }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_start_upload(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a start_upload request announcing a file to attach.
+
+        Request data: room_id, username, hash (hex SHA-256), size,
+        content_type and filename. The client gets upload_started with the
+        upload ID and chunk size, or upload_complete right away if this
+        node already has the file.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        try:
+            self._check_upload_room(websocket, room_id)
+            result = self.attachments.start_upload(
+                username,
+                room_id,
+                request_data.get("hash"),
+                request_data.get("size"),
+                request_data.get("content_type"),
+                request_data.get("filename"),
+            )
+        except AttachmentError as e:
+            await self._send_upload_error(websocket, "start_upload", e)
+            return
+        if result.get("complete"):
+            response = {
+                "type": "upload_complete",
+                "data": {
+                    "upload_id": None,
+                    "room_id": room_id,
+                    "attachment": result["attachment"],
+                },
+            }
+        else:
+            response = {
+                "type": "upload_started",
+                "data": {"room_id": room_id, **result},
+            }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_upload_chunk(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an upload_chunk request carrying part of an uploaded file.
+
+        Request data: upload_id, username, offset and data (base64). The
+        client gets upload_progress with the number of bytes received.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        upload_id = request_data.get("upload_id")
+        try:
+            self._check_upload_room(websocket)
+            received = self.attachments.upload_chunk(
+                upload_id,
+                request_data.get("username"),
+                request_data.get("offset"),
+                request_data.get("data"),
+            )
+        except AttachmentError as e:
+            await self._send_upload_error(
+                websocket, "upload_chunk", e, upload_id
+            )
+            return
+        response = {
+            "type": "upload_progress",
+            "data": {"upload_id": upload_id, "received": received},
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_finish_upload(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a finish_upload request once every chunk was sent.
+
+        Request data: upload_id and username. The client gets
+        upload_complete with the attachment reference to send in a
+        message's attachments.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        upload_id = request_data.get("upload_id")
+        try:
+            self._check_upload_room(websocket)
+            loop = asyncio.get_running_loop()
+            upload = await loop.run_in_executor(
+                None,
+                self.attachments.finish_upload,
+                upload_id,
+                request_data.get("username"),
+            )
+        except AttachmentError as e:
+            await self._send_upload_error(
+                websocket, "finish_upload", e, upload_id
+            )
+            return
+        except OSError as e:
+            logger.error(f"Failed to store upload {upload_id}: {e}")
+            await self._send_upload_error(
+                websocket,
+                "finish_upload",
+                AttachmentError("Failed to store file", "INTERNAL_ERROR"),
+                upload_id,
+            )
+            return
+        response = {
+            "type": "upload_complete",
+            "data": {
+                "upload_id": upload_id,
+                "room_id": upload.room_id,
+                "attachment": upload.attachment(),
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_get_attachment(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a get_attachment request downloading part of a file.
+
+        Request data: room_id, username, hash and optionally offset. The
+        client gets attachment_chunk with up to CHUNK_SIZE bytes (base64)
+        from the offset, the file's size and whether it was the last
+        chunk. A file this node doesn't have yet is fetched first from the
+        room's admin node, or failing that from any peer.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        sha256 = request_data.get("hash")
+        offset = request_data.get("offset") or 0
+        try:
+            self._check_upload_room(websocket, room_id)
+            if not isinstance(offset, int) or offset < 0:
+                raise AttachmentError(
+                    "offset must be a non-negative integer", "INVALID_REQUEST"
+                )
+            chunk = self.attachments.read_chunk(sha256, offset)
+            if chunk is None:
+                sources = [self._room_admin_node(room_id)]
+                if self.peer_registry:
+                    sources += sorted(self.peer_registry.list_peers())
+                loop = asyncio.get_running_loop()
+                await loop.run_in_executor(
+                    None, self.attachments.fetch, sha256, sources
+                )
+                chunk = self.attachments.read_chunk(sha256, offset)
+            if chunk is None:
+                raise AttachmentError(
+                    "Attachment not found", "ATTACHMENT_NOT_FOUND"
+                )
+        except AttachmentError as e:
+            await self._send_upload_error(websocket, "get_attachment", e)
+            return
+        size = self.attachments.blob_store.size(sha256)
+        response = {
+            "type": "attachment_chunk",
+            "data": {
+                "room_id": room_id,
+                "hash": sha256,
+                "offset": offset,
+                "data": base64.b64encode(chunk).decode("ascii"),
+                "size": size,
+                "done": offset + len(chunk) >= size,
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+
+    def _check_upload_room(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: Optional[str] = None,
+    ) -> None:
+        """
+        Check that attachments are enabled and the client is in the room.
+
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room the request is for (None to skip the check)
+
+        Raises:
+            AttachmentError: If attachments are disabled
+                (ATTACHMENTS_DISABLED) or the client is not in the room
+                (NOT_MEMBER)
+        """
+        if self.attachments is None:
+            raise AttachmentError(
+                "Attachments are not supported by this node",
+                "ATTACHMENTS_DISABLED",
+            )
+        if room_id is not None and not self._is_client_in_room(
+            websocket, room_id
+        ):
+            raise AttachmentError(
+                "You are not a member of this room", "NOT_MEMBER"
+            )
+
+    def _require_attachments(self, attachments: List[dict]) -> None:
+        """
+        Check that this node holds the blobs of a message's attachments.
+
+        Args:
+            attachments: The message's attachment references
+
+        Raises:
+            AttachmentError: If attachments are disabled or a reference is
+                invalid (INVALID_ATTACHMENT), or a blob isn't stored here
+                (ATTACHMENT_NOT_FOUND)
+        """
+        if self.attachments is None:
+            raise AttachmentError(
+                "Attachments are not supported by this node",
+                "INVALID_ATTACHMENT",
+            )
+        self.attachments.require(attachments)
+
+    async def _send_upload_error(
+        self,
+        websocket: WebSocketServerProtocol,
+        request_type: str,
+        error: AttachmentError,
+        upload_id: Optional[str] = None,
+    ):
+        """Send an upload_error response for a failed attachment request."""
+        response = create_upload_error_response(
+            request_type, str(error), error.error_code, upload_id
+        )
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_typing(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a client saying its user started or stopped typing.
+
+        The typing event goes to the room's other clients here and to
+        every peer node, at most once per TYPING_THROTTLE seconds per user
+        and room. Like receipts, typing updates are best effort: nothing
+        is sent back and nothing is logged.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        username = request_data.get("username")
+        typing = request_data.get("typing", True) is not False
+        if not room_id or not username:
+            return
+        if not self._is_client_in_room(websocket, room_id):
+            return
+        if not self.typing.allow(room_id, username, typing):
+            return
+
+        event = create_typing_event(
+            room_id,
+            username,
+            typing,
+            self.typing.timeout,
+            datetime.now(timezone.utc).isoformat(),
+        )
+        await self.broadcast_to_room(
+            room_id, event, exclude_websocket=websocket
+        )
+        self._broadcast_to_peers(room_id, event["type"], event["data"])
+
+    async def _route_receipt(
+        self, receipt: DeliveryReceipt, origin_node: str
+    ) -> bool:
+        """
+        Pass a delivery receipt to the node its message's sender is on.
+
+        Args:
+            receipt: The receipt
+            origin_node: Node the sender is connected to
+
+        Returns:
+            bool: True if the receipt reached at least one connection
+        """
+        if not origin_node or origin_node == self.room_manager.node_id:
+            event = self._message_status_event(receipt)
+            return await self._send_to_user(receipt.sender, event) > 0
+
+        if not self.peer_registry:
+            return False
+        try:
+            result = self.peer_registry.call_peer(
+                origin_node, "deliver_receipt", receipt.to_dict()
+            )
+        except Exception as e:
+            logger.debug(
+                f"Could not deliver receipt for message "
+                f"{receipt.message_id} to {origin_node}: {e}"
+            )
+            return False
+        return bool(result and result.get("success"))
+
+    def deliver_receipt_sync(self, receipt: dict) -> int:
+        """
+        Deliver a receipt from a peer, for use in XML-RPC callbacks.
+
+        The sends are scheduled on the event loop; the return value counts
+        the connections they were scheduled for.
+
+        Args:
+            receipt: The DeliveryReceipt dict
+
+        Returns:
+            int: Number of local connections of the sender
+        """
+        sender = receipt.get("sender", "")
+        connections = self.connections.find_by_username(sender)
+        if not connections:
+            return 0
+        event = self._message_status_event(DeliveryReceipt.from_dict(receipt))
+        self.dispatcher.submit(
+            receipt.get("room_id"), self._send_to_user, sender, event
+        )
+        return len(connections)
+
+    @staticmethod
+    def _message_status_event(receipt: DeliveryReceipt) -> dict:
+        """Build the "delivered" message_status event for a receipt."""
+        return create_message_status_event(
+            room_id=receipt.room_id,
+            message_id=receipt.message_id,
+            status="delivered",
+            recipient=receipt.recipient,
+            timestamp=receipt.timestamp,
+        )
+
+    def _is_client_in_room(
+        self, websocket: WebSocketServerProtocol, room_id: str
+    ) -> bool:
+        """
+        Check if a client's websocket is registered as being in a room.
+
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room ID
+
+        Returns:
+            bool: True if client is in the room
+        """
+        if websocket not in self._client_rooms:
+            return False
+        return room_id in self._client_rooms[websocket]
+
+    async def _handle_local_message(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        username: str,
+        content: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+        encryption: Optional[dict] = None,
+        attachments: Optional[List[dict]] = None,
+    ) -> dict:
+        """
+        Handle a message for a room administered by this node.
+
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room ID
+            username: The username
+            content: The message content
+            message_id: Optional ID generated by the sender
+            reply_to: Optional ID of the message replied to
+            encryption: Optional envelope of an encrypted message
+            attachments: Optional references to uploaded files
+
+        Returns:
+            dict: Result with success status and message data or error
+        """
+        # Add message to room (assigns sequence number)
+        try:
+            if attachments:
+                self._require_attachments(attachments)
+            message = self.room_manager.add_message(
+                room_id,
+                username,
+                content,
+                message_id=message_id,
+                reply_to=reply_to,
+                encryption=encryption,
+                attachments=attachments,
+            )
+        except (
+            ThreadError,
+            E2EEError,
+            AttachmentError,
+            AnnouncementError,
+            ContentFilterError,
+        ) as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        except SpamError as e:
+            if e.error_code == SPAM_DETECTED:
+                await self._announce_spam(room_id, username, e)
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        except DuplicateMessageError as e:
+            # A retry of a message that was already added
+            existing = e.message
+            if existing["username"] != username:
+                return {
+                    "success": False,
+                    "error": "Message ID is already in use",
+                    "error_code": "DUPLICATE_MESSAGE_ID",
+                }
+            return {
+                "success": True,
+                "message_id": existing["message_id"],
+                "sequence_number": existing["sequence_number"],
+                "timestamp": existing["timestamp"],
+                "vector_clock": existing["vector_clock"],
+            }
+
+        if not message:
+            return {
+                "success": False,
+                "error": "Failed to add message",
+                "error_code": "INTERNAL_ERROR",
+            }
+
+        # Broadcast to all room members (including sender)
+        await self._broadcast_message_to_room(room_id, message)
+        if message.get("thread_id"):
+            await self._announce_thread(room_id, message)
+        if message.get("attachments") and self.replication:
+            self.attachments.replicate(
+                room_id,
+                message["attachments"],
+                self.replication.choose_followers(room_id),
+            )
+
+        return {
+            "success": True,
+            "message_id": message["message_id"],
+            "sequence_number": message["sequence_number"],
+            "timestamp": message["timestamp"],
+            "vector_clock": message["vector_clock"],
+        }
+
+    async def _await_durable(self, room, result: dict) -> dict:
+        """
+        Hold a durable room's message until a write quorum holds it.
+
+        Args:
+            room: The local room the message was added to
+            result: Result of _handle_local_message
+
+        Returns:
+            dict: The result with the copies holding the message, or a
+            QUORUM_NOT_REACHED error (see durability.py)
+        """
+        if not room.durable or not result.get("success"):
+            return result
+        return await asyncio.get_running_loop().run_in_executor(
+            None, await_quorum, self.replication, room.room_id, result
+        )
+
+    async def _handle_remote_message(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        username: str,
+        content: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+        encryption: Optional[dict] = None,
+        attachments: Optional[List[dict]] = None,
+    ) -> dict:
+        """
+        Handle a message for a room administered by another node.
+
+        A message with an ID is forwarded again if the call fails (e.g.
+        times out): the administrator recognises the ID, so a message that
+        did arrive the first time is not added twice.
+
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room ID
+            username: The username
+            content: The message content
+            message_id: Optional ID generated by the sender
+            reply_to: Optional ID of the message replied to
+            encryption: Optional envelope of an encrypted message
+            attachments: Optional references to files uploaded here, which
+                the administrator pulls from this node
+
+        Returns:
+            dict: Result with success status and message data or error
+        """
+        if not self.peer_registry:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+
+        # Find the administrator node for this room
+        target_room, node_address = self._locate_room_admin(room_id)
+
+        if not target_room:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+
+        if not node_address:
+            return {
+                "success": False,
+                "error": "Administrator node unavailable",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+
+        # Forward message to administrator via XML-RPC
+        extra_args = self._auth_args(websocket)
+        attempts = 1
+        if message_id or reply_to or encryption is not None or attachments:
+            extra_args = (
+                self._session_token(websocket) or "",
+                message_id or "",
+                reply_to or "",
+            )
+        if encryption is not None or attachments:
+            extra_args += (encryption,)
+        if attachments:
+            extra_args += (attachments,)
+        if message_id and delivery_policy(target_room.get("delivery")).retry:
+            attempts += FORWARD_RETRIES
+        for attempt in range(attempts):
+            try:
+                proxy = ServerProxy(node_address, allow_none=True)
+                return proxy.forward_message(
+                    room_id,
+                    username,
+                    content,
+                    self.room_manager.node_id,
+                    *extra_args,
+                )
+            except Exception as e:
+                error = e
+                logger.warning(
+                    f"Failed to forward message (attempt {attempt + 1} of "
+                    f"{attempts}): {e}"
+                )
+            if attempt + 1 < attempts:
+                await asyncio.sleep(FORWARD_RETRY_DELAY)
+
+        logger.error(f"Failed to forward message: {error}")
+        return {
+            "success": False,
+            "error": f"Failed to contact administrator node: {error}",
+            "error_code": "ADMIN_NODE_UNAVAILABLE",
+        }
+
+    def _handle_degraded_message(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        username: str,
+        content: str,
+        message_id: Optional[str] = None,
+        reply_to: Optional[str] = None,
+        encryption: Optional[dict] = None,
+        attachments: Optional[List[dict]] = None,
+    ) -> dict:
+        """
+        Handle a message for a room whose admin node is unreachable.
+
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room ID
+            username: The username
+            content: The message content
+            message_id: Optional ID generated by the sender
+            reply_to: Optional ID of the message replied to
+            encryption: Optional envelope of an encrypted message
+            attachments: Optional references to uploaded files
+
+        Returns:
+            dict: Result with success and buffered set and the buffered
+            message's ID, or an error (e.g., ROOM_READ_ONLY)
+        """
+        try:
+            message = self.partition.buffer(
+                room_id,
+                username,
+                content,
+                message_id,
+                reply_to,
+                self._session_token(websocket),
+                self.causal_buffer.delivered_clock(room_id)
+                if self.causal_buffer
+                else None,
+                encryption,
+                attachments,
+            )
+        except PartitionError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {
+            "success": True,
+            "buffered": True,
+            "message_id": message.message_id,
+        }
+
+    def _room_admin_node(self, room_id: str) -> Optional[str]:
+        """
+        Get the node ID of a remote room's admin as known to this node.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            The admin node ID from the room registry, directory or
+            replica, or None if unknown
+        """
+        if self.room_registry:
+            room = self.room_registry.get(room_id)
+            if room:
+                return room["admin_node"]
+        if self.room_directory:
+            entry = self.room_directory.get(room_id)
+            if entry:
+                return entry.admin_node
+        if self.replica_store:
+            replica = self.replica_store.get(room_id)
+            if replica:
+                return replica.admin_node
+        return None
+
+    async def degrade_room(
+        self, room_id: str, admin_node: Optional[str], reason: str
+    ) -> None:
+        """
+        Degrade a remote room and tell its local clients.
+
+        Args:
+            room_id: The room ID
+            admin_node: Node ID of the unreachable admin, if known
+            reason: Why the admin is unreachable
+        """
+        if self.partition.degrade(room_id, admin_node, reason):
+            status = self.partition.status(room_id)
+            await self.broadcast_to_room(
+                room_id, create_room_status_event(status)
+            )
+
+    async def on_membership_change(self, event: MembershipEvent) -> None:
+        """
+        Degrade the remote rooms of a peer that stopped responding, or try
+        to reconcile degraded rooms when a peer comes back.
+
+        Args:
+            event: The peer's liveness change
+        """
+        if not self.partition:
+            return
+        if event.current == PeerState.ALIVE:
+            await self.reconcile_partitions()
+            return
+        for room_id in list(self._room_clients):
+            if self.room_manager.get_room(room_id):
+                continue
+            if self._room_admin_node(room_id) == event.node_id:
+                await self.degrade_room(
+                    room_id,
+                    event.node_id,
+                    f"Admin node {event.node_id} is {event.current.value}",
+                )
+
+    async def reconcile_partitions(self) -> int:
+        """
+        Forward the buffered messages of degraded rooms whose admin node is
+        reachable again, and restore the rooms whose buffer is drained.
+
+        A buffered message the admin rejects (e.g., its sender was removed
+        from the room meanwhile) is dropped and its sender gets a
+        message_error; one that can't be delivered stops the room's
+        reconciliation until the next round.
+
+        Returns:
+            int: Number of rooms that are healthy again
+        """
+        if not self.partition:
+            return 0
+
+        restored = 0
+        for room_id in self.partition.degraded_rooms():
+            if self.room_manager.get_room(room_id):
+                admin_node = self.room_manager.node_id
+            else:
+                admin_node = self._room_admin_node(room_id)
+            if not self.partition.reachable(admin_node):
+                continue
+            # Joins and leaves first, so the admin accepts the messages
+            # of members who joined while the room was degraded
+            if not await self._merge_replica_members(room_id):
+                continue
+
+            drained = True
+            for message in self.partition.pending(room_id):
+                result = await self._deliver_buffered(message)
+                if result.get("error_code") == "ADMIN_NODE_UNAVAILABLE":
+                    drained = False
+                    break
+                self.partition.delivered(room_id, message.message_id)
+                if result["success"]:
+                    event = create_message_status_event(
+                        room_id=room_id,
+                        message_id=result["message_id"],
+                        status="sent",
+                        sequence_number=result["sequence_number"],
+                        timestamp=result["timestamp"],
+                    )
+                else:
+                    event = create_message_error(
+                        room_id,
+                        result.get("error", "Failed to send message"),
+                        result.get("error_code", "UNKNOWN_ERROR"),
+                    )
+                await self._send_to_member(room_id, message.username, event)
+
+            if drained and self.partition.restore(room_id):
+                restored += 1
+                await self.broadcast_to_room(
+                    room_id,
+                    create_room_status_event(self.partition.status(room_id)),
+                )
+        return restored
+
+    async def _merge_replica_members(self, room_id: str) -> bool:
+        """
+        Send a degraded room's replica membership set to its admin.
+
+        The admin merges in the joins and leaves of local members made
+        while it was unreachable, and the merged set is kept in the
+        replica.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            bool: False if the admin couldn't be reached
+        """
+        if self.room_manager.get_room(room_id) or not self.replica_store:
+            return True
+        replica = self.replica_store.get(room_id)
+        if replica is None or not replica.member_set:
+            return True
+        result = await self._call_room_admin(
+            room_id,
+            "merge_room_members",
+            room_id,
+            replica.member_set,
+            self.room_manager.node_id,
+        )
+        if result.get("error_code") == "ADMIN_NODE_UNAVAILABLE":
+            return False
+        if result.get("success"):
+            self.replica_store.merge_member_set(room_id, result["member_set"])
+        else:
+            logger.warning(
+                f"Admin of room {room_id} refused its membership set: "
+                f"{result.get('error')}"
+            )
+        return True
+
+    async def _deliver_buffered(self, message) -> dict:
+        """
+        Submit a buffered message to its room's admin (maybe this node).
+
+        Args:
+            message: The BufferedMessage
+
+        Returns:
+            dict: Result as from _handle_local_message
+        """
+        args = (
+            message.room_id,
+            message.username,
+            message.content,
+            message.message_id,
+            message.reply_to,
+            message.encryption,
+            message.attachments,
+        )
+        if self.room_manager.get_room(message.room_id):
+            return await self._handle_local_message(None, *args)
+
+        _, node_address = self._locate_room_admin(message.room_id)
+        if not node_address:
+            return {
+                "success": False,
+                "error": "Administrator node unavailable",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+        try:
+            proxy = ServerProxy(node_address, allow_none=True)
+            return proxy.forward_message(
+                message.room_id,
+                message.username,
+                message.content,
+                self.room_manager.node_id,
+                message.session_token or "",
+                message.message_id,
+                message.reply_to or "",
+                message.encryption,
+                message.attachments,
+            )
+        except Exception as e:
+            logger.warning(f"Failed to forward buffered message: {e}")
+            return {
+                "success": False,
+                "error": f"Failed to contact administrator node: {e}",
+                "error_code": "ADMIN_NODE_UNAVAILABLE",
+            }
+
+    async def _send_to_member(
+        self, room_id: str, username: str, message: dict
+    ) -> None:
+        """Send a message to a room member's local connections."""
+        frame = encode_frame(message)
+        for websocket, member in list(self._room_clients.get(room_id, ())):
+            if member == username:
+                try:
+                    await self._send(websocket, frame)
+                except websockets.exceptions.ConnectionClosed:
+                    pass
+
+    async def _announce_thread(self, room_id: str, reply: dict):
+        """
+        Announce the summary of a reply's thread to the room's members.
+
+        Args:
+            room_id: The room ID
+            reply: The reply just added
+        """
+        thread = self.room_manager.get_thread(room_id, reply["thread_id"])
+        if thread is None:
+            return
+        event = create_thread_updated_event(
+            room_id, reply["thread_id"], thread, reply.get("hlc")
+        )
+        await self.broadcast_to_room(room_id, event)
+        self._broadcast_to_peers(room_id, event["type"], event["data"])
+
+    async def _broadcast_message_to_room(self, room_id: str, message: dict):
+        """
+        Broadcast a message to all room members.
+
+        For local clients, sends via WebSocket.
+        For remote nodes with members in the room, calls XML-RPC.
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+        """
+        # Broadcast to local clients via WebSocket
+        broadcast_msg = {"type": "new_message", "data": message}
+        self._record_delivery(room_id, message)
+
+        if room_id in self._room_clients:
+            frame = encode_frame(broadcast_msg)
+            hidden = self._hidden_from(room_id, broadcast_msg)
+            with start_span("deliver", attributes={"chat.room_id": room_id}):
+                for ws, username in self._room_clients[room_id]:
+                    if username in hidden:
+                        continue
+                    try:
+                        await self._send(ws, frame)
+                    except websockets.exceptions.ConnectionClosed:
+                        pass
+        await self._notify_mentions(room_id, message)
+
+        # Broadcast to remote nodes via XML-RPC
+        self._broadcast_message_to_peers(room_id, message)
+
+        # Stream to the room's follower replicas
+        if self.replication:
+            self.replication.replicate(room_id, message)
+
+    def broadcast_message_to_room_sync(self, room_id: str, message: dict):
+        """
+        Synchronous version of broadcast for use in XML-RPC callbacks.
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+        """
+        broadcast_msg = {"type": "new_message", "data": message}
+        self._record_delivery(room_id, message)
+
+        async def _do_broadcast():
+            if room_id in self._room_clients:
+                frame = encode_frame(broadcast_msg)
+                hidden = self._hidden_from(room_id, broadcast_msg)
+                for websocket, username in self._room_clients[room_id]:
+                    if username in hidden:
+                        continue
+                    try:
+                        await self._send(websocket, frame)
+                    except websockets.exceptions.ConnectionClosed:
+                        pass
+            await self._notify_mentions(room_id, message)
+
+        self.dispatcher.submit(room_id, _do_broadcast)
+
+    async def _notify_mentions(self, room_id: str, message: dict):
+        """
+        Send a mention event to the local connections of mentioned users.
+
+        Mentions get through a muted room, but not to users who filter
+        out or blocked the sender (see mentions.py).
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+        """
+        mentioned = mentioned_users(message)
+        if not mentioned:
+            return
+        hidden = self._filtering(message.get("username"))
+        for username in mentioned:
+            if username in hidden:
+                continue
+            frame = encode_frame(
+                {
+                    "type": "mention",
+                    "data": create_mention_event(room_id, username, message),
+                }
+            )
+            for connection in self.connections.find_by_username(username):
+                try:
+                    await self._send(connection.websocket, frame)
+                except websockets.exceptions.ConnectionClosed:
+                    pass
+
+    def _record_delivery(self, room_id: str, message: dict):
+        """
+        Note a room message handed to local clients.
+
+        Remembers it for delivery receipts and buffers it for users whose
+        sessions in the room are held, unless they muted the room, filter
+        out or blocked the sender (or the room is at most once).
+
+        Args:
+            room_id: The room ID
+            message: The message data dict
+        """
+        self.receipts.track(room_id, message)
+        policy = delivery_policy(message.get("delivery"))
+        sequence = message.get("sequence_number")
+        if policy.retry and isinstance(sequence, int):
+            self.stream_repair.record(room_id, sequence)
+        if self.offline_queue and policy.queue:
+            self.offline_queue.add(
+                room_id,
+                message,
+                self.mutes.silenced(room_id)
+                | self._filtering(message.get("username")),
+            )
+        if self.push and self.room_manager.get_room(room_id):
+            self._notify_offline_members(room_id, message)
+
+    def _notify_offline_members(self, room_id: str, message: dict):
+        """
+        Queue push notifications of a room message for offline members.
+
+        Members connected anywhere in the cluster (or, without a presence
+        directory, to this node) are not notified, nor are the sender and
+        users who filter out or blocked the sender, or who muted the room
+        unless the message mentions them.
+
+        Args:
+            room_id: The ID of a room hosted here
+            message: The message data dict
+        """
+        room = self.room_manager.get_room(room_id)
+        sender = message.get("username")
+        mentioned = set(mentioned_users(message))
+        skipped = (
+            {sender}
+            | (self.mutes.silenced(room_id) - mentioned)
+            | self._filtering(sender)
+        )
+        for username in room.members - skipped:
+            if self._is_online(username):
+                continue
+            tokens = self.push_tokens.tokens_for(username)
+            if not tokens:
+                continue
+            title = f"{sender} in {room.room_name}"
+            kind = "new_message"
+            if username in mentioned:
+                title = f"{sender} mentioned you in {room.room_name}"
+                kind = "mention"
+            self.push.enqueue(
+                tokens,
+                room_id,
+                title,
+                preview(message),
+                {
+                    "type": kind,
+                    "room_id": room_id,
+                    "message_id": message.get("message_id", ""),
+                },
+            )
+
+    def _is_online(self, username: str) -> bool:
+        """Check whether a user is connected anywhere we know of."""
+        if self.presence:
+            return self.presence.get_status(username) != "offline"
+        return bool(self.connections.find_by_username(username))
+
+    def _hidden_from(self, room_id: str, message: dict) -> Set[str]:
+        """
+        Get the users a room broadcast is not delivered to.
+
+        Returns:
+            Usernames that filter out or blocked the sender of a
+            new_message, or may not read it (service accounts without the
+            read scope), or everyone in the room but its owner and
+            moderators for a spam_detected (empty for other broadcasts)
+        """
+        data = message.get("data", {})
+        if message.get("type") == "spam_detected":
+            return {
+                username for _, username in self._room_clients.get(room_id, ())
+            } - set(data.get("moderators", []))
+        if message.get("type") != "new_message":
+            return set()
+        hidden = self._filtering(data.get("username"))
+        if self.service_accounts:
+            hidden |= self.service_accounts.without_scope(READ)
+        return hidden
+
+    def _filtering(self, sender: Optional[str]) -> Set[str]:
+        """
+        Get the users whose delivery streams leave out a sender.
+
+        Returns:
+            Usernames that muted the sender with filter_muted_users on, or
+            blocked the sender
+        """
+        return self.mutes.filtering(sender) | self.profiles.blocked_by(sender)
+
+    async def send_message_error(
+        self,
+        websocket: WebSocketServerProtocol,
+        room_id: str,
+        error: str,
+        error_code: str,
+        message_id: Optional[str] = None,
+    ):
+        """
+        Send a message_error response.
+
+        Args:
+            websocket: The WebSocket connection
+            room_id: The room ID
+            error: The error message
+            error_code: The error code
+            message_id: ID of the message, if it was added but can't be
+                acknowledged yet
+        """
+        response = create_message_error(
+            room_id, error, error_code, message_id
+        )
+        await self._send(websocket, json.dumps(response))
+
+    # ===== Direct Messages =====
+
+    async def handle_announce_presence(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an announce_presence request.
+
+        Marks the client's user as online on this node so it can receive
+        direct messages without joining a room. Messages buffered here
+        while the user was offline are delivered right after the response.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        username = data.get("data", {}).get("username")
+        if not username:
+            await self.send_error(
+                websocket, "Missing username", "presence_error"
+            )
+            return
+
+        self.connections.set_username(websocket, username)
+        response = {
+            "type": "presence_announced",
+            "data": {
+                "username": username,
+                "node_id": self.room_manager.node_id,
+                "pending": self.direct_messages.pending_count(username),
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_set_status(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a set_status request ("online" or "away").
+
+        Members of the user's rooms are told about the change once the
+        presence debounce has passed.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+        status = request_data.get("status")
+        if not username or status not in CLIENT_STATUSES:
+            await self.send_error(
+                websocket,
+                f"set_status needs a username and a status of "
+                f"{' or '.join(CLIENT_STATUSES)}",
+                "status_error",
+            )
+            return
+        if not self.presence:
+            await self.send_error(
+                websocket,
+                "Presence is not enabled on this node",
+                "status_error",
+            )
+            return
+
+        self.connections.set_username(websocket, username)
+        await self._update_presence(websocket)
+        self.presence.set_status(username, status)
+        response = {
+            "type": "status_updated",
+            "data": {"username": username, "status": status},
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_get_presence(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a get_presence request.
+
+        Reports the status of the members of ``room_id``, or of the users
+        listed in ``usernames``.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        usernames = request_data.get("usernames")
+        if room_id:
+            usernames = self._room_members(room_id)
+        if not isinstance(usernames, list):
+            await self.send_error(
+                websocket,
+                "get_presence needs a room_id or a list of usernames",
+                "presence_error",
+            )
+            return
+
+        users = {}
+        for username in usernames:
+            if self.presence:
+                users[username] = self.presence.get_status(username)
+            elif self.connections.find_by_username(username):
+                users[username] = "online"
+            else:
+                users[username] = "offline"
+        response = {
+            "type": "presence",
+            "data": {"room_id": room_id, "users": users},
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def publish_presence_changes(
+        self, changes: List[PresenceEntry]
+    ) -> int:
+        """
+        Tell clients about presence changes of members of their rooms.
+
+        Each client in a room the user is a member of gets a
+        presence_update event; the user's own connections are skipped.
+
+        Args:
+            changes: Entries returned by PresenceDirectory.take_changes()
+
+        Returns:
+            int: Number of events sent
+        """
+        sent = 0
+        timestamp = datetime.now(timezone.utc).isoformat()
+        for room_id, clients in list(self._room_clients.items()):
+            if not clients:
+                continue
+            members = set(self._room_members(room_id))
+            for entry in changes:
+                if entry.username not in members:
+                    continue
+                event = json.dumps(
+                    create_presence_update_event(
+                        room_id,
+                        entry.username,
+                        entry.status,
+                        entry.node_id,
+                        timestamp,
+                    )
+                )
+                for websocket, username in list(clients):
+                    if username == entry.username:
+                        continue
+                    try:
+                        await self._send(websocket, event)
+                        sent += 1
+                    except websockets.exceptions.ConnectionClosed:
+                        pass
+        return sent
+
+    # ===== User Profiles =====
+
+    async def handle_update_profile(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an update_profile request changing the user's profile.
+
+        Request data: username and any of display_name, avatar_url,
+        avatar_hash and bio; fields left out keep their values. The client
+        gets update_profile_success with the whole profile, the change is
+        pushed to every peer, and clients sharing a room with the user get
+        a profile_updated event.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+        fields = {
+            field: request_data[field]
+            for field in PROFILE_FIELDS
+            if field in request_data
+        }
+
+        try:
+            profile = self.profiles.update(username, fields)
+        except ProfileError as e:
+            response = create_profile_error_response(
+                "update_profile", str(e), e.error_code
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        logger.info(f"User {username} updated their profile")
+        response = {
+            "type": "update_profile_success",
+            "data": profile.to_dict(),
+        }
+        await self._send(websocket, json.dumps(response))
+        await self.publish_profiles([profile], exclude=websocket)
+        if self.peer_registry:
+            push_profile_update(profile, self.peer_registry)
+
+    async def handle_register_push_token(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a register_push_token request adding a device's push token.
+
+        Request data: username, token and platform ("fcm" or "apns"). The
+        client gets push_token_registered with the number of tokens the
+        user has, and the change is pushed to every peer.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+        token = request_data.get("token")
+        platform = request_data.get("platform")
+
+        try:
+            if not username:
+                raise PushError("Missing username", "INVALID_REQUEST")
+            records = self.push_tokens.register(username, token, platform)
+        except PushError as e:
+            response = create_push_error_response(
+                "register_push_token", str(e), e.error_code
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        logger.info(f"User {username} registered a {platform} push token")
+        response = {
+            "type": "push_token_registered",
+            "data": {
+                "username": username,
+                "token": token,
+                "platform": platform,
+                "tokens": len(self.push_tokens.tokens_for(username)),
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        if self.peer_registry:
+            push_token_update(records, self.peer_registry)
+
+    async def handle_unregister_push_token(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an unregister_push_token request removing a push token.
+
+        Request data: username and token. The client gets
+        push_token_unregistered, and the removal is pushed to every peer.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+        token = request_data.get("token")
+
+        tombstone = self.push_tokens.unregister(username, token)
+        if tombstone is None:
+            response = create_push_error_response(
+                "unregister_push_token",
+                "Push token not registered",
+                "TOKEN_NOT_FOUND",
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        logger.info(f"User {username} removed a push token")
+        response = {
+            "type": "push_token_unregistered",
+            "data": {
+                "username": username,
+                "token": token,
+                "tokens": len(self.push_tokens.tokens_for(username)),
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        if self.peer_registry:
+            push_token_update([tombstone], self.peer_registry)
+
+    async def handle_get_profile(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a get_profile request.
+
+        Reports the profiles of the members of ``room_id``, or of the users
+        listed in ``usernames``; users without a profile map to None.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        room_id = request_data.get("room_id")
+        usernames = request_data.get("usernames")
+        if room_id:
+            usernames = self._room_members(room_id)
+        if not isinstance(usernames, list):
+            response = create_profile_error_response(
+                "get_profile",
+                "get_profile needs a room_id or a list of usernames",
+                "INVALID_REQUEST",
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        profiles = {}
+        for username in usernames:
+            profile = self.profiles.get(username)
+            profiles[username] = profile.public_dict() if profile else None
+        response = {
+            "type": "profiles",
+            "data": {"room_id": room_id, "profiles": profiles},
+        }
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_update_mutes(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle an update_mutes request changing the rooms and users a user
+        muted.
+
+        Request data: username and any of mute_rooms, unmute_rooms,
+        mute_users and unmute_users (lists) and filter_muted_users (bool).
+        A request with none of them just reports the current mutes. The
+        client gets mutes_updated with the whole preferences.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+
+        try:
+            preferences = self.mutes.update(
+                username,
+                request_data.get("mute_rooms", []),
+                request_data.get("unmute_rooms", []),
+                request_data.get("mute_users", []),
+                request_data.get("unmute_users", []),
+                request_data.get("filter_muted_users"),
+            )
+        except MuteError as e:
+            response = create_mutes_error_response(
+                username, str(e), e.error_code
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {"type": "mutes_updated", "data": preferences.to_dict()}
+        await self._send(websocket, json.dumps(response))
+
+    async def handle_block_user(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a block_user request blocking or unblocking a user.
+
+        Request data: username, user (the user to block) and unblock (true
+        to lift the block). The block list is part of the user's profile,
+        so the change is pushed to every peer and the user's other
+        connections get profile_updated with it. The client gets
+        blocks_updated with the whole block list.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        username = request_data.get("username")
+
+        try:
+            profile = self.profiles.block(
+                username,
+                request_data.get("user"),
+                bool(request_data.get("unblock", False)),
+            )
+        except ProfileError as e:
+            response = create_block_error_response(
+                username, str(e), e.error_code
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        response = {
+            "type": "blocks_updated",
+            "data": {"username": username, "blocked": profile.blocked},
+        }
+        await self._send(websocket, json.dumps(response))
+        event = encode_frame(create_profile_updated_event(profile.to_dict()))
+        for connection in self.connections.find_by_username(username):
+            if connection.websocket is websocket:
+                continue
+            try:
+                await self._send(connection.websocket, event)
+            except websockets.exceptions.ConnectionClosed:
+                pass
+        if self.peer_registry:
+            push_profile_update(profile, self.peer_registry)
+
+    async def handle_stats(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a stats request for the cluster's statistics.
+
+        Request data: optional room_id to report one room. The client gets
+        stats with every node's connections and hosted rooms, and each
+        room's admin node, throughput, members, active members and
+        average delivery latency, as gossiped by the nodes. Private rooms
+        are only reported to clients in them.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        room_id = (data.get("data") or {}).get("room_id")
+        summary = self.cluster_stats(room_id)
+        joined = self._client_rooms.get(websocket, set())
+        summary["rooms"] = {
+            rid: room
+            for rid, room in summary["rooms"].items()
+            if not room["private"] or rid in joined
+        }
+        if room_id and room_id not in summary["rooms"]:
+            response = create_stats_error_response(
+                room_id, "No statistics for this room", "ROOM_NOT_FOUND"
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        await self._send(
+            websocket, json.dumps({"type": "stats", "data": summary})
+        )
+
+    def refresh_stats(self) -> NodeStats:
+        """
+        Measure this node's statistics, for the stats command and gossip.
+
+        Returns:
+            NodeStats: This node's new statistics
+        """
+        counts = self.room_manager.message_counts()
+        hosted = {
+            room["room_id"]: {
+                "messages": counts.get(room["room_id"], 0),
+                "members": room["member_count"],
+                "private": room["private"],
+            }
+            for room in self.room_manager.list_rooms()
+        }
+        active = {
+            room_id: len({username for _, username in clients})
+            for room_id, clients in list(self._room_clients.items())
+            if clients
+        }
+        return self.stats.update_local(hosted, active, len(self.clients))
+
+    def cluster_stats(self, room_id: Optional[str] = None) -> dict:
+        """
+        Get the statistics of the cluster, measuring this node's first.
+
+        Args:
+            room_id: Only report this room
+
+        Returns:
+            dict: node_id of this node, and the nodes and rooms (see
+            ClusterStats.summary)
+        """
+        self.refresh_stats()
+        summary = self.stats.summary(room_id)
+        summary["node_id"] = self.room_manager.node_id
+        return summary
+
+    async def publish_profiles(
+        self,
+        profiles: List[UserProfile],
+        exclude: Optional[WebSocketServerProtocol] = None,
+    ) -> int:
+        """
+        Tell clients about changed profiles of members of their rooms.
+
+        Each client sharing at least one room with the user gets one
+        profile_updated event, however many rooms they share. The user's
+        own connections get it too, with their block list.
+
+        Args:
+            profiles: The changed profiles
+            exclude: Optional connection to skip (the one that made the
+                change, which gets the profile in its response)
+
+        Returns:
+            int: Number of events sent
+        """
+        sent = 0
+        for profile in profiles:
+            own = {
+                connection.websocket
+                for connection in self.connections.find_by_username(
+                    profile.username
+                )
+            }
+            recipients = set(own)
+            for room_id, clients in list(self._room_clients.items()):
+                if not clients:
+                    continue
+                if profile.username not in self._room_members(room_id):
+                    continue
+                recipients.update(websocket for websocket, _ in clients)
+            recipients.discard(exclude)
+
+            public = encode_frame(
+                create_profile_updated_event(profile.public_dict())
+            )
+            private = encode_frame(
+                create_profile_updated_event(profile.to_dict())
+            )
+            for websocket in recipients:
+                try:
+                    await self._send(
+                        websocket, private if websocket in own else public
+                    )
+                    sent += 1
+                except websockets.exceptions.ConnectionClosed:
+                    pass
+        return sent
+
+    def publish_profiles_sync(self, profiles: List[UserProfile]):
+        """
+        Publish profiles adopted from peers, for use as a registry callback.
+
+        The sends are scheduled on the event loop.
+
+        Args:
+            profiles: Profiles returned by ProfileRegistry.merge()
+        """
+        self.dispatcher.submit("profiles", self.publish_profiles, profiles)
+
+    def _room_members(self, room_id: str) -> List[str]:
+        """Get a room's members from local state or this node's replica."""
+        if self.room_manager.get_room(room_id):
+            return self.room_manager.get_members(room_id)
+        if self.replica_store:
+            replica = self.replica_store.get(room_id)
+            if replica:
+                return list(replica.members)
+        clients = self._room_clients.get(room_id, set())
+        return [username for _, username in clients]
+
+    async def handle_resume_session(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a resume_session request from a reconnecting client.
+
+        The session is found by the ``session_id`` the previous connection
+        was given in session_started, or by ``username``. The connection is
+        put back into the rooms of the session, without member events, the
+        user's presence status is restored and pending direct messages are
+        delivered. It then gets session_resumed followed by the missed
+        messages of each room in sequence order. Messages up to the
+        sequence number in ``last_seen`` for a room are not sent again.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        session_id = request_data.get("session_id")
+        username = request_data.get("username")
+        last_seen = request_data.get("last_seen") or {}
+        if not (session_id or username) or not isinstance(last_seen, dict):
+            response = create_resume_error_response(
+                username or "",
+                "resume_session needs a session_id or username and a "
+                "last_seen map",
+                "INVALID_REQUEST",
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        session = None
+        if self.offline_queue:
+            owner = username
+            if session_id:
+                owner = self.offline_queue.find_user(session_id)
+            connection = self.connections.get(websocket)
+            # Names given in the request or bound at login must match
+            claimed = {username, connection.username if connection else None}
+            if owner and claimed <= {owner, None}:
+                username = owner
+                session = self.offline_queue.resume(owner)
+        if session is None:
+            response = create_resume_error_response(
+                username or "",
+                "No session to resume on this node, join the rooms again",
+                "SESSION_NOT_FOUND",
+            )
+            await self._send(websocket, json.dumps(response))
+            return
+
+        replay = []
+        muted = self.mutes.get(username)
+        profile = self.profiles.get(username)
+        blocked = set(profile.blocked) if profile else set()
+        for room_id in sorted(session.rooms):
+            self.register_client_room_membership(websocket, room_id, username)
+            replay.extend(
+                (room, message)
+                for room, message in self._missed_messages(
+                    session, room_id, last_seen.get(room_id)
+                )
+                if message.get("username") not in blocked
+                and (
+                    not muted.filter_muted_users
+                    or message.get("username") not in muted.users
+                )
+            )
+
+        response = {
+            "type": "session_resumed",
+            "data": {
+                "username": username,
+                "rooms": sorted(session.rooms),
+                "replayed": len(replay),
+                "truncated": session.truncated,
+                "status": session.status or "online",
+            },
+        }
+        await self._send(websocket, json.dumps(response))
+        await self._update_presence(websocket)
+        if self.presence and session.status == "away":
+            self.presence.set_status(username, "away")
+        for room_id, message in replay:
+            self.receipts.track(room_id, message)
+            await self._send(
+                websocket,
+                json.dumps({"type": "new_message", "data": message}),
+            )
+        logger.info(
+            f"Resumed session of {username} in {len(session.rooms)} rooms, "
+            f"replayed {len(replay)} messages"
+        )
+
+    def _missed_messages(
+        self,
+        session: OfflineSession,
+        room_id: str,
+        last_seen: Optional[int],
+    ) -> List[Tuple[str, dict]]:
+        """
+        Get the messages of a room to replay to a resumed session.
+
+        Besides the buffered messages, the room's recent history is used
+        when this node has it, so messages in flight when the client
+        disconnected are not lost.
+
+        Args:
+            session: The resumed session
+            room_id: The room ID
+            last_seen: Highest sequence number the client saw in the room,
+                or None to replay everything buffered
+
+        Returns:
+            List of (room_id, message) in sequence order
+        """
+        candidates = list(session.messages.get(room_id, []))
+        if last_seen is not None:
+            room = self.room_manager.get_room(room_id)
+            replica = self.replica_store and self.replica_store.get(room_id)
+            if room:
+                candidates.extend(room.messages)
+            elif replica:
+                candidates.extend(replica.messages)
+
+        missed = {}
+        for message in candidates:
+            sequence_number = message.get("sequence_number", 0)
+            if last_seen is not None and sequence_number <= last_seen:
+                continue
+            missed.setdefault(message.get("message_id"), message)
+        ordered = sorted(
+            missed.values(), key=lambda message: message["sequence_number"]
+        )
+        return [(room_id, message) for message in ordered]
+
+    async def keepalive_round(self) -> Tuple[int, int]:
+        """
+        Ping every client and deal with those that stopped answering.
+
+        Clients that just became stale are marked offline and their
+        typing indicators stopped; clients stale for longer than the
+        grace period are disconnected, which cleans them up like any
+        other disconnect.
+
+        Returns:
+            (clients that became stale, clients disconnected)
+        """
+        if not self.keepalive:
+            return 0, 0
+        connections = self.connections.list_connections()
+        stale, expired = self.keepalive.check(connections)
+        for connection in stale:
+            logger.info(
+                f"Client {connection.client_id} stopped answering pings, "
+                f"marking it offline"
+            )
+            self._mark_offline(connection.websocket)
+            await self._stop_typing(connection)
+
+        ping = json.dumps(
+            create_ping_event(
+                self.keepalive.timeout,
+                datetime.now(timezone.utc).isoformat(),
+            )
+        )
+        for connection in connections:
+            if connection not in expired:
+                await self._send(connection.websocket, ping)
+
+        await asyncio.gather(
+            *(self._close_stale(connection) for connection in expired)
+        )
+        return len(stale), len(expired)
+
+    async def _stop_typing(self, connection):
+        """
+        Tell rooms a stale client's user is no longer typing.
+
+        Args:
+            connection: ClientConnection of the stale client
+        """
+        username = connection.username
+        if not username:
+            return
+        for room_id in list(self._client_rooms.get(connection.websocket, ())):
+            if not self.typing.allow(room_id, username, False):
+                continue
+            event = create_typing_event(
+                room_id,
+                username,
+                False,
+                self.typing.timeout,
+                datetime.now(timezone.utc).isoformat(),
+            )
+            await self.broadcast_to_room(
+                room_id, event, exclude_websocket=connection.websocket
+            )
+            self._broadcast_to_peers(room_id, event["type"], event["data"])
+
+    async def _close_stale(self, connection):
+        """
+        Disconnect a client that didn't answer within the grace period.
+
+        Args:
+            connection: ClientConnection of the stale client
+        """
+        logger.info(
+            f"Disconnecting client {connection.client_id}: no answer to "
+            f"pings for {self.keepalive.timeout + self.keepalive.grace}s"
+        )
+        try:
+            await connection.websocket.close(
+                KEEPALIVE_CLOSE_CODE, "Keepalive timeout"
+            )
+        except websockets.exceptions.ConnectionClosed:
+            pass
+
+    async def expire_offline_sessions(self) -> int:
+        """
+        Take users whose held sessions expired out of their rooms.
+
+        Rooms the user has since joined again on a new connection are
+        left alone.
+
+        Returns:
+            int: Number of sessions expired
+        """
+        if not self.offline_queue:
+            return 0
+        expired = self.offline_queue.take_expired()
+        for session in expired:
+            for room_id in session.rooms:
+                clients = self._room_clients.get(room_id, set())
+                if any(user == session.username for _, user in clients):
+                    continue
+                await self._remove_disconnected_member(
+                    room_id, session.username
+                )
+            logger.info(f"Session of {session.username} expired")
+        return len(expired)
+
+    async def handle_send_direct_message(
+        self, websocket: WebSocketServerProtocol, data: dict
+    ):
+        """
+        Handle a send_direct_message request from a client.
+
+        The message is delivered to the recipient's connections on this
+        node and on every node the presence directory has them online on.
+        If none of that works it is buffered and the sender is told it is
+        "buffered" rather than "delivered". A message to a recipient who
+        blocked the sender is dropped, and reported as delivered.
+
+        Args:
+            websocket: The WebSocket connection
+            data: The request data
+        """
+        request_data = data.get("data", {})
+        sender = request_data.get("username")
+        recipient = request_data.get("recipient")
+        content = request_data.get("content")
+
+        if not sender or not recipient:
+            await self.send_direct_message_error(
+                websocket,
+                recipient or "",
+                "Missing username or recipient",
+                "INVALID_REQUEST",
+            )
+            return
+
+        is_valid, error_msg = validate_message_content(content)
+        if not is_valid:
+            await self.send_direct_message_error(
+                websocket, recipient, error_msg, "INVALID_CONTENT"
+            )
+            return
+
+        self.connections.set_username(websocket, sender)
+        message = create_direct_message(
+            sender,
+            recipient,
+            content,
+            self.room_manager.node_id,
+            self._session_token(websocket) or "",
+        )
+        if await self._deliver_direct_message(message):
+            status = "delivered"
+        else:
+            self.direct_messages.add(message)
+            status = "buffered"
+            self._notify_direct_message(message)
+
+        logger.info(
+            f"Direct message {message.message_id} from {sender} to "
+            f"{recipient} {status}"
+        )
+        confirmation = create_direct_message_sent_confirmation(
+            message.message_id, recipient, status, message.timestamp
+        )
+        await self._send(websocket, json.dumps(confirmation))
+
+    def _notify_direct_message(self, message: DirectMessage):
+        """
+        Queue a push notification of a buffered direct message.
+
+        Args:
+            message: The message
         """
-        if not self.peer_registry:
-            return {
-                "success": False,
-                "error": "Room not found",
-                "error_code": "ROOM_NOT_FOUND",
-            }
+        if not self.push:
+            return
+        tokens = self.push_tokens.tokens_for(message.recipient)
+        if tokens:
+            self.push.enqueue(
+                tokens,
+                f"dm:{message.sender}",
+                message.sender,
+                preview(message.to_dict()),
+                {
+                    "type": "direct_message",
+                    "sender": message.sender,
+                    "message_id": message.message_id,
+                },
+            )
 
-        # Find the administrator node for this room
-        local_rooms = self.room_manager.list_rooms()
-        discovery_result = self.peer_registry.discover_global_rooms(local_rooms)
+    async def _deliver_direct_message(self, message: DirectMessage) -> bool:
+        """
+        Try to deliver a direct message once, locally and to peer nodes.
 
-        # Find the room in the discovered rooms
-        target_room = None
-        for room in discovery_result.get("rooms", []):
-            if room.get("room_id") == room_id:
-                target_room = room
-                break
+        The recipient may be connected from several devices, so the
+        message goes to their connections here and to every other node
+        the presence directory has them online on. A message from a user
+        the recipient blocked, or to a service account without the dm
+        scope, is dropped instead.
 
-        if not target_room:
-            return {
-                "success": False,
-                "error": "Room not found",
-                "error_code": "ROOM_NOT_FOUND",
-            }
+        Args:
+            message: The message
 
-        # Get the admin node address
-        admin_node = target_room.get("admin_node")
-        node_address = target_room.get("node_address")
+        Returns:
+            bool: True if the message reached at least one connection (or
+            was dropped)
+        """
+        if self.profiles.blocks(message.recipient, message.sender):
+            return True
+        if self.service_accounts and (
+            message.recipient in self.service_accounts.without_scope(DM)
+        ):
+            return True
+        event = create_direct_message_event(message.to_dict())
+        delivered = bool(await self._send_to_user(message.recipient, event))
+
+        if not self.presence or not self.peer_registry:
+            return delivered
+        for entry in self.presence.locate_all(message.recipient):
+            if entry.node_id == self.room_manager.node_id:
+                continue
+            if self._deliver_to_peer(message, entry):
+                delivered = True
+        return delivered
 
-        if not node_address:
-            node_address = self.peer_registry.get_peer_address(admin_node)
+    def _deliver_to_peer(
+        self, message: DirectMessage, entry: PresenceEntry
+    ) -> bool:
+        """
+        Hand a direct message to a node the recipient is connected to.
 
-        if not node_address:
-            return {
-                "success": False,
-                "error": "Administrator node unavailable",
-                "error_code": "ADMIN_NODE_UNAVAILABLE",
-            }
+        Args:
+            message: The message
+            entry: The recipient's presence entry for that node
 
-        # Forward message to administrator via XML-RPC
+        Returns:
+            bool: True if the node delivered it to a connection
+        """
+        auth_args = (message.auth_token,) if message.auth_token else ()
         try:
-            proxy = ServerProxy(node_address, allow_none=True)
-            result = proxy.forward_message(
-                room_id, username, content, self.room_manager.node_id
+            result = self.peer_registry.rpc.call(
+                entry.node_address,
+                "deliver_direct_message",
+                message.to_dict(),
+                *auth_args,
             )
-            return result
         except Exception as e:
-            logger.error(f"Failed to forward message: {e}")
-            return {
-                "success": False,
-                "error": f"Failed to contact administrator node: {e}",
-                "error_code": "ADMIN_NODE_UNAVAILABLE",
-            }
+            logger.warning(
+                f"Could not deliver direct message to {message.recipient} "
+                f"on {entry.node_id}: {e}"
+            )
+            return False
 
-    async def _broadcast_message_to_room(self, room_id: str, message: dict):
+        if not result.get("success"):
+            logger.info(
+                f"Node {entry.node_id} did not deliver direct message to "
+                f"{message.recipient}: {result.get('error')}"
+            )
+            return False
+        return True
+
+    async def retry_direct_messages(self) -> int:
         """
-        Broadcast a message to all room members.
+        Retry delivery of buffered direct messages.
 
-        For local clients, sends via WebSocket.
-        For remote nodes with members in the room, calls XML-RPC.
+        Called periodically so messages reach users who came online on
+        another node. Messages for a recipient are retried in order, and
+        the first failure puts the rest back in the buffer.
+
+        Returns:
+            int: Number of messages delivered
+        """
+        self.direct_messages.purge_expired()
+        delivered = 0
+        for recipient in self.direct_messages.recipients():
+            pending = self.direct_messages.take(recipient)
+            while pending and await self._deliver_direct_message(pending[0]):
+                pending.pop(0)
+                delivered += 1
+            self.direct_messages.requeue(pending)
+        if delivered:
+            logger.info(f"Delivered {delivered} buffered direct messages")
+        return delivered
+
+    async def _send_to_user(self, username: str, message: dict) -> int:
+        """
+        Send a message to every connection of a user on this node.
 
         Args:
-            room_id: The room ID
-            message: The message data dict
+            username: The user
+            message: The message to send
+
+        Returns:
+            int: Number of connections the message was sent to
         """
-        # Broadcast to local clients via WebSocket
-        broadcast_msg = {"type": "new_message", "data": message}
+        frame = encode_frame(message)
+        sent = 0
+        for connection in self.connections.find_by_username(username):
+            try:
+                await self._send(connection.websocket, frame)
+                sent += 1
+            except websockets.exceptions.ConnectionClosed:
+                pass
+        return sent
 
-        if room_id in self._room_clients:
-            message_json = json.dumps(broadcast_msg)
-            for ws, _ in self._room_clients[room_id]:
-                try:
-                    await ws.send(message_json)
-                except websockets.exceptions.ConnectionClosed:
-                    pass
+    def deliver_direct_message_sync(self, username: str, message: dict) -> int:
+        """
+        Deliver a direct message from a peer, for use in XML-RPC callbacks.
 
-        # Broadcast to remote nodes via XML-RPC
-        broadcast_message_to_peers(self.peer_registry, room_id, message)
+        The sends are scheduled on the event loop; the return value counts
+        the connections they were scheduled for. Messages from users the
+        recipient blocked are dropped, but counted as delivered.
 
-    def broadcast_message_to_room_sync(self, room_id: str, message: dict):
+        Args:
+            username: The recipient
+            message: The DirectMessage dict
+
+        Returns:
+            int: Number of local connections of the recipient
         """
-        Synchronous version of broadcast for use in XML-RPC callbacks.
+        connections = self.connections.find_by_username(username)
+        if not connections:
+            return 0
+        if self.profiles.blocks(username, message.get("sender")):
+            return len(connections)
+        event = create_direct_message_event(message)
+        self.dispatcher.submit(
+            ("direct", username), self._send_to_user, username, event
+        )
+        return len(connections)
+
+    async def _update_presence(self, websocket: WebSocketServerProtocol):
+        """
+        Mark a client's user online once the connection names a user.
+
+        Delivers the direct messages buffered here for the user, except
+        those from users they blocked since.
 
         Args:
-            room_id: The room ID
-            message: The message data dict
+            websocket: The WebSocket connection
         """
-        broadcast_msg = {"type": "new_message", "data": message}
+        connection = self.connections.get(websocket)
+        username = connection.username if connection else None
+        if not username or self._online_users.get(websocket) == username:
+            return
 
-        async def _do_broadcast():
-            if room_id not in self._room_clients:
-                return
-            message_json = json.dumps(broadcast_msg)
-            for websocket, _ in self._room_clients[room_id]:
-                try:
-                    await websocket.send(message_json)
-                except websockets.exceptions.ConnectionClosed:
-                    pass
+        self._mark_offline(websocket)
+        self._online_users[websocket] = username
+        if self.presence:
+            self.presence.set_online(username)
 
-        try:
-            loop = asyncio.get_running_loop()
-            loop.create_task(_do_broadcast())
-        except RuntimeError:
-            # No running event loop, use asyncio.run
-            asyncio.run(_do_broadcast())
+        pending = self.direct_messages.take(username)
+        for index, message in enumerate(pending):
+            if self.profiles.blocks(username, message.sender):
+                continue
+            event = create_direct_message_event(message.to_dict())
+            try:
+                await self._send(websocket, json.dumps(event))
+            except websockets.exceptions.ConnectionClosed:
+                self.direct_messages.requeue(pending[index:])
+                break
 
-    async def send_message_error(
+    def _mark_offline(self, websocket: WebSocketServerProtocol):
+        """
+        Mark a client's user offline if it has no other connection here.
+
+        Args:
+            websocket: The WebSocket connection that closed or changed user
+        """
+        username = self._online_users.pop(websocket, None)
+        if not username or not self.presence:
+            return
+        if username not in self._online_users.values():
+            self.presence.set_offline(username)
+
+    async def send_direct_message_error(
         self,
         websocket: WebSocketServerProtocol,
-        room_id: str,
+        recipient: str,
         error: str,
         error_code: str,
     ):
         """
-        Send a message_error response.
+        Send a direct_message_error response.
 
         Args:
             websocket: The WebSocket connection
-            room_id: The room ID
+            recipient: The recipient the message was addressed to
             error: The error message
             error_code: The error code
         """
-        response = create_message_error(room_id, error, error_code)
-        await websocket.send(json.dumps(response))
+        response = create_direct_message_error(recipient, error, error_code)
+        await self._send(websocket, json.dumps(response))
 
     # ===== Room Deletion with Two-Phase Commit (2PC) =====
 
@@ -1260,12 +7886,12 @@ class WebSocketServer:
                 )
                 return
 
-            # Verify that the requester is the room creator
-            if room.creator_id != username:
+            # Verify that the requester's role allows deleting the room
+            if not room.has_permission(username, DELETE_ROOM):
                 await self._send_delete_room_error(
                     websocket,
                     room_id,
-                    "Only the room creator can delete the room",
+                    "Only the room owner can delete the room",
                     "UNAUTHORIZED",
                 )
                 return
@@ -1280,14 +7906,9 @@ class WebSocketServer:
                 )
                 return
 
-            # Get list of participant nodes (all peer nodes)
-            participants = []
-            if self.peer_registry:
-                participants = list(self.peer_registry.list_peers().keys())
-
             # Start 2PC transaction
             transaction = self.room_manager.start_deletion_transaction(
-                room_id, participants
+                room_id, self._deletion_participants()
             )
 
             if not transaction:
@@ -1308,14 +7929,14 @@ class WebSocketServer:
                     "status": "in_progress",
                 },
             }
-            await websocket.send(json.dumps(initiated_response))
+            await self._send(websocket, json.dumps(initiated_response))
 
             # Notify room members that deletion is starting
             await self._notify_deletion_initiated(room_id, username)
 
             # Execute 2PC (pass room_name for participant notifications)
             success, error_reason = await self._execute_2pc_deletion(
-                transaction, room_id, room.room_name
+                transaction, room_id, room.room_name, username
             )
 
             if success:
@@ -1328,7 +7949,7 @@ class WebSocketServer:
                         "message": "Room deleted successfully",
                     },
                 }
-                await websocket.send(json.dumps(success_response))
+                await self._send(websocket, json.dumps(success_response))
 
                 # Notify all local clients that room was deleted
                 await self._notify_room_deleted(room_id, room.room_name)
@@ -1349,241 +7970,284 @@ class WebSocketServer:
                 websocket, room_id, str(e), "INTERNAL_ERROR"
             )
 
-    async def _execute_2pc_deletion(
-        self, transaction, room_id: str, room_name: str
-    ) -> tuple:
+    async def close_room(self, room_id: str, initiator: str) -> dict:
         """
-        Execute the Two-Phase Commit protocol for room deletion.
+        Delete a hosted room on behalf of an operator.
+
+        The room is deleted with the same 2PC transaction as a delete_room
+        request, without checking the initiator's role in the room.
 
         Args:
-            transaction: The DeletionTransaction object
-            room_id: The room ID being deleted
-            room_name: The room name for participant notifications
+            room_id: The room to delete
+            initiator: Who requested the deletion, shown to the members
 
         Returns:
-            tuple: (success: bool, error_reason: Optional[str])
+            dict: Result with success, room_id, transaction_id, and error
+            and error_code on failure
         """
-        transaction_id = transaction.transaction_id
-        participants = transaction.participants
+        room = self.room_manager.get_room(room_id)
+        if not room:
+            return {
+                "success": False,
+                "room_id": room_id,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        if room.state != RoomState.ACTIVE:
+            return {
+                "success": False,
+                "room_id": room_id,
+                "error": f"Room is in {room.state.value} state",
+                "error_code": "INVALID_STATE",
+            }
 
-        # Phase 1: PREPARE - collect votes from all participants
-        logger.info(
-            f"2PC PREPARE phase for transaction {transaction_id} "
-            f"with {len(participants)} participants"
+        transaction = self.room_manager.start_deletion_transaction(
+            room_id, self._deletion_participants()
         )
+        if not transaction:
+            return {
+                "success": False,
+                "room_id": room_id,
+                "error": "Failed to start deletion transaction",
+                "error_code": "INTERNAL_ERROR",
+            }
 
-        all_ready = True
-        abort_reason = None
+        logger.info(f"Closing room {room_id} as requested by {initiator}")
+        await self._notify_deletion_initiated(room_id, initiator)
+        success, error_reason = await self._execute_2pc_deletion(
+            transaction, room_id, room.room_name, initiator
+        )
+        result = {
+            "success": success,
+            "room_id": room_id,
+            "transaction_id": transaction.transaction_id,
+        }
+        if success:
+            await self._notify_room_deleted(room_id, room.room_name)
+        else:
+            result["error"] = error_reason or "Deletion failed"
+            result["error_code"] = "DELETION_FAILED"
+        return result
 
-        if participants:
-            votes = await self._collect_prepare_votes(
-                room_id, transaction_id, participants
-            )
+    async def archive_room(self, room_id: str, initiator: str) -> dict:
+        """
+        Archive a hosted room on behalf of an operator (see archive.py).
 
-            for node_id, vote_result in votes.items():
-                if vote_result is None:
-                    # Timeout
-                    all_ready = False
-                    abort_reason = f"Node {node_id} timed out"
-                    self.room_manager.record_vote(
-                        transaction_id, node_id, "ABORT"
-                    )
-                elif vote_result.get("vote") == "ABORT":
-                    all_ready = False
-                    abort_reason = vote_result.get(
-                        "reason", f"Node {node_id} voted ABORT"
-                    )
-                    self.room_manager.record_vote(
-                        transaction_id, node_id, "ABORT"
-                    )
-                else:
-                    self.room_manager.record_vote(
-                        transaction_id, node_id, "READY"
-                    )
+        Members here and on the other nodes are sent room_archived, and
+        the other nodes drop their replicas of the room.
 
-        # Phase 2: COMMIT or ROLLBACK
-        if all_ready:
-            logger.info(f"2PC COMMIT phase for transaction {transaction_id}")
-            self.room_manager.transition_to_commit(transaction_id)
+        Args:
+            room_id: The room to archive
+            initiator: Who requested the archival, shown to the members
 
-            # Send COMMIT to all participants (include room_name for notifications)
-            if participants:
-                await self._send_commit_to_participants(
-                    room_id, transaction_id, participants, room_name
-                )
+        Returns:
+            dict: Result with success and the archived room's summary as
+            archive, or error and error_code on failure
+        """
+        try:
+            summary = self.room_manager.archive_room(room_id, initiator)
+        except ArchiveError as e:
+            return {
+                "success": False,
+                "room_id": room_id,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        except OSError as e:
+            logger.error(f"Could not archive room {room_id}: {e}")
+            return {
+                "success": False,
+                "room_id": room_id,
+                "error": f"Could not write the archive: {e}",
+                "error_code": "ARCHIVE_FAILED",
+            }
 
-            # Complete deletion on coordinator (this node)
-            self.room_manager.complete_deletion(transaction_id)
+        event_data = create_room_archived_event(
+            room_id,
+            summary["room_name"],
+            initiator,
+            datetime.now(timezone.utc).isoformat(),
+        )
+        await self._close_room_clients(
+            room_id, {"type": "room_archived", "data": event_data}
+        )
+        self._broadcast_to_peers(room_id, "room_archived", event_data)
+        return {"success": True, "archive": summary}
 
-            return True, None
-        else:
-            logger.info(
-                f"2PC ROLLBACK phase for transaction {transaction_id}: "
-                f"{abort_reason}"
-            )
-            self.room_manager.transition_to_rollback(transaction_id)
+    async def migrate_room(
+        self, room_id: str, target: str, initiator: str
+    ) -> dict:
+        """
+        Move a hosted room to another node on behalf of an operator.
 
-            # Send ROLLBACK to all participants
-            if participants:
-                await self._send_rollback_to_participants(
-                    room_id, transaction_id, participants
-                )
+        The migration runs off the event loop (see migration.py); the
+        room's members here are then sent room_admin_changed.
 
-            # Rollback on coordinator
-            self.room_manager.rollback_deletion(transaction_id)
+        Args:
+            room_id: The room to move
+            target: ID of the node to move it to
+            initiator: Who requested the migration, for the audit log
 
-            return False, abort_reason
+        Returns:
+            dict: The migration's result (see RoomMigrator.migrate)
+        """
+        if self.migrator is None:
+            return {
+                "success": False,
+                "room_id": room_id,
+                "error": "Migrating rooms needs failover enabled",
+                "error_code": "HANDOFF_UNSUPPORTED",
+            }
+        result = await asyncio.get_running_loop().run_in_executor(
+            None, self.migrator.migrate, room_id, target, initiator
+        )
+        if result["success"]:
+            await self.broadcast_to_room(
+                room_id,
+                create_room_admin_changed_event(
+                    room_id,
+                    result["room_name"],
+                    target,
+                    self.room_manager.node_id,
+                ),
+            )
+        return result
 
-    async def _collect_prepare_votes(
-        self,
-        room_id: str,
-        transaction_id: str,
-        participants: List[str],
-    ) -> Dict[str, Optional[dict]]:
+    async def seed_rooms(self, rooms: List[Dict], initiator: str) -> dict:
         """
-        Collect PREPARE votes from all participant nodes.
+        Create rooms with members and history from a fixture (see seed.py).
+
+        Each room is registered like a created one; rooms that can't be
+        seeded are skipped and the rest are still seeded.
 
         Args:
-            room_id: The room ID
-            transaction_id: The transaction ID
-            participants: List of participant node IDs
+            rooms: The rooms returned by parse_fixture
+            initiator: Who seeded the rooms, for the audit log
 
         Returns:
-            Dict mapping node_id to vote result (or None for timeout)
+            dict: success, rooms (room_id, room_name, member_count and
+            message_count of each seeded room) and skipped (room_name,
+            error and error_code of each skipped room)
         """
-        votes = {}
-
-        def call_prepare(node_id: str, node_addr: str) -> tuple:
-            """Call prepare_delete_room on a participant node."""
+        seeded, skipped = [], []
+        for seed in rooms:
             try:
-                proxy = ServerProxy(node_addr, allow_none=True)
-                result = proxy.prepare_delete_room(
-                    room_id,
-                    transaction_id,
-                    self.room_manager.node_id,
+                room = self.room_manager.seed_room(seed, initiator)
+                if self.room_registry:
+                    await self._register_room(room)
+            except (SeedError, ValueError) as e:
+                # A ValueError is the Raft registry refusing the room
+                skipped.append(
+                    {
+                        "room_name": seed["room_name"],
+                        "error": str(e),
+                        "error_code": (
+                            e.error_code
+                            if isinstance(e, SeedError)
+                            else "REGISTRATION_FAILED"
+                        ),
+                    }
                 )
-                return node_id, result
-            except Exception as e:
-                logger.error(f"Failed to send PREPARE to {node_id}: {e}")
-                return node_id, None
+                continue
+            seeded.append(
+                {
+                    "room_id": room.room_id,
+                    "room_name": room.room_name,
+                    "member_count": len(room.members),
+                    "message_count": room.message_counter,
+                }
+            )
+            # Let clients be served between large rooms
+            await asyncio.sleep(0)
+        return {"success": True, "rooms": seeded, "skipped": skipped}
 
-        # Use ThreadPoolExecutor for parallel XML-RPC calls
-        loop = asyncio.get_running_loop()
-        with ThreadPoolExecutor(max_workers=len(participants)) as executor:
-            futures = []
-            for node_id in participants:
-                node_addr = self.peer_registry.get_peer_address(node_id)
-                if node_addr:
-                    future = loop.run_in_executor(
-                        executor, call_prepare, node_id, node_addr
-                    )
-                    futures.append(future)
-                else:
-                    votes[node_id] = None
+    def _deletion_participants(self) -> List[str]:
+        """
+        Get the nodes taking part in a room deletion.
 
-            # Wait for all with timeout
-            try:
-                results = await asyncio.wait_for(
-                    asyncio.gather(*futures, return_exceptions=True),
-                    timeout=PREPARE_TIMEOUT,
-                )
-                for result in results:
-                    if isinstance(result, tuple):
-                        node_id, vote = result
-                        votes[node_id] = vote
-                    elif isinstance(result, Exception):
-                        logger.error(f"PREPARE error: {result}")
-            except asyncio.TimeoutError:
-                logger.warning(
-                    f"PREPARE phase timeout for transaction {transaction_id}"
-                )
-                # Mark remaining as None (timeout)
-                for node_id in participants:
-                    if node_id not in votes:
-                        votes[node_id] = None
+        Returns:
+            The membership view's other members, or every known peer
+            without a membership view
+        """
+        if self.membership is not None:
+            return self.membership.peers()
+        if self.peer_registry:
+            return list(self.peer_registry.list_peers().keys())
+        return []
 
-        return votes
+    async def _execute_2pc_deletion(
+        self, transaction, room_id: str, room_name: str, initiator: str = ""
+    ) -> tuple:
+        """
+        Execute the Two-Phase Commit protocol for room deletion.
 
-    async def _send_commit_to_participants(
-        self,
-        room_id: str,
-        transaction_id: str,
-        participants: List[str],
-        room_name: str,
-    ):
-        """Send COMMIT to all participant nodes."""
+        Args:
+            transaction: The DeletionTransaction object
+            room_id: The room ID being deleted
+            room_name: The room name for participant notifications
+            initiator: Who requested the deletion, for the audit log
 
-        def call_commit(node_id: str, node_addr: str) -> tuple:
-            """Call commit_delete_room on a participant node."""
-            try:
-                proxy = ServerProxy(node_addr, allow_none=True)
-                result = proxy.commit_delete_room(
-                    room_id, transaction_id, room_name
-                )
-                return node_id, result
-            except Exception as e:
-                logger.error(f"Failed to send COMMIT to {node_id}: {e}")
-                return node_id, {"success": False, "error": str(e)}
+        Returns:
+            tuple: (success: bool, error_reason: Optional[str])
+        """
+        transaction_id = transaction.transaction_id
 
-        loop = asyncio.get_running_loop()
-        with ThreadPoolExecutor(max_workers=len(participants)) as executor:
-            futures = []
-            for node_id in participants:
-                node_addr = self.peer_registry.get_peer_address(node_id)
-                if node_addr:
-                    future = loop.run_in_executor(
-                        executor, call_commit, node_id, node_addr
-                    )
-                    futures.append(future)
+        def on_decision(result):
+            """Mirror the votes and decision onto the room state."""
+            for node_id, vote in result.votes.items():
+                self.room_manager.record_vote(transaction_id, node_id, vote)
+            if result.committed:
+                self.room_manager.transition_to_commit(transaction_id)
+            else:
+                self.room_manager.transition_to_rollback(transaction_id)
 
-            try:
-                await asyncio.wait_for(
-                    asyncio.gather(*futures, return_exceptions=True),
-                    timeout=COMMIT_TIMEOUT,
-                )
-            except asyncio.TimeoutError:
-                logger.warning(
-                    f"COMMIT phase timeout for transaction {transaction_id}"
-                )
+        result = await self.tpc.execute(
+            "delete_room",
+            {
+                "room_id": room_id,
+                "room_name": room_name,
+                "coordinator": self.room_manager.node_id,
+            },
+            transaction.participants,
+            transaction_id=transaction_id,
+            on_decision=on_decision,
+        )
 
-    async def _send_rollback_to_participants(
-        self,
-        room_id: str,
-        transaction_id: str,
-        participants: List[str],
-    ):
-        """Send ROLLBACK to all participant nodes."""
+        if result.committed:
+            # Complete deletion on coordinator (this node)
+            self.room_manager.complete_deletion(transaction_id)
+            audit(
+                self.room_manager.audit_log,
+                initiator,
+                ROOM_DELETED,
+                room_id,
+                room_name=room_name,
+                transaction_id=transaction_id,
+            )
+            if self.room_registry:
+                await self._unregister_room(room_id)
+            return True, None
 
-        def call_rollback(node_id: str, node_addr: str) -> tuple:
-            """Call rollback_delete_room on a participant node."""
-            try:
-                proxy = ServerProxy(node_addr, allow_none=True)
-                result = proxy.rollback_delete_room(room_id, transaction_id)
-                return node_id, result
-            except Exception as e:
-                logger.error(f"Failed to send ROLLBACK to {node_id}: {e}")
-                return node_id, {"success": False, "error": str(e)}
+        # Rollback on coordinator
+        self.room_manager.rollback_deletion(transaction_id)
+        return False, result.abort_reason
 
-        loop = asyncio.get_running_loop()
-        with ThreadPoolExecutor(max_workers=len(participants)) as executor:
-            futures = []
-            for node_id in participants:
-                node_addr = self.peer_registry.get_peer_address(node_id)
-                if node_addr:
-                    future = loop.run_in_executor(
-                        executor, call_rollback, node_id, node_addr
-                    )
-                    futures.append(future)
+    async def _unregister_room(self, room_id: str) -> None:
+        """
+        Remove a deleted room from the Raft room registry.
 
-            try:
-                await asyncio.wait_for(
-                    asyncio.gather(*futures, return_exceptions=True),
-                    timeout=COMMIT_TIMEOUT,
-                )
-            except asyncio.TimeoutError:
-                logger.warning(
-                    f"ROLLBACK phase timeout for transaction {transaction_id}"
-                )
+        Args:
+            room_id: The deleted room's ID
+        """
+        loop = asyncio.get_running_loop()
+        result = await loop.run_in_executor(
+            None, self.room_registry.unregister_room, room_id
+        )
+        if not result.get("success"):
+            logger.warning(
+                f"Room {room_id} not removed from the room registry: "
+                f"{result.get('error')}"
+            )
 
     async def _notify_deletion_initiated(self, room_id: str, initiator: str):
         """Notify room members that deletion has been initiated."""
@@ -1599,17 +8263,23 @@ class WebSocketServer:
 
     async def _notify_room_deleted(self, room_id: str, room_name: str):
         """Notify all local clients that a room was deleted."""
-        notification = create_room_deleted_event(room_id, room_name)
+        await self._close_room_clients(
+            room_id, create_room_deleted_event(room_id, room_name)
+        )
+
+    async def _close_room_clients(self, room_id: str, notification: dict):
+        """Send a room's local clients a notification and forget them."""
         # Broadcast to all clients in the room
         if room_id in self._room_clients:
-            message_json = json.dumps(notification)
+            frame = encode_frame(notification)
             for ws, _ in list(self._room_clients[room_id]):
                 try:
-                    await ws.send(message_json)
+                    await self._send(ws, frame)
                 except websockets.exceptions.ConnectionClosed:
                     pass
             # Clear room client tracking
             del self._room_clients[room_id]
+        self.stream_repair.forget(room_id)
 
     async def _send_delete_room_error(
         self,
@@ -1625,9 +8295,9 @@ class WebSocketServer:
             "data": {
                 "room_id": room_id,
                 "reason": reason,
-                "error_code": error_code,
+                **error_fields(error_code),
             },
         }
         if transaction_id:
             response["data"]["transaction_id"] = transaction_id
-        await websocket.send(json.dumps(response))
+        await self._send(websocket, json.dumps(response))
@@ -4,20 +4,336 @@ XML-RPC Server for Inter-Node Communication
 Handles XML-RPC requests from peer nodes for distributed operations.
 """
 
+import functools
 import logging
+import ssl
+import time
 from datetime import datetime, timezone
-from xmlrpc.server import SimpleXMLRPCServer
-from threading import Thread
+from concurrent.futures import ThreadPoolExecutor
+from xmlrpc.server import SimpleXMLRPCRequestHandler, SimpleXMLRPCServer
+from threading import BoundedSemaphore, Thread
 from typing import List, Dict, Callable, Optional
+from xmlrpc.client import Binary
 
 from .room_state import RoomStateManager
-from .schemas.events import create_member_joined_event, create_member_left_event
+from .rpc import NODE_SERVICE_METHODS
+from .compression import (
+    COMPRESSION_THRESHOLD,
+    CompressionError,
+    choose_encoding,
+    decompress,
+    maybe_compress,
+    supported_encodings,
+)
+from .attachments import BLOB_CHUNK_SIZE, AttachmentError
+from .bots import BotError
+from .capacity import WAITLISTED, CapacityError
+from .e2ee import E2EEError
+from .edits import EDIT_EVENT_TYPES, EditError
+from .reactions import ReactionError
+from .read_receipts import ReadReceiptError
+from .threads import ThreadError
+from .invites import InviteError
+from .faults import HeartbeatDropped
+from .log_context import context_from_headers, log_context
+from .membership import MEMBERSHIP_CHANGE
+from .tls import HANDSHAKE_TIMEOUT
+from .tracing import SERVER, TRACEPARENT_HEADER, remote_parent, start_span
+from .moderation import BAN, MODERATION_ACTIONS, ModerationError
+from .announcements import AnnouncementError
+from .pins import PIN_EVENT_TYPES, PinError
+from .scheduled import ScheduleError
+from .retention import RetentionError
+from .room_metadata import RoomUpdateError
+from .roles import RoleError
+from .dedup import DedupWindow, DuplicateMessageError
+from .delivery import delivery_policy
+from .durability import await_quorum
+from .dispatch import RPC_WORKERS
+from .message_streams import StreamReceiver
+from .history import HISTORY_PAGE_SIZE
+from .search import SEARCH_LIMIT
+from .spam import SPAM_DETECTED, SpamError
+from .content_filters import ContentFilterError
+from .room_directory import DIGEST_BUCKETS, RoomDirectory
+from .snapshot import HANDOFF, RoomSnapshot, SnapshotReceiver
+from .tpc import TPCParticipant, TransactionHandler
+from .total_order import SequenceBuffer
+from .vector_clock import CausalBuffer
+from .webhooks import WebhookError
+from .bridges import BridgeError
+from .schemas.events import (
+    create_member_joined_event,
+    create_member_left_event,
+    create_member_role_changed_event,
+    create_retention_changed_event,
+    create_spam_detected_event,
+    create_spam_thresholds_changed_event,
+    create_content_filters_changed_event,
+    create_pin_event,
+    create_room_updated_event,
+    create_read_position_updated_event,
+    create_key_published_event,
+)
+from .schemas.errors import annotate_error, error_fields
+from .schemas.messages import (
+    create_message_edit_event,
+    create_message_reaction_event,
+    create_thread_updated_event,
+)
 from .utils.broadcast import broadcast_to_peers, broadcast_message_to_peers
-from .utils.validation import validate_message_content
+from .utils.validation import (
+    MAX_RPC_PAYLOAD_SIZE,
+    validate_message_content,
+    validate_message_id,
+    validate_rpc_params,
+)
 
 logger = logging.getLogger(__name__)
 
 
+# HTTP status answering a request body that can't be decompressed
+_DECODE_ERROR_STATUS = {
+    "UNSUPPORTED_ENCODING": 415,
+    "CORRUPT_BODY": 400,
+    "PAYLOAD_TOO_LARGE": 413,
+}
+
+
+class ContextRequestHandler(SimpleXMLRPCRequestHandler):
+    """
+    Request handler that logs each call in the caller's log context and
+    refuses request bodies over the server's max_payload_size.
+
+    Compressed requests are read in any encoding of compression.py, and
+    responses of at least the server's compression_threshold are
+    compressed in the best encoding the caller accepts.
+    """
+
+    def do_POST(self):
+        """Handle a call inside the log and trace context of its caller."""
+        try:
+            length = int(self.headers.get("content-length") or 0)
+        except ValueError:
+            length = 0
+        if length > self.server.max_payload_size:
+            logger.warning(
+                f"Rejected {length} byte XML-RPC request from "
+                f"{self.client_address[0]} "
+                f"(max {self.server.max_payload_size})"
+            )
+            self.send_response(413)
+            self.send_header("Content-length", "0")
+            self.end_headers()
+            self.close_connection = True
+            return
+        with log_context(**context_from_headers(self.headers)):
+            with remote_parent(self.headers.get(TRACEPARENT_HEADER)):
+                self._answer()
+
+    def _answer(self):
+        """Dispatch the call and send its response."""
+        if not self.is_rpc_path_valid():
+            self.report_404()
+            return
+        try:
+            length = int(self.headers["content-length"])
+            data = self.decode_request_content(self.rfile.read(length))
+            if data is None:
+                return
+            response = self.server._marshaled_dispatch(data, None, self.path)
+        except Exception as e:
+            logger.error(f"XML-RPC request failed: {e}")
+            self.send_response(500)
+            self.send_header("Content-length", "0")
+            self.end_headers()
+            return
+        response, encoding = maybe_compress(
+            response,
+            choose_encoding(self.headers.get("accept-encoding")),
+            self.server.compression_threshold,
+            self.server.metrics,
+        )
+        self.send_response(200)
+        self.send_header("Content-type", "text/xml")
+        self.send_header("Accept-Encoding", ", ".join(supported_encodings()))
+        if encoding:
+            self.send_header("Content-Encoding", encoding)
+        self.send_header("Content-length", str(len(response)))
+        self.end_headers()
+        self.wfile.write(response)
+
+    def decode_request_content(self, data):
+        """Decompress a request body, answering an error if it can't."""
+        encoding = self.headers.get("content-encoding", "identity")
+        try:
+            return decompress(data, encoding, self.server.max_payload_size)
+        except CompressionError as e:
+            logger.warning(
+                f"Rejected XML-RPC request from {self.client_address[0]}: "
+                f"{e}"
+            )
+            status = _DECODE_ERROR_STATUS[e.error_code]
+        self.send_response(status)
+        self.send_header("Content-length", "0")
+        self.end_headers()
+        self.close_connection = True
+        return None
+
+
+class ThreadedXMLRPCServer(SimpleXMLRPCServer):
+    """
+    SimpleXMLRPCServer that handles requests on a bounded thread pool.
+
+    Each connection is handled by one of `workers` threads. While they
+    are all busy and as many connections wait for them, the server stops
+    accepting, so callers wait in the listen backlog instead of each
+    getting a thread of its own.
+
+    With an SSL context set, each connection's TLS handshake runs in its
+    worker thread, so a slow or failing handshake doesn't hold up others.
+    """
+
+    workers = RPC_WORKERS
+    ssl_context: Optional[ssl.SSLContext] = None
+    max_payload_size = MAX_RPC_PAYLOAD_SIZE
+    compression_threshold: Optional[int] = COMPRESSION_THRESHOLD
+    metrics = None
+    faults = None
+    migrator = None
+    _pool: Optional[ThreadPoolExecutor] = None
+    _slots: Optional[BoundedSemaphore] = None
+
+    def process_request(self, request, client_address):
+        """Hand a connection to the pool, waiting for a free slot."""
+        if self._pool is None:
+            self._pool = ThreadPoolExecutor(
+                self.workers, thread_name_prefix="xmlrpc"
+            )
+            self._slots = BoundedSemaphore(2 * self.workers)
+        self._slots.acquire()
+        self._pool.submit(self._process_request, request, client_address)
+
+    def _process_request(self, request, client_address):
+        """Handle a connection in a worker thread."""
+        try:
+            self.finish_request(request, client_address)
+        except Exception:
+            self.handle_error(request, client_address)
+        finally:
+            self.shutdown_request(request)
+            self._slots.release()
+
+    def server_close(self):
+        """Close the socket and stop the worker threads once idle."""
+        super().server_close()
+        if self._pool is not None:
+            self._pool.shutdown(wait=False)
+
+    def finish_request(self, request, client_address):
+        """Handle a connection, first completing its TLS handshake."""
+        if self.ssl_context is None:
+            super().finish_request(request, client_address)
+            return
+        try:
+            request.settimeout(HANDSHAKE_TIMEOUT)
+            connection = self.ssl_context.wrap_socket(
+                request, server_side=True
+            )
+            connection.settimeout(None)
+        except (OSError, ssl.SSLError) as e:
+            logger.warning(
+                f"TLS handshake with {client_address[0]} failed: {e}"
+            )
+            return
+        try:
+            super().finish_request(connection, client_address)
+        finally:
+            connection.close()
+
+    def _dispatch(self, method, params):
+        """
+        Call a registered method, recording a server span.
+
+        Failed results with an error code are given its category and
+        retryable flag (see schemas/errors.py).
+        """
+        with start_span(
+            f"NodeService/{method}",
+            SERVER,
+            {"rpc.system": "xmlrpc", "rpc.method": method},
+        ) as span:
+            if self.faults is not None:
+                self._inject_faults(method)
+            func = self.funcs.get(method)
+            error = func and validate_rpc_params(func, params)
+            if error:
+                logger.warning(f"Rejected {method} call: {error['error']}")
+                result = {
+                    "success": False,
+                    "error": error["error"],
+                    **error_fields(error["error_code"]),
+                }
+            elif self.migrator is not None:
+                result = self.migrator.gate(
+                    method,
+                    params,
+                    functools.partial(super()._dispatch, method, params),
+                )
+            else:
+                result = super()._dispatch(method, params)
+            if isinstance(result, dict) and not result.get("success", True):
+                if span:
+                    span.set_error(result.get("error_code") or "FAILED")
+                annotate_error(result)
+            return result
+
+    def _inject_faults(self, method: str) -> None:
+        """Drop or delay a call as the armed faults say."""
+        if method == "heartbeat" and self.faults.drop_heartbeat():
+            raise HeartbeatDropped("Heartbeat dropped by fault injection")
+        delay = self.faults.rpc_delay(method)
+        if delay:
+            logger.warning(f"Fault injection: holding {method} for {delay}s")
+            time.sleep(delay)
+
+
+class RoomDeletionHandler(TransactionHandler):
+    """
+    2PC participant handler for the "delete_room" operation.
+
+    Delegates each phase to the server's room deletion methods, which also
+    notify local clients.
+    """
+
+    def __init__(self, server: "XMLRPCServer"):
+        """
+        Initialize the handler.
+
+        Args:
+            server: The XML-RPC server whose room state is affected
+        """
+        self.server = server
+
+    def prepare(self, transaction_id: str, payload: Dict) -> Dict:
+        """Vote on deleting payload['room_id']."""
+        return self.server.room_manager.prepare_for_deletion(
+            payload["room_id"], transaction_id, payload.get("coordinator", "")
+        )
+
+    def commit(self, transaction_id: str, payload: Dict) -> Dict:
+        """Delete the room and notify local clients."""
+        return self.server.commit_delete_room(
+            payload["room_id"], transaction_id, payload.get("room_name")
+        )
+
+    def abort(self, transaction_id: str, payload: Dict) -> Dict:
+        """Restore the room and notify local clients."""
+        return self.server.rollback_delete_room(
+            payload["room_id"], transaction_id
+        )
+
+
 class XMLRPCServer:
     """
     XML-RPC server for handling inter-node communication.
@@ -33,6 +349,30 @@ class XMLRPCServer:
         port: int,
         node_address: str,
         peer_registry=None,
+        room_directory=None,
+        causal_buffer: Optional[CausalBuffer] = None,
+        failover=None,
+        auth=None,
+        replication=None,
+        discovery=None,
+        presence=None,
+        sequence_buffer: Optional[SequenceBuffer] = None,
+        tls=None,
+        max_payload_size: int = MAX_RPC_PAYLOAD_SIZE,
+        profiles=None,
+        membership=None,
+        room_registry=None,
+        attachments=None,
+        load_balancer=None,
+        faults=None,
+        stats=None,
+        push_tokens=None,
+        tpc_store=None,
+        rpc_workers: int = RPC_WORKERS,
+        streams=None,
+        compression_threshold: Optional[int] = COMPRESSION_THRESHOLD,
+        metrics=None,
+        migrator=None,
     ):
         """
         Initialize the XML-RPC server.
@@ -43,6 +383,50 @@ class XMLRPCServer:
             port: Port to listen on
             node_address: Full address of this node (e.g., "http://localhost:9090")
             peer_registry: Optional registry of peer nodes for broadcasting
+            room_directory: Optional global room directory for gossip
+            causal_buffer: Optional buffer for causal message delivery
+            failover: Optional RoomFailover that keeps replicas of remote
+                rooms and runs admin elections
+            auth: Optional AuthManager used to verify the session tokens
+                forwarded with client operations
+            replication: Optional ReplicationManager that streams messages
+                of rooms administered here to follower nodes
+            discovery: Optional PeerDiscovery that answers handshakes from
+                nodes joining the cluster
+            presence: Optional PresenceDirectory of where users are
+                connected, gossiped for direct messages
+            sequence_buffer: Optional buffer for delivering messages of
+                total-order rooms by sequence number
+            tls: Optional TLSManager; when set, peers call this node over
+                https:// (with mutual TLS if it has a CA file)
+            max_payload_size: Largest request body accepted, in bytes
+            profiles: Optional ProfileRegistry of user profiles, merged
+                from pushes and gossip
+            membership: Optional ClusterMembership; when set, this node
+                votes on and installs membership view changes
+            room_registry: Optional RaftRoomRegistry whose Raft node
+                answers this node's Raft RPCs
+            attachments: Optional AttachmentManager whose blob store
+                serves and receives attachment blobs
+            load_balancer: Optional LoadBalancer whose load table is
+                gossiped with peers
+            faults: Optional FaultInjector whose delays, dropped
+                heartbeats and 2PC crashes apply to calls into this node
+            stats: Optional ClusterStats gossiped with peers
+            push_tokens: Optional PushTokenRegistry of users' push
+                tokens, merged from pushes and gossip
+            tpc_store: Optional TransactionStore keeping this node's
+                undecided 2PC transactions across restarts
+            rpc_workers: Threads answering requests; further requests
+                wait for one to be free
+            streams: Optional MessageStreams sending this node's room
+                messages to peers in batches instead of a call each
+            compression_threshold: Smallest response body compressed, in
+                bytes (None sends responses uncompressed)
+            metrics: Optional NodeMetrics counting the bytes compression
+                saved
+            migrator: Optional RoomMigrator pausing calls on rooms being
+                migrated (see migration.py)
         """
         self.room_manager = room_manager
         self.host = host
@@ -51,7 +435,56 @@ class XMLRPCServer:
         self.server = None
         self.server_thread = None
         self._broadcast_callback: Optional[Callable] = None
+        self._direct_message_callback: Optional[Callable] = None
+        self._receipt_callback: Optional[Callable] = None
+        self._removal_callback: Optional[Callable] = None
+        self._admission_callback: Optional[Callable] = None
+        self._backlog_callback: Optional[Callable] = None
         self.peer_registry = peer_registry
+        self.room_directory = room_directory
+        self.causal_buffer = causal_buffer or CausalBuffer()
+        self.sequence_buffer = sequence_buffer or SequenceBuffer()
+        # IDs of messages already received from room administrators
+        self.delivered_messages = DedupWindow()
+        self.failover = failover
+        self.auth = auth
+        self.replication = replication
+        self.discovery = discovery
+        self.presence = presence
+        self.tls = tls
+        self.max_payload_size = max_payload_size
+        self.rpc_workers = rpc_workers
+        self.streams = streams
+        self.compression_threshold = compression_threshold
+        self.metrics = metrics
+        self.stream_receiver = StreamReceiver()
+        self.profiles = profiles
+        self.faults = faults
+        self.migrator = migrator
+        self.tpc_participant = TPCParticipant(
+            room_manager.node_id,
+            faults=faults,
+            peer_registry=peer_registry,
+            store=tpc_store,
+        )
+        self.tpc_participant.register_handler(
+            "delete_room", RoomDeletionHandler(self)
+        )
+        self.membership = membership
+        self.room_registry = room_registry
+        self.attachments = attachments
+        self.load_balancer = load_balancer
+        self.stats = stats
+        self.push_tokens = push_tokens
+        if membership is not None:
+            self.tpc_participant.register_handler(
+                MEMBERSHIP_CHANGE, membership.handler
+            )
+        self.snapshot_receiver = SnapshotReceiver(
+            room_manager.node_id,
+            self._accept_snapshot,
+            on_replica=self._accept_replica_snapshot,
+        )
 
     def set_broadcast_callback(self, callback: Callable):
         """
@@ -62,42 +495,76 @@ class XMLRPCServer:
         """
         self._broadcast_callback = callback
 
+    def set_direct_message_callback(self, callback: Callable):
+        """
+        Set a callback for delivering direct messages to local clients.
+
+        Args:
+            callback: Function that takes (username, message_dict) and
+                returns the number of connections it was sent to
+        """
+        self._direct_message_callback = callback
+
+    def set_receipt_callback(self, callback: Callable):
+        """
+        Set a callback for passing delivery receipts to local senders.
+
+        Args:
+            callback: Function that takes a DeliveryReceipt dict and
+                returns the number of connections it was sent to
+        """
+        self._receipt_callback = callback
+
+    def set_removal_callback(self, callback: Callable):
+        """
+        Set a callback for taking kicked or banned users out of a room.
+
+        Args:
+            callback: Function that takes (room_id, username, action,
+                moderator) and returns the number of connections removed
+        """
+        self._removal_callback = callback
+
+    def set_admission_callback(self, callback: Callable):
+        """
+        Set a callback for putting users admitted from a waiting list in
+        their room.
+
+        Args:
+            callback: Function that takes (room_id, username, room_info,
+                messages) and returns the number of connections admitted
+        """
+        self._admission_callback = callback
+
+    def set_backlog_callback(self, callback: Callable):
+        """
+        Set a callback reporting the deliveries to local clients waiting,
+        which streams from peers are slowed down by.
+
+        Args:
+            callback: Function that takes no arguments and returns the
+                number of deliveries waiting
+        """
+        self._backlog_callback = callback
+
     def start(self):
         """Start the XML-RPC server in a background thread."""
-        self.server = SimpleXMLRPCServer(
+        self.server = ThreadedXMLRPCServer(
             (self.host, self.port),
+            requestHandler=ContextRequestHandler,
             allow_none=True,
             logRequests=False,
         )
+        self.server.max_payload_size = self.max_payload_size
+        self.server.faults = self.faults
+        self.server.migrator = self.migrator
+        self.server.workers = self.rpc_workers
+        self.server.compression_threshold = self.compression_threshold
+        self.server.metrics = self.metrics
+        if self.tls:
+            self.server.ssl_context = self.tls.node_server_context
 
-        # Register methods
-        self.server.register_function(self.get_hosted_rooms, "get_hosted_rooms")
-        self.server.register_function(self.join_room, "join_room")
-        self.server.register_function(self.leave_room, "leave_room")
-        self.server.register_function(self.forward_message, "forward_message")
-        self.server.register_function(
-            self.receive_message_broadcast, "receive_message_broadcast"
-        )
-        self.server.register_function(
-            self.receive_member_event_broadcast,
-            "receive_member_event_broadcast",
-        )
-        # Member disconnect notification
-        self.server.register_function(
-            self.notify_member_disconnect, "notify_member_disconnect"
-        )
-        # Node health/heartbeat
-        self.server.register_function(self.heartbeat, "heartbeat")
-        # 2PC room deletion methods
-        self.server.register_function(
-            self.prepare_delete_room, "prepare_delete_room"
-        )
-        self.server.register_function(
-            self.commit_delete_room, "commit_delete_room"
-        )
-        self.server.register_function(
-            self.rollback_delete_room, "rollback_delete_room"
-        )
+        self.register_methods(self.server)
 
         logger.info(f"XML-RPC server starting on {self.host}:{self.port}")
 
@@ -107,6 +574,18 @@ class XMLRPCServer:
 
         logger.info(f"XML-RPC server started at {self.node_address}")
 
+    def register_methods(self, dispatcher) -> None:
+        """
+        Register every method of the NodeService contract on a dispatcher.
+
+        Args:
+            dispatcher: The SimpleXMLRPCDispatcher answering calls
+        """
+        for method_name in NODE_SERVICE_METHODS:
+            dispatcher.register_function(
+                getattr(self, method_name), method_name
+            )
+
     def _run_server(self):
         """Run the XML-RPC server (called in background thread)."""
         self.server.serve_forever()
@@ -118,6 +597,7 @@ class XMLRPCServer:
             self.server.shutdown()
             if self.server_thread:
                 self.server_thread.join(timeout=2)
+            self.server.server_close()
             logger.info("XML-RPC server stopped")
 
     def get_hosted_rooms(self) -> List[Dict]:
@@ -125,6 +605,7 @@ class XMLRPCServer:
         Returns a list of rooms hosted by this node.
 
         This method is exposed via XML-RPC and can be called by peer nodes.
+        Private rooms are not listed.
 
         Returns:
             list: List of room dictionaries with structure:
@@ -143,7 +624,7 @@ class XMLRPCServer:
         logger.info("XML-RPC: get_hosted_rooms called")
 
         # Get rooms from room manager
-        rooms = self.room_manager.list_rooms()
+        rooms = self.room_manager.list_public_rooms()
 
         # Add node_address to each room
         for room in rooms:
@@ -152,211 +633,2678 @@ class XMLRPCServer:
         logger.info(f"XML-RPC: Returning {len(rooms)} hosted rooms")
         return rooms
 
-    def join_room(
-        self, room_id: str, username: str, client_node_id: str
-    ) -> Dict:
+    def get_room_info(self, room_id: str) -> Dict:
         """
-        Handle a join request for a room administered by this node.
+        Get details of a single room hosted by this node.
 
         This method is exposed via XML-RPC and can be called by peer nodes
-        when a client connected to them wants to join a room hosted here.
+        that need room metadata without listing every hosted room.
 
         Args:
-            room_id: The ID of the room to join
-            username: The username of the joining user
-            client_node_id: The node the client is connected to
+            room_id: The ID of the room
 
         Returns:
-            dict: Join result with structure:
+            dict: Result with structure:
             {
                 'success': bool,
-                'message': str,
-                'room_info': {
-                    'room_id': str,
-                    'room_name': str,
-                    'description': str,
-                    'members': list,
-                    'member_count': int,
-                    'admin_node': str
-                } or None if failed
+                'room_info': dict or None,
+                'error_code': str (if not found)
             }
         """
-        logger.info(
-            f"XML-RPC: join_room called for room {room_id} "
-            f"by {username} from {client_node_id}"
-        )
+        logger.info(f"XML-RPC: get_room_info called for room {room_id}")
 
-        # Get the room
         room = self.room_manager.get_room(room_id)
         if not room:
-            logger.warning(f"XML-RPC: Room {room_id} not found")
             return {
                 "success": False,
-                "message": "Room not found",
-                "error_code": "ROOM_NOT_FOUND",
                 "room_info": None,
+                "error_code": "ROOM_NOT_FOUND",
             }
 
-        # Check if user is already in the room - allow re-registration
-        if username in room.members:
-            logger.info(
-                f"XML-RPC: User {username} already in room {room_id}, "
-                "allowing re-registration"
-            )
-            # Return success without re-broadcasting join event
-            return {
-                "success": True,
-                "message": "Already in room, re-registered",
-                "room_info": {
-                    "room_id": room.room_id,
-                    "room_name": room.room_name,
-                    "description": room.description,
-                    "members": list(room.members),
-                    "member_count": len(room.members),
-                    "admin_node": room.admin_node,
-                },
-                "messages": room.messages,
-            }
+        room_info = room.to_dict()
+        room_info["members"] = list(room.members)
+        room_info["state"] = room.state.value
+        room_info["node_address"] = self.node_address
+        return {"success": True, "room_info": room_info}
 
-        # Add user to the room with their node information
-        self.room_manager.add_member(room_id, username, client_node_id)
+    def exchange_room_directory(self, entries: List[Dict]) -> List[Dict]:
+        """
+        Exchange room directory entries with a gossiping peer.
 
-        logger.info(f"XML-RPC: User {username} joined room {room.room_name}")
+        This method is exposed via XML-RPC. The caller pushes its
+        directory; this node merges it and replies with its own entries
+        so both sides converge in a single round trip.
 
-        # Create member_joined event data
-        event_data = create_member_joined_event(
-            room_id=room_id,
-            username=username,
-            member_count=len(room.members),
-            timestamp=datetime.now(timezone.utc).isoformat(),
-        )
+        Args:
+            entries: Directory entries from the calling peer
 
-        # Broadcast member_joined to local clients via callback
-        if self._broadcast_callback:
-            broadcast_msg = {
-                "type": "member_joined",
-                "data": event_data,
-            }
-            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        Returns:
+            list: This node's directory entries (including tombstones)
+        """
+        if self.room_directory is None:
+            return []
 
-        # Broadcast member_joined to peer nodes via XML-RPC
-        broadcast_to_peers(
-            self.peer_registry, room_id, "member_joined", event_data
-        )
+        self.room_directory.update_local(self.room_manager.list_rooms())
+        self.room_directory.merge(entries)
+        return self.room_directory.get_entries()
 
-        return {
-            "success": True,
-            "message": "Successfully joined room",
-            "room_info": {
-                "room_id": room.room_id,
-                "room_name": room.room_name,
-                "description": room.description,
-                "members": list(room.members),
-                "member_count": len(room.members),
-                "admin_node": room.admin_node,
-            },
-            "messages": room.messages,  # Include existing messages for late joiners
-        }
+    def room_directory_digest(self, buckets: int = DIGEST_BUCKETS) -> Dict:
+        """
+        Get the digest tree of this node's room directory.
 
-    def forward_message(
-        self, room_id: str, username: str, content: str, sender_node_id: str
+        This method is exposed via XML-RPC for anti-entropy.
+
+        Args:
+            buckets: Number of leaf buckets of the digest
+
+        Returns:
+            dict: {'root': str, 'buckets': list of str}
+        """
+        if self.room_directory is None:
+            return RoomDirectory(self.room_manager.node_id).digest(buckets)
+
+        self.room_directory.update_local(self.room_manager.list_rooms())
+        return self.room_directory.digest(buckets)
+
+    def room_directory_versions(
+        self, bucket_indices: List[int], buckets: int = DIGEST_BUCKETS
     ) -> Dict:
         """
-        Forward a message to the room administrator for ordering and broadcast.
+        Get the versions of the directory entries in some digest buckets.
 
-        This method is exposed via XML-RPC and can be called by peer nodes
-        when a client connected to them wants to send a message to a room
-        hosted here.
+        Args:
+            bucket_indices: Indices of the leaf buckets that differ
+            buckets: Number of leaf buckets of the digest
+
+        Returns:
+            dict: Maps room_id -> {'version': int, 'deleted': bool}
+        """
+        if self.room_directory is None:
+            return {}
+        return self.room_directory.bucket_versions(bucket_indices, buckets)
+
+    def sync_room_directory(
+        self, entries: List[Dict], room_ids: List[str]
+    ) -> List[Dict]:
+        """
+        Repair divergent room directory entries found by anti-entropy.
 
         Args:
-            room_id: The ID of the room
-            username: The username of the sender
-            content: The message content
-            sender_node_id: The node the sender is connected to
+            entries: Entries this node is missing or holds stale versions
+                of
+            room_ids: Rooms whose entries the caller is missing or holds
+                stale versions of
 
         Returns:
-            dict: Result with structure:
-            {
-                'success': bool,
-                'message_id': str,
-                'sequence_number': int,
-                'timestamp': str,
-                'error': str or None
-            }
+            list: This node's entries for room_ids
         """
+        if self.room_directory is None:
+            return []
+
+        self.room_directory.update_local(self.room_manager.list_rooms())
+        merged = self.room_directory.merge(entries)
         logger.info(
-            f"XML-RPC: forward_message called for room {room_id} "
-            f"from {username} via {sender_node_id}"
+            f"XML-RPC: sync_room_directory merged {merged} entries and "
+            f"returned {len(room_ids)}"
         )
+        return self.room_directory.get_entries_for(room_ids)
 
-        # Validate message content
-        is_valid, error_msg = validate_message_content(content)
-        if not is_valid:
-            return {
-                "success": False,
-                "error": error_msg,
-                "error_code": "INVALID_CONTENT",
-            }
+    def exchange_presence(self, entries: List[Dict]) -> List[Dict]:
+        """
+        Exchange presence entries with a gossiping peer.
 
-        # Get the room
-        room = self.room_manager.get_room(room_id)
-        if not room:
-            logger.warning(f"XML-RPC: Room {room_id} not found")
-            return {
-                "success": False,
-                "error": "Room not found",
-                "error_code": "ROOM_NOT_FOUND",
-            }
+        Args:
+            entries: Presence entries from the calling peer
 
-        # Check if user is a member
-        if username not in room.members:
-            logger.warning(
-                f"XML-RPC: User {username} not a member of room {room_id}"
-            )
-            return {
-                "success": False,
-                "error": "You are not a member of this room",
-                "error_code": "NOT_MEMBER",
-            }
+        Returns:
+            list: This node's presence entries
+        """
+        if self.presence is None:
+            return []
 
-        # Add message to room (assigns sequence number)
-        message = self.room_manager.add_message(room_id, username, content)
+        self.presence.merge(entries)
+        return self.presence.get_entries()
 
-        if not message:
+    def receive_presence_update(self, entries: List[Dict]) -> Dict:
+        """
+        Receive presence changes pushed by the node the users are on.
+
+        Merged changes reach clients in shared rooms on this node once the
+        node publishes its own presence changes.
+
+        Args:
+            entries: Changed presence entries
+
+        Returns:
+            dict: {'success': bool, 'updated': int}
+        """
+        if self.presence is None:
             return {
                 "success": False,
-                "error": "Failed to add message",
-                "error_code": "INTERNAL_ERROR",
+                "error": "Presence is not enabled on this node",
+                "error_code": "PRESENCE_UNSUPPORTED",
             }
 
-        # Broadcast to local clients via callback
-        if self._broadcast_callback:
-            broadcast_msg = {"type": "new_message", "data": message}
-            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
-
-        # Broadcast to peer nodes via XML-RPC
-        broadcast_message_to_peers(self.peer_registry, room_id, message)
+        updated = self.presence.merge(entries)
+        logger.debug(f"XML-RPC: Merged {updated} pushed presence changes")
+        return {"success": True, "updated": updated}
 
-        logger.info(
-            f"XML-RPC: Message #{message['sequence_number']} "
-            f"from {username} processed"
-        )
+    def exchange_profiles(self, entries: List[Dict]) -> List[Dict]:
+        """
+        Exchange user profiles with a gossiping peer.
 
-        return {
-            "success": True,
-            "message_id": message["message_id"],
-            "sequence_number": message["sequence_number"],
-            "timestamp": message["timestamp"],
-        }
+        Args:
+            entries: Profiles from the calling peer
 
-    def receive_message_broadcast(
-        self, room_id: str, message_data: Dict
-    ) -> bool:
+        Returns:
+            list: This node's profiles
         """
-        Receive a message broadcast from the administrator node.
+        if self.profiles is None:
+            return []
 
-        This method is exposed via XML-RPC and is called by the administrator
-        node when it broadcasts a message to all member nodes.
+        self.profiles.merge(entries)
+        return self.profiles.get_entries()
+
+    def exchange_push_tokens(self, entries: List[Dict]) -> List[Dict]:
+        """
+        Exchange users' push tokens with a gossiping peer.
+
+        Args:
+            entries: Token records from the calling peer
+
+        Returns:
+            list: This node's token records, tombstones included
+        """
+        if self.push_tokens is None:
+            return []
+
+        self.push_tokens.merge(entries)
+        return self.push_tokens.get_entries()
+
+    def exchange_load(self, entries: List[Dict]) -> List[Dict]:
+        """
+        Exchange node loads with a gossiping peer.
+
+        Args:
+            entries: Loads from the calling peer
+
+        Returns:
+            list: This node's load table
+        """
+        if self.load_balancer is None:
+            return []
+
+        self.load_balancer.merge(entries)
+        return self.load_balancer.get_entries()
+
+    def exchange_stats(self, entries: List[Dict]) -> List[Dict]:
+        """
+        Exchange node and room statistics with a gossiping peer.
+
+        Args:
+            entries: Statistics from the calling peer
+
+        Returns:
+            list: The statistics this node has
+        """
+        if self.stats is None:
+            return []
+
+        self.stats.merge(entries)
+        return self.stats.get_entries()
+
+    def receive_profile_update(self, entries: List[Dict]) -> Dict:
+        """
+        Receive profiles changed on the node the users are connected to.
+
+        Profiles newer than the local ones are adopted, and the registry's
+        subscribers tell clients in the users' rooms on this node.
+
+        Args:
+            entries: Changed profiles
+
+        Returns:
+            dict: {'success': bool, 'updated': int}
+        """
+        if self.profiles is None:
+            return {
+                "success": False,
+                "error": "Profiles are not enabled on this node",
+                "error_code": "PROFILES_UNSUPPORTED",
+            }
+
+        updated = self.profiles.merge(entries)
+        logger.debug(f"XML-RPC: Merged {len(updated)} pushed profiles")
+        return {"success": True, "updated": len(updated)}
+
+    def receive_push_tokens(self, entries: List[Dict]) -> Dict:
+        """
+        Receive push tokens registered or removed on another node.
+
+        Args:
+            entries: Changed token records
+
+        Returns:
+            dict: {'success': bool, 'updated': int}
+        """
+        if self.push_tokens is None:
+            return {
+                "success": False,
+                "error": "Push notifications are not enabled on this node",
+                "error_code": "PUSH_UNSUPPORTED",
+            }
+
+        updated = self.push_tokens.merge(entries)
+        logger.debug(f"XML-RPC: Merged {updated} pushed push tokens")
+        return {"success": True, "updated": updated}
+
+    def get_membership_view(self) -> Optional[Dict]:
+        """
+        Get this node's cluster membership view.
+
+        Returns:
+            dict: The view ('epoch' and 'members'), or None without a
+            membership view
+        """
+        if self.membership is None:
+            return None
+        return self.membership.view.to_dict()
+
+    def raft_request_vote(
+        self,
+        term: int,
+        candidate_id: str,
+        last_log_index: int,
+        last_log_term: int,
+    ) -> Dict:
+        """
+        Handle a Raft candidate's vote request.
+
+        Args:
+            term: The candidate's term
+            candidate_id: The candidate's node ID
+            last_log_index: Index of the candidate's last log entry
+            last_log_term: Term of the candidate's last log entry
+
+        Returns:
+            dict: {'term': int, 'vote_granted': bool}
+        """
+        if self.room_registry is None:
+            return self._raft_unsupported()
+        return self.room_registry.raft.handle_request_vote(
+            term, candidate_id, last_log_index, last_log_term
+        )
+
+    def raft_append_entries(
+        self,
+        term: int,
+        leader_id: str,
+        prev_log_index: int,
+        prev_log_term: int,
+        entries: List[Dict],
+        leader_commit: int,
+    ) -> Dict:
+        """
+        Handle a Raft leader's log entries or heartbeat.
+
+        Args:
+            term: The leader's term
+            leader_id: The leader's node ID
+            prev_log_index: Index of the entry preceding the new ones
+            prev_log_term: Term of the entry preceding the new ones
+            entries: New log entries (empty for a heartbeat)
+            leader_commit: The leader's commit index
+
+        Returns:
+            dict: {'term': int, 'success': bool, 'last_index': int}
+        """
+        if self.room_registry is None:
+            return self._raft_unsupported()
+        return self.room_registry.raft.handle_append_entries(
+            term,
+            leader_id,
+            prev_log_index,
+            prev_log_term,
+            entries,
+            leader_commit,
+        )
+
+    def raft_install_snapshot(
+        self,
+        term: int,
+        leader_id: str,
+        last_index: int,
+        last_term: int,
+        state: Dict,
+    ) -> Dict:
+        """
+        Handle a Raft leader's snapshot for a follower missing entries.
+
+        Args:
+            term: The leader's term
+            leader_id: The leader's node ID
+            last_index: Index of the last entry the snapshot covers
+            last_term: Term of that entry
+            state: The room registry's state
+
+        Returns:
+            dict: {'term': int}
+        """
+        if self.room_registry is None:
+            return self._raft_unsupported()
+        return self.room_registry.raft.handle_install_snapshot(
+            term, leader_id, last_index, last_term, state
+        )
+
+    def raft_submit(self, command: Dict) -> Dict:
+        """
+        Commit a room registry command forwarded by a follower.
+
+        Args:
+            command: The command
+
+        Returns:
+            dict: The command's result
+        """
+        if self.room_registry is None:
+            return self._raft_unsupported()
+        logger.debug(f"XML-RPC: Raft command {command.get('op')} submitted")
+        return self.room_registry.raft.propose(command)
+
+    def _raft_unsupported(self) -> Dict:
+        """Error for Raft RPCs on a node without the Raft registry."""
+        return {
+            "success": False,
+            "error": "The Raft room registry is not enabled on this node",
+            "error_code": "RAFT_UNSUPPORTED",
+        }
+
+    def join_room(
+        self,
+        room_id: str,
+        username: str,
+        client_node_id: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Handle a join request for a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them wants to join a room hosted here.
+
+        Args:
+            room_id: The ID of the room to join
+            username: The username of the joining user
+            client_node_id: The node the client is connected to
+            auth_token: Session token of the joining user, if any
+
+        Returns:
+            dict: Join result with structure:
+            {
+                'success': bool,
+                'message': str,
+                'room_info': {
+                    'room_id': str,
+                    'room_name': str,
+                    'description': str,
+                    'members': list,
+                    'member_count': int,
+                    'admin_node': str,
+                    'creator_id': str,
+                    'vector_clock': dict
+                } or None if failed
+            }
+        """
+        logger.info(
+            f"XML-RPC: join_room called for room {room_id} "
+            f"by {username} from {client_node_id}"
+        )
+
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return {
+                "success": False,
+                "message": denied["error"],
+                "error_code": denied["error_code"],
+                "room_info": None,
+            }
+
+        # Get the room
+        room = self.room_manager.get_room(room_id)
+        if not room:
+            logger.warning(f"XML-RPC: Room {room_id} not found")
+            return {
+                "success": False,
+                "message": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+                "room_info": None,
+            }
+
+        if username in room.banned:
+            logger.warning(
+                f"XML-RPC: Banned user {username} tried to join room {room_id}"
+            )
+            return {
+                "success": False,
+                "message": "You are banned from this room",
+                "error_code": "BANNED",
+                "room_info": None,
+            }
+
+        if not room.can_join(username):
+            logger.warning(
+                f"XML-RPC: User {username} needs an invite for room {room_id}"
+            )
+            return {
+                "success": False,
+                "message": "Room is private, an invite is required",
+                "error_code": "INVITE_REQUIRED",
+                "room_info": None,
+            }
+
+        return self._admit_member(room, username, client_node_id)
+
+    def join_room_by_invite(
+        self,
+        room_id: str,
+        username: str,
+        client_node_id: str,
+        invite_token: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Handle an invite join for a private room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them redeems an invite to a room hosted
+        here. Members re-joining don't use up the invite.
+
+        Args:
+            room_id: The ID of the room to join
+            username: The username of the joining user
+            client_node_id: The node the client is connected to
+            invite_token: The invite token
+            auth_token: Session token of the joining user, if any
+
+        Returns:
+            dict: Join result, as returned by join_room
+        """
+        logger.info(
+            f"XML-RPC: join_room_by_invite called for room {room_id} "
+            f"by {username} from {client_node_id}"
+        )
+
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return {
+                "success": False,
+                "message": denied["error"],
+                "error_code": denied["error_code"],
+                "room_info": None,
+            }
+
+        room = self.room_manager.get_room(room_id)
+        if not room:
+            return {
+                "success": False,
+                "message": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+                "room_info": None,
+            }
+
+        if username in room.banned:
+            return {
+                "success": False,
+                "message": "You are banned from this room",
+                "error_code": "BANNED",
+                "room_info": None,
+            }
+
+        if username not in room.members:
+            try:
+                self.room_manager.redeem_invite(room_id, invite_token, username)
+            except InviteError as e:
+                return {
+                    "success": False,
+                    "message": str(e),
+                    "error_code": e.error_code,
+                    "room_info": None,
+                }
+
+        return self._admit_member(room, username, client_node_id)
+
+    def _admit_member(self, room, username: str, client_node_id: str) -> Dict:
+        """Add a remote user to a hosted room and build the join result."""
+        room_id = room.room_id
+
+        # Check if user is already in the room - allow re-registration,
+        # e.g. from another device connected to a different node
+        if username in room.members:
+            logger.info(
+                f"XML-RPC: User {username} already in room {room_id}, "
+                "allowing re-registration"
+            )
+            self.room_manager.add_member(room_id, username, client_node_id)
+            # Return success without re-broadcasting join event
+            return {
+                "success": True,
+                "message": "Already in room, re-registered",
+                "room_info": self._room_info(room),
+                "messages": room.messages,
+            }
+
+        # Add user to the room with their node information, or queue them
+        # if it is full
+        try:
+            position = self.room_manager.join_or_wait(
+                room_id, username, client_node_id
+            )
+        except CapacityError as e:
+            return {
+                "success": False,
+                "message": str(e),
+                "error_code": e.error_code,
+                "room_info": None,
+            }
+        if position:
+            return {
+                "success": False,
+                "message": (
+                    f"Room is full, you are number {position} on the "
+                    f"waiting list"
+                ),
+                "error_code": WAITLISTED,
+                "waitlist_position": position,
+                "max_members": room.max_members,
+                "room_info": None,
+            }
+
+        logger.info(f"XML-RPC: User {username} joined room {room.room_name}")
+        self._announce_joined(room_id, username)
+
+        return {
+            "success": True,
+            "message": "Successfully joined room",
+            "room_info": self._room_info(room),
+            # Include existing messages for late joiners
+            "messages": room.messages,
+        }
+
+    def _room_info(self, room) -> Dict:
+        """Describe a hosted room for a join result."""
+        return {
+            "room_id": room.room_id,
+            "room_name": room.room_name,
+            "description": room.description,
+            "members": list(room.members),
+            "member_count": len(room.members),
+            "admin_node": room.admin_node,
+            "creator_id": room.creator_id,
+            "vector_clock": dict(room.vector_clock),
+            "private": room.private,
+            "total_order": room.total_order,
+            "roles": dict(room.roles),
+            "max_members": room.max_members,
+            "waitlist_enabled": room.waitlist_enabled,
+            "announcement": room.announcement,
+            "delivery": room.delivery,
+            "ephemeral": room.ephemeral,
+            "placement": dict(room.placement),
+            "durable": room.durable,
+            "member_set": room.member_set.to_dict(),
+            "read_positions": dict(room.read_positions),
+            "public_keys": dict(room.public_keys),
+            "retention": list(room.retention),
+            "pinned": list(room.pinned),
+            "topic": room.topic,
+            "metadata_versions": dict(room.metadata_versions),
+            "spam_thresholds": dict(room.spam_thresholds),
+            "content_filters": [dict(f) for f in room.content_filters],
+        }
+
+    def _announce_joined(self, room_id: str, username: str):
+        """Announce a new member to local clients and peer nodes."""
+        event_data = create_member_joined_event(
+            room_id=room_id,
+            username=username,
+            member_count=len(self.room_manager.get_members(room_id)),
+            timestamp=datetime.now(timezone.utc).isoformat(),
+            hlc=self.room_manager.clock.now().encode(),
+        )
+
+        # Broadcast member_joined to local clients via callback
+        if self._broadcast_callback:
+            broadcast_msg = {
+                "type": "member_joined",
+                "data": event_data,
+            }
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+
+        # Broadcast member_joined to peer nodes via XML-RPC
+        broadcast_to_peers(
+            self.peer_registry, room_id, "member_joined", event_data
+        )
+
+    def _admit_waitlisted(self, room_id: str):
+        """
+        Fill a hosted room's free slots from its waiting list.
+
+        Each admitted user is put in the room through the node they are
+        connected to; users no longer connected give up their slot.
+        """
+        while True:
+            admitted = self.room_manager.admit_next(room_id)
+            room = self.room_manager.get_room(room_id)
+            if admitted is None or room is None:
+                return
+            username, member_node = admitted
+            room_info = self._room_info(room)
+            messages = self.room_manager.get_messages(room_id)
+            delivered = 0
+            if member_node == self.room_manager.node_id:
+                if self._admission_callback:
+                    delivered = self._admission_callback(
+                        room_id, username, room_info, messages
+                    )
+            elif self.peer_registry:
+                try:
+                    result = self.peer_registry.call_peer(
+                        member_node,
+                        "notify_waitlist_admitted",
+                        room_id,
+                        username,
+                        room_info,
+                        messages,
+                    )
+                    delivered = result.get("admitted", 0)
+                except Exception as e:
+                    logger.warning(
+                        f"Could not tell {member_node} that {username} "
+                        f"was admitted to room {room_id}: {e}"
+                    )
+            if not delivered:
+                logger.info(
+                    f"XML-RPC: Waiting user {username} is gone, giving "
+                    f"their slot in room {room_id} to the next"
+                )
+                self.room_manager.remove_member(room_id, username)
+                continue
+            logger.info(
+                f"XML-RPC: Admitted {username} to room {room_id} from the "
+                f"waiting list"
+            )
+            self._announce_joined(room_id, username)
+
+    def notify_waitlist_admitted(
+        self,
+        room_id: str,
+        username: str,
+        room_info: Dict,
+        messages: List[Dict],
+    ) -> Dict:
+        """
+        Put a user admitted from a room's waiting list in the room.
+
+        This method is exposed via XML-RPC and is called by the
+        administrator node of a room when a user connected to this node
+        gets a free slot.
+
+        Args:
+            room_id: The ID of the room
+            username: The admitted user
+            room_info: The room, as in a join result
+            messages: The room's recent messages
+
+        Returns:
+            dict: {'success': True, 'admitted': int} with the number of
+            the user's connections put in the room (0 if they left)
+        """
+        logger.info(
+            f"XML-RPC: notify_waitlist_admitted called for room {room_id}, "
+            f"user {username}"
+        )
+        admitted = 0
+        if self._admission_callback:
+            admitted = self._admission_callback(
+                room_id, username, room_info, messages
+            )
+        return {"success": True, "admitted": admitted}
+
+    def create_room_invite(
+        self,
+        room_id: str,
+        inviter: str,
+        invitee: str = "",
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Create an invite to a private room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a member connected to them invites someone.
+
+        Args:
+            room_id: The ID of the private room
+            inviter: Username of the creator or a member of the room
+            invitee: Optional username allowed to redeem the invite
+            auth_token: Session token of the inviter, if any
+
+        Returns:
+            dict: {'success': True, 'invite': dict} or an error with
+            'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: create_room_invite called for room {room_id} "
+            f"by {inviter}"
+        )
+        denied = self._check_auth(auth_token, inviter)
+        if denied:
+            return denied
+        try:
+            invite = self.room_manager.create_invite(
+                room_id, inviter, invitee or None
+            )
+        except InviteError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "invite": invite.to_dict()}
+
+    def revoke_room_invite(
+        self,
+        room_id: str,
+        invite_token: str,
+        requester: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Revoke an invite to a private room administered by this node.
+
+        Args:
+            room_id: The ID of the private room
+            invite_token: The invite token
+            requester: Username of the inviter, room owner or a moderator
+            auth_token: Session token of the requester, if any
+
+        Returns:
+            dict: {'success': True, 'invite': dict} or an error with
+            'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: revoke_room_invite called for room {room_id} "
+            f"by {requester}"
+        )
+        denied = self._check_auth(auth_token, requester)
+        if denied:
+            return denied
+        try:
+            invite = self.room_manager.revoke_invite(
+                room_id, invite_token, requester
+            )
+        except InviteError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "invite": invite.to_dict()}
+
+    def moderate_member(
+        self,
+        room_id: str,
+        moderator: str,
+        target: str,
+        action: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Kick or ban a member of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the room owner or a moderator is connected to them.
+
+        Args:
+            room_id: The ID of the room
+            moderator: Username of the room owner or a moderator
+            target: The user to remove
+            action: "kick" or "ban"
+            auth_token: Session token of the moderator, if any
+
+        Returns:
+            dict: {'success': True, 'room_id', 'username', 'action'} or an
+            error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: moderate_member called for room {room_id}: "
+            f"{moderator} {action}s {target}"
+        )
+        denied = self._check_auth(auth_token, moderator)
+        if denied:
+            return denied
+        if action not in MODERATION_ACTIONS or not target:
+            return {
+                "success": False,
+                "error": "Give a target and action 'kick' or 'ban'",
+                "error_code": "INVALID_REQUEST",
+            }
+        try:
+            member_node = self.room_manager.moderate_member(
+                room_id, moderator, target, ban=action == BAN
+            )
+        except ModerationError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        if member_node is not None:
+            self._enforce_removal(
+                room_id, target, member_node, action, moderator
+            )
+            self._admit_waitlisted(room_id)
+        return {
+            "success": True,
+            "room_id": room_id,
+            "username": target,
+            "action": action,
+        }
+
+    def _enforce_removal(
+        self,
+        room_id: str,
+        username: str,
+        member_node: str,
+        action: str,
+        moderator: str,
+    ):
+        """Take a removed member out of the room and announce it."""
+        if member_node == self.room_manager.node_id:
+            if self._removal_callback:
+                self._removal_callback(room_id, username, action, moderator)
+        elif self.peer_registry:
+            try:
+                self.peer_registry.call_peer(
+                    member_node,
+                    "remove_room_member",
+                    room_id,
+                    username,
+                    action,
+                    moderator,
+                )
+            except Exception as e:
+                logger.warning(
+                    f"Could not tell {member_node} to remove {username} "
+                    f"from room {room_id}: {e}"
+                )
+
+        event_data = create_member_left_event(
+            room_id=room_id,
+            username=username,
+            member_count=len(self.room_manager.get_members(room_id)),
+            timestamp=datetime.now(timezone.utc).isoformat(),
+            hlc=self.room_manager.clock.now().encode(),
+        )
+        if self._broadcast_callback:
+            broadcast_msg = {"type": "member_left", "data": event_data}
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, "member_left", event_data
+        )
+
+    def set_member_role(
+        self,
+        room_id: str,
+        requester: str,
+        target: str,
+        role: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Promote or demote a member of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the room owner is connected to them. The change is announced
+        to local clients and peer nodes with a member_role_changed event.
+
+        Args:
+            room_id: The ID of the room
+            requester: Username of the room owner
+            target: The member whose role changes
+            role: "moderator" or "member"
+            auth_token: Session token of the requester, if any
+
+        Returns:
+            dict: {'success': True, 'room_id', 'username', 'role'} or an
+            error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: set_member_role called for room {room_id}: "
+            f"{requester} makes {target} {role}"
+        )
+        denied = self._check_auth(auth_token, requester)
+        if denied:
+            return denied
+        try:
+            changed = self.room_manager.set_member_role(
+                room_id, requester, target, role
+            )
+        except RoleError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        if changed:
+            event_data = create_member_role_changed_event(
+                room_id=room_id,
+                username=target,
+                role=role,
+                changed_by=requester,
+                timestamp=datetime.now(timezone.utc).isoformat(),
+            )
+            if self._broadcast_callback:
+                broadcast_msg = {
+                    "type": "member_role_changed",
+                    "data": event_data,
+                }
+                self._broadcast_callback(
+                    room_id, broadcast_msg, exclude_user=None
+                )
+            broadcast_to_peers(
+                self.peer_registry, room_id, "member_role_changed", event_data
+            )
+        return {
+            "success": True,
+            "room_id": room_id,
+            "username": target,
+            "role": role,
+        }
+
+    def set_room_retention(
+        self,
+        room_id: str,
+        requester: str,
+        limits: List[str],
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Set how long a room administered by this node keeps its messages.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the room owner is connected to them. The change is announced
+        to local clients and peer nodes with a retention_changed event.
+
+        Args:
+            room_id: The ID of the room
+            requester: Username of the room owner
+            limits: Retention limits like ["age=7d"] (empty for none)
+            auth_token: Session token of the requester, if any
+
+        Returns:
+            dict: {'success': True, 'room_id', 'retention'} or an error
+            with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: set_room_retention called for room {room_id} "
+            f"by {requester}: {limits}"
+        )
+        denied = self._check_auth(auth_token, requester)
+        if denied:
+            return denied
+        try:
+            retention = self.room_manager.set_retention(
+                room_id, requester, limits
+            )
+        except RetentionError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event_data = create_retention_changed_event(
+            room_id=room_id,
+            retention=retention,
+            changed_by=requester,
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        if self._broadcast_callback:
+            broadcast_msg = {"type": "retention_changed", "data": event_data}
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, "retention_changed", event_data
+        )
+        return {"success": True, "room_id": room_id, "retention": retention}
+
+    def set_spam_thresholds(
+        self,
+        room_id: str,
+        requester: str,
+        changes: Dict[str, int],
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Change the spam thresholds of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the room owner or a moderator is connected to them. The
+        change is announced to local clients and peer nodes with a
+        spam_thresholds_changed event.
+
+        Args:
+            room_id: The ID of the room
+            requester: Username of the room owner or a moderator
+            changes: Maps threshold -> new value (see spam.py)
+            auth_token: Session token of the requester, if any
+
+        Returns:
+            dict: {'success': True, 'room_id', 'spam_thresholds'} or an
+            error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: set_spam_thresholds called for room {room_id} "
+            f"by {requester}: {changes}"
+        )
+        denied = self._check_auth(auth_token, requester)
+        if denied:
+            return denied
+        try:
+            thresholds = self.room_manager.set_spam_thresholds(
+                room_id, requester, changes
+            )
+        except SpamError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event_data = create_spam_thresholds_changed_event(
+            room_id=room_id,
+            thresholds=self.room_manager.get_room(room_id).spam_thresholds,
+            changed_by=requester,
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        if self._broadcast_callback:
+            broadcast_msg = {
+                "type": "spam_thresholds_changed",
+                "data": event_data,
+            }
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, "spam_thresholds_changed", event_data
+        )
+        return {
+            "success": True,
+            "room_id": room_id,
+            "spam_thresholds": thresholds,
+        }
+
+    def set_content_filters(
+        self,
+        room_id: str,
+        requester: str,
+        filters: List[Dict],
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Replace the content filters of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the room owner or a moderator is connected to them. The
+        change is announced to local clients and peer nodes with a
+        content_filters_changed event.
+
+        Args:
+            room_id: The ID of the room
+            requester: Username of the room owner or a moderator
+            filters: The filters in the order they run (see
+                content_filters.py)
+            auth_token: Session token of the requester, if any
+
+        Returns:
+            dict: {'success': True, 'room_id', 'content_filters',
+            'filter_types'} or an error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: set_content_filters called for room {room_id} "
+            f"by {requester}"
+        )
+        denied = self._check_auth(auth_token, requester)
+        if denied:
+            return denied
+        try:
+            filters = self.room_manager.set_content_filters(
+                room_id, requester, filters
+            )
+        except ContentFilterError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event_data = create_content_filters_changed_event(
+            room_id=room_id,
+            filters=filters,
+            changed_by=requester,
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        if self._broadcast_callback:
+            broadcast_msg = {
+                "type": "content_filters_changed",
+                "data": event_data,
+            }
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, "content_filters_changed", event_data
+        )
+        return {
+            "success": True,
+            "room_id": room_id,
+            "content_filters": filters,
+            "filter_types": self.room_manager.content_filters.types(),
+        }
+
+    def _announce_spam(self, room_id: str, username: str, error: SpamError):
+        """Tell a hosted room's owner and moderators a member was muted."""
+        room = self.room_manager.get_room(room_id)
+        if room is None:
+            return
+        event_data = create_spam_detected_event(
+            room_id=room_id,
+            username=username,
+            reason=error.reason,
+            muted_until=datetime.fromtimestamp(
+                error.muted_until, timezone.utc
+            ).isoformat(),
+            moderators=room.moderators(),
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        if self._broadcast_callback:
+            broadcast_msg = {"type": "spam_detected", "data": event_data}
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, "spam_detected", event_data
+        )
+
+    def edit_message(
+        self,
+        room_id: str,
+        username: str,
+        message_id: str,
+        action: str,
+        content: str = "",
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Edit or delete a message of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the author or a moderator is connected to them. The change is
+        announced to local clients and peer nodes with a message_edited or
+        message_deleted event.
+
+        Args:
+            room_id: The ID of the room
+            username: The user making the change
+            message_id: ID of the message
+            action: "edit" or "delete"
+            content: The new content, for "edit"
+            auth_token: Session token of the user, if any
+
+        Returns:
+            dict: {'success': True, 'edit': dict} with the applied edit
+            record, or an error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: edit_message called for room {room_id}: {username} "
+            f"{action}s message {message_id}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            edit = self.room_manager.edit_message(
+                room_id, username, message_id, action, content
+            )
+        except EditError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event = create_message_edit_event(
+            room_id, edit, self.room_manager.clock.now().encode()
+        )
+        if self._broadcast_callback:
+            self._broadcast_callback(room_id, event, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, event["type"], event["data"]
+        )
+        return {"success": True, "edit": edit}
+
+    def pin_message(
+        self,
+        room_id: str,
+        requester: str,
+        message_id: str,
+        pin: bool = True,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Pin or unpin a message of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the owner or a moderator is connected to them. The change is
+        announced to local clients and peer nodes with a message_pinned or
+        message_unpinned event.
+
+        Args:
+            room_id: The ID of the room
+            requester: Username of the owner or moderator
+            message_id: ID of the message
+            pin: True to pin the message, False to unpin it
+            auth_token: Session token of the requester, if any
+
+        Returns:
+            dict: {'success': True, 'room_id', 'message_id', 'pinned'} or
+            an error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: pin_message called for room {room_id}: {requester} "
+            f"{'pins' if pin else 'unpins'} message {message_id}"
+        )
+        denied = self._check_auth(auth_token, requester)
+        if denied:
+            return denied
+        try:
+            pinned = self.room_manager.pin_message(
+                room_id, requester, message_id, pin
+            )
+        except PinError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event_data = create_pin_event(
+            room_id=room_id,
+            message_id=message_id,
+            pinned=pinned,
+            changed_by=requester,
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        if self._broadcast_callback:
+            broadcast_msg = {"type": PIN_EVENT_TYPES[pin], "data": event_data}
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, PIN_EVENT_TYPES[pin], event_data
+        )
+        return {
+            "success": True,
+            "room_id": room_id,
+            "message_id": message_id,
+            "pinned": pinned,
+        }
+
+    def schedule_message(
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        send_at: str,
+        message_id: str = "",
+        reply_to: str = "",
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Schedule a message in a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends send_message with send_at.
+        The room's followers are sent its new schedule.
+
+        Args:
+            room_id: The ID of the room
+            username: The member sending it
+            content: The message text
+            send_at: ISO 8601 time to send it at
+            message_id: ID generated by the sender ("" for a new one)
+            reply_to: ID of the message it replies to ("" for none)
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'scheduled': dict} or an error with
+            'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: schedule_message called for room {room_id} by "
+            f"{username} for {send_at}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            scheduled = self.room_manager.schedule_message(
+                room_id,
+                username,
+                content,
+                send_at,
+                message_id or None,
+                reply_to or None,
+            )
+        except ScheduleError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        if self.replication:
+            self.replication.replicate_room_info(room_id)
+        return {"success": True, "scheduled": scheduled}
+
+    def list_scheduled(
+        self, room_id: str, username: str, auth_token: str = ""
+    ) -> Dict:
+        """
+        List the messages scheduled in a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends list_scheduled.
+
+        Args:
+            room_id: The ID of the room
+            username: The member asking
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'scheduled': list} with the member's
+            messages (everyone's for the owner and moderators), or an
+            error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: list_scheduled called for room {room_id} by {username}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            scheduled = self.room_manager.list_scheduled(room_id, username)
+        except ScheduleError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "scheduled": scheduled}
+
+    def cancel_scheduled(
+        self,
+        room_id: str,
+        username: str,
+        message_id: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Cancel a message scheduled in a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends cancel_scheduled. The room's
+        followers are sent its new schedule.
+
+        Args:
+            room_id: The ID of the room
+            username: The member cancelling it
+            message_id: The scheduled message's ID
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'message_id': str} or an error with
+            'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: cancel_scheduled called for room {room_id} by "
+            f"{username}: {message_id}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            self.room_manager.cancel_scheduled(room_id, username, message_id)
+        except ScheduleError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        if self.replication:
+            self.replication.replicate_room_info(room_id)
+        return {"success": True, "message_id": message_id}
+
+    def update_room_metadata(
+        self,
+        room_id: str,
+        requester: str,
+        changes: Dict,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Change the name, topic or description of a room administered here.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the owner or a moderator is connected to them. A rename is
+        committed to the Raft room registry first, if there is one. The
+        change is announced to local clients and peer nodes with a
+        room_updated event.
+
+        Args:
+            room_id: The ID of the room
+            requester: Username of the owner or moderator
+            changes: Maps room_name, topic or description -> new value
+            auth_token: Session token of the requester, if any
+
+        Returns:
+            dict: {'success': True, 'room_id', 'changes', 'versions'} or
+            an error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: update_room_metadata called for room {room_id} "
+            f"by {requester}: {changes}"
+        )
+        denied = self._check_auth(auth_token, requester)
+        if denied:
+            return denied
+        try:
+            checked = self.room_manager.check_room_update(
+                room_id, requester, changes
+            )
+            if self.room_registry:
+                registered = self.room_registry.update_room(room_id, checked)
+                if not registered.get("success"):
+                    return registered
+            update = self.room_manager.update_room(room_id, requester, checked)
+        except RoomUpdateError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event_data = create_room_updated_event(
+            room_id=room_id,
+            changes=update["changes"],
+            versions=update["versions"],
+            updated_by=requester,
+            timestamp=datetime.now(timezone.utc).isoformat(),
+        )
+        if self._broadcast_callback:
+            broadcast_msg = {"type": "room_updated", "data": event_data}
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, "room_updated", event_data
+        )
+        return dict(update, success=True, room_id=room_id)
+
+    def react(
+        self,
+        room_id: str,
+        username: str,
+        message_id: str,
+        emoji: str,
+        remove: bool = False,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Add or remove a reaction to a message of a room administered here.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when the reacting member is connected to them. Changes are
+        announced to local clients and peer nodes with a message_reaction
+        event; repeating a reaction changes nothing.
+
+        Args:
+            room_id: The ID of the room
+            username: The reacting member
+            message_id: ID of the message
+            emoji: The emoji
+            remove: True to take the reaction back
+            auth_token: Session token of the member, if any
+
+        Returns:
+            dict: {'success': True, 'changed': bool, 'reactions': dict}
+            with the message's reactions afterwards, or an error with
+            'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: react called for room {room_id}: {username} "
+            f"{'removes' if remove else 'adds'} {emoji} on {message_id}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            reaction, reactions = self.room_manager.react(
+                room_id, username, message_id, emoji, remove
+            )
+        except ReactionError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        if reaction:
+            event = create_message_reaction_event(
+                room_id,
+                reaction,
+                reactions,
+                self.room_manager.clock.now().encode(),
+            )
+            if self._broadcast_callback:
+                self._broadcast_callback(room_id, event, exclude_user=None)
+            broadcast_to_peers(
+                self.peer_registry, room_id, event["type"], event["data"]
+            )
+        return {
+            "success": True,
+            "changed": reaction is not None,
+            "reactions": reactions,
+        }
+
+    def remove_room_member(
+        self, room_id: str, username: str, action: str, moderator: str
+    ) -> Dict:
+        """
+        Take a kicked or banned user's clients out of a room.
+
+        This method is exposed via XML-RPC and is called by the
+        administrator node of a room after it removed a member connected
+        to this node.
+
+        Args:
+            room_id: The ID of the room
+            username: The removed user
+            action: "kick" or "ban"
+            moderator: Username of the owner or moderator who removed them
+
+        Returns:
+            dict: {'success': True, 'removed': int} with the number of
+            connections taken out of the room
+        """
+        logger.info(
+            f"XML-RPC: remove_room_member called for room {room_id}, "
+            f"user {username} ({action})"
+        )
+        removed = 0
+        if self._removal_callback:
+            removed = self._removal_callback(
+                room_id, username, action, moderator
+            )
+        return {"success": True, "removed": removed}
+
+    def forward_message(
+        self,
+        room_id: str,
+        username: str,
+        content: str,
+        sender_node_id: str,
+        auth_token: str = "",
+        message_id: str = "",
+        reply_to: str = "",
+        encryption: Optional[Dict] = None,
+        attachments: Optional[List[Dict]] = None,
+    ) -> Dict:
+        """
+        Forward a message to the room administrator for ordering and broadcast.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them wants to send a message to a room
+        hosted here. A retry with the ID of a message that was already
+        added returns that message again without broadcasting it twice.
+        A reply is followed by a thread_updated event for its thread.
+        Attachment blobs missing here are pulled from the sender's node
+        first, and replicated to the room's followers once the message is
+        added. A durable room's message is acknowledged once a write quorum
+        of the room's copies holds it (see durability.py).
+
+        Args:
+            room_id: The ID of the room
+            username: The username of the sender
+            content: The message content
+            sender_node_id: The node the sender is connected to
+            auth_token: Session token of the sender, if any
+            message_id: ID generated by the sender, if any
+            reply_to: ID of the message replied to, if any
+            encryption: Encryption envelope of an encrypted message, whose
+                content is then its ciphertext
+            attachments: References to the files attached to the message,
+                whose content may then be empty
+
+        Returns:
+            dict: Result with structure:
+            {
+                'success': bool,
+                'message_id': str,
+                'sequence_number': int,
+                'timestamp': str,
+                'vector_clock': dict,
+                'error': str or None
+            }
+        """
+        logger.info(
+            f"XML-RPC: forward_message called for room {room_id} "
+            f"from {username} via {sender_node_id}"
+        )
+
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return {
+                "success": False,
+                "error": denied["error"],
+                "error_code": denied["error_code"],
+            }
+
+        # Validate message content (ciphertext is checked when added)
+        is_valid, error_msg = (
+            (True, None)
+            if encryption is not None or (attachments and content == "")
+            else validate_message_content(content)
+        )
+        if not is_valid:
+            return {
+                "success": False,
+                "error": error_msg,
+                "error_code": "INVALID_CONTENT",
+            }
+
+        # Get the room
+        room = self.room_manager.get_room(room_id)
+        if not room:
+            logger.warning(f"XML-RPC: Room {room_id} not found")
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+
+        # Check if user is a member
+        if username not in room.members:
+            logger.warning(
+                f"XML-RPC: User {username} not a member of room {room_id}"
+            )
+            return {
+                "success": False,
+                "error": "You are not a member of this room",
+                "error_code": "NOT_MEMBER",
+            }
+
+        for field_id in (message_id, reply_to):
+            if not field_id:
+                continue
+            is_valid, error_msg = validate_message_id(field_id)
+            if not is_valid:
+                return {
+                    "success": False,
+                    "error": error_msg,
+                    "error_code": "INVALID_REQUEST",
+                }
+
+        # Add message to room (assigns sequence number and vector clock)
+        try:
+            if attachments:
+                self._require_attachments(attachments, sender_node_id)
+            message = self.room_manager.add_message(
+                room_id,
+                username,
+                content,
+                origin_node=sender_node_id,
+                message_id=message_id or None,
+                reply_to=reply_to or None,
+                encryption=encryption,
+                attachments=attachments,
+            )
+        except DuplicateMessageError as e:
+            return self._await_durable(
+                room, self._duplicate_message_result(e.message, username)
+            )
+        except SpamError as e:
+            if e.error_code == SPAM_DETECTED:
+                self._announce_spam(room_id, username, e)
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        except (
+            ThreadError,
+            E2EEError,
+            AttachmentError,
+            AnnouncementError,
+            ContentFilterError,
+        ) as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        if not message:
+            return {
+                "success": False,
+                "error": "Failed to add message",
+                "error_code": "INTERNAL_ERROR",
+            }
+
+        # Broadcast to local clients via callback
+        if self._broadcast_callback:
+            broadcast_msg = {"type": "new_message", "data": message}
+            self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
+
+        # Broadcast to peer nodes via XML-RPC, once per peer for rooms that
+        # are at most once
+        if not delivery_policy(message.get("delivery")).retry:
+            broadcast_message_to_peers(
+                self.peer_registry, room_id, message, retries=0
+            )
+        elif self.streams:
+            self.streams.send(room_id, message)
+        else:
+            broadcast_message_to_peers(self.peer_registry, room_id, message)
+
+        # Stream to the room's follower replicas
+        if self.replication:
+            self.replication.replicate(room_id, message)
+            if message.get("attachments") and self.attachments:
+                self.attachments.replicate(
+                    room_id,
+                    message["attachments"],
+                    self.replication.choose_followers(room_id),
+                )
+
+        if message.get("thread_id"):
+            self._announce_thread(room_id, message)
+
+        logger.info(
+            f"XML-RPC: Message #{message['sequence_number']} "
+            f"from {username} processed"
+        )
+
+        return self._await_durable(
+            room,
+            {
+                "success": True,
+                "message_id": message["message_id"],
+                "sequence_number": message["sequence_number"],
+                "timestamp": message["timestamp"],
+                "vector_clock": message["vector_clock"],
+            },
+        )
+
+    def mark_read(
+        self,
+        room_id: str,
+        username: str,
+        sequence_number: int,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Move a member's read position in a room administered here.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends mark_read. A change is
+        announced with a read_position_updated event to local clients and
+        peer nodes.
+
+        Args:
+            room_id: The ID of the room
+            username: The member who read the messages
+            sequence_number: Sequence number of the last message read
+            auth_token: Session token of the member, if any
+
+        Returns:
+            dict: {'success': True, ...} with the member's read state (see
+            RoomStateManager.get_read_state), or an error with 'error' and
+            'error_code'
+        """
+        logger.debug(
+            f"XML-RPC: mark_read called for room {room_id} by {username} "
+            f"up to #{sequence_number}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            changed = self.room_manager.mark_read(
+                room_id, username, sequence_number
+            )
+            state = self.room_manager.get_read_state(room_id, username)
+        except ReadReceiptError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        if changed:
+            event = create_read_position_updated_event(
+                room_id,
+                username,
+                state["last_read"],
+                self.room_manager.clock.now().encode(),
+            )
+            if self._broadcast_callback:
+                self._broadcast_callback(room_id, event, exclude_user=None)
+            broadcast_to_peers(
+                self.peer_registry, room_id, event["type"], event["data"]
+            )
+        return dict(state, success=True)
+
+    def get_read_state(
+        self, room_id: str, username: str, auth_token: str = ""
+    ) -> Dict:
+        """
+        Get a member's read state in a room administered here.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends get_read_state.
+
+        Args:
+            room_id: The ID of the room
+            username: The member asking
+            auth_token: Session token of the member, if any
+
+        Returns:
+            dict: {'success': True, 'last_read', 'unread_count',
+            'message_counter', 'read_positions'} or an error with 'error'
+            and 'error_code'
+        """
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            state = self.room_manager.get_read_state(room_id, username)
+        except ReadReceiptError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return dict(state, success=True)
+
+    def publish_key(
+        self,
+        room_id: str,
+        username: str,
+        key_id: str,
+        algorithm: str,
+        public_key: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Publish a member's public key to a private room administered here.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends publish_key. The key is
+        announced with a key_published event to local clients and peer
+        nodes.
+
+        Args:
+            room_id: The ID of the room
+            username: The member publishing the key
+            key_id: ID the client chose for the key
+            algorithm: Key algorithm
+            public_key: The public key, base64-encoded
+            auth_token: Session token of the member, if any
+
+        Returns:
+            dict: {'success': True, 'key': dict} or an error with 'error'
+            and 'error_code'
+        """
+        logger.debug(
+            f"XML-RPC: publish_key called for room {room_id} by {username}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            key = self.room_manager.publish_key(
+                room_id, username, key_id, algorithm, public_key
+            )
+        except E2EEError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+
+        event = create_key_published_event(
+            room_id, key, self.room_manager.clock.now().encode()
+        )
+        if self._broadcast_callback:
+            self._broadcast_callback(room_id, event, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, event["type"], event["data"]
+        )
+        return {"success": True, "key": key}
+
+    def get_room_keys(
+        self, room_id: str, username: str, auth_token: str = ""
+    ) -> Dict:
+        """
+        Get the public keys of a private room administered here.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends get_room_keys.
+
+        Args:
+            room_id: The ID of the room
+            username: The member asking
+            auth_token: Session token of the member, if any
+
+        Returns:
+            dict: {'success': True, 'keys': {username: key}} or an error
+            with 'error' and 'error_code'
+        """
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            keys = self.room_manager.get_public_keys(room_id, username)
+        except E2EEError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "keys": keys}
+
+    def _require_attachments(
+        self, attachments: List[Dict], sender_node_id: str
+    ) -> None:
+        """
+        Make sure this node holds the blobs of a message's attachments.
+
+        Args:
+            attachments: The message's attachment references
+            sender_node_id: Node the sender uploaded the files to
+
+        Raises:
+            AttachmentError: If attachments aren't supported here or a
+                reference is invalid (INVALID_ATTACHMENT), or a blob
+                can't be fetched (ATTACHMENT_NOT_FOUND)
+        """
+        if self.attachments is None:
+            raise AttachmentError(
+                "Attachments are not supported by this node",
+                "INVALID_ATTACHMENT",
+            )
+        self.attachments.require(attachments, [sender_node_id])
+
+    def get_blob(
+        self, sha256: str, offset: int = 0, length: int = BLOB_CHUNK_SIZE
+    ) -> Dict:
+        """
+        Read part of an attachment blob stored on this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        pulling a blob they don't have (see attachments.py).
+
+        Args:
+            sha256: The blob's hash
+            offset: First byte to read
+            length: Most bytes to read (capped at BLOB_CHUNK_SIZE)
+
+        Returns:
+            dict: {'success': True, 'data': Binary, 'size': int} with the
+            blob's total size, or an error with 'error' and 'error_code'
+        """
+        chunk = None
+        if self.attachments is not None:
+            chunk = self.attachments.read_chunk(
+                sha256, offset, max(0, min(length, BLOB_CHUNK_SIZE))
+            )
+        if chunk is None:
+            return {
+                "success": False,
+                "error": "Blob not found",
+                "error_code": "BLOB_NOT_FOUND",
+            }
+        return {
+            "success": True,
+            "data": Binary(chunk),
+            "size": self.attachments.blob_store.size(sha256),
+        }
+
+    def replicate_blob(
+        self, room_id: str, sha256: str, size: int, source_node: str
+    ) -> Dict:
+        """
+        Pull an attachment blob of a room this node follows.
+
+        This method is exposed via XML-RPC and is called by a room's
+        administrator after a message with attachments is added. Returns
+        immediately; the blob is pulled from source_node in the
+        background.
+
+        Args:
+            room_id: The room the blob is attached in
+            sha256: The blob's hash
+            size: The blob's size in bytes
+            source_node: Node ID to pull the blob from
+
+        Returns:
+            dict: {'success': bool}
+        """
+        if self.attachments is None:
+            return {"success": False}
+        logger.debug(
+            f"XML-RPC: Replicating blob {sha256} of room {room_id} from "
+            f"{source_node}"
+        )
+        Thread(
+            target=self.attachments.fetch,
+            args=(sha256, [source_node], size),
+            daemon=True,
+        ).start()
+        return {"success": True}
+
+    def _announce_thread(self, room_id: str, reply: Dict) -> None:
+        """
+        Announce the summary of a reply's thread to local clients and peers.
+
+        Args:
+            room_id: The room ID
+            reply: The reply just added
+        """
+        thread = self.room_manager.get_thread(room_id, reply["thread_id"])
+        if thread is None:
+            return
+        event = create_thread_updated_event(
+            room_id, reply["thread_id"], thread, reply.get("hlc")
+        )
+        if self._broadcast_callback:
+            self._broadcast_callback(room_id, event, exclude_user=None)
+        broadcast_to_peers(
+            self.peer_registry, room_id, event["type"], event["data"]
+        )
+
+    def get_room_history(
+        self,
+        room_id: str,
+        username: str,
+        before: str = "",
+        after: str = "",
+        limit: int = HISTORY_PAGE_SIZE,
+        auth_token: str = "",
+        thread_id: str = "",
+    ) -> Dict:
+        """
+        Get a page of the history of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends get_history. Reading a
+        durable room repairs its followers' replicas.
+
+        Args:
+            room_id: The room ID
+            username: Username of the client asking
+            before: Page ends just before this message ID ("" for none)
+            after: Page starts just after this message ID ("" for none)
+            limit: Maximum number of messages in the page
+            auth_token: Session token of the client, if any
+            thread_id: Page only this message's thread subtree ("" for
+                the whole room)
+
+        Returns:
+            dict: {'success': True, 'messages': list, 'has_more': bool} or
+            an error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: get_room_history called for room {room_id} "
+            f"by {username}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        room = self.room_manager.get_room(room_id)
+        if room and room.durable and self.replication:
+            self.replication.repair_on_read(room_id)
+        return self.room_manager.get_history(
+            room_id,
+            username,
+            before or None,
+            after or None,
+            limit,
+            thread_id or None,
+        )
+
+    def get_replica_history(
+        self,
+        room_id: str,
+        username: str,
+        before: str = "",
+        after: str = "",
+        limit: int = HISTORY_PAGE_SIZE,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Get a page of the history of a room this node follows.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        whose latency router found this follower nearer than the room's
+        admin (see routing.py).
+
+        Args:
+            room_id: The room ID
+            username: Username of the client asking
+            before: Page ends just before this message ID ("" for none)
+            after: Page starts just after this message ID ("" for none)
+            limit: Maximum number of messages in the page
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'messages': list, 'has_more': bool} or
+            an error with 'error' and 'error_code' (REPLICA_UNAVAILABLE or
+            REPLICA_INCOMPLETE when the admin has to answer instead)
+        """
+        logger.info(
+            f"XML-RPC: get_replica_history called for room {room_id} "
+            f"by {username}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        if not self.failover:
+            return {
+                "success": False,
+                "error": "No up-to-date replica of this room",
+                "error_code": "REPLICA_UNAVAILABLE",
+            }
+        return self.failover.replica_store.history_page(
+            room_id, username, before or None, after or None, limit
+        )
+
+    def search_room(
+        self,
+        room_id: str,
+        username: str,
+        query: str,
+        author: str = "",
+        since: str = "",
+        until: str = "",
+        limit: int = SEARCH_LIMIT,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Search the history of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends search.
+
+        Args:
+            room_id: The room ID
+            username: Username of the client searching
+            query: Words that must all appear in a message
+            author: Only messages by this user ("" for any)
+            since: Only messages sent at or after this ISO 8601 time ("" for
+                no lower bound)
+            until: Only messages sent at or before this ISO 8601 time (""
+                for no upper bound)
+            limit: Most messages returned
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'messages': list, 'total': int} or an
+            error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: search_room called for room {room_id} by {username}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        return self.room_manager.search_messages(
+            room_id,
+            username,
+            query,
+            author or None,
+            since or None,
+            until or None,
+            limit,
+        )
+
+    def register_webhook(
+        self,
+        room_id: str,
+        username: str,
+        url: str,
+        events: List[str],
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Register a webhook for a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends register_webhook.
+
+        Args:
+            room_id: The room ID
+            username: The room owner registering it
+            url: http:// or https:// URL the events are POSTed to
+            events: Events to deliver (empty for all)
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'webhook': dict} with the webhook's
+            secret, or an error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: register_webhook called for room {room_id} by "
+            f"{username}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            webhook = self.room_manager.register_webhook(
+                room_id, username, url, events
+            )
+        except WebhookError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "webhook": webhook}
+
+    def remove_webhook(
+        self,
+        room_id: str,
+        username: str,
+        webhook_id: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Remove a webhook of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends remove_webhook.
+
+        Args:
+            room_id: The room ID
+            username: The room owner removing it
+            webhook_id: The webhook's ID
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'webhook_id': str} or an error with
+            'error' and 'error_code'
+        """
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            self.room_manager.remove_webhook(room_id, username, webhook_id)
+        except WebhookError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "webhook_id": webhook_id}
+
+    def list_webhooks(
+        self, room_id: str, username: str, auth_token: str = ""
+    ) -> Dict:
+        """
+        List the webhooks of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends list_webhooks.
+
+        Args:
+            room_id: The room ID
+            username: The room owner asking
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'webhooks': list} without secrets, or
+            an error with 'error' and 'error_code'
+        """
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            webhooks = self.room_manager.list_webhooks(room_id, username)
+        except WebhookError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "webhooks": webhooks}
+
+    def add_bridge(
+        self,
+        room_id: str,
+        username: str,
+        protocol: str,
+        settings: Dict,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Bridge a room administered by this node to IRC or Matrix.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends add_bridge.
+
+        Args:
+            room_id: The room ID
+            username: The room owner adding it
+            protocol: "irc" or "matrix"
+            settings: The network's settings
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'bridge': dict} without secrets, or an
+            error with 'error' and 'error_code'
+        """
+        logger.info(
+            f"XML-RPC: add_bridge called for room {room_id} by {username}"
+        )
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            bridge = self.room_manager.add_bridge(
+                room_id, username, protocol, settings
+            )
+        except BridgeError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "bridge": bridge}
+
+    def remove_bridge(
+        self,
+        room_id: str,
+        username: str,
+        bridge_id: str,
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Remove a bridge of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends remove_bridge.
+
+        Args:
+            room_id: The room ID
+            username: The room owner removing it
+            bridge_id: The bridge's ID
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'bridge_id': str} or an error with
+            'error' and 'error_code'
+        """
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            self.room_manager.remove_bridge(room_id, username, bridge_id)
+        except BridgeError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "bridge_id": bridge_id}
+
+    def list_bridges(
+        self, room_id: str, username: str, auth_token: str = ""
+    ) -> Dict:
+        """
+        List the bridges of a room administered by this node.
+
+        This method is exposed via XML-RPC and can be called by peer nodes
+        when a client connected to them sends list_bridges.
+
+        Args:
+            room_id: The room ID
+            username: The room owner asking
+            auth_token: Session token of the client, if any
+
+        Returns:
+            dict: {'success': True, 'bridges': list} without secrets, or an
+            error with 'error' and 'error_code'
+        """
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return denied
+        try:
+            bridges = self.room_manager.list_bridges(room_id, username)
+        except BridgeError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "bridges": bridges}
+
+    def set_room_bot(
+        self,
+        room_id: str,
+        bot_name: str,
+        commands: List[str],
+        auth_token: str = "",
+    ) -> Dict:
+        """
+        Register the commands of a bot in a room administered here.
+
+        This method is exposed via XML-RPC and is called by the node a bot
+        is connected to after the bot joins the room.
+
+        Args:
+            room_id: The room ID
+            bot_name: The bot
+            commands: Commands routed to the bot
+            auth_token: Session token of the bot, if any
+
+        Returns:
+            dict: {'success': True, 'commands': list} or an error with
+            'error' and 'error_code'
+        """
+        denied = self._check_auth(auth_token, bot_name)
+        if denied:
+            return denied
+        try:
+            self.room_manager.set_room_bot(room_id, bot_name, commands)
+        except BotError as e:
+            return {
+                "success": False,
+                "error": str(e),
+                "error_code": e.error_code,
+            }
+        return {"success": True, "commands": list(commands)}
+
+    def _await_durable(self, room, result: Dict) -> Dict:
+        """
+        Hold a durable room's message until a write quorum holds it.
+
+        Args:
+            room: The room the message was added to
+            result: The forward_message result
+
+        Returns:
+            dict: The result with the copies holding the message, or a
+            QUORUM_NOT_REACHED error (see durability.py)
+        """
+        if not room.durable or not result.get("success"):
+            return result
+        return await_quorum(self.replication, room.room_id, result)
+
+    @staticmethod
+    def _duplicate_message_result(message: Dict, username: str) -> Dict:
+        """
+        Build the forward_message result for a message ID already in use.
+
+        Args:
+            message: The message already added with that ID
+            username: The sender retrying the message
+
+        Returns:
+            dict: The original message's result, or DUPLICATE_MESSAGE_ID
+            if another user sent it
+        """
+        if message["username"] != username:
+            return {
+                "success": False,
+                "error": "Message ID is already in use",
+                "error_code": "DUPLICATE_MESSAGE_ID",
+            }
+        logger.info(
+            f"XML-RPC: Message {message['message_id']} already added, "
+            f"acknowledging retry"
+        )
+        return {
+            "success": True,
+            "message_id": message["message_id"],
+            "sequence_number": message["sequence_number"],
+            "timestamp": message["timestamp"],
+            "vector_clock": message["vector_clock"],
+        }
+
+    def deliver_direct_message(
+        self, message: Dict, auth_token: str = ""
+    ) -> Dict:
+        """
+        Deliver a direct message to a user connected to this node.
+
+        This method is exposed via XML-RPC and is called by the sender's
+        node once it has found the recipient here in the presence
+        directory.
+
+        Args:
+            message: DirectMessage dict (message_id, sender, recipient,
+                content, timestamp, sender_node)
+            auth_token: Session token of the sender, if any
+
+        Returns:
+            dict: {'success': True, 'delivered': int} or an error with
+            'error_code' RECIPIENT_OFFLINE if the recipient has no
+            connection here
+        """
+        sender = message.get("sender", "")
+        recipient = message.get("recipient", "")
+        logger.info(
+            f"XML-RPC: deliver_direct_message called from {sender} "
+            f"to {recipient}"
+        )
+
+        denied = self._check_auth(auth_token, sender)
+        if denied:
+            return {
+                "success": False,
+                "error": denied["error"],
+                "error_code": denied["error_code"],
+            }
+
+        is_valid, error_msg = validate_message_content(
+            message.get("content", "")
+        )
+        if not is_valid or not recipient or not message.get("message_id"):
+            return {
+                "success": False,
+                "error": error_msg or "Direct message is incomplete",
+                "error_code": "INVALID_MESSAGE",
+            }
+
+        delivered = 0
+        if self._direct_message_callback:
+            delivered = self._direct_message_callback(recipient, message)
+        if not delivered:
+            return {
+                "success": False,
+                "error": f"User {recipient} is not connected to this node",
+                "error_code": "RECIPIENT_OFFLINE",
+            }
+        return {"success": True, "delivered": delivered}
+
+    def deliver_receipt(self, receipt: Dict) -> Dict:
+        """
+        Tell a sender connected to this node that a message was received.
+
+        This method is exposed via XML-RPC and is called by the node of a
+        recipient whose client confirmed receipt of a message sent from
+        here.
+
+        Args:
+            receipt: DeliveryReceipt dict (room_id, message_id, sender,
+                recipient, timestamp)
+
+        Returns:
+            dict: {'success': True, 'delivered': int} or an error with
+            'error_code' SENDER_OFFLINE if the sender has no connection
+            here
+        """
+        sender = receipt.get("sender", "")
+        logger.debug(
+            f"XML-RPC: deliver_receipt called for message "
+            f"{receipt.get('message_id')} to {sender}"
+        )
+        if not sender or not receipt.get("message_id"):
+            return {
+                "success": False,
+                "error": "Receipt is incomplete",
+                "error_code": "INVALID_RECEIPT",
+            }
+
+        delivered = 0
+        if self._receipt_callback:
+            delivered = self._receipt_callback(receipt)
+        if not delivered:
+            return {
+                "success": False,
+                "error": f"User {sender} is not connected to this node",
+                "error_code": "SENDER_OFFLINE",
+            }
+        return {"success": True, "delivered": delivered}
+
+    def _check_auth(self, auth_token: str, username: str) -> Optional[Dict]:
+        """
+        Verify the session token forwarded with a client operation.
+
+        Returns:
+            None if the operation may proceed, otherwise the auth error
+        """
+        if not self.auth:
+            return None
+        result = self.auth.authorize(auth_token or None, username)
+        if result["success"]:
+            return None
+        logger.warning(
+            f"XML-RPC: Rejected operation for {username}: {result['error']}"
+        )
+        return result
+
+    def receive_message_broadcast(
+        self, room_id: str, message_data: Dict
+    ) -> bool:
+        """
+        Receive a message broadcast from the administrator node.
+
+        This method is exposed via XML-RPC and is called by the administrator
+        node when it broadcasts a message to all member nodes.
 
         Args:
             room_id: The ID of the room
@@ -366,23 +3314,177 @@ class XMLRPCServer:
                 - content: str
                 - sequence_number: int
                 - timestamp: str (ISO format)
+                - vector_clock: Dict[str, int]
+                - origin_node: str
+                - hlc: str (hybrid logical clock timestamp)
+
+        Messages are released to local clients in causal order; a message
+        that arrives before its dependencies is held back until they do.
+        A message whose ID was already received is acknowledged but not
+        delivered again, so the call is safe to retry.
+        Messages of total-order rooms are released strictly by sequence
+        number instead.
+
+        Returns:
+            bool: True if accepted for delivery to local clients
+        """
+        logger.info(
+            f"XML-RPC: receive_message_broadcast called for room {room_id}, "
+            f"msg #{message_data.get('sequence_number')}"
+        )
+        self.room_manager.clock.update(message_data.get("hlc"))
+
+        # A retransmission of a message that was already delivered (members
+        # of at-least-once rooms keep no window and deliver it again)
+        message_id = message_data.get("message_id")
+        policy = delivery_policy(message_data.get("delivery"))
+        if (
+            message_id
+            and policy.deduplicate
+            and self.delivered_messages.add(room_id, message_data)
+        ):
+            logger.info(
+                f"XML-RPC: Ignoring retransmitted message {message_id}"
+            )
+            return True
+
+        if self.failover:
+            self.failover.replica_store.record_message(room_id, message_data)
+
+        # Broadcast to local clients via callback
+        if self._broadcast_callback:
+            if message_data.get("total_order"):
+                buffer = self.sequence_buffer
+            else:
+                buffer = self.causal_buffer
+            for message in buffer.receive(room_id, message_data):
+                self._deliver_message(room_id, message)
+            return True
+
+        logger.warning("No broadcast callback set for message delivery")
+        return False
+
+    def receive_message_stream(
+        self, sender_node: str, stream_id: str, batch: List
+    ) -> Dict:
+        """
+        Receive a batch of a peer's message stream (see message_streams.py).
+
+        Each message is taken as by receive_message_broadcast, except ones
+        the stream already delivered, which a sender retrying after a
+        failed call sends again.
+
+        Args:
+            sender_node: ID of the sending node
+            stream_id: ID of the sender's stream
+            batch: [sequence number, room_id, message data] items, in
+                stream order (empty to ask for credit)
+
+        Returns:
+            dict: success, acked (the last sequence number taken) and
+                credit (the messages the sender may send next)
+        """
+        acked = self.stream_receiver.receive(
+            sender_node, stream_id, batch, self.receive_message_broadcast
+        )
+        backlog = self._backlog_callback() if self._backlog_callback else 0
+        return {
+            "success": True,
+            "acked": acked,
+            "credit": self.stream_receiver.credit(backlog),
+        }
+
+    def deliver_overdue_messages(self) -> int:
+        """
+        Deliver held messages whose dependencies never arrived.
+
+        Returns:
+            int: Number of messages delivered
+        """
+        delivered = 0
+        for room_id, messages in self.causal_buffer.flush_overdue().items():
+            for message in messages:
+                self._deliver_message(room_id, message)
+                delivered += 1
+        return delivered
+
+    def retransmit_messages(
+        self, room_id: str, first_sequence: int, last_sequence: int
+    ) -> Dict:
+        """
+        Send again messages of a total-order room a node is missing.
+
+        This method is exposed via XML-RPC and is called by nodes holding
+        back later messages until the gap is filled, and by nodes
+        repairing their clients' streams (see stream_repair.py).
+
+        Args:
+            room_id: The ID of a room administered by this node
+            first_sequence: First missing sequence number
+            last_sequence: Last missing sequence number
+
+        Returns:
+            dict: {'success': True, 'messages': list} with the messages
+            still in the room's history, or an error
+        """
+        logger.info(
+            f"XML-RPC: retransmit_messages called for room {room_id}, "
+            f"#{first_sequence}-#{last_sequence}"
+        )
+        if not self.room_manager.get_room(room_id):
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        messages = self.room_manager.get_sequence_range(
+            room_id, first_sequence, last_sequence
+        )
+        return {"success": True, "messages": messages}
+
+    def repair_sequence_gaps(self) -> int:
+        """
+        Fill gaps in total-order rooms by asking their sequencers.
+
+        Gaps that stayed open through every retransmission attempt are
+        skipped so the held messages reach clients.
 
         Returns:
-            bool: True if successfully delivered to local clients
+            int: Number of messages delivered
         """
-        logger.info(
-            f"XML-RPC: receive_message_broadcast called for room {room_id}, "
-            f"msg #{message_data.get('sequence_number')}"
-        )
+        delivered = 0
+        for gap in self.sequence_buffer.gaps():
+            try:
+                result = self.peer_registry.call_peer(
+                    gap.sequencer,
+                    "retransmit_messages",
+                    gap.room_id,
+                    gap.first_sequence,
+                    gap.last_sequence,
+                )
+            except Exception as e:
+                logger.warning(
+                    f"Retransmission from {gap.sequencer} for room "
+                    f"{gap.room_id} failed: {e}"
+                )
+                continue
+            for missing in result.get("messages", []):
+                released = self.sequence_buffer.receive(gap.room_id, missing)
+                for message in released:
+                    self._deliver_message(gap.room_id, message)
+                    delivered += 1
 
-        # Broadcast to local clients via callback
+        for room_id, messages in self.sequence_buffer.skip_stale_gaps().items():
+            for message in messages:
+                self._deliver_message(room_id, message)
+                delivered += 1
+        return delivered
+
+    def _deliver_message(self, room_id: str, message: Dict):
+        """Send a new_message to local clients in a room."""
         if self._broadcast_callback:
-            broadcast_msg = {"type": "new_message", "data": message_data}
+            broadcast_msg = {"type": "new_message", "data": message}
             self._broadcast_callback(room_id, broadcast_msg, exclude_user=None)
-            return True
-
-        logger.warning("No broadcast callback set for message delivery")
-        return False
 
     def receive_member_event_broadcast(
         self, room_id: str, event_type: str, event_data: Dict
@@ -395,8 +3497,16 @@ class XMLRPCServer:
 
         Args:
             room_id: The ID of the room
-            event_type: Type of event ("member_joined" or "member_left")
-            event_data: Event data containing username, member_count, timestamp
+            event_type: Type of event ("member_joined", "member_left",
+                "member_role_changed", "retention_changed",
+                "spam_thresholds_changed", "spam_detected",
+                "content_filters_changed", "message_edited",
+                "message_deleted", "message_pinned", "message_unpinned",
+                "room_updated", "message_reaction", "thread_updated",
+                "read_position_updated", "key_published", "room_archived"
+                or "typing")
+            event_data: Event data containing username, timestamp and
+                member_count, role or the edit
 
         Returns:
             bool: True if successfully delivered to local clients
@@ -405,6 +3515,60 @@ class XMLRPCServer:
             f"XML-RPC: receive_member_event_broadcast called for room {room_id}, "
             f"event {event_type}, user {event_data.get('username')}"
         )
+        self.room_manager.clock.update(event_data.get("hlc"))
+
+        if event_type == "room_updated":
+            event_data = self._apply_room_updated(room_id, event_data)
+            if event_data is None:
+                # Every change was older than the room's metadata
+                return True
+        elif self.failover and event_type == "member_role_changed":
+            self.failover.replica_store.record_role_change(
+                room_id, event_data.get("username", ""), event_data["role"]
+            )
+        elif self.failover and event_type == "retention_changed":
+            self.failover.replica_store.record_retention(
+                room_id, event_data["retention"]
+            )
+        elif self.failover and event_type == "spam_thresholds_changed":
+            self.failover.replica_store.record_spam_thresholds(
+                room_id, event_data["spam_thresholds"]
+            )
+        elif self.failover and event_type == "content_filters_changed":
+            self.failover.replica_store.record_content_filters(
+                room_id, event_data["content_filters"]
+            )
+        elif self.failover and event_type in EDIT_EVENT_TYPES.values():
+            self.failover.replica_store.record_edit(room_id, event_data)
+        elif self.failover and event_type in PIN_EVENT_TYPES.values():
+            self.failover.replica_store.record_pins(
+                room_id, event_data["pinned"]
+            )
+        elif self.failover and event_type == "message_reaction":
+            self.failover.replica_store.record_reactions(
+                room_id, event_data["message_id"], event_data["reactions"]
+            )
+        elif self.failover and event_type == "read_position_updated":
+            self.failover.replica_store.record_read(
+                room_id,
+                event_data.get("username", ""),
+                event_data["sequence_number"],
+            )
+        elif self.failover and event_type == "key_published":
+            self.failover.replica_store.record_public_key(room_id, event_data)
+        elif self.failover and event_type == "room_archived":
+            # The archive has the room now; a replica left here could
+            # bring it back through an election
+            self.failover.replica_store.remove(room_id)
+        elif self.failover and event_type == "thread_updated":
+            self.failover.replica_store.record_thread(
+                room_id, event_data["thread_id"], event_data
+            )
+        elif self.failover and event_type != "typing":
+            # Typing events are ephemeral and leave replicas alone
+            self.failover.replica_store.record_member_event(
+                room_id, event_type, event_data.get("username", "")
+            )
 
         # Broadcast to local clients via callback
         if self._broadcast_callback:
@@ -415,8 +3579,51 @@ class XMLRPCServer:
         logger.warning("No broadcast callback set for member event delivery")
         return False
 
+    def _apply_room_updated(
+        self, room_id: str, event_data: Dict
+    ) -> Optional[Dict]:
+        """
+        Apply a room_updated event to the room or its replica here.
+
+        The event usually comes from the room's admin, but after a
+        failover it can be a late one from the previous admin, so only
+        changes newer than the local metadata are applied.
+
+        Args:
+            room_id: The room ID
+            event_data: The room_updated event data
+
+        Returns:
+            The event with only the applied changes, or None if none
+            were newer
+        """
+        changes = event_data.get("changes") or {}
+        versions = event_data.get("versions") or {}
+        if self.room_manager.get_room(room_id):
+            applied = self.room_manager.apply_room_update(
+                room_id, changes, versions
+            )["changes"]
+        elif self.failover and self.failover.replica_store.get(room_id):
+            self.room_manager.clock.update(max(versions.values(), default=None))
+            applied = self.failover.replica_store.record_metadata(
+                room_id, changes, versions
+            )
+        else:
+            return event_data
+        if not applied:
+            return None
+        return dict(
+            event_data,
+            changes=applied,
+            versions={name: versions[name] for name in applied},
+        )
+
     def leave_room(
-        self, room_id: str, username: str, client_node_id: str
+        self,
+        room_id: str,
+        username: str,
+        client_node_id: str,
+        auth_token: str = "",
     ) -> Dict:
         """
         Handle a leave request for a room administered by this node.
@@ -428,6 +3635,7 @@ class XMLRPCServer:
             room_id: The ID of the room to leave
             username: The username of the leaving user
             client_node_id: The node the client is connected to
+            auth_token: Session token of the leaving user, if any
 
         Returns:
             dict: Leave result with success status
@@ -437,6 +3645,14 @@ class XMLRPCServer:
             f"by {username} from {client_node_id}"
         )
 
+        denied = self._check_auth(auth_token, username)
+        if denied:
+            return {
+                "success": False,
+                "message": denied["error"],
+                "error_code": denied["error_code"],
+            }
+
         # Get the room
         room = self.room_manager.get_room(room_id)
         if not room:
@@ -449,6 +3665,15 @@ class XMLRPCServer:
 
         # Check if user is in the room
         if username not in room.members:
+            if self.room_manager.leave_waitlist(room_id, username):
+                logger.info(
+                    f"XML-RPC: User {username} left the waiting list of "
+                    f"room {room_id}"
+                )
+                return {
+                    "success": True,
+                    "message": "Left the waiting list",
+                }
             logger.warning(f"XML-RPC: User {username} not in room {room_id}")
             return {
                 "success": False,
@@ -460,13 +3685,22 @@ class XMLRPCServer:
         self.room_manager.remove_member(room_id, username)
 
         logger.info(f"XML-RPC: User {username} left room {room.room_name}")
+        self._announce_left(room_id, username)
+        self._admit_waitlisted(room_id)
 
-        # Create member_left event data
+        return {
+            "success": True,
+            "message": "Successfully left room",
+        }
+
+    def _announce_left(self, room_id: str, username: str):
+        """Announce a departed member to local clients and peer nodes."""
         event_data = create_member_left_event(
             room_id=room_id,
             username=username,
-            member_count=len(room.members),
+            member_count=len(self.room_manager.get_members(room_id)),
             timestamp=datetime.now(timezone.utc).isoformat(),
+            hlc=self.room_manager.clock.now().encode(),
         )
 
         # Broadcast member_left to local clients via callback
@@ -482,9 +3716,46 @@ class XMLRPCServer:
             self.peer_registry, room_id, "member_left", event_data
         )
 
+    def merge_room_members(
+        self, room_id: str, member_set: Dict, client_node_id: str
+    ) -> Dict:
+        """
+        Merge a node's membership set of a room administered here.
+
+        This method is exposed via XML-RPC and is called by a node that
+        recorded joins and leaves of its clients while it couldn't reach
+        this node (see member_set.py), once it reaches it again. Members
+        who joined or left through the merge are announced like other
+        joins and leaves.
+
+        Args:
+            room_id: The ID of the room
+            member_set: The node's membership set of the room, as a dict
+            client_node_id: The node the joining members are connected to
+
+        Returns:
+            dict: Result with success, the merged 'member_set', and the
+            usernames who 'joined' and 'left'
+        """
+        changes = self.room_manager.merge_members(
+            room_id, member_set, client_node_id
+        )
+        if changes is None:
+            return {
+                "success": False,
+                "error": "Room not found",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        for username in changes["joined"]:
+            self._announce_joined(room_id, username)
+        for username in changes["left"]:
+            self._announce_left(room_id, username)
+        if changes["left"]:
+            self._admit_waitlisted(room_id)
         return {
             "success": True,
-            "message": "Successfully left room",
+            "member_set": self.room_manager.get_member_set(room_id),
+            **changes,
         }
 
     # ===== Member Disconnect Notification Methods =====
@@ -531,14 +3802,22 @@ class XMLRPCServer:
 
         # Check if user is in the room
         if username not in room.members:
+            self.room_manager.leave_waitlist(room_id, username)
             logger.warning(f"XML-RPC: User {username} not in room {room_id}")
             return {
                 "success": True,  # Not an error - user already gone
                 "message": "User not in room",
             }
 
-        # Remove user from the room
-        self.room_manager.remove_member(room_id, username)
+        # Remove user from the room, unless they are still connected
+        # from a device on another node
+        if not self.room_manager.remove_member_node(
+            room_id, username, member_node_id
+        ):
+            return {
+                "success": True,
+                "message": "User still connected through another node",
+            }
 
         logger.info(
             f"XML-RPC: User {username} removed from room {room.room_name} "
@@ -552,6 +3831,7 @@ class XMLRPCServer:
             member_count=len(room.members),
             timestamp=datetime.now(timezone.utc).isoformat(),
             reason=reason,
+            hlc=self.room_manager.clock.now().encode(),
         )
 
         # Broadcast member_left to local clients via callback
@@ -566,6 +3846,7 @@ class XMLRPCServer:
         broadcast_to_peers(
             self.peer_registry, room_id, "member_left", event_data
         )
+        self._admit_waitlisted(room_id)
 
         return {
             "success": True,
@@ -577,14 +3858,16 @@ class XMLRPCServer:
         Respond to heartbeat/health check from administrator node.
 
         This method is exposed via XML-RPC and is called by administrator
-        nodes to verify this node is alive and healthy.
+        nodes to verify this node is alive and healthy. The wall clock
+        time lets the caller estimate the skew between the two clocks.
 
         Returns:
             dict: Health status
             {
                 'status': 'ok',
                 'node_id': str,
-                'timestamp': str
+                'timestamp': str,
+                'clock': float  # UNIX time
             }
         """
         logger.debug("XML-RPC: heartbeat called")
@@ -592,6 +3875,7 @@ class XMLRPCServer:
             "status": "ok",
             "node_id": self.room_manager.node_id,
             "timestamp": datetime.now(timezone.utc).isoformat(),
+            "clock": time.time(),
         }
 
     # ===== Two-Phase Commit (2PC) Methods for Room Deletion =====
@@ -663,6 +3947,10 @@ class XMLRPCServer:
             room_name = room.room_name if room else "Unknown"
 
         result = self.room_manager.commit_deletion(room_id, transaction_id)
+        self.causal_buffer.forget(room_id)
+        self.sequence_buffer.forget(room_id)
+        if self.failover:
+            self.failover.replica_store.remove(room_id)
 
         # Notify local clients that room was deleted
         if result.get("success") and self._broadcast_callback:
@@ -717,3 +4005,371 @@ class XMLRPCServer:
             self._broadcast_callback(room_id, notification, exclude_user=None)
 
         return result
+
+    # ===== Generic Two-Phase Commit (2PC) Methods =====
+
+    def tpc_prepare(
+        self,
+        transaction_id: str,
+        operation: str,
+        payload: Dict,
+        coordinator_node: str,
+    ) -> Dict:
+        """
+        Phase 1 (PREPARE): Vote on a 2PC operation.
+
+        This method is exposed via XML-RPC and is called by the coordinator
+        node during the PREPARE phase of 2PC.
+
+        Args:
+            transaction_id: Unique transaction identifier
+            operation: Name of the operation (e.g., "delete_room")
+            payload: Operation arguments
+            coordinator_node: Node coordinating the transaction
+
+        Returns:
+            dict: Vote with structure:
+            {
+                'vote': 'READY' or 'ABORT',
+                'reason': str (if ABORT),
+                'node_id': str,
+                'transaction_id': str
+            }
+        """
+        logger.info(
+            f"XML-RPC: tpc_prepare called for {operation} transaction "
+            f"{transaction_id} from {coordinator_node}"
+        )
+        return self.tpc_participant.prepare(
+            transaction_id, operation, payload, coordinator_node
+        )
+
+    def tpc_commit(self, transaction_id: str) -> Dict:
+        """
+        Phase 2 (COMMIT): Apply a prepared 2PC operation.
+
+        Args:
+            transaction_id: Transaction identifier from PREPARE
+
+        Returns:
+            dict: Confirmation with 'success' and 'node_id'
+        """
+        logger.info(f"XML-RPC: tpc_commit called for {transaction_id}")
+        return self.tpc_participant.commit(transaction_id)
+
+    def tpc_abort(self, transaction_id: str) -> Dict:
+        """
+        Phase 2 (ABORT): Abandon a prepared 2PC operation.
+
+        Args:
+            transaction_id: Transaction identifier from PREPARE
+
+        Returns:
+            dict: Confirmation with 'success' and 'node_id'
+        """
+        logger.info(f"XML-RPC: tpc_abort called for {transaction_id}")
+        return self.tpc_participant.abort(transaction_id)
+
+    def tpc_precommit(self, transaction_id: str) -> Dict:
+        """
+        Recovery extension: promise to commit a prepared 2PC operation.
+
+        Args:
+            transaction_id: Transaction identifier from PREPARE
+
+        Returns:
+            dict: Confirmation with 'success', 'node_id' and, on failure,
+            'error'
+        """
+        logger.info(f"XML-RPC: tpc_precommit called for {transaction_id}")
+        return self.tpc_participant.precommit(transaction_id)
+
+    def tpc_status(self, transaction_id: str, requester: str = "") -> Dict:
+        """
+        Recovery extension: report this node's state of a 2PC transaction.
+
+        Called by participants recovering a transaction whose coordinator
+        went silent.
+
+        Args:
+            transaction_id: Transaction identifier from PREPARE
+            requester: Node ID of the recovering node
+
+        Returns:
+            dict: {'transaction_id', 'node_id', 'state'} where state is
+            PREPARED, PRECOMMITTED, COMMIT, ROLLBACK or UNKNOWN
+        """
+        logger.info(
+            f"XML-RPC: tpc_status called for {transaction_id} from "
+            f"{requester}"
+        )
+        return self.tpc_participant.status(transaction_id, requester)
+
+    # ===== Room Admin Failover Methods =====
+
+    def get_room_replica(self, room_id: str) -> Dict:
+        """
+        Get this node's replica of a room administered elsewhere.
+
+        Called by the winner of an admin election to rebuild the room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            dict: {'success': bool, 'replica': dict} or an error
+        """
+        logger.info(f"XML-RPC: get_room_replica called for room {room_id}")
+        replica = self.failover.get_replica(room_id) if self.failover else None
+        if replica is None:
+            return {
+                "success": False,
+                "error": "No replica of this room",
+                "error_code": "ROOM_NOT_FOUND",
+            }
+        return {"success": True, "replica": replica}
+
+    def failover_election(self, room_id: str, candidate_node: str) -> Dict:
+        """
+        Receive a bully election message from a lower-ID candidate.
+
+        Args:
+            room_id: The room whose administrator is being elected
+            candidate_node: Node ID of the candidate
+
+        Returns:
+            dict: {'ok': bool, 'node_id': str}; ok means this node will take
+            over the election
+        """
+        logger.info(
+            f"XML-RPC: failover_election called for room {room_id} "
+            f"by {candidate_node}"
+        )
+        if not self.failover:
+            return {"ok": False, "node_id": self.room_manager.node_id}
+        return self.failover.handle_election_message(room_id, candidate_node)
+
+    def room_admin_changed(
+        self, room_id: str, admin_node: str, node_address: str
+    ) -> Dict:
+        """
+        Receive the announcement of a room's newly elected administrator.
+
+        Args:
+            room_id: The room ID
+            admin_node: Node ID of the new administrator
+            node_address: XML-RPC address of the new administrator
+
+        Returns:
+            dict: {'success': bool, 'node_id': str}
+        """
+        logger.info(
+            f"XML-RPC: room_admin_changed called for room {room_id}, "
+            f"new admin {admin_node}"
+        )
+        if self.failover:
+            self.failover.apply_admin_change(room_id, admin_node, node_address)
+        elif self.room_directory:
+            self.room_directory.reassign(room_id, admin_node, node_address)
+        return {"success": True, "node_id": self.room_manager.node_id}
+
+    def replicate_messages(
+        self, room_id: str, room_info: Dict, messages: List, reset: bool
+    ) -> Dict:
+        """
+        Receive a batch of a room's messages as one of its followers.
+
+        Called by the room's administrator; see ReplicationManager.
+
+        Args:
+            room_id: The room ID
+            room_info: Room metadata and member list from the admin
+            messages: Messages in sequence order
+            reset: If True, the batch replaces the follower's position
+
+        Returns:
+            dict: {'success': bool, 'acked_sequence': int} with the highest
+            contiguous sequence number this node holds
+        """
+        logger.debug(
+            f"XML-RPC: replicate_messages called for room {room_id} "
+            f"with {len(messages)} messages"
+        )
+        if not self.failover:
+            return {
+                "success": False,
+                "error": "Replication is not enabled on this node",
+                "error_code": "REPLICATION_DISABLED",
+            }
+        acked = self.failover.replica_store.apply_replication(
+            dict(room_info, room_id=room_id), messages, reset
+        )
+        return {
+            "success": True,
+            "acked_sequence": acked,
+            "node_id": self.room_manager.node_id,
+        }
+
+    def drop_room_replica(self, room_id: str) -> Dict:
+        """
+        Drop this node's follower replica of a room.
+
+        Args:
+            room_id: The room ID
+
+        Returns:
+            dict: {'success': bool, 'node_id': str}
+        """
+        logger.info(f"XML-RPC: drop_room_replica called for room {room_id}")
+        if self.failover:
+            self.failover.replica_store.remove(room_id)
+        return {"success": True, "node_id": self.room_manager.node_id}
+
+    def accept_room_handoff(
+        self, room_state: Dict, previous_admin: str
+    ) -> Dict:
+        """
+        Take over a room from an administrator that is shutting down.
+
+        Args:
+            room_state: Full room state (ID, metadata, members mapped to
+                their node IDs, messages, counter and vector clock)
+            previous_admin: Node ID of the departing administrator
+
+        Returns:
+            dict: {'success': bool, 'node_id': str} or an error
+        """
+        room_id = room_state.get("room_id")
+        logger.info(
+            f"XML-RPC: accept_room_handoff called for room {room_id} "
+            f"by {previous_admin}"
+        )
+        return self._take_over_room(room_state, previous_admin)
+
+    def _accept_snapshot(self, snapshot: RoomSnapshot, sender: str) -> Dict:
+        """Take over the room of a received snapshot."""
+        return self._take_over_room(snapshot.restore_args(), sender)
+
+    def _accept_replica_snapshot(
+        self, snapshot: RoomSnapshot, sender: str
+    ) -> Dict:
+        """Install a received snapshot as this node's replica of its room."""
+        if not self.failover:
+            return {
+                "success": False,
+                "error": "Replication is not enabled on this node",
+                "error_code": "REPLICATION_DISABLED",
+            }
+        acked = self.failover.replica_store.install_snapshot(snapshot)
+        return {
+            "success": True,
+            "acked_sequence": acked,
+            "node_id": self.room_manager.node_id,
+        }
+
+    def _take_over_room(self, room_state: Dict, previous_admin: str) -> Dict:
+        """Take over a room handed off by its administrator."""
+        if not self.failover:
+            return {
+                "success": False,
+                "error": "Failover is not enabled on this node",
+                "error_code": "HANDOFF_UNSUPPORTED",
+            }
+        if not self.failover.accept_handoff(room_state, previous_admin):
+            return {
+                "success": False,
+                "error": "Room already exists on this node",
+                "error_code": "ROOM_EXISTS",
+            }
+        return {"success": True, "node_id": self.room_manager.node_id}
+
+    def begin_snapshot_transfer(
+        self,
+        transfer_id: str,
+        room_id: str,
+        size: int,
+        chunk_count: int,
+        checksum: str,
+        sender: str,
+        purpose: str = HANDOFF,
+    ) -> Dict:
+        """
+        Start or resume receiving the snapshot of a room handed to us, or
+        of one we are to follow.
+
+        Args:
+            transfer_id: ID of the transfer, reused when resuming
+            room_id: Room the snapshot is of
+            size: Size of the encoded snapshot in bytes
+            chunk_count: Number of chunks
+            checksum: SHA-256 checksum of the encoded snapshot
+            sender: Node ID of the sending administrator
+            purpose: "handoff" to take over the room, or "replica" to
+                install the snapshot as a follower replica
+
+        Returns:
+            dict: {'success': True, 'next_chunk': int} or an error
+        """
+        logger.info(
+            f"XML-RPC: begin_snapshot_transfer called for room {room_id} "
+            f"by {sender} ({purpose})"
+        )
+        return self.snapshot_receiver.begin(
+            transfer_id, room_id, size, chunk_count, checksum, sender, purpose
+        )
+
+    def receive_snapshot_chunk(
+        self, transfer_id: str, index: int, data, checksum: str
+    ) -> Dict:
+        """
+        Receive one chunk of a room snapshot.
+
+        Args:
+            transfer_id: ID of the transfer
+            index: Index of the chunk
+            data: The chunk, as xmlrpc.client.Binary
+            checksum: SHA-256 checksum of the chunk
+
+        Returns:
+            dict: {'success': True, 'next_chunk': int} or an error
+        """
+        return self.snapshot_receiver.add_chunk(
+            transfer_id, index, getattr(data, "data", data), checksum
+        )
+
+    def commit_snapshot_transfer(self, transfer_id: str) -> Dict:
+        """
+        Verify a received room snapshot and take over the room (or
+        install the replica, for a replica transfer).
+
+        Args:
+            transfer_id: ID of the transfer
+
+        Returns:
+            dict: {'success': bool, 'node_id': str} or an error
+        """
+        logger.info(
+            f"XML-RPC: commit_snapshot_transfer called for {transfer_id}"
+        )
+        return self.snapshot_receiver.commit(transfer_id)
+
+    def hello(self, hello: Dict) -> Dict:
+        """
+        Answer the discovery handshake of a node joining the cluster.
+
+        Args:
+            hello: The caller's node_id, address, protocol_version,
+                min_protocol_version and capabilities
+
+        Returns:
+            dict: This node's hello payload with 'success', 'peers' and
+            'negotiated_version', or an error
+        """
+        logger.info(f"XML-RPC: hello called by {hello.get('node_id')}")
+        if not self.discovery:
+            return {
+                "success": False,
+                "error": "Discovery is not enabled on this node",
+                "error_code": "DISCOVERY_UNSUPPORTED",
+            }
+        return self.discovery.handle_hello(hello)
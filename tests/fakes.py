@@ -0,0 +1,64 @@
+"""
+Shared Test Fakes
+
+A PeerRegistry calling other nodes in-process, shared by the cluster
+tests.
+"""
+
+
+class LocalPeerRegistry:
+    """
+    Peer registry that calls other nodes' servers in-process.
+
+    Servers are looked up by node ID in a dict the cluster's registries
+    share. A node without a server (or whose server is None) or in down
+    is unreachable, and so is every node while this one is down. Calls
+    are recorded in calls as (node_id, method).
+    """
+
+    def __init__(
+        self, node_id=None, servers=None, down=None, capabilities=(), tags=None
+    ):
+        self.node_id = node_id
+        self.servers = {} if servers is None else servers
+        self.down = set() if down is None else down
+        self.capabilities = list(capabilities)
+        self.tags = {} if tags is None else tags
+        self.calls = []
+        self.registered = {}
+
+    def methods(self):
+        """Get the methods called, in order."""
+        return [method for _, method in self.calls]
+
+    def register_peer(self, node_id, address):
+        self.registered[node_id] = address
+
+    def list_peers(self):
+        return {
+            node_id: f"http://{node_id}"
+            for node_id in self.servers
+            if node_id != self.node_id
+        }
+
+    def get_peer_address(self, node_id):
+        return f"http://{node_id}" if node_id in self.servers else None
+
+    def get_capabilities(self, node_id):
+        return list(self.capabilities)
+
+    def get_tags(self, node_id):
+        return dict(self.tags.get(node_id, {}))
+
+    def get_protocol_version(self, node_id):
+        return None
+
+    def connection_status(self, node_id):
+        return None
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        self.calls.append((node_id, method))
+        server = self.servers.get(node_id)
+        if server is None or node_id in self.down or self.node_id in self.down:
+            raise ConnectionError("unreachable")
+        return getattr(server, method)(*args)
@@ -0,0 +1,340 @@
+"""
+Tests for the Admin HTTP API
+
+Tests for token authentication, the listings of rooms, clients, peers and
+in-flight 2PC transactions, and the endpoints closing rooms,
+disconnecting clients and forcing in-doubt transactions.
+"""
+
+import asyncio
+import http.client
+import json
+import threading
+import pytest
+
+from src.node import (
+    AdminAPI,
+    AdminServer,
+    AuditLog,
+    FailureDetector,
+    PeerRegistry,
+    RoomStateManager,
+    TPCParticipant,
+    TransactionHandler,
+    WebSocketServer,
+)
+from src.node.config import NodeConfig
+from src.node.tpc import PARTICIPANTS_KEY
+
+TOKEN = "s3cret"
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+        self.closed = None
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    async def close(self, code=1000, reason=""):
+        self.closed = (code, reason)
+
+    def types(self):
+        return [json.loads(m)["type"] for m in self.sent_messages]
+
+
+class BlockingPeerRegistry:
+    """Peer registry whose participant waits before voting."""
+
+    def __init__(self):
+        self.release = threading.Event()
+
+    def list_peers(self):
+        return {"node-b": "http://node-b:9090"}
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        self.release.wait(5)
+        if method == "tpc_prepare":
+            return {"vote": "READY", "node_id": node_id}
+        return {"success": True, "node_id": node_id}
+
+
+class SilentPeerRegistry:
+    """Peer registry whose participant votes READY, then stops answering."""
+
+    def __init__(self):
+        self.calls = []
+
+    def list_peers(self):
+        return {"node-b": "http://node-b:9090"}
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        self.calls.append(method)
+        if method == "tpc_prepare":
+            return {"vote": "READY", "node_id": node_id, "recovery": True}
+        if method == "tpc_abort":
+            return {"success": True, "node_id": node_id}
+        raise ConnectionError("unreachable")
+
+
+class ReadyHandler(TransactionHandler):
+    """Handler that votes READY."""
+
+    def prepare(self, transaction_id, payload):
+        return {"vote": "READY"}
+
+
+def _request(port, method, path, token=TOKEN):
+    connection = http.client.HTTPConnection("127.0.0.1", port, timeout=5)
+    headers = {"Authorization": f"Bearer {token}"} if token else {}
+    try:
+        connection.request(method, path, headers=headers)
+        response = connection.getresponse()
+        return response.status, json.loads(response.read())
+    finally:
+        connection.close()
+
+
+async def _call(server, method, path, token=TOKEN):
+    """Make a request from a thread, leaving the event loop free."""
+    return await asyncio.get_running_loop().run_in_executor(
+        None, _request, server.port, method, path, token
+    )
+
+
+def _admin(ws_server=None, **kwargs):
+    ws_server = ws_server or WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+    server = AdminServer(AdminAPI(ws_server, **kwargs), TOKEN, "127.0.0.1", 0)
+    server.start()
+    return server, ws_server
+
+
+class TestAuthentication:
+    """Tests for the admin token."""
+
+    @pytest.mark.asyncio
+    async def test_token_required(self):
+        """Test that requests without the right token get 401."""
+        server, _ = _admin()
+        try:
+            missing = await _call(server, "GET", "/admin/rooms", token=None)
+            wrong = await _call(server, "GET", "/admin/rooms", token="guess")
+            allowed = await _call(server, "GET", "/admin/rooms")
+        finally:
+            server.stop()
+
+        assert missing[0] == wrong[0] == 401
+        assert missing[1]["error_code"] == "UNAUTHORIZED"
+        assert allowed[0] == 200
+
+    @pytest.mark.asyncio
+    async def test_unknown_paths(self):
+        """Test the responses to unknown endpoints and wrong methods."""
+        server, _ = _admin()
+        try:
+            unknown = await _call(server, "GET", "/admin/nodes")
+            wrong_method = await _call(server, "POST", "/admin/rooms")
+        finally:
+            server.stop()
+
+        assert unknown[0] == 404
+        assert wrong_method[0] == 405
+
+    def test_token_required_by_config(self):
+        """Test that the API can't be enabled without a token."""
+        assert NodeConfig(admin_port=9200).validate() == [
+            "admin_port requires an admin_token"
+        ]
+        assert NodeConfig(admin_port=9200, admin_token=TOKEN).validate() == []
+
+
+class TestListings:
+    """Tests for the GET endpoints."""
+
+    @pytest.mark.asyncio
+    async def test_rooms_and_clients(self):
+        """Test listing hosted rooms and connected clients with their rooms."""
+        server, ws_server = _admin()
+        room = ws_server.room_manager.create_room("General", "alice")
+        websocket = MockWebSocket()
+        connection = ws_server.connections.register(websocket)
+        ws_server.register_client_room_membership(websocket, room.room_id, "alice")
+        try:
+            _, rooms = await _call(server, "GET", "/admin/rooms")
+            _, clients = await _call(server, "GET", "/admin/clients")
+        finally:
+            server.stop()
+
+        assert [r["room_id"] for r in rooms["rooms"]] == [room.room_id]
+        assert clients["clients"][0]["client_id"] == connection.client_id
+        assert clients["clients"][0]["username"] == "alice"
+        assert clients["clients"][0]["rooms"] == [room.room_id]
+
+    @pytest.mark.asyncio
+    async def test_peer_health(self):
+        """Test that peers are listed with their failure detector state."""
+        registry = PeerRegistry("node-a")
+        registry.register_peer("node-b", "http://node-b:9090")
+        registry.register_peer("node-c", "http://node-c:9090")
+        detector = FailureDetector("node-a", registry, suspect_threshold=1)
+        detector.record_success("node-b", 0.01)
+        detector.record_failure("node-c")
+        registry.rpc.connections.get("http://node-c:9090").record_failure(
+            OSError("refused")
+        )
+        server, _ = _admin(peer_registry=registry, failure_detector=detector)
+        try:
+            _, body = await _call(server, "GET", "/admin/peers")
+        finally:
+            server.stop()
+
+        states = {p["node_id"]: (p["address"], p["state"]) for p in body["peers"]}
+        assert states == {
+            "node-b": ("http://node-b:9090", "alive"),
+            "node-c": ("http://node-c:9090", "suspect"),
+        }
+        connections = {p["node_id"]: p["connection"] for p in body["peers"]}
+        assert connections["node-b"] is None
+        assert connections["node-c"]["failures"] == 1
+        assert connections["node-c"]["state"] == "closed"
+        assert [p["clock_skew"] for p in body["peers"]] == [None, None]
+
+    @pytest.mark.asyncio
+    async def test_in_flight_transactions(self):
+        """Test that running and prepared 2PC transactions are listed."""
+        room_manager = RoomStateManager("node-a")
+        registry = BlockingPeerRegistry()
+        ws_server = WebSocketServer(room_manager, "localhost", 0, registry)
+        participant = TPCParticipant("node-a")
+        participant.register_handler("rename_room", ReadyHandler())
+        participant.prepare("t-remote", "rename_room", {}, "node-c")
+        server, _ = _admin(ws_server, tpc_participant=participant)
+        task = asyncio.create_task(
+            ws_server.tpc.execute("rename_room", {}, ["node-b"], "t-local")
+        )
+        try:
+            await asyncio.sleep(0.05)
+            _, during = await _call(server, "GET", "/admin/transactions")
+            registry.release.set()
+            await task
+            _, after = await _call(server, "GET", "/admin/transactions")
+        finally:
+            registry.release.set()
+            server.stop()
+
+        assert during["coordinating"][0]["transaction_id"] == "t-local"
+        assert during["coordinating"][0]["participants"] == ["node-b"]
+        assert during["participating"][0]["coordinator"] == "node-c"
+        assert after["coordinating"] == []
+
+
+class TestActions:
+    """Tests for the POST endpoints."""
+
+    @pytest.mark.asyncio
+    async def test_close_room(self):
+        """Test that closing a room deletes it and tells its members."""
+        server, ws_server = _admin()
+        room = ws_server.room_manager.create_room("General", "alice")
+        websocket = MockWebSocket()
+        ws_server.register_client_room_membership(websocket, room.room_id, "bob")
+        try:
+            status, body = await _call(
+                server, "POST", f"/admin/rooms/{room.room_id}/close"
+            )
+            missing = await _call(server, "POST", "/admin/rooms/nope/close")
+        finally:
+            server.stop()
+
+        assert status == 200
+        assert body["success"] is True
+        assert ws_server.room_manager.get_room(room.room_id) is None
+        assert websocket.types() == ["delete_room_initiated", "room_deleted"]
+        assert missing[0] == 404
+        assert missing[1]["error_code"] == "ROOM_NOT_FOUND"
+
+    @pytest.mark.asyncio
+    async def test_disconnect_client(self):
+        """Test that disconnecting a client closes its connection."""
+        server, ws_server = _admin()
+        websocket = MockWebSocket()
+        connection = ws_server.connections.register(websocket)
+        try:
+            status, _ = await _call(
+                server, "POST", f"/admin/clients/{connection.client_id}/disconnect"
+            )
+            missing = await _call(server, "POST", "/admin/clients/nope/disconnect")
+        finally:
+            server.stop()
+
+        assert status == 200
+        assert websocket.closed == (1008, "Disconnected by administrator")
+        assert missing[0] == 404
+
+
+class TestInDoubtTransactions:
+    """Tests for listing and forcing transactions recovery can't decide."""
+
+    @pytest.mark.asyncio
+    async def test_force_participant_transaction(self, tmp_path):
+        """Test the listing, the confirmation, and the audited commit."""
+        audit_log = AuditLog(str(tmp_path / "audit.log"), "node-a")
+        room_manager = RoomStateManager("node-a", audit_log=audit_log)
+        ws_server = WebSocketServer(room_manager, "localhost", 0)
+        participant = TPCParticipant(
+            "node-a", 0, peer_registry=SilentPeerRegistry()
+        )
+        participant.register_handler("rename_room", ReadyHandler())
+        payload = {PARTICIPANTS_KEY: ["node-a", "node-b"]}
+        participant.prepare("t1", "rename_room", payload, "node-c")
+        participant.recover_blocked()
+        server, _ = _admin(ws_server, tpc_participant=participant)
+        path = "/admin/transactions/t1/commit"
+        try:
+            _, listed = await _call(server, "GET", "/admin/transactions/in-doubt")
+            refused = await _call(server, "POST", path)
+            status, forced = await _call(server, "POST", f"{path}?confirm=yes")
+            missing = await _call(server, "POST", f"{path}?confirm=yes")
+        finally:
+            server.stop()
+
+        (txn,) = listed["participating"]
+        assert txn["statuses"] == {"node-b": None}
+        assert txn["recovery_attempts"] == 1
+        assert refused[0] == 428
+        assert refused[1]["error_code"] == "CONFIRMATION_REQUIRED"
+        assert status == 200
+        assert (forced["decision"], forced["role"]) == ("COMMIT", "participant")
+        assert forced["acknowledged"] == []
+        assert participant.get_transaction("t1") is None
+        assert missing[1]["error_code"] == "TRANSACTION_NOT_FOUND"
+        (entry,) = audit_log.query(action="transaction_forced")
+        assert (entry.actor, entry.target) == ("admin", "t1")
+        assert entry.details["decision"] == "COMMIT"
+
+    @pytest.mark.asyncio
+    async def test_force_coordinator_transaction(self):
+        """Test aborting a transaction the coordinator left in doubt."""
+        registry = SilentPeerRegistry()
+        ws_server = WebSocketServer(
+            RoomStateManager("node-a"), "localhost", 0, registry
+        )
+        txn = await ws_server.tpc.execute("rename_room", {}, ["node-b"], "t1")
+        server, _ = _admin(ws_server)
+        try:
+            _, listed = await _call(server, "GET", "/admin/transactions/in-doubt")
+            _, forced = await _call(
+                server, "POST", "/admin/transactions/t1/abort?confirm=yes"
+            )
+        finally:
+            server.stop()
+
+        assert txn.abort_reason == "Aborted by an operator"
+        assert listed["coordinating"][0]["votes"] == {"node-b": "READY"}
+        assert (forced["decision"], forced["role"]) == ("ROLLBACK", "coordinator")
+        assert forced["acknowledged"] == ["node-b"]
+        assert registry.calls[-1] == "tpc_abort"
+        assert ws_server.tpc.in_doubt_transactions() == []
@@ -0,0 +1,156 @@
+"""
+Tests for Announcement Rooms
+
+Tests for refusing posts by members while the owner and moderators post,
+the message_error of a refused send, forwarded messages, and keeping the
+flag across recovery, snapshots and replicas.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    AnnouncementError,
+    MemoryStorage,
+    ReplicaStore,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.snapshot import RoomSnapshot
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+def _room(manager):
+    room = manager.create_room("News", "alice", announcement=True)
+    for username in ("alice", "bob", "carol"):
+        manager.add_member(room.room_id, username)
+    manager.set_member_role(room.room_id, "alice", "carol", "moderator")
+    return room.room_id
+
+
+class TestAnnouncementRoom:
+    """Tests for posting in an announcement room."""
+
+    def test_only_owner_and_moderators_post(self):
+        """Test that members are refused with READ_ONLY_ROOM."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+
+        manager.add_message(room_id, "alice", "Release on Friday")
+        manager.add_message(room_id, "carol", "Reminder: release Friday")
+        with pytest.raises(AnnouncementError) as error:
+            manager.add_message(room_id, "bob", "Can it be Monday?")
+
+        assert error.value.error_code == "READ_ONLY_ROOM"
+        assert [m["username"] for m in manager.get_messages(room_id)] == [
+            "alice",
+            "carol",
+        ]
+
+    def test_regular_room_unaffected(self):
+        """Test that members post in rooms that aren't announcement rooms."""
+        manager = RoomStateManager("node1")
+        room = manager.create_room("General", "alice")
+        manager.add_member(room.room_id, "bob")
+
+        manager.add_message(room.room_id, "bob", "hi")
+
+        assert room.to_dict()["announcement"] is False
+
+    def test_forwarded_message_refused(self):
+        """Test that the admin node refuses forwarded posts by members."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+        server = XMLRPCServer(manager, "localhost", 0, "http://node1")
+
+        refused = server.forward_message(room_id, "bob", "hi", "node2")
+        sent = server.forward_message(room_id, "carol", "hi", "node2")
+
+        assert refused["success"] is False
+        assert refused["error_code"] == "READ_ONLY_ROOM"
+        assert sent["success"] is True
+
+    def test_flag_kept(self):
+        """Test the flag across recovery, snapshots and replicas."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room(manager)
+        room = manager.get_room(room_id)
+
+        recovered = RoomStateManager("node1", storage)
+        recovered.recover_rooms()
+        replicas = ReplicaStore()
+        replicas.update_from_join(
+            XMLRPCServer(manager, "localhost", 0, "http://node1")._room_info(
+                room
+            ),
+            room.messages,
+            "bob",
+        )
+
+        assert recovered.get_room(room_id).announcement is True
+        assert RoomSnapshot.from_room(manager, room_id).announcement is True
+        assert replicas.get(room_id).announcement is True
+        assert replicas.get(room_id).to_dict()["announcement"] is True
+
+
+class TestAnnouncementCommands:
+    """Tests for the WebSocket commands."""
+
+    @pytest.mark.asyncio
+    async def test_create_and_send(self):
+        """Test room_created and the message_error of a refused send."""
+        manager = RoomStateManager("node1")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        ws = MockWebSocket()
+
+        await ws_server.process_message(
+            ws,
+            json.dumps(
+                {
+                    "type": "create_room",
+                    "data": {
+                        "room_name": "News",
+                        "creator_id": "alice",
+                        "announcement": True,
+                    },
+                }
+            ),
+        )
+        created = ws.last()
+        room_id = created["data"]["room_id"]
+        manager.add_member(room_id, "bob")
+        ws_server.register_client_room_membership(ws, room_id, "bob")
+        await ws_server.process_message(
+            ws,
+            json.dumps(
+                {
+                    "type": "send_message",
+                    "data": {
+                        "room_id": room_id,
+                        "username": "bob",
+                        "content": "hi",
+                    },
+                }
+            ),
+        )
+
+        assert created["type"] == "room_created"
+        assert created["data"]["announcement"] is True
+        error = ws.last()
+        assert error["type"] == "message_error"
+        assert error["data"]["error_code"] == "READ_ONLY_ROOM"
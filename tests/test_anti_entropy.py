@@ -0,0 +1,220 @@
+"""
+Tests for Room Directory Anti-Entropy
+
+Tests for the directory digest tree and for reconciling divergent
+directories between peers after a partition, with divergence metrics.
+"""
+
+from src.node import (
+    AntiEntropy,
+    NodeMetrics,
+    RoomDirectory,
+    RoomStateManager,
+    XMLRPCServer,
+)
+from src.node.room_directory import gossip_round
+from tests.fakes import LocalPeerRegistry
+
+
+class Cluster:
+    """Nodes node-a and node-b, each with its own room directory."""
+
+    def __init__(self, node_ids=("node-a", "node-b")):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in node_ids:
+            registry = LocalPeerRegistry(node_id, self.servers)
+            manager = RoomStateManager(node_id)
+            directory = RoomDirectory(node_id, f"http://{node_id}")
+            metrics = NodeMetrics()
+            self.servers[node_id] = XMLRPCServer(
+                manager, "localhost", 0, f"http://{node_id}", registry, directory
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "directory": directory,
+                "registry": registry,
+                "metrics": metrics,
+                "anti_entropy": AntiEntropy(directory, manager, registry, metrics),
+            }
+
+    def node(self, node_id):
+        return self.nodes[node_id]
+
+    def create_room(self, node_id, name):
+        node = self.nodes[node_id]
+        room = node["manager"].create_room(name, "alice")
+        node["directory"].update_local(node["manager"].list_rooms())
+        return room
+
+
+def _divergence(metrics, kind):
+    return metrics.directory_divergence.value(kind=kind)
+
+
+class TestDigest:
+    """Tests for the directory digest tree."""
+
+    def test_equal_directories_have_equal_roots(self):
+        """Test that the digest depends only on entries and versions."""
+        first = RoomDirectory("node-x")
+        second = RoomDirectory("node-y")
+        entries = [
+            {"room_id": f"r{i}", "room_name": "Room", "admin_node": "node-z"}
+            for i in range(10)
+        ]
+        first.merge(entries)
+        second.merge(list(reversed(entries)))
+
+        assert first.digest() == second.digest()
+
+        second.merge([dict(entries[3], version=2)])
+        first_digest, second_digest = first.digest(), second.digest()
+        assert first_digest["root"] != second_digest["root"]
+        differing = [
+            index
+            for index, (a, b) in enumerate(
+                zip(first_digest["buckets"], second_digest["buckets"])
+            )
+            if a != b
+        ]
+        assert len(differing) == 1
+        assert list(second.bucket_versions(differing)) == ["r3"]
+
+    def test_tombstones_left_out(self):
+        """Test that a dropped tombstone doesn't make directories differ."""
+        directory = RoomDirectory("node-x")
+        empty = directory.digest()
+        directory.merge(
+            [
+                {
+                    "room_id": "r1",
+                    "room_name": "Room",
+                    "admin_node": "node-z",
+                    "deleted": True,
+                }
+            ]
+        )
+
+        assert directory.digest() == empty
+
+
+class TestReconcile:
+    """Tests for reconciling directories with a peer."""
+
+    def test_partitioned_directories_converge(self):
+        """Test that rooms created on both sides of a partition are repaired."""
+        cluster = Cluster()
+        room_a = cluster.create_room("node-a", "Alpha")
+        room_b = cluster.create_room("node-b", "Beta")
+
+        result = cluster.node("node-a")["anti_entropy"].reconcile("node-b")
+
+        assert result == {"missing": 2, "stale": 0, "pushed": 1, "pulled": 1}
+        for node_id in ("node-a", "node-b"):
+            directory = cluster.node(node_id)["directory"]
+            assert directory.get(room_a.room_id) is not None
+            assert directory.get(room_b.room_id) is not None
+        metrics = cluster.node("node-a")["metrics"]
+        assert _divergence(metrics, "missing") == 2
+        assert metrics.directory_syncs.value(outcome="repaired") == 1
+
+    def test_in_sync_peers_exchange_only_digests(self):
+        """Test that agreeing directories stop after comparing roots."""
+        cluster = Cluster()
+        cluster.create_room("node-a", "Alpha")
+        anti_entropy = cluster.node("node-a")["anti_entropy"]
+        anti_entropy.reconcile("node-b")
+        registry = cluster.node("node-a")["registry"]
+        registry.calls.clear()
+
+        result = anti_entropy.reconcile("node-b")
+
+        assert result["missing"] == result["stale"] == 0
+        assert registry.methods() == ["room_directory_digest"]
+        metrics = cluster.node("node-a")["metrics"]
+        assert metrics.directory_syncs.value(outcome="in_sync") == 1
+
+    def test_stale_entry_pulled(self):
+        """Test that a changed room's newer entry replaces the stale one."""
+        cluster = Cluster()
+        room = cluster.create_room("node-b", "Beta")
+        cluster.node("node-a")["anti_entropy"].reconcile("node-b")
+        cluster.node("node-b")["manager"].add_member(room.room_id, "bob")
+
+        result = cluster.node("node-a")["anti_entropy"].reconcile("node-b")
+
+        assert result["stale"] == 1
+        entry = cluster.node("node-a")["directory"].get(room.room_id)
+        assert entry.version == 2
+        assert entry.member_count == 1
+        assert _divergence(cluster.node("node-a")["metrics"], "stale") == 1
+
+    def test_deletion_replaces_live_entry(self):
+        """Test that a deleted room's tombstone reaches peers listing it."""
+        cluster = Cluster()
+        room = cluster.create_room("node-b", "Beta")
+        cluster.node("node-a")["anti_entropy"].reconcile("node-b")
+        cluster.node("node-b")["manager"].delete_room(room.room_id)
+
+        result = cluster.node("node-a")["anti_entropy"].reconcile("node-b")
+
+        assert result["stale"] == 1
+        assert cluster.node("node-a")["directory"].get(room.room_id) is None
+
+    def test_deleted_room_stays_deleted_after_long_partition(self):
+        """Test a room listed again after its tombstones expired."""
+        cluster = Cluster(("node-a", "node-b", "node-c"))
+        room_id = cluster.create_room("node-a", "Alpha").room_id
+        for peer_id in ("node-b", "node-c"):
+            cluster.node("node-a")["anti_entropy"].reconcile(peer_id)
+        cluster.node("node-a")["manager"].delete_room(room_id)
+        cluster.node("node-b")["anti_entropy"].reconcile("node-a")
+        for node_id in ("node-a", "node-b"):
+            cluster.node(node_id)["directory"].purge_tombstones(ttl=-1)
+
+        # node-c comes back still listing the room
+        cluster.node("node-b")["anti_entropy"].reconcile("node-c")
+        revived = cluster.node("node-b")["directory"].get(room_id)
+        result = cluster.node("node-a")["anti_entropy"].reconcile("node-b")
+        node_c = cluster.node("node-c")
+        gossip_round(
+            node_c["directory"], node_c["manager"], node_c["registry"]
+        )
+
+        assert revived is not None
+        assert result["stale"] == 1 and result["pulled"] == 0
+        for node_id in ("node-a", "node-b", "node-c"):
+            directory = cluster.node(node_id)["directory"]
+            assert directory.get(room_id) is None
+            assert directory.list_rooms() == []
+
+    def test_tombstones_not_spread_to_peers_without_entry(self):
+        """Test that peers that never saw a deleted room aren't sent it."""
+        cluster = Cluster()
+        cluster.node("node-a")["directory"].merge(
+            [
+                {
+                    "room_id": "gone",
+                    "room_name": "Gone",
+                    "admin_node": "node-z",
+                    "deleted": True,
+                }
+            ]
+        )
+
+        result = cluster.node("node-a")["anti_entropy"].reconcile("node-b")
+
+        assert result["missing"] == result["pushed"] == 0
+        assert cluster.node("node-b")["directory"].get_entries() == []
+
+    def test_unreachable_peer_counted(self):
+        """Test that a failed reconciliation is counted as an error."""
+        cluster = Cluster()
+        cluster.servers["node-b"] = None
+
+        results = cluster.node("node-a")["anti_entropy"].run_round()
+
+        assert results == {"node-b": None}
+        metrics = cluster.node("node-a")["metrics"]
+        assert metrics.directory_syncs.value(outcome="error") == 1
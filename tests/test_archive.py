@@ -0,0 +1,263 @@
+"""
+Tests for Room Archival
+
+Tests for the archive store, archiving a room with its full history,
+reading an archived room, restoring it on the same or another node, and
+the admin API endpoints and room_archived event.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    AdminAPI,
+    ArchiveError,
+    ArchiveStore,
+    AuditLog,
+    MemoryStorage,
+    ReplicaStore,
+    RoomDirectory,
+    RoomFailover,
+    RoomSnapshot,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.snapshot import SNAPSHOT_CAPABILITY
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, messages=3):
+    """A room owned by alice, with bob a moderator and mallory banned."""
+    room = manager.create_room("General", "alice", "Chat")
+    manager.add_member(room.room_id, "alice")
+    manager.add_member(room.room_id, "bob", "node-b")
+    manager.set_member_role(room.room_id, "alice", "bob", "moderator")
+    manager.moderate_member(room.room_id, "alice", "mallory", ban=True)
+    for i in range(messages):
+        manager.add_message(room.room_id, "alice", f"message {i}")
+    return room.room_id
+
+
+def _cluster():
+    """Nodes node-a and node-b that can hand rooms to each other."""
+    servers, nodes = {}, {}
+    for node_id in ("node-a", "node-b"):
+        registry = LocalPeerRegistry(
+            node_id, servers, capabilities=[SNAPSHOT_CAPABILITY]
+        )
+        manager = RoomStateManager(node_id)
+        failover = RoomFailover(
+            node_id,
+            f"http://{node_id}",
+            manager,
+            ReplicaStore(),
+            registry,
+            room_directory=RoomDirectory(node_id, f"http://{node_id}"),
+        )
+        servers[node_id] = XMLRPCServer(
+            manager,
+            "localhost",
+            0,
+            f"http://{node_id}",
+            registry,
+            failover=failover,
+        )
+        nodes[node_id] = (manager, failover)
+    return servers, nodes
+
+
+class TestArchiveStore:
+    """Tests for storing archived rooms."""
+
+    def test_store_on_disk_and_in_memory(self, tmp_path):
+        """Test saving, listing, loading and removing archived rooms."""
+        manager = RoomStateManager("node-a")
+        snapshot = RoomSnapshot.from_room(manager, _room(manager))
+
+        for store in (ArchiveStore(str(tmp_path / "archive")), ArchiveStore()):
+            store.save(snapshot)
+            (summary,) = store.list_archived()
+            assert store.load(snapshot.room_id) == snapshot
+            assert (summary["room_name"], summary["message_count"]) == (
+                "General",
+                3,
+            )
+            assert summary["archived_on"] == "node-a"
+            assert store.remove(snapshot.room_id) is True
+            assert store.remove(snapshot.room_id) is False
+            assert store.room_ids() == []
+
+        assert ArchiveStore(str(tmp_path / "archive")).load("../x") is None
+        snapshot.room_id = "../escape"
+        with pytest.raises(ValueError):
+            ArchiveStore(str(tmp_path)).save(snapshot)
+
+
+class TestArchiveRoom:
+    """Tests for archiving and restoring hosted rooms."""
+
+    def test_archived_room_is_read_only(self, tmp_path):
+        """Test the full history, storage dropped, and reading it."""
+        storage = MemoryStorage()
+        audit_log = AuditLog(str(tmp_path / "audit.log"), "node-a")
+        room_id = _room(RoomStateManager("node-a", storage), messages=12)
+        manager = RoomStateManager("node-a", storage, audit_log=audit_log)
+        manager.recover_rooms(max_messages=5)
+
+        summary = manager.archive_room(room_id, "admin")
+        page = manager.get_history(room_id, "carol", limit=20)
+
+        assert summary["message_count"] == 12
+        assert manager.get_room(room_id) is None
+        assert manager.list_rooms() == []
+        assert storage.room_ids() == []
+        assert page["archived"] is True
+        assert len(page["messages"]) == 12
+        (entry,) = audit_log.query(action="room_archived")
+        assert (entry.actor, entry.target) == ("admin", room_id)
+        with pytest.raises(ArchiveError) as error:
+            manager.archive_room(room_id, "admin")
+        assert error.value.error_code == "ROOM_NOT_FOUND"
+
+    def test_private_archive_only_read_by_members(self):
+        """Test history of an archived private room."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("Secret", "alice", private=True)
+        manager.add_member(room.room_id, "alice")
+        manager.archive_room(room.room_id, "admin")
+
+        outsider = manager.get_history(room.room_id, "carol")
+        member = manager.get_history(room.room_id, "alice")
+
+        assert outsider["error_code"] == "NOT_A_MEMBER"
+        assert member["success"] is True
+
+    def test_restore_keeps_members_and_history(self):
+        """Test restoring, the restored room surviving a restart, and errors."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node-a", storage)
+        room_id = _room(manager)
+        manager.archive_room(room_id, "admin")
+
+        with pytest.raises(ArchiveError) as missing:
+            manager.restore_archived("missing", "admin")
+        taken = manager.create_room("general", "dave")
+        with pytest.raises(ArchiveError) as clash:
+            manager.restore_archived(room_id, "admin")
+        manager.delete_room(taken.room_id)
+        room = manager.restore_archived(room_id, "admin")
+        manager.add_message(room_id, "bob", "back again")
+        recovered = RoomStateManager("node-a", storage)
+        recovered.recover_rooms()
+
+        assert missing.value.error_code == "ARCHIVE_NOT_FOUND"
+        assert clash.value.error_code == "ROOM_NAME_TAKEN"
+        assert room.members == {"alice", "bob"}
+        assert room.member_info["bob"].node_id == "node-b"
+        assert (room.roles, room.banned) == ({"bob": "moderator"}, {"mallory"})
+        assert manager.archive.room_ids() == []
+        assert len(recovered.get_room(room_id).messages) == 4
+        assert manager.get_history(room_id, "alice")["archived"] is False
+
+
+class TestArchiveEndpoints:
+    """Tests for the admin endpoints and the room_archived event."""
+
+    @pytest.mark.asyncio
+    async def test_archive_and_restore_here(self):
+        """Test the endpoints, the members' event and reading the archive."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        member = MockWebSocket()
+        ws_server.register_client_room_membership(member, room_id, "alice")
+        api = AdminAPI(ws_server)
+
+        archived = await api.handle("POST", f"/admin/rooms/{room_id}/archive")
+        listed = await api.handle("GET", "/admin/archives")
+        await ws_server.process_message(
+            member,
+            json.dumps(
+                {
+                    "type": "get_history",
+                    "data": {"room_id": room_id, "username": "alice"},
+                }
+            ),
+        )
+        elsewhere = await api.handle(
+            "POST", f"/admin/archives/{room_id}/restore", {"node": "node-b"}
+        )
+        restored = await api.handle(
+            "POST", f"/admin/archives/{room_id}/restore"
+        )
+
+        assert archived["archive"]["room_id"] == room_id
+        assert member.received("room_archived")[0]["archived_by"] == "admin"
+        assert room_id not in ws_server._room_clients
+        assert listed["count"] == 1
+        history = member.received("history")[0]
+        assert history["archived"] is True
+        assert len(history["messages"]) == 3
+        assert elsewhere["error_code"] == "HANDOFF_UNSUPPORTED"
+        assert restored["admin_node"] == "node-a"
+        assert manager.get_room(room_id) is not None
+
+    @pytest.mark.asyncio
+    async def test_restore_on_another_node(self):
+        """Test handing a restored room off, and a node refusing it."""
+        servers, nodes = _cluster()
+        manager, failover = nodes["node-a"]
+        room_id = _room(manager)
+        manager.archive_room(room_id, "admin")
+        api = AdminAPI(
+            WebSocketServer(manager, "localhost", 0), failover=failover
+        )
+        path = f"/admin/archives/{room_id}/restore"
+
+        refused = await api.handle("POST", path, {"node": "node-c"})
+        still_archived = manager.archive.has(room_id)
+        restored = await api.handle("POST", path, {"node": "node-b"})
+
+        assert refused["error_code"] == "HANDOFF_FAILED"
+        assert still_archived
+        assert restored["admin_node"] == "node-b"
+        assert manager.get_room(room_id) is None
+        assert manager.archive.room_ids() == []
+        room = nodes["node-b"][0].get_room(room_id)
+        assert len(room.messages) == 3
+        assert room.roles == {"bob": "moderator"}
+
+    def test_peers_drop_replicas(self):
+        """Test that room_archived removes a peer's replica of the room."""
+        servers, nodes = _cluster()
+        manager = nodes["node-a"][0]
+        room_id = _room(manager)
+        replicas = nodes["node-b"][1].replica_store
+        replicas.update_from_join(
+            servers["node-a"]._room_info(manager.get_room(room_id)), [], "bob"
+        )
+
+        servers["node-b"].receive_member_event_broadcast(
+            room_id, "room_archived", {"room_id": room_id}
+        )
+
+        assert replicas.get(room_id) is None
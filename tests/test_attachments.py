@@ -0,0 +1,480 @@
+"""
+Tests for File and Image Attachments
+
+Tests for the content-addressed blob store, chunked uploads (in order,
+resumed, verified against their hash, expired), attachment references in
+messages, pulling blobs from the sender's node and replicating them to
+followers, the upload and download commands, and the max_attachment_size
+setting.
+"""
+
+import base64
+import hashlib
+import json
+import time
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    AttachmentError,
+    AttachmentManager,
+    BlobStore,
+    RoomDirectory,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+    validate_attachments,
+)
+from src.node.attachments import CHUNK_SIZE
+from src.node.config import NodeConfig
+from src.node.edits import DELETE
+from tests.fakes import LocalPeerRegistry
+
+DATA = bytes(range(256)) * 300  # spans several chunks
+DATA_HASH = hashlib.sha256(DATA).hexdigest()
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _attachment(data=DATA, filename="photo.png"):
+    return {
+        "hash": hashlib.sha256(data).hexdigest(),
+        "size": len(data),
+        "content_type": "image/png",
+        "filename": filename,
+    }
+
+
+def _upload(manager, data=DATA, username="alice"):
+    started = manager.start_upload(
+        username,
+        "room-1",
+        hashlib.sha256(data).hexdigest(),
+        len(data),
+        "image/png",
+        "photo.png",
+    )
+    for offset in range(0, len(data), CHUNK_SIZE):
+        chunk = base64.b64encode(data[offset : offset + CHUNK_SIZE]).decode()
+        manager.upload_chunk(started["upload_id"], username, offset, chunk)
+    return manager.finish_upload(started["upload_id"], username)
+
+
+def _room(manager, *members):
+    room = manager.create_room("General", "alice")
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestBlobStore:
+    """Tests for the content-addressed blob store."""
+
+    def test_put_and_read(self, tmp_path):
+        """Test that blobs are stored once under their hash, on disk or not."""
+        for store in (BlobStore(), BlobStore(str(tmp_path))):
+            assert store.put(DATA) == DATA_HASH
+            assert store.put(DATA) == DATA_HASH
+
+            assert store.has(DATA_HASH)
+            assert store.size(DATA_HASH) == len(DATA)
+            assert store.read(DATA_HASH, 10, 5) == DATA[10:15]
+            assert store.read(DATA_HASH) == DATA
+            assert not store.has("0" * 64)
+            assert store.size("../etc/passwd") is None
+        assert (tmp_path / DATA_HASH[:2] / DATA_HASH).read_bytes() == DATA
+        with pytest.raises(KeyError):
+            BlobStore().read(DATA_HASH)
+
+
+class TestUploads:
+    """Tests for chunked uploads."""
+
+    def test_chunked_upload(self):
+        """Test that chunks in order make a verified, stored attachment."""
+        manager = AttachmentManager("node-a")
+
+        upload = _upload(manager)
+
+        assert upload.attachment() == _attachment()
+        assert manager.blob_store.read(DATA_HASH) == DATA
+
+    def test_resent_chunk_ignored_and_gap_rejected(self):
+        """Test that resending resumes and skipping ahead is refused."""
+        manager = AttachmentManager("node-a")
+        started = manager.start_upload(
+            "alice", "room-1", DATA_HASH, len(DATA), "image/png", "a.png"
+        )
+        first = base64.b64encode(DATA[:CHUNK_SIZE]).decode()
+        upload_id = started["upload_id"]
+
+        assert manager.upload_chunk(upload_id, "alice", 0, first) == CHUNK_SIZE
+        assert manager.upload_chunk(upload_id, "alice", 0, first) == CHUNK_SIZE
+        for args, code in (
+            ((upload_id, "alice", CHUNK_SIZE * 2, first), "OUT_OF_ORDER"),
+            ((upload_id, "alice", CHUNK_SIZE, "not base64!"), "INVALID_CHUNK"),
+            ((upload_id, "bob", CHUNK_SIZE, first), "UPLOAD_NOT_FOUND"),
+        ):
+            with pytest.raises(AttachmentError) as error:
+                manager.upload_chunk(*args)
+            assert error.value.error_code == code
+        with pytest.raises(AttachmentError) as error:
+            manager.finish_upload(upload_id, "alice")
+        assert error.value.error_code == "INCOMPLETE_UPLOAD"
+
+    def test_hash_mismatch(self):
+        """Test that data not matching the announced hash is dropped."""
+        manager = AttachmentManager("node-a")
+        started = manager.start_upload(
+            "alice", "room-1", "0" * 64, 4, "text/plain", "a.txt"
+        )
+        manager.upload_chunk(
+            started["upload_id"], "alice", 0, base64.b64encode(b"abcd").decode()
+        )
+
+        with pytest.raises(AttachmentError) as error:
+            manager.finish_upload(started["upload_id"], "alice")
+
+        assert error.value.error_code == "HASH_MISMATCH"
+        assert not manager.blob_store.has("0" * 64)
+
+    def test_start_refused_or_skipped(self):
+        """Test bad metadata and limits, and that stored files are skipped."""
+        manager = AttachmentManager("node-a", max_size=len(DATA))
+        manager.blob_store.put(DATA)
+
+        skipped = manager.start_upload(
+            "alice", "room-1", DATA_HASH, len(DATA), "image/png", "photo.png"
+        )
+        assert skipped == {"complete": True, "attachment": _attachment()}
+        for args, code in (
+            (("0" * 64, len(DATA) + 1, "image/png", "a"), "ATTACHMENT_TOO_LARGE"),
+            (("abc", 10, "image/png", "a.png"), "INVALID_ATTACHMENT"),
+            (("0" * 64, 10, "png", "a.png"), "INVALID_ATTACHMENT"),
+            (("0" * 64, 10, "image/png", "../a.png"), "INVALID_ATTACHMENT"),
+        ):
+            with pytest.raises(AttachmentError) as error:
+                manager.start_upload("alice", "room-1", *args)
+            assert error.value.error_code == code
+
+    def test_too_many_and_expired(self):
+        """Test the per-user upload limit and dropping idle uploads."""
+        now = [1000.0]
+        manager = AttachmentManager("node-a", clock=lambda: now[0])
+        for _ in range(5):
+            manager.start_upload(
+                "alice", "room-1", "0" * 64, 10, "text/plain", "a.txt"
+            )
+
+        with pytest.raises(AttachmentError) as error:
+            manager.start_upload(
+                "alice", "room-1", "0" * 64, 10, "text/plain", "a.txt"
+            )
+        assert error.value.error_code == "TOO_MANY_UPLOADS"
+        now[0] += manager.upload_ttl + 1
+        assert manager.expire() == 5
+        manager.start_upload("alice", "room-1", "0" * 64, 10, "text/plain", "a")
+
+    def test_validate_attachments(self):
+        """Test the checks of a message's attachment references."""
+        assert validate_attachments([_attachment()]) == (True, None)
+        assert not validate_attachments(_attachment())[0]
+        assert not validate_attachments([_attachment()] * 11)[0]
+        assert not validate_attachments([_attachment(filename="")])[0]
+        assert not validate_attachments([_attachment()], max_size=10)[0]
+
+
+class TestAttachedMessages:
+    """Tests for messages referencing attachments."""
+
+    def test_attachments_stored_and_dropped_on_delete(self):
+        """Test that a deleted message loses its attachment references."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)
+        message = manager.add_message(
+            room_id, "alice", "look", attachments=[_attachment()]
+        )
+
+        assert message["attachments"] == [_attachment()]
+        manager.edit_message(room_id, "alice", message["message_id"], DELETE)
+        (deleted,) = manager.get_messages(room_id)
+        assert "attachments" not in deleted
+
+    def test_blob_pulled_from_sender_node(self):
+        """Test that the admin fetches a missing blob in chunks."""
+        sender = AttachmentManager("node-b")
+        sender.blob_store.put(DATA)
+        sender_rpc = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b",
+            attachments=sender,
+        )
+        admin = AttachmentManager("node-a", peer_registry=LocalPeerRegistry())
+        admin.peer_registry.servers["node-b"] = sender_rpc
+
+        with patch("src.node.attachments.BLOB_CHUNK_SIZE", 1000):
+            admin.require([_attachment()], ["node-b"])
+
+        assert admin.blob_store.read(DATA_HASH) == DATA
+        with pytest.raises(AttachmentError) as error:
+            admin.require([_attachment(b"other")], ["node-b"])
+        assert error.value.error_code == "ATTACHMENT_NOT_FOUND"
+
+    def test_blobs_replicated_to_followers(self):
+        """Test that followers pull blobs the admin asks them to."""
+        peers = LocalPeerRegistry()
+        admin = AttachmentManager("node-a", peer_registry=peers)
+        admin.blob_store.put(DATA)
+        follower = AttachmentManager("node-c", peer_registry=peers)
+        peers.servers["node-a"] = XMLRPCServer(
+            RoomStateManager("node-a"),
+            "localhost",
+            0,
+            "http://node-a",
+            attachments=admin,
+        )
+        peers.servers["node-c"] = XMLRPCServer(
+            RoomStateManager("node-c"),
+            "localhost",
+            0,
+            "http://node-c",
+            attachments=follower,
+        )
+
+        admin.replicate("room-1", [_attachment()], ["node-c"]).join(1)
+
+        deadline = time.time() + 2
+        while not follower.blob_store.has(DATA_HASH) and time.time() < deadline:
+            time.sleep(0.01)
+        assert follower.blob_store.read(DATA_HASH) == DATA
+
+
+class TestAttachmentCommands:
+    """Tests for the upload and download commands."""
+
+    @pytest.mark.asyncio
+    async def test_upload_send_and_download(self):
+        """Test uploading, attaching and downloading a file on one node."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(
+            manager, "localhost", 0, attachments=AttachmentManager("node-a")
+        )
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        started = await _request(
+            ws_server,
+            alice,
+            "start_upload",
+            room_id=room_id,
+            username="alice",
+            hash=DATA_HASH,
+            size=len(DATA),
+            content_type="image/png",
+            filename="photo.png",
+        )
+        upload_id = started["data"]["upload_id"]
+        for offset in range(0, len(DATA), started["data"]["chunk_size"]):
+            chunk = DATA[offset : offset + CHUNK_SIZE]
+            progress = await _request(
+                ws_server,
+                alice,
+                "upload_chunk",
+                upload_id=upload_id,
+                username="alice",
+                offset=offset,
+                data=base64.b64encode(chunk).decode(),
+            )
+        complete = await _request(
+            ws_server,
+            alice,
+            "finish_upload",
+            upload_id=upload_id,
+            username="alice",
+        )
+        attachment = complete["data"]["attachment"]
+        await _request(
+            ws_server,
+            alice,
+            "send_message",
+            room_id=room_id,
+            username="alice",
+            content="",
+            attachments=[attachment],
+        )
+        downloaded = b""
+        while True:
+            chunk = await _request(
+                ws_server,
+                bob,
+                "get_attachment",
+                room_id=room_id,
+                username="bob",
+                hash=DATA_HASH,
+                offset=len(downloaded),
+            )
+            downloaded += base64.b64decode(chunk["data"]["data"])
+            if chunk["data"]["done"]:
+                break
+
+        assert started["type"] == "upload_started"
+        assert progress["data"]["received"] == len(DATA)
+        assert complete["type"] == "upload_complete"
+        assert attachment == _attachment()
+        (message,) = bob.received("new_message")
+        assert message["attachments"] == [attachment]
+        assert downloaded == DATA
+
+    @pytest.mark.asyncio
+    async def test_missing_blob_and_outsider_rejected(self):
+        """Test unknown blobs in messages and uploads by non-members."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)
+        ws_server = WebSocketServer(
+            manager, "localhost", 0, attachments=AttachmentManager("node-a")
+        )
+        alice = _join(ws_server, room_id, "alice")
+        outsider = MockWebSocket()
+        ws_server.connections.register(outsider)
+
+        sent = await _request(
+            ws_server,
+            alice,
+            "send_message",
+            room_id=room_id,
+            username="alice",
+            content="look",
+            attachments=[_attachment()],
+        )
+        refused = await _request(
+            ws_server,
+            outsider,
+            "start_upload",
+            room_id=room_id,
+            username="mallory",
+            hash=DATA_HASH,
+            size=len(DATA),
+            content_type="image/png",
+            filename="photo.png",
+        )
+
+        assert sent["type"] == "message_error"
+        assert sent["data"]["error_code"] == "ATTACHMENT_NOT_FOUND"
+        assert manager.get_messages(room_id) == []
+        assert refused["type"] == "upload_error"
+        assert refused["data"]["error_code"] == "NOT_MEMBER"
+
+    @pytest.mark.asyncio
+    async def test_attachment_through_admin(self):
+        """Test a file sent via a member node and downloaded on another."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, "bob")
+        peers = LocalPeerRegistry()
+        store_a = AttachmentManager("node-a", peer_registry=peers)
+        store_b = AttachmentManager("node-b", peer_registry=peers)
+        store_c = AttachmentManager("node-c", peer_registry=peers)
+        admin_rpc = XMLRPCServer(
+            admin, "localhost", 0, "http://node-a", attachments=store_a
+        )
+        peers.servers["node-a"] = admin_rpc
+        peers.servers["node-b"] = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b",
+            attachments=store_b,
+        )
+        directory_a = RoomDirectory("node-a", "http://node-a")
+        directory_a.update_local(admin.list_rooms())
+        servers = {}
+        for node_id, store in (("node-b", store_b), ("node-c", store_c)):
+            directory = RoomDirectory(node_id, f"http://{node_id}")
+            directory.merge(directory_a.get_entries())
+            servers[node_id] = WebSocketServer(
+                RoomStateManager(node_id),
+                "localhost",
+                0,
+                peer_registry=peers,
+                room_directory=directory,
+                attachments=store,
+            )
+        alice = _join(servers["node-b"], room_id, "alice")
+        bob = _join(servers["node-c"], room_id, "bob")
+        _upload(store_b)
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address,
+            allow_none=True: admin_rpc,
+        ):
+            await _request(
+                servers["node-b"],
+                alice,
+                "send_message",
+                room_id=room_id,
+                username="alice",
+                content="look",
+                message_id="m-1",
+                attachments=[_attachment()],
+            )
+            first = await _request(
+                servers["node-c"],
+                bob,
+                "get_attachment",
+                room_id=room_id,
+                username="bob",
+                hash=DATA_HASH,
+            )
+
+        (sent,) = alice.received("message_sent")
+        assert sent["message_id"] == "m-1"
+        (message,) = admin.get_messages(room_id)
+        assert message["attachments"] == [_attachment()]
+        assert store_a.blob_store.read(DATA_HASH) == DATA
+        assert first["type"] == "attachment_chunk"
+        assert base64.b64decode(first["data"]["data"]) == DATA[:CHUNK_SIZE]
+        assert first["data"]["size"] == len(DATA)
+        assert store_c.blob_store.has(DATA_HASH)
+
+    def test_max_attachment_size(self):
+        """Test that the setting must not be negative."""
+        errors = NodeConfig(max_attachment_size=-1).validate()
+
+        assert any("max_attachment_size" in error for error in errors)
+        assert NodeConfig(max_attachment_size=0).validate() == []
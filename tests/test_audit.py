@@ -0,0 +1,232 @@
+"""
+Tests for the Audit Log
+
+Tests for the hash chain and its verification, reading the log back from
+its file, the privileged actions recorded by the room manager, 2PC
+coordinator and failover, and the GET /admin/audit endpoint.
+"""
+
+import asyncio
+import http.client
+import json
+
+import pytest
+
+from src.node import (
+    AdminAPI,
+    AdminServer,
+    AuditLog,
+    ReplicaStore,
+    RoomFailover,
+    RoomStateManager,
+    TPCCoordinator,
+    WebSocketServer,
+)
+from src.node.audit import GENESIS_HASH
+
+TOKEN = "s3cret"
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+
+class NoPeers:
+    """Peer registry of a node alone in the cluster."""
+
+    def list_peers(self):
+        return {}
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        raise ConnectionError("unreachable")
+
+
+class DeadAdmin:
+    """Failure detector reporting node-a dead."""
+
+    def is_alive(self, node_id):
+        return node_id != "node-a"
+
+    def alive_peers(self):
+        return []
+
+
+def _actions(audit_log):
+    return [(e.actor, e.action, e.target) for e in audit_log.query()]
+
+
+class TestAuditLog:
+    """Tests for the hash-chained log."""
+
+    def test_chain_and_tampering(self):
+        """Test that entries chain and changed entries are detected."""
+        audit_log = AuditLog(node_id="node1")
+        first = audit_log.record("alice", "room_created", "r1")
+        second = audit_log.record("alice", "member_banned", "r1", {"user": "eve"})
+
+        assert first.sequence == 1
+        assert first.previous_hash == GENESIS_HASH
+        assert second.previous_hash == first.hash
+        assert audit_log.verify() is None
+
+        second.details["user"] = "bob"
+        assert audit_log.verify() == 2
+        first.actor = "mallory"
+        assert audit_log.verify() == 1
+
+    def test_file_read_back(self, tmp_path):
+        """Test that the file is appended to and checked when read again."""
+        path = str(tmp_path / "audit.log")
+        AuditLog(path, "node1").record("alice", "room_created", "r1")
+        reopened = AuditLog(path, "node1")
+        reopened.record("alice", "room_deleted", "r1")
+
+        assert len(AuditLog(path)) == 2
+        assert AuditLog(path).verify() is None
+        lines = open(path).read().splitlines()
+        del lines[0]
+        with open(path, "w") as handle:
+            handle.write("\n".join(lines) + "\n")
+        assert AuditLog(path).verify() == 1
+
+    def test_query_filters(self):
+        """Test filtering by time, actor and action, and the limit."""
+        audit_log = AuditLog()
+        for actor in ("alice", "bob", "alice"):
+            audit_log.record(actor, "room_created", f"room-{actor}")
+        first = audit_log.query()[0]
+
+        assert len(audit_log.query(actor="alice")) == 2
+        assert audit_log.query(action="room_deleted") == []
+        assert audit_log.query(until=first.timestamp) == []
+        assert len(audit_log.query(since=first.timestamp)) == 3
+        assert [e.sequence for e in audit_log.query(limit=2)] == [2, 3]
+
+
+class TestAuditedActions:
+    """Tests for the actions that are recorded."""
+
+    def test_room_actions(self):
+        """Test room creation, kicks, bans and role changes."""
+        audit_log = AuditLog()
+        manager = RoomStateManager("node1", audit_log=audit_log)
+        room_id = manager.create_room("General", "alice").room_id
+        for username in ("alice", "bob", "carol", "dave"):
+            manager.add_member(room_id, username)
+
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+        manager.moderate_member(room_id, "bob", "carol")
+        manager.moderate_member(room_id, "bob", "dave", ban=True)
+
+        assert _actions(audit_log) == [
+            ("alice", "room_created", room_id),
+            ("alice", "role_changed", room_id),
+            ("bob", "member_kicked", room_id),
+            ("bob", "member_banned", room_id),
+        ]
+        assert audit_log.query()[3].details == {"user": "dave"}
+
+    @pytest.mark.asyncio
+    async def test_room_deletion_and_transaction_outcome(self):
+        """Test delete_room recording the deletion and the 2PC decision."""
+        audit_log = AuditLog()
+        manager = RoomStateManager("node1", audit_log=audit_log)
+        room_id = manager.create_room("General", "alice").room_id
+        manager.add_member(room_id, "alice")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        await ws_server.process_message(
+            MockWebSocket(),
+            json.dumps(
+                {
+                    "type": "delete_room",
+                    "data": {"room_id": room_id, "username": "alice"},
+                }
+            ),
+        )
+        result = await TPCCoordinator("node1", audit_log=audit_log).execute(
+            "rename_room", {}, []
+        )
+
+        actions = _actions(audit_log)
+        assert actions[-3][:2] == ("node1", "transaction_decided")
+        assert actions[-2] == ("alice", "room_deleted", room_id)
+        assert actions[-1] == ("node1", "transaction_decided", result.transaction_id)
+        assert audit_log.query()[-1].details["decision"] == "COMMIT"
+
+    def test_admin_failover(self):
+        """Test that taking over a room of a dead admin is recorded."""
+        audit_log = AuditLog()
+        manager = RoomStateManager("node-b", audit_log=audit_log)
+        store = ReplicaStore()
+        store.update_from_join(
+            {
+                "room_id": "room-1",
+                "room_name": "General",
+                "creator_id": "alice",
+                "admin_node": "node-a",
+                "members": ["alice", "bob"],
+            },
+            [],
+            "bob",
+        )
+        failover = RoomFailover(
+            "node-b", "http://node-b", manager, store, NoPeers(), DeadAdmin()
+        )
+
+        assert failover.handle_node_dead("node-a") == ["room-1"]
+        entry = audit_log.query(action="admin_failover")[0]
+        assert (entry.actor, entry.target) == ("node-b", "room-1")
+        assert entry.details["previous_admin"] == "node-a"
+
+
+class TestAuditEndpoint:
+    """Tests for GET /admin/audit."""
+
+    @pytest.mark.asyncio
+    async def test_query_endpoint(self):
+        """Test the filters, the chain check and invalid queries."""
+        audit_log = AuditLog()
+        audit_log.record("alice", "room_created", "r1")
+        audit_log.record("bob", "room_created", "r2")
+        ws_server = WebSocketServer(
+            RoomStateManager("node1", audit_log=audit_log), "localhost", 0
+        )
+        server = AdminServer(AdminAPI(ws_server), TOKEN, "127.0.0.1", 0)
+        server.start()
+
+        def request(path):
+            connection = http.client.HTTPConnection("127.0.0.1", server.port, timeout=5)
+            try:
+                connection.request(
+                    "GET", path, headers={"Authorization": f"Bearer {TOKEN}"}
+                )
+                response = connection.getresponse()
+                return response.status, json.loads(response.read())
+            finally:
+                connection.close()
+
+        loop = asyncio.get_running_loop()
+        try:
+            by_actor = await loop.run_in_executor(
+                None, request, "/admin/audit?actor=bob&since=0"
+            )
+            invalid = await loop.run_in_executor(
+                None, request, "/admin/audit?since=yesterday"
+            )
+        finally:
+            server.stop()
+
+        assert by_actor[0] == 200
+        assert [e["target"] for e in by_actor[1]["entries"]] == ["r2"]
+        assert by_actor[1]["verified"] is True
+        assert by_actor[1]["broken_at"] is None
+        assert invalid[0] == 400
+        assert invalid[1]["error_code"] == "INVALID_QUERY"
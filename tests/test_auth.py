@@ -0,0 +1,452 @@
+"""
+Tests for Client Authentication
+
+Tests for session token signing, user registration, login and account
+deletion, session checks on WebSocket commands, and token verification on
+forwarded operations.
+"""
+
+import json
+import time
+import pytest
+
+from src.node import (
+    MemoryStorage,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+    AuthManager,
+    AuthError,
+    TokenSigner,
+)
+from src.client.service import ClientService
+
+SECRET = b"cluster-secret"
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self, responses=None):
+        self.sent_messages = []
+        self.responses = list(responses or [])
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    async def recv(self):
+        return self.responses.pop(0)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+def _auth(node_id="node1", required=False, **kwargs):
+    return AuthManager(
+        node_id, SECRET, required, password_iterations=1, **kwargs
+    )
+
+
+def _logged_in(auth, username="alice"):
+    auth.register(username, "correct horse")
+    return auth.login(username, "correct horse")["token"]
+
+
+# ===== Token Signer Tests =====
+
+
+def test_sign_and_verify():
+    """Test that a signed token verifies and returns its claims."""
+    signer = TokenSigner(SECRET)
+    token = signer.sign({"sub": "alice", "exp": time.time() + 60})
+
+    assert signer.verify(token)["sub"] == "alice"
+
+
+def test_verify_rejects_other_secret():
+    """Test that a token signed with another secret is rejected."""
+    token = TokenSigner(b"other").sign({"sub": "alice", "exp": 2**31})
+
+    with pytest.raises(AuthError) as exc_info:
+        TokenSigner(SECRET).verify(token)
+    assert exc_info.value.error_code == "INVALID_TOKEN"
+
+
+def test_verify_rejects_tampered_claims():
+    """Test that changing the claims invalidates the signature."""
+    signer = TokenSigner(SECRET)
+    token = signer.sign({"sub": "alice", "exp": 2**31})
+    forged = TokenSigner(b"x").sign({"sub": "mallory", "exp": 2**31})
+    tampered = forged.split(".")[0] + "." + token.split(".")[1]
+
+    with pytest.raises(AuthError):
+        signer.verify(tampered)
+
+
+def test_verify_rejects_expired():
+    """Test that an expired token is rejected."""
+    signer = TokenSigner(SECRET)
+    token = signer.sign({"sub": "alice", "exp": time.time() - 1})
+
+    with pytest.raises(AuthError) as exc_info:
+        signer.verify(token)
+    assert exc_info.value.error_code == "TOKEN_EXPIRED"
+
+
+def test_verify_rejects_garbage():
+    """Test that malformed tokens are rejected."""
+    signer = TokenSigner(SECRET)
+
+    for token in ("", "abc", "a.b.c", "!!!.???"):
+        with pytest.raises(AuthError):
+            signer.verify(token)
+
+
+# ===== Auth Manager Tests =====
+
+
+def test_register_and_login():
+    """Test registering a user and logging in."""
+    auth = _auth()
+
+    assert auth.register("alice", "correct horse")["success"] is True
+    result = auth.login("alice", "correct horse")
+
+    assert result["success"] is True
+    assert result["username"] == "alice"
+    assert auth.verify_token(result["token"])["username"] == "alice"
+
+
+def test_register_duplicate_and_weak_password():
+    """Test registration validation."""
+    auth = _auth()
+    auth.register("alice", "correct horse")
+
+    assert auth.register("alice", "another one")["error_code"] == (
+        "USERNAME_TAKEN"
+    )
+    assert auth.register("bob", "short")["error_code"] == "WEAK_PASSWORD"
+    assert auth.register("  ", "long enough")["error_code"] == (
+        "INVALID_USERNAME"
+    )
+
+
+def test_login_wrong_password():
+    """Test that a wrong password is rejected."""
+    auth = _auth()
+    auth.register("alice", "correct horse")
+
+    result = auth.login("alice", "battery staple")
+
+    assert result["success"] is False
+    assert result["error_code"] == "INVALID_CREDENTIALS"
+    assert auth.login("nobody", "whatever1")["success"] is False
+
+
+def test_logout_revokes_session():
+    """Test that a logged-out token is no longer accepted."""
+    auth = _auth()
+    token = _logged_in(auth)
+
+    assert auth.logout(token)["success"] is True
+    assert auth.verify_token(token)["error_code"] == "TOKEN_REVOKED"
+
+
+def test_delete_account():
+    """Test deleting an account, its sessions and registering it again."""
+    storage = MemoryStorage()
+    auth = _auth(storage=storage)
+    token = _logged_in(auth)
+    peer_token = _logged_in(_auth("node2"))
+
+    assert auth.delete_account("alice", "wrong one")["error_code"] == (
+        "INVALID_CREDENTIALS"
+    )
+    assert auth.delete_account("alice", "correct horse")["success"] is True
+
+    assert auth.has_account("alice") is False
+    assert storage.accounts() == []
+    assert auth.verify_token(token)["error_code"] == "TOKEN_REVOKED"
+    assert auth.verify_token(peer_token)["success"] is True
+    assert auth.delete_account("alice", "correct horse")["success"] is False
+    token = _logged_in(auth)
+    assert auth.verify_token(token)["success"] is True
+
+
+def test_deleted_account_sessions_revoked_after_restart():
+    """Test an old session of a deleted account rejected after a restart."""
+    storage = MemoryStorage()
+    auth = _auth(storage=storage)
+    token = _logged_in(auth)
+    _logged_in(auth, "bob")
+    auth.delete_account("alice", "correct horse")
+    auth.delete_account("bob", "correct horse")
+    auth.register("bob", "correct horse")
+
+    restarted = _auth(storage=storage)
+
+    assert restarted.verify_token(token)["error_code"] == "TOKEN_REVOKED"
+    assert restarted.verify_token(_logged_in(restarted, "bob"))["success"]
+
+
+def test_token_verified_by_peer():
+    """Test that a peer sharing the secret accepts the token."""
+    token = _logged_in(_auth("node1"))
+
+    result = _auth("node2").verify_token(token)
+
+    assert result["success"] is True
+    assert result["username"] == "alice"
+    assert result["issuer"] == "node1"
+
+
+def test_authorize():
+    """Test the identity checks for a request."""
+    optional = _auth(required=False)
+    required = _auth(required=True)
+    token = _logged_in(optional)
+
+    assert optional.authorize(None, "bob")["success"] is True
+    assert required.authorize(None, "bob")["error_code"] == "AUTH_REQUIRED"
+    assert required.authorize(token, "alice")["success"] is True
+    assert required.authorize(token, None)["username"] == "alice"
+    assert required.authorize(token, "bob")["error_code"] == (
+        "IDENTITY_MISMATCH"
+    )
+
+
+# ===== WebSocket Tests =====
+
+
+@pytest.mark.asyncio
+async def test_ws_register_login_binds_session():
+    """Test that logging in binds the session to the connection."""
+    auth = _auth(required=True)
+    ws_server = WebSocketServer(
+        RoomStateManager("node1"), "localhost", 8080, auth=auth
+    )
+    ws = MockWebSocket()
+    ws_server.connections.register(ws)
+
+    await ws_server.process_message(
+        ws,
+        json.dumps(
+            {
+                "type": "register",
+                "data": {"username": "alice", "password": "correct horse"},
+            }
+        ),
+    )
+    assert ws.last()["type"] == "register_success"
+
+    await ws_server.process_message(
+        ws,
+        json.dumps(
+            {
+                "type": "login",
+                "data": {"username": "alice", "password": "correct horse"},
+            }
+        ),
+    )
+    assert ws.last()["type"] == "login_success"
+    connection = ws_server.connections.get(ws)
+    assert connection.username == "alice"
+    assert connection.session_token == ws.last()["data"]["token"]
+
+    await ws_server.process_message(
+        ws,
+        json.dumps(
+            {
+                "type": "create_room",
+                "data": {"room_name": "General", "creator_id": "alice"},
+            }
+        ),
+    )
+    assert ws.last()["type"] == "room_created"
+
+
+@pytest.mark.asyncio
+async def test_ws_rejects_command_without_session():
+    """Test that commands are rejected when auth is required."""
+    ws_server = WebSocketServer(
+        RoomStateManager("node1"), "localhost", 8080, auth=_auth(required=True)
+    )
+    ws = MockWebSocket()
+    ws_server.connections.register(ws)
+
+    await ws_server.process_message(
+        ws, json.dumps({"type": "list_rooms", "data": {}})
+    )
+
+    response = ws.last()
+    assert response["type"] == "auth_error"
+    assert response["data"]["request_type"] == "list_rooms"
+    assert response["data"]["error_code"] == "AUTH_REQUIRED"
+
+
+@pytest.mark.asyncio
+async def test_ws_rejects_identity_mismatch():
+    """Test that a session cannot act as another user."""
+    auth = _auth(required=False)
+    token = _logged_in(auth)
+    room_manager = RoomStateManager("node1")
+    ws_server = WebSocketServer(room_manager, "localhost", 8080, auth=auth)
+    ws = MockWebSocket()
+    ws_server.connections.register(ws)
+
+    await ws_server.process_message(
+        ws,
+        json.dumps(
+            {
+                "type": "create_room",
+                "token": token,
+                "data": {"room_name": "General", "creator_id": "mallory"},
+            }
+        ),
+    )
+
+    assert ws.last()["data"]["error_code"] == "IDENTITY_MISMATCH"
+    assert room_manager.get_room_count() == 0
+
+
+@pytest.mark.asyncio
+async def test_ws_logout_clears_session():
+    """Test that logout revokes and unbinds the session."""
+    auth = _auth(required=True)
+    token = _logged_in(auth)
+    ws_server = WebSocketServer(
+        RoomStateManager("node1"), "localhost", 8080, auth=auth
+    )
+    ws = MockWebSocket()
+    ws_server.connections.register(ws)
+
+    await ws_server.process_message(
+        ws, json.dumps({"type": "logout", "token": token, "data": {}})
+    )
+    assert ws.last()["type"] == "logout_success"
+
+    await ws_server.process_message(
+        ws, json.dumps({"type": "list_rooms", "token": token, "data": {}})
+    )
+    assert ws.last()["data"]["error_code"] == "TOKEN_REVOKED"
+
+
+@pytest.mark.asyncio
+async def test_ws_delete_account_clears_session():
+    """Test the delete_account command and its error."""
+    auth = _auth()
+    token = _logged_in(auth)
+    ws_server = WebSocketServer(
+        RoomStateManager("node1"), "localhost", 8080, auth=auth
+    )
+    ws = MockWebSocket()
+    ws_server.connections.register(ws)
+    ws_server.connections.set_session(ws, "alice", token)
+    request = {"username": "alice", "password": "correct horse"}
+
+    for _ in range(2):
+        await ws_server.process_message(
+            ws, json.dumps({"type": "delete_account", "data": request})
+        )
+        if ws.last()["type"] == "account_deleted":
+            deleted = ws.last()["data"]
+
+    assert deleted == {"success": True, "username": "alice"}
+    assert ws.last()["type"] == "delete_account_error"
+    assert ws_server.connections.get(ws).session_token is None
+
+
+@pytest.mark.asyncio
+async def test_ws_without_auth_rejects_login():
+    """Test that login fails when authentication is disabled."""
+    ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 8080)
+    ws = MockWebSocket()
+
+    await ws_server.process_message(
+        ws, json.dumps({"type": "login", "data": {"username": "alice"}})
+    )
+
+    assert ws.last()["type"] == "login_error"
+
+
+# ===== Forwarded Operation Tests =====
+
+
+def test_admin_verifies_forwarded_token():
+    """Test that the admin node checks tokens issued by a peer."""
+    token = _logged_in(_auth("node2"))
+    room_manager = RoomStateManager("node1")
+    room = room_manager.create_room("General", "alice")
+    server = XMLRPCServer(
+        room_manager,
+        "localhost",
+        9090,
+        "http://localhost:9090",
+        auth=_auth("node1", required=True),
+    )
+
+    denied = server.join_room(room.room_id, "alice", "node2")
+    assert denied["success"] is False
+    assert denied["error_code"] == "AUTH_REQUIRED"
+
+    mismatch = server.join_room(room.room_id, "bob", "node2", token)
+    assert mismatch["error_code"] == "IDENTITY_MISMATCH"
+
+    joined = server.join_room(room.room_id, "alice", "node2", token)
+    assert joined["success"] is True
+
+    sent = server.forward_message(room.room_id, "alice", "hi", "node2", token)
+    assert sent["success"] is True
+
+    left = server.leave_room(room.room_id, "alice", "node2", token)
+    assert left["success"] is True
+
+
+# ===== Client Tests =====
+
+
+@pytest.mark.asyncio
+async def test_client_login_attaches_token():
+    """Test that the client sends its token with later requests."""
+    ws = MockWebSocket(
+        [
+            json.dumps(
+                {
+                    "type": "login_success",
+                    "data": {"username": "alice", "token": "tok-123"},
+                }
+            )
+        ]
+    )
+    client = ClientService("ws://localhost:8080")
+    client._set_test_mode(ws)
+
+    token = await client.login("alice", "correct horse")
+    await client.send_message("room-1", "alice", "hello")
+
+    assert token == "tok-123"
+    assert client.session_token == "tok-123"
+    sent = ws.last()
+    assert sent["type"] == "send_message"
+    assert sent["token"] == "tok-123"
+
+
+@pytest.mark.asyncio
+async def test_client_login_error():
+    """Test that a rejected login raises ValueError."""
+    ws = MockWebSocket(
+        [
+            json.dumps(
+                {
+                    "type": "login_error",
+                    "data": {"error": "Invalid username or password"},
+                }
+            )
+        ]
+    )
+    client = ClientService("ws://localhost:8080")
+    client._set_test_mode(ws)
+
+    with pytest.raises(ValueError):
+        await client.login("alice", "wrong")
+    assert client.session_token is None
@@ -0,0 +1,180 @@
+"""
+Tests for User Blocking
+
+Tests for block lists kept in user profiles and synced between nodes,
+blocked users' room messages, direct messages and invites being left out
+of the blocking user's delivery stream, and the block_user command.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    HybridLogicalClock,
+    ProfileError,
+    ProfileRegistry,
+    RoomStateManager,
+    WebSocketServer,
+)
+from src.node.offline_queue import OfflineQueue
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _server():
+    return WebSocketServer(
+        RoomStateManager("node1"), "localhost", 0, offline_queue=OfflineQueue()
+    )
+
+
+def _connect(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.connections.set_username(websocket, username)
+    ws_server.room_manager.add_member(room_id, username)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+class TestBlockLists:
+    """Tests for block lists in profiles."""
+
+    def test_block_list_synced_not_shown(self):
+        """Test blocking, unblocking, merging and the public profile."""
+        node_a = ProfileRegistry(HybridLogicalClock("node-a"))
+        node_b = ProfileRegistry(HybridLogicalClock("node-b"))
+        node_a.update("bob", {"display_name": "Bob"})
+        node_a.block("bob", "carol")
+        node_a.block("bob", "mallory")
+        profile = node_a.block("bob", "carol", unblock=True)
+
+        node_b.merge(node_a.get_entries())
+
+        assert profile.blocked == ["mallory"]
+        assert node_b.blocks("bob", "mallory")
+        assert not node_b.blocks("bob", "carol")
+        assert node_b.blocked_by("mallory") == {"bob"}
+        assert node_b.get("bob").display_name == "Bob"
+        assert "blocked" not in node_b.get("bob").public_dict()
+        for user, code in (("bob", "INVALID_BLOCK"), ("", "INVALID_BLOCK")):
+            with pytest.raises(ProfileError) as error:
+                node_a.block("bob", user)
+            assert error.value.error_code == code
+
+
+class TestBlockedDelivery:
+    """Tests for what blocked users' messages reach."""
+
+    @pytest.mark.asyncio
+    async def test_room_messages_left_out(self):
+        """Test live delivery and the offline queue leaving out blocked users."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        carol = _connect(ws_server, room.room_id, "carol")
+        ws_server.profiles.block("bob", "alice")
+
+        for websocket, username in ((alice, "alice"), (carol, "carol")):
+            await _request(
+                ws_server,
+                websocket,
+                "send_message",
+                {"room_id": room.room_id, "username": username, "content": "hi"},
+            )
+        await ws_server._handle_client_disconnect(bob)
+        await _request(
+            ws_server,
+            alice,
+            "send_message",
+            {"room_id": room.room_id, "username": "alice", "content": "away"},
+        )
+
+        assert [m["username"] for m in bob.received("new_message")] == ["carol"]
+        assert ws_server.offline_queue.resume("bob").message_count() == 0
+        assert len(carol.received("new_message")) == 3
+
+    @pytest.mark.asyncio
+    async def test_direct_messages_and_invites_refused(self):
+        """Test dropped direct messages and refused invites."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("club", "alice", private=True)
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = MockWebSocket()
+        ws_server.connections.register(bob)
+        ws_server.connections.set_username(bob, "bob")
+        ws_server.profiles.block("bob", "alice")
+
+        await _request(
+            ws_server,
+            alice,
+            "send_direct_message",
+            {"username": "alice", "recipient": "bob", "content": "hey"},
+        )
+        await _request(
+            ws_server,
+            alice,
+            "create_invite",
+            {"room_id": room.room_id, "username": "alice", "invitee": "bob"},
+        )
+        dropped = ws_server.deliver_direct_message_sync(
+            "bob", {"sender": "alice", "recipient": "bob", "content": "hey"}
+        )
+
+        assert bob.received("direct_message") == []
+        assert alice.received("direct_message_sent")[0]["status"] == "delivered"
+        assert alice.received("invite_error")[0]["error_code"] == "INVITE_REFUSED"
+        assert dropped == 1
+        assert ws_server.direct_messages.pending_count("bob") == 0
+
+
+class TestBlockCommand:
+    """Tests for the block_user command."""
+
+    @pytest.mark.asyncio
+    async def test_block_user_command(self):
+        """Test blocks_updated, other devices synced and block_error."""
+        ws_server = _server()
+        phone, laptop = MockWebSocket(), MockWebSocket()
+        for websocket in (phone, laptop):
+            ws_server.connections.register(websocket)
+            ws_server.connections.set_username(websocket, "bob")
+
+        await _request(
+            ws_server, phone, "block_user", {"username": "bob", "user": "alice"}
+        )
+        await _request(
+            ws_server, phone, "block_user", {"username": "bob", "user": "bob"}
+        )
+        await _request(
+            ws_server, phone, "get_profile", {"usernames": ["bob"]}
+        )
+
+        assert phone.received("blocks_updated") == [
+            {"username": "bob", "blocked": ["alice"]}
+        ]
+        assert laptop.received("profile_updated")[0]["blocked"] == ["alice"]
+        assert phone.received("block_error")[0]["error_code"] == "INVALID_BLOCK"
+        assert "blocked" not in phone.received("profiles")[0]["profiles"]["bob"]
@@ -0,0 +1,288 @@
+"""
+Tests for Bots
+
+Tests for registering bots and checking their API keys, keeping them in
+every storage backend, routing command messages to the bot that handles
+them, and the bot commands and login over WebSocket.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    AuthManager,
+    BotError,
+    BotRegistry,
+    RoomStateManager,
+    WebSocketServer,
+)
+from src.node.bots import route_command
+from src.node.sqlite_storage import SQLiteStorage
+from src.node.storage import MemoryStorage
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+def _connect(ws_server):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    return websocket
+
+
+class TestBotRegistry:
+    """Tests for registering bots and their API keys."""
+
+    def test_register_and_authenticate(self):
+        """Test that only the returned API key logs the bot in."""
+        registry = BotRegistry("node-a")
+        bot, api_key = registry.register("alice", "dice", ["/roll", "/roll"])
+
+        assert bot == {
+            "name": "dice",
+            "owner": "alice",
+            "commands": ["/roll"],
+            "created_at": bot["created_at"],
+        }
+        assert registry.authenticate("dice", api_key).owner == "alice"
+        assert api_key not in json.dumps(registry.get("dice").to_dict())
+        for name, key in (("dice", "wrong"), ("dice", None), ("nobody", api_key)):
+            with pytest.raises(BotError) as error:
+                registry.authenticate(name, key)
+            assert error.value.error_code == "INVALID_API_KEY"
+
+    def test_rejections(self):
+        """Test invalid names and commands, taken names and removal."""
+        registry = BotRegistry("node-a")
+        registry.register("alice", "dice", ["/roll"])
+
+        for args, code in (
+            (("alice", "bad name", []), "INVALID_BOT_NAME"),
+            (("alice", "cards", ["roll"]), "INVALID_COMMANDS"),
+            (("alice", "cards", "/draw"), "INVALID_COMMANDS"),
+            (("bob", "dice", []), "BOT_NAME_TAKEN"),
+        ):
+            with pytest.raises(BotError) as error:
+                registry.register(*args)
+            assert error.value.error_code == code
+        for owner, name, code in (
+            ("bob", "dice", "NOT_ALLOWED"),
+            ("alice", "cards", "BOT_NOT_FOUND"),
+        ):
+            with pytest.raises(BotError) as error:
+                registry.remove(owner, name)
+            assert error.value.error_code == code
+
+        registry.remove("alice", "dice")
+        assert registry.list_bots("alice") == []
+
+    def test_bots_survive_restart(self, tmp_path):
+        """Test that each storage backend keeps bots and their removal."""
+        for make_storage in (
+            lambda: MessageLog(str(tmp_path / "wal")),
+            lambda: SQLiteStorage(str(tmp_path / "node.db")),
+        ):
+            registry = BotRegistry("node-a", make_storage())
+            _, api_key = registry.register("alice", "dice", ["/roll"])
+            registry.register("alice", "cards", ["/draw"])
+            registry.remove("alice", "cards")
+
+            reloaded = BotRegistry("node-a", make_storage())
+
+            assert [b["name"] for b in reloaded.list_bots("alice")] == ["dice"]
+            assert reloaded.authenticate("dice", api_key).commands == ["/roll"]
+
+        memory = MemoryStorage()
+        BotRegistry("node-a", memory).register("alice", "dice", [])
+        assert BotRegistry("node-a", memory).get("dice") is not None
+
+
+class TestCommandRouting:
+    """Tests for routing command messages to bots."""
+
+    def test_route_command(self):
+        """Test that only a registered command's first word is routed."""
+        bots = {"dice": ["/roll"], "cards": ["/draw"]}
+
+        assert route_command(bots, "/ROLL 2d6  ") == {
+            "bot": "dice",
+            "command": "/roll",
+            "args": "2d6",
+        }
+        assert route_command(bots, "/draw") == {
+            "bot": "cards",
+            "command": "/draw",
+            "args": "",
+        }
+        assert route_command(bots, "/unknown") is None
+        assert route_command(bots, "roll /roll") is None
+
+    def test_messages_marked_for_bot(self):
+        """Test bot_command on commands, and bots' own messages."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        for username in ("alice", "dice", "cards"):
+            manager.add_member(room_id, username)
+        manager.set_room_bot(room_id, "dice", ["/roll"])
+
+        command = manager.add_message(room_id, "alice", "/roll 1d20")
+        reply = manager.add_message(room_id, "dice", "/roll 17")
+        with pytest.raises(BotError) as error:
+            manager.set_room_bot(room_id, "cards", ["/draw", "/roll"])
+        manager.remove_member(room_id, "dice")
+        after_leaving = manager.add_message(room_id, "alice", "/roll 1d20")
+
+        assert command["bot_command"]["bot"] == "dice"
+        assert command["bot_command"]["args"] == "1d20"
+        assert "bot_command" not in reply
+        assert error.value.error_code == "COMMAND_TAKEN"
+        assert "bot_command" not in after_leaving
+        with pytest.raises(BotError) as error:
+            manager.set_room_bot(room_id, "dice", ["/roll"])
+        assert error.value.error_code == "NOT_IN_ROOM"
+
+
+class TestBotCommands:
+    """Tests for the bot commands over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_bot_joins_and_receives_commands(self):
+        """Test register_bot, bot_login, joining and a routed command."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        ws_server = WebSocketServer(
+            manager, "localhost", 0, bots=BotRegistry("node-a")
+        )
+        alice = _connect(ws_server)
+        bot = _connect(ws_server)
+
+        registered = await _request(
+            ws_server,
+            alice,
+            "register_bot",
+            username="alice",
+            bot_name="dice",
+            commands=["/roll"],
+        )
+        refused = await _request(
+            ws_server, bot, "bot_login", bot_name="dice", api_key="wrong"
+        )
+        logged_in = await _request(
+            ws_server,
+            bot,
+            "bot_login",
+            bot_name="dice",
+            api_key=registered["data"]["api_key"],
+        )
+        await _request(ws_server, alice, "join_room", room_id=room_id, username="alice")
+        joined = await _request(
+            ws_server, bot, "join_room", room_id=room_id, username="dice"
+        )
+        await _request(
+            ws_server,
+            alice,
+            "send_message",
+            room_id=room_id,
+            username="alice",
+            content="/roll 2d6",
+        )
+        listed = await _request(ws_server, alice, "list_bots", username="alice")
+
+        assert registered["type"] == "bot_registered"
+        assert refused["type"] == "bot_error"
+        assert refused["data"]["error_code"] == "INVALID_API_KEY"
+        assert logged_in["type"] == "bot_login_success"
+        assert logged_in["data"]["commands"] == ["/roll"]
+        assert ws_server.connections.get(bot).to_dict()["bot"]
+        assert joined["type"] == "bot_commands_registered"
+        routed = [
+            m["data"]
+            for m in bot.received("new_message")
+            if "bot_command" in m["data"]
+        ]
+        assert routed[0]["bot_command"] == {
+            "bot": "dice",
+            "command": "/roll",
+            "args": "2d6",
+        }
+        assert listed["data"]["bots"][0]["name"] == "dice"
+
+    @pytest.mark.asyncio
+    async def test_bot_sessions_with_auth(self):
+        """Test bot login tokens and names shared with user accounts."""
+        manager = RoomStateManager("node-a")
+        auth = AuthManager("node-a", b"secret", required=True)
+        auth.register("alice", "password123")
+        ws_server = WebSocketServer(
+            manager, "localhost", 0, auth=auth, bots=BotRegistry("node-a")
+        )
+        alice = _connect(ws_server)
+        await _request(
+            ws_server, alice, "login", username="alice", password="password123"
+        )
+
+        taken = await _request(
+            ws_server, alice, "register_bot", username="alice", bot_name="alice"
+        )
+        registered = await _request(
+            ws_server, alice, "register_bot", username="alice", bot_name="dice"
+        )
+        bot = _connect(ws_server)
+        logged_in = await _request(
+            ws_server,
+            bot,
+            "bot_login",
+            bot_name="dice",
+            api_key=registered["data"]["api_key"],
+        )
+        impostor = await _request(
+            ws_server,
+            _connect(ws_server),
+            "register",
+            username="dice",
+            password="password123",
+        )
+
+        assert taken["data"]["error_code"] == "BOT_NAME_TAKEN"
+        token = logged_in["data"]["token"]
+        assert auth.verify_token(token)["username"] == "dice"
+        assert impostor["type"] == "register_error"
+        assert impostor["data"]["error_code"] == "USERNAME_TAKEN"
+
+    @pytest.mark.asyncio
+    async def test_bots_disabled(self):
+        """Test that bot commands are refused without a registry."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        websocket = _connect(ws_server)
+
+        response = await _request(
+            ws_server, websocket, "bot_login", bot_name="dice", api_key="key"
+        )
+
+        assert response["data"]["error_code"] == "BOTS_DISABLED"
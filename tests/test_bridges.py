@@ -0,0 +1,484 @@
+"""
+Tests for Bridges
+
+Tests for adding, listing and removing a room's IRC and Matrix bridges,
+the IRC and Matrix transports, relaying messages both ways with puppet
+members, keeping bridges across restarts and snapshots, and the bridge
+commands locally and through the admin node.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    BridgeError,
+    BridgeManager,
+    EgressError,
+    EgressPolicy,
+    RoomDirectory,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.bridges import (
+    MAX_BUFFER,
+    MAX_READS_PER_POLL,
+    IRCTransport,
+    MatrixTransport,
+    create_bridge,
+    open_transport,
+    parse_irc_line,
+)
+from src.node.snapshot import RoomSnapshot
+from src.node.wal import MessageLog
+
+IRC_SETTINGS = {"server": "irc.example.org", "channel": "#chat", "nick": "relay"}
+MATRIX_SETTINGS = {
+    "homeserver": "https://matrix.example.org/",
+    "room_id": "!abc:example.org",
+    "user_id": "@relay:example.org",
+    "access_token": "token-123",
+}
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class FakeTransport:
+    """Transport stub recording sent messages and returning queued ones."""
+
+    def __init__(self):
+        self.sent = []
+        self.inbound = []
+        self.closed = False
+        self.fail = False
+
+    def send(self, sender, text):
+        if self.fail:
+            raise ConnectionError("connection reset")
+        self.sent.append((sender, text))
+
+    def poll(self):
+        inbound, self.inbound = self.inbound, []
+        return inbound
+
+    def close(self):
+        self.closed = True
+
+
+class FakeSocket:
+    """IRC server stub returning queued lines."""
+
+    def __init__(self, *lines):
+        self.written = []
+        self.chunks = ["".join(f"{line}\r\n" for line in lines).encode()]
+
+    def sendall(self, data):
+        self.written.append(data.decode().rstrip("\r\n"))
+
+    def recv(self, size):
+        if not self.chunks:
+            raise BlockingIOError()
+        return self.chunks.pop(0)
+
+    def settimeout(self, timeout):
+        pass
+
+    def close(self):
+        self.closed = True
+
+
+def _room(manager, name="General", private=False):
+    room = manager.create_room(name, "alice", private=private)
+    manager.add_member(room.room_id, "alice")
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestBridges:
+    """Tests for managing a room's bridges."""
+
+    def test_create_bridge(self):
+        """Test validation of settings and their defaults."""
+        irc = create_bridge("room-1", "irc", IRC_SETTINGS, "alice")
+        matrix = create_bridge("room-1", "matrix", MATRIX_SETTINGS, "alice")
+
+        assert irc["settings"] == dict(IRC_SETTINGS, port=6697, tls=True)
+        assert matrix["settings"]["homeserver"] == "https://matrix.example.org"
+        for protocol, settings, code in (
+            ("xmpp", IRC_SETTINGS, "INVALID_PROTOCOL"),
+            ("irc", dict(IRC_SETTINGS, channel="chat"), "INVALID_SETTINGS"),
+            ("irc", dict(IRC_SETTINGS, port=70000), "INVALID_SETTINGS"),
+            ("irc", dict(IRC_SETTINGS, nick="no spaces"), "INVALID_SETTINGS"),
+            ("matrix", dict(MATRIX_SETTINGS, room_id="abc"), "INVALID_SETTINGS"),
+            ("matrix", dict(MATRIX_SETTINGS, access_token=""), "INVALID_SETTINGS"),
+            ("irc", "irc.example.org", "INVALID_SETTINGS"),
+        ):
+            with pytest.raises(BridgeError) as error:
+                create_bridge("room-1", protocol, settings, "alice")
+            assert error.value.error_code == code
+
+    def test_only_the_owner_manages_bridges(self):
+        """Test permissions, private rooms, limits and disabled bridges."""
+        manager = RoomStateManager("node-a", bridges=True)
+        room_id = _room(manager)
+        manager.add_member(room_id, "bob")
+        private_id = _room(manager, "Secret", private=True)
+        for _ in range(3):
+            manager.add_bridge(room_id, "alice", "irc", IRC_SETTINGS)
+
+        for args, code in (
+            ((room_id, "bob", "irc", IRC_SETTINGS), "NOT_ALLOWED"),
+            ((room_id, "alice", "irc", IRC_SETTINGS), "TOO_MANY_BRIDGES"),
+            ((private_id, "alice", "irc", IRC_SETTINGS), "ROOM_PRIVATE"),
+            (("missing", "alice", "irc", IRC_SETTINGS), "ROOM_NOT_FOUND"),
+        ):
+            with pytest.raises(BridgeError) as error:
+                manager.add_bridge(*args)
+            assert error.value.error_code == code
+        with pytest.raises(BridgeError) as error:
+            manager.remove_bridge(room_id, "alice", "missing")
+        assert error.value.error_code == "BRIDGE_NOT_FOUND"
+
+        disabled = RoomStateManager("node-a")
+        with pytest.raises(BridgeError) as error:
+            disabled.add_bridge(_room(disabled), "alice", "irc", IRC_SETTINGS)
+        assert error.value.error_code == "BRIDGES_DISABLED"
+
+    def test_bridges_survive_restart_and_snapshot(self, tmp_path):
+        """Test that bridges are recovered from the log and snapshotted."""
+        manager = RoomStateManager(
+            "node-a", MessageLog(str(tmp_path)), bridges=True
+        )
+        room_id = _room(manager)
+        kept = manager.add_bridge(room_id, "alice", "matrix", MATRIX_SETTINGS)
+        removed = manager.add_bridge(room_id, "alice", "irc", IRC_SETTINGS)
+        manager.remove_bridge(room_id, "alice", removed["bridge_id"])
+
+        recovered = RoomStateManager(
+            "node-a", MessageLog(str(tmp_path)), bridges=True
+        )
+        recovered.recover_rooms()
+        snapshot = RoomSnapshot.from_room(recovered, room_id)
+        receiver = RoomStateManager("node-b", bridges=True)
+        receiver.restore_room(**snapshot.restore_args())
+
+        assert list(recovered.get_all_bridges()) == [kept["bridge_id"]]
+        restored = receiver.get_all_bridges()[kept["bridge_id"]]
+        assert restored["settings"]["access_token"] == "token-123"
+        listed = receiver.list_bridges(room_id, "alice")
+        assert "access_token" not in listed[0]["settings"]
+
+
+class TestTransports:
+    """Tests for the IRC and Matrix transports."""
+
+    def test_parse_irc_line(self):
+        """Test prefixes, commands and trailing parameters."""
+        assert parse_irc_line(":bob!b@host PRIVMSG #chat :hi there") == (
+            "bob!b@host",
+            "PRIVMSG",
+            ["#chat", "hi there"],
+        )
+        assert parse_irc_line("PING :irc.example.org") == (
+            "",
+            "PING",
+            ["irc.example.org"],
+        )
+        assert parse_irc_line("join #chat") == ("", "JOIN", ["#chat"])
+
+    def test_irc_transport(self):
+        """Test registration, pings, joining and channel messages."""
+        sock = FakeSocket(
+            ":irc.example.org 001 relay :Welcome",
+            "PING :token",
+            ":bob!b@host PRIVMSG #Chat :hello",
+            ":bob!b@host PRIVMSG relay :private",
+            ":relay!r@host PRIVMSG #chat :<alice> echo",
+        )
+        settings = dict(IRC_SETTINGS, port=6667, tls=False)
+        transport = IRCTransport(settings, lambda address, timeout: sock)
+
+        messages = transport.poll()
+        transport.send("alice", "one\ntwo")
+
+        assert messages == [("bob", "hello")]
+        assert sock.written == [
+            "NICK relay",
+            "USER relay 0 * :Chat room bridge",
+            "JOIN #chat",
+            "PONG :token",
+            "PRIVMSG #chat :<alice> one",
+            "PRIVMSG #chat :<alice> two",
+        ]
+
+    def test_irc_reads_bounded(self):
+        """Test reads capped per round and overlong lines disconnected."""
+        sock = FakeSocket()
+        sock.chunks = [b":bob!b@host PRIVMSG #chat :hi\r\n"] * 20
+        transport = IRCTransport(
+            dict(IRC_SETTINGS, port=6667, tls=False),
+            lambda address, timeout: sock,
+        )
+
+        assert len(transport.poll()) == MAX_READS_PER_POLL
+        assert len(transport.poll()) == 20 - MAX_READS_PER_POLL
+
+        sock.chunks = [b"x" * 4096] * (MAX_BUFFER // 4096 + 1)
+        with pytest.raises(ConnectionError):
+            transport.poll()
+        assert sock.closed
+
+    def test_internal_targets_refused(self):
+        """Test bridges to internal addresses refused before connecting."""
+        irc = create_bridge(
+            "r", "irc", dict(IRC_SETTINGS, server="127.0.0.1"), "a"
+        )
+        matrix = create_bridge(
+            "r",
+            "matrix",
+            dict(MATRIX_SETTINGS, homeserver="http://169.254.169.254"),
+            "a",
+        )
+
+        with patch("socket.socket") as sock:
+            for bridge in (irc, matrix):
+                with pytest.raises(EgressError):
+                    open_transport(bridge).poll()
+        sock.assert_not_called()
+        irc["settings"]["port"] = 1
+        allowed = EgressPolicy(["127.0.0.0/8"])
+        with pytest.raises(ConnectionRefusedError):
+            open_transport(irc, allowed).poll()
+
+    def test_matrix_transport(self):
+        """Test sending and syncing, skipping history and own messages."""
+        requests = []
+        timeline = [
+            {
+                "type": "m.room.message",
+                "sender": "@carol:example.org",
+                "content": {"msgtype": "m.text", "body": "hi"},
+            },
+            {
+                "type": "m.room.message",
+                "sender": "@relay:example.org",
+                "content": {"msgtype": "m.text", "body": "<alice> echo"},
+            },
+            {"type": "m.reaction", "sender": "@carol:example.org"},
+        ]
+
+        def request(method, url, token, body=None):
+            requests.append((method, url, token, body))
+            room = {"timeline": {"events": timeline}}
+            return {
+                "next_batch": f"batch-{len(requests)}",
+                "rooms": {"join": {"!abc:example.org": room}},
+            }
+
+        settings = create_bridge("r", "matrix", MATRIX_SETTINGS, "a")["settings"]
+        transport = MatrixTransport(settings, request)
+
+        history = transport.poll()
+        messages = transport.poll()
+        transport.send("alice", "hello")
+
+        assert history == []
+        assert messages == [("carol", "hi")]
+        assert "since=batch-1" in requests[1][1]
+        method, url, token, body = requests[2]
+        assert method == "PUT"
+        assert "/rooms/%21abc%3Aexample.org/send/m.room.message/" in url
+        assert token == "token-123"
+        assert body == {"msgtype": "m.text", "body": "<alice> hello"}
+
+
+class TestBridgeRelay:
+    """Tests for relaying messages between rooms and bridges."""
+
+    def test_relay_round(self):
+        """Test relaying new messages out and external messages in."""
+        manager = RoomStateManager("node-a", bridges=True)
+        room_id = _room(manager)
+        manager.add_message(room_id, "alice", "before the bridge")
+        bridge = manager.add_bridge(room_id, "alice", "irc", IRC_SETTINGS)
+        transports = []
+
+        def factory(record):
+            transports.append(FakeTransport())
+            return transports[-1]
+
+        bridges = BridgeManager(manager, factory)
+        assert bridges.relay_round() == []
+        manager.add_message(room_id, "alice", "hello irc")
+        manager.add_member(room_id, "bob[irc]")
+        manager.add_message(room_id, "bob[irc]", "from irc")
+        transports[0].inbound = [("bob", "hi room")]
+
+        inbound = bridges.relay_round()
+        transports[0].fail = True
+        manager.add_message(room_id, "alice", "lost connection")
+        bridges.relay_round()
+        bridges.relay_round()
+
+        assert inbound == [(room_id, "bob[irc]", "hi room")]
+        assert transports[0].sent == [("alice", "hello irc")]
+        assert transports[0].closed
+        assert transports[1].sent == [("alice", "lost connection")]
+        manager.remove_bridge(room_id, "alice", bridge["bridge_id"])
+        bridges.relay_round()
+        assert transports[1].closed
+
+    @pytest.mark.asyncio
+    async def test_puppets_post_messages(self):
+        """Test that a puppet joins once and its messages are broadcast."""
+        manager = RoomStateManager("node-a", bridges=True)
+        room_id = _room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+
+        assert await ws_server.post_bridged_message(room_id, "bob[irc]", "hi")
+        assert await ws_server.post_bridged_message(room_id, "bob[irc]", "again")
+        refused = await _request(
+            ws_server,
+            MockWebSocket(),
+            "join_room",
+            room_id=room_id,
+            username="eve[irc]",
+        )
+
+        joined = alice.received("member_joined")
+        assert [e["data"]["username"] for e in joined] == ["bob[irc]"]
+        messages = [m["data"] for m in alice.received("new_message")]
+        assert [(m["username"], m["content"]) for m in messages] == [
+            ("bob[irc]", "hi"),
+            ("bob[irc]", "again"),
+        ]
+        assert refused["data"]["error_code"] == "INVALID_USERNAME"
+
+
+class TestBridgeCommands:
+    """Tests for the bridge commands."""
+
+    @pytest.mark.asyncio
+    async def test_local_commands(self):
+        """Test add, list and remove on the admin node."""
+        manager = RoomStateManager("node-a", bridges=True)
+        room_id = _room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+
+        added = await _request(
+            ws_server,
+            alice,
+            "add_bridge",
+            room_id=room_id,
+            username="alice",
+            protocol="matrix",
+            settings=MATRIX_SETTINGS,
+        )
+        bridge_id = added["data"]["bridge"]["bridge_id"]
+        listed = await _request(
+            ws_server, alice, "list_bridges", room_id=room_id, username="alice"
+        )
+        removed = await _request(
+            ws_server,
+            alice,
+            "remove_bridge",
+            room_id=room_id,
+            username="alice",
+            bridge_id=bridge_id,
+        )
+        refused = await _request(
+            ws_server,
+            alice,
+            "add_bridge",
+            room_id=room_id,
+            username="alice",
+            protocol="xmpp",
+        )
+
+        assert added["type"] == "bridge_added"
+        assert "access_token" not in added["data"]["bridge"]["settings"]
+        assert listed["type"] == "bridges"
+        assert listed["data"]["bridges"][0]["protocol"] == "matrix"
+        assert removed["type"] == "bridge_removed"
+        assert removed["data"]["bridge_id"] == bridge_id
+        assert refused["type"] == "bridge_error"
+        assert refused["data"]["request_type"] == "add_bridge"
+        assert refused["data"]["error_code"] == "INVALID_PROTOCOL"
+
+    @pytest.mark.asyncio
+    async def test_add_through_admin(self):
+        """Test that another node forwards bridge commands to the admin."""
+        admin = RoomStateManager("node-a", bridges=True)
+        room_id = _room(admin)
+        admin.add_member(room_id, "bob", "node-b")
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+        alice = _join(ws_b, room_id, "alice")
+        bob = _join(ws_b, room_id, "bob")
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            added = await _request(
+                ws_b,
+                alice,
+                "add_bridge",
+                room_id=room_id,
+                username="alice",
+                protocol="irc",
+                settings=IRC_SETTINGS,
+            )
+            refused = await _request(
+                ws_b, bob, "list_bridges", room_id=room_id, username="bob"
+            )
+
+        assert added["type"] == "bridge_added"
+        assert admin.list_bridges(room_id, "alice")[0]["protocol"] == "irc"
+        assert refused["type"] == "bridge_error"
+        assert refused["data"]["error_code"] == "NOT_ALLOWED"
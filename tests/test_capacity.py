@@ -0,0 +1,188 @@
+"""
+Tests for Room Capacity Limits and Waiting Lists
+
+Tests for refusing joins to full rooms, waiting list positions, admitting
+waiting users as members leave (on the admin node and through the node
+they are connected to), and waiting lists moving with room snapshots.
+"""
+
+import asyncio
+import json
+
+import pytest
+
+from src.node import (
+    CapacityError,
+    RoomSnapshot,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.capacity import ROOM_FULL, WAITLISTED
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, max_members, waitlist=False):
+    room = manager.create_room(
+        "general", "alice", max_members=max_members, waitlist_enabled=waitlist
+    )
+    manager.add_member(room.room_id, "alice")
+    return room.room_id
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestRoomCapacity:
+    """Tests for capacity limits and waiting lists in the room state."""
+
+    def test_full_room_refused(self):
+        """Test that joins beyond max_members are refused."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, max_members=2)
+
+        assert manager.join_or_wait(room_id, "bob", "node-a") == 0
+        with pytest.raises(CapacityError) as full:
+            manager.join_or_wait(room_id, "carol", "node-a")
+
+        assert full.value.error_code == ROOM_FULL
+        assert sorted(manager.get_members(room_id)) == ["alice", "bob"]
+
+    def test_waitlist_positions(self):
+        """Test that waiting users are queued in order and keep their place."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, max_members=1, waitlist=True)
+
+        assert manager.join_or_wait(room_id, "bob", "node-b") == 1
+        assert manager.join_or_wait(room_id, "carol", "node-a") == 2
+        assert manager.join_or_wait(room_id, "bob", "node-b") == 1
+        assert manager.get_waitlist(room_id) == ["bob", "carol"]
+
+    def test_admit_next_skips_banned(self):
+        """Test that users banned while waiting are not admitted."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, max_members=2, waitlist=True)
+        manager.add_member(room_id, "bob")
+        manager.join_or_wait(room_id, "carol", "node-a")
+        manager.join_or_wait(room_id, "dave", "node-b")
+        manager.moderate_member(room_id, "alice", "carol", ban=True)
+        manager.remove_member(room_id, "bob")
+
+        assert manager.admit_next(room_id) == ("dave", "node-b")
+        assert manager.get_waitlist(room_id) == []
+        assert manager.admit_next(room_id) is None
+
+    def test_negative_limit_rejected(self):
+        """Test that max_members can't be negative."""
+        manager = RoomStateManager("node-a")
+
+        with pytest.raises(ValueError):
+            manager.create_room("general", "alice", max_members=-1)
+
+    def test_snapshot_carries_waitlist(self):
+        """Test that a handed-off room keeps its limit and waiting list."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, max_members=1, waitlist=True)
+        manager.join_or_wait(room_id, "bob", "node-b")
+
+        snapshot = RoomSnapshot.from_room(manager, room_id)
+        restored = RoomStateManager("node-b")
+        restored.restore_room(**snapshot.restore_args())
+
+        room = restored.get_room(room_id)
+        assert room.max_members == 1
+        assert restored.get_waitlist(room_id) == ["bob"]
+
+
+class TestWaitlistAdmission:
+    """Tests for admitting waiting users as slots free up."""
+
+    @pytest.mark.asyncio
+    async def test_local_user_admitted_on_leave(self):
+        """Test that a waiting client joins the room when a member leaves."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, max_members=2, waitlist=True)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        bob = MockWebSocket()
+        carol = MockWebSocket()
+        ws_server.connections.register(bob)
+        ws_server.connections.register(carol)
+        await _request(ws_server, bob, "join_room", room_id=room_id, username="bob")
+
+        waiting = await _request(
+            ws_server, carol, "join_room", room_id=room_id, username="carol"
+        )
+        assert waiting["type"] == "waitlist_joined"
+        assert waiting["data"]["position"] == 1
+
+        await _request(ws_server, bob, "leave_room", room_id=room_id, username="bob")
+        await asyncio.sleep(0)
+
+        assert sorted(manager.get_members(room_id)) == ["alice", "carol"]
+        assert carol.received("waitlist_admitted")[0]["room_id"] == room_id
+        assert ws_server._is_client_in_room(carol, room_id)
+
+    def test_remote_user_admitted_through_their_node(self):
+        """Test that the admin node tells the waiting user's node."""
+        ws_b = WebSocketServer(RoomStateManager("node-b"), "localhost", 0)
+        rpc_b = XMLRPCServer(ws_b.room_manager, "localhost", 0, "http://b")
+        rpc_b.set_admission_callback(ws_b.deliver_admission_sync)
+        carol = MockWebSocket()
+        ws_b.connections.register(carol)
+        ws_b.connections.set_username(carol, "carol")
+
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, max_members=2, waitlist=True)
+        admin.add_member(room_id, "bob", "node-a")
+        registry = LocalPeerRegistry(servers={"node-b": rpc_b})
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://a", registry)
+
+        result = admin_rpc.join_room(room_id, "carol", "node-b")
+        assert result["error_code"] == WAITLISTED
+        assert result["waitlist_position"] == 1
+
+        admin_rpc.leave_room(room_id, "bob", "node-a")
+
+        assert sorted(admin.get_members(room_id)) == ["alice", "carol"]
+        assert ws_b._is_client_in_room(carol, room_id)
+        assert carol.received("waitlist_admitted")[0]["max_members"] == 2
+
+    def test_disconnected_user_skipped(self):
+        """Test that a slot goes to the next user if one has left."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, max_members=2, waitlist=True)
+        admin.add_member(room_id, "bob", "node-a")
+        admin_rpc = XMLRPCServer(
+            admin, "localhost", 0, "http://a", LocalPeerRegistry()
+        )
+        admin_rpc.join_room(room_id, "carol", "node-gone")
+        admin_rpc.join_room(room_id, "dave", "node-gone")
+
+        admin_rpc.leave_room(room_id, "bob", "node-a")
+
+        assert admin.get_members(room_id) == ["alice"]
+        assert admin.get_waitlist(room_id) == []
@@ -0,0 +1,123 @@
+"""
+Tests for the Message Catalog
+
+Tests for the catalog covering every command the WebSocket server
+handles, validation and error response types driven by it, the JSON
+Schemas and the protocol_info command.
+"""
+
+import json
+
+import pytest
+
+from src.node import AuthManager, RoomStateManager, WebSocketServer
+from src.node.schemas import CLIENT_PROTOCOL_VERSION, COMMAND_CATALOG
+from src.node.schemas.responses import ERROR_RESPONSE_TYPES
+from src.node.utils.validation import REQUIRED_FIELDS, validate_request_fields
+from src.node.versioning import PROTOCOL_VERSION
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+async def _request(ws_server, message_type, data):
+    websocket = MockWebSocket()
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestCatalog:
+    """Tests for the catalog's contents."""
+
+    def test_covers_every_handler(self):
+        """Test that the catalog and the server's handlers match."""
+        ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 0)
+
+        assert set(COMMAND_CATALOG) == set(ws_server._handlers)
+        for message_type, spec in COMMAND_CATALOG.items():
+            assert set(spec.required) <= set(spec.fields), message_type
+
+    def test_drives_validation(self):
+        """Test required fields, field types and error response types."""
+        wrong_type = validate_request_fields(
+            {
+                "type": "search",
+                "data": {"room_id": "r1", "username": "bob", "query": 5},
+            }
+        )
+        boolean = validate_request_fields(
+            {"type": "protocol_info", "data": {"schemas": 1}}
+        )
+        unchecked = validate_request_fields(
+            {"type": "update_mutes", "data": {"username": "bob", "mute_rooms": "r1"}}
+        )
+
+        assert REQUIRED_FIELDS["react"] == COMMAND_CATALOG["react"].required
+        assert ERROR_RESPONSE_TYPES["search"] == "search_error"
+        assert wrong_type["field"] == "query"
+        assert wrong_type["error_code"] == "INVALID_REQUEST"
+        assert boolean["field"] == "schemas"
+        assert unchecked is None
+
+    def test_json_schema(self):
+        """Test the JSON Schema of a command."""
+        schema = COMMAND_CATALOG["set_status"].json_schema("set_status")
+
+        assert schema["title"] == "set_status"
+        assert schema["properties"]["type"] == {"const": "set_status"}
+        data = schema["properties"]["data"]
+        assert data["required"] == ["username", "status"]
+        assert data["properties"]["status"] == {"type": "string", "minLength": 1}
+
+
+class TestProtocolInfoCommand:
+    """Tests for the protocol_info command."""
+
+    @pytest.mark.asyncio
+    async def test_protocol_info(self):
+        """Test the versions, commands and events, with and without schemas."""
+        ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 0)
+
+        plain = await _request(ws_server, "protocol_info", {})
+        with_schemas = await _request(ws_server, "protocol_info", {"schemas": True})
+
+        assert plain["type"] == "protocol_info"
+        info = plain["data"]
+        assert info["protocol_version"] == CLIENT_PROTOCOL_VERSION
+        assert info["node_protocol_version"] == PROTOCOL_VERSION
+        assert info["node_id"] == "node1"
+        assert info["commands"]["send_message"]["error"] == "message_error"
+        assert info["commands"]["join_room"]["since"] == 1
+        assert "schema" not in info["commands"]["join_room"]
+        assert "new_message" in info["events"]
+        schema = with_schemas["data"]["commands"]["join_room"]["schema"]
+        assert schema["properties"]["data"]["required"] == ["room_id", "username"]
+
+    @pytest.mark.asyncio
+    async def test_only_handled_commands_without_session(self):
+        """Test protocol_info before login and a server missing a command."""
+        auth = AuthManager("node1", "secret", True, password_iterations=1)
+        ws_server = WebSocketServer(
+            RoomStateManager("node1"), "localhost", 0, auth=auth
+        )
+        del ws_server._handlers["update_mutes"]
+
+        response = await _request(ws_server, "protocol_info", {})
+        refused = await _request(ws_server, "list_rooms", {})
+
+        assert response["type"] == "protocol_info"
+        assert "update_mutes" not in response["data"]["commands"]
+        assert "login" in response["data"]["commands"]
+        assert refused["type"] == "auth_error"
@@ -0,0 +1,198 @@
+"""
+Tests for the Command-Line Chat Client
+
+Tests for the commands of the line-oriented client (login, room listing,
+creation and joining, sending messages) and its live view of incoming
+messages.
+"""
+
+import asyncio
+import json
+import pytest
+
+from src.client import ChatClient
+from src.client.cli import ChatCLI, format_message
+
+
+class MockWebSocket:
+    """Mock WebSocket whose incoming messages are fed by the test."""
+
+    def __init__(self, *responses):
+        self.sent_messages = []
+        self.incoming = asyncio.Queue()
+        for response in responses:
+            self.push(response)
+
+    def push(self, message):
+        self.incoming.put_nowait(json.dumps(message))
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+    async def recv(self):
+        return await self.incoming.get()
+
+    def __aiter__(self):
+        return self
+
+    async def __anext__(self):
+        return await self.incoming.get()
+
+    async def close(self):
+        pass
+
+
+def _response(message_type, **data):
+    return {"type": message_type, "data": data}
+
+
+def _room(room_id="r1", room_name="General", members=("alice",)):
+    return _response(
+        "join_room_success",
+        room_id=room_id,
+        room_name=room_name,
+        description=None,
+        members=list(members),
+        member_count=len(members),
+        admin_node="node-a",
+    )
+
+
+def _cli(*responses, username=None):
+    websocket = MockWebSocket(*responses)
+    client = ChatClient("ws://localhost:8080")
+    client._set_test_mode(websocket)
+    if username:
+        client.set_username(username)
+    lines = []
+    return ChatCLI(client, lines.append), websocket, lines
+
+
+class TestCommands:
+    """Tests for the /commands."""
+
+    @pytest.mark.asyncio
+    async def test_login(self):
+        """Test that /login stores the session and the username."""
+        cli, websocket, lines = _cli(_response("login_success", token="t0k"))
+
+        await cli.execute("/login alice hunter2")
+
+        assert websocket.sent_messages[0]["type"] == "login"
+        assert cli.client.session_token == "t0k"
+        assert cli.client.username == "alice"
+        assert lines == ["Logged in as alice"]
+
+    @pytest.mark.asyncio
+    async def test_errors_are_printed(self):
+        """Test that rejected commands print the node's error."""
+        cli, _, lines = _cli(_response("login_error", error="Invalid credentials"))
+
+        assert await cli.execute("/login alice wrong")
+        assert await cli.execute("/login alice")
+        assert await cli.execute("/frobnicate")
+
+        assert lines == [
+            "Error: Invalid credentials",
+            "Usage: /login <username> <password>",
+            "Unknown command /frobnicate; type /help",
+        ]
+
+    @pytest.mark.asyncio
+    async def test_rooms(self):
+        """Test that /rooms lists the node's rooms."""
+        rooms = [
+            {
+                "room_id": "r1",
+                "room_name": "General",
+                "member_count": 2,
+                "admin_node": "node-a",
+            }
+        ]
+        cli, _, lines = _cli(_response("rooms_list", rooms=rooms, total_count=1))
+
+        await cli.execute("/rooms")
+
+        assert lines == ["r1  General (2 members)"]
+
+    @pytest.mark.asyncio
+    async def test_create_joins_room(self):
+        """Test that /create creates a room and joins it."""
+        created = _response(
+            "room_created",
+            room_id="r1",
+            room_name="Team chat",
+            admin_node="node-a",
+            members=["alice"],
+            created_at="2025-11-24T15:47:37Z",
+        )
+        cli, websocket, lines = _cli(
+            created, _room(room_name="Team chat"), username="alice"
+        )
+
+        await cli.execute("/create Team chat")
+        await cli.close()
+
+        assert websocket.sent_messages[0]["data"]["room_name"] == "Team chat"
+        assert websocket.sent_messages[1]["type"] == "join_room"
+        assert cli.client.current_room == "r1"
+        assert lines == [
+            "Created Team chat (r1)",
+            "Joined Team chat with 1 members: alice",
+        ]
+
+    @pytest.mark.asyncio
+    async def test_quit(self):
+        """Test that /quit ends the input loop."""
+        cli, _, _ = _cli()
+
+        assert await cli.execute("/quit") is False
+
+
+class TestMessaging:
+    """Tests for sending and the live view."""
+
+    @pytest.mark.asyncio
+    async def test_plain_lines_sent_to_room(self):
+        """Test that lines without a slash are sent to the current room."""
+        cli, websocket, lines = _cli(_room(), username="alice")
+
+        await cli.execute("hello?")
+        await cli.execute("/join r1")
+        await cli.execute("hello everyone")
+        await cli.close()
+
+        assert lines[0] == "Join a room first (/rooms, /join <room_id>)"
+        sent = websocket.sent_messages[-1]
+        assert sent["type"] == "send_message"
+        assert sent["data"]["room_id"] == "r1"
+        assert sent["data"]["content"] == "hello everyone"
+
+    @pytest.mark.asyncio
+    async def test_live_view(self):
+        """Test that messages and joins in the room are printed as they come."""
+        cli, websocket, lines = _cli(_room(), username="alice")
+        await cli.execute("/join r1")
+
+        websocket.push(_response("member_joined", room_id="r1", username="bob"))
+        websocket.push(
+            _response(
+                "new_message",
+                room_id="r1",
+                message_id="m1",
+                username="bob",
+                content="hi alice",
+                sequence_number=1,
+                timestamp="2025-11-24T15:47:37+00:00",
+            )
+        )
+        await asyncio.sleep(0.05)
+        await cli.close()
+
+        assert lines[1:] == ["* bob joined", "[15:47:37] bob: hi alice"]
+
+    def test_format_message_without_timestamp(self):
+        """Test that messages with no valid timestamp still format."""
+        assert format_message({"username": "bob", "content": "hey"}) == (
+            "[--:--:--] bob: hey"
+        )
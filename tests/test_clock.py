@@ -0,0 +1,129 @@
+"""
+Tests for Lamport and Hybrid Logical Clocks
+
+Tests for the clocks' ordering guarantees, the HLC wire format, and the
+timestamps on messages and membership events.
+"""
+
+from src.node import (
+    HLCTimestamp,
+    HybridLogicalClock,
+    LamportClock,
+    RoomStateManager,
+    XMLRPCServer,
+)
+
+
+class FakeTime:
+    """Wall clock set by the test, in seconds."""
+
+    def __init__(self, now=1700000000.0):
+        self.now = now
+
+    def __call__(self):
+        return self.now
+
+
+class TestLamportClock:
+    """Tests for Lamport clocks."""
+
+    def test_tick_and_update(self):
+        """Test that received timestamps advance the clock past them."""
+        clock = LamportClock()
+
+        assert clock.tick() == 1
+        assert clock.update(10) == 11
+        assert clock.update(3) == 12
+        assert clock.value == 12
+
+
+class TestHybridLogicalClock:
+    """Tests for hybrid logical clocks."""
+
+    def test_follows_wall_clock(self):
+        """Test that timestamps use the wall time when it advances."""
+        time = FakeTime()
+        clock = HybridLogicalClock("node-a", time)
+
+        first = clock.now()
+        time.now += 0.005
+        second = clock.now()
+
+        assert first == HLCTimestamp(1700000000000, 0, "node-a")
+        assert second == HLCTimestamp(1700000000005, 0, "node-a")
+
+    def test_monotonic_when_wall_clock_goes_back(self):
+        """Test that a wall clock stepping back doesn't reorder events."""
+        time = FakeTime()
+        clock = HybridLogicalClock("node-a", time)
+        first = clock.now()
+
+        time.now -= 10
+        second = clock.now()
+        third = clock.now()
+
+        assert first < second < third
+        assert third == HLCTimestamp(first.wall, 2, "node-a")
+
+    def test_update_orders_after_remote(self):
+        """Test that events after a receipt are ordered after the sender's."""
+        time = FakeTime()
+        clock = HybridLogicalClock("node-a", time)
+        remote = HLCTimestamp(1700000005000, 7, "node-b")
+
+        received = clock.update(remote)
+        after = clock.now()
+
+        assert received == HLCTimestamp(1700000005000, 8, "node-a")
+        assert remote < received < after
+
+    def test_update_ignores_malformed_timestamps(self):
+        """Test that missing or malformed timestamps don't break the clock."""
+        clock = HybridLogicalClock("node-a", FakeTime())
+        first = clock.update(None)
+
+        assert clock.update("garbage") > first
+
+    def test_wire_format_sorts_like_timestamps(self):
+        """Test encoding, decoding and ordering of encoded timestamps."""
+        stamps = [
+            HLCTimestamp(1700000000000, 12, "node-b"),
+            HLCTimestamp(1700000000000, 2, "node.c"),
+            HLCTimestamp(999, 0, "node-a"),
+        ]
+        encoded = [stamp.encode() for stamp in stamps]
+
+        assert encoded[1] == "001700000000000.000002.node.c"
+        assert [HLCTimestamp.decode(e) for e in encoded] == stamps
+        assert sorted(encoded) == [s.encode() for s in sorted(stamps)]
+        assert HLCTimestamp.from_dict(stamps[0].to_dict()) == stamps[0]
+
+
+class TestStamping:
+    """Tests for timestamps on messages and events."""
+
+    def test_messages_stamped_in_order(self):
+        """Test that the admin stamps each message with an increasing HLC."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        manager.add_member(room.room_id, "alice")
+
+        first = manager.add_message(room.room_id, "alice", "one")
+        second = manager.add_message(room.room_id, "alice", "two")
+
+        assert first["hlc"].endswith(".node-a")
+        assert first["hlc"] < second["hlc"]
+
+    def test_received_broadcast_updates_clock(self):
+        """Test that member nodes order their events after received ones."""
+        manager = RoomStateManager("node-b")
+        server = XMLRPCServer(manager, "localhost", 0, "http://node-b")
+        ahead = HLCTimestamp(manager.clock.now().wall + 5000, 3, "node-a")
+
+        server.receive_member_event_broadcast(
+            "room-1",
+            "member_joined",
+            {"username": "alice", "member_count": 1, "hlc": ahead.encode()},
+        )
+
+        assert manager.clock.now() > ahead
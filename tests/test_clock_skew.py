@@ -0,0 +1,126 @@
+"""
+Tests for Clock Skew Detection
+
+Tests for estimating a peer's clock skew from heartbeat samples, the
+warnings about skewed peers, the estimates given to the hybrid logical
+clock, and heartbeats carrying the wall clock between nodes.
+"""
+
+import logging
+import time
+
+import pytest
+
+from src.node import (
+    ClockSkewMonitor,
+    FailureDetector,
+    HLCTimestamp,
+    HybridLogicalClock,
+    NodeMetrics,
+    PeerRegistry,
+    RoomStateManager,
+    XMLRPCServer,
+)
+
+
+class RecordingHandler(logging.Handler):
+    """Log handler keeping the messages of records at WARNING or above."""
+
+    def __init__(self, name):
+        super().__init__(logging.WARNING)
+        self.logger = logging.getLogger(name)
+        self.warnings = []
+
+    def emit(self, record):
+        self.warnings.append(record.getMessage())
+
+    def __enter__(self):
+        self.logger.addHandler(self)
+        return self
+
+    def __exit__(self, *exc):
+        self.logger.removeHandler(self)
+
+
+class SkewedPeerRegistry:
+    """Peer registry whose one peer's clock runs 30 s ahead."""
+
+    def list_peers(self):
+        return {"node-b": "http://node-b:9090"}
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        return {"status": "ok", "node_id": node_id, "clock": time.time() + 30}
+
+
+class TestEstimates:
+    """Tests for the estimates and warnings."""
+
+    def test_shortest_round_trip_wins(self):
+        """Test the estimate, its error and warnings crossing the threshold."""
+        monitor = ClockSkewMonitor(threshold=1.0, samples=3)
+        with RecordingHandler("src.node.clock_skew") as handler:
+            first = monitor.record("node-b", 100.0, 105.2, 100.4)
+            monitor.record("node-b", 200.0, 204.95, 200.1)
+            monitor.record("node-b", 300.0, 305.0, 300.6)
+            skewed = monitor.status("node-b")
+            for n in range(3):
+                monitor.record("node-b", 400.0 + n, 400.0 + n, 400.0 + n)
+
+        assert first == pytest.approx(5.0)
+        assert skewed["skew"] == pytest.approx(4.9)
+        assert skewed["error"] == pytest.approx(0.05)
+        assert (skewed["samples"], skewed["skewed"]) == (3, True)
+        assert len(handler.warnings) == 1
+        assert "node-b is 5.000 s ahead of" in handler.warnings[0]
+        assert monitor.status("node-b")["skewed"] is False
+        assert monitor.estimates() == {"node-b": 0.0}
+        assert monitor.status("node-c") is None
+
+    def test_clock_warns_beyond_known_skew(self):
+        """Test that the HLC only warns about drift skew doesn't explain."""
+        clock = HybridLogicalClock("node-a", lambda: 1700000000.0, 1000)
+        monitor = ClockSkewMonitor(clock=clock)
+        monitor.record("node-b", 1699999995.0, 1700000000.0, 1699999995.0)
+        wall = 1700000000000
+        with RecordingHandler("src.node.clock") as handler:
+            clock.update(HLCTimestamp(wall + 5500, 0, "node-b"))
+            clock.update(HLCTimestamp(wall + 7000, 0, "node-b"))
+            clock.update(HLCTimestamp(wall + 5500, 0, "node-c"))
+
+        assert len(handler.warnings) == 2
+        assert "node-b is 7000 ms ahead" in handler.warnings[0]
+        assert "node-c" in handler.warnings[1]
+
+
+class TestHeartbeats:
+    """Tests for heartbeats carrying the wall clock."""
+
+    @pytest.mark.asyncio
+    async def test_skew_measured_by_heartbeats(self):
+        """Test a skewed peer, a real one, and the exported estimates."""
+        metrics = NodeMetrics()
+        detector = FailureDetector("node-a", SkewedPeerRegistry())
+        metrics.track_clock_skew(detector.skew_monitor)
+        server = XMLRPCServer(RoomStateManager("node-c"), "127.0.0.1", 0, "")
+        server.start()
+        registry = PeerRegistry("node-a")
+        registry.register_peer(
+            "node-c", f"http://127.0.0.1:{server.server.server_address[1]}"
+        )
+        local = FailureDetector("node-a", registry)
+        try:
+            await detector.probe_all()
+            await local.probe_all()
+        finally:
+            server.stop()
+
+        skewed = detector.skew_monitor.status("node-b")
+        assert skewed["skew"] == pytest.approx(30, abs=0.5)
+        assert skewed["skewed"] is True
+        assert abs(local.skew_monitor.status("node-c")["skew"]) < 0.5
+        (line,) = [
+            line
+            for line in metrics.registry.render().splitlines()
+            if line.startswith('chat_peer_clock_skew_seconds{peer="node-b"}')
+        ]
+        assert float(line.split()[-1]) == pytest.approx(30, abs=0.5)
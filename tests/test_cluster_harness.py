@@ -0,0 +1,185 @@
+"""
+Tests for the Cluster Test Harness
+
+Tests for the invariant checks, and end-to-end runs of joins, partitions,
+2PC deletion and failover with fake clients on an in-process cluster, plus
+the commands driving a docker-compose cluster.
+"""
+
+import pytest
+
+from src.node.cluster_harness import (
+    ClusterHarness,
+    ComposeCluster,
+    InvariantViolation,
+    delivery_violations,
+    membership_violations,
+)
+
+
+class TestInvariants:
+    """Tests for the invariant checks."""
+
+    def test_lost_and_duplicated_messages(self):
+        """Test that missing and repeated message IDs are reported."""
+        delivered = {
+            "alice": [{"message_id": "m1"}, {"message_id": "m2"}],
+            "bob": [{"message_id": "m1"}, {"message_id": "m1"}],
+        }
+
+        violations = delivery_violations(
+            {"alice": ["m1", "m2"], "bob": ["m1", "m2"]}, delivered
+        )
+
+        assert violations == [
+            "bob never got message m2",
+            "bob got message m1 2 times",
+        ]
+        assert delivery_violations({"alice": ["m2"]}, delivered) == []
+
+    def test_membership_divergence(self):
+        """Test that views differing from the admin's are reported."""
+        views = {
+            "node1": ["alice", "bob"],
+            "node2": ["bob", "alice"],
+            "node3": ["alice"],
+        }
+
+        assert membership_violations(views, "node1") == [
+            "node3 has members ['alice'] but node1 has ['alice', 'bob']"
+        ]
+
+
+class TestClusterHarness:
+    """End-to-end runs on an in-process cluster."""
+
+    def test_joins_and_messages(self):
+        """Test clients on every node seeing each message once."""
+        with ClusterHarness(seed=1) as cluster:
+            alice = cluster.connect("node1", "alice")
+            bob = cluster.connect("node2", "bob")
+            carol = cluster.connect("node3", "carol")
+            room_id = alice.create_room("General")
+            assert bob.join(room_id)["success"]
+            assert alice.send(room_id, "hello")["success"]
+            assert carol.join(room_id)["success"]
+            for client in (alice, bob, carol):
+                assert client.send(room_id, f"hi from {client.username}")[
+                    "success"
+                ]
+
+            cluster.check(room_id)
+
+            assert len(bob.messages(room_id)) == 4
+            assert len(carol.messages(room_id)) == 3
+            assert cluster.membership_views(room_id)["node2"] == [
+                "alice",
+                "bob",
+                "carol",
+            ]
+
+    def test_partition_refuses_sends_until_healed(self):
+        """Test refused sends, and broadcasts lost in a partition found."""
+        with ClusterHarness(seed=2) as cluster:
+            alice = cluster.connect("node1", "alice")
+            carol = cluster.connect("node3", "carol")
+            room_id = alice.create_room("General")
+            carol.join(room_id)
+
+            cluster.partition({"node1", "node2"}, {"node3"})
+            refused = carol.send(room_id, "anyone there?")
+            assert alice.send(room_id, "quiet today")["success"]
+            cluster.settle()
+            cluster.heal()
+            assert carol.send(room_id, "back")["success"]
+
+            assert refused["error_code"] == "PEER_UNAVAILABLE"
+            with pytest.raises(InvariantViolation) as error:
+                cluster.check(room_id)
+            # The lost broadcast also holds back the next one (causal order)
+            assert error.value.violations == [
+                f"carol never got message {message_id}"
+                for message_id in cluster.accepted[room_id]
+            ]
+
+    @pytest.mark.asyncio
+    async def test_two_phase_delete(self):
+        """Test a deletion aborted by a partition and then committed."""
+        with ClusterHarness(seed=3) as cluster:
+            alice = cluster.connect("node1", "alice")
+            bob = cluster.connect("node2", "bob")
+            room_id = alice.create_room("General")
+            bob.join(room_id)
+
+            cluster.partition({"node1", "node2"}, {"node3"})
+            aborted = await alice.delete_room(room_id)
+            cluster.heal()
+            committed = await alice.delete_room(room_id)
+            cluster.settle()
+
+            assert aborted is False
+            assert committed is True
+            assert cluster.admin_of(room_id) is None
+            assert cluster.membership_views(room_id) == {}
+            deleted = bob.events(room_id, "room_deleted")
+            assert [event["data"]["room_id"] for event in deleted] == [room_id]
+
+    def test_failover_keeps_messages(self):
+        """Test an admin crash: a follower takes over, nothing is lost."""
+        with ClusterHarness(seed=5) as cluster:
+            alice = cluster.connect("node1", "alice")
+            bob = cluster.connect("node2", "bob")
+            carol = cluster.connect("node3", "carol")
+            room_id = alice.create_room("General")
+            bob.join(room_id)
+            carol.join(room_id)
+            bob.send(room_id, "before")
+            cluster.settle()
+
+            cluster.crash("node1")
+            cluster.detect_failures()
+            admin = cluster.wait_for_admin(room_id)
+            assert bob.send(room_id, "after")["success"]
+
+            assert admin in ("node2", "node3")
+            assert cluster.running() == ["node2", "node3"]
+            cluster.check(room_id)
+            assert [m["content"] for m in carol.messages(room_id)] == [
+                "before",
+                "after",
+            ]
+
+
+class TestComposeCluster:
+    """Tests for driving the docker-compose cluster."""
+
+    def test_commands(self):
+        """Test the docker commands for the lifecycle and faults."""
+        commands = []
+        with ComposeCluster(runner=commands.append) as cluster:
+            cluster.crash("node2")
+            cluster.recover("node2")
+            cluster.isolate("node3")
+            cluster.rejoin("node3")
+            url = cluster.ws_url("node3")
+
+        compose = ["docker", "compose", "-f", "docker-compose.yml"]
+        compose += ["-p", "chat-cluster"]
+        network = "chat-cluster_chat-network"
+        assert commands == [
+            compose + ["up", "-d", "--build", "--wait"],
+            compose + ["kill", "node2"],
+            compose + ["start", "node2"],
+            ["docker", "network", "disconnect", network, "chat-node3"],
+            [
+                "docker",
+                "network",
+                "connect",
+                "--alias",
+                "node3",
+                network,
+                "chat-node3",
+            ],
+            compose + ["down", "--remove-orphans"],
+        ]
+        assert url == "ws://localhost:8083"
@@ -0,0 +1,237 @@
+"""
+Tests for Log Compaction
+
+Tests for parsing retention policies and applying their count, age and
+size limits, compacting rooms on each storage backend, recovering
+compacted rooms after a restart, per-room policies, and the compaction
+settings.
+"""
+
+import os
+from datetime import datetime
+
+import pytest
+
+from src.node import (
+    Compactor,
+    MemoryStorage,
+    MessageLog,
+    RetentionPolicy,
+    RoomStateManager,
+    SQLiteStorage,
+)
+from src.node.compaction import parse_retention, parse_room_retention
+from src.node.config import NodeConfig
+
+
+def _message(n, timestamp="2026-01-01T00:00:00+00:00"):
+    return {"message_id": f"m{n}", "content": "x" * 10, "timestamp": timestamp}
+
+
+def _room_with_messages(manager, name, count):
+    room = manager.create_room(name, "alice")
+    manager.add_member(room.room_id, "alice")
+    manager.add_member(room.room_id, "bob")
+    for n in range(count):
+        manager.add_message(room.room_id, "alice", f"message {n}")
+    return room.room_id
+
+
+class TestRetentionPolicy:
+    """Tests for parsing and applying retention policies."""
+
+    def test_parse_limits(self):
+        """Test that limits are parsed with their units."""
+        policy = parse_retention(["count=100", "age=2h", "size=1K"])
+
+        assert policy == RetentionPolicy(
+            max_messages=100, max_age=7200.0, max_bytes=1024
+        )
+        assert parse_retention([]).unlimited
+        rooms = parse_room_retention(["general:count=5", "general:age=1d"])
+        assert rooms == {
+            "general": RetentionPolicy(max_messages=5, max_age=86400.0)
+        }
+
+    def test_invalid_limits_rejected(self):
+        """Test that unknown, malformed and non-positive limits fail."""
+        for limits in (["count"], ["ttl=5"], ["age=5w"], ["size=0"]):
+            with pytest.raises(ValueError):
+                parse_retention(limits)
+        with pytest.raises(ValueError):
+            parse_room_retention(["count=5"])
+
+    def test_count_and_size_keep_newest(self):
+        """Test that the newest messages within the limits are kept."""
+        messages = [_message(n) for n in range(10)]
+        size = len(
+            '{"message_id": "m0", "content": "xxxxxxxxxx", '
+            '"timestamp": "2026-01-01T00:00:00+00:00"}'
+        )
+
+        by_count = RetentionPolicy(max_messages=3).retain(messages)
+        by_size = RetentionPolicy(max_bytes=size * 2).retain(messages)
+
+        assert [m["message_id"] for m in by_count] == ["m7", "m8", "m9"]
+        assert [m["message_id"] for m in by_size] == ["m8", "m9"]
+
+    def test_age_keeps_recent(self):
+        """Test that messages older than the age limit are dropped."""
+        now = datetime.fromisoformat("2026-01-02T00:00:00+00:00").timestamp()
+        messages = [
+            _message(0, "2026-01-01T00:00:00+00:00"),
+            _message(1, "2026-01-01T23:00:00+00:00"),
+            _message(2, "2026-01-01T23:59:00+00:00"),
+        ]
+
+        kept = RetentionPolicy(max_age=3600).retain(messages, now)
+
+        assert [m["message_id"] for m in kept] == ["m1", "m2"]
+
+
+class TestCompaction:
+    """Tests for compacting rooms in storage."""
+
+    def test_wal_replaces_old_segments(self, tmp_path):
+        """Test that the WAL keeps one new segment and recovers from it."""
+        log = MessageLog(str(tmp_path), segment_size=256)
+        manager = RoomStateManager("node1", log)
+        room_id = _room_with_messages(manager, "general", 10)
+        manager.moderate_member(room_id, "alice", "bob", ban=True)
+        room_dir = tmp_path / "rooms" / room_id
+        old_segments = sorted(os.listdir(room_dir))
+        assert len(old_segments) > 1
+
+        dropped = manager.compact_room(
+            room_id, RetentionPolicy(max_messages=3)
+        )
+        manager.add_message(room_id, "alice", "after")
+        log.close()
+
+        assert dropped == 7
+        segments = sorted(os.listdir(room_dir))
+        assert segments[0] > old_segments[-1]
+        assert [m["content"] for m in manager.get_room(room_id).messages] == [
+            "message 7",
+            "message 8",
+            "message 9",
+            "after",
+        ]
+        restarted = RoomStateManager("node1", MessageLog(str(tmp_path)))
+        assert restarted.recover_rooms() == 1
+        room = restarted.get_room(room_id)
+        assert [m["content"] for m in room.messages] == [
+            "message 7",
+            "message 8",
+            "message 9",
+            "after",
+        ]
+        assert room.banned == {"bob"}
+        assert room.message_counter == 11
+
+    def test_snapshot_records_membership(self):
+        """Test that the snapshot holds the room's current members."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room_with_messages(manager, "general", 4)
+        manager.mark_read(room_id, "bob", 4)
+
+        manager.compact_room(room_id, RetentionPolicy(max_messages=1))
+
+        (record,) = storage.records(room_id)
+        assert record["type"] == "snapshot"
+        assert record["room"]["members"] == ["alice", "bob"]
+        assert record["room"]["read_positions"] == {"bob": 4}
+        assert [m["sequence_number"] for m in record["messages"]] == [4]
+
+    def test_sqlite(self, tmp_path):
+        """Test that SQLite compaction survives a restart."""
+        path = str(tmp_path / "node.db")
+        manager = RoomStateManager("node1", SQLiteStorage(path))
+        room_id = _room_with_messages(manager, "general", 5)
+
+        manager.compact_room(room_id, RetentionPolicy(max_messages=2))
+        manager.message_log.close()
+
+        storage = SQLiteStorage(path)
+        assert len(list(storage.records(room_id))) == 1
+        restarted = RoomStateManager("node1", storage)
+        restarted.recover_rooms()
+        history = restarted.get_room(room_id).messages
+        assert [m["content"] for m in history] == ["message 3", "message 4"]
+
+    def test_nothing_dropped_writes_nothing(self):
+        """Test that rooms within their policy are left alone."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room_with_messages(manager, "general", 2)
+        before = list(storage.records(room_id))
+
+        dropped = manager.compact_room(
+            room_id, RetentionPolicy(max_messages=5)
+        )
+
+        assert dropped == 0
+        assert list(storage.records(room_id)) == before
+        assert RoomStateManager("node1").compact_room(
+            room_id, RetentionPolicy(max_messages=5)
+        ) is None
+
+
+class TestCompactor:
+    """Tests for compaction rounds."""
+
+    def test_room_policies_override_default(self):
+        """Test that rooms use their own policy by ID or name."""
+        manager = RoomStateManager("node1", MemoryStorage())
+        general = _room_with_messages(manager, "general", 6)
+        random = _room_with_messages(manager, "random", 6)
+        quiet = _room_with_messages(manager, "quiet", 6)
+        compactor = Compactor(
+            manager,
+            RetentionPolicy(max_messages=4),
+            {
+                "general": RetentionPolicy(max_messages=1),
+                random: RetentionPolicy(max_messages=2),
+                "quiet": RetentionPolicy(),
+            },
+        )
+
+        compacted = compactor.run_round()
+
+        assert compacted == {general: 5, random: 4}
+        assert len(manager.get_room(quiet).messages) == 6
+        assert compactor.run_round() == {}
+
+    def test_failure_keeps_records(self):
+        """Test that a failed compaction keeps the room's records."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room_with_messages(manager, "general", 3)
+
+        def fail(room_id, record):
+            raise OSError("disk full")
+
+        storage.compact = fail
+        compactor = Compactor(manager, RetentionPolicy(max_messages=1))
+
+        assert compactor.run_round() == {}
+        assert len(storage.messages(room_id)) == 3
+        assert len(manager.get_room(room_id).messages) == 3
+
+
+class TestConfig:
+    """Tests for the compaction settings."""
+
+    def test_invalid_retention(self):
+        """Test that bad retention limits fail validation."""
+        errors = NodeConfig(
+            retention=["count=-1"], room_retention=["general"]
+        ).validate()
+        interval = NodeConfig(compaction_interval=0).validate()
+
+        assert any("count=-1" in error for error in errors)
+        assert NodeConfig(
+            retention=["count=10"], room_retention=["general:age=1h"]
+        ).validate() == []
+        assert any("compaction_interval" in error for error in interval)
@@ -0,0 +1,207 @@
+"""
+Tests for Message Compression
+
+Tests for choosing, applying and undoing content encodings, for the
+compressed XML-RPC bodies nodes exchange, and for permessage-deflate on
+WebSocket connections skipping small messages.
+"""
+
+import gzip
+import http.client
+import xmlrpc.client
+from types import SimpleNamespace
+
+import pytest
+
+from src.node import NodeMetrics, RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node import websocket_server
+from src.node.compression import (
+    CompressionError,
+    ThresholdDeflate,
+    choose_encoding,
+    decompress,
+    maybe_compress,
+)
+from src.node.rpc import RPCClientPool
+
+BODY = b"<value>" + b"hello " * 1000 + b"</value>"
+
+
+def _saved(metrics, channel):
+    return metrics.compression_saved.value(channel=channel)
+
+
+def _skipped(metrics, channel):
+    return metrics.compression_skipped.value(channel=channel)
+
+
+class TestEncodings:
+    """Tests for choosing, applying and undoing content encodings."""
+
+    def test_choose_compress_and_decompress(self):
+        """Test negotiation, the threshold and the metrics."""
+        metrics = NodeMetrics()
+
+        small, none = maybe_compress(b"tiny", "gzip", 1024, metrics)
+        body, encoding = maybe_compress(BODY, "gzip", 1024, metrics)
+        off = maybe_compress(BODY, "gzip", None, metrics)
+
+        assert choose_encoding("gzip;q=1.0, br") == "gzip"
+        assert choose_encoding("gzip;q=0, identity") is None
+        assert choose_encoding(None) is None
+        assert (small, none, encoding) == (b"tiny", None, "gzip")
+        assert off == (BODY, None)
+        assert decompress(body, "gzip") == BODY
+        assert decompress(BODY, "identity") == BODY
+        assert _skipped(metrics, "rpc") == 1
+        assert _saved(metrics, "rpc") == len(BODY) - len(body)
+
+    def test_refused_bodies(self):
+        """Test bodies too large, corrupt or in an unknown encoding."""
+        for data, encoding, code in (
+            (gzip.compress(BODY), "gzip", "PAYLOAD_TOO_LARGE"),
+            (b"not gzip", "gzip", "CORRUPT_BODY"),
+            (BODY, "br", "UNSUPPORTED_ENCODING"),
+        ):
+            with pytest.raises(CompressionError) as error:
+                decompress(data, encoding, max_size=1000)
+            assert error.value.error_code == code
+
+
+def _post(port, body, headers):
+    connection = http.client.HTTPConnection("127.0.0.1", port, timeout=5)
+    try:
+        connection.request("POST", "/RPC2", body=body, headers=headers)
+        response = connection.getresponse()
+        return response, response.read()
+    finally:
+        connection.close()
+
+
+class TestRPC:
+    """Tests for the compressed bodies nodes exchange."""
+
+    def test_compressed_calls(self):
+        """Test compressed requests and responses between two nodes."""
+        server_metrics, client_metrics = NodeMetrics(), NodeMetrics()
+        server = XMLRPCServer(
+            RoomStateManager("node-a"),
+            "127.0.0.1",
+            0,
+            "",
+            metrics=server_metrics,
+        )
+        server.start()
+        server.server.register_function(lambda text: text * 2, "echo")
+        address = f"http://127.0.0.1:{server.server.server_address[1]}"
+        pool = RPCClientPool(metrics=client_metrics)
+        try:
+            small = pool.call(address, "heartbeat")
+            echoed = pool.call(address, "echo", "hello " * 1000)
+        finally:
+            server.stop()
+
+        assert small["status"] == "ok"
+        assert echoed == "hello " * 2000
+        assert pool.get_proxy(address)("transport").request_encoding == "gzip"
+        assert _saved(client_metrics, "rpc") > 4000
+        assert _saved(server_metrics, "rpc") > 8000
+        assert _skipped(client_metrics, "rpc") == 1
+        assert _skipped(server_metrics, "rpc") == 1
+
+    def test_server_negotiation_and_refusals(self):
+        """Test responses to callers with and without gzip, and bad bodies."""
+        server = XMLRPCServer(
+            RoomStateManager("node-a"),
+            "127.0.0.1",
+            0,
+            "",
+            max_payload_size=100000,
+        )
+        server.start()
+        server.server.register_function(lambda: "x" * 5000, "large")
+        port = server.server.server_address[1]
+        call = xmlrpc.client.dumps((), "large").encode()
+        bomb = gzip.compress(b" " * 200000)
+        try:
+            gzipped, gzipped_body = _post(
+                port,
+                gzip.compress(call),
+                {"Content-Encoding": "gzip", "Accept-Encoding": "gzip"},
+            )
+            plain, plain_body = _post(port, call, {})
+            too_large, _ = _post(port, bomb, {"Content-Encoding": "gzip"})
+            unknown, _ = _post(port, call, {"Content-Encoding": "br"})
+        finally:
+            server.stop()
+
+        assert gzipped.status == 200
+        assert gzipped.getheader("Content-Encoding") == "gzip"
+        assert gzipped.getheader("Accept-Encoding").endswith("gzip")
+        assert "x" * 5000 in gzip.decompress(gzipped_body).decode()
+        assert plain.getheader("Content-Encoding") is None
+        assert "x" * 5000 in plain_body.decode()
+        assert (too_large.status, unknown.status) == (413, 415)
+
+
+class FakeDeflate:
+    """A negotiated PerMessageDeflate halving the frames it compresses."""
+
+    def encode(self, frame):
+        return SimpleNamespace(
+            opcode=frame.opcode, fin=frame.fin, data=frame.data[::2]
+        )
+
+    def decode(self, frame, *, max_size=None):
+        return frame
+
+
+class TestWebSocket:
+    """Tests for permessage-deflate on client connections."""
+
+    def test_small_messages_sent_uncompressed(self):
+        """Test the threshold, control frames and fragments."""
+        metrics = NodeMetrics()
+        extension = ThresholdDeflate(FakeDeflate(), 100, metrics)
+        small = SimpleNamespace(opcode=0x1, fin=True, data=b"x" * 10)
+        large = SimpleNamespace(opcode=0x1, fin=True, data=b"x" * 400)
+        fragment = SimpleNamespace(opcode=0x1, fin=False, data=b"x" * 10)
+        ping = SimpleNamespace(opcode=0x9, fin=True, data=b"")
+
+        assert extension.encode(small) is small
+        assert len(extension.encode(large).data) == 200
+        assert len(extension.encode(fragment).data) == 5
+        assert extension.encode(ping) is not ping
+        assert extension.decode(small) is small
+        assert _skipped(metrics, "websocket") == 1
+        assert _saved(metrics, "websocket") == 200
+
+    @pytest.mark.asyncio
+    async def test_server_offers_deflate(self):
+        """Test the extensions passed to the server and turning it off."""
+        options = []
+
+        async def serve(handler, host, port, **kwargs):
+            options.append(kwargs)
+            return SimpleNamespace()
+
+        original, websocket_server.websockets.serve = (
+            websocket_server.websockets.serve,
+            serve,
+        )
+        try:
+            for threshold in (512, None):
+                await WebSocketServer(
+                    RoomStateManager("node-a"),
+                    "localhost",
+                    0,
+                    compression_threshold=threshold,
+                ).start()
+        finally:
+            websocket_server.websockets.serve = original
+
+        (factory,) = options[0]["extensions"]
+        _, extension = factory.process_request_params([], [])
+        assert isinstance(extension, ThresholdDeflate)
+        assert extension.threshold == 512
+        assert options[1]["compression"] is None
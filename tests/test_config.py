@@ -0,0 +1,277 @@
+"""
+Tests for Node Configuration
+
+Tests for defaults, config files, environment and flag overrides,
+validation, and printing the effective configuration.
+"""
+
+import io
+import json
+import os
+import pytest
+
+from contextlib import redirect_stdout
+from dataclasses import fields
+from unittest.mock import patch
+
+from src.node.config import (
+    OPTIONS,
+    ConfigError,
+    NodeConfig,
+    format_config,
+    load_config,
+    parse_args,
+    parse_peer_nodes,
+    read_config_file,
+)
+from src.node.main import main
+
+TOML_CONFIG = """
+[node]
+id = "node2"
+
+[websocket]
+port = 8082
+
+[xmlrpc]
+port = 9092
+
+[peers]
+node1 = "http://node1:9090"
+
+[timeouts]
+probe_interval = 2.5
+
+[features]
+failover = false
+"""
+
+
+def _write(tmp_path, name, content):
+    path = tmp_path / name
+    path.write_text(content)
+    return str(path)
+
+
+class TestDefaults:
+    """Tests for the built-in defaults."""
+
+    def test_defaults_without_sources(self):
+        """Test that no file, env or flags gives the defaults."""
+        config = load_config(environ={})
+
+        assert config.node_id == "node1"
+        assert config.ws_port == 8080
+        assert config.xmlrpc_address == "http://node1:9090"
+        assert config.peers == {}
+        assert config.failover is True
+
+    def test_every_field_is_an_option(self):
+        """Test that every NodeConfig field can be configured."""
+        assert {o.name for o in OPTIONS} == {
+            f.name for f in fields(NodeConfig)
+        }
+
+
+class TestSources:
+    """Tests for config files, environment variables and flags."""
+
+    def test_toml_file(self, tmp_path):
+        """Test loading settings from a TOML file."""
+        path = _write(tmp_path, "node.toml", TOML_CONFIG)
+
+        config = load_config(parse_args(["--config", path]), environ={})
+
+        assert config.node_id == "node2"
+        assert config.ws_port == 8082
+        assert config.xmlrpc_address == "http://node2:9092"
+        assert config.peers == {"node1": "http://node1:9090"}
+        assert config.probe_interval == 2.5
+        assert config.failover is False
+
+    def test_yaml_file(self, tmp_path):
+        """Test loading settings from a YAML file."""
+        try:
+            import yaml  # noqa: F401
+        except ImportError:
+            return
+        path = _write(
+            tmp_path,
+            "node.yaml",
+            "node:\n  id: node3\nauth:\n  required: true\n",
+        )
+
+        config = load_config(environ={"NODE_CONFIG": path})
+
+        assert config.node_id == "node3"
+        assert config.auth_required is True
+
+    def test_json_file(self, tmp_path):
+        """Test loading settings from a JSON file."""
+        path = _write(
+            tmp_path,
+            "node.json",
+            json.dumps({"storage": {"wal_fsync": "never"}}),
+        )
+
+        config = load_config(parse_args(["--config", path]), environ={})
+
+        assert config.wal_fsync == "never"
+
+    def test_env_overrides_file(self, tmp_path):
+        """Test that environment variables override the file."""
+        path = _write(tmp_path, "node.toml", TOML_CONFIG)
+        environ = {
+            "NODE_CONFIG": path,
+            "WEBSOCKET_PORT": "8099",
+            "PEER_NODES": "node3:http://node3:9090",
+            "FAILOVER_ENABLED": "yes",
+        }
+
+        config = load_config(environ=environ)
+
+        assert config.ws_port == 8099
+        assert config.peers == {"node3": "http://node3:9090"}
+        assert config.failover is True
+        assert config.node_id == "node2"
+
+    def test_flags_override_env(self, tmp_path):
+        """Test that flags override the environment and file."""
+        path = _write(tmp_path, "node.toml", TOML_CONFIG)
+        args = parse_args(
+            [
+                "--config",
+                path,
+                "--ws-port",
+                "8100",
+                "--peer",
+                "node4=http://node4:9090",
+                "--failover",
+                "--reconnect-url",
+                "ws://node4:8080",
+            ]
+        )
+
+        config = load_config(args, environ={"WEBSOCKET_PORT": "8099"})
+
+        assert config.ws_port == 8100
+        assert config.peers == {"node4": "http://node4:9090"}
+        assert config.failover is True
+        assert config.reconnect_urls == ["ws://node4:8080"]
+
+    def test_unset_flags_do_not_override(self):
+        """Test that flags that were not given keep the env value."""
+        config = load_config(parse_args([]), environ={"WEBSOCKET_PORT": "8099"})
+
+        assert config.ws_port == 8099
+
+    def test_legacy_peer_format(self):
+        """Test the node_id:host:port PEER_NODES form."""
+        assert parse_peer_nodes("node2:node2:9090, node3:https://h:9091") == {
+            "node2": "http://node2:9090",
+            "node3": "https://h:9091",
+        }
+        assert parse_peer_nodes("") == {}
+
+
+class TestValidation:
+    """Tests for type checking and validation."""
+
+    def test_bad_types_are_reported(self):
+        """Test that values that don't convert are rejected."""
+        with pytest.raises(ConfigError) as exc_info:
+            load_config(
+                environ={"WEBSOCKET_PORT": "abc", "AUTH_REQUIRED": "maybe"}
+            )
+
+        assert len(exc_info.value.errors) == 2
+        assert "WEBSOCKET_PORT" in exc_info.value.errors[0]
+
+    def test_invalid_values_are_reported_together(self):
+        """Test that every validation problem is reported."""
+        environ = {
+            "NODE_ID": "node1",
+            "WEBSOCKET_PORT": "9090",
+            "XMLRPC_PORT": "9090",
+            "WAL_FSYNC": "sometimes",
+            "PEER_NODES": "node1:http://node1:9090",
+            "REPLICATION_FACTOR": "-1",
+        }
+
+        with pytest.raises(ConfigError) as exc_info:
+            load_config(environ=environ)
+
+        message = str(exc_info.value)
+        assert len(exc_info.value.errors) == 4
+        assert "both 9090" in message
+        assert "wal_fsync" in message
+        assert "Peer list contains this node" in message
+        assert "replication_factor" in message
+
+    def test_unknown_file_setting(self, tmp_path):
+        """Test that misspelled file settings are rejected."""
+        path = _write(tmp_path, "node.toml", "[websocket]\nprot = 8080\n")
+
+        with pytest.raises(ConfigError) as exc_info:
+            load_config(parse_args(["--config", path]), environ={})
+
+        assert "websocket.prot" in str(exc_info.value)
+
+    def test_unreadable_file(self, tmp_path):
+        """Test that missing and unsupported files are rejected."""
+        with pytest.raises(ConfigError):
+            read_config_file(str(tmp_path / "missing.toml"))
+        with pytest.raises(ConfigError):
+            read_config_file(_write(tmp_path, "node.ini", "[node]"))
+        with pytest.raises(ConfigError):
+            read_config_file(_write(tmp_path, "bad.toml", "[node"))
+
+    def test_threshold_order(self):
+        """Test that suspect_threshold may not exceed dead_threshold."""
+        config = NodeConfig(suspect_threshold=4, dead_threshold=3)
+
+        assert any("threshold" in error for error in config.validate())
+
+
+class TestPrintConfig:
+    """Tests for printing the effective configuration."""
+
+    def test_format_round_trips(self, tmp_path):
+        """Test that printed configuration can be loaded back."""
+        config = NodeConfig(
+            node_id="node2",
+            peers={"node1": "http://node1:9090"},
+            reconnect_urls=["ws://node1:8080"],
+            probe_interval=2.5,
+        )
+        path = _write(tmp_path, "printed.toml", format_config(config))
+
+        loaded = load_config(parse_args(["--config", path]), environ={})
+
+        assert loaded == config
+
+    def test_secret_is_redacted(self):
+        """Test that the auth secret is not printed."""
+        text = format_config(NodeConfig(auth_secret="hunter2"))
+
+        assert "hunter2" not in text
+        assert 'secret = "<redacted>"' in text
+
+    def test_print_config_flag(self):
+        """Test that --print-config prints and returns without serving."""
+        stdout = io.StringIO()
+        with patch.dict(os.environ, {"NODE_ID": "node7"}):
+            with redirect_stdout(stdout):
+                main(["--print-config", "--ws-port", "8181"])
+
+        output = stdout.getvalue()
+        assert 'id = "node7"' in output
+        assert "port = 8181" in output
+
+    def test_invalid_config_exits(self):
+        """Test that the node exits with status 2 on invalid settings."""
+        with patch.dict(os.environ, {"WEBSOCKET_PORT": "0"}):
+            with pytest.raises(SystemExit) as exc_info:
+                main(["--print-config"])
+
+        assert exc_info.value.code == 2
@@ -0,0 +1,226 @@
+"""
+Tests for Hot Configuration Reload
+
+Tests for applying the reloadable settings, keeping structural ones until
+restart, the audit log entry, rejecting invalid configurations, TLS
+certificate paths and the admin API endpoint.
+"""
+
+import asyncio
+import http.client
+import json
+import logging
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    AdminAPI,
+    AdminServer,
+    AuditLog,
+    ConfigReloader,
+    RoomStateManager,
+    WebSocketServer,
+)
+from src.node.audit import CONFIG_RELOADED
+from src.node.compaction import Compactor, RetentionPolicy
+from src.node.config import ConfigError, NodeConfig
+from src.node.config_reload import diff_config
+from src.node.rate_limit import RateLimiter
+
+TOKEN = "s3cret"
+
+
+class StubDiscovery:
+    """Discovery that records handshakes."""
+
+    def __init__(self, seeds):
+        self.seeds = list(seeds)
+        self.handshakes = []
+
+    def handshake(self, address):
+        self.handshakes.append(address)
+
+
+class StubTLS:
+    """TLS manager that records reloads."""
+
+    def __init__(self, mutual=False):
+        self.mutual = mutual
+        self.reloaded = []
+
+    def reload(self, cert_file=None, key_file=None, ca_file=None):
+        self.reloaded.append((cert_file, key_file, ca_file))
+        return True
+
+
+def _reloader(config, new_config, **components):
+    def load():
+        if isinstance(new_config, Exception):
+            raise new_config
+        return new_config
+
+    return ConfigReloader(config, load, **components)
+
+
+class TestConfigReloader:
+    """Tests for reloading the configuration."""
+
+    def test_applies_runtime_settings_and_audits(self):
+        """Test the applied settings, restart-only ones and the audit entry."""
+        config = NodeConfig(node_id="node1", seeds=["http://node2:9090"])
+        new = NodeConfig(
+            node_id="node1",
+            ws_port=8081,
+            log_level="DEBUG",
+            rate_limits=["send_message=1/2"],
+            retention=["count=10"],
+            room_retention=["general:age=7d"],
+            seeds=["http://node2:9090", "http://node3:9090"],
+            auth_secret="changed",
+        )
+        rate_limiter = RateLimiter()
+        rate_limiter.acquire("client-1", "send_message")
+        compactor = Compactor(RoomStateManager("node1"))
+        discovery = StubDiscovery(config.seeds)
+        audit_log = AuditLog()
+        reloader = _reloader(
+            config,
+            new,
+            rate_limiter=rate_limiter,
+            compactor=compactor,
+            discovery=discovery,
+            audit_log=audit_log,
+        )
+        root = logging.getLogger()
+        level = root.level
+
+        try:
+            with patch("src.node.config_reload.audit_logger") as audit:
+                result = reloader.reload("SIGHUP")
+            assert root.level == logging.DEBUG
+        finally:
+            root.setLevel(level)
+
+        assert sorted(result["changed"]) == [
+            "log_level",
+            "rate_limits",
+            "retention",
+            "room_retention",
+            "seeds",
+        ]
+        assert result["changed"]["log_level"] == {"old": "INFO", "new": "DEBUG"}
+        assert result["restart_required"] == ["auth_secret", "ws_port", "ws_url"]
+        assert rate_limiter.limit_for("send_message").burst == 2
+        assert rate_limiter._buckets == {}
+        assert compactor.default_policy == RetentionPolicy(max_messages=10)
+        assert compactor.policy_for("r1", "general").max_age == 7 * 86400
+        assert discovery.handshakes == ["http://node3:9090"]
+        assert reloader.config.log_level == "DEBUG"
+        assert reloader.config.ws_port == 8080
+
+        message = audit.info.call_args[0][0]
+        assert "log_level: 'INFO' -> 'DEBUG'" in message
+        assert "kept until restart: auth_secret, ws_port, ws_url" in message
+        extra = audit.info.call_args[1]["extra"]
+        assert extra["trigger"] == "SIGHUP"
+        (entry,) = audit_log.query(action=CONFIG_RELOADED)
+        assert (entry.actor, entry.details["trigger"]) == ("SIGHUP", "SIGHUP")
+        assert entry.details["changed"] == result["changed"]
+        assert entry.details["restart_required"] == [
+            "auth_secret",
+            "ws_port",
+            "ws_url",
+        ]
+        assert audit_log.verify() is None
+        assert diff_config(config, new)["auth_secret"]["new"] == "<redacted>"
+
+    def test_invalid_config_rejected(self):
+        """Test that a configuration failing validation changes nothing."""
+        config = NodeConfig(node_id="node1")
+        reloader = _reloader(config, ConfigError(["ws_port 0 is invalid"]))
+
+        with patch("src.node.config_reload.audit_logger") as audit:
+            result = reloader.reload("admin_api")
+
+        assert result["error_code"] == "INVALID_CONFIG"
+        assert reloader.config is config
+        assert audit.warning.called
+
+    def test_tls_certificates(self):
+        """Test new certificate paths, and turning mutual TLS on."""
+        config = NodeConfig(tls_cert_file="old.pem", tls_key_file="old.key")
+        rotated = NodeConfig(tls_cert_file="new.pem", tls_key_file="new.key")
+        tls = StubTLS()
+
+        result = _reloader(config, rotated, tls=tls).reload()
+        mutual = NodeConfig(
+            tls_cert_file="old.pem", tls_key_file="old.key", tls_ca_file="ca"
+        )
+        refused = _reloader(config, mutual, tls=StubTLS()).reload()
+
+        assert result["tls_reloaded"]
+        assert tls.reloaded == [("new.pem", "new.key", "")]
+        assert sorted(result["changed"]) == ["tls_cert_file", "tls_key_file"]
+        assert refused["restart_required"] == ["tls_ca_file"]
+        assert not refused["tls_reloaded"]
+
+
+class TestReloadEndpoint:
+    """Tests for POST /admin/config/reload."""
+
+    @pytest.mark.asyncio
+    async def test_reload_endpoint(self):
+        """Test that the endpoint runs the reload and reports it."""
+        config = NodeConfig(node_id="node1")
+        audit_log = AuditLog()
+        reloader = _reloader(
+            config, NodeConfig(node_id="node1"), audit_log=audit_log
+        )
+        ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 0)
+        servers = [
+            AdminServer(AdminAPI(ws_server, reloader=api_reloader), TOKEN)
+            for api_reloader in (reloader, None)
+        ]
+        for server in servers:
+            server.start()
+
+        def request(port):
+            connection = http.client.HTTPConnection("127.0.0.1", port, timeout=5)
+            try:
+                connection.request(
+                    "POST",
+                    "/admin/config/reload",
+                    headers={"Authorization": f"Bearer {TOKEN}"},
+                )
+                response = connection.getresponse()
+                return response.status, json.loads(response.read())
+            finally:
+                connection.close()
+
+        loop = asyncio.get_running_loop()
+        try:
+            reloaded = await loop.run_in_executor(None, request, servers[0].port)
+            disabled = await loop.run_in_executor(None, request, servers[1].port)
+        finally:
+            for server in servers:
+                server.stop()
+
+        assert reloaded == (
+            200,
+            {
+                "success": True,
+                "changed": {},
+                "restart_required": [],
+                "tls_reloaded": False,
+            },
+        )
+        assert reloader.reloads == 1
+        (entry,) = audit_log.query(actor="admin", action=CONFIG_RELOADED)
+        assert entry.details == {
+            "trigger": "admin_api",
+            "changed": {},
+            "restart_required": [],
+        }
+        assert disabled[0] == 404
+        assert disabled[1]["error_code"] == "RELOAD_UNSUPPORTED"
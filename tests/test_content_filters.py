@@ -0,0 +1,319 @@
+"""
+Tests for Content Filters
+
+Tests for the built-in filters, node rules and plugins, running a room's
+filter chain on new messages and edits, filters surviving restarts and
+failover, and the set_content_filters command.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    ContentFilter,
+    ContentFilterError,
+    EditError,
+    FilterChain,
+    FilterRegistry,
+    MemoryStorage,
+    ReplicaStore,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.content_filters import (
+    BannedWordsFilter,
+    MaxMentionsFilter,
+    URLAllowlistFilter,
+    load_filter_plugins,
+    parse_filter_rules,
+)
+from src.node.failover import merge_replicas
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class ShoutFilter(ContentFilter):
+    """Plugin filter lowering messages written in capitals."""
+
+    type = "no_shouting"
+
+    def apply(self, content):
+        return content.lower() if content.isupper() else content
+
+
+def _room(manager):
+    """A room owned by alice, with bob as a member and carol a moderator."""
+    room = manager.create_room("General", "alice")
+    for username in ("alice", "bob", "carol"):
+        manager.add_member(room.room_id, username)
+    manager.set_member_role(room.room_id, "alice", "carol", "moderator")
+    return room.room_id
+
+
+async def _send(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+class TestFilters:
+    """Tests for the built-in filters and the chain."""
+
+    def test_builtin_filters(self):
+        """Test rejecting and redacting with each built-in filter."""
+        words = BannedWordsFilter(words=["darn", "Heck it"])
+        links = URLAllowlistFilter(domains=["example.com"], action="redact")
+
+        assert words.apply("Darn, heck it! darned") == "****, *******! darned"
+        assert links.apply("see https://docs.example.com/a and www.x.io") == (
+            "see https://docs.example.com/a and [link removed]"
+        )
+        assert links.apply("notexample.com is text") == "notexample.com is text"
+        for content_filter, content in (
+            (MaxMentionsFilter(limit=2), "@a @b @c"),
+            (BannedWordsFilter(words=["darn"], action="reject"), "DARN"),
+            (URLAllowlistFilter(domains=[]), "http://example.com.evil.io"),
+        ):
+            with pytest.raises(ContentFilterError) as error:
+                content_filter.apply(content)
+            assert error.value.error_code == "MESSAGE_REJECTED"
+            assert error.value.filter_type == content_filter.type
+
+    def test_chain_reports_what_changed(self):
+        """Test filters running on the previous filter's output."""
+        chain = FilterChain(
+            [
+                BannedWordsFilter(words=["spam"]),
+                ShoutFilter(),
+                MaxMentionsFilter(limit=5),
+            ]
+        )
+
+        assert chain.run("BUY SPAM") == ("buy ****", ["banned_words", "no_shouting"])
+        assert chain.run("hello") == ("hello", [])
+
+    def test_registry_and_plugins(self):
+        """Test validating specs, plugins, rules and skipped filters."""
+        (plugin,) = load_filter_plugins(["tests.test_content_filters:ShoutFilter"])
+        registry = FilterRegistry([plugin], parse_filter_rules(["redact:\\d{4}"]))
+
+        assert registry.types() == [
+            "max_mentions",
+            "banned_words",
+            "url_allowlist",
+            "no_shouting",
+        ]
+        assert registry.validate(
+            [{"type": "no_shouting"}, {"type": "banned_words", "words": ["X"]}]
+        ) == [
+            {"type": "no_shouting"},
+            {"type": "banned_words", "words": ["x"], "action": "redact"},
+        ]
+        for specs in (
+            None,
+            [{"type": "unknown"}],
+            [{"type": "max_mentions", "limit": 0}],
+            [{"type": "max_mentions", "limit": 2, "extra": 1}],
+            [{"type": "no_shouting", "loud": True}],
+            [{"type": "url_allowlist", "domains": ["not a host"]}],
+            [{"type": "banned_words", "words": ["x"], "action": "hide"}],
+            [{"type": "max_mentions", "limit": 2}] * 11,
+        ):
+            with pytest.raises(ContentFilterError) as error:
+                registry.validate(specs)
+            assert error.value.error_code == "INVALID_REQUEST"
+        chain = FilterRegistry().chain([{"type": "no_shouting"}])
+        assert len(chain) == 0
+        assert len(registry.chain([{"type": "no_shouting"}])) == 2
+        for specs in (["nothing"], ["src.node.spam:SpamError"], ["no.such:X"]):
+            with pytest.raises(ValueError):
+                load_filter_plugins(specs)
+        for specs in (["reject"], ["hide:x"], ["reject:("]):
+            with pytest.raises(ValueError):
+                parse_filter_rules(specs)
+
+
+class TestRoomFilters:
+    """Tests for filtering the messages of hosted rooms."""
+
+    def test_messages_and_edits_filtered(self):
+        """Test redacted, rejected and edited messages and a node rule."""
+        registry = FilterRegistry(rules=parse_filter_rules(["reject:free crypto"]))
+        manager = RoomStateManager("node1", content_filters=registry)
+        room_id = _room(manager)
+        manager.set_content_filters(
+            room_id,
+            "carol",
+            [
+                {"type": "banned_words", "words": ["darn"]},
+                {"type": "max_mentions", "limit": 1},
+            ],
+        )
+
+        message = manager.add_message(room_id, "alice", "darn it")
+        plain = manager.add_message(room_id, "bob", "hello")
+        for content in ("@a @b", "Free Crypto here"):
+            with pytest.raises(ContentFilterError):
+                manager.add_message(room_id, "bob", content)
+        with pytest.raises(EditError) as error:
+            manager.edit_message(room_id, "bob", plain["message_id"], "edit", "@a @b")
+        edit = manager.edit_message(
+            room_id, "bob", plain["message_id"], "edit", "oh darn"
+        )
+
+        assert (message["content"], message["filtered"]) == (
+            "**** it",
+            ["banned_words"],
+        )
+        assert "filtered" not in plain
+        assert error.value.error_code == "MESSAGE_REJECTED"
+        assert edit["content"] == "oh ****"
+        assert len(manager.get_room(room_id).messages) == 2
+
+    def test_set_content_filters(self):
+        """Test permissions, replacing and removing filters."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+        for room, username, code in (
+            ("missing", "alice", "ROOM_NOT_FOUND"),
+            (room_id, "bob", "NOT_ALLOWED"),
+        ):
+            with pytest.raises(ContentFilterError) as error:
+                manager.set_content_filters(room, username, [])
+            assert error.value.error_code == code
+
+        filters = manager.set_content_filters(
+            room_id, "alice", [{"type": "url_allowlist", "domains": ["a.org"]}]
+        )
+        assert filters == [
+            {"type": "url_allowlist", "domains": ["a.org"], "action": "reject"}
+        ]
+        assert manager.get_content_filters(room_id) == filters
+        manager.set_content_filters(room_id, "alice", [])
+        assert manager.add_message(room_id, "bob", "http://b.org")
+
+    def test_filters_survive_restart_and_failover(self):
+        """Test recovery, replica events and merging surviving replicas."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room(manager)
+        filters = [{"type": "max_mentions", "limit": 3}]
+        manager.set_content_filters(room_id, "alice", filters)
+
+        recovered = RoomStateManager("node1", storage)
+        recovered.recover_rooms()
+        replicas = ReplicaStore()
+        xmlrpc_server = XMLRPCServer(manager, "localhost", 0, "http://node1")
+        replicas.update_from_join(
+            xmlrpc_server._room_info(manager.get_room(room_id)), [], "bob"
+        )
+        replicas.record_content_filters(room_id, [{"type": "no_shouting"}])
+        state = merge_replicas(
+            [dict(replicas.get(room_id).to_dict(), node_id="node2")], 100
+        )
+        restored = manager.restore_room(**dict(state, room_id="r2"))
+
+        assert recovered.get_content_filters(room_id) == filters
+        assert restored.content_filters == [{"type": "no_shouting"}]
+        assert manager.add_message("r2", "bob", "HI")["content"] == "HI"
+
+
+class TestFilterCommands:
+    """Tests for set_content_filters and rejected messages."""
+
+    @pytest.mark.asyncio
+    async def test_rejected_message(self):
+        """Test the sender's message_error."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+        manager.set_content_filters(
+            room_id, "alice", [{"type": "max_mentions", "limit": 1}]
+        )
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        websocket = MockWebSocket()
+        ws_server.register_client_room_membership(websocket, room_id, "bob")
+
+        await _send(
+            ws_server,
+            websocket,
+            "send_message",
+            {"room_id": room_id, "username": "bob", "content": "@a @b"},
+        )
+
+        error = websocket.received("message_error")[0]
+        assert error["error_code"] == "MESSAGE_REJECTED"
+        assert websocket.received("new_message") == []
+
+    @pytest.mark.asyncio
+    async def test_set_filters_on_admin_and_forwarded(self):
+        """Test the command on the admin node, forwarding, and an error."""
+        admin = RoomStateManager("node1")
+        room_id = _room(admin)
+        xmlrpc_server = XMLRPCServer(admin, "localhost", 0, "http://node1")
+        broadcasts = []
+        xmlrpc_server.set_broadcast_callback(
+            lambda room_id, message, exclude_user: broadcasts.append(message)
+        )
+        local = WebSocketServer(admin, "localhost", 0)
+        remote = WebSocketServer(RoomStateManager("node2"), "localhost", 0)
+
+        async def call_admin(room_id, method, *args):
+            return getattr(xmlrpc_server, method)(*args)
+
+        remote._call_room_admin = call_admin
+        owner, moderator, member = (
+            MockWebSocket(),
+            MockWebSocket(),
+            MockWebSocket(),
+        )
+        local.register_client_room_membership(member, room_id, "bob")
+        filters = [{"type": "banned_words", "words": ["darn"]}]
+        await _send(
+            local,
+            owner,
+            "set_content_filters",
+            {"room_id": room_id, "username": "alice", "filters": filters},
+        )
+        await _send(
+            remote,
+            moderator,
+            "set_content_filters",
+            {"room_id": room_id, "username": "carol", "filters": []},
+        )
+        await _send(
+            local,
+            member,
+            "set_content_filters",
+            {"room_id": room_id, "username": "bob"},
+        )
+
+        response = owner.received("content_filters_set")[0]
+        assert response["content_filters"][0]["action"] == "redact"
+        assert "url_allowlist" in response["filter_types"]
+        assert moderator.received("content_filters_set")[0][
+            "content_filters"
+        ] == []
+        assert member.received("content_filters_changed")[0][
+            "content_filters"
+        ] == response["content_filters"]
+        assert broadcasts[0]["type"] == "content_filters_changed"
+        assert member.received("filter_error")[0]["error_code"] == (
+            "NOT_ALLOWED"
+        )
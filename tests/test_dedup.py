@@ -0,0 +1,230 @@
+"""
+Tests for Message Deduplication
+
+Tests for the per-room dedup window, and for retransmitted messages being
+added and delivered only once, at the administrator and at member nodes.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    DedupWindow,
+    DuplicateMessageError,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+
+
+class FakeTime:
+    """Clock set by the test, in seconds."""
+
+    def __init__(self, now=1000.0):
+        self.now = now
+
+    def __call__(self):
+        return self.now
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+
+class FlakyProxy:
+    """ServerProxy whose first calls fail, then reach an XML-RPC server."""
+
+    def __init__(self, server, failures):
+        self.server = server
+        self.failures = failures
+        self.calls = 0
+
+    def __call__(self, address, allow_none=False):
+        return self
+
+    def forward_message(self, *args):
+        self.calls += 1
+        # The call reaches the administrator, but the reply is lost
+        result = self.server.forward_message(*args)
+        if self.calls <= self.failures:
+            raise TimeoutError("timed out")
+        return result
+
+
+def _admin():
+    manager = RoomStateManager("node-a")
+    server = XMLRPCServer(manager, "localhost", 0, "http://node-a")
+    room = manager.create_room("General", "alice")
+    manager.add_member(room.room_id, "alice")
+    return manager, server, room
+
+
+class TestDedupWindow:
+    """Tests for the dedup window."""
+
+    def test_ids_expire(self):
+        """Test that IDs are forgotten after the window."""
+        time = FakeTime()
+        window = DedupWindow(window=60, clock=time)
+
+        assert window.add("room-1", {"message_id": "m1"}) is None
+        assert window.add("room-1", {"message_id": "m1", "x": 1}) == {
+            "message_id": "m1"
+        }
+        assert window.get("room-2", "m1") is None
+
+        time.now += 61
+        assert window.get("room-1", "m1") is None
+        assert window.count("room-1") == 0
+
+    def test_oldest_ids_dropped_over_limit(self):
+        """Test that a room keeps at most max_ids IDs."""
+        window = DedupWindow(max_ids=2)
+        for message_id in ("m1", "m2", "m3"):
+            window.add("room-1", {"message_id": message_id})
+
+        assert window.count("room-1") == 2
+        assert window.get("room-1", "m1") is None
+        assert window.get("room-1", "m3") is not None
+
+
+class TestAdministrator:
+    """Tests for deduplication at the room administrator."""
+
+    def test_add_message_rejects_known_id(self):
+        """Test that adding a message ID twice raises with the original."""
+        manager, _, room = _admin()
+        first = manager.add_message(
+            room.room_id, "alice", "hello", message_id="m1"
+        )
+
+        with pytest.raises(DuplicateMessageError) as excinfo:
+            manager.add_message(room.room_id, "alice", "hello", message_id="m1")
+
+        assert excinfo.value.message is first
+        assert len(manager.get_room(room.room_id).messages) == 1
+
+    def test_forward_retry_returns_original(self):
+        """Test that a retried forward gets the same sequence number."""
+        manager, server, room = _admin()
+        broadcasts = []
+        server.set_broadcast_callback(
+            lambda room_id, message, exclude_user=None: broadcasts.append(
+                message
+            )
+        )
+
+        first = server.forward_message(
+            room.room_id, "alice", "hello", "node-b", "", "m1"
+        )
+        retry = server.forward_message(
+            room.room_id, "alice", "hello", "node-b", "", "m1"
+        )
+
+        assert first["success"] and retry["success"]
+        assert retry["sequence_number"] == first["sequence_number"]
+        assert len(manager.get_room(room.room_id).messages) == 1
+        assert len(broadcasts) == 1
+
+    def test_retry_after_buffer_eviction(self):
+        """Test that the window catches retries of evicted messages."""
+        manager, server, room = _admin()
+        manager.add_message(room.room_id, "alice", "first", message_id="m1")
+        manager.get_room(room.room_id).messages.clear()
+
+        retry = server.forward_message(
+            room.room_id, "alice", "first", "node-b", "", "m1"
+        )
+
+        assert retry["sequence_number"] == 1
+        assert manager.get_room(room.room_id).messages == []
+
+
+class TestMemberNode:
+    """Tests for deduplication at member nodes."""
+
+    def test_retransmitted_broadcast_delivered_once(self):
+        """Test that a broadcast received twice reaches clients once."""
+        server = XMLRPCServer(
+            RoomStateManager("node-b"), "localhost", 0, "http://node-b"
+        )
+        delivered = []
+        server.set_broadcast_callback(
+            lambda room_id, message, exclude_user=None: delivered.append(
+                message
+            )
+        )
+        message = {
+            "message_id": "m1",
+            "username": "alice",
+            "content": "hello",
+            "sequence_number": 1,
+        }
+
+        assert server.receive_message_broadcast("room-1", dict(message))
+        assert server.receive_message_broadcast("room-1", dict(message))
+
+        assert len(delivered) == 1
+
+    @pytest.mark.asyncio
+    async def test_message_id_required(self):
+        """Test that sends without an ID are rejected when IDs are required."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        manager.add_member(room.room_id, "alice")
+        ws_server = WebSocketServer(
+            manager, "localhost", 0, require_message_id=True
+        )
+        ws = MockWebSocket()
+        ws_server.register_client_room_membership(ws, room.room_id, "alice")
+
+        await ws_server.process_message(
+            ws,
+            json.dumps(
+                {
+                    "type": "send_message",
+                    "data": {
+                        "room_id": room.room_id,
+                        "username": "alice",
+                        "content": "hello",
+                    },
+                }
+            ),
+        )
+
+        assert ws.sent_messages[-1]["type"] == "message_error"
+        assert ws.sent_messages[-1]["data"]["error_code"] == "INVALID_REQUEST"
+        assert manager.get_room(room.room_id).messages == []
+
+    @pytest.mark.asyncio
+    async def test_forward_retried_after_lost_reply(self):
+        """Test that a forward whose reply was lost is retried exactly once."""
+        manager, server, room = _admin()
+        ws_server = WebSocketServer(
+            RoomStateManager("node-b"), "localhost", 0, object()
+        )
+        ws_server._locate_room_admin = lambda room_id: (
+            {"room_id": room_id},
+            "http://node-a",
+        )
+        proxy = FlakyProxy(server, failures=1)
+
+        with patch("src.node.websocket_server.ServerProxy", proxy), patch(
+            "src.node.websocket_server.FORWARD_RETRY_DELAY", 0
+        ):
+            result = await ws_server._handle_remote_message(
+                MockWebSocket(), room.room_id, "alice", "hello", "m1"
+            )
+
+        assert result["success"] is True
+        assert result["sequence_number"] == 1
+        assert proxy.calls == 2
+        assert len(manager.get_room(room.room_id).messages) == 1
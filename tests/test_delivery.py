@@ -0,0 +1,180 @@
+"""
+Tests for Per-Room Delivery Guarantees
+
+Tests for choosing a room's delivery guarantee, messages carrying it, and
+what each guarantee changes: retried forwards, message streams, buffering
+for held sessions and the duplicate window of member nodes.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    DirectoryEntry,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+    delivery_policy,
+)
+from src.node.failover import merge_replicas
+from src.node.snapshot import RoomSnapshot
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+
+class RecordingStreams:
+    """Message streams recording the messages sent on them."""
+
+    def __init__(self):
+        self.sent = []
+
+    def send(self, room_id, message):
+        self.sent.append(message["content"])
+
+
+class RecordingQueue:
+    """Offline queue recording the messages buffered in it."""
+
+    def __init__(self):
+        self.added = []
+
+    def add(self, room_id, message, excluded=frozenset()):
+        self.added.append(message["content"])
+
+
+class FailingProxy:
+    """ServerProxy whose forwards always time out."""
+
+    def __init__(self):
+        self.calls = 0
+
+    def __call__(self, address, allow_none=False):
+        return self
+
+    def forward_message(self, *args):
+        self.calls += 1
+        raise TimeoutError("timed out")
+
+
+class TestRooms:
+    """Tests for the guarantee of a room."""
+
+    def test_guarantee_kept_with_room(self):
+        """Test messages, snapshots, replicas and directory entries."""
+        manager = RoomStateManager("node-a")
+        chatter = manager.create_room("Chatter", "alice", delivery="at_most_once")
+        general = manager.create_room("General", "alice")
+        with pytest.raises(ValueError):
+            manager.create_room("Other", "alice", delivery="twice")
+        for room in (chatter, general):
+            manager.add_member(room.room_id, "alice")
+
+        quick = manager.add_message(chatter.room_id, "alice", "hi")
+        normal = manager.add_message(general.room_id, "alice", "hi")
+        snapshot = RoomSnapshot.from_room(manager, chatter.room_id)
+        replica = {"node_id": "node-b", **chatter.to_dict()}
+        entry = DirectoryEntry("room-1", "Chatter", "node-a", delivery="at_most_once")
+
+        assert quick["delivery"] == "at_most_once"
+        assert "delivery" not in normal
+        assert general.delivery == "exactly_once"
+        assert snapshot.delivery == "at_most_once"
+        assert merge_replicas([replica], 100)["delivery"] == "at_most_once"
+        assert DirectoryEntry.from_dict(entry.to_dict()).delivery == (
+            "at_most_once"
+        )
+        assert delivery_policy("unknown") == delivery_policy("exactly_once")
+
+
+class TestDelivery:
+    """Tests for what each guarantee changes."""
+
+    def test_at_most_once_sent_once_per_peer(self):
+        """Test at-most-once messages bypassing the message streams."""
+        manager = RoomStateManager("node-a")
+        chatter = manager.create_room("Chatter", "alice", delivery="at_most_once")
+        general = manager.create_room("General", "alice")
+        streams = RecordingStreams()
+        server = XMLRPCServer(
+            manager, "localhost", 0, "http://node-a", streams=streams
+        )
+        calls = []
+
+        with patch(
+            "src.node.xmlrpc_server.broadcast_message_to_peers",
+            lambda *args, **kwargs: calls.append(kwargs),
+        ):
+            for room in (chatter, general):
+                manager.add_member(room.room_id, "alice")
+                server.forward_message(
+                    room.room_id, "alice", room.room_name, "node-b"
+                )
+
+        assert calls == [{"retries": 0}]
+        assert streams.sent == ["General"]
+
+    def test_at_least_once_delivered_again(self):
+        """Test that member nodes only drop exactly-once retransmissions."""
+        server = XMLRPCServer(
+            RoomStateManager("node-b"), "localhost", 0, "http://node-b"
+        )
+        delivered = []
+        server.set_broadcast_callback(
+            lambda room_id, message, exclude_user=None: delivered.append(
+                message["data"]["content"]
+            )
+        )
+        messages = [
+            {"message_id": "m1", "content": "lossy", "sequence_number": 1},
+            {
+                "message_id": "m2",
+                "content": "repeated",
+                "sequence_number": 2,
+                "delivery": "at_least_once",
+            },
+        ]
+
+        for message in messages * 2:
+            assert server.receive_message_broadcast("room-1", dict(message))
+
+        assert delivered == ["lossy", "repeated", "repeated"]
+
+    @pytest.mark.asyncio
+    async def test_at_most_once_not_retried_or_queued(self):
+        """Test a failed forward tried once and nothing buffered."""
+        ws_server = WebSocketServer(
+            RoomStateManager("node-b"), "localhost", 0, object()
+        )
+        ws_server._locate_room_admin = lambda room_id: (
+            {"room_id": room_id, "delivery": "at_most_once"},
+            "http://node-a",
+        )
+        ws_server.offline_queue = RecordingQueue()
+        proxy = FailingProxy()
+
+        with patch("src.node.websocket_server.ServerProxy", proxy), patch(
+            "src.node.websocket_server.FORWARD_RETRY_DELAY", 0
+        ):
+            result = await ws_server._handle_remote_message(
+                MockWebSocket(), "room-1", "alice", "hello", "m1"
+            )
+        for message in (
+            {"content": "lossy", "delivery": "at_most_once"},
+            {"content": "kept", "delivery": "at_least_once"},
+            {"content": "default"},
+        ):
+            ws_server._record_delivery("room-1", message)
+
+        assert result["error_code"] == "ADMIN_NODE_UNAVAILABLE"
+        assert proxy.calls == 1
+        assert ws_server.offline_queue.added == ["kept", "default"]
@@ -0,0 +1,362 @@
+"""
+Tests for Direct Messages
+
+Tests for the presence directory, buffering direct messages for offline
+users, and routing direct messages to the recipient's node.
+"""
+
+import asyncio
+import json
+import pytest
+
+from src.node import (
+    MembershipEvent,
+    PeerRegistry,
+    PeerState,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.direct_messages import DirectMessageBuffer, create_direct_message
+from src.node.presence import PresenceDirectory
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class LocalRPC:
+    """RPC client pool that calls other nodes' XML-RPC servers in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def call(self, address, method, *args, timeout=None):
+        target = self.servers.get(address)
+        if target is None:
+            raise ConnectionError("unreachable")
+        return getattr(target, method)(*args)
+
+
+class Cluster:
+    """Nodes with WebSocket and XML-RPC servers reaching each other."""
+
+    def __init__(self):
+        self.servers = {}
+        self.nodes = {}
+
+    def add_node(self, node_id):
+        address = f"http://{node_id}:9090"
+        registry = PeerRegistry(node_id)
+        registry.rpc = LocalRPC(self.servers)
+        for other_id, other in self.nodes.items():
+            registry.register_peer(other_id, other.presence.node_address)
+            other.peer_registry.register_peer(node_id, address)
+        manager = RoomStateManager(node_id)
+        presence = PresenceDirectory(node_id, address)
+        ws_server = WebSocketServer(
+            manager, "localhost", 0, registry, presence=presence
+        )
+        xmlrpc_server = XMLRPCServer(
+            manager, "localhost", 0, address, registry, presence=presence
+        )
+        xmlrpc_server.set_direct_message_callback(
+            ws_server.deliver_direct_message_sync
+        )
+        self.servers[address] = xmlrpc_server
+        self.nodes[node_id] = ws_server
+        return ws_server
+
+    def gossip(self):
+        for ws_server in self.nodes.values():
+            for other in self.nodes.values():
+                other.presence.merge(ws_server.presence.get_entries())
+
+
+async def _connect(ws_server, username=None):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    if username:
+        await ws_server.process_message(
+            websocket,
+            json.dumps(
+                {"type": "announce_presence", "data": {"username": username}}
+            ),
+        )
+    return websocket
+
+
+async def _send_dm(ws_server, websocket, sender, recipient, content="hi"):
+    await ws_server.process_message(
+        websocket,
+        json.dumps(
+            {
+                "type": "send_direct_message",
+                "data": {
+                    "username": sender,
+                    "recipient": recipient,
+                    "content": content,
+                },
+            }
+        ),
+    )
+    # Let deliveries scheduled by XML-RPC callbacks run
+    await asyncio.sleep(0)
+    return websocket.received("direct_message_sent")[-1]
+
+
+class TestPresenceDirectory:
+    """Tests for tracking where users are connected."""
+
+    def test_user_moves_between_nodes(self):
+        """Test that the most recent connection wins after gossip."""
+        node_a = PresenceDirectory("node-a", "http://node-a:9090")
+        node_b = PresenceDirectory("node-b", "http://node-b:9090")
+        node_a.set_online("alice")
+        node_b.merge(node_a.get_entries())
+
+        node_b.set_online("alice")
+        node_a.set_offline("alice")
+        node_a.merge(node_b.get_entries())
+
+        assert node_a.locate("alice").node_id == "node-b"
+        assert node_a.locate("alice").online is True
+
+    def test_offline_from_old_node_does_not_win(self):
+        """Test that going offline on a node doesn't hide a newer login."""
+        node_a = PresenceDirectory("node-a", "http://node-a:9090")
+        node_b = PresenceDirectory("node-b", "http://node-b:9090")
+        node_a.set_online("alice")
+        node_b.merge(node_a.get_entries())
+        node_b.set_online("alice")
+        node_a.merge(node_b.get_entries())
+
+        node_a.set_offline("alice")
+
+        assert node_a.locate("alice").node_id == "node-b"
+        assert node_a.locate("alice").online is True
+
+    def test_failed_node_users_marked_offline(self):
+        """Test that users on a dead node are no longer online."""
+        node_a = PresenceDirectory("node-a", "http://node-a:9090")
+        node_b = PresenceDirectory("node-b", "http://node-b:9090")
+        node_b.set_online("bob")
+        node_a.merge(node_b.get_entries())
+
+        node_a.on_membership_change(
+            MembershipEvent("node-b", PeerState.SUSPECT, PeerState.DEAD, 0.0)
+        )
+
+        assert node_a.online_users() == []
+
+    def test_wrongly_offline_user_is_reasserted(self):
+        """Test that a connected user marked offline by a peer stays online."""
+        node_a = PresenceDirectory("node-a", "http://node-a:9090")
+        node_b = PresenceDirectory("node-b", "http://node-b:9090")
+        node_b.set_online("bob")
+        node_a.merge(node_b.get_entries())
+        node_a.mark_node_offline("node-b")
+
+        node_b.merge(node_a.get_entries())
+        node_a.merge(node_b.get_entries())
+
+        assert node_a.locate("bob").online is True
+        assert node_a.locate("bob").node_id == "node-b"
+
+    def test_purge_offline(self):
+        """Test that long-offline users are forgotten."""
+        directory = PresenceDirectory("node-a")
+        directory.set_online("alice")
+        directory.set_offline("alice")
+
+        assert directory.purge_offline(ttl=-1) == 1
+        assert directory.locate("alice") is None
+
+
+class TestDirectMessageBuffer:
+    """Tests for the buffer of undelivered messages."""
+
+    def test_limit_drops_oldest(self):
+        """Test that a full buffer keeps the newest messages."""
+        buffer = DirectMessageBuffer(limit=2)
+        for content in ("one", "two", "three"):
+            buffer.add(create_direct_message("alice", "bob", content))
+
+        assert [m.content for m in buffer.take("bob")] == ["two", "three"]
+        assert buffer.pending_count() == 0
+
+    def test_requeue_keeps_order(self):
+        """Test that requeued messages go before newer ones."""
+        buffer = DirectMessageBuffer()
+        buffer.add(create_direct_message("alice", "bob", "one"))
+        taken = buffer.take("bob")
+        buffer.add(create_direct_message("alice", "bob", "two"))
+
+        buffer.requeue(taken)
+
+        assert [m.content for m in buffer.take("bob")] == ["one", "two"]
+
+    def test_expired_messages_dropped(self):
+        """Test that messages older than the TTL are dropped."""
+        buffer = DirectMessageBuffer(ttl=-1)
+        buffer.add(create_direct_message("alice", "bob", "late"))
+
+        assert buffer.purge_expired() == 1
+        assert buffer.recipients() == []
+
+    def test_token_not_serialized(self):
+        """Test that the sender's token is never sent to clients."""
+        message = create_direct_message("alice", "bob", "hi", "node-a", "tok")
+
+        assert "tok" not in json.dumps(message.to_dict())
+
+
+class TestLocalDelivery:
+    """Tests for direct messages between users on the same node."""
+
+    @pytest.mark.asyncio
+    async def test_delivered_to_online_user(self):
+        """Test that an online recipient gets the message immediately."""
+        ws_server = Cluster().add_node("node-a")
+        alice = await _connect(ws_server, "alice")
+        bob = await _connect(ws_server, "bob")
+
+        sent = await _send_dm(ws_server, alice, "alice", "bob")
+
+        assert sent["status"] == "delivered"
+        received = bob.received("direct_message")
+        assert received[0]["sender"] == "alice"
+        assert received[0]["content"] == "hi"
+        assert "auth_token" not in received[0]
+
+    @pytest.mark.asyncio
+    async def test_buffered_until_user_announces(self):
+        """Test that messages to an offline user arrive when they connect."""
+        ws_server = Cluster().add_node("node-a")
+        alice = await _connect(ws_server, "alice")
+
+        sent = await _send_dm(ws_server, alice, "alice", "bob", "first")
+        await _send_dm(ws_server, alice, "alice", "bob", "second")
+        bob = await _connect(ws_server, "bob")
+
+        assert sent["status"] == "buffered"
+        assert bob.received("presence_announced")[0]["pending"] == 2
+        assert [m["content"] for m in bob.received("direct_message")] == [
+            "first",
+            "second",
+        ]
+        assert ws_server.direct_messages.pending_count() == 0
+
+    @pytest.mark.asyncio
+    async def test_invalid_request(self):
+        """Test that messages without a recipient or content are rejected."""
+        ws_server = Cluster().add_node("node-a")
+        alice = await _connect(ws_server, "alice")
+
+        await ws_server.process_message(
+            alice,
+            json.dumps(
+                {
+                    "type": "send_direct_message",
+                    "data": {"username": "alice", "recipient": "bob"},
+                }
+            ),
+        )
+
+        errors = alice.received("direct_message_error")
+        assert errors[0]["error_code"] == "INVALID_CONTENT"
+        assert ws_server.direct_messages.pending_count() == 0
+
+    @pytest.mark.asyncio
+    async def test_disconnect_marks_user_offline(self):
+        """Test that closing the last connection takes the user offline."""
+        ws_server = Cluster().add_node("node-a")
+        first = await _connect(ws_server, "bob")
+        second = await _connect(ws_server, "bob")
+
+        ws_server.connections.unregister(first)
+        ws_server._mark_offline(first)
+        assert ws_server.presence.locate("bob").online is True
+
+        ws_server.connections.unregister(second)
+        ws_server._mark_offline(second)
+        assert ws_server.presence.locate("bob").online is False
+
+
+class TestRemoteDelivery:
+    """Tests for direct messages routed to another node."""
+
+    @pytest.mark.asyncio
+    async def test_routed_to_recipient_node(self):
+        """Test that a message reaches a user on another node."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b")
+        alice = await _connect(node_a, "alice")
+        bob = await _connect(node_b, "bob")
+        cluster.gossip()
+
+        sent = await _send_dm(node_a, alice, "alice", "bob")
+
+        assert sent["status"] == "delivered"
+        received = bob.received("direct_message")
+        assert received[0]["sender_node"] == "node-a"
+
+    @pytest.mark.asyncio
+    async def test_buffered_and_retried_after_user_moves(self):
+        """Test that a buffered message follows the user to another node."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b")
+        alice = await _connect(node_a, "alice")
+
+        sent = await _send_dm(node_a, alice, "alice", "bob")
+        bob = await _connect(node_b, "bob")
+        cluster.gossip()
+        delivered = await node_a.retry_direct_messages()
+        await asyncio.sleep(0)
+
+        assert sent["status"] == "buffered"
+        assert delivered == 1
+        assert bob.received("direct_message")[0]["content"] == "hi"
+
+    @pytest.mark.asyncio
+    async def test_stale_presence_buffers(self):
+        """Test that a recipient who already left is buffered for."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b")
+        alice = await _connect(node_a, "alice")
+        bob = await _connect(node_b, "bob")
+        cluster.gossip()
+        node_b.connections.unregister(bob)
+
+        sent = await _send_dm(node_a, alice, "alice", "bob")
+
+        assert sent["status"] == "buffered"
+        assert node_a.direct_messages.pending_count("bob") == 1
+
+    def test_rpc_rejects_offline_recipient(self):
+        """Test that deliver_direct_message reports absent recipients."""
+        cluster = Cluster()
+        cluster.add_node("node-a")
+        message = create_direct_message("alice", "bob", "hi", "node-b")
+
+        result = cluster.servers["http://node-a:9090"].deliver_direct_message(
+            message.to_dict()
+        )
+
+        assert result["error_code"] == "RECIPIENT_OFFLINE"
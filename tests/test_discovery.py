@@ -0,0 +1,224 @@
+"""
+Tests for Node Bootstrap and Peer Discovery
+
+Tests for the hello handshake, bootstrapping from seeds and known peers,
+LAN broadcast announcements and the advertised capabilities.
+"""
+
+import json
+
+from src.node import PeerRegistry, RoomStateManager, XMLRPCServer
+from src.node.config import NodeConfig
+from src.node.discovery import (
+    PROTOCOL_VERSION,
+    PeerDiscovery,
+    node_capabilities,
+)
+
+
+class LocalRPC:
+    """RPC client pool that calls other nodes' XML-RPC servers in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def call(self, address, method, *args, timeout=None):
+        target = self.servers.get(address)
+        if target is None:
+            raise ConnectionError("unreachable")
+        return getattr(target, method)(*args)
+
+
+class Cluster:
+    """Nodes whose peer registries reach each other in-process."""
+
+    def __init__(self):
+        self.servers = {}
+        self.nodes = {}
+
+    def add_node(self, node_id, seeds=(), capabilities=("rooms",)):
+        address = f"http://{node_id}:9090"
+        registry = PeerRegistry(node_id)
+        registry.rpc = LocalRPC(self.servers)
+        discovery = PeerDiscovery(
+            node_id, address, registry, list(seeds), capabilities
+        )
+        self.servers[address] = XMLRPCServer(
+            RoomStateManager(node_id),
+            "localhost",
+            0,
+            address,
+            registry,
+            discovery=discovery,
+        )
+        self.nodes[node_id] = discovery
+        return discovery
+
+
+class TestHandshake:
+    """Tests for the hello handshake."""
+
+    def test_handshake_registers_both_sides(self):
+        """Test that both nodes learn each other's address and features."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a", capabilities=("rooms", "auth"))
+        node_b = cluster.add_node("node-b", capabilities=("rooms",))
+
+        response = node_b.handshake("http://node-a:9090")
+
+        assert response["node_id"] == "node-a"
+        assert node_b.peer_registry.list_peers() == {
+            "node-a": "http://node-a:9090"
+        }
+        assert node_b.peer_registry.get_capabilities("node-a") == [
+            "rooms",
+            "auth",
+        ]
+        assert node_a.peer_registry.list_peers() == {
+            "node-b": "http://node-b:9090"
+        }
+        assert node_a.peer_registry.get_capabilities("node-b") == ["rooms"]
+
+    def test_protocol_mismatch_refused(self):
+        """Test that a node speaking another protocol version is refused."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        hello = {
+            "node_id": "node-b",
+            "address": "http://node-b:9090",
+            "protocol_version": PROTOCOL_VERSION + 1,
+        }
+
+        result = node_a.handle_hello(hello)
+
+        assert result["success"] is False
+        assert result["error_code"] == "PROTOCOL_MISMATCH"
+        assert node_a.peer_registry.list_peers() == {}
+
+    def test_duplicate_node_id_refused(self):
+        """Test that a node reusing this node's ID is refused."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        hello = dict(node_a.hello_payload(), address="http://other:9090")
+
+        result = node_a.handle_hello(hello)
+
+        assert result["error_code"] == "DUPLICATE_NODE_ID"
+
+    def test_unreachable_node(self):
+        """Test that a failed handshake registers nothing."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+
+        assert node_a.handshake("http://missing:9090") is None
+        assert node_a.peer_registry.list_peers() == {}
+
+    def test_server_without_discovery(self):
+        """Test that nodes without discovery reject the handshake."""
+        server = XMLRPCServer(
+            RoomStateManager("node-a"), "localhost", 0, "http://node-a:9090"
+        )
+
+        result = server.hello({"node_id": "node-b", "address": "http://b"})
+
+        assert result["error_code"] == "DISCOVERY_UNSUPPORTED"
+
+
+class TestBootstrap:
+    """Tests for bootstrapping from seed nodes."""
+
+    def test_bootstrap_finds_peers_of_seeds(self):
+        """Test that a new node learns the whole cluster from one seed."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b", seeds=["http://node-a:9090"])
+        node_b.bootstrap()
+        node_c = cluster.add_node("node-c", seeds=["http://node-a:9090"])
+
+        joined = node_c.bootstrap()
+
+        assert sorted(joined) == ["node-a", "node-b"]
+        assert node_c.peer_registry.list_peers() == {
+            "node-a": "http://node-a:9090",
+            "node-b": "http://node-b:9090",
+        }
+        assert "node-c" in node_a.peer_registry.list_peers()
+        assert "node-c" in node_b.peer_registry.list_peers()
+
+    def test_bootstrap_skips_dead_seeds(self):
+        """Test that unreachable seeds don't stop the bootstrap."""
+        cluster = Cluster()
+        cluster.add_node("node-a")
+        node_b = cluster.add_node(
+            "node-b", seeds=["http://gone:9090", "http://node-a:9090"]
+        )
+
+        assert node_b.bootstrap() == ["node-a"]
+        assert "gone" not in str(node_b.peer_registry.list_peers())
+
+    def test_bootstrap_contacts_static_peers(self):
+        """Test that statically configured peers are also handshaken."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b")
+        node_b.peer_registry.register_peer("node-a", "http://node-a:9090")
+
+        node_b.bootstrap()
+
+        assert "node-b" in node_a.peer_registry.list_peers()
+        assert node_b.peer_registry.get_capabilities("node-a") == ["rooms"]
+
+
+class TestLanBroadcast:
+    """Tests for LAN broadcast announcements."""
+
+    def test_new_node_announcement(self):
+        """Test that an announcement from an unknown node is accepted."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b")
+
+        address = node_a.handle_announcement(node_b.announcement())
+        node_a.handshake_announced(address)
+
+        assert address == "http://node-b:9090"
+        assert "node-b" in node_a.peer_registry.list_peers()
+
+    def test_known_and_foreign_announcements_ignored(self):
+        """Test that own, known and unrelated datagrams are ignored."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b")
+        node_a.peer_registry.register_peer("node-b", "http://node-b:9090")
+        other = json.dumps({"service": "printer", "node_id": "x"}).encode()
+
+        assert node_a.handle_announcement(node_a.announcement()) is None
+        assert node_a.handle_announcement(node_b.announcement()) is None
+        assert node_a.handle_announcement(other) is None
+        assert node_a.handle_announcement(b"\xff garbage") is None
+
+    def test_pending_handshake_not_repeated(self):
+        """Test that repeated announcements start only one handshake."""
+        cluster = Cluster()
+        node_a = cluster.add_node("node-a")
+        node_b = cluster.add_node("node-b")
+
+        assert node_a.handle_announcement(node_b.announcement()) is not None
+        assert node_a.handle_announcement(node_b.announcement()) is None
+
+
+class TestCapabilities:
+    """Tests for the advertised capabilities."""
+
+    def test_capabilities_follow_config(self):
+        """Test that optional features are advertised when enabled."""
+        enabled = node_capabilities(
+            NodeConfig(failover=True, replication_factor=2, auth_required=True)
+        )
+        disabled = node_capabilities(
+            NodeConfig(failover=False, replication_factor=0)
+        )
+
+        assert {"failover", "replication", "auth"} <= set(enabled)
+        assert not {"failover", "replication", "auth"} & set(disabled)
+        assert "rooms" in disabled
@@ -0,0 +1,240 @@
+"""
+Tests for Bounded Dispatch
+
+Tests for the keyed dispatcher on the event loop and the keyed worker
+pool: per-key order, parallel keys, jobs handed over from other threads
+and submitters held back while a pool is full; and for the WebSocket and
+XML-RPC servers running their work on these pools.
+"""
+
+import asyncio
+import json
+import threading
+import time
+import xmlrpc.client
+
+import pytest
+
+from src.node import (
+    KeyedDispatcher,
+    KeyedWorkerPool,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+
+
+class RecordingWebSocket:
+    """A client connection recording what the node sends it."""
+
+    def __init__(self):
+        self.sent = []
+
+    async def send(self, message):
+        self.sent.append(message)
+
+
+class RecordingPool:
+    """A fan-out pool recording the jobs submitted to it."""
+
+    def __init__(self):
+        self.jobs = []
+
+    def submit(self, key, job, *args):
+        self.jobs.append((key, job.__name__, args))
+
+
+class TestKeyedDispatcher:
+    """Tests for the keyed dispatcher on the event loop."""
+
+    @pytest.mark.asyncio
+    async def test_order_per_key_and_parallel_keys(self):
+        """Test that a key's jobs run in order while other keys proceed."""
+        dispatcher = KeyedDispatcher(workers=2)
+        log = []
+
+        async def job(key, n, delay):
+            await asyncio.sleep(delay)
+            log.append((key, n))
+
+        for n in range(3):
+            dispatcher.submit("slow", job, "slow", n, 0.02)
+        for n in range(3):
+            dispatcher.submit("fast", job, "fast", n, 0)
+        assert dispatcher.pending == 6
+
+        for _ in range(100):
+            if not dispatcher.pending:
+                break
+            await asyncio.sleep(0.01)
+
+        assert [n for key, n in log if key == "slow"] == [0, 1, 2]
+        assert [n for key, n in log if key == "fast"] == [0, 1, 2]
+        assert log[:3] == [("fast", 0), ("fast", 1), ("fast", 2)]
+        assert len(dispatcher._tasks) == 2
+
+    @pytest.mark.asyncio
+    async def test_jobs_from_other_threads_run_on_the_loop(self):
+        """Test jobs handed over from threads, and a failing job."""
+        dispatcher = KeyedDispatcher(workers=4)
+        dispatcher.bind(asyncio.get_running_loop())
+        loop_thread = threading.get_ident()
+        ran = []
+
+        async def job(n):
+            if n == 0:
+                raise RuntimeError("boom")
+            ran.append((n, threading.get_ident()))
+
+        def submit_all():
+            for n in range(20):
+                dispatcher.submit("room", job, n)
+
+        await asyncio.get_running_loop().run_in_executor(None, submit_all)
+        for _ in range(100):
+            if len(ran) == 19:
+                break
+            await asyncio.sleep(0.01)
+
+        assert [n for n, _ in ran] == list(range(1, 20))
+        assert {thread for _, thread in ran} == {loop_thread}
+        assert dispatcher.pending == 0
+
+    def test_without_a_loop_jobs_run_in_place(self):
+        """Test that jobs run to completion when there's no loop."""
+        ran = []
+
+        async def job():
+            ran.append(True)
+
+        KeyedDispatcher().submit("room", job)
+
+        assert ran == [True]
+        with pytest.raises(ValueError):
+            KeyedDispatcher(workers=0)
+
+
+class TestKeyedWorkerPool:
+    """Tests for the keyed worker pool."""
+
+    def test_order_per_key_and_workers(self):
+        """Test per-key order, the thread count and shutting down."""
+        pool = KeyedWorkerPool(workers=3, name="test")
+        log, names = [], set()
+
+        def job(key, n):
+            time.sleep(0.001)
+            log.append((key, n))
+            names.add(threading.current_thread().name)
+
+        for n in range(10):
+            for key in ("a", "b", "c", "d"):
+                pool.submit(key, job, key, n)
+
+        assert pool.join(timeout=5)
+        for key in ("a", "b", "c", "d"):
+            assert [n for k, n in log if k == key] == list(range(10))
+        assert names <= {"test-0", "test-1", "test-2"}
+        pool.shutdown(timeout=1)
+        pool.submit("a", job, "a", 10)
+        assert log[-1] == ("a", 10)
+        assert not any(thread.is_alive() for thread in pool._threads)
+
+    def test_submit_waits_while_full(self):
+        """Test that submitters wait until a queued job has run."""
+        pool = KeyedWorkerPool(workers=1, max_pending=2)
+        release = threading.Event()
+        done = []
+        pool.submit("a", release.wait)
+        pool.submit("b", done.append, "b")
+        submitter = threading.Thread(
+            target=pool.submit, args=("c", done.append, "c")
+        )
+        submitter.start()
+        submitter.join(timeout=0.1)
+
+        assert submitter.is_alive() and pool.pending == 2
+        release.set()
+        submitter.join(timeout=2)
+        assert pool.join(timeout=2)
+        assert done == ["b", "c"]
+        pool.shutdown(timeout=1)
+
+
+class TestServers:
+    """Tests for the servers running their work on the pools."""
+
+    @pytest.mark.asyncio
+    async def test_peer_events_delivered_in_order(self):
+        """Test events from XML-RPC threads and fan-out keyed by room."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        fanout = RecordingPool()
+        ws_server = WebSocketServer(manager, "localhost", 0, fanout=fanout)
+        ws_server.dispatcher.bind(asyncio.get_running_loop())
+        websocket = RecordingWebSocket()
+        ws_server.register_client_room_membership(
+            websocket, room.room_id, "bob"
+        )
+
+        def deliver():
+            for n in range(30):
+                ws_server.broadcast_to_room_sync(
+                    room.room_id, {"type": "member_joined", "data": {"n": n}}
+                )
+
+        await asyncio.get_running_loop().run_in_executor(None, deliver)
+        for _ in range(100):
+            if len(websocket.sent) == 30:
+                break
+            await asyncio.sleep(0.01)
+        ws_server._broadcast_to_peers(room.room_id, "member_left", {})
+
+        numbers = [json.loads(sent)["data"]["n"] for sent in websocket.sent]
+        assert numbers == list(range(30))
+        assert fanout.jobs == [
+            (
+                room.room_id,
+                "broadcast_to_peers",
+                (None, room.room_id, "member_left", {}),
+            )
+        ]
+
+    def test_xmlrpc_requests_answered_by_bounded_pool(self):
+        """Test that no more than rpc_workers requests run at once."""
+        server = XMLRPCServer(
+            RoomStateManager("node-a"), "127.0.0.1", 0, "", rpc_workers=2
+        )
+        server.start()
+        lock = threading.Lock()
+        running, peak, names = [0], [0], set()
+
+        def slow():
+            with lock:
+                running[0] += 1
+                peak[0] = max(peak[0], running[0])
+                names.add(threading.current_thread().name)
+            time.sleep(0.05)
+            with lock:
+                running[0] -= 1
+            return True
+
+        server.server.register_function(slow, "slow")
+        url = f"http://127.0.0.1:{server.server.server_address[1]}"
+        results = []
+
+        def call():
+            results.append(xmlrpc.client.ServerProxy(url).slow())
+
+        try:
+            callers = [threading.Thread(target=call) for _ in range(6)]
+            for caller in callers:
+                caller.start()
+            for caller in callers:
+                caller.join(timeout=5)
+        finally:
+            server.stop()
+
+        assert results == [True] * 6
+        assert peak[0] == 2
+        assert all(name.startswith("xmlrpc") for name in names)
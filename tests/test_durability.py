@@ -0,0 +1,208 @@
+"""
+Tests for Durable Rooms
+
+Tests for write quorums, acknowledging durable rooms' messages once a
+quorum holds them, read repair of followers' replicas, and the durable
+flag being kept with the room.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    ReplicaStore,
+    ReplicationManager,
+    RoomFailover,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+    write_quorum,
+)
+from src.node.durability import await_quorum
+from src.node.failover import merge_replicas
+from src.node.snapshot import RoomSnapshot
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+    def received(self, message_type):
+        return [
+            m["data"] for m in self.sent_messages if m["type"] == message_type
+        ]
+
+
+class Cluster:
+    """Admin node-a with a durable room replicated to node-b and node-c."""
+
+    def __init__(self):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in ("node-a", "node-b", "node-c"):
+            registry = LocalPeerRegistry(node_id, self.servers)
+            manager = RoomStateManager(node_id)
+            store = ReplicaStore()
+            failover = RoomFailover(
+                node_id, f"http://{node_id}", manager, store, registry
+            )
+            replication = ReplicationManager(node_id, manager, registry, 2)
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                failover=failover,
+                replication=replication,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "store": store,
+                "replication": replication,
+                "registry": registry,
+            }
+        self.admin = self.nodes["node-a"]
+        self.room_id = (
+            self.admin["manager"]
+            .create_room("General", "alice", durable=True)
+            .room_id
+        )
+        self.admin["manager"].add_member(self.room_id, "alice")
+
+    def send(self, content, message_id=None):
+        message = self.admin["manager"].add_message(
+            self.room_id, "alice", content, message_id=message_id
+        )
+        return {
+            "success": True,
+            "message_id": message["message_id"],
+            "sequence_number": message["sequence_number"],
+        }
+
+
+class TestQuorum:
+    """Tests for waiting for a write quorum."""
+
+    def test_write_quorum(self):
+        """Test the majority of the admin and its followers."""
+        assert [write_quorum(n) for n in (0, 1, 2, 3, 4)] == [1, 2, 2, 3, 3]
+
+    def test_acknowledged_once_quorum_holds_message(self):
+        """Test the quorum error, and the resend once followers caught up."""
+        cluster = Cluster()
+        replication = cluster.admin["replication"]
+        cluster.admin["registry"].down.update({"node-b", "node-c"})
+        sent = cluster.send("hi", "m1")
+
+        failed = await_quorum(replication, cluster.room_id, sent, 0.2)
+        cluster.admin["registry"].down.clear()
+        resent = await_quorum(replication, cluster.room_id, sent, 2)
+
+        assert failed["success"] is False
+        assert failed["error_code"] == "QUORUM_NOT_REACHED"
+        assert failed["message_id"] == "m1"
+        assert resent["success"] is True
+        assert resent["durable"] is True
+        assert resent["replicas"] >= 2
+        assert await_quorum(None, cluster.room_id, resent)["error_code"] == (
+            "QUORUM_NOT_REACHED"
+        )
+
+
+class TestReadRepair:
+    """Tests for repairing followers' replicas on reads."""
+
+    def test_lost_replica_resent(self):
+        """Test a follower that lost its replica getting it back."""
+        cluster = Cluster()
+        replication = cluster.admin["replication"]
+        for number in range(3):
+            sent = cluster.send(f"message {number}")
+        replication.wait_for_quorum(cluster.room_id, 3)
+        for node_id in ("node-b", "node-c"):
+            replication.sync_follower(cluster.room_id, node_id)
+        cluster.nodes["node-b"]["store"].remove(cluster.room_id)
+
+        repaired = replication.read_repair(cluster.room_id)
+
+        assert sent["sequence_number"] == 3
+        assert repaired == ["node-b"]
+        replica = cluster.nodes["node-b"]["store"].get(cluster.room_id)
+        assert replica.message_counter == 3
+        assert replica.durable is True
+        assert replication.read_repair(cluster.room_id) == []
+        assert replication.repair_on_read(cluster.room_id) is True
+        assert replication.repair_on_read(cluster.room_id) is False
+
+
+class TestDurableRooms:
+    """Tests for the durable flag of rooms."""
+
+    def test_durable_kept_with_room(self):
+        """Test the flag in snapshots and merged replicas."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice", durable=True).room_id
+        replica = {"node_id": "node-b", **manager.get_room(room_id).to_dict()}
+
+        snapshot = RoomSnapshot.from_room(manager, room_id)
+
+        assert snapshot.durable is True
+        assert merge_replicas([replica], 100)["durable"] is True
+
+    @pytest.mark.asyncio
+    async def test_send_message_to_durable_room(self):
+        """Test message_sent carrying the copies, and creation refused."""
+        cluster = Cluster()
+        ws_server = WebSocketServer(
+            cluster.admin["manager"],
+            "localhost",
+            0,
+            replication=cluster.admin["replication"],
+        )
+        websocket = MockWebSocket()
+        ws_server.register_client_room_membership(
+            websocket, cluster.room_id, "alice"
+        )
+        plain = WebSocketServer(RoomStateManager("node-d"), "localhost", 0)
+
+        await ws_server.process_message(
+            websocket,
+            json.dumps(
+                {
+                    "type": "send_message",
+                    "data": {
+                        "room_id": cluster.room_id,
+                        "username": "alice",
+                        "content": "hi",
+                    },
+                }
+            ),
+        )
+        await plain.process_message(
+            websocket,
+            json.dumps(
+                {
+                    "type": "create_room",
+                    "data": {
+                        "room_name": "Ledger",
+                        "creator_id": "alice",
+                        "durable": True,
+                    },
+                }
+            ),
+        )
+
+        sent = websocket.received("message_sent")[0]
+        assert sent["durable"] is True
+        assert sent["replicas"] >= 2
+        refused = websocket.received("room_created")[0]
+        assert refused["success"] is False
+        assert "replication" in refused["message"]
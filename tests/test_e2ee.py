@@ -0,0 +1,404 @@
+"""
+Tests for End-to-End Encryption Support
+
+Tests for publishing and rotating public keys in private rooms, keeping
+them across restarts, handoffs and failover, checking encrypted message
+envelopes, storing and forwarding ciphertext as is, refusing edits of
+encrypted messages, and the publish_key and get_room_keys commands
+locally and through the admin node.
+"""
+
+import base64
+import json
+from types import SimpleNamespace
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    E2EEError,
+    ReplicaStore,
+    RoomDirectory,
+    RoomSnapshot,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+    validate_encrypted_message,
+)
+from src.node.edits import EditError
+from src.node.failover import merge_replicas
+from src.node.wal import MessageLog
+
+PUBLIC_KEY = base64.b64encode(b"k" * 32).decode()
+CIPHERTEXT = base64.b64encode(b"\x00opaque\xff" * 4).decode()
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _envelope(*recipients):
+    wrapped = base64.b64encode(b"w" * 48).decode()
+    return {
+        "algorithm": "x25519-xsalsa20-poly1305",
+        "sender_key_id": "alice-1",
+        "nonce": base64.b64encode(b"n" * 24).decode(),
+        "recipients": {
+            username: {"key_id": f"{username}-1", "wrapped_key": wrapped}
+            for username in recipients
+        },
+    }
+
+
+def _room(manager, *members, private=True):
+    name = "secret" if private else "public"
+    room = manager.create_room(name, "alice", private=private)
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestPublicKeys:
+    """Tests for public keys in the room state."""
+
+    def test_publish_and_rotate(self):
+        """Test that a member's new key replaces the old one."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+
+        manager.publish_key(room_id, "bob", "bob-1", "x25519", PUBLIC_KEY)
+        key = manager.publish_key(room_id, "bob", "bob-2", "x25519", PUBLIC_KEY)
+
+        keys = manager.get_public_keys(room_id, "alice")
+        assert list(keys) == ["bob"]
+        assert keys["bob"] == key
+        assert key["key_id"] == "bob-2"
+        assert key["public_key"] == PUBLIC_KEY
+
+    def test_rejections(self):
+        """Test that public rooms, outsiders and bad keys are refused."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        public_id = _room(manager, "bob", private=False)
+
+        for args, code in (
+            ((public_id, "bob", "bob-1", "x25519", PUBLIC_KEY), "ROOM_NOT_PRIVATE"),
+            ((room_id, "mallory", "m-1", "x25519", PUBLIC_KEY), "NOT_IN_ROOM"),
+            ((room_id, "bob", "bob-1", "x25519", "not base64!"), "INVALID_KEY"),
+            ((room_id, "bob", "bob 1", "x25519", PUBLIC_KEY), "INVALID_KEY"),
+            (("missing", "bob", "bob-1", "x25519", PUBLIC_KEY), "ROOM_NOT_FOUND"),
+        ):
+            with pytest.raises(E2EEError) as error:
+                manager.publish_key(*args)
+            assert error.value.error_code == code
+
+    def test_only_current_members_listed(self):
+        """Test that keys of members who left are not handed out."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        for username in ("bob", "carol"):
+            manager.publish_key(
+                room_id, username, f"{username}-1", "x25519", PUBLIC_KEY
+            )
+
+        manager.remove_member(room_id, "carol")
+
+        assert list(manager.get_public_keys(room_id, "bob")) == ["bob"]
+
+    def test_keys_replayed_from_log(self, tmp_path):
+        """Test that published keys survive a restart."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager, "bob")
+        manager.publish_key(room_id, "bob", "bob-1", "x25519", PUBLIC_KEY)
+        manager.publish_key(room_id, "bob", "bob-2", "x25519", PUBLIC_KEY)
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        keys = recovered.get_all_public_keys(room_id)
+        assert keys["bob"]["key_id"] == "bob-2"
+
+    def test_snapshot_and_failover_keep_keys(self):
+        """Test that handoffs and merged replicas keep the newest keys."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        manager.publish_key(room_id, "bob", "bob-1", "x25519", PUBLIC_KEY)
+
+        snapshot = RoomSnapshot.from_room(manager, room_id)
+        restored = RoomStateManager("node-b")
+        restored.restore_room(**snapshot.restore_args())
+        old = {"username": "bob", "key_id": "old", "published_at": "2026-01-01"}
+        new = dict(old, key_id="new", published_at="2026-02-01")
+        base = {"room_id": room_id, "room_name": "secret", "node_id": "n1"}
+        merged = merge_replicas(
+            [
+                dict(base, public_keys={"bob": new}),
+                dict(base, node_id="n2", public_keys={"bob": old}),
+            ],
+            max_messages=10,
+        )
+
+        assert restored.get_all_public_keys(room_id)["bob"]["key_id"] == "bob-1"
+        assert merged["public_keys"]["bob"]["key_id"] == "new"
+
+
+class TestEncryptedMessages:
+    """Tests for ciphertext messages in the room state."""
+
+    def test_envelope_checked(self):
+        """Test that malformed ciphertext and envelopes are refused."""
+        envelope = _envelope("bob")
+
+        assert validate_encrypted_message(CIPHERTEXT, envelope) == (True, None)
+        for content, broken in (
+            ("plain text!", envelope),
+            (CIPHERTEXT, None),
+            (CIPHERTEXT, dict(envelope, recipients={})),
+            (CIPHERTEXT, dict(envelope, nonce="")),
+            (CIPHERTEXT, dict(envelope, plaintext="hi")),
+            (CIPHERTEXT, dict(envelope, recipients={"bob": {"key_id": "b"}})),
+        ):
+            is_valid, error = validate_encrypted_message(content, broken)
+            assert is_valid is False
+            assert error
+
+    def test_ciphertext_stored_as_is(self):
+        """Test that encrypted messages keep their content and envelope."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        envelope = _envelope("alice", "bob")
+
+        message = manager.add_message(
+            room_id, "alice", CIPHERTEXT, encryption=envelope
+        )
+        plain = manager.add_message(room_id, "alice", "hello")
+
+        assert message["content"] == CIPHERTEXT
+        assert message["encrypted"] is True
+        assert message["encryption"] == envelope
+        assert message["sequence_number"] == 1
+        assert plain["sequence_number"] == 2
+        assert "encrypted" not in plain
+
+    def test_encryption_needs_private_room(self):
+        """Test that public rooms and broken envelopes are refused."""
+        manager = RoomStateManager("node-a")
+        public_id = _room(manager, "bob", private=False)
+        room_id = _room(manager, "bob")
+
+        with pytest.raises(E2EEError) as public:
+            manager.add_message(
+                public_id, "alice", CIPHERTEXT, encryption=_envelope("bob")
+            )
+        with pytest.raises(E2EEError) as broken:
+            manager.add_message(room_id, "alice", CIPHERTEXT, encryption={})
+
+        assert public.value.error_code == "ROOM_NOT_PRIVATE"
+        assert broken.value.error_code == "INVALID_CIPHERTEXT"
+
+    def test_encrypted_message_deleted_not_edited(self):
+        """Test that edits are refused and deletion drops the wrapped keys."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message = manager.add_message(
+            room_id, "alice", CIPHERTEXT, encryption=_envelope("bob")
+        )
+
+        with pytest.raises(EditError) as error:
+            manager.edit_message(
+                room_id, "alice", message["message_id"], "edit", "new"
+            )
+        manager.edit_message(room_id, "alice", message["message_id"], "delete")
+
+        assert error.value.error_code == "MESSAGE_ENCRYPTED"
+        (stored,) = manager.get_messages(room_id)
+        assert stored["deleted"] is True
+        assert "encryption" not in stored
+
+
+class TestKeyCommands:
+    """Tests for the key commands and encrypted messages over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_publish_key_announced(self):
+        """Test that a published key is confirmed and broadcast."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        response = await _request(
+            ws_server,
+            bob,
+            "publish_key",
+            room_id=room_id,
+            username="bob",
+            key_id="bob-1",
+            algorithm="x25519",
+            public_key=PUBLIC_KEY,
+        )
+        keys = await _request(
+            ws_server, alice, "get_room_keys", room_id=room_id, username="alice"
+        )
+
+        assert response["type"] == "publish_key_success"
+        assert response["data"]["key_id"] == "bob-1"
+        (event,) = alice.received("key_published")
+        assert event["room_id"] == room_id
+        assert event["public_key"] == PUBLIC_KEY
+        assert keys["type"] == "room_keys"
+        assert keys["data"]["keys"]["bob"]["key_id"] == "bob-1"
+
+    @pytest.mark.asyncio
+    async def test_public_room_rejected(self):
+        """Test that publishing to a public room gets key_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", private=False)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            _join(ws_server, room_id, "bob"),
+            "publish_key",
+            room_id=room_id,
+            username="bob",
+            key_id="bob-1",
+            algorithm="x25519",
+            public_key=PUBLIC_KEY,
+        )
+
+        assert response["type"] == "key_error"
+        assert response["data"]["request_type"] == "publish_key"
+        assert response["data"]["error_code"] == "ROOM_NOT_PRIVATE"
+
+    @pytest.mark.asyncio
+    async def test_keys_and_ciphertext_through_admin(self):
+        """Test that a client on another node publishes and sends via the admin."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, "bob")
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+        bob = _join(ws_b, room_id, "bob")
+        envelope = _envelope("alice", "bob")
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            published = await _request(
+                ws_b,
+                bob,
+                "publish_key",
+                room_id=room_id,
+                username="bob",
+                key_id="bob-1",
+                algorithm="x25519",
+                public_key=PUBLIC_KEY,
+            )
+            await _request(
+                ws_b,
+                bob,
+                "send_message",
+                room_id=room_id,
+                username="bob",
+                content=CIPHERTEXT,
+                message_id="m-1",
+                encryption=envelope,
+            )
+
+        assert published["type"] == "publish_key_success"
+        assert admin.get_all_public_keys(room_id)["bob"]["key_id"] == "bob-1"
+        (sent,) = bob.received("message_sent")
+        assert sent["message_id"] == "m-1"
+        (message,) = admin.get_messages(room_id)
+        assert message["content"] == CIPHERTEXT
+        assert message["encryption"] == envelope
+
+    @pytest.mark.asyncio
+    async def test_bad_ciphertext_rejected(self):
+        """Test that a malformed encrypted message gets message_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            _join(ws_server, room_id, "bob"),
+            "send_message",
+            room_id=room_id,
+            username="bob",
+            content="plain text",
+            encryption=_envelope("alice"),
+        )
+
+        assert response["type"] == "message_error"
+        assert response["data"]["error_code"] == "INVALID_CIPHERTEXT"
+        assert manager.get_messages(room_id) == []
+
+    def test_event_applied_to_replica(self):
+        """Test that a key_published event updates the replica."""
+        store = ReplicaStore()
+        store.update_from_join({"room_id": "r1", "room_name": "secret"}, [], "bob")
+        rpc = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b:9090",
+            failover=SimpleNamespace(replica_store=store),
+        )
+        event = {
+            "room_id": "r1",
+            "username": "bob",
+            "key_id": "bob-1",
+            "algorithm": "x25519",
+            "public_key": PUBLIC_KEY,
+            "published_at": "2026-01-01T00:00:00+00:00",
+            "hlc": "x",
+        }
+
+        rpc.receive_member_event_broadcast("r1", "key_published", event)
+
+        key = store.get("r1").public_keys["bob"]
+        assert key["key_id"] == "bob-1"
+        assert "hlc" not in key
@@ -0,0 +1,278 @@
+"""
+Tests for Message Editing and Deletion
+
+Tests for who may edit or delete a message, tombstones, replaying edit
+records from the message log, announcing edits over WebSocket and to the
+admin node, and applying them to replicas on other nodes.
+"""
+
+import json
+from types import SimpleNamespace
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    EditError,
+    ReplicaStore,
+    RoomDirectory,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.failover import merge_replicas
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, *members):
+    room = manager.create_room("general", "alice")
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestEditMessage:
+    """Tests for edits and deletions in the room state."""
+
+    def test_author_edits(self):
+        """Test that the author can change a message's content."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message = manager.add_message(room_id, "bob", "helo")
+
+        edit = manager.edit_message(
+            room_id, "bob", message["message_id"], "edit", "hello"
+        )
+
+        stored = manager.get_messages(room_id)[0]
+        assert stored["content"] == "hello"
+        assert stored["edited_by"] == "bob"
+        assert stored["edited_at"] == edit["timestamp"]
+        assert stored["sequence_number"] == message["sequence_number"]
+
+    def test_others_not_allowed(self):
+        """Test that other members can't change a message."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        message = manager.add_message(room_id, "bob", "hi")
+
+        with pytest.raises(EditError) as not_allowed:
+            manager.edit_message(room_id, "carol", message["message_id"], "delete")
+        with pytest.raises(EditError) as not_found:
+            manager.edit_message(room_id, "bob", "missing", "delete")
+
+        assert not_allowed.value.error_code == "NOT_ALLOWED"
+        assert not_found.value.error_code == "MESSAGE_NOT_FOUND"
+
+    def test_moderator_deletes(self):
+        """Test that a moderator's deletion leaves a tombstone."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        manager.set_member_role(room_id, "alice", "carol", "moderator")
+        message = manager.add_message(room_id, "bob", "spam")
+
+        manager.edit_message(room_id, "carol", message["message_id"], "delete")
+
+        stored = manager.get_messages(room_id)[0]
+        assert stored["deleted"] is True
+        assert stored["content"] == ""
+        assert stored["deleted_by"] == "carol"
+        with pytest.raises(EditError) as deleted:
+            manager.edit_message(
+                room_id, "bob", message["message_id"], "edit", "again"
+            )
+        assert deleted.value.error_code == "MESSAGE_DELETED"
+
+    def test_empty_edit_rejected(self):
+        """Test that edits are validated like new messages."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message = manager.add_message(room_id, "bob", "hi")
+
+        with pytest.raises(EditError) as invalid:
+            manager.edit_message(room_id, "bob", message["message_id"], "edit", "")
+
+        assert invalid.value.error_code == "INVALID_CONTENT"
+
+    def test_edits_replayed_from_log(self, tmp_path):
+        """Test that edit records survive a restart and reach history."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager, "bob")
+        first = manager.add_message(room_id, "bob", "helo")
+        second = manager.add_message(room_id, "bob", "oops")
+        manager.edit_message(room_id, "bob", first["message_id"], "edit", "hello")
+        manager.edit_message(room_id, "bob", second["message_id"], "delete")
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        messages = recovered.get_messages(room_id)
+        assert messages[0]["content"] == "hello"
+        assert messages[1]["deleted"] is True
+        history = recovered.get_history(room_id, "bob")["messages"]
+        assert [m.get("deleted", False) for m in history] == [False, True]
+
+
+class TestEditCommands:
+    """Tests for edit_message and delete_message over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_edit_announced_to_room(self):
+        """Test that an edit is confirmed and broadcast to members."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message = manager.add_message(room_id, "alice", "helo")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        response = await _request(
+            ws_server,
+            alice,
+            "edit_message",
+            room_id=room_id,
+            username="alice",
+            message_id=message["message_id"],
+            content="hello",
+        )
+
+        assert response["type"] == "edit_message_success"
+        edited = bob.received("message_edited")[0]
+        assert edited["message_id"] == message["message_id"]
+        assert edited["content"] == "hello"
+        assert edited["action"] == "edit"
+
+    @pytest.mark.asyncio
+    async def test_delete_rejected(self):
+        """Test that a refused deletion gets message_edit_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message = manager.add_message(room_id, "alice", "hi")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            _join(ws_server, room_id, "bob"),
+            "delete_message",
+            room_id=room_id,
+            username="bob",
+            message_id=message["message_id"],
+        )
+
+        assert response["type"] == "message_edit_error"
+        assert response["data"]["request_type"] == "delete_message"
+        assert response["data"]["error_code"] == "NOT_ALLOWED"
+
+    @pytest.mark.asyncio
+    async def test_delete_forwarded_to_admin(self):
+        """Test that a deletion for a remote room is made by its admin."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, "bob")
+        message = admin.add_message(room_id, "bob", "oops")
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            response = await _request(
+                ws_b,
+                _join(ws_b, room_id, "bob"),
+                "delete_message",
+                room_id=room_id,
+                username="bob",
+                message_id=message["message_id"],
+            )
+
+        assert response["type"] == "delete_message_success"
+        assert admin.get_messages(room_id)[0]["deleted"] is True
+
+
+class TestReplicas:
+    """Tests for edits reaching replicas on other nodes."""
+
+    def test_event_applied_to_replica(self):
+        """Test that a message_deleted event updates the local replica."""
+        store = ReplicaStore()
+        room_info = {"room_id": "r1", "room_name": "general"}
+        message = {"message_id": "m1", "sequence_number": 1, "content": "hi"}
+        store.update_from_join(room_info, [message], "bob")
+        rpc = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b:9090",
+            failover=SimpleNamespace(replica_store=store),
+        )
+        edit = {
+            "message_id": "m1",
+            "action": "delete",
+            "content": None,
+            "username": "bob",
+            "timestamp": "2026-01-01T00:00:00+00:00",
+        }
+
+        rpc.receive_member_event_broadcast("r1", "message_deleted", edit)
+
+        assert store.get("r1").messages[0]["deleted"] is True
+
+    def test_merge_keeps_tombstone(self):
+        """Test that failover keeps the deleted copy of a message."""
+        base = {"room_id": "r1", "room_name": "general", "node_id": "node-b"}
+        message = {"message_id": "m1", "sequence_number": 1, "content": "hi"}
+        tombstone = dict(message, content="", deleted=True)
+        merged = merge_replicas(
+            [
+                dict(base, messages=[message]),
+                dict(base, node_id="node-c", messages=[tombstone]),
+            ],
+            max_messages=10,
+        )
+
+        assert merged["messages"] == [tombstone]
@@ -0,0 +1,119 @@
+"""
+Tests for the Outbound Connection Policy
+
+Tests for refusing connections to internal addresses unless their
+network is allowed, and for HTTP requests that don't follow redirects.
+"""
+
+import threading
+from contextlib import contextmanager
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+import pytest
+
+from src.node import EgressError, EgressPolicy
+from src.node.config import NodeConfig
+from src.node.webhooks import http_post
+
+
+class Endpoint(BaseHTTPRequestHandler):
+    """Local endpoint redirecting /redirect and recording requests."""
+
+    paths = []
+
+    def do_POST(self):
+        self.paths.append(self.path)
+        self.rfile.read(int(self.headers["Content-Length"]))
+        if self.path == "/redirect":
+            self.send_response(302)
+            self.send_header("Location", "/internal")
+        else:
+            self.send_response(204)
+        self.end_headers()
+
+    def log_message(self, format, *args):
+        pass
+
+
+@contextmanager
+def _endpoint():
+    Endpoint.paths = []
+    server = HTTPServer(("127.0.0.1", 0), Endpoint)
+    thread = threading.Thread(target=server.serve_forever, daemon=True)
+    thread.start()
+    try:
+        yield f"http://127.0.0.1:{server.server_address[1]}"
+    finally:
+        server.shutdown()
+        server.server_close()
+
+
+def _post(url, egress):
+    return http_post(url, b"{}", {"Content-Type": "application/json"}, 5, egress)
+
+
+class TestEgressPolicy:
+    """Tests for deciding which addresses may be connected to."""
+
+    def test_internal_addresses_refused(self):
+        """Test loopback, private, link-local and other ranges refused."""
+        policy = EgressPolicy()
+
+        for address in (
+            "127.0.0.1",
+            "10.1.2.3",
+            "172.16.0.1",
+            "192.168.1.1",
+            "169.254.169.254",
+            "100.64.0.1",
+            "0.0.0.0",
+            "224.0.0.1",
+            "::1",
+            "fe80::1",
+            "fd00::1",
+            "::ffff:127.0.0.1",
+        ):
+            assert not policy.permits(address), address
+        assert policy.permits("93.184.216.34")
+        assert policy.permits("2606:4700::1111")
+
+    def test_allowed_networks(self):
+        """Test internal networks the operator allows permitted."""
+        policy = EgressPolicy(["10.0.0.0/8", "fd00::/8"])
+
+        assert policy.permits("10.1.2.3")
+        assert policy.permits("fd00::1")
+        assert not policy.permits("192.168.1.1")
+        with pytest.raises(ValueError):
+            EgressPolicy(["not-a-network"])
+        assert NodeConfig(egress_allow=["10.0.0.0/33"]).validate() != []
+
+    def test_connect_refuses_host_names_of_internal_addresses(self):
+        """Test a name resolving to loopback refused before connecting."""
+        with pytest.raises(EgressError):
+            EgressPolicy().connect(("localhost", 80), 1)
+
+
+class TestHTTP:
+    """Tests for HTTP requests through the policy."""
+
+    def test_internal_targets_refused(self):
+        """Test requests to internal addresses refused unless allowed."""
+        with _endpoint() as url:
+            with pytest.raises(EgressError):
+                _post(f"{url}/hook", EgressPolicy())
+            with pytest.raises(EgressError):
+                _post("http://169.254.169.254/latest/meta-data", EgressPolicy())
+            assert Endpoint.paths == []
+
+            assert _post(f"{url}/hook", EgressPolicy(["127.0.0.0/8"])) == 204
+            assert Endpoint.paths == ["/hook"]
+
+    def test_redirects_not_followed(self):
+        """Test a redirect returned as the status, with or without policy."""
+        allowed = EgressPolicy(["127.0.0.0/8"])
+
+        with _endpoint() as url:
+            assert _post(f"{url}/redirect", allowed) == 302
+            assert _post(f"{url}/redirect", None) == 302
+            assert Endpoint.paths == ["/redirect", "/redirect"]
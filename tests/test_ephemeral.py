@@ -0,0 +1,120 @@
+"""
+Tests for Ephemeral Rooms
+
+Tests for finding the ephemeral rooms that are empty or idle, tearing
+them down with the coordinated deletion, and the flag being kept with the
+room on other nodes.
+"""
+
+import json
+import time
+
+import pytest
+
+from src.node import (
+    DirectoryEntry,
+    EphemeralReaper,
+    RoomStateManager,
+    WebSocketServer,
+)
+from src.node.ephemeral import EMPTY, IDLE
+from src.node.failover import merge_replicas
+from src.node.snapshot import RoomSnapshot
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+
+class TestDue:
+    """Tests for which rooms are torn down."""
+
+    def test_empty_and_idle_rooms_due(self):
+        """Test the grace for new rooms, emptied rooms and idle rooms."""
+        manager = RoomStateManager("node-a")
+        huddle = manager.create_room("Huddle", "alice", ephemeral=True)
+        busy = manager.create_room("Busy", "alice", ephemeral=True)
+        manager.create_room("General", "alice")
+        manager.add_member(busy.room_id, "alice")
+        reaper = EphemeralReaper(manager, None, idle_timeout=3600)
+        now = time.time()
+
+        fresh = reaper.due(now)
+        later = reaper.due(now + 61)
+        idle = reaper.due(now + 3601)
+        manager.remove_member(busy.room_id, "alice")
+        emptied = reaper.due(now)
+
+        assert fresh == {}
+        assert later == {huddle.room_id: EMPTY}
+        assert idle == {huddle.room_id: EMPTY, busy.room_id: IDLE}
+        assert emptied == {busy.room_id: EMPTY}
+        assert EphemeralReaper(manager, None, idle_timeout=0).due(
+            now + 86400
+        ) == {huddle.room_id: EMPTY, busy.room_id: EMPTY}
+
+    def test_flag_kept_with_room(self):
+        """Test snapshots, replicas and directory entries."""
+        manager = RoomStateManager("node-a")
+        huddle = manager.create_room("Huddle", "alice", ephemeral=True)
+        general = manager.create_room("General", "alice")
+        snapshot = RoomSnapshot.from_room(manager, huddle.room_id)
+        replica = {"node_id": "node-b", **huddle.to_dict()}
+        entry = DirectoryEntry("room-1", "Huddle", "node-a", ephemeral=True)
+
+        assert general.ephemeral is False
+        assert snapshot.ephemeral is True
+        assert merge_replicas([replica], 100)["ephemeral"] is True
+        assert DirectoryEntry.from_dict(entry.to_dict()).ephemeral is True
+
+
+class TestTeardown:
+    """Tests for tearing rooms down."""
+
+    @pytest.mark.asyncio
+    async def test_failed_teardown_retried(self):
+        """Test that a room whose deletion failed is due again."""
+        manager = RoomStateManager("node-a")
+        huddle = manager.create_room("Huddle", "alice", ephemeral=True)
+        calls = []
+
+        async def close_room(room_id, initiator):
+            calls.append((room_id, initiator))
+            return {"success": len(calls) > 1, "error": "Busy"}
+
+        reaper = EphemeralReaper(manager, close_room, empty_grace=0)
+
+        assert await reaper.run_round() == {}
+        assert await reaper.run_round() == {huddle.room_id: EMPTY}
+        assert calls == [(huddle.room_id, "ephemeral")] * 2
+
+    @pytest.mark.asyncio
+    async def test_last_member_leaving_deletes_room(self):
+        """Test the coordinated deletion once the last member left."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        manager = ws_server.room_manager
+        huddle = manager.create_room("Huddle", "alice", ephemeral=True)
+        manager.add_member(huddle.room_id, "alice")
+        websocket = MockWebSocket()
+        ws_server.register_client_room_membership(
+            websocket, huddle.room_id, "bob"
+        )
+        reaper = EphemeralReaper(manager, ws_server.close_room)
+
+        kept = await reaper.run_round()
+        manager.remove_member(huddle.room_id, "alice")
+        deleted = await reaper.run_round()
+
+        assert kept == {}
+        assert deleted == {huddle.room_id: EMPTY}
+        assert manager.get_room(huddle.room_id) is None
+        initiated, removed = websocket.sent_messages
+        assert initiated["type"] == "delete_room_initiated"
+        assert initiated["data"]["initiator"] == "ephemeral"
+        assert removed["type"] == "room_deleted"
@@ -0,0 +1,185 @@
+"""
+Tests for the Error Catalog
+
+Tests for error codes' categories and retryable flags, and for their
+reaching clients over WebSocket, peers over XML-RPC and operators through
+the admin API.
+"""
+
+import asyncio
+import http.client
+import json
+
+import pytest
+
+from src.client import ClientService, NodeError
+from src.client.schemas import MessageErrorResponse
+from src.node import RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.admin_api import AdminAPI, AdminServer
+from src.node.log_context import ServerProxy
+from src.node.schemas import ERROR_CATALOG, describe_error, error_fields
+from src.node.schemas.errors import CATEGORIES, INTERNAL, annotate_error
+
+TOKEN = "secret"
+
+
+class ServerSide:
+    """The node's end of a NodeWebSocket."""
+
+    def __init__(self):
+        self.responses = asyncio.Queue()
+
+    async def send(self, message):
+        await self.responses.put(message)
+
+
+class NodeWebSocket:
+    """Client connection answered by a WebSocketServer in-process."""
+
+    def __init__(self, ws_server):
+        self.ws_server = ws_server
+        self.server_side = ServerSide()
+
+    async def send(self, message):
+        await self.ws_server.process_message(self.server_side, message)
+
+    async def recv(self):
+        return await self.server_side.responses.get()
+
+
+def _connect(ws_server):
+    """Connect a ClientService to a WebSocketServer in-process."""
+    service = ClientService("ws://localhost:8080")
+    service._set_test_mode(NodeWebSocket(ws_server))
+    return service
+
+
+def _request(port, path, token):
+    """GET an admin API path."""
+    connection = http.client.HTTPConnection("127.0.0.1", port)
+    try:
+        headers = {"Authorization": f"Bearer {token}"} if token else {}
+        connection.request("GET", path, headers=headers)
+        response = connection.getresponse()
+        return response.status, json.loads(response.read())
+    finally:
+        connection.close()
+
+
+class TestCatalog:
+    """Tests for looking error codes up."""
+
+    def test_codes_described(self):
+        """Test known codes, unknown codes and the fields sent with them."""
+        spec = describe_error("ROOM_MIGRATING")
+        unknown = describe_error("SOMETHING_ELSE")
+
+        assert (spec.category, spec.retryable) == ("unavailable", True)
+        assert describe_error("ROOM_NOT_FOUND").retryable is False
+        assert unknown.category == INTERNAL
+        assert unknown.retryable is False
+        assert error_fields("NOT_ALLOWED") == {
+            "error_code": "NOT_ALLOWED",
+            "category": "forbidden",
+            "retryable": False,
+        }
+        assert all(s.category in CATEGORIES for s in ERROR_CATALOG.values())
+        assert all(code == s.code for code, s in ERROR_CATALOG.items())
+
+    def test_annotate(self):
+        """Test results given a category only when they have a code."""
+        failed = annotate_error({"success": False, "error_code": "TIMEOUT"})
+
+        assert failed["category"] == "unavailable"
+        assert failed["retryable"] is True
+        assert annotate_error({"success": True}) == {"success": True}
+        assert annotate_error(None) is None
+
+
+class TestClients:
+    """Tests for the errors clients get."""
+
+    @pytest.mark.asyncio
+    async def test_error_responses_carry_category(self):
+        """Test WebSocket errors, the client's NodeError and protocol_info."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        service = _connect(WebSocketServer(manager, "localhost", 0))
+
+        with pytest.raises(NodeError) as join:
+            await service.join_room("missing", "alice")
+        with pytest.raises(NodeError) as pin:
+            await service.pin_message(room_id, "bob", "m1")
+        info = await service.get_protocol_info()
+
+        assert join.value.error_code == "ROOM_NOT_FOUND"
+        assert join.value.category == "not_found"
+        assert join.value.retryable is False
+        assert pin.value.error_code in ERROR_CATALOG
+        assert pin.value.category == describe_error(pin.value.error_code).category
+        assert isinstance(pin.value, ValueError)
+        assert info["errors"]["RATE_LIMITED"]["retryable"] is True
+        assert info["errors"]["ROOM_FULL"]["category"] == "limit_exceeded"
+
+    def test_client_schema(self):
+        """Test error responses parsed with their category."""
+        response = MessageErrorResponse.from_json(
+            json.dumps(
+                {
+                    "type": "message_error",
+                    "data": {
+                        "room_id": "r",
+                        "error": "Room is moving",
+                        **error_fields("ROOM_MIGRATING"),
+                    },
+                }
+            )
+        )
+
+        assert response.category == "unavailable"
+        assert response.retryable is True
+
+
+class TestPeersAndOperators:
+    """Tests for the errors peers and the admin API get."""
+
+    def test_xmlrpc_results_carry_category(self):
+        """Test failed peer calls answered with the code's category."""
+        manager = RoomStateManager("node-a")
+        server = XMLRPCServer(manager, "127.0.0.1", 0, "")
+        server.start()
+        try:
+            port = server.server.server_address[1]
+            proxy = ServerProxy(f"http://127.0.0.1:{port}", allow_none=True)
+            missing = proxy.forward_message("missing", "alice", "hi", "n")
+            rejected = proxy.forward_message("bad id!", "alice", "hi", "n")
+        finally:
+            server.stop()
+
+        assert missing["category"] == describe_error(
+            missing["error_code"]
+        ).category
+        assert missing["retryable"] is False
+        assert rejected["error_code"] == "INVALID_ROOM_ID"
+        assert rejected["category"] == "invalid_request"
+
+    @pytest.mark.asyncio
+    async def test_admin_errors_carry_category(self):
+        """Test admin API errors, including ones from the node."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        server = AdminServer(AdminAPI(ws_server), TOKEN, "127.0.0.1", 0)
+        server.start()
+        loop = asyncio.get_running_loop()
+        try:
+            unauthorized = await loop.run_in_executor(
+                None, _request, server.port, "/admin/rooms", None
+            )
+            status, missing = await loop.run_in_executor(
+                None, _request, server.port, "/admin/rooms/missing/export", TOKEN
+            )
+        finally:
+            server.stop()
+
+        assert unauthorized[1]["category"] == "unauthenticated"
+        assert status == 404
+        assert missing["category"] == "not_found"
@@ -0,0 +1,212 @@
+"""
+Tests for History Export
+
+Tests for rebuilding a room's messages from its records in two passes,
+filtering by time range, encoding NDJSON and JSON, and streaming exports
+of hosted and archived rooms through the admin API.
+"""
+
+import asyncio
+import http.client
+import json
+
+import pytest
+
+from src.node import (
+    AdminAPI,
+    AdminServer,
+    AuditLog,
+    ExportError,
+    MemoryStorage,
+    RoomStateManager,
+    WebSocketServer,
+)
+from src.node.admin_api import StreamedBody
+from src.node.compaction import RetentionPolicy
+from src.node.export import (
+    encode_export,
+    parse_range,
+    select_messages,
+    stored_messages,
+)
+from src.node.storage import replay_messages
+
+TOKEN = "s3cret"
+
+
+def _room(manager):
+    """A room with a thread, an edit, a deletion and reactions."""
+    room = manager.create_room("General", "alice")
+    for username in ("alice", "bob"):
+        manager.add_member(room.room_id, username)
+    first = manager.add_message(room.room_id, "alice", "hello")
+    second = manager.add_message(room.room_id, "bob", "typo")
+    manager.add_message(
+        room.room_id, "bob", "hi", reply_to=first["message_id"]
+    )
+    manager.edit_message(
+        room.room_id, "bob", second["message_id"], "edit", "fixed"
+    )
+    manager.react(room.room_id, "bob", first["message_id"], "👍")
+    manager.react(room.room_id, "alice", first["message_id"], "👍")
+    return room.room_id, first, second
+
+
+def _export(manager, room_id, since=None, until=None):
+    return list(manager.export_history(room_id, since, until))
+
+
+class TestStoredMessages:
+    """Tests for rebuilding messages from records."""
+
+    def test_same_messages_as_replay(self):
+        """Test edits, reactions and threads, before and after compaction."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node-a", storage)
+        room_id, first, second = _room(manager)
+        reply = manager.get_room(room_id).messages[-1]
+
+        def without_edits(messages):
+            return [
+                {k: v for k, v in m.items() if k != "edits"} for m in messages
+            ]
+
+        exported = list(stored_messages(lambda: storage.records(room_id)))
+        assert without_edits(exported) == replay_messages(
+            storage.records(room_id)
+        )
+        assert exported[0]["reactions"] == {"👍": ["alice", "bob"]}
+        assert exported[0]["thread"]["reply_count"] == 1
+        assert [e["content"] for e in exported[1]["edits"]] == ["fixed"]
+
+        manager.compact_room(room_id, RetentionPolicy(max_messages=2))
+        manager.edit_message(room_id, "bob", reply["message_id"], "delete")
+        compacted = list(stored_messages(lambda: storage.records(room_id)))
+
+        assert without_edits(compacted) == replay_messages(
+            storage.records(room_id)
+        )
+        assert compacted[0]["edits"] == []
+        assert compacted[0]["edited_by"] == "bob"
+        assert compacted[1]["deleted"] is True
+        assert [e["action"] for e in compacted[1]["edits"]] == ["delete"]
+
+    def test_time_range_and_encoding(self):
+        """Test since and until, invalid ranges, and both formats."""
+        manager = RoomStateManager("node-a")
+        room_id, first, second = _room(manager)
+        since, until = parse_range(second["timestamp"], "2999-01-01")
+
+        kept = list(select_messages(_export(manager, room_id), since, until))
+        ndjson = b"".join(encode_export(kept))
+        array = b"".join(encode_export(kept, "json"))
+
+        assert [m["content"] for m in kept] == ["fixed", "hi"]
+        assert [json.loads(line) for line in ndjson.splitlines()] == kept
+        assert json.loads(array) == kept
+        assert b"".join(encode_export([], "json")) == b"[]\n"
+        assert parse_range() == (None, None)
+        for bounds in (("yesterday", None), ("2026-02-01", "2026-01-01")):
+            with pytest.raises(ExportError) as error:
+                parse_range(*bounds)
+            assert error.value.error_code == "INVALID_REQUEST"
+
+
+class TestExportRooms:
+    """Tests for exporting hosted and archived rooms."""
+
+    def test_hosted_and_archived_rooms(self):
+        """Test the buffer, the log, the archive and a missing room."""
+        storage = MemoryStorage()
+        room_id = _room(RoomStateManager("node-a", storage))[0]
+        manager = RoomStateManager("node-a", storage)
+        manager.recover_rooms(max_messages=1)
+        buffered = RoomStateManager("node-a")
+        buffer_room = _room(buffered)[0]
+
+        from_log = _export(manager, room_id)
+        buffer = manager.get_room(room_id).messages
+        manager.archive_room(room_id, "admin")
+        archived = _export(manager, room_id)
+
+        assert len(buffer) == 1
+        assert [m["content"] for m in from_log] == ["hello", "fixed", "hi"]
+        assert len(_export(buffered, buffer_room)) == 3
+        assert [m["content"] for m in archived] == ["hello", "fixed", "hi"]
+        assert archived[1]["edits"] == []
+        with pytest.raises(ExportError) as error:
+            _export(manager, "missing")
+        assert error.value.error_code == "ROOM_NOT_FOUND"
+
+
+def _download(port, path):
+    connection = http.client.HTTPConnection("127.0.0.1", port, timeout=5)
+    try:
+        connection.request(
+            "GET", path, headers={"Authorization": f"Bearer {TOKEN}"}
+        )
+        response = connection.getresponse()
+        return response.status, dict(response.getheaders()), response.read()
+    finally:
+        connection.close()
+
+
+class TestExportEndpoint:
+    """Tests for GET /admin/rooms/<room_id>/export."""
+
+    @pytest.mark.asyncio
+    async def test_export_endpoint(self, tmp_path):
+        """Test the streamed body, errors and the audit entry."""
+        audit_log = AuditLog(str(tmp_path / "audit.log"), "node-a")
+        manager = RoomStateManager("node-a", audit_log=audit_log)
+        room_id = _room(manager)[0]
+        api = AdminAPI(WebSocketServer(manager, "localhost", 0))
+        path = f"/admin/rooms/{room_id}/export"
+
+        body = await api.handle("GET", path, {"format": "json"})
+        bad_format = await api.handle("GET", path, {"format": "csv"})
+        bad_time = await api.handle("GET", path, {"since": "soon"})
+        missing = await api.handle("GET", "/admin/rooms/missing/export")
+        wrong_method = await api.handle("POST", path)
+
+        assert isinstance(body, StreamedBody)
+        assert body.content_type == "application/json"
+        assert body.filename == f"{room_id}.json"
+        assert len(json.loads(b"".join(body.chunks))) == 3
+        assert bad_format["error_code"] == bad_time["error_code"] == (
+            "INVALID_REQUEST"
+        )
+        assert missing["error_code"] == "ROOM_NOT_FOUND"
+        assert wrong_method["error_code"] == "METHOD_NOT_ALLOWED"
+        (entry,) = audit_log.query(action="history_exported")
+        assert (entry.target, entry.details["format"]) == (room_id, "json")
+
+    @pytest.mark.asyncio
+    async def test_streamed_over_http(self):
+        """Test that the server streams NDJSON without a Content-Length."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)[0]
+        server = AdminServer(
+            AdminAPI(WebSocketServer(manager, "localhost", 0)),
+            TOKEN,
+            "127.0.0.1",
+            0,
+        )
+        server.start()
+        loop = asyncio.get_running_loop()
+        try:
+            status, headers, body = await loop.run_in_executor(
+                None, _download, server.port, f"/admin/rooms/{room_id}/export"
+            )
+            missing = await loop.run_in_executor(
+                None, _download, server.port, "/admin/rooms/missing/export"
+            )
+        finally:
+            server.stop()
+
+        lines = [json.loads(line) for line in body.splitlines()]
+        assert status == 200
+        assert headers["Content-Type"] == "application/x-ndjson"
+        assert "Content-Length" not in headers
+        assert [m["username"] for m in lines] == ["alice", "bob", "bob"]
+        assert missing[0] == 404
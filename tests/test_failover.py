@@ -0,0 +1,403 @@
+"""
+Tests for Room Administrator Failover
+
+Tests for room replicas, replica merging, room restoration, the bully
+election and re-pointing rooms to the new administrator.
+"""
+
+import time
+import pytest
+
+from src.node import (
+    RoomStateManager,
+    RoomDirectory,
+    XMLRPCServer,
+    ReplicaStore,
+    RoomFailover,
+    MembershipEvent,
+    PeerState,
+)
+from src.node.failover import merge_replicas
+from tests.fakes import LocalPeerRegistry
+
+
+class StubFailureDetector:
+    """Failure detector with a fixed set of dead peers."""
+
+    def __init__(self, peer_registry, dead):
+        self.peer_registry = peer_registry
+        self.dead = set(dead)
+
+    def is_alive(self, node_id):
+        return node_id not in self.dead
+
+    def alive_peers(self):
+        return [
+            node_id
+            for node_id in self.peer_registry.list_peers()
+            if node_id not in self.dead
+        ]
+
+
+def _room_info(room_id="room-1", admin="node-a", members=None):
+    return {
+        "room_id": room_id,
+        "room_name": "General",
+        "description": "Chat",
+        "creator_id": "alice",
+        "admin_node": admin,
+        "members": members or ["alice", "bob", "carol"],
+        "vector_clock": {"node-a": 1},
+    }
+
+
+def _message(seq, origin="node-b"):
+    return {
+        "message_id": f"msg-{seq}",
+        "room_id": "room-1",
+        "username": "bob",
+        "content": f"hello {seq}",
+        "sequence_number": seq,
+        "timestamp": "2024-01-01T00:00:00+00:00",
+        "vector_clock": {origin: seq},
+        "origin_node": origin,
+    }
+
+
+class Cluster:
+    """Nodes node-b and node-c holding replicas of a room on dead node-a."""
+
+    def __init__(self, election_timeout=10):
+        self.servers = {"node-a": None}
+        self.nodes = {}
+        for node_id in ("node-b", "node-c"):
+            registry = LocalPeerRegistry(node_id, self.servers)
+            detector = StubFailureDetector(registry, dead=["node-a"])
+            manager = RoomStateManager(node_id)
+            directory = RoomDirectory(node_id, f"http://{node_id}")
+            store = ReplicaStore()
+            failover = RoomFailover(
+                node_id,
+                f"http://{node_id}",
+                manager,
+                store,
+                registry,
+                detector,
+                directory,
+                election_timeout=election_timeout,
+            )
+            notified = []
+            failover.set_notify_callback(
+                lambda room_id, msg, notified=notified: notified.append(
+                    (room_id, msg)
+                )
+            )
+            server = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                directory,
+                failover=failover,
+            )
+            self.servers[node_id] = server
+            self.nodes[node_id] = {
+                "manager": manager,
+                "directory": directory,
+                "store": store,
+                "failover": failover,
+                "notified": notified,
+                "registry": registry,
+            }
+
+        self.nodes["node-b"]["store"].update_from_join(
+            _room_info(), [_message(1)], "bob"
+        )
+        self.nodes["node-c"]["store"].update_from_join(
+            _room_info(), [_message(1)], "carol"
+        )
+
+
+class TestReplicaStore:
+    """Tests for ReplicaStore."""
+
+    def test_update_from_join_creates_replica(self):
+        """Test that a successful join creates a replica."""
+        store = ReplicaStore()
+        store.update_from_join(_room_info(), [_message(1)], "bob")
+
+        replica = store.get("room-1")
+        assert replica.room_name == "General"
+        assert replica.admin_node == "node-a"
+        assert replica.local_members == ["bob"]
+        assert replica.message_counter == 1
+        assert replica.vector_clock == {"node-a": 1, "node-b": 1}
+
+    def test_record_message_ignores_duplicates(self):
+        """Test that messages are recorded once, in sequence order."""
+        store = ReplicaStore()
+        store.update_from_join(_room_info(), [], "bob")
+
+        store.record_message("room-1", _message(2))
+        store.record_message("room-1", _message(1))
+        store.record_message("room-1", _message(2))
+
+        replica = store.get("room-1")
+        assert [m["sequence_number"] for m in replica.messages] == [1, 2]
+        assert replica.message_counter == 2
+
+    def test_messages_are_bounded(self):
+        """Test that only the most recent messages are kept."""
+        store = ReplicaStore(max_messages=2)
+        store.update_from_join(_room_info(), [], "bob")
+
+        for seq in range(1, 5):
+            store.record_message("room-1", _message(seq))
+
+        replica = store.get("room-1")
+        assert [m["sequence_number"] for m in replica.messages] == [3, 4]
+        assert replica.message_counter == 4
+
+    def test_record_member_event(self):
+        """Test that member events update the member list."""
+        store = ReplicaStore()
+        store.update_from_join(_room_info(members=["bob"]), [], "bob")
+
+        store.record_member_event("room-1", "member_joined", "dave")
+        store.record_member_event("room-1", "member_left", "bob")
+
+        assert store.get("room-1").members == ["dave"]
+
+    def test_replica_dropped_when_last_local_member_leaves(self):
+        """Test that a replica is dropped with its last local member."""
+        store = ReplicaStore()
+        store.update_from_join(_room_info(), [], "bob")
+        store.update_from_join(_room_info(), [], "dave")
+
+        store.remove_local_member("room-1", "bob")
+        assert store.get("room-1") is not None
+
+        store.remove_local_member("room-1", "dave")
+        assert store.get("room-1") is None
+
+    def test_rooms_administered_by(self):
+        """Test finding replicated rooms by admin node."""
+        store = ReplicaStore()
+        store.update_from_join(_room_info("room-1", "node-a"), [], "bob")
+        store.update_from_join(_room_info("room-2", "node-x"), [], "bob")
+
+        assert store.rooms_administered_by("node-a") == ["room-1"]
+
+
+class TestMergeReplicas:
+    """Tests for merge_replicas."""
+
+    def test_merge_combines_members_and_messages(self):
+        """Test that replicas are merged into one room state."""
+        store_b = ReplicaStore()
+        store_b.update_from_join(_room_info(), [_message(1)], "bob")
+        store_c = ReplicaStore()
+        store_c.update_from_join(
+            _room_info(), [_message(1), _message(2, "node-c")], "carol"
+        )
+
+        state = merge_replicas(
+            [
+                dict(store_b.get("room-1").to_dict(), node_id="node-b"),
+                dict(store_c.get("room-1").to_dict(), node_id="node-c"),
+            ],
+            max_messages=100,
+        )
+
+        assert state["members"] == {"bob": "node-b", "carol": "node-c"}
+        assert [m["message_id"] for m in state["messages"]] == [
+            "msg-1",
+            "msg-2",
+        ]
+        assert state["message_counter"] == 2
+        assert state["vector_clock"] == {
+            "node-a": 1,
+            "node-b": 1,
+            "node-c": 2,
+        }
+
+
+class TestRestoreRoom:
+    """Tests for RoomStateManager.restore_room."""
+
+    def test_restore_room_keeps_id_and_history(self):
+        """Test that a restored room keeps its ID, members and messages."""
+        manager = RoomStateManager("node-c")
+
+        room = manager.restore_room(
+            room_id="room-1",
+            room_name="General",
+            creator_id="alice",
+            members={"bob": "node-b", "carol": "node-c"},
+            messages=[_message(1)],
+            message_counter=1,
+            vector_clock={"node-b": 1},
+        )
+
+        assert room.room_id == "room-1"
+        assert room.admin_node == "node-c"
+        assert room.members == {"bob", "carol"}
+        assert room.member_info["bob"].node_id == "node-b"
+
+        message = manager.add_message("room-1", "carol", "hi")
+        assert message["sequence_number"] == 2
+        assert message["vector_clock"] == {"node-b": 1, "node-c": 1}
+
+    def test_restore_room_rejects_existing_id(self):
+        """Test that an existing room is not overwritten."""
+        manager = RoomStateManager("node-c")
+        room = manager.create_room("General", "alice")
+
+        restored = manager.restore_room(
+            room_id=room.room_id,
+            room_name="General",
+            creator_id="alice",
+            members={},
+            messages=[],
+            message_counter=0,
+            vector_clock={},
+        )
+
+        assert restored is None
+
+
+class TestElection:
+    """Tests for the bully election."""
+
+    def test_highest_node_becomes_admin(self):
+        """Test that the highest-ID replica holder takes over the room."""
+        cluster = Cluster()
+        node_c = cluster.nodes["node-c"]
+
+        assert node_c["failover"].handle_node_dead("node-a") == ["room-1"]
+
+        room = node_c["manager"].get_room("room-1")
+        assert room is not None
+        assert room.admin_node == "node-c"
+        assert room.member_info["bob"].node_id == "node-b"
+        assert room.member_info["carol"].node_id == "node-c"
+        assert room.message_counter == 1
+        assert node_c["store"].get("room-1") is None
+
+    def test_other_nodes_are_repointed(self):
+        """Test that the announcement re-points the room on other nodes."""
+        cluster = Cluster()
+        cluster.nodes["node-c"]["failover"].handle_node_dead("node-a")
+
+        node_b = cluster.nodes["node-b"]
+        assert node_b["store"].get("room-1").admin_node == "node-c"
+        entry = node_b["directory"].get("room-1")
+        assert entry.admin_node == "node-c"
+        assert entry.node_address == "http://node-c"
+
+    def test_clients_notified_of_new_admin(self):
+        """Test that local clients receive room_admin_changed."""
+        cluster = Cluster()
+        cluster.nodes["node-c"]["failover"].handle_node_dead("node-a")
+
+        for node_id in ("node-b", "node-c"):
+            notified = cluster.nodes[node_id]["notified"]
+            assert len(notified) == 1
+            room_id, msg = notified[0]
+            assert room_id == "room-1"
+            assert msg["type"] == "room_admin_changed"
+            assert msg["data"]["admin_node"] == "node-c"
+            assert msg["data"]["previous_admin"] == "node-a"
+
+    def test_lower_node_defers_to_higher(self):
+        """Test that a lower-ID node defers to a higher replica holder."""
+        cluster = Cluster()
+        node_b = cluster.nodes["node-b"]
+
+        assert node_b["failover"].run_election("room-1") is False
+        assert node_b["manager"].get_room("room-1") is None
+
+        # node-c runs its own election after answering node-b
+        node_c = cluster.nodes["node-c"]
+        deadline = time.time() + 2
+        while time.time() < deadline:
+            if node_c["manager"].get_room("room-1"):
+                break
+            time.sleep(0.01)
+        assert node_c["manager"].get_room("room-1") is not None
+
+    def test_lower_node_wins_when_higher_unreachable(self):
+        """Test that an unreachable higher node does not block election."""
+        cluster = Cluster()
+        cluster.servers["node-c"] = None
+        node_b = cluster.nodes["node-b"]
+
+        assert node_b["failover"].run_election("room-1") is True
+        room = node_b["manager"].get_room("room-1")
+        assert room.members == {"bob"}
+
+    def test_no_election_while_admin_alive(self):
+        """Test that no election runs if the admin is still alive."""
+        cluster = Cluster()
+        node_c = cluster.nodes["node-c"]
+        node_c["registry"].servers = dict(cluster.servers)
+        node_c["failover"].failure_detector.dead.clear()
+
+        assert node_c["failover"].run_election("room-1") is False
+        assert node_c["manager"].get_room("room-1") is None
+
+    def test_election_message_without_replica(self):
+        """Test that a node without a replica does not take over."""
+        cluster = Cluster()
+        server = cluster.servers["node-c"]
+
+        result = server.failover_election("room-unknown", "node-b")
+
+        assert result["ok"] is False
+        assert result["node_id"] == "node-c"
+
+    def test_get_room_replica(self):
+        """Test fetching a replica over XML-RPC."""
+        cluster = Cluster()
+        server = cluster.servers["node-b"]
+
+        result = server.get_room_replica("room-1")
+        assert result["success"] is True
+        assert result["replica"]["local_members"] == ["bob"]
+
+        missing = server.get_room_replica("room-unknown")
+        assert missing["success"] is False
+        assert missing["error_code"] == "ROOM_NOT_FOUND"
+
+
+class TestMembershipSubscription:
+    """Tests for the failure detector subscription."""
+
+    @pytest.mark.asyncio
+    async def test_dead_event_triggers_election(self):
+        """Test that a DEAD membership event starts elections."""
+        cluster = Cluster()
+        node_c = cluster.nodes["node-c"]
+
+        await node_c["failover"].on_membership_change(
+            MembershipEvent(
+                "node-a", PeerState.SUSPECT, PeerState.DEAD, time.time()
+            )
+        )
+
+        assert node_c["manager"].get_room("room-1") is not None
+
+    @pytest.mark.asyncio
+    async def test_suspect_event_ignored(self):
+        """Test that a SUSPECT membership event does not start elections."""
+        cluster = Cluster()
+        node_c = cluster.nodes["node-c"]
+
+        await node_c["failover"].on_membership_change(
+            MembershipEvent(
+                "node-a", PeerState.ALIVE, PeerState.SUSPECT, time.time()
+            )
+        )
+
+        assert node_c["manager"].get_room("room-1") is None
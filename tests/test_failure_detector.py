@@ -0,0 +1,153 @@
+"""
+Tests for Peer Failure Detection
+
+Tests for alive/suspect/dead transitions, round-trip time tracking, and
+membership-change subscriptions.
+"""
+
+import pytest
+
+from src.node import (
+    RoomStateManager,
+    NodeStatus,
+    FailureDetector,
+    PeerState,
+)
+from src.node.main import _handle_membership_change
+
+
+class FakePeerRegistry:
+    """Peer registry whose peers answer heartbeats as configured."""
+
+    def __init__(self, peers):
+        self.peers = peers  # node_id -> True (up) / False (down)
+
+    def list_peers(self):
+        return {node_id: f"http://{node_id}" for node_id in self.peers}
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        assert method == "heartbeat"
+        if not self.peers[node_id]:
+            raise ConnectionError("down")
+        return {"status": "ok", "node_id": node_id}
+
+
+def test_thresholds_are_validated():
+    """Test that inconsistent thresholds are rejected."""
+    with pytest.raises(ValueError):
+        FailureDetector("node1", FakePeerRegistry({}), 3, 0, 2)
+    with pytest.raises(ValueError):
+        FailureDetector(
+            "node1", FakePeerRegistry({}), suspect_threshold=3, dead_threshold=2
+        )
+
+
+def test_unprobed_peer_is_alive():
+    """Test that peers are assumed alive before the first probe."""
+    detector = FailureDetector("node1", FakePeerRegistry({"node2": True}))
+    assert detector.get_state("node2") == PeerState.ALIVE
+    assert detector.alive_peers() == ["node2"]
+
+
+def test_missed_heartbeats_suspect_then_dead():
+    """Test the alive -> suspect -> dead progression."""
+    detector = FailureDetector(
+        "node1", FakePeerRegistry({}), suspect_threshold=1, dead_threshold=3
+    )
+
+    event = detector.record_failure("node2")
+    assert event.previous == PeerState.ALIVE
+    assert event.current == PeerState.SUSPECT
+
+    assert detector.record_failure("node2") is None
+    event = detector.record_failure("node2")
+    assert event.current == PeerState.DEAD
+    assert not detector.is_alive("node2")
+
+
+def test_heartbeat_revives_peer_and_tracks_rtt():
+    """Test that a response returns a peer to alive and records RTT."""
+    detector = FailureDetector("node1", FakePeerRegistry({}))
+    detector.record_failure("node2")
+
+    event = detector.record_success("node2", 0.1)
+    assert event.previous == PeerState.SUSPECT
+    assert event.current == PeerState.ALIVE
+
+    detector.record_success("node2", 0.2)
+    status = detector.get_status("node2")
+    assert status.missed_heartbeats == 0
+    assert status.last_rtt == 0.2
+    assert status.avg_rtt == pytest.approx(0.12)
+    assert status.to_dict()["state"] == "alive"
+
+
+@pytest.mark.asyncio
+async def test_probe_all_notifies_subscribers():
+    """Test that a probe round delivers events to sync and async listeners."""
+    registry = FakePeerRegistry({"node2": True, "node3": False})
+    detector = FailureDetector("node1", registry, dead_threshold=1)
+    sync_events = []
+    async_events = []
+
+    async def async_listener(event):
+        async_events.append(event)
+
+    detector.subscribe(sync_events.append)
+    detector.subscribe(async_listener)
+
+    events = await detector.probe_all()
+
+    assert [(e.node_id, e.current) for e in events] == [
+        ("node3", PeerState.DEAD)
+    ]
+    assert sync_events == events
+    assert async_events == events
+    assert detector.get_status("node2").last_rtt is not None
+
+
+@pytest.mark.asyncio
+async def test_unsubscribe_and_failing_listener():
+    """Test that listener errors are contained and unsubscribe works."""
+    registry = FakePeerRegistry({"node2": False})
+    detector = FailureDetector("node1", registry)
+    received = []
+
+    def broken(event):
+        raise RuntimeError("boom")
+
+    detector.subscribe(broken)
+    detector.subscribe(received.append)
+    detector.unsubscribe(received.append)
+
+    await detector.probe_all()
+    assert received == []
+
+
+@pytest.mark.asyncio
+async def test_membership_change_removes_members_of_dead_node():
+    """Test that a dead peer's members are removed from local rooms."""
+    manager = RoomStateManager(node_id="node1")
+    room = manager.create_room("General", "alice")
+    manager.add_member(room.room_id, "bob", "node2")
+
+    class WsServer:
+        def __init__(self):
+            self.broadcasts = []
+
+        def broadcast_to_room_sync(self, room_id, message):
+            self.broadcasts.append(message)
+
+    ws_server = WsServer()
+    detector = FailureDetector(
+        "node1", FakePeerRegistry({"node2": False}), dead_threshold=1
+    )
+    event = detector.record_failure("node2")
+
+    await _handle_membership_change(
+        manager, ws_server, FakePeerRegistry({}), event
+    )
+
+    assert "bob" not in manager.get_room(room.room_id).members
+    assert manager.get_node_health("node2").status == NodeStatus.FAILED
+    assert ws_server.broadcasts[0]["type"] == "member_left"
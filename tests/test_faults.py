@@ -0,0 +1,186 @@
+"""
+Tests for Fault Injection
+
+Tests for arming and triggering faults, crashes at 2PC phases and dropped
+heartbeats on simulated nodes, and the /admin/faults endpoints.
+"""
+
+import pytest
+
+from src.node import (
+    AdminAPI,
+    FaultInjector,
+    RoomStateManager,
+    Simulation,
+    WebSocketServer,
+)
+from src.node.faults import (
+    COORDINATOR_AFTER_DECISION,
+    PARTICIPANT_AFTER_VOTE,
+    FaultError,
+)
+from src.node.simulation import SimulatedCrash
+
+
+class TestFaultInjector:
+    """Tests for the armed faults and their hooks."""
+
+    def test_crash_fires_once_at_its_phase(self):
+        """Test that a crash only fires at the armed phase, once."""
+        crashes = []
+        faults = FaultInjector("node1", crash=lambda: crashes.append(1))
+        faults.arm_crash(PARTICIPANT_AFTER_VOTE)
+
+        faults.crash_point(COORDINATOR_AFTER_DECISION, "t1")
+        faults.crash_point(PARTICIPANT_AFTER_VOTE, "t1")
+        faults.crash_point(PARTICIPANT_AFTER_VOTE, "t2")
+
+        assert crashes == [1]
+        assert faults.status()["crash_phase"] is None
+
+    def test_delays_and_dropped_heartbeats(self):
+        """Test that counted faults run out and others last until cleared."""
+        faults = FaultInjector("node1")
+        faults.delay_rpc("tpc_commit", 0.5, count=2)
+        faults.delay_rpc("heartbeat", 1)
+        faults.drop_heartbeats(count=2)
+
+        assert [faults.rpc_delay("tpc_commit") for _ in range(3)] == [
+            0.5,
+            0.5,
+            0.0,
+        ]
+        assert faults.rpc_delay("heartbeat") == 1
+        assert [faults.drop_heartbeat() for _ in range(3)] == [
+            True,
+            True,
+            False,
+        ]
+        faults.drop_heartbeats(seconds=60)
+        assert faults.drop_heartbeat() is True
+        assert faults.clear()["delays"] == {}
+        assert faults.drop_heartbeat() is False
+        assert faults.rpc_delay("heartbeat") == 0.0
+
+    def test_invalid_faults(self):
+        """Test refusing unknown phases and methods and bad numbers."""
+        faults = FaultInjector("node1")
+
+        with pytest.raises(FaultError):
+            faults.arm_crash("after_lunch")
+        with pytest.raises(FaultError):
+            faults.delay_rpc("no_such_method", 1)
+        with pytest.raises(FaultError):
+            faults.delay_rpc("heartbeat", 3600)
+        with pytest.raises(FaultError) as error:
+            faults.drop_heartbeats()
+        assert error.value.error_code == "INVALID_FAULT"
+
+
+class TestInjectedFailures:
+    """Tests for failures injected into simulated nodes."""
+
+    @pytest.mark.asyncio
+    async def test_participant_crash_after_vote(self):
+        """Test that a vote lost to a crash aborts the transaction."""
+        with Simulation(seed=2) as sim:
+            node1, node2, node3 = (sim.add_node(f"node{i}") for i in (1, 2, 3))
+            room_id = node1.create_room("General", "alice")
+            node3.faults.arm_crash(PARTICIPANT_AFTER_VOTE)
+
+            committed = await node1.delete_room(room_id)
+
+            assert committed is False
+            assert sim.network.is_crashed("node3")
+            assert node1.room_manager.get_room(room_id) is not None
+            # node3 is left prepared, to expire or be recovered
+            assert len(node3.server.tpc_participant.prepared_transactions()) == 1
+            assert node2.server.tpc_participant.prepared_transactions() == []
+
+    @pytest.mark.asyncio
+    async def test_coordinator_crash_after_decision(self):
+        """Test a coordinator crashing before sending its decision."""
+        with Simulation(seed=2) as sim:
+            node1, node2 = (sim.add_node(f"node{i}") for i in (1, 2))
+            room_id = node1.create_room("General", "alice")
+            node1.faults.arm_crash(COORDINATOR_AFTER_DECISION)
+
+            with pytest.raises(SimulatedCrash):
+                await node1.delete_room(room_id)
+
+            assert sim.network.is_crashed("node1")
+            assert len(node2.server.tpc_participant.prepared_transactions()) == 1
+
+    def test_dropped_heartbeats_trigger_failover(self):
+        """Test that a live admin whose heartbeats drop loses its room."""
+        with Simulation(seed=4) as sim:
+            node1, node2 = (sim.add_node(f"node{i}") for i in (1, 2))
+            room_id = node1.create_room("General", "alice")
+            node2.join(room_id, "bob", "node1")
+            sim.run()
+            node1.faults.drop_heartbeats(count=node2.failure_detector.dead_threshold)
+
+            for _ in range(node2.failure_detector.dead_threshold):
+                node2.heartbeat()
+
+            assert not sim.network.is_crashed("node1")
+            assert node2.room_manager.get_room(room_id) is not None
+            assert node2.failure_detector.get_state("node1").value == "dead"
+            node2.heartbeat()
+            assert node2.failure_detector.is_alive("node1")
+
+
+class TestFaultEndpoints:
+    """Tests for the /admin/faults endpoints."""
+
+    @pytest.mark.asyncio
+    async def test_arm_list_and_clear(self):
+        """Test arming faults through the API and listing them."""
+        ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 0)
+        api = AdminAPI(ws_server, faults=FaultInjector("node1"))
+
+        crash = await api.handle(
+            "POST", "/admin/faults/crash", {"phase": PARTICIPANT_AFTER_VOTE}
+        )
+        delay = await api.handle(
+            "POST",
+            "/admin/faults/delay",
+            {"method": "tpc_prepare", "seconds": "2.5", "count": "1"},
+        )
+        dropped = await api.handle("POST", "/admin/faults/heartbeats", {"count": "3"})
+        listed = await api.handle("GET", "/admin/faults")
+        cleared = await api.handle("POST", "/admin/faults/clear")
+
+        assert crash["faults"]["crash_phase"] == PARTICIPANT_AFTER_VOTE
+        assert delay["faults"]["delays"] == {
+            "tpc_prepare": {"seconds": 2.5, "count": 1}
+        }
+        assert dropped["faults"]["dropped_heartbeats"] == 3
+        assert listed["faults"]["crash_phase"] == PARTICIPANT_AFTER_VOTE
+        assert cleared["faults"] == {
+            "crash_phase": None,
+            "delays": {},
+            "dropped_heartbeats": 0,
+            "drop_heartbeats_until": None,
+        }
+
+    @pytest.mark.asyncio
+    async def test_refused_requests(self):
+        """Test a node without fault injection and invalid settings."""
+        ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 0)
+        disabled = AdminAPI(ws_server)
+        api = AdminAPI(ws_server, faults=FaultInjector("node1"))
+
+        off = await disabled.handle("GET", "/admin/faults")
+        bad_phase = await api.handle("POST", "/admin/faults/crash", {})
+        bad_number = await api.handle(
+            "POST", "/admin/faults/delay", {"method": "heartbeat", "seconds": "x"}
+        )
+        unknown = await api.handle("POST", "/admin/faults/flood")
+        wrong_method = await api.handle("GET", "/admin/faults/clear")
+
+        assert off["error_code"] == "FAULTS_DISABLED"
+        assert bad_phase["error_code"] == "INVALID_FAULT"
+        assert bad_number["error_code"] == "INVALID_FAULT"
+        assert unknown["error_code"] == "NOT_FOUND"
+        assert wrong_method["error_code"] == "METHOD_NOT_ALLOWED"
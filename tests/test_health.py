@@ -0,0 +1,143 @@
+"""
+Tests for Health and Readiness Checks
+
+Tests for the readiness dependency checks and the /healthz and /readyz
+probes served next to /metrics.
+"""
+
+import asyncio
+import json
+import urllib.error
+import urllib.request
+from unittest.mock import MagicMock
+
+import pytest
+
+from src.node import (
+    HealthChecker,
+    MetricsServer,
+    NodeMetrics,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.config import NodeConfig
+
+
+def _failing(checks):
+    return sorted(name for name, check in checks.items() if not check["ok"])
+
+
+async def _start_servers():
+    """Start the XML-RPC and WebSocket server of one node."""
+    room_manager = RoomStateManager("node1")
+    xmlrpc_server = XMLRPCServer(room_manager, "127.0.0.1", 0, "http://node1")
+    ws_server = WebSocketServer(room_manager, "127.0.0.1", 0)
+    xmlrpc_server.start()
+    await ws_server.start()
+    return xmlrpc_server, ws_server
+
+
+class TestReadiness:
+    """Tests for the dependency checks."""
+
+    def test_not_ready_while_starting(self):
+        """Test that servers not yet started fail their checks."""
+        room_manager = RoomStateManager("node1")
+        health = HealthChecker(
+            "node1",
+            XMLRPCServer(room_manager, "127.0.0.1", 0, "http://node1"),
+            WebSocketServer(room_manager, "127.0.0.1", 0),
+        )
+
+        result = health.readiness()
+
+        assert result["ready"] is False
+        assert _failing(result["checks"]) == ["startup", "websocket", "xmlrpc"]
+        assert result["checks"]["storage"]["detail"] == "in memory"
+        assert health.liveness()["status"] == "ok"
+
+    @pytest.mark.asyncio
+    async def test_ready_then_draining(self):
+        """Test a started node, and draining taking it out of rotation."""
+        xmlrpc_server, ws_server = await _start_servers()
+        health = HealthChecker("node1", xmlrpc_server, ws_server)
+        health.mark_started()
+
+        ready = health.readiness()
+        ws_server.begin_drain()
+        draining = health.readiness()
+        xmlrpc_server.stop()
+        stopped = health.readiness()
+
+        assert ready["ready"] is True
+        assert draining["ready"] is False
+        assert draining["checks"]["websocket"] == {
+            "ok": False,
+            "detail": "draining",
+        }
+        assert stopped["checks"]["xmlrpc"]["detail"] == "stopped"
+
+    @pytest.mark.asyncio
+    async def test_peers_and_storage(self):
+        """Test the peer minimum and a storage backend failing reads."""
+        xmlrpc_server, ws_server = await _start_servers()
+        failure_detector = MagicMock()
+        failure_detector.alive_peers.return_value = ["node2"]
+        storage = MagicMock()
+        storage.room_ids.side_effect = OSError("disk gone")
+        health = HealthChecker(
+            "node1", xmlrpc_server, ws_server, storage, failure_detector, 2
+        )
+        health.mark_started()
+
+        result = health.readiness()
+        failure_detector.alive_peers.return_value = ["node2", "node3"]
+        storage.room_ids.side_effect = None
+        storage.room_ids.return_value = ["r1"]
+        recovered = health.readiness()
+        xmlrpc_server.stop()
+
+        assert _failing(result["checks"]) == ["peers", "storage"]
+        assert result["checks"]["peers"]["detail"] == "1 alive, 2 required"
+        assert result["checks"]["storage"]["detail"] == "check failed: disk gone"
+        assert recovered["ready"] is True
+
+    def test_min_ready_peers_validation(self):
+        """Test that the peer minimum can't be negative."""
+        assert NodeConfig(min_ready_peers=2).validate() == []
+        assert NodeConfig(min_ready_peers=-1).validate() == [
+            "min_ready_peers must not be negative"
+        ]
+
+
+class TestProbeEndpoints:
+    """Tests for /healthz and /readyz on the metrics server."""
+
+    @pytest.mark.asyncio
+    async def test_probes(self):
+        """Test the status codes and JSON bodies of the probes."""
+        health = HealthChecker("node1")
+        server = MetricsServer(NodeMetrics().registry, "127.0.0.1", 0, health)
+        server.start()
+
+        def fetch(path):
+            url = f"http://127.0.0.1:{server.port}{path}"
+            try:
+                with urllib.request.urlopen(url, timeout=5) as response:
+                    return response.status, json.loads(response.read())
+            except urllib.error.HTTPError as error:
+                return error.code, json.loads(error.read())
+
+        try:
+            loop = asyncio.get_running_loop()
+            live = await loop.run_in_executor(None, fetch, "/healthz")
+            not_ready = await loop.run_in_executor(None, fetch, "/readyz")
+        finally:
+            server.stop()
+
+        assert live[0] == 200
+        assert live[1]["node_id"] == "node1"
+        assert not_ready[0] == 503
+        assert not_ready[1]["ready"] is False
+        assert not_ready[1]["checks"]["startup"]["detail"] == "starting"
@@ -0,0 +1,243 @@
+"""
+Tests for Room Message History
+
+Tests for cursor-based pagination of a room's history, reading it from the
+write-ahead log, and get_history requests on the admin and other nodes.
+"""
+
+import json
+import pytest
+from unittest.mock import patch
+
+from src.client import ChatClient
+from src.node import RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.history import MAX_HISTORY_PAGE_SIZE, paginate_history
+from src.node.room_directory import RoomDirectory
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+def _messages(count):
+    return [
+        {"message_id": f"m{seq}", "sequence_number": seq}
+        for seq in range(1, count + 1)
+    ]
+
+
+def _ids(page):
+    return [message["message_id"] for message in page["messages"]]
+
+
+def _room(manager, count, private=False):
+    room = manager.create_room("general", "alice", private=private)
+    manager.add_member(room.room_id, "alice")
+    for seq in range(1, count + 1):
+        manager.add_message(
+            room.room_id, "alice", f"message {seq}", message_id=f"m{seq}"
+        )
+    return room.room_id
+
+
+async def _get_history(ws_server, websocket, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": "get_history", "data": data})
+    )
+    return websocket.last()
+
+
+class TestPagination:
+    """Tests for cutting a history into pages."""
+
+    def test_newest_page_by_default(self):
+        """Test that no cursor returns the most recent messages."""
+        page = paginate_history(_messages(5), limit=2)
+
+        assert _ids(page) == ["m4", "m5"]
+        assert page["has_more"] is True
+
+    def test_page_before_cursor(self):
+        """Test paging backwards from a message."""
+        page = paginate_history(_messages(5), before="m4", limit=2)
+
+        assert _ids(page) == ["m2", "m3"]
+        assert page["has_more"] is True
+
+        first = paginate_history(_messages(5), before="m2", limit=2)
+        assert _ids(first) == ["m1"]
+        assert first["has_more"] is False
+
+    def test_page_after_cursor(self):
+        """Test paging forwards from a message."""
+        page = paginate_history(_messages(5), after="m2", limit=2)
+
+        assert _ids(page) == ["m3", "m4"]
+        assert page["has_more"] is True
+
+        last = paginate_history(_messages(5), after="m4", limit=2)
+        assert _ids(last) == ["m5"]
+        assert last["has_more"] is False
+
+    def test_unknown_cursor(self):
+        """Test that a cursor not in the history is reported."""
+        page = paginate_history(_messages(3), before="gone")
+
+        assert page["error_code"] == "MESSAGE_NOT_FOUND"
+
+    def test_invalid_requests(self):
+        """Test that both cursors or a bad limit are rejected."""
+        both = paginate_history(_messages(3), before="m3", after="m1")
+        too_big = paginate_history(_messages(3), limit=MAX_HISTORY_PAGE_SIZE + 1)
+        not_int = paginate_history(_messages(3), limit="10")
+
+        assert both["error_code"] == "INVALID_REQUEST"
+        assert too_big["error_code"] == "INVALID_REQUEST"
+        assert not_int["error_code"] == "INVALID_REQUEST"
+
+
+class TestRoomHistory:
+    """Tests for the admin node's room history."""
+
+    def test_log_serves_messages_beyond_buffer(self, tmp_path):
+        """Test that the WAL keeps history the memory buffer dropped."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room = manager.create_room("general", "alice")
+        manager.add_member(room.room_id, "alice")
+        for seq in range(1, 6):
+            manager.add_message(
+                room.room_id, "alice", "hi", max_messages=2, message_id=f"m{seq}"
+            )
+
+        page = manager.get_history(room.room_id, "bob", before="m4", limit=10)
+
+        assert len(manager.get_messages(room.room_id)) == 2
+        assert _ids(page) == ["m1", "m2", "m3"]
+
+    def test_private_history_for_members_only(self):
+        """Test that non-members can't read a private room's history."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, 2, private=True)
+
+        denied = manager.get_history(room_id, "mallory")
+
+        assert denied["error_code"] == "NOT_A_MEMBER"
+        assert _ids(manager.get_history(room_id, "alice")) == ["m1", "m2"]
+
+    def test_unknown_room(self):
+        """Test that history of a room not hosted here is not found."""
+        result = RoomStateManager("node-a").get_history("nope", "alice")
+
+        assert result["error_code"] == "ROOM_NOT_FOUND"
+
+
+class TestGetHistoryCommand:
+    """Tests for get_history over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_local_room(self):
+        """Test that the admin node answers get_history itself."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, 4)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _get_history(
+            ws_server, MockWebSocket(), room_id=room_id, username="bob", limit=3
+        )
+
+        assert response["type"] == "history"
+        assert [m["content"] for m in response["data"]["messages"]] == [
+            "message 2",
+            "message 3",
+            "message 4",
+        ]
+        assert response["data"]["has_more"] is True
+
+    @pytest.mark.asyncio
+    async def test_forwarded_to_admin_node(self):
+        """Test that another node reads the history from the admin."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, 3)
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_server = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            response = await _get_history(
+                ws_server, MockWebSocket(), room_id=room_id, username="bob", after="m1"
+            )
+
+        assert response["type"] == "history"
+        ids = [m["message_id"] for m in response["data"]["messages"]]
+        assert ids == ["m2", "m3"]
+
+    @pytest.mark.asyncio
+    async def test_errors_reported(self):
+        """Test that failed requests get history_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, 1)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        missing = await _get_history(ws_server, MockWebSocket(), room_id=room_id)
+        bad_cursor = await _get_history(
+            ws_server, MockWebSocket(), room_id=room_id, username="bob", before="x"
+        )
+
+        assert missing["type"] == "history_error"
+        assert missing["data"]["error_code"] == "INVALID_REQUEST"
+        assert bad_cursor["data"]["error_code"] == "MESSAGE_NOT_FOUND"
+
+
+class TestClient:
+    """Tests for the client side of get_history."""
+
+    @pytest.mark.asyncio
+    async def test_get_history_request(self):
+        """Test that get_history sends the cursor and returns the page."""
+        client = ChatClient("ws://localhost:8000")
+        websocket = MockWebSocket()
+
+        async def recv():
+            return json.dumps(
+                {
+                    "type": "history",
+                    "data": {"messages": [{"message_id": "m1"}], "has_more": False},
+                }
+            )
+
+        websocket.recv = recv
+        client._set_test_mode(mock_websocket=websocket)
+
+        page = await client.get_history("room-1", "bob", before="m2", limit=10)
+
+        assert page["has_more"] is False
+        request = json.loads(websocket.sent_messages[0])
+        assert request["type"] == "get_history"
+        assert request["data"] == {
+            "room_id": "room-1",
+            "username": "bob",
+            "before": "m2",
+            "limit": 10,
+        }
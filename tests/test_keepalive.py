@@ -0,0 +1,161 @@
+"""
+Tests for Client Keepalive
+
+Tests for finding clients that stopped answering pings, marking them
+offline and stopping their typing indicators, disconnecting them after
+the grace period, and clients that answer again in time.
+"""
+
+import json
+from unittest.mock import MagicMock
+
+import pytest
+
+from src.node import KeepaliveMonitor, RoomStateManager, WebSocketServer
+from src.node.connection_registry import ClientConnection
+from src.node.keepalive import KEEPALIVE_CLOSE_CODE
+
+
+class FakeClock:
+    """Clock advanced by hand."""
+
+    def __init__(self):
+        self.now = 100.0
+
+    def __call__(self):
+        return self.now
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+        self.closed = None
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    async def close(self, code=1000, reason=""):
+        self.closed = (code, reason)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+async def _send(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+async def _setup():
+    """A room with alice and bob connected, both online."""
+    clock = FakeClock()
+    keepalive = KeepaliveMonitor(25, 60, 30, clock=clock)
+    ws_server = WebSocketServer(
+        RoomStateManager("node1"), "localhost", 0, keepalive=keepalive
+    )
+    ws_server.presence = MagicMock()
+    room_id = ws_server.room_manager.create_room("General", "alice").room_id
+    clients = {}
+    for username in ("alice", "bob"):
+        websocket = MockWebSocket()
+        keepalive.touch(ws_server.connections.register(websocket))
+        ws_server.register_client_room_membership(websocket, room_id, username)
+        await _send(ws_server, websocket, "pong", {})
+        clients[username] = websocket
+    return clock, ws_server, room_id, clients
+
+
+class TestKeepaliveMonitor:
+    """Tests for deciding which clients are stale."""
+
+    def test_stale_expired_and_revived(self):
+        """Test a client going silent, expiring, and one answering again."""
+        clock = FakeClock()
+        keepalive = KeepaliveMonitor(25, 60, 30, clock=clock)
+        quiet = ClientConnection("c1", object())
+        revived = ClientConnection("c2", object())
+        keepalive.touch(quiet)
+        keepalive.touch(revived)
+
+        clock.now += 59
+        assert keepalive.check([quiet, revived]) == ([], [])
+        clock.now += 1
+        assert keepalive.check([quiet, revived]) == ([quiet, revived], [])
+        assert keepalive.check([quiet, revived]) == ([], [])
+        assert keepalive.touch(revived) is True
+        clock.now += 30
+
+        assert keepalive.check([quiet, revived]) == ([], [quiet])
+        assert revived.stale_since is None
+        assert keepalive.touch(revived) is False
+
+
+class TestKeepaliveRound:
+    """Tests for pinging and reaping clients on the WebSocket server."""
+
+    @pytest.mark.asyncio
+    async def test_stale_client_marked_offline_then_disconnected(self):
+        """Test the presence, typing and disconnect of a silent client."""
+        clock, ws_server, room_id, clients = await _setup()
+        alice, bob = clients["alice"], clients["bob"]
+        await _send(
+            ws_server, alice, "typing", {"room_id": room_id, "username": "alice"}
+        )
+
+        assert await ws_server.keepalive_round() == (0, 0)
+        clock.now += 50
+        await _send(ws_server, bob, "pong", {})
+        clock.now += 10
+        stale = await ws_server.keepalive_round()
+        clock.now += 30
+        await _send(ws_server, bob, "pong", {})
+        closed = await ws_server.keepalive_round()
+
+        assert stale == (1, 0)
+        assert closed == (0, 1)
+        ws_server.presence.set_offline.assert_called_once_with("alice")
+        assert [event["typing"] for event in bob.received("typing")] == [
+            True,
+            False,
+        ]
+        assert len(bob.received("ping")) == 3
+        assert bob.received("ping")[0]["timeout"] == 60
+        assert len(alice.received("ping")) == 2
+        assert alice.closed == (KEEPALIVE_CLOSE_CODE, "Keepalive timeout")
+        assert bob.closed is None
+
+    @pytest.mark.asyncio
+    async def test_client_answering_within_grace(self):
+        """Test that a stale client that answers is online again."""
+        clock, ws_server, room_id, clients = await _setup()
+        alice = clients["alice"]
+
+        clock.now += 60
+        await _send(ws_server, clients["bob"], "pong", {})
+        await ws_server.keepalive_round()
+        await _send(ws_server, alice, "pong", {})
+        clock.now += 30
+        result = await ws_server.keepalive_round()
+
+        assert result == (0, 0)
+        assert ws_server.presence.set_online.call_count == 3
+        assert alice.closed is None
+        assert "alice" in ws_server._online_users.values()
+
+    @pytest.mark.asyncio
+    async def test_disabled(self):
+        """Test that a server without keepalive sends no pings."""
+        ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 0)
+        websocket = MockWebSocket()
+        ws_server.connections.register(websocket)
+
+        assert await ws_server.keepalive_round() == (0, 0)
+        await _send(ws_server, websocket, "pong", {})
+        assert websocket.sent_messages == []
@@ -0,0 +1,187 @@
+"""
+Tests for Client Load Balancing
+
+Tests for merging gossiped node loads, picking the peer to redirect new
+clients to, redirecting connections to an overloaded node, and clients
+following the redirect.
+"""
+
+import json
+import time
+from unittest.mock import patch
+
+import pytest
+
+from src.client.service import ClientService
+from src.node import (
+    LoadBalancer,
+    NodeMetrics,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.config import NodeConfig
+from src.node.load_balancing import LOAD_TTL, load_gossip_round
+from tests.fakes import LocalPeerRegistry
+
+
+def _load(node_id, connections, capacity=10, updated_at=None):
+    return {
+        "node_id": node_id,
+        "ws_url": f"ws://{node_id}:8080",
+        "connections": connections,
+        "capacity": capacity,
+        "updated_at": time.time() if updated_at is None else updated_at,
+    }
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self, replies=()):
+        self.sent_messages = []
+        self.replies = list(replies)
+        self.closed = None
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    async def recv(self):
+        return json.dumps(self.replies.pop(0))
+
+    async def close(self, code=1000, reason=""):
+        self.closed = (code, reason)
+
+
+class TestLoadBalancer:
+    """Tests for the load table and picking a redirect target."""
+
+    def test_redirect_to_least_loaded_peer(self):
+        """Test that only fresh peers with fewer clients and room qualify."""
+        balancer = LoadBalancer("node-a", "ws://node-a:8080", threshold=5)
+        balancer.merge(
+            [
+                _load("node-b", 3),
+                _load("node-c", 1),
+                _load("node-d", 0, capacity=0),
+                _load("node-a", 0),
+            ]
+        )
+
+        assert balancer.redirect_target(4) is None
+        assert balancer.redirect_target(5).node_id == "node-d"
+        balancer.merge([_load("node-d", 9, capacity=9)])
+        target = balancer.redirect_target(5)
+        assert target.node_id == "node-c"
+        assert target.ws_url == "ws://node-c:8080"
+        balancer.merge([_load("node-c", 6), _load("node-b", 5)])
+        assert balancer.redirect_target(5) is None
+        assert balancer.get("node-a").connections == 0
+
+    def test_newest_load_wins_and_stale_loads_expire(self):
+        """Test that older loads are ignored and unrefreshed peers dropped."""
+        balancer = LoadBalancer("node-a", "ws://node-a:8080", threshold=2)
+        balancer.merge([_load("node-b", 1, updated_at=100)])
+
+        assert balancer.merge([_load("node-b", 0, updated_at=50)]) == 0
+        assert balancer.get("node-b").connections == 1
+        assert balancer.merge([{"node_id": "node-c"}]) == 0
+        assert balancer.redirect_target(2).node_id == "node-b"
+        later = time.monotonic() + LOAD_TTL + 1
+        with patch("src.node.load_balancing.time.monotonic", return_value=later):
+            assert balancer.redirect_target(2) is None
+        assert LoadBalancer("node-a", "ws://a", 0).redirect_target(100) is None
+
+    def test_load_gossip_round(self):
+        """Test that a gossip round exchanges loads with a peer."""
+        servers = {}
+        balancers = {}
+        for node_id in ("node-a", "node-b"):
+            balancers[node_id] = LoadBalancer(
+                node_id, f"ws://{node_id}:8080", threshold=2
+            )
+            servers[node_id] = XMLRPCServer(
+                RoomStateManager(node_id),
+                "localhost",
+                0,
+                f"http://{node_id}",
+                load_balancer=balancers[node_id],
+            )
+        balancers["node-a"].update_local(2)
+        balancers["node-b"].update_local(1)
+
+        reached = load_gossip_round(
+            balancers["node-a"], LocalPeerRegistry("node-a", servers)
+        )
+
+        assert reached == ["node-b"]
+        assert balancers["node-b"].get("node-a").connections == 2
+        assert balancers["node-a"].redirect_target(2).node_id == "node-b"
+
+
+class TestRedirects:
+    """Tests for redirecting new clients and following redirects."""
+
+    @pytest.mark.asyncio
+    async def test_overloaded_node_redirects_new_client(self):
+        """Test the redirect frame, close code and redirect metric."""
+        balancer = LoadBalancer("node-a", "ws://node-a:8080", threshold=1)
+        balancer.merge([_load("node-b", 0)])
+        metrics = NodeMetrics()
+        ws_server = WebSocketServer(
+            RoomStateManager("node-a"),
+            "localhost",
+            0,
+            metrics=metrics,
+            load_balancer=balancer,
+        )
+        ws_server.clients.add(MockWebSocket())
+        websocket = MockWebSocket()
+
+        await ws_server.handle_client(websocket)
+
+        assert json.loads(websocket.sent_messages[0]) == {
+            "type": "redirect",
+            "data": {
+                "node_id": "node-a",
+                "target_node": "node-b",
+                "url": "ws://node-b:8080",
+                "reason": "overloaded",
+            },
+        }
+        assert websocket.closed[0] == 1013
+        assert websocket not in ws_server.clients
+        assert metrics.redirects.value(target="node-b") == 1
+
+    @pytest.mark.asyncio
+    async def test_client_follows_redirect(self):
+        """Test that the client reconnects and resends its request."""
+        redirect = {
+            "type": "redirect",
+            "data": {"node_id": "node-a", "url": "ws://node-b:8080"},
+        }
+        sockets = {
+            "ws://node-a:8080": MockWebSocket([redirect]),
+            "ws://node-b:8080": MockWebSocket(
+                [{"type": "bots", "data": {"bots": []}}]
+            ),
+        }
+
+        async def factory(url):
+            return sockets[url]
+
+        client = ClientService("ws://node-a:8080", websocket_factory=factory)
+        await client.connect()
+
+        assert await client.list_bots("alice") == []
+        assert client.node_url == "ws://node-b:8080"
+        resent = json.loads(sockets["ws://node-b:8080"].sent_messages[0])
+        assert resent["type"] == "list_bots"
+
+    def test_config(self):
+        """Test the derived WebSocket URL and threshold validation."""
+        assert NodeConfig(node_id="node1").ws_url == "ws://node1:8080"
+        errors = NodeConfig(ws_url="http://x", redirect_threshold=-1).validate()
+
+        assert any("ws_url" in error for error in errors)
+        assert any("redirect_threshold" in error for error in errors)
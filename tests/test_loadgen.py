@@ -0,0 +1,191 @@
+"""
+Tests for the Load Generator
+
+Tests for latency percentiles and the report, and for load test runs
+against in-process nodes: rooms created and joined, messages confirmed
+and delivered, and refused messages and failed connections counted.
+"""
+
+import asyncio
+import contextlib
+import io
+import json
+
+import pytest
+
+from src.client.loadgen import (
+    LatencyStats,
+    LoadConfig,
+    LoadGenerator,
+    LoadReport,
+    main,
+)
+from src.node import AuthManager, RoomStateManager, WebSocketServer
+from src.node.rate_limit import RateLimit, RateLimiter
+
+
+class ServerEnd:
+    """The node's end of an in-process connection."""
+
+    def __init__(self):
+        self.incoming = asyncio.Queue()
+
+    async def send(self, message):
+        self.incoming.put_nowait(message)
+
+
+class ClientEnd:
+    """A client's end of an in-process connection to a WebSocketServer."""
+
+    def __init__(self, ws_server):
+        self.ws_server = ws_server
+        self.peer = ServerEnd()
+        ws_server.connections.register(self.peer)
+
+    async def send(self, message):
+        await self.ws_server.process_message(self.peer, message)
+
+    def __aiter__(self):
+        return self
+
+    async def __anext__(self):
+        message = await self.peer.incoming.get()
+        if message is None:
+            raise StopAsyncIteration
+        return message
+
+    async def close(self):
+        self.peer.incoming.put_nowait(None)
+
+
+def _connector(servers):
+    async def connect(url):
+        if url not in servers:
+            raise OSError(f"Connection refused: {url}")
+        return ClientEnd(servers[url])
+
+    return connect
+
+
+class TestReport:
+    """Tests for latency percentiles and the report."""
+
+    def test_percentiles_and_report(self):
+        """Test nearest-rank percentiles, the error rate and both formats."""
+        stats = LatencyStats()
+        for ms in range(1, 101):
+            stats.add(ms / 1000)
+        report = LoadReport(
+            clients=2, sent=200, acknowledged=190, failed=10, elapsed=2.0
+        )
+        report.errors["RATE_LIMITED"] = 10
+        report.ack_latency = stats
+
+        summary = report.to_dict()
+
+        assert stats.percentile(50) == 0.05
+        assert stats.percentile(99) == 0.099
+        assert LatencyStats().percentile(50) is None
+        assert summary["ack_latency"] == {
+            "count": 100,
+            "p50_ms": 50.0,
+            "p90_ms": 90.0,
+            "p99_ms": 99.0,
+            "max_ms": 100.0,
+        }
+        assert summary["delivery_latency"]["p99_ms"] is None
+        assert (summary["error_rate"], summary["messages_per_second"]) == (
+            0.05,
+            100.0,
+        )
+        text = report.format()
+        assert "p99 99.0 ms" in text and "RATE_LIMITED 10" in text
+        assert "Delivery latency: no samples" in text
+
+
+class TestLoadRun:
+    """Tests for load test runs against in-process nodes."""
+
+    @pytest.mark.asyncio
+    async def test_messages_confirmed_and_delivered(self):
+        """Test rooms, joins, confirmations and deliveries to members."""
+        manager = RoomStateManager("node-a")
+        servers = {"ws://a": WebSocketServer(manager, "localhost", 0)}
+        config = LoadConfig(
+            urls=["ws://a"], clients=6, rooms=2, rate=20, duration=0.3
+        )
+
+        report = await LoadGenerator(config, _connector(servers)).run()
+
+        assert (report.connected, report.joined, report.rooms) == (6, 6, 2)
+        assert [r["member_count"] for r in manager.list_rooms()] == [3, 3]
+        assert report.sent > 6
+        assert (report.acknowledged, report.failed) == (report.sent, 0)
+        assert report.deliveries == 2 * report.sent
+        assert report.ack_latency.summary()["count"] == report.sent
+        assert len(report.delivery_latency.samples) == report.deliveries
+        assert not report.errors
+
+    @pytest.mark.asyncio
+    async def test_refusals_and_failed_connections(self):
+        """Test logging in, rate-limited messages and an unreachable node."""
+        auth = AuthManager("node-a", b"secret", True, password_iterations=1)
+        limiter = RateLimiter({"send_message": RateLimit(0.001, 2)})
+        servers = {
+            "ws://a": WebSocketServer(
+                RoomStateManager("node-a"),
+                "localhost",
+                0,
+                auth=auth,
+                rate_limiter=limiter,
+            )
+        }
+        config = LoadConfig(
+            urls=["ws://a", "ws://down"],
+            clients=4,
+            rooms=1,
+            rate=20,
+            duration=0.3,
+            password="password123",
+        )
+
+        report = await LoadGenerator(config, _connector(servers)).run()
+
+        assert (report.connected, report.joined) == (2, 2)
+        assert report.errors["CONNECT_FAILED"] == 2
+        assert report.acknowledged == 4
+        assert report.failed == report.sent - 4 > 0
+        assert report.errors["RATE_LIMITED"] == report.failed
+        assert report.error_rate > 0.5
+
+
+class TestCommand:
+    """Tests for the command's arguments and exit status."""
+
+    def test_arguments_and_exit_status(self):
+        """Test refused arguments and a run with no reachable node."""
+        with pytest.raises(SystemExit) as invalid:
+            with contextlib.redirect_stderr(io.StringIO()):
+                main(["--clients", "2", "--rooms", "5"])
+        output = io.StringIO()
+        with pytest.raises(SystemExit) as unreachable:
+            with contextlib.redirect_stdout(output):
+                main(
+                    [
+                        "--url",
+                        "ws://127.0.0.1:9",
+                        "--clients",
+                        "2",
+                        "--rooms",
+                        "1",
+                        "--duration",
+                        "0.1",
+                        "--json",
+                    ]
+                )
+
+        assert invalid.value.code == 2
+        assert unreachable.value.code == 1
+        report = json.loads(output.getvalue())
+        assert report["connected"] == 0
+        assert report["errors"] == {"CONNECT_FAILED": 2}
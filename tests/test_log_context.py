@@ -0,0 +1,217 @@
+"""
+Tests for Structured Logging
+
+Tests for the log context of requests, the key=value and JSON log
+formats, and correlation IDs travelling from a WebSocket request to the
+admin node through XML-RPC forwarding.
+"""
+
+import json
+import logging
+import pytest
+
+from src.node import RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.config import NodeConfig
+from src.node.log_context import (
+    ContextFilter,
+    CorrelationTransport,
+    JsonFormatter,
+    TextFormatter,
+    context_from_headers,
+    current_context,
+    log_context,
+)
+from src.node.room_directory import RoomDirectory
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+class RecordingHandler(logging.Handler):
+    """Log handler that keeps the records of the node's loggers."""
+
+    def __init__(self, node_id="node-a"):
+        super().__init__()
+        self.addFilter(ContextFilter(node_id))
+        self.records = []
+
+    def emit(self, record):
+        self.records.append(record)
+
+
+class MockConnection:
+    """HTTP connection that records the headers it is sent."""
+
+    def __init__(self):
+        self.headers = {}
+
+    def putheader(self, key, value):
+        self.headers[key] = value
+
+
+class capture_logs:
+    """Context manager collecting the records of src.node loggers."""
+
+    def __enter__(self):
+        self.handler = RecordingHandler()
+        self.logger = logging.getLogger("src.node")
+        self.level = self.logger.level
+        self.logger.addHandler(self.handler)
+        self.logger.setLevel(logging.INFO)
+        return self.handler.records
+
+    def __exit__(self, *exc):
+        self.logger.removeHandler(self.handler)
+        self.logger.setLevel(self.level)
+
+
+def _record(message="Room created", **context):
+    record = logging.LogRecord(
+        "src.node.test", logging.INFO, __file__, 1, message, None, None
+    )
+    with log_context(**context):
+        ContextFilter("node-a").filter(record)
+    return record
+
+
+class TestLogContext:
+    """Tests for tagging log lines with the request's context."""
+
+    def test_nested_context(self):
+        """Test that inner contexts add to and then restore the outer one."""
+        with log_context(correlation_id="c1", user_id="alice"):
+            with log_context(room_id="r1"):
+                assert current_context() == {
+                    "correlation_id": "c1",
+                    "room_id": "r1",
+                    "user_id": "alice",
+                }
+            assert current_context() == {"correlation_id": "c1", "user_id": "alice"}
+
+        assert current_context() == {}
+
+    def test_headers_carry_context(self):
+        """Test that XML-RPC calls send the context as HTTP headers."""
+        connection = MockConnection()
+
+        with log_context(correlation_id="c1", room_id="r1"):
+            CorrelationTransport().send_headers(connection, [("X-Other", "1")])
+
+        assert connection.headers == {
+            "X-Other": "1",
+            "X-Correlation-ID": "c1",
+            "X-Room-ID": "r1",
+        }
+
+    def test_missing_correlation_id_generated(self):
+        """Test that calls without a correlation ID get a new one."""
+        context = context_from_headers({"X-User-ID": "alice"})
+
+        assert context["correlation_id"]
+        assert context["user_id"] == "alice"
+        assert context["room_id"] is None
+
+
+class TestFormatters:
+    """Tests for the text and JSON log formats."""
+
+    def test_text_format(self):
+        """Test key=value output, quoting values with spaces."""
+        record = _record(correlation_id="c1", room_id="r1")
+
+        line = TextFormatter().format(record)
+
+        assert "level=INFO logger=src.node.test node=node-a" in line
+        assert 'correlation_id=c1 room_id=r1 msg="Room created"' in line
+        assert "user_id" not in line
+
+    def test_json_format(self):
+        """Test one JSON object per line, with extra fields kept."""
+        record = _record(correlation_id="c1", user_id="alice")
+        record.peer = "node-b"
+
+        fields = json.loads(JsonFormatter().format(record))
+
+        assert fields["node"] == "node-a"
+        assert fields["correlation_id"] == "c1"
+        assert fields["user_id"] == "alice"
+        assert fields["msg"] == "Room created"
+        assert fields["peer"] == "node-b"
+
+    def test_log_format_validated(self):
+        """Test that unknown log formats are rejected."""
+        assert NodeConfig(log_format="json").validate() == []
+        assert NodeConfig(log_format="xml").validate() == [
+            "log_format 'xml' must be one of text, json"
+        ]
+
+
+class TestRequestTracing:
+    """Tests for following a request across nodes by correlation ID."""
+
+    @pytest.mark.asyncio
+    async def test_websocket_request_tagged(self):
+        """Test that a client request's log lines carry its context."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        message = {
+            "type": "create_room",
+            "correlation_id": "c1",
+            "data": {"room_name": "general", "creator_id": "alice"},
+        }
+
+        with capture_logs() as records:
+            await ws_server.process_message(MockWebSocket(), json.dumps(message))
+
+        tagged = [r for r in records if r.correlation_id == "c1"]
+        assert tagged
+        assert all(r.user_id == "alice" for r in tagged)
+
+    @pytest.mark.asyncio
+    async def test_forwarded_call_keeps_correlation_id(self):
+        """Test that the admin node logs a forwarded call under the same ID."""
+        admin = RoomStateManager("node-a")
+        room = admin.create_room("general", "alice")
+        for username in ("alice", "bob"):
+            admin.add_member(room.room_id, username)
+        admin_rpc = XMLRPCServer(admin, "127.0.0.1", 0, "")
+        admin_rpc.start()
+        address = f"http://127.0.0.1:{admin_rpc.server.server_address[1]}"
+        directory_a = RoomDirectory("node-a", address)
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_server = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+        websocket = MockWebSocket()
+        message = {
+            "type": "promote_member",
+            "correlation_id": "c1",
+            "data": {"room_id": room.room_id, "username": "alice", "target": "bob"},
+        }
+
+        try:
+            with capture_logs() as records:
+                await ws_server.process_message(websocket, json.dumps(message))
+        finally:
+            admin_rpc.stop()
+
+        assert websocket.last()["type"] == "role_changed"
+        admin_lines = [r for r in records if r.name == "src.node.xmlrpc_server"]
+        assert admin_lines
+        assert all(r.correlation_id == "c1" for r in admin_lines)
+        assert all(r.room_id == room.room_id for r in admin_lines)
@@ -0,0 +1,237 @@
+"""
+Tests for Room Membership Sets
+
+Tests for the OR-Set of room members, merging other nodes' sets into
+hosted rooms and failover state, and joins and leaves made on both sides
+of a partition converging once it heals.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    MemberSet,
+    PartitionManager,
+    ReplicaStore,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.failover import merge_replicas
+from src.node.member_set import merge_member_sets
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+    def of_type(self, message_type):
+        return [
+            m["data"] for m in self.sent_messages if m["type"] == message_type
+        ]
+
+
+class StubFailureDetector:
+    """Failure detector reporting the nodes in down as dead."""
+
+    def __init__(self, down):
+        self.down = down
+
+    def is_alive(self, node_id):
+        return node_id not in self.down
+
+
+class PartitionedProxy:
+    """ServerProxy reaching an XML-RPC server unless its node is down."""
+
+    def __init__(self, server, down):
+        self.server = server
+        self.down = down
+
+    def __call__(self, address, allow_none=False):
+        return self
+
+    def __getattr__(self, method):
+        def call(*args):
+            if "node-a" in self.down:
+                raise ConnectionRefusedError("unreachable")
+            return getattr(self.server, method)(*args)
+
+        return call
+
+
+class Partition:
+    """Admin node-a, and node-b whose client bob is in node-a's room."""
+
+    def __init__(self):
+        self.down = set()
+        self.admin = RoomStateManager("node-a")
+        self.server = XMLRPCServer(self.admin, "localhost", 0, "http://node-a")
+        self.room_id = self.admin.create_room("General", "alice").room_id
+        self.admin.add_member(self.room_id, "alice")
+        self.store = ReplicaStore()
+        self.ws_server = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            object(),
+            replica_store=self.store,
+            partition=PartitionManager(
+                "node-b", failure_detector=StubFailureDetector(self.down)
+            ),
+        )
+        self.ws_server._locate_room_admin = lambda room_id: (
+            {"room_id": room_id},
+            "http://node-a",
+        )
+        self.ws_server._room_admin_node = lambda room_id: "node-a"
+        self.proxy = patch(
+            "src.node.websocket_server.ServerProxy",
+            PartitionedProxy(self.server, self.down),
+        )
+        self.bob = MockWebSocket()
+
+    async def request(self, websocket, message_type, username):
+        data = {"room_id": self.room_id, "username": username}
+        with self.proxy:
+            await self.ws_server.process_message(
+                websocket, json.dumps({"type": message_type, "data": data})
+            )
+
+    async def reconcile(self):
+        with self.proxy:
+            return await self.ws_server.reconcile_partitions()
+
+
+class TestMemberSet:
+    """Tests for the OR-Set of members."""
+
+    def test_concurrent_join_survives_leave(self):
+        """Test add-wins merges, in either order, and re-joins."""
+        side_a = MemberSet()
+        side_a.add("alice")
+        side_b = MemberSet.from_dict(side_a.to_dict())
+        side_a.remove("alice")
+        side_b.add("alice")
+        side_b.add("bob")
+
+        merged = [
+            merge_member_sets(side_a.to_dict(), side_b.to_dict()),
+            merge_member_sets(side_b.to_dict(), side_a.to_dict()),
+        ]
+
+        assert merged[0] == merged[1]
+        assert MemberSet.from_dict(merged[0]).members() == ["alice", "bob"]
+        side_b.remove("bob")
+        side_a.merge(side_b)
+        assert side_a.members() == ["alice"]
+        assert side_a.remove("alice") is True
+        assert side_a.remove("alice") is False
+
+    def test_tombstones_purged(self):
+        """Test that only leaves older than the TTL are forgotten."""
+        members = MemberSet()
+        for username in ("alice", "bob"):
+            members.add(username)
+        members.remove("alice", now=100)
+        members.remove("bob", now=500)
+
+        assert members.purge_tombstones(ttl=300, now=600) == 1
+        assert len(members.to_dict()["tombstones"]) == 1
+        assert members.purge_tombstones(ttl=300, now=600) == 0
+
+
+class TestMergeMembers:
+    """Tests for merging sets into hosted rooms and failover state."""
+
+    def test_merge_into_room(self):
+        """Test added and removed members, and banned users kept out."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        for username in ("alice", "bob"):
+            manager.add_member(room_id, username)
+        remote = MemberSet.from_dict(manager.get_member_set(room_id))
+        remote.remove("bob")
+        for username in ("carol", "mallory"):
+            remote.add(username)
+        manager.get_room(room_id).banned.add("mallory")
+
+        changes = manager.merge_members(room_id, remote.to_dict(), "node-b")
+
+        assert changes == {"joined": ["carol"], "left": ["bob"]}
+        assert sorted(manager.get_members(room_id)) == ["alice", "carol"]
+        assert manager.get_room(room_id).member_info["carol"].node_id == (
+            "node-b"
+        )
+        assert "mallory" not in MemberSet.from_dict(
+            manager.get_member_set(room_id)
+        )
+        assert manager.merge_members("missing", {}, "node-b") is None
+
+    def test_failover_merges_sets(self):
+        """Test the rebuilt room keeping joins made on either replica."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        manager.add_member(room_id, "alice")
+        replicas = []
+        for node_id, username in (("node-b", "bob"), ("node-c", "carol")):
+            member_set = MemberSet.from_dict(manager.get_member_set(room_id))
+            member_set.add(username)
+            replicas.append(
+                {
+                    "node_id": node_id,
+                    **manager.get_room(room_id).to_dict(),
+                    "local_members": [username],
+                    "member_set": member_set.to_dict(),
+                }
+            )
+
+        state = merge_replicas(replicas, 100)
+        restored = RoomStateManager("node-b").restore_room(**state)
+
+        assert MemberSet.from_dict(state["member_set"]).members() == [
+            "alice",
+            "bob",
+            "carol",
+        ]
+        assert restored.member_set.members() == ["alice", "bob", "carol"]
+
+
+class TestPartitionedMembership:
+    """Tests for joins and leaves on both sides of a partition."""
+
+    @pytest.mark.asyncio
+    async def test_joins_and_leaves_converge(self):
+        """Test degraded joins and leaves merged with the admin's."""
+        cluster = Partition()
+        await cluster.request(cluster.bob, "join_room", "bob")
+        cluster.down.add("node-a")
+        carol = MockWebSocket()
+
+        await cluster.request(carol, "join_room", "carol")
+        await cluster.request(cluster.bob, "leave_room", "bob")
+        cluster.admin.add_member(cluster.room_id, "dave")
+        cluster.admin.remove_member(cluster.room_id, "alice")
+        joined = carol.of_type("join_room_success")
+
+        assert joined[0]["degraded"] is True
+        assert "member_set" not in joined[0]
+        assert await cluster.reconcile() == 0
+        assert "carol" not in cluster.admin.get_members(cluster.room_id)
+        cluster.down.clear()
+        assert await cluster.reconcile() == 1
+
+        assert sorted(cluster.admin.get_members(cluster.room_id)) == [
+            "carol",
+            "dave",
+        ]
+        replica = cluster.store.get(cluster.room_id)
+        assert sorted(replica.members) == ["carol", "dave"]
+        assert replica.local_members == ["carol"]
@@ -0,0 +1,269 @@
+"""
+Tests for the Cluster Membership View
+
+Tests for view quorums, agreeing on view changes through 2PC, rejecting
+stale and concurrent changes, refusing changes and elections without a
+quorum, syncing missed views, and deriving 2PC participants, replication
+followers and election candidates from the view.
+"""
+
+import pytest
+
+from src.node import (
+    ClusterMembership,
+    MembershipView,
+    ReplicaStore,
+    ReplicationManager,
+    RoomFailover,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.admin_api import AdminAPI
+from tests.fakes import LocalPeerRegistry
+
+
+class StubFailureDetector:
+    """Failure detector reporting the cluster's down nodes as dead."""
+
+    def __init__(self, peer_registry):
+        self.peer_registry = peer_registry
+
+    def is_alive(self, node_id):
+        return node_id not in self.peer_registry.down
+
+    def alive_peers(self):
+        return [p for p in self.peer_registry.list_peers() if self.is_alive(p)]
+
+
+class Cluster:
+    """Nodes whose epoch 0 view holds all of them."""
+
+    def __init__(self, node_ids=("node-a", "node-b", "node-c")):
+        self.servers = {}
+        self.down = set()
+        self.nodes = {}
+        for node_id in node_ids:
+            registry = LocalPeerRegistry(node_id, self.servers, self.down)
+            detector = StubFailureDetector(registry)
+            membership = ClusterMembership(
+                node_id,
+                f"http://{node_id}",
+                registry,
+                detector,
+                {n: f"http://{n}" for n in node_ids if n != node_id},
+            )
+            manager = RoomStateManager(node_id)
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                membership=membership,
+            )
+            self.nodes[node_id] = {
+                "membership": membership,
+                "registry": registry,
+                "detector": detector,
+                "manager": manager,
+            }
+
+    def membership(self, node_id):
+        return self.nodes[node_id]["membership"]
+
+
+class TestMembershipView:
+    """Tests for views and their quorum."""
+
+    def test_quorum_is_majority(self):
+        """Test that a quorum is a majority of the view's members."""
+        view = MembershipView(3, {"a": "http://a", "b": "http://b"})
+        five = MembershipView(1, {n: n for n in "abcde"})
+
+        assert view.quorum == 2
+        assert not view.has_quorum(["a", "x"])
+        assert five.quorum == 3
+        assert five.has_quorum(["a", "c", "e"])
+        assert MembershipView.from_dict(view.to_dict()) == view
+
+
+class TestViewChanges:
+    """Tests for agreeing on new views through 2PC."""
+
+    @pytest.mark.asyncio
+    async def test_dead_node_removed_everywhere(self):
+        """Test that the proposer installs a view without the dead node."""
+        cluster = Cluster()
+        cluster.down.add("node-c")
+        node_a = cluster.membership("node-a")
+
+        assert cluster.membership("node-b").is_proposer() is False
+        txn = await node_a.reconcile()
+
+        assert txn.committed
+        for node_id in ("node-a", "node-b"):
+            view = cluster.membership(node_id).view
+            assert view.epoch == 1
+            assert view.node_ids == ["node-a", "node-b"]
+        assert cluster.membership("node-c").epoch == 0
+        assert await node_a.reconcile() is None
+
+    @pytest.mark.asyncio
+    async def test_rejoined_node_catches_up_and_is_added(self):
+        """Test that a returning node syncs and is added in a new epoch."""
+        cluster = Cluster()
+        cluster.down.add("node-c")
+        await cluster.membership("node-a").reconcile()
+        cluster.down.clear()
+        node_c = cluster.membership("node-c")
+
+        assert node_c.sync() is True
+        assert node_c.epoch == 1
+        txn = await cluster.membership("node-a").reconcile()
+
+        assert txn.committed
+        for node_id in ("node-a", "node-b", "node-c"):
+            view = cluster.membership(node_id).view
+            assert view.epoch == 2
+            assert view.node_ids == ["node-a", "node-b", "node-c"]
+
+    def test_stale_and_concurrent_changes_rejected(self):
+        """Test that only one change can be prepared, and only forward."""
+        membership = Cluster().membership("node-b")
+        view = MembershipView(1, {"node-a": "a", "node-b": "b"})
+
+        first = membership.prepare_change("txn-1", view)
+        second = membership.prepare_change("txn-2", view)
+        membership.commit_change("txn-1", view)
+        stale = membership.prepare_change("txn-3", view)
+
+        assert first["vote"] == "READY"
+        assert second["vote"] == "ABORT"
+        assert stale["vote"] == "ABORT"
+        assert membership.epoch == 1
+        later = membership.prepare_change("txn-4", MembershipView(2, {}))
+        assert later["vote"] == "READY"
+
+    @pytest.mark.asyncio
+    async def test_minority_cannot_change_view(self):
+        """Test that a node cut off from the majority keeps its view."""
+        cluster = Cluster()
+        cluster.down.update(["node-a", "node-b"])
+        node_c = cluster.membership("node-c")
+
+        assert node_c.is_proposer() is True
+        assert await node_c.reconcile() is None
+        assert node_c.epoch == 0
+        assert node_c.has_quorum() is False
+
+    @pytest.mark.asyncio
+    async def test_aborted_change_keeps_view(self):
+        """Test that a member voting ABORT leaves every view unchanged."""
+        cluster = Cluster()
+        cluster.membership("node-b").prepare_change(
+            "other", MembershipView(1, {})
+        )
+
+        txn = await cluster.membership("node-a").propose(
+            {"node-a": "http://node-a", "node-b": "http://node-b"}
+        )
+
+        assert not txn.committed
+        assert cluster.membership("node-a").epoch == 0
+        assert cluster.membership("node-c").epoch == 0
+
+    def test_installed_members_registered_as_peers(self):
+        """Test that a new view's members are registered with addresses."""
+        cluster = Cluster(("node-a", "node-b"))
+        node_b = cluster.membership("node-b")
+        installed = []
+        node_b.subscribe(installed.append)
+
+        node_b.install(
+            MembershipView(
+                4, {"node-b": "http://node-b", "node-d": "http://d:9090"}
+            )
+        )
+
+        assert cluster.nodes["node-b"]["registry"].registered == {
+            "node-d": "http://d:9090"
+        }
+        assert [view.epoch for view in installed] == [4]
+        assert cluster.servers["node-b"].get_membership_view()["epoch"] == 4
+
+
+class TestViewConsumers:
+    """Tests for subsystems deriving their node sets from the view."""
+
+    def test_followers_chosen_among_live_members(self):
+        """Test that replication skips peers outside the view."""
+        cluster = Cluster()
+        node_a = cluster.nodes["node-a"]
+        node_a["membership"].install(
+            MembershipView(1, {"node-a": "a", "node-b": "b"})
+        )
+        replication = ReplicationManager(
+            "node-a",
+            node_a["manager"],
+            node_a["registry"],
+            replication_factor=2,
+            failure_detector=node_a["detector"],
+            membership=node_a["membership"],
+        )
+
+        assert replication.choose_followers("room-1") == ["node-b"]
+
+    def test_deletion_participants_are_view_members(self):
+        """Test that room deletions involve the view's other members."""
+        cluster = Cluster()
+        node_b = cluster.nodes["node-b"]
+        node_b["membership"].install(
+            MembershipView(1, {"node-a": "a", "node-b": "b"})
+        )
+        ws_server = WebSocketServer(
+            node_b["manager"],
+            "localhost",
+            0,
+            node_b["registry"],
+            membership=node_b["membership"],
+        )
+
+        assert ws_server._deletion_participants() == ["node-a"]
+        admin = AdminAPI(
+            ws_server, node_b["registry"], membership=node_b["membership"]
+        )
+        assert admin.list_peers()["membership"]["epoch"] == 1
+
+    def test_no_election_without_quorum(self):
+        """Test that a node in the minority doesn't take rooms over."""
+        cluster = Cluster()
+        cluster.down.update(["node-a", "node-b"])
+        node_c = cluster.nodes["node-c"]
+        store = ReplicaStore()
+        store.update_from_join(
+            {
+                "room_id": "room-1",
+                "room_name": "General",
+                "admin_node": "node-a",
+                "members": ["carol"],
+            },
+            [],
+            "carol",
+        )
+        failover = RoomFailover(
+            "node-c",
+            "http://node-c",
+            node_c["manager"],
+            store,
+            node_c["registry"],
+            node_c["detector"],
+            election_timeout=3600,
+            membership=node_c["membership"],
+        )
+
+        assert failover.run_election("room-1") is False
+        assert node_c["manager"].get_room("room-1") is None
+
+        cluster.down.discard("node-b")
+        assert failover.live_peers() == ["node-b"]
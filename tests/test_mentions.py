@@ -0,0 +1,124 @@
+"""
+Tests for Mentions
+
+Tests for parsing @mentions of room members, the mentions carried by
+messages, and mention events reaching mentioned users also in muted
+rooms.
+"""
+
+import json
+
+import pytest
+
+from src.node import RoomStateManager, WebSocketServer
+from src.node.mentions import mentioned_users, parse_mentions
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+    def received(self, message_type):
+        return [
+            m["data"] for m in self.sent_messages if m["type"] == message_type
+        ]
+
+
+def _connect(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.connections.set_username(websocket, username)
+    ws_server.room_manager.add_member(room_id, username)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+class TestParsing:
+    """Tests for finding the members a message mentions."""
+
+    def test_only_members_mentioned(self):
+        """Test offsets, trailing punctuation, emails and non-members."""
+        members = {"bob", "carol.b"}
+        content = "@bob see carol@bob.com, @dave and @carol.b. Thanks @bob."
+
+        mentions = parse_mentions(content, members)
+
+        assert mentions == [
+            {"username": "bob", "offset": 0, "length": 4},
+            {"username": "carol.b", "offset": 34, "length": 8},
+            {"username": "bob", "offset": 51, "length": 4},
+        ]
+        assert parse_mentions("", members) == []
+        assert mentioned_users(
+            {"username": "bob", "mentions": mentions}
+        ) == ["carol.b"]
+
+    def test_mentions_kept_with_message(self):
+        """Test messages carrying mentions until they are deleted."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        for username in ("alice", "bob"):
+            manager.add_member(room_id, username)
+
+        message = manager.add_message(room_id, "alice", "hi @bob and @zed")
+        plain = manager.add_message(room_id, "alice", "hi all")
+
+        assert message["mentions"] == [
+            {"username": "bob", "offset": 3, "length": 4}
+        ]
+        assert "mentions" not in plain
+        manager.edit_message(
+            room_id, "alice", message["message_id"], "delete"
+        )
+
+        assert "mentions" not in manager.find_message(
+            room_id, message["message_id"]
+        )
+
+
+class TestMentionEvents:
+    """Tests for the mention event."""
+
+    @pytest.mark.asyncio
+    async def test_mention_gets_through_mute(self):
+        """Test muted and other devices notified, blockers and sender not."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        room_id = ws_server.room_manager.create_room("General", "alice").room_id
+        alice = _connect(ws_server, room_id, "alice")
+        bob = _connect(ws_server, room_id, "bob")
+        carol = _connect(ws_server, room_id, "carol")
+        phone = MockWebSocket()
+        ws_server.connections.register(phone)
+        ws_server.connections.set_username(phone, "bob")
+        ws_server.mutes.update("bob", mute_rooms=[room_id])
+        ws_server.profiles.block("carol", "alice")
+
+        await ws_server.process_message(
+            alice,
+            json.dumps(
+                {
+                    "type": "send_message",
+                    "data": {
+                        "room_id": room_id,
+                        "username": "alice",
+                        "content": "@bob @carol @alice look",
+                    },
+                }
+            ),
+        )
+
+        mention = bob.received("mention")[0]
+        assert mention["username"] == "bob"
+        assert mention["sender"] == "alice"
+        assert mention["mentions"] == [
+            {"username": "bob", "offset": 0, "length": 4}
+        ]
+        assert len(bob.received("new_message")) == 1
+        assert phone.received("mention") == [mention]
+        assert carol.received("mention") == []
+        assert alice.received("mention") == []
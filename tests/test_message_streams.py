@@ -0,0 +1,240 @@
+"""
+Tests for Message Streams Between Nodes
+
+Tests for streaming room messages to peers: batches of what queued up,
+messages delivered once and in order, credit from a backlogged receiver,
+senders held back by a full stream, streams re-established after failed
+calls, and peers too old for streams.
+"""
+
+import threading
+import time
+
+import pytest
+
+from src.node import (
+    MessageStreams,
+    RoomStateManager,
+    StreamReceiver,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node import message_streams
+from src.node.versioning import IncompatiblePeerError
+
+
+class PeerNetwork:
+    """A PeerRegistry calling in-process XML-RPC servers."""
+
+    def __init__(self, servers):
+        self.servers = servers
+        self.calls = []
+        self.gate = threading.Event()
+        self.gate.set()
+        self.failures = 0
+        self.incompatible = False
+
+    def list_peers(self):
+        return {peer: f"http://{peer}:9090" for peer in self.servers}
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        if node_id not in self.servers:
+            raise ValueError(f"Unknown peer node: {node_id}")
+        self.gate.wait()
+        self.calls.append((method, args))
+        if self.failures:
+            self.failures -= 1
+            raise OSError("Connection refused")
+        if self.incompatible and method == "receive_message_stream":
+            raise IncompatiblePeerError("protocol version 9")
+        return getattr(self.servers[node_id], method)(*args)
+
+
+def _receiver(node_id="node-b"):
+    """An XML-RPC server recording the messages it delivers."""
+    server = XMLRPCServer(RoomStateManager(node_id), "localhost", 0, "")
+    delivered = []
+    server.set_broadcast_callback(
+        lambda room_id, event, exclude_user=None: delivered.append(
+            event["data"]["content"]
+        )
+    )
+    return server, delivered
+
+
+def _message(n):
+    return {
+        "message_id": f"m{n}",
+        "room_id": "room-1",
+        "username": "alice",
+        "content": str(n),
+        "sequence_number": n,
+        "vector_clock": {"node-a": n},
+        "origin_node": "node-a",
+    }
+
+
+def _wait(condition, timeout=5):
+    deadline = time.monotonic() + timeout
+    while not condition():
+        assert time.monotonic() < deadline, "timed out"
+        time.sleep(0.005)
+
+
+def _batches(network):
+    return [
+        len(args[2])
+        for method, args in network.calls
+        if method == "receive_message_stream"
+    ]
+
+
+class TestStreams:
+    """Tests for batches, delivery and flow control."""
+
+    def test_batches_delivered_once_in_order(self):
+        """Test that queued messages go out in batches, each once."""
+        server, delivered = _receiver()
+        network = PeerNetwork({"node-b": server})
+        streams = MessageStreams("node-a", network, batch_size=10)
+        network.gate.clear()
+        for n in range(1, 31):
+            streams.send("room-1", _message(n))
+        network.gate.set()
+        _wait(lambda: streams.status()["node-b"]["acked"] == 30)
+
+        status = streams.status()["node-b"]
+        assert delivered == [str(n) for n in range(1, 31)]
+        batches = _batches(network)
+        assert sum(batches) == 30 and len(batches) <= 4
+        assert max(batches) == 10
+        assert (status["acked"], status["queued"]) == (30, 0)
+        assert status["connected"] and not status["failures"]
+        streams.shutdown(timeout=1)
+
+    def test_credit_and_full_streams(self):
+        """Test a backlogged receiver's credit and a sender waiting."""
+        server, delivered = _receiver()
+        backlog = [1000]
+        server.set_backlog_callback(lambda: backlog[0])
+        network = PeerNetwork({"node-b": server})
+        streams = MessageStreams("node-a", network, queue_size=3)
+        streams.send("room-1", _message(1))
+        _wait(lambda: streams.status()["node-b"]["credit"] == 0)
+        for n in range(2, 5):
+            streams.send("room-1", _message(n))
+        sender = threading.Thread(
+            target=streams.send, args=("room-1", _message(5))
+        )
+        sender.start()
+        time.sleep(0.1)
+
+        assert sender.is_alive()
+        assert delivered == ["1"]
+        assert set(_batches(network)[1:]) == {0}
+        backlog[0] = 998
+        sender.join(timeout=2)
+        _wait(lambda: len(delivered) == 5)
+        assert delivered == ["1", "2", "3", "4", "5"]
+        batches = _batches(network)
+        assert sum(batches) == 5 and max(batches) == 2
+        streams.shutdown(timeout=1)
+
+
+class TestFailures:
+    """Tests for failed calls, restarted senders and old peers."""
+
+    def test_reestablished_after_failed_calls(self):
+        """Test retries from the first unacknowledged message."""
+        server, delivered = _receiver()
+        network = PeerNetwork({"node-b": server})
+        network.failures = 3
+        delay, message_streams.STREAM_RETRY_DELAY = (
+            message_streams.STREAM_RETRY_DELAY,
+            0.01,
+        )
+        try:
+            streams = MessageStreams("node-a", network)
+            for n in range(1, 6):
+                streams.send("room-1", _message(n))
+            _wait(lambda: streams.status()["node-b"]["acked"] == 5)
+        finally:
+            message_streams.STREAM_RETRY_DELAY = delay
+
+        status = streams.status()["node-b"]
+        assert delivered == ["1", "2", "3", "4", "5"]
+        assert (status["failures"], status["connected"]) == (3, True)
+        assert len(network.calls) >= 4
+        streams.shutdown(timeout=1)
+
+    def test_receiver_skips_messages_it_has(self):
+        """Test retried batches, a restarted sender and several senders."""
+        receiver = StreamReceiver(window=10)
+        delivered = []
+
+        def deliver(room_id, message):
+            delivered.append(message)
+
+        batch = [[1, "room-1", "a"], [2, "room-1", "b"]]
+        assert receiver.receive("node-a", "s1", batch, deliver) == 2
+        assert receiver.receive("node-a", "s1", batch, deliver) == 2
+        more = [[2, "room-1", "b"], [3, "room-1", "c"]]
+        assert receiver.receive("node-a", "s1", more, deliver) == 3
+        assert receiver.receive("node-a", "s2", batch[:1], deliver) == 1
+        assert receiver.receive("node-c", "s9", [], deliver) == 0
+
+        assert delivered == ["a", "b", "c", "a"]
+        assert (receiver.credit(4), receiver.credit(25)) == (6, 0)
+
+    def test_old_peers_and_peers_that_left(self):
+        """Test a call per message to old peers and removed peers."""
+        server, delivered = _receiver()
+        network = PeerNetwork({"node-b": server})
+        network.incompatible = True
+        streams = MessageStreams("node-a", network)
+        for n in range(1, 4):
+            streams.send("room-1", _message(n))
+        _wait(lambda: len(delivered) == 3)
+        network.servers = {}
+        streams.send("room-1", _message(4))
+
+        methods = [method for method, _ in network.calls]
+        assert methods.count("receive_message_broadcast") == 3
+        assert delivered == ["1", "2", "3"]
+        assert streams.status() == {}
+        with pytest.raises(ValueError):
+            MessageStreams("node-a", network, batch_size=0)
+
+
+class RecordingStreams:
+    """MessageStreams recording what is sent."""
+
+    def __init__(self):
+        self.sent = []
+
+    def send(self, room_id, message):
+        self.sent.append((room_id, message["content"]))
+
+
+class TestServers:
+    """Tests for the servers sending room messages on streams."""
+
+    @pytest.mark.asyncio
+    async def test_messages_sent_on_streams(self):
+        """Test messages of local and remote senders streamed to peers."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        manager.add_member(room.room_id, "bob")
+        streams = RecordingStreams()
+        ws_server = WebSocketServer(manager, "localhost", 0, streams=streams)
+        xmlrpc_server = XMLRPCServer(
+            manager, "localhost", 0, "", streams=streams
+        )
+
+        ws_server._broadcast_message_to_peers(room.room_id, _message(1))
+        result = xmlrpc_server.forward_message(
+            room.room_id, "bob", "hello", "node-c"
+        )
+
+        assert result["success"]
+        assert streams.sent == [(room.room_id, "1"), (room.room_id, "hello")]
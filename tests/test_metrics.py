@@ -0,0 +1,248 @@
+"""
+Tests for Prometheus Metrics
+
+Tests for the metric types and their text exposition format, the metrics
+recorded by RPC calls, 2PC transactions and heartbeats, the state metrics
+read from the WebSocket server, and the /metrics HTTP endpoint.
+"""
+
+import asyncio
+import urllib.error
+import urllib.request
+import pytest
+
+from src.node import (
+    FailureDetector,
+    MetricsRegistry,
+    MetricsServer,
+    NodeMetrics,
+    PeerRegistry,
+    RoomStateManager,
+    TPCCoordinator,
+    WebSocketServer,
+)
+from src.node.config import NodeConfig
+from src.node.rpc import RPCClientPool
+
+
+class MockTransport:
+    """Transport with a fixed amount of buffered data."""
+
+    def __init__(self, size):
+        self.size = size
+
+    def get_write_buffer_size(self):
+        return self.size
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self, buffered=0):
+        self.sent_messages = []
+        self.transport = MockTransport(buffered)
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+
+class FakeProxy:
+    """ServerProxy stand-in whose methods succeed or raise."""
+
+    def heartbeat(self):
+        return {"status": "ok"}
+
+    def get_room_info(self, room_id):
+        raise ConnectionError("unreachable")
+
+
+class TestMetricTypes:
+    """Tests for counters, gauges, histograms and their rendering."""
+
+    def test_counter_with_labels(self):
+        """Test that counters add up per label set."""
+        registry = MetricsRegistry()
+        counter = registry.counter("events_total", "Events", ("kind",))
+
+        counter.inc(kind="a")
+        counter.inc(2, kind="a")
+        counter.inc(kind='say "hi"')
+
+        assert counter.value(kind="a") == 3
+        text = registry.render()
+        assert "# TYPE events_total counter" in text
+        assert 'events_total{kind="a"} 3' in text
+        assert r'events_total{kind="say \"hi\""} 1' in text
+
+    def test_counter_rejects_bad_use(self):
+        """Test that counters can't go down or miss labels."""
+        counter = MetricsRegistry().counter("events_total", "Events", ("kind",))
+
+        with pytest.raises(ValueError):
+            counter.inc(-1, kind="a")
+        with pytest.raises(ValueError):
+            counter.inc()
+
+    def test_gauge_callback(self):
+        """Test that gauges with a callback are read on every scrape."""
+        registry = MetricsRegistry()
+        items = []
+        registry.gauge("queue_depth", "Depth", function=lambda: len(items))
+
+        items.extend([1, 2])
+
+        assert "queue_depth 2" in registry.render()
+
+    def test_histogram_buckets(self):
+        """Test that histogram buckets are cumulative up to +Inf."""
+        registry = MetricsRegistry()
+        histogram = registry.histogram("latency_seconds", "Latency", buckets=(0.1, 1))
+
+        for value in (0.05, 0.5, 0.7, 3):
+            histogram.observe(value)
+
+        text = registry.render()
+        assert 'latency_seconds_bucket{le="0.1"} 1' in text
+        assert 'latency_seconds_bucket{le="1"} 3' in text
+        assert 'latency_seconds_bucket{le="+Inf"} 4' in text
+        assert "latency_seconds_sum 4.25" in text
+        assert "latency_seconds_count 4" in text
+
+    def test_failing_callback_left_out(self):
+        """Test that a broken callback doesn't break the whole scrape."""
+        registry = MetricsRegistry()
+        registry.gauge("broken", "Broken", function=lambda: 1 / 0)
+        registry.gauge("working", "Working", function=lambda: 1)
+
+        text = registry.render()
+
+        assert "broken" not in text
+        assert "working 1" in text
+
+    def test_duplicate_name_rejected(self):
+        """Test that two metrics can't share a name."""
+        registry = MetricsRegistry()
+        registry.counter("events_total", "Events")
+
+        with pytest.raises(ValueError):
+            registry.gauge("events_total", "Events")
+
+
+class TestRecordedMetrics:
+    """Tests for metrics recorded by the node's components."""
+
+    def test_rpc_latency(self):
+        """Test that RPC calls are timed with their method and outcome."""
+        metrics = NodeMetrics()
+        pool = RPCClientPool(metrics=metrics)
+        pool.get_proxy = lambda address, timeout=None: FakeProxy()
+        pool.discard = lambda address: None
+
+        pool.call("http://node-b:9090", "heartbeat")
+        with pytest.raises(ConnectionError):
+            pool.call("http://node-b:9090", "get_room_info", "r1")
+
+        assert metrics.rpc_duration.count(method="heartbeat", outcome="ok") == 1
+        assert (
+            metrics.rpc_duration.count(method="get_room_info", outcome="error") == 1
+        )
+
+    def test_peer_registry_shares_metrics(self):
+        """Test that the peer registry's client pool records calls."""
+        metrics = NodeMetrics()
+
+        assert PeerRegistry("node-a", metrics=metrics).rpc.metrics is metrics
+
+    @pytest.mark.asyncio
+    async def test_tpc_outcomes(self):
+        """Test that decided transactions are counted by outcome."""
+        metrics = NodeMetrics()
+        coordinator = TPCCoordinator("node-a", metrics=metrics)
+
+        await coordinator.execute("delete_room", {"room_id": "r1"}, [])
+
+        assert (
+            metrics.tpc_transactions.value(operation="delete_room", outcome="commit")
+            == 1
+        )
+
+    def test_heartbeat_failures(self):
+        """Test that every missed heartbeat is counted per peer."""
+        metrics = NodeMetrics()
+        detector = FailureDetector("node-a", PeerRegistry("node-a"), metrics=metrics)
+
+        detector.record_failure("node-b")
+        detector.record_failure("node-b")
+        detector.record_success("node-b", 0.01)
+
+        assert metrics.heartbeat_failures.value(peer="node-b") == 2
+
+
+class TestServerMetrics:
+    """Tests for the state metrics read from the WebSocket server."""
+
+    def test_clients_and_send_queues(self):
+        """Test connected clients and their buffered bytes."""
+        metrics = NodeMetrics()
+        ws_server = WebSocketServer(
+            RoomStateManager("node-a"), "localhost", 0, metrics=metrics
+        )
+        ws_server.connections.register(MockWebSocket(buffered=100))
+        ws_server.connections.register(MockWebSocket(buffered=50))
+
+        text = metrics.registry.render()
+
+        assert "chat_connected_clients 2" in text
+        assert "chat_websocket_send_queue_bytes 150" in text
+        assert "chat_websocket_send_queue_max_bytes 100" in text
+
+    def test_messages_per_room(self):
+        """Test that each hosted room reports its message count."""
+        manager = RoomStateManager("node-a")
+        metrics = NodeMetrics()
+        WebSocketServer(manager, "localhost", 0, metrics=metrics)
+        room = manager.create_room("general", "alice")
+        manager.add_member(room.room_id, "alice")
+        manager.add_message(room.room_id, "alice", "hi")
+        manager.add_message(room.room_id, "alice", "again")
+
+        text = metrics.registry.render()
+
+        assert f'chat_room_messages_total{{room_id="{room.room_id}"}} 2' in text
+
+
+class TestMetricsServer:
+    """Tests for the /metrics HTTP endpoint."""
+
+    @pytest.mark.asyncio
+    async def test_scrape(self):
+        """Test that GET /metrics returns the registry in text format."""
+        metrics = NodeMetrics()
+        metrics.record_heartbeat_failure("node-b")
+        server = MetricsServer(metrics.registry, "127.0.0.1", 0)
+        server.start()
+
+        def fetch(path):
+            url = f"http://127.0.0.1:{server.port}{path}"
+            with urllib.request.urlopen(url, timeout=5) as response:
+                return response.headers["Content-Type"], response.read().decode()
+
+        try:
+            loop = asyncio.get_running_loop()
+            content_type, body = await loop.run_in_executor(None, fetch, "/metrics")
+            with pytest.raises(urllib.error.HTTPError) as error:
+                await loop.run_in_executor(None, fetch, "/other")
+        finally:
+            server.stop()
+
+        assert content_type.startswith("text/plain; version=0.0.4")
+        assert 'chat_heartbeat_failures_total{peer="node-b"} 1' in body
+        assert error.value.code == 404
+
+    def test_port_validation(self):
+        """Test that the metrics port can't clash with the other servers."""
+        assert NodeConfig(metrics_port=0).validate() == []
+        assert NodeConfig(metrics_port=70000).validate() != []
+        assert NodeConfig(metrics_port=8080).validate() == [
+            "ws_port and metrics_port are both 8080 on 0.0.0.0"
+        ]
@@ -0,0 +1,312 @@
+"""
+Tests for Room Migration
+
+Tests for operators moving a hosted room to another node, requests on the
+room waiting while it moves, and clients and peers following the room to
+its new admin.
+"""
+
+import functools
+import json
+import threading
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    ReplicaStore,
+    RoomDirectory,
+    RoomFailover,
+    RoomMigrator,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.log_context import ServerProxy
+from src.node.migration import ROOM_MIGRATING, ROOM_MOVED
+from src.node.snapshot import SNAPSHOT_CAPABILITY
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+    def received(self, message_type):
+        return [
+            m["data"] for m in self.sent_messages if m["type"] == message_type
+        ]
+
+
+class NodeProxy:
+    """ServerProxy calling the cluster's servers, as their dispatch does."""
+
+    def __init__(self, cluster):
+        self.cluster = cluster
+        self.calls = []
+
+    def __call__(self, address, allow_none=False):
+        return NodeConnection(self, address.split("//")[1])
+
+
+class NodeConnection:
+    """One node's end of a NodeProxy."""
+
+    def __init__(self, proxy, node_id):
+        self.proxy = proxy
+        self.node_id = node_id
+
+    def __getattr__(self, method):
+        server = self.proxy.cluster.servers[self.node_id]
+        migrator = self.proxy.cluster.nodes[self.node_id]["migrator"]
+
+        def call(*args):
+            self.proxy.calls.append((self.node_id, method))
+            return migrator.gate(
+                method,
+                args,
+                functools.partial(getattr(server, method), *args),
+            )
+
+        return call
+
+
+class DirectoryPeerRegistry(LocalPeerRegistry):
+    """Local registry listing the rooms the other nodes host."""
+
+    def discover_global_rooms(self, local_rooms):
+        return {
+            "rooms": [
+                room
+                for node_id in self.list_peers()
+                for room in self.servers[node_id].get_hosted_rooms()
+            ]
+        }
+
+
+class Cluster:
+    """Admin node-a of a room with alice, and peers node-b and node-c."""
+
+    def __init__(self, pause=1):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in ("node-a", "node-b", "node-c"):
+            registry = DirectoryPeerRegistry(
+                node_id,
+                self.servers,
+                capabilities=[SNAPSHOT_CAPABILITY],
+                tags={"node-c": {"region": "eu"}},
+            )
+            manager = RoomStateManager(node_id)
+            store = ReplicaStore()
+            failover = RoomFailover(
+                node_id, f"http://{node_id}", manager, store, registry
+            )
+            migrator = RoomMigrator(manager, failover, pause=pause)
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                failover=failover,
+                migrator=migrator,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "store": store,
+                "migrator": migrator,
+                "registry": registry,
+            }
+        self.admin = self.nodes["node-a"]
+        self.migrator = self.admin["migrator"]
+        self.room_id = self.admin["manager"].create_room("General", "alice").room_id
+        self.admin["manager"].add_member(self.room_id, "alice")
+        self.admin["manager"].add_member(self.room_id, "carol", "node-c")
+        self.admin["manager"].add_message(self.room_id, "alice", "hello")
+
+    def hosts(self, node_id):
+        return self.nodes[node_id]["manager"].get_room(self.room_id) is not None
+
+    def ws_server(self, node_id, **kwargs):
+        node = self.nodes[node_id]
+        return WebSocketServer(
+            node["manager"],
+            "localhost",
+            0,
+            node["registry"],
+            replica_store=node["store"],
+            migrator=node["migrator"],
+            **kwargs,
+        )
+
+
+async def send_message(ws_server, websocket, room_id, username, content):
+    await ws_server.process_message(
+        websocket,
+        json.dumps(
+            {
+                "type": "send_message",
+                "data": {
+                    "room_id": room_id,
+                    "username": username,
+                    "content": content,
+                },
+            }
+        ),
+    )
+
+
+class TestMigrate:
+    """Tests for moving rooms to other nodes."""
+
+    def test_room_moves_to_target(self):
+        """Test the target hosting the room, and the replica kept here."""
+        cluster = Cluster()
+
+        result = cluster.migrator.migrate(cluster.room_id, "node-b", "admin")
+
+        assert result["success"] is True
+        assert result["admin_node"] == "node-b"
+        assert result["previous_admin"] == "node-a"
+        assert not cluster.hosts("node-a")
+        target = cluster.nodes["node-b"]["manager"]
+        assert sorted(target.get_members(cluster.room_id)) == ["alice", "carol"]
+        assert target.get_messages(cluster.room_id)[0]["content"] == "hello"
+        replica = cluster.admin["store"].get(cluster.room_id)
+        assert replica.admin_node == "node-b"
+        assert replica.local_members == ["alice"]
+        assert cluster.migrator.is_migrating(cluster.room_id) is False
+
+    def test_refused(self):
+        """Test missing rooms, bad targets and placement mismatches."""
+        cluster = Cluster()
+        manager = cluster.admin["manager"]
+        placed = manager.create_room(
+            "Europe", "alice", placement={"region": "eu"}
+        ).room_id
+
+        refused = [
+            cluster.migrator.migrate(room_id, target, "admin")["error_code"]
+            for room_id, target in (
+                ("missing", "node-b"),
+                (cluster.room_id, "node-a"),
+                (cluster.room_id, "node-z"),
+                (placed, "node-b"),
+            )
+        ]
+        moved = cluster.migrator.migrate(placed, "node-c", "admin")
+
+        assert refused == [
+            "ROOM_NOT_FOUND",
+            "INVALID_REQUEST",
+            "PEER_UNAVAILABLE",
+            "PLACEMENT_MISMATCH",
+        ]
+        assert cluster.hosts("node-a")
+        assert moved["success"] is True
+
+
+class TestPause:
+    """Tests for requests waiting while a room moves."""
+
+    def test_waits_for_requests_in_flight(self):
+        """Test the room moving once the request being handled is done."""
+        cluster = Cluster()
+        assert cluster.migrator.enter(cluster.room_id) is None
+        results = []
+        migration = threading.Thread(
+            target=lambda: results.append(
+                cluster.migrator.migrate(cluster.room_id, "node-b", "admin")
+            )
+        )
+
+        migration.start()
+        while not cluster.migrator.is_migrating(cluster.room_id):
+            pass
+        refused = cluster.migrator.enter(cluster.room_id, timeout=0)
+        still_here = cluster.hosts("node-a")
+        cluster.migrator.leave(cluster.room_id)
+        migration.join()
+
+        assert refused["error_code"] == ROOM_MIGRATING
+        assert still_here is True
+        assert results[0]["success"] is True
+        assert cluster.hosts("node-b")
+
+    def test_times_out(self):
+        """Test a request that never finishes keeping the room here."""
+        cluster = Cluster(pause=0.1)
+        cluster.migrator.enter(cluster.room_id)
+
+        result = cluster.migrator.migrate(cluster.room_id, "node-b", "admin")
+
+        assert result["error_code"] == "MIGRATION_TIMEOUT"
+        assert cluster.hosts("node-a")
+        assert not cluster.hosts("node-b")
+        assert cluster.migrator.is_migrating(cluster.room_id) is False
+
+
+class TestRedirect:
+    """Tests for clients and peers following the room."""
+
+    def test_peer_calls_answered_with_room_moved(self):
+        """Test the XML-RPC server answering changes with the new admin."""
+        cluster = Cluster()
+        server = XMLRPCServer(
+            cluster.admin["manager"],
+            "127.0.0.1",
+            0,
+            "",
+            migrator=cluster.migrator,
+        )
+        cluster.migrator.migrate(cluster.room_id, "node-b", "admin")
+        server.start()
+        try:
+            port = server.server.server_address[1]
+            proxy = ServerProxy(f"http://127.0.0.1:{port}", allow_none=True)
+            moved = proxy.forward_message(cluster.room_id, "alice", "hi", "n")
+            info = proxy.get_room_info(cluster.room_id)
+        finally:
+            server.stop()
+
+        assert moved["error_code"] == ROOM_MOVED
+        assert moved["admin_node"] == "node-b"
+        assert moved["node_address"] == "http://node-b"
+        assert info["success"] is False
+
+    @pytest.mark.asyncio
+    async def test_clients_follow_room(self):
+        """Test local members told, and remote ones retrying on the new admin."""
+        cluster = Cluster()
+        ws_server = cluster.ws_server("node-a")
+        alice = MockWebSocket()
+        ws_server.register_client_room_membership(alice, cluster.room_id, "alice")
+        directory = RoomDirectory("node-c")
+        directory.reassign(cluster.room_id, "node-a", "http://node-a", "General")
+        remote = cluster.ws_server("node-c", room_directory=directory)
+        carol = MockWebSocket()
+        remote.register_client_room_membership(carol, cluster.room_id, "carol")
+
+        proxy = NodeProxy(cluster)
+
+        result = await ws_server.migrate_room(cluster.room_id, "node-b", "admin")
+        with patch("src.node.websocket_server.ServerProxy", proxy):
+            await send_message(ws_server, alice, cluster.room_id, "alice", "hi")
+            await send_message(remote, carol, cluster.room_id, "carol", "yo")
+
+        assert result["success"] is True
+        changed = alice.received("room_admin_changed")[0]
+        assert changed["admin_node"] == "node-b"
+        assert changed["previous_admin"] == "node-a"
+        assert alice.received("message_sent")
+        assert carol.received("message_sent")
+        assert ("node-a", "forward_message") in proxy.calls
+        assert directory.get(cluster.room_id).admin_node == "node-b"
+        messages = cluster.nodes["node-b"]["manager"].get_messages(cluster.room_id)
+        assert [m["content"] for m in messages] == ["hello", "hi", "yo"]
@@ -0,0 +1,357 @@
+"""
+Tests for Room Moderation
+
+Tests for the room creator kicking and banning members, the admin node
+enforcing bans on later joins, and removed users being taken out of the
+room on the node they are connected to.
+"""
+
+import asyncio
+import json
+import pytest
+from unittest.mock import patch
+
+from src.client import ChatClient
+from src.node import (
+    ModerationError,
+    PeerRegistry,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.failover import merge_replicas
+from src.node.room_directory import RoomDirectory
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class LocalRPC:
+    """RPC client pool that calls other nodes' XML-RPC servers in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def call(self, address, method, *args, timeout=None):
+        target = self.servers.get(address)
+        if target is None:
+            raise ConnectionError("unreachable")
+        return getattr(target, method)(*args)
+
+
+def _room(manager, *members):
+    room = manager.create_room("general", "alice")
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestRoomModeration:
+    """Tests for kicking and banning in the room state."""
+
+    def test_kick_removes_member(self):
+        """Test that a kicked member is removed but may join again."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+
+        assert manager.moderate_member(room_id, "alice", "bob") == "node-a"
+
+        assert "bob" not in manager.get_members(room_id)
+        assert manager.get_room(room_id).can_join("bob")
+        assert manager.get_banned(room_id) == []
+
+    def test_ban_recorded(self):
+        """Test that a ban removes the member and is remembered."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)
+        manager.add_member(room_id, "bob", "node-b")
+
+        assert manager.moderate_member(room_id, "alice", "bob", ban=True) == (
+            "node-b"
+        )
+
+        assert manager.get_banned(room_id) == ["bob"]
+
+    def test_ban_non_member(self):
+        """Test that users can be banned before they join."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)
+
+        assert manager.moderate_member(room_id, "alice", "eve", ban=True) is None
+        assert manager.get_banned(room_id) == ["eve"]
+
+    def test_only_creator_moderates(self):
+        """Test that members can't kick each other or the creator."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+
+        with pytest.raises(ModerationError) as not_allowed:
+            manager.moderate_member(room_id, "bob", "carol")
+        with pytest.raises(ModerationError) as creator:
+            manager.moderate_member(room_id, "alice", "alice", ban=True)
+        with pytest.raises(ModerationError) as not_member:
+            manager.moderate_member(room_id, "alice", "dave")
+
+        assert not_allowed.value.error_code == "NOT_ALLOWED"
+        assert creator.value.error_code == "INVALID_TARGET"
+        assert not_member.value.error_code == "NOT_IN_ROOM"
+        assert "carol" in manager.get_members(room_id)
+
+    def test_ban_survives_restart(self, tmp_path):
+        """Test that bans are replayed from the message log."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager, "bob")
+        manager.moderate_member(room_id, "alice", "bob", ban=True)
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        assert recovered.get_banned(room_id) == ["bob"]
+
+    def test_bans_kept_on_failover(self):
+        """Test that merged replicas keep every ban."""
+        base = {"room_id": "r1", "room_name": "general", "node_id": "node-b"}
+        merged = merge_replicas(
+            [
+                dict(base, banned=["bob"]),
+                dict(base, node_id="node-c", banned=["eve"]),
+            ],
+            max_messages=10,
+        )
+
+        assert merged["banned"] == ["bob", "eve"]
+
+
+class TestBannedJoins:
+    """Tests for refusing joins of banned users."""
+
+    @pytest.mark.asyncio
+    async def test_local_join_refused(self):
+        """Test that the admin node refuses a banned user's join."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)
+        manager.moderate_member(room_id, "alice", "bob", ban=True)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server, MockWebSocket(), "join_room", room_id=room_id, username="bob"
+        )
+
+        assert response["type"] == "join_room_error"
+        assert response["data"]["error_code"] == "BANNED"
+
+    def test_remote_join_refused(self):
+        """Test that joins forwarded by other nodes are refused too."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager)
+        manager.moderate_member(room_id, "alice", "bob", ban=True)
+        rpc = XMLRPCServer(manager, "localhost", 0, "http://node-a:9090")
+
+        result = rpc.join_room(room_id, "bob", "node-b")
+
+        assert result["error_code"] == "BANNED"
+        assert "bob" not in manager.get_members(room_id)
+
+    def test_invite_does_not_lift_ban(self):
+        """Test that a banned user can't join a private room by invite."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("secret", "alice", private=True)
+        manager.add_member(room.room_id, "alice")
+        invite = manager.create_invite(room.room_id, "alice", "bob")
+        manager.moderate_member(room.room_id, "alice", "bob", ban=True)
+        rpc = XMLRPCServer(manager, "localhost", 0, "http://node-a:9090")
+
+        result = rpc.join_room_by_invite(
+            room.room_id, "bob", "node-b", invite.token
+        )
+
+        assert result["error_code"] == "BANNED"
+
+
+class TestModerationCommands:
+    """Tests for kick_user and ban_user over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_kick_local_member(self):
+        """Test that a kicked client is taken out of the room."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        await _request(
+            ws_server,
+            alice,
+            "kick_user",
+            room_id=room_id,
+            username="alice",
+            target="bob",
+        )
+
+        assert alice.received("user_kicked") == [
+            {"room_id": room_id, "username": "bob"}
+        ]
+        assert alice.received("member_left")[0]["username"] == "bob"
+        removed = bob.received("removed_from_room")[0]
+        assert removed == {"room_id": room_id, "action": "kick", "moderator": "alice"}
+        assert not ws_server._is_client_in_room(bob, room_id)
+
+    @pytest.mark.asyncio
+    async def test_rejected_by_non_creator(self):
+        """Test that members other than the creator get moderation_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            MockWebSocket(),
+            "ban_user",
+            room_id=room_id,
+            username="bob",
+            target="alice",
+        )
+
+        assert response["type"] == "moderation_error"
+        assert response["data"]["request_type"] == "ban_user"
+        assert response["data"]["error_code"] == "NOT_ALLOWED"
+
+    @pytest.mark.asyncio
+    async def test_ban_enforced_across_nodes(self):
+        """Test a ban sent from another node reaching the target's node."""
+        servers = {}
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin)
+        admin.add_member(room_id, "bob", "node-b")
+        registry = PeerRegistry("node-a")
+        registry.rpc = LocalRPC(servers)
+        registry.register_peer("node-b", "http://node-b:9090")
+        admin_rpc = XMLRPCServer(
+            admin, "localhost", 0, "http://node-a:9090", registry
+        )
+
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+        rpc_b = XMLRPCServer(
+            ws_b.room_manager, "localhost", 0, "http://node-b:9090"
+        )
+        rpc_b.set_removal_callback(ws_b.remove_member_sync)
+        rpc_b.set_broadcast_callback(ws_b.broadcast_to_room_sync)
+        servers["http://node-b:9090"] = rpc_b
+        alice = _join(ws_b, room_id, "alice")
+        bob = _join(ws_b, room_id, "bob")
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ), patch(
+            "src.node.utils.broadcast.ServerProxy",
+            lambda address, allow_none=True: servers[address],
+        ):
+            response = await _request(
+                ws_b,
+                alice,
+                "ban_user",
+                room_id=room_id,
+                username="alice",
+                target="bob",
+            )
+            await asyncio.sleep(0)
+
+        assert response["type"] == "user_banned"
+        assert admin.get_banned(room_id) == ["bob"]
+        assert bob.received("removed_from_room")[0]["action"] == "ban"
+        assert not ws_b._is_client_in_room(bob, room_id)
+        assert alice.received("member_left")[0]["username"] == "bob"
+
+
+class TestClient:
+    """Tests for the client side of kick_user and ban_user."""
+
+    @pytest.mark.asyncio
+    async def test_ban_user_request(self):
+        """Test that ban_user sends the target and returns the result."""
+        client = ChatClient("ws://localhost:8000")
+        websocket = MockWebSocket()
+
+        async def recv():
+            return json.dumps(
+                {
+                    "type": "user_banned",
+                    "data": {"room_id": "room-1", "username": "bob"},
+                }
+            )
+
+        websocket.recv = recv
+        client._set_test_mode(mock_websocket=websocket)
+
+        result = await client.ban_user("room-1", "alice", "bob")
+
+        assert result["username"] == "bob"
+        request = json.loads(websocket.sent_messages[0])
+        assert request == {
+            "type": "ban_user",
+            "data": {"room_id": "room-1", "username": "alice", "target": "bob"},
+        }
+
+    @pytest.mark.asyncio
+    async def test_removed_from_room_clears_room(self):
+        """Test that a removed client leaves its current room."""
+        client = ChatClient("ws://localhost:8000")
+        client.set_current_room("room-1")
+        removals = []
+        client.set_on_removed_from_room(removals.append)
+
+        await client._process_incoming_message(
+            json.dumps(
+                {
+                    "type": "removed_from_room",
+                    "data": {"room_id": "room-1", "action": "kick"},
+                }
+            )
+        )
+
+        assert client.current_room is None
+        assert removals == [{"room_id": "room-1", "action": "kick"}]
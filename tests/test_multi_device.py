@@ -0,0 +1,264 @@
+"""
+Tests for Multi-Device Support
+
+Tests for users connected from several devices, possibly through
+different nodes: room membership lasting until the last device is gone,
+leaving on all devices at once, presence across nodes, and direct
+messages reaching every device.
+"""
+
+import asyncio
+import json
+
+import pytest
+
+from src.node import (
+    PeerRegistry,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.failover import merge_replicas
+from src.node.presence import PresenceDirectory
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class LocalRPC:
+    """RPC client pool that calls other nodes' XML-RPC servers in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def call(self, address, method, *args, timeout=None):
+        target = self.servers.get(address)
+        if target is None:
+            raise ConnectionError("unreachable")
+        return getattr(target, method)(*args)
+
+
+def _node(node_id, servers):
+    address = f"http://{node_id}:9090"
+    registry = PeerRegistry(node_id)
+    registry.rpc = LocalRPC(servers)
+    presence = PresenceDirectory(node_id, address, debounce=0)
+    manager = RoomStateManager(node_id)
+    ws_server = WebSocketServer(
+        manager, "localhost", 0, registry, presence=presence
+    )
+    xmlrpc_server = XMLRPCServer(
+        manager, "localhost", 0, address, registry, presence=presence
+    )
+    xmlrpc_server.set_direct_message_callback(
+        ws_server.deliver_direct_message_sync
+    )
+    servers[address] = xmlrpc_server
+    return ws_server
+
+
+async def _device(ws_server, username, room_id=None):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    await ws_server.process_message(
+        websocket,
+        json.dumps({"type": "announce_presence", "data": {"username": username}}),
+    )
+    if room_id:
+        ws_server.room_manager.add_member(room_id, username)
+        ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+class TestMembership:
+    """Tests for members connected through several nodes."""
+
+    def test_member_stays_until_last_node_is_gone(self):
+        """Test disconnects through one node and a failed node."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        manager.add_member(room.room_id, "alice", "node-b")
+        manager.add_member(room.room_id, "alice", "node-c")
+        manager.add_member(room.room_id, "bob", "node-c")
+
+        assert room.member_info["alice"].nodes == {"node-b", "node-c"}
+        assert manager.remove_member_node(room.room_id, "alice", "node-c") is False
+        assert room.member_info["alice"].node_id == "node-b"
+        assert manager.remove_all_members_from_node("node-c") == [
+            (room.room_id, "bob")
+        ]
+        assert manager.remove_member_node(room.room_id, "alice", "node-b") is True
+        assert room.members == set()
+
+    def test_nodes_survive_failover(self):
+        """Test that a member reported by two replicas keeps both nodes."""
+        replica = {
+            "room_id": "r1",
+            "room_name": "General",
+            "creator_id": "alice",
+            "messages": [],
+            "message_counter": 0,
+            "vector_clock": {},
+        }
+        state = merge_replicas(
+            [
+                dict(replica, node_id="node-b", local_members=["alice", "bob"]),
+                dict(replica, node_id="node-c", local_members=["alice"]),
+            ],
+            100,
+        )
+        room = RoomStateManager("node-b").restore_room(**state)
+
+        assert state["member_nodes"] == {"alice": ["node-b", "node-c"]}
+        assert room.member_info["alice"].nodes == {"node-b", "node-c"}
+        assert room.member_info["bob"].nodes == {"node-b"}
+
+    def test_disconnect_notice_from_one_node(self):
+        """Test the admin keeping a member still connected elsewhere."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        xmlrpc_server = XMLRPCServer(manager, "localhost", 0, "http://node-a")
+        for node_id in ("node-b", "node-c"):
+            assert xmlrpc_server.join_room(room.room_id, "bob", node_id)[
+                "success"
+            ]
+
+        first = xmlrpc_server.notify_member_disconnect(
+            room.room_id, "bob", "node-b"
+        )
+        assert "bob" in room.members
+        assert first["message"] == "User still connected through another node"
+        xmlrpc_server.notify_member_disconnect(room.room_id, "bob", "node-c")
+        assert "bob" not in room.members
+
+
+class TestConnections:
+    """Tests for several connections of a user to one node."""
+
+    @pytest.mark.asyncio
+    async def test_closing_one_device_keeps_the_others(self):
+        """Test that messages still reach the remaining device."""
+        servers = {}
+        ws_server = _node("node-a", servers)
+        room = ws_server.room_manager.create_room("General", "alice")
+        phone = await _device(ws_server, "alice", room.room_id)
+        laptop = await _device(ws_server, "alice", room.room_id)
+        bob = await _device(ws_server, "bob", room.room_id)
+
+        await ws_server._handle_client_disconnect(phone)
+        message = ws_server.room_manager.add_message(
+            room.room_id, "bob", "hello"
+        )
+        await ws_server.broadcast_to_room(
+            room.room_id, {"type": "new_message", "data": message}
+        )
+
+        assert "alice" in room.members
+        assert bob.received("member_left") == []
+        assert laptop.received("new_message")[0]["content"] == "hello"
+        assert ws_server.presence.get_status("alice") == "online"
+
+    @pytest.mark.asyncio
+    async def test_leaving_leaves_on_every_device(self):
+        """Test that a leave from one device takes the others out too."""
+        servers = {}
+        ws_server = _node("node-a", servers)
+        room = ws_server.room_manager.create_room("General", "alice")
+        phone = await _device(ws_server, "alice", room.room_id)
+        laptop = await _device(ws_server, "alice", room.room_id)
+
+        await ws_server.process_message(
+            phone,
+            json.dumps(
+                {
+                    "type": "leave_room",
+                    "data": {"room_id": room.room_id, "username": "alice"},
+                }
+            ),
+        )
+
+        assert laptop.received("member_left")[0]["username"] == "alice"
+        assert ws_server._client_rooms[laptop] == set()
+        assert "alice" not in room.members
+
+
+class TestPresenceAcrossNodes:
+    """Tests for presence of a user on several nodes."""
+
+    def test_status_combines_devices(self):
+        """Test locating, statuses and going offline on one node."""
+        node_a = PresenceDirectory("node-a", debounce=0)
+        node_b = PresenceDirectory("node-b", debounce=0)
+        node_a.set_online("alice")
+        node_b.set_online("alice")
+        node_b.set_status("alice", "away")
+        node_b.merge(node_a.get_entries())
+        node_b.take_changes()
+
+        assert [e.node_id for e in node_b.locate_all("alice")] == [
+            "node-b",
+            "node-a",
+        ]
+        assert node_b.get_status("alice") == "online"
+        node_a.set_offline("alice")
+        node_b.merge(node_a.get_entries())
+        assert node_b.get_status("alice") == "away"
+        assert [(c.status, c.node_id) for c in node_b.take_changes()] == [
+            ("away", "node-b")
+        ]
+        node_b.set_offline("alice")
+        assert node_b.get_status("alice") == "offline"
+        assert node_b.purge_offline(ttl=-1) == 2
+
+    @pytest.mark.asyncio
+    async def test_direct_message_reaches_every_device(self):
+        """Test a direct message to a user on two other nodes."""
+        servers = {}
+        nodes = {n: _node(n, servers) for n in ("node-a", "node-b", "node-c")}
+        for node_id, ws_server in nodes.items():
+            for other_id in nodes:
+                if other_id != node_id:
+                    ws_server.peer_registry.register_peer(
+                        other_id, f"http://{other_id}:9090"
+                    )
+        sender = await _device(nodes["node-a"], "alice")
+        phone = await _device(nodes["node-b"], "bob")
+        laptop = await _device(nodes["node-c"], "bob")
+        for ws_server in nodes.values():
+            for other in nodes.values():
+                other.presence.merge(ws_server.presence.get_entries())
+
+        await nodes["node-a"].process_message(
+            sender,
+            json.dumps(
+                {
+                    "type": "send_direct_message",
+                    "data": {
+                        "username": "alice",
+                        "recipient": "bob",
+                        "content": "hi",
+                    },
+                }
+            ),
+        )
+        await asyncio.sleep(0)
+
+        assert sender.received("direct_message_sent")[0]["status"] == (
+            "delivered"
+        )
+        assert phone.received("direct_message")[0]["content"] == "hi"
+        assert laptop.received("direct_message")[0]["content"] == "hi"
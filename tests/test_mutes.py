@@ -0,0 +1,189 @@
+"""
+Tests for Muted Rooms and Users
+
+Tests for changing a user's mutes, muted rooms not filling the offline
+queue, filtering muted users' messages from delivery and session replay,
+and the update_mutes command.
+"""
+
+import json
+
+import pytest
+
+from src.node import MuteError, MuteRegistry, RoomStateManager, WebSocketServer
+from src.node.offline_queue import OfflineQueue
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _server():
+    return WebSocketServer(
+        RoomStateManager("node1"), "localhost", 0, offline_queue=OfflineQueue()
+    )
+
+
+def _connect(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.room_manager.add_member(room_id, username)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+async def _send(ws_server, websocket, room_id, username, content):
+    await _request(
+        ws_server,
+        websocket,
+        "send_message",
+        {"room_id": room_id, "username": username, "content": content},
+    )
+
+
+class TestMuteRegistry:
+    """Tests for the store of mutes."""
+
+    def test_update(self):
+        """Test muting, unmuting and keeping the filter setting."""
+        mutes = MuteRegistry()
+
+        mutes.update("bob", mute_rooms=["r1", "r2"], mute_users=["carol"])
+        mutes.update("bob", filter_muted_users=True)
+        preferences = mutes.update("bob", unmute_rooms=["r2"])
+
+        assert preferences.to_dict() == {
+            "username": "bob",
+            "muted_rooms": ["r1"],
+            "muted_users": ["carol"],
+            "filter_muted_users": True,
+        }
+        assert mutes.room_muted("bob", "r1")
+        assert not mutes.room_muted("alice", "r1")
+        assert mutes.silenced("r1") == {"bob"}
+        assert mutes.filtering("carol") == {"bob"}
+        assert mutes.get("alice").to_dict()["muted_rooms"] == []
+
+    def test_invalid_updates(self):
+        """Test that invalid changes are refused and change nothing."""
+        mutes = MuteRegistry(limit=2)
+        mutes.update("bob", mute_rooms=["r1"])
+
+        for changes, code in (
+            ({"mute_rooms": "r2"}, "INVALID_MUTE"),
+            ({"mute_users": [""]}, "INVALID_MUTE"),
+            ({"mute_users": ["bob"]}, "INVALID_MUTE"),
+            ({"filter_muted_users": "yes"}, "INVALID_MUTE"),
+            ({"mute_rooms": ["r2", "r3"]}, "TOO_MANY_MUTES"),
+        ):
+            with pytest.raises(MuteError) as error:
+                mutes.update("bob", **changes)
+            assert error.value.error_code == code
+        assert mutes.get("bob").rooms == {"r1"}
+
+
+class TestMutedDelivery:
+    """Tests for what muted rooms and users deliver."""
+
+    @pytest.mark.asyncio
+    async def test_muted_room_not_buffered(self):
+        """Test that a muted room's messages skip the offline queue."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        ws_server.mutes.update("bob", mute_rooms=[room.room_id])
+
+        await _send(ws_server, alice, room.room_id, "alice", "live")
+        await ws_server._handle_client_disconnect(bob)
+        await _send(ws_server, alice, room.room_id, "alice", "while away")
+
+        assert [m["content"] for m in bob.received("new_message")] == ["live"]
+        session = ws_server.offline_queue.resume("bob")
+        assert session.message_count() == 0
+        assert len(ws_server.room_manager.get_messages(room.room_id)) == 2
+
+    @pytest.mark.asyncio
+    async def test_filtered_users_left_out(self):
+        """Test filtering muted users from live delivery and replay."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        carol = _connect(ws_server, room.room_id, "carol")
+        ws_server.mutes.update("bob", mute_users=["alice"])
+
+        await _send(ws_server, alice, room.room_id, "alice", "hinted")
+        ws_server.mutes.update("bob", filter_muted_users=True)
+        await _send(ws_server, alice, room.room_id, "alice", "filtered")
+        await _send(ws_server, carol, room.room_id, "carol", "kept")
+        await ws_server._handle_client_disconnect(bob)
+        await _send(ws_server, alice, room.room_id, "alice", "away")
+        await _send(ws_server, carol, room.room_id, "carol", "away too")
+        resumed = MockWebSocket()
+        ws_server.connections.register(resumed)
+        await _request(
+            ws_server,
+            resumed,
+            "resume_session",
+            {"username": "bob", "last_seen": {room.room_id: 0}},
+        )
+
+        assert [m["content"] for m in bob.received("new_message")] == [
+            "hinted",
+            "kept",
+        ]
+        assert [m["content"] for m in resumed.received("new_message")] == [
+            "kept",
+            "away too",
+        ]
+        assert len(carol.received("new_message")) == 5
+
+
+class TestMutesCommand:
+    """Tests for the update_mutes command."""
+
+    @pytest.mark.asyncio
+    async def test_update_mutes_command(self):
+        """Test the mutes_updated response and mutes_error."""
+        ws_server = _server()
+        ws = MockWebSocket()
+
+        await _request(
+            ws_server,
+            ws,
+            "update_mutes",
+            {"username": "bob", "mute_users": ["alice"], "filter_muted_users": True},
+        )
+        await _request(
+            ws_server, ws, "update_mutes", {"username": "bob", "mute_rooms": "r1"}
+        )
+
+        assert ws.received("mutes_updated") == [
+            {
+                "username": "bob",
+                "muted_rooms": [],
+                "muted_users": ["alice"],
+                "filter_muted_users": True,
+            }
+        ]
+        assert ws.received("mutes_error")[0]["error_code"] == "INVALID_MUTE"
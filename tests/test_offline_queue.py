@@ -0,0 +1,323 @@
+"""
+Tests for the Offline Message Queue
+
+Tests for holding the sessions of disconnected users, buffering the
+messages they miss, and replaying them when the session is resumed.
+"""
+
+import json
+import pytest
+
+from src.client import ChatClient
+from src.node import RoomStateManager, WebSocketServer
+from src.node.config import ConfigError, load_config
+from src.node.offline_queue import OfflineQueue
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _message(room_id, sequence_number, username="alice"):
+    return {
+        "message_id": f"msg-{sequence_number}",
+        "room_id": room_id,
+        "username": username,
+        "content": f"message {sequence_number}",
+        "sequence_number": sequence_number,
+        "timestamp": f"2025-11-23T10:30:{sequence_number:02d}Z",
+    }
+
+
+def _server(retention=60):
+    room_manager = RoomStateManager("node-a")
+    return WebSocketServer(
+        room_manager, "localhost", 0, offline_queue=OfflineQueue(retention)
+    )
+
+
+def _connect(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.room_manager.add_member(room_id, username)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _disconnect(ws_server, websocket):
+    await ws_server._handle_client_disconnect(websocket)
+    ws_server.connections.unregister(websocket)
+
+
+async def _send(ws_server, websocket, room_id, username, content):
+    await ws_server.process_message(
+        websocket,
+        json.dumps(
+            {
+                "type": "send_message",
+                "data": {"room_id": room_id, "username": username, "content": content},
+            }
+        ),
+    )
+
+
+async def _resume(ws_server, username, last_seen):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    await ws_server.process_message(
+        websocket,
+        json.dumps(
+            {
+                "type": "resume_session",
+                "data": {"username": username, "last_seen": last_seen},
+            }
+        ),
+    )
+    return websocket
+
+
+class TestOfflineQueue:
+    """Tests for the store of held sessions."""
+
+    def test_buffers_only_held_rooms(self):
+        """Test that messages are buffered for the rooms of the session."""
+        queue = OfflineQueue()
+        queue.hold("bob", {"room-1"})
+
+        assert queue.add("room-1", _message("room-1", 1)) == 1
+        assert queue.add("room-2", _message("room-2", 1)) == 0
+
+        session = queue.resume("bob")
+        assert session.messages == {"room-1": [_message("room-1", 1)]}
+        assert queue.is_held("bob") is False
+
+    def test_expired_session_not_resumed(self):
+        """Test that a session outliving the window can't be resumed."""
+        queue = OfflineQueue(retention=-1)
+        queue.hold("bob", {"room-1"})
+
+        assert queue.resume("bob") is None
+        assert [s.username for s in queue.take_expired()] == ["bob"]
+        assert queue.take_expired() == []
+
+    def test_limit_drops_oldest(self):
+        """Test that a full queue drops the oldest message and says so."""
+        queue = OfflineQueue(limit=2)
+        queue.hold("bob", {"room-1", "room-2"})
+        queue.add("room-1", _message("room-1", 1))
+        queue.add("room-2", _message("room-2", 2))
+        queue.add("room-1", _message("room-1", 3))
+
+        session = queue.resume("bob")
+        assert session.truncated is True
+        assert session.messages["room-1"] == [_message("room-1", 3)]
+        assert session.message_count() == 2
+
+    def test_second_hold_extends_session(self):
+        """Test that disconnecting again adds rooms to the held session."""
+        queue = OfflineQueue()
+        queue.hold("bob", {"room-1"})
+        queue.hold("bob", {"room-2"})
+
+        assert queue.resume("bob").rooms == {"room-1", "room-2"}
+
+
+class TestHeldSessions:
+    """Tests for disconnecting and resuming through the WebSocket server."""
+
+    @pytest.mark.asyncio
+    async def test_disconnect_keeps_membership(self):
+        """Test that a held user stays in the room without member_left."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+
+        await _disconnect(ws_server, bob)
+
+        assert "bob" in ws_server.room_manager.get_members(room.room_id)
+        assert alice.received("member_left") == []
+        assert ws_server.offline_queue.is_held("bob")
+
+    @pytest.mark.asyncio
+    async def test_resume_replays_missed_messages(self):
+        """Test that messages sent while away arrive in order on resume."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        await _send(ws_server, alice, room.room_id, "alice", "before")
+        await _disconnect(ws_server, bob)
+        await _send(ws_server, alice, room.room_id, "alice", "first")
+        await _send(ws_server, alice, room.room_id, "alice", "second")
+
+        resumed = await _resume(ws_server, "bob", {room.room_id: 1})
+
+        data = resumed.received("session_resumed")[0]
+        assert data["rooms"] == [room.room_id]
+        assert data["replayed"] == 2
+        replayed = resumed.received("new_message")
+        assert [m["content"] for m in replayed] == ["first", "second"]
+        assert resumed.received("member_joined") == []
+
+    @pytest.mark.asyncio
+    async def test_last_seen_recovers_in_flight_messages(self):
+        """Test that history fills in messages missed just before the drop."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        await _send(ws_server, alice, room.room_id, "alice", "seen")
+        await _send(ws_server, alice, room.room_id, "alice", "lost in flight")
+        await _disconnect(ws_server, bob)
+        await _send(ws_server, alice, room.room_id, "alice", "while away")
+
+        resumed = await _resume(ws_server, "bob", {room.room_id: 1})
+
+        replayed = resumed.received("new_message")
+        assert [m["sequence_number"] for m in replayed] == [2, 3]
+
+    @pytest.mark.asyncio
+    async def test_resumed_connection_gets_new_messages(self):
+        """Test that the resumed connection is back in the room."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        await _disconnect(ws_server, bob)
+
+        resumed = await _resume(ws_server, "bob", {})
+        await _send(ws_server, alice, room.room_id, "alice", "welcome back")
+
+        assert resumed.received("new_message")[0]["content"] == "welcome back"
+        assert ws_server._is_client_in_room(resumed, room.room_id)
+
+    @pytest.mark.asyncio
+    async def test_relayed_messages_buffered(self):
+        """Test that messages relayed from the admin node are buffered."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        await _disconnect(ws_server, bob)
+
+        ws_server.broadcast_to_room_sync(
+            room.room_id, {"type": "new_message", "data": _message(room.room_id, 7)}
+        )
+        resumed = await _resume(ws_server, "bob", {room.room_id: 6})
+
+        assert resumed.received("new_message")[0]["message_id"] == "msg-7"
+
+    @pytest.mark.asyncio
+    async def test_no_session_to_resume(self):
+        """Test that resuming without a held session is reported."""
+        ws_server = _server()
+
+        resumed = await _resume(ws_server, "bob", {})
+
+        error = resumed.received("resume_error")[0]
+        assert error["error_code"] == "SESSION_NOT_FOUND"
+
+    @pytest.mark.asyncio
+    async def test_expired_session_leaves_rooms(self):
+        """Test that an expired session's user leaves with member_left."""
+        ws_server = _server(retention=-1)
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _connect(ws_server, room.room_id, "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        await _disconnect(ws_server, bob)
+
+        assert await ws_server.expire_offline_sessions() == 1
+
+        assert "bob" not in ws_server.room_manager.get_members(room.room_id)
+        assert alice.received("member_left")[0]["username"] == "bob"
+
+    @pytest.mark.asyncio
+    async def test_expiry_skips_rooms_joined_again(self):
+        """Test that a user who came back another way isn't removed."""
+        ws_server = _server(retention=-1)
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+        await _disconnect(ws_server, bob)
+        _connect(ws_server, room.room_id, "bob")
+
+        await ws_server.expire_offline_sessions()
+
+        assert "bob" in ws_server.room_manager.get_members(room.room_id)
+
+    @pytest.mark.asyncio
+    async def test_disabled_without_queue(self):
+        """Test that disconnecting leaves rooms at once without a queue."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _connect(ws_server, room.room_id, "bob")
+
+        await _disconnect(ws_server, bob)
+
+        assert "bob" not in ws_server.room_manager.get_members(room.room_id)
+
+
+class TestClient:
+    """Tests for the client side of the handshake."""
+
+    def test_last_seen_sequences(self):
+        """Test that the chat client reports its last displayed messages."""
+        client = ChatClient("ws://localhost:8000")
+        client.set_current_room("room-1")
+        client.message_buffers["room-1"].add_message(_message("room-1", 1))
+        client.message_buffers["room-1"].get_new_messages()
+
+        assert client.last_seen_sequences() == {"room-1": 1}
+
+    @pytest.mark.asyncio
+    async def test_resume_session_request(self):
+        """Test that resume_session sends the handshake and returns the result."""
+        client = ChatClient("ws://localhost:8000")
+        websocket = MockWebSocket()
+
+        async def recv():
+            return json.dumps(
+                {
+                    "type": "session_resumed",
+                    "data": {"username": "bob", "rooms": ["room-1"], "replayed": 0},
+                }
+            )
+
+        websocket.recv = recv
+        client._set_test_mode(mock_websocket=websocket)
+
+        result = await client.resume_session("bob", {"room-1": 4})
+
+        assert result["rooms"] == ["room-1"]
+        request = json.loads(websocket.sent_messages[0])
+        assert request["type"] == "resume_session"
+        assert request["data"]["last_seen"] == {"room-1": 4}
+
+
+class TestConfig:
+    """Tests for the retention setting."""
+
+    def test_retention_from_env(self):
+        """Test that OFFLINE_RETENTION is read from the environment."""
+        config = load_config(environ={"OFFLINE_RETENTION": "30"})
+
+        assert config.offline_retention == 30
+
+    def test_negative_retention_rejected(self):
+        """Test that a negative retention window is reported."""
+        with pytest.raises(ConfigError) as exc_info:
+            load_config(environ={"OFFLINE_RETENTION": "-5"})
+
+        assert "offline_retention" in str(exc_info.value)
@@ -0,0 +1,181 @@
+"""
+Tests for Orphaned State Reaping
+
+Tests for removing a dead node's members, presence entries, transactions
+and receipt tracking when the failure detector declares it dead, and for
+participants recovering the transactions of a dead coordinator right away
+while keeping the prepared ones they can't recover until the timeout.
+"""
+
+import pytest
+
+from src.node import (
+    FailureDetector,
+    OrphanReaper,
+    PresenceDirectory,
+    ReceiptTracker,
+    RoomStateManager,
+    TPCParticipant,
+    TransactionHandler,
+)
+from src.node.main import _handle_membership_change
+from src.node.room_state import RoomState
+from src.node.tpc import PARTICIPANTS_KEY
+from tests.fakes import LocalPeerRegistry
+
+
+class ParticipantPeerRegistry(LocalPeerRegistry):
+    """Local registry calling participants by their own method names."""
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        method = method.replace("tpc_", "")
+        return super().call_peer(node_id, method, *args, timeout=timeout)
+
+
+class RecordingHandler(TransactionHandler):
+    """Handler that votes READY and records calls."""
+
+    def __init__(self):
+        self.calls = []
+
+    def prepare(self, transaction_id, payload):
+        return {"vote": "READY"}
+
+    def commit(self, transaction_id, payload):
+        self.calls.append(("commit", transaction_id))
+        return {"success": True}
+
+    def abort(self, transaction_id, payload):
+        self.calls.append(("abort", transaction_id))
+        return {"success": True}
+
+
+class WsServer:
+    """WebSocket server recording broadcasts to local clients."""
+
+    def __init__(self):
+        self.broadcasts = []
+
+    def broadcast_to_room_sync(self, room_id, message):
+        self.broadcasts.append(message)
+
+    def admit_waitlisted_sync(self, room_id):
+        pass
+
+
+def _dead(node_id):
+    """Get the event of a node declared dead."""
+    detector = FailureDetector("node1", LocalPeerRegistry(), dead_threshold=1)
+    return detector.record_failure(node_id)
+
+
+class TestReaper:
+    """Tests for reaping the state of a dead node."""
+
+    @pytest.mark.asyncio
+    async def test_reaps_everything_tied_to_the_node(self):
+        """Test members, presence, transactions and receipts reaped."""
+        manager = RoomStateManager("node1")
+        general = manager.create_room("General", "alice").room_id
+        alerts = manager.create_room("Alerts", "alice").room_id
+        manager.add_member(general, "alice")
+        manager.add_member(general, "bob", "node2")
+        manager.prepare_for_deletion(alerts, "t-legacy", "node2")
+        presence = PresenceDirectory("node1")
+        presence.merge([{"username": "bob", "node_id": "node2", "status": "away"}])
+        participant = TPCParticipant("node1")
+        handler = RecordingHandler()
+        participant.register_handler("rename_room", handler)
+        participant.prepare("t1", "rename_room", {}, "node2")
+        participant.prepare("t2", "rename_room", {}, "node3")
+        receipts = ReceiptTracker()
+        receipts.track(general, {"message_id": "m1", "origin_node": "node2"})
+        receipts.track(general, {"message_id": "m2", "origin_node": "node1"})
+        ws_server = WsServer()
+        reaper = OrphanReaper(
+            manager, ws_server, None, presence, participant, receipts
+        )
+
+        await _handle_membership_change(
+            manager, ws_server, None, _dead("node2"), reaper
+        )
+
+        assert manager.get_room(general).members == {"alice"}
+        assert [m["type"] for m in ws_server.broadcasts] == ["member_left"]
+        assert ws_server.broadcasts[0]["data"]["reason"] == "Node unreachable"
+        assert presence.locate_all("bob") == []
+        assert handler.calls == []
+        assert participant.get_transaction("t1") is not None
+        assert manager.get_room(alerts).state == RoomState.DELETION_PENDING
+        assert receipts.tracked_count() == 1
+        assert await reaper.reap("node2") == {
+            "members": 0,
+            "presence": 0,
+            "transactions": 0,
+            "deletions": 0,
+            "receipts": 0,
+        }
+
+        # Presumed abort once the prepared ones time out
+        participant.participant_timeout = -1
+        reaper.deletion_timeout = -1
+        assert participant.expire_prepared() == ["t1", "t2"]
+        assert reaper.cancel_deletions("node2") == ["t-legacy"]
+        assert handler.calls == [("abort", "t1"), ("abort", "t2")]
+        assert ws_server.broadcasts[-1]["type"] == "delete_room_cancelled"
+        assert manager.get_room(alerts).state == RoomState.ACTIVE
+
+    def test_presence_forgotten_until_alive(self):
+        """Test users published offline and stale gossip ignored."""
+        presence = PresenceDirectory("node1", debounce=0)
+        entry = {"username": "bob", "node_id": "node2", "status": "online"}
+        presence.merge([entry])
+        presence.take_changes()
+
+        assert presence.forget_node("node2") == 1
+        changes = presence.take_changes()
+        presence.merge([entry])
+
+        assert [(c.username, c.status) for c in changes] == [
+            ("bob", "offline")
+        ]
+        assert presence.get_entries() == []
+        detector = FailureDetector("node1", LocalPeerRegistry())
+        detector.record_failure("node2")
+        presence.on_membership_change(detector.record_success("node2", 0.1))
+        assert presence.merge([entry]) == 1
+
+
+class TestResolveOrphaned:
+    """Tests for participants deciding a dead coordinator's transactions."""
+
+    def test_recovers_with_the_other_participants(self):
+        """Test a recoverable transaction committed without waiting."""
+        servers = {}
+        registry = ParticipantPeerRegistry(servers=servers)
+        handlers = {}
+        payload = {PARTICIPANTS_KEY: ["node2", "node3"]}
+        for node_id in ("node2", "node3"):
+            servers[node_id] = TPCParticipant(node_id, peer_registry=registry)
+            handlers[node_id] = RecordingHandler()
+            servers[node_id].register_handler("rename_room", handlers[node_id])
+            servers[node_id].prepare("t1", "rename_room", payload, "node1")
+        servers["node3"].precommit("t1")
+
+        assert servers["node2"].resolve_orphaned("node9") == []
+        assert servers["node2"].resolve_orphaned("node1") == ["t1"]
+
+        for node_id in ("node2", "node3"):
+            assert handlers[node_id].calls == [("commit", "t1")]
+
+    def test_prepared_kept_for_a_coordinator_wrongly_declared_dead(self):
+        """Test a transaction without participants still committed."""
+        participant = TPCParticipant("node2")
+        handler = RecordingHandler()
+        participant.register_handler("rename_room", handler)
+        participant.prepare("t1", "rename_room", {}, "node1")
+
+        assert participant.resolve_orphaned("node1") == []
+        participant.commit("t1")
+
+        assert handler.calls == [("commit", "t1")]
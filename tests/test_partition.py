@@ -0,0 +1,272 @@
+"""
+Tests for Network Partition Handling
+
+Tests for buffering messages of degraded rooms with causal vector clocks,
+degrading rooms when forwarding fails or their admin is suspected, the
+room_status and message_status events clients get, reconciling buffered
+messages in order once the admin is back, read-only mode, and the
+degraded_mode setting.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    PartitionError,
+    PartitionManager,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.config import NodeConfig
+from src.node.failure_detector import MembershipEvent, PeerState
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+    def of_type(self, message_type):
+        return [m["data"] for m in self.sent_messages if m["type"] == message_type]
+
+
+class StubFailureDetector:
+    """Failure detector reporting the nodes in down as dead."""
+
+    def __init__(self, down):
+        self.down = down
+
+    def is_alive(self, node_id):
+        return node_id not in self.down
+
+
+class PartitionedProxy:
+    """ServerProxy reaching an XML-RPC server unless its node is down."""
+
+    def __init__(self, server, down):
+        self.server = server
+        self.down = down
+
+    def __call__(self, address, allow_none=False):
+        return self
+
+    def forward_message(self, *args):
+        if "node-a" in self.down:
+            raise ConnectionRefusedError("unreachable")
+        return self.server.forward_message(*args)
+
+
+class Partition:
+    """Admin node-a and node-b, whose client alice is in node-a's room."""
+
+    def __init__(self, mode="buffer"):
+        self.down = set()
+        self.admin = RoomStateManager("node-a")
+        self.server = XMLRPCServer(self.admin, "localhost", 0, "http://node-a")
+        self.room = self.admin.create_room("General", "alice")
+        self.admin.add_member(self.room.room_id, "alice")
+        self.partition = PartitionManager(
+            "node-b", mode, failure_detector=StubFailureDetector(self.down)
+        )
+        self.ws_server = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            object(),
+            partition=self.partition,
+        )
+        self.ws_server._locate_room_admin = lambda room_id: (
+            {"room_id": room_id},
+            "http://node-a",
+        )
+        self.ws_server._room_admin_node = lambda room_id: "node-a"
+        self.ws = MockWebSocket()
+        self.ws_server.register_client_room_membership(
+            self.ws, self.room.room_id, "alice"
+        )
+        self.proxy = patch(
+            "src.node.websocket_server.ServerProxy",
+            PartitionedProxy(self.server, self.down),
+        )
+
+    async def send(self, content, message_id=None, username="alice", ws=None):
+        request = {
+            "type": "send_message",
+            "data": {
+                "room_id": self.room.room_id,
+                "username": username,
+                "content": content,
+                "message_id": message_id,
+            },
+        }
+        with self.proxy, patch(
+            "src.node.websocket_server.FORWARD_RETRY_DELAY", 0
+        ):
+            await self.ws_server.handle_send_message(ws or self.ws, request)
+
+    async def reconcile(self):
+        with self.proxy:
+            return await self.ws_server.reconcile_partitions()
+
+    def history(self):
+        return [m["content"] for m in self.admin.get_room(self.room.room_id).messages]
+
+
+class TestPartitionManager:
+    """Tests for degraded rooms and their buffers."""
+
+    def test_buffered_clocks_follow_delivered_and_buffered(self):
+        """Test that each message depends on what came before it."""
+        partition = PartitionManager("node-b")
+        partition.degrade("room-1", "node-a", "unreachable")
+
+        first = partition.buffer(
+            "room-1", "alice", "one", delivered_clock={"node-a": 4}
+        )
+        second = partition.buffer("room-1", "bob", "two", "m2")
+
+        assert first.vector_clock == {"node-a": 4, "node-b": 1}
+        assert second.vector_clock == {"node-a": 4, "node-b": 2}
+        assert second.message_id == "m2"
+        assert first.message_id
+        assert partition.pending("room-1") == [first, second]
+        assert partition.status("room-1")["buffered"] == 2
+
+    def test_buffer_refused(self):
+        """Test that healthy, read-only and full rooms refuse messages."""
+        read_only = PartitionManager("node-b", "read_only")
+        read_only.degrade("room-1", "node-a", "unreachable")
+        full = PartitionManager("node-b", max_buffered=1)
+        full.degrade("room-1", "node-a", "unreachable")
+        full.buffer("room-1", "alice", "one")
+
+        for partition, code in (
+            (PartitionManager("node-b"), "NOT_DEGRADED"),
+            (read_only, "ROOM_READ_ONLY"),
+            (full, "BUFFER_FULL"),
+        ):
+            with pytest.raises(PartitionError) as error:
+                partition.buffer("room-1", "alice", "two")
+            assert error.value.error_code == code
+        with pytest.raises(ValueError):
+            PartitionManager("node-b", "drop")
+
+
+class TestDegradedRooms:
+    """Tests for degrading and reconciling rooms on a member node."""
+
+    @pytest.mark.asyncio
+    async def test_unreachable_admin_buffers_messages(self):
+        """Test that a failed forward degrades the room and buffers."""
+        cluster = Partition()
+        cluster.down.add("node-a")
+
+        await cluster.send("hello", "m1")
+        await cluster.send("again", "m2")
+
+        (status,) = cluster.ws.of_type("room_status")
+        assert status["status"] == "degraded"
+        assert status["mode"] == "buffer"
+        assert status["admin_node"] == "node-a"
+        buffered = cluster.ws.of_type("message_status")
+        assert [s["message_id"] for s in buffered] == ["m1", "m2"]
+        assert {s["status"] for s in buffered} == {"buffered"}
+        assert cluster.history() == []
+
+    @pytest.mark.asyncio
+    async def test_reconciled_in_order_when_admin_returns(self):
+        """Test that buffered messages reach the admin once, in order."""
+        cluster = Partition()
+        cluster.down.add("node-a")
+        await cluster.send("one", "m1")
+        await cluster.send("two", "m2")
+
+        assert await cluster.reconcile() == 0
+        cluster.down.clear()
+        restored = await cluster.reconcile()
+
+        assert restored == 1
+        assert cluster.history() == ["one", "two"]
+        statuses = cluster.ws.of_type("message_status")
+        sent = [s for s in statuses if s["status"] == "sent"]
+        assert [(s["message_id"], s["sequence_number"]) for s in sent] == [
+            ("m1", 1),
+            ("m2", 2),
+        ]
+        assert cluster.ws.of_type("room_status")[-1]["status"] == "healthy"
+        assert not cluster.partition.is_degraded(cluster.room.room_id)
+        await cluster.send("three", "m3")
+        assert cluster.history() == ["one", "two", "three"]
+
+    @pytest.mark.asyncio
+    async def test_rejected_buffered_message_dropped(self):
+        """Test that a message the admin rejects is reported and dropped."""
+        cluster = Partition()
+        mallory = MockWebSocket()
+        cluster.ws_server.register_client_room_membership(
+            mallory, cluster.room.room_id, "mallory"
+        )
+        cluster.down.add("node-a")
+        await cluster.send("not a member", "m1", "mallory", mallory)
+        await cluster.send("ok", "m2")
+        cluster.down.clear()
+
+        await cluster.reconcile()
+
+        (error,) = mallory.of_type("message_error")
+        assert error["error_code"] == "NOT_MEMBER"
+        assert cluster.history() == ["ok"]
+        assert cluster.partition.pending(cluster.room.room_id) == []
+        assert not cluster.partition.is_degraded(cluster.room.room_id)
+
+    @pytest.mark.asyncio
+    async def test_read_only_rejects_messages(self):
+        """Test that read-only degraded rooms reject new messages."""
+        cluster = Partition("read_only")
+        cluster.down.add("node-a")
+
+        await cluster.send("hello", "m1")
+
+        (error,) = cluster.ws.of_type("message_error")
+        assert error["error_code"] == "ROOM_READ_ONLY"
+        assert cluster.ws.of_type("room_status")[0]["mode"] == "read_only"
+        cluster.down.clear()
+        assert await cluster.reconcile() == 1
+
+    @pytest.mark.asyncio
+    async def test_suspected_admin_degrades_its_rooms(self):
+        """Test that liveness changes degrade and then restore rooms."""
+        cluster = Partition()
+        suspect = MembershipEvent("node-a", PeerState.ALIVE, PeerState.SUSPECT, 0)
+        alive = MembershipEvent("node-a", PeerState.SUSPECT, PeerState.ALIVE, 1)
+        cluster.down.add("node-a")
+
+        await cluster.ws_server.on_membership_change(suspect)
+        await cluster.send("while suspected", "m1")
+        cluster.down.clear()
+        with cluster.proxy:
+            await cluster.ws_server.on_membership_change(alive)
+
+        statuses = [s["status"] for s in cluster.ws.of_type("room_status")]
+        assert statuses == ["degraded", "healthy"]
+        assert "suspect" in cluster.ws.of_type("room_status")[0]["reason"]
+        assert cluster.history() == ["while suspected"]
+
+
+class TestConfig:
+    """Tests for the degraded_mode setting."""
+
+    def test_degraded_mode(self):
+        """Test that only the buffer and read_only modes are accepted."""
+        errors = NodeConfig(degraded_mode="drop").validate()
+
+        assert any("degraded_mode" in error for error in errors)
+        assert NodeConfig(degraded_mode="read_only").validate() == []
+        assert NodeConfig().degraded_mode == "buffer"
@@ -0,0 +1,205 @@
+"""
+Tests for Payload Validation
+
+Tests for the checks every client message and XML-RPC call goes through:
+payload size, UTF-8 encoding, JSON structure, required fields, and room ID
+and username formats, with the structured error responses they produce.
+"""
+
+import json
+import http.client
+import pytest
+
+from src.node import RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.config import NodeConfig
+from src.node.log_context import ServerProxy
+from src.node.utils.validation import (
+    parse_client_request,
+    validate_request_fields,
+    validate_room_id,
+    validate_username,
+)
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+async def _send(ws_server, message):
+    websocket = MockWebSocket()
+    if not isinstance(message, (str, bytes)):
+        message = json.dumps(message)
+    await ws_server.process_message(websocket, message)
+    return websocket.last()
+
+
+class TestParsing:
+    """Tests for reading a client message."""
+
+    def test_valid_message(self):
+        """Test that a well-formed message is returned parsed."""
+        request, error = parse_client_request('{"type": "list_rooms"}')
+
+        assert request == {"type": "list_rooms"}
+        assert error is None
+
+    def test_size_limit(self):
+        """Test that messages over the limit are refused by byte size."""
+        message = json.dumps({"type": "send_message", "data": {"content": "é" * 60}})
+
+        _, error = parse_client_request(message, max_size=100)
+
+        assert error["error_code"] == "PAYLOAD_TOO_LARGE"
+
+    def test_invalid_utf8(self):
+        """Test that binary frames and escapes must be valid UTF-8."""
+        _, binary = parse_client_request(b'{"type": "list_rooms\xff"}')
+        _, escaped = parse_client_request('{"type": "x", "data": {"a": "\\ud800"}}')
+
+        assert binary["error_code"] == "INVALID_UTF8"
+        assert escaped["error_code"] == "INVALID_UTF8"
+
+    def test_structure(self):
+        """Test that messages must be objects with a type and object data."""
+        _, not_json = parse_client_request("{")
+        _, not_object = parse_client_request("[1]")
+        _, no_type = parse_client_request('{"data": {}}')
+        _, bad_data = parse_client_request('{"type": "list_rooms", "data": []}')
+
+        assert not_json["error_code"] == "INVALID_JSON"
+        assert not_object["error_code"] == "INVALID_REQUEST"
+        assert no_type["field"] == "type"
+        assert bad_data["field"] == "data"
+
+
+class TestFields:
+    """Tests for the fields of each command."""
+
+    def test_required_fields(self):
+        """Test that a command's required fields must be non-empty strings."""
+        error = validate_request_fields(
+            {"type": "kick_user", "data": {"room_id": "r1", "username": "alice"}}
+        )
+        wrong_type = validate_request_fields(
+            {"type": "login", "data": {"username": "alice", "password": 1234}}
+        )
+
+        assert error == {
+            "error": "Missing or invalid field: target",
+            "error_code": "INVALID_REQUEST",
+            "field": "target",
+        }
+        assert wrong_type["field"] == "password"
+
+    def test_id_formats(self):
+        """Test the room ID and username formats."""
+        assert validate_room_id("3f1c2a9e-5b7d-4c1e-9a2b-0d6e8f4a1b2c")[0]
+        assert not validate_room_id("room/../1")[0]
+        assert not validate_room_id("r" * 65)[0]
+        assert validate_username("zoë")[0]
+        assert not validate_username("bob smith")[0]
+        assert not validate_username("bob\x00")[0]
+
+    def test_usernames_list_checked(self):
+        """Test that every name in a usernames list is checked."""
+        error = validate_request_fields(
+            {"type": "get_presence", "data": {"usernames": ["alice", "b\nb"]}}
+        )
+
+        assert error["error_code"] == "INVALID_USERNAME"
+        assert error["field"] == "usernames"
+
+    def test_limits_validated(self):
+        """Test that payload limits must be positive."""
+        assert NodeConfig(max_payload_size=0).validate() == [
+            "max_payload_size must be positive"
+        ]
+
+
+class TestServerResponses:
+    """Tests for the errors the WebSocket server sends back."""
+
+    @pytest.mark.asyncio
+    async def test_error_uses_command_response_type(self):
+        """Test that invalid fields are reported in the command's error type."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+
+        response = await _send(
+            ws_server,
+            {"type": "join_room", "data": {"room_id": "r 1", "username": "alice"}},
+        )
+
+        assert response["type"] == "join_room_error"
+        assert response["data"]["error_code"] == "INVALID_ROOM_ID"
+        assert response["data"]["field"] == "room_id"
+        assert response["data"]["room_id"] == "r 1"
+
+    @pytest.mark.asyncio
+    async def test_oversized_message(self):
+        """Test that an oversized message gets an error, not a crash."""
+        ws_server = WebSocketServer(
+            RoomStateManager("node-a"), "localhost", 0, max_payload_size=64
+        )
+
+        response = await _send(
+            ws_server,
+            {"type": "create_room", "data": {"room_name": "x" * 100}},
+        )
+
+        assert response["type"] == "error"
+        assert response["data"]["error_code"] == "PAYLOAD_TOO_LARGE"
+
+    @pytest.mark.asyncio
+    async def test_previously_silent_receipt_rejected(self):
+        """Test that a malformed receipt gets an error instead of nothing."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+
+        response = await _send(
+            ws_server, {"type": "message_received", "data": {"room_id": "r1"}}
+        )
+
+        assert response["type"] == "message_error"
+        assert response["data"]["field"] == "message_id"
+
+
+class TestRPCValidation:
+    """Tests for checks on inbound XML-RPC calls."""
+
+    def _start(self, **kwargs):
+        server = XMLRPCServer(RoomStateManager("node-a"), "127.0.0.1", 0, "", **kwargs)
+        server.start()
+        return server, server.server.server_address[1]
+
+    def test_malformed_room_id_rejected(self):
+        """Test that calls naming a malformed room ID get an error result."""
+        server, port = self._start()
+        try:
+            proxy = ServerProxy(f"http://127.0.0.1:{port}", allow_none=True)
+            result = proxy.join_room("room\n1", "alice", "node-b")
+        finally:
+            server.stop()
+
+        assert result["success"] is False
+        assert result["error_code"] == "INVALID_ROOM_ID"
+
+    def test_oversized_request_refused(self):
+        """Test that request bodies over the limit get HTTP 413."""
+        server, port = self._start(max_payload_size=128)
+        connection = http.client.HTTPConnection("127.0.0.1", port, timeout=5)
+        try:
+            connection.request("POST", "/RPC2", body="x" * 200)
+            status = connection.getresponse().status
+        finally:
+            connection.close()
+            server.stop()
+
+        assert status == 413
@@ -0,0 +1,137 @@
+"""
+Tests for the Peer Connection Manager
+
+Tests for each peer's circuit breaker: opening after failed calls in a
+row, refusing calls while open, a single trial call once the jittered
+reconnect delay has passed, and closing again on success; and for calls
+through the RPC client pool, the admin API and the metrics reporting it.
+"""
+
+import time
+import xmlrpc.client
+
+import pytest
+
+from src.node import (
+    NodeMetrics,
+    PeerConnections,
+    PeerRegistry,
+    PeerUnavailableError,
+    RoomStateManager,
+    XMLRPCServer,
+)
+from src.node.rpc import RPCClientPool
+
+# Nothing listens on port 1, so connections are refused at once
+DEAD_ADDRESS = "http://127.0.0.1:1"
+
+
+class TestCircuitBreaker:
+    """Tests for the states of a peer connection."""
+
+    def test_opens_after_failures_in_a_row(self):
+        """Test the threshold, refused calls and a success resetting it."""
+        connection = PeerConnections(failure_threshold=3).get("http://b")
+        connection.record_failure(OSError("refused"))
+        connection.record_success()
+        for _ in range(2):
+            connection.before_call()
+            connection.record_failure(OSError("refused"))
+        assert connection.status()["state"] == "closed"
+
+        connection.record_failure(OSError("timed out"))
+        status = connection.status()
+        with pytest.raises(PeerUnavailableError) as error:
+            connection.before_call()
+
+        assert (status["state"], status["failures"]) == ("open", 3)
+        assert status["last_error"] == "timed out"
+        assert 0.25 <= status["retry_in"] <= 0.5
+        assert isinstance(error.value, ConnectionError)
+        assert error.value.error_code == "PEER_UNAVAILABLE"
+
+    def test_trial_calls_after_growing_delays(self):
+        """Test one trial at a time, longer delays and closing again."""
+        connection = PeerConnections(
+            failure_threshold=1, base_delay=0.02, max_delay=0.05
+        ).get("http://b")
+        delays = []
+        for _ in range(3):
+            connection.record_failure(OSError("refused"))
+            delays.append(connection.status()["retry_in"])
+            time.sleep(connection.status()["retry_in"] + 0.01)
+            connection.before_call()
+            assert connection.status()["state"] == "half_open"
+            with pytest.raises(PeerUnavailableError):
+                connection.before_call()
+
+        assert 0.01 <= delays[0] <= 0.02
+        assert 0.02 <= delays[1] <= 0.04
+        assert 0.025 <= delays[2] <= 0.05
+        connection.record_success()
+        connection.before_call()
+        status = connection.status()
+        assert (status["state"], status["opens"], status["failures"]) == (
+            "closed",
+            0,
+            0,
+        )
+        with pytest.raises(ValueError):
+            PeerConnections(failure_threshold=0)
+
+
+class TestCalls:
+    """Tests for calls through the RPC client pool."""
+
+    def test_peer_not_dialled_while_open(self):
+        """Test refused connections opening the circuit, then no dials."""
+        pool = RPCClientPool(connections=PeerConnections(failure_threshold=2))
+        dials = []
+        get_proxy = pool.get_proxy
+        pool.get_proxy = lambda *args: dials.append(args) or get_proxy(*args)
+        for _ in range(2):
+            with pytest.raises(ConnectionRefusedError):
+                pool.call(DEAD_ADDRESS, "heartbeat")
+        for _ in range(5):
+            with pytest.raises(PeerUnavailableError):
+                pool.call(DEAD_ADDRESS, "heartbeat")
+
+        assert len(dials) == 2
+        assert pool.connections.status(DEAD_ADDRESS)["state"] == "open"
+
+    def test_faults_are_answers(self):
+        """Test that a peer answering with a fault keeps its circuit closed."""
+        server = XMLRPCServer(RoomStateManager("node-b"), "127.0.0.1", 0, "")
+        server.start()
+        address = f"http://127.0.0.1:{server.server.server_address[1]}"
+        pool = RPCClientPool(connections=PeerConnections(failure_threshold=1))
+        try:
+            for _ in range(3):
+                with pytest.raises(xmlrpc.client.Fault):
+                    pool.call(address, "no_such_method")
+            result = pool.call(address, "heartbeat")
+        finally:
+            server.stop()
+
+        assert result["status"] == "ok"
+        assert pool.connections.status(address)["state"] == "closed"
+
+    def test_state_reported_per_peer(self):
+        """Test the connection state of peers and its metrics."""
+        metrics = NodeMetrics()
+        registry = PeerRegistry(
+            "node-a", connections=PeerConnections(failure_threshold=1)
+        )
+        registry.register_peer("node-b", DEAD_ADDRESS)
+        registry.register_peer("node-c", "http://node-c:9090")
+        metrics.track_peer_connections(registry)
+        with pytest.raises(ConnectionRefusedError):
+            registry.call_peer("node-b", "heartbeat")
+
+        text = metrics.registry.render()
+        assert registry.connection_status("node-b")["state"] == "open"
+        assert registry.connection_status("node-c") is None
+        assert registry.connection_status("node-d") is None
+        assert 'chat_peer_circuit_state{peer="node-b"} 2' in text
+        assert 'chat_peer_consecutive_failures{peer="node-b"} 1' in text
+        assert 'peer="node-c"' not in text
@@ -0,0 +1,212 @@
+"""
+Tests for Pinned Messages
+
+Tests for pinning and unpinning messages, pins surviving restarts and
+failover, their place in join responses and history, and the
+pin_message and unpin_message commands on the admin node and on a node
+forwarding to it.
+"""
+
+import json
+from unittest.mock import MagicMock
+
+import pytest
+
+from src.node import (
+    MemoryStorage,
+    PinError,
+    ReplicaStore,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.edits import DELETE, create_edit
+from src.node.failover import merge_replicas
+from src.node.pins import update_pins
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, count):
+    """A room owned by alice, with bob as a member and carol a moderator."""
+    room = manager.create_room("General", "alice")
+    for username in ("alice", "bob", "carol"):
+        manager.add_member(room.room_id, username)
+    manager.set_member_role(room.room_id, "alice", "carol", "moderator")
+    ids = [
+        manager.add_message(room.room_id, "bob", f"message {n}")["message_id"]
+        for n in range(count)
+    ]
+    return room.room_id, ids
+
+
+async def _send(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+class TestPinMessages:
+    """Tests for a room's pinned messages."""
+
+    def test_pin_and_unpin(self):
+        """Test permissions, ordering, repeats and unknown messages."""
+        manager = RoomStateManager("node1")
+        room_id, (first, second) = _room(manager, 2)
+
+        assert manager.pin_message(room_id, "carol", second) == [second]
+        assert manager.pin_message(room_id, "alice", first) == [second, first]
+        assert manager.pin_message(room_id, "alice", first) == [second, first]
+        for username, message_id, code in (
+            ("bob", first, "NOT_ALLOWED"),
+            ("alice", "missing", "MESSAGE_NOT_FOUND"),
+        ):
+            with pytest.raises(PinError) as error:
+                manager.pin_message(room_id, username, message_id)
+            assert error.value.error_code == code
+        with pytest.raises(PinError) as error:
+            manager.pin_message("missing", "alice", first)
+        assert error.value.error_code == "ROOM_NOT_FOUND"
+
+        assert manager.pin_message(room_id, "carol", second, False) == [first]
+        assert manager.get_pinned(room_id) == [first]
+        assert manager.get_history(room_id, "bob")["pinned"] == [first]
+
+    def test_limit(self):
+        """Test that a room can't pin more than the limit."""
+        assert update_pins(["a", "b"], "b", True, limit=2) == ["a", "b"]
+        assert update_pins(["a", "b"], "a", False, limit=2) == ["b"]
+        with pytest.raises(PinError) as error:
+            update_pins(["a", "b"], "c", True, limit=2)
+        assert error.value.error_code == "PIN_LIMIT"
+
+    def test_deleting_unpins_and_recovery(self):
+        """Test that deleted messages are unpinned, and pins are recovered."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id, (first, second) = _room(manager, 2)
+        manager.pin_message(room_id, "alice", first)
+        manager.pin_message(room_id, "alice", second)
+
+        manager.edit_message(room_id, "bob", first, "delete")
+        with pytest.raises(PinError) as error:
+            manager.pin_message(room_id, "alice", first)
+        recovered = RoomStateManager("node1", storage)
+        recovered.recover_rooms()
+
+        assert error.value.error_code == "MESSAGE_DELETED"
+        assert manager.get_pinned(room_id) == [second]
+        assert recovered.get_pinned(room_id) == [second]
+
+
+class TestReplicaPins:
+    """Tests for pins on replicas of remote rooms."""
+
+    def test_replicas_carry_pins(self):
+        """Test join info, pin and delete events, and failover state."""
+        admin = RoomStateManager("node1")
+        room_id, (first, second) = _room(admin, 2)
+        admin.pin_message(room_id, "alice", first)
+        room = admin.get_room(room_id)
+        replicas = ReplicaStore()
+        xmlrpc_server = XMLRPCServer(admin, "localhost", 0, "http://node1")
+        replicas.update_from_join(
+            xmlrpc_server._room_info(room), room.messages, "bob"
+        )
+
+        assert replicas.get(room_id).pinned == [first]
+        replicas.record_pins(room_id, [first, second])
+        replicas.record_edit(room_id, create_edit(first, DELETE, "bob"))
+        replica = replicas.get(room_id)
+        state = merge_replicas(
+            [dict(replica.to_dict(), node_id="node2")], 100
+        )
+
+        assert replica.pinned == [second]
+        assert state["pinned"] == [second]
+        assert admin.restore_room(**dict(state, room_id="r2")).pinned == [
+            second
+        ]
+
+
+class TestPinCommands:
+    """Tests for the pin_message and unpin_message commands."""
+
+    @pytest.mark.asyncio
+    async def test_commands_on_admin_node(self):
+        """Test the success responses, the events and an error."""
+        manager = RoomStateManager("node1")
+        room_id, (first,) = _room(manager, 1)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        moderator, member = MockWebSocket(), MockWebSocket()
+        ws_server.register_client_room_membership(member, room_id, "bob")
+        request = {"room_id": room_id, "message_id": first}
+
+        await _send(
+            ws_server, moderator, "pin_message", dict(request, username="carol")
+        )
+        await _send(
+            ws_server, member, "unpin_message", dict(request, username="bob")
+        )
+        await _send(
+            ws_server,
+            moderator,
+            "unpin_message",
+            dict(request, username="carol"),
+        )
+
+        assert moderator.received("pin_message_success") == [
+            dict(request, pinned=[first])
+        ]
+        assert moderator.received("unpin_message_success") == [
+            dict(request, pinned=[])
+        ]
+        error = member.received("pin_error")[0]
+        assert error["request_type"] == "unpin_message"
+        assert error["error_code"] == "NOT_ALLOWED"
+        assert member.received("message_pinned")[0]["changed_by"] == "carol"
+        assert member.received("message_unpinned")[0]["pinned"] == []
+
+    @pytest.mark.asyncio
+    async def test_forwarded_to_admin_node(self):
+        """Test a pin from a node that doesn't administer the room."""
+        admin = RoomStateManager("node1")
+        room_id, (first,) = _room(admin, 1)
+        xmlrpc_server = XMLRPCServer(admin, "localhost", 0, "http://node1")
+        broadcast = MagicMock()
+        xmlrpc_server.set_broadcast_callback(broadcast)
+        ws_server = WebSocketServer(RoomStateManager("node2"), "localhost", 0)
+
+        async def call_admin(room_id, method, *args):
+            return getattr(xmlrpc_server, method)(*args)
+
+        ws_server._call_room_admin = call_admin
+        moderator = MockWebSocket()
+        await _send(
+            ws_server,
+            moderator,
+            "pin_message",
+            {"room_id": room_id, "username": "carol", "message_id": first},
+        )
+
+        assert moderator.received("pin_message_success")[0]["pinned"] == [
+            first
+        ]
+        event = broadcast.call_args[0][1]
+        assert event["type"] == "message_pinned"
+        assert event["data"]["message_id"] == first
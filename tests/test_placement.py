@@ -0,0 +1,233 @@
+"""
+Tests for Room Placement
+
+Tests for node tags and placement constraints, tags in the discovery
+handshake, moving rooms to matching nodes, and the constraints being
+kept with the room.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    PeerRegistry,
+    ReplicaStore,
+    RoomDirectory,
+    RoomFailover,
+    RoomPlacement,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.discovery import PeerDiscovery
+from src.node.failover import merge_replicas
+from src.node.placement import matches, parse_tags, validate_placement
+from src.node.snapshot import SNAPSHOT_CAPABILITY, RoomSnapshot
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+class Cluster:
+    """Nodes with tags, handing rooms to each other in-process."""
+
+    def __init__(self, tags):
+        self.servers = {}
+        self.nodes = {}
+        for node_id, node_tags in tags.items():
+            manager = RoomStateManager(node_id)
+            failover = RoomFailover(
+                node_id,
+                f"http://{node_id}",
+                manager,
+                ReplicaStore(),
+                LocalPeerRegistry(
+                    node_id,
+                    self.servers,
+                    capabilities=[SNAPSHOT_CAPABILITY],
+                    tags=tags,
+                ),
+                room_directory=RoomDirectory(node_id, f"http://{node_id}"),
+            )
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                failover.peer_registry,
+                failover=failover,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "placement": RoomPlacement(
+                    node_id, node_tags, manager, failover
+                ),
+            }
+
+    def host(self, room_id):
+        return [
+            node_id
+            for node_id, node in self.nodes.items()
+            if node["manager"].get_room(room_id)
+        ]
+
+
+class TestTags:
+    """Tests for node tags and placement constraints."""
+
+    def test_parse_and_validate(self):
+        """Test parsing node tags, checking constraints and matching."""
+        tags = parse_tags(["region=eu", "storage=persistent"])
+
+        assert tags == {"region": "eu", "storage": "persistent"}
+        for specs in (["region"], ["region=eu", "region=us"], ["a b=c"]):
+            with pytest.raises(ValueError):
+                parse_tags(specs)
+        assert validate_placement(None) == {}
+        for placement in (["region"], {"region": ""}, {"region": 1}):
+            with pytest.raises(ValueError):
+                validate_placement(placement)
+        assert matches(tags, {"region": "eu"})
+        assert matches(tags, {})
+        assert not matches(tags, {"region": "us"})
+        assert not matches({}, {"region": "eu"})
+
+    def test_tags_in_handshake(self):
+        """Test that a node learns its peer's tags from the hello."""
+        registry = PeerRegistry("node-a")
+        discovery = PeerDiscovery("node-a", "http://node-a:9090", registry, [])
+        peer = PeerDiscovery(
+            "node-b",
+            "http://node-b:9090",
+            PeerRegistry("node-b"),
+            [],
+            tags={"region": "eu"},
+        )
+
+        result = discovery.handle_hello(peer.hello_payload())
+
+        assert result["success"] is True
+        assert result["tags"] == {}
+        assert registry.get_tags("node-b") == {"region": "eu"}
+        assert registry.get_tags("node-c") == {}
+
+
+class TestPlacing:
+    """Tests for moving rooms to matching nodes."""
+
+    def test_room_moves_to_matching_node(self):
+        """Test new rooms placed on matching peers, and the rest staying."""
+        cluster = Cluster(
+            {
+                "node-a": {"region": "us"},
+                "node-b": {"region": "eu"},
+                "node-c": {"region": "eu", "storage": "persistent"},
+            }
+        )
+        node_a = cluster.nodes["node-a"]
+        placed = {}
+        for placement in ({"region": "eu"}, {"storage": "persistent"}, {}):
+            room = node_a["manager"].create_room(
+                "General", "alice", placement=placement
+            )
+            placed[room.room_id] = node_a["placement"].place_room(room.room_id)
+        eu, persistent, anywhere = placed
+
+        assert placed[eu] in ("node-b", "node-c")
+        assert cluster.host(eu) == [placed[eu]]
+        assert placed[persistent] == "node-c"
+        assert placed[anywhere] == "node-a"
+        room = cluster.nodes["node-c"]["manager"].get_room(persistent)
+        assert room.placement == {"storage": "persistent"}
+        assert not node_a["placement"].can_place({"region": "asia"})
+
+    def test_rebalance_moves_misplaced_rooms(self):
+        """Test a placement round moving the rooms this node doesn't match."""
+        cluster = Cluster({"node-a": {}, "node-b": {"region": "eu"}})
+        node_a = cluster.nodes["node-a"]
+        room_ids = [
+            node_a["manager"]
+            .create_room(f"Room {number}", "alice", placement=placement)
+            .room_id
+            for number, placement in enumerate(
+                [{"region": "eu"}] * 3 + [{}] * 2
+            )
+        ]
+
+        moved = node_a["placement"].rebalance(max_moves=2)
+        moved.update(node_a["placement"].rebalance())
+
+        assert sorted(moved) == sorted(room_ids[:3])
+        assert set(moved.values()) == {"node-b"}
+        assert [cluster.host(r) for r in room_ids[3:]] == [["node-a"]] * 2
+        assert node_a["placement"].rebalance() == {}
+
+    def test_placement_kept_with_room(self):
+        """Test constraints in snapshots and merged replicas."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room(
+            "General", "alice", placement={"region": "eu"}
+        ).room_id
+        stale = {"node_id": "node-b", **manager.get_room(room_id).to_dict()}
+        stale["placement"] = {}
+        current = {"node_id": "node-c", **manager.get_room(room_id).to_dict()}
+
+        snapshot = RoomSnapshot.from_room(manager, room_id)
+
+        assert snapshot.placement == {"region": "eu"}
+        assert merge_replicas([stale, current], 100)["placement"] == {
+            "region": "eu"
+        }
+        with pytest.raises(ValueError):
+            manager.create_room("Other", "alice", placement={"region": "?"})
+
+
+class TestCreateRoom:
+    """Tests for placement in create_room."""
+
+    @pytest.mark.asyncio
+    async def test_create_room_placed_or_refused(self):
+        """Test room_created naming the matching node, or an error."""
+        cluster = Cluster({"node-a": {}, "node-b": {"region": "eu"}})
+        node_a = cluster.nodes["node-a"]
+        ws_server = WebSocketServer(
+            node_a["manager"], "localhost", 0, placement=node_a["placement"]
+        )
+        websocket = MockWebSocket()
+
+        for placement in ({"region": "eu"}, {"region": "us"}):
+            await ws_server.process_message(
+                websocket,
+                json.dumps(
+                    {
+                        "type": "create_room",
+                        "data": {
+                            "room_name": "General",
+                            "creator_id": "alice",
+                            "placement": placement,
+                        },
+                    }
+                ),
+            )
+            if placement == {"region": "eu"}:
+                created = websocket.last()["data"]
+
+        refused = websocket.last()
+        assert created["admin_node"] == "node-b"
+        assert created["placement"] == {"region": "eu"}
+        assert cluster.host(created["room_id"]) == ["node-b"]
+        assert refused["type"] == "room_created"
+        assert refused["data"]["success"] is False
+        assert "placement" in refused["data"]["message"]
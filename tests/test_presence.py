@@ -0,0 +1,306 @@
+"""
+Tests for User Presence
+
+Tests for online/away/offline status, debouncing of presence changes,
+pushing changes to peers, and presence_update events to room members.
+"""
+
+import json
+import pytest
+
+from src.node import PeerRegistry, RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.config import ConfigError, load_config
+from src.node.presence import PresenceDirectory, push_presence_changes
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class LocalRPC:
+    """RPC client pool that calls other nodes' XML-RPC servers in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def call(self, address, method, *args, timeout=None):
+        target = self.servers.get(address)
+        if target is None:
+            raise ConnectionError("unreachable")
+        return getattr(target, method)(*args)
+
+
+def _node(node_id, servers, debounce=0):
+    address = f"http://{node_id}:9090"
+    registry = PeerRegistry(node_id)
+    registry.rpc = LocalRPC(servers)
+    manager = RoomStateManager(node_id)
+    presence = PresenceDirectory(node_id, address, debounce=debounce)
+    ws_server = WebSocketServer(manager, "localhost", 0, registry, presence=presence)
+    servers[address] = XMLRPCServer(
+        manager, "localhost", 0, address, registry, presence=presence
+    )
+    return ws_server
+
+
+async def _request(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+async def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.room_manager.add_member(room_id, username)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    await _request(ws_server, websocket, "announce_presence", {"username": username})
+    return websocket
+
+
+class TestDebounce:
+    """Tests for collecting presence changes before publishing them."""
+
+    def test_change_published_after_window(self):
+        """Test that a change is only returned once the debounce passes."""
+        directory = PresenceDirectory("node-a", debounce=2)
+        directory.set_online("alice")
+        now = directory._changed["alice"]
+
+        assert directory.take_changes(now=now + 1) == []
+        changes = directory.take_changes(now=now + 2)
+        assert [(c.username, c.status) for c in changes] == [("alice", "online")]
+        assert directory.take_changes(now=now + 10) == []
+
+    def test_only_latest_status_published(self):
+        """Test that several changes in a window publish the last status."""
+        directory = PresenceDirectory("node-a", debounce=0)
+        directory.set_online("alice")
+        directory.take_changes()
+
+        directory.set_status("alice", "away")
+        directory.set_status("alice", "online")
+        directory.set_status("alice", "away")
+
+        changes = directory.take_changes()
+        assert [c.status for c in changes] == ["away"]
+
+    def test_flapping_connection_publishes_nothing(self):
+        """Test that a reconnect within the window is not published."""
+        directory = PresenceDirectory("node-a", debounce=0)
+        directory.set_online("alice")
+        directory.take_changes()
+
+        directory.set_offline("alice")
+        directory.set_online("alice")
+
+        assert directory.take_changes() == []
+        assert directory.get_status("alice") == "online"
+
+    def test_short_visit_publishes_nothing(self):
+        """Test that a user who leaves before being published is skipped."""
+        directory = PresenceDirectory("node-a", debounce=0)
+        directory.set_online("alice")
+        directory.set_offline("alice")
+
+        assert directory.take_changes() == []
+
+
+class TestStatus:
+    """Tests for choosing between online and away."""
+
+    def test_set_status_of_local_user(self):
+        """Test that a connected user can go away and come back."""
+        directory = PresenceDirectory("node-a")
+        directory.set_online("alice")
+
+        assert directory.set_status("alice", "away") is True
+        assert directory.get_status("alice") == "away"
+        assert directory.locate("alice").online is True
+        assert directory.online_users() == ["alice"]
+
+    def test_set_status_of_remote_user(self):
+        """Test that only the user's own node sets their status."""
+        node_a = PresenceDirectory("node-a")
+        node_b = PresenceDirectory("node-b")
+        node_b.set_online("bob")
+        node_a.merge(node_b.get_entries())
+
+        assert node_a.set_status("bob", "away") is False
+        assert node_a.get_status("bob") == "online"
+
+    def test_invalid_status(self):
+        """Test that unknown statuses are rejected."""
+        directory = PresenceDirectory("node-a")
+        directory.set_online("alice")
+
+        with pytest.raises(ValueError):
+            directory.set_status("alice", "busy")
+
+    def test_unknown_user_is_offline(self):
+        """Test that users never seen are reported offline."""
+        assert PresenceDirectory("node-a").get_status("nobody") == "offline"
+
+
+class TestPropagation:
+    """Tests for pushing presence changes to peers."""
+
+    def test_away_pushed_to_peer(self):
+        """Test that a status change reaches peers without gossip."""
+        servers = {}
+        node_a = _node("node-a", servers)
+        node_b = _node("node-b", servers)
+        node_a.peer_registry.register_peer("node-b", "http://node-b:9090")
+        node_a.presence.set_online("alice")
+        node_a.presence.set_status("alice", "away")
+
+        reached = push_presence_changes(
+            node_a.presence,
+            node_a.presence.take_changes(),
+            node_a.peer_registry,
+        )
+
+        assert reached == ["node-b"]
+        assert node_b.presence.get_status("alice") == "away"
+        assert node_b.presence.locate("alice").node_id == "node-a"
+
+    def test_learned_changes_not_pushed_again(self):
+        """Test that a node only pushes changes to its own users."""
+        servers = {}
+        node_a = _node("node-a", servers)
+        node_b = _node("node-b", servers)
+        node_b.peer_registry.register_peer("node-a", "http://node-a:9090")
+        node_a.presence.set_online("alice")
+        servers["http://node-b:9090"].receive_presence_update(
+            node_a.presence.get_entries()
+        )
+
+        reached = push_presence_changes(
+            node_b.presence,
+            node_b.presence.take_changes(),
+            node_b.peer_registry,
+        )
+
+        assert reached == []
+
+    def test_unreachable_peer_skipped(self):
+        """Test that a failed push doesn't stop pushes to other peers."""
+        servers = {}
+        node_a = _node("node-a", servers)
+        _node("node-b", servers)
+        node_a.peer_registry.register_peer("node-c", "http://node-c:9090")
+        node_a.peer_registry.register_peer("node-b", "http://node-b:9090")
+        node_a.presence.set_online("alice")
+
+        reached = push_presence_changes(
+            node_a.presence,
+            node_a.presence.take_changes(),
+            node_a.peer_registry,
+        )
+
+        assert reached == ["node-b"]
+
+
+class TestClientEvents:
+    """Tests for presence requests and events over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_room_members_told_about_away(self):
+        """Test that members of a room get presence_update events."""
+        ws_server = _node("node-a", {})
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = await _join(ws_server, room.room_id, "alice")
+        bob = await _join(ws_server, room.room_id, "bob")
+        ws_server.presence.take_changes()
+
+        await _request(
+            ws_server, alice, "set_status", {"username": "alice", "status": "away"}
+        )
+        sent = await ws_server.publish_presence_changes(
+            ws_server.presence.take_changes()
+        )
+
+        assert alice.received("status_updated")[0]["status"] == "away"
+        assert sent == 1
+        updates = bob.received("presence_update")
+        assert updates[0]["username"] == "alice"
+        assert updates[0]["status"] == "away"
+        assert updates[0]["room_id"] == room.room_id
+        assert alice.received("presence_update") == []
+
+    @pytest.mark.asyncio
+    async def test_non_members_not_told(self):
+        """Test that clients in other rooms get no events."""
+        ws_server = _node("node-a", {})
+        general = ws_server.room_manager.create_room("general", "alice")
+        other = ws_server.room_manager.create_room("other", "carol")
+        await _join(ws_server, general.room_id, "alice")
+        carol = await _join(ws_server, other.room_id, "carol")
+        ws_server.presence.take_changes()
+
+        ws_server.presence.set_status("alice", "away")
+        await ws_server.publish_presence_changes(ws_server.presence.take_changes())
+
+        assert carol.received("presence_update") == []
+
+    @pytest.mark.asyncio
+    async def test_get_presence_of_room(self):
+        """Test that a room's member statuses can be requested."""
+        ws_server = _node("node-a", {})
+        room = ws_server.room_manager.create_room("general", "alice")
+        ws_server.room_manager.add_member(room.room_id, "dave")
+        alice = await _join(ws_server, room.room_id, "alice")
+        await _join(ws_server, room.room_id, "bob")
+        ws_server.presence.set_status("bob", "away")
+
+        await _request(ws_server, alice, "get_presence", {"room_id": room.room_id})
+
+        users = alice.received("presence")[0]["users"]
+        assert users == {"alice": "online", "bob": "away", "dave": "offline"}
+
+    @pytest.mark.asyncio
+    async def test_invalid_status_rejected(self):
+        """Test that set_status only accepts online or away."""
+        ws_server = _node("node-a", {})
+        websocket = MockWebSocket()
+        ws_server.connections.register(websocket)
+
+        await _request(
+            ws_server,
+            websocket,
+            "set_status",
+            {"username": "alice", "status": "offline"},
+        )
+
+        assert websocket.received("status_error")
+        assert ws_server.presence.locate("alice") is None
+
+
+class TestConfig:
+    """Tests for the presence debounce setting."""
+
+    def test_debounce_from_env(self):
+        """Test that PRESENCE_DEBOUNCE is read from the environment."""
+        config = load_config(environ={"PRESENCE_DEBOUNCE": "0.5"})
+
+        assert config.presence_debounce == 0.5
+
+    def test_negative_debounce_rejected(self):
+        """Test that a negative debounce is reported."""
+        with pytest.raises(ConfigError) as exc_info:
+            load_config(environ={"PRESENCE_DEBOUNCE": "-1"})
+
+        assert "presence_debounce" in str(exc_info.value)
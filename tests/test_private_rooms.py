@@ -0,0 +1,426 @@
+"""
+Tests for Private Rooms and Invitations
+
+Tests for hiding private rooms from listings and discovery, creating,
+revoking and redeeming invites, joining by invite across nodes, and
+keeping rooms private through handoff and replication.
+"""
+
+import json
+import pytest
+from unittest.mock import patch
+
+from src.node import (
+    RoomStateManager,
+    RoomDirectory,
+    WebSocketServer,
+    XMLRPCServer,
+    ReplicaStore,
+)
+from src.node.invites import InviteError, parse_invite_token
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def types(self):
+        return [json.loads(m)["type"] for m in self.sent_messages]
+
+
+def _request(message_type, **data):
+    return json.dumps({"type": message_type, "data": data})
+
+
+def _private_room(manager, creator="alice"):
+    room = manager.create_room("Secret", creator, private=True)
+    manager.add_member(room.room_id, creator)
+    return room
+
+
+class TestInvites:
+    """Tests for creating, revoking and redeeming invites."""
+
+    def test_member_creates_invite(self):
+        """Test that a member gets a token naming the room."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+
+        invite = manager.create_invite(room.room_id, "alice", "bob")
+
+        assert parse_invite_token(invite.token) == room.room_id
+        assert invite.inviter == "alice"
+        assert invite.invitee == "bob"
+
+    def test_non_member_cannot_invite(self):
+        """Test that outsiders can't create invites."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+
+        with pytest.raises(InviteError) as exc_info:
+            manager.create_invite(room.room_id, "mallory")
+
+        assert exc_info.value.error_code == "NOT_A_MEMBER"
+
+    def test_public_room_has_no_invites(self):
+        """Test that invites are only for private rooms."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("Lobby", "alice")
+
+        with pytest.raises(InviteError) as exc_info:
+            manager.create_invite(room.room_id, "alice")
+
+        assert exc_info.value.error_code == "ROOM_NOT_PRIVATE"
+
+    def test_invite_is_single_use(self):
+        """Test that a redeemed invite can't be used again."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        invite = manager.create_invite(room.room_id, "alice")
+
+        manager.redeem_invite(room.room_id, invite.token, "bob")
+
+        with pytest.raises(InviteError) as exc_info:
+            manager.redeem_invite(room.room_id, invite.token, "carol")
+        assert exc_info.value.error_code == "INVITE_NOT_FOUND"
+
+    def test_invite_for_other_user(self):
+        """Test that an invite restricted to one user rejects others."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        invite = manager.create_invite(room.room_id, "alice", "bob")
+
+        with pytest.raises(InviteError) as exc_info:
+            manager.redeem_invite(room.room_id, invite.token, "carol")
+
+        assert exc_info.value.error_code == "INVITE_NOT_FOR_USER"
+
+    def test_expired_invite(self):
+        """Test that an expired invite is rejected."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        invite = manager.create_invite(room.room_id, "alice", ttl=-1)
+
+        with pytest.raises(InviteError) as exc_info:
+            manager.redeem_invite(room.room_id, invite.token, "bob")
+
+        assert exc_info.value.error_code == "INVITE_EXPIRED"
+
+    def test_revoke_by_inviter_or_creator_only(self):
+        """Test who may revoke an invite."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        manager.add_member(room.room_id, "bob")
+        invite = manager.create_invite(room.room_id, "bob")
+        other = manager.create_invite(room.room_id, "bob")
+        manager.add_member(room.room_id, "carol")
+
+        with pytest.raises(InviteError) as exc_info:
+            manager.revoke_invite(room.room_id, invite.token, "carol")
+        assert exc_info.value.error_code == "NOT_ALLOWED"
+
+        manager.revoke_invite(room.room_id, invite.token, "bob")
+        manager.revoke_invite(room.room_id, other.token, "alice")
+        assert manager.list_invites(room.room_id) == []
+
+    def test_malformed_token(self):
+        """Test that tokens without a room ID are rejected."""
+        with pytest.raises(InviteError):
+            parse_invite_token("garbage")
+
+
+class TestDiscovery:
+    """Tests for hiding private rooms."""
+
+    def test_private_room_not_listed(self):
+        """Test that private rooms are left out of every listing."""
+        manager = RoomStateManager("node-a")
+        manager.create_room("Lobby", "alice")
+        _private_room(manager)
+        xmlrpc_server = XMLRPCServer(
+            manager, "localhost", 0, "http://node-a:9090"
+        )
+        directory = RoomDirectory("node-a", "http://node-a:9090")
+        directory.update_local(manager.list_rooms())
+
+        hosted = [room["room_name"] for room in xmlrpc_server.get_hosted_rooms()]
+        listed = [room["room_name"] for room in directory.list_rooms()]
+
+        assert hosted == ["Lobby"]
+        assert listed == ["Lobby"]
+        assert len(manager.list_rooms()) == 2
+
+    @pytest.mark.asyncio
+    async def test_list_rooms_hides_private_room(self):
+        """Test that list_rooms doesn't show private rooms to clients."""
+        manager = RoomStateManager("node-a")
+        _private_room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        ws = MockWebSocket()
+
+        await ws_server.process_message(ws, _request("list_rooms"))
+
+        assert ws.last()["data"]["rooms"] == []
+
+    def test_directory_keeps_private_entry_for_routing(self):
+        """Test that peers can still find a private room's admin."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(manager.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+
+        directory_b.merge(directory_a.get_entries())
+
+        assert directory_b.get(room.room_id).node_address == (
+            "http://node-a:9090"
+        )
+        assert directory_b.list_rooms() == []
+
+
+class TestLocalJoin:
+    """Tests for joining a private room hosted on the client's node."""
+
+    @pytest.mark.asyncio
+    async def test_join_without_invite_rejected(self):
+        """Test that join_room needs an invite for a private room."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        ws = MockWebSocket()
+
+        await ws_server.process_message(
+            ws, _request("join_room", room_id=room.room_id, username="bob")
+        )
+
+        assert ws.last()["type"] == "join_room_error"
+        assert ws.last()["data"]["error_code"] == "INVITE_REQUIRED"
+
+    @pytest.mark.asyncio
+    async def test_creator_joins_without_invite(self):
+        """Test that the creator can join their private room."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("Secret", "alice", private=True)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        ws = MockWebSocket()
+
+        await ws_server.process_message(
+            ws, _request("join_room", room_id=room.room_id, username="alice")
+        )
+
+        assert ws.last()["type"] == "join_room_success"
+        assert ws.last()["data"]["private"] is True
+
+    @pytest.mark.asyncio
+    async def test_invite_and_join_flow(self):
+        """Test creating an invite and joining with it."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice, bob = MockWebSocket(), MockWebSocket()
+
+        await ws_server.process_message(
+            alice,
+            _request(
+                "create_invite",
+                room_id=room.room_id,
+                username="alice",
+                invitee="bob",
+            ),
+        )
+        created = alice.last()
+        token = created["data"]["invite_token"]
+        await ws_server.process_message(
+            bob, _request("join_by_invite", invite_token=token, username="bob")
+        )
+
+        assert created["type"] == "invite_created"
+        assert created["data"]["invitee"] == "bob"
+        assert bob.last()["type"] == "join_room_success"
+        assert "bob" in manager.get_members(room.room_id)
+
+    @pytest.mark.asyncio
+    async def test_revoked_invite_cannot_be_used(self):
+        """Test that revoke_invite stops the invite from working."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        invite = manager.create_invite(room.room_id, "alice")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice, bob = MockWebSocket(), MockWebSocket()
+
+        await ws_server.process_message(
+            alice,
+            _request(
+                "revoke_invite", invite_token=invite.token, username="alice"
+            ),
+        )
+        await ws_server.process_message(
+            bob,
+            _request(
+                "join_by_invite", invite_token=invite.token, username="bob"
+            ),
+        )
+
+        assert alice.last()["type"] == "invite_revoked"
+        assert bob.last()["data"]["error_code"] == "INVITE_NOT_FOUND"
+
+    @pytest.mark.asyncio
+    async def test_create_invite_error(self):
+        """Test that a failed create_invite gets an invite_error."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        ws = MockWebSocket()
+
+        await ws_server.process_message(
+            ws,
+            _request("create_invite", room_id=room.room_id, username="eve"),
+        )
+
+        assert ws.last()["type"] == "invite_error"
+        assert ws.last()["data"]["request_type"] == "create_invite"
+        assert ws.last()["data"]["error_code"] == "NOT_A_MEMBER"
+
+
+class TwoNodes:
+    """Node node-a administering a private room, with client node node-b."""
+
+    def __init__(self):
+        self.admin = RoomStateManager("node-a")
+        self.room = _private_room(self.admin)
+        self.admin_rpc = XMLRPCServer(
+            self.admin, "localhost", 0, "http://node-a:9090"
+        )
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(self.admin.list_rooms())
+
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        self.replica_store = ReplicaStore()
+        self.ws_server = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+            replica_store=self.replica_store,
+        )
+
+    def proxy(self, address, allow_none=True):
+        assert address == "http://node-a:9090"
+        return self.admin_rpc
+
+
+class TestCrossNode:
+    """Tests for invite commands forwarded to the admin node."""
+
+    @pytest.mark.asyncio
+    async def test_remote_invite_and_join(self):
+        """Test inviting and joining when the admin is another node."""
+        nodes = TwoNodes()
+        nodes.admin.add_member(nodes.room.room_id, "carol", "node-b")
+        carol, dave = MockWebSocket(), MockWebSocket()
+
+        with patch("src.node.websocket_server.ServerProxy", nodes.proxy):
+            await nodes.ws_server.process_message(
+                carol,
+                _request(
+                    "create_invite",
+                    room_id=nodes.room.room_id,
+                    username="carol",
+                ),
+            )
+            token = carol.last()["data"]["invite_token"]
+            await nodes.ws_server.process_message(
+                dave,
+                _request("join_by_invite", invite_token=token, username="dave"),
+            )
+
+        assert carol.last()["type"] == "invite_created"
+        assert dave.types()[0] == "join_room_success"
+        member = nodes.admin.get_member_info(nodes.room.room_id, "dave")
+        assert member.node_id == "node-b"
+        assert nodes.replica_store.get(nodes.room.room_id).private is True
+
+    @pytest.mark.asyncio
+    async def test_remote_join_without_invite_rejected(self):
+        """Test that the admin also enforces invites for remote joins."""
+        nodes = TwoNodes()
+        ws = MockWebSocket()
+
+        with patch("src.node.websocket_server.ServerProxy", nodes.proxy):
+            await nodes.ws_server.process_message(
+                ws,
+                _request(
+                    "join_room", room_id=nodes.room.room_id, username="dave"
+                ),
+            )
+
+        assert ws.last()["data"]["error_code"] == "INVITE_REQUIRED"
+
+    @pytest.mark.asyncio
+    async def test_remote_revoke(self):
+        """Test revoking an invite held by a remote admin."""
+        nodes = TwoNodes()
+        invite = nodes.admin.create_invite(nodes.room.room_id, "alice")
+        ws = MockWebSocket()
+
+        with patch("src.node.websocket_server.ServerProxy", nodes.proxy):
+            await nodes.ws_server.process_message(
+                ws,
+                _request(
+                    "revoke_invite", invite_token=invite.token, username="alice"
+                ),
+            )
+
+        assert ws.last()["type"] == "invite_revoked"
+        assert nodes.admin.list_invites(nodes.room.room_id) == []
+
+
+class TestPrivacyPreserved:
+    """Tests for keeping rooms private when they move between nodes."""
+
+    def test_restore_keeps_private_and_invites(self):
+        """Test that a handed-off room stays private with its invites."""
+        manager = RoomStateManager("node-a")
+        room = _private_room(manager)
+        invite = manager.create_invite(room.room_id, "alice")
+        new_admin = RoomStateManager("node-b")
+
+        restored = new_admin.restore_room(
+            room_id=room.room_id,
+            room_name=room.room_name,
+            creator_id=room.creator_id,
+            members={"alice": "node-a"},
+            messages=[],
+            message_counter=0,
+            vector_clock={},
+            private=True,
+            invites=manager.list_invites(room.room_id),
+        )
+
+        assert restored.private is True
+        new_admin.redeem_invite(room.room_id, invite.token, "bob")
+
+    def test_wal_recovery_keeps_private(self, tmp_path):
+        """Test that a recovered room is still private."""
+        from src.node import MessageLog
+
+        log = MessageLog(str(tmp_path))
+        room = RoomStateManager("node-a", log).create_room(
+            "Secret", "alice", private=True
+        )
+        log.close()
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        assert recovered.get_room(room.room_id).private is True
@@ -0,0 +1,252 @@
+"""
+Tests for User Profiles
+
+Tests for changing and validating profiles, last-writer-wins merging on
+HLC timestamps, gossip between registries, and the update_profile and
+get_profile commands with profile_updated events on this and other nodes.
+"""
+
+import asyncio
+import json
+
+import pytest
+
+from src.node import (
+    ProfileError,
+    ProfileRegistry,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.clock import HybridLogicalClock
+from src.node.profiles import profile_gossip_round
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _registry(node_id, now=100.0):
+    return ProfileRegistry(HybridLogicalClock(node_id, lambda: now))
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestProfileRegistry:
+    """Tests for changing and merging profiles."""
+
+    def test_update_keeps_other_fields(self):
+        """Test that fields left out of an update keep their values."""
+        profiles = _registry("node-a")
+
+        first = profiles.update("bob", {"display_name": "Bob", "bio": "hi"})
+        second = profiles.update("bob", {"bio": ""})
+
+        assert second.display_name == "Bob"
+        assert second.bio == ""
+        assert second.hlc > first.hlc
+        assert profiles.get("bob") == second
+        assert profiles.get("carol") is None
+
+    def test_invalid_fields_rejected(self):
+        """Test that bad values and unknown fields change nothing."""
+        profiles = _registry("node-a")
+
+        for fields in (
+            {"display_name": "x" * 65},
+            {"avatar_url": "ftp://example.com/a.png"},
+            {"avatar_hash": "not-hex"},
+            {"bio": 5},
+            {"email": "bob@example.com"},
+        ):
+            with pytest.raises(ProfileError) as invalid:
+                profiles.update("bob", fields)
+            assert invalid.value.error_code == "INVALID_PROFILE"
+
+        assert profiles.get("bob") is None
+
+    def test_latest_timestamp_wins(self):
+        """Test that merging keeps the profile with the highest HLC."""
+        older = _registry("node-a", now=100.0)
+        newer = _registry("node-b", now=200.0)
+        stale = older.update("bob", {"display_name": "Old"}).to_dict()
+        fresh = newer.update("bob", {"display_name": "New"}).to_dict()
+        adopted = []
+        older.subscribe(adopted.extend)
+
+        assert [p.display_name for p in older.merge([fresh])] == ["New"]
+        assert newer.merge([stale]) == []
+        assert older.merge([fresh]) == []
+
+        assert older.get("bob").display_name == "New"
+        assert newer.get("bob").display_name == "New"
+        assert [p.username for p in adopted] == ["bob"]
+        # Later local changes are stamped after the adopted profile
+        assert older.update("bob", {"bio": "again"}).hlc > fresh["hlc"]
+
+    def test_gossip_converges(self):
+        """Test that a gossip round exchanges profiles both ways."""
+        profiles_a = _registry("node-a")
+        profiles_b = _registry("node-b")
+        profiles_a.update("alice", {"display_name": "Alice"})
+        profiles_b.update("bob", {"display_name": "Bob"})
+        rpc_b = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b:9090",
+            profiles=profiles_b,
+        )
+
+        reached = profile_gossip_round(
+            profiles_a, LocalPeerRegistry(servers={"node-b": rpc_b})
+        )
+
+        assert reached == ["node-b"]
+        assert profiles_a.get("bob").display_name == "Bob"
+        assert profiles_b.get("alice").display_name == "Alice"
+
+
+class TestProfileCommands:
+    """Tests for update_profile and get_profile over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_update_announced_to_room_members(self):
+        """Test that clients sharing rooms get one profile_updated event."""
+        manager = RoomStateManager("node-a")
+        general = manager.create_room("general", "alice").room_id
+        random = manager.create_room("random", "alice").room_id
+        for room_id in (general, random):
+            manager.add_member(room_id, "alice")
+            manager.add_member(room_id, "bob")
+        other = manager.create_room("other", "carol").room_id
+        manager.add_member(other, "carol")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        bob = _join(ws_server, general, "bob")
+        ws_server.register_client_room_membership(bob, random, "bob")
+        carol = _join(ws_server, other, "carol")
+        alice = _join(ws_server, general, "alice")
+
+        response = await _request(
+            ws_server,
+            alice,
+            "update_profile",
+            username="alice",
+            display_name="Alice",
+            avatar_url="https://example.com/alice.png",
+        )
+
+        assert response["type"] == "update_profile_success"
+        assert response["data"]["display_name"] == "Alice"
+        events = bob.received("profile_updated")
+        assert len(events) == 1
+        assert events[0]["username"] == "alice"
+        assert events[0]["avatar_url"] == "https://example.com/alice.png"
+        assert carol.received("profile_updated") == []
+        assert alice.received("profile_updated") == []
+
+    @pytest.mark.asyncio
+    async def test_invalid_update_rejected(self):
+        """Test that an invalid profile gets profile_error."""
+        manager = RoomStateManager("node-a")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        websocket = MockWebSocket()
+        ws_server.connections.register(websocket)
+
+        response = await _request(
+            ws_server,
+            websocket,
+            "update_profile",
+            username="alice",
+            avatar_hash="xyz",
+        )
+
+        assert response["type"] == "profile_error"
+        assert response["data"]["request_type"] == "update_profile"
+        assert response["data"]["error_code"] == "INVALID_PROFILE"
+
+    @pytest.mark.asyncio
+    async def test_get_profiles_of_room(self):
+        """Test that get_profile returns every member's profile."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("general", "alice").room_id
+        manager.add_member(room_id, "alice")
+        manager.add_member(room_id, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        ws_server.profiles.update("alice", {"bio": "hello"})
+
+        response = await _request(
+            ws_server,
+            _join(ws_server, room_id, "bob"),
+            "get_profile",
+            room_id=room_id,
+        )
+
+        assert response["type"] == "profiles"
+        profiles = response["data"]["profiles"]
+        assert profiles["alice"]["bio"] == "hello"
+        assert profiles["bob"] is None
+
+    @pytest.mark.asyncio
+    async def test_update_reaches_clients_on_peers(self):
+        """Test that a change is pushed to peers and their room clients."""
+        manager_a = RoomStateManager("node-a")
+        manager_b = RoomStateManager("node-b")
+        room_id = manager_b.create_room("general", "bob").room_id
+        manager_b.add_member(room_id, "alice")
+        manager_b.add_member(room_id, "bob")
+        profiles_b = ProfileRegistry(manager_b.clock)
+        ws_b = WebSocketServer(manager_b, "localhost", 0, profiles=profiles_b)
+        rpc_b = XMLRPCServer(
+            manager_b,
+            "localhost",
+            0,
+            "http://node-b:9090",
+            profiles=profiles_b,
+        )
+        bob = _join(ws_b, room_id, "bob")
+        ws_a = WebSocketServer(
+            manager_a,
+            "localhost",
+            0,
+            peer_registry=LocalPeerRegistry(servers={"node-b": rpc_b}),
+        )
+        alice = MockWebSocket()
+        ws_a.connections.register(alice)
+
+        await _request(
+            ws_a, alice, "update_profile", username="alice", bio="on a"
+        )
+        await asyncio.sleep(0)
+
+        assert profiles_b.get("alice").bio == "on a"
+        assert [e["bio"] for e in bob.received("profile_updated")] == ["on a"]
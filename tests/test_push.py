@@ -0,0 +1,303 @@
+"""
+Tests for Push Notifications
+
+Tests for registering push tokens and replicating them last-writer-wins,
+queuing, merging and batching notifications, sending them to a push
+gateway, and notifying offline room members and recipients of buffered
+direct messages.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    Notifier,
+    PushDispatcher,
+    PushError,
+    PushGatewayNotifier,
+    PushTokenRegistry,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.clock import HybridLogicalClock
+from src.node.push import preview
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class RecordingNotifier(Notifier):
+    """Notifier keeping the batches it was given, failing when told to."""
+
+    def __init__(self, failures=0):
+        self.batches = []
+        self.failures = failures
+
+    def send(self, notifications):
+        if self.failures:
+            self.failures -= 1
+            raise OSError("gateway down")
+        self.batches.append(notifications)
+
+
+def _registry(node_id="node1"):
+    return PushTokenRegistry(HybridLogicalClock(node_id))
+
+
+async def _send(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+class TestPushTokenRegistry:
+    """Tests for registering and replicating push tokens."""
+
+    def test_register_and_unregister(self):
+        """Test validation, the limit and moving a token to another user."""
+        tokens = PushTokenRegistry(HybridLogicalClock("node1"), max_tokens=2)
+        tokens.register("alice", "t1", "fcm")
+        tokens.register("alice", "t2", "apns")
+        tokens.register("alice", "t2", "apns")
+        for token, platform, code in (
+            ("t3", "fcm", "TOO_MANY_TOKENS"),
+            ("", "fcm", "INVALID_TOKEN"),
+            ("t1", "sms", "INVALID_PLATFORM"),
+        ):
+            with pytest.raises(PushError) as error:
+                tokens.register("alice", token, platform)
+            assert error.value.error_code == code
+
+        changed = tokens.register("bob", "t1", "fcm")
+
+        assert [(r.username, r.removed) for r in changed] == [
+            ("bob", False),
+            ("alice", True),
+        ]
+        assert [r.token for r in tokens.tokens_for("alice")] == ["t2"]
+        assert tokens.unregister("alice", "t2").removed is True
+        assert tokens.unregister("alice", "t2") is None
+        assert tokens.tokens_for("alice") == []
+
+    def test_merge_keeps_newest_record(self):
+        """Test that removals win over older registrations and vice versa."""
+        node1, node2 = _registry("node1"), _registry("node2")
+        node1.register("alice", "t1", "fcm")
+        node2.merge(node1.get_entries())
+        node2.unregister("alice", "t1")
+
+        assert node1.merge(node2.get_entries()) == 1
+        assert node1.tokens_for("alice") == []
+        assert node2.merge(node1.get_entries()) == 0
+        node1.register("alice", "t1", "fcm")
+        node2.merge(node1.get_entries() + [{"username": "alice"}])
+        assert [r.token for r in node2.tokens_for("alice")] == ["t1"]
+
+    def test_xmlrpc_gossip(self):
+        """Test the exchange and push RPCs."""
+        manager = RoomStateManager("node1")
+        tokens = _registry("node2")
+        tokens.register("alice", "t1", "fcm")
+        xmlrpc_server = XMLRPCServer(
+            manager, "localhost", 0, "http://node1", push_tokens=_registry()
+        )
+        disabled = XMLRPCServer(manager, "localhost", 0, "http://node1")
+
+        assert xmlrpc_server.receive_push_tokens(tokens.get_entries()) == {
+            "success": True,
+            "updated": 1,
+        }
+        assert len(xmlrpc_server.exchange_push_tokens([])) == 1
+        assert disabled.exchange_push_tokens(tokens.get_entries()) == []
+        assert disabled.receive_push_tokens([])["error_code"] == (
+            "PUSH_UNSUPPORTED"
+        )
+
+
+class TestPushDispatcher:
+    """Tests for queuing and sending notifications."""
+
+    def test_merges_per_device_and_conversation(self):
+        """Test coalescing, batching and the queue limit."""
+        tokens = _registry()
+        tokens.register("alice", "t1", "fcm")
+        tokens.register("alice", "t2", "apns")
+        notifier = RecordingNotifier()
+        push = PushDispatcher(notifier, batch_size=2, max_queued=3)
+        devices = tokens.tokens_for("alice")
+
+        push.enqueue(devices, "r1", "bob in General", "one", {})
+        push.enqueue(devices, "r1", "bob in General", "two", {})
+        push.enqueue(devices, "r2", "bob in Random", "three", {})
+
+        assert push.pending() == 3
+        assert push.deliver() == 3
+        assert [len(batch) for batch in notifier.batches] == [2, 1]
+        sent = [n for batch in notifier.batches for n in batch]
+        assert [(n.token, n.body, n.count) for n in sent] == [
+            ("t2", "two", 2),
+            ("t1", "three", 1),
+            ("t2", "three", 1),
+        ]
+        assert push.pending() == 0
+
+    def test_failed_batches_are_retried(self):
+        """Test retries and dropping after the last attempt."""
+        tokens = _registry()
+        tokens.register("alice", "t1", "fcm")
+        push = PushDispatcher(RecordingNotifier(failures=5), max_attempts=2)
+        push.enqueue(tokens.tokens_for("alice"), "r1", "title", "hi", {})
+
+        assert push.deliver() == 0
+        assert push.pending() == 1
+        assert push.deliver() == 0
+        assert push.pending() == 0
+
+    def test_gateway_request(self):
+        """Test the body and headers POSTed to the gateway."""
+        requests = []
+
+        def post(url, body, headers, timeout):
+            requests.append((url, json.loads(body), headers))
+            return 503 if len(requests) > 1 else 202
+
+        tokens = _registry()
+        tokens.register("alice", "t1", "apns")
+        notifier = PushGatewayNotifier(
+            "https://push.example.com/send", "secret", post
+        )
+        push = PushDispatcher(notifier)
+        push.enqueue(
+            tokens.tokens_for("alice"), "r1", "bob", "hi", {"room_id": "r1"}
+        )
+        push.deliver()
+
+        url, body, headers = requests[0]
+        assert url == "https://push.example.com/send"
+        assert headers["Authorization"] == "Bearer secret"
+        assert body["notifications"] == [
+            {
+                "token": "t1",
+                "platform": "apns",
+                "title": "bob",
+                "body": "hi",
+                "count": 1,
+                "data": {"room_id": "r1"},
+            }
+        ]
+        with pytest.raises(OSError):
+            notifier.send([])
+
+    def test_preview(self):
+        """Test encrypted, attachment-only and long messages."""
+        assert preview({"content": "hi", "encryption": {"alg": "x"}}) == (
+            "New encrypted message"
+        )
+        assert preview({"content": "", "attachments": [{}]}) == (
+            "Sent an attachment"
+        )
+        assert len(preview({"content": "x" * 500})) == 100
+
+
+class TestPushCommands:
+    """Tests for the push token commands and the notifications sent."""
+
+    @pytest.mark.asyncio
+    async def test_register_and_unregister_commands(self):
+        """Test the responses and an unknown token."""
+        ws_server = WebSocketServer(RoomStateManager("node1"), "localhost", 0)
+        websocket = MockWebSocket()
+        request = {"username": "alice", "token": "t1"}
+
+        await _send(
+            ws_server,
+            websocket,
+            "register_push_token",
+            dict(request, platform="fcm"),
+        )
+        await _send(ws_server, websocket, "unregister_push_token", request)
+        await _send(ws_server, websocket, "unregister_push_token", request)
+
+        assert websocket.received("push_token_registered") == [
+            dict(request, platform="fcm", tokens=1)
+        ]
+        assert websocket.received("push_token_unregistered") == [
+            dict(request, tokens=0)
+        ]
+        error = websocket.received("push_error")[0]
+        assert error["request_type"] == "unregister_push_token"
+        assert error["error_code"] == "TOKEN_NOT_FOUND"
+
+    @pytest.mark.asyncio
+    async def test_offline_members_are_notified(self):
+        """Test room messages for offline and muted members."""
+        manager = RoomStateManager("node1")
+        room = manager.create_room("General", "alice")
+        for username in ("alice", "bob", "carol", "dave"):
+            manager.add_member(room.room_id, username)
+        push = PushDispatcher(RecordingNotifier())
+        ws_server = WebSocketServer(manager, "localhost", 0, push=push)
+        for username in ("alice", "bob", "carol"):
+            ws_server.push_tokens.register(username, f"{username}-t", "fcm")
+        online = MockWebSocket()
+        ws_server.connections.register(online)
+        ws_server.connections.set_username(online, "carol")
+        ws_server.mutes.update("bob", mute_rooms=[room.room_id])
+
+        message = manager.add_message(room.room_id, "alice", "hello")
+        await ws_server._broadcast_message_to_room(room.room_id, message)
+        assert push.pending() == 0
+        ws_server.mutes.update("bob", unmute_rooms=[room.room_id])
+        message = manager.add_message(room.room_id, "alice", "again")
+        await ws_server._broadcast_message_to_room(room.room_id, message)
+        push.deliver()
+
+        (sent,) = push.notifier.batches[0]
+        assert (sent.username, sent.title, sent.body) == (
+            "bob",
+            "alice in General",
+            "again",
+        )
+        assert sent.data["message_id"] == message["message_id"]
+
+    @pytest.mark.asyncio
+    async def test_buffered_direct_message_is_notified(self):
+        """Test a direct message to a recipient connected nowhere."""
+        push = PushDispatcher(RecordingNotifier())
+        ws_server = WebSocketServer(
+            RoomStateManager("node1"), "localhost", 0, push=push
+        )
+        ws_server.push_tokens.register("bob", "t1", "apns")
+        sender = MockWebSocket()
+        ws_server.connections.register(sender)
+
+        await _send(
+            ws_server,
+            sender,
+            "send_direct_message",
+            {"username": "alice", "recipient": "bob", "content": "hi"},
+        )
+        push.deliver()
+
+        assert sender.received("direct_message_sent")[0]["status"] == (
+            "buffered"
+        )
+        (sent,) = push.notifier.batches[0]
+        assert (sent.title, sent.body) == ("alice", "hi")
+        assert sent.data["type"] == "direct_message"
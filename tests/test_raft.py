@@ -0,0 +1,430 @@
+"""
+Tests for the Raft Room Registry
+
+Tests for leader election, committing and replicating registry commands,
+forwarding from followers, electing a new leader with the committed log,
+refusing commits without a majority, repairing diverged follower logs,
+the durable Raft state, appending to the log file and compacting the log
+into snapshots, cluster-wide unique room names on creation and
+usernames on registration, the admin compare-and-set guarding takeovers,
+and the room_registry setting.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    AuthManager,
+    RaftRoomRegistry,
+    RaftStore,
+    ReplicaStore,
+    RoomFailover,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.config import NodeConfig
+from src.node.raft import FOLLOWER, LEADER
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+class Clock:
+    """Manually advanced monotonic clock."""
+
+    def __init__(self):
+        self.now = 0.0
+
+    def __call__(self):
+        return self.now
+
+
+class Cluster:
+    """Nodes whose Raft room registries form one group."""
+
+    def __init__(
+        self, node_ids=("node-a", "node-b", "node-c"), stores=None, **options
+    ):
+        self.servers = {}
+        self.down = set()
+        self.clock = Clock()
+        self.nodes = {}
+        for node_id in node_ids:
+            registry = LocalPeerRegistry(node_id, self.servers, self.down)
+            room_registry = RaftRoomRegistry(
+                node_id,
+                f"http://{node_id}",
+                registry,
+                store=(stores or {}).get(node_id),
+                election_timeout=(1.0, 1.0),
+                clock=self.clock,
+                **options,
+            )
+            manager = RoomStateManager(node_id)
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                room_registry=room_registry,
+            )
+            self.nodes[node_id] = {
+                "registry": registry,
+                "rooms": room_registry,
+                "manager": manager,
+            }
+
+    def raft(self, node_id):
+        return self.nodes[node_id]["rooms"].raft
+
+    def elect(self, node_id):
+        """Let node_id's election timer expire first."""
+        self.clock.now += 1.0
+        self.raft(node_id).tick()
+        return self.raft(node_id)
+
+    def heartbeat(self, node_id):
+        """Send the leader's next heartbeat round."""
+        self.clock.now += 0.5
+        self.raft(node_id).tick()
+
+
+def _room(room_id, name):
+    return {"room_id": room_id, "room_name": name, "creator_id": "alice"}
+
+
+class TestElection:
+    """Tests for electing a leader."""
+
+    def test_leader_elected_by_majority(self):
+        """Test that the first candidate wins and the others follow it."""
+        cluster = Cluster()
+
+        leader = cluster.elect("node-a")
+
+        assert leader.status()["role"] == LEADER
+        assert leader.current_term == 1
+        for node_id in ("node-b", "node-c"):
+            status = cluster.raft(node_id).status()
+            assert status["role"] == FOLLOWER
+            assert status["leader_id"] == "node-a"
+            assert status["term"] == 1
+
+    def test_no_leader_without_majority(self):
+        """Test that a candidate cut off from the others doesn't win."""
+        cluster = Cluster()
+        cluster.down.add("node-c")
+
+        candidate = cluster.elect("node-c")
+
+        assert candidate.role != LEADER
+        assert cluster.raft("node-a").current_term == 0
+
+    def test_vote_refused_to_stale_log(self):
+        """Test that nodes don't vote for a candidate missing entries."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        cluster.down.add("node-c")
+        cluster.nodes["node-a"]["rooms"].register_room(
+            _room("room-1", "General")
+        )
+        cluster.down.clear()
+
+        response = cluster.raft("node-b").handle_request_vote(5, "node-c", 0, 0)
+
+        assert response == {"term": 5, "vote_granted": False}
+
+
+class TestReplication:
+    """Tests for committing and replicating commands."""
+
+    def test_command_applied_everywhere(self):
+        """Test that a committed room is registered on every node."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+
+        result = cluster.nodes["node-a"]["rooms"].register_room(
+            _room("room-1", "General")
+        )
+        cluster.heartbeat("node-a")
+
+        assert result["success"] is True
+        for node_id in ("node-a", "node-b", "node-c"):
+            room = cluster.nodes[node_id]["rooms"].get("room-1")
+            assert room["admin_node"] == "node-a"
+            assert room["node_address"] == "http://node-a"
+
+    def test_follower_forwards_to_leader(self):
+        """Test that commands submitted to a follower are committed."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+
+        result = cluster.nodes["node-c"]["rooms"].register_room(
+            _room("room-1", "General")
+        )
+
+        assert result["success"] is True
+        room = cluster.nodes["node-a"]["rooms"].get("room-1")
+        assert room["admin_node"] == "node-c"
+
+    def test_no_commit_without_majority(self):
+        """Test that a leader cut off from the majority can't commit."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        cluster.down.update(["node-b", "node-c"])
+
+        result = cluster.raft("node-a").propose({"op": "noop"}, timeout=0)
+
+        assert result["error_code"] == "TIMEOUT"
+        assert Cluster().raft("node-b").propose({"op": "noop"}) == {
+            "success": False,
+            "error": "No Raft leader is known",
+            "error_code": "NOT_LEADER",
+        }
+
+    def test_new_leader_keeps_committed_rooms(self):
+        """Test that a leader elected after a failure has the log."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        cluster.nodes["node-a"]["rooms"].register_room(
+            _room("room-1", "General")
+        )
+        cluster.down.add("node-a")
+
+        leader = cluster.elect("node-b")
+        result = cluster.nodes["node-c"]["rooms"].unregister_room("room-1")
+
+        assert leader.role == LEADER
+        assert leader.current_term == 2
+        assert result["success"] is True
+        assert cluster.nodes["node-b"]["rooms"].get("room-1") is None
+
+    def test_diverged_follower_log_replaced(self):
+        """Test that a follower's uncommitted entries are overwritten."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        cluster.down.update(["node-b", "node-c"])
+        stale = cluster.nodes["node-a"]["rooms"].raft
+        stale.propose({"op": "delete_room", "room_id": "x"}, timeout=0)
+        cluster.down.clear()
+        cluster.down.add("node-a")
+        cluster.elect("node-b")
+        cluster.nodes["node-b"]["rooms"].register_room(
+            _room("room-2", "Random")
+        )
+        cluster.down.clear()
+
+        cluster.heartbeat("node-b")
+
+        assert stale.role == FOLLOWER
+        assert [e["term"] for e in stale.log] == [1, 2, 2]
+        assert stale.commit_index == 3
+        assert cluster.nodes["node-a"]["rooms"].get("room-2") is not None
+
+    def test_state_survives_restart(self, tmp_path):
+        """Test that the term, vote and log are reloaded from disk."""
+        path = str(tmp_path / "raft.json")
+        cluster = Cluster(stores={"node-a": RaftStore(path)})
+        cluster.elect("node-a")
+        cluster.nodes["node-a"]["rooms"].register_room(
+            _room("room-1", "General")
+        )
+
+        term, voted_for, log = RaftStore(path).load()
+
+        assert (term, voted_for) == (1, "node-a")
+        assert [e["command"]["op"] for e in log] == ["noop", "create_room"]
+
+    def test_log_file_appended_and_truncated(self, tmp_path):
+        """Test entries appended to the log file and cut on conflict."""
+        path = str(tmp_path / "raft.json")
+        store = RaftStore(path)
+        store.load()
+        entries = [{"term": 1, "command": {"op": "noop", "n": n}} for n in range(3)]
+
+        store.append(entries[:2])
+        with open(f"{path}.log", "rb") as handle:
+            written = handle.read()
+        store.append(entries[2:])
+        with open(f"{path}.log", "rb") as handle:
+            assert handle.read().startswith(written)
+        store.truncate(1)
+        store.append([{"term": 2, "command": {"op": "noop"}}])
+        with open(f"{path}.log", "ab") as handle:
+            handle.write(b'{"term":2,"comm')  # torn by a crash
+
+        _, _, log = RaftStore(path).load()
+        assert [e["term"] for e in log] == [1, 2]
+        assert RaftStore(path).load()[2] == log
+
+    def test_log_compacted_into_snapshot(self, tmp_path):
+        """Test the log trimmed, lagging followers and restarts restored."""
+        path = str(tmp_path / "raft.json")
+        cluster = Cluster(stores={"node-a": RaftStore(path)}, snapshot_threshold=3)
+        cluster.elect("node-a")
+        cluster.down.add("node-c")
+        for n in range(4):
+            cluster.nodes["node-a"]["rooms"].register_room(
+                _room(f"room-{n}", f"Room {n}")
+            )
+        leader = cluster.raft("node-a")
+
+        assert leader.snapshot_index == 3
+        assert len(leader.log) == 2
+        cluster.down.clear()
+        cluster.heartbeat("node-a")
+        cluster.heartbeat("node-a")
+        lagging = cluster.nodes["node-c"]["rooms"]
+        assert lagging.raft.snapshot_index == 3
+        assert lagging.raft.commit_index == 5
+        assert len(lagging.list_rooms()) == 4
+
+        restarted = RaftRoomRegistry(
+            "node-a", "http://node-a", None, store=RaftStore(path)
+        )
+        assert restarted.raft.snapshot_index == 3
+        assert [e["command"]["op"] for e in restarted.raft.log] == [
+            "create_room",
+            "create_room",
+        ]
+        assert restarted.get("room-1") is not None
+        assert restarted.get("room-3") is None  # applied once committed
+
+
+class TestRoomRegistry:
+    """Tests for the room registry state machine and its users."""
+
+    def test_room_names_unique(self):
+        """Test that a name committed first can't be registered again."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        rooms = cluster.nodes["node-b"]["rooms"]
+
+        first = rooms.register_room(_room("room-1", "General"))
+        second = rooms.register_room(_room("room-2", "general"))
+
+        assert first["success"] is True
+        assert second["error_code"] == "ROOM_NAME_TAKEN"
+        assert [r["room_id"] for r in rooms.list_rooms()] == ["room-1"]
+
+    @pytest.mark.asyncio
+    async def test_create_room_rejected_cluster_wide(self):
+        """Test that a room named like one on another node isn't created."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        servers = {}
+        for node_id in ("node-a", "node-b"):
+            node = cluster.nodes[node_id]
+            servers[node_id] = WebSocketServer(
+                node["manager"],
+                "localhost",
+                0,
+                node["registry"],
+                room_registry=node["rooms"],
+            )
+        request = {"data": {"room_name": "General", "creator_id": "alice"}}
+        ws_a, ws_b = MockWebSocket(), MockWebSocket()
+
+        await servers["node-a"].handle_create_room(ws_a, request)
+        await servers["node-b"].handle_create_room(ws_b, request)
+
+        assert ws_a.last()["type"] == "room_created"
+        assert ws_b.last()["data"]["success"] is False
+        assert "already taken" in ws_b.last()["data"]["message"]
+        assert cluster.nodes["node-b"]["manager"].list_rooms() == []
+
+    def test_usernames_reserved_cluster_wide(self):
+        """Test registering a name taken on another node, and releasing it."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        auth = {
+            node_id: AuthManager(
+                node_id,
+                b"secret",
+                password_iterations=1,
+                usernames=cluster.nodes[node_id]["rooms"],
+            )
+            for node_id in ("node-a", "node-b")
+        }
+        rooms = cluster.nodes["node-c"]["rooms"]
+
+        assert auth["node-a"].register("Alice", "password1")["success"]
+        taken = auth["node-b"].register("alice", "password2")
+        cluster.heartbeat("node-a")
+        holder = rooms.username_holder("ALICE")
+        not_held = cluster.nodes["node-b"]["rooms"].release_username("alice")
+        auth["node-a"].delete_account("Alice", "password1")
+        cluster.down.add("node-a")
+        failed = auth["node-b"].register("alice", "password2")
+        cluster.down.clear()
+        registered = auth["node-b"].register("alice", "password2")
+        cluster.heartbeat("node-a")
+
+        assert taken["error_code"] == "USERNAME_TAKEN"
+        assert holder == "node-a"
+        assert not_held["error_code"] == "USERNAME_NOT_RESERVED"
+        assert failed["error_code"] == "RESERVATION_FAILED"
+        assert registered["success"] is True
+        assert rooms.username_holder("alice") == "node-b"
+
+    def test_takeover_needs_admin_assignment(self):
+        """Test that only the first node to replace an admin takes over."""
+        cluster = Cluster()
+        cluster.elect("node-a")
+        cluster.nodes["node-a"]["rooms"].register_room(
+            _room("room-1", "General")
+        )
+        cluster.down.add("node-a")
+        cluster.elect("node-b")
+        state = {
+            "room_id": "room-1",
+            "room_name": "General",
+            "creator_id": "alice",
+            "members": {"bob": "node-b"},
+            "messages": [],
+            "message_counter": 0,
+            "vector_clock": {},
+        }
+        takeovers = {}
+        for node_id in ("node-b", "node-c"):
+            node = cluster.nodes[node_id]
+            failover = RoomFailover(
+                node_id,
+                f"http://{node_id}",
+                node["manager"],
+                ReplicaStore(),
+                node["registry"],
+                room_registry=node["rooms"],
+            )
+            takeovers[node_id] = failover._take_over(dict(state), "node-a")
+
+        assert takeovers == {"node-b": True, "node-c": False}
+        assert cluster.nodes["node-c"]["manager"].get_room("room-1") is None
+        room = cluster.nodes["node-c"]["rooms"].get("room-1")
+        assert room["admin_node"] == "node-b"
+
+
+class TestConfig:
+    """Tests for the room_registry setting."""
+
+    def test_room_registry_mode(self):
+        """Test that only the gossip and raft registries are accepted."""
+        errors = NodeConfig(room_registry="paxos").validate()
+
+        assert any("room_registry" in error for error in errors)
+        assert NodeConfig(room_registry="raft").validate() == []
+        assert NodeConfig().room_registry == "gossip"
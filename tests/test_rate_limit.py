@@ -0,0 +1,193 @@
+"""
+Tests for Client Rate Limiting
+
+Tests for the token buckets per connection and per user, the limits per
+command type, their configuration, and the rate_limited responses sent by
+the WebSocket server.
+"""
+
+import json
+import pytest
+
+from src.node import RoomStateManager, WebSocketServer
+from src.node.config import NodeConfig
+from src.node.rate_limit import RateLimit, RateLimiter, parse_rate_limits
+
+
+class FakeClock:
+    """Clock that only moves when told to."""
+
+    def __init__(self):
+        self.now = 1000.0
+
+    def __call__(self):
+        return self.now
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def types(self):
+        return [json.loads(m)["type"] for m in self.sent_messages]
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+def _limiter(**limits):
+    clock = FakeClock()
+    return RateLimiter(limits, clock=clock), clock
+
+
+class TestTokenBuckets:
+    """Tests for counting commands against limits."""
+
+    def test_burst_then_refill(self):
+        """Test that a burst is allowed, then commands wait for the rate."""
+        limiter, clock = _limiter(send_message=RateLimit(2, 3))
+
+        results = [limiter.acquire("c1", "send_message") for _ in range(4)]
+
+        assert results[:3] == [None, None, None]
+        assert results[3] == {"limit": "connection", "retry_after": 0.5}
+        clock.now += 0.5
+        assert limiter.acquire("c1", "send_message") is None
+
+    def test_command_types_limited_separately(self):
+        """Test that each limited type has its own bucket."""
+        limiter, _ = _limiter(send_message=RateLimit(1, 1))
+
+        assert limiter.acquire("c1", "send_message") is None
+        assert limiter.acquire("c1", "send_message") is not None
+        assert limiter.acquire("c1", "list_rooms") is None
+
+    def test_other_types_share_default(self):
+        """Test that types without a limit share the "*" bucket."""
+        limiter, _ = _limiter(**{"*": RateLimit(1, 2)})
+
+        assert limiter.acquire("c1", "list_rooms") is None
+        assert limiter.acquire("c1", "get_presence") is None
+        assert limiter.acquire("c1", "no_such_type") is not None
+
+    def test_user_limit_survives_reconnect(self):
+        """Test that a new connection doesn't reset the user's bucket."""
+        limiter, _ = _limiter(send_message=RateLimit(1, 2))
+        limiter.acquire("c1", "send_message", "alice")
+        limiter.acquire("c1", "send_message", "alice")
+
+        limiter.forget_connection("c1")
+
+        assert limiter.acquire("c2", "send_message", "alice") == {
+            "limit": "user",
+            "retry_after": 1.0,
+        }
+        assert limiter.acquire("c3", "send_message", "bob") is None
+
+    def test_rejected_command_costs_nothing(self):
+        """Test that hitting one bucket's limit leaves the other's tokens."""
+        limiter, _ = _limiter(send_message=RateLimit(1, 1))
+        limiter.acquire("c1", "send_message", "alice")
+
+        assert limiter.acquire("c1", "send_message", "bob")["limit"] == "connection"
+        assert limiter.acquire("c2", "send_message", "bob") is None
+
+    def test_idle_buckets_dropped(self):
+        """Test that closed connections and refilled users are forgotten."""
+        limiter, clock = _limiter(send_message=RateLimit(1, 2))
+        limiter.acquire("c1", "send_message", "alice")
+        clock.now += 5
+
+        limiter.forget_connection("c1")
+
+        assert limiter.bucket_count() == 0
+
+
+class TestConfiguration:
+    """Tests for configuring the limits."""
+
+    def test_parse_limits(self):
+        """Test parsing COMMAND=RATE/BURST values."""
+        assert parse_rate_limits(["send_message=5/10", "*=0.5/2"]) == {
+            "send_message": RateLimit(5, 10),
+            "*": RateLimit(0.5, 2),
+        }
+        with pytest.raises(ValueError):
+            parse_rate_limits(["send_message=5"])
+        with pytest.raises(ValueError):
+            parse_rate_limits(["send_message=0/10"])
+
+    def test_config_validated(self):
+        """Test that malformed limits are reported by validate()."""
+        assert NodeConfig(rate_limits=["login=1/3"]).validate() == []
+        assert NodeConfig(rate_limits=["login"]).validate() == [
+            "rate limit 'login' must be COMMAND=RATE/BURST"
+        ]
+
+
+class TestServerRateLimiting:
+    """Tests for rate limiting client commands on the WebSocket server."""
+
+    def _server(self, **limits):
+        limiter, clock = _limiter(**limits)
+        ws_server = WebSocketServer(
+            RoomStateManager("node-a"), "localhost", 0, rate_limiter=limiter
+        )
+        return ws_server, clock
+
+    @pytest.mark.asyncio
+    async def test_rate_limited_event(self):
+        """Test that a command over its limit gets a rate_limited event."""
+        ws_server, _ = self._server(list_rooms=RateLimit(1, 2))
+        websocket = MockWebSocket()
+        ws_server.connections.register(websocket)
+        request = json.dumps({"type": "list_rooms", "data": {}})
+
+        for _ in range(3):
+            await ws_server.process_message(websocket, request)
+
+        assert websocket.types() == ["rooms_list", "rooms_list", "rate_limited"]
+        assert websocket.last()["data"] == {
+            "request_type": "list_rooms",
+            "limit": "connection",
+            "retry_after": 1.0,
+            "error": "Too many list_rooms requests",
+            "error_code": "RATE_LIMITED",
+            "category": "limit_exceeded",
+            "retryable": True,
+        }
+
+    @pytest.mark.asyncio
+    async def test_authenticated_user_limited_across_connections(self):
+        """Test that a logged-in user's connections share one limit."""
+        ws_server, _ = self._server(list_rooms=RateLimit(1, 2))
+        first, second = MockWebSocket(), MockWebSocket()
+        for websocket in (first, second):
+            ws_server.connections.register(websocket)
+            ws_server.connections.set_session(websocket, "alice", "token")
+        request = json.dumps({"type": "list_rooms", "data": {}})
+
+        await ws_server.process_message(first, request)
+        await ws_server.process_message(first, request)
+        await ws_server.process_message(second, request)
+
+        assert second.last()["type"] == "rate_limited"
+        assert second.last()["data"]["limit"] == "user"
+
+    @pytest.mark.asyncio
+    async def test_unlimited_without_limiter(self):
+        """Test that servers without a rate limiter accept every command."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        websocket = MockWebSocket()
+        ws_server.connections.register(websocket)
+        request = json.dumps({"type": "list_rooms", "data": {}})
+
+        for _ in range(50):
+            await ws_server.process_message(websocket, request)
+
+        assert "rate_limited" not in websocket.types()
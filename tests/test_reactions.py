@@ -0,0 +1,275 @@
+"""
+Tests for Emoji Reactions
+
+Tests for validating emoji, idempotent reactions aggregated per message,
+replaying reaction records from the message log, the react command over
+WebSocket and through the admin node, and reactions reaching replicas.
+"""
+
+import json
+from types import SimpleNamespace
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    ReactionError,
+    ReplicaStore,
+    RoomDirectory,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.reactions import validate_emoji
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, *members):
+    room = manager.create_room("general", "alice")
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestValidateEmoji:
+    """Tests for emoji validation."""
+
+    def test_emoji_accepted(self):
+        """Test that single and joined emoji are accepted."""
+        assert validate_emoji("👍") == (True, None)
+        assert validate_emoji("👩‍💻")[0] is True
+
+    def test_text_rejected(self):
+        """Test that text, whitespace and long sequences are rejected."""
+        assert validate_emoji("ok")[0] is False
+        assert validate_emoji("👍 ")[0] is False
+        assert validate_emoji("")[0] is False
+        assert validate_emoji("👍" * 17)[0] is False
+
+
+class TestReact:
+    """Tests for reactions in the room state."""
+
+    def test_reactions_aggregated(self):
+        """Test that reactions are grouped by emoji with sorted users."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        message = manager.add_message(room_id, "alice", "hi")
+        message_id = message["message_id"]
+
+        manager.react(room_id, "carol", message_id, "👍")
+        manager.react(room_id, "bob", message_id, "👍")
+        _, reactions = manager.react(room_id, "bob", message_id, "🎉")
+
+        assert reactions == {"👍": ["bob", "carol"], "🎉": ["bob"]}
+        stored = manager.get_messages(room_id)[0]
+        assert stored["reactions"] == reactions
+
+    def test_idempotent(self):
+        """Test that repeated adds and removes change nothing."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message_id = manager.add_message(room_id, "alice", "hi")["message_id"]
+
+        first, _ = manager.react(room_id, "bob", message_id, "👍")
+        again, reactions = manager.react(room_id, "bob", message_id, "👍")
+        assert first is not None
+        assert again is None
+        assert reactions == {"👍": ["bob"]}
+
+        removed, reactions = manager.react(
+            room_id, "bob", message_id, "👍", remove=True
+        )
+        repeated, _ = manager.react(room_id, "bob", message_id, "👍", remove=True)
+        assert removed["action"] == "remove"
+        assert repeated is None
+        assert reactions == {}
+
+    def test_rejections(self):
+        """Test that invalid emoji and non-members are refused."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message_id = manager.add_message(room_id, "alice", "hi")["message_id"]
+
+        with pytest.raises(ReactionError) as invalid:
+            manager.react(room_id, "bob", message_id, "yes")
+        with pytest.raises(ReactionError) as outsider:
+            manager.react(room_id, "mallory", message_id, "👍")
+        with pytest.raises(ReactionError) as missing:
+            manager.react(room_id, "bob", "missing", "👍")
+
+        assert invalid.value.error_code == "INVALID_EMOJI"
+        assert outsider.value.error_code == "NOT_IN_ROOM"
+        assert missing.value.error_code == "MESSAGE_NOT_FOUND"
+
+    def test_reactions_replayed_from_log(self, tmp_path):
+        """Test that reaction records survive a restart and reach history."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager, "bob")
+        message_id = manager.add_message(room_id, "alice", "hi")["message_id"]
+        manager.react(room_id, "bob", message_id, "👍")
+        manager.react(room_id, "alice", message_id, "👍")
+        manager.react(room_id, "alice", message_id, "👍", remove=True)
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        assert recovered.get_messages(room_id)[0]["reactions"] == {"👍": ["bob"]}
+        history = recovered.get_history(room_id, "bob")["messages"]
+        assert history[0]["reactions"] == {"👍": ["bob"]}
+
+
+class TestReactCommand:
+    """Tests for the react command over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_reaction_announced_to_room(self):
+        """Test that a reaction is confirmed and broadcast once."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message_id = manager.add_message(room_id, "alice", "hi")["message_id"]
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        for _ in range(2):
+            response = await _request(
+                ws_server,
+                bob,
+                "react",
+                room_id=room_id,
+                username="bob",
+                message_id=message_id,
+                emoji="👍",
+            )
+
+        assert response["type"] == "react_success"
+        assert response["data"]["changed"] is False
+        assert response["data"]["reactions"] == {"👍": ["bob"]}
+        events = alice.received("message_reaction")
+        assert len(events) == 1
+        assert events[0]["emoji"] == "👍"
+        assert events[0]["reactions"] == {"👍": ["bob"]}
+
+    @pytest.mark.asyncio
+    async def test_invalid_emoji_rejected(self):
+        """Test that a text reaction gets reaction_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        message_id = manager.add_message(room_id, "alice", "hi")["message_id"]
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            _join(ws_server, room_id, "bob"),
+            "react",
+            room_id=room_id,
+            username="bob",
+            message_id=message_id,
+            emoji="lol",
+        )
+
+        assert response["type"] == "reaction_error"
+        assert response["data"]["error_code"] == "INVALID_EMOJI"
+
+    @pytest.mark.asyncio
+    async def test_reaction_forwarded_to_admin(self):
+        """Test that a reaction in a remote room is made by its admin."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, "bob")
+        message_id = admin.add_message(room_id, "alice", "hi")["message_id"]
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            response = await _request(
+                ws_b,
+                _join(ws_b, room_id, "bob"),
+                "react",
+                room_id=room_id,
+                username="bob",
+                message_id=message_id,
+                emoji="🎉",
+            )
+
+        assert response["type"] == "react_success"
+        assert response["data"]["changed"] is True
+        assert admin.get_messages(room_id)[0]["reactions"] == {"🎉": ["bob"]}
+
+
+class TestReplicas:
+    """Tests for reactions reaching replicas on other nodes."""
+
+    def test_event_applied_to_replica(self):
+        """Test that a message_reaction event updates the local replica."""
+        store = ReplicaStore()
+        room_info = {"room_id": "r1", "room_name": "general"}
+        message = {"message_id": "m1", "sequence_number": 1, "content": "hi"}
+        store.update_from_join(room_info, [message], "bob")
+        rpc = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b:9090",
+            failover=SimpleNamespace(replica_store=store),
+        )
+        event = {
+            "room_id": "r1",
+            "message_id": "m1",
+            "emoji": "👍",
+            "username": "bob",
+            "action": "add",
+            "reactions": {"👍": ["bob"]},
+        }
+
+        rpc.receive_member_event_broadcast("r1", "message_reaction", event)
+
+        assert store.get("r1").messages[0]["reactions"] == {"👍": ["bob"]}
@@ -0,0 +1,271 @@
+"""
+Tests for Read Receipts and Unread Counts
+
+Tests for moving read positions, unread counts and "seen by" lists,
+keeping positions across restarts, handoffs and failover, and the
+mark_read and get_read_state commands locally and through the admin node.
+"""
+
+import json
+from types import SimpleNamespace
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    ReadReceiptError,
+    ReplicaStore,
+    RoomDirectory,
+    RoomSnapshot,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.failover import merge_replicas
+from src.node.read_receipts import seen_by
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, *members, messages=3):
+    room = manager.create_room("general", "alice")
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    for number in range(messages):
+        manager.add_message(room.room_id, "alice", f"message {number}")
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestReadPositions:
+    """Tests for read positions in the room state."""
+
+    def test_position_only_moves_forward(self):
+        """Test that older and repeated positions change nothing."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+
+        assert manager.mark_read(room_id, "bob", 2) is True
+        assert manager.mark_read(room_id, "bob", 1) is False
+        assert manager.mark_read(room_id, "bob", 2) is False
+        assert manager.mark_read(room_id, "bob", 99) is True
+
+        assert manager.get_read_positions(room_id) == {"bob": 3}
+
+    def test_unread_count(self):
+        """Test that the read state counts messages after the position."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        manager.mark_read(room_id, "bob", 1)
+        manager.mark_read(room_id, "carol", 3)
+
+        state = manager.get_read_state(room_id, "bob")
+
+        assert state["last_read"] == 1
+        assert state["unread_count"] == 2
+        assert state["message_counter"] == 3
+        assert seen_by(state["read_positions"], 2) == ["carol"]
+        assert seen_by(state["read_positions"], 1) == ["bob", "carol"]
+        assert manager.get_read_state(room_id, "alice")["unread_count"] == 3
+
+    def test_rejections(self):
+        """Test that non-members and bad positions are refused."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+
+        with pytest.raises(ReadReceiptError) as outsider:
+            manager.mark_read(room_id, "mallory", 1)
+        with pytest.raises(ReadReceiptError) as invalid:
+            manager.mark_read(room_id, "bob", "2")
+        with pytest.raises(ReadReceiptError) as missing:
+            manager.get_read_state("missing", "bob")
+
+        assert outsider.value.error_code == "NOT_IN_ROOM"
+        assert invalid.value.error_code == "INVALID_REQUEST"
+        assert missing.value.error_code == "ROOM_NOT_FOUND"
+
+    def test_positions_replayed_from_log(self, tmp_path):
+        """Test that read positions survive a restart."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager, "bob")
+        manager.mark_read(room_id, "bob", 1)
+        manager.mark_read(room_id, "bob", 3)
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        assert recovered.get_read_positions(room_id) == {"bob": 3}
+
+    def test_snapshot_and_failover_keep_positions(self):
+        """Test that handoffs and merged replicas keep the positions."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        manager.mark_read(room_id, "bob", 2)
+
+        snapshot = RoomSnapshot.from_room(manager, room_id)
+        restored = RoomStateManager("node-b")
+        restored.restore_room(**snapshot.restore_args())
+        base = {"room_id": room_id, "room_name": "general", "node_id": "n1"}
+        merged = merge_replicas(
+            [
+                dict(base, read_positions={"bob": 2, "carol": 5}),
+                dict(base, node_id="n2", read_positions={"bob": 3}),
+            ],
+            max_messages=10,
+        )
+
+        assert restored.get_read_positions(room_id) == {"bob": 2}
+        assert merged["read_positions"] == {"bob": 3, "carol": 5}
+
+
+class TestReadCommands:
+    """Tests for mark_read and get_read_state over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_mark_read_announced(self):
+        """Test that a new position is confirmed and broadcast once."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        for _ in range(2):
+            response = await _request(
+                ws_server,
+                bob,
+                "mark_read",
+                room_id=room_id,
+                username="bob",
+                sequence_number=2,
+            )
+
+        assert response["type"] == "mark_read_success"
+        assert response["data"]["unread_count"] == 1
+        events = alice.received("read_position_updated")
+        assert events == [
+            {
+                "room_id": room_id,
+                "username": "bob",
+                "sequence_number": 2,
+                "hlc": events[0]["hlc"],
+            }
+        ]
+
+    @pytest.mark.asyncio
+    async def test_invalid_position_rejected(self):
+        """Test that a missing sequence number gets read_state_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            _join(ws_server, room_id, "bob"),
+            "mark_read",
+            room_id=room_id,
+            username="bob",
+        )
+
+        assert response["type"] == "read_state_error"
+        assert response["data"]["request_type"] == "mark_read"
+        assert response["data"]["error_code"] == "INVALID_REQUEST"
+
+    @pytest.mark.asyncio
+    async def test_read_state_from_another_node(self):
+        """Test that a client on another node gets its state from the admin."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, "bob")
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            await _request(
+                ws_b,
+                _join(ws_b, room_id, "bob"),
+                "mark_read",
+                room_id=room_id,
+                username="bob",
+                sequence_number=1,
+            )
+            # Reconnected with a new connection
+            response = await _request(
+                ws_b,
+                _join(ws_b, room_id, "bob"),
+                "get_read_state",
+                room_id=room_id,
+                username="bob",
+            )
+
+        assert response["type"] == "read_state"
+        assert response["data"]["last_read"] == 1
+        assert response["data"]["unread_count"] == 2
+        assert admin.get_read_positions(room_id) == {"bob": 1}
+
+
+class TestReplicas:
+    """Tests for read positions reaching replicas on other nodes."""
+
+    def test_event_applied_to_replica(self):
+        """Test that a read_position_updated event updates the replica."""
+        store = ReplicaStore()
+        room_info = {"room_id": "r1", "room_name": "general"}
+        store.update_from_join(room_info, [], "bob")
+        rpc = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b:9090",
+            failover=SimpleNamespace(replica_store=store),
+        )
+        event = {"room_id": "r1", "username": "bob", "sequence_number": 4}
+
+        rpc.receive_member_event_broadcast("r1", "read_position_updated", event)
+
+        assert store.get("r1").read_positions == {"bob": 4}
@@ -0,0 +1,347 @@
+"""
+Tests for Message Acknowledgment and Delivery Receipts
+
+Tests for sender-generated message IDs, message_status acknowledgments
+from the node, and delivery receipts routed back to the sender's node.
+"""
+
+import asyncio
+import json
+import pytest
+
+from src.client import ChatClient
+from src.node import PeerRegistry, RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.receipts import ReceiptTracker
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class LocalRPC:
+    """RPC client pool that calls other nodes' XML-RPC servers in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def call(self, address, method, *args, timeout=None):
+        target = self.servers.get(address)
+        if target is None:
+            raise ConnectionError("unreachable")
+        return getattr(target, method)(*args)
+
+
+def _node(node_id, servers):
+    address = f"http://{node_id}:9090"
+    registry = PeerRegistry(node_id)
+    registry.rpc = LocalRPC(servers)
+    manager = RoomStateManager(node_id)
+    ws_server = WebSocketServer(manager, "localhost", 0, registry)
+    xmlrpc_server = XMLRPCServer(manager, "localhost", 0, address, registry)
+    xmlrpc_server.set_broadcast_callback(ws_server.broadcast_to_room_sync)
+    xmlrpc_server.set_receipt_callback(ws_server.deliver_receipt_sync)
+    servers[address] = xmlrpc_server
+    return ws_server
+
+
+def _client(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _send(ws_server, websocket, room_id, username, content, message_id=None):
+    data = {"room_id": room_id, "username": username, "content": content}
+    if message_id is not None:
+        data["message_id"] = message_id
+    await ws_server.process_message(
+        websocket, json.dumps({"type": "send_message", "data": data})
+    )
+
+
+async def _confirm(ws_server, websocket, room_id, message_id, username):
+    await ws_server.process_message(
+        websocket,
+        json.dumps(
+            {
+                "type": "message_received",
+                "data": {
+                    "room_id": room_id,
+                    "message_id": message_id,
+                    "username": username,
+                },
+            }
+        ),
+    )
+    # Let receipts scheduled by XML-RPC callbacks run
+    await asyncio.sleep(0)
+
+
+def _room(ws_server, *members):
+    room = ws_server.room_manager.create_room("general", members[0])
+    for member in members:
+        ws_server.room_manager.add_member(room.room_id, member)
+    return room.room_id
+
+
+class TestMessageIds:
+    """Tests for message IDs chosen by the sender."""
+
+    @pytest.mark.asyncio
+    async def test_sender_id_is_used(self):
+        """Test that the message keeps the ID the client generated."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice")
+        alice = _client(ws_server, room_id, "alice")
+
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+
+        assert alice.received("new_message")[0]["message_id"] == "msg-1"
+        assert alice.received("message_sent")[0]["message_id"] == "msg-1"
+
+    @pytest.mark.asyncio
+    async def test_retry_is_not_added_twice(self):
+        """Test that resending a message ID acknowledges the original."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice")
+        alice = _client(ws_server, room_id, "alice")
+
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+
+        assert len(alice.received("new_message")) == 1
+        sent = alice.received("message_sent")
+        assert [s["sequence_number"] for s in sent] == [1, 1]
+        assert len(ws_server.room_manager.get_room(room_id).messages) == 1
+
+    @pytest.mark.asyncio
+    async def test_id_of_another_sender_rejected(self):
+        """Test that a user can't reuse another user's message ID."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice", "bob")
+        alice = _client(ws_server, room_id, "alice")
+        bob = _client(ws_server, room_id, "bob")
+
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+        await _send(ws_server, bob, room_id, "bob", "hey", "msg-1")
+
+        errors = bob.received("message_error")
+        assert errors[0]["error_code"] == "DUPLICATE_MESSAGE_ID"
+
+    @pytest.mark.asyncio
+    async def test_invalid_id_rejected(self):
+        """Test that overlong message IDs are rejected."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice")
+        alice = _client(ws_server, room_id, "alice")
+
+        await _send(ws_server, alice, room_id, "alice", "hi", "x" * 65)
+
+        assert alice.received("message_error")[0]["error_code"] == "INVALID_REQUEST"
+        assert alice.received("new_message") == []
+
+    def test_forwarded_retry_is_not_added_twice(self):
+        """Test that forward_message recognises a retried message ID."""
+        servers = {}
+        ws_server = _node("node-a", servers)
+        room_id = _room(ws_server, "alice")
+        server = servers["http://node-a:9090"]
+
+        first = server.forward_message(room_id, "alice", "hi", "node-b", "", "m-1")
+        again = server.forward_message(room_id, "alice", "hi", "node-b", "", "m-1")
+
+        assert first["success"] and again["success"]
+        assert again["sequence_number"] == first["sequence_number"]
+        assert len(ws_server.room_manager.get_room(room_id).messages) == 1
+
+
+class TestAcknowledgment:
+    """Tests for the node acknowledging messages to the sender."""
+
+    @pytest.mark.asyncio
+    async def test_sent_status(self):
+        """Test that the sender gets message_status "sent"."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice")
+        alice = _client(ws_server, room_id, "alice")
+
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+
+        status = alice.received("message_status")[0]
+        assert status["message_id"] == "msg-1"
+        assert status["status"] == "sent"
+        assert status["sequence_number"] == 1
+
+    @pytest.mark.asyncio
+    async def test_no_status_for_rejected_message(self):
+        """Test that rejected messages get an error and no status."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice")
+        alice = _client(ws_server, room_id, "alice")
+
+        await _send(ws_server, alice, room_id, "alice", "", "msg-1")
+
+        assert alice.received("message_status") == []
+        assert alice.received("message_error")
+
+
+class TestDeliveryReceipts:
+    """Tests for recipients confirming receipt to the sender."""
+
+    @pytest.mark.asyncio
+    async def test_local_receipt(self):
+        """Test that a recipient on the same node produces "delivered"."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice", "bob")
+        alice = _client(ws_server, room_id, "alice")
+        bob = _client(ws_server, room_id, "bob")
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+
+        await _confirm(ws_server, bob, room_id, "msg-1", "bob")
+
+        statuses = alice.received("message_status")
+        assert [s["status"] for s in statuses] == ["sent", "delivered"]
+        assert statuses[1]["recipient"] == "bob"
+        assert bob.received("message_status") == []
+
+    @pytest.mark.asyncio
+    async def test_repeated_and_own_receipts_ignored(self):
+        """Test that each recipient is reported once, and never the sender."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice", "bob")
+        alice = _client(ws_server, room_id, "alice")
+        bob = _client(ws_server, room_id, "bob")
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+
+        await _confirm(ws_server, bob, room_id, "msg-1", "bob")
+        await _confirm(ws_server, bob, room_id, "msg-1", "bob")
+        await _confirm(ws_server, alice, room_id, "msg-1", "alice")
+
+        delivered = [
+            s for s in alice.received("message_status") if s["status"] == "delivered"
+        ]
+        assert len(delivered) == 1
+
+    @pytest.mark.asyncio
+    async def test_receipt_outside_room_ignored(self):
+        """Test that clients not in the room can't confirm its messages."""
+        ws_server = _node("node-a", {})
+        room_id = _room(ws_server, "alice", "bob")
+        alice = _client(ws_server, room_id, "alice")
+        await _send(ws_server, alice, room_id, "alice", "hi", "msg-1")
+        outsider = MockWebSocket()
+        ws_server.connections.register(outsider)
+
+        await _confirm(ws_server, outsider, room_id, "msg-1", "bob")
+
+        assert len(alice.received("message_status")) == 1
+
+    @pytest.mark.asyncio
+    async def test_receipt_routed_to_sender_node(self):
+        """Test that a receipt reaches a sender connected to another node."""
+        servers = {}
+        node_a = _node("node-a", servers)
+        node_b = _node("node-b", servers)
+        node_b.peer_registry.register_peer("node-a", "http://node-a:9090")
+        room_id = _room(node_a, "alice", "bob")
+        alice = _client(node_a, room_id, "alice")
+        bob = _client(node_b, room_id, "bob")
+        await _send(node_a, alice, room_id, "alice", "hi", "msg-1")
+        message = node_a.room_manager.find_message(room_id, "msg-1")
+        servers["http://node-b:9090"].receive_message_broadcast(room_id, message)
+        await asyncio.sleep(0)
+
+        await _confirm(node_b, bob, room_id, "msg-1", "bob")
+
+        assert bob.received("new_message")[0]["message_id"] == "msg-1"
+        delivered = alice.received("message_status")[-1]
+        assert delivered["status"] == "delivered"
+        assert delivered["recipient"] == "bob"
+
+    def test_rpc_reports_offline_sender(self):
+        """Test that deliver_receipt reports senders not connected here."""
+        servers = {}
+        _node("node-a", servers)
+
+        result = servers["http://node-a:9090"].deliver_receipt(
+            {
+                "room_id": "room-1",
+                "message_id": "msg-1",
+                "sender": "alice",
+                "recipient": "bob",
+            }
+        )
+
+        assert result["error_code"] == "SENDER_OFFLINE"
+
+    def test_tracker_forgets_oldest(self):
+        """Test that the tracker keeps at most its limit of messages."""
+        tracker = ReceiptTracker(limit=2)
+        for message_id in ("m1", "m2", "m3"):
+            tracker.track(
+                "room-1",
+                {"message_id": message_id, "username": "alice", "origin_node": "a"},
+            )
+
+        assert tracker.tracked_count() == 2
+        assert tracker.confirm("room-1", "m1", "bob") is None
+        assert tracker.confirm("room-1", "m3", "bob").sender == "alice"
+
+
+class TestChatClientReceipts:
+    """Tests for the chat client confirming receipt automatically."""
+
+    @pytest.mark.asyncio
+    async def test_confirms_messages_from_others(self):
+        """Test that send_receipts confirms other users' messages only."""
+        client = ChatClient("ws://localhost:8000")
+        websocket = MockWebSocket()
+        client._set_test_mode(mock_websocket=websocket)
+        client.set_username("bob")
+        client.set_current_room("room-1")
+        client.send_receipts = True
+        statuses = []
+        client.set_on_message_status(statuses.append)
+
+        for seq, sender in ((1, "alice"), (2, "bob")):
+            await client._process_incoming_message(
+                json.dumps(
+                    {
+                        "type": "new_message",
+                        "data": {
+                            "room_id": "room-1",
+                            "message_id": f"msg-{seq}",
+                            "username": sender,
+                            "content": "hi",
+                            "sequence_number": seq,
+                            "timestamp": "2025-11-23T10:30:15Z",
+                        },
+                    }
+                )
+            )
+        await client._process_incoming_message(
+            json.dumps(
+                {
+                    "type": "message_status",
+                    "data": {"message_id": "msg-2", "status": "sent"},
+                }
+            )
+        )
+
+        receipts = websocket.received("message_received")
+        assert [r["message_id"] for r in receipts] == ["msg-1"]
+        assert statuses[0]["status"] == "sent"
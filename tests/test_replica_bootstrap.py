@@ -0,0 +1,166 @@
+"""
+Tests for Replica Bootstrap
+
+Tests for bootstrapping followers of busy rooms with a snapshot, sending
+the live messages buffered meanwhile after it, and falling back to the
+message buffer when the snapshot can't be sent.
+"""
+
+from unittest.mock import patch
+
+from src.node import (
+    ReplicaStore,
+    ReplicationManager,
+    RoomFailover,
+    RoomStateManager,
+    XMLRPCServer,
+)
+from src.node.snapshot import (
+    REPLICA,
+    SNAPSHOT_CAPABILITY,
+    RoomSnapshot,
+    SnapshotReceiver,
+    SnapshotSender,
+)
+from tests.fakes import LocalPeerRegistry
+
+
+class Cluster:
+    """Admin node-a with a busy room and a new follower node-b."""
+
+    def __init__(self, messages=60, capabilities=(SNAPSHOT_CAPABILITY,)):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in ("node-a", "node-b"):
+            registry = LocalPeerRegistry(
+                node_id, self.servers, capabilities=capabilities
+            )
+            manager = RoomStateManager(node_id)
+            store = ReplicaStore()
+            failover = RoomFailover(
+                node_id, f"http://{node_id}", manager, store, registry
+            )
+            replication = ReplicationManager(
+                node_id,
+                manager,
+                registry,
+                1,
+                snapshots=SnapshotSender(node_id, registry),
+            )
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                failover=failover,
+                replication=replication,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "store": store,
+                "replication": replication,
+                "registry": registry,
+            }
+        self.admin = self.nodes["node-a"]
+        self.room_id = (
+            self.admin["manager"]
+            .create_room("General", "alice", durable=True)
+            .room_id
+        )
+        self.admin["manager"].add_member(self.room_id, "alice")
+        for number in range(messages):
+            self.send(f"message {number}")
+
+    def send(self, content):
+        return self.admin["manager"].add_message(
+            self.room_id, "alice", content
+        )
+
+    def replica(self):
+        return self.nodes["node-b"]["store"].get(self.room_id)
+
+
+class TestBootstrap:
+    """Tests for bootstrapping followers with a snapshot."""
+
+    def test_new_follower_gets_snapshot(self):
+        """Test a follower of a busy room installing a replica snapshot."""
+        cluster = Cluster()
+        replication = cluster.admin["replication"]
+
+        acked = replication.sync_follower(cluster.room_id, "node-b")
+
+        assert acked == 60
+        calls = cluster.admin["registry"].methods()
+        assert "begin_snapshot_transfer" in calls
+        assert "replicate_messages" not in calls
+        replica = cluster.replica()
+        assert replica.message_counter == 60
+        assert len(replica.messages) == 60
+        assert replica.durable is True
+        assert replication.get_status(cluster.room_id)["bootstrapping"] == []
+        follower = cluster.nodes["node-b"]["manager"]
+        assert follower.get_room(cluster.room_id) is None
+
+    def test_live_messages_sent_after_snapshot(self):
+        """Test messages added during the transfer buffered, then sent."""
+        cluster = Cluster()
+        replication = cluster.admin["replication"]
+        send = SnapshotSender.send
+        status = {}
+
+        def send_while_live(sender, peer_id, snapshot, purpose):
+            for number in range(2):
+                message = cluster.send(f"live {number}")
+                replication.replicate(cluster.room_id, message)
+            status.update(replication.get_status(cluster.room_id))
+            return send(sender, peer_id, snapshot, purpose)
+
+        with patch.object(SnapshotSender, "send", send_while_live):
+            acked = replication.sync_follower(cluster.room_id, "node-b")
+
+        assert status["bootstrapping"] == ["node-b"]
+        assert acked == 62
+        assert cluster.admin["registry"].methods()[-1] == "replicate_messages"
+        replica = cluster.replica()
+        assert replica.replicated_sequence == 62
+        assert replica.messages[-1]["content"] == "live 1"
+
+    def test_falls_back_to_message_buffer(self):
+        """Test followers without the capability, or small rooms, batched."""
+        cluster = Cluster(capabilities=())
+        small = Cluster(messages=3)
+
+        acked = cluster.admin["replication"].sync_follower(
+            cluster.room_id, "node-b"
+        )
+        small_acked = small.admin["replication"].sync_follower(
+            small.room_id, "node-b"
+        )
+
+        assert acked == 60
+        assert "begin_snapshot_transfer" not in cluster.admin["registry"].methods()
+        assert cluster.replica().message_counter == 60
+        assert small_acked == 3
+        assert "begin_snapshot_transfer" not in small.admin["registry"].methods()
+
+
+class TestReceiver:
+    """Tests for receiving replica snapshots."""
+
+    def test_replica_refused_without_handler(self):
+        """Test a receiver that only takes over rooms refusing replicas."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        data = RoomSnapshot.from_room(manager, room_id).encode()
+        receiver = SnapshotReceiver(
+            "node-b", lambda snapshot, sender: {"success": True}
+        )
+
+        result = receiver.begin(
+            "t1", room_id, len(data), 1, "", "node-a", REPLICA
+        )
+
+        assert result["success"] is False
+        assert result["error_code"] == "UNSUPPORTED_TRANSFER"
@@ -0,0 +1,328 @@
+"""
+Tests for Message Replication
+
+Tests for applying the replication stream on followers, follower
+selection, acknowledgment tracking, catch-up of lagging followers and
+failover from a follower replica.
+"""
+
+from src.node import (
+    RoomStateManager,
+    XMLRPCServer,
+    ReplicaStore,
+    RoomFailover,
+    ReplicationManager,
+)
+from tests.fakes import LocalPeerRegistry
+
+
+class StubFailureDetector:
+    """Failure detector with a fixed set of dead peers."""
+
+    def __init__(self, peer_registry, dead=()):
+        self.peer_registry = peer_registry
+        self.dead = set(dead)
+
+    def is_alive(self, node_id):
+        return node_id not in self.dead
+
+    def alive_peers(self):
+        return [
+            node_id
+            for node_id in self.peer_registry.list_peers()
+            if node_id not in self.dead
+        ]
+
+
+def _room_info(room_id="room-1"):
+    return {
+        "room_id": room_id,
+        "room_name": "General",
+        "description": None,
+        "creator_id": "alice",
+        "admin_node": "node-a",
+        "members": ["alice"],
+    }
+
+
+def _message(seq):
+    return {
+        "message_id": f"msg-{seq}",
+        "room_id": "room-1",
+        "username": "alice",
+        "content": f"hello {seq}",
+        "sequence_number": seq,
+        "timestamp": "2024-01-01T00:00:00+00:00",
+        "vector_clock": {"node-a": seq},
+        "origin_node": "node-a",
+    }
+
+
+class Cluster:
+    """Admin node-a replicating to followers node-b and node-c."""
+
+    def __init__(self, replication_factor=2):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in ("node-a", "node-b", "node-c"):
+            registry = LocalPeerRegistry(node_id, self.servers)
+            detector = StubFailureDetector(registry)
+            manager = RoomStateManager(node_id)
+            store = ReplicaStore()
+            failover = RoomFailover(
+                node_id,
+                f"http://{node_id}",
+                manager,
+                store,
+                registry,
+                detector,
+            )
+            replication = ReplicationManager(
+                node_id, manager, registry, replication_factor, detector
+            )
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                failover=failover,
+                replication=replication,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "store": store,
+                "failover": failover,
+                "replication": replication,
+                "registry": registry,
+                "detector": detector,
+            }
+
+        self.admin = self.nodes["node-a"]
+        self.room = self.admin["manager"].create_room("General", "alice")
+        self.admin["manager"].add_member(self.room.room_id, "alice")
+
+    def send(self, count):
+        for n in range(count):
+            self.admin["manager"].add_message(
+                self.room.room_id, "alice", f"message {n}"
+            )
+
+
+class TestApplyReplication:
+    """Tests for ReplicaStore.apply_replication."""
+
+    def test_applies_contiguous_batch(self):
+        """Test that a batch creates a follower replica."""
+        store = ReplicaStore()
+
+        acked = store.apply_replication(
+            _room_info(), [_message(1), _message(2)]
+        )
+
+        replica = store.get("room-1")
+        assert acked == 2
+        assert replica.follower is True
+        assert replica.members == ["alice"]
+        assert replica.message_counter == 2
+
+    def test_skips_duplicates_and_stops_at_gap(self):
+        """Test that duplicates are ignored and a gap stops the batch."""
+        store = ReplicaStore()
+        store.apply_replication(_room_info(), [_message(1)])
+
+        acked = store.apply_replication(
+            _room_info(), [_message(1), _message(2), _message(4)]
+        )
+
+        replica = store.get("room-1")
+        assert acked == 2
+        assert [m["sequence_number"] for m in replica.messages] == [1, 2]
+
+    def test_reset_restarts_stream(self):
+        """Test that a reset batch is applied despite the gap."""
+        store = ReplicaStore()
+        store.apply_replication(_room_info(), [_message(1)])
+
+        acked = store.apply_replication(
+            _room_info(), [_message(7), _message(8)], reset=True
+        )
+
+        assert acked == 8
+        assert store.get("room-1").message_counter == 8
+
+    def test_follower_replica_kept_when_local_member_leaves(self):
+        """Test that a follower keeps its replica without local members."""
+        store = ReplicaStore()
+        store.update_from_join(_room_info(), [], "alice")
+        store.apply_replication(_room_info(), [_message(1)])
+
+        store.remove_local_member("room-1", "alice")
+
+        assert store.get("room-1") is not None
+
+
+class TestFollowerSelection:
+    """Tests for choosing a room's followers."""
+
+    def test_followers_limited_by_factor(self):
+        """Test that at most replication_factor followers are chosen."""
+        cluster = Cluster(replication_factor=1)
+
+        followers = cluster.admin["replication"].choose_followers("room-1")
+
+        assert len(followers) == 1
+        assert followers[0] in ("node-b", "node-c")
+
+    def test_selection_is_deterministic(self):
+        """Test that the same room always gets the same followers."""
+        cluster = Cluster(replication_factor=1)
+        replication = cluster.admin["replication"]
+
+        assert replication.choose_followers("room-9") == (
+            replication.choose_followers("room-9")
+        )
+
+    def test_dead_peers_not_chosen(self):
+        """Test that dead peers are skipped."""
+        cluster = Cluster()
+        cluster.admin["detector"].dead.add("node-b")
+
+        followers = cluster.admin["replication"].choose_followers("room-1")
+
+        assert followers == ["node-c"]
+
+    def test_factor_zero_disables_replication(self):
+        """Test that a replication factor of 0 chooses no followers."""
+        cluster = Cluster(replication_factor=0)
+
+        assert cluster.admin["replication"].choose_followers("room-1") == []
+
+
+class TestReplicationStream:
+    """Tests for streaming messages and tracking acknowledgments."""
+
+    def test_replicate_streams_to_followers(self):
+        """Test that a new message reaches every follower."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+        message = cluster.admin["manager"].add_message(room_id, "alice", "hi")
+
+        replication = cluster.admin["replication"]
+        replication.replicate(room_id, message)
+        replication._executor.shutdown(wait=True)
+
+        for node_id in ("node-b", "node-c"):
+            replica = cluster.nodes[node_id]["store"].get(room_id)
+            assert replica.follower is True
+            assert replica.messages[0]["content"] == "hi"
+            assert replication.get_acked(room_id, node_id) == 1
+
+    def test_forwarded_message_is_replicated(self):
+        """Test that messages forwarded to the admin are replicated."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+        server = cluster.servers["node-a"]
+
+        server.forward_message(room_id, "alice", "hello", "node-b")
+        cluster.admin["replication"]._executor.shutdown(wait=True)
+
+        replica = cluster.nodes["node-c"]["store"].get(room_id)
+        assert replica.replicated_sequence == 1
+
+    def test_status_reports_lag(self):
+        """Test that get_status reports each follower's lag."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+        replication = cluster.admin["replication"]
+        cluster.send(2)
+        replication.catch_up()
+        cluster.send(3)
+
+        status = replication.get_status(room_id)
+
+        assert status["sequence_number"] == 5
+        assert status["followers"]["node-b"] == {
+            "acked_sequence": 2,
+            "lag": 3,
+        }
+        assert replication.get_status("missing") is None
+
+
+class TestCatchUp:
+    """Tests for catching up lagging followers."""
+
+    def test_unreachable_follower_caught_up_later(self):
+        """Test that a follower that missed messages is caught up."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+        replication = cluster.admin["replication"]
+        node_b = cluster.servers["node-b"]
+        cluster.servers["node-b"] = None
+
+        cluster.send(3)
+        assert replication.catch_up() == 1
+        assert replication.get_acked(room_id, "node-b") == 0
+
+        cluster.servers["node-b"] = node_b
+        assert replication.catch_up() == 2
+
+        replica = cluster.nodes["node-b"]["store"].get(room_id)
+        assert replica.replicated_sequence == 3
+        assert len(replica.messages) == 3
+
+    def test_follower_behind_buffer_gets_reset(self):
+        """Test that a follower behind the admin's buffer is reset."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+        replication = cluster.admin["replication"]
+        cluster.send(3)
+        # Simulate the admin's buffer having dropped older messages
+        cluster.room.messages = cluster.room.messages[2:]
+
+        replication.catch_up()
+
+        replica = cluster.nodes["node-c"]["store"].get(room_id)
+        assert replica.replicated_sequence == 3
+        assert [m["sequence_number"] for m in replica.messages] == [3]
+
+    def test_deleted_room_dropped_from_followers(self):
+        """Test that followers drop replicas of deleted rooms."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+        replication = cluster.admin["replication"]
+        cluster.send(1)
+        replication.catch_up()
+
+        cluster.admin["manager"].delete_room(room_id)
+        replication.catch_up()
+
+        for node_id in ("node-b", "node-c"):
+            assert cluster.nodes[node_id]["store"].get(room_id) is None
+        assert replication.get_status(room_id) is None
+
+
+class TestFailoverFromFollower:
+    """Tests for taking over a room from a follower replica."""
+
+    def test_follower_takes_over_room(self):
+        """Test that a follower without members can become admin."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+        cluster.send(2)
+        cluster.admin["replication"].catch_up()
+
+        cluster.servers["node-a"] = None
+        for node_id in ("node-b", "node-c"):
+            cluster.nodes[node_id]["detector"].dead.add("node-a")
+
+        node_c = cluster.nodes["node-c"]
+        assert node_c["failover"].handle_node_dead("node-a") == [room_id]
+
+        room = node_c["manager"].get_room(room_id)
+        assert room.admin_node == "node-c"
+        assert room.message_counter == 2
+        assert [m["content"] for m in room.messages] == [
+            "message 0",
+            "message 1",
+        ]
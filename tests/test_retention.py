@@ -0,0 +1,209 @@
+"""
+Tests for Room Retention Policies
+
+Tests for setting a room's policy, history respecting it with the
+truncated marker, the reaper deleting expired messages from memory,
+storage and replicas, and the set_retention command.
+"""
+
+import json
+import time
+
+import pytest
+
+from src.node import (
+    MemoryStorage,
+    ReplicaStore,
+    RetentionError,
+    RetentionReaper,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.config import NodeConfig
+from src.node.failover import merge_replicas
+
+LATER = time.time() + 8 * 86400  # past a 7 day policy
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+def _room(manager, count):
+    room = manager.create_room("General", "alice")
+    manager.add_member(room.room_id, "alice")
+    manager.add_member(room.room_id, "bob")
+    for n in range(count):
+        manager.add_message(room.room_id, "alice", f"message {n}")
+    return room.room_id
+
+
+class TestRoomRetention:
+    """Tests for a room's retention policy."""
+
+    def test_set_retention(self):
+        """Test permissions, validation and clearing the policy."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager, 0)
+
+        assert manager.set_retention(
+            room_id, "alice", [" count=10000", "age=7d"]
+        ) == ["age=7d", "count=10000"]
+        assert manager.get_retention(room_id) == ["age=7d", "count=10000"]
+        for username, limits, code in (
+            ("bob", ["age=7d"], "NOT_ALLOWED"),
+            ("alice", ["age=7w"], "INVALID_RETENTION"),
+            ("alice", ["count=1", "count=2"], "INVALID_RETENTION"),
+            ("alice", "age=7d", "INVALID_RETENTION"),
+        ):
+            with pytest.raises(RetentionError) as error:
+                manager.set_retention(room_id, username, limits)
+            assert error.value.error_code == code
+        with pytest.raises(RetentionError) as error:
+            manager.set_retention("missing", "alice", [])
+        assert error.value.error_code == "ROOM_NOT_FOUND"
+        assert manager.set_retention(room_id, "alice", []) == []
+
+    def test_history_respects_policy(self):
+        """Test that history hides expired messages and marks truncation."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager, 5)
+
+        assert manager.get_history(room_id, "bob")["truncated"] is False
+        manager.set_retention(room_id, "alice", ["count=3"])
+        page = manager.get_history(room_id, "bob")
+        older = manager.get_history(room_id, "bob", limit=2)
+
+        assert [m["content"] for m in page["messages"]] == [
+            "message 2",
+            "message 3",
+            "message 4",
+        ]
+        assert page["truncated"] is True
+        assert page["has_more"] is False
+        assert older["truncated"] is False
+        assert len(manager.get_messages(room_id)) == 5
+
+    def test_reaper_deletes_from_memory(self):
+        """Test that expired messages are deleted and history stays marked."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager, 4)
+        manager.set_retention(room_id, "alice", ["age=7d"])
+        reaper = RetentionReaper(manager)
+
+        assert reaper.run_round() == {}
+        assert reaper.run_round(LATER) == {room_id: 4}
+        manager.add_message(room_id, "alice", "fresh")
+        manager.set_retention(room_id, "alice", [])
+        page = manager.get_history(room_id, "bob")
+
+        assert [m["content"] for m in page["messages"]] == ["fresh"]
+        assert page["truncated"] is True
+        assert manager.get_room(room_id).expired_through == 4
+
+    def test_reaper_deletes_from_storage(self):
+        """Test compaction of stored messages and recovery of the policy."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room(manager, 5)
+        manager.set_retention(room_id, "alice", ["count=2"])
+
+        assert RetentionReaper(manager).run_round() == {room_id: 3}
+        assert [m["content"] for m in storage.messages(room_id)] == [
+            "message 3",
+            "message 4",
+        ]
+        recovered = RoomStateManager("node1", storage)
+        recovered.recover_rooms()
+
+        assert recovered.get_retention(room_id) == ["count=2"]
+        assert recovered.get_room(room_id).expired_through == 3
+        assert recovered.get_history(room_id, "bob")["truncated"] is True
+
+
+class TestReplicaRetention:
+    """Tests for retention on replicas of remote rooms."""
+
+    def test_replicas_expire_and_carry_policy(self):
+        """Test join info, retention_changed events and failover state."""
+        admin = RoomStateManager("node1")
+        room_id = _room(admin, 3)
+        admin.set_retention(room_id, "alice", ["count=2"])
+        room = admin.get_room(room_id)
+        replicas = ReplicaStore()
+        replicas.update_from_join(
+            XMLRPCServer(admin, "localhost", 0, "http://node1")._room_info(
+                room
+            ),
+            room.messages,
+            "bob",
+        )
+
+        assert replicas.get(room_id).retention == ["count=2"]
+        reaper = RetentionReaper(RoomStateManager("node2"), replicas)
+        assert reaper.run_round() == {room_id: 1}
+        replicas.record_retention(room_id, ["age=7d"])
+        assert reaper.run_round(LATER) == {room_id: 2}
+        replica = replicas.get(room_id)
+        assert replica.messages == []
+        state = merge_replicas(
+            [dict(replica.to_dict(), node_id="node2")], 100
+        )
+        assert state["retention"] == ["age=7d"]
+        assert state["expired_through"] == 3
+
+
+class TestRetentionCommand:
+    """Tests for the set_retention command."""
+
+    @pytest.mark.asyncio
+    async def test_set_retention_command(self):
+        """Test the retention_set response, event and errors."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager, 0)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        owner = MockWebSocket()
+        member = MockWebSocket()
+        ws_server.register_client_room_membership(member, room_id, "bob")
+
+        for websocket, username in ((owner, "alice"), (owner, "bob")):
+            await ws_server.process_message(
+                websocket,
+                json.dumps(
+                    {
+                        "type": "set_retention",
+                        "data": {
+                            "room_id": room_id,
+                            "username": username,
+                            "retention": ["age=7d"],
+                        },
+                    }
+                ),
+            )
+
+        responses = [json.loads(m) for m in owner.sent_messages]
+        assert responses[0] == {
+            "type": "retention_set",
+            "data": {"room_id": room_id, "retention": ["age=7d"]},
+        }
+        assert responses[1]["type"] == "retention_error"
+        assert responses[1]["data"]["error_code"] == "NOT_ALLOWED"
+        event = member.last()
+        assert event["type"] == "retention_changed"
+        assert event["data"]["changed_by"] == "alice"
+
+    def test_config(self):
+        """Test validation of the reaper interval."""
+        errors = NodeConfig(retention_interval=0).validate()
+
+        assert any("retention_interval" in error for error in errors)
@@ -0,0 +1,343 @@
+"""
+Tests for Room Roles and Permissions
+
+Tests for owner, moderator and member roles, promoting and demoting
+members, permission checks of room commands, and replicating roles to the
+nodes holding room state.
+"""
+
+import json
+import pytest
+from unittest.mock import patch
+
+from src.client import ChatClient
+from src.node import (
+    ModerationError,
+    RoleError,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.failover import ReplicaStore, merge_replicas
+from src.node.room_directory import RoomDirectory
+from src.node.roles import DELETE_ROOM, KICK_MEMBERS, has_permission
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, *members, private=False):
+    room = manager.create_room("general", "alice", private=private)
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestRoles:
+    """Tests for roles and their permissions."""
+
+    def test_default_roles(self):
+        """Test that the creator owns the room and others are members."""
+        manager = RoomStateManager("node-a")
+        room = manager.get_room(_room(manager, "bob"))
+
+        assert room.role_of("alice") == "owner"
+        assert room.role_of("bob") == "member"
+        assert room.has_permission("alice", DELETE_ROOM)
+        assert not room.has_permission("bob", KICK_MEMBERS)
+
+    def test_moderator_permissions(self):
+        """Test that moderators may moderate but not delete the room."""
+        assert has_permission("moderator", KICK_MEMBERS)
+        assert not has_permission("moderator", DELETE_ROOM)
+        assert not has_permission("unknown", KICK_MEMBERS)
+
+
+class TestSetMemberRole:
+    """Tests for promoting and demoting members."""
+
+    def test_promote_and_demote(self):
+        """Test that the owner can promote a member and demote them again."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+
+        assert manager.set_member_role(room_id, "alice", "bob", "moderator")
+        assert manager.get_roles(room_id) == {"bob": "moderator"}
+        assert not manager.set_member_role(room_id, "alice", "bob", "moderator")
+
+        assert manager.set_member_role(room_id, "alice", "bob", "member")
+        assert manager.get_roles(room_id) == {}
+
+    def test_invalid_changes(self):
+        """Test the errors for changes the owner can't make."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+
+        codes = []
+        for requester, target, role in [
+            ("bob", "carol", "moderator"),
+            ("alice", "alice", "member"),
+            ("alice", "dave", "moderator"),
+            ("alice", "carol", "owner"),
+        ]:
+            with pytest.raises(RoleError) as error:
+                manager.set_member_role(room_id, requester, target, role)
+            codes.append(error.value.error_code)
+
+        assert codes == ["NOT_ALLOWED", "INVALID_TARGET", "NOT_IN_ROOM", "INVALID_ROLE"]
+
+    def test_roles_survive_restart(self, tmp_path):
+        """Test that role changes are replayed from the message log."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager, "bob", "carol")
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+        manager.set_member_role(room_id, "alice", "carol", "moderator")
+        manager.set_member_role(room_id, "alice", "carol", "member")
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        assert recovered.get_roles(room_id) == {"bob": "moderator"}
+
+
+class TestPermissionChecks:
+    """Tests for room commands checking the requester's role."""
+
+    def test_moderator_kicks_member(self):
+        """Test that a moderator can kick plain members."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+
+        manager.moderate_member(room_id, "bob", "carol", ban=True)
+
+        assert manager.get_banned(room_id) == ["carol"]
+
+    def test_moderator_cannot_remove_moderator(self):
+        """Test that moderators can't remove each other."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+        manager.set_member_role(room_id, "alice", "carol", "moderator")
+
+        with pytest.raises(ModerationError) as error:
+            manager.moderate_member(room_id, "bob", "carol")
+
+        assert error.value.error_code == "NOT_ALLOWED"
+
+    def test_kicked_moderator_loses_role(self):
+        """Test that a moderator removed by the owner is no longer one."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+
+        manager.moderate_member(room_id, "alice", "bob")
+
+        assert manager.get_roles(room_id) == {}
+
+    def test_moderator_revokes_invites(self):
+        """Test that moderators can revoke invites created by others."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol", private=True)
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+        invite = manager.create_invite(room_id, "carol")
+
+        manager.revoke_invite(room_id, invite.token, "bob")
+
+        assert manager.list_invites(room_id) == []
+
+    @pytest.mark.asyncio
+    async def test_moderator_cannot_delete_room(self):
+        """Test that deleting a room stays with its owner."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        manager.set_member_role(room_id, "alice", "bob", "moderator")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server, MockWebSocket(), "delete_room", room_id=room_id, username="bob"
+        )
+
+        assert response["data"]["error_code"] == "UNAUTHORIZED"
+        assert manager.get_room(room_id) is not None
+
+
+class TestRoleCommands:
+    """Tests for promote_member and demote_member over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_promote_local_member(self):
+        """Test that room members are told about a promotion."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        response = await _request(
+            ws_server,
+            alice,
+            "promote_member",
+            room_id=room_id,
+            username="alice",
+            target="bob",
+        )
+
+        assert response["type"] == "role_changed"
+        changed = bob.received("member_role_changed")[0]
+        assert (changed["username"], changed["role"]) == ("bob", "moderator")
+        assert changed["changed_by"] == "alice"
+
+    @pytest.mark.asyncio
+    async def test_demote_rejected_for_member(self):
+        """Test that members can't change roles."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob", "carol")
+        manager.set_member_role(room_id, "alice", "carol", "moderator")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            MockWebSocket(),
+            "demote_member",
+            room_id=room_id,
+            username="bob",
+            target="carol",
+        )
+
+        assert response["type"] == "moderation_error"
+        assert response["data"]["request_type"] == "demote_member"
+        assert manager.get_roles(room_id) == {"carol": "moderator"}
+
+    @pytest.mark.asyncio
+    async def test_forwarded_to_admin_node(self):
+        """Test that an owner on another node changes roles on the admin."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, "bob")
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_server = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            response = await _request(
+                ws_server,
+                MockWebSocket(),
+                "promote_member",
+                room_id=room_id,
+                username="alice",
+                target="bob",
+            )
+
+        assert response["type"] == "role_changed"
+        assert admin.get_roles(room_id) == {"bob": "moderator"}
+
+
+class TestReplicatedRoles:
+    """Tests for roles reaching the nodes that hold room state."""
+
+    def test_role_change_event_updates_replica(self):
+        """Test that a member_role_changed event updates the replica."""
+        replicas = ReplicaStore()
+        replicas.update_from_join(
+            {"room_id": "r1", "admin_node": "node-a", "roles": {}}, [], "bob"
+        )
+
+        replicas.record_role_change("r1", "bob", "moderator")
+        assert replicas.get("r1").roles == {"bob": "moderator"}
+        replicas.record_role_change("r1", "bob", "member")
+        assert replicas.get("r1").roles == {}
+
+    def test_replication_carries_roles(self):
+        """Test that followers take the roles sent with replication."""
+        replicas = ReplicaStore()
+
+        replicas.apply_replication(
+            {"room_id": "r1", "admin_node": "node-a", "roles": {"bob": "moderator"}},
+            [],
+        )
+
+        assert replicas.get("r1").roles == {"bob": "moderator"}
+
+    def test_roles_kept_on_failover(self):
+        """Test that the merged room state keeps the roles."""
+        base = {"room_id": "r1", "room_name": "general", "node_id": "node-b"}
+
+        merged = merge_replicas(
+            [dict(base, roles={"bob": "moderator"}), dict(base, node_id="node-c")],
+            max_messages=10,
+        )
+
+        assert merged["roles"] == {"bob": "moderator"}
+
+
+class TestClient:
+    """Tests for the client side of role commands."""
+
+    @pytest.mark.asyncio
+    async def test_promote_member_request(self):
+        """Test that promote_member sends the target."""
+        client = ChatClient("ws://localhost:8000")
+        websocket = MockWebSocket()
+
+        async def recv():
+            return json.dumps(
+                {
+                    "type": "role_changed",
+                    "data": {"room_id": "room-1", "role": "moderator"},
+                }
+            )
+
+        websocket.recv = recv
+        client._set_test_mode(mock_websocket=websocket)
+
+        result = await client.promote_member("room-1", "alice", "bob")
+
+        assert result["role"] == "moderator"
+        request = json.loads(websocket.sent_messages[0])
+        assert request["type"] == "promote_member"
+        assert request["data"]["target"] == "bob"
@@ -0,0 +1,253 @@
+"""
+Tests for the Gossiped Global Room Directory
+
+Tests for directory versioning, merging, tombstones, the gossip round,
+and the global list_rooms scope.
+"""
+
+import json
+import time
+import pytest
+from unittest.mock import Mock
+
+from src.node import (
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+    RoomDirectory,
+)
+from src.node.room_directory import gossip_round
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+
+def _remote_entry(room_id="r2", version=1, **overrides):
+    entry = {
+        "room_id": room_id,
+        "room_name": "Remote",
+        "admin_node": "node2",
+        "node_address": "http://node2:9090",
+        "member_count": 1,
+        "version": version,
+        "deleted": False,
+    }
+    entry.update(overrides)
+    return entry
+
+
+def test_update_local_creates_entries():
+    """Test that local rooms are published to the directory."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1", "http://node1:9090")
+    room = manager.create_room("General", "alice")
+
+    directory.update_local(manager.list_rooms())
+
+    entry = directory.get(room.room_id)
+    assert entry.room_name == "General"
+    assert entry.admin_node == "node1"
+    assert entry.node_address == "http://node1:9090"
+    assert entry.version == 1
+
+
+def test_update_local_bumps_version_on_change():
+    """Test that a changed room gets a new version."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1")
+    room = manager.create_room("General", "alice")
+    directory.update_local(manager.list_rooms())
+
+    directory.update_local(manager.list_rooms())
+    assert directory.get(room.room_id).version == 1
+
+    manager.add_member(room.room_id, "alice")
+    directory.update_local(manager.list_rooms())
+    entry = directory.get(room.room_id)
+    assert entry.version == 2
+    assert entry.member_count == 1
+
+
+def test_deleted_local_room_becomes_tombstone():
+    """Test that deleting a local room publishes a tombstone."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1")
+    room = manager.create_room("General", "alice")
+    directory.update_local(manager.list_rooms())
+
+    manager.delete_room(room.room_id)
+    directory.update_local(manager.list_rooms())
+
+    assert directory.get(room.room_id) is None
+    entries = directory.get_entries()
+    assert entries[0]["deleted"] is True
+    assert entries[0]["version"] == 2
+
+
+def test_merge_keeps_highest_version():
+    """Test that merging only accepts newer versions."""
+    directory = RoomDirectory("node1")
+
+    assert directory.merge([_remote_entry(version=2, member_count=5)]) == 1
+    assert directory.merge([_remote_entry(version=1, member_count=9)]) == 0
+    assert directory.get("r2").member_count == 5
+
+    assert directory.merge([_remote_entry(version=3, deleted=True)]) == 1
+    assert directory.get("r2") is None
+
+
+def test_merge_ignores_entries_for_own_rooms():
+    """Test that peers cannot overwrite rooms this node administers."""
+    directory = RoomDirectory("node1")
+    assert directory.merge([_remote_entry(admin_node="node1")]) == 0
+    assert directory.list_rooms() == []
+
+
+def test_merge_disowns_rooms_not_hosted():
+    """Test a tombstone outranking live entries naming this node."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1")
+    hosted = manager.create_room("General", "alice").room_id
+    directory.update_local(manager.list_rooms())
+
+    directory.merge(
+        [
+            _remote_entry(version=4, admin_node="node1"),
+            _remote_entry(hosted, version=7, admin_node="node1"),
+        ]
+    )
+    directory.merge([_remote_entry(version=2, admin_node="node1")])
+
+    tombstone = directory.get_entries_for(["r2"])[0]
+    assert (tombstone["version"], tombstone["deleted"]) == (5, True)
+    assert directory.get(hosted).version == 1
+
+
+def test_merge_ignores_malformed_entries():
+    """Test that malformed entries are skipped."""
+    directory = RoomDirectory("node1")
+    assert directory.merge([{"room_name": "no id"}]) == 0
+
+
+def test_purge_tombstones():
+    """Test that old tombstones are forgotten."""
+    directory = RoomDirectory("node1")
+    directory.merge([_remote_entry(deleted=True)])
+    directory._entries["r2"].updated_at = time.time() - 1000
+
+    assert directory.purge_tombstones(ttl=300) == 1
+    assert directory.get_entries() == []
+
+
+def test_gossip_round_exchanges_with_peers():
+    """Test a gossip round pushes local entries and merges replies."""
+    manager = RoomStateManager(node_id="node1")
+    manager.create_room("Local", "alice")
+    directory = RoomDirectory("node1")
+    peer_registry = Mock()
+    peer_registry.list_peers.return_value = {"node2": "http://node2:9090"}
+    peer_registry.call_peer.return_value = [_remote_entry()]
+
+    reached = gossip_round(directory, manager, peer_registry)
+
+    assert reached == ["node2"]
+    method, pushed = peer_registry.call_peer.call_args[0][1:]
+    assert method == "exchange_room_directory"
+    assert pushed[0]["room_name"] == "Local"
+    assert {r["room_name"] for r in directory.list_rooms()} == {
+        "Local",
+        "Remote",
+    }
+
+
+def test_gossip_round_tolerates_unreachable_peer():
+    """Test that an unreachable peer doesn't break the round."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1")
+    peer_registry = Mock()
+    peer_registry.list_peers.return_value = {"node2": "http://node2:9090"}
+    peer_registry.call_peer.side_effect = ConnectionError("down")
+
+    assert gossip_round(directory, manager, peer_registry) == []
+
+
+def test_xmlrpc_exchange_room_directory():
+    """Test the exchange RPC merges and replies with local entries."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1", "http://node1:9090")
+    server = XMLRPCServer(
+        manager,
+        "localhost",
+        9090,
+        "http://node1:9090",
+        room_directory=directory,
+    )
+    manager.create_room("Local", "alice")
+
+    reply = server.exchange_room_directory([_remote_entry()])
+
+    names = {entry["room_name"] for entry in reply}
+    assert names == {"Local", "Remote"}
+
+
+@pytest.mark.asyncio
+async def test_list_rooms_global_scope_uses_directory():
+    """Test list_rooms with global scope returns directory rooms."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1")
+    directory.merge([_remote_entry()])
+    ws_server = WebSocketServer(
+        manager, "localhost", 9000, room_directory=directory
+    )
+    manager.create_room("Local", "alice")
+    ws = MockWebSocket()
+
+    await ws_server.process_message(
+        ws, json.dumps({"type": "list_rooms", "data": {"scope": "global"}})
+    )
+
+    response = json.loads(ws.sent_messages[0])
+    assert response["type"] == "rooms_list"
+    assert response["data"]["scope"] == "global"
+    assert response["data"]["total_count"] == 2
+
+
+@pytest.mark.asyncio
+async def test_list_rooms_default_scope_is_local():
+    """Test list_rooms without scope still lists only local rooms."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1")
+    directory.merge([_remote_entry()])
+    ws_server = WebSocketServer(
+        manager, "localhost", 9000, room_directory=directory
+    )
+    ws = MockWebSocket()
+
+    await ws_server.process_message(ws, json.dumps({"type": "list_rooms"}))
+
+    response = json.loads(ws.sent_messages[0])
+    assert response["data"]["total_count"] == 0
+
+
+def test_locate_room_admin_prefers_directory():
+    """Test that admin lookup uses the directory before discovery."""
+    manager = RoomStateManager(node_id="node1")
+    directory = RoomDirectory("node1")
+    directory.merge([_remote_entry()])
+    peer_registry = Mock()
+    ws_server = WebSocketServer(
+        manager, "localhost", 9000, peer_registry, directory
+    )
+
+    room, address = ws_server._locate_room_admin("r2")
+
+    assert room["admin_node"] == "node2"
+    assert address == "http://node2:9090"
+    peer_registry.discover_global_rooms.assert_not_called()
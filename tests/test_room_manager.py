@@ -0,0 +1,105 @@
+"""
+Tests for RoomStateManager Thread Safety and Validation
+
+Tests for concurrent access to room state, room name validation, and
+snapshot accessors.
+"""
+
+import threading
+import pytest
+from src.node import RoomStateManager
+
+
+def test_create_room_duplicate_name_case_insensitive():
+    """Test that duplicate detection ignores case and whitespace."""
+    manager = RoomStateManager(node_id="test_node")
+    manager.create_room(room_name="General", creator_id="user1")
+
+    with pytest.raises(ValueError, match="already exists"):
+        manager.create_room(room_name="  general ", creator_id="user2")
+
+
+def test_create_room_strips_name():
+    """Test that room names are stored trimmed."""
+    manager = RoomStateManager(node_id="test_node")
+    room = manager.create_room(room_name="  Lobby  ", creator_id="user1")
+    assert room.room_name == "Lobby"
+
+
+def test_create_room_rejects_empty_name():
+    """Test that empty room names are rejected."""
+    manager = RoomStateManager(node_id="test_node")
+    with pytest.raises(ValueError, match="cannot be empty"):
+        manager.create_room(room_name="   ", creator_id="user1")
+
+
+def test_create_room_rejects_long_name():
+    """Test that overly long room names are rejected."""
+    manager = RoomStateManager(node_id="test_node")
+    with pytest.raises(ValueError, match="too long"):
+        manager.create_room(room_name="x" * 101, creator_id="user1")
+
+
+def test_get_members_and_messages_return_copies():
+    """Test that snapshot accessors don't expose internal state."""
+    manager = RoomStateManager(node_id="test_node")
+    room = manager.create_room(room_name="Room", creator_id="user1")
+    manager.add_member(room.room_id, "user1")
+    manager.add_message(room.room_id, "user1", "hello")
+
+    members = manager.get_members(room.room_id)
+    messages = manager.get_messages(room.room_id)
+    members.append("intruder")
+    messages.clear()
+
+    assert "intruder" not in room.members
+    assert len(room.messages) == 1
+    assert manager.get_members("missing") == []
+    assert manager.get_messages("missing") == []
+
+
+def test_concurrent_messages_get_unique_sequence_numbers():
+    """Test that concurrent add_message calls never reuse a sequence."""
+    manager = RoomStateManager(node_id="test_node")
+    room = manager.create_room(room_name="Busy", creator_id="user1")
+    manager.add_member(room.room_id, "user1")
+    results = []
+
+    def send_many():
+        for _ in range(100):
+            message = manager.add_message(
+                room.room_id, "user1", "hi", max_messages=10000
+            )
+            results.append(message["sequence_number"])
+
+    threads = [threading.Thread(target=send_many) for _ in range(8)]
+    for thread in threads:
+        thread.start()
+    for thread in threads:
+        thread.join()
+
+    assert len(results) == 800
+    assert sorted(results) == list(range(1, 801))
+
+
+def test_concurrent_room_creation_same_name():
+    """Test that only one of several concurrent creates succeeds."""
+    manager = RoomStateManager(node_id="test_node")
+    created = []
+    errors = []
+
+    def create():
+        try:
+            created.append(manager.create_room("Race", "user1"))
+        except ValueError as e:
+            errors.append(e)
+
+    threads = [threading.Thread(target=create) for _ in range(10)]
+    for thread in threads:
+        thread.start()
+    for thread in threads:
+        thread.join()
+
+    assert len(created) == 1
+    assert len(errors) == 9
+    assert manager.get_room_count() == 1
@@ -0,0 +1,296 @@
+"""
+Tests for Room Metadata Updates
+
+Tests for changing a room's name, topic and description, resolving
+concurrent and late updates by their HLC versions, metadata surviving
+restarts and failover, renames in the Raft room registry, and the
+update_room command on the admin node and on a node forwarding to it.
+"""
+
+import json
+from unittest.mock import MagicMock
+
+import pytest
+
+from src.node import (
+    MemoryStorage,
+    RaftRoomRegistry,
+    ReplicaStore,
+    RoomStateManager,
+    RoomUpdateError,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.clock import HLCTimestamp
+from src.node.failover import merge_replicas
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager):
+    """A room owned by alice, with bob as a member and carol a moderator."""
+    room = manager.create_room("General", "alice", description="Chat")
+    for username in ("alice", "bob", "carol"):
+        manager.add_member(room.room_id, username)
+    manager.set_member_role(room.room_id, "alice", "carol", "moderator")
+    return room.room_id
+
+
+def _version(wall, node_id="node1"):
+    return HLCTimestamp(wall, 0, node_id).encode()
+
+
+async def _send(ws_server, websocket, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": "update_room", "data": data})
+    )
+
+
+class TestUpdateRoom:
+    """Tests for updating a hosted room's metadata."""
+
+    def test_update_and_errors(self):
+        """Test permissions, validation, name conflicts and clearing."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+        manager.create_room("Random", "dave")
+
+        first = manager.update_room(
+            room_id, "alice", {"room_name": " Lobby ", "topic": "Welcome"}
+        )
+        second = manager.update_room(room_id, "carol", {"topic": ""})
+        for username, changes, code in (
+            ("bob", {"topic": "Mine"}, "NOT_ALLOWED"),
+            ("alice", {}, "INVALID_REQUEST"),
+            ("alice", {"owner": "bob"}, "INVALID_REQUEST"),
+            ("alice", {"topic": "x" * 301}, "INVALID_REQUEST"),
+            ("alice", {"room_name": ""}, "INVALID_ROOM_NAME"),
+            ("alice", {"room_name": "random"}, "ROOM_NAME_TAKEN"),
+        ):
+            with pytest.raises(RoomUpdateError) as error:
+                manager.update_room(room_id, username, changes)
+            assert error.value.error_code == code
+        with pytest.raises(RoomUpdateError) as error:
+            manager.update_room("missing", "alice", {"topic": "Hi"})
+        room = manager.get_room(room_id)
+
+        assert error.value.error_code == "ROOM_NOT_FOUND"
+        assert first["changes"] == {"room_name": "Lobby", "topic": "Welcome"}
+        assert second["changes"] == {"topic": None}
+        assert second["versions"]["topic"] > first["versions"]["topic"]
+        assert (room.room_name, room.topic) == ("Lobby", None)
+        assert room.metadata_versions == {
+            "room_name": first["versions"]["room_name"],
+            "topic": second["versions"]["topic"],
+        }
+
+    def test_recovered_from_storage(self):
+        """Test that metadata and its versions survive a restart."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room(manager)
+        update = manager.update_room(
+            room_id, "alice", {"topic": "Rules", "description": "Talk"}
+        )
+
+        recovered = RoomStateManager("node1", storage)
+        recovered.recover_rooms()
+        room = recovered.get_room(room_id)
+
+        assert (room.topic, room.description) == ("Rules", "Talk")
+        assert room.metadata_versions == update["versions"]
+
+
+class TestConflictResolution:
+    """Tests for resolving updates by their versions."""
+
+    def test_late_update_only_wins_where_newer(self):
+        """Test an old admin's update arriving after newer ones."""
+        manager = RoomStateManager("node2")
+        room_id = _room(manager)
+        current = manager.update_room(room_id, "alice", {"topic": "New"})
+        newer = HLCTimestamp.decode(current["versions"]["topic"]).wall + 1
+
+        applied = manager.apply_room_update(
+            room_id,
+            {"topic": "Old", "description": "Late"},
+            {"topic": _version(1000), "description": _version(1000)},
+        )
+        newest = manager.apply_room_update(
+            room_id, {"topic": "Newest"}, {"topic": _version(newer)}
+        )
+        room = manager.get_room(room_id)
+
+        assert applied["changes"] == {"description": "Late"}
+        assert newest["changes"] == {"topic": "Newest"}
+        assert (room.topic, room.description) == ("Newest", "Late")
+        update = manager.update_room(room_id, "alice", {"topic": "Next"})
+        assert update["versions"]["topic"] > _version(newer)
+
+    def test_replicas_and_failover_keep_newest_fields(self):
+        """Test replica events, join info and merging surviving replicas."""
+        admin = RoomStateManager("node1")
+        room_id = _room(admin)
+        admin.update_room(room_id, "alice", {"topic": "Hello"})
+        xmlrpc_server = XMLRPCServer(admin, "localhost", 0, "http://node1")
+        replicas = ReplicaStore()
+        replicas.update_from_join(
+            xmlrpc_server._room_info(admin.get_room(room_id)), [], "bob"
+        )
+        replica = replicas.get(room_id)
+        stale = replicas.record_metadata(
+            room_id, {"topic": "Stale"}, {"topic": _version(1000)}
+        )
+        renamed = replicas.record_metadata(
+            room_id, {"room_name": "Lobby"}, {"room_name": _version(2000)}
+        )
+
+        other = dict(
+            replica.to_dict(),
+            node_id="node3",
+            room_name="Hall",
+            topic="Later",
+            metadata_versions={
+                "room_name": _version(1500, "node3"),
+                "topic": _version(2 * 10**12, "node3"),
+            },
+        )
+        state = merge_replicas(
+            [dict(replica.to_dict(), node_id="node2"), other], 100
+        )
+
+        assert replica.topic == "Hello"
+        assert stale == {}
+        assert renamed == {"room_name": "Lobby"}
+        assert (state["room_name"], state["topic"]) == ("Lobby", "Later")
+        assert state["description"] == "Chat"
+        restored = admin.restore_room(**dict(state, room_id="r2"))
+        assert restored.metadata_versions["room_name"] == _version(2000)
+
+    def test_raft_registry_keeps_names_unique(self):
+        """Test renaming a registered room to another room's name."""
+        registry = RaftRoomRegistry("node1", "http://node1", MagicMock())
+        for room_id, name in (("r1", "General"), ("r2", "Random")):
+            registry.apply(
+                {
+                    "op": "create_room",
+                    "room": {
+                        "room_id": room_id,
+                        "room_name": name,
+                        "private": False,
+                    },
+                }
+            )
+
+        def rename(room_id, name):
+            return registry.apply(
+                {
+                    "op": "update_room",
+                    "room_id": room_id,
+                    "fields": {"room_name": name},
+                }
+            )
+
+        assert rename("r1", "RANDOM")["error_code"] == "ROOM_NAME_TAKEN"
+        assert rename("r1", "general")["success"] is True
+        assert rename("r1", "Lobby")["success"] is True
+        assert registry.get("r1")["room_name"] == "Lobby"
+
+
+class TestUpdateRoomCommand:
+    """Tests for the update_room command and room_updated events."""
+
+    @pytest.mark.asyncio
+    async def test_command_on_admin_node(self):
+        """Test the success response, the event and an error."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        moderator, member = MockWebSocket(), MockWebSocket()
+        ws_server.register_client_room_membership(member, room_id, "bob")
+
+        await _send(
+            ws_server,
+            moderator,
+            {"room_id": room_id, "username": "carol", "topic": "Welcome"},
+        )
+        await _send(
+            ws_server,
+            member,
+            {"room_id": room_id, "username": "bob", "room_name": "Mine"},
+        )
+
+        success = moderator.received("update_room_success")[0]
+        assert success["changes"] == {"topic": "Welcome"}
+        event = member.received("room_updated")[0]
+        assert event["updated_by"] == "carol"
+        assert event["versions"] == success["versions"]
+        error = member.received("room_update_error")[0]
+        assert error["error_code"] == "NOT_ALLOWED"
+        assert manager.get_room(room_id).room_name == "General"
+
+    @pytest.mark.asyncio
+    async def test_forwarded_to_admin_node(self):
+        """Test an update from a node that doesn't administer the room."""
+        admin = RoomStateManager("node1")
+        room_id = _room(admin)
+        xmlrpc_server = XMLRPCServer(admin, "localhost", 0, "http://node1")
+        broadcast = MagicMock()
+        xmlrpc_server.set_broadcast_callback(broadcast)
+        ws_server = WebSocketServer(RoomStateManager("node2"), "localhost", 0)
+
+        async def call_admin(room_id, method, *args):
+            return getattr(xmlrpc_server, method)(*args)
+
+        ws_server._call_room_admin = call_admin
+        owner = MockWebSocket()
+        await _send(
+            ws_server,
+            owner,
+            {"room_id": room_id, "username": "alice", "room_name": "Lobby"},
+        )
+
+        assert owner.received("update_room_success")[0]["changes"] == {
+            "room_name": "Lobby"
+        }
+        event = broadcast.call_args[0][1]
+        assert event["type"] == "room_updated"
+        assert admin.get_room(room_id).room_name == "Lobby"
+
+    def test_stale_event_not_delivered(self):
+        """Test that an event older than the hosted room's metadata is dropped."""
+        manager = RoomStateManager("node2")
+        room_id = _room(manager)
+        manager.update_room(room_id, "alice", {"topic": "New"})
+        xmlrpc_server = XMLRPCServer(manager, "localhost", 0, "http://node2")
+        broadcast = MagicMock()
+        xmlrpc_server.set_broadcast_callback(broadcast)
+
+        xmlrpc_server.receive_member_event_broadcast(
+            room_id,
+            "room_updated",
+            {
+                "room_id": room_id,
+                "changes": {"topic": "Old"},
+                "versions": {"topic": _version(1000)},
+                "updated_by": "alice",
+            },
+        )
+
+        broadcast.assert_not_called()
+        assert manager.get_room(room_id).topic == "New"
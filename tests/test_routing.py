@@ -0,0 +1,301 @@
+"""
+Tests for Latency-Aware Routing
+
+Tests for ranking the nodes able to serve a request by round-trip time and
+region, serving history pages from follower replicas, and get_history on
+a remote room read from the nearest of its admin and followers.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    FailureDetector,
+    LatencyRouter,
+    ReplicaStore,
+    ReplicationManager,
+    RoomFailover,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.metrics import NodeMetrics
+from tests.fakes import LocalPeerRegistry
+
+
+class AdminProxy:
+    """ServerProxy reaching the room admin's XML-RPC server."""
+
+    def __init__(self, server):
+        self.server = server
+
+    def __call__(self, address, allow_none=False):
+        return self
+
+    def __getattr__(self, method):
+        return getattr(self.server, method)
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+
+def _room_info(private=False):
+    return {
+        "room_id": "room-1",
+        "room_name": "General",
+        "creator_id": "alice",
+        "admin_node": "node-a",
+        "members": ["alice"],
+        "private": private,
+    }
+
+
+def _message(seq):
+    return {
+        "message_id": f"msg-{seq}",
+        "room_id": "room-1",
+        "username": "alice",
+        "content": f"hello {seq}",
+        "sequence_number": seq,
+        "timestamp": "2024-01-01T00:00:00+00:00",
+        "vector_clock": {"node-a": seq},
+        "origin_node": "node-a",
+    }
+
+
+class Cluster:
+    """Admin node-a replicating room General to its followers."""
+
+    def __init__(self, replication_factor=1):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in ("node-a", "node-b", "node-c"):
+            registry = LocalPeerRegistry(node_id, self.servers)
+            detector = FailureDetector(node_id, registry)
+            manager = RoomStateManager(node_id)
+            store = ReplicaStore()
+            failover = RoomFailover(
+                node_id, f"http://{node_id}", manager, store, registry
+            )
+            replication = ReplicationManager(
+                node_id, manager, registry, replication_factor, detector
+            )
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                failover=failover,
+                replication=replication,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "store": store,
+                "registry": registry,
+                "detector": detector,
+                "replication": replication,
+            }
+
+        admin = self.nodes["node-a"]
+        self.room_id = admin["manager"].create_room("General", "alice").room_id
+        admin["manager"].add_member(self.room_id, "alice")
+        for n in range(3):
+            message = admin["manager"].add_message(
+                self.room_id, "alice", f"message {n}"
+            )
+            admin["replication"].replicate(self.room_id, message)
+        admin["replication"]._executor.shutdown(wait=True)
+        self.followers = admin["replication"].choose_followers(self.room_id)
+
+    def ws_server(self, node_id, metrics=None):
+        """Create a WebSocket server of a node, routing by latency."""
+        node = self.nodes[node_id]
+        router = LatencyRouter(
+            node_id, node["detector"], node["registry"], metrics=metrics
+        )
+        ws_server = WebSocketServer(
+            node["manager"],
+            "localhost",
+            0,
+            node["registry"],
+            replica_store=node["store"],
+            replication=node["replication"],
+            router=router,
+        )
+        ws_server._locate_room_admin = lambda room_id: (
+            {"room_id": room_id, "admin_node": "node-a"},
+            "http://node-a",
+        )
+        return ws_server
+
+    async def get_history(self, ws_server):
+        """Send get_history for General as alice; return the response."""
+        websocket = MockWebSocket()
+        request = {
+            "type": "get_history",
+            "data": {"room_id": self.room_id, "username": "alice"},
+        }
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            AdminProxy(self.servers["node-a"]),
+        ):
+            await ws_server.process_message(websocket, json.dumps(request))
+        return websocket.sent_messages[-1]
+
+
+class TestLatencyRouter:
+    """Tests for ranking candidate nodes."""
+
+    def test_rank(self):
+        """Test self, then RTT, then region, with dead peers last."""
+        servers = dict.fromkeys(("node-a", "node-b", "node-c", "node-d"))
+        servers["node-e"] = None
+        registry = LocalPeerRegistry(
+            "node-a", servers, tags={"node-d": {"region": "eu"}}
+        )
+        detector = FailureDetector("node-a", registry, dead_threshold=1)
+        detector.record_success("node-b", 0.3)
+        detector.record_success("node-c", 0.1)
+        detector.record_failure("node-e")
+        router = LatencyRouter("node-a", detector, registry, region="eu")
+
+        nodes = ["node-e", "node-f", "node-d", "node-b", "node-c", "node-a"]
+        assert router.rank(nodes + [""]) == [
+            "node-a",
+            "node-c",
+            "node-b",
+            "node-d",
+            "node-f",
+            "node-e",
+        ]
+        assert router.rank(["node-f", "node-g"], preferred="node-g") == [
+            "node-g",
+            "node-f",
+        ]
+        assert router.rtt("node-a") == 0.0
+        assert router.rtt("node-f") is None
+
+    def test_metrics(self):
+        """Test routing decisions, fallbacks and RTTs exported."""
+        registry = LocalPeerRegistry("node-a", {"node-b": None})
+        detector = FailureDetector("node-a", registry)
+        detector.record_success("node-b", 0.25)
+        metrics = NodeMetrics()
+        metrics.track_peer_rtt(detector)
+        router = LatencyRouter("node-a", detector, registry, metrics=metrics)
+
+        router.record("history", "node-b")
+        router.record("history", "node-a", fallbacks=2)
+
+        decisions = metrics.routing_decisions
+        assert decisions.value(purpose="history", peer="node-b") == 1
+        assert decisions.value(purpose="history", peer="node-a") == 1
+        assert metrics.routing_fallbacks.value(purpose="history") == 2
+        text = metrics.registry.render()
+        assert 'chat_peer_rtt_seconds{peer="node-b"} 0.25' in text
+
+
+class TestReplicaHistory:
+    """Tests for history pages served from a follower's replica."""
+
+    def test_follower_serves_page(self):
+        """Test pages of an up-to-date replica, like the admin's."""
+        store = ReplicaStore()
+        store.apply_replication(_room_info(), [_message(n) for n in (1, 2, 3)])
+
+        page = store.history_page("room-1", "alice", limit=2)
+        older = store.history_page("room-1", "alice", before="msg-2")
+
+        assert [m["message_id"] for m in page["messages"]] == ["msg-2", "msg-3"]
+        assert page["has_more"] is True
+        assert [m["message_id"] for m in older["messages"]] == ["msg-1"]
+        assert older["truncated"] is False
+
+    def test_refusals(self):
+        """Test missing, lagging, trimmed and private replicas refused."""
+        trimmed = ReplicaStore(max_messages=2)
+        trimmed.apply_replication(
+            _room_info(), [_message(n) for n in (1, 2, 3)]
+        )
+        private = ReplicaStore()
+        private.apply_replication(_room_info(private=True), [_message(1)])
+        lagging = ReplicaStore()
+        lagging.apply_replication(_room_info(), [_message(1)])
+        lagging.record_message("room-1", _message(2))
+
+        assert trimmed.history_page("room-1", "alice", limit=1)["success"]
+        for store, username, code in (
+            (ReplicaStore(), "alice", "REPLICA_UNAVAILABLE"),
+            (lagging, "alice", "REPLICA_UNAVAILABLE"),
+            (trimmed, "alice", "REPLICA_INCOMPLETE"),
+            (private, "bob", "NOT_A_MEMBER"),
+        ):
+            result = store.history_page("room-1", username)
+            assert result["error_code"] == code
+
+
+class TestFollowersOf:
+    """Tests for finding a remote room's followers."""
+
+    def test_agrees_with_admin(self):
+        """Test that every node computes the admin's followers."""
+        cluster = Cluster(replication_factor=1)
+
+        for node_id in ("node-b", "node-c"):
+            replication = cluster.nodes[node_id]["replication"]
+            followers = replication.followers_of(cluster.room_id, "node-a")
+            assert followers == cluster.followers
+
+
+class TestGetHistory:
+    """Tests for get_history routed to the nearest replica."""
+
+    @pytest.mark.asyncio
+    async def test_nearest_follower_then_admin(self):
+        """Test a nearby follower serving, and the admin as fallback."""
+        cluster = Cluster(replication_factor=1)
+        follower = cluster.followers[0]
+        reader = ({"node-b", "node-c"} - {follower}).pop()
+        node = cluster.nodes[reader]
+        node["detector"].record_success(follower, 0.01)
+        node["detector"].record_success("node-a", 0.2)
+        metrics = NodeMetrics()
+        ws_server = cluster.ws_server(reader, metrics)
+
+        served = await cluster.get_history(ws_server)
+        cluster.servers[follower] = None
+        fallback = await cluster.get_history(ws_server)
+
+        for response in (served, fallback):
+            assert response["type"] == "history"
+            assert len(response["data"]["messages"]) == 3
+        assert node["registry"].calls == [
+            (follower, "get_replica_history"),
+            (follower, "get_replica_history"),
+        ]
+        decisions = metrics.routing_decisions
+        assert decisions.value(purpose="history", peer=follower) == 1
+        assert decisions.value(purpose="history", peer="node-a") == 1
+        assert metrics.routing_fallbacks.value(purpose="history") == 1
+
+    @pytest.mark.asyncio
+    async def test_own_replica_served_locally(self):
+        """Test a follower reading its own replica without any call."""
+        cluster = Cluster(replication_factor=2)
+        cluster.nodes["node-b"]["detector"].record_success("node-a", 0.01)
+        ws_server = cluster.ws_server("node-b")
+
+        response = await cluster.get_history(ws_server)
+
+        assert len(response["data"]["messages"]) == 3
+        assert cluster.nodes["node-b"]["registry"].calls == []
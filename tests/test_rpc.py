@@ -0,0 +1,126 @@
+"""
+Tests for the Inter-Node RPC Layer
+
+Tests for the NodeService contract, the pooled XML-RPC client, and the
+get_room_info RPC.
+"""
+
+import threading
+import pytest
+from unittest.mock import Mock, patch
+
+from src.node import RoomStateManager, XMLRPCServer, PeerRegistry
+from src.node.rpc import NODE_SERVICE_METHODS, RPCClientPool, TimeoutTransport
+
+
+def test_node_service_methods_exist_on_server():
+    """Test that every contract method is implemented by the server."""
+    manager = RoomStateManager(node_id="test_node")
+    server = XMLRPCServer(
+        room_manager=manager,
+        host="localhost",
+        port=9090,
+        node_address="http://localhost:9090",
+    )
+    for method_name in NODE_SERVICE_METHODS:
+        assert callable(getattr(server, method_name))
+
+
+def test_pool_reuses_proxy_per_thread():
+    """Test that the pool caches one proxy per address and thread."""
+    pool = RPCClientPool(timeout=1)
+
+    proxy1 = pool.get_proxy("http://node2:9090")
+    proxy2 = pool.get_proxy("http://node2:9090")
+    assert proxy1 is proxy2
+
+    other = []
+    thread = threading.Thread(
+        target=lambda: other.append(pool.get_proxy("http://node2:9090"))
+    )
+    thread.start()
+    thread.join()
+    assert other[0] is not proxy1
+
+
+def test_pool_proxy_uses_timeout_transport():
+    """Test that proxies are created with the configured timeout."""
+    pool = RPCClientPool(timeout=7)
+    proxy = pool.get_proxy("http://node2:9090")
+    transport = proxy("transport")
+    assert isinstance(transport, TimeoutTransport)
+    assert transport.timeout == 7
+
+    override = pool.get_proxy("http://node2:9090", timeout=1)
+    assert override("transport").timeout == 1
+
+
+def test_pool_call_discards_proxy_on_failure():
+    """Test that a failing call drops the cached proxy."""
+    pool = RPCClientPool()
+    failing = Mock()
+    failing.heartbeat.side_effect = ConnectionError("down")
+
+    with patch.object(pool, "get_proxy", return_value=failing):
+        with patch.object(pool, "discard") as mock_discard:
+            with pytest.raises(ConnectionError):
+                pool.call("http://node2:9090", "heartbeat")
+            mock_discard.assert_called_once_with("http://node2:9090")
+
+
+def test_peer_registry_call_peer():
+    """Test calling a registered peer through the registry."""
+    registry = PeerRegistry(node_id="node1")
+    registry.register_peer("node2", "http://node2:9090")
+
+    with patch.object(registry.rpc, "call", return_value={"status": "ok"}):
+        result = registry.call_peer("node2", "heartbeat")
+        registry.rpc.call.assert_called_once_with(
+            "http://node2:9090", "heartbeat", timeout=None
+        )
+    assert result == {"status": "ok"}
+
+
+def test_peer_registry_call_unknown_peer():
+    """Test that calling an unknown peer raises ValueError."""
+    registry = PeerRegistry(node_id="node1")
+    with pytest.raises(ValueError, match="Unknown peer"):
+        registry.call_peer("node9", "heartbeat")
+
+
+def test_xmlrpc_get_room_info():
+    """Test get_room_info returns room details."""
+    manager = RoomStateManager(node_id="node1")
+    server = XMLRPCServer(
+        room_manager=manager,
+        host="localhost",
+        port=9090,
+        node_address="http://node1:9090",
+    )
+    room = manager.create_room("General", "alice", "Chat")
+    manager.add_member(room.room_id, "alice")
+
+    result = server.get_room_info(room.room_id)
+
+    assert result["success"] is True
+    info = result["room_info"]
+    assert info["room_name"] == "General"
+    assert info["members"] == ["alice"]
+    assert info["state"] == "ACTIVE"
+    assert info["node_address"] == "http://node1:9090"
+
+
+def test_xmlrpc_get_room_info_not_found():
+    """Test get_room_info for an unknown room."""
+    manager = RoomStateManager(node_id="node1")
+    server = XMLRPCServer(
+        room_manager=manager,
+        host="localhost",
+        port=9090,
+        node_address="http://node1:9090",
+    )
+
+    result = server.get_room_info("missing")
+
+    assert result["success"] is False
+    assert result["error_code"] == "ROOM_NOT_FOUND"
@@ -0,0 +1,179 @@
+"""
+Tests for Scheduled Messages
+
+Tests for scheduling, listing and cancelling messages, the admin node
+sending them when due, and pending messages being kept with the room
+across restarts, failovers and snapshots.
+"""
+
+import json
+from datetime import datetime, timedelta, timezone
+
+import pytest
+
+from src.node import RoomStateManager, ScheduleError, WebSocketServer
+from src.node.failover import merge_replicas
+from src.node.snapshot import RoomSnapshot
+from src.node.storage import MemoryStorage
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(json.loads(message))
+
+    def received(self, message_type):
+        return [
+            m["data"] for m in self.sent_messages if m["type"] == message_type
+        ]
+
+
+def _at(seconds):
+    return (datetime.now(timezone.utc) + timedelta(seconds=seconds)).isoformat()
+
+
+def _room(manager, *members):
+    room_id = manager.create_room("General", "alice").room_id
+    for username in members:
+        manager.add_member(room_id, username)
+    return room_id
+
+
+class TestScheduling:
+    """Tests for scheduling, listing and cancelling."""
+
+    def test_schedule_rejected(self):
+        """Test the error codes of messages that can't be scheduled."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "alice")
+        manager.schedule_message(room_id, "alice", "hi", _at(60), "m1")
+
+        for args, code in (
+            (("missing", "alice", "hi", _at(60)), "ROOM_NOT_FOUND"),
+            ((room_id, "bob", "hi", _at(60)), "NOT_MEMBER"),
+            ((room_id, "alice", "hi", "tomorrow"), "INVALID_SEND_AT"),
+            ((room_id, "alice", "hi", _at(40 * 86400)), "INVALID_SEND_AT"),
+            ((room_id, "alice", "hi", _at(60), "m1"), "DUPLICATE_MESSAGE_ID"),
+            ((room_id, "alice", "hi", _at(60), None, "x"), "PARENT_NOT_FOUND"),
+        ):
+            with pytest.raises(ScheduleError) as error:
+                manager.schedule_message(*args)
+            assert error.value.error_code == code
+
+    def test_list_and_cancel_permissions(self):
+        """Test members seeing their own messages and the owner everyone's."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "alice", "bob", "carol")
+        manager.schedule_message(room_id, "bob", "later", _at(120), "m2")
+        manager.schedule_message(room_id, "bob", "soon", _at(60), "m1")
+        manager.schedule_message(room_id, "carol", "hey", _at(90), "m3")
+
+        own = manager.list_scheduled(room_id, "bob")
+        everyone = manager.list_scheduled(room_id, "alice")
+        with pytest.raises(ScheduleError) as denied:
+            manager.cancel_scheduled(room_id, "carol", "m1")
+        manager.cancel_scheduled(room_id, "bob", "m1")
+        manager.cancel_scheduled(room_id, "alice", "m3")
+        with pytest.raises(ScheduleError) as missing:
+            manager.cancel_scheduled(room_id, "bob", "m1")
+
+        assert [s["message_id"] for s in own] == ["m1", "m2"]
+        assert [s["message_id"] for s in everyone] == ["m1", "m3", "m2"]
+        assert denied.value.error_code == "NOT_ALLOWED"
+        assert missing.value.error_code == "SCHEDULED_NOT_FOUND"
+        assert list(manager.get_scheduled(room_id)) == ["m2"]
+
+
+class TestSending:
+    """Tests for sending the messages that are due."""
+
+    def test_due_message_sent_as_author(self):
+        """Test the message posted with its ID, and banned authors dropped."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "alice", "bob", "carol")
+        manager.schedule_message(room_id, "bob", "hi", _at(60), "m1")
+        manager.schedule_message(room_id, "carol", "spam", _at(60), "m2")
+        manager.schedule_message(room_id, "bob", "later", _at(600), "m3")
+        manager.remove_member(room_id, "bob")
+        manager.moderate_member(room_id, "alice", "carol", ban=True)
+        now = datetime.now(timezone.utc) + timedelta(seconds=61)
+
+        due = manager.due_scheduled(now)
+        sent = [manager.send_scheduled(room_id, m) for _, m in due]
+
+        assert sorted(m for _, m in due) == ["m1", "m2"]
+        message = next(m for m in sent if m)
+        assert message["message_id"] == "m1"
+        assert message["username"] == "bob"
+        assert "scheduled_at" in message
+        assert None in sent
+        assert list(manager.get_scheduled(room_id)) == ["m3"]
+
+    def test_kept_across_restart_and_failover(self):
+        """Test recovery from the log, replica merges and snapshots."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node-a", message_log=storage)
+        room_id = _room(manager, "alice")
+        manager.schedule_message(room_id, "alice", "hi", _at(-1), "m1")
+        manager.schedule_message(room_id, "alice", "bye", _at(60), "m2")
+        stale = {"node_id": "node-b", **manager.get_room(room_id).to_dict()}
+        stale["scheduled"] = dict(manager.get_scheduled(room_id))
+        manager.send_scheduled(room_id, "m1")
+        current = {"node_id": "node-c", **manager.get_room(room_id).to_dict()}
+        current["messages"] = manager.get_messages(room_id)
+        current["scheduled"] = manager.get_scheduled(room_id)
+
+        recovered = RoomStateManager("node-a", message_log=storage)
+        recovered.recover_rooms()
+        merged = merge_replicas([stale, current], 100)
+
+        assert list(recovered.get_scheduled(room_id)) == ["m2"]
+        assert list(merged["scheduled"]) == ["m2"]
+        assert list(RoomSnapshot.from_room(manager, room_id).scheduled) == [
+            "m2"
+        ]
+
+
+class TestWebSocket:
+    """Tests for the client requests and delivery rounds."""
+
+    @pytest.mark.asyncio
+    async def test_scheduled_then_broadcast(self):
+        """Test message_scheduled, list_scheduled and the delivery round."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        room_id = _room(ws_server.room_manager, "alice")
+        websocket = MockWebSocket()
+        ws_server.register_client_room_membership(websocket, room_id, "alice")
+
+        for message_type, data in (
+            ("send_message", {"content": "hi", "send_at": _at(30)}),
+            ("list_scheduled", {}),
+            ("cancel_scheduled", {"message_id": "missing"}),
+        ):
+            await ws_server.process_message(
+                websocket,
+                json.dumps(
+                    {
+                        "type": message_type,
+                        "data": {"room_id": room_id, "username": "alice", **data},
+                    }
+                ),
+            )
+        early = await ws_server.post_scheduled_messages()
+        sent = await ws_server.post_scheduled_messages(
+            datetime.now(timezone.utc) + timedelta(seconds=31)
+        )
+
+        scheduled = websocket.received("message_scheduled")[0]["scheduled"]
+        listed = websocket.received("scheduled_messages")[0]["scheduled"]
+        error = websocket.received("schedule_error")[0]
+        assert listed == [scheduled]
+        assert error["error_code"] == "SCHEDULED_NOT_FOUND"
+        assert (early, sent) == (0, 1)
+        message = websocket.received("new_message")[0]
+        assert message["message_id"] == scheduled["message_id"]
+        assert websocket.received("message_sent") == []
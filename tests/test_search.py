@@ -0,0 +1,266 @@
+"""
+Tests for Message Search
+
+Tests for tokenizing, searching a room's history by words, author and
+time range, keeping the inverted index up to date as messages are added,
+edited and deleted, indexing the full history from the message log,
+leaving encrypted messages out, and the search command locally and
+through the admin node.
+"""
+
+import base64
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    RoomDirectory,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.edits import DELETE, EDIT
+from src.node.search import tokenize
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+def _room(manager, *messages, private=False):
+    room = manager.create_room("General", "alice", private=private)
+    for username in ("alice", "bob"):
+        manager.add_member(room.room_id, username)
+    for username, content in messages:
+        manager.add_message(room.room_id, username, content)
+    return room.room_id
+
+
+def _contents(result):
+    return [m["content"] for m in result["messages"]]
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+MESSAGES = (
+    ("alice", "The deploy is green"),
+    ("bob", "Deploy failed again, rolling back"),
+    ("alice", "Lunch?"),
+    ("bob", "green light for the DEPLOY"),
+)
+
+
+class TestSearch:
+    """Tests for searching a room's history."""
+
+    def test_tokenize(self):
+        """Test that words are lowercased, split on punctuation and unique."""
+        assert tokenize("Deploy, deploy: it's GREEN!") == [
+            "deploy",
+            "it",
+            "s",
+            "green",
+        ]
+        assert tokenize(None) == []
+
+    def test_all_words_must_match(self):
+        """Test that results hold every word, newest first."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, *MESSAGES)
+
+        result = manager.search_messages(room_id, "alice", "green deploy")
+
+        assert result["success"]
+        assert _contents(result) == [
+            "green light for the DEPLOY",
+            "The deploy is green",
+        ]
+        assert result["total"] == 2
+        assert _contents(manager.search_messages(room_id, "alice", "dep")) == []
+
+    def test_filters_and_limit(self):
+        """Test the author and time filters and the result limit."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, *MESSAGES)
+        third = manager.get_messages(room_id)[2]["timestamp"]
+
+        by_bob = manager.search_messages(room_id, "alice", "deploy", author="bob")
+        recent = manager.search_messages(room_id, "alice", "", since=third)
+        older = manager.search_messages(room_id, "alice", "", until=third)
+        limited = manager.search_messages(room_id, "alice", "deploy", limit=1)
+
+        assert _contents(by_bob) == [
+            "green light for the DEPLOY",
+            "Deploy failed again, rolling back",
+        ]
+        assert _contents(recent) == ["green light for the DEPLOY", "Lunch?"]
+        assert len(older["messages"]) == 3
+        assert len(limited["messages"]) == 1
+        assert limited["total"] == 3
+
+    def test_index_follows_new_edited_and_deleted_messages(self):
+        """Test that the index is updated once it has been built."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, *MESSAGES)
+        assert manager.search_messages(room_id, "alice", "lunch")["total"] == 1
+
+        added = manager.add_message(room_id, "bob", "lunch at noon")
+        lunch = manager.get_messages(room_id)[2]["message_id"]
+        manager.edit_message(room_id, "alice", lunch, EDIT, "Dinner?")
+        deploy = manager.get_messages(room_id)[0]["message_id"]
+        manager.edit_message(room_id, "alice", deploy, DELETE)
+
+        assert _contents(manager.search_messages(room_id, "alice", "lunch")) == [
+            added["content"]
+        ]
+        assert _contents(manager.search_messages(room_id, "alice", "dinner")) == [
+            "Dinner?"
+        ]
+        assert manager.search_messages(room_id, "alice", "green")["total"] == 1
+
+    def test_full_history_from_log(self, tmp_path):
+        """Test that messages beyond the buffer are searched after a restart."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager)
+        for number in range(5):
+            manager.add_message(room_id, "alice", f"note {number}", max_messages=2)
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms(max_messages=2)
+        result = recovered.search_messages(room_id, "alice", "note")
+
+        assert len(recovered.get_messages(room_id)) == 2
+        assert result["total"] == 5
+
+    def test_encrypted_messages_not_indexed(self):
+        """Test that ciphertext never shows up in results."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, private=True)
+        ciphertext = base64.b64encode(b"deploy").decode()
+        envelope = {
+            "algorithm": "x25519-xsalsa20-poly1305",
+            "sender_key_id": "alice-1",
+            "nonce": base64.b64encode(b"n" * 24).decode(),
+            "recipients": {
+                "bob": {
+                    "key_id": "bob-1",
+                    "wrapped_key": base64.b64encode(b"w" * 48).decode(),
+                }
+            },
+        }
+        manager.add_message(room_id, "alice", ciphertext, encryption=envelope)
+
+        result = manager.search_messages(room_id, "bob", "", author="alice")
+
+        assert result["total"] == 0
+
+    def test_rejections(self):
+        """Test invalid queries, unknown rooms and private room outsiders."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, *MESSAGES)
+        private_id = manager.create_room("Secret", "alice", private=True).room_id
+
+        for args, kwargs, code in (
+            ((room_id, "alice", ""), {}, "INVALID_QUERY"),
+            ((room_id, "alice", "x" * 201), {}, "INVALID_QUERY"),
+            ((room_id, "alice", "a b c d e f g h i j k"), {}, "INVALID_QUERY"),
+            ((room_id, "alice", "deploy"), {"since": "yesterday"}, "INVALID_QUERY"),
+            ((room_id, "alice", "deploy"), {"limit": 0}, "INVALID_QUERY"),
+            (("missing", "alice", "deploy"), {}, "ROOM_NOT_FOUND"),
+            ((private_id, "mallory", "deploy"), {}, "NOT_A_MEMBER"),
+        ):
+            result = manager.search_messages(*args, **kwargs)
+            assert result["error_code"] == code
+
+
+class TestSearchCommand:
+    """Tests for the search command."""
+
+    @pytest.mark.asyncio
+    async def test_local_search(self):
+        """Test search_results and search_error on the admin node."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, *MESSAGES)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+
+        found = await _request(
+            ws_server,
+            alice,
+            "search",
+            room_id=room_id,
+            username="alice",
+            query="deploy",
+            author="alice",
+        )
+        refused = await _request(
+            ws_server, alice, "search", room_id=room_id, username="alice"
+        )
+
+        assert found["type"] == "search_results"
+        assert found["data"]["total"] == 1
+        assert found["data"]["messages"][0]["content"] == "The deploy is green"
+        assert refused["type"] == "search_error"
+        assert refused["data"]["error_code"] == "INVALID_QUERY"
+
+    @pytest.mark.asyncio
+    async def test_search_through_admin(self):
+        """Test that another node forwards search to the admin node."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, *MESSAGES)
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+        bob = _join(ws_b, room_id, "bob")
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            response = await _request(
+                ws_b,
+                bob,
+                "search",
+                room_id=room_id,
+                username="bob",
+                query="GREEN",
+                limit=1,
+            )
+
+        assert response["type"] == "search_results"
+        assert response["data"]["total"] == 2
+        assert [m["content"] for m in response["data"]["messages"]] == [
+            "green light for the DEPLOY"
+        ]
@@ -0,0 +1,205 @@
+"""
+Tests for Room Seeding
+
+Tests for checking fixtures, seeding rooms with their members and
+imported history, and loading fixtures through POST /admin/seed and the
+seed command.
+"""
+
+import asyncio
+import http.client
+import json
+
+import pytest
+
+from src.node import (
+    AdminAPI,
+    AdminServer,
+    MemoryStorage,
+    RoomStateManager,
+    SeedError,
+    WebSocketServer,
+)
+from src.node import admin_api
+from src.node.seed import main, parse_fixture, post_fixture
+
+TOKEN = "s3cret"
+DEMO_FIXTURE = "deployment/demo/fixtures/demo.json"
+
+
+def _fixture(**room):
+    """A fixture with one room, General, created by alice."""
+    return {"rooms": [dict({"room_name": "General", "creator": "alice"}, **room)]}
+
+
+class TestParseFixture:
+    """Tests for checking fixtures."""
+
+    def test_demo_fixture(self):
+        """Test the shipped demo fixture and the defaults filled in."""
+        with open(DEMO_FIXTURE, encoding="utf-8") as handle:
+            general, ops = parse_fixture(json.load(handle))
+        (plain,) = parse_fixture(_fixture(members=["bob"]))
+
+        assert len(general["messages"]) == 3
+        assert ops["private"] is True
+        assert plain["members"] == ["alice", "bob"]
+        assert (plain["roles"], plain["banned"], plain["messages"]) == ({}, [], [])
+
+    def test_malformed_fixtures(self):
+        """Test that each malformed fixture is refused."""
+        message = {"username": "alice", "content": "hi"}
+        for fixture in (
+            [],
+            {"rooms": []},
+            {"rooms": ["General"]},
+            _fixture(topic="extra"),
+            _fixture(creator=""),
+            _fixture(private="yes"),
+            _fixture(members=["bob"], banned=["bob"]),
+            _fixture(roles={"carol": "moderator"}),
+            _fixture(members=["bob"], roles={"bob": "owner"}),
+            _fixture(messages=[dict(message, username="mallory")]),
+            _fixture(messages=[dict(message, timestamp="noon")]),
+            _fixture(messages=[dict(message, message_id="m1")] * 2),
+            _fixture(messages=[dict(message, message_id="m1", reply_to="m1")]),
+            _fixture(messages=[dict(message, reactions={"👍": "bob"})]),
+        ):
+            with pytest.raises(SeedError) as error:
+                parse_fixture(fixture)
+            assert error.value.error_code == "INVALID_FIXTURE"
+
+
+class TestSeedRoom:
+    """Tests for seeding rooms with imported history."""
+
+    def test_seeded_room_and_history(self):
+        """Test members, roles, messages and the room surviving a restart."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node-a", storage)
+        messages = [
+            {
+                "message_id": "m1",
+                "username": "alice",
+                "content": f"message {i}",
+                "timestamp": f"2026-01-05T09:{i:02d}:00+00:00",
+                "reactions": {"👍": ["bob"]},
+            }
+            for i in range(5)
+        ]
+        for i, message in enumerate(messages[1:], start=2):
+            message.update(message_id=f"m{i}", reply_to="m1", reactions={})
+        (seed,) = parse_fixture(
+            _fixture(
+                members=["bob"],
+                roles={"bob": "moderator"},
+                banned=["mallory"],
+                messages=messages,
+            )
+        )
+
+        room = manager.seed_room(seed, "admin", max_messages=2)
+        recovered = RoomStateManager("node-a", storage)
+        recovered.recover_rooms()
+        history = recovered.get_history(room.room_id, "bob", limit=10)
+
+        assert room.members == {"alice", "bob"}
+        assert (room.roles, room.banned) == ({"bob": "moderator"}, {"mallory"})
+        assert room.message_counter == 5 and len(room.messages) == 2
+        root = history["messages"][0]
+        assert root["timestamp"] == "2026-01-05T09:00:00+00:00"
+        assert root["reactions"] == {"👍": ["bob"]}
+        assert root["thread"] == {
+            "reply_count": 4,
+            "last_reply_at": "2026-01-05T09:04:00+00:00",
+        }
+        assert history["messages"][-1]["thread_id"] == "m1"
+        assert len(history["messages"]) == 5
+        recovered.add_member(room.room_id, "bob")
+        added = recovered.add_message(room.room_id, "bob", "new")
+        assert added["sequence_number"] == 6
+        with pytest.raises(SeedError) as error:
+            manager.seed_room(dict(seed, room_name="general"), "admin")
+        assert error.value.error_code == "ROOM_NAME_TAKEN"
+
+
+def _post(port, body):
+    connection = http.client.HTTPConnection("127.0.0.1", port, timeout=5)
+    try:
+        connection.request(
+            "POST",
+            "/admin/seed",
+            body=body,
+            headers={"Authorization": f"Bearer {TOKEN}"},
+        )
+        response = connection.getresponse()
+        return response.status, json.loads(response.read())
+    finally:
+        connection.close()
+
+
+class TestSeedEndpoint:
+    """Tests for POST /admin/seed and the seed command."""
+
+    @pytest.mark.asyncio
+    async def test_seed_endpoint(self):
+        """Test seeding, a skipped room and refused bodies."""
+        manager = RoomStateManager("node-a")
+        manager.create_room("Ops", "erin")
+        api = AdminAPI(WebSocketServer(manager, "localhost", 0))
+        with open(DEMO_FIXTURE, encoding="utf-8") as handle:
+            fixture = json.load(handle)
+
+        result = await api.handle("POST", "/admin/seed", None, fixture)
+        invalid = await api.handle("POST", "/admin/seed", None, {"rooms": 1})
+        wrong_method = await api.handle("GET", "/admin/seed")
+
+        (seeded,) = result["rooms"]
+        assert (seeded["room_name"], seeded["message_count"]) == ("General", 3)
+        assert result["skipped"][0]["error_code"] == "ROOM_NAME_TAKEN"
+        assert manager.get_room(seeded["room_id"]).roles == {"bob": "moderator"}
+        assert invalid["error_code"] == "INVALID_FIXTURE"
+        assert wrong_method["error_code"] == "METHOD_NOT_ALLOWED"
+
+    @pytest.mark.asyncio
+    async def test_seed_over_http(self):
+        """Test the command, the body read by the server and bad bodies."""
+        manager = RoomStateManager("node-a")
+        server = AdminServer(
+            AdminAPI(WebSocketServer(manager, "localhost", 0)),
+            TOKEN,
+            "127.0.0.1",
+            0,
+        )
+        server.start()
+        url = f"http://127.0.0.1:{server.port}"
+        loop = asyncio.get_running_loop()
+        limit, admin_api.MAX_BODY_SIZE = admin_api.MAX_BODY_SIZE, 1000
+        try:
+            with pytest.raises(SystemExit) as exited:
+                await loop.run_in_executor(
+                    None, main, [DEMO_FIXTURE, "--url", url, "--token", TOKEN]
+                )
+            again = await loop.run_in_executor(
+                None, post_fixture, url, TOKEN, _fixture(members=["bob"])
+            )
+            not_json = await loop.run_in_executor(
+                None, _post, server.port, b"{rooms"
+            )
+            too_large = await loop.run_in_executor(
+                None, _post, server.port, b" " * 1001
+            )
+        finally:
+            admin_api.MAX_BODY_SIZE = limit
+            server.stop()
+
+        assert exited.value.code == 0
+        assert sorted(room["room_name"] for room in manager.list_rooms()) == [
+            "General",
+            "Ops",
+        ]
+        assert again[0] == 200
+        assert again[1]["skipped"][0]["room_name"] == "General"
+        assert not_json[0] == 400
+        assert not_json[1]["error_code"] == "INVALID_REQUEST"
+        assert too_large[0] == 413
@@ -293,13 +293,15 @@ async def test_websocket_send_message_success():
 
     await ws_server.process_message(mock_ws, request)
 
-    # Should get both new_message broadcast and message_sent confirmation
-    assert len(mock_ws.sent_messages) == 2
+    # Should get the new_message broadcast, message_sent confirmation and
+    # message_status acknowledgment
+    assert len(mock_ws.sent_messages) == 3
 
     # Check for new_message broadcast
     messages_types = [json.loads(msg)["type"] for msg in mock_ws.sent_messages]
     assert "new_message" in messages_types
     assert "message_sent" in messages_types
+    assert "message_status" in messages_types
 
     # Check message_sent confirmation
     for msg in mock_ws.sent_messages:
@@ -655,14 +657,13 @@ async def test_client_service_send_message_success():
     mock_ws = MockWebSocketClient()
     service._set_test_mode(mock_websocket=mock_ws)
 
-    # send_message is now fire-and-forget, returns None
+    # send_message is fire-and-forget, returns the generated message ID
     result = await service.send_message("room-123", "alice", "Hello everyone!")
 
-    assert result is None  # Fire-and-forget, no return value
-
     # Verify request was sent
     assert len(mock_ws.sent_messages) == 1
     sent_msg = json.loads(mock_ws.sent_messages[0])
+    assert sent_msg["data"]["message_id"] == result
     assert sent_msg["type"] == "send_message"
     assert sent_msg["data"]["room_id"] == "room-123"
     assert sent_msg["data"]["username"] == "alice"
@@ -686,5 +687,5 @@ async def test_client_service_send_message_error():
 
     # send_message is fire-and-forget, should not raise
     result = await service.send_message("room-123", "alice", "Hello!")
-    assert result is None
+    assert result
     assert len(mock_ws.sent_messages) == 1
@@ -0,0 +1,297 @@
+"""
+Tests for Bounded WebSocket Send Queues
+
+Tests for the overflow policies, the slow_consumer warning, the queue
+depth metrics, frames shared by recipients and written in batches, the
+websockets methods batches are written with, and broadcasts not waiting
+for slow clients.
+"""
+
+import asyncio
+import inspect
+import json
+
+import pytest
+
+from src.node import NodeMetrics, RoomStateManager, WebSocketServer
+from src.node.send_queue import (
+    DISCONNECT,
+    DROP_NEWEST,
+    DROP_OLDEST,
+    SEND_BATCH_SIZE,
+    SLOW_CONSUMER_CLOSE_CODE,
+    TEXT_OPCODE,
+    TRANSPORT_METHODS,
+    FrameWriter,
+    SendQueue,
+    encode_frame,
+)
+
+
+class SlowWebSocket:
+    """Mock WebSocket whose sends wait until the test releases them."""
+
+    def __init__(self, blocked=True):
+        self.sent = []
+        self.closed = None
+        self.released = asyncio.Event()
+        if not blocked:
+            self.released.set()
+        self._commands = asyncio.Queue()
+
+    async def send(self, message):
+        await self.released.wait()
+        self.sent.append(json.loads(message))
+
+    async def close(self, code=1000, reason=""):
+        self.closed = code
+        await self._commands.put(None)
+
+    def __aiter__(self):
+        return self
+
+    async def __anext__(self):
+        command = await self._commands.get()
+        if command is None:
+            raise StopAsyncIteration
+        return command
+
+
+class TransportWebSocket:
+    """Mock of a websockets connection that writes frames directly."""
+
+    def __init__(self):
+        self.frames = []
+        self.drains = 0
+
+    async def ensure_open(self):
+        pass
+
+    def write_frame_sync(self, fin, opcode, data):
+        self.frames.append((fin, opcode, data))
+
+    async def drain(self):
+        self.drains += 1
+
+    def messages(self):
+        return [json.loads(data) for _, _, data in self.frames]
+
+
+def _fill(queue, count):
+    for i in range(count):
+        queue.put(json.dumps({"type": "new_message", "data": {"n": i}}))
+
+
+def _numbers(sent):
+    return [m["data"]["n"] for m in sent if m["type"] == "new_message"]
+
+
+class TestSendQueue:
+    """Tests for a single client's send queue."""
+
+    @pytest.mark.asyncio
+    async def test_drop_oldest(self):
+        """Test that a full queue drops its oldest messages first."""
+        websocket = SlowWebSocket(blocked=False)
+        queue = SendQueue(websocket, max_size=3, policy=DROP_OLDEST)
+
+        _fill(queue, 5)
+        queue.start()
+        await queue.close()
+
+        assert _numbers(websocket.sent) == [2, 3, 4]
+        assert queue.dropped == 2
+
+    @pytest.mark.asyncio
+    async def test_drop_newest(self):
+        """Test that a full queue drops new messages under drop_newest."""
+        websocket = SlowWebSocket(blocked=False)
+        queue = SendQueue(websocket, max_size=3, policy=DROP_NEWEST)
+
+        _fill(queue, 5)
+        queue.start()
+        await queue.close()
+
+        assert _numbers(websocket.sent) == [0, 1, 2]
+        assert queue.dropped == 2
+
+    @pytest.mark.asyncio
+    async def test_disconnect(self):
+        """Test that a full queue closes the connection under disconnect."""
+        websocket = SlowWebSocket()
+        overflows = []
+        queue = SendQueue(
+            websocket, max_size=2, policy=DISCONNECT, on_overflow=overflows.append
+        )
+
+        _fill(queue, 3)
+        await asyncio.sleep(0)
+
+        assert queue.closed
+        assert websocket.closed == SLOW_CONSUMER_CLOSE_CODE
+        assert overflows == [DISCONNECT]
+        assert queue.put("{}") is False
+
+    @pytest.mark.asyncio
+    async def test_slow_consumer_warned_once(self):
+        """Test that the warning goes ahead of the queued messages once."""
+        websocket = SlowWebSocket(blocked=False)
+        queue = SendQueue(websocket, max_size=10)
+
+        _fill(queue, 12)
+        queue.start()
+        await queue.close()
+
+        warnings = [m for m in websocket.sent if m["type"] == "slow_consumer"]
+        assert len(warnings) == 1
+        assert websocket.sent[0]["type"] == "slow_consumer"
+        assert warnings[0]["data"]["queue_depth"] == 8
+        assert warnings[0]["data"]["policy"] == DROP_OLDEST
+
+    def test_unknown_policy_rejected(self):
+        """Test that only the known policies are accepted."""
+        with pytest.raises(ValueError):
+            SendQueue(object(), policy="block")
+
+
+class TestFrames:
+    """Tests for frames shared by recipients and batched writes."""
+
+    @pytest.mark.asyncio
+    async def test_frames_shared_and_batched(self):
+        """Test one encoding per message and one drain per batch."""
+        first, second = TransportWebSocket(), TransportWebSocket()
+        queues = [SendQueue(first), SendQueue(second)]
+        frames = [
+            encode_frame({"type": "new_message", "data": {"n": i}})
+            for i in range(SEND_BATCH_SIZE + 1)
+        ]
+
+        for frame in frames:
+            for queue in queues:
+                queue.put(frame)
+        for queue in queues:
+            queue.start()
+            await queue.close()
+
+        assert _numbers(first.messages()) == list(range(SEND_BATCH_SIZE + 1))
+        assert first.drains == second.drains == 2
+        assert all(
+            mine is theirs
+            for (_, _, mine), (_, _, theirs) in zip(first.frames, second.frames)
+        )
+        assert first.frames[0][:2] == (True, TEXT_OPCODE)
+
+    @pytest.mark.asyncio
+    async def test_broadcast_encodes_once(self):
+        """Test that a broadcast's recipients get the same bytes."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        websockets = [TransportWebSocket() for _ in range(3)]
+        for websocket, username in zip(websockets, ("alice", "bob", "carol")):
+            connection = ws_server.connections.register(websocket)
+            connection.send_queue = SendQueue(websocket)
+            ws_server.register_client_room_membership(
+                websocket, room.room_id, username
+            )
+
+        await ws_server.broadcast_to_room(
+            room.room_id, {"type": "member_joined", "data": {"n": 0}}
+        )
+        for websocket in websockets:
+            queue = ws_server.connections.get(websocket).send_queue
+            queue.start()
+            await queue.close()
+
+        first, *others = [websocket.frames[0][2] for websocket in websockets]
+        assert json.loads(first)["type"] == "member_joined"
+        assert all(data is first for data in others)
+
+
+class TestFrameWriter:
+    """Tests for writing batches to websockets and other connections."""
+
+    @pytest.mark.asyncio
+    async def test_batches_written_to_transport(self):
+        """Test a batch written as text frames with one drain."""
+        websocket = TransportWebSocket()
+        writer = FrameWriter(websocket)
+        batch = [
+            encode_frame({"type": "new_message", "data": {"n": i}})
+            for i in range(3)
+        ]
+
+        await writer.write(batch)
+
+        assert writer.batched
+        assert websocket.frames == [
+            (True, TEXT_OPCODE, frame.data) for frame in batch
+        ]
+        assert websocket.drains == 1
+
+    @pytest.mark.asyncio
+    async def test_other_connections_sent_each_message(self):
+        """Test a connection without the methods given each with send()."""
+        websocket = SlowWebSocket(blocked=False)
+        writer = FrameWriter(websocket)
+
+        await writer.write([encode_frame({"type": "pong", "data": {}})] * 2)
+
+        assert not writer.batched
+        assert [m["type"] for m in websocket.sent] == ["pong", "pong"]
+
+    def test_websockets_has_the_methods(self):
+        """Test the installed websockets still has the methods used."""
+        try:
+            from websockets.legacy.protocol import WebSocketCommonProtocol
+        except ImportError:
+            pytest.skip("websockets legacy protocol not installed")
+
+        for name in TRANSPORT_METHODS:
+            assert callable(getattr(WebSocketCommonProtocol, name, None))
+        write_frame = WebSocketCommonProtocol.write_frame_sync
+        assert list(inspect.signature(write_frame).parameters) == [
+            "self",
+            "fin",
+            "opcode",
+            "data",
+        ]
+        assert not inspect.iscoroutinefunction(write_frame)
+        assert inspect.iscoroutinefunction(WebSocketCommonProtocol.drain)
+        assert inspect.iscoroutinefunction(
+            WebSocketCommonProtocol.ensure_open
+        )
+
+
+class TestServer:
+    """Tests for send queues of the WebSocket server's clients."""
+
+    @pytest.mark.asyncio
+    async def test_broadcast_not_held_up_by_slow_client(self):
+        """Test that broadcasts return while a client isn't reading."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("General", "alice")
+        metrics = NodeMetrics()
+        ws_server = WebSocketServer(
+            manager, "localhost", 0, metrics=metrics, send_queue_size=5
+        )
+        slow = SlowWebSocket()
+        serving = asyncio.ensure_future(ws_server.handle_client(slow))
+        await asyncio.sleep(0)
+        ws_server.register_client_room_membership(slow, room.room_id, "bob")
+
+        for i in range(8):
+            await ws_server.broadcast_to_room(
+                room.room_id, {"type": "new_message", "data": {"n": i}}
+            )
+
+        depth = metrics.registry.get("chat_websocket_send_queue_messages")
+        assert depth.value() == 5
+        assert metrics.send_queue_overflows.value(policy=DROP_OLDEST) == 3
+
+        slow.released.set()
+        await slow.close()
+        await asyncio.wait_for(serving, timeout=1)
+        assert _numbers(slow.sent) == [3, 4, 5, 6, 7]
+        assert slow.sent[0]["type"] == "slow_consumer"
@@ -0,0 +1,408 @@
+"""
+Tests for Service Accounts
+
+Tests for provisioning service accounts and checking their API keys,
+keeping them in every storage backend, limiting their commands and
+deliveries to their scopes and rooms over WebSocket, and the admin API
+endpoints managing them.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    AuthManager,
+    RoomStateManager,
+    ServiceAccountRegistry,
+    WebSocketServer,
+)
+from src.node.admin_api import AdminAPI
+from src.node.service_accounts import ServiceAccountError
+from src.node.sqlite_storage import SQLiteStorage
+from src.node.storage import MemoryStorage
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+        self.closed = None
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    async def close(self, code, reason):
+        self.closed = (code, reason)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+def _connect(ws_server):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    return websocket
+
+
+class Node:
+    """A node hosting rooms General and Alerts, with alice in both."""
+
+    def __init__(self, auth=None):
+        self.manager = RoomStateManager("node-a")
+        self.general = self.manager.create_room("General", "alice").room_id
+        self.alerts = self.manager.create_room("Alerts", "alice").room_id
+        self.accounts = ServiceAccountRegistry("node-a")
+        self.ws_server = WebSocketServer(
+            self.manager,
+            "localhost",
+            0,
+            auth=auth,
+            service_accounts=self.accounts,
+        )
+        self.alice = _connect(self.ws_server)
+        for room_id in (self.general, self.alerts):
+            self.ws_server.register_client_room_membership(
+                self.alice, room_id, "alice"
+            )
+            self.manager.add_member(room_id, "alice")
+
+    async def login(self, name, scopes, rooms=None):
+        """Provision an account and log a connection in as it."""
+        _, api_key = self.accounts.create(name, scopes, rooms)
+        websocket = _connect(self.ws_server)
+        response = await _request(
+            self.ws_server,
+            websocket,
+            "service_login",
+            account=name,
+            api_key=api_key,
+        )
+        assert response["type"] == "service_login_success"
+        return websocket
+
+
+class TestRegistry:
+    """Tests for provisioning accounts and their API keys."""
+
+    def test_create_and_authenticate(self):
+        """Test that only the returned API key logs the account in."""
+        registry = ServiceAccountRegistry("node-a")
+        account, api_key = registry.create("monitor", ["post", "post"], ["r1"])
+
+        assert account == {
+            "name": "monitor",
+            "scopes": ["post"],
+            "rooms": ["r1"],
+            "created_at": account["created_at"],
+        }
+        assert registry.authenticate("monitor", api_key).scopes == ["post"]
+        assert api_key not in json.dumps(registry.get("monitor").to_dict())
+        assert registry.without_scope("read") == {"monitor"}
+        for name, key in (("monitor", "wrong"), ("nobody", api_key)):
+            with pytest.raises(ServiceAccountError) as error:
+                registry.authenticate(name, key)
+            assert error.value.error_code == "INVALID_API_KEY"
+
+    def test_rejections(self):
+        """Test invalid names, scopes and rooms, and taken names."""
+        registry = ServiceAccountRegistry("node-a")
+        registry.create("monitor", ["read"])
+
+        for name, scopes, rooms, code in (
+            ("bad name!", ["read"], None, "INVALID_ACCOUNT_NAME"),
+            ("other", [], None, "INVALID_SCOPES"),
+            ("other", ["admin"], None, "INVALID_SCOPES"),
+            ("other", ["read"], "r1", "INVALID_REQUEST"),
+            ("monitor", ["read"], None, "ACCOUNT_NAME_TAKEN"),
+        ):
+            with pytest.raises(ServiceAccountError) as error:
+                registry.create(name, scopes, rooms)
+            assert error.value.error_code == code
+
+        registry.remove("monitor")
+        with pytest.raises(ServiceAccountError) as error:
+            registry.remove("monitor")
+        assert error.value.error_code == "ACCOUNT_NOT_FOUND"
+        assert registry.list_accounts() == []
+
+    def test_refusal(self):
+        """Test commands checked against scopes, rooms and identity."""
+        registry = ServiceAccountRegistry("node-a")
+        registry.create("alerts", ["post"], ["r1"])
+        account = registry.get("alerts")
+
+        assert account.refusal("send_message", {"room_id": "r1"}) is None
+        assert account.refusal("pong", {}) is None
+        assert account.refusal("send_message", {"room_id": "r2"})
+        assert account.refusal("get_history", {"room_id": "r1"})
+        assert account.refusal("create_room", {"creator_id": "alerts"})
+        assert account.refusal(
+            "send_message", {"room_id": "r1", "username": "alice"}
+        )
+
+    def test_accounts_survive_restart(self, tmp_path):
+        """Test that each storage backend keeps accounts and removals."""
+        for make_storage in (
+            lambda: MessageLog(str(tmp_path / "wal")),
+            lambda: SQLiteStorage(str(tmp_path / "node.db")),
+        ):
+            registry = ServiceAccountRegistry("node-a", make_storage())
+            _, api_key = registry.create("monitor", ["read"], ["r1"])
+            registry.create("poster", ["post"])
+            registry.remove("poster")
+
+            reloaded = ServiceAccountRegistry("node-a", make_storage())
+
+            assert [a["name"] for a in reloaded.list_accounts()] == ["monitor"]
+            assert reloaded.authenticate("monitor", api_key).rooms == ["r1"]
+
+        memory = MemoryStorage()
+        ServiceAccountRegistry("node-a", memory).create("monitor", ["dm"])
+        assert ServiceAccountRegistry("node-a", memory).get("monitor")
+
+
+class TestWebSocket:
+    """Tests for service accounts over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_post_only_account(self):
+        """Test posting to its room only, without receiving messages."""
+        node = Node()
+        bot = await node.login("alerts", ["post"], [node.alerts])
+
+        joined = await _request(
+            node.ws_server,
+            bot,
+            "join_room",
+            room_id=node.alerts,
+            username="alerts",
+        )
+        await _request(
+            node.ws_server,
+            bot,
+            "send_message",
+            room_id=node.alerts,
+            username="alerts",
+            content="disk full",
+        )
+        other_room = await _request(
+            node.ws_server,
+            bot,
+            "join_room",
+            room_id=node.general,
+            username="alerts",
+        )
+        history = await _request(
+            node.ws_server,
+            bot,
+            "get_history",
+            room_id=node.alerts,
+            username="alerts",
+        )
+        await _request(
+            node.ws_server,
+            node.alice,
+            "send_message",
+            room_id=node.alerts,
+            username="alice",
+            content="on it",
+        )
+
+        assert joined["type"] == "join_room_success"
+        assert bot.received("message_sent")
+        assert other_room["data"]["error_code"] == "OUT_OF_SCOPE"
+        assert history["data"]["error_code"] == "OUT_OF_SCOPE"
+        assert history["data"]["category"] == "forbidden"
+        contents = [m["content"] for m in node.alice.received("new_message")]
+        assert contents == ["disk full", "on it"]
+        assert bot.received("new_message") == []
+        client = node.ws_server.connections.get(bot).to_dict()
+        assert client["service_account"] == "alerts"
+
+    @pytest.mark.asyncio
+    async def test_read_only_account(self):
+        """Test receiving messages, but not posting, DMs or impersonation."""
+        node = Node()
+        watcher = await node.login("watcher", ["read"])
+        await _request(
+            node.ws_server,
+            watcher,
+            "join_room",
+            room_id=node.general,
+            username="watcher",
+        )
+
+        posted = await _request(
+            node.ws_server,
+            watcher,
+            "send_message",
+            room_id=node.general,
+            username="watcher",
+            content="hi",
+        )
+        direct = await _request(
+            node.ws_server,
+            watcher,
+            "send_direct_message",
+            username="watcher",
+            recipient="alice",
+            content="hi",
+        )
+        impostor = await _request(
+            node.ws_server,
+            watcher,
+            "get_history",
+            room_id=node.general,
+            username="alice",
+        )
+        await _request(
+            node.ws_server,
+            node.alice,
+            "send_message",
+            room_id=node.general,
+            username="alice",
+            content="hello",
+        )
+        await _request(
+            node.ws_server,
+            node.alice,
+            "send_direct_message",
+            username="alice",
+            recipient="watcher",
+            content="psst",
+        )
+
+        assert posted["data"]["error_code"] == "OUT_OF_SCOPE"
+        assert direct["data"]["error_code"] == "OUT_OF_SCOPE"
+        assert impostor["data"]["error_code"] == "OUT_OF_SCOPE"
+        received = watcher.received("new_message")
+        assert [m["content"] for m in received] == ["hello"]
+        assert watcher.received("direct_message") == []
+
+    @pytest.mark.asyncio
+    async def test_login_with_auth(self):
+        """Test session tokens, bad keys and names shared with users."""
+        auth = AuthManager("node-a", b"secret", required=True)
+        node = Node(auth)
+        _, api_key = node.accounts.create("monitor", ["read"])
+        websocket = _connect(node.ws_server)
+
+        refused = await _request(
+            node.ws_server,
+            websocket,
+            "service_login",
+            account="monitor",
+            api_key="wrong",
+        )
+        logged_in = await _request(
+            node.ws_server,
+            websocket,
+            "service_login",
+            account="monitor",
+            api_key=api_key,
+        )
+        impostor = await _request(
+            node.ws_server,
+            _connect(node.ws_server),
+            "register",
+            username="monitor",
+            password="password123",
+        )
+
+        assert refused["type"] == "service_login_error"
+        assert refused["data"]["error_code"] == "INVALID_API_KEY"
+        token = logged_in["data"]["token"]
+        assert auth.verify_token(token)["username"] == "monitor"
+        assert logged_in["data"]["scopes"] == ["read"]
+        assert impostor["data"]["error_code"] == "USERNAME_TAKEN"
+
+    @pytest.mark.asyncio
+    async def test_disabled(self):
+        """Test that service_login is refused without a registry."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            _connect(ws_server),
+            "service_login",
+            account="monitor",
+            api_key="key",
+        )
+
+        assert response["data"]["error_code"] == "SERVICE_ACCOUNTS_DISABLED"
+
+
+class TestAdminAPI:
+    """Tests for managing service accounts through the admin API."""
+
+    @pytest.mark.asyncio
+    async def test_provision_list_and_remove(self):
+        """Test the API key returned once, and removal closing sessions."""
+        auth = AuthManager("node-a", b"secret")
+        auth.register("alice", "password123")
+        node = Node(auth)
+        api = AdminAPI(node.ws_server)
+
+        created = await api.handle(
+            "POST",
+            "/admin/service-accounts",
+            body={"name": "alerts", "scopes": ["post"], "rooms": [node.alerts]},
+        )
+        taken = await api.handle(
+            "POST",
+            "/admin/service-accounts",
+            body={"name": "alice", "scopes": ["read"]},
+        )
+        invalid = await api.handle(
+            "POST", "/admin/service-accounts", body=["alerts"]
+        )
+        listed = await api.handle("GET", "/admin/service-accounts")
+        websocket = _connect(node.ws_server)
+        await _request(
+            node.ws_server,
+            websocket,
+            "service_login",
+            account="alerts",
+            api_key=created["api_key"],
+        )
+        client_id = node.ws_server.connections.get(websocket).client_id
+        removed = await api.handle(
+            "POST", "/admin/service-accounts/alerts/remove"
+        )
+        missing = await api.handle(
+            "POST", "/admin/service-accounts/alerts/remove"
+        )
+        refused = await _request(
+            node.ws_server,
+            websocket,
+            "join_room",
+            room_id=node.alerts,
+            username="alerts",
+        )
+
+        assert created["account"]["scopes"] == ["post"]
+        assert "api_key" not in listed["accounts"][0]
+        assert listed["count"] == 1
+        assert taken["error_code"] == "ACCOUNT_NAME_TAKEN"
+        assert invalid["error_code"] == "INVALID_REQUEST"
+        assert removed["disconnected"] == [client_id]
+        assert websocket.closed[0] == 1008
+        assert missing["error_code"] == "ACCOUNT_NOT_FOUND"
+        assert refused["data"]["error_code"] == "OUT_OF_SCOPE"
@@ -0,0 +1,284 @@
+"""
+Tests for Session Resumption
+
+Tests for the resumable session ID given to each connection, and for
+restoring room memberships, presence and pending messages when a client
+reconnects with it.
+"""
+
+import json
+import pytest
+
+from src.client import ChatClient
+from src.node import RoomStateManager, WebSocketServer
+from src.node.connection_registry import ClientConnection
+from src.node.direct_messages import create_direct_message
+from src.node.offline_queue import OfflineQueue
+from src.node.presence import PresenceDirectory
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self, incoming=()):
+        self.sent_messages = []
+        self.incoming = list(incoming)
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def __aiter__(self):
+        return self
+
+    async def __anext__(self):
+        if not self.incoming:
+            raise StopAsyncIteration
+        return self.incoming.pop(0)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _server(retention=60):
+    room_manager = RoomStateManager("node-a")
+    return WebSocketServer(
+        room_manager,
+        "localhost",
+        0,
+        presence=PresenceDirectory("node-a", debounce=0),
+        offline_queue=OfflineQueue(retention),
+    )
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.room_manager.add_member(room_id, username)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+async def _drop(ws_server, websocket):
+    """Disconnect a client the way handle_client does."""
+    session_id = ws_server.connections.get(websocket).session_id
+    await ws_server._handle_client_disconnect(websocket)
+    ws_server.connections.unregister(websocket)
+    ws_server._mark_offline(websocket)
+    return session_id
+
+
+async def _reconnect(ws_server, data):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    await _request(ws_server, websocket, "resume_session", data)
+    return websocket
+
+
+class TestSessionStarted:
+    """Tests for handing out session IDs on connect."""
+
+    @pytest.mark.asyncio
+    async def test_connect_gets_session_id(self):
+        """Test that a new connection is told its session ID."""
+        ws_server = _server(retention=30)
+        websocket = MockWebSocket()
+
+        await ws_server.handle_client(websocket)
+
+        started = websocket.received("session_started")[0]
+        assert len(started["session_id"]) >= 16
+        assert started["grace_period"] == 30
+
+    @pytest.mark.asyncio
+    async def test_no_session_id_without_queue(self):
+        """Test that nodes that can't hold sessions don't offer one."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        websocket = MockWebSocket()
+
+        await ws_server.handle_client(websocket)
+
+        assert websocket.received("session_started") == []
+
+    def test_session_id_kept_private(self):
+        """Test that connection listings don't reveal session IDs."""
+        first = ClientConnection(client_id="c1", websocket=None)
+        second = ClientConnection(client_id="c2", websocket=None)
+
+        assert first.session_id != second.session_id
+        assert "session_id" not in first.to_dict()
+
+
+class TestResumeById:
+    """Tests for resuming a held session with its session ID."""
+
+    @pytest.mark.asyncio
+    async def test_rooms_restored_without_rejoin(self):
+        """Test that the session ID alone restores memberships."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        alice = _join(ws_server, room.room_id, "alice")
+        bob = _join(ws_server, room.room_id, "bob")
+        session_id = await _drop(ws_server, bob)
+        await _request(
+            ws_server,
+            alice,
+            "send_message",
+            {"room_id": room.room_id, "username": "alice", "content": "hi"},
+        )
+
+        resumed = await _reconnect(
+            ws_server, {"session_id": session_id, "last_seen": {}}
+        )
+
+        data = resumed.received("session_resumed")[0]
+        assert data["username"] == "bob"
+        assert data["rooms"] == [room.room_id]
+        assert resumed.received("new_message")[0]["content"] == "hi"
+        assert ws_server._is_client_in_room(resumed, room.room_id)
+        assert ws_server.connections.get(resumed).username == "bob"
+
+    @pytest.mark.asyncio
+    async def test_unknown_session_id(self):
+        """Test that an ID no held session has is reported."""
+        ws_server = _server()
+
+        resumed = await _reconnect(
+            ws_server, {"session_id": "guess", "last_seen": {}}
+        )
+
+        error = resumed.received("resume_error")[0]
+        assert error["error_code"] == "SESSION_NOT_FOUND"
+
+    @pytest.mark.asyncio
+    async def test_session_id_of_another_user(self):
+        """Test that a session ID can't be used to resume as someone else."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _join(ws_server, room.room_id, "bob")
+        session_id = await _drop(ws_server, bob)
+
+        resumed = await _reconnect(
+            ws_server,
+            {"session_id": session_id, "username": "mallory", "last_seen": {}},
+        )
+
+        assert resumed.received("resume_error")
+        assert ws_server.offline_queue.is_held("bob")
+
+    @pytest.mark.asyncio
+    async def test_session_id_used_once(self):
+        """Test that a resumed session can't be resumed again."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _join(ws_server, room.room_id, "bob")
+        session_id = await _drop(ws_server, bob)
+        data = {"session_id": session_id, "last_seen": {}}
+
+        await _reconnect(ws_server, data)
+        again = await _reconnect(ws_server, data)
+
+        assert again.received("resume_error")[0]["error_code"] == (
+            "SESSION_NOT_FOUND"
+        )
+
+    @pytest.mark.asyncio
+    async def test_expired_session_id(self):
+        """Test that the ID stops working after the grace period."""
+        ws_server = _server(retention=-1)
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _join(ws_server, room.room_id, "bob")
+        session_id = await _drop(ws_server, bob)
+
+        resumed = await _reconnect(
+            ws_server, {"session_id": session_id, "last_seen": {}}
+        )
+
+        assert resumed.received("resume_error")
+
+
+class TestRestoredState:
+    """Tests for presence and pending messages of a resumed session."""
+
+    @pytest.mark.asyncio
+    async def test_away_status_restored(self):
+        """Test that a user who was away is away again after resuming."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _join(ws_server, room.room_id, "bob")
+        await _request(
+            ws_server, bob, "set_status", {"username": "bob", "status": "away"}
+        )
+        session_id = await _drop(ws_server, bob)
+        assert ws_server.presence.get_status("bob") == "offline"
+
+        resumed = await _reconnect(
+            ws_server, {"session_id": session_id, "last_seen": {}}
+        )
+
+        assert resumed.received("session_resumed")[0]["status"] == "away"
+        assert ws_server.presence.get_status("bob") == "away"
+
+    @pytest.mark.asyncio
+    async def test_pending_direct_messages_delivered(self):
+        """Test that direct messages buffered while away are delivered."""
+        ws_server = _server()
+        room = ws_server.room_manager.create_room("general", "alice")
+        bob = _join(ws_server, room.room_id, "bob")
+        session_id = await _drop(ws_server, bob)
+        ws_server.direct_messages.add(
+            create_direct_message("alice", "bob", "psst", "node-a")
+        )
+
+        resumed = await _reconnect(
+            ws_server, {"session_id": session_id, "last_seen": {}}
+        )
+
+        assert resumed.received("direct_message")[0]["content"] == "psst"
+
+
+class TestClient:
+    """Tests for the client keeping and presenting its session ID."""
+
+    @pytest.mark.asyncio
+    async def test_resume_presents_previous_session_id(self):
+        """Test that resume_session sends the ID of the last connection."""
+        connections = []
+
+        async def factory(url):
+            websocket = MockWebSocket()
+            replies = [
+                {"type": "session_started", "data": {"session_id": "new"}},
+                {"type": "session_resumed", "data": {"rooms": ["room-1"]}},
+            ]
+
+            async def recv():
+                return json.dumps(replies.pop(0))
+
+            websocket.recv = recv
+            connections.append(websocket)
+            return websocket
+
+        client = ChatClient("ws://localhost:8000", websocket_factory=factory)
+        await client.connect()
+        await client._process_incoming_message(
+            json.dumps({"type": "session_started", "data": {"session_id": "old"}})
+        )
+        assert client.session_id == "old"
+
+        await client.connect()
+        result = await client.resume_session(last_seen={"room-1": 3})
+
+        assert result["rooms"] == ["room-1"]
+        request = json.loads(connections[1].sent_messages[0])
+        assert request["data"] == {"session_id": "old", "last_seen": {"room-1": 3}}
+        assert client.session_id == "new"
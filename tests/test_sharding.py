@@ -0,0 +1,229 @@
+"""
+Tests for Room Sharding
+
+Tests for the consistent hash ring, moving new rooms to their owners,
+rebalancing when the membership view changes, and looking rooms up on
+the ring.
+"""
+
+import json
+
+import pytest
+
+from src.node import (
+    HashRing,
+    ReplicaStore,
+    RoomDirectory,
+    RoomFailover,
+    RoomSharding,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.membership import MembershipView
+from src.node.snapshot import SNAPSHOT_CAPABILITY
+from tests.fakes import LocalPeerRegistry
+
+
+class StubMembership:
+    """Membership whose views are installed by the test."""
+
+    def __init__(self, node_ids):
+        self.view = MembershipView(1, {n: f"http://{n}" for n in node_ids})
+        self.listeners = []
+
+    def subscribe(self, listener):
+        self.listeners.append(listener)
+
+    def peers(self):
+        return self.view.node_ids
+
+    def install(self, node_ids):
+        self.view = MembershipView(
+            self.view.epoch + 1, {n: f"http://{n}" for n in node_ids}
+        )
+        for listener in self.listeners:
+            listener(self.view)
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+class Cluster:
+    """Nodes with sharding, handing rooms to each other in-process."""
+
+    def __init__(self, node_ids, view=None):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in node_ids:
+            manager = RoomStateManager(node_id)
+            registry = LocalPeerRegistry(
+                node_id, self.servers, capabilities=[SNAPSHOT_CAPABILITY]
+            )
+            membership = StubMembership(view or node_ids)
+            failover = RoomFailover(
+                node_id,
+                f"http://{node_id}",
+                manager,
+                ReplicaStore(),
+                registry,
+                room_directory=RoomDirectory(node_id, f"http://{node_id}"),
+                membership=membership,
+            )
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                failover=failover,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "failover": failover,
+                "membership": membership,
+                "sharding": RoomSharding(
+                    node_id, manager, failover, membership
+                ),
+            }
+
+    def host(self, room_id):
+        return [
+            node_id
+            for node_id, node in self.nodes.items()
+            if node["manager"].get_room(room_id)
+        ]
+
+
+class TestHashRing:
+    """Tests for the consistent hash ring."""
+
+    def test_keys_spread_evenly_and_move_little(self):
+        """Test balance, and that a new node only takes keys to itself."""
+        keys = [f"room-{i}" for i in range(3000)]
+        ring = HashRing(["node-a", "node-b", "node-c"])
+        grown = HashRing(["node-a", "node-b", "node-c", "node-d"])
+
+        owners = {key: ring.owner(key) for key in keys}
+        counts = [list(owners.values()).count(n) for n in ring.node_ids]
+        moved = [key for key in keys if grown.owner(key) != owners[key]]
+
+        assert all(700 < count < 1300 for count in counts)
+        assert {grown.owner(key) for key in moved} == {"node-d"}
+        assert 450 < len(moved) < 1050
+        assert HashRing(["node-c", "node-a", "node-b"]).owner("x") == ring.owner(
+            "x"
+        )
+        assert HashRing([]).owner("x") is None
+
+
+class TestRoomSharding:
+    """Tests for placing rooms on their owners."""
+
+    def test_new_rooms_move_to_their_owner(self):
+        """Test that a room created elsewhere is handed to its owner."""
+        cluster = Cluster(["node-a", "node-b", "node-c"])
+        node_a = cluster.nodes["node-a"]
+        placed = {}
+        for number in range(12):
+            room = node_a["manager"].create_room(f"Room {number}", "alice")
+            node_a["manager"].add_member(room.room_id, "alice")
+            placed[room.room_id] = node_a["sharding"].place_room(room.room_id)
+
+        for room_id, admin in placed.items():
+            assert admin == node_a["sharding"].owner_of(room_id)
+            assert cluster.host(room_id) == [admin]
+        moved = [r for r, admin in placed.items() if admin != "node-a"]
+        assert moved
+        replica = node_a["failover"].replica_store.get(moved[0])
+        assert replica.local_members == ["alice"]
+        assert replica.admin_node == placed[moved[0]]
+        assert node_a["failover"].room_directory.get(moved[0]).admin_node == (
+            placed[moved[0]]
+        )
+
+    def test_rebalance_when_a_node_joins(self):
+        """Test that only the rooms the new node owns move to it."""
+        cluster = Cluster(["node-a", "node-b"], view=["node-a"])
+        node_a = cluster.nodes["node-a"]
+        room_ids = []
+        for number in range(12):
+            room = node_a["manager"].create_room(f"Room {number}", "alice")
+            room_ids.append(room.room_id)
+
+        assert node_a["sharding"].rebalance() == {}
+        for node in cluster.nodes.values():
+            node["membership"].install(["node-a", "node-b"])
+        moved = node_a["sharding"].rebalance()
+
+        owned_by_b = [
+            r for r in room_ids if node_a["sharding"].owner_of(r) == "node-b"
+        ]
+        assert sorted(moved) == sorted(owned_by_b)
+        for room_id in room_ids:
+            assert cluster.host(room_id) == [node_a["sharding"].owner_of(room_id)]
+        assert node_a["sharding"].rebalance() == {}
+
+
+class TestShardedCommands:
+    """Tests for sharding in the WebSocket server."""
+
+    @pytest.mark.asyncio
+    async def test_create_room_reports_owner(self):
+        """Test that room_created names the owner the room moved to."""
+        cluster = Cluster(["node-a", "node-b", "node-c"])
+        node_a = cluster.nodes["node-a"]
+        ws_server = WebSocketServer(
+            node_a["manager"], "localhost", 0, sharding=node_a["sharding"]
+        )
+        websocket = MockWebSocket()
+
+        await ws_server.process_message(
+            websocket,
+            json.dumps(
+                {
+                    "type": "create_room",
+                    "data": {"room_name": "General", "creator_id": "alice"},
+                }
+            ),
+        )
+
+        created = websocket.last()["data"]
+        assert created["admin_node"] == node_a["sharding"].owner_of(
+            created["room_id"]
+        )
+        assert cluster.host(created["room_id"]) == [created["admin_node"]]
+
+    def test_lookup_on_the_ring(self):
+        """Test that rooms missing from the directory are found on the ring."""
+        cluster = Cluster(["node-a", "node-b", "node-c"])
+        node_a = cluster.nodes["node-a"]
+        ws_server = WebSocketServer(
+            node_a["manager"],
+            "localhost",
+            0,
+            peer_registry=LocalPeerRegistry(
+                "node-a", cluster.servers, capabilities=[SNAPSHOT_CAPABILITY]
+            ),
+            sharding=node_a["sharding"],
+        )
+        room_id = next(
+            f"room-{i}"
+            for i in range(100)
+            if node_a["sharding"].owner_of(f"room-{i}") == "node-c"
+        )
+
+        room, address = ws_server._locate_room_admin(room_id)
+
+        assert room["admin_node"] == "node-c"
+        assert address == "http://node-c"
@@ -0,0 +1,316 @@
+"""
+Tests for Graceful Node Shutdown
+
+Tests for handing rooms off to a peer, notifying and turning away clients
+while draining, the drain deadline and the shutdown signal handlers.
+"""
+
+import asyncio
+import json
+import os
+import signal
+import time
+import pytest
+
+from src.node import (
+    RoomStateManager,
+    RoomDirectory,
+    WebSocketServer,
+    XMLRPCServer,
+    ReplicaStore,
+    RoomFailover,
+)
+from src.node.shutdown import drain_node, install_signal_handlers
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+        self.closed = None
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    async def close(self, code=1000, reason=""):
+        self.closed = (code, reason)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+class Cluster:
+    """Node node-a administering a room, with peers node-b and node-c."""
+
+    def __init__(self):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in ("node-a", "node-b", "node-c"):
+            registry = LocalPeerRegistry(
+                node_id,
+                self.servers,
+                capabilities=["rooms", "handoff", "snapshot_transfer"],
+            )
+            manager = RoomStateManager(node_id)
+            directory = RoomDirectory(node_id, f"http://{node_id}")
+            store = ReplicaStore()
+            failover = RoomFailover(
+                node_id,
+                f"http://{node_id}",
+                manager,
+                store,
+                registry,
+                room_directory=directory,
+            )
+            notified = []
+            failover.set_notify_callback(
+                lambda room_id, msg, notified=notified: notified.append(
+                    (room_id, msg)
+                )
+            )
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                directory,
+                failover=failover,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "directory": directory,
+                "store": store,
+                "failover": failover,
+                "notified": notified,
+            }
+
+        admin = self.nodes["node-a"]["manager"]
+        self.room = admin.create_room("General", "alice", "Chat")
+        admin.add_member(self.room.room_id, "alice")
+        admin.add_member(self.room.room_id, "bob", "node-b")
+        admin.add_message(self.room.room_id, "alice", "hello")
+        self.nodes["node-b"]["store"].update_from_join(
+            dict(self.room.to_dict(), admin_node="node-a"),
+            admin.get_messages(self.room.room_id),
+            "bob",
+        )
+
+
+class TestRoomHandoff:
+    """Tests for handing rooms off during shutdown."""
+
+    def test_room_handed_off_to_highest_peer(self):
+        """Test that the highest live peer takes over with full state."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+
+        handed_off = cluster.nodes["node-a"]["failover"].hand_off_rooms()
+
+        assert handed_off == {room_id: "node-c"}
+        assert cluster.nodes["node-a"]["manager"].get_room(room_id) is None
+        room = cluster.nodes["node-c"]["manager"].get_room(room_id)
+        assert room.admin_node == "node-c"
+        assert room.description == "Chat"
+        assert room.member_info["bob"].node_id == "node-b"
+        assert room.message_counter == 1
+        assert room.messages[0]["content"] == "hello"
+
+    def test_peers_repointed_after_handoff(self):
+        """Test that other nodes learn the room's new admin."""
+        cluster = Cluster()
+        room_id = cluster.room.room_id
+
+        cluster.nodes["node-a"]["failover"].hand_off_rooms()
+
+        node_b = cluster.nodes["node-b"]
+        assert node_b["store"].get(room_id).admin_node == "node-c"
+        assert node_b["directory"].get(room_id).admin_node == "node-c"
+        event = node_b["notified"][-1][1]
+        assert event["type"] == "room_admin_changed"
+        assert event["data"]["previous_admin"] == "node-a"
+
+    def test_unreachable_peer_skipped(self):
+        """Test that the next peer is tried if one is unreachable."""
+        cluster = Cluster()
+        cluster.servers["node-c"] = None
+
+        handed_off = cluster.nodes["node-a"]["failover"].hand_off_rooms()
+
+        assert handed_off == {cluster.room.room_id: "node-b"}
+        room = cluster.nodes["node-b"]["manager"].get_room(
+            cluster.room.room_id
+        )
+        assert room is not None
+        assert cluster.nodes["node-b"]["store"].get(room.room_id) is None
+
+    def test_room_kept_without_peers(self):
+        """Test that a room stays local if no peer accepts it."""
+        cluster = Cluster()
+        cluster.servers["node-b"] = None
+        cluster.servers["node-c"] = None
+
+        assert cluster.nodes["node-a"]["failover"].hand_off_rooms() == {}
+        manager = cluster.nodes["node-a"]["manager"]
+        assert manager.get_room(cluster.room.room_id) is not None
+
+
+class TestDrainingWebSocket:
+    """Tests for the WebSocket server while draining."""
+
+    @pytest.mark.asyncio
+    async def test_notify_shutdown_sends_reconnect_hint(self):
+        """Test that clients get the reconnect hint and are closed."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        ws = MockWebSocket()
+        ws_server.clients.add(ws)
+        ws_server.register_client_room_membership(ws, "room-1", "alice")
+
+        notified = await ws_server.notify_shutdown(
+            2, ["node-b", "node-c"], {"room-1": "node-c"}, ["ws://node-b"]
+        )
+
+        assert notified == 1
+        event = ws.last()
+        assert event["type"] == "node_shutdown"
+        assert event["data"]["node_id"] == "node-a"
+        assert event["data"]["retry_after"] == 2
+        assert event["data"]["nodes"] == ["node-b", "node-c"]
+        assert event["data"]["rooms"] == {"room-1": "node-c"}
+        assert event["data"]["reconnect_urls"] == ["ws://node-b"]
+        assert ws.closed[0] == 1001
+
+    @pytest.mark.asyncio
+    async def test_new_clients_turned_away(self):
+        """Test that a client connecting during the drain is closed."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "localhost", 0)
+        ws_server.begin_drain()
+        await ws_server.notify_shutdown(1, ["node-b"], {})
+        ws = MockWebSocket()
+
+        await ws_server.handle_client(ws)
+
+        assert ws.last()["type"] == "node_shutdown"
+        assert ws.closed[0] == 1001
+        assert ws not in ws_server.clients
+
+    @pytest.mark.asyncio
+    async def test_commands_rejected_while_draining(self):
+        """Test that client commands are rejected during the drain."""
+        room_manager = RoomStateManager("node-a")
+        ws_server = WebSocketServer(room_manager, "localhost", 0)
+        ws_server.begin_drain()
+        ws = MockWebSocket()
+
+        await ws_server.process_message(
+            ws,
+            json.dumps(
+                {
+                    "type": "create_room",
+                    "data": {"room_name": "General", "creator_id": "alice"},
+                }
+            ),
+        )
+
+        assert ws.last()["type"] == "node_shutting_down"
+        assert room_manager.get_room_count() == 0
+
+
+class StubWebSocketServer:
+    """WebSocket server recording the drain steps."""
+
+    def __init__(self):
+        self.steps = []
+
+    def begin_drain(self):
+        self.steps.append("drain")
+
+    async def notify_shutdown(self, retry_after, nodes, handed_off, urls):
+        self.steps.append(("notify", nodes, handed_off))
+        return 3
+
+    async def wait_disconnected(self, timeout):
+        return True
+
+
+class StubFailover:
+    """Failover whose handoff takes a configurable time."""
+
+    def __init__(self, delay=0.0):
+        self.delay = delay
+
+    def hand_off_rooms(self):
+        time.sleep(self.delay)
+        return {"room-1": "node-b"}
+
+    def live_peers(self):
+        return ["node-c", "node-b"]
+
+
+class StubLog:
+    """Message log recording syncs."""
+
+    def __init__(self):
+        self.synced = 0
+
+    def sync(self):
+        self.synced += 1
+
+
+class TestDrainNode:
+    """Tests for the drain sequence."""
+
+    @pytest.mark.asyncio
+    async def test_drain_runs_all_steps(self):
+        """Test the order and result of a complete drain."""
+        ws_server = StubWebSocketServer()
+        log = StubLog()
+
+        summary = await drain_node(ws_server, StubFailover(), log)
+
+        assert ws_server.steps == [
+            "drain",
+            ("notify", ["node-b", "node-c"], {"room-1": "node-b"}),
+        ]
+        assert summary == {
+            "handed_off": {"room-1": "node-b"},
+            "clients_notified": 3,
+            "completed": True,
+        }
+        assert log.synced == 1
+
+    @pytest.mark.asyncio
+    async def test_log_flushed_when_deadline_expires(self):
+        """Test that the log is flushed even if the drain times out."""
+        ws_server = StubWebSocketServer()
+        log = StubLog()
+
+        summary = await drain_node(
+            ws_server, StubFailover(delay=0.5), log, drain_timeout=0.05
+        )
+
+        assert summary["completed"] is False
+        assert ws_server.steps == ["drain"]
+        assert log.synced == 1
+
+
+class TestSignalHandlers:
+    """Tests for the shutdown signal handlers."""
+
+    @pytest.mark.asyncio
+    async def test_sigterm_sets_shutdown_event(self):
+        """Test that SIGTERM requests a shutdown."""
+        loop = asyncio.get_running_loop()
+        shutdown_event = asyncio.Event()
+        installed = install_signal_handlers(loop, shutdown_event)
+        try:
+            assert signal.SIGTERM in installed
+            os.kill(os.getpid(), signal.SIGTERM)
+            await asyncio.wait_for(shutdown_event.wait(), 1)
+        finally:
+            for sig in installed:
+                loop.remove_signal_handler(sig)
+
+        assert shutdown_event.is_set()
@@ -0,0 +1,179 @@
+"""
+Tests for the Deterministic Multi-Node Simulation
+
+Tests for replaying a run from its seed, message ordering under
+reordered broadcasts, 2PC under a partition, and failover after a crash,
+on in-process nodes connected by the simulated network.
+"""
+
+import time
+from unittest.mock import patch
+
+import pytest
+
+from src.node import Simulation
+from src.node.log_context import ServerProxy
+from src.node.simulation import PARTITIONED, REFUSED, TIMED_OUT
+
+
+def _cluster(sim, count=3):
+    return [sim.add_node(f"node{i}") for i in range(1, count + 1)]
+
+
+def _ordered_run(seed, arrivals=None):
+    """Send messages to a total-order room over slow, jittery links."""
+    with Simulation(seed=seed, latency=(0.0, 0.5)) as sim:
+        node1, node2, node3 = _cluster(sim)
+        buffer = node3.sequence_buffer
+        room_id = node1.create_room("General", "alice", total_order=True)
+        node2.join(room_id, "bob", "node1")
+        node3.join(room_id, "carol", "node1")
+        for i in range(8):
+            assert node2.send(room_id, "bob", f"message {i}")["success"]
+        with patch.object(buffer, "receive", wraps=buffer.receive) as receive:
+            sim.run()
+        if arrivals is not None:
+            arrivals.extend(
+                call.args[1]["sequence_number"] for call in receive.call_args_list
+            )
+        return sim, node3.delivered(room_id)
+
+
+class TestDeterminism:
+    """Tests for repeating a run from its seed."""
+
+    def test_same_seed_same_run(self):
+        """Test that a seed fixes the calls, their times and the IDs."""
+        first, delivered = _ordered_run(7)
+        second, _ = _ordered_run(7)
+        other, _ = _ordered_run(8)
+
+        assert first.network.trace == second.network.trace
+        assert first.network.trace != other.network.trace
+        assert [m["message_id"] for m in delivered] == [
+            m["message_id"] for m in _ordered_run(7)[1]
+        ]
+
+    def test_transport_restored(self):
+        """Test that proxies use real transports once the run is over."""
+        with Simulation():
+            pass
+
+        proxy = ServerProxy("http://localhost:1", allow_none=True)
+        assert type(proxy("transport")).__name__ == "CorrelationTransport"
+
+
+class TestOrdering:
+    """Tests for delivery order under reordered broadcasts."""
+
+    def test_total_order_despite_reordering(self):
+        """Test that broadcasts arrive out of order but are shown in order."""
+        arrivals = []
+        _, delivered = _ordered_run(7, arrivals)
+
+        assert sorted(arrivals) == list(range(1, 9))
+        assert arrivals != sorted(arrivals)
+        assert [m["sequence_number"] for m in delivered] == list(range(1, 9))
+        assert [m["content"] for m in delivered] == [
+            f"message {i}" for i in range(8)
+        ]
+
+    def test_dropped_broadcasts_time_out(self):
+        """Test that a lossy link times calls out and is retried."""
+        with Simulation(seed=1) as sim:
+            node1, node2 = _cluster(sim, 2)
+            room_id = node1.create_room("General", "alice")
+            node2.join(room_id, "bob", "node1")
+            sim.network.set_link("node1", "node2", drop_rate=1.0)
+            node1.send(room_id, "alice", "hello")
+            sim.run()
+
+            outcomes = [
+                entry.outcome
+                for entry in sim.network.trace
+                if entry.method == "receive_message_broadcast"
+            ]
+            assert outcomes == ["dropped", "dropped"]
+            assert node2.delivered(room_id) == []
+
+
+class TestTwoPhaseCommit:
+    """Tests for room deletion through 2PC on the simulated network."""
+
+    @pytest.mark.asyncio
+    async def test_partition_aborts_then_heal_commits(self):
+        """Test aborting while a participant is cut off and retrying."""
+        with Simulation(seed=3) as sim:
+            node1, _, _ = _cluster(sim)
+            room_id = node1.create_room("General", "alice")
+
+            sim.network.partition({"node1", "node2"}, {"node3"})
+            aborted = await node1.delete_room(room_id)
+            state = node1.room_manager.get_room(room_id).state.value
+            sim.network.heal()
+            committed = await node1.delete_room(room_id)
+
+            assert aborted is False
+            assert state == "ACTIVE"
+            assert committed is True
+            assert node1.room_manager.get_room(room_id) is None
+            prepares = [
+                (entry.target, entry.outcome)
+                for entry in sim.network.trace
+                if entry.method == "tpc_prepare"
+            ]
+            assert sorted(prepares) == [
+                ("node2", "ok"),
+                ("node2", "ok"),
+                ("node3", "ok"),
+                ("node3", PARTITIONED),
+            ]
+
+    @pytest.mark.asyncio
+    async def test_slow_participant_times_out(self):
+        """Test that a vote slower than the timeout aborts the deletion."""
+        with Simulation(seed=3) as sim:
+            node1, _ = _cluster(sim, 2)
+            node1.tpc.prepare_timeout = 1
+            sim.network.set_link("node1", "node2", latency=(2, 2))
+            room_id = node1.create_room("General", "alice")
+
+            assert await node1.delete_room(room_id) is False
+            assert sim.network.trace[0].outcome == TIMED_OUT
+
+
+class TestFailover:
+    """Tests for failover after a crash, driven by heartbeat rounds."""
+
+    def test_admin_crash_elects_new_admin(self):
+        """Test that the highest replica holder takes over the room."""
+        with Simulation(seed=5) as sim:
+            node1, node2, node3 = _cluster(sim)
+            room_id = node1.create_room("General", "alice")
+            node2.join(room_id, "bob", "node1")
+            node3.join(room_id, "carol", "node1")
+            node2.send(room_id, "bob", "before")
+            sim.run()
+
+            sim.network.crash("node1")
+            for _ in range(node2.failure_detector.dead_threshold):
+                sim.heartbeat_round()
+            # node3 may take over from the election node2 started
+            deadline = time.time() + 2
+            while time.time() < deadline:
+                if node3.room_manager.get_room(room_id):
+                    break
+                time.sleep(0.01)
+
+            assert node3.room_manager.get_room(room_id) is not None
+            assert node2.admin_of(room_id) == "node3"
+            assert node2.send(room_id, "bob", "after")["success"]
+            sim.run()
+            assert [m["content"] for m in node3.delivered(room_id)] == [
+                "before",
+                "after",
+            ]
+            assert any(
+                entry.target == "node1" and entry.outcome == REFUSED
+                for entry in sim.network.trace
+            )
@@ -0,0 +1,251 @@
+"""
+Tests for Room Snapshots and Transfer
+
+Tests for the snapshot format, the chunked transfer with checksums,
+resuming interrupted transfers, and handing rooms off with snapshots.
+"""
+
+import pytest
+
+from src.node import (
+    RoomStateManager,
+    RoomDirectory,
+    XMLRPCServer,
+    ReplicaStore,
+    RoomFailover,
+    RoomSnapshot,
+    SnapshotReceiver,
+    SnapshotSender,
+)
+from src.node.snapshot import SNAPSHOT_CAPABILITY, SnapshotError
+from tests.fakes import LocalPeerRegistry
+
+
+class FlakyPeerRegistry(LocalPeerRegistry):
+    """Local registry answering the nth call with failures[n], if set."""
+
+    def __init__(self, *args, **kwargs):
+        super().__init__(*args, **kwargs)
+        self.failures = {}
+
+    def call_peer(self, node_id, method, *args, timeout=None):
+        failure = self.failures.get(len(self.calls) + 1)
+        if failure:
+            self.calls.append((node_id, method))
+            return failure(method, args)
+        return super().call_peer(node_id, method, *args, timeout=timeout)
+
+
+def _interrupt(method, args):
+    raise ConnectionError("connection reset")
+
+
+class Cluster:
+    """Node node-a administering a room that node-b can take over."""
+
+    def __init__(self, capabilities=(SNAPSHOT_CAPABILITY,)):
+        self.servers = {}
+        self.nodes = {}
+        for node_id in ("node-a", "node-b"):
+            registry = FlakyPeerRegistry(
+                node_id, self.servers, capabilities=capabilities
+            )
+            manager = RoomStateManager(node_id)
+            failover = RoomFailover(
+                node_id,
+                f"http://{node_id}",
+                manager,
+                ReplicaStore(),
+                registry,
+                room_directory=RoomDirectory(node_id, f"http://{node_id}"),
+            )
+            self.servers[node_id] = XMLRPCServer(
+                manager,
+                "localhost",
+                0,
+                f"http://{node_id}",
+                registry,
+                failover=failover,
+            )
+            self.nodes[node_id] = {
+                "manager": manager,
+                "failover": failover,
+                "registry": registry,
+            }
+
+        admin = self.nodes["node-a"]["manager"]
+        self.room = admin.create_room("General", "alice", "Chat")
+        admin.add_member(self.room.room_id, "alice")
+        admin.add_member(self.room.room_id, "bob", "node-b")
+        admin.moderate_member(self.room.room_id, "alice", "mallory", ban=True)
+        admin.set_member_role(self.room.room_id, "alice", "bob", "moderator")
+        for i in range(20):
+            admin.add_message(self.room.room_id, "alice", f"message {i}")
+
+    def sender(self, chunk_size=256):
+        return SnapshotSender(
+            "node-a", self.nodes["node-a"]["registry"], chunk_size
+        )
+
+    def snapshot(self):
+        return RoomSnapshot.from_room(
+            self.nodes["node-a"]["manager"], self.room.room_id
+        )
+
+    def taken_over(self):
+        return self.nodes["node-b"]["manager"].get_room(self.room.room_id)
+
+
+class TestRoomSnapshot:
+    """Tests for the snapshot format."""
+
+    def test_snapshot_captures_room_state(self):
+        """Test that a snapshot has the room's members, roles and messages."""
+        cluster = Cluster()
+        snapshot = cluster.snapshot()
+
+        assert snapshot.members == {"alice": "node-a", "bob": "node-b"}
+        assert snapshot.banned == ["mallory"]
+        assert snapshot.roles["bob"] == "moderator"
+        assert len(snapshot.messages) == 20
+        assert snapshot.message_counter == 20
+        assert snapshot.source_node == "node-a"
+
+    def test_encode_round_trip(self):
+        """Test that decoding an encoded snapshot gives it back."""
+        snapshot = Cluster().snapshot()
+
+        assert RoomSnapshot.decode(snapshot.encode()) == snapshot
+
+    def test_unsupported_version_rejected(self):
+        """Test that snapshots of another format version are refused."""
+        data = Cluster().snapshot().to_dict()
+        data["version"] = 99
+
+        with pytest.raises(SnapshotError):
+            RoomSnapshot.from_dict(data)
+        with pytest.raises(SnapshotError):
+            RoomSnapshot.decode(b"not json")
+
+
+class TestTransfer:
+    """Tests for the chunked transfer."""
+
+    def test_chunked_transfer_takes_over_room(self):
+        """Test that a snapshot sent in chunks restores the room."""
+        cluster = Cluster()
+        snapshot = cluster.snapshot()
+
+        result = cluster.sender().send("node-b", snapshot)
+
+        assert result == {"success": True, "node_id": "node-b"}
+        calls = cluster.nodes["node-a"]["registry"].methods()
+        assert calls.count("receive_snapshot_chunk") > 1
+        room = cluster.taken_over()
+        assert room.message_counter == 20
+        assert cluster.nodes["node-b"]["manager"].get_banned(
+            room.room_id
+        ) == ["mallory"]
+
+    def test_corrupted_chunk_sent_again(self):
+        """Test that a chunk failing its checksum is retried."""
+        cluster = Cluster()
+        registry = cluster.nodes["node-a"]["registry"]
+        receiver = cluster.servers["node-b"]
+
+        def corrupt(method, args):
+            transfer_id, index, data, chunk_checksum = args
+            return receiver.receive_snapshot_chunk(
+                transfer_id, index, b"garbage", chunk_checksum
+            )
+
+        registry.failures[3] = corrupt
+
+        result = cluster.sender().send("node-b", cluster.snapshot())
+
+        assert result["success"] is True
+        assert registry.methods()[2:4] == [
+            "receive_snapshot_chunk",
+            "receive_snapshot_chunk",
+        ]
+        assert cluster.taken_over() is not None
+
+    def test_interrupted_transfer_resumes(self):
+        """Test that a broken transfer resumes from the missing chunk."""
+        cluster = Cluster()
+        registry = cluster.nodes["node-a"]["registry"]
+        registry.failures[4] = _interrupt
+
+        result = cluster.sender().send("node-b", cluster.snapshot())
+
+        assert result["success"] is True
+        assert registry.methods().count("begin_snapshot_transfer") == 2
+        # Chunks 0 and 1 were received before the break and not sent again
+        chunk_calls = registry.methods().count("receive_snapshot_chunk")
+        snapshot_size = len(cluster.snapshot().encode())
+        assert chunk_calls == -(-snapshot_size // 256) + 1
+        assert cluster.taken_over() is not None
+
+    def test_commit_is_idempotent(self):
+        """Test that retrying a commit whose reply was lost succeeds."""
+        cluster = Cluster()
+        registry = cluster.nodes["node-a"]["registry"]
+        receiver = cluster.servers["node-b"]
+        sender = SnapshotSender("node-a", registry, chunk_size=1 << 20)
+
+        def lost_reply(method, args):
+            receiver.commit_snapshot_transfer(*args)
+            raise ConnectionError("connection reset")
+
+        registry.failures[3] = lost_reply
+
+        result = sender.send("node-b", cluster.snapshot())
+
+        assert result == {"success": True, "node_id": "node-b"}
+        assert registry.methods().count("commit_snapshot_transfer") == 2
+
+    def test_incomplete_and_expired_transfers(self):
+        """Test committing early and dropping idle transfers."""
+        now = [1000.0]
+        receiver = SnapshotReceiver("node-b", None, ttl=60, clock=lambda: now[0])
+        receiver.begin("t1", "room-1", 10, 2, "abc", "node-a")
+
+        assert receiver.commit("t1")["error_code"] == "INCOMPLETE_TRANSFER"
+        now[0] += 61
+        assert receiver.expire() == 1
+        assert receiver.commit("t1")["error_code"] == "UNKNOWN_TRANSFER"
+
+
+class TestHandoff:
+    """Tests for handing rooms off with snapshots."""
+
+    def test_handoff_uses_snapshot_transfer(self):
+        """Test that peers taking snapshots receive the room in chunks."""
+        cluster = Cluster()
+
+        new_admin = cluster.nodes["node-a"]["failover"].hand_off_room(
+            cluster.room.room_id
+        )
+
+        assert new_admin == "node-b"
+        calls = cluster.nodes["node-a"]["registry"].methods()
+        assert "commit_snapshot_transfer" in calls
+        assert "accept_room_handoff" not in calls
+        assert cluster.nodes["node-a"]["manager"].get_room(
+            cluster.room.room_id
+        ) is None
+        assert cluster.taken_over().message_counter == 20
+
+    def test_handoff_falls_back_for_older_peers(self):
+        """Test that peers without the capability get the state in one call."""
+        cluster = Cluster(capabilities=("handoff",))
+
+        new_admin = cluster.nodes["node-a"]["failover"].hand_off_room(
+            cluster.room.room_id
+        )
+
+        assert new_admin == "node-b"
+        assert cluster.nodes["node-a"]["registry"].methods() == [
+            "accept_room_handoff"
+        ]
+        assert cluster.taken_over() is not None
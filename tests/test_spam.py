@@ -0,0 +1,266 @@
+"""
+Tests for Spam and Flood Detection
+
+Tests for catching duplicate bursts and mention floods, temporary mutes,
+the audit log entries, per-room thresholds surviving restarts and
+failover, and the spam_detected event reaching only moderators.
+"""
+
+import json
+from unittest.mock import MagicMock
+
+import pytest
+
+from src.node import (
+    AuditLog,
+    MemoryStorage,
+    ReplicaStore,
+    RoomStateManager,
+    SpamDetector,
+    SpamError,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.failover import merge_replicas
+from src.node.spam import DEFAULT_THRESHOLDS, count_mentions
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager):
+    """A room owned by alice, with bob as a member and carol a moderator."""
+    room = manager.create_room("General", "alice")
+    for username in ("alice", "bob", "carol"):
+        manager.add_member(room.room_id, username)
+    manager.set_member_role(room.room_id, "alice", "carol", "moderator")
+    return room.room_id
+
+
+def _thresholds(**changes):
+    return dict(DEFAULT_THRESHOLDS, **changes)
+
+
+async def _send(ws_server, websocket, message_type, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+
+
+class TestSpamDetector:
+    """Tests for the detection heuristics."""
+
+    def test_duplicate_burst_mutes_until_it_ends(self):
+        """Test repeats within and outside the window, and the mute."""
+        detector = SpamDetector()
+        thresholds = _thresholds(duplicate_limit=2, window=10)
+        detector.check("r1", "bob", "Buy now", thresholds, now=0)
+        detector.check("r1", "bob", "buy   NOW", thresholds, now=1)
+        detector.check("r1", "bob", "Buy now", thresholds, now=11)
+        detector.check("r1", "bob", "something else", thresholds, now=11)
+        detector.check("r1", "bob", "Buy now", thresholds, now=12)
+
+        with pytest.raises(SpamError) as error:
+            detector.check("r1", "bob", "Buy now", thresholds, now=12)
+        assert error.value.error_code == "SPAM_DETECTED"
+        assert error.value.reason == "duplicate_burst"
+        assert error.value.muted_until == 312
+        with pytest.raises(SpamError) as error:
+            detector.check("r1", "bob", "hello", thresholds, now=200)
+        assert error.value.error_code == "USER_MUTED"
+        detector.check("r2", "bob", "hello", thresholds, now=200)
+        assert detector.muted_until("r1", "bob", now=200) == 312
+
+        detector.check("r1", "bob", "Buy now", thresholds, now=312)
+        assert detector.muted_until("r1", "bob", now=312) is None
+
+    def test_mention_flood_and_disabled_checks(self):
+        """Test mentions counted across messages, and limits of 0."""
+        detector = SpamDetector()
+        thresholds = _thresholds(mention_limit=4)
+        detector.check("r1", "bob", "@a @b hi", thresholds, now=0)
+        detector.check("r1", "bob", "@c me@example.com", thresholds, now=1)
+        with pytest.raises(SpamError) as error:
+            detector.check("r1", "bob", "@d @e", thresholds, now=2)
+        assert error.value.reason == "mention_flood"
+
+        off = _thresholds(duplicate_limit=0, mention_limit=0)
+        for n in range(10):
+            detector.check("r1", "dave", "@a @b @c same", off, now=n)
+        assert count_mentions("@a, @b.c and a@b") == 2
+
+
+class TestRoomSpam:
+    """Tests for spam detection in hosted rooms."""
+
+    def test_member_muted_and_audited(self, tmp_path):
+        """Test the mute, the audit entry, and exempt moderators and bots."""
+        audit_log = AuditLog(str(tmp_path / "audit.log"), "node1")
+        manager = RoomStateManager("node1", audit_log=audit_log)
+        room_id = _room(manager)
+        manager.set_spam_thresholds(room_id, "carol", {"duplicate_limit": 1})
+
+        manager.add_message(room_id, "bob", "spam")
+        with pytest.raises(SpamError) as error:
+            manager.add_message(room_id, "bob", "spam")
+        with pytest.raises(SpamError) as muted:
+            manager.add_message(room_id, "bob", "sorry")
+        for username in ("alice", "carol"):
+            for _ in range(3):
+                manager.add_message(room_id, username, "announcement")
+
+        assert error.value.error_code == "SPAM_DETECTED"
+        assert muted.value.error_code == "USER_MUTED"
+        (entry,) = audit_log.query(action="member_muted")
+        assert (entry.actor, entry.target) == ("node1", room_id)
+        assert entry.details["user"] == "bob"
+        assert entry.details["reason"] == "duplicate_burst"
+        assert len(manager.get_room(room_id).messages) == 7
+
+    def test_thresholds(self):
+        """Test permissions, validation and the merged thresholds."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+
+        thresholds = manager.set_spam_thresholds(
+            room_id, "carol", {"mention_limit": 0, "window": 60}
+        )
+        for username, changes, code in (
+            ("bob", {"window": 5}, "NOT_ALLOWED"),
+            ("alice", {}, "INVALID_REQUEST"),
+            ("alice", {"burst": 5}, "INVALID_REQUEST"),
+            ("alice", {"window": 0}, "INVALID_REQUEST"),
+            ("alice", {"mute_duration": 10**6}, "INVALID_REQUEST"),
+            ("alice", {"duplicate_limit": True}, "INVALID_REQUEST"),
+        ):
+            with pytest.raises(SpamError) as error:
+                manager.set_spam_thresholds(room_id, username, changes)
+            assert error.value.error_code == code
+
+        assert thresholds == _thresholds(mention_limit=0, window=60)
+        assert manager.get_room(room_id).spam_thresholds == {
+            "mention_limit": 0,
+            "window": 60,
+        }
+        assert manager.get_spam_thresholds("missing") == DEFAULT_THRESHOLDS
+
+    def test_thresholds_survive_restart_and_failover(self):
+        """Test recovery, replica events and merging surviving replicas."""
+        storage = MemoryStorage()
+        manager = RoomStateManager("node1", storage)
+        room_id = _room(manager)
+        manager.set_spam_thresholds(room_id, "alice", {"duplicate_limit": 5})
+
+        recovered = RoomStateManager("node1", storage)
+        recovered.recover_rooms()
+        replicas = ReplicaStore()
+        xmlrpc_server = XMLRPCServer(manager, "localhost", 0, "http://node1")
+        replicas.update_from_join(
+            xmlrpc_server._room_info(manager.get_room(room_id)), [], "bob"
+        )
+        replicas.record_spam_thresholds(room_id, {"window": 90})
+        state = merge_replicas(
+            [dict(replicas.get(room_id).to_dict(), node_id="node2")], 100
+        )
+        restored = manager.restore_room(**dict(state, room_id="r2"))
+
+        assert recovered.get_spam_thresholds(room_id)["duplicate_limit"] == 5
+        assert restored.spam_thresholds == {"window": 90}
+
+
+class TestSpamCommands:
+    """Tests for set_spam_thresholds and the spam_detected event."""
+
+    @pytest.mark.asyncio
+    async def test_moderators_told_of_mute(self):
+        """Test the sender's error and who gets spam_detected."""
+        manager = RoomStateManager("node1")
+        room_id = _room(manager)
+        manager.set_spam_thresholds(room_id, "alice", {"duplicate_limit": 1})
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        clients = {u: MockWebSocket() for u in ("alice", "bob", "carol")}
+        for username, websocket in clients.items():
+            ws_server.register_client_room_membership(
+                websocket, room_id, username
+            )
+
+        for _ in range(2):
+            await _send(
+                ws_server,
+                clients["bob"],
+                "send_message",
+                {"room_id": room_id, "username": "bob", "content": "spam"},
+            )
+
+        error = clients["bob"].received("message_error")[0]
+        assert error["error_code"] == "SPAM_DETECTED"
+        assert clients["bob"].received("spam_detected") == []
+        for moderator in ("alice", "carol"):
+            (event,) = clients[moderator].received("spam_detected")
+            assert event["username"] == "bob"
+            assert event["reason"] == "duplicate_burst"
+            assert event["moderators"] == ["alice", "carol"]
+
+    @pytest.mark.asyncio
+    async def test_set_thresholds_on_admin_and_forwarded(self):
+        """Test the command on the admin node, forwarding, and an error."""
+        admin = RoomStateManager("node1")
+        room_id = _room(admin)
+        xmlrpc_server = XMLRPCServer(admin, "localhost", 0, "http://node1")
+        broadcast = MagicMock()
+        xmlrpc_server.set_broadcast_callback(broadcast)
+        local = WebSocketServer(admin, "localhost", 0)
+        remote = WebSocketServer(RoomStateManager("node2"), "localhost", 0)
+
+        async def call_admin(room_id, method, *args):
+            return getattr(xmlrpc_server, method)(*args)
+
+        remote._call_room_admin = call_admin
+        owner, moderator, member = (
+            MockWebSocket(),
+            MockWebSocket(),
+            MockWebSocket(),
+        )
+        local.register_client_room_membership(member, room_id, "bob")
+        request = {"room_id": room_id, "window": 45}
+        await _send(
+            local,
+            owner,
+            "set_spam_thresholds",
+            dict(request, username="alice"),
+        )
+        await _send(
+            remote,
+            moderator,
+            "set_spam_thresholds",
+            dict(request, username="carol", mute_duration=60),
+        )
+        await _send(
+            local, member, "set_spam_thresholds", dict(request, username="bob")
+        )
+
+        assert owner.received("spam_thresholds_set")[0]["spam_thresholds"] == (
+            _thresholds(window=45)
+        )
+        forwarded = moderator.received("spam_thresholds_set")[0]
+        assert forwarded["spam_thresholds"]["mute_duration"] == 60
+        assert member.received("spam_thresholds_changed")[0][
+            "spam_thresholds"
+        ] == {"window": 45}
+        event = broadcast.call_args[0][1]
+        assert event["type"] == "spam_thresholds_changed"
+        assert member.received("spam_error")[0]["error_code"] == "NOT_ALLOWED"
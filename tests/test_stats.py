@@ -0,0 +1,177 @@
+"""
+Tests for Cluster Statistics
+
+Tests for measuring throughput and delivery latency, aggregating the
+statistics gossiped by peers, the stats command and GET /admin/stats.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    AdminAPI,
+    ClusterStats,
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+)
+
+
+class FakeClock:
+    """Clock advanced by hand."""
+
+    def __init__(self):
+        self.now = 1000.0
+
+    def __call__(self):
+        return self.now
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+def _hosted(messages, members=2, private=False):
+    return {"messages": messages, "members": members, "private": private}
+
+
+async def _stats(ws_server, websocket, data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": "stats", "data": data})
+    )
+    return websocket.last()
+
+
+class TestClusterStats:
+    """Tests for measuring and aggregating statistics."""
+
+    def test_throughput_and_latency(self):
+        """Test messages per minute and latency weighted across nodes."""
+        clock = FakeClock()
+        admin = ClusterStats("node1", clock=clock)
+        follower = ClusterStats("node2", clock=clock)
+        admin.update_local({"r1": _hosted(10)}, {"r1": 1}, 1)
+        admin.record_delivery("r1", 0.010)
+        follower.record_delivery("r1", 0.040)
+        follower.record_delivery("r1", 0.070)
+        clock.now += 30
+
+        admin.update_local({"r1": _hosted(25)}, {"r1": 1}, 1)
+        follower.update_local({}, {"r1": 2}, 3)
+        assert admin.merge(follower.get_entries()) == 1
+        assert admin.merge(follower.get_entries()) == 0
+        summary = admin.summary()
+
+        assert summary["rooms"]["r1"] == {
+            "admin_node": "node1",
+            "private": False,
+            "messages": 25,
+            "throughput": 30.0,
+            "members": 2,
+            "active_members": 3,
+            "avg_latency_ms": 40.0,
+            "nodes": ["node1", "node2"],
+        }
+        assert summary["nodes"] == [
+            {"node_id": "node1", "connections": 1, "rooms": 1, "updated_at": 1030},
+            {"node_id": "node2", "connections": 3, "rooms": 0, "updated_at": 1030},
+        ]
+
+    def test_old_samples_and_stale_peers_left_out(self):
+        """Test the measurement window and peers not refreshed in time."""
+        clock = FakeClock()
+        stats = ClusterStats("node1", window=60, ttl=30, clock=clock)
+        peer = ClusterStats("node2", clock=clock)
+        stats.record_delivery("r1", 5.0)
+        peer.update_local({"r2": _hosted(3)}, {}, 0)
+        with patch("src.node.stats.time.monotonic", return_value=0):
+            stats.merge(peer.get_entries())
+        clock.now += 61
+
+        stats.update_local({}, {"r1": 1}, 1)
+        with patch("src.node.stats.time.monotonic", return_value=31):
+            summary = stats.summary()
+
+        assert summary["rooms"]["r1"]["avg_latency_ms"] is None
+        assert summary["rooms"]["r1"]["admin_node"] is None
+        assert "r2" not in summary["rooms"]
+        assert [node["node_id"] for node in summary["nodes"]] == ["node1"]
+        assert stats.merge([{"node_id": "node3"}]) == 0
+
+
+class TestStatsCommand:
+    """Tests for the stats command and the admin endpoint."""
+
+    @pytest.mark.asyncio
+    async def test_cluster_wide_room_stats(self):
+        """Test a room administered on one node asked about on another."""
+        manager1 = RoomStateManager("node1")
+        ws1 = WebSocketServer(manager1, "localhost", 0)
+        xmlrpc1 = XMLRPCServer(
+            manager1, "localhost", 0, "http://node1", stats=ws1.stats
+        )
+        ws2 = WebSocketServer(RoomStateManager("node2"), "localhost", 0)
+        room = manager1.create_room("General", "alice")
+        manager1.add_member(room.room_id, "alice")
+        manager1.add_member(room.room_id, "bob")
+        alice, bob = MockWebSocket(), MockWebSocket()
+        ws1.register_client_room_membership(alice, room.room_id, "alice")
+        ws2.register_client_room_membership(bob, room.room_id, "bob")
+
+        message = manager1.add_message(room.room_id, "alice", "hello")
+        event = {"type": "new_message", "data": message}
+        await ws1.broadcast_to_room(room.room_id, event)
+        await ws2.broadcast_to_room(room.room_id, event)
+        ws1.refresh_stats()
+        ws2.refresh_stats()
+        ws2.stats.merge(xmlrpc1.exchange_stats(ws2.stats.get_entries()))
+
+        response = await _stats(ws2, bob, {"room_id": room.room_id})
+
+        assert response["type"] == "stats"
+        assert response["data"]["node_id"] == "node2"
+        stats = response["data"]["rooms"][room.room_id]
+        assert stats["admin_node"] == "node1"
+        assert stats["messages"] == 1
+        assert stats["members"] == 2
+        assert stats["active_members"] == 2
+        assert stats["nodes"] == ["node1", "node2"]
+        assert stats["avg_latency_ms"] is not None
+        assert room.room_id in ws1.stats.summary()["rooms"]
+
+    @pytest.mark.asyncio
+    async def test_private_rooms_and_unknown_room(self):
+        """Test hiding private rooms from outsiders, and a missing room."""
+        manager = RoomStateManager("node1")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        secret = manager.create_room("Secret", "alice", private=True)
+        member, outsider = MockWebSocket(), MockWebSocket()
+        ws_server.register_client_room_membership(
+            member, secret.room_id, "alice"
+        )
+        api = AdminAPI(ws_server)
+
+        seen = await _stats(ws_server, member, {})
+        hidden = await _stats(ws_server, outsider, {"room_id": secret.room_id})
+        admin = await api.handle(
+            "GET", "/admin/stats", {"room_id": secret.room_id}
+        )
+        missing = await api.handle("GET", "/admin/stats", {"room_id": "nope"})
+
+        assert secret.room_id in seen["data"]["rooms"]
+        assert hidden["type"] == "stats_error"
+        assert hidden["data"]["error_code"] == "ROOM_NOT_FOUND"
+        assert admin["success"] is True
+        assert admin["rooms"][secret.room_id]["private"] is True
+        assert missing["error_code"] == "ROOM_NOT_FOUND"
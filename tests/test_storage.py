@@ -0,0 +1,196 @@
+"""
+Tests for Storage Backends
+
+Tests for the in-memory and SQLite backends keeping room records, rooms
+recovered through the room manager from each backend, user accounts and
+logouts surviving restarts, and selecting the backend in the config.
+"""
+
+import pytest
+
+from src.node import (
+    AuthManager,
+    MemoryStorage,
+    MessageLog,
+    RoomStateManager,
+    SQLiteStorage,
+)
+from src.node.config import NodeConfig
+from src.node.main import open_storage
+
+
+def _populate(manager):
+    room = manager.create_room("General", "alice", "Chat")
+    manager.add_member(room.room_id, "alice")
+    manager.add_member(room.room_id, "bob")
+    first = manager.add_message(room.room_id, "alice", "first")
+    manager.add_message(room.room_id, "bob", "second")
+    manager.edit_message(
+        room.room_id, "alice", first["message_id"], "edit", "first!"
+    )
+    manager.moderate_member(room.room_id, "alice", "bob", ban=True)
+    manager.mark_read(room.room_id, "alice", 2)
+    return room.room_id
+
+
+class TestBackends:
+    """Tests for reading back stored records."""
+
+    def test_memory_records_are_copies(self):
+        """Test that changing a record after storing it changes nothing."""
+        storage = MemoryStorage()
+        record = {"type": "ban", "username": "bob"}
+        storage.append("room-1", record)
+        record["username"] = "mallory"
+
+        stored = list(storage.records("room-1"))
+        stored[0]["username"] = "eve"
+
+        assert list(storage.records("room-1")) == [
+            {"type": "ban", "username": "bob"}
+        ]
+        assert storage.room_ids() == ["room-1"]
+
+    def test_sqlite_keeps_order_per_room(self, tmp_path):
+        """Test that SQLite returns each room's records oldest first."""
+        path = str(tmp_path / "node.db")
+        storage = SQLiteStorage(path)
+        for n in range(3):
+            storage.append("room-b", {"n": n})
+            storage.append("room-a", {"n": n + 10})
+        storage.drop_room("room-a")
+        storage.close()
+
+        reopened = SQLiteStorage(path)
+        assert reopened.room_ids() == ["room-b"]
+        assert [r["n"] for r in reopened.records("room-b")] == [0, 1, 2]
+
+    def test_sqlite_write_failure_is_os_error(self, tmp_path):
+        """Test that a failed write rejects the message like the WAL."""
+        storage = SQLiteStorage(str(tmp_path / "node.db"))
+        manager = RoomStateManager("node1", storage)
+        room = manager.create_room("General", "alice")
+        manager.add_member(room.room_id, "alice")
+        storage.close()
+
+        with pytest.raises(OSError):
+            storage.append(room.room_id, {"type": "ban", "username": "x"})
+        assert manager.add_message(room.room_id, "alice", "hi") is None
+
+    def test_unknown_fsync_policy(self, tmp_path):
+        """Test that SQLite rejects unknown fsync policies."""
+        with pytest.raises(ValueError):
+            SQLiteStorage(str(tmp_path / "node.db"), fsync_policy="often")
+
+
+class TestRoomRecovery:
+    """Tests for recovering rooms from each backend."""
+
+    def _recover(self, storage, reopen):
+        manager = RoomStateManager("node1", storage)
+        room_id = _populate(manager)
+        storage.close()
+
+        restarted = RoomStateManager("node1", reopen())
+        assert restarted.recover_rooms() == 1
+        return restarted, room_id
+
+    def _check(self, restarted, room_id):
+        room = restarted.get_room(room_id)
+        assert room.room_name == "General"
+        assert [m["content"] for m in room.messages] == ["first!", "second"]
+        assert room.banned == {"bob"}
+        assert restarted.get_read_positions(room_id) == {"alice": 2}
+        restarted.add_member(room_id, "carol")
+        message = restarted.add_message(room_id, "carol", "third")
+        assert message["sequence_number"] == 3
+
+    def test_memory(self):
+        """Test that MemoryStorage replays rooms like the WAL."""
+        storage = MemoryStorage()
+
+        restarted, room_id = self._recover(storage, lambda: storage)
+
+        self._check(restarted, room_id)
+
+    def test_sqlite(self, tmp_path):
+        """Test that rooms survive a restart with SQLite storage."""
+        path = str(tmp_path / "node.db")
+
+        restarted, room_id = self._recover(
+            SQLiteStorage(path), lambda: SQLiteStorage(path)
+        )
+
+        self._check(restarted, room_id)
+        history = restarted.get_history(room_id, "carol")["messages"]
+        assert [m["content"] for m in history] == ["first!", "second", "third"]
+
+
+class TestSessions:
+    """Tests for user accounts and logouts in storage."""
+
+    def test_accounts_and_logouts_survive_restart(self, tmp_path):
+        """Test that a restarted node keeps accounts and revocations."""
+        path = str(tmp_path / "node.db")
+        auth = AuthManager("node1", b"secret", storage=SQLiteStorage(path))
+        auth.register("alice", "password123")
+        token = auth.login("alice", "password123")["token"]
+        auth.logout(token)
+        auth.storage.close()
+
+        restarted = AuthManager(
+            "node1", b"secret", storage=SQLiteStorage(path)
+        )
+
+        assert restarted.login("alice", "password123")["success"] is True
+        assert restarted.login("alice", "wrong-password")["success"] is False
+        revoked = restarted.verify_token(token)
+        assert revoked["error_code"] == "TOKEN_REVOKED"
+        taken = restarted.register("alice", "password456")
+        assert taken["error_code"] == "USERNAME_TAKEN"
+
+    def test_wal_stores_accounts(self, tmp_path):
+        """Test that the WAL backend keeps accounts too."""
+        auth = AuthManager(
+            "node1", b"secret", storage=MessageLog(str(tmp_path))
+        )
+        auth.register("bob", "password123")
+        auth.storage.close()
+
+        restarted = AuthManager(
+            "node1", b"secret", storage=MessageLog(str(tmp_path))
+        )
+
+        assert restarted.login("bob", "password123")["success"] is True
+
+
+class TestConfig:
+    """Tests for selecting the backend."""
+
+    def test_open_selected_backend(self, tmp_path):
+        """Test that the configured backend is opened."""
+        data_dir = str(tmp_path)
+
+        sqlite = open_storage(
+            NodeConfig(storage_backend="sqlite", data_dir=data_dir)
+        )
+        wal = open_storage(NodeConfig(data_dir=data_dir))
+
+        assert isinstance(sqlite, SQLiteStorage)
+        assert sqlite.path == str(tmp_path / "node.db")
+        assert isinstance(wal, MessageLog)
+        assert open_storage(NodeConfig()) is None
+        assert (
+            open_storage(
+                NodeConfig(storage_backend="memory", data_dir=data_dir)
+            )
+            is None
+        )
+
+    def test_invalid_backend_settings(self):
+        """Test that unknown backends and SQLite without a directory fail."""
+        unknown = NodeConfig(storage_backend="postgres").validate()
+        no_dir = NodeConfig(storage_backend="sqlite").validate()
+
+        assert any("storage_backend" in error for error in unknown)
+        assert any("needs a data_dir" in error for error in no_dir)
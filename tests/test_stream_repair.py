@@ -0,0 +1,196 @@
+"""
+Tests for Stream Repair
+
+Tests for clients reporting their stream positions in pongs, and the node
+sending them again the room messages they missed, from its own history or
+the room's admin.
+"""
+
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.client import ChatClient
+from src.node import RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.stream_repair import StreamRepair
+
+
+class FakeClock:
+    """Clock advanced by hand."""
+
+    def __init__(self):
+        self.now = 100.0
+
+    def __call__(self):
+        return self.now
+
+
+class MockWebSocket:
+    """Mock WebSocket that records sent messages, dropping some."""
+
+    def __init__(self, drop=()):
+        self.sent_messages = []
+        self.drop = set(drop)
+
+    async def send(self, message):
+        message = json.loads(message)
+        sequence = message.get("data", {}).get("sequence_number")
+        if message["type"] == "new_message" and sequence in self.drop:
+            self.drop.discard(sequence)
+            return
+        self.sent_messages.append(message)
+
+    def sequences(self, retransmitted=False):
+        return [
+            m["data"]["sequence_number"]
+            for m in self.sent_messages
+            if m["type"] == "new_message"
+            and m["data"].get("retransmitted", False) == retransmitted
+        ]
+
+
+class AdminProxy:
+    """ServerProxy reaching the room admin's XML-RPC server."""
+
+    def __init__(self, server):
+        self.server = server
+
+    def __call__(self, address, allow_none=False):
+        return self
+
+    def __getattr__(self, method):
+        return getattr(self.server, method)
+
+
+async def pong(ws_server, websocket, sequences):
+    await ws_server.process_message(
+        websocket,
+        json.dumps({"type": "pong", "data": {"sequences": sequences}}),
+    )
+
+
+async def send_message(ws_server, websocket, room_id, username, content):
+    await ws_server.process_message(
+        websocket,
+        json.dumps(
+            {
+                "type": "send_message",
+                "data": {
+                    "room_id": room_id,
+                    "username": username,
+                    "content": content,
+                },
+            }
+        ),
+    )
+
+
+def _connect(ws_server, room_id, username, websocket):
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+class TestStreamRepair:
+    """Tests for the sequence numbers tracked per room."""
+
+    def test_missing_ranges(self):
+        """Test the grace period, the batch size and the floor."""
+        clock = FakeClock()
+        repair = StreamRepair(grace=2, batch=3, clock=clock)
+        for sequence in range(1, 6):
+            repair.record("room-1", sequence)
+        clock.now += 1
+        repair.record("room-1", 6)
+
+        assert repair.latest("room-1") == 6
+        assert repair.missing("room-1", 0) is None
+        clock.now += 1.5
+        assert repair.missing("room-1", 0) == (1, 3)
+        assert repair.missing("room-1", 1, floor=4) == (5, 5)
+        assert repair.missing("room-1", 5) is None
+        clock.now += 1
+        assert repair.missing("room-1", 5) == (6, 6)
+        repair.forget("room-1")
+        assert repair.missing("room-1", 0) is None
+
+
+class TestPong:
+    """Tests for repairing streams reported in pongs."""
+
+    @pytest.mark.asyncio
+    async def test_dropped_messages_sent_again(self):
+        """Test a hosted room's gap filled once, from after the join."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("General", "alice").room_id
+        for username in ("alice", "bob"):
+            manager.add_member(room_id, username)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        ws_server.stream_repair = StreamRepair(grace=0)
+        alice = _connect(ws_server, room_id, "alice", MockWebSocket())
+        await send_message(ws_server, alice, room_id, "alice", "before")
+        bob = _connect(ws_server, room_id, "bob", MockWebSocket(drop={3}))
+
+        for content in ("one", "two", "three"):
+            await send_message(ws_server, alice, room_id, "alice", content)
+        await pong(ws_server, bob, {room_id: 2})
+        await pong(ws_server, bob, {room_id: 2})
+        await pong(ws_server, alice, {room_id: 4, "other-room": 0})
+
+        assert bob.sequences() == [2, 4]
+        assert bob.sequences(retransmitted=True) == [3, 4]
+        assert alice.sequences(retransmitted=True) == []
+
+    @pytest.mark.asyncio
+    async def test_remote_room_read_from_admin(self):
+        """Test messages fetched from the admin, except filtered ones."""
+        admin = RoomStateManager("node-a")
+        room_id = admin.create_room("General", "alice").room_id
+        for username in ("alice", "bob", "carol"):
+            admin.add_member(room_id, username)
+        for username, content in (
+            ("alice", "one"),
+            ("carol", "spam"),
+            ("alice", "two"),
+        ):
+            admin.add_message(room_id, username, content)
+        ws_server = WebSocketServer(
+            RoomStateManager("node-b"), "localhost", 0, object()
+        )
+        ws_server.stream_repair = StreamRepair(grace=0)
+        ws_server._locate_room_admin = lambda room_id: (
+            {"room_id": room_id},
+            "http://node-a",
+        )
+        bob = _connect(ws_server, room_id, "bob", MockWebSocket())
+        ws_server.profiles.block("bob", "carol")
+        for message in admin.get_messages(room_id):
+            ws_server._record_delivery(room_id, message)
+
+        server = XMLRPCServer(admin, "localhost", 0, "http://node-a")
+        with patch("src.node.websocket_server.ServerProxy", AdminProxy(server)):
+            await pong(ws_server, bob, {room_id: 0})
+
+        assert bob.sequences(retransmitted=True) == [1, 3]
+
+
+class TestClient:
+    """Tests for the client reporting its stream positions."""
+
+    @pytest.mark.asyncio
+    async def test_ping_answered_with_sequences(self):
+        """Test the chat client's pong carrying its last seen sequences."""
+        websocket = MockWebSocket()
+        client = ChatClient("ws://localhost:8080")
+        client._set_test_mode(websocket)
+        client.set_current_room("room-1")
+        client.message_buffers["room-1"].set_last_displayed_seq(7)
+
+        await client._process_incoming_message(
+            json.dumps({"type": "ping", "data": {}})
+        )
+
+        assert websocket.sent_messages == [
+            {"type": "pong", "data": {"sequences": {"room-1": 7}}}
+        ]
@@ -0,0 +1,287 @@
+"""
+Tests for Threaded Replies
+
+Tests for replies joining their parent's thread, thread summaries, paging
+a thread subtree, rebuilding summaries from the message log, replies over
+WebSocket and through the admin node, and summaries reaching replicas.
+"""
+
+import json
+from types import SimpleNamespace
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    ReplicaStore,
+    RoomDirectory,
+    RoomStateManager,
+    ThreadError,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+def _room(manager, *members):
+    room = manager.create_room("general", "alice")
+    for username in ("alice",) + members:
+        manager.add_member(room.room_id, username)
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestReplies:
+    """Tests for replies in the room state."""
+
+    def test_reply_joins_root_thread(self):
+        """Test that replies to replies keep the first message's thread."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        root = manager.add_message(room_id, "alice", "lunch?")
+        reply = manager.add_message(
+            room_id, "bob", "sure", reply_to=root["message_id"]
+        )
+        nested = manager.add_message(
+            room_id, "alice", "noon", reply_to=reply["message_id"]
+        )
+
+        assert reply["reply_to"] == root["message_id"]
+        assert reply["thread_id"] == root["message_id"]
+        assert nested["reply_to"] == reply["message_id"]
+        assert nested["thread_id"] == root["message_id"]
+        assert "thread_id" not in root
+
+    def test_thread_summary(self):
+        """Test that the root counts replies and notes the last one."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        root_id = manager.add_message(room_id, "alice", "lunch?")["message_id"]
+        manager.add_message(room_id, "bob", "sure", reply_to=root_id)
+        last = manager.add_message(room_id, "alice", "noon", reply_to=root_id)
+
+        thread = manager.get_thread(room_id, root_id)
+        assert thread == {"reply_count": 2, "last_reply_at": last["timestamp"]}
+        assert manager.get_messages(room_id)[0]["thread"] == thread
+        assert manager.get_thread(room_id, last["message_id"]) is None
+
+    def test_unknown_parent_rejected(self):
+        """Test that a reply to a message not in the room is refused."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+
+        with pytest.raises(ThreadError) as missing:
+            manager.add_message(room_id, "bob", "hi", reply_to="missing")
+
+        assert missing.value.error_code == "PARENT_NOT_FOUND"
+        assert manager.get_messages(room_id) == []
+
+    def test_history_of_subtree(self):
+        """Test that history with a thread_id pages only that subtree."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        root_id = manager.add_message(room_id, "alice", "lunch?")["message_id"]
+        manager.add_message(room_id, "bob", "unrelated")
+        reply = manager.add_message(room_id, "bob", "sure", reply_to=root_id)
+        nested = manager.add_message(
+            room_id, "alice", "noon", reply_to=reply["message_id"]
+        )
+
+        subtree = manager.get_history(room_id, "bob", thread_id=root_id)
+        branch = manager.get_history(
+            room_id, "bob", thread_id=reply["message_id"]
+        )
+        missing = manager.get_history(room_id, "bob", thread_id="missing")
+
+        assert [m["content"] for m in subtree["messages"]] == [
+            "lunch?",
+            "sure",
+            "noon",
+        ]
+        assert [m["message_id"] for m in branch["messages"]] == [
+            reply["message_id"],
+            nested["message_id"],
+        ]
+        assert missing["error_code"] == "MESSAGE_NOT_FOUND"
+
+    def test_summary_rebuilt_from_log(self, tmp_path):
+        """Test that thread summaries survive a restart and reach history."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = _room(manager, "bob")
+        root_id = manager.add_message(room_id, "alice", "lunch?")["message_id"]
+        manager.add_message(room_id, "bob", "sure", reply_to=root_id)
+        last = manager.add_message(room_id, "alice", "noon", reply_to=root_id)
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        expected = {"reply_count": 2, "last_reply_at": last["timestamp"]}
+        assert recovered.get_messages(room_id)[0]["thread"] == expected
+        history = recovered.get_history(room_id, "bob")["messages"]
+        assert history[0]["thread"] == expected
+
+
+class TestReplyCommands:
+    """Tests for replies over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_reply_announces_thread(self):
+        """Test that a reply is delivered with a thread_updated event."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        root_id = manager.add_message(room_id, "alice", "lunch?")["message_id"]
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        await _request(
+            ws_server,
+            bob,
+            "send_message",
+            room_id=room_id,
+            username="bob",
+            content="sure",
+            reply_to=root_id,
+        )
+
+        reply = alice.received("new_message")[0]
+        assert reply["reply_to"] == root_id
+        updated = alice.received("thread_updated")[0]
+        assert updated["thread_id"] == root_id
+        assert updated["reply_count"] == 1
+        assert updated["last_reply_at"] == reply["timestamp"]
+
+    @pytest.mark.asyncio
+    async def test_reply_to_unknown_message(self):
+        """Test that a reply to an unknown message gets message_error."""
+        manager = RoomStateManager("node-a")
+        room_id = _room(manager, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+
+        response = await _request(
+            ws_server,
+            _join(ws_server, room_id, "bob"),
+            "send_message",
+            room_id=room_id,
+            username="bob",
+            content="sure",
+            reply_to="missing",
+        )
+
+        assert response["type"] == "message_error"
+        assert response["data"]["error_code"] == "PARENT_NOT_FOUND"
+
+    @pytest.mark.asyncio
+    async def test_reply_and_thread_through_admin(self):
+        """Test that replies and thread history work for remote rooms."""
+        admin = RoomStateManager("node-a")
+        room_id = _room(admin, "bob")
+        root_id = admin.add_message(room_id, "alice", "lunch?")["message_id"]
+        admin.add_message(room_id, "alice", "unrelated")
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+        bob = _join(ws_b, room_id, "bob")
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            await _request(
+                ws_b,
+                bob,
+                "send_message",
+                room_id=room_id,
+                username="bob",
+                content="sure",
+                reply_to=root_id,
+            )
+            history = await _request(
+                ws_b,
+                bob,
+                "get_history",
+                room_id=room_id,
+                username="bob",
+                thread_id=root_id,
+            )
+
+        assert admin.get_thread(room_id, root_id)["reply_count"] == 1
+        assert history["type"] == "history"
+        assert [m["content"] for m in history["data"]["messages"]] == [
+            "lunch?",
+            "sure",
+        ]
+
+
+class TestReplicas:
+    """Tests for thread summaries reaching replicas on other nodes."""
+
+    def test_event_applied_to_replica(self):
+        """Test that a thread_updated event updates the local replica."""
+        store = ReplicaStore()
+        room_info = {"room_id": "r1", "room_name": "general"}
+        message = {"message_id": "m1", "sequence_number": 1, "content": "hi"}
+        store.update_from_join(room_info, [message], "bob")
+        rpc = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b:9090",
+            failover=SimpleNamespace(replica_store=store),
+        )
+        event = {
+            "room_id": "r1",
+            "thread_id": "m1",
+            "reply_count": 3,
+            "last_reply_at": "2026-01-01T00:00:00+00:00",
+        }
+
+        rpc.receive_member_event_broadcast("r1", "thread_updated", event)
+
+        assert store.get("r1").messages[0]["thread"] == {
+            "reply_count": 3,
+            "last_reply_at": "2026-01-01T00:00:00+00:00",
+        }
@@ -0,0 +1,241 @@
+"""
+Tests for TLS
+
+Tests for the wss:// client listener, mutual TLS between nodes' XML-RPC
+servers and clients, certificate reload, and the TLS settings checks.
+Certificates are generated with the openssl command line tool.
+"""
+
+import asyncio
+import os
+import signal
+import socket
+import ssl
+import subprocess
+import xmlrpc.client
+from unittest.mock import AsyncMock, patch
+import pytest
+
+from src.node import RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.config import NodeConfig
+from src.node.rpc import RPCClientPool
+from src.node.tls import TLSManager, configure_tls, install_reload_handler
+
+
+# Options for a new elliptic curve key without a passphrase
+_NEW_KEY = "-newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes"
+
+
+def _openssl(command, cwd):
+    subprocess.run(
+        ["openssl", *command.split()], cwd=cwd, check=True, capture_output=True
+    )
+
+
+def make_ca(directory, name="test-ca"):
+    """Create a CA certificate and key; returns the certificate path."""
+    _openssl(
+        f"req -x509 {_NEW_KEY} -keyout {name}.key -out {name}.pem -days 1 "
+        f"-subj /CN={name}",
+        directory,
+    )
+    return str(directory / f"{name}.pem")
+
+
+def make_cert(directory, name, ca="test-ca"):
+    """Create a localhost certificate signed by a CA; returns (cert, key)."""
+    (directory / "san.cnf").write_text("subjectAltName=DNS:localhost,IP:127.0.0.1\n")
+    _openssl(
+        f"req {_NEW_KEY} -keyout {name}.key -out {name}.csr -subj /CN={name}",
+        directory,
+    )
+    _openssl(
+        f"x509 -req -in {name}.csr -CA {ca}.pem -CAkey {ca}.key -CAcreateserial "
+        f"-out {name}.pem -days 1 -extfile san.cnf",
+        directory,
+    )
+    return str(directory / f"{name}.pem"), str(directory / f"{name}.key")
+
+
+def _peer_common_name(port, context):
+    """Connect to a TLS server and get the common name of its certificate."""
+    with socket.create_connection(("127.0.0.1", port), timeout=5) as sock:
+        with context.wrap_socket(sock, server_hostname="localhost") as tls_sock:
+            subject = dict(item[0] for item in tls_sock.getpeercert()["subject"])
+    return subject["commonName"]
+
+
+def _start_xmlrpc(tls):
+    server = XMLRPCServer(RoomStateManager("node-a"), "127.0.0.1", 0, "", tls=tls)
+    server.start()
+    return server, server.server.server_address[1]
+
+
+class TestWebSocketTLS:
+    """Tests for the wss:// client listener."""
+
+    @pytest.mark.asyncio
+    async def test_listener_serves_wss(self, tmp_path):
+        """Test that the listener is started with the node's certificate."""
+        make_ca(tmp_path)
+        tls = TLSManager(*make_cert(tmp_path, "node-a"))
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "127.0.0.1", 0, tls=tls)
+        serve = AsyncMock()
+
+        with patch("src.node.websocket_server.websockets.serve", serve):
+            await ws_server.start()
+
+        assert serve.call_args.kwargs["ssl"] is tls.server_context
+
+    @pytest.mark.asyncio
+    async def test_plaintext_without_certificate(self):
+        """Test that the listener serves ws:// when TLS isn't configured."""
+        ws_server = WebSocketServer(RoomStateManager("node-a"), "127.0.0.1", 0)
+        serve = AsyncMock()
+
+        with patch("src.node.websocket_server.websockets.serve", serve):
+            await ws_server.start()
+
+        assert serve.call_args.kwargs["ssl"] is None
+
+
+class TestMutualTLS:
+    """Tests for certificate-authenticated calls between nodes."""
+
+    def test_peer_call_with_client_certificate(self, tmp_path):
+        """Test that a node with a certificate from the CA can call a peer."""
+        ca = make_ca(tmp_path)
+        server, port = _start_xmlrpc(TLSManager(*make_cert(tmp_path, "node-a"), ca))
+        configure_tls(TLSManager(*make_cert(tmp_path, "node-b"), ca))
+
+        try:
+            result = RPCClientPool().call(f"https://localhost:{port}", "heartbeat")
+        finally:
+            configure_tls(None)
+            server.stop()
+
+        assert result["status"] == "ok"
+
+    def test_caller_without_certificate_rejected(self, tmp_path):
+        """Test that the XML-RPC server refuses callers with no certificate."""
+        ca = make_ca(tmp_path)
+        server, port = _start_xmlrpc(TLSManager(*make_cert(tmp_path, "node-a"), ca))
+        transport = xmlrpc.client.SafeTransport(
+            context=ssl.create_default_context(cafile=ca)
+        )
+        proxy = xmlrpc.client.ServerProxy(
+            f"https://localhost:{port}", transport=transport
+        )
+
+        try:
+            with pytest.raises((ssl.SSLError, ConnectionError)):
+                proxy.heartbeat()
+        finally:
+            server.stop()
+
+    def test_certificate_from_other_ca_rejected(self, tmp_path):
+        """Test that a certificate signed by another CA is refused."""
+        ca = make_ca(tmp_path)
+        make_ca(tmp_path, "other-ca")
+        server, port = _start_xmlrpc(TLSManager(*make_cert(tmp_path, "node-a"), ca))
+        configure_tls(TLSManager(*make_cert(tmp_path, "intruder", "other-ca"), ca))
+
+        try:
+            with pytest.raises((ssl.SSLError, ConnectionError)):
+                RPCClientPool().call(f"https://localhost:{port}", "heartbeat")
+        finally:
+            configure_tls(None)
+            server.stop()
+
+
+class TestReload:
+    """Tests for rotating certificates without a restart."""
+
+    def test_reload_serves_new_certificate(self, tmp_path):
+        """Test that connections after a reload get the new certificate."""
+        ca = make_ca(tmp_path)
+        cert, key = make_cert(tmp_path, "node-a")
+        tls = TLSManager(cert, key, ca)
+        server, port = _start_xmlrpc(tls)
+        peer = TLSManager(*make_cert(tmp_path, "node-b"), ca)
+
+        try:
+            before = _peer_common_name(port, peer.client_context)
+            rotated = make_cert(tmp_path, "node-a-rotated")
+            os.replace(rotated[0], cert)
+            os.replace(rotated[1], key)
+            assert tls.reload()
+            after = _peer_common_name(port, peer.client_context)
+        finally:
+            server.stop()
+
+        assert (before, after) == ("node-a", "node-a-rotated")
+        assert tls.reloads == 1
+
+    def test_bad_files_keep_previous_certificate(self, tmp_path):
+        """Test that a failed reload leaves the node serving its old cert."""
+        ca = make_ca(tmp_path)
+        cert, key = make_cert(tmp_path, "node-a")
+        tls = TLSManager(cert, key, ca)
+        server, port = _start_xmlrpc(tls)
+        peer = TLSManager(*make_cert(tmp_path, "node-b"), ca)
+
+        try:
+            with open(cert, "w") as f:
+                f.write("not a certificate")
+            assert not tls.reload()
+            served = _peer_common_name(port, peer.client_context)
+        finally:
+            server.stop()
+
+        assert served == "node-a"
+        assert tls.reloads == 0
+
+    @pytest.mark.asyncio
+    async def test_sighup_reloads(self, tmp_path):
+        """Test that SIGHUP triggers a reload."""
+        make_ca(tmp_path)
+        tls = TLSManager(*make_cert(tmp_path, "node-a"))
+        loop = asyncio.get_running_loop()
+
+        assert install_reload_handler(loop, tls)
+        try:
+            os.kill(os.getpid(), signal.SIGHUP)
+            await asyncio.sleep(0.1)
+        finally:
+            loop.remove_signal_handler(signal.SIGHUP)
+
+        assert tls.reloads == 1
+
+
+class TestTLSConfig:
+    """Tests for the TLS settings checks."""
+
+    def test_files_checked(self, tmp_path):
+        """Test that the certificate and key go together and must exist."""
+        cert = tmp_path / "node.pem"
+        cert.write_text("")
+
+        assert NodeConfig(tls_cert_file=str(cert)).validate() == [
+            "tls_cert_file and tls_key_file must be set together"
+        ]
+        assert NodeConfig(tls_ca_file=str(cert)).validate() == [
+            "tls_ca_file requires tls_cert_file and tls_key_file"
+        ]
+        missing = str(tmp_path / "missing.key")
+        assert NodeConfig(tls_cert_file=str(cert), tls_key_file=missing).validate() == [
+            f"tls_key_file {missing!r} does not exist"
+        ]
+
+    def test_peers_must_use_https(self, tmp_path):
+        """Test that TLS nodes advertise and call https:// addresses."""
+        cert = tmp_path / "node.pem"
+        cert.write_text("")
+        settings = {"tls_cert_file": str(cert), "tls_key_file": str(cert)}
+
+        assert NodeConfig(**settings).xmlrpc_address == "https://node1:9090"
+        peers = {"node2": "http://node2:9090"}
+        assert NodeConfig(peers=peers, **settings).validate() == [
+            "peer node2 'http://node2:9090' must be an https:// URL when TLS "
+            "is enabled"
+        ]
@@ -0,0 +1,270 @@
+"""
+Tests for Total-Order Rooms
+
+Tests for the admin node sequencing messages of total-order rooms, other
+nodes delivering them strictly by sequence number, and gap repair through
+retransmission requests.
+"""
+
+import json
+import pytest
+
+from src.node import PeerRegistry, RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.total_order import SequenceBuffer
+from src.node.wal import MessageLog
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+class LocalRPC:
+    """RPC client pool that calls other nodes' XML-RPC servers in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def call(self, address, method, *args, timeout=None):
+        target = self.servers.get(address)
+        if target is None:
+            raise ConnectionError("unreachable")
+        return getattr(target, method)(*args)
+
+
+def _message(sequence_number, sequencer="node-a"):
+    return {
+        "message_id": f"m{sequence_number}",
+        "sequence_number": sequence_number,
+        "total_order": True,
+        "sequencer": sequencer,
+    }
+
+
+def _seqs(messages):
+    return [message["sequence_number"] for message in messages]
+
+
+def _node(node_id, servers):
+    address = f"http://{node_id}:9090"
+    registry = PeerRegistry(node_id)
+    registry.rpc = LocalRPC(servers)
+    manager = RoomStateManager(node_id)
+    server = XMLRPCServer(
+        manager,
+        "localhost",
+        0,
+        address,
+        registry,
+        sequence_buffer=SequenceBuffer(retransmit_timeout=0),
+    )
+    delivered = []
+    server.set_broadcast_callback(
+        lambda room_id, message, exclude_user=None: delivered.append(
+            message["data"]
+        )
+    )
+    servers[address] = server
+    return server, delivered
+
+
+def _sequenced_room(manager, count):
+    room = manager.create_room("ordered", "alice", total_order=True)
+    manager.add_member(room.room_id, "alice")
+    messages = [
+        manager.add_message(room.room_id, "alice", f"message {seq}")
+        for seq in range(1, count + 1)
+    ]
+    return room.room_id, messages
+
+
+class TestSequenceBuffer:
+    """Tests for releasing messages strictly by sequence number."""
+
+    def test_in_order_messages_released(self):
+        """Test that consecutive messages are released at once."""
+        buffer = SequenceBuffer()
+
+        assert _seqs(buffer.receive("room-1", _message(1))) == [1]
+        assert _seqs(buffer.receive("room-1", _message(2))) == [2]
+
+    def test_gap_holds_later_messages(self):
+        """Test that a message after a gap waits for the missing one."""
+        buffer = SequenceBuffer()
+        buffer.receive("room-1", _message(1))
+
+        assert buffer.receive("room-1", _message(3)) == []
+        assert buffer.receive("room-1", _message(4)) == []
+        assert _seqs(buffer.receive("room-1", _message(2))) == [2, 3, 4]
+        assert buffer.held_count("room-1") == 0
+
+    def test_duplicates_dropped(self):
+        """Test that already delivered messages are not released again."""
+        buffer = SequenceBuffer()
+        buffer.receive("room-1", _message(1))
+
+        assert buffer.receive("room-1", _message(1)) == []
+
+    def test_seed_after_join(self):
+        """Test that messages that came with a join are not expected."""
+        buffer = SequenceBuffer()
+        buffer.seed("room-1", 5)
+
+        assert buffer.receive("room-1", _message(5)) == []
+        assert _seqs(buffer.receive("room-1", _message(6))) == [6]
+
+    def test_gap_reported_after_timeout(self):
+        """Test that an open gap is reported with its missing range."""
+        buffer = SequenceBuffer(retransmit_timeout=5)
+        buffer.receive("room-1", _message(1))
+        buffer.receive("room-1", _message(4))
+        opened_at = buffer._gaps["room-1"][0]
+
+        assert buffer.gaps(now=opened_at + 1) == []
+        gap = buffer.gaps(now=opened_at + 5)[0]
+        assert (gap.first_sequence, gap.last_sequence) == (2, 3)
+        assert gap.sequencer == "node-a"
+
+    def test_stale_gap_skipped(self):
+        """Test that a gap that can't be filled is eventually skipped."""
+        buffer = SequenceBuffer(retransmit_timeout=0, max_attempts=2)
+        buffer.receive("room-1", _message(1))
+        buffer.receive("room-1", _message(3))
+
+        assert buffer.skip_stale_gaps() == {}
+        assert len(buffer.gaps()) == 1
+        assert len(buffer.gaps()) == 1
+        assert buffer.gaps() == []
+
+        released = buffer.skip_stale_gaps()
+        assert _seqs(released["room-1"]) == [3]
+        assert buffer.next_sequence("room-1") == 4
+
+    def test_too_many_held_skips_gap(self):
+        """Test that the held limit bounds memory use."""
+        buffer = SequenceBuffer(max_held=2)
+        buffer.receive("room-1", _message(1))
+        buffer.receive("room-1", _message(3))
+        buffer.receive("room-1", _message(4))
+
+        assert _seqs(buffer.receive("room-1", _message(5))) == [3, 4, 5]
+
+
+class TestSequencer:
+    """Tests for the admin node sequencing total-order rooms."""
+
+    def test_messages_marked_with_sequencer(self):
+        """Test that total-order messages name the admin as sequencer."""
+        manager = RoomStateManager("node-a")
+        _, messages = _sequenced_room(manager, 2)
+
+        assert _seqs(messages) == [1, 2]
+        assert all(m["total_order"] for m in messages)
+        assert all(m["sequencer"] == "node-a" for m in messages)
+
+    def test_ordinary_rooms_unmarked(self):
+        """Test that rooms without the option keep causal delivery."""
+        manager = RoomStateManager("node-a")
+        room = manager.create_room("general", "alice")
+        manager.add_member(room.room_id, "alice")
+
+        message = manager.add_message(room.room_id, "alice", "hi")
+
+        assert "total_order" not in message
+        assert room.to_dict()["total_order"] is False
+
+    def test_option_survives_restart(self, tmp_path):
+        """Test that recovered rooms keep the total order option."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id, _ = _sequenced_room(manager, 1)
+
+        recovered = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        recovered.recover_rooms()
+
+        assert recovered.get_room(room_id).total_order is True
+
+    def test_sequence_range(self):
+        """Test that a range of messages can be read for retransmission."""
+        manager = RoomStateManager("node-a")
+        room_id, _ = _sequenced_room(manager, 5)
+
+        assert _seqs(manager.get_sequence_range(room_id, 2, 4)) == [2, 3, 4]
+
+
+class TestRemoteDelivery:
+    """Tests for non-admin nodes delivering total-order messages."""
+
+    def test_out_of_order_broadcast_held(self):
+        """Test that clients never see a message before its predecessor."""
+        servers = {}
+        admin, _ = _node("node-a", servers)
+        member, delivered = _node("node-b", servers)
+        room_id, messages = _sequenced_room(admin.room_manager, 3)
+
+        member.receive_message_broadcast(room_id, messages[0])
+        member.receive_message_broadcast(room_id, messages[2])
+        assert _seqs(delivered) == [1]
+
+        member.receive_message_broadcast(room_id, messages[1])
+        assert _seqs(delivered) == [1, 2, 3]
+
+    def test_gap_filled_by_retransmission(self):
+        """Test that a lost message is fetched from the sequencer."""
+        servers = {}
+        admin, _ = _node("node-a", servers)
+        member, delivered = _node("node-b", servers)
+        member.peer_registry.register_peer("node-a", "http://node-a:9090")
+        room_id, messages = _sequenced_room(admin.room_manager, 4)
+        member.receive_message_broadcast(room_id, messages[0])
+        member.receive_message_broadcast(room_id, messages[3])
+
+        assert member.repair_sequence_gaps() == 3
+
+        assert _seqs(delivered) == [1, 2, 3, 4]
+
+    def test_retransmit_unknown_room(self):
+        """Test that retransmission for a room not hosted is an error."""
+        servers = {}
+        admin, _ = _node("node-a", servers)
+
+        result = admin.retransmit_messages("nope", 1, 2)
+
+        assert result["error_code"] == "ROOM_NOT_FOUND"
+
+
+class TestCreateRoom:
+    """Tests for creating total-order rooms over WebSocket."""
+
+    @pytest.mark.asyncio
+    async def test_create_total_order_room(self):
+        """Test that create_room accepts the total_order option."""
+        manager = RoomStateManager("node-a")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        websocket = MockWebSocket()
+
+        await ws_server.process_message(
+            websocket,
+            json.dumps(
+                {
+                    "type": "create_room",
+                    "data": {
+                        "room_name": "ordered",
+                        "creator_id": "alice",
+                        "total_order": True,
+                    },
+                }
+            ),
+        )
+
+        response = websocket.last()
+        assert response["data"]["total_order"] is True
+        room = manager.get_room(response["data"]["room_id"])
+        assert room.total_order is True
@@ -0,0 +1,351 @@
+"""
+Tests for the Generic Two-Phase Commit Engine
+
+Tests for participant voting and decisions, coordinator commit/abort
+paths, timeouts, transaction logs, and room deletion over the engine.
+"""
+
+import json
+import time
+import pytest
+
+from src.node import (
+    RoomStateManager,
+    RoomState,
+    WebSocketServer,
+    XMLRPCServer,
+    TPCCoordinator,
+    TPCParticipant,
+    TransactionHandler,
+    TransactionLog,
+)
+from tests.fakes import LocalPeerRegistry
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+
+class RecordingHandler(TransactionHandler):
+    """Handler that records calls and votes as configured."""
+
+    def __init__(self, vote="READY"):
+        self.vote = vote
+        self.calls = []
+
+    def prepare(self, transaction_id, payload):
+        self.calls.append(("prepare", transaction_id))
+        return {"vote": self.vote, "reason": "busy"}
+
+    def commit(self, transaction_id, payload):
+        self.calls.append(("commit", transaction_id))
+        return {"success": True}
+
+    def abort(self, transaction_id, payload):
+        self.calls.append(("abort", transaction_id))
+        return {"success": True}
+
+
+class ParticipantServer:
+    """Expose a TPCParticipant under the RPC method names."""
+
+    def __init__(self, participant):
+        self.participant = participant
+
+    def tpc_prepare(self, transaction_id, operation, payload, coordinator):
+        return self.participant.prepare(
+            transaction_id, operation, payload, coordinator
+        )
+
+    def tpc_commit(self, transaction_id):
+        return self.participant.commit(transaction_id)
+
+    def tpc_abort(self, transaction_id):
+        return self.participant.abort(transaction_id)
+
+
+def _participant(node_id, vote="READY"):
+    participant = TPCParticipant(node_id)
+    handler = RecordingHandler(vote)
+    participant.register_handler("rename_room", handler)
+    return participant, handler
+
+
+# ===== Transaction Log Tests =====
+
+
+def test_transaction_log_records_events():
+    """Test that events are kept per transaction."""
+    log = TransactionLog()
+    log.append("t1", "PREPARE", operation="x")
+    log.append("t1", "COMMIT")
+    log.append("t2", "PREPARE")
+
+    events = log.get("t1")
+    assert [e["event"] for e in events] == ["PREPARE", "COMMIT"]
+    assert events[0]["operation"] == "x"
+    assert log.transaction_ids() == ["t1", "t2"]
+
+
+def test_transaction_log_is_bounded():
+    """Test that the oldest transactions are evicted."""
+    log = TransactionLog(max_transactions=2)
+    for transaction_id in ("t1", "t2", "t3"):
+        log.append(transaction_id, "PREPARE")
+
+    assert log.transaction_ids() == ["t2", "t3"]
+    assert log.get("t1") == []
+
+
+# ===== Participant Tests =====
+
+
+def test_participant_prepare_and_commit():
+    """Test a READY vote followed by commit."""
+    participant, handler = _participant("node2")
+
+    vote = participant.prepare("t1", "rename_room", {}, "node1")
+    assert vote["vote"] == "READY"
+    assert participant.get_transaction("t1") is not None
+
+    result = participant.commit("t1")
+    assert result["success"] is True
+    assert result["node_id"] == "node2"
+    assert handler.calls == [("prepare", "t1"), ("commit", "t1")]
+    assert participant.get_transaction("t1") is None
+
+
+def test_participant_abort_vote_is_not_tracked():
+    """Test that an ABORT vote leaves nothing prepared."""
+    participant, _ = _participant("node2", vote="ABORT")
+
+    vote = participant.prepare("t1", "rename_room", {}, "node1")
+    assert vote["vote"] == "ABORT"
+    assert vote["reason"] == "busy"
+    assert participant.get_transaction("t1") is None
+    assert participant.abort("t1")["success"] is True
+
+
+def test_participant_unknown_operation_votes_abort():
+    """Test that an unregistered operation is refused."""
+    participant = TPCParticipant("node2")
+    vote = participant.prepare("t1", "unknown", {}, "node1")
+    assert vote["vote"] == "ABORT"
+    assert "Unknown operation" in vote["reason"]
+
+
+def test_participant_commit_unprepared_fails():
+    """Test that committing an unknown transaction fails."""
+    participant, _ = _participant("node2")
+    assert participant.commit("missing")["success"] is False
+
+
+def test_participant_repeated_prepare_repeats_vote():
+    """Test that a retried PREPARE doesn't call the handler again."""
+    participant, handler = _participant("node2")
+    participant.prepare("t1", "rename_room", {}, "node1")
+    vote = participant.prepare("t1", "rename_room", {}, "node1")
+    assert vote["vote"] == "READY"
+    assert handler.calls == [("prepare", "t1")]
+
+
+def test_participant_expires_undecided_transactions():
+    """Test that a prepared transaction without a decision is aborted."""
+    participant, handler = _participant("node2")
+    participant.prepare("t1", "rename_room", {}, "node1")
+    participant.get_transaction("t1").prepared_at = time.time() - 1000
+
+    assert participant.expire_prepared() == ["t1"]
+    assert handler.calls[-1] == ("abort", "t1")
+    events = [e["event"] for e in participant.log.get("t1")]
+    assert events == ["PREPARE", "VOTE", "TIMEOUT", "ROLLBACK"]
+
+
+# ===== Coordinator Tests =====
+
+
+@pytest.mark.asyncio
+async def test_coordinator_commits_when_all_ready():
+    """Test that unanimous READY votes commit everywhere."""
+    p2, h2 = _participant("node2")
+    p3, h3 = _participant("node3")
+    registry = LocalPeerRegistry(
+        servers={"node2": ParticipantServer(p2), "node3": ParticipantServer(p3)}
+    )
+    coordinator = TPCCoordinator("node1", registry)
+
+    result = await coordinator.execute(
+        "rename_room", {"room_id": "r1"}, ["node2", "node3"]
+    )
+
+    assert result.committed
+    assert result.votes == {"node2": "READY", "node3": "READY"}
+    assert h2.calls[-1][0] == "commit"
+    assert h3.calls[-1][0] == "commit"
+    events = [e["event"] for e in coordinator.log.get(result.transaction_id)]
+    assert events[0] == "PREPARE"
+    assert "COMMIT" in events
+
+
+@pytest.mark.asyncio
+async def test_coordinator_aborts_on_abort_vote():
+    """Test that a single ABORT vote aborts everywhere."""
+    p2, h2 = _participant("node2")
+    p3, h3 = _participant("node3", vote="ABORT")
+    registry = LocalPeerRegistry(
+        servers={"node2": ParticipantServer(p2), "node3": ParticipantServer(p3)}
+    )
+    coordinator = TPCCoordinator("node1", registry)
+
+    result = await coordinator.execute("rename_room", {}, ["node2", "node3"])
+
+    assert not result.committed
+    assert result.abort_reason == "busy"
+    assert h2.calls[-1][0] == "abort"
+    assert ("node3", "tpc_abort") in registry.calls
+
+
+@pytest.mark.asyncio
+async def test_coordinator_aborts_on_unreachable_participant():
+    """Test that a failed PREPARE call counts as ABORT."""
+    p2, h2 = _participant("node2")
+    registry = LocalPeerRegistry(
+        servers={"node2": ParticipantServer(p2), "node3": None}
+    )
+    coordinator = TPCCoordinator("node1", registry)
+
+    result = await coordinator.execute("rename_room", {}, ["node2", "node3"])
+
+    assert not result.committed
+    assert "node3" in result.abort_reason
+    assert h2.calls[-1][0] == "abort"
+
+
+@pytest.mark.asyncio
+async def test_coordinator_aborts_on_prepare_timeout():
+    """Test that a participant slower than the timeout aborts the txn."""
+
+    class SlowServer(ParticipantServer):
+        def tpc_prepare(self, *args):
+            time.sleep(0.3)
+            return super().tpc_prepare(*args)
+
+    p2, _ = _participant("node2")
+    registry = LocalPeerRegistry(servers={"node2": SlowServer(p2)})
+    coordinator = TPCCoordinator("node1", registry, prepare_timeout=0.05)
+
+    result = await coordinator.execute("rename_room", {}, ["node2"])
+
+    assert not result.committed
+    assert result.votes["node2"] == "ABORT"
+
+
+@pytest.mark.asyncio
+async def test_coordinator_without_participants_commits():
+    """Test that a local-only transaction commits immediately."""
+    decisions = []
+    coordinator = TPCCoordinator("node1")
+
+    result = await coordinator.execute(
+        "rename_room", {}, [], on_decision=decisions.append
+    )
+
+    assert result.committed
+    assert decisions == [result]
+
+
+# ===== Room Deletion Over the Engine =====
+
+
+def _node(node_id):
+    manager = RoomStateManager(node_id=node_id)
+    server = XMLRPCServer(manager, "localhost", 9090, f"http://{node_id}")
+    return manager, server
+
+
+def test_xmlrpc_tpc_delete_room_handler():
+    """Test that tpc_prepare/tpc_commit delete a room on a participant."""
+    manager, server = _node("node2")
+    room = manager.create_room("Doomed", "alice")
+    payload = {"room_id": room.room_id, "room_name": "Doomed"}
+
+    vote = server.tpc_prepare("t1", "delete_room", payload, "node1")
+    assert vote["vote"] == "READY"
+    assert manager.get_room(room.room_id).state == RoomState.DELETION_PENDING
+
+    assert server.tpc_commit("t1")["success"] is True
+    assert manager.get_room(room.room_id) is None
+
+
+def test_xmlrpc_tpc_abort_restores_room():
+    """Test that tpc_abort restores a pending room to ACTIVE."""
+    manager, server = _node("node2")
+    room = manager.create_room("Kept", "alice")
+    payload = {"room_id": room.room_id, "room_name": "Kept"}
+
+    server.tpc_prepare("t1", "delete_room", payload, "node1")
+    assert server.tpc_abort("t1")["success"] is True
+    assert manager.get_room(room.room_id).state == RoomState.ACTIVE
+
+
+@pytest.mark.asyncio
+async def test_websocket_delete_room_uses_tpc_participants():
+    """Test that delete_room runs 2PC against peer participants."""
+    manager = RoomStateManager(node_id="node1")
+    peer_manager, peer_server = _node("node2")
+    registry = LocalPeerRegistry(servers={"node2": peer_server})
+    ws_server = WebSocketServer(manager, "localhost", 9000, registry)
+    room = manager.create_room("Doomed", "alice")
+    shadow = peer_manager.create_room("Doomed", "alice")
+    mock_ws = MockWebSocket()
+
+    await ws_server.process_message(
+        mock_ws,
+        json.dumps(
+            {
+                "type": "delete_room",
+                "data": {"room_id": room.room_id, "username": "alice"},
+            }
+        ),
+    )
+
+    types = [json.loads(m)["type"] for m in mock_ws.sent_messages]
+    assert "delete_room_success" in types
+    assert manager.get_room(room.room_id) is None
+    assert ("node2", "tpc_prepare") in registry.calls
+    assert ("node2", "tpc_commit") in registry.calls
+    # The peer held no copy of this room ID, so its own room is untouched
+    assert peer_manager.get_room(shadow.room_id) is not None
+
+
+@pytest.mark.asyncio
+async def test_websocket_delete_room_rolls_back_on_abort_vote():
+    """Test that an ABORT vote keeps the room and reports failure."""
+    manager = RoomStateManager(node_id="node1")
+    peer = TPCParticipant("node2")
+    peer.register_handler("delete_room", RecordingHandler(vote="ABORT"))
+    registry = LocalPeerRegistry(servers={"node2": ParticipantServer(peer)})
+    ws_server = WebSocketServer(manager, "localhost", 9000, registry)
+    room = manager.create_room("Kept", "alice")
+    mock_ws = MockWebSocket()
+
+    await ws_server.process_message(
+        mock_ws,
+        json.dumps(
+            {
+                "type": "delete_room",
+                "data": {"room_id": room.room_id, "username": "alice"},
+            }
+        ),
+    )
+
+    response = json.loads(mock_ws.sent_messages[-1])
+    assert response["type"] == "delete_room_failed"
+    assert response["data"]["error_code"] == "DELETION_FAILED"
+    assert manager.get_room(room.room_id).state == RoomState.ACTIVE
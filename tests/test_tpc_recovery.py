@@ -0,0 +1,291 @@
+"""
+Tests for 2PC Recovery
+
+Tests for the pre-commit round, deciding from participants' states,
+participants recovering a transaction without its coordinator, fencing
+late pre-commits, and undecided transactions surviving restarts.
+"""
+
+import pytest
+
+from src.node import (
+    RoomStateManager,
+    TPCCoordinator,
+    TPCParticipant,
+    TransactionHandler,
+    TransactionStore,
+    XMLRPCServer,
+)
+from src.node.room_state import TransactionState
+from src.node.tpc import PARTICIPANTS_KEY, decide_outcome
+from tests.fakes import LocalPeerRegistry
+
+PARTICIPANTS = ["node2", "node3", "node4"]
+
+
+class RecordingHandler(TransactionHandler):
+    """Handler that votes READY and records calls."""
+
+    def __init__(self):
+        self.calls = []
+
+    def prepare(self, transaction_id, payload):
+        self.calls.append(("prepare", payload))
+        return {"vote": "READY"}
+
+    def commit(self, transaction_id, payload):
+        self.calls.append(("commit", payload))
+        return {"success": True}
+
+    def abort(self, transaction_id, payload):
+        self.calls.append(("abort", payload))
+        return {"success": True}
+
+
+class ParticipantServer:
+    """Expose a TPCParticipant under the RPC method names."""
+
+    def __init__(self, participant):
+        self.participant = participant
+
+    def tpc_prepare(self, transaction_id, operation, payload, coordinator):
+        return self.participant.prepare(
+            transaction_id, operation, payload, coordinator
+        )
+
+    def tpc_precommit(self, transaction_id):
+        return self.participant.precommit(transaction_id)
+
+    def tpc_status(self, transaction_id, requester):
+        return self.participant.status(transaction_id, requester)
+
+    def tpc_commit(self, transaction_id):
+        return self.participant.commit(transaction_id)
+
+    def tpc_abort(self, transaction_id):
+        return self.participant.abort(transaction_id)
+
+
+def _cluster(timeout=0, store=None):
+    """Recovering participants sharing one registry, with their handlers."""
+    registry = LocalPeerRegistry()
+    participants, handlers = {}, {}
+    for node_id in PARTICIPANTS:
+        participant = TPCParticipant(
+            node_id,
+            timeout,
+            peer_registry=registry,
+            store=store if node_id == "node2" else None,
+        )
+        handlers[node_id] = RecordingHandler()
+        participant.register_handler("rename_room", handlers[node_id])
+        participants[node_id] = participant
+        registry.servers[node_id] = ParticipantServer(participant)
+    return registry, participants, handlers
+
+
+def _prepare_all(participants, transaction_id="t1"):
+    payload = {"name": "New", PARTICIPANTS_KEY: PARTICIPANTS}
+    return [
+        p.prepare(transaction_id, "rename_room", payload, "node1")
+        for p in participants.values()
+    ]
+
+
+class TestDecideOutcome:
+    """Tests for the termination rule."""
+
+    def test_outcomes(self):
+        """Test each state that settles the outcome, and a blocked one."""
+        for statuses, outcome in (
+            ({"a": "PREPARED", "b": "PRECOMMITTED", "c": None}, "COMMIT"),
+            ({"a": "PREPARED", "b": "COMMIT"}, "COMMIT"),
+            ({"a": "PREPARED", "b": "UNKNOWN", "c": None}, "ROLLBACK"),
+            ({"a": "ROLLBACK", "b": None}, "ROLLBACK"),
+            ({"a": "PREPARED", "b": "PREPARED"}, "ROLLBACK"),
+        ):
+            assert decide_outcome(statuses) == TransactionState(outcome)
+        assert decide_outcome({"a": "PREPARED", "b": None}) is None
+
+
+class TestCoordinator:
+    """Tests for the pre-commit round."""
+
+    @pytest.mark.asyncio
+    async def test_precommit_round_when_all_recover(self):
+        """Test the extra round, and plain 2PC with an older participant."""
+        registry, participants, handlers = _cluster(timeout=30)
+        coordinator = TPCCoordinator("node1", registry)
+
+        txn = await coordinator.execute(
+            "rename_room", {"name": "New"}, PARTICIPANTS
+        )
+        sent = [m for _, m in registry.calls]
+        registry.calls.clear()
+        registry.servers["node4"].participant.peer_registry = None
+        plain = await coordinator.execute(
+            "rename_room", {"name": "Again"}, PARTICIPANTS
+        )
+
+        assert txn.committed
+        assert sent.count("tpc_precommit") == 3
+        assert handlers["node2"].calls[:2] == [
+            ("prepare", {"name": "New"}),
+            ("commit", {"name": "New"}),
+        ]
+        assert plain.committed
+        assert "tpc_precommit" not in [m for _, m in registry.calls]
+
+    @pytest.mark.asyncio
+    async def test_no_precommit_acknowledged(self):
+        """Test aborting when all are fenced, and a transaction in doubt."""
+        registry, participants, handlers = _cluster(timeout=30)
+        coordinator = TPCCoordinator("node1", registry)
+        for participant in participants.values():
+            participant.precommit = lambda transaction_id: {"success": False}
+
+        aborted = await coordinator.execute(
+            "rename_room", {}, PARTICIPANTS, "t1"
+        )
+        for participant in participants.values():
+            participant.status = lambda *args: {"state": None}
+        decided = []
+        in_doubt = await coordinator.execute(
+            "rename_room", {}, PARTICIPANTS, "t2", decided.append
+        )
+
+        assert aborted.state == TransactionState.ROLLBACK
+        assert aborted.abort_reason == "No participant accepted PRECOMMIT"
+        assert ("abort", {}) in handlers["node3"].calls
+        assert in_doubt.in_doubt and not in_doubt.committed
+        assert decided == []
+        assert participants["node2"].get_transaction("t2") is not None
+
+
+class TestParticipantRecovery:
+    """Tests for participants finishing a transaction themselves."""
+
+    def test_commits_after_any_precommit(self):
+        """Test the election and the lowest-ID node committing everyone."""
+        registry, participants, handlers = _cluster()
+        votes = _prepare_all(participants)
+        participants["node3"].precommit("t1")
+
+        assert participants["node4"].recover_blocked() == []
+        assert participants["node4"].log.get("t1")[-1]["reason"] == (
+            "left to node2"
+        )
+        assert participants["node2"].recover_blocked() == ["t1"]
+
+        assert all(vote["recovery"] for vote in votes)
+        for node_id in PARTICIPANTS:
+            assert handlers[node_id].calls[-1] == ("commit", {"name": "New"})
+            assert participants[node_id].get_transaction("t1") is None
+        assert participants["node4"].commit("t1")["success"] is True
+        assert participants["node4"].abort("t1")["success"] is False
+
+    def test_aborts_only_when_everyone_answers(self):
+        """Test a blocked transaction, fencing, and aborting it later."""
+        registry, participants, handlers = _cluster()
+        _prepare_all(participants)
+        down = registry.servers.pop("node4")
+
+        assert participants["node2"].recover_blocked() == []
+        assert participants["node3"].precommit("t1")["success"] is False
+        registry.servers["node4"] = down
+        assert participants["node2"].recover_blocked() == ["t1"]
+
+        for node_id in PARTICIPANTS:
+            assert handlers[node_id].calls[-1] == ("abort", {"name": "New"})
+
+    def test_recovering_node_refuses_late_precommit(self):
+        """Test a PRECOMMIT arriving during recovery refused by the node."""
+        registry, participants, handlers = _cluster()
+        _prepare_all(participants)
+        node2, late = participants["node2"], []
+        server = registry.servers["node3"]
+        query = server.tpc_status
+
+        def tpc_status(transaction_id, requester):
+            late.append(node2.precommit(transaction_id))
+            return query(transaction_id, requester)
+
+        server.tpc_status = tpc_status
+
+        assert node2.recover_blocked() == ["t1"]
+
+        assert late[0]["error"] == "Transaction is being recovered"
+        for node_id in PARTICIPANTS:
+            assert handlers[node_id].calls[-1] == ("abort", {"name": "New"})
+
+    def test_unknown_transaction_refuses_late_prepare(self):
+        """Test a status query for a transaction never prepared."""
+        registry, participants, handlers = _cluster()
+        node4 = participants.pop("node4")
+        _prepare_all(participants)
+
+        assert node4.status("t1", "node2")["state"] == "UNKNOWN"
+        late = _prepare_all({"node4": node4})[0]
+        assert participants["node3"].recover_blocked() == ["t1"]
+
+        assert late["vote"] == "ABORT"
+        assert handlers["node4"].calls == []
+        assert handlers["node2"].calls[-1][0] == "abort"
+
+    def test_legacy_transactions_presume_abort(self):
+        """Test that only transactions without participants expire."""
+        registry, participants, handlers = _cluster()
+        _prepare_all(participants)
+        node2 = participants["node2"]
+        node2.prepare("t2", "rename_room", {}, "node1")
+
+        assert node2.expire_prepared() == ["t2"]
+        assert node2.get_transaction("t1") is not None
+
+
+class TestDurability:
+    """Tests for undecided transactions surviving restarts."""
+
+    def test_state_survives_restart(self, tmp_path):
+        """Test reloading a pre-committed transaction and an outcome."""
+        store = TransactionStore(str(tmp_path / "tpc.json"))
+        registry, participants, handlers = _cluster(timeout=30, store=store)
+        _prepare_all(participants)
+        participants["node2"].precommit("t1")
+        _prepare_all(participants, "t2")
+        participants["node2"].abort("t2")
+
+        restarted = TPCParticipant(
+            "node2",
+            peer_registry=registry,
+            store=TransactionStore(str(tmp_path / "tpc.json")),
+        )
+        restarted.register_handler("rename_room", RecordingHandler())
+        txn = restarted.get_transaction("t1")
+
+        assert (txn.state, txn.participants) == ("PRECOMMITTED", PARTICIPANTS)
+        assert txn.payload == {"name": "New"}
+        assert restarted.status("t2")["state"] == "ROLLBACK"
+        assert restarted.commit("t1")["success"] is True
+        assert TransactionStore(store.path).load()[0] == []
+
+    def test_xmlrpc_methods(self):
+        """Test the RPCs and servers without a peer registry."""
+        manager = RoomStateManager("node2")
+        registry = LocalPeerRegistry()
+        xmlrpc_server = XMLRPCServer(
+            manager, "localhost", 0, "http://node2", registry
+        )
+        room = manager.create_room("Doomed", "alice")
+        payload = {"room_id": room.room_id, PARTICIPANTS_KEY: ["node2"]}
+        plain = XMLRPCServer(manager, "localhost", 0, "http://node2")
+
+        vote = xmlrpc_server.tpc_prepare("t1", "delete_room", payload, "node1")
+        assert xmlrpc_server.tpc_status("t1", "node3")["state"] == "PREPARED"
+        assert xmlrpc_server.tpc_precommit("t1")["error"] == (
+            "Transaction is being recovered"
+        )
+        assert vote["recovery"] is True
+        assert "recovery" not in plain.tpc_prepare(
+            "t2", "delete_room", payload, "node1"
+        )
@@ -0,0 +1,267 @@
+"""
+Tests for Distributed Tracing
+
+Tests for spans and their parent links, traceparent propagation, the
+OTLP/JSON export format, and one trace covering a message sent on one node,
+forwarded to the admin node and delivered back to the first node.
+"""
+
+import asyncio
+import json
+import threading
+import pytest
+
+from src.node import PeerRegistry, RoomStateManager, WebSocketServer, XMLRPCServer
+from src.node.config import NodeConfig
+from src.node.log_context import ServerProxy
+from src.node.room_directory import RoomDirectory
+from src.node.tracing import (
+    CLIENT,
+    INTERNAL,
+    SERVER,
+    STATUS_ERROR,
+    OTLPExporter,
+    SpanContext,
+    configure_tracing,
+    remote_parent,
+    start_span,
+    traceparent_headers,
+)
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class ListExporter:
+    """Span exporter that keeps finished spans in memory."""
+
+    def __init__(self):
+        self.spans = []
+        self.lock = threading.Lock()
+
+    def export(self, span):
+        with self.lock:
+            self.spans.append(span)
+
+    def named(self, name, kind=None):
+        return [
+            s for s in self.spans if s.name == name and kind in (None, s.kind)
+        ]
+
+
+class tracing_to:
+    """Context manager installing a tracer for the duration of a test."""
+
+    def __init__(self, exporter, sample_ratio=1.0):
+        self.exporter = exporter
+        self.sample_ratio = sample_ratio
+
+    def __enter__(self):
+        configure_tracing(self.exporter, self.sample_ratio)
+        return self.exporter
+
+    def __exit__(self, *exc):
+        configure_tracing(None)
+
+
+def _xmlrpc_node(manager, peer_registry=None):
+    server = XMLRPCServer(manager, "127.0.0.1", 0, "", peer_registry)
+    server.start()
+    return server, f"http://127.0.0.1:{server.server.server_address[1]}"
+
+
+class TestSpans:
+    """Tests for recording spans."""
+
+    def test_child_spans_share_trace(self):
+        """Test that nested spans form a tree within one trace."""
+        with tracing_to(ListExporter()) as exporter:
+            with start_span("parent") as parent:
+                with start_span("child") as child:
+                    pass
+
+        assert child.context.trace_id == parent.context.trace_id
+        assert child.parent_span_id == parent.context.span_id
+        assert parent.parent_span_id == ""
+        assert [s.name for s in exporter.spans] == ["child", "parent"]
+
+    def test_exception_marks_error(self):
+        """Test that an exception in the block fails the span."""
+        with tracing_to(ListExporter()) as exporter:
+            with pytest.raises(ValueError):
+                with start_span("failing"):
+                    raise ValueError("bad")
+
+        assert exporter.spans[0].status == STATUS_ERROR
+        assert exporter.spans[0].status_message == "ValueError: bad"
+
+    def test_disabled_by_default(self):
+        """Test that nothing is recorded without an exporter."""
+        with start_span("ignored") as span:
+            assert span is None
+            assert traceparent_headers() == {}
+
+    def test_unsampled_trace_not_exported(self):
+        """Test that unsampled traces still propagate but aren't exported."""
+        with tracing_to(ListExporter(), sample_ratio=0) as exporter:
+            with start_span("root"):
+                header = traceparent_headers()["traceparent"]
+
+        assert header.endswith("-00")
+        assert exporter.spans == []
+
+
+class TestPropagation:
+    """Tests for carrying the trace context between nodes."""
+
+    def test_traceparent_round_trip(self):
+        """Test that a traceparent header can be parsed back."""
+        context = SpanContext("ab" * 16, "cd" * 8)
+
+        assert SpanContext.from_traceparent(context.to_traceparent()) == context
+        assert SpanContext.from_traceparent("00-" + "0" * 32 + "-x-01") is None
+        assert SpanContext.from_traceparent(None) is None
+
+    def test_remote_parent(self):
+        """Test that spans for an incoming call join the caller's trace."""
+        remote = SpanContext("ab" * 16, "cd" * 8)
+
+        with tracing_to(ListExporter()):
+            with remote_parent(remote.to_traceparent()):
+                with start_span("handle") as span:
+                    pass
+
+        assert span.context.trace_id == remote.trace_id
+        assert span.parent_span_id == remote.span_id
+
+    def test_rpc_call_spans(self):
+        """Test that an XML-RPC call records linked client and server spans."""
+        server, address = _xmlrpc_node(RoomStateManager("node-a"))
+        try:
+            with tracing_to(ListExporter()) as exporter:
+                ServerProxy(address, allow_none=True).get_room_info("nope")
+        finally:
+            server.stop()
+
+        client = exporter.named("NodeService/get_room_info", CLIENT)[0]
+        handled = exporter.named("NodeService/get_room_info", SERVER)[0]
+        assert handled.parent_span_id == client.context.span_id
+        assert handled.status == STATUS_ERROR
+
+
+class TestExport:
+    """Tests for the OTLP/HTTP exporter."""
+
+    def test_otlp_json_encoding(self):
+        """Test the export request built for a span."""
+        exporter = OTLPExporter("http://collector:4318", "chat", "node-a")
+        with tracing_to(exporter):
+            with start_span("deliver", attributes={"chat.room_id": "r1"}):
+                pass
+
+        request = exporter.encode(list(exporter._queue))
+
+        assert exporter.url == "http://collector:4318/v1/traces"
+        resource = request["resourceSpans"][0]
+        assert {"key": "service.instance.id", "value": {"stringValue": "node-a"}} in (
+            resource["resource"]["attributes"]
+        )
+        span = resource["scopeSpans"][0]["spans"][0]
+        assert span["name"] == "deliver"
+        assert len(span["traceId"]) == 32
+        assert span["attributes"] == [
+            {"key": "chat.room_id", "value": {"stringValue": "r1"}}
+        ]
+
+    def test_failed_export_dropped(self):
+        """Test that spans are dropped if the collector is unreachable."""
+        exporter = OTLPExporter("http://127.0.0.1:9", timeout=1)
+        with tracing_to(exporter):
+            with start_span("lost"):
+                pass
+
+        assert exporter.flush() == 0
+        assert len(exporter._queue) == 0
+
+    def test_config_validated(self):
+        """Test the tracing settings checks."""
+        assert NodeConfig(tracing_endpoint="http://collector:4318").validate() == []
+        assert NodeConfig(tracing_endpoint="collector").validate() != []
+        assert NodeConfig(tracing_sample_ratio=2).validate() == [
+            "tracing_sample_ratio must be between 0 and 1"
+        ]
+
+
+class TestMessageTrace:
+    """Tests for the trace of a message crossing nodes."""
+
+    @pytest.mark.asyncio
+    async def test_send_message_single_trace(self):
+        """Test that one trace covers handling, forwarding, fan-out, delivery."""
+        admin = RoomStateManager("node-a")
+        room = admin.create_room("general", "alice")
+        admin.add_member(room.room_id, "alice", "node-b")
+
+        ws_b = WebSocketServer(RoomStateManager("node-b"), "localhost", 0)
+        rpc_b, address_b = _xmlrpc_node(ws_b.room_manager)
+        rpc_b.set_broadcast_callback(ws_b.broadcast_to_room_sync)
+        registry_a = PeerRegistry("node-a")
+        registry_a.register_peer("node-b", address_b)
+        rpc_a, address_a = _xmlrpc_node(admin, registry_a)
+
+        directory_a = RoomDirectory("node-a", address_a)
+        directory_a.update_local(admin.list_rooms())
+        ws_b.peer_registry = PeerRegistry("node-b")
+        ws_b.room_directory = RoomDirectory("node-b", address_b)
+        ws_b.room_directory.merge(directory_a.get_entries())
+        alice = MockWebSocket()
+        ws_b.connections.register(alice)
+        ws_b.register_client_room_membership(alice, room.room_id, "alice")
+        request = {
+            "type": "send_message",
+            "data": {"room_id": room.room_id, "username": "alice", "content": "hi"},
+        }
+
+        try:
+            with tracing_to(ListExporter()) as exporter:
+                await ws_b.process_message(alice, json.dumps(request))
+                await asyncio.sleep(0.1)
+        finally:
+            rpc_a.stop()
+            rpc_b.stop()
+
+        assert alice.received("new_message")[0]["content"] == "hi"
+        root = exporter.named("ws send_message")[0]
+        assert len({s.context.trace_id for s in exporter.spans}) == 1
+        spans = {s.context.span_id: s for s in exporter.spans}
+
+        def ancestors(span):
+            names = []
+            while span.parent_span_id:
+                span = spans[span.parent_span_id]
+                names.append((span.name, span.kind))
+            return names
+
+        delivered = exporter.named("deliver")[0]
+        assert ancestors(delivered) == [
+            ("NodeService/receive_message_broadcast", SERVER),
+            ("NodeService/receive_message_broadcast", CLIENT),
+            ("fan_out", INTERNAL),
+            ("NodeService/forward_message", SERVER),
+            ("NodeService/forward_message", CLIENT),
+            (root.name, SERVER),
+        ]
@@ -0,0 +1,203 @@
+"""
+Tests for Typing Indicators
+
+Tests for throttling and expiring typing announcements, fanning typing
+events out to a room's clients and peer nodes, and delivering them on the
+receiving node without touching the message log or replicas.
+"""
+
+import json
+from types import SimpleNamespace
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    ReplicaStore,
+    RoomStateManager,
+    TypingThrottle,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.wal import MessageLog
+
+
+class FakeClock:
+    """Clock advanced by hand."""
+
+    def __init__(self):
+        self.now = 100.0
+
+    def __call__(self):
+        return self.now
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def received(self, message_type):
+        return [
+            json.loads(m)["data"]
+            for m in self.sent_messages
+            if json.loads(m)["type"] == message_type
+        ]
+
+
+class RecordingPeerRegistry:
+    """Peer registry whose peers' XML-RPC servers are called in-process."""
+
+    def __init__(self, servers):
+        self.servers = servers
+
+    def list_peers(self):
+        return {node_id: node_id for node_id in self.servers}
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _typing(ws_server, websocket, room_id, username, typing=True):
+    await ws_server.process_message(
+        websocket,
+        json.dumps(
+            {
+                "type": "typing",
+                "data": {
+                    "room_id": room_id,
+                    "username": username,
+                    "typing": typing,
+                },
+            }
+        ),
+    )
+
+
+class TestTypingThrottle:
+    """Tests for the per-user typing throttle."""
+
+    def test_repeats_throttled(self):
+        """Test that a user is announced once per interval."""
+        clock = FakeClock()
+        throttle = TypingThrottle(interval=3, clock=clock)
+
+        assert throttle.allow("r1", "bob", True) is True
+        clock.now += 2
+        assert throttle.allow("r1", "bob", True) is False
+        assert throttle.allow("r2", "bob", True) is True
+        clock.now += 1
+        assert throttle.allow("r1", "bob", True) is True
+
+    def test_stop_only_for_active_indicator(self):
+        """Test that "stopped" is passed on once, before expiry."""
+        clock = FakeClock()
+        throttle = TypingThrottle(interval=3, timeout=6, clock=clock)
+
+        assert throttle.allow("r1", "bob", False) is False
+        throttle.allow("r1", "bob", True)
+        assert throttle.allow("r1", "bob", False) is True
+        assert throttle.allow("r1", "bob", False) is False
+        assert throttle.allow("r1", "bob", True) is True
+
+    def test_indicators_expire(self):
+        """Test that expired indicators are forgotten."""
+        clock = FakeClock()
+        throttle = TypingThrottle(interval=3, timeout=6, clock=clock)
+        throttle.allow("r1", "bob", True)
+        throttle.allow("r1", "carol", True)
+        assert throttle.active_count() == 2
+
+        clock.now += 6
+
+        assert throttle.active_count() == 0
+        assert throttle.allow("r1", "bob", False) is False
+
+
+class TestTypingFanOut:
+    """Tests for typing events between clients and nodes."""
+
+    @pytest.mark.asyncio
+    async def test_sent_to_other_clients_once(self, tmp_path):
+        """Test that other members get one event and nothing is logged."""
+        manager = RoomStateManager("node-a", MessageLog(str(tmp_path)))
+        room_id = manager.create_room("general", "alice").room_id
+        manager.add_member(room_id, "alice")
+        manager.add_member(room_id, "bob")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        bob = _join(ws_server, room_id, "bob")
+
+        await _typing(ws_server, bob, room_id, "bob")
+        await _typing(ws_server, bob, room_id, "bob")
+
+        events = alice.received("typing")
+        assert len(events) == 1
+        assert events[0]["username"] == "bob"
+        assert events[0]["typing"] is True
+        assert events[0]["expires_in"] == ws_server.typing.timeout
+        assert bob.received("typing") == []
+        assert manager.get_history(room_id, "alice")["messages"] == []
+
+    @pytest.mark.asyncio
+    async def test_non_member_ignored(self):
+        """Test that clients outside the room can't send typing events."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("general", "alice").room_id
+        manager.add_member(room_id, "alice")
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+        mallory = MockWebSocket()
+        ws_server.connections.register(mallory)
+
+        await _typing(ws_server, mallory, room_id, "mallory")
+
+        assert alice.received("typing") == []
+
+    @pytest.mark.asyncio
+    async def test_fanned_out_to_peer_clients(self):
+        """Test that clients on another node get the event."""
+        manager = RoomStateManager("node-a")
+        room_id = manager.create_room("general", "alice").room_id
+        manager.add_member(room_id, "alice")
+
+        store = ReplicaStore()
+        room_info = {"room_id": room_id, "room_name": "general"}
+        store.update_from_join(dict(room_info, members=["carol"]), [], "carol")
+        rpc_b = XMLRPCServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            "http://node-b",
+            failover=SimpleNamespace(replica_store=store),
+        )
+        delivered = []
+        rpc_b.set_broadcast_callback(
+            lambda room_id, message, exclude_user: delivered.append(message)
+        )
+        ws_a = WebSocketServer(
+            manager,
+            "localhost",
+            0,
+            peer_registry=RecordingPeerRegistry({"node-b": rpc_b}),
+        )
+        alice = _join(ws_a, room_id, "alice")
+
+        with patch(
+            "src.node.utils.broadcast.ServerProxy",
+            lambda address, allow_none=True: rpc_b,
+        ):
+            await _typing(ws_a, alice, room_id, "alice")
+
+        assert delivered[0]["type"] == "typing"
+        assert delivered[0]["data"]["username"] == "alice"
+        assert delivered[0]["data"]["room_id"] == room_id
+        assert store.get(room_id).members == ["carol"]
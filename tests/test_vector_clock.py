@@ -0,0 +1,247 @@
+"""
+Tests for Vector Clocks and Causal Message Delivery
+
+Tests for clock comparison, causal buffering of relayed messages, and
+vector clocks in the message wire format.
+"""
+
+import json
+import time
+import pytest
+
+from src.node import (
+    RoomStateManager,
+    WebSocketServer,
+    XMLRPCServer,
+    VectorClock,
+    CausalBuffer,
+)
+from src.client.schemas.message import NewMessageNotification
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+
+def _message(seq, origin, clock):
+    return {
+        "message_id": f"m{seq}",
+        "sequence_number": seq,
+        "origin_node": origin,
+        "vector_clock": clock,
+    }
+
+
+# ===== VectorClock Tests =====
+
+
+def test_vector_clock_increment_and_merge():
+    """Test increment and element-wise max merge."""
+    a = VectorClock().increment("n1").increment("n1")
+    b = VectorClock({"n2": 3})
+
+    a.merge(b)
+    assert a.to_dict() == {"n1": 2, "n2": 3}
+
+
+def test_vector_clock_ordering():
+    """Test happened-before and concurrency."""
+    a = VectorClock({"n1": 1})
+    b = VectorClock({"n1": 1, "n2": 1})
+    c = VectorClock({"n1": 2})
+
+    assert a.happened_before(b)
+    assert not b.happened_before(a)
+    assert b.concurrent_with(c)
+    assert a == VectorClock({"n1": 1, "n2": 0})
+
+
+# ===== CausalBuffer Tests =====
+
+
+def test_causal_buffer_in_order_delivery():
+    """Test that in-order messages are released immediately."""
+    buffer = CausalBuffer()
+    m1 = _message(1, "n1", {"n1": 1})
+    m2 = _message(2, "n2", {"n1": 1, "n2": 1})
+
+    assert buffer.receive("r1", m1) == [m1]
+    assert buffer.receive("r1", m2) == [m2]
+    assert buffer.delivered_clock("r1") == {"n1": 1, "n2": 1}
+
+
+def test_causal_buffer_holds_until_dependency_arrives():
+    """Test that a message waits for its causal predecessor."""
+    buffer = CausalBuffer()
+    buffer.seed("r1", {})
+    m1 = _message(1, "n1", {"n1": 1})
+    m2 = _message(2, "n2", {"n1": 1, "n2": 1})
+    m3 = _message(3, "n1", {"n1": 2, "n2": 1})
+
+    assert buffer.receive("r1", m3) == []
+    assert buffer.receive("r1", m2) == []
+    assert buffer.pending_count("r1") == 2
+    assert buffer.receive("r1", m1) == [m1, m2, m3]
+    assert buffer.pending_count("r1") == 0
+
+
+def test_causal_buffer_drops_duplicates():
+    """Test that an already delivered message is not released twice."""
+    buffer = CausalBuffer()
+    m1 = _message(1, "n1", {"n1": 1})
+    buffer.receive("r1", m1)
+    assert buffer.receive("r1", m1) == []
+
+
+def test_causal_buffer_passes_messages_without_clock():
+    """Test that messages from nodes without clocks are not held."""
+    buffer = CausalBuffer()
+    legacy = {"message_id": "m1", "sequence_number": 1}
+    assert buffer.receive("r1", legacy) == [legacy]
+
+
+def test_causal_buffer_releases_overdue_messages():
+    """Test that a message whose dependency is lost is released."""
+    buffer = CausalBuffer(delivery_timeout=0.01)
+    buffer.seed("r1", {})
+    m2 = _message(2, "n1", {"n1": 2})
+    assert buffer.receive("r1", m2) == []
+
+    time.sleep(0.02)
+    assert buffer.flush_overdue() == {"r1": [m2]}
+    assert buffer.delivered_clock("r1") == {"n1": 2}
+
+
+def test_causal_buffer_overflow_releases_oldest():
+    """Test that exceeding the buffer size force-releases messages."""
+    buffer = CausalBuffer(max_buffered=1)
+    buffer.seed("r1", {})
+    m2 = _message(2, "n1", {"n1": 2})
+    m3 = _message(3, "n1", {"n1": 3})
+
+    assert buffer.receive("r1", m2) == []
+    assert buffer.receive("r1", m3) == [m2, m3]
+
+
+def test_causal_buffer_seed_only_moves_forward():
+    """Test that seeding never rewinds the delivered clock."""
+    buffer = CausalBuffer()
+    buffer.seed("r1", {"n1": 5})
+    buffer.seed("r1", {"n1": 2, "n2": 1})
+    assert buffer.delivered_clock("r1") == {"n1": 5, "n2": 1}
+
+
+# ===== Room State and Wire Format Tests =====
+
+
+def test_add_message_assigns_vector_clock():
+    """Test that the admin stamps messages with the origin's counter."""
+    manager = RoomStateManager(node_id="node1")
+    room = manager.create_room("General", "alice")
+    manager.add_member(room.room_id, "alice")
+
+    first = manager.add_message(room.room_id, "alice", "hi")
+    second = manager.add_message(
+        room.room_id, "alice", "hello", origin_node="node2"
+    )
+
+    assert first["vector_clock"] == {"node1": 1}
+    assert first["origin_node"] == "node1"
+    assert second["vector_clock"] == {"node1": 1, "node2": 1}
+    assert second["origin_node"] == "node2"
+
+
+def test_forward_message_returns_vector_clock():
+    """Test that forwarded messages are stamped with the sender's node."""
+    manager = RoomStateManager(node_id="node1")
+    server = XMLRPCServer(manager, "localhost", 9090, "http://node1:9090")
+    room = manager.create_room("General", "alice")
+    manager.add_member(room.room_id, "bob", "node2")
+
+    result = server.forward_message(room.room_id, "bob", "hey", "node2")
+
+    assert result["success"] is True
+    assert result["vector_clock"] == {"node2": 1}
+
+
+def test_receive_message_broadcast_delivers_in_causal_order():
+    """Test that out-of-order broadcasts reach clients in causal order."""
+    manager = RoomStateManager(node_id="node2")
+    server = XMLRPCServer(manager, "localhost", 9090, "http://node2:9090")
+    delivered = []
+    server.set_broadcast_callback(
+        lambda room_id, msg, exclude_user=None: delivered.append(msg)
+    )
+    server.causal_buffer.seed("r1", {})
+    m1 = _message(1, "node1", {"node1": 1})
+    m2 = _message(2, "node3", {"node1": 1, "node3": 1})
+
+    assert server.receive_message_broadcast("r1", m2) is True
+    assert delivered == []
+    server.receive_message_broadcast("r1", m1)
+
+    assert [msg["data"]["message_id"] for msg in delivered] == ["m1", "m2"]
+
+
+@pytest.mark.asyncio
+async def test_send_message_confirmation_includes_vector_clock():
+    """Test that message_sent and new_message carry the vector clock."""
+    manager = RoomStateManager(node_id="node1")
+    ws_server = WebSocketServer(manager, "localhost", 9000)
+    room = manager.create_room("General", "alice")
+    mock_ws = MockWebSocket()
+
+    await ws_server.process_message(
+        mock_ws,
+        json.dumps(
+            {
+                "type": "join_room",
+                "data": {"room_id": room.room_id, "username": "alice"},
+            }
+        ),
+    )
+    await ws_server.process_message(
+        mock_ws,
+        json.dumps(
+            {
+                "type": "send_message",
+                "data": {
+                    "room_id": room.room_id,
+                    "username": "alice",
+                    "content": "hi",
+                },
+            }
+        ),
+    )
+
+    responses = [json.loads(m) for m in mock_ws.sent_messages]
+    by_type = {r["type"]: r for r in responses}
+    assert by_type["message_sent"]["data"]["vector_clock"] == {"node1": 1}
+    assert by_type["new_message"]["data"]["vector_clock"] == {"node1": 1}
+
+
+def test_client_notification_parses_vector_clock():
+    """Test that the client schema exposes the clock."""
+    notification = NewMessageNotification.from_dict(
+        {
+            "type": "new_message",
+            "data": {
+                "room_id": "r1",
+                "message_id": "m1",
+                "username": "alice",
+                "content": "hi",
+                "sequence_number": 1,
+                "timestamp": "2024-01-01T00:00:00+00:00",
+                "vector_clock": {"node1": 1},
+                "origin_node": "node1",
+            },
+        }
+    )
+    assert notification.vector_clock == {"node1": 1}
+    assert notification.origin_node == "node1"
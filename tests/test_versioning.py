@@ -0,0 +1,211 @@
+"""
+Tests for Protocol Versions and Compatibility Gates
+
+Tests for negotiating a protocol version, handshakes between nodes of
+different versions (including nodes that predate version ranges), and the
+gates refusing calls a peer's version or capabilities can't serve.
+"""
+
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    IncompatiblePeerError,
+    PeerRegistry,
+    RoomStateManager,
+    WebSocketServer,
+    negotiate_version,
+)
+from src.node.discovery import PeerDiscovery
+from src.node.snapshot import SNAPSHOT_CAPABILITY
+from src.node.versioning import MIN_PROTOCOL_VERSION, PROTOCOL_VERSION
+
+
+class RecordingRPC:
+    """RPC client pool that answers calls in-process and records them."""
+
+    def __init__(self, servers=None):
+        self.servers = servers or {}
+        self.calls = []
+
+    def call(self, address, method, *args, timeout=None):
+        self.calls.append((address, method, args))
+        target = self.servers.get(address)
+        if target is None:
+            return {"success": True}
+        return getattr(target, method)(*args)
+
+
+class VersionOneNode:
+    """A node from before version ranges, accepting only version 1."""
+
+    def hello(self, hello):
+        if hello.get("protocol_version") != 1:
+            return {
+                "success": False,
+                "error": "Protocol version not supported (expected 1)",
+                "error_code": "PROTOCOL_MISMATCH",
+            }
+        return {
+            "success": True,
+            "node_id": "node-old",
+            "address": "http://node-old:9090",
+            "protocol_version": 1,
+            "capabilities": ["rooms"],
+            "peers": {},
+        }
+
+
+class FutureNode:
+    """A node that no longer speaks any version this node speaks."""
+
+    def hello(self, hello):
+        return {
+            "success": False,
+            "error": "Protocol versions not supported",
+            "error_code": "PROTOCOL_MISMATCH",
+            "protocol_version": PROTOCOL_VERSION + 2,
+            "min_protocol_version": PROTOCOL_VERSION + 1,
+        }
+
+
+def _discovery(servers=None):
+    registry = PeerRegistry("node-new")
+    registry.rpc = RecordingRPC(servers)
+    return PeerDiscovery("node-new", "http://node-new:9090", registry, [])
+
+
+class TestNegotiation:
+    """Tests for settling on a version."""
+
+    def test_negotiate_version(self):
+        """Test the highest common version and ranges without one."""
+        assert negotiate_version(PROTOCOL_VERSION, MIN_PROTOCOL_VERSION) == (
+            PROTOCOL_VERSION
+        )
+        assert negotiate_version(PROTOCOL_VERSION + 3, 1) == PROTOCOL_VERSION
+        assert negotiate_version(1) == 1
+        assert negotiate_version(PROTOCOL_VERSION + 1) is None
+        assert negotiate_version(PROTOCOL_VERSION + 5, PROTOCOL_VERSION + 1) is None
+        assert negotiate_version(MIN_PROTOCOL_VERSION - 1) is None
+        assert negotiate_version("2") is None
+        assert negotiate_version(None) is None
+
+
+class TestMixedVersionHandshake:
+    """Tests for handshakes between nodes of different versions."""
+
+    def test_handshake_with_older_node(self):
+        """Test retrying with version 1 for a node without version ranges."""
+        discovery = _discovery({"http://node-old:9090": VersionOneNode()})
+
+        response = discovery.handshake("http://node-old:9090")
+
+        assert response["node_id"] == "node-old"
+        calls = discovery.peer_registry.rpc.calls
+        offered = [args[0]["protocol_version"] for _, _, args in calls]
+        assert offered == list(range(PROTOCOL_VERSION, 0, -1))
+        assert discovery.peer_registry.get_protocol_version("node-old") == 1
+
+    def test_older_node_handshakes_with_us(self):
+        """Test answering a hello that only offers version 1."""
+        discovery = _discovery()
+
+        response = discovery.handle_hello(
+            {
+                "node_id": "node-old",
+                "address": "http://node-old:9090",
+                "protocol_version": 1,
+                "capabilities": ["rooms"],
+            }
+        )
+
+        assert response["success"] is True
+        assert response["negotiated_version"] == 1
+        assert response["min_protocol_version"] == MIN_PROTOCOL_VERSION
+        assert discovery.peer_registry.get_protocol_version("node-old") == 1
+
+    def test_disjoint_ranges_refused(self):
+        """Test refusing a range without a common version, both ways."""
+        discovery = _discovery({"http://node-future:9090": FutureNode()})
+        low, high = PROTOCOL_VERSION + 1, PROTOCOL_VERSION + 2
+
+        refused = discovery.handle_hello(
+            {
+                "node_id": "node-future",
+                "address": "http://node-future:9090",
+                "protocol_version": high,
+                "min_protocol_version": low,
+            }
+        )
+        response = discovery.handshake("http://node-future:9090")
+
+        assert refused["error_code"] == "PROTOCOL_MISMATCH"
+        assert f"{low} to {high}" in refused["error"]
+        assert response is None
+        assert len(discovery.peer_registry.rpc.calls) == 1
+        assert discovery.peer_registry.list_peers() == {}
+
+
+class TestCompatibilityGates:
+    """Tests for the gates on calls to peers."""
+
+    def test_version_and_capability_gates(self):
+        """Test that gated calls fail without going out."""
+        registry = PeerRegistry("node1")
+        registry.rpc = RecordingRPC()
+        registry.register_peer("node-old", "http://node-old:9090")
+        registry.set_protocol_version("node-old", 1)
+        registry.register_peer("node-new", "http://node-new:9090")
+        registry.set_protocol_version("node-new", PROTOCOL_VERSION)
+        registry.set_capabilities("node-new", ["rooms"])
+
+        with pytest.raises(IncompatiblePeerError) as old:
+            registry.call_peer("node-old", "set_room_retention", "r1", 60)
+        with pytest.raises(IncompatiblePeerError) as missing:
+            registry.call_peer("node-new", "begin_snapshot_transfer", "t1")
+        registry.call_peer("node-old", "get_hosted_rooms")
+        registry.set_capabilities("node-new", ["rooms", SNAPSHOT_CAPABILITY])
+        registry.call_peer("node-new", "begin_snapshot_transfer", "t1")
+
+        assert old.value.error_code == "PEER_INCOMPATIBLE"
+        assert "needs version 2" in str(old.value)
+        assert SNAPSHOT_CAPABILITY in str(missing.value)
+        assert [method for _, method, _ in registry.rpc.calls] == [
+            "get_hosted_rooms",
+            "begin_snapshot_transfer",
+        ]
+
+    def test_peers_never_handshaken_not_gated(self):
+        """Test that statically configured peers are called as before."""
+        registry = PeerRegistry("node1")
+        registry.rpc = RecordingRPC()
+        registry.register_peer("node2", "http://node2:9090")
+
+        registry.call_peer("node2", "exchange_load", [])
+
+        assert registry.get_protocol_version("node2") is None
+        assert len(registry.rpc.calls) == 1
+
+    @pytest.mark.asyncio
+    async def test_room_admin_call_gated(self):
+        """Test forwarding a newer command to an older admin node."""
+        registry = PeerRegistry("node1")
+        registry.register_peer("node-old", "http://node-old:9090")
+        registry.set_protocol_version("node-old", 1)
+        ws_server = WebSocketServer(
+            RoomStateManager("node1"), "localhost", 0, peer_registry=registry
+        )
+
+        with patch.object(
+            ws_server,
+            "_locate_room_admin",
+            return_value=({"admin_node": "node-old"}, "http://node-old:9090"),
+        ):
+            result = await ws_server._call_room_admin(
+                "room-1", "set_room_retention", "room-1", "alice", 60
+            )
+
+        assert result["success"] is False
+        assert result["error_code"] == "PEER_INCOMPATIBLE"
@@ -0,0 +1,247 @@
+"""
+Tests for the Write-Ahead Message Log
+
+Tests for segment framing and rollover, CRC checking, torn-tail recovery,
+fsync policies, and recovering rooms through the room manager.
+"""
+
+import os
+import pytest
+
+from src.node import RoomStateManager, MessageLog, SegmentedLog
+
+
+class TestSegmentedLog:
+    """Tests for SegmentedLog."""
+
+    def test_append_and_read(self, tmp_path):
+        """Test that appended records are read back in order."""
+        log = SegmentedLog(str(tmp_path / "log"))
+        log.append({"n": 1})
+        log.append({"n": 2})
+        log.close()
+
+        assert list(log.records()) == [{"n": 1}, {"n": 2}]
+
+    def test_rolls_over_segments(self, tmp_path):
+        """Test that full segments are rolled over."""
+        log = SegmentedLog(str(tmp_path / "log"), segment_size=64)
+        for n in range(10):
+            log.append({"n": n, "padding": "x" * 20})
+        log.close()
+
+        assert len(log.segments()) > 1
+        assert [r["n"] for r in log.records()] == list(range(10))
+
+    def test_reopened_log_appends(self, tmp_path):
+        """Test that a reopened log appends after existing records."""
+        path = str(tmp_path / "log")
+        first = SegmentedLog(path)
+        first.append({"n": 1})
+        first.close()
+
+        second = SegmentedLog(path)
+        second.append({"n": 2})
+        second.close()
+
+        assert [r["n"] for r in second.records()] == [1, 2]
+        assert len(second.segments()) == 1
+
+    def test_torn_tail_is_truncated(self, tmp_path):
+        """Test that a partially written last record is discarded."""
+        log = SegmentedLog(str(tmp_path / "log"))
+        log.append({"n": 1})
+        log.append({"n": 2})
+        log.close()
+
+        segment = log.segments()[-1]
+        size = os.path.getsize(segment)
+        with open(segment, "r+b") as handle:
+            handle.truncate(size - 3)
+
+        assert list(log.records()) == [{"n": 1}]
+
+        log.append({"n": 3})
+        log.close()
+        assert [r["n"] for r in log.records()] == [1, 3]
+
+    def test_corrupt_record_fails_crc(self, tmp_path):
+        """Test that a record with a bad checksum stops the replay."""
+        log = SegmentedLog(str(tmp_path / "log"))
+        log.append({"n": 1})
+        log.append({"n": 2})
+        log.close()
+
+        segment = log.segments()[-1]
+        with open(segment, "r+b") as handle:
+            data = bytearray(handle.read())
+            data[-2] ^= 0xFF
+            handle.seek(0)
+            handle.write(data)
+
+        assert list(log.records()) == [{"n": 1}]
+
+    def test_fsync_policies(self, tmp_path):
+        """Test that every fsync policy persists records."""
+        for policy in ("always", "interval", "never"):
+            log = SegmentedLog(str(tmp_path / policy), fsync_policy=policy)
+            log.append({"n": 1})
+            log.sync()
+            log.close()
+
+            assert list(log.records()) == [{"n": 1}]
+
+    def test_unknown_fsync_policy(self, tmp_path):
+        """Test that an unknown fsync policy is rejected."""
+        with pytest.raises(ValueError):
+            SegmentedLog(str(tmp_path / "log"), fsync_policy="sometimes")
+
+
+class TestMessageLog:
+    """Tests for MessageLog."""
+
+    def _room(self, room_id="room-1"):
+        return {
+            "room_id": room_id,
+            "room_name": "General",
+            "description": None,
+            "creator_id": "alice",
+            "created_at": "2024-01-01T00:00:00+00:00",
+        }
+
+    def _message(self, seq):
+        return {
+            "message_id": f"msg-{seq}",
+            "room_id": "room-1",
+            "username": "alice",
+            "content": f"hello {seq}",
+            "sequence_number": seq,
+            "timestamp": "2024-01-01T00:00:00+00:00",
+            "vector_clock": {"node1": seq},
+            "origin_node": "node1",
+        }
+
+    def test_recover_room_and_messages(self, tmp_path):
+        """Test replaying a room and its messages."""
+        log = MessageLog(str(tmp_path))
+        log.log_room(self._room())
+        log.log_message("room-1", self._message(1))
+        log.log_message("room-1", self._message(2))
+        log.close()
+
+        rooms = MessageLog(str(tmp_path)).recover()
+
+        assert len(rooms) == 1
+        state = rooms[0]
+        assert state["room_name"] == "General"
+        assert state["message_counter"] == 2
+        assert state["vector_clock"] == {"node1": 2}
+        assert [m["message_id"] for m in state["messages"]] == [
+            "msg-1",
+            "msg-2",
+        ]
+
+    def test_recover_keeps_recent_messages(self, tmp_path):
+        """Test that only the most recent messages are returned."""
+        log = MessageLog(str(tmp_path))
+        log.log_room(self._room())
+        for seq in range(1, 6):
+            log.log_message("room-1", self._message(seq))
+        log.close()
+
+        state = MessageLog(str(tmp_path)).recover(max_messages=2)[0]
+
+        assert [m["sequence_number"] for m in state["messages"]] == [4, 5]
+        assert state["message_counter"] == 5
+
+    def test_recover_snapshot(self, tmp_path):
+        """Test replaying a snapshot written by a failover takeover."""
+        log = MessageLog(str(tmp_path))
+        room = dict(
+            self._room(), message_counter=7, vector_clock={"node2": 7}
+        )
+        log.log_snapshot(room, [self._message(7)])
+        log.log_message("room-1", self._message(8))
+        log.close()
+
+        state = MessageLog(str(tmp_path)).recover()[0]
+
+        assert state["message_counter"] == 8
+        assert [m["sequence_number"] for m in state["messages"]] == [7, 8]
+
+    def test_drop_room(self, tmp_path):
+        """Test that dropping a room deletes its log."""
+        log = MessageLog(str(tmp_path))
+        log.log_room(self._room())
+        log.drop_room("room-1")
+
+        assert MessageLog(str(tmp_path)).recover() == []
+
+    def test_rejects_unsafe_room_id(self, tmp_path):
+        """Test that room IDs cannot escape the data directory."""
+        log = MessageLog(str(tmp_path))
+
+        with pytest.raises(ValueError):
+            log.log_room(self._room("../escape"))
+
+
+class TestRoomManagerRecovery:
+    """Tests for RoomStateManager with a message log."""
+
+    def test_rooms_survive_restart(self, tmp_path):
+        """Test that rooms and messages are recovered after a restart."""
+        manager = RoomStateManager("node1", MessageLog(str(tmp_path)))
+        room = manager.create_room("General", "alice", "Chat")
+        manager.add_member(room.room_id, "alice")
+        manager.add_message(room.room_id, "alice", "first")
+        manager.add_message(room.room_id, "alice", "second")
+        manager.message_log.close()
+
+        restarted = RoomStateManager("node1", MessageLog(str(tmp_path)))
+        assert restarted.recover_rooms() == 1
+
+        recovered = restarted.get_room(room.room_id)
+        assert recovered.room_name == "General"
+        assert recovered.description == "Chat"
+        assert recovered.admin_node == "node1"
+        assert recovered.members == set()
+        assert [m["content"] for m in recovered.messages] == [
+            "first",
+            "second",
+        ]
+
+        restarted.add_member(room.room_id, "bob")
+        message = restarted.add_message(room.room_id, "bob", "third")
+        assert message["sequence_number"] == 3
+        assert message["vector_clock"] == {"node1": 3}
+
+    def test_deleted_room_not_recovered(self, tmp_path):
+        """Test that deleted rooms stay deleted after a restart."""
+        manager = RoomStateManager("node1", MessageLog(str(tmp_path)))
+        room = manager.create_room("General", "alice")
+        manager.delete_room(room.room_id)
+
+        restarted = RoomStateManager("node1", MessageLog(str(tmp_path)))
+        assert restarted.recover_rooms() == 0
+
+    def test_failed_write_rejects_message(self, tmp_path):
+        """Test that a message is not added if the WAL write fails."""
+
+        class FailingLog(MessageLog):
+            def log_message(self, room_id, message):
+                raise OSError("disk full")
+
+        manager = RoomStateManager("node1", FailingLog(str(tmp_path)))
+        room = manager.create_room("General", "alice")
+        manager.add_member(room.room_id, "alice")
+
+        assert manager.add_message(room.room_id, "alice", "hi") is None
+        assert room.message_counter == 0
+        assert room.messages == []
+        assert room.vector_clock == {}
+
+    def test_recover_without_log(self):
+        """Test that recovery is a no-op without a message log."""
+        manager = RoomStateManager("node1")
+
+        assert manager.recover_rooms() == 0
@@ -0,0 +1,364 @@
+"""
+Tests for Webhooks
+
+Tests for registering, listing and removing a room's webhooks, queuing
+the events they subscribe to, signed delivery with retries and backoff,
+keeping webhooks across restarts and snapshots, and the webhook commands
+locally and through the admin node.
+"""
+
+import hashlib
+import hmac
+import json
+from unittest.mock import patch
+
+import pytest
+
+from src.node import (
+    RoomDirectory,
+    RoomStateManager,
+    WebhookDispatcher,
+    WebhookError,
+    WebSocketServer,
+    XMLRPCServer,
+)
+from src.node.snapshot import RoomSnapshot
+from src.node.wal import MessageLog
+from src.node.webhooks import (
+    MEMBER_JOINED,
+    MEMBER_LEFT,
+    MESSAGE_POSTED,
+    ROOM_DELETED,
+    SIGNATURE_HEADER,
+    create_webhook,
+)
+
+URL = "https://ci.example.com/hooks/chat"
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self):
+        self.sent_messages = []
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+    def last(self):
+        return json.loads(self.sent_messages[-1])
+
+
+class Recorder:
+    """Webhook endpoint stub recording requests and answering with statuses."""
+
+    def __init__(self, *statuses):
+        self.requests = []
+        self.statuses = list(statuses)
+
+    def __call__(self, url, body, headers, timeout):
+        self.requests.append((url, json.loads(body), headers, body))
+        status = self.statuses.pop(0) if self.statuses else 200
+        if isinstance(status, Exception):
+            raise status
+        return status
+
+
+class Clock:
+    """Settable clock for the dispatcher."""
+
+    def __init__(self):
+        self.now = 1000.0
+
+    def __call__(self):
+        return self.now
+
+
+def _room(manager):
+    room = manager.create_room("General", "alice")
+    manager.add_member(room.room_id, "alice")
+    return room.room_id
+
+
+def _join(ws_server, room_id, username):
+    websocket = MockWebSocket()
+    ws_server.connections.register(websocket)
+    ws_server.register_client_room_membership(websocket, room_id, username)
+    return websocket
+
+
+async def _request(ws_server, websocket, message_type, **data):
+    await ws_server.process_message(
+        websocket, json.dumps({"type": message_type, "data": data})
+    )
+    return websocket.last()
+
+
+class TestWebhooks:
+    """Tests for managing webhooks and delivering events."""
+
+    def test_create_webhook(self):
+        """Test validation of URLs and events and the generated secret."""
+        webhook = create_webhook("room-1", URL, [MESSAGE_POSTED], "alice")
+        every = create_webhook("room-1", URL, [], "alice")
+
+        assert webhook["events"] == [MESSAGE_POSTED]
+        assert len(webhook["secret"]) == 64
+        assert every["events"] == [
+            MESSAGE_POSTED,
+            MEMBER_JOINED,
+            MEMBER_LEFT,
+            ROOM_DELETED,
+        ]
+        for url, events, code in (
+            ("ftp://ci.example.com/hook", [], "INVALID_URL"),
+            ("https://", [], "INVALID_URL"),
+            (None, [], "INVALID_URL"),
+            (URL, ["message_edited"], "INVALID_EVENTS"),
+            (URL, "message_posted", "INVALID_EVENTS"),
+        ):
+            with pytest.raises(WebhookError) as error:
+                create_webhook("room-1", url, events, "alice")
+            assert error.value.error_code == code
+
+    def test_only_the_owner_manages_webhooks(self):
+        """Test permissions, the per-room limit and disabled webhooks."""
+        manager = RoomStateManager("node-a", webhooks=WebhookDispatcher())
+        room_id = _room(manager)
+        manager.add_member(room_id, "bob")
+        for number in range(5):
+            manager.register_webhook(room_id, "alice", f"{URL}/{number}", [])
+
+        for args, code in (
+            ((room_id, "bob", URL, []), "NOT_ALLOWED"),
+            ((room_id, "alice", URL, []), "TOO_MANY_WEBHOOKS"),
+            (("missing", "alice", URL, []), "ROOM_NOT_FOUND"),
+        ):
+            with pytest.raises(WebhookError) as error:
+                manager.register_webhook(*args)
+            assert error.value.error_code == code
+
+        disabled = RoomStateManager("node-a")
+        with pytest.raises(WebhookError) as error:
+            disabled.register_webhook(_room(disabled), "alice", URL, [])
+        assert error.value.error_code == "WEBHOOKS_DISABLED"
+
+    def test_events_delivered_signed(self):
+        """Test that subscribed events are POSTed with a valid signature."""
+        endpoint = Recorder()
+        manager = RoomStateManager("node-a", webhooks=WebhookDispatcher(endpoint))
+        room_id = _room(manager)
+        webhook = manager.register_webhook(room_id, "alice", URL, [])
+        manager.register_webhook(
+            room_id, "alice", f"{URL}/messages", [MESSAGE_POSTED]
+        )
+
+        manager.add_member(room_id, "bob")
+        manager.add_member(room_id, "bob")
+        message = manager.add_message(room_id, "bob", "build passed")
+        manager.remove_member(room_id, "bob")
+        manager.delete_room(room_id)
+
+        assert manager.webhooks.deliver_due() == 5
+        to_all = [r for r in endpoint.requests if r[0] == URL]
+        assert [payload["event"] for _, payload, _, _ in to_all] == [
+            MEMBER_JOINED,
+            MESSAGE_POSTED,
+            MEMBER_LEFT,
+            ROOM_DELETED,
+        ]
+        _, payload, headers, body = to_all[1]
+        expected = hmac.new(
+            webhook["secret"].encode(), body, hashlib.sha256
+        ).hexdigest()
+        assert headers[SIGNATURE_HEADER] == f"sha256={expected}"
+        assert payload["room_id"] == room_id
+        assert payload["data"]["message_id"] == message["message_id"]
+        assert to_all[0][1]["data"] == {"username": "bob", "member_count": 2}
+        assert manager.webhooks.pending() == 0
+
+    def test_retries_with_backoff(self):
+        """Test that failed deliveries are retried later, then dropped."""
+        clock = Clock()
+        endpoint = Recorder(500, OSError("refused"), 200, 500, 500, 500)
+        dispatcher = WebhookDispatcher(
+            endpoint, max_retries=2, backoff=2.0, clock=clock
+        )
+        webhook = create_webhook("room-1", URL, [], "alice")
+
+        dispatcher.enqueue([webhook], MESSAGE_POSTED, "room-1", {"n": 1})
+        assert dispatcher.deliver_due() == 0
+        assert dispatcher.deliver_due() == 0  # not due yet
+        clock.now += 2
+        assert dispatcher.deliver_due() == 0  # second failure
+        clock.now += 3
+        assert dispatcher.deliver_due() == 0  # backoff doubled to 4s
+        clock.now += 1
+        assert dispatcher.deliver_due() == 1
+        assert len(endpoint.requests) == 3
+        assert len({r[2]["X-Chat-Delivery"] for r in endpoint.requests}) == 1
+
+        dispatcher.enqueue([webhook], MEMBER_LEFT, "room-1", {})
+        for _ in range(3):
+            dispatcher.deliver_due()
+            clock.now += 10
+        assert dispatcher.pending() == 0
+        assert len(endpoint.requests) == 6
+
+    def test_internal_targets_refused(self):
+        """Test deliveries to internal addresses failed without a request."""
+        clock = Clock()
+        dispatcher = WebhookDispatcher(clock=clock)
+        webhooks = [
+            create_webhook("room-1", url, [], "alice")
+            for url in (
+                "http://127.0.0.1:8080/hooks",
+                "http://169.254.169.254/latest/meta-data",
+                "https://localhost/hooks",
+            )
+        ]
+
+        with patch("socket.socket") as sock:
+            dispatcher.enqueue(webhooks, MESSAGE_POSTED, "room-1", {"n": 1})
+            assert dispatcher.deliver_due() == 0
+        assert dispatcher.pending() == 3
+        sock.assert_not_called()
+
+    def test_removed_webhook_stops_delivering(self):
+        """Test that removing a webhook drops its waiting deliveries."""
+        endpoint = Recorder()
+        manager = RoomStateManager("node-a", webhooks=WebhookDispatcher(endpoint))
+        room_id = _room(manager)
+        webhook_id = manager.register_webhook(room_id, "alice", URL, [])[
+            "webhook_id"
+        ]
+        manager.add_message(room_id, "alice", "hello")
+
+        manager.remove_webhook(room_id, "alice", webhook_id)
+        manager.add_message(room_id, "alice", "again")
+
+        assert manager.webhooks.deliver_due() == 0
+        assert manager.list_webhooks(room_id, "alice") == []
+        with pytest.raises(WebhookError) as error:
+            manager.remove_webhook(room_id, "alice", webhook_id)
+        assert error.value.error_code == "WEBHOOK_NOT_FOUND"
+
+    def test_webhooks_survive_restart_and_snapshot(self, tmp_path):
+        """Test that webhooks are recovered from the log and snapshotted."""
+        manager = RoomStateManager(
+            "node-a", MessageLog(str(tmp_path)), WebhookDispatcher()
+        )
+        room_id = _room(manager)
+        kept = manager.register_webhook(room_id, "alice", URL, [])
+        removed = manager.register_webhook(room_id, "alice", f"{URL}/2", [])
+        manager.remove_webhook(room_id, "alice", removed["webhook_id"])
+
+        recovered = RoomStateManager(
+            "node-a", MessageLog(str(tmp_path)), WebhookDispatcher()
+        )
+        recovered.recover_rooms()
+        snapshot = RoomSnapshot.from_room(recovered, room_id)
+        receiver = RoomStateManager("node-b", webhooks=WebhookDispatcher())
+        receiver.restore_room(**snapshot.restore_args())
+
+        assert recovered.get_room(room_id).webhooks == {
+            kept["webhook_id"]: kept
+        }
+        listed = receiver.list_webhooks(room_id, "alice")
+        assert [w["webhook_id"] for w in listed] == [kept["webhook_id"]]
+        assert "secret" not in listed[0]
+
+
+class TestWebhookCommands:
+    """Tests for the webhook commands."""
+
+    @pytest.mark.asyncio
+    async def test_local_commands(self):
+        """Test register, list and remove on the admin node."""
+        manager = RoomStateManager("node-a", webhooks=WebhookDispatcher())
+        room_id = _room(manager)
+        ws_server = WebSocketServer(manager, "localhost", 0)
+        alice = _join(ws_server, room_id, "alice")
+
+        registered = await _request(
+            ws_server,
+            alice,
+            "register_webhook",
+            room_id=room_id,
+            username="alice",
+            url=URL,
+            events=[MESSAGE_POSTED],
+        )
+        webhook_id = registered["data"]["webhook"]["webhook_id"]
+        listed = await _request(
+            ws_server, alice, "list_webhooks", room_id=room_id, username="alice"
+        )
+        removed = await _request(
+            ws_server,
+            alice,
+            "remove_webhook",
+            room_id=room_id,
+            username="alice",
+            webhook_id=webhook_id,
+        )
+        refused = await _request(
+            ws_server,
+            alice,
+            "register_webhook",
+            room_id=room_id,
+            username="alice",
+            url="not a url",
+        )
+
+        assert registered["type"] == "webhook_registered"
+        assert registered["data"]["webhook"]["secret"]
+        assert listed["type"] == "webhooks"
+        assert listed["data"]["webhooks"][0]["url"] == URL
+        assert "secret" not in listed["data"]["webhooks"][0]
+        assert removed["type"] == "webhook_removed"
+        assert removed["data"]["webhook_id"] == webhook_id
+        assert refused["type"] == "webhook_error"
+        assert refused["data"]["request_type"] == "register_webhook"
+        assert refused["data"]["error_code"] == "INVALID_URL"
+
+    @pytest.mark.asyncio
+    async def test_register_through_admin(self):
+        """Test that another node forwards webhook commands to the admin."""
+        admin = RoomStateManager("node-a", webhooks=WebhookDispatcher())
+        room_id = _room(admin)
+        admin.add_member(room_id, "bob", "node-b")
+        admin_rpc = XMLRPCServer(admin, "localhost", 0, "http://node-a:9090")
+        directory_a = RoomDirectory("node-a", "http://node-a:9090")
+        directory_a.update_local(admin.list_rooms())
+        directory_b = RoomDirectory("node-b", "http://node-b:9090")
+        directory_b.merge(directory_a.get_entries())
+        ws_b = WebSocketServer(
+            RoomStateManager("node-b"),
+            "localhost",
+            0,
+            peer_registry=object(),
+            room_directory=directory_b,
+        )
+        alice = _join(ws_b, room_id, "alice")
+        bob = _join(ws_b, room_id, "bob")
+
+        with patch(
+            "src.node.websocket_server.ServerProxy",
+            lambda address, allow_none=True: admin_rpc,
+        ):
+            registered = await _request(
+                ws_b,
+                alice,
+                "register_webhook",
+                room_id=room_id,
+                username="alice",
+                url=URL,
+            )
+            refused = await _request(
+                ws_b, bob, "list_webhooks", room_id=room_id, username="bob"
+            )
+
+        assert registered["type"] == "webhook_registered"
+        assert admin.list_webhooks(room_id, "alice")[0]["url"] == URL
+        assert refused["type"] == "webhook_error"
+        assert refused["data"]["error_code"] == "NOT_ALLOWED"
@@ -0,0 +1,141 @@
+"""
+Tests for WebSocket Connection Registry and Message Dispatch
+
+Tests for client connection tracking and the handler table used to
+dispatch client messages.
+"""
+
+import json
+import pytest
+from src.node import (
+    RoomStateManager,
+    WebSocketServer,
+    ConnectionRegistry,
+)
+
+
+class MockWebSocket:
+    """Mock WebSocket for testing."""
+
+    def __init__(self, remote_address=None):
+        self.sent_messages = []
+        self.remote_address = remote_address
+
+    async def send(self, message):
+        self.sent_messages.append(message)
+
+
+# ===== Connection Registry Tests =====
+
+
+def test_registry_register_and_get():
+    """Test registering a connection assigns an ID and metadata."""
+    registry = ConnectionRegistry()
+    ws = MockWebSocket(remote_address=("127.0.0.1", 5555))
+
+    connection = registry.register(ws)
+
+    assert connection.client_id
+    assert connection.remote_address == "127.0.0.1:5555"
+    assert connection.connected_at
+    assert registry.get(ws) is connection
+    assert registry.get_by_id(connection.client_id) is connection
+    assert ws in registry
+    assert len(registry) == 1
+
+
+def test_registry_unregister():
+    """Test unregistering removes the connection."""
+    registry = ConnectionRegistry()
+    ws = MockWebSocket()
+    registry.register(ws)
+
+    removed = registry.unregister(ws)
+
+    assert removed is not None
+    assert ws not in registry
+    assert registry.unregister(ws) is None
+
+
+def test_registry_find_by_username():
+    """Test looking up connections by username."""
+    registry = ConnectionRegistry()
+    ws1 = MockWebSocket()
+    ws2 = MockWebSocket()
+    registry.register(ws1)
+    registry.register(ws2)
+
+    registry.set_username(ws1, "alice")
+
+    matches = registry.find_by_username("alice")
+    assert len(matches) == 1
+    assert matches[0].websocket is ws1
+    assert registry.find_by_username("bob") == []
+
+
+def test_register_client_room_membership_records_username():
+    """Test joining a room records the username on the connection."""
+    manager = RoomStateManager(node_id="test_node")
+    ws_server = WebSocketServer(manager, "localhost", 9000)
+    ws = MockWebSocket()
+    ws_server.connections.register(ws)
+
+    ws_server.register_client_room_membership(ws, "room-1", "alice")
+
+    assert ws_server.connections.get(ws).username == "alice"
+
+
+# ===== Dispatch Tests =====
+
+
+def test_default_handlers_registered():
+    """Test that built-in message types have handlers."""
+    manager = RoomStateManager(node_id="test_node")
+    ws_server = WebSocketServer(manager, "localhost", 9000)
+
+    for message_type in [
+        "list_rooms",
+        "create_room",
+        "discover_rooms",
+        "join_room",
+        "leave_room",
+        "send_message",
+        "delete_room",
+    ]:
+        assert message_type in ws_server._handlers
+
+
+@pytest.mark.asyncio
+async def test_custom_handler_dispatch():
+    """Test that a registered handler receives matching messages."""
+    manager = RoomStateManager(node_id="test_node")
+    ws_server = WebSocketServer(manager, "localhost", 9000)
+    received = []
+
+    async def handle_ping(websocket, data):
+        received.append(data)
+        await websocket.send(json.dumps({"type": "pong"}))
+
+    ws_server.register_handler("ping", handle_ping)
+
+    ws = MockWebSocket()
+    await ws_server.process_message(
+        ws, json.dumps({"type": "ping", "data": {"n": 1}})
+    )
+
+    assert received == [{"type": "ping", "data": {"n": 1}}]
+    assert json.loads(ws.sent_messages[0])["type"] == "pong"
+
+
+@pytest.mark.asyncio
+async def test_unknown_message_type_returns_error():
+    """Test that unknown message types produce an error response."""
+    manager = RoomStateManager(node_id="test_node")
+    ws_server = WebSocketServer(manager, "localhost", 9000)
+    ws = MockWebSocket()
+
+    await ws_server.process_message(ws, json.dumps({"type": "bogus"}))
+
+    response = json.loads(ws.sent_messages[0])
+    assert response["type"] == "error"
+    assert "bogus" in response["data"]["message"]